@@ -14,6 +14,7 @@ if [ $# -eq 0 ]; then
     echo "      Build the target. If no target is specified, build all targets."
     echo "      Available targets:"
     echo "        cli - build the CLI as \`./cling-sync\`"
+    echo "        cli-ui - build the CLI with the web UI of \`serve --ui\`"
     echo "        wasm - build the wasm binary"
     echo
     echo "  release check|tag|build|upload|all"
@@ -53,7 +54,7 @@ if [ $# -eq 0 ]; then
     exit 1
 fi
 
-projects="lib workspace http cli wasm test"
+projects="lib workspace http rclone cli clingsync wasm test"
 
 # Per-platform tool cache (<os>-<arch>, matching Go's GOOS-GOARCH so the protoc
 # test helpers resolve it).
@@ -113,9 +114,16 @@ run_build() {
     fi
     for target in $targets; do
         case "$target" in
-            cli)
+            cli|cli-ui)
+                local tags=""
+                if [ "$target" = "cli-ui" ]; then
+                    # Embed the Wasm module for `serve --ui`.
+                    bash wasm/build.sh build
+                    cp wasm/build/main.wasm wasm/build/wasm_exec.js cli/ui/
+                    tags="-tags ui"
+                fi
                 echo ">>> Building CLI ($(go env GOOS)/$(go env GOARCH))"
-                go build "$@" -o cling-sync ./cli
+                go build $tags "$@" -o cling-sync ./cli
                 if [ -n "${CS_DARWIN_CODESIGN:-}" ] && [ "$(uname -s)" = "Darwin" ] && [ "$(go env GOOS)" = "darwin" ]; then
                     echo "Codesigning CLI"
                     codesign --sign "${CS_DARWIN_CODESIGN}" --force --options runtime ./cling-sync
@@ -2,7 +2,9 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"encoding/hex"
@@ -10,36 +12,112 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/flunderpero/cling-sync/cli/keychain"
 	clingHTTP "github.com/flunderpero/cling-sync/http"
 	"github.com/flunderpero/cling-sync/lib"
+	"github.com/flunderpero/cling-sync/rclone"
 	ws "github.com/flunderpero/cling-sync/workspace"
 	"golang.org/x/term"
 )
 
 const (
-	appName                   = "cling-sync"
-	fastScanFlagDescription   = "Speed up scanning by skipping file hash comparisons.\nFile changes are detected by trusting file metadata (size, ctime, inode).\nWARNING: May miss some changes, especially on network or FUSE file-systems.\nWhen in doubt, run without this flag for thorough verification."
-	repositoryFlagDescription = "Use this repository (local path or s3+... URI) instead of the workspace repository"
-	pathPrefixFlagDescription = "Use this path prefix instead of the workspace's, e.g. `dir/`.\nUse `/` to ignore the workspace prefix and operate on the whole repository from its root."
+	appName                        = "cling-sync"
+	fastScanFlagDescription        = "Speed up scanning by skipping file hash comparisons.\nFile changes are detected by trusting file metadata (size, ctime, inode).\nWARNING: May miss some changes, especially on network or FUSE file-systems.\nWhen in doubt, run without this flag for thorough verification."
+	jsonProgressFlagDescription    = "Print the progress as JSON lines to stderr instead of a progress bar"
+	jsonFlagDescription            = "Print one JSON object per line instead of the human readable output"
+	useWatchJournalFlagDescription = "Only scan directories that changed according to a running \"watch --journal-only\".\nImplies --fast-scan."
+	repositoryFlagDescription      = "Use this repository (local path, s3+... or rclone://... URI) instead of the workspace repository"
+	unsupportedFlagDescription     = "What to do with sockets, FIFOs, and device nodes, which cannot be archived:\n`skip` them silently, `warn` about each of them, or `fail`"
+	failOnIgnoredFlagDescription   = "Exit with code 3 if any path was skipped or an error was ignored"
+	noRepoIgnoreFlagDescription    = "Do not respect .gitignore and .clingignore files,\nsync the ignored paths like all others"
+	waitFlagDescription            = "Wait for another cling-sync command running in this workspace to finish"
+	noWaitFlagDescription          = "Fail right away if another cling-sync command is running in this workspace (default)"
+	maxMemoryFlagDescription       = "Memory for the caches of the revisions compared by a merge, e.g. `512MiB`.\nThe caches grow as long as there is memory left and spill to disk otherwise.\nWithout it, each cache keeps a fixed number of chunks in memory."
+	hardlinkDupesFlagDescription   = "Restore files with the same content and metadata as hard links of each other.\nHard links of the workspace are always restored as hard links."
+	xattrsFlagDescription          = "Include extended attributes (and POSIX ACLs on Linux)"
+	messageFlagDescription         = "Commit message, {hostname}, {date}, and {time} are replaced"
+	includeFlagDescription         = "Include paths matching the given pattern even if they match an --exclude pattern\n(can be used multiple times), like a negated (!) pattern in a .gitignore file"
+	pathPrefixFlagDescription      = "Use this path prefix instead of the workspace's, e.g. `dir/`.\nUse `/` to ignore the workspace prefix and operate on the whole repository from its root."
 )
 
 // version is "dev" for normal builds and set to the release tag via -ldflags.
 var version = "dev"
 
+// errIgnoredPaths is returned with `--fail-on-ignored` if a command completed,
+// but skipped paths or ignored errors on the way. `run` exits with
+// `exitCodeIgnored` instead of 1 then.
+var errIgnoredPaths = lib.Errorf("some paths were skipped or failed")
+
+// Set by the global `--encrypt-temp-files` flag, see `tempDirFS`.
+var encryptTempFiles bool //nolint:gochecknoglobals
+
+// Turns on `--encrypt-temp-files` if set to anything but an empty string.
+const encryptTempFilesEnv = "CLING_SYNC_ENCRYPT_TEMP_FILES"
+
+// Set by the global `--encrypt-cache` flag, see `ws.Workspace.EncryptCache`.
+var encryptCache bool //nolint:gochecknoglobals
+
+// Turns on `--encrypt-cache` if set to anything but an empty string.
+const encryptCacheEnv = "CLING_SYNC_ENCRYPT_CACHE"
+
+// The exit codes of a failed command, see "Exit codes" in the README.
+// Exit code 2 is used by the flag package for invalid flags.
+const (
+	exitCodeError      = 1
+	exitCodeIgnored    = 3
+	exitCodeConflict   = 4
+	exitCodeAuth       = 5
+	exitCodeCorrupt    = 6
+	exitCodeContention = 7
+	exitCodeNetwork    = 8
+	exitCodeQuota      = 9
+)
+
+// Return the exit code for `err` by its kind (see `lib.ErrAuth`, ...).
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, errIgnoredPaths):
+		return exitCodeIgnored
+	case errors.Is(err, ws.ErrConflict):
+		return exitCodeConflict
+	case errors.Is(err, lib.ErrAuth):
+		return exitCodeAuth
+	case errors.Is(err, lib.ErrCorrupt):
+		return exitCodeCorrupt
+	case errors.Is(err, lib.ErrContention):
+		return exitCodeContention
+	case errors.Is(err, lib.ErrNetwork):
+		return exitCodeNetwork
+	case errors.Is(err, lib.ErrQuotaExceeded):
+		return exitCodeQuota
+	default:
+		return exitCodeError
+	}
+}
+
 func AttachCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
 	args := struct { //nolint:exhaustruct
 		Help          bool
 		PathPrefix    string
 		AllowNonEmpty bool
+		RecoveryCode  bool
 	}{}
 	flags := flag.NewFlagSet("attach", flag.ExitOnError)
 	flags.BoolVar(&args.Help, "help", false, "Show help message")
@@ -50,6 +128,14 @@ func AttachCmd(ctx context.Context, argv []string, passphraseFromStdin bool) err
 		false,
 		"Allow attaching to a directory that already contains files.\nExisting files matching the repository by content are adopted as-is;\nfiles at the same path with different content become merge conflicts;\nfiles not present in the repository are committed as new additions\non the next merge.",
 	)
+	flags.BoolVar(
+		&args.RecoveryCode,
+		"recovery-code",
+		false,
+		"The passphrase was lost: set a new one using the repository's recovery code\n"+
+			"(see `security export-recovery-code`) before attaching.\n"+
+			"With --passphrase-from-stdin the first line of stdin is the recovery code.",
+	)
 	flags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s attach <repository-uri> <directory>\n\n", appName)
 		fmt.Fprint(os.Stderr, "Attach a local directory to a repository.\n")
@@ -63,8 +149,8 @@ func AttachCmd(ctx context.Context, argv []string, passphraseFromStdin bool) err
 		fmt.Fprint(os.Stderr, "\nFlags:\n")
 		flags.PrintDefaults()
 	}
-	if err := flags.Parse(argv); err != nil {
-		return err //nolint:wrapcheck
+	if err := parseFlags(flags, argv); err != nil {
+		return err
 	}
 	if args.Help {
 		flags.Usage()
@@ -98,28 +184,42 @@ func AttachCmd(ctx context.Context, argv []string, passphraseFromStdin bool) err
 			)
 		}
 	}
-	repositoryURI := flags.Arg(0)
-	if err := clingHTTP.RejectBareHTTPURI(repositoryURI); err != nil {
-		return err //nolint:wrapcheck
-	}
-	passphrase, err := readPassphrase(passphraseFromStdin)
+	repositoryURI, err := resolveRepositoryAlias(flags.Arg(0))
 	if err != nil {
 		return err
 	}
-	storage, resolvedURI, err := openStorage(repositoryURI, passphrase, passphraseFromStdin)
-	if err != nil {
-		return err
+	if err := clingHTTP.RejectBareHTTPURI(repositoryURI); err != nil {
+		return err //nolint:wrapcheck
 	}
-	repository, err := lib.OpenRepository(ctx, storage, passphrase)
-	if err != nil {
-		return lib.WrapErrorf(err, "failed to open repository")
+	var repository *lib.Repository
+	var resolvedURI string
+	if args.RecoveryCode {
+		repository, resolvedURI, err = resetPassphrase(ctx, repositoryURI, false, passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	} else {
+		passphrase, err := readPassphrase(passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+		var storage lib.Storage
+		storage, resolvedURI, err = openStorage(repositoryURI, passphrase, passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+		repository, err = lib.OpenRepository(ctx, storage, passphrase)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open repository")
+		}
 	}
+	repositoryConfig := repository.Config()
 	repository.Close() //nolint:errcheck,gosec
 	repositoryURI = resolvedURI
 	// We know the repository exists, so let's create the workspace.
-	tmpDir, err := os.MkdirTemp(os.TempDir(), "cling-sync-workspace")
+	tmpFS, err := newWorkspaceTempFS()
 	if err != nil {
-		return lib.WrapErrorf(err, "failed to create temporary directory")
+		return err
 	}
 	pathPrefix, err := parsePathPrefix(args.PathPrefix, lib.Path{})
 	if err != nil {
@@ -128,14 +228,17 @@ func AttachCmd(ctx context.Context, argv []string, passphraseFromStdin bool) err
 	workspace, err := ws.NewWorkspace(
 		ctx,
 		lib.NewRealFS(localPath),
-		lib.NewRealFS(tmpDir),
+		tmpFS,
 		ws.RemoteRepository(repositoryURI),
 		pathPrefix,
 	)
 	if err != nil {
 		return lib.WrapErrorf(err, "failed to create workspace")
 	}
-	workspace.Close() //nolint:errcheck,gosec
+	defer workspace.Close() //nolint:errcheck
+	if err := workspace.MirrorRepositoryConfig(ctx, repositoryConfig); err != nil {
+		return err //nolint:wrapcheck
+	}
 	fmt.Printf("Attached %s to %s\n", localPath, repositoryURI)
 	return nil
 }
@@ -144,143 +247,374 @@ func InitCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error
 	args := struct { //nolint:exhaustruct
 		Help                bool
 		AllowWeakPassphrase bool
+		Wizard              bool
+		RecoveryCode        bool
+		Chunking            string
+		ChunkSize           int
+		MinChunkSize        int
+		AvgChunkSize        int
+		MaxChunkSize        int
 	}{}
 	flags := flag.NewFlagSet("init", flag.ExitOnError)
 	flags.BoolVar(&args.Help, "help", false, "Show help message")
 	flags.BoolVar(&args.AllowWeakPassphrase, "allow-weak-passphrase", false, "Allow weak passphrase (not recommended)")
+	flags.BoolVar(
+		&args.Wizard,
+		"wizard",
+		false,
+		"Interactively walk through creating a repository and attaching a workspace",
+	)
+	flags.BoolVar(
+		&args.RecoveryCode,
+		"recovery-code",
+		false,
+		"Set a new passphrase for the existing repository at <repository-path>\n"+
+			"using its recovery code (see `security export-recovery-code`).\n"+
+			"With --passphrase-from-stdin the first line of stdin is the recovery code.",
+	)
+	defaultChunking := lib.DefaultChunkingPolicy()
+	flags.StringVar(
+		&args.Chunking,
+		"chunking",
+		string(lib.ChunkingModeGearCDC),
+		"How files are split into blocks: `gear-cdc` (content-defined) or `fixed`.\n"+
+			"All clients use the chunking of the repository, it cannot be changed later.",
+	)
+	byteSizeFlag(
+		flags,
+		"chunk-size",
+		fmt.Sprintf("The chunk size of --chunking fixed (default %d)", lib.DefaultFixedChunkSize),
+		&args.ChunkSize,
+	)
+	byteSizeFlag(
+		flags,
+		"min-chunk-size",
+		fmt.Sprintf("The minimum chunk size of --chunking gear-cdc (default %d)", defaultChunking.MinSize),
+		&args.MinChunkSize,
+	)
+	byteSizeFlag(
+		flags,
+		"avg-chunk-size",
+		fmt.Sprintf(
+			"The average chunk size of --chunking gear-cdc, must be a power of two (default %d)",
+			defaultChunking.AvgSize,
+		),
+		&args.AvgChunkSize,
+	)
+	byteSizeFlag(
+		flags,
+		"max-chunk-size",
+		fmt.Sprintf("The maximum chunk size of --chunking gear-cdc (default %d)", defaultChunking.MaxSize),
+		&args.MaxChunkSize,
+	)
 	flags.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s init <repository-path>\n\n", appName)
+		fmt.Fprintf(os.Stderr, "Usage: %s init <repository-path>\n", appName)
+		fmt.Fprintf(os.Stderr, "       %s init --recovery-code <repository-path>\n", appName)
+		fmt.Fprintf(os.Stderr, "       %s init --wizard\n\n", appName)
 		fmt.Fprint(os.Stderr, "Create and initialize a new local repository.\n")
 		fmt.Fprint(os.Stderr, "\nArguments:\n")
 		fmt.Fprint(os.Stderr, "  repository-path\n")
 		fmt.Fprint(os.Stderr, "        The repository will be created at this path.\n")
 		fmt.Fprint(os.Stderr, "        The directory must not exist or must be empty.\n")
+		fmt.Fprint(os.Stderr, "        With --recovery-code, the repository must exist.\n")
 		fmt.Fprint(os.Stderr, "\nFlags:\n")
 		flags.PrintDefaults()
 	}
-	if err := flags.Parse(argv); err != nil {
-		return err //nolint:wrapcheck
+	if err := parseFlags(flags, argv); err != nil {
+		return err
 	}
 	if args.Help {
 		flags.Usage()
 		return nil
 	}
+	if args.Wizard {
+		if len(flags.Args()) != 0 {
+			return lib.Errorf("--wizard does not take positional arguments")
+		}
+		if passphraseFromStdin || !IsTerm(os.Stdin) {
+			return lib.Errorf("--wizard can only be used in an interactive terminal session")
+		}
+		return newInitWizard(os.Stdin, os.Stderr, readTermPassword).Run(ctx)
+	}
 	if len(flags.Args()) != 1 {
 		return lib.Errorf("one positional argument is required: <repository-path>")
 	}
+	if args.RecoveryCode {
+		return resetPassphraseCmd(ctx, flags.Arg(0), args.AllowWeakPassphrase, passphraseFromStdin)
+	}
 	if !IsTerm(os.Stdin) && !passphraseFromStdin {
 		return lib.Errorf(
 			"a new repository can only be created in an interactive terminal session or --passphrase-from-stdin must be used",
 		)
 	}
+	opts := lib.DefaultRepositoryOptions()
+	switch lib.ChunkingMode(args.Chunking) {
+	case lib.ChunkingModeGearCDC:
+		if args.ChunkSize != 0 {
+			return lib.Errorf("--chunk-size requires --chunking fixed")
+		}
+		if args.MinChunkSize != 0 {
+			opts.Chunking.MinSize = args.MinChunkSize
+		}
+		if args.AvgChunkSize != 0 {
+			opts.Chunking.AvgSize = args.AvgChunkSize
+		}
+		if args.MaxChunkSize != 0 {
+			opts.Chunking.MaxSize = args.MaxChunkSize
+		}
+	case lib.ChunkingModeFixed:
+		if args.MinChunkSize != 0 || args.AvgChunkSize != 0 || args.MaxChunkSize != 0 {
+			return lib.Errorf("--min-chunk-size, --avg-chunk-size, and --max-chunk-size require --chunking gear-cdc")
+		}
+		opts.Chunking = lib.NewFixedChunkingPolicy(lib.DefaultFixedChunkSize)
+		if args.ChunkSize != 0 {
+			opts.Chunking.MaxSize = args.ChunkSize
+		}
+	default:
+		return lib.Errorf("invalid --chunking %q, must be `gear-cdc` or `fixed`", args.Chunking)
+	}
+	if err := opts.Chunking.Validate(); err != nil {
+		return lib.WrapErrorf(err, "invalid chunking")
+	}
+	passphrase, err := readNewPassphrase(passphraseFromStdin, args.AllowWeakPassphrase)
+	if err != nil {
+		return err
+	}
+	storage, repositoryURI, err := newRepositoryStorage(flags.Arg(0), passphrase, passphraseFromStdin)
+	if err != nil {
+		return err
+	}
+	repository, err := lib.InitNewRepositoryWithOptions(ctx, storage, passphrase, opts)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to initialize repository")
+	}
+	repository.Close() //nolint:errcheck,gosec
+	tmpFS, err := newWorkspaceTempFS()
+	if err != nil {
+		return err
+	}
+	workspace, err := ws.NewWorkspace(
+		ctx,
+		lib.NewRealFS("."),
+		tmpFS,
+		ws.RemoteRepository(repositoryURI),
+		lib.Path{},
+	)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to create workspace")
+	}
+	workspace.Close() //nolint:errcheck,gosec
+	return nil
+}
+
+// readNewPassphrase reads a passphrase that is about to be set and checks its
+// strength. In a terminal, the passphrase has to be entered twice.
+func readNewPassphrase(passphraseFromStdin, allowWeakPassphrase bool) ([]byte, error) {
 	var passphrase []byte
 	if passphraseFromStdin {
 		var err error
 		passphrase, err = io.ReadAll(os.Stdin)
 		if err != nil {
-			return lib.WrapErrorf(err, "failed to read passphrase from stdin")
+			return nil, lib.WrapErrorf(err, "failed to read passphrase from stdin")
 		}
 	} else {
 		_, err := fmt.Fprint(os.Stderr, "Enter passphrase: ")
 		if err != nil {
-			return err //nolint:wrapcheck
+			return nil, err //nolint:wrapcheck
 		}
 		passphrase, err = term.ReadPassword(int(os.Stdin.Fd())) //nolint:gosec
 		if err != nil {
-			return lib.WrapErrorf(err, "failed to read passphrase")
+			return nil, lib.WrapErrorf(err, "failed to read passphrase")
 		}
 		_, _ = fmt.Fprintln(os.Stdout)
 	}
 	if err := lib.CheckPassphraseStrength(passphrase); err != nil {
-		if args.AllowWeakPassphrase {
+		if allowWeakPassphrase {
 			fmt.Fprintf(os.Stderr, "\nWarning: %s\n", err.Error())
 		} else {
-			return err //nolint:wrapcheck
+			return nil, err //nolint:wrapcheck
 		}
 	}
 	if !passphraseFromStdin {
 		_, err := fmt.Fprint(os.Stdout, "Repeat passphrase: ")
 		if err != nil {
-			return err //nolint:wrapcheck
+			return nil, err //nolint:wrapcheck
 		}
 		passphraseRepeat, err := term.ReadPassword(int(os.Stdin.Fd())) //nolint:gosec
 		if err != nil {
-			return lib.WrapErrorf(err, "failed to read passphrase")
+			return nil, lib.WrapErrorf(err, "failed to read passphrase")
 		}
 		if string(passphrase) != string(passphraseRepeat) {
-			return lib.Errorf("passphrases do not match")
+			return nil, lib.Errorf("passphrases do not match")
 		}
 	}
-	rawTarget := flags.Arg(0)
-	if err := clingHTTP.RejectBareHTTPURI(rawTarget); err != nil {
-		return err //nolint:wrapcheck
-	}
-	var (
-		repositoryURI string
-		storage       lib.Storage
-	)
-	if clingHTTP.IsS3StorageURI(rawTarget) {
-		encryptedURI, err := resolveS3URI(rawTarget, passphrase, passphraseFromStdin)
+	return passphrase, nil
+}
+
+// readRecoveryCode reads the recovery code from the terminal or, with
+// `--passphrase-from-stdin`, from the first line of stdin. In the latter case
+// the rest of stdin is left for the passphrase.
+func readRecoveryCode(passphraseFromStdin bool) (string, error) {
+	var code []byte
+	if passphraseFromStdin {
+		var err error
+		code, err = readStdinLine()
 		if err != nil {
-			return err
+			return "", lib.WrapErrorf(err, "failed to read recovery code from stdin")
 		}
-		cfg, _, err := clingHTTP.DecodeS3URI(encryptedURI, passphrase)
+	} else {
+		_, err := fmt.Fprint(os.Stderr, "Enter recovery code: ")
 		if err != nil {
-			return lib.WrapErrorf(err, "failed to decode S3 URI")
+			return "", err //nolint:wrapcheck
 		}
-		storage = clingHTTP.NewS3StorageClient(cfg, clingHTTP.NewDefaultHTTPClient(nil))
-		repositoryURI = encryptedURI
-	} else {
-		repositoryPath, err := filepath.Abs(rawTarget)
+		code, err = term.ReadPassword(int(os.Stdin.Fd())) //nolint:gosec
 		if err != nil {
-			return lib.WrapErrorf(err, "failed to get absolute path for %s", rawTarget)
+			return "", lib.WrapErrorf(err, "failed to read recovery code")
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+	normalized := strings.ToUpper(strings.Join(strings.Fields(string(code)), ""))
+	clear(code)
+	return normalized, nil
+}
+
+// readStdinLine reads the first line of stdin without the line break.
+// Read byte by byte, buffering would swallow what follows.
+func readStdinLine() ([]byte, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if n == 1 && b[0] == '\n' || errors.Is(err, io.EOF) {
+			return line, nil
 		}
-		stat, err := os.Stat(repositoryPath)
 		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				if err := os.MkdirAll(repositoryPath, 0o700); err != nil {
-					return lib.WrapErrorf(err, "failed to create directory %s", repositoryPath)
-				}
-			} else {
-				return lib.WrapErrorf(err, "failed to stat %s", repositoryPath)
-			}
-		} else if !stat.IsDir() {
-			return lib.Errorf("%s is not a directory", repositoryPath)
+			return nil, err //nolint:wrapcheck
+		}
+		line = append(line, b[:n]...)
+	}
+}
+
+// resetPassphraseCmd sets a new passphrase for the existing repository at
+// `uri` using the recovery code.
+func resetPassphraseCmd(ctx context.Context, uri string, allowWeakPassphrase, passphraseFromStdin bool) error {
+	repository, uri, err := resetPassphrase(ctx, uri, allowWeakPassphrase, passphraseFromStdin)
+	if err != nil {
+		return err
+	}
+	repository.Close() //nolint:errcheck,gosec
+	fmt.Printf("The passphrase of %s was reset\n", uri)
+	return nil
+}
+
+// resetPassphrase reads the recovery code and the new passphrase and resets
+// the passphrase of the repository at `uri`. The returned URI is the one to
+// record in the workspace config.
+func resetPassphrase(
+	ctx context.Context,
+	uri string,
+	allowWeakPassphrase bool,
+	passphraseFromStdin bool,
+) (*lib.Repository, string, error) {
+	if !IsTerm(os.Stdin) && !passphraseFromStdin {
+		return nil, "", lib.Errorf(
+			"the passphrase can only be reset in an interactive terminal session or --passphrase-from-stdin must be used",
+		)
+	}
+	code, err := readRecoveryCode(passphraseFromStdin)
+	if err != nil {
+		return nil, "", err
+	}
+	passphrase, err := readNewPassphrase(passphraseFromStdin, allowWeakPassphrase)
+	if err != nil {
+		return nil, "", err
+	}
+	storage, resolvedURI, err := openStorage(uri, passphrase, passphraseFromStdin)
+	if err != nil {
+		return nil, "", err
+	}
+	repository, err := lib.ResetPassphrase(ctx, storage, code, passphrase)
+	if err != nil {
+		return nil, "", lib.WrapErrorf(err, "failed to reset passphrase")
+	}
+	return repository, resolvedURI, nil
+}
+
+// newRepositoryStorage prepares the storage for a new repository at
+// `rawTarget`, which is either a local directory (that must not exist or be
+// empty) or an S3 URI. It returns the storage and the URI to record in the
+// workspace config.
+func newRepositoryStorage( //nolint:ireturn
+	rawTarget string,
+	passphrase []byte,
+	passphraseFromStdin bool,
+) (lib.Storage, string, error) {
+	rawTarget, err := resolveRepositoryAlias(rawTarget)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := clingHTTP.RejectBareHTTPURI(rawTarget); err != nil {
+		return nil, "", err //nolint:wrapcheck
+	}
+	if clingHTTP.IsS3StorageURI(rawTarget) {
+		encryptedURI, err := resolveS3URI(rawTarget, passphrase, passphraseFromStdin)
+		if err != nil {
+			return nil, "", err
 		}
-		files, err := os.ReadDir(repositoryPath)
+		cfg, _, err := clingHTTP.DecodeS3URI(encryptedURI, passphrase)
 		if err != nil {
-			return lib.WrapErrorf(err, "failed to read directory %s", repositoryPath)
+			return nil, "", lib.WrapErrorf(err, "failed to decode S3 URI")
 		}
-		if len(files) > 0 {
-			return lib.Errorf("directory %s is not empty", repositoryPath)
+		client, err := clingHTTP.NewDefaultHTTPClientFromEnv()
+		if err != nil {
+			return nil, "", err //nolint:wrapcheck
 		}
-		storage, err = lib.NewFileStorage(lib.NewRealFS(repositoryPath), lib.StoragePurposeRepository)
+		return clingHTTP.NewS3StorageClient(cfg, client), encryptedURI, nil
+	}
+	if rclone.IsStorageURI(rawTarget) {
+		storage, err := rclone.NewStorage(rawTarget)
 		if err != nil {
-			return lib.WrapErrorf(err, "failed to create storage")
+			return nil, "", err //nolint:wrapcheck
 		}
-		repositoryURI = repositoryPath
+		return storage, rawTarget, nil
 	}
-	repository, err := lib.InitNewRepository(ctx, storage, passphrase)
+	repositoryPath, err := prepareLocalRepositoryDir(rawTarget)
 	if err != nil {
-		return lib.WrapErrorf(err, "failed to initialize repository")
+		return nil, "", err
 	}
-	repository.Close() //nolint:errcheck,gosec
-	tmpDir, err := os.MkdirTemp(os.TempDir(), "cling-sync-workspace")
+	storage, err := lib.NewFileStorage(lib.NewRealFS(repositoryPath), lib.StoragePurposeRepository)
 	if err != nil {
-		return lib.WrapErrorf(err, "failed to create temporary directory")
+		return nil, "", lib.WrapErrorf(err, "failed to create storage")
 	}
-	workspace, err := ws.NewWorkspace(
-		ctx,
-		lib.NewRealFS("."),
-		lib.NewRealFS(tmpDir),
-		ws.RemoteRepository(repositoryURI),
-		lib.Path{},
-	)
+	return storage, repositoryPath, nil
+}
+
+// prepareLocalRepositoryDir makes sure `path` is an empty directory, creating
+// it if needed, and returns its absolute path.
+func prepareLocalRepositoryDir(path string) (string, error) {
+	repositoryPath, err := filepath.Abs(path)
 	if err != nil {
-		return lib.WrapErrorf(err, "failed to create workspace")
+		return "", lib.WrapErrorf(err, "failed to get absolute path for %s", path)
 	}
-	workspace.Close() //nolint:errcheck,gosec
-	return nil
+	stat, err := os.Stat(repositoryPath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", lib.WrapErrorf(err, "failed to stat %s", repositoryPath)
+		}
+		if err := os.MkdirAll(repositoryPath, 0o700); err != nil {
+			return "", lib.WrapErrorf(err, "failed to create directory %s", repositoryPath)
+		}
+	} else if !stat.IsDir() {
+		return "", lib.Errorf("%s is not a directory", repositoryPath)
+	}
+	files, err := os.ReadDir(repositoryPath)
+	if err != nil {
+		return "", lib.WrapErrorf(err, "failed to read directory %s", repositoryPath)
+	}
+	if len(files) > 0 {
+		return "", lib.Errorf("directory %s is not empty", repositoryPath)
+	}
+	return repositoryPath, nil
 }
 
 func CatCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
@@ -296,7 +630,7 @@ func CatCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error
 	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
 	flags.BoolVar(&args.Stdout, "stdout", false, "Write to stdout even when it is a terminal (do not page)")
 	flags.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s cat <path>\n\n", appName)
+		fmt.Fprintf(os.Stderr, "Usage: %s cat [--revision <revision>] <path>\n\n", appName)
 		fmt.Fprint(os.Stderr, "Print the contents of a file in the repository.\n")
 		fmt.Fprint(os.Stderr, "When stdout is a terminal, the file is shown in a pager;\n")
 		fmt.Fprint(os.Stderr, "otherwise it is written to stdout.\n")
@@ -306,8 +640,8 @@ func CatCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error
 		fmt.Fprint(os.Stderr, "\nFlags:\n")
 		flags.PrintDefaults()
 	}
-	if err := flags.Parse(argv); err != nil {
-		return err //nolint:wrapcheck
+	if err := parseFlags(flags, argv); err != nil {
+		return err
 	}
 	if args.Help {
 		flags.Usage()
@@ -333,7 +667,7 @@ func CatCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error
 			return lib.WrapErrorf(err, "failed to open workspace")
 		}
 		defer workspace.Close() //nolint:errcheck
-		repository, err = openRepository(ctx, workspace, "", passphraseFromStdin)
+		repository, _, err = openCachedRepository(ctx, workspace, "", passphraseFromStdin, blockCacheRead)
 		if err != nil {
 			return err
 		}
@@ -360,32 +694,41 @@ func CatCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error
 
 func CpCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
 	args := struct { //nolint:exhaustruct
-		Help         bool
-		Revision     string
-		IgnoreErrors bool
-		Verbose      bool
-		NoProgress   bool
-		Overwrite    bool
-		Chown        bool
-		Repository   string
-		PathPrefix   string
-		Exclude      lib.ExtendedGlobPatterns
+		Help          bool
+		Revision      string
+		IgnoreErrors  bool
+		FailOnIgnored bool
+		Verbose       bool
+		NoProgress    bool
+		JSONProgress  bool
+		Overwrite     bool
+		Chown         bool
+		Xattrs        bool
+		HardlinkDupes bool
+		Repository    string
+		PathPrefix    string
+		Wait          bool
+		NoWait        bool
 	}{}
 	flags := flag.NewFlagSet("cp", flag.ExitOnError)
 	flags.BoolVar(&args.Help, "help", false, "Show help message")
 	flags.StringVar(&args.Revision, "revision", "HEAD", "Revision to copy from")
 	flags.BoolVar(&args.IgnoreErrors, "ignore-errors", false, "Ignore errors")
+	flags.BoolVar(&args.FailOnIgnored, "fail-on-ignored", false, failOnIgnoredFlagDescription)
 	flags.BoolVar(&args.Verbose, "verbose", false, "Show progress")
 	flags.BoolVar(&args.NoProgress, "no-progress", false, "Do not show progress")
+	flags.BoolVar(&args.JSONProgress, "json-progress", false, jsonProgressFlagDescription)
 	flags.BoolVar(&args.Chown, "chown", false, "Restore file ownership from the repository.")
+	flags.BoolVar(&args.Xattrs, "xattrs", false, xattrsFlagDescription)
 	flags.BoolVar(&args.Overwrite, "overwrite", false, "Overwrite existing files")
+	flags.BoolVar(&args.HardlinkDupes, "hardlink-dupes", false, hardlinkDupesFlagDescription)
 	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
 	flags.StringVar(&args.PathPrefix, "path-prefix", "", pathPrefixFlagDescription)
-	globPatternFlag(
+	flags.BoolVar(&args.Wait, "wait", false, waitFlagDescription)
+	flags.BoolVar(&args.NoWait, "no-wait", false, noWaitFlagDescription)
+	pathFilterFlags := addPathFilterFlags(
 		flags,
-		"exclude",
 		"Exclude paths matching the given pattern (can be used multiple times).\nThe pattern syntax is the same as for the <pattern> argument.",
-		&args.Exclude,
 	)
 	flags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s cp <pattern> <target>\n\n", appName)
@@ -402,8 +745,8 @@ func CpCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error {
 		fmt.Fprint(os.Stderr, "\n\nFlags:\n")
 		flags.PrintDefaults()
 	}
-	if err := flags.Parse(argv); err != nil {
-		return err //nolint:wrapcheck
+	if err := parseFlags(flags, argv); err != nil {
+		return err
 	}
 	if args.Help {
 		flags.Usage()
@@ -429,7 +772,13 @@ func CpCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error {
 			return lib.WrapErrorf(err, "failed to open workspace")
 		}
 		defer workspace.Close() //nolint:errcheck
-		repository, err = openRepository(ctx, workspace, "", passphraseFromStdin)
+		var unlock func() error
+		unlock, err = lockWorkspace(ctx, workspace, args.Wait, args.NoWait)
+		if err != nil {
+			return err
+		}
+		defer unlock() //nolint:errcheck
+		repository, _, err = openCachedRepository(ctx, workspace, "", passphraseFromStdin, blockCacheRead)
 		if err != nil {
 			return err
 		}
@@ -440,15 +789,17 @@ func CpCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error {
 	if err != nil {
 		return err
 	}
-	pathFilter := &lib.AllPathFilter{Filters: []lib.PathFilter{
-		lib.NewPathInclusionFilter([]string{flags.Arg(0)}),
-		&lib.PathExclusionFilter{args.Exclude},
-	}}
+	pathFilter := pathFilterFlags.PathFilter(flags.Arg(0))
 	cpOnExists := ws.CpOnExistsAbort
 	if args.Overwrite {
 		cpOnExists = ws.CpOnExistsOverwrite
 	}
-	mon := NewCpMonitor(CLIMonitorMode(args.Verbose, args.NoProgress), cpOnExists, args.IgnoreErrors)
+	mode := CLIMonitorMode(args.Verbose, args.NoProgress)
+	progress, err := cliProgress(mode, args.JSONProgress)
+	if err != nil {
+		return err
+	}
+	mon := NewCpMonitor(mode, progress, cpOnExists, args.IgnoreErrors)
 	revisionId, err := revisionId(ctx, repository, args.Revision)
 	if err != nil {
 		return err
@@ -459,15 +810,20 @@ func CpCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error {
 		Monitor:                mon,
 		RevisionId:             revisionId,
 		RestorableMetadataFlag: lib.RestorableMetadataAll,
+		HardLinkDupes:          args.HardlinkDupes,
 	}
 	if !args.Chown {
 		opts.RestorableMetadataFlag ^= lib.RestorableMetadataOwnership
 	}
+	if !args.Xattrs {
+		opts.RestorableMetadataFlag ^= lib.RestorableMetadataXattrs
+	}
 	tmpFS, cleanup, err := newTempFS("cp")
 	if err != nil {
 		return err
 	}
 	defer cleanup()
+	start := time.Now()
 	mon.Preparing()
 	err = ws.Cp(ctx, repository, lib.NewRealFS(flags.Arg(1)), opts, tmpFS)
 	mon.close()
@@ -477,58 +833,188 @@ func CpCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error {
 	if err != nil {
 		return err //nolint:wrapcheck
 	}
-	mbs := float64(mon.BytesWritten) / float64(time.Since(mon.StartTime).Seconds())
-	fmt.Printf(
-		"%d files copied (%s at %s/s)\n",
-		mon.Paths,
-		ws.FormatBytes(mon.BytesWritten),
-		ws.FormatBytes(int64(mbs)),
-	)
-	return nil
+	return printRunSummary(cpRunSummary(mon, start), args.FailOnIgnored)
 }
 
-func ResetCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
-	workspace, err := openWorkspace(ctx)
-	if err != nil {
-		return lib.WrapErrorf(err, "failed to open workspace")
+func cpRunSummary(mon *cliCpMonitor, start time.Time) runSummary {
+	return runSummary{
+		Ok:       max(0, mon.Paths-mon.Skipped-mon.Errors),
+		Skipped:  mon.Skipped,
+		Failed:   mon.Errors,
+		Bytes:    mon.BytesWritten,
+		Duration: time.Since(start),
 	}
-	defer workspace.Close() //nolint:errcheck
-	args := struct {        //nolint:exhaustruct
-		Help       bool
-		Chown      bool
-		Chtime     bool
-		Chmod      bool
-		Verbose    bool
-		NoProgress bool
-		FastScan   bool
-		Force      bool
+}
+
+func CheckoutToCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help         bool
+		Verbose      bool
+		NoProgress   bool
+		JSONProgress bool
+		Chown        bool
+		Xattrs       bool
 	}{}
-	flags := flag.NewFlagSet("reset", flag.ExitOnError)
+	flags := flag.NewFlagSet("checkout-to", flag.ExitOnError)
 	flags.BoolVar(&args.Help, "help", false, "Show help message")
 	flags.BoolVar(&args.Verbose, "verbose", false, "Show progress")
 	flags.BoolVar(&args.NoProgress, "no-progress", false, "Do not show progress")
-	flags.BoolVar(&args.Chown, "chown", false, "Include file ownership changes")
-	flags.BoolVar(&args.Chmod, "chmod", false, "Include file mode changes")
-	flags.BoolVar(&args.Chtime, "chtime", false, "Include file time changes")
-	flags.BoolVar(&args.FastScan, "fast-scan", false, fastScanFlagDescription)
-	flags.BoolVar(&args.Force, "force", false, "Ignore local changes. All local changes will be lost.")
+	flags.BoolVar(&args.JSONProgress, "json-progress", false, jsonProgressFlagDescription)
+	flags.BoolVar(&args.Chown, "chown", false, "Restore file ownership from the repository.")
+	flags.BoolVar(&args.Xattrs, "xattrs", false, xattrsFlagDescription)
 	flags.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s reset <revision-id>\n\n", appName)
-		fmt.Fprint(os.Stderr, "Reset the workspace to a specific revision.\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s checkout-to <revision> <target>\n\n", appName)
+		fmt.Fprint(os.Stderr, "Write the workspace as it was at <revision> into the empty directory <target>.\n")
+		fmt.Fprint(os.Stderr, "The workspace itself is not changed.\n")
 		fmt.Fprint(os.Stderr, "\nFlags:\n")
 		flags.PrintDefaults()
 	}
-	if err := flags.Parse(argv); err != nil {
-		return err //nolint:wrapcheck
+	if err := parseFlags(flags, argv); err != nil {
+		return err
 	}
 	if args.Help {
 		flags.Usage()
 		return nil
 	}
-	if len(flags.Args()) != 1 {
-		return lib.Errorf("one positional argument is required: <revision-id>")
+	if len(flags.Args()) != 2 {
+		return lib.Errorf("two positional arguments are required: <revision> <target>")
 	}
-	repository, err := openRepository(ctx, workspace, "", passphraseFromStdin)
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	workspacePath, err := filepath.Abs(".")
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to get absolute path of the workspace")
+	}
+	target, err := filepath.Abs(flags.Arg(1))
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to get absolute path for %s", flags.Arg(1))
+	}
+	if rel, err := filepath.Rel(workspacePath, target); err == nil && rel != ".." &&
+		!strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return lib.Errorf("the target %s must not be inside the workspace", target)
+	}
+	repository, _, err := openCachedRepository(ctx, workspace, "", passphraseFromStdin, blockCacheRead)
+	if err != nil {
+		return err
+	}
+	defer repository.Close() //nolint:errcheck
+	revisionId, err := revisionId(ctx, repository, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, 0o700); err != nil {
+		return lib.WrapErrorf(err, "failed to create %s", target)
+	}
+	mode := CLIMonitorMode(args.Verbose, args.NoProgress)
+	progress, err := cliProgress(mode, args.JSONProgress)
+	if err != nil {
+		return err
+	}
+	mon := NewCpMonitor(mode, progress, ws.CpOnExistsAbort, false)
+	opts := &ws.CheckoutToOptions{
+		RevisionId:             revisionId,
+		Monitor:                mon,
+		RestorableMetadataFlag: lib.RestorableMetadataAll,
+	}
+	if !args.Chown {
+		opts.RestorableMetadataFlag ^= lib.RestorableMetadataOwnership
+	}
+	if !args.Xattrs {
+		opts.RestorableMetadataFlag ^= lib.RestorableMetadataXattrs
+	}
+	mon.Preparing()
+	err = ws.CheckoutTo(ctx, workspace, repository, lib.NewRealFS(target), opts)
+	mon.close()
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	fmt.Printf(
+		"%d files of revision %s written to %s (%s)\n",
+		mon.Paths,
+		revisionId,
+		target,
+		ws.FormatBytes(mon.BytesWritten),
+	)
+	return nil
+}
+
+func ResetCmd(ctx context.Context, argv []string, passphraseFromStdin bool) (retErr error) { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help          bool
+		Chown         bool
+		Xattrs        bool
+		Chtime        bool
+		Chmod         bool
+		Verbose       bool
+		NoProgress    bool
+		JSONProgress  bool
+		FastScan      bool
+		Force         bool
+		FailOnIgnored bool
+		NoRepoIgnore  bool
+		HardlinkDupes bool
+		Wait          bool
+		NoWait        bool
+	}{}
+	flags := flag.NewFlagSet("reset", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.BoolVar(&args.Verbose, "verbose", false, "Show progress")
+	flags.BoolVar(&args.NoProgress, "no-progress", false, "Do not show progress")
+	flags.BoolVar(&args.JSONProgress, "json-progress", false, jsonProgressFlagDescription)
+	flags.BoolVar(&args.Chown, "chown", false, "Include file ownership changes")
+	flags.BoolVar(&args.Xattrs, "xattrs", false, xattrsFlagDescription)
+	flags.BoolVar(&args.Chmod, "chmod", false, "Include file mode changes")
+	flags.BoolVar(&args.Chtime, "chtime", false, "Include file time changes")
+	flags.BoolVar(&args.FastScan, "fast-scan", false, fastScanFlagDescription)
+	flags.BoolVar(&args.Force, "force", false, "Ignore local changes. All local changes will be lost.")
+	flags.BoolVar(&args.FailOnIgnored, "fail-on-ignored", false, failOnIgnoredFlagDescription)
+	flags.BoolVar(&args.NoRepoIgnore, "no-repo-ignore", false, noRepoIgnoreFlagDescription)
+	flags.BoolVar(&args.HardlinkDupes, "hardlink-dupes", false, hardlinkDupesFlagDescription)
+	flags.BoolVar(&args.Wait, "wait", false, waitFlagDescription)
+	flags.BoolVar(&args.NoWait, "no-wait", false, noWaitFlagDescription)
+	pathFilterFlags := addPathFilterFlags(
+		flags,
+		"Do not reset paths matching the given pattern (can be used multiple times).\n"+
+			"They are left as they are and become local changes if they differ from the revision.",
+	)
+	notify := addNotifyFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s reset <revision-id>\n\n", appName)
+		fmt.Fprint(os.Stderr, "Reset the workspace to a specific revision.\n")
+		fmt.Fprint(os.Stderr, "\nThe patterns of --exclude and --include:\n")
+		fmt.Fprint(os.Stderr, globPatternDescription("    ")+"\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if err := notify.start(); err != nil {
+		return err
+	}
+	defer func() { notify.send(ctx, retErr) }()
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	if len(flags.Args()) != 1 {
+		return lib.Errorf("one positional argument is required: <revision-id>")
+	}
+	unlock, err := lockWorkspace(ctx, workspace, args.Wait, args.NoWait)
+	if err != nil {
+		return err
+	}
+	defer unlock() //nolint:errcheck
+	workspace.NoRepoIgnore = args.NoRepoIgnore
+	repository, _, err := openCachedRepository(ctx, workspace, "", passphraseFromStdin, blockCacheRead)
 	if err != nil {
 		return err
 	}
@@ -537,11 +1023,19 @@ func ResetCmd(ctx context.Context, argv []string, passphraseFromStdin bool) erro
 	if err != nil {
 		return err
 	}
-	stagingMonitor, cpMonitor := NewResetMonitors(CLIMonitorMode(args.Verbose, args.NoProgress))
+	mode := CLIMonitorMode(args.Verbose, args.NoProgress)
+	progress, err := cliProgress(mode, args.JSONProgress)
+	if err != nil {
+		return err
+	}
+	stagingMonitor, cpMonitor := NewResetMonitors(mode, progress)
 	restorableMetadataFlag := lib.RestorableMetadataAll
 	if !args.Chown {
 		restorableMetadataFlag ^= lib.RestorableMetadataOwnership
 	}
+	if !args.Xattrs {
+		restorableMetadataFlag ^= lib.RestorableMetadataXattrs
+	}
 	if !args.Chtime {
 		restorableMetadataFlag ^= lib.RestorableMetadataMTime
 	}
@@ -550,12 +1044,15 @@ func ResetCmd(ctx context.Context, argv []string, passphraseFromStdin bool) erro
 	}
 	opts := &ws.ResetOptions{
 		RevisionId:             revisionId,
+		PathFilter:             pathFilterFlags.PathFilter(),
 		Force:                  args.Force,
 		StagingMonitor:         stagingMonitor,
 		CpMonitor:              cpMonitor,
 		RestorableMetadataFlag: restorableMetadataFlag,
 		UseStagingCache:        args.FastScan,
+		HardLinkDupes:          args.HardlinkDupes,
 	}
+	start := time.Now()
 	stagingMonitor.Preparing()
 	if err := ws.Reset(ctx, workspace, repository, opts); err != nil {
 		stagingMonitor.close()
@@ -569,342 +1066,3373 @@ func ResetCmd(ctx context.Context, argv []string, passphraseFromStdin bool) erro
 		return err //nolint:wrapcheck
 	}
 	fmt.Printf("Reset to revision %s\n", wsHead)
-	return nil
+	summary := cpRunSummary(cpMonitor, start)
+	summary.Skipped += stagingMonitor.Unsupported
+	notify.done(wsHead, summary, false)
+	return printRunSummary(summary, args.FailOnIgnored)
 }
 
-func MergeCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
-	workspace, err := openWorkspace(ctx)
-	if err != nil {
-		return lib.WrapErrorf(err, "failed to open workspace")
-	}
-	defer workspace.Close() //nolint:errcheck
-	args := struct {        //nolint:exhaustruct
-		Help        bool
-		Message     string
-		Author      string
-		Chown       bool
-		Chtime      bool
-		Chmod       bool
-		Verbose     bool
-		AcceptLocal bool
-		NoProgress  bool
-		FastScan    bool
+func RepairHeadCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help         bool
+		Revision     string
+		Chown        bool
+		Xattrs       bool
+		Chmod        bool
+		Chtime       bool
+		Verbose      bool
+		NoProgress   bool
+		JSONProgress bool
+		FastScan     bool
 	}{}
-	defaultAuthor := "<anonymous>"
-	whoami, err := user.Current()
-	if err == nil {
-		defaultAuthor = whoami.Username
-	}
-	defaultMessage := "Synced with cling-sync"
-	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	flags := flag.NewFlagSet("repair-head", flag.ExitOnError)
 	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.StringVar(
+		&args.Revision,
+		"revision",
+		"",
+		"Set the workspace head to this revision without comparing it to the workspace",
+	)
 	flags.BoolVar(&args.Verbose, "verbose", false, "Show progress")
 	flags.BoolVar(&args.NoProgress, "no-progress", false, "Do not show progress")
-	flags.BoolVar(&args.AcceptLocal, "accept-local", false, "Ignore all conflicts and commit all local changes")
+	flags.BoolVar(&args.JSONProgress, "json-progress", false, jsonProgressFlagDescription)
 	flags.BoolVar(&args.Chown, "chown", false, "Include file ownership changes")
+	flags.BoolVar(&args.Xattrs, "xattrs", false, xattrsFlagDescription)
 	flags.BoolVar(&args.Chmod, "chmod", false, "Include file mode changes")
 	flags.BoolVar(&args.Chtime, "chtime", false, "Include file time changes")
 	flags.BoolVar(&args.FastScan, "fast-scan", false, fastScanFlagDescription)
-	flags.StringVar(&args.Author, "author", defaultAuthor, "Author name")
-	flags.StringVar(&args.Message, "message", defaultMessage, "Commit message")
 	flags.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s merge\n\n", appName)
-		fmt.Fprint(os.Stderr, "Commit all local changes to the repository\n")
-		fmt.Fprint(os.Stderr, "and merge all changes from the repository into the workspace.\n")
-		fmt.Fprint(os.Stderr, "As a result, the workspace will be identical to the repository.\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s repair-head [--revision <revision-id>]\n\n", appName)
+		fmt.Fprint(os.Stderr, "Repair the workspace head after a merge committed to the repository\n")
+		fmt.Fprint(os.Stderr, "but failed to update the workspace.\n")
+		fmt.Fprint(os.Stderr, "The revisions committed since are compared to the workspace and the\n")
+		fmt.Fprint(os.Stderr, "newest one that matches becomes the workspace head. No files are changed.\n")
 		fmt.Fprint(os.Stderr, "\nFlags:\n")
 		flags.PrintDefaults()
 	}
-	if err := flags.Parse(argv); err != nil {
-		return err //nolint:wrapcheck
+	if err := parseFlags(flags, argv); err != nil {
+		return err
 	}
 	if args.Help {
 		flags.Usage()
 		return nil
 	}
-	if len(flags.Args()) != 0 {
-		return lib.Errorf("no positional arguments allowed")
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	if len(flags.Args()) > 0 {
+		return lib.Errorf("too many positional arguments")
 	}
 	repository, err := openRepository(ctx, workspace, "", passphraseFromStdin)
 	if err != nil {
 		return err
 	}
 	defer repository.Close() //nolint:errcheck
-	stagingMonitor, cpMonitor, commitMonitor := NewMergeMonitors(
-		CLIMonitorMode(args.Verbose, args.NoProgress),
-	)
+	var revision *lib.RevisionId
+	if args.Revision != "" {
+		revisionId, err := revisionId(ctx, repository, args.Revision)
+		if err != nil {
+			return err
+		}
+		revision = &revisionId
+	} else {
+		_, pending, err := workspace.PendingCommit(ctx)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+		if !pending {
+			fmt.Println("Nothing to repair")
+			return nil
+		}
+	}
 	restorableMetadataFlag := lib.RestorableMetadataAll
 	if !args.Chown {
 		restorableMetadataFlag ^= lib.RestorableMetadataOwnership
 	}
+	if !args.Xattrs {
+		restorableMetadataFlag ^= lib.RestorableMetadataXattrs
+	}
 	if !args.Chtime {
 		restorableMetadataFlag ^= lib.RestorableMetadataMTime
 	}
 	if !args.Chmod {
 		restorableMetadataFlag ^= lib.RestorableMetadataMode
 	}
-	opts := &ws.MergeOptions{
-		Author:                 args.Author,
-		Message:                args.Message,
-		StagingMonitor:         stagingMonitor,
-		CpMonitor:              cpMonitor,
-		CommitMonitor:          commitMonitor,
+	mode := CLIMonitorMode(args.Verbose, args.NoProgress)
+	progress, err := cliProgress(mode, args.JSONProgress)
+	if err != nil {
+		return err
+	}
+	mon := NewStatusMonitor(mode, progress)
+	opts := &ws.RepairHeadOptions{
+		RevisionId:             revision,
+		StagingMonitor:         mon,
 		RestorableMetadataFlag: restorableMetadataFlag,
 		UseStagingCache:        args.FastScan,
 	}
-	stagingMonitor.Preparing()
-	var revisionId lib.RevisionId
-	if args.AcceptLocal {
-		revisionId, err = ws.ForceCommit(ctx, workspace, repository, &ws.ForceCommitOptions{MergeOptions: *opts})
-	} else {
-		revisionId, err = ws.Merge(ctx, workspace, repository, opts)
-	}
-	stagingMonitor.close()
-	cpMonitor.close()
-	commitMonitor.close()
-	if errors.Is(err, ws.ErrUpToDate) {
-		fmt.Println("No changes")
-		return nil
-	}
-	conflicts := ws.MergeConflictsError{}
-	if errors.As(err, &conflicts) {
-		var sb strings.Builder
-		sb.WriteString("merge aborted due to conflicts:\n\n")
-		for _, conflict := range conflicts {
-			fmt.Fprintf(&sb, "  %s (remote: %s, local: %s)\n",
-				conflict.WorkspaceEntry.Path,
-				conflict.RepositoryEntry.Kind,
-				conflict.WorkspaceEntry.Kind)
-		}
-		fmt.Fprintf(&sb, `
-No files were changed, you need to resolve the conflicts manually.
-
-To accept all local changes, run `+"`"+`%s merge --accept-local`+"`"+`
-To select remote changes, run `+"`"+`%s cp --overwrite <remote-path> .`+"`"+`
-`, appName, appName)
-		return lib.Errorf("%s", sb.String())
-	}
+	mon.Preparing()
+	wsHead, err := ws.RepairHead(ctx, workspace, repository, opts)
+	mon.close()
 	if err != nil {
 		return err //nolint:wrapcheck
 	}
-	if commitMonitor.Paths == 0 {
-		fmt.Println("No local changes, workspace is up to date now")
-		return nil
-	}
-	compressionRatio := "n/a"
-	if commitMonitor.RawBytesAdded > 0 {
-		compressionRatio = fmt.Sprintf(
-			"%.2f",
-			float64(commitMonitor.CompressedBytesAdded)/float64(commitMonitor.RawBytesAdded),
-		)
-	}
-	fmt.Printf(
-		"Revision %s (%s added, compressed: %s)\n",
-		revisionId,
-		ws.FormatBytes(commitMonitor.RawBytesAdded),
-		compressionRatio,
-	)
+	fmt.Printf("Workspace head is now %s\n", wsHead)
 	return nil
 }
 
-func StatusCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
-	workspace, err := openWorkspace(ctx)
-	if err != nil {
-		return lib.WrapErrorf(err, "failed to open workspace")
-	}
-	defer workspace.Close() //nolint:errcheck
-	args := struct {        //nolint:exhaustruct
-		Help       bool
-		Short      bool
-		Verbose    bool
-		NoProgress bool
-		Exclude    lib.ExtendedGlobPatterns
-		NoSummary  bool
-		Chown      bool
-		Chmod      bool
-		Chtime     bool
-		FastScan   bool
+func RestoreCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help         bool
+		Revision     string
+		Chown        bool
+		Xattrs       bool
+		Verbose      bool
+		NoProgress   bool
+		JSONProgress bool
+		FastScan     bool
+		Force        bool
 	}{}
-	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
 	flags.BoolVar(&args.Help, "help", false, "Show help message")
-	flags.BoolVar(&args.Short, "short", false, "Only show the number of added, updated, and deleted files")
+	flags.StringVar(&args.Revision, "revision", "", "Revision to restore from (required)")
 	flags.BoolVar(&args.Verbose, "verbose", false, "Show progress")
 	flags.BoolVar(&args.NoProgress, "no-progress", false, "Do not show progress")
-	flags.BoolVar(&args.Chown, "chown", false, "Include file ownership changes")
-	flags.BoolVar(&args.Chmod, "chmod", false, "Include file mode changes")
-	flags.BoolVar(&args.Chtime, "chtime", false, "Include file time changes")
+	flags.BoolVar(&args.JSONProgress, "json-progress", false, jsonProgressFlagDescription)
+	flags.BoolVar(&args.Chown, "chown", false, "Restore file ownership from the repository.")
+	flags.BoolVar(&args.Xattrs, "xattrs", false, xattrsFlagDescription)
 	flags.BoolVar(&args.FastScan, "fast-scan", false, fastScanFlagDescription)
-	flags.BoolVar(&args.NoSummary, "no-summary", false, "Do not show a summary at the end")
-	globPatternFlag(
+	flags.BoolVar(&args.Force, "force", false, "Overwrite local changes of the restored paths.")
+	pathFilterFlags := addPathFilterFlags(
 		flags,
-		"exclude",
-		"Exclude paths matching the given pattern (can be used multiple times).\nThe pattern syntax is the same as the [pattern] argument.",
-		&args.Exclude,
+		"Do not restore paths matching the given pattern (can be used multiple times).\nThe pattern syntax is the same as for the <pattern> argument.",
 	)
 	flags.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s status [pattern]\n\n", appName)
-		fmt.Fprint(os.Stderr, "Show the difference between the working directory and the repository.\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s restore --revision <revision> <pattern>...\n\n", appName)
+		fmt.Fprint(os.Stderr, "Restore paths from an older revision into the workspace.\n")
+		fmt.Fprint(os.Stderr, "The workspace head is not changed: the restored files show up in\n")
+		fmt.Fprintf(os.Stderr, "`%s status` and are committed by the next `%s merge`.\n", appName, appName)
 		fmt.Fprint(os.Stderr, "\nArguments:\n")
-		fmt.Fprint(os.Stderr, "  pattern (optional)\n")
+		fmt.Fprint(os.Stderr, "  pattern\n")
 		fmt.Fprint(
 			os.Stderr,
-			"        Show status only for paths matching the given pattern.\n"+globPatternDescription("        "),
+			"        Paths matching the given pattern are restored.\n"+globPatternDescription("        "),
 		)
 		fmt.Fprint(os.Stderr, "\n\nFlags:\n")
 		flags.PrintDefaults()
 	}
-	if err := flags.Parse(argv); err != nil {
-		return err //nolint:wrapcheck
+	if err := parseFlags(flags, argv); err != nil {
+		return err
 	}
 	if args.Help {
 		flags.Usage()
 		return nil
 	}
-	var pathFilter lib.PathFilter
-	if len(flags.Args()) == 1 {
-		pathFilter = lib.NewPathInclusionFilter([]string{flags.Arg(0)})
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
 	}
-	if len(flags.Args()) > 1 {
-		return lib.Errorf("too many positional arguments")
+	defer workspace.Close() //nolint:errcheck
+	if args.Revision == "" {
+		return lib.Errorf("--revision is required")
 	}
-	if len(args.Exclude) > 0 {
-		exclusionFilter := &lib.PathExclusionFilter{args.Exclude}
-		if pathFilter != nil {
-			pathFilter = &lib.AllPathFilter{[]lib.PathFilter{pathFilter, exclusionFilter}}
-		} else {
-			pathFilter = exclusionFilter
-		}
+	if len(flags.Args()) == 0 {
+		return lib.Errorf("at least one positional argument is required: <pattern>")
 	}
-	repository, err := openRepository(ctx, workspace, "", passphraseFromStdin)
+	repository, _, err := openCachedRepository(ctx, workspace, "", passphraseFromStdin, blockCacheRead)
 	if err != nil {
 		return err
 	}
 	defer repository.Close() //nolint:errcheck
-	tmpFS, err := workspace.TempFS.MkSub("status")
+	revisionId, err := revisionId(ctx, repository, args.Revision)
 	if err != nil {
-		return err //nolint:wrapcheck
+		return err
+	}
+	mode := CLIMonitorMode(args.Verbose, args.NoProgress)
+	progress, err := cliProgress(mode, args.JSONProgress)
+	if err != nil {
+		return err
+	}
+	stagingMonitor, cpMonitor := NewResetMonitors(mode, progress)
+	opts := &ws.RestoreOptions{
+		RevisionId:             revisionId,
+		PathFilter:             pathFilterFlags.PathFilter(flags.Args()...),
+		Force:                  args.Force,
+		StagingMonitor:         stagingMonitor,
+		CpMonitor:              cpMonitor,
+		RestorableMetadataFlag: lib.RestorableMetadataAll,
+		UseStagingCache:        args.FastScan,
 	}
-	mon := NewStatusMonitor(CLIMonitorMode(args.Verbose, args.NoProgress))
-	restorableMetadataFlag := lib.RestorableMetadataAll
 	if !args.Chown {
-		restorableMetadataFlag ^= lib.RestorableMetadataOwnership
+		opts.RestorableMetadataFlag ^= lib.RestorableMetadataOwnership
 	}
-	if !args.Chtime {
-		restorableMetadataFlag ^= lib.RestorableMetadataMTime
+	if !args.Xattrs {
+		opts.RestorableMetadataFlag ^= lib.RestorableMetadataXattrs
 	}
-	if !args.Chmod {
+	stagingMonitor.Preparing()
+	n, err := ws.Restore(ctx, workspace, repository, opts)
+	stagingMonitor.close()
+	cpMonitor.close()
+	restoreErr := ws.RestoreError{}
+	if errors.As(err, &restoreErr) {
+		var sb strings.Builder
+		sb.WriteString("restore aborted due to local changes:\n\n")
+		for _, path := range restoreErr.LocalChanges {
+			fmt.Fprintf(&sb, "  %s\n", path)
+		}
+		sb.WriteString("\nUse --force to overwrite them.")
+		return lib.WrapErrorKindf(ws.ErrConflict, nil, "%s", sb.String())
+	}
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	fmt.Printf("Restored %d paths from revision %s\n", n, revisionId)
+	fmt.Printf("Run `%s status` to review and `%s merge` to commit them.\n", appName, appName)
+	return nil
+}
+
+func UndeleteCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help         bool
+		Chown        bool
+		Xattrs       bool
+		Verbose      bool
+		NoProgress   bool
+		JSONProgress bool
+		FastScan     bool
+		Force        bool
+	}{}
+	flags := flag.NewFlagSet("undelete", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.BoolVar(&args.Verbose, "verbose", false, "Show progress")
+	flags.BoolVar(&args.NoProgress, "no-progress", false, "Do not show progress")
+	flags.BoolVar(&args.JSONProgress, "json-progress", false, jsonProgressFlagDescription)
+	flags.BoolVar(&args.Chown, "chown", false, "Restore file ownership from the repository.")
+	flags.BoolVar(&args.Xattrs, "xattrs", false, xattrsFlagDescription)
+	flags.BoolVar(&args.FastScan, "fast-scan", false, fastScanFlagDescription)
+	flags.BoolVar(&args.Force, "force", false, "Overwrite local changes of the path.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s undelete <path>\n\n", appName)
+		fmt.Fprint(os.Stderr, "Bring back a path that was deleted from the repository.\n")
+		fmt.Fprint(os.Stderr, "The path is copied from the last revision that contained it into the\n")
+		fmt.Fprintf(os.Stderr, "workspace and committed by the next `%s merge`.\n", appName)
+		fmt.Fprint(os.Stderr, "\nArguments:\n")
+		fmt.Fprint(os.Stderr, "  path\n")
+		fmt.Fprint(os.Stderr, "        The deleted path. A directory is brought back with everything\n")
+		fmt.Fprint(os.Stderr, "        that was below it.\n")
+		fmt.Fprint(os.Stderr, "\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	if len(flags.Args()) != 1 {
+		return lib.Errorf("exactly one positional argument is required: <path>")
+	}
+	path, err := lib.NewPath(strings.TrimSuffix(flags.Arg(0), "/"))
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	if path.IsEmpty() {
+		return lib.Errorf("the path must not be empty")
+	}
+	repository, _, err := openCachedRepository(ctx, workspace, "", passphraseFromStdin, blockCacheRead)
+	if err != nil {
+		return err
+	}
+	defer repository.Close() //nolint:errcheck
+	mode := CLIMonitorMode(args.Verbose, args.NoProgress)
+	progress, err := cliProgress(mode, args.JSONProgress)
+	if err != nil {
+		return err
+	}
+	stagingMonitor, cpMonitor := NewResetMonitors(mode, progress)
+	opts := &ws.UndeleteOptions{
+		Path:                   path,
+		Force:                  args.Force,
+		StagingMonitor:         stagingMonitor,
+		CpMonitor:              cpMonitor,
+		RestorableMetadataFlag: lib.RestorableMetadataAll,
+		UseStagingCache:        args.FastScan,
+	}
+	if !args.Chown {
+		opts.RestorableMetadataFlag ^= lib.RestorableMetadataOwnership
+	}
+	if !args.Xattrs {
+		opts.RestorableMetadataFlag ^= lib.RestorableMetadataXattrs
+	}
+	stagingMonitor.Preparing()
+	deletion, n, err := ws.Undelete(ctx, workspace, repository, opts)
+	stagingMonitor.close()
+	cpMonitor.close()
+	restoreErr := ws.RestoreError{}
+	if errors.As(err, &restoreErr) {
+		return lib.WrapErrorKindf(ws.ErrConflict, nil, "%s has local changes, use --force to overwrite them", path)
+	}
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	fmt.Printf("Restored %d paths from revision %s\n", n, deletion.RevisionId)
+	fmt.Printf("They were deleted in revision %s\n", deletion.DeletedIn)
+	fmt.Printf("Run `%s status` to review and `%s merge` to commit them.\n", appName, appName)
+	return nil
+}
+
+func MergeCmd(ctx context.Context, argv []string, passphraseFromStdin bool) (retErr error) { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help          bool
+		Message       messageFlag
+		Edit          bool
+		Author        string
+		Chown         bool
+		Xattrs        bool
+		Chtime        bool
+		Chmod         bool
+		Verbose       bool
+		AcceptLocal   bool
+		KeepConflicts bool
+		NoProgress    bool
+		JSONProgress  bool
+		FastScan      bool
+		UseJournal    bool
+		FailOnIgnored bool
+		NoRepoIgnore  bool
+		MergeText     bool
+		Wait          bool
+		NoWait        bool
+		MaxMemory     int
+		Unsupported   string
+		Remote        string
+		First         lib.ExtendedGlobPatterns
+	}{}
+	defaultMessage := "Synced with cling-sync"
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.BoolVar(&args.Verbose, "verbose", false, "Show progress")
+	flags.BoolVar(&args.NoProgress, "no-progress", false, "Do not show progress")
+	flags.BoolVar(&args.JSONProgress, "json-progress", false, jsonProgressFlagDescription)
+	flags.BoolVar(&args.AcceptLocal, "accept-local", false, "Ignore all conflicts and commit all local changes")
+	flags.BoolVar(
+		&args.KeepConflicts,
+		"keep-conflicts",
+		false,
+		"With --accept-local, keep the overwritten repository versions under\n"+
+			ws.ConflictsDir+"/<revision>/<path> in the repository",
+	)
+	flags.BoolVar(
+		&args.MergeText,
+		"merge-text",
+		false,
+		"Merge conflicting text files line by line, like git. Changes to the same lines\n"+
+			"are marked with conflict markers and not committed until the markers are removed",
+	)
+	flags.BoolVar(&args.Chown, "chown", false, "Include file ownership changes")
+	flags.BoolVar(&args.Xattrs, "xattrs", false, xattrsFlagDescription)
+	flags.BoolVar(&args.Chmod, "chmod", false, "Include file mode changes")
+	flags.BoolVar(&args.Chtime, "chtime", false, "Include file time changes")
+	flags.BoolVar(&args.FastScan, "fast-scan", false, fastScanFlagDescription)
+	flags.BoolVar(&args.UseJournal, "use-watch-journal", false, useWatchJournalFlagDescription)
+	flags.StringVar(&args.Author, "author", "", "Author name (default: the identity of the workspace)")
+	messageFlagVar(flags, &args.Message, defaultMessage)
+	flags.BoolVar(
+		&args.Edit,
+		"edit",
+		false,
+		"Edit the commit message in $VISUAL or $EDITOR, pre-filled with the message and the local changes",
+	)
+	flags.StringVar(&args.Unsupported, "unsupported", "warn", unsupportedFlagDescription)
+	flags.StringVar(
+		&args.Remote,
+		"remote",
+		ws.DefaultRemote,
+		"Merge with this sync target (see `sync-repo`) instead of the repository of the workspace",
+	)
+	flags.BoolVar(&args.FailOnIgnored, "fail-on-ignored", false, failOnIgnoredFlagDescription)
+	flags.BoolVar(&args.NoRepoIgnore, "no-repo-ignore", false, noRepoIgnoreFlagDescription)
+	flags.BoolVar(&args.Wait, "wait", false, waitFlagDescription)
+	flags.BoolVar(&args.NoWait, "no-wait", false, noWaitFlagDescription)
+	byteSizeFlag(flags, "max-memory", maxMemoryFlagDescription, &args.MaxMemory)
+	globPatternFlag(
+		flags,
+		"first",
+		"Upload and download paths matching the given pattern before all others (can be used multiple times).\n"+
+			"Useful to get the most important files to safety first during a long initial merge.",
+		&args.First,
+	)
+	pathFilterFlags := addPathFilterFlags(
+		flags,
+		"Do not commit local changes of paths matching the given pattern (can be used multiple times).\n"+
+			"They stay local changes, changes from the repository are still merged.",
+	)
+	notify := addNotifyFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s merge\n\n", appName)
+		fmt.Fprint(os.Stderr, "Commit all local changes to the repository\n")
+		fmt.Fprint(os.Stderr, "and merge all changes from the repository into the workspace.\n")
+		fmt.Fprint(os.Stderr, "As a result, the workspace will be identical to the repository.\n")
+		fmt.Fprintf(os.Stderr, "\nThe hooks in %s/ (pre-merge, post-commit, post-merge) are run\n", ws.HooksDir)
+		fmt.Fprint(os.Stderr, "before and after the merge.\n")
+		fmt.Fprint(os.Stderr, "\nThe patterns of --first, --exclude, and --include:\n")
+		fmt.Fprint(os.Stderr, globPatternDescription("    ")+"\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if err := notify.start(); err != nil {
+		return err
+	}
+	defer func() { notify.send(ctx, retErr) }()
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	if len(flags.Args()) != 0 {
+		return lib.Errorf("no positional arguments allowed")
+	}
+	if args.KeepConflicts && !args.AcceptLocal {
+		return lib.Errorf("--keep-conflicts requires --accept-local")
+	}
+	if args.MergeText && args.AcceptLocal {
+		return lib.Errorf("--merge-text cannot be used with --accept-local")
+	}
+	commitFilter := pathFilterFlags.PathFilter()
+	if commitFilter != nil && args.AcceptLocal {
+		return lib.Errorf("--exclude cannot be used with --accept-local")
+	}
+	unlock, err := lockWorkspace(ctx, workspace, args.Wait, args.NoWait)
+	if err != nil {
+		return err
+	}
+	defer unlock() //nolint:errcheck
+	workspace.NoRepoIgnore = args.NoRepoIgnore
+	if err := workspace.UseRemote(ctx, args.Remote); err != nil {
+		return err //nolint:wrapcheck
+	}
+	repository, _, err := openCachedRepository(ctx, workspace, "", passphraseFromStdin, blockCacheRead)
+	if err != nil {
+		return err
+	}
+	defer repository.Close() //nolint:errcheck
+	if args.Author == "" {
+		if args.Author, err = defaultAuthor(ctx, workspace); err != nil {
+			return err
+		}
+	}
+	mode := CLIMonitorMode(args.Verbose, args.NoProgress)
+	progress, err := cliProgress(mode, args.JSONProgress)
+	if err != nil {
+		return err
+	}
+	stagingMonitor, cpMonitor, commitMonitor := NewMergeMonitors(mode, progress)
+	if stagingMonitor.UnsupportedFilePolicy, err = ws.ParseUnsupportedFilePolicy(args.Unsupported); err != nil {
+		return err //nolint:wrapcheck
+	}
+	restorableMetadataFlag := lib.RestorableMetadataAll
+	if !args.Chown {
+		restorableMetadataFlag ^= lib.RestorableMetadataOwnership
+	}
+	if !args.Xattrs {
+		restorableMetadataFlag ^= lib.RestorableMetadataXattrs
+	}
+	if !args.Chtime {
+		restorableMetadataFlag ^= lib.RestorableMetadataMTime
+	}
+	if !args.Chmod {
 		restorableMetadataFlag ^= lib.RestorableMetadataMode
 	}
-	opts := &ws.StatusOptions{
-		PathFilter:             pathFilter,
-		Monitor:                mon,
+	var first lib.PathFilter
+	if len(args.First) > 0 {
+		first = &lib.PathInclusionFilter{args.First}
+	}
+	message := expandMessage(args.Message.String(), time.Now())
+	if args.Edit {
+		statusOpts := &ws.StatusOptions{
+			PathFilter:             commitFilter,
+			Monitor:                ws.NewDefaultStagingMonitor(ws.DefaultMonitorModeSilent, nil, nil),
+			RestorableMetadataFlag: restorableMetadataFlag,
+			UseStagingCache:        args.FastScan || args.UseJournal,
+			WatchJournal:           nil,
+		}
+		if message, err = editMergeMessage(ctx, workspace, repository, statusOpts, message); err != nil {
+			return err
+		}
+	}
+	opts := &ws.MergeOptions{
+		Author:                 args.Author,
+		Message:                message,
+		StagingMonitor:         stagingMonitor,
+		CpMonitor:              cpMonitor,
+		CommitMonitor:          commitMonitor,
 		RestorableMetadataFlag: restorableMetadataFlag,
-		UseStagingCache:        args.FastScan,
+		UseStagingCache:        args.FastScan || args.UseJournal,
+		First:                  first,
+		CommitFilter:           commitFilter,
+		WatchJournal:           nil,
+		MergeText:              args.MergeText,
+		MemoryBudget:           newMemoryBudget(args.MaxMemory),
+		CacheMonitor:           commitMonitor,
+		HookOutput:             os.Stderr,
+	}
+	if args.UseJournal {
+		opts.WatchJournal = readWatchJournalPosition(ctx)
+	}
+	start := time.Now()
+	stagingMonitor.Preparing()
+	var revisionId lib.RevisionId
+	if args.AcceptLocal {
+		revisionId, err = ws.ForceCommit(
+			ctx,
+			workspace,
+			repository,
+			&ws.ForceCommitOptions{MergeOptions: *opts, KeepConflicts: args.KeepConflicts},
+		)
+	} else {
+		revisionId, err = ws.Merge(ctx, workspace, repository, opts)
+	}
+	stagingMonitor.close()
+	cpMonitor.close()
+	commitMonitor.close()
+	printUnsupportedSummary(stagingMonitor)
+	// Uploaded and downloaded paths are counted together.
+	summary := cpRunSummary(cpMonitor, start)
+	summary.Ok += commitMonitor.Paths
+	summary.Skipped += stagingMonitor.Unsupported
+	summary.Bytes += commitMonitor.RawBytesAdded
+	if errors.Is(err, ws.ErrUpToDate) {
+		fmt.Println("No changes")
+		notify.done(lib.RevisionId{}, summary, true)
+		if err := printRunSummary(summary, args.FailOnIgnored); err != nil {
+			return err
+		}
+		return unresolvedConflictsError(ctx, workspace)
+	}
+	conflicts := ws.MergeConflictsError{}
+	if errors.As(err, &conflicts) {
+		var sb strings.Builder
+		sb.WriteString("merge aborted due to conflicts:\n\n")
+		for _, conflict := range conflicts {
+			remote := conflict.RepositoryEntry.Kind.String()
+			if conflict.RepositoryEntry.RenamedFrom != nil {
+				remote = "renamed from " + conflict.RepositoryEntry.RenamedFrom.String()
+			}
+			fmt.Fprintf(&sb, "  %s (remote: %s, local: %s)\n",
+				conflict.WorkspaceEntry.Path,
+				remote,
+				conflict.WorkspaceEntry.Kind)
+		}
+		fmt.Fprintf(&sb, `
+No files were changed, you need to resolve the conflicts manually.
+
+To accept all local changes, run `+"`"+`%s merge --accept-local`+"`"+`
+(add `+"`"+`--keep-conflicts`+"`"+` to keep the remote versions in the repository)
+To select remote changes, run `+"`"+`%s cp --overwrite <remote-path> .`+"`"+`
+To merge conflicting text files line by line, run `+"`"+`%s merge --merge-text`+"`"+`
+`, appName, appName, appName)
+		return lib.WrapErrorKindf(ws.ErrConflict, nil, "%s", sb.String())
+	}
+	if errors.Is(err, ws.ErrHeadNotInRepository) {
+		return lib.WrapErrorf(
+			err,
+			"remote %q does not have the revision this workspace was last merged with, "+
+				"copy it with `%s replicate <remote> %s` first",
+			args.Remote,
+			appName,
+			args.Remote,
+		)
+	}
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	if commitMonitor.Paths == 0 {
+		fmt.Println("No local changes, workspace is up to date now")
+	} else {
+		printCommitSummary(revisionId, commitMonitor)
+	}
+	notify.done(revisionId, summary, false)
+	if err := printRunSummary(summary, args.FailOnIgnored); err != nil {
+		return err
+	}
+	return unresolvedConflictsError(ctx, workspace)
+}
+
+// Return an error listing the files merged by `merge --merge-text` that
+// still contain conflict markers, nil if there are none.
+func unresolvedConflictsError(ctx context.Context, workspace *ws.Workspace) error {
+	unresolved, err := workspace.UnresolvedConflicts(ctx)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	if len(unresolved) == 0 {
+		return nil
+	}
+	var sb strings.Builder
+	sb.WriteString("conflicts in these files need to be resolved:\n\n")
+	for _, path := range unresolved {
+		fmt.Fprintf(&sb, "  %s\n", path)
+	}
+	fmt.Fprintf(&sb, `
+The conflicting lines are marked with %q, %q, and %q.
+Edit the files and run `+"`"+`%s merge`+"`"+` again, they are not committed until the markers are removed.
+`, ws.ConflictMarkerWorkspace, ws.ConflictMarkerSeparator, ws.ConflictMarkerRepository, appName)
+	return lib.WrapErrorKindf(ws.ErrConflict, nil, "%s", sb.String())
+}
+
+func printCommitSummary(revisionId lib.RevisionId, commitMonitor *cliCommitMonitor) {
+	compressionRatio := "n/a"
+	if commitMonitor.RawBytesAdded > 0 {
+		compressionRatio = fmt.Sprintf(
+			"%.2f",
+			float64(commitMonitor.CompressedBytesAdded)/float64(commitMonitor.RawBytesAdded),
+		)
+	}
+	fmt.Printf(
+		"Revision %s (%s added, compressed: %s)\n",
+		revisionId,
+		ws.FormatBytes(commitMonitor.RawBytesAdded),
+		compressionRatio,
+	)
+}
+
+func WatchCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help         bool
+		Status       bool
+		JournalOnly  bool
+		Message      string
+		Author       string
+		Verbose      bool
+		PollInterval time.Duration
+		QuietPeriod  time.Duration
+		MaxMemory    int
+		Unsupported  string
+	}{}
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.BoolVar(&args.Status, "status", false, "Show the state of the running `watch` of this workspace and exit")
+	flags.BoolVar(
+		&args.JournalOnly,
+		"journal-only",
+		false,
+		"Do not merge, only record which directories change (see --use-watch-journal of status and merge)",
+	)
+	flags.BoolVar(&args.Verbose, "verbose", false, "Show every path of each merge")
+	flags.DurationVar(&args.PollInterval, "poll-interval", 2*time.Second, "How often to check for changes")
+	flags.DurationVar(
+		&args.QuietPeriod,
+		"quiet-period",
+		5*time.Second,
+		"Merge local changes once the workspace did not change for this long",
+	)
+	flags.StringVar(&args.Author, "author", "", "Author name (default: the identity of the workspace)")
+	flags.StringVar(&args.Message, "message", "Synced with cling-sync watch", messageFlagDescription)
+	flags.StringVar(&args.Unsupported, "unsupported", "warn", unsupportedFlagDescription)
+	byteSizeFlag(flags, "max-memory", maxMemoryFlagDescription, &args.MaxMemory)
+	pathFilterFlags := addPathFilterFlags(
+		flags,
+		"Changes to paths matching the given pattern do not trigger a merge (can be used multiple times).\n"+
+			"They are still committed by the next merge, use `.clingignore` to keep them out of the repository.",
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s watch\n\n", appName)
+		fmt.Fprint(os.Stderr, "Keep the workspace in sync with the repository.\n")
+		fmt.Fprint(os.Stderr, "The workspace is merged on start, whenever the repository changed,\n")
+		fmt.Fprint(os.Stderr, "and once local changes settled for `--quiet-period`.\n")
+		fmt.Fprint(os.Stderr, "Conflicts have to be resolved with `merge`, `watch` keeps running.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) != 0 {
+		return lib.Errorf("no positional arguments allowed")
+	}
+	if args.PollInterval <= 0 || args.QuietPeriod < 0 {
+		return lib.Errorf("--poll-interval must be positive and --quiet-period must not be negative")
+	}
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	if args.JournalOnly {
+		return watchJournal(ctx)
+	}
+	socketPath, err := filepath.Abs(ws.WatchSocketPath)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to get absolute path for %s", ws.WatchSocketPath)
+	}
+	if args.Status {
+		status, err := ws.ReadWatchStatus(ctx, socketPath)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+		printWatchStatus(status)
+		return nil
+	}
+	if _, err := ws.ReadWatchStatus(ctx, socketPath); err == nil {
+		return lib.Errorf("`watch` is already running for this workspace")
+	}
+	// A leftover of a `watch` that did not exit cleanly.
+	_ = os.Remove(socketPath)
+	repository, _, err := openCachedRepository(ctx, workspace, "", passphraseFromStdin, blockCacheRead)
+	if err != nil {
+		return err
+	}
+	defer repository.Close() //nolint:errcheck
+	if args.Author == "" {
+		if args.Author, err = defaultAuthor(ctx, workspace); err != nil {
+			return err
+		}
+	}
+	unsupportedPolicy, err := ws.ParseUnsupportedFilePolicy(args.Unsupported)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	pathFilter := pathFilterFlags.PathFilter()
+	mode := CLIMonitorMode(args.Verbose, true)
+	watcher := ws.NewWatcher(workspace, repository, &ws.WatchOptions{
+		MergeOptions: func() *ws.MergeOptions {
+			stagingMonitor, cpMonitor, commitMonitor := NewMergeMonitors(mode, newProgress(false))
+			stagingMonitor.UnsupportedFilePolicy = unsupportedPolicy
+			return &ws.MergeOptions{
+				StagingMonitor: stagingMonitor,
+				CpMonitor:      cpMonitor,
+				CommitMonitor:  commitMonitor,
+				Author:         args.Author,
+				Message:        expandMessage(args.Message, time.Now()),
+				RestorableMetadataFlag: lib.RestorableMetadataAll ^
+					lib.RestorableMetadataOwnership ^ lib.RestorableMetadataMTime ^ lib.RestorableMetadataMode ^
+					lib.RestorableMetadataXattrs,
+				UseStagingCache: true,
+				First:           nil,
+				CommitFilter:    nil,
+				WatchJournal:    nil,
+				MergeText:       false,
+				// A new budget for every merge, see `lib.MemoryBudget`.
+				MemoryBudget: newMemoryBudget(args.MaxMemory),
+				CacheMonitor: commitMonitor,
+				HookOutput:   os.Stderr,
+			}
+		},
+		PollInterval: args.PollInterval,
+		QuietPeriod:  args.QuietPeriod,
+		PathFilter:   pathFilter,
+		Monitor:      cliWatchMonitor{""},
+	})
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to listen on %s", socketPath)
+	}
+	defer os.Remove(socketPath) //nolint:errcheck
+	defer listener.Close()      //nolint:errcheck
+
+	go ws.ServeWatchStatus(listener, watcher) //nolint:errcheck
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Println("Watching the workspace (press Ctrl+C to stop)")
+	return watcher.Run(ctx) //nolint:wrapcheck
+}
+
+func watchJournal(ctx context.Context) error {
+	socketPath, err := filepath.Abs(ws.WatchJournalSocketPath)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to get absolute path for %s", ws.WatchJournalSocketPath)
+	}
+	if _, err := ws.ReadWatchJournalPosition(ctx, socketPath); err == nil {
+		return lib.Errorf("`watch --journal-only` is already running for this workspace")
+	}
+	// A leftover of a `watch --journal-only` that did not exit cleanly.
+	_ = os.Remove(socketPath)
+	root, err := filepath.Abs(".")
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to get absolute path of the workspace")
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to listen on %s", socketPath)
+	}
+	defer os.Remove(socketPath) //nolint:errcheck
+	defer listener.Close()      //nolint:errcheck
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Println("Recording changes to the workspace (press Ctrl+C to stop)")
+	return ws.RunWatchJournal(ctx, root, listener) //nolint:wrapcheck
+}
+
+// Ask `watch --journal-only` for its position. Without a running journal
+// watcher, the whole workspace is scanned.
+func readWatchJournalPosition(ctx context.Context) *ws.WatchJournalPosition {
+	socketPath, err := filepath.Abs(ws.WatchJournalSocketPath)
+	if err == nil {
+		var position ws.WatchJournalPosition
+		position, err = ws.ReadWatchJournalPosition(ctx, socketPath)
+		if err == nil {
+			return &position
+		}
+	}
+	slog.Warn("Failed to read the position of the watch journal, scanning the whole workspace", "error", err)
+	return nil
+}
+
+func AgentCmd(ctx context.Context, argv []string) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help     bool
+		Socket   string
+		Lifetime time.Duration
+	}{}
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.StringVar(&args.Socket, "socket", agentSocketPath(), "The unix socket of the agent")
+	flags.DurationVar(&args.Lifetime, "lifetime", 0, "Forget the keys of a repository this long after they were added")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s agent [flags] [forget]\n\n", appName)
+		fmt.Fprint(os.Stderr, "Keep the decrypted keys of repositories in memory, so that the passphrase\n")
+		fmt.Fprint(os.Stderr, "is only asked for once. Every command that opens a repository asks the\n")
+		fmt.Fprint(os.Stderr, "agent first and hands it the keys after the passphrase was entered.\n")
+		fmt.Fprint(os.Stderr, "The agent runs in the foreground until it is stopped.\n\n")
+		fmt.Fprint(os.Stderr, "The socket is $CLING_SYNC_AGENT_SOCK or a socket per user in\n")
+		fmt.Fprint(os.Stderr, "$XDG_RUNTIME_DIR (or the temp directory).\n\n")
+		fmt.Fprint(os.Stderr, "Commands:\n")
+		fmt.Fprint(os.Stderr, "  forget\n")
+		fmt.Fprint(os.Stderr, "        Make the running agent forget all keys.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	switch flags.Arg(0) {
+	case "":
+	case "forget":
+		if err := ws.CheckAgentSocket(args.Socket); err != nil {
+			return err //nolint:wrapcheck
+		}
+		if err := ws.ForgetAgentKeys(ctx, args.Socket); err != nil {
+			return err //nolint:wrapcheck
+		}
+		fmt.Println("The agent forgot all keys")
+		return nil
+	default:
+		return lib.Errorf("unknown command %q", flags.Arg(0))
+	}
+	if _, _, err := ws.ReadAgentKeys(ctx, args.Socket, ""); err == nil {
+		return lib.Errorf("an agent is already running on %s", args.Socket)
+	}
+	// A leftover of an agent that did not exit cleanly.
+	_ = os.Remove(args.Socket)
+	listener, err := net.Listen("unix", args.Socket)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to listen on %s", args.Socket)
+	}
+	defer os.Remove(args.Socket) //nolint:errcheck
+	defer listener.Close()       //nolint:errcheck
+	if err := os.Chmod(args.Socket, 0o600); err != nil {
+		return lib.WrapErrorf(err, "failed to restrict access to %s", args.Socket)
+	}
+	agent := ws.NewAgent(args.Lifetime)
+	defer agent.Forget()
+	go ws.ServeAgent(listener, agent) //nolint:errcheck
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Printf("Agent listening on %s (press Ctrl+C to stop)\n", args.Socket)
+	<-ctx.Done()
+	return nil
+}
+
+// The socket of `agent`: $CLING_SYNC_AGENT_SOCK or one per user in
+// $XDG_RUNTIME_DIR or the temp directory.
+func agentSocketPath() string {
+	if path := os.Getenv("CLING_SYNC_AGENT_SOCK"); path != "" {
+		return path
+	}
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, fmt.Sprintf("cling-sync-agent-%d.sock", os.Getuid()))
+}
+
+// The key under which `agent` keeps the keys of the repository at `uri`.
+func agentRepositoryKey(uri string) string {
+	if clingHTTP.IsS3StorageURI(uri) || rclone.IsStorageURI(uri) {
+		return uri
+	}
+	abs, err := filepath.Abs(uri)
+	if err != nil {
+		return uri
+	}
+	return abs
+}
+
+// Ask a running `agent` for the keys of the repository at `uri`. Return
+// false if there is no agent (or a socket that is not to be trusted) or it
+// does not have the keys.
+func readAgentKeys(ctx context.Context, uri string) (ws.AgentKeys, bool) {
+	socketPath := agentSocketPath()
+	if ws.CheckAgentSocket(socketPath) != nil {
+		return ws.AgentKeys{}, false
+	}
+	keys, ok, err := ws.ReadAgentKeys(ctx, socketPath, agentRepositoryKey(uri))
+	return keys, ok && err == nil
+}
+
+// Hand the keys of the repository at `uri` to a running `agent`, if there
+// is one.
+func addAgentKeys(ctx context.Context, storage lib.Storage, uri string, encryptedURI string, passphrase []byte) {
+	socketPath := agentSocketPath()
+	if ws.CheckAgentSocket(socketPath) != nil {
+		return
+	}
+	keys, err := ws.NewAgentKeys(ctx, storage, encryptedURI, passphrase)
+	if err == nil {
+		err = ws.AddAgentKeys(ctx, socketPath, agentRepositoryKey(uri), keys)
+	}
+	if err != nil {
+		slog.Warn("Failed to hand the keys to the agent", "error", err)
+	}
+}
+
+func MvCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help       bool
+		Message    string
+		Author     string
+		Repository string
+		PathPrefix string
+	}{}
+	flags := flag.NewFlagSet("mv", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.StringVar(&args.Author, "author", "", "Author name (default: the identity of the workspace)")
+	flags.StringVar(&args.Message, "message", "", "Commit message (default \"Move <source> to <target>\")")
+	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
+	flags.StringVar(&args.PathPrefix, "path-prefix", "", pathPrefixFlagDescription)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s mv <source> <target>\n\n", appName)
+		fmt.Fprint(os.Stderr, "Rename a path in the repository by committing a new revision.\n")
+		fmt.Fprint(os.Stderr, "The rename is recorded as such, so `log --status` shows it as a\n")
+		fmt.Fprint(os.Stderr, "single entry and workspaces that did the same rename locally do\n")
+		fmt.Fprint(os.Stderr, "not run into conflicts. Workspaces move the files on their next merge.\n")
+		fmt.Fprint(os.Stderr, "\nArguments:\n")
+		fmt.Fprint(os.Stderr, "  source\n")
+		fmt.Fprint(os.Stderr, "        The repository path to rename. Renaming a directory moves\n")
+		fmt.Fprint(os.Stderr, "        everything below it.\n")
+		fmt.Fprint(os.Stderr, "  target\n")
+		fmt.Fprint(os.Stderr, "        The new repository path. It must not exist.\n")
+		fmt.Fprint(os.Stderr, "\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) != 2 {
+		return lib.Errorf("exactly two positional arguments are required: <source> <target>")
+	}
+	source, err := lib.NewPath(strings.TrimSuffix(flags.Arg(0), "/"))
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	target, err := lib.NewPath(strings.TrimSuffix(flags.Arg(1), "/"))
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	var (
+		repository *lib.Repository
+		pathPrefix lib.Path
+		workspace  *ws.Workspace
+	)
+	if args.Repository != "" {
+		repository, err = openRepository(ctx, nil, args.Repository, passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	} else {
+		workspace, err = openWorkspace(ctx)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open workspace")
+		}
+		defer workspace.Close() //nolint:errcheck
+		repository, err = openRepository(ctx, workspace, "", passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+		pathPrefix = workspace.PathPrefix
+	}
+	defer repository.Close() //nolint:errcheck
+	if args.Author == "" {
+		if args.Author, err = defaultAuthor(ctx, workspace); err != nil {
+			return err
+		}
+	}
+	pathPrefix, err = parsePathPrefix(args.PathPrefix, pathPrefix)
+	if err != nil {
+		return err
+	}
+	if args.Message == "" {
+		args.Message = fmt.Sprintf("Move %s to %s", source, target)
+	}
+	opts := &ws.MvOptions{
+		Source:     source,
+		Target:     target,
+		PathPrefix: pathPrefix,
+		Author:     args.Author,
+		Message:    args.Message,
+	}
+	tmpFS, cleanup, err := newTempFS("mv")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	moved, revisionId, err := ws.Mv(ctx, repository, opts, tmpFS)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	for _, file := range moved {
+		fmt.Println(file.Format())
+	}
+	fmt.Printf("Moved %d paths in revision %s\n", len(moved), revisionId)
+	return nil
+}
+
+func PingCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help       bool
+		Quiet      bool
+		Timeout    time.Duration
+		Repository string
+	}{}
+	flags := flag.NewFlagSet("ping", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.BoolVar(&args.Quiet, "quiet", false, "Do not print anything, only set the exit code")
+	flags.DurationVar(&args.Timeout, "timeout", 10*time.Second, "Fail if the repository does not respond in time")
+	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s ping\n\n", appName)
+		fmt.Fprint(os.Stderr, "Check that the repository is reachable, the passphrase is correct,\n")
+		fmt.Fprint(os.Stderr, "and the head revision can be read. Nothing else is read or written,\n")
+		fmt.Fprint(os.Stderr, "so this is cheap enough for monitoring scripts.\n")
+		fmt.Fprint(os.Stderr, "The exit code is 0 on success and 1 otherwise.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) > 0 {
+		return lib.Errorf("too many positional arguments")
+	}
+	ctx, cancel := context.WithTimeout(ctx, args.Timeout)
+	defer cancel()
+	start := time.Now()
+	var (
+		repository *lib.Repository
+		uri        string
+		err        error
+	)
+	if args.Repository != "" {
+		uri = args.Repository
+		repository, err = openRepository(ctx, nil, args.Repository, passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	} else {
+		var workspace *ws.Workspace
+		workspace, err = openWorkspace(ctx)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open workspace")
+		}
+		defer workspace.Close() //nolint:errcheck
+		uri = string(workspace.RemoteRepository)
+		repository, err = openRepository(ctx, workspace, "", passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	}
+	defer repository.Close() //nolint:errcheck
+	opened := time.Since(start)
+	head, revision, err := repository.Ping(ctx)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	if args.Quiet {
+		return nil
+	}
+	fmt.Printf("Repository: %s\n", uri)
+	if repository.StorageVersion() == lib.LegacyStorageVersion {
+		fmt.Printf("Version:    %d (run `%s upgrade-repo` to upgrade)\n", lib.LegacyStorageVersion, appName)
+	}
+	if head.IsRoot() {
+		fmt.Print("Head:       <empty repository>\n")
+	} else {
+		fmt.Printf("Head:       %s (%s)\n", head, revision.Timestamp.Time().Format(time.RFC3339))
+	}
+	fmt.Printf("OK (open: %s, total: %s)\n", opened.Round(time.Millisecond), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func PrefetchCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help       bool
+		Revision   string
+		PathPrefix string
+	}{}
+	flags := flag.NewFlagSet("prefetch", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.StringVar(&args.Revision, "revision", "HEAD", "Revision to prefetch")
+	flags.StringVar(&args.PathPrefix, "path-prefix", "", pathPrefixFlagDescription)
+	pathFilterFlags := addPathFilterFlags(
+		flags,
+		"Exclude paths matching the given pattern (can be used multiple times).\nThe pattern syntax is the same as for the <pattern> argument.",
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s prefetch [--revision <revision>] <pattern>\n\n", appName)
+		fmt.Fprint(os.Stderr, "Download the files matching <pattern> into the block cache of the workspace\n")
+		fmt.Fprint(os.Stderr, "without writing them. Afterwards, `cp`, `cat`, and `ls` read them from the\n")
+		fmt.Fprint(os.Stderr, "cache, even if the repository cannot be reached.\n")
+		fmt.Fprint(os.Stderr, "\nArguments:\n")
+		fmt.Fprint(os.Stderr, "  pattern\n")
+		fmt.Fprint(
+			os.Stderr,
+			"        Repository paths matching the given pattern are prefetched.\n"+globPatternDescription("        "),
+		)
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) != 1 {
+		return lib.Errorf("prefetch requires exactly one positional argument: <pattern>")
+	}
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	repository, cache, err := openCachedRepository(ctx, workspace, "", passphraseFromStdin, blockCachePopulate)
+	if err != nil {
+		return err
+	}
+	defer repository.Close() //nolint:errcheck
+	pathPrefix, err := parsePathPrefix(args.PathPrefix, workspace.PathPrefix)
+	if err != nil {
+		return err
+	}
+	revisionId, err := revisionId(ctx, repository, args.Revision)
+	if err != nil {
+		return err
+	}
+	opts := &ws.PrefetchOptions{
+		RevisionId: revisionId,
+		PathFilter: pathFilterFlags.PathFilter(flags.Arg(0)),
+		PathPrefix: pathPrefix,
+	}
+	tmpFS, cleanup, err := newTempFS("prefetch")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	result, err := ws.Prefetch(ctx, repository, cache, opts, tmpFS)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	fmt.Printf(
+		"%d files prefetched (%d blocks, %s downloaded)\n",
+		result.Files,
+		result.Blocks,
+		ws.FormatBytes(result.Bytes),
+	)
+	return nil
+}
+
+func CacheCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help bool
+	}{}
+	flags := flag.NewFlagSet("cache", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s cache [command]\n\n", appName)
+		fmt.Fprint(os.Stderr, "Manage the block cache of the workspace (see `prefetch`).\n\n")
+		fmt.Fprint(os.Stderr, "Commands:\n")
+		fmt.Fprint(os.Stderr, "  info\n")
+		fmt.Fprint(os.Stderr, "        Show the size and the size limit of the cache.\n")
+		fmt.Fprint(os.Stderr, "  limit <size>|none\n")
+		fmt.Fprint(os.Stderr, "        Limit the size of the cache, e.g. `10GiB`. The least recently used\n")
+		fmt.Fprint(os.Stderr, "        blocks are evicted once the cache grows beyond it. With a limit, all\n")
+		fmt.Fprint(os.Stderr, "        blocks read from an S3 repository are cached, not only prefetched ones.\n")
+		fmt.Fprint(os.Stderr, "  clear\n")
+		fmt.Fprint(os.Stderr, "        Remove everything from the cache.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) == 0 {
+		return lib.Errorf("missing command")
+	}
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	posArgs := flags.Args()[1:]
+	switch flags.Arg(0) {
+	case "info":
+		if len(posArgs) != 0 {
+			return lib.Errorf("usage: cache info")
+		}
+		cache, err := workspace.OpenBlockCache(ctx, nil)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open block cache")
+		}
+		blocks, size, err := cache.Usage(ctx)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+		limit := "none"
+		if cache.Limit() > 0 {
+			limit = ws.FormatBytes(cache.Limit())
+		}
+		fmt.Printf("%d blocks (%s), limit: %s\n", blocks, ws.FormatBytes(size), limit)
+		return nil
+	case "limit":
+		if len(posArgs) != 1 {
+			return lib.Errorf("usage: cache limit <size>|none")
+		}
+		limit := 0
+		if posArgs[0] != "none" {
+			limit, err = parseByteSize(posArgs[0])
+			if err != nil {
+				return err
+			}
+			if limit == 0 {
+				return lib.Errorf("the limit must be greater than 0, use `none` to remove it")
+			}
+		}
+		if err := workspace.SetBlockCacheLimit(ctx, int64(limit)); err != nil {
+			return err //nolint:wrapcheck
+		}
+		if limit == 0 {
+			fmt.Println("Removed the block cache limit")
+		} else {
+			fmt.Printf("Limited the block cache to %s\n", ws.FormatBytes(int64(limit)))
+		}
+		return nil
+	case "clear":
+		if len(posArgs) != 0 {
+			return lib.Errorf("usage: cache clear")
+		}
+		if err := workspace.ClearBlockCache(); err != nil {
+			return err //nolint:wrapcheck
+		}
+		fmt.Println("Cleared the block cache")
+		return nil
+	default:
+		return lib.Errorf("unknown command: %s", flags.Arg(0))
+	}
+}
+
+func TagCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help       bool
+		List       bool
+		Delete     bool
+		Force      bool
+		Repository string
+	}{}
+	flags := flag.NewFlagSet("tag", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.BoolVar(&args.List, "list", false, "List all tags")
+	flags.BoolVar(&args.Delete, "delete", false, "Delete the tag")
+	flags.BoolVar(&args.Force, "force", false, "Move the tag if it already exists")
+	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s tag <name> [revision]\n", appName)
+		fmt.Fprintf(os.Stderr, "       %s tag --delete <name>\n", appName)
+		fmt.Fprintf(os.Stderr, "       %s tag --list\n\n", appName)
+		fmt.Fprint(os.Stderr, "Give a revision a name. Tags can be used wherever a revision is\n")
+		fmt.Fprint(os.Stderr, "expected, e.g. `ls --revision <name>` or `diff <name> HEAD`.\n")
+		fmt.Fprint(os.Stderr, "Tag names are stored unencrypted in the repository.\n")
+		fmt.Fprint(os.Stderr, "\nArguments:\n")
+		fmt.Fprint(os.Stderr, "  name\n")
+		fmt.Fprint(os.Stderr, "        The tag name. Only a-z, A-Z, 0-9, and - are allowed.\n")
+		fmt.Fprint(os.Stderr, "  revision\n")
+		fmt.Fprint(os.Stderr, "        The revision to tag (default `HEAD`).\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	switch {
+	case args.List && args.Delete:
+		return lib.Errorf("--list and --delete are mutually exclusive")
+	case args.List && len(flags.Args()) > 0:
+		return lib.Errorf("--list does not take positional arguments")
+	case args.Delete && len(flags.Args()) != 1:
+		return lib.Errorf("--delete requires exactly one positional argument: <name>")
+	case !args.List && len(flags.Args()) == 0:
+		return lib.Errorf("missing positional argument: <name>")
+	case len(flags.Args()) > 2:
+		return lib.Errorf("too many positional arguments")
+	}
+	var repository *lib.Repository
+	if args.Repository != "" {
+		var err error
+		repository, err = openRepository(ctx, nil, args.Repository, passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	} else {
+		workspace, err := openWorkspace(ctx)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open workspace")
+		}
+		defer workspace.Close() //nolint:errcheck
+		repository, err = openRepository(ctx, workspace, "", passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	}
+	defer repository.Close() //nolint:errcheck
+	name := flags.Arg(0)
+	switch {
+	case args.List:
+		tags, err := repository.Tags(ctx)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+		for _, tag := range tags {
+			fmt.Printf("%s %s\n", tag.RevisionId, tag.Name)
+		}
+	case args.Delete:
+		if err := repository.DeleteTag(ctx, name); err != nil {
+			return err //nolint:wrapcheck
+		}
+		fmt.Printf("Deleted tag %s\n", name)
+	default:
+		revision := "HEAD"
+		if len(flags.Args()) > 1 {
+			revision = flags.Arg(1)
+		}
+		revId, err := revisionId(ctx, repository, revision)
+		if err != nil {
+			return err
+		}
+		if err := repository.WriteTag(ctx, name, revId, args.Force); err != nil {
+			return err //nolint:wrapcheck
+		}
+		fmt.Printf("Tagged %s as %s\n", revId, name)
+	}
+	return nil
+}
+
+func RmCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help       bool
+		Message    string
+		Author     string
+		DryRun     bool
+		Repository string
+		PathPrefix string
+	}{}
+	flags := flag.NewFlagSet("rm", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.StringVar(&args.Author, "author", "", "Author name (default: the identity of the workspace)")
+	flags.StringVar(&args.Message, "message", "", "Commit message (default \"Remove <pattern>...\")")
+	flags.BoolVar(&args.DryRun, "dry-run", false, "Only show what would be removed")
+	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
+	flags.StringVar(&args.PathPrefix, "path-prefix", "", pathPrefixFlagDescription)
+	pathFilterFlags := addPathFilterFlags(
+		flags,
+		"Do not remove paths matching the given pattern (can be used multiple times).\nThe pattern syntax is the same as for the <pattern> argument.",
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s rm <pattern>...\n\n", appName)
+		fmt.Fprint(os.Stderr, "Remove paths from the repository by committing a new revision.\n")
+		fmt.Fprint(os.Stderr, "The paths do not have to exist in the workspace. Workspaces\n")
+		fmt.Fprint(os.Stderr, "delete the files on their next merge. Older revisions still\n")
+		fmt.Fprint(os.Stderr, "contain the files.\n")
+		fmt.Fprint(os.Stderr, "\nArguments:\n")
+		fmt.Fprint(os.Stderr, "  pattern\n")
+		fmt.Fprint(
+			os.Stderr,
+			"        Repository paths matching the given pattern are removed.\n"+
+				"        Removing a directory removes everything below it.\n"+
+				globPatternDescription("        "),
+		)
+		fmt.Fprint(os.Stderr, "\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) == 0 {
+		return lib.Errorf("at least one positional argument is required: <pattern>")
+	}
+	var (
+		repository *lib.Repository
+		pathPrefix lib.Path
+		workspace  *ws.Workspace
+		err        error
+	)
+	if args.Repository != "" {
+		repository, err = openRepository(ctx, nil, args.Repository, passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	} else {
+		workspace, err = openWorkspace(ctx)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open workspace")
+		}
+		defer workspace.Close() //nolint:errcheck
+		repository, err = openRepository(ctx, workspace, "", passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+		pathPrefix = workspace.PathPrefix
+	}
+	defer repository.Close() //nolint:errcheck
+	if args.Author == "" {
+		if args.Author, err = defaultAuthor(ctx, workspace); err != nil {
+			return err
+		}
+	}
+	pathPrefix, err = parsePathPrefix(args.PathPrefix, pathPrefix)
+	if err != nil {
+		return err
+	}
+	if args.Message == "" {
+		args.Message = "Remove " + strings.Join(flags.Args(), " ")
+	}
+	opts := &ws.RmOptions{
+		PathFilter: pathFilterFlags.PathFilter(flags.Args()...),
+		PathPrefix: pathPrefix,
+		Author:     args.Author,
+		Message:    args.Message,
+		DryRun:     args.DryRun,
+	}
+	tmpFS, cleanup, err := newTempFS("rm")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	removed, revisionId, err := ws.Rm(ctx, repository, opts, tmpFS)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	for _, file := range removed {
+		fmt.Println(file.Format())
+	}
+	if args.DryRun {
+		fmt.Printf("Would remove %d paths (dry-run)\n", len(removed))
+		return nil
+	}
+	fmt.Printf("Removed %d paths in revision %s\n", len(removed), revisionId)
+	return nil
+}
+
+func StatusCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help         bool
+		Short        bool
+		JSON         bool
+		Verbose      bool
+		NoProgress   bool
+		JSONProgress bool
+		NoSummary    bool
+		Chown        bool
+		Xattrs       bool
+		Chmod        bool
+		Chtime       bool
+		FastScan     bool
+		UseJournal   bool
+		NoRepoIgnore bool
+		Unsupported  string
+		Compare      string
+		Repository   string
+		Revision     string
+		PathPrefix   string
+		Wait         bool
+		NoWait       bool
+	}{}
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.BoolVar(&args.Short, "short", false, "Only show the number of added, updated, and deleted files")
+	flags.BoolVar(&args.JSON, "json", false, jsonFlagDescription+" (the summary is not printed)")
+	flags.BoolVar(&args.Verbose, "verbose", false, "Show progress")
+	flags.BoolVar(&args.NoProgress, "no-progress", false, "Do not show progress")
+	flags.BoolVar(&args.JSONProgress, "json-progress", false, jsonProgressFlagDescription)
+	flags.BoolVar(&args.Chown, "chown", false, "Include file ownership changes")
+	flags.BoolVar(&args.Xattrs, "xattrs", false, xattrsFlagDescription)
+	flags.BoolVar(&args.Chmod, "chmod", false, "Include file mode changes")
+	flags.BoolVar(&args.Chtime, "chtime", false, "Include file time changes")
+	flags.BoolVar(&args.FastScan, "fast-scan", false, fastScanFlagDescription)
+	flags.BoolVar(&args.UseJournal, "use-watch-journal", false, useWatchJournalFlagDescription)
+	flags.BoolVar(&args.NoSummary, "no-summary", false, "Do not show a summary at the end")
+	flags.BoolVar(&args.NoRepoIgnore, "no-repo-ignore", false, noRepoIgnoreFlagDescription)
+	flags.StringVar(&args.Unsupported, "unsupported", "warn", unsupportedFlagDescription)
+	flags.StringVar(
+		&args.Compare,
+		"compare",
+		"",
+		"Compare this directory instead of the workspace with a revision (no workspace needed)",
+	)
+	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription+" (only with --compare)")
+	flags.StringVar(&args.Revision, "revision", "HEAD", "Revision to compare with (only with --compare)")
+	flags.StringVar(&args.PathPrefix, "path-prefix", "", pathPrefixFlagDescription+" (only with --compare)")
+	flags.BoolVar(&args.Wait, "wait", false, waitFlagDescription+" (not with --compare)")
+	flags.BoolVar(&args.NoWait, "no-wait", false, noWaitFlagDescription+" (not with --compare)")
+	pathFilterFlags := addPathFilterFlags(
+		flags,
+		"Exclude paths matching the given pattern (can be used multiple times).\nThe pattern syntax is the same as the [pattern] argument.",
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s status [pattern]\n", appName)
+		fmt.Fprintf(os.Stderr, "       %s status --compare <dir> [--revision <revision>] [pattern]\n\n", appName)
+		fmt.Fprint(os.Stderr, "Show the difference between the working directory and the repository.\n")
+		fmt.Fprint(
+			os.Stderr,
+			"With --compare, show the difference between <dir> and a revision instead.\n"+
+				"<dir> does not have to be a workspace and is not modified.\n",
+		)
+		fmt.Fprint(os.Stderr, "\nArguments:\n")
+		fmt.Fprint(os.Stderr, "  pattern (optional)\n")
+		fmt.Fprint(
+			os.Stderr,
+			"        Show status only for paths matching the given pattern.\n"+globPatternDescription("        "),
+		)
+		fmt.Fprint(os.Stderr, "\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) > 1 {
+		return lib.Errorf("too many positional arguments")
+	}
+	pathFilter := pathFilterFlags.PathFilter(flags.Args()...)
+	mode := CLIMonitorMode(args.Verbose, args.NoProgress)
+	progress, err := cliProgress(mode, args.JSONProgress)
+	if err != nil {
+		return err
+	}
+	mon := NewStatusMonitor(mode, progress)
+	if mon.UnsupportedFilePolicy, err = ws.ParseUnsupportedFilePolicy(args.Unsupported); err != nil {
+		return err //nolint:wrapcheck
+	}
+	if args.JSON {
+		if args.Short || args.Verbose {
+			return lib.Errorf("--json cannot be used with --short or --verbose")
+		}
+		// Keep stdout for the JSON lines.
+		mon.out = os.Stderr
+	}
+	restorableMetadataFlag := lib.RestorableMetadataAll
+	if !args.Chown {
+		restorableMetadataFlag ^= lib.RestorableMetadataOwnership
+	}
+	if !args.Xattrs {
+		restorableMetadataFlag ^= lib.RestorableMetadataXattrs
+	}
+	if !args.Chtime {
+		restorableMetadataFlag ^= lib.RestorableMetadataMTime
+	}
+	if !args.Chmod {
+		restorableMetadataFlag ^= lib.RestorableMetadataMode
+	}
+	if args.Compare != "" {
+		if args.FastScan || args.UseJournal || args.NoRepoIgnore {
+			return lib.Errorf("--fast-scan, --use-watch-journal, and --no-repo-ignore cannot be used with --compare")
+		}
+		opts := &ws.CompareOptions{
+			RevisionId:             lib.RevisionId{},
+			PathPrefix:             lib.Path{},
+			PathFilter:             pathFilter,
+			Monitor:                nil,
+			RestorableMetadataFlag: restorableMetadataFlag,
+		}
+		printer := &statusPrinter{mon, args.Short, args.JSON, false}
+		summary, err := compareDirectory(
+			ctx,
+			args.Compare,
+			args.Repository,
+			args.Revision,
+			args.PathPrefix,
+			opts,
+			printer,
+			passphraseFromStdin,
+		)
+		if err != nil {
+			return err
+		}
+		printer.finish(summary, args.NoSummary)
+		return nil
+	}
+	if args.Repository != "" || args.Revision != "HEAD" || args.PathPrefix != "" {
+		return lib.Errorf("--repository, --revision, and --path-prefix can only be used with --compare")
+	}
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	// Even a full scan replaces the staging cache that a concurrent
+	// `--fast-scan` would read.
+	unlock, err := lockWorkspace(ctx, workspace, args.Wait, args.NoWait)
+	if err != nil {
+		return err
+	}
+	defer unlock() //nolint:errcheck
+	workspace.NoRepoIgnore = args.NoRepoIgnore
+	repository, err := openRepository(ctx, workspace, "", passphraseFromStdin)
+	if err != nil {
+		return err
+	}
+	defer repository.Close() //nolint:errcheck
+	tmpFS, err := workspace.TempFS.MkSub("status")
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	opts := &ws.StatusOptions{
+		PathFilter:             pathFilter,
+		Monitor:                mon,
+		RestorableMetadataFlag: restorableMetadataFlag,
+		UseStagingCache:        args.FastScan || args.UseJournal,
+		WatchJournal:           nil,
+	}
+	if args.UseJournal {
+		opts.WatchJournal = readWatchJournalPosition(ctx)
+	}
+	if _, pending, err := workspace.PendingCommit(ctx); err == nil && pending {
+		fmt.Fprintf(
+			os.Stderr,
+			"Warning: the last merge was interrupted, changes it committed are shown as local changes.\n"+
+				"Run `%s merge` or `%s repair-head` to fix the workspace head.\n",
+			appName,
+			appName,
+		)
+	}
+	printer := &statusPrinter{mon, args.Short, args.JSON, false}
+	mon.Preparing()
+	summary, err := ws.StatusStream(ctx, workspace, repository, opts, tmpFS, printer.print)
+	printer.closeMonitor()
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	printer.finish(summary, args.NoSummary)
+	return nil
+}
+
+// Compare the directory `dir` with a revision (see `status --compare`).
+// The repository and path prefix default to those of the workspace in the
+// current directory.
+func compareDirectory( //nolint:funlen
+	ctx context.Context,
+	dir string,
+	repositoryURI string,
+	revision string,
+	pathPrefixFlag string,
+	opts *ws.CompareOptions,
+	printer *statusPrinter,
+	passphraseFromStdin bool,
+) (ws.StatusSummary, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return ws.StatusSummary{}, lib.WrapErrorf(err, "failed to open %s", dir)
+	}
+	if !info.IsDir() {
+		return ws.StatusSummary{}, lib.Errorf("%s is not a directory", dir)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return ws.StatusSummary{}, lib.WrapErrorf(err, "failed to get absolute path for %s", dir)
+	}
+	var (
+		repository *lib.Repository
+		pathPrefix lib.Path
+	)
+	if repositoryURI != "" {
+		repository, err = openRepository(ctx, nil, repositoryURI, passphraseFromStdin)
+		if err != nil {
+			return ws.StatusSummary{}, err
+		}
+	} else {
+		workspace, err := openWorkspace(ctx)
+		if err != nil {
+			return ws.StatusSummary{}, lib.WrapErrorf(
+				err,
+				"failed to open workspace (use --repository outside of a workspace)",
+			)
+		}
+		defer workspace.Close() //nolint:errcheck
+		repository, _, err = openCachedRepository(ctx, workspace, "", passphraseFromStdin, blockCacheRead)
+		if err != nil {
+			return ws.StatusSummary{}, err
+		}
+		pathPrefix = workspace.PathPrefix
+	}
+	defer repository.Close() //nolint:errcheck
+	if opts.PathPrefix, err = parsePathPrefix(pathPrefixFlag, pathPrefix); err != nil {
+		return ws.StatusSummary{}, err
+	}
+	if opts.RevisionId, err = revisionId(ctx, repository, revision); err != nil {
+		return ws.StatusSummary{}, err
+	}
+	tmpFS, cleanup, err := newTempFS("status")
+	if err != nil {
+		return ws.StatusSummary{}, err
+	}
+	defer cleanup()
+	opts.Monitor = printer.mon
+	printer.mon.Preparing()
+	summary, err := ws.CompareDirectoryStream(ctx, repository, lib.NewRealFS(absDir), opts, tmpFS, printer.print)
+	printer.closeMonitor()
+	return summary, err //nolint:wrapcheck
+}
+
+// statusPrinter prints the files of `status` as they are found. The
+// progress of the scan is cleared before the first file is printed.
+type statusPrinter struct {
+	mon           *cliStagingMonitor
+	short         bool
+	json          bool
+	monitorClosed bool
+}
+
+func (p *statusPrinter) print(file ws.StatusFile) error {
+	p.closeMonitor()
+	if p.json {
+		return printJSON(newJSONStatusFile(&file))
+	}
+	if !p.short {
+		fmt.Println(file.Format())
+	}
+	return nil
+}
+
+func (p *statusPrinter) closeMonitor() {
+	if !p.monitorClosed {
+		p.mon.close()
+		p.monitorClosed = true
+	}
+}
+
+func (p *statusPrinter) finish(summary ws.StatusSummary, noSummary bool) {
+	if p.json || (noSummary && !p.short) {
+		return
+	}
+	fmt.Println(summary)
+	printUnsupportedSummary(p.mon)
+}
+
+func parsePathPrefix(flag string, default_ lib.Path) (lib.Path, error) {
+	switch flag {
+	case "":
+		return default_, nil
+	case "/":
+		return lib.Path{}, nil
+	default:
+		prefix, err := ws.ValidatePathPrefix(flag)
+		if err != nil {
+			return lib.Path{}, lib.WrapErrorf(err, "invalid path prefix %q", flag)
+		}
+		return prefix, nil
+	}
+}
+
+func IdentityCmd(ctx context.Context, argv []string, _ bool) error {
+	args := struct { //nolint:exhaustruct
+		Help     bool
+		Name     string
+		Email    string
+		ClientId string
+	}{}
+	flags := flag.NewFlagSet("identity", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.StringVar(&args.Name, "name", "", "Set the name (an empty name unsets it)")
+	flags.StringVar(&args.Email, "email", "", "Set the email (an empty email unsets it)")
+	flags.StringVar(&args.ClientId, "client-id", "", "Set the client id, e.g. `laptop`")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s identity [--name <name>] [--email <email>] [--client-id <id>]\n\n", appName)
+		fmt.Fprint(os.Stderr, "Show or change the identity of the workspace.\n")
+		fmt.Fprint(os.Stderr, "The name and the email are the default author of the revisions\n")
+		fmt.Fprint(os.Stderr, "committed from the workspace (instead of the name of the current user).\n")
+		fmt.Fprint(os.Stderr, "The client id is recorded in every revision and shown in `log`, so\n")
+		fmt.Fprint(os.Stderr, "that the revisions of different machines can be told apart. A random\n")
+		fmt.Fprint(os.Stderr, "client id is generated for every workspace.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) != 0 {
+		return lib.Errorf("no positional arguments allowed")
+	}
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	identity, err := workspace.Identity(ctx)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	changed := false
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "name":
+			identity.Name, changed = args.Name, true
+		case "email":
+			identity.Email, changed = args.Email, true
+		case "client-id":
+			identity.ClientId, changed = args.ClientId, true
+		}
+	})
+	if changed {
+		if err := workspace.SetIdentity(ctx, identity); err != nil {
+			return err //nolint:wrapcheck
+		}
+	}
+	fmt.Printf("Name:      %s\n", identity.Name)
+	fmt.Printf("Email:     %s\n", identity.Email)
+	fmt.Printf("Client id: %s\n", identity.ClientId)
+	return nil
+}
+
+func ImportCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help         bool
+		Message      string
+		Author       string
+		Chown        bool
+		Xattrs       bool
+		Chtime       bool
+		Chmod        bool
+		Verbose      bool
+		NoProgress   bool
+		JSONProgress bool
+		Repository   string
+		PathPrefix   string
+	}{}
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.StringVar(&args.Author, "author", "", "Author name (default: the identity of the workspace)")
+	flags.StringVar(&args.Message, "message", "", "Commit message (default \"Import <tar-or-dir>\")")
+	flags.BoolVar(&args.Verbose, "verbose", false, "Show progress")
+	flags.BoolVar(&args.NoProgress, "no-progress", false, "Do not show progress")
+	flags.BoolVar(&args.JSONProgress, "json-progress", false, jsonProgressFlagDescription)
+	flags.BoolVar(&args.Chown, "chown", false, "Include file ownership changes")
+	flags.BoolVar(&args.Xattrs, "xattrs", false, xattrsFlagDescription)
+	flags.BoolVar(&args.Chmod, "chmod", false, "Include file mode changes")
+	flags.BoolVar(&args.Chtime, "chtime", false, "Include file time changes")
+	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
+	flags.StringVar(&args.PathPrefix, "path-prefix", "", pathPrefixFlagDescription)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s import <tar-or-dir>\n\n", appName)
+		fmt.Fprint(os.Stderr, "Commit the content of a tar archive or a directory as a new revision.\n")
+		fmt.Fprint(os.Stderr, "The directory does not have to be a workspace and is not written to.\n")
+		fmt.Fprint(os.Stderr, "Paths in the repository that are not imported are kept.\n")
+		fmt.Fprint(os.Stderr, "\nArguments:\n")
+		fmt.Fprint(os.Stderr, "  tar-or-dir\n")
+		fmt.Fprint(os.Stderr, "        A directory, a tar archive (optionally gzip compressed),\n")
+		fmt.Fprint(os.Stderr, "        or `-` to read a tar archive from stdin.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) != 1 {
+		return lib.Errorf("exactly one positional argument is required: <tar-or-dir>")
+	}
+	src := flags.Arg(0)
+	if src == "-" && passphraseFromStdin {
+		return lib.Errorf("cannot read both the passphrase and the tar archive from stdin")
+	}
+	var (
+		srcInfo fs.FileInfo
+		err     error
+	)
+	if src != "-" {
+		if srcInfo, err = os.Stat(src); err != nil {
+			return lib.WrapErrorf(err, "failed to stat %s", src)
+		}
+	}
+	var (
+		repository *lib.Repository
+		pathPrefix lib.Path
+		workspace  *ws.Workspace
+	)
+	if args.Repository != "" {
+		repository, err = openRepository(ctx, nil, args.Repository, passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	} else {
+		workspace, err = openWorkspace(ctx)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open workspace (use --repository outside of a workspace)")
+		}
+		defer workspace.Close() //nolint:errcheck
+		repository, err = openRepository(ctx, workspace, "", passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+		pathPrefix = workspace.PathPrefix
+	}
+	defer repository.Close() //nolint:errcheck
+	if args.Author == "" {
+		if args.Author, err = defaultAuthor(ctx, workspace); err != nil {
+			return err
+		}
+	}
+	pathPrefix, err = parsePathPrefix(args.PathPrefix, pathPrefix)
+	if err != nil {
+		return err
+	}
+	if args.Message == "" {
+		args.Message = "Import " + filepath.Base(src)
+	}
+	restorableMetadataFlag := lib.RestorableMetadataAll
+	if !args.Chown {
+		restorableMetadataFlag ^= lib.RestorableMetadataOwnership
+	}
+	if !args.Xattrs {
+		restorableMetadataFlag ^= lib.RestorableMetadataXattrs
+	}
+	if !args.Chtime {
+		restorableMetadataFlag ^= lib.RestorableMetadataMTime
+	}
+	if !args.Chmod {
+		restorableMetadataFlag ^= lib.RestorableMetadataMode
+	}
+	mode := CLIMonitorMode(args.Verbose, args.NoProgress)
+	progress, err := cliProgress(mode, args.JSONProgress)
+	if err != nil {
+		return err
+	}
+	stagingMonitor, _, commitMonitor := NewMergeMonitors(mode, progress)
+	opts := &ws.ImportOptions{
+		PathPrefix:             pathPrefix,
+		Author:                 args.Author,
+		Message:                args.Message,
+		RestorableMetadataFlag: restorableMetadataFlag,
+		StagingMonitor:         stagingMonitor,
+		CommitMonitor:          commitMonitor,
+	}
+	tmpFS, cleanup, err := newTempFS("import")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	var revisionId lib.RevisionId
+	if srcInfo != nil && srcInfo.IsDir() {
+		var absDir string
+		if absDir, err = filepath.Abs(src); err != nil {
+			return lib.WrapErrorf(err, "failed to get absolute path for %s", src)
+		}
+		stagingMonitor.Preparing()
+		revisionId, err = ws.ImportDirectory(ctx, repository, lib.NewRealFS(absDir), opts, tmpFS)
+		stagingMonitor.close()
+		printUnsupportedSummary(stagingMonitor)
+	} else {
+		var r io.Reader = os.Stdin
+		if src != "-" {
+			f, err := os.Open(src)
+			if err != nil {
+				return lib.WrapErrorf(err, "failed to open %s", src)
+			}
+			defer f.Close() //nolint:errcheck
+			r = f
+		}
+		br := bufio.NewReader(r)
+		r = br
+		// Gzip compressed archives are recognized by their magic number.
+		if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+			gz, err := gzip.NewReader(br)
+			if err != nil {
+				return lib.WrapErrorf(err, "failed to read gzip header of %s", src)
+			}
+			r = gz
+		}
+		revisionId, err = ws.ImportTar(ctx, repository, r, opts, tmpFS)
+	}
+	commitMonitor.close()
+	if errors.Is(err, lib.ErrEmptyCommit) {
+		fmt.Println("No changes")
+		return nil
+	}
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	printCommitSummary(revisionId, commitMonitor)
+	return nil
+}
+
+func LsCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help            bool
+		Revision        string
+		Short           bool
+		Human           bool
+		TimestampFormat string
+		ShortFileMode   bool
+		FileHash        bool
+		JSON            bool
+		Repository      string
+		PathPrefix      string
+	}{
+		TimestampFormat: time.RFC3339,
+	}
+	flags := flag.NewFlagSet("ls", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.StringVar(&args.Revision, "revision", "HEAD", "Revision to show")
+	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
+	flags.StringVar(&args.PathPrefix, "path-prefix", "", pathPrefixFlagDescription)
+	flags.BoolVar(&args.Short, "short", false, "Show short listing (same as --timestamp-format=relative)")
+	flags.BoolVar(&args.FileHash, "file-hash", false, "Show file hash")
+	flags.BoolVar(&args.JSON, "json", false, jsonFlagDescription)
+	flags.BoolVar(
+		&args.Human,
+		"human",
+		false,
+		"Show human readable file sizes (same as --timestamp-format=rfc3339 --full-file-mode)",
+	)
+	flags.Func(
+		"timestamp-format",
+		"Timestamp format: relative, rfc3339, unix, unix-fraction (default rfc3339)",
+		func(value string) error {
+			if value != "relative" && value != "rfc3339" && value != "unix" && value != "unix-fraction" {
+				return lib.Errorf("invalid timestamp-format: %s", value)
+			}
+			if value == "rfc3339" {
+				value = time.RFC3339
+			}
+			args.TimestampFormat = value
+			return nil
+		},
+	)
+	flags.BoolVar(
+		&args.ShortFileMode,
+		"short-file-mode",
+		false,
+		"Show short file mode (only permissions and file type)",
+	)
+	pathFilterFlags := addPathFilterFlags(
+		flags,
+		"Exclude paths matching the given pattern (can be used multiple times).\nThe pattern syntax is the same as for the [pattern] argument.",
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s ls [pattern]\n\n", appName)
+		fmt.Fprint(os.Stderr, "List files in the repository.\n")
+		fmt.Fprint(os.Stderr, "\nArguments:\n")
+		fmt.Fprint(os.Stderr, "  pattern\n")
+		fmt.Fprint(os.Stderr, "        The pattern syntax is the same as for the `commit --ignore` option.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) > 1 {
+		return lib.Errorf("too many positional arguments")
+	}
+	pathFilter := pathFilterFlags.PathFilter(flags.Args()...)
+	if args.JSON && (args.Short || args.Human) {
+		return lib.Errorf("--json cannot be used with --short or --human")
+	}
+	var (
+		repository *lib.Repository
+		pathPrefix lib.Path
+		err        error
+	)
+	if args.Repository != "" {
+		repository, err = openRepository(ctx, nil, args.Repository, passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	} else {
+		var workspace *ws.Workspace
+		workspace, err = openWorkspace(ctx)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open workspace")
+		}
+		defer workspace.Close() //nolint:errcheck
+		repository, _, err = openCachedRepository(ctx, workspace, "", passphraseFromStdin, blockCacheRead)
+		if err != nil {
+			return err
+		}
+		pathPrefix = workspace.PathPrefix
+	}
+	defer repository.Close() //nolint:errcheck
+	pathPrefix, err = parsePathPrefix(args.PathPrefix, pathPrefix)
+	if err != nil {
+		return err
+	}
+	revisionId, err := revisionId(ctx, repository, args.Revision)
+	if err != nil {
+		return err
+	}
+	opts := &ws.LsOptions{RevisionId: revisionId, PathFilter: pathFilter, PathPrefix: pathPrefix}
+	tmpFS, cleanup, err := newTempFS("ls")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	files, err := ws.Ls(ctx, repository, tmpFS, opts)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	if args.JSON {
+		for _, file := range files {
+			if err := printJSON(newJSONPath(file.Path, &file.Metadata)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if args.Short {
+		args.TimestampFormat = "relative"
+		args.ShortFileMode = true
+	}
+	if args.Human {
+		args.TimestampFormat = "rfc3339"
+		args.ShortFileMode = false
+	}
+	format := &ws.LsFormat{
+		FullPath:          true,
+		FullMode:          !args.ShortFileMode,
+		FileHash:          args.FileHash,
+		TimestampFormat:   args.TimestampFormat,
+		HumanReadableSize: args.Human,
+	}
+	for i, file := range files {
+		if args.Short && file.Metadata.FileMode.IsDir() && i > 0 {
+			fmt.Println()
+		}
+		fmt.Println(file.Format(format))
+	}
+	return nil
+}
+
+func ExportCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help       bool
+		Revision   string
+		Repository string
+		PathPrefix string
+		Gzip       bool
+	}{}
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.StringVar(&args.Revision, "revision", "HEAD", "Revision to export")
+	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
+	flags.StringVar(&args.PathPrefix, "path-prefix", "", pathPrefixFlagDescription)
+	flags.BoolVar(&args.Gzip, "gzip", false, "Compress the archive with gzip")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s export [pattern] > out.tar\n\n", appName)
+		fmt.Fprint(os.Stderr, "Write a revision as a tar archive to stdout.\n")
+		fmt.Fprint(os.Stderr, "File modes, mtimes, and owners are preserved.\n")
+		fmt.Fprint(os.Stderr, "\nArguments:\n")
+		fmt.Fprint(os.Stderr, "  pattern\n")
+		fmt.Fprint(os.Stderr, "        The pattern syntax is the same as for the `commit --ignore` option.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	var pathFilter lib.PathFilter
+	if len(flags.Args()) == 1 {
+		pathFilter = lib.NewPathInclusionFilter([]string{flags.Arg(0)})
+	}
+	if len(flags.Args()) > 1 {
+		return lib.Errorf("too many positional arguments")
+	}
+	if IsTerm(os.Stdout) {
+		return lib.Errorf("refusing to write a tar archive to a terminal, redirect stdout to a file")
+	}
+	var (
+		repository *lib.Repository
+		pathPrefix lib.Path
+		err        error
+	)
+	if args.Repository != "" {
+		repository, err = openRepository(ctx, nil, args.Repository, passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	} else {
+		var workspace *ws.Workspace
+		workspace, err = openWorkspace(ctx)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open workspace")
+		}
+		defer workspace.Close() //nolint:errcheck
+		repository, _, err = openCachedRepository(ctx, workspace, "", passphraseFromStdin, blockCacheRead)
+		if err != nil {
+			return err
+		}
+		pathPrefix = workspace.PathPrefix
+	}
+	defer repository.Close() //nolint:errcheck
+	pathPrefix, err = parsePathPrefix(args.PathPrefix, pathPrefix)
+	if err != nil {
+		return err
+	}
+	revisionId, err := revisionId(ctx, repository, args.Revision)
+	if err != nil {
+		return err
+	}
+	tmpFS, cleanup, err := newTempFS("export")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	out := bufio.NewWriter(os.Stdout)
+	opts := &lib.ExportTarOptions{
+		RevisionId: revisionId,
+		PathFilter: pathFilter,
+		PathPrefix: pathPrefix,
+		Gzip:       args.Gzip,
+	}
+	if err := lib.ExportTar(ctx, repository, out, opts, tmpFS); err != nil {
+		return err //nolint:wrapcheck
+	}
+	if err := out.Flush(); err != nil {
+		return lib.WrapErrorf(err, "failed to write to stdout")
+	}
+	return nil
+}
+
+func LogCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help       bool
+		Short      bool
+		Status     bool
+		JSON       bool
+		Verify     bool
+		Repository string
+		Pattern    string
+		Revision   string
+	}{}
+	flags := flag.NewFlagSet("log", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.BoolVar(&args.Short, "short", false, "Show short log")
+	flags.BoolVar(&args.JSON, "json", false, jsonFlagDescription)
+	flags.BoolVar(&args.Status, "status", false, "Show status of paths affected in a revision")
+	flags.BoolVar(&args.Verify, "verify", false,
+		"Verify the signature of every revision against the trusted signers of the workspace "+
+			"and fail if one is invalid or untrusted")
+	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
+	flags.StringVar(&args.Pattern, "pattern", "", "Show log only for paths matching the given pattern")
+	flags.StringVar(&args.Revision, "revision", "",
+		"Revision to show, or a range `<old>..<new>` which excludes `<old>` (like git). Defaults to the head revision.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s log\n\n", appName)
+		fmt.Fprint(os.Stderr, "Show revision log.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+		fmt.Fprint(os.Stderr, "\n"+globPatternDescription("")+"\n")
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) > 0 {
+		return lib.Errorf("too many positional arguments")
+	}
+	var pathFilter lib.PathFilter
+	if args.Pattern != "" {
+		pathFilter = lib.NewPathInclusionFilter([]string{args.Pattern})
+	}
+	var (
+		repository     *lib.Repository
+		trustedSigners map[string]lib.Ed25519PublicKey
+		err            error
+	)
+	if args.Repository != "" {
+		repository, err = openRepository(ctx, nil, args.Repository, passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	} else {
+		var workspace *ws.Workspace
+		workspace, err = openWorkspace(ctx)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open workspace")
+		}
+		defer workspace.Close() //nolint:errcheck
+		repository, err = openRepository(ctx, workspace, "", passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+		if trustedSigners, err = workspace.TrustedSigners(ctx); err != nil {
+			return err //nolint:wrapcheck
+		}
+	}
+	defer repository.Close() //nolint:errcheck
+	var revisionRange lib.RevisionRange
+	if args.Revision != "" {
+		var chain lib.RevisionChain
+		if chain, err = lib.ReadRevisionChain(ctx, repository); err != nil {
+			return err //nolint:wrapcheck
+		}
+		var tags []lib.Tag
+		if tags, err = repository.Tags(ctx); err != nil {
+			return lib.WrapErrorf(err, "failed to read tags")
+		}
+		if revisionRange, err = chain.ParseRevisionRangeOrTag(args.Revision, tags); err != nil {
+			return err //nolint:wrapcheck
+		}
+	}
+	opts := &ws.LogOptions{
+		PathFilter:     pathFilter,
+		Status:         args.Status,
+		Range:          revisionRange,
+		Verify:         args.Verify,
+		TrustedSigners: trustedSigners,
+	}
+	logs, err := ws.Log(ctx, repository, opts)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	if args.JSON {
+		for i := range logs {
+			if err := printJSON(newJSONRevisionLog(&logs[i], args.Status)); err != nil {
+				return err
+			}
+		}
+		return verifyLogError(logs)
+	}
+	if len(logs) == 0 {
+		fmt.Println("No revisions")
+	}
+	for i, log := range logs {
+		if args.Short {
+			fmt.Println(log.Short())
+		} else {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Println(log.Long())
+		}
+		if !args.Status {
+			continue
+		}
+		fmt.Println()
+		for _, file := range log.Files {
+			fmt.Printf("    %s\n", file.Format())
+		}
+		if args.Short && i < len(logs)-1 {
+			fmt.Println()
+		}
+	}
+	return verifyLogError(logs)
+}
+
+// Return an error if a revision of `log --verify` has an invalid signature or
+// is signed by an untrusted signer.
+func verifyLogError(logs []ws.RevisionLog) error {
+	failed := 0
+	for _, log := range logs {
+		if log.Signature != nil && !log.Signature.OK() {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return lib.WrapErrorKindf(lib.ErrCorrupt, nil, "%d of %d revisions failed the signature verification",
+			failed, len(logs))
+	}
+	return nil
+}
+
+func FindCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help       bool
+		Regexp     bool
+		JSON       bool
+		Repository string
+		PathPrefix string
+		Since      time.Time
+		Until      time.Time
+	}{}
+	flags := flag.NewFlagSet("find", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.BoolVar(&args.Regexp, "regexp", false, "The pattern is a regular expression (RE2 syntax) instead of a glob")
+	flags.BoolVar(&args.JSON, "json", false, jsonFlagDescription)
+	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
+	flags.StringVar(&args.PathPrefix, "path-prefix", "", pathPrefixFlagDescription)
+	flags.Func(
+		"since",
+		"Only show versions that are in a revision at or after this `date` (2006-01-02 or RFC 3339)",
+		func(value string) error {
+			var err error
+			args.Since, err = parseDateFlag(value, false)
+			return err
+		},
+	)
+	flags.Func(
+		"until",
+		"Only search the revisions at or before this `date` (2006-01-02 or RFC 3339)",
+		func(value string) error {
+			var err error
+			args.Until, err = parseDateFlag(value, true)
+			return err
+		},
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s find [flags] <pattern>\n\n", appName)
+		fmt.Fprint(os.Stderr, "Search the paths of all revisions and show every version of the matching\n")
+		fmt.Fprint(os.Stderr, "files: its size and hash, the first and the last revision that contain it,\n")
+		fmt.Fprint(os.Stderr, "and the revision that deleted or changed it.\n")
+		fmt.Fprint(os.Stderr, "\nArguments:\n")
+		fmt.Fprint(os.Stderr, "  pattern\n")
+		fmt.Fprint(os.Stderr, "        A glob pattern like for `ls`, or a regular expression with --regexp.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+		fmt.Fprint(os.Stderr, "\n"+globPatternDescription("")+"\n")
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) != 1 {
+		return lib.Errorf("expected exactly one pattern")
+	}
+	var pathFilter lib.PathFilter = lib.NewPathInclusionFilter(flags.Args())
+	if args.Regexp {
+		re, err := regexp.Compile(flags.Arg(0))
+		if err != nil {
+			return lib.WrapErrorf(err, "invalid regular expression %q", flags.Arg(0))
+		}
+		pathFilter = &lib.PathRegexpFilter{Regexp: re}
+	}
+	var (
+		repository *lib.Repository
+		pathPrefix lib.Path
+		err        error
+	)
+	if args.Repository != "" {
+		repository, err = openRepository(ctx, nil, args.Repository, passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	} else {
+		var workspace *ws.Workspace
+		workspace, err = openWorkspace(ctx)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open workspace")
+		}
+		defer workspace.Close() //nolint:errcheck
+		repository, _, err = openCachedRepository(ctx, workspace, "", passphraseFromStdin, blockCacheRead)
+		if err != nil {
+			return err
+		}
+		pathPrefix = workspace.PathPrefix
+	}
+	defer repository.Close() //nolint:errcheck
+	pathPrefix, err = parsePathPrefix(args.PathPrefix, pathPrefix)
+	if err != nil {
+		return err
+	}
+	matches, err := ws.Find(ctx, repository, &ws.FindOptions{
+		PathFilter: pathFilter,
+		PathPrefix: pathPrefix,
+		Since:      args.Since,
+		Until:      args.Until,
+	})
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	if args.JSON {
+		for i := range matches {
+			if err := printJSON(newJSONFindMatch(&matches[i])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(matches) == 0 {
+		fmt.Println("No matches")
+	}
+	for _, match := range matches {
+		fmt.Println(match.String())
+	}
+	return nil
+}
+
+// Parse the value of a date flag like `find --since`: a date (in local time)
+// or an RFC 3339 timestamp. With `endOfDay`, a date is the last moment of
+// that day, so that `--until 2025-05-01` includes the whole day.
+func parseDateFlag(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+	if err != nil {
+		return time.Time{}, lib.Errorf("invalid date %q, use 2006-01-02 or 2006-01-02T15:04:05Z07:00", value)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return t, nil
+}
+
+func DiffCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help       bool
+		Stat       bool
+		Repository string
+		PathPrefix string
+	}{}
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.BoolVar(&args.Stat, "stat", false, "Only show a summary of the differences")
+	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
+	flags.StringVar(&args.PathPrefix, "path-prefix", "", pathPrefixFlagDescription)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s diff <from-revision> <to-revision> [pattern]\n\n", appName)
+		fmt.Fprint(os.Stderr, "Show the paths that differ between two revisions.\n")
+		fmt.Fprint(os.Stderr, "\nArguments:\n")
+		fmt.Fprint(os.Stderr, "  from-revision, to-revision\n")
+		fmt.Fprint(os.Stderr, "        A revision id, a tag, or `HEAD`, optionally followed by `~<n>`.\n")
+		fmt.Fprint(os.Stderr, "  pattern\n")
+		fmt.Fprint(os.Stderr, "        Only compare paths matching the given pattern.\n"+globPatternDescription("        "))
+		fmt.Fprint(os.Stderr, "\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) < 2 {
+		return lib.Errorf("two positional arguments are required: <from-revision> <to-revision>")
+	}
+	if len(flags.Args()) > 3 {
+		return lib.Errorf("too many positional arguments")
+	}
+	var pathFilter lib.PathFilter
+	if len(flags.Args()) == 3 {
+		pathFilter = lib.NewPathInclusionFilter([]string{flags.Arg(2)})
+	}
+	var (
+		repository *lib.Repository
+		pathPrefix lib.Path
+		err        error
+	)
+	if args.Repository != "" {
+		repository, err = openRepository(ctx, nil, args.Repository, passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	} else {
+		var workspace *ws.Workspace
+		workspace, err = openWorkspace(ctx)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open workspace")
+		}
+		defer workspace.Close() //nolint:errcheck
+		repository, err = openRepository(ctx, workspace, "", passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+		pathPrefix = workspace.PathPrefix
+	}
+	defer repository.Close() //nolint:errcheck
+	pathPrefix, err = parsePathPrefix(args.PathPrefix, pathPrefix)
+	if err != nil {
+		return err
+	}
+	chain, err := lib.ReadRevisionChain(ctx, repository)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to read revision chain")
+	}
+	tags, err := repository.Tags(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to read tags")
+	}
+	from, err := chain.ParseRevisionIdOrTag(flags.Arg(0), tags)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	to, err := chain.ParseRevisionIdOrTag(flags.Arg(1), tags)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	tmpFS, cleanup, err := newTempFS("diff")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	opts := &ws.DiffOptions{From: from, To: to, PathFilter: pathFilter, PathPrefix: pathPrefix}
+	stat, err := ws.Diff(ctx, repository, tmpFS, opts, func(f ws.DiffFile) error {
+		if !args.Stat {
+			fmt.Println(f.Format())
+		}
+		return nil
+	})
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	fmt.Println(stat.Summary())
+	return nil
+}
+
+const (
+	healthCheckReportFile         = "health-check.txt"
+	healthCheckOrphanedBlocksFile = "health-check-orphaned-blocks.txt"
+)
+
+func CheckCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help           bool
+		Verbose        bool
+		NoProgress     bool
+		Data           bool
+		OrphanedBlocks bool
+		Full           bool
+		JSON           bool
+		Repair         bool
+		Yes            bool
+		Repository     string
+		ReportDir      string
+	}{}
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.BoolVar(&args.Verbose, "verbose", false, "Show progress")
+	flags.BoolVar(&args.NoProgress, "no-progress", false, "Do not show progress")
+	flags.BoolVar(&args.Data, "data", false, "Check all file data blocks of all paths in all revisions")
+	flags.BoolVar(&args.OrphanedBlocks, "orphaned-blocks", false,
+		"Detect blocks in storage that are not referenced by any revision")
+	flags.BoolVar(&args.Full, "full", false, "Run all checks (implies --data and --orphaned-blocks)")
+	flags.BoolVar(
+		&args.JSON,
+		"json",
+		false,
+		"Print the result as JSON instead of the report (the report is still saved)",
+	)
+	flags.BoolVar(&args.Repair, "repair", false,
+		"Repair the head and the tags and quarantine corrupt blocks (see --data) instead of failing")
+	flags.BoolVar(&args.Yes, "yes", false, "With --repair, drop corrupt revisions at the head without asking")
+	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
+	flags.StringVar(&args.ReportDir, "report-dir", "", "Directory to write the report to (default: current directory)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s check\n\n", appName)
+		fmt.Fprint(os.Stderr, "Check the health of a repository.\n")
+		fmt.Fprint(os.Stderr, "With --repair, a broken head is reset to the newest intact revision\n")
+		fmt.Fprint(os.Stderr, "(after confirmation) and corrupt blocks are moved to lost-found.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) != 0 {
+		return lib.Errorf("too many positional arguments")
+	}
+	if args.Full {
+		args.Data = true
+		args.OrphanedBlocks = true
+	}
+	if args.JSON && args.Verbose {
+		return lib.Errorf("--json cannot be used with --verbose")
+	}
+	if args.Yes && !args.Repair {
+		return lib.Errorf("--yes can only be used with --repair")
+	}
+	var (
+		repository     *lib.Repository
+		trustedSigners []lib.Ed25519PublicKey
+		err            error
+	)
+	if args.Repository != "" {
+		repository, err = openRepository(ctx, nil, args.Repository, passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	} else {
+		var workspace *ws.Workspace
+		workspace, err = openWorkspace(ctx)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open workspace")
+		}
+		defer workspace.Close() //nolint:errcheck
+		var signers map[string]lib.Ed25519PublicKey
+		signers, err = workspace.TrustedSigners(ctx)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+		trustedSigners = slices.Collect(maps.Values(signers))
+		repository, err = openRepository(ctx, workspace, "", passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	}
+	defer repository.Close() //nolint:errcheck
+	tempFS, cleanup, err := newTempFS("check")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	monitor := NewHeathCheckMonitor(CLIMonitorMode(args.Verbose, args.NoProgress))
+	monitor.Preparing()
+	err = lib.CheckHealth(ctx, repository, tempFS, lib.HealthCheckOptions{
+		Monitor:              monitor,
+		CheckBlocks:          args.Data,
+		CheckOrphanedBlocks:  args.OrphanedBlocks,
+		Repair:               args.Repair,
+		ConfirmDropRevisions: confirmDropRevisions(args.Yes),
+		TrustedSigners:       trustedSigners,
+	})
+	monitor.Finish()
+	monitor.close()
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	reportDir := args.ReportDir
+	if reportDir == "" {
+		reportDir = "."
+	}
+	if err := os.MkdirAll(reportDir, 0o700); err != nil {
+		return lib.WrapErrorf(err, "failed to create %s", reportDir)
+	}
+	reportPath := filepath.Join(reportDir, healthCheckReportFile)
+	orphansPath := filepath.Join(reportDir, healthCheckOrphanedBlocksFile)
+	report, err := monitor.Report(args.Data, args.OrphanedBlocks, orphansPath)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	if !args.JSON {
+		fmt.Print(report)
+	}
+	if err := os.WriteFile(reportPath, []byte(report), 0o600); err != nil {
+		return lib.WrapErrorf(err, "failed to write %s", reportPath)
+	}
+	if args.JSON {
+		return printJSON(newJSONHealthCheck(monitor, args.Data, args.OrphanedBlocks, reportPath, orphansPath))
+	}
+	fmt.Printf("Report saved to: %s\n", reportPath)
+	return nil
+}
+
+// Return the `lib.HealthCheckOptions.ConfirmDropRevisions` of `check
+// --repair`. It asks on the terminal unless `yes` is set.
+func confirmDropRevisions(yes bool) func(revisions []lib.RevisionId) bool {
+	return func(revisions []lib.RevisionId) bool {
+		clearLine()
+		fmt.Fprint(os.Stderr, "The head revision is corrupt, these revisions would be dropped:\n")
+		for _, revisionId := range revisions {
+			fmt.Fprintf(os.Stderr, "  %s\n", revisionId)
+		}
+		if yes {
+			return true
+		}
+		if !IsTerm(os.Stdin) {
+			fmt.Fprint(os.Stderr, "Re-run with --yes to drop them.\n")
+			return false
+		}
+		in := bufio.NewReader(os.Stdin)
+		for {
+			fmt.Fprint(os.Stderr, "Drop them? [y/N] ")
+			line, err := in.ReadString('\n')
+			if err != nil && line == "" {
+				return false
+			}
+			switch strings.ToLower(strings.TrimSpace(line)) {
+			case "y", "yes":
+				return true
+			case "", "n", "no":
+				return false
+			}
+		}
+	}
+}
+
+func ReplicateCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help       bool
+		Verbose    bool
+		NoProgress bool
+		Workers    int
+		Depth      int
+		LatestOnly bool
+	}{}
+	flags := flag.NewFlagSet("replicate", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.BoolVar(&args.Verbose, "verbose", false, "Show every copied block and control file")
+	flags.BoolVar(&args.NoProgress, "no-progress", false, "Do not show progress")
+	flags.IntVar(&args.Workers, "workers", 4, "Number of blocks to copy in parallel")
+	flags.IntVar(&args.Depth, "depth", 0, "Create a shallow mirror with only the latest n revisions")
+	flags.BoolVar(&args.LatestOnly, "latest-only", false, "Create a shallow mirror with only the latest revision")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replicate <source-uri> <target-uri>\n\n", appName)
+		fmt.Fprint(os.Stderr, "Copy all blocks and control files that are missing in the target from the\n")
+		fmt.Fprint(os.Stderr, "source repository. Nothing is decrypted, the target is a mirror that is\n")
+		fmt.Fprint(os.Stderr, "opened with the same passphrases as the source.\n")
+		fmt.Fprint(os.Stderr, "\nArguments:\n")
+		fmt.Fprint(os.Stderr, "  source-uri, target-uri\n")
+		fmt.Fprint(os.Stderr, "        A local directory or an s3+... URI. The target is created if it\n")
+		fmt.Fprint(os.Stderr, "        does not exist.\n")
+		fmt.Fprint(os.Stderr, "\n        In a workspace, `origin` is its repository and the names of its sync\n")
+		fmt.Fprint(os.Stderr, "        targets (see `sync-repo`) can be used as well.\n")
+		fmt.Fprint(os.Stderr, "\n        S3 URIs with encrypted credentials need the repository passphrase to\n")
+		fmt.Fprint(os.Stderr, "        decrypt them. Otherwise the credentials come from the CLING_S3_* /\n")
+		fmt.Fprint(os.Stderr, "        AWS_* env vars.\n")
+		fmt.Fprint(os.Stderr, "\nWith --depth or --latest-only, only the files of the latest revisions are\n")
+		fmt.Fprint(os.Stderr, "copied and the revisions are written again, which needs the passphrase.\n")
+		fmt.Fprint(os.Stderr, "Later runs append the new revisions of the source to such a shallow mirror.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) != 2 {
+		return lib.Errorf("two positional arguments are required: <source-uri> <target-uri>")
+	}
+	if args.Depth < 0 {
+		return lib.Errorf("--depth must not be negative")
+	}
+	if args.LatestOnly {
+		if args.Depth > 1 {
+			return lib.Errorf("--latest-only and --depth are mutually exclusive")
+		}
+		args.Depth = 1
+	}
+	// The passphrase is only read if an S3 URI has encrypted credentials.
+	var passphrase []byte
+	readPassphraseOnce := func() ([]byte, error) {
+		if passphrase != nil {
+			return passphrase, nil
+		}
+		var err error
+		passphrase, err = readPassphrase(passphraseFromStdin)
+		return passphrase, err
+	}
+	srcURI, err := resolveRemoteArg(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	dstURI, err := resolveRemoteArg(ctx, flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	src, err := openReplicationStorage(srcURI, false, readPassphraseOnce, passphraseFromStdin)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open source")
+	}
+	dst, err := openReplicationStorage(dstURI, true, readPassphraseOnce, passphraseFromStdin)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open target")
+	}
+	tempFS, cleanup, err := newTempFS("replicate")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	var repository *lib.Repository
+	if args.Depth > 0 {
+		passphrase, err := readPassphraseOnce()
+		if err != nil {
+			return err
+		}
+		repository, err = lib.OpenRepository(ctx, src, passphrase)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open source repository")
+		}
+		defer repository.Close() //nolint:errcheck
+	}
+	monitor := NewReplicationMonitor(CLIMonitorMode(args.Verbose, args.NoProgress))
+	monitor.Preparing()
+	if repository != nil {
+		err = lib.ReplicateShallow(ctx, repository, dst, tempFS, lib.ShallowReplicationOptions{
+			Monitor: monitor,
+			Workers: args.Workers,
+			Depth:   args.Depth,
+		})
+	} else {
+		err = lib.Replicate(ctx, src, dst, tempFS, lib.ReplicationOptions{Monitor: monitor, Workers: args.Workers})
+	}
+	monitor.close()
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	fmt.Printf(
+		"Copied %d blocks (%s) and %d control files\n",
+		monitor.Blocks,
+		ws.FormatBytes(monitor.Bytes),
+		monitor.ControlFiles,
+	)
+	return nil
+}
+
+// openReplicationStorage opens the storage at `uri` without a repository
+// passphrase unless the S3 credentials in `uri` are encrypted. With `create`,
+// a missing local directory is created.
+func openReplicationStorage( //nolint:ireturn
+	uri string,
+	create bool,
+	getPassphrase func() ([]byte, error),
+	passphraseFromStdin bool,
+) (lib.Storage, error) {
+	if err := clingHTTP.RejectBareHTTPURI(uri); err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	if clingHTTP.S3URIHasEmbeddedCredentials(uri) {
+		passphrase, err := getPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		return ws.OpenStorage(uri, passphrase) //nolint:wrapcheck
+	}
+	if clingHTTP.IsS3StorageURI(uri) {
+		creds, err := readS3Credentials(passphraseFromStdin)
+		if err != nil {
+			return nil, err
+		}
+		cfg, err := clingHTTP.ParseS3Endpoint(uri, creds)
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to parse S3 URI")
+		}
+		client, err := clingHTTP.NewDefaultHTTPClientFromEnv()
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+		return clingHTTP.NewS3StorageClient(cfg, client), nil
+	}
+	if rclone.IsStorageURI(uri) {
+		return rclone.NewStorage(uri) //nolint:wrapcheck
+	}
+	abs, err := filepath.Abs(uri)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to get absolute path for %s", uri)
+	}
+	if create {
+		if err := os.MkdirAll(abs, 0o700); err != nil {
+			return nil, lib.WrapErrorf(err, "failed to create directory %s", abs)
+		}
+	}
+	return ws.OpenStorage(abs, nil) //nolint:wrapcheck
+}
+
+func ReposCmd(argv []string) error {
+	var help bool
+	flags := flag.NewFlagSet("repos", flag.ExitOnError)
+	flags.BoolVar(&help, "help", false, "Show help message")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s repos\n\n", appName)
+		fmt.Fprint(os.Stderr, "List the repository aliases of the user config, which is\n")
+		fmt.Fprint(os.Stderr, "$XDG_CONFIG_HOME/cling-sync/config.toml (default ~/.config/cling-sync/config.toml):\n\n")
+		fmt.Fprint(os.Stderr, "    [repositories]\n")
+		fmt.Fprint(os.Stderr, "    backup = \"s3+https://host:4242/backup\"\n\n")
+		fmt.Fprint(os.Stderr, "An alias can be used wherever a repository URI is expected,\n")
+		fmt.Fprintf(os.Stderr, "e.g. `%s attach backup ~/data` or `--repository backup`.\n", appName)
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if help {
+		flags.Usage()
+		return nil
+	}
+	if flags.NArg() != 0 {
+		return lib.Errorf("too many positional arguments")
+	}
+	config, path, err := readUserConfig()
+	if err != nil {
+		return err
+	}
+	aliases := config.Section(userConfigRepositoriesSection)
+	if len(aliases) == 0 {
+		fmt.Printf("No repository aliases configured in %s.\n", path)
+		return nil
+	}
+	names := slices.Sorted(maps.Keys(aliases))
+	nameWidth := 0
+	for _, name := range names {
+		nameWidth = max(nameWidth, len(name))
+	}
+	for _, name := range names {
+		fmt.Printf("%-*s  %s\n", nameWidth, name, aliases[name])
+	}
+	return nil
+}
+
+func ScrubCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help       bool
+		Verbose    bool
+		NoProgress bool
+		Percent    float64
+		Blocks     int
+		Repository string
+	}{}
+	flags := flag.NewFlagSet("scrub", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.BoolVar(&args.Verbose, "verbose", false, "Show every verified block")
+	flags.BoolVar(&args.NoProgress, "no-progress", false, "Do not show progress")
+	flags.Float64Var(&args.Percent, "percent", 5, "Percentage of all blocks to verify")
+	flags.IntVar(&args.Blocks, "blocks", 0, "Number of blocks to verify (instead of --percent)")
+	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s scrub\n\n", appName)
+		fmt.Fprint(os.Stderr, "Verify that a part of the blocks in the repository decrypt and match their id.\n")
+		fmt.Fprint(os.Stderr, "Each run continues where the last one stopped, so that repeated runs\n")
+		fmt.Fprint(os.Stderr, "eventually cover the whole repository.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) != 0 {
+		return lib.Errorf("too many positional arguments")
+	}
+	if args.Percent <= 0 || args.Percent > 100 {
+		return lib.Errorf("--percent must be greater than 0 and at most 100")
+	}
+	if args.Blocks < 0 {
+		return lib.Errorf("--blocks must not be negative")
+	}
+	var (
+		repository *lib.Repository
+		err        error
+	)
+	if args.Repository != "" {
+		repository, err = openRepository(ctx, nil, args.Repository, passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	} else {
+		var workspace *ws.Workspace
+		workspace, err = openWorkspace(ctx)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open workspace")
+		}
+		defer workspace.Close() //nolint:errcheck
+		repository, err = openRepository(ctx, workspace, "", passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	}
+	defer repository.Close() //nolint:errcheck
+	tempFS, cleanup, err := newTempFS("scrub")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	monitor := NewScrubMonitor(CLIMonitorMode(args.Verbose, args.NoProgress))
+	monitor.Preparing()
+	result, err := lib.Scrub(ctx, repository, tempFS, lib.ScrubOptions{
+		Monitor: monitor,
+		Blocks:  args.Blocks,
+		Percent: args.Percent,
+	})
+	monitor.close()
+	if result == nil {
+		return err //nolint:wrapcheck
+	}
+	fmt.Printf(
+		"Verified %d of %d blocks (%s), %d corrupt\n",
+		result.Verified,
+		result.Blocks,
+		ws.FormatBytes(result.Bytes),
+		len(result.Corrupt),
+	)
+	if result.CompletedCycle {
+		fmt.Print("Every block in the repository has been verified, the next run starts over\n")
+	} else if result.Blocks > 0 {
+		p := result.Progress
+		fmt.Printf(
+			"Cycle %d (started %s): %d%% of the repository verified\n",
+			p.Cycle,
+			p.CycleStart.Format(time.RFC3339),
+			min(p.Verified*100/result.Blocks, 100),
+		)
 	}
-	mon.Preparing()
-	result, err := ws.Status(ctx, workspace, repository, opts, tmpFS)
-	mon.close()
 	if err != nil {
-		return err //nolint:wrapcheck
+		fmt.Printf("Run `%s check --data --repair` to quarantine the corrupt blocks\n", appName)
 	}
-	if args.Short {
-		fmt.Println(result.Summary())
+	return err //nolint:wrapcheck
+}
+
+func PackCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help       bool
+		Verbose    bool
+		NoProgress bool
+		PackSize   int
+		Repository string
+	}{}
+	flags := flag.NewFlagSet("pack", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.BoolVar(&args.Verbose, "verbose", false, "Show every written pack")
+	flags.BoolVar(&args.NoProgress, "no-progress", false, "Do not show progress")
+	byteSizeFlag(
+		flags,
+		"pack-size",
+		fmt.Sprintf("Start a new pack once a pack holds this many bytes (default %d)", lib.DefaultPackSize),
+		&args.PackSize,
+	)
+	flags.StringVar(
+		&args.Repository,
+		"repository",
+		"",
+		"Pack this local repository instead of the workspace repository",
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s pack\n\n", appName)
+		fmt.Fprint(os.Stderr, "Move the blocks of a local repository into a few large pack files.\n")
+		fmt.Fprint(os.Stderr, "Every block is stored as a file of its own first, this keeps the number\n")
+		fmt.Fprint(os.Stderr, "of files in the repository down. No passphrase is needed.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
 		return nil
 	}
-	for _, file := range result {
-		fmt.Println(file.Format())
+	if len(flags.Args()) != 0 {
+		return lib.Errorf("too many positional arguments")
 	}
-	if !args.NoSummary {
-		fmt.Println(result.Summary())
+	if args.PackSize < 0 || args.PackSize > lib.MaxPackSize {
+		return lib.Errorf("--pack-size must be at most %s", ws.FormatBytes(lib.MaxPackSize))
 	}
-	return nil
+	uri := args.Repository
+	if uri == "" {
+		workspace, err := openWorkspace(ctx)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open workspace")
+		}
+		defer workspace.Close() //nolint:errcheck
+		uri = string(workspace.RemoteRepository)
+	}
+	if clingHTTP.IsS3StorageURI(uri) {
+		return lib.Errorf("only local repositories can be packed, run `pack` where the repository is stored")
+	}
+	storage, _, err := openStorage(uri, nil, passphraseFromStdin)
+	if err != nil {
+		return err
+	}
+	fileStorage, ok := storage.(*lib.FileStorage)
+	if !ok {
+		return lib.Errorf("only local repositories can be packed")
+	}
+	if _, err := fileStorage.Open(ctx); err != nil {
+		return lib.WrapErrorf(err, "failed to open repository %s", uri)
+	}
+	monitor := NewPackMonitor(CLIMonitorMode(args.Verbose, args.NoProgress))
+	result, err := lib.PackBlocks(ctx, fileStorage, lib.PackOptions{Monitor: monitor, PackSize: args.PackSize})
+	monitor.close()
+	if result != nil {
+		fmt.Printf("Packed %d blocks (%s) into %d packs\n", result.Blocks, ws.FormatBytes(result.Bytes), result.Packs)
+	}
+	return err //nolint:wrapcheck
 }
 
-func parsePathPrefix(flag string, default_ lib.Path) (lib.Path, error) {
-	switch flag {
-	case "":
-		return default_, nil
-	case "/":
-		return lib.Path{}, nil
-	default:
-		prefix, err := ws.ValidatePathPrefix(flag)
+func StatsCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help         bool
+		Revisions    bool
+		LargestFiles int
+		Repository   string
+	}{}
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.BoolVar(&args.Revisions, "revisions", false, "Show the statistics of each revision")
+	flags.IntVar(&args.LargestFiles, "largest-files", 10, "Number of largest files to show")
+	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s stats\n\n", appName)
+		fmt.Fprint(os.Stderr, "Show size and deduplication statistics of the repository.\n")
+		fmt.Fprint(os.Stderr, "Only the revision metadata is read, no file data is downloaded.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) > 0 {
+		return lib.Errorf("too many positional arguments")
+	}
+	var (
+		repository *lib.Repository
+		err        error
+	)
+	if args.Repository != "" {
+		repository, err = openRepository(ctx, nil, args.Repository, passphraseFromStdin)
 		if err != nil {
-			return lib.Path{}, lib.WrapErrorf(err, "invalid path prefix %q", flag)
+			return err
 		}
-		return prefix, nil
+	} else {
+		var workspace *ws.Workspace
+		workspace, err = openWorkspace(ctx)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open workspace")
+		}
+		defer workspace.Close() //nolint:errcheck
+		repository, err = openRepository(ctx, workspace, "", passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	}
+	defer repository.Close() //nolint:errcheck
+	stats, err := lib.ComputeStats(ctx, repository, lib.StatsOptions{LargestFiles: args.LargestFiles})
+	if err != nil {
+		return err //nolint:wrapcheck
 	}
+	printStats(stats, args.Revisions)
+	return nil
 }
 
-func LsCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+func DuCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
 	args := struct { //nolint:exhaustruct
-		Help            bool
-		Revision        string
-		Short           bool
-		Human           bool
-		TimestampFormat string
-		ShortFileMode   bool
-		FileHash        bool
-		Repository      string
-		PathPrefix      string
-	}{
-		TimestampFormat: time.RFC3339,
-	}
-	flags := flag.NewFlagSet("ls", flag.ExitOnError)
+		Help       bool
+		Revision   string
+		Top        int
+		Repository string
+		PathPrefix string
+	}{}
+	flags := flag.NewFlagSet("du", flag.ExitOnError)
 	flags.BoolVar(&args.Help, "help", false, "Show help message")
 	flags.StringVar(&args.Revision, "revision", "HEAD", "Revision to show")
+	flags.IntVar(&args.Top, "top", 10, "Number of largest directories and files to show")
 	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
 	flags.StringVar(&args.PathPrefix, "path-prefix", "", pathPrefixFlagDescription)
-	flags.BoolVar(&args.Short, "short", false, "Show short listing (same as --timestamp-format=relative)")
-	flags.BoolVar(&args.FileHash, "file-hash", false, "Show file hash")
-	flags.BoolVar(
-		&args.Human,
-		"human",
-		false,
-		"Show human readable file sizes (same as --timestamp-format=rfc3339 --full-file-mode)",
-	)
-	flags.Func(
-		"timestamp-format",
-		"Timestamp format: relative, rfc3339, unix, unix-fraction (default rfc3339)",
-		func(value string) error {
-			if value != "relative" && value != "rfc3339" && value != "unix" && value != "unix-fraction" {
-				return lib.Errorf("invalid timestamp-format: %s", value)
-			}
-			if value == "rfc3339" {
-				value = time.RFC3339
-			}
-			args.TimestampFormat = value
-			return nil
-		},
-	)
-	flags.BoolVar(
-		&args.ShortFileMode,
-		"short-file-mode",
-		false,
-		"Show short file mode (only permissions and file type)",
-	)
 	flags.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s ls [pattern]\n\n", appName)
-		fmt.Fprint(os.Stderr, "List files in the repository.\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s du [path]\n\n", appName)
+		fmt.Fprint(os.Stderr, "Show the logical and the deduplicated size of a directory of a revision\n")
+		fmt.Fprint(os.Stderr, "and of its largest directories and files.\n")
+		fmt.Fprint(os.Stderr, "Only the revision metadata is read, no file data is downloaded.\n")
 		fmt.Fprint(os.Stderr, "\nArguments:\n")
-		fmt.Fprint(os.Stderr, "  pattern\n")
-		fmt.Fprint(os.Stderr, "        The pattern syntax is the same as for the `commit --ignore` option.\n")
+		fmt.Fprint(os.Stderr, "  path\n")
+		fmt.Fprint(os.Stderr, "        The directory to show (default: all paths)\n")
 		fmt.Fprint(os.Stderr, "\nFlags:\n")
 		flags.PrintDefaults()
 	}
-	if err := flags.Parse(argv); err != nil {
-		return err //nolint:wrapcheck
+	if err := parseFlags(flags, argv); err != nil {
+		return err
 	}
 	if args.Help {
 		flags.Usage()
 		return nil
 	}
-	var pathFilter lib.PathFilter
-	if len(flags.Args()) == 1 {
-		pathFilter = lib.NewPathInclusionFilter([]string{flags.Arg(0)})
-	}
 	if len(flags.Args()) > 1 {
 		return lib.Errorf("too many positional arguments")
 	}
+	var path lib.Path
+	if len(flags.Args()) == 1 {
+		var err error
+		path, err = lib.NewPath(strings.TrimSuffix(flags.Arg(0), "/"))
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+	}
 	var (
 		repository *lib.Repository
 		pathPrefix lib.Path
@@ -937,253 +4465,327 @@ func LsCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error {
 	if err != nil {
 		return err
 	}
-	opts := &ws.LsOptions{RevisionId: revisionId, PathFilter: pathFilter, PathPrefix: pathPrefix}
-	tmpFS, cleanup, err := newTempFS("ls")
+	tmpFS, cleanup, err := newTempFS("du")
 	if err != nil {
 		return err
 	}
 	defer cleanup()
-	files, err := ws.Ls(ctx, repository, tmpFS, opts)
+	report, err := lib.ComputeDiskUsage(
+		ctx,
+		repository,
+		tmpFS,
+		lib.DiskUsageOptions{RevisionId: revisionId, PathPrefix: pathPrefix, Path: path, Top: args.Top},
+	)
 	if err != nil {
 		return err //nolint:wrapcheck
 	}
-	if args.Short {
-		args.TimestampFormat = "relative"
-		args.ShortFileMode = true
+	printDiskUsage(report)
+	return nil
+}
+
+func DebugCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error {
+	args := struct { //nolint:exhaustruct
+		Help bool
+	}{}
+	flags := flag.NewFlagSet("debug", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s debug [command]\n\n", appName)
+		fmt.Fprint(os.Stderr, "Diagnose problems with a repository.\n\n")
+		fmt.Fprint(os.Stderr, "Commands:\n")
+		fmt.Fprint(os.Stderr, "  locks\n")
+		fmt.Fprint(os.Stderr, "        List the locks that are held right now, with their age and owner.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
 	}
-	if args.Human {
-		args.TimestampFormat = "rfc3339"
-		args.ShortFileMode = false
+	if err := parseFlags(flags, argv); err != nil {
+		return err
 	}
-	format := &ws.LsFormat{
-		FullPath:          true,
-		FullMode:          !args.ShortFileMode,
-		FileHash:          args.FileHash,
-		TimestampFormat:   args.TimestampFormat,
-		HumanReadableSize: args.Human,
+	if args.Help {
+		flags.Usage()
+		return nil
 	}
-	for i, file := range files {
-		if args.Short && file.Metadata.FileMode.IsDir() && i > 0 {
-			fmt.Println()
-		}
-		fmt.Println(file.Format(format))
+	if len(flags.Args()) == 0 {
+		return lib.Errorf("missing command")
+	}
+	switch flags.Arg(0) {
+	case "locks":
+		return debugLocksCmd(ctx, flags.Args()[1:], passphraseFromStdin)
+	default:
+		return lib.Errorf("unknown command: %s", flags.Arg(0))
 	}
-	return nil
 }
 
-func LogCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+func debugLocksCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
 	args := struct { //nolint:exhaustruct
 		Help       bool
-		Short      bool
-		Status     bool
+		StaleAfter time.Duration
 		Repository string
-		Pattern    string
-		Revision   string
 	}{}
-	flags := flag.NewFlagSet("log", flag.ExitOnError)
+	flags := flag.NewFlagSet("debug locks", flag.ExitOnError)
 	flags.BoolVar(&args.Help, "help", false, "Show help message")
-	flags.BoolVar(&args.Short, "short", false, "Show short log")
-	flags.BoolVar(&args.Status, "status", false, "Show status of paths affected in a revision")
+	flags.DurationVar(&args.StaleAfter, "stale-after", 10*time.Minute, "Flag locks older than this as possibly stale")
 	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
-	flags.StringVar(&args.Pattern, "pattern", "", "Show log only for paths matching the given pattern")
-	flags.StringVar(&args.Revision, "revision", "",
-		"Revision to show, or a range `<old>..<new>` which excludes `<old>` (like git). Defaults to the head revision.")
 	flags.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s log\n\n", appName)
-		fmt.Fprint(os.Stderr, "Show revision log.\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s debug locks\n\n", appName)
+		fmt.Fprint(os.Stderr, "List the locks of the repository that are held right now.\n")
+		fmt.Fprint(os.Stderr, "A commit that hangs or fails with \"lock held\" waits for one of them.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) > 0 {
+		return lib.Errorf("too many positional arguments")
+	}
+	uri := args.Repository
+	var passphrase []byte
+	var err error
+	if uri == "" {
+		workspace, err := openWorkspace(ctx)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open workspace")
+		}
+		defer workspace.Close() //nolint:errcheck
+		uri = string(workspace.RemoteRepository)
+		// Only needed to decrypt the credentials of S3 URIs.
+		if clingHTTP.IsS3StorageURI(uri) {
+			passphrase, err = readWorkspaceRepositoryPassphrase(ctx, workspace, passphraseFromStdin)
+		}
+	} else if clingHTTP.IsS3StorageURI(uri) {
+		passphrase, err = readPassphrase(passphraseFromStdin)
+	}
+	if err != nil {
+		return err
+	}
+	storage, _, err := openStorage(uri, passphrase, passphraseFromStdin)
+	if err != nil {
+		return err
+	}
+	locks, err := storage.ListLocks(ctx)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	if len(locks) == 0 {
+		fmt.Println("No locks are held")
+		return nil
+	}
+	stale := false
+	for _, lock := range locks {
+		fmt.Println(formatLockInfo(lock, args.StaleAfter))
+		if !lock.CreatedAt.IsZero() && time.Since(lock.CreatedAt) > args.StaleAfter {
+			stale = true
+		}
+	}
+	if stale {
+		fmt.Printf("\nLocks older than %s might belong to a client that crashed.\n", args.StaleAfter)
+		fmt.Print("Locks held through `serve` are released when `serve` is restarted.\n")
+	}
+	return nil
+}
+
+func FleetCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error {
+	args := struct { //nolint:exhaustruct
+		Help bool
+	}{}
+	flags := flag.NewFlagSet("fleet", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s fleet [command]\n\n", appName)
+		fmt.Fprint(os.Stderr, "Work with several workspaces on this machine at once.\n\n")
+		fmt.Fprint(os.Stderr, "Commands:\n")
+		fmt.Fprint(os.Stderr, "  status --config <path>\n")
+		fmt.Fprint(os.Stderr, "        Show how far behind each workspace is and how many local changes it has.\n")
 		fmt.Fprint(os.Stderr, "\nFlags:\n")
 		flags.PrintDefaults()
-		fmt.Fprint(os.Stderr, "\n"+globPatternDescription("")+"\n")
 	}
-	if err := flags.Parse(argv); err != nil {
-		return err //nolint:wrapcheck
+	if err := parseFlags(flags, argv); err != nil {
+		return err
 	}
 	if args.Help {
 		flags.Usage()
 		return nil
 	}
-	if len(flags.Args()) > 0 {
-		return lib.Errorf("too many positional arguments")
-	}
-	var pathFilter lib.PathFilter
-	if args.Pattern != "" {
-		pathFilter = lib.NewPathInclusionFilter([]string{args.Pattern})
-	}
-	var (
-		repository *lib.Repository
-		err        error
-	)
-	if args.Repository != "" {
-		repository, err = openRepository(ctx, nil, args.Repository, passphraseFromStdin)
-		if err != nil {
-			return err
-		}
-	} else {
-		var workspace *ws.Workspace
-		workspace, err = openWorkspace(ctx)
-		if err != nil {
-			return lib.WrapErrorf(err, "failed to open workspace")
-		}
-		defer workspace.Close() //nolint:errcheck
-		repository, err = openRepository(ctx, workspace, "", passphraseFromStdin)
-		if err != nil {
-			return err
-		}
+	if len(flags.Args()) == 0 {
+		return lib.Errorf("missing command")
 	}
-	defer repository.Close() //nolint:errcheck
-	var revisionRange lib.RevisionRange
-	if args.Revision != "" {
-		var chain lib.RevisionChain
-		if chain, err = lib.ReadRevisionChain(ctx, repository); err != nil {
-			return err //nolint:wrapcheck
-		}
-		if revisionRange, err = chain.ParseRevisionRange(args.Revision); err != nil {
-			return err //nolint:wrapcheck
-		}
+	switch flags.Arg(0) {
+	case "status":
+		return fleetStatusCmd(ctx, flags.Args()[1:], passphraseFromStdin)
+	default:
+		return lib.Errorf("unknown command: %s", flags.Arg(0))
 	}
-	opts := &ws.LogOptions{PathFilter: pathFilter, Status: args.Status, Range: revisionRange}
-	logs, err := ws.Log(ctx, repository, opts)
+}
+
+// The workspaces of a fleet, read from the `[workspaces]` section of the
+// fleet config (`<name> = "<path>"`), sorted by name.
+func readFleetConfig(path string) ([][2]string, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return err //nolint:wrapcheck
-	}
-	if len(logs) == 0 {
-		fmt.Println("No revisions")
+		return nil, lib.WrapErrorf(err, "failed to open fleet config %s", path)
 	}
-	for i, log := range logs {
-		if args.Short {
-			fmt.Println(log.Short())
-		} else {
-			if i > 0 {
-				fmt.Println()
+	defer f.Close() //nolint:errcheck
+	toml, err := lib.ReadToml(f)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to parse fleet config %s", path)
+	}
+	workspaces := toml["workspaces"]
+	if len(workspaces) == 0 {
+		return nil, lib.Errorf("fleet config %s has no workspaces, add them under [workspaces]", path)
+	}
+	result := make([][2]string, 0, len(workspaces))
+	for _, name := range slices.Sorted(maps.Keys(workspaces)) {
+		dir := workspaces[name]
+		if strings.HasPrefix(dir, "~/") {
+			if home, err := os.UserHomeDir(); err == nil {
+				dir = filepath.Join(home, dir[2:])
 			}
-			fmt.Println(log.Long())
-		}
-		if !args.Status {
-			continue
-		}
-		fmt.Println()
-		for _, file := range log.Files {
-			fmt.Printf("    %s\n", file.Format())
-		}
-		if args.Short && i < len(logs)-1 {
-			fmt.Println()
 		}
+		result = append(result, [2]string{name, dir})
 	}
-	return nil
+	return result, nil
 }
 
-const (
-	healthCheckReportFile         = "health-check.txt"
-	healthCheckOrphanedBlocksFile = "health-check-orphaned-blocks.txt"
-)
+type fleetStatusRow struct {
+	Name string
+	Path string
+	// Revisions in the repository the workspace has not merged yet.
+	Behind int
+	// Local changes that are not committed yet.
+	Changes  int
+	LastSync time.Time
+	Err      error
+}
 
-func CheckCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+func fleetStatusCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
 	args := struct { //nolint:exhaustruct
-		Help           bool
-		Verbose        bool
-		NoProgress     bool
-		Data           bool
-		OrphanedBlocks bool
-		Full           bool
-		Repository     string
-		ReportDir      string
+		Help   bool
+		Config string
 	}{}
-	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags := flag.NewFlagSet("fleet status", flag.ExitOnError)
 	flags.BoolVar(&args.Help, "help", false, "Show help message")
-	flags.BoolVar(&args.Verbose, "verbose", false, "Show progress")
-	flags.BoolVar(&args.NoProgress, "no-progress", false, "Do not show progress")
-	flags.BoolVar(&args.Data, "data", false, "Check all file data blocks of all paths in all revisions")
-	flags.BoolVar(&args.OrphanedBlocks, "orphaned-blocks", false,
-		"Detect blocks in storage that are not referenced by any revision")
-	flags.BoolVar(&args.Full, "full", false, "Run all checks (implies --data and --orphaned-blocks)")
-	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
-	flags.StringVar(&args.ReportDir, "report-dir", "", "Directory to write the report to (default: current directory)")
+	flags.StringVar(&args.Config, "config", "", "Fleet config listing the workspaces (required)")
 	flags.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s check\n\n", appName)
-		fmt.Fprint(os.Stderr, "Check the health of a repository.\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s fleet status --config <path>\n\n", appName)
+		fmt.Fprint(os.Stderr, "Show the status of all workspaces listed in the fleet config:\n\n")
+		fmt.Fprint(os.Stderr, "    [workspaces]\n")
+		fmt.Fprint(os.Stderr, "    documents = \"~/Documents\"\n")
+		fmt.Fprint(os.Stderr, "    photos = \"/mnt/data/photos\"\n\n")
+		fmt.Fprint(os.Stderr, "BEHIND is the number of revisions not merged into the workspace yet,\n")
+		fmt.Fprint(os.Stderr, "CHANGES the number of local changes (detected like `status --fast-scan`),\n")
+		fmt.Fprint(os.Stderr, "and LAST SYNC the time of the revision the workspace was last merged with.\n")
+		fmt.Fprint(os.Stderr, "Workspaces without a saved passphrase share the passphrase entered once.\n")
 		fmt.Fprint(os.Stderr, "\nFlags:\n")
 		flags.PrintDefaults()
 	}
-	if err := flags.Parse(argv); err != nil {
-		return err //nolint:wrapcheck
+	if err := parseFlags(flags, argv); err != nil {
+		return err
 	}
 	if args.Help {
 		flags.Usage()
 		return nil
 	}
 	if len(flags.Args()) != 0 {
-		return lib.Errorf("too many positional arguments")
-	}
-	if args.Full {
-		args.Data = true
-		args.OrphanedBlocks = true
+		return lib.Errorf("no positional arguments allowed")
 	}
-	var (
-		repository *lib.Repository
-		err        error
-	)
-	if args.Repository != "" {
-		repository, err = openRepository(ctx, nil, args.Repository, passphraseFromStdin)
-		if err != nil {
-			return err
-		}
-	} else {
-		var workspace *ws.Workspace
-		workspace, err = openWorkspace(ctx)
-		if err != nil {
-			return lib.WrapErrorf(err, "failed to open workspace")
-		}
-		defer workspace.Close() //nolint:errcheck
-		repository, err = openRepository(ctx, workspace, "", passphraseFromStdin)
-		if err != nil {
-			return err
-		}
+	if args.Config == "" {
+		return lib.Errorf("--config is required")
 	}
-	defer repository.Close() //nolint:errcheck
-	tempFS, cleanup, err := newTempFS("check")
+	workspaces, err := readFleetConfig(args.Config)
 	if err != nil {
 		return err
 	}
-	defer cleanup()
-	monitor := NewHeathCheckMonitor(CLIMonitorMode(args.Verbose, args.NoProgress))
-	monitor.Preparing()
-	err = lib.CheckHealth(ctx, repository, tempFS, lib.HealthCheckOptions{
-		Monitor:             monitor,
-		CheckBlocks:         args.Data,
-		CheckOrphanedBlocks: args.OrphanedBlocks,
-	})
-	monitor.Finish()
-	monitor.close()
+	readPassphraseOnce := sync.OnceValues(func() ([]byte, error) { return readPassphrase(passphraseFromStdin) })
+	rows := make([]fleetStatusRow, 0, len(workspaces))
+	failed := 0
+	for _, w := range workspaces {
+		row := fleetStatus(ctx, w[0], w[1], readPassphraseOnce, passphraseFromStdin)
+		if row.Err != nil {
+			failed++
+		}
+		rows = append(rows, row)
+	}
+	printFleetStatus(rows)
+	if failed > 0 {
+		return lib.Errorf("failed to get the status of %d workspace(s)", failed)
+	}
+	return nil
+}
+
+func fleetStatus(
+	ctx context.Context,
+	name string,
+	dir string,
+	readPassphraseOnce func() ([]byte, error),
+	passphraseFromStdin bool,
+) fleetStatusRow {
+	row := fleetStatusRow{Name: name, Path: dir} //nolint:exhaustruct
+	workspace, err := openWorkspaceAt(ctx, dir)
 	if err != nil {
-		return err //nolint:wrapcheck
+		row.Err = lib.WrapErrorf(err, "failed to open workspace")
+		return row
 	}
-	reportDir := args.ReportDir
-	if reportDir == "" {
-		reportDir = "."
+	defer workspace.Close() //nolint:errcheck
+	repository, err := openSharedPassphraseRepository(ctx, workspace, readPassphraseOnce, passphraseFromStdin)
+	if err != nil {
+		row.Err = err
+		return row
 	}
-	if err := os.MkdirAll(reportDir, 0o700); err != nil {
-		return lib.WrapErrorf(err, "failed to create %s", reportDir)
+	defer repository.Close() //nolint:errcheck
+	wsHead, err := workspace.Head(ctx)
+	if err != nil {
+		row.Err = err
+		return row
 	}
-	reportPath := filepath.Join(reportDir, healthCheckReportFile)
-	orphansPath := filepath.Join(reportDir, healthCheckOrphanedBlocksFile)
-	report, err := monitor.Report(args.Data, args.OrphanedBlocks, orphansPath)
+	chain, err := lib.ReadRevisionChain(ctx, repository)
 	if err != nil {
-		return err //nolint:wrapcheck
+		row.Err = err
+		return row
+	}
+	row.Behind = len(chain)
+	if !wsHead.IsRoot() {
+		row.Behind = slices.Index(chain, wsHead)
+		if row.Behind < 0 {
+			row.Err = lib.Errorf("workspace head %s is not in the repository's revision chain", wsHead)
+			return row
+		}
+		revision, err := repository.ReadRevision(ctx, wsHead, lib.NewBlockBuf())
+		if err != nil {
+			row.Err = err
+			return row
+		}
+		row.LastSync = revision.Timestamp.Time()
 	}
-	fmt.Print(report)
-	if err := os.WriteFile(reportPath, []byte(report), 0o600); err != nil {
-		return lib.WrapErrorf(err, "failed to write %s", reportPath)
+	tmpFS, err := workspace.TempFS.MkSub("status")
+	if err != nil {
+		row.Err = err
+		return row
+	}
+	mon := NewStatusMonitor(ws.DefaultMonitorModeSilent, newProgress(false))
+	summary, err := ws.StatusStream(ctx, workspace, repository, &ws.StatusOptions{
+		PathFilter: nil,
+		Monitor:    mon,
+		RestorableMetadataFlag: lib.RestorableMetadataAll ^
+			lib.RestorableMetadataOwnership ^ lib.RestorableMetadataMTime ^ lib.RestorableMetadataMode ^
+			lib.RestorableMetadataXattrs,
+		UseStagingCache: true,
+		WatchJournal:    nil,
+	}, tmpFS, func(ws.StatusFile) error { return nil })
+	mon.close()
+	if err != nil {
+		row.Err = err
+		return row
 	}
-	fmt.Printf("Report saved to: %s\n", reportPath)
-	return nil
+	row.Changes = summary.Total()
+	return row
 }
 
 func SyncRepoCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen,gocognit
-	workspace, err := openWorkspace(ctx)
-	if err != nil {
-		return lib.WrapErrorf(err, "failed to open workspace")
-	}
-	defer workspace.Close() //nolint:errcheck
 	var help bool
 	flags := flag.NewFlagSet("sync-repo", flag.ExitOnError)
 	flags.BoolVar(&help, "help", false, "Show help message")
@@ -1191,6 +4793,7 @@ func SyncRepoCmd(ctx context.Context, argv []string, passphraseFromStdin bool) e
 		fmt.Fprintf(os.Stderr, "Usage: %s sync-repo <command> [args]\n\n", appName)
 		fmt.Fprint(os.Stderr, "Manage and run mirror copies of this repository.\n\n")
 		fmt.Fprint(os.Stderr, "Commands:\n")
+		fmt.Fprint(os.Stderr, "  import       Commit a tar archive or a directory without a workspace\n")
 		fmt.Fprint(os.Stderr, "  init <name> <dir>\n")
 		fmt.Fprint(os.Stderr, "        Create a new local repository at `dir` and register it as `name`.\n")
 		fmt.Fprint(os.Stderr, "  add <name> <uri>\n")
@@ -1203,17 +4806,24 @@ func SyncRepoCmd(ctx context.Context, argv []string, passphraseFromStdin bool) e
 		fmt.Fprint(os.Stderr, "        Sync to every registered target, or to a single named target.\n")
 		fmt.Fprint(os.Stderr, "        Failures are reported but do not stop subsequent targets.\n")
 		fmt.Fprint(os.Stderr, "        Run `sync-repo run --help` for its flags.\n")
-		fmt.Fprint(os.Stderr, "\nNames must be ASCII alphanumeric including '-'.\n")
+		fmt.Fprint(os.Stderr, "\nNames must be ASCII alphanumeric including '-', `origin` is reserved for the\n")
+		fmt.Fprint(os.Stderr, "repository of the workspace. The names work with `merge --remote` and\n")
+		fmt.Fprint(os.Stderr, "`replicate`.\n")
 		fmt.Fprint(os.Stderr, "\nFlags:\n")
 		flags.PrintDefaults()
 	}
-	if err := flags.Parse(argv); err != nil {
-		return err //nolint:wrapcheck
+	if err := parseFlags(flags, argv); err != nil {
+		return err
 	}
 	if help {
 		flags.Usage()
 		return nil
 	}
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
 	if len(flags.Args()) == 0 {
 		flags.Usage()
 		return lib.Errorf("missing command")
@@ -1258,7 +4868,11 @@ func SyncRepoCmd(ctx context.Context, argv []string, passphraseFromStdin bool) e
 			if err != nil {
 				return lib.WrapErrorf(err, "failed to decode S3 target URI")
 			}
-			storage := clingHTTP.NewS3StorageClient(cfg, clingHTTP.NewDefaultHTTPClient(nil))
+			client, err := clingHTTP.NewDefaultHTTPClientFromEnv()
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+			storage := clingHTTP.NewS3StorageClient(cfg, client)
 			if err := storage.Init(ctx, toml, lib.RepositoryConfigHeaderComment); err != nil {
 				return lib.WrapErrorf(err, "failed to initialize S3 target repository")
 			}
@@ -1271,6 +4885,23 @@ func SyncRepoCmd(ctx context.Context, argv []string, passphraseFromStdin bool) e
 			fmt.Printf("Initialized and registered sync target %q at %s\n", name, encryptedURI)
 			return nil
 		}
+		if rclone.IsStorageURI(rawTarget) {
+			storage, err := rclone.NewStorage(rawTarget)
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+			if err := storage.Init(ctx, toml, lib.RepositoryConfigHeaderComment); err != nil {
+				return lib.WrapErrorf(err, "failed to initialize rclone target repository")
+			}
+			if err := lib.WriteRef(ctx, storage, "head", lib.RevisionId{}); err != nil {
+				return lib.WrapErrorf(err, "failed to write head reference")
+			}
+			if err := ws.AddSyncTarget(ctx, workspace, name, rawTarget, passphrase); err != nil {
+				return lib.WrapErrorf(err, "target was initialized but could not be registered")
+			}
+			fmt.Printf("Initialized and registered sync target %q at %s\n", name, rawTarget)
+			return nil
+		}
 		targetRepositoryPath, err := filepath.Abs(rawTarget)
 		if err != nil {
 			return lib.WrapErrorf(err, "failed to get absolute path for %s", rawTarget)
@@ -1303,7 +4934,10 @@ func SyncRepoCmd(ctx context.Context, argv []string, passphraseFromStdin bool) e
 			return lib.Errorf("usage: sync-repo add <name> <uri>")
 		}
 		name := posArgs[0]
-		uri := posArgs[1]
+		uri, err := resolveRepositoryAlias(posArgs[1])
+		if err != nil {
+			return err
+		}
 		if err := clingHTTP.RejectBareHTTPURI(uri); err != nil {
 			return err //nolint:wrapcheck
 		}
@@ -1326,6 +4960,7 @@ func SyncRepoCmd(ctx context.Context, argv []string, passphraseFromStdin bool) e
 			if err != nil {
 				return err
 			}
+		case rclone.IsStorageURI(uri):
 		default:
 			abs, err := filepath.Abs(uri)
 			if err != nil {
@@ -1478,6 +5113,104 @@ func SyncRepoCmd(ctx context.Context, argv []string, passphraseFromStdin bool) e
 	}
 }
 
+func UpgradeRepoCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help       bool
+		Repository string
+		Workers    int
+	}{}
+	flags := flag.NewFlagSet("upgrade-repo", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
+	flags.IntVar(&args.Workers, "workers", 4, "Number of blocks upgraded concurrently")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s upgrade-repo <target>\n\n", appName)
+		fmt.Fprintf(
+			os.Stderr,
+			"Copy a repository of version %d to a repository of version %d.\n",
+			lib.LegacyStorageVersion,
+			lib.StorageVersion,
+		)
+		fmt.Fprint(os.Stderr, "Every block is encrypted again and bound to the new repository's id,\n")
+		fmt.Fprint(os.Stderr, "so blocks of other repositories cannot be mixed in.\n")
+		fmt.Fprint(os.Stderr, "Revisions, tags, and passphrases stay the same. The source is not changed.\n")
+		fmt.Fprint(os.Stderr, "\nArguments:\n")
+		fmt.Fprint(os.Stderr, "  target\n")
+		fmt.Fprint(os.Stderr, "        An empty local directory or an s3+... URI of an empty bucket.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) != 1 {
+		return lib.Errorf("one positional argument is required: <target>")
+	}
+	var (
+		passphrase []byte
+		uri        string
+		err        error
+	)
+	if args.Repository != "" {
+		uri = args.Repository
+		passphrase, err = readPassphrase(passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	} else {
+		var workspace *ws.Workspace
+		workspace, err = openWorkspace(ctx)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open workspace")
+		}
+		defer workspace.Close() //nolint:errcheck
+		uri = string(workspace.RemoteRepository)
+		passphrase, err = readWorkspaceRepositoryPassphrase(ctx, workspace, passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	}
+	src, _, err := openStorage(uri, passphrase, passphraseFromStdin)
+	if err != nil {
+		return err
+	}
+	dst, target, err := newRepositoryStorage(flags.Arg(0), passphrase, passphraseFromStdin)
+	if err != nil {
+		return err
+	}
+	monitor := &upgradeRepoMonitor{0, 0, IsTerm(os.Stdout)}
+	repository, err := lib.UpgradeRepository(ctx, src, dst, passphrase, args.Workers, monitor)
+	if monitor.progress {
+		fmt.Print("\r\x1b[K")
+	}
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	defer repository.Close() //nolint:errcheck
+	fmt.Printf("Upgraded %d blocks (%s) to %s\n", monitor.blocks, ws.FormatBytes(monitor.bytes), target)
+	fmt.Print("Once nobody writes to the old repository anymore, replace it with the upgraded one\n")
+	fmt.Print("and run `ping` in every workspace to check that it can be read.\n")
+	return nil
+}
+
+type upgradeRepoMonitor struct {
+	blocks   int
+	bytes    int64
+	progress bool
+}
+
+func (m *upgradeRepoMonitor) OnUpgradeBlock(_ lib.BlockId, length int) {
+	m.blocks++
+	m.bytes += int64(length)
+	if m.progress && m.blocks%100 == 0 {
+		fmt.Printf("\rUpgraded %d blocks (%s)", m.blocks, ws.FormatBytes(m.bytes))
+	}
+}
+
 func resolveS3URI(rawTarget string, passphrase []byte, passphraseFromStdin bool) (string, error) {
 	if clingHTTP.S3URIHasEmbeddedCredentials(rawTarget) {
 		return rawTarget, nil
@@ -1524,11 +5257,47 @@ func SecurityCmd(ctx context.Context, argv []string, passphraseFromStdin bool) e
 		fmt.Fprint(os.Stderr, "        Credentials come from --credentials-file (lines\n")
 		fmt.Fprint(os.Stderr, "        `CLING_S3_KEY_ID=...` and `CLING_S3_ACCESS_KEY=...`) or from the\n")
 		fmt.Fprint(os.Stderr, "        CLING_S3_* / AWS_* env vars.\n")
+		fmt.Fprint(os.Stderr, "  export-config\n")
+		fmt.Fprint(os.Stderr, "        Print the config (`.cling/repository.txt`) of the workspace's repository.\n")
+		fmt.Fprint(os.Stderr, "        Use it to back up the config or to restore it if it was lost: if the\n")
+		fmt.Fprint(os.Stderr, "        repository has no config anymore, the encrypted copy kept in the\n")
+		fmt.Fprint(os.Stderr, "        repository or the copy kept in the workspace is printed.\n")
+		fmt.Fprint(os.Stderr, "  export-recovery-code\n")
+		fmt.Fprint(os.Stderr, "        Print the recovery code of the workspace's repository. It contains the\n")
+		fmt.Fprint(os.Stderr, "        repository keys, i.e. it unlocks the repository without the passphrase.\n")
+		fmt.Fprint(os.Stderr, "        Keep it offline. If the passphrase is lost, use it to set a new one with\n")
+		fmt.Fprintf(os.Stderr, "        `%s init --recovery-code` or `%s attach --recovery-code`.\n", appName, appName)
+		fmt.Fprint(os.Stderr, "  add-passphrase [--allow-weak-passphrase] <name>\n")
+		fmt.Fprint(os.Stderr, "        Add another passphrase that opens the workspace's repository. <name>\n")
+		fmt.Fprint(os.Stderr, "        identifies the passphrase, e.g. the device or person using it.\n")
+		fmt.Fprint(os.Stderr, "        With --passphrase-from-stdin, the first line of stdin is the current\n")
+		fmt.Fprint(os.Stderr, "        passphrase (unless it is saved) and the rest is the new passphrase.\n")
+		fmt.Fprint(os.Stderr, "  remove-passphrase <name>\n")
+		fmt.Fprint(os.Stderr, "        Remove the passphrase <name>. The first passphrase of a repository\n")
+		fmt.Fprintf(os.Stderr, "        is named %q and cannot be removed. Whoever knew the removed\n", lib.DefaultKeySlot)
+		fmt.Fprint(os.Stderr, "        passphrase might have kept the repository keys, nothing is re-encrypted.\n")
+		fmt.Fprint(os.Stderr, "  generate-identity\n")
+		fmt.Fprint(os.Stderr, "        Print a new X25519 identity (private key) and its recipient (public\n")
+		fmt.Fprint(os.Stderr, "        key). Save the output to a file and pass it instead of the passphrase,\n")
+		fmt.Fprint(os.Stderr, "        e.g. with --passphrase-from-stdin, once the recipient was added.\n")
+		fmt.Fprint(os.Stderr, "  add-recipient <name> <recipient>\n")
+		fmt.Fprint(os.Stderr, "        Encrypt the repository keys to <recipient>, so that the matching\n")
+		fmt.Fprint(os.Stderr, "        identity opens the repository without the passphrase. Useful for\n")
+		fmt.Fprint(os.Stderr, "        backup agents. The identity can read everything the passphrase can.\n")
+		fmt.Fprint(os.Stderr, "  generate-signing-key [--force]\n")
+		fmt.Fprint(os.Stderr, "        Generate an Ed25519 key that signs all revisions committed from this\n")
+		fmt.Fprint(os.Stderr, "        workspace and print its signer (public key). With --force, an existing\n")
+		fmt.Fprint(os.Stderr, "        key is replaced.\n")
+		fmt.Fprint(os.Stderr, "  signer\n")
+		fmt.Fprint(os.Stderr, "        Print the signer of the workspace's signing key.\n")
+		fmt.Fprint(os.Stderr, "  trust-signer <name> <signer>\n")
+		fmt.Fprint(os.Stderr, "        Trust the revisions signed by <signer>, e.g. another of your devices.\n")
+		fmt.Fprintf(os.Stderr, "        Verified by `%s log --verify` and `%s check`.\n", appName, appName)
 		fmt.Fprint(os.Stderr, "\nFlags:\n")
 		flags.PrintDefaults()
 	}
-	if err := flags.Parse(argv); err != nil {
-		return err //nolint:wrapcheck
+	if err := parseFlags(flags, argv); err != nil {
+		return err
 	}
 	if args.Help {
 		flags.Usage()
@@ -1540,6 +5309,54 @@ func SecurityCmd(ctx context.Context, argv []string, passphraseFromStdin bool) e
 	if flags.Arg(0) == "encrypt-s3-url" {
 		return securityEncryptS3URLCmd(ctx, flags.Args()[1:], passphraseFromStdin)
 	}
+	if flags.Arg(0) == "export-config" {
+		if len(flags.Args()) != 1 {
+			return lib.Errorf("too many positional arguments")
+		}
+		return securityExportConfigCmd(ctx, passphraseFromStdin)
+	}
+	if flags.Arg(0) == "export-recovery-code" {
+		if len(flags.Args()) != 1 {
+			return lib.Errorf("too many positional arguments")
+		}
+		return securityExportRecoveryCodeCmd(ctx, passphraseFromStdin)
+	}
+	if flags.Arg(0) == "generate-identity" {
+		if len(flags.Args()) != 1 {
+			return lib.Errorf("too many positional arguments")
+		}
+		return securityGenerateIdentityCmd()
+	}
+	if flags.Arg(0) == "add-recipient" {
+		if len(flags.Args()) != 3 {
+			return lib.Errorf("add-recipient requires exactly two positional arguments: <name> <recipient>")
+		}
+		return securityAddRecipientCmd(ctx, flags.Arg(1), flags.Arg(2), passphraseFromStdin)
+	}
+	if flags.Arg(0) == "generate-signing-key" {
+		return securityGenerateSigningKeyCmd(ctx, flags.Args()[1:])
+	}
+	if flags.Arg(0) == "signer" {
+		if len(flags.Args()) != 1 {
+			return lib.Errorf("too many positional arguments")
+		}
+		return securitySignerCmd(ctx)
+	}
+	if flags.Arg(0) == "trust-signer" {
+		if len(flags.Args()) != 3 {
+			return lib.Errorf("trust-signer requires exactly two positional arguments: <name> <signer>")
+		}
+		return securityTrustSignerCmd(ctx, flags.Arg(1), flags.Arg(2))
+	}
+	if flags.Arg(0) == "add-passphrase" {
+		return securityAddPassphraseCmd(ctx, flags.Args()[1:], passphraseFromStdin)
+	}
+	if flags.Arg(0) == "remove-passphrase" {
+		if len(flags.Args()) != 2 {
+			return lib.Errorf("remove-passphrase requires exactly one positional argument: <name>")
+		}
+		return securityRemovePassphraseCmd(ctx, flags.Arg(1), passphraseFromStdin)
+	}
 
 	op := flags.Arg(0)
 	if op != "save-passphrase" && op != "delete-passphrase" {
@@ -1565,7 +5382,7 @@ func securityPassphraseCmd(ctx context.Context, op string, positional []string,
 		if err := keychain.DeleteKeychainEntry(
 			ctx,
 			"com.cling.sync",
-			string(workspace.RemoteRepository),
+			string(workspace.Origin),
 		); err != nil && !errors.Is(err, keychain.ErrKeychainEntryNotFound) {
 			return lib.WrapErrorf(err, "failed to delete local encryption key from keychain")
 		}
@@ -1591,7 +5408,7 @@ func securityPassphraseCmd(ctx context.Context, op string, positional []string,
 	existing, err := keychain.GetKeychainEntry(
 		ctx,
 		"com.cling.sync",
-		string(workspace.RemoteRepository),
+		string(workspace.Origin),
 	)
 	switch {
 	case err == nil:
@@ -1608,7 +5425,7 @@ func securityPassphraseCmd(ctx context.Context, op string, positional []string,
 		if err := keychain.AddKeychainEntry(
 			ctx,
 			"com.cling.sync",
-			string(workspace.RemoteRepository),
+			string(workspace.Origin),
 			hex.EncodeToString(encKey[:]),
 		); err != nil {
 			return lib.WrapErrorf(err, "failed to save local encryption key to keychain")
@@ -1626,6 +5443,260 @@ func securityPassphraseCmd(ctx context.Context, op string, positional []string,
 	return nil
 }
 
+// securityExportConfigCmd prints the repository config. If the repository's
+// config was lost, fall back to the encrypted backup in the repository and
+// then to the copy in the workspace.
+func securityExportConfigCmd(ctx context.Context, passphraseFromStdin bool) error {
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	passphrase, err := readWorkspaceRepositoryPassphrase(ctx, workspace, passphraseFromStdin)
+	if err != nil {
+		return err
+	}
+	config, err := exportRepositoryConfig(ctx, workspace, passphrase, passphraseFromStdin)
+	if err != nil {
+		return err
+	}
+	if err := lib.WriteToml(os.Stdout, lib.RepositoryConfigHeaderComment, config); err != nil {
+		return lib.WrapErrorf(err, "failed to write repository config")
+	}
+	return nil
+}
+
+func securityExportRecoveryCodeCmd(ctx context.Context, passphraseFromStdin bool) error {
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	passphrase, err := readWorkspaceRepositoryPassphrase(ctx, workspace, passphraseFromStdin)
+	if err != nil {
+		return err
+	}
+	storage, _, err := openStorage(string(workspace.RemoteRepository), passphrase, passphraseFromStdin)
+	if err != nil {
+		return err
+	}
+	code, err := lib.ExportRecoveryCode(ctx, storage, passphrase)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to export recovery code")
+	}
+	fmt.Fprintln(os.Stderr, "Warning: the recovery code unlocks the repository without the passphrase.")
+	fmt.Fprintln(os.Stderr, "Keep it offline, e.g. printed out, and never store it next to the repository.")
+	fmt.Println(code)
+	return nil
+}
+
+func securityAddPassphraseCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error {
+	args := struct { //nolint:exhaustruct
+		AllowWeakPassphrase bool
+	}{}
+	flags := flag.NewFlagSet("security add-passphrase", flag.ExitOnError)
+	flags.BoolVar(&args.AllowWeakPassphrase, "allow-weak-passphrase", false, "Allow weak passphrase (not recommended)")
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if len(flags.Args()) != 1 {
+		return lib.Errorf("add-passphrase requires exactly one positional argument: <name>")
+	}
+	name := flags.Arg(0)
+	if err := lib.ValidateKeySlotName(name); err != nil {
+		return err //nolint:wrapcheck
+	}
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	var passphrase []byte
+	if workspace.HasSavedPassphrase(ctx) || !passphraseFromStdin {
+		passphrase, err = readWorkspaceRepositoryPassphrase(ctx, workspace, passphraseFromStdin)
+	} else {
+		// The rest of stdin is the new passphrase.
+		passphrase, err = readStdinLine()
+	}
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to read passphrase")
+	}
+	storage, _, err := openStorage(string(workspace.RemoteRepository), passphrase, passphraseFromStdin)
+	if err != nil {
+		return err
+	}
+	if !passphraseFromStdin {
+		fmt.Fprintf(os.Stderr, "Enter the new passphrase %q.\n", name)
+	}
+	newPassphrase, err := readNewPassphrase(passphraseFromStdin, args.AllowWeakPassphrase)
+	if err != nil {
+		return err
+	}
+	if err := lib.AddPassphrase(ctx, storage, passphrase, name, newPassphrase); err != nil {
+		return lib.WrapErrorf(err, "failed to add passphrase")
+	}
+	fmt.Printf("Passphrase %q added\n", name)
+	return nil
+}
+
+func securityRemovePassphraseCmd(ctx context.Context, name string, passphraseFromStdin bool) error {
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	passphrase, err := readWorkspaceRepositoryPassphrase(ctx, workspace, passphraseFromStdin)
+	if err != nil {
+		return err
+	}
+	storage, _, err := openStorage(string(workspace.RemoteRepository), passphrase, passphraseFromStdin)
+	if err != nil {
+		return err
+	}
+	err = lib.RemovePassphrase(ctx, storage, passphrase, name)
+	if errors.Is(err, lib.ErrKeySlotNotFound) {
+		if config, openErr := storage.Open(ctx); openErr == nil {
+			if names, namesErr := lib.KeySlotNames(config); namesErr == nil {
+				return lib.WrapErrorf(err, "failed to remove passphrase, existing passphrases: %s", strings.Join(names, ", "))
+			}
+		}
+	}
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to remove passphrase")
+	}
+	fmt.Printf("Passphrase %q removed\n", name)
+	return nil
+}
+
+func securityGenerateIdentityCmd() error {
+	identity, err := lib.NewIdentity()
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to generate identity")
+	}
+	fmt.Fprintf(os.Stderr, "Recipient: %s\n", identity.Recipient())
+	fmt.Printf("# recipient: %s\n", identity.Recipient())
+	fmt.Println(identity.String())
+	return nil
+}
+
+func securityAddRecipientCmd(ctx context.Context, name, recipient string, passphraseFromStdin bool) error {
+	if err := lib.ValidateKeySlotName(name); err != nil {
+		return err //nolint:wrapcheck
+	}
+	if _, err := lib.ParseRecipient(recipient); err != nil {
+		return err //nolint:wrapcheck
+	}
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	passphrase, err := readWorkspaceRepositoryPassphrase(ctx, workspace, passphraseFromStdin)
+	if err != nil {
+		return err
+	}
+	storage, _, err := openStorage(string(workspace.RemoteRepository), passphrase, passphraseFromStdin)
+	if err != nil {
+		return err
+	}
+	if err := lib.AddRecipient(ctx, storage, passphrase, name, recipient); err != nil {
+		return lib.WrapErrorf(err, "failed to add recipient")
+	}
+	fmt.Printf("Recipient %q added\n", name)
+	return nil
+}
+
+func securityGenerateSigningKeyCmd(ctx context.Context, argv []string) error {
+	args := struct { //nolint:exhaustruct
+		Force bool
+	}{}
+	flags := flag.NewFlagSet("security generate-signing-key", flag.ExitOnError)
+	flags.BoolVar(&args.Force, "force", false, "Replace an existing signing key")
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if len(flags.Args()) != 0 {
+		return lib.Errorf("too many positional arguments")
+	}
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	key, err := lib.NewSigningKey()
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to generate signing key")
+	}
+	if err := workspace.SetSigningKey(ctx, key, args.Force); err != nil {
+		return err //nolint:wrapcheck
+	}
+	fmt.Printf("Signer: %s\n", key.Signer())
+	return nil
+}
+
+func securitySignerCmd(ctx context.Context) error {
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	key, err := workspace.SigningKey(ctx)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	if key == nil {
+		return lib.Errorf("the workspace has no signing key, see `%s security generate-signing-key`", appName)
+	}
+	fmt.Println(key.Signer())
+	return nil
+}
+
+func securityTrustSignerCmd(ctx context.Context, name, s string) error {
+	signer, err := lib.ParseSigner(s)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	if err := workspace.TrustSigner(ctx, name, signer); err != nil {
+		return err //nolint:wrapcheck
+	}
+	fmt.Printf("Signer %q trusted\n", name)
+	return nil
+}
+
+func exportRepositoryConfig(
+	ctx context.Context,
+	workspace *ws.Workspace,
+	passphrase []byte,
+	passphraseFromStdin bool,
+) (lib.Toml, error) {
+	storage, _, err := openStorage(string(workspace.RemoteRepository), passphrase, passphraseFromStdin)
+	if err != nil {
+		return nil, err
+	}
+	config, err := storage.Open(ctx)
+	if err == nil {
+		return config, nil
+	}
+	fmt.Fprintf(os.Stderr, "Warning: failed to read the repository config: %s\n", err.Error())
+	config, backupErr := lib.ReadRepositoryConfigBackup(ctx, storage, passphrase)
+	if backupErr == nil {
+		fmt.Fprintln(os.Stderr, "Printing the encrypted backup kept in the repository instead.")
+		return config, nil
+	}
+	fmt.Fprintf(os.Stderr, "Warning: failed to read the repository config backup: %s\n", backupErr.Error())
+	config, mirrorErr := workspace.ReadRepositoryConfig(ctx)
+	if mirrorErr != nil {
+		return nil, lib.WrapErrorf(mirrorErr, "no copy of the repository config found")
+	}
+	fmt.Fprintln(os.Stderr, "Printing the copy kept in the workspace instead.")
+	return config, nil
+}
+
 func securityEncryptS3URLCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
 	args := struct { //nolint:exhaustruct
 		CredentialsFile string
@@ -1633,8 +5704,8 @@ func securityEncryptS3URLCmd(ctx context.Context, argv []string, passphraseFromS
 	flags := flag.NewFlagSet("security encrypt-s3-url", flag.ExitOnError)
 	flags.StringVar(&args.CredentialsFile, "credentials-file", "",
 		"File with `CLING_S3_KEY_ID=...` and `CLING_S3_ACCESS_KEY=...` lines (TOML or .env style).")
-	if err := flags.Parse(argv); err != nil {
-		return err //nolint:wrapcheck
+	if err := parseFlags(flags, argv); err != nil {
+		return err
 	}
 	if flags.NArg() != 1 {
 		return lib.Errorf("encrypt-s3-url requires exactly one positional argument: <endpoint>")
@@ -1645,32 +5716,10 @@ func securityEncryptS3URLCmd(ctx context.Context, argv []string, passphraseFromS
 	}
 	var creds clingHTTP.S3Credentials
 	if args.CredentialsFile != "" {
-		data, err := os.ReadFile(args.CredentialsFile)
-		if err != nil {
-			return lib.WrapErrorf(err, "failed to read --credentials-file")
-		}
-		var id, secret string
-		for line := range strings.SplitSeq(string(data), "\n") {
-			line = strings.TrimSpace(line)
-			var dst *string
-			switch {
-			case strings.HasPrefix(line, "CLING_S3_KEY_ID"):
-				dst = &id
-			case strings.HasPrefix(line, "CLING_S3_ACCESS_KEY"):
-				dst = &secret
-			default:
-				continue
-			}
-			_, v, ok := strings.Cut(line, "=")
-			if !ok {
-				continue
-			}
-			*dst = strings.Trim(strings.TrimSpace(v), `"`)
-		}
-		if id == "" || secret == "" {
-			return lib.Errorf("--credentials-file is missing CLING_S3_KEY_ID or CLING_S3_ACCESS_KEY")
+		var err error
+		if creds, err = readCredentialsFile(args.CredentialsFile); err != nil {
+			return err
 		}
-		creds = clingHTTP.S3Credentials{AccessKeyID: id, SecretAccessKey: []byte(secret)}
 	} else {
 		envCreds, ok, err := readEnvS3Credentials()
 		if err != nil {
@@ -1691,162 +5740,625 @@ func securityEncryptS3URLCmd(ctx context.Context, argv []string, passphraseFromS
 	if err != nil {
 		return lib.WrapErrorf(err, "failed to parse endpoint")
 	}
-	storage := clingHTTP.NewS3StorageClient(cfg, clingHTTP.NewDefaultHTTPClient(nil))
-	repository, err := lib.OpenRepository(ctx, storage, passphrase)
-	if err != nil {
-		return lib.WrapErrorf(err, "failed to open repository at %s", endpoint)
+	client, err := clingHTTP.NewDefaultHTTPClientFromEnv()
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	storage := clingHTTP.NewS3StorageClient(cfg, client)
+	repository, err := lib.OpenRepository(ctx, storage, passphrase)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open repository at %s", endpoint)
+	}
+	repository.Close() //nolint:errcheck,gosec
+	uri, err := clingHTTP.EncodeS3URI(endpoint, creds, passphrase)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to encode S3 URI")
+	}
+	fmt.Println(uri)
+	return nil
+}
+
+// readCredentialsFile reads S3 credentials from `CLING_S3_KEY_ID=...` and
+// `CLING_S3_ACCESS_KEY=...` lines (TOML or .env style), e.g. `conf/serve`.
+func readCredentialsFile(path string) (clingHTTP.S3Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return clingHTTP.S3Credentials{}, lib.WrapErrorf(err, "failed to read --credentials-file")
+	}
+	var id, secret string
+	for line := range strings.SplitSeq(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		var dst *string
+		switch {
+		case strings.HasPrefix(line, "CLING_S3_KEY_ID"):
+			dst = &id
+		case strings.HasPrefix(line, "CLING_S3_ACCESS_KEY"):
+			dst = &secret
+		default:
+			continue
+		}
+		_, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		*dst = strings.Trim(strings.TrimSpace(v), `"`)
+	}
+	if id == "" || secret == "" {
+		return clingHTTP.S3Credentials{}, lib.Errorf("--credentials-file is missing CLING_S3_KEY_ID or CLING_S3_ACCESS_KEY")
+	}
+	return clingHTTP.S3Credentials{AccessKeyID: id, SecretAccessKey: []byte(secret)}, nil
+}
+
+// readServeCredentials reads the S3 credentials `serve` checks requests
+// against from the repository's `conf/serve` control file and generates them
+// on first run.
+func readServeCredentials(ctx context.Context, storage lib.Storage) (string, string, bool, error) {
+	data, err := storage.ReadControlFile(ctx, lib.ControlFileSectionConf, "serve")
+	switch {
+	case err == nil:
+		toml, err := lib.ReadToml(bytes.NewReader(data))
+		if err != nil {
+			return "", "", false, lib.WrapErrorf(err, "failed to parse conf/serve")
+		}
+		ak := toml["serve"]["CLING_S3_KEY_ID"]
+		sk := toml["serve"]["CLING_S3_ACCESS_KEY"]
+		if ak == "" || sk == "" {
+			return "", "", false, lib.Errorf("conf/serve is missing CLING_S3_KEY_ID or CLING_S3_ACCESS_KEY under [serve]")
+		}
+		return ak, sk, false, nil
+	case errors.Is(err, lib.ErrControlFileNotFound):
+		const keyIDAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+		idRand, err := lib.Rand(16)
+		if err != nil {
+			return "", "", false, lib.WrapErrorf(err, "failed to generate key id")
+		}
+		id := []byte("CLIA")
+		for _, b := range idRand {
+			id = append(id, keyIDAlphabet[int(b)%len(keyIDAlphabet)])
+		}
+		ak := string(id)
+		secretBytes, err := lib.Rand(30)
+		if err != nil {
+			return "", "", false, lib.WrapErrorf(err, "failed to generate access key")
+		}
+		sk := base64.RawStdEncoding.EncodeToString(secretBytes)
+		toml := lib.Toml{"serve": {"CLING_S3_KEY_ID": ak, "CLING_S3_ACCESS_KEY": sk}}
+		var buf bytes.Buffer
+		if err := lib.WriteToml(&buf, "", toml); err != nil {
+			return "", "", false, lib.WrapErrorf(err, "failed to encode conf/serve")
+		}
+		if err := storage.WriteControlFile(ctx, lib.ControlFileSectionConf, "serve", buf.Bytes()); err != nil {
+			return "", "", false, lib.WrapErrorf(err, "failed to write conf/serve")
+		}
+		return ak, sk, true, nil
+	default:
+		return "", "", false, lib.WrapErrorf(err, "failed to read conf/serve")
+	}
+}
+
+// prepareServeTLS creates a self-signed certificate for `serve` if asked to
+// and prints the fingerprint of the certificate, so that it can be checked
+// on the clients.
+func prepareServeTLS(address, certFile, keyFile string, selfSigned bool) error {
+	_, err := os.Stat(certFile)
+	switch {
+	case err == nil:
+	case errors.Is(err, os.ErrNotExist) && selfSigned:
+		hosts := []string{"localhost", "127.0.0.1", "::1"}
+		if host, _, err := net.SplitHostPort(address); err == nil && host != "" {
+			if ip := net.ParseIP(host); (ip == nil || !ip.IsUnspecified()) && !slices.Contains(hosts, host) {
+				hosts = append(hosts, host)
+			}
+		}
+		if hostname, err := os.Hostname(); err == nil && !slices.Contains(hosts, hostname) {
+			hosts = append(hosts, hostname)
+		}
+		if err := clingHTTP.GenerateSelfSignedCert(hosts, certFile, keyFile); err != nil {
+			return lib.WrapErrorf(err, "failed to create self-signed certificate")
+		}
+		fmt.Printf("Created self-signed certificate %s for %s\n", certFile, strings.Join(hosts, ", "))
+		if abs, err := filepath.Abs(certFile); err == nil {
+			certFile = abs
+		}
+		fmt.Printf("Clients trust it with:\n  export %s=%s\n", clingHTTP.CAFileEnv, certFile)
+	default:
+		return lib.WrapErrorf(err, "failed to read --tls-cert")
 	}
-	repository.Close() //nolint:errcheck,gosec
-	uri, err := clingHTTP.EncodeS3URI(endpoint, creds, passphrase)
+	fingerprint, err := clingHTTP.CertFingerprint(certFile)
 	if err != nil {
-		return lib.WrapErrorf(err, "failed to encode S3 URI")
+		return err //nolint:wrapcheck
 	}
-	fmt.Println(uri)
+	fmt.Printf("TLS certificate SHA-256 fingerprint: %s\n", fingerprint)
 	return nil
 }
 
 func ServeCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
 	args := struct { //nolint:exhaustruct
-		Address      string
-		LogRequests  bool
-		CORSAllowAll bool
-		ReadTimeout  time.Duration
-		WriteTimeout time.Duration
-		Region       string
-		Repository   string
-		Help         bool
+		Address         string
+		LogRequests     bool
+		CORSAllowAll    bool
+		ReadTimeout     time.Duration
+		WriteTimeout    time.Duration
+		Region          string
+		Repository      string
+		CredentialsFile string
+		TLSCert         string
+		TLSKey          string
+		TLSSelfSigned   bool
+		ReadOnly        bool
+		AppendOnly      bool
+		MaxSize         int
+		MetricsAddress  string
+		BasePath        string
+		SyncInterval    time.Duration
+		Workspaces      []string
+		UI              bool
+		Help            bool
 	}{}
 	flags := flag.NewFlagSet("serve", flag.ExitOnError)
 	flags.BoolVar(&args.Help, "help", false, "Show help message")
-	flags.BoolVar(&args.LogRequests, "log-requests", false, "Log all requests")
+	flags.BoolVar(
+		&args.LogRequests,
+		"log-requests",
+		false,
+		"Log all requests to stderr, lowers the global --log-level to info",
+	)
 	flags.BoolVar(&args.CORSAllowAll, "cors-allow-all", false, "Allow all origins")
 	flags.StringVar(&args.Address, "address", "0.0.0.0:4242", "Address to listen on")
 	flags.DurationVar(&args.ReadTimeout, "read-timeout", 10*time.Second, "Timeout for reading a response")
 	flags.DurationVar(&args.WriteTimeout, "write-timeout", 10*time.Second, "Timeout for writing a response")
 	flags.StringVar(&args.Region, "region", "us-east-1", "Region for SigV4 verification")
 	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
+	flags.StringVar(
+		&args.CredentialsFile,
+		"credentials-file",
+		"",
+		"Check requests against the credentials in this file instead of `conf/serve`\n"+
+			"(`CLING_S3_KEY_ID=...` and `CLING_S3_ACCESS_KEY=...` lines)",
+	)
+	flags.StringVar(&args.TLSCert, "tls-cert", "", "Serve HTTPS with this PEM certificate (requires `--tls-key`)")
+	flags.StringVar(&args.TLSKey, "tls-key", "", "PEM private key for `--tls-cert`")
+	flags.BoolVar(
+		&args.TLSSelfSigned,
+		"tls-self-signed",
+		false,
+		"Create a self-signed certificate at `--tls-cert` and `--tls-key` if they do not exist",
+	)
+	flags.BoolVar(
+		&args.ReadOnly,
+		"read-only",
+		false,
+		"Only serve reads, reject all requests that would modify the repository",
+	)
+	flags.BoolVar(
+		&args.AppendOnly,
+		"append-only",
+		false,
+		"Reject requests that would overwrite blocks, delete control files, or move the head back",
+	)
+	byteSizeFlag(
+		flags,
+		"max-size",
+		"Reject new blocks once the blocks of a repository take up this many bytes, e.g. 100G",
+		&args.MaxSize,
+	)
+	flags.StringVar(
+		&args.MetricsAddress,
+		"metrics-address",
+		"",
+		"Serve Prometheus metrics at `/metrics` on this address, e.g. 127.0.0.1:9100",
+	)
+	flags.StringVar(
+		&args.BasePath,
+		"base-path",
+		"",
+		"The path a reverse proxy serves the server at, e.g. /cling (the proxy may strip it or not)",
+	)
+	flags.DurationVar(
+		&args.SyncInterval,
+		"sync-interval",
+		0,
+		"Check the `--sync-workspace` directories for changes and merge them at this interval",
+	)
+	flags.Func("sync-workspace", "Merge this workspace every `--sync-interval` (can be used multiple times)",
+		func(path string) error {
+			args.Workspaces = append(args.Workspaces, path)
+			return nil
+		})
+	flags.BoolVar(
+		&args.UI,
+		"ui",
+		false,
+		"Serve a read-only web UI to browse revisions and download files at /ui/",
+	)
 	flags.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s serve\n\n", appName)
+		fmt.Fprintf(os.Stderr, "Usage: %s serve [<dir>]\n\n", appName)
 		fmt.Fprint(os.Stderr, "Serve the workspace repository as an S3-compatible bucket.\n")
+		fmt.Fprint(os.Stderr, "With <dir>, serve every repository directly inside <dir> instead. The\n")
+		fmt.Fprint(os.Stderr, "repository in <dir>/<name> is served at `/repos/<name>`.\n")
 		fmt.Fprint(os.Stderr, "Credentials live in the repository's `conf/serve` control file and\n")
-		fmt.Fprint(os.Stderr, "are auto-generated on first run.\n")
+		fmt.Fprint(os.Stderr, "are auto-generated on first run, unless `--credentials-file` is given.\n")
+		fmt.Fprint(os.Stderr, "With `--tls-cert` and `--tls-key`, the server speaks HTTPS.\n")
+		fmt.Fprint(os.Stderr, "With `--read-only`, clients can `cp`, `ls`, etc. but never commit.\n")
+		fmt.Fprint(os.Stderr, "With `--append-only`, clients can commit but never remove what was\n")
+		fmt.Fprint(os.Stderr, "committed, e.g. to protect backups from a compromised client.\n")
+		fmt.Fprint(os.Stderr, "With `--max-size`, every repository is limited to that many bytes.\n")
+		fmt.Fprint(os.Stderr, "With `--metrics-address`, Prometheus metrics are served on that address.\n")
+		fmt.Fprint(os.Stderr, "With `--sync-interval`, the `--sync-workspace` directories are merged\n")
+		fmt.Fprint(os.Stderr, "on start and then whenever they or their repository changed.\n")
+		fmt.Fprint(os.Stderr, "With `--ui`, a web UI to browse the revisions and download files is\n")
+		fmt.Fprint(os.Stderr, "served at `/ui/`. The files are decrypted in the browser.\n")
 		fmt.Fprint(os.Stderr, "\nFlags:\n")
 		flags.PrintDefaults()
 	}
-	if err := flags.Parse(argv); err != nil {
-		return err //nolint:wrapcheck
+	if err := parseFlags(flags, argv); err != nil {
+		return err
 	}
 	if args.Help {
 		flags.Usage()
 		return nil
 	}
-	if len(flags.Args()) != 0 {
-		return lib.Errorf("no positional arguments allowed")
+	if len(flags.Args()) > 1 {
+		return lib.Errorf("at most one positional argument allowed: <dir>")
 	}
-	var (
-		storage         lib.Storage
-		repositoryLabel string
-		err             error
-	)
-	if args.Repository != "" {
-		var passphrase []byte
-		if clingHTTP.IsS3StorageURI(args.Repository) {
-			passphrase, err = readPassphrase(passphraseFromStdin)
-			if err != nil {
-				return err
+	if len(flags.Args()) == 1 && args.Repository != "" {
+		return lib.Errorf("--repository and <dir> are mutually exclusive")
+	}
+	if (args.SyncInterval > 0) != (len(args.Workspaces) > 0) {
+		return lib.Errorf("--sync-interval and --sync-workspace must be used together")
+	}
+	if (args.TLSCert != "") != (args.TLSKey != "") {
+		return lib.Errorf("--tls-cert and --tls-key must be used together")
+	}
+	if args.ReadOnly && args.AppendOnly {
+		return lib.Errorf("--read-only and --append-only are mutually exclusive")
+	}
+	if args.TLSSelfSigned && args.TLSCert == "" {
+		return lib.Errorf("--tls-self-signed requires --tls-cert and --tls-key")
+	}
+	scheme := "s3+http"
+	if args.TLSCert != "" {
+		scheme = "s3+https"
+		if err := prepareServeTLS(args.Address, args.TLSCert, args.TLSKey, args.TLSSelfSigned); err != nil {
+			return err
+		}
+	}
+	endpoint := scheme + "://" + args.Address
+	mux := http.NewServeMux()
+	var uiURL string
+	if args.UI {
+		var err error
+		if uiURL, err = registerServeUI(mux, scheme, args.Address, args.BasePath); err != nil {
+			return err
+		}
+	}
+	var metrics *clingHTTP.Metrics
+	if args.MetricsAddress != "" {
+		metrics = clingHTTP.NewMetrics()
+	}
+	var repositoryLabel string
+	var s3Servers []*clingHTTP.S3StorageServer
+	if flags.NArg() == 1 {
+		servers, err := newServeServers(
+			ctx,
+			flags.Arg(0),
+			args.CredentialsFile,
+			args.Region,
+			serveServerOptions{args.ReadOnly, args.AppendOnly, int64(args.MaxSize)},
+			endpoint,
+			args.BasePath,
+		)
+		if err != nil {
+			return err
+		}
+		clingHTTP.NewS3MultiStorageServer(servers, args.BasePath).RegisterRoutes(mux)
+		s3Servers = slices.Collect(maps.Values(servers))
+		if metrics != nil {
+			for name, server := range servers {
+				metrics.Add(name, server)
 			}
 		}
-		storage, repositoryLabel, err = openStorage(args.Repository, passphrase, passphraseFromStdin)
+		repositoryLabel = fmt.Sprintf("%d repositories in %s", len(servers), flags.Arg(0))
+		endpoint = serveEndpoint(endpoint, args.BasePath, "/"+clingHTTP.MultiRepositoryKeyPrefix+"/<name>")
+	} else {
+		endpoint = serveEndpoint(endpoint, args.BasePath, "")
+		storage, label, err := openServeStorage(ctx, args.Repository, passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+		repositoryLabel = label
+		s3Server, err := newServeServer(
+			ctx,
+			storage,
+			repositoryLabel,
+			args.CredentialsFile,
+			args.Region,
+			serveServerOptions{args.ReadOnly, args.AppendOnly, int64(args.MaxSize)},
+			endpoint,
+		)
+		if err != nil {
+			return err
+		}
+		s3Server.BasePath = args.BasePath
+		s3Server.RegisterRoutes(mux)
+		s3Servers = append(s3Servers, s3Server)
+		if metrics != nil {
+			metrics.Add(serveMetricsRepository, s3Server)
+		}
+	}
+	var handler http.Handler = mux
+	if args.LogRequests {
+		// The requests are logged at the info level.
+		if logLevel.Level() > slog.LevelInfo {
+			logLevel.Set(slog.LevelInfo)
+		}
+		handler = clingHTTP.RequestLogMiddleware(handler)
+	}
+	if args.CORSAllowAll {
+		handler = clingHTTP.CORSMiddleware(handler)
+	}
+	server := &http.Server{ //nolint:exhaustruct
+		Addr:         args.Address,
+		Handler:      handler,
+		ReadTimeout:  args.ReadTimeout,
+		WriteTimeout: args.WriteTimeout,
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// The running merges are waited for before `serve` exits.
+	var syncing sync.WaitGroup
+	if len(args.Workspaces) > 0 {
+		watchers, err := newSyncWatchers(ctx, args.Workspaces, args.SyncInterval, passphraseFromStdin)
 		if err != nil {
 			return err
 		}
+		for dir, watcher := range watchers {
+			fmt.Printf("Syncing %s every %s\n", dir, args.SyncInterval)
+			syncing.Go(func() {
+				if err := watcher.Run(ctx); err != nil {
+					PrintErr("sync of %s stopped: %s", dir, err)
+				}
+			})
+		}
+	}
+	if metrics != nil {
+		metricsMux := http.NewServeMux()
+		metrics.RegisterRoutes(metricsMux)
+		metricsServer := &http.Server{ //nolint:exhaustruct
+			Addr:         args.MetricsAddress,
+			Handler:      metricsMux,
+			ReadTimeout:  args.ReadTimeout,
+			WriteTimeout: args.WriteTimeout,
+		}
+		fmt.Printf("Serving metrics at http://%s/metrics\n", args.MetricsAddress)
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil {
+				PrintErr("failed to serve metrics: %s", err)
+			}
+		}()
+	}
+	switch {
+	case args.ReadOnly:
+		fmt.Printf("Serving %s read-only at %s\n", repositoryLabel, endpoint)
+	case args.AppendOnly:
+		fmt.Printf("Serving %s append-only at %s\n", repositoryLabel, endpoint)
+	default:
+		fmt.Printf("Serving %s at %s\n", repositoryLabel, endpoint)
+	}
+	if uiURL != "" {
+		fmt.Printf("Serving the web UI at %s\n", uiURL)
+	}
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		// Let the running requests finish, so that the saved quota usage
+		// includes their blocks.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	var err error
+	if args.TLSCert != "" {
+		err = server.ListenAndServeTLS(args.TLSCert, args.TLSKey)
 	} else {
-		var workspace *ws.Workspace
-		workspace, err = openWorkspace(ctx)
+		err = server.ListenAndServe()
+	}
+	stop()
+	<-shutdown
+	syncing.Wait()
+	for _, s3Server := range s3Servers {
+		if err := s3Server.SaveUsedSize(context.WithoutCancel(ctx)); err != nil {
+			PrintErr("failed to save the quota usage: %s", err)
+		}
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return lib.WrapErrorf(err, "failed to serve repository")
+	}
+	return nil
+}
+
+// How long `serve` waits for running requests when it is stopped.
+const serveShutdownTimeout = 10 * time.Second
+
+// The `repository` label of the metrics of `serve` without <dir>.
+const serveMetricsRepository = "default"
+
+// openServeStorage opens the storage of `repository` or, if it is empty,
+// of the workspace's repository.
+func openServeStorage(
+	ctx context.Context,
+	repository string,
+	passphraseFromStdin bool,
+) (lib.Storage, string, error) {
+	var passphrase []byte
+	var err error
+	if repository == "" {
+		workspace, err := openWorkspace(ctx)
 		if err != nil {
-			return lib.WrapErrorf(err, "failed to open workspace")
+			return nil, "", lib.WrapErrorf(err, "failed to open workspace")
 		}
 		defer workspace.Close() //nolint:errcheck
-		repositoryLabel = string(workspace.RemoteRepository)
-		var passphrase []byte
-		if clingHTTP.IsS3StorageURI(repositoryLabel) {
+		repository = string(workspace.RemoteRepository)
+		if clingHTTP.IsS3StorageURI(repository) {
 			passphrase, err = readWorkspaceRepositoryPassphrase(ctx, workspace, passphraseFromStdin)
 			if err != nil {
-				return err
+				return nil, "", err
 			}
 		}
-		storage, repositoryLabel, err = openStorage(repositoryLabel, passphrase, passphraseFromStdin)
+	} else if clingHTTP.IsS3StorageURI(repository) {
+		passphrase, err = readPassphrase(passphraseFromStdin)
 		if err != nil {
-			return err
+			return nil, "", err
 		}
 	}
-	if _, err := storage.Open(ctx); err != nil {
-		return lib.WrapErrorf(err, "failed to open repository")
+	return openStorage(repository, passphrase, passphraseFromStdin)
+}
+
+// serveEndpoint returns the endpoint of the repository at `path` of the
+// server at `endpoint` that a reverse proxy serves at `basePath`.
+func serveEndpoint(endpoint, basePath, path string) string {
+	basePath = strings.Trim(basePath, "/")
+	if basePath == "" {
+		return endpoint + path
+	}
+	return endpoint + "/" + basePath + path + "?base-path=/" + basePath
+}
+
+// registerServeUI serves the web UI at `/ui/`, below `basePath`, too, in
+// case a reverse proxy does not strip it. It returns the URL of the UI.
+func registerServeUI(mux *http.ServeMux, scheme, address, basePath string) (string, error) {
+	handler, err := uiHandler()
+	if err != nil {
+		return "", err
 	}
-	var ak, sk string
-	created := false
-	data, err := storage.ReadControlFile(ctx, lib.ControlFileSectionConf, "serve")
-	switch {
-	case err == nil:
-		toml, err := lib.ReadToml(bytes.NewReader(data))
-		if err != nil {
-			return lib.WrapErrorf(err, "failed to parse conf/serve")
+	path := handleServeUI(mux, handler, basePath)
+	return strings.TrimPrefix(scheme, "s3+") + "://" + address + path, nil
+}
+
+// handleServeUI registers `handler` at `/ui/` and below `basePath` and
+// returns the last path. The UI only consists of static files, so only GET
+// and HEAD are allowed. Without this, other methods would be answered by the
+// file server instead of reaching the S3 handler at `/`.
+// The files of the UI are public, the UI reads the repository through the S3
+// endpoint with the credentials of the authenticated URL like any client.
+func handleServeUI(mux *http.ServeMux, handler http.Handler, basePath string) string {
+	paths := []string{"/ui/"}
+	if basePath = strings.Trim(basePath, "/"); basePath != "" {
+		paths = append(paths, "/"+basePath+"/ui/")
+	}
+	readOnly := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
 		}
-		ak = toml["serve"]["CLING_S3_KEY_ID"]
-		sk = toml["serve"]["CLING_S3_ACCESS_KEY"]
-		if ak == "" || sk == "" {
-			return lib.Errorf("conf/serve is missing CLING_S3_KEY_ID or CLING_S3_ACCESS_KEY under [serve]")
+		handler.ServeHTTP(w, r)
+	})
+	for _, path := range paths {
+		mux.Handle(path, http.StripPrefix(path, readOnly))
+	}
+	return paths[len(paths)-1]
+}
+
+// The policies of `serve` that apply to every repository, see the fields of
+// the same name in `clingHTTP.S3StorageServer`.
+type serveServerOptions struct {
+	ReadOnly   bool
+	AppendOnly bool
+	MaxSize    int64
+}
+
+// newServeServers creates a server for every repository directly inside
+// `dir`, keyed by the name of its directory. Other directories are skipped.
+func newServeServers(
+	ctx context.Context,
+	dir, credentialsFile, region string,
+	opts serveServerOptions,
+	endpoint, basePath string,
+) (map[string]*clingHTTP.S3StorageServer, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read %s", dir)
+	}
+	servers := map[string]*clingHTTP.S3StorageServer{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || lib.ValidateControlFileName(name) != nil {
+			continue
 		}
-	case errors.Is(err, lib.ErrControlFileNotFound):
-		const keyIDAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-		idRand, err := lib.Rand(16)
+		path, err := filepath.Abs(filepath.Join(dir, name))
 		if err != nil {
-			return lib.WrapErrorf(err, "failed to generate key id")
-		}
-		id := []byte("CLIA")
-		for _, b := range idRand {
-			id = append(id, keyIDAlphabet[int(b)%len(keyIDAlphabet)])
+			return nil, lib.WrapErrorf(err, "failed to get absolute path for %s", name)
 		}
-		ak = string(id)
-		secretBytes, err := lib.Rand(30)
+		storage, err := lib.NewFileStorage(lib.NewRealFS(path), lib.StoragePurposeRepository)
 		if err != nil {
-			return lib.WrapErrorf(err, "failed to generate access key")
+			return nil, lib.WrapErrorf(err, "failed to create storage for %s", path)
 		}
-		sk = base64.RawStdEncoding.EncodeToString(secretBytes)
-		toml := lib.Toml{"serve": {"CLING_S3_KEY_ID": ak, "CLING_S3_ACCESS_KEY": sk}}
-		var buf bytes.Buffer
-		if err := lib.WriteToml(&buf, "", toml); err != nil {
-			return lib.WrapErrorf(err, "failed to encode conf/serve")
+		if _, err := storage.Open(ctx); errors.Is(err, lib.ErrStorageNotFound) {
+			continue
 		}
-		if err := storage.WriteControlFile(ctx, lib.ControlFileSectionConf, "serve", buf.Bytes()); err != nil {
-			return lib.WrapErrorf(err, "failed to write conf/serve")
+		fmt.Printf("Repository %s:\n", name)
+		server, err := newServeServer(
+			ctx,
+			storage,
+			path,
+			credentialsFile,
+			region,
+			opts,
+			serveEndpoint(endpoint, basePath, "/"+clingHTTP.MultiRepositoryKeyPrefix+"/"+name),
+		)
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to serve %s", path)
 		}
-		created = true
-	default:
-		return lib.WrapErrorf(err, "failed to read conf/serve")
+		servers[name] = server
 	}
-	mux := http.NewServeMux()
-	clingHTTP.NewS3StorageServer(storage, args.Region, ak, sk).RegisterRoutes(mux)
-	var handler http.Handler = mux
-	if args.LogRequests {
-		handler = clingHTTP.RequestLogMiddleware(handler)
+	if len(servers) == 0 {
+		return nil, lib.Errorf("no repositories found in %s", dir)
 	}
-	if args.CORSAllowAll {
-		handler = clingHTTP.CORSMiddleware(handler)
+	return servers, nil
+}
+
+// newServeServer reads the credentials for `storage` and prints how clients
+// get an authenticated URL for `endpoint`.
+func newServeServer(
+	ctx context.Context,
+	storage lib.Storage,
+	repositoryLabel, credentialsFile, region string,
+	opts serveServerOptions,
+	endpoint string,
+) (*clingHTTP.S3StorageServer, error) {
+	if _, err := storage.Open(ctx); err != nil {
+		return nil, lib.WrapErrorf(err, "failed to open repository")
 	}
-	server := &http.Server{ //nolint:exhaustruct
-		Addr:         args.Address,
-		Handler:      handler,
-		ReadTimeout:  args.ReadTimeout,
-		WriteTimeout: args.WriteTimeout,
+	var ak, sk string
+	created := false
+	if credentialsFile != "" {
+		creds, err := readCredentialsFile(credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		ak, sk = creds.AccessKeyID, string(creds.SecretAccessKey)
+	} else {
+		var err error
+		if ak, sk, created, err = readServeCredentials(ctx, storage); err != nil {
+			return nil, err
+		}
 	}
-	if clingHTTP.IsS3StorageURI(repositoryLabel) {
+	switch {
+	case credentialsFile != "":
+		fmt.Printf("Read credentials from %s\n", credentialsFile)
+		fmt.Printf(
+			"Get an authenticated URL with:\n  %s security encrypt-s3-url --credentials-file %s %s\n",
+			appName, credentialsFile, endpoint,
+		)
+	case clingHTTP.IsS3StorageURI(repositoryLabel):
 		if created {
 			fmt.Println("First run - new serve credentials created in conf/serve")
 		} else {
 			fmt.Println("Read serve credentials from conf/serve")
 		}
-	} else {
+	default:
 		confPath := filepath.Join(repositoryLabel, ".cling", "repository", "conf", "serve")
 		if created {
 			fmt.Printf("First run - new credentials created at %s\n", confPath)
@@ -1854,35 +6366,227 @@ func ServeCmd(ctx context.Context, argv []string, passphraseFromStdin bool) erro
 			fmt.Printf("Read credentials from %s\n", confPath)
 		}
 		fmt.Printf(
-			"Get an authenticated URL with:\n  %s security encrypt-s3-url --credentials-file %s s3+http://%s\n",
-			appName, confPath, args.Address,
+			"Get an authenticated URL with:\n  %s security encrypt-s3-url --credentials-file %s %s\n",
+			appName, confPath, endpoint,
 		)
 	}
-	fmt.Printf("Serving %s at s3+http://%s\n", repositoryLabel, args.Address)
-	if err := server.ListenAndServe(); err != nil {
-		return lib.WrapErrorf(err, "failed to serve repository")
+	server := clingHTTP.NewS3StorageServer(storage, region, ak, sk)
+	server.ReadOnly = opts.ReadOnly
+	server.AppendOnly = opts.AppendOnly
+	server.MaxSize = opts.MaxSize
+	if opts.MaxSize > 0 {
+		used, err := server.UsedSize(ctx)
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to get the size of the repository")
+		}
+		fmt.Printf("Quota: %s of %s used\n", ws.FormatBytes(used), ws.FormatBytes(opts.MaxSize))
+	}
+	return server, nil
+}
+
+// openSharedPassphraseRepository opens the repository of one of several
+// workspaces. The saved passphrase is used if there is one, otherwise
+// `readPassphraseOnce` is asked, which should only prompt once for all
+// workspaces.
+func openSharedPassphraseRepository(
+	ctx context.Context,
+	workspace *ws.Workspace,
+	readPassphraseOnce func() ([]byte, error),
+	passphraseFromStdin bool,
+) (*lib.Repository, error) {
+	if workspace.HasSavedPassphrase(ctx) {
+		return openRepository(ctx, workspace, "", passphraseFromStdin)
+	}
+	passphrase, err := readPassphraseOnce()
+	if err != nil {
+		return nil, err
+	}
+	storage, _, err := openStorage(string(workspace.RemoteRepository), passphrase, passphraseFromStdin)
+	if err != nil {
+		return nil, err
+	}
+	repository, err := lib.OpenRepository(ctx, storage, passphrase)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to open repository")
+	}
+	return repository, nil
+}
+
+// newSyncWatchers opens the workspaces merged by `serve --sync-interval` and
+// their repositories. Workspaces without a saved passphrase share the
+// passphrase read from the terminal (or stdin).
+func newSyncWatchers(
+	ctx context.Context,
+	dirs []string,
+	interval time.Duration,
+	passphraseFromStdin bool,
+) (map[string]*ws.Watcher, error) {
+	readPassphraseOnce := sync.OnceValues(func() ([]byte, error) { return readPassphrase(passphraseFromStdin) })
+	watchers := map[string]*ws.Watcher{}
+	for _, dir := range dirs {
+		workspace, err := openWorkspaceAt(ctx, dir)
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to open workspace %s", dir)
+		}
+		repository, err := openSharedPassphraseRepository(ctx, workspace, readPassphraseOnce, passphraseFromStdin)
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to open the repository of workspace %s", dir)
+		}
+		watchers[dir] = ws.NewWatcher(workspace, repository, &ws.WatchOptions{
+			MergeOptions: func() *ws.MergeOptions {
+				stagingMonitor, cpMonitor, commitMonitor := NewMergeMonitors(
+					ws.DefaultMonitorModeSilent,
+					newProgress(false),
+				)
+				return &ws.MergeOptions{
+					StagingMonitor: stagingMonitor,
+					CpMonitor:      cpMonitor,
+					CommitMonitor:  commitMonitor,
+					Author:         "cling-sync serve",
+					Message:        "Synced with cling-sync serve",
+					RestorableMetadataFlag: lib.RestorableMetadataAll ^
+						lib.RestorableMetadataOwnership ^ lib.RestorableMetadataMTime ^ lib.RestorableMetadataMode ^
+						lib.RestorableMetadataXattrs,
+					UseStagingCache: true,
+					First:           nil,
+					CommitFilter:    nil,
+					WatchJournal:    nil,
+					MergeText:       false,
+					MemoryBudget:    nil,
+					CacheMonitor:    nil,
+					HookOutput:      os.Stderr,
+				}
+			},
+			PollInterval: interval,
+			QuietPeriod:  0,
+			PathFilter:   nil,
+			Monitor:      cliWatchMonitor{dir},
+		})
+	}
+	return watchers, nil
+}
+
+func revisionId(ctx context.Context, repository *lib.Repository, revision string) (lib.RevisionId, error) {
+	chain, err := lib.ReadRevisionChain(ctx, repository)
+	if err != nil {
+		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to read revision chain")
+	}
+	tags, err := repository.Tags(ctx)
+	if err != nil {
+		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to read tags")
+	}
+	return chain.ParseRevisionIdOrTag(revision, tags) //nolint:wrapcheck
+}
+
+// resolveRemoteArg returns the URI of the remote named `arg` if the current
+// directory is a workspace with such a remote (see `ws.ResolveRemote`),
+// otherwise that of the repository alias `arg` or `arg` itself (see
+// `resolveRepositoryAlias`). A directory with the name of a remote is
+// passed as `./<name>`.
+func resolveRemoteArg(ctx context.Context, arg string) (string, error) {
+	if arg != ws.DefaultRemote && ws.ValidateSyncTargetName(arg) != nil {
+		return arg, nil
+	}
+	workspace, err := openWorkspace(ctx)
+	if errors.Is(err, lib.ErrStorageNotFound) {
+		return resolveRepositoryAlias(arg)
+	}
+	if err != nil {
+		return "", lib.WrapErrorf(err, "failed to open workspace")
+	}
+	defer workspace.Close() //nolint:errcheck
+	if arg == ws.DefaultRemote {
+		return string(workspace.Origin), nil
+	}
+	uri, found, err := ws.GetSyncTarget(ctx, workspace, arg)
+	if err != nil {
+		return "", lib.WrapErrorf(err, "failed to look up remote %q", arg)
+	}
+	if !found {
+		return resolveRepositoryAlias(arg)
 	}
-	return nil
+	return uri, nil
 }
 
-func revisionId(ctx context.Context, repository *lib.Repository, revision string) (lib.RevisionId, error) {
-	chain, err := lib.ReadRevisionChain(ctx, repository)
+// Return the author of the revisions committed from `workspace`: the
+// identity of the workspace (see `IdentityCmd`), or the name of the current
+// user if the identity has no name. `workspace` may be nil.
+func defaultAuthor(ctx context.Context, workspace *ws.Workspace) (string, error) {
+	if workspace != nil {
+		identity, err := workspace.Identity(ctx)
+		if err != nil {
+			return "", err //nolint:wrapcheck
+		}
+		if author := identity.Author(); author != "" {
+			return author, nil
+		}
+	}
+	whoami, err := user.Current()
 	if err != nil {
-		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to read revision chain")
+		return "<anonymous>", nil //nolint:nilerr
 	}
-	return chain.ParseRevisionId(revision) //nolint:wrapcheck
+	return whoami.Username, nil
 }
 
 func openWorkspace(ctx context.Context) (*ws.Workspace, error) {
-	path, err := filepath.Abs(".")
+	return openWorkspaceAt(ctx, ".")
+}
+
+func openWorkspaceAt(ctx context.Context, dir string) (*ws.Workspace, error) {
+	path, err := filepath.Abs(dir)
 	if err != nil {
 		return nil, lib.WrapErrorf(err, "failed to get absolute path for %s", path)
 	}
-	tmpDir, err := os.MkdirTemp(os.TempDir(), "cling-sync-workspace")
+	tmpFS, err := newWorkspaceTempFS()
 	if err != nil {
-		return nil, lib.WrapErrorf(err, "failed to create temporary directory")
+		return nil, err
+	}
+	workspace, err := ws.OpenWorkspace(ctx, lib.NewRealFS(path), tmpFS)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	workspace.EncryptCache = encryptCache
+	reportRemovedTempFiles(workspace.Storage)
+	return workspace, nil
+}
+
+// lockWorkspace acquires the workspace lock for the rest of a command, see
+// `ws.Workspace.Lock`. `wait` and `noWait` are the `--wait` and `--no-wait`
+// flags.
+func lockWorkspace(ctx context.Context, workspace *ws.Workspace, wait, noWait bool) (func() error, error) {
+	if wait && noWait {
+		return nil, lib.Errorf("--wait and --no-wait cannot be used together")
+	}
+	unlock, err := workspace.Lock(ctx, false)
+	if !errors.Is(err, ws.ErrWorkspaceLocked) {
+		return unlock, err //nolint:wrapcheck
+	}
+	if !wait {
+		return nil, lib.WrapErrorf(
+			err,
+			"another cling-sync command is running in this workspace, use --wait to wait for it",
+		)
+	}
+	fmt.Fprintln(os.Stderr, "Waiting for another cling-sync command in this workspace to finish...")
+	return workspace.Lock(ctx, true) //nolint:wrapcheck
+}
+
+// reportRemovedTempFiles tells the user about leftovers of interrupted writes
+// that were cleaned up when `storage` was opened.
+func reportRemovedTempFiles(storage lib.Storage) {
+	fileStorage, ok := storage.(*lib.FileStorage)
+	if !ok || len(fileStorage.RemovedTempFiles) == 0 {
+		return
+	}
+	fmt.Fprintf(
+		os.Stderr,
+		"Removed %d stale temporary files left by interrupted writes in %s:\n",
+		len(fileStorage.RemovedTempFiles),
+		fileStorage.FS,
+	)
+	for _, path := range fileStorage.RemovedTempFiles {
+		fmt.Fprintf(os.Stderr, "  %s\n", path)
 	}
-	return ws.OpenWorkspace(ctx, lib.NewRealFS(path), lib.NewRealFS(tmpDir)) //nolint:wrapcheck
 }
 
 // newTempFS creates a scratch FS under the system temp dir and returns it with
@@ -1893,7 +6597,36 @@ func newTempFS(name string) (lib.FS, func(), error) { //nolint:ireturn
 		return nil, nil, lib.WrapErrorf(err, "failed to create temporary directory")
 	}
 	cleanup := func() { os.RemoveAll(tmpDir) } //nolint:errcheck,gosec
-	return lib.NewRealFS(tmpDir), cleanup, nil
+	tmpFS, err := tempDirFS(tmpDir)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return tmpFS, cleanup, nil
+}
+
+// newWorkspaceTempFS creates the `ws.Workspace.TempFS` of a workspace under
+// the system temp dir. It is removed when the workspace is closed.
+func newWorkspaceTempFS() (lib.FS, error) { //nolint:ireturn
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "cling-sync-workspace")
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to create temporary directory")
+	}
+	tmpFS, err := tempDirFS(tmpDir)
+	if err != nil {
+		os.RemoveAll(tmpDir) //nolint:errcheck,gosec
+		return nil, err
+	}
+	return tmpFS, nil
+}
+
+// tempDirFS returns the FS of the temporary directory `dir`, encrypted with
+// a key that only lives in memory with `--encrypt-temp-files`.
+func tempDirFS(dir string) (lib.FS, error) { //nolint:ireturn
+	if !encryptTempFiles {
+		return lib.NewRealFS(dir), nil
+	}
+	return lib.NewEncryptedFS(lib.NewRealFS(dir)) //nolint:wrapcheck
 }
 
 // readWorkspaceRepositoryPassphrase returns the repository passphrase for the
@@ -1910,7 +6643,7 @@ func readWorkspaceRepositoryPassphrase(
 		encKeyStr, err := keychain.GetKeychainEntry(
 			ctx,
 			"com.cling.sync",
-			string(workspace.RemoteRepository),
+			string(workspace.Origin),
 		)
 		if err != nil {
 			return nil, lib.WrapErrorf(err, "failed to read local encryption key from keychain")
@@ -1937,6 +6670,10 @@ func openStorage(
 	passphrase []byte,
 	passphraseFromStdin bool,
 ) (lib.Storage, string, error) { //nolint:ireturn
+	uri, err := resolveRepositoryAlias(uri)
+	if err != nil {
+		return nil, "", err
+	}
 	if err := clingHTTP.RejectBareHTTPURI(uri); err != nil {
 		return nil, "", err //nolint:wrapcheck
 	}
@@ -1951,6 +6688,13 @@ func openStorage(
 		}
 		return storage, encryptedURI, nil
 	}
+	if rclone.IsStorageURI(uri) {
+		storage, err := ws.OpenStorage(uri, nil)
+		if err != nil {
+			return nil, "", lib.WrapErrorf(err, "failed to open repository storage")
+		}
+		return storage, uri, nil
+	}
 	abs, err := filepath.Abs(uri)
 	if err != nil {
 		return nil, "", lib.WrapErrorf(err, "failed to get absolute path for %s", uri)
@@ -1971,32 +6715,118 @@ func openRepository(
 	uri string,
 	passphraseFromStdin bool,
 ) (*lib.Repository, error) {
+	repository, _, err := openCachedRepository(ctx, workspace, uri, passphraseFromStdin, blockCacheOff)
+	return repository, err
+}
+
+type blockCacheMode int
+
+const (
+	blockCacheOff blockCacheMode = 1
+	// Read blocks from the workspace's block cache first. If the repository
+	// is unreachable, the head and the config cached by `prefetch` are used.
+	// If the cache has a size limit and the repository is remote, everything
+	// read is added to the cache as well.
+	blockCacheRead blockCacheMode = 2
+	// Like `blockCacheRead`, and add everything read to the cache.
+	blockCachePopulate blockCacheMode = 3
+)
+
+// openCachedRepository is like `openRepository`, but reads the repository
+// through the block cache of the workspace according to `mode`. The cache
+// is returned if it is used, i.e. if there is a workspace and `mode` is not
+// `blockCacheOff`.
+func openCachedRepository( //nolint:funlen
+	ctx context.Context,
+	workspace *ws.Workspace,
+	uri string,
+	passphraseFromStdin bool,
+	mode blockCacheMode,
+) (*lib.Repository, *ws.BlockCache, error) {
 	if workspace != nil && uri != "" {
 		panic("openRepository: workspace and uri are mutually exclusive")
 	}
 	if workspace == nil && uri == "" {
 		panic("openRepository: either workspace or uri must be set")
 	}
-	var passphrase []byte
-	var err error
 	if workspace != nil {
 		uri = string(workspace.RemoteRepository)
-		passphrase, err = readWorkspaceRepositoryPassphrase(ctx, workspace, passphraseFromStdin)
 	} else {
-		passphrase, err = readPassphrase(passphraseFromStdin)
+		var err error
+		uri, err = resolveRepositoryAlias(uri)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
-	if err != nil {
-		return nil, err
+	// With the keys from a running `agent`, there is no need for the passphrase.
+	agentKeys, fromAgent := readAgentKeys(ctx, uri)
+	var remote lib.Storage
+	var encryptedURI string
+	var passphrase []byte
+	var err error
+	if fromAgent {
+		remote, err = ws.OpenAgentStorage(agentRepositoryKey(uri), agentKeys)
+		if err != nil {
+			return nil, nil, lib.WrapErrorf(err, "failed to open repository storage")
+		}
+	} else {
+		if workspace != nil {
+			passphrase, err = readWorkspaceRepositoryPassphrase(ctx, workspace, passphraseFromStdin)
+		} else {
+			passphrase, err = readPassphrase(passphraseFromStdin)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		remote, encryptedURI, err = openStorage(uri, passphrase, passphraseFromStdin)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
-	storage, _, err := openStorage(uri, passphrase, passphraseFromStdin)
-	if err != nil {
-		return nil, err
+	storage := remote
+	var cache *ws.BlockCache
+	if workspace != nil && mode != blockCacheOff {
+		cache, err = workspace.OpenBlockCache(ctx, remote)
+		if err != nil {
+			return nil, nil, lib.WrapErrorf(err, "failed to open block cache")
+		}
+		cache.Populate = mode == blockCachePopulate ||
+			(mode == blockCacheRead && cache.Limit() > 0 &&
+				(clingHTTP.IsS3StorageURI(uri) || rclone.IsStorageURI(uri)))
+		storage = cache
+	}
+	var repository *lib.Repository
+	if fromAgent {
+		repository, err = lib.OpenRepositoryWithRecoveryCode(ctx, storage, agentKeys.RecoveryCode)
+	} else {
+		repository, err = lib.OpenRepository(ctx, storage, passphrase)
 	}
-	repository, err := lib.OpenRepository(ctx, storage, passphrase)
 	if err != nil {
-		return nil, lib.WrapErrorf(err, "failed to open repository")
+		return nil, nil, lib.WrapErrorf(err, "failed to open repository")
 	}
-	return repository, nil
+	if !fromAgent {
+		addAgentKeys(ctx, remote, uri, encryptedURI, passphrase)
+	}
+	reportRemovedTempFiles(remote)
+	if workspace != nil {
+		if err := workspace.MirrorRepositoryConfig(ctx, repository.Config()); err != nil {
+			repository.Close() //nolint:errcheck,gosec
+			return nil, nil, lib.WrapErrorf(err, "failed to mirror repository config")
+		}
+		signingKey, err := workspace.SigningKey(ctx)
+		if err != nil {
+			repository.Close()   //nolint:errcheck,gosec
+			return nil, nil, err //nolint:wrapcheck
+		}
+		repository.SetSigningKey(signingKey)
+		identity, err := workspace.Identity(ctx)
+		if err != nil {
+			repository.Close()   //nolint:errcheck,gosec
+			return nil, nil, err //nolint:wrapcheck
+		}
+		repository.SetClientId(identity.ClientId)
+	}
+	return repository, cache, nil
 }
 
 const s3KeyMinLen = 16
@@ -2116,6 +6946,53 @@ Pattern syntax:
 	`), "\n", "\n"+indent)
 }
 
+// newMemoryBudget returns nil, i.e. no budget, for a `--max-memory` of 0.
+func newMemoryBudget(maxMemory int) *lib.MemoryBudget {
+	if maxMemory == 0 {
+		return nil
+	}
+	return lib.NewMemoryBudget(int64(maxMemory))
+}
+
+// byteSizeFlag accepts a number of bytes with an optional binary unit,
+// e.g. `65536`, `64K`, or `4MiB`.
+func byteSizeFlag(flags *flag.FlagSet, name string, usage string, value *int) {
+	flags.Func(
+		name,
+		usage,
+		func(s string) error {
+			size, err := parseByteSize(s)
+			if err != nil {
+				return err
+			}
+			*value = size
+			return nil
+		},
+	)
+}
+
+func parseByteSize(s string) (int, error) {
+	units := []struct {
+		suffix     string
+		multiplier int
+	}{
+		{"GiB", 1024 * 1024 * 1024}, {"MiB", 1024 * 1024}, {"KiB", 1024},
+		{"G", 1024 * 1024 * 1024}, {"M", 1024 * 1024}, {"K", 1024}, {"B", 1},
+	}
+	number, multiplier := s, 1
+	for _, unit := range units {
+		if n, ok := strings.CutSuffix(s, unit.suffix); ok {
+			number, multiplier = n, unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil || n <= 0 {
+		return 0, lib.Errorf("invalid size %q, use a number of bytes with an optional unit (K, M, G)", s)
+	}
+	return n * multiplier, nil
+}
+
 func globPatternFlag(flags *flag.FlagSet, name string, usage string, value *lib.ExtendedGlobPatterns) {
 	flags.Func(
 		name,
@@ -2128,6 +7005,325 @@ func globPatternFlag(flags *flag.FlagSet, name string, usage string, value *lib.
 	)
 }
 
+// The flags that can be given multiple times. Their values in the config
+// file are comma separated lists.
+var listFlags = map[string]bool{"exclude": true, "include": true, "first": true} //nolint:gochecknoglobals
+
+// parseFlags parses `argv` like `flags.Parse`, after setting the defaults
+// from the `[defaults]` section and the section of the command in the user
+// config (see `userConfigFile`) and then in the config file of the workspace
+// in the current directory (see `ws.Config`).
+// The flags on the command line take precedence, the patterns of the list
+// flags are added to those of the config files.
+func parseFlags(flags *flag.FlagSet, argv []string) error {
+	if flagCollector != nil {
+		flagCollector(flags)
+		return errFlagsCollected
+	}
+	userConfig, path, err := readUserConfig()
+	if err != nil {
+		return err
+	}
+	if err := setConfigFlags(flags, userConfig, path); err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(".")
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to get the current directory")
+	}
+	config, err := ws.ReadConfig(lib.NewRealFS(dir))
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	if err := setConfigFlags(flags, config, ws.ConfigFile); err != nil {
+		return err
+	}
+	return flags.Parse(argv) //nolint:wrapcheck
+}
+
+// Set the flags of the `[defaults]` section and the section of the command
+// in `config`, which was read from `path`.
+func setConfigFlags(flags *flag.FlagSet, config *ws.Config, path string) error {
+	for _, section := range []string{ws.ConfigDefaultsSection, flags.Name()} {
+		values := config.Section(section)
+		for _, name := range slices.Sorted(maps.Keys(values)) {
+			if flags.Lookup(name) == nil {
+				if section == ws.ConfigDefaultsSection {
+					// Only some commands have the flag.
+					continue
+				}
+				return lib.Errorf("unknown flag %q in section [%s] of %s", name, section, path)
+			}
+			value := []string{values[name]}
+			if listFlags[name] {
+				value = ws.SplitConfigList(values[name])
+			}
+			for _, v := range value {
+				if err := flags.Set(name, v); err != nil {
+					return lib.WrapErrorf(err, "invalid value for %q in section [%s] of %s", name, section, path)
+				}
+			}
+		}
+	}
+	// The next config file or the command line replaces the messages.
+	markMessageFlagDefaults(flags)
+	return nil
+}
+
+// The config of the user, relative to $XDG_CONFIG_HOME or `~/.config`.
+// It has the format of the config file of a workspace (see `ws.Config`),
+// its flag defaults apply to all workspaces. In addition, it has the
+// sections `userConfigRepositoriesSection` and `userConfigKeychainSection`.
+const userConfigFile = "cling-sync/config.toml"
+
+// The aliases of repositories, e.g. `backup = "s3+https://host:4242/backup"`.
+// They can be used wherever a repository URI is expected.
+const userConfigRepositoriesSection = "repositories"
+
+// The keychain preferences: `backend` selects the keychain backend like
+// `keychain.BackendEnv`, which takes precedence.
+const userConfigKeychainSection = "keychain"
+
+// The absolute path of `userConfigFile`.
+func userConfigPath() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", lib.WrapErrorf(err, "failed to get the home directory")
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, userConfigFile), nil
+}
+
+// Read `userConfigFile` and return it with its path. The config is empty if
+// there is none.
+func readUserConfig() (*ws.Config, string, error) {
+	path, err := userConfigPath()
+	if err != nil {
+		return nil, "", err
+	}
+	config, err := ws.ReadConfigFile(lib.NewRealFS(filepath.Dir(path)), filepath.Base(path))
+	if err != nil {
+		return nil, "", lib.WrapErrorf(err, "failed to read the user config %s", path)
+	}
+	return config, path, nil
+}
+
+// Apply the keychain preferences of the user config.
+func applyUserConfig() error {
+	config, path, err := readUserConfig()
+	if err != nil {
+		return err
+	}
+	for key, value := range config.Section(userConfigKeychainSection) {
+		if key != "backend" {
+			return lib.Errorf("unknown key %q in section [%s] of %s", key, userConfigKeychainSection, path)
+		}
+		if !slices.Contains(keychain.Backends(), value) {
+			return lib.Errorf(
+				"unknown keychain backend %q in section [%s] of %s, use one of: %s",
+				value,
+				userConfigKeychainSection,
+				path,
+				strings.Join(keychain.Backends(), ", "),
+			)
+		}
+		keychain.PreferredBackend = value
+	}
+	return nil
+}
+
+// resolveRepositoryAlias returns the URI of the repository alias `uri` of
+// the user config, otherwise `uri` itself. Like the names of remotes, a
+// directory with the name of an alias is passed as `./<name>`.
+func resolveRepositoryAlias(uri string) (string, error) {
+	if ws.ValidateSyncTargetName(uri) != nil {
+		return uri, nil
+	}
+	config, _, err := readUserConfig()
+	if err != nil {
+		return "", err
+	}
+	if alias, ok := config.Section(userConfigRepositoriesSection)[uri]; ok {
+		return alias, nil
+	}
+	return uri, nil
+}
+
+// Replace the placeholders `{hostname}`, `{date}`, and `{time}` of a
+// commit message, e.g. of a message template in the config file.
+func expandMessage(message string, now time.Time) string {
+	if !strings.Contains(message, "{") {
+		return message
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return strings.NewReplacer(
+		"{hostname}", hostname,
+		"{date}", now.Format(time.DateOnly),
+		"{time}", now.Format(time.TimeOnly),
+	).Replace(message)
+}
+
+// The `--exclude` and `--include` flags of the commands that filter paths.
+type pathFilterFlags struct {
+	excludes []string
+	includes []string
+}
+
+// addPathFilterFlags adds `--exclude` with the given usage and `--include`
+// to `flags`.
+func addPathFilterFlags(flags *flag.FlagSet, excludeUsage string) *pathFilterFlags {
+	f := &pathFilterFlags{}
+	flags.Func("exclude", excludeUsage, func(pattern string) error {
+		f.excludes = append(f.excludes, pattern)
+		return nil
+	})
+	flags.Func("include", includeFlagDescription, func(pattern string) error {
+		f.includes = append(f.includes, pattern)
+		return nil
+	})
+	return f
+}
+
+// PathFilter returns the filter for the flags combined with the inclusion
+// filter of `patterns` (the positional arguments of a command, if any).
+// A path matching an `--exclude` pattern is excluded unless it matches an
+// `--include` pattern, no matter in which order the flags were given.
+// Like git, a path below an excluded directory cannot be included again.
+// Return nil if nothing is filtered.
+func (f *pathFilterFlags) PathFilter(patterns ...string) lib.PathFilter {
+	var filters []lib.PathFilter
+	if len(patterns) > 0 {
+		filters = append(filters, lib.NewPathInclusionFilter(patterns))
+	}
+	if len(f.excludes) > 0 {
+		excludes := slices.Clone(f.excludes)
+		for _, pattern := range f.includes {
+			excludes = append(excludes, "!"+pattern)
+		}
+		filters = append(filters, &parentsPathFilter{lib.NewPathExclusionFilter(excludes)})
+	}
+	switch len(filters) {
+	case 0:
+		return nil
+	case 1:
+		return filters[0]
+	default:
+		return &lib.AllPathFilter{Filters: filters}
+	}
+}
+
+// Exclude the paths below a directory that `filter` excludes. Otherwise,
+// the commands that skip excluded directories while walking the workspace
+// would not agree with the commands that read all paths of a revision.
+type parentsPathFilter struct {
+	filter lib.PathFilter
+}
+
+func (f *parentsPathFilter) Include(p lib.Path, isDir bool) bool {
+	for dir := p.Dir(); !dir.IsEmpty(); dir = dir.Dir() {
+		if !f.filter.Include(dir, true) {
+			return false
+		}
+	}
+	return f.filter.Include(p, isDir)
+}
+
+// A command of the CLI, see `commands`.
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, argv []string, passphraseFromStdin bool) error
+	// What the positional arguments are completed with (see `completion`).
+	args completionKind
+	// The first positional argument of commands like `security`.
+	subcommands []string
+}
+
+// All commands of the CLI in the order of the usage.
+func commands() []command {
+	agentCmd := func(ctx context.Context, argv []string, _ bool) error { return AgentCmd(ctx, argv) }
+	reposCmd := func(_ context.Context, argv []string, _ bool) error { return ReposCmd(argv) }
+	return []command{
+		{
+			"agent",
+			"Keep the decrypted repository keys in memory for other commands",
+			agentCmd,
+			completeNothing,
+			[]string{"forget"},
+		},
+		{"attach", "Attach a local directory to a repository", AttachCmd, completeFiles, nil},
+		{"cache", "Manage the block cache of the workspace", CacheCmd, completeNothing, []string{
+			"info", "limit", "clear",
+		}},
+		{"cat", "Print the contents of a file in the repository", CatCmd, completePaths, nil},
+		{"check", "Check the health of the repository", CheckCmd, completeNothing, nil},
+		{"checkout-to", "Write an older revision into a separate directory", CheckoutToCmd, completeRevisions, nil},
+		{
+			"completion",
+			"Print a shell completion script for bash, zsh, or fish",
+			CompletionCmd,
+			completeNothing,
+			[]string{"bash", "zsh", "fish"},
+		},
+		{"cp", "Copy files from the repository to a local directory", CpCmd, completePaths, nil},
+		{"debug", "Diagnose problems with a repository, e.g. stuck locks", DebugCmd, completeNothing, []string{
+			"locks",
+		}},
+		{"diff", "Show differences between two revisions", DiffCmd, completeRevisions, nil},
+		{"du", "Show the size of the directories and files of a revision", DuCmd, completePaths, nil},
+		{"export", "Write a revision as a tar archive to stdout", ExportCmd, completePaths, nil},
+		{"find", "Find all versions of paths in all revisions", FindCmd, completePaths, nil},
+		{"fleet", "Show the status of several workspaces at once", FleetCmd, completeNothing, []string{
+			"status",
+		}},
+		{"identity", "Show or change the author and client id of the workspace", IdentityCmd, completeNothing, nil},
+		{"import", "Commit a tar archive or a directory without a workspace", ImportCmd, completeFiles, nil},
+		{"init", "Initialize a new repository", InitCmd, completeFiles, nil},
+		{"ls", "List files in the repository", LsCmd, completePaths, nil},
+		{"log", "Show revision log", LogCmd, completeNothing, nil},
+		{"merge", "Merge changes from the repository and the workspace", MergeCmd, completeNothing, nil},
+		{"mount", "Mount a revision as a read-only FUSE filesystem", MountCmd, completeFiles, nil},
+		{"mv", "Rename a path in the repository", MvCmd, completePaths, nil},
+		{"pack", "Move the blocks of a local repository into pack files", PackCmd, completeNothing, nil},
+		{"ping", "Check that the repository is reachable and readable", PingCmd, completeNothing, nil},
+		{"prefetch", "Download files into the local block cache for offline use", PrefetchCmd, completePaths, nil},
+		{"repair-head", "Repair the workspace head after an interrupted merge", RepairHeadCmd, completeNothing, nil},
+		{"replicate", "Mirror a repository to another storage without decrypting it", ReplicateCmd, completeFiles, nil},
+		{"repos", "List the repository aliases of the user config", reposCmd, completeNothing, nil},
+		{"reset", "Reset the workspace to a specific revision", ResetCmd, completeRevisions, nil},
+		{"restore", "Restore paths from an older revision into the workspace", RestoreCmd, completePaths, nil},
+		{"rm", "Remove paths from the repository", RmCmd, completePaths, nil},
+		{"scrub", "Verify a part of the repository's blocks on every run", ScrubCmd, completeNothing, nil},
+		{
+			"security",
+			"Configure security settings (saved passphrase, encrypted S3 URIs)",
+			SecurityCmd,
+			completeNothing,
+			[]string{
+				"save-passphrase", "delete-passphrase", "encrypt-s3-url", "export-config", "export-recovery-code",
+				"add-passphrase", "remove-passphrase", "generate-identity", "add-recipient",
+				"generate-signing-key", "signer", "trust-signer",
+			},
+		},
+		{"serve", "Serve the workspace repository as an S3-compatible bucket", ServeCmd, completeFiles, nil},
+		{"stats", "Show size and deduplication statistics", StatsCmd, completeNothing, nil},
+		{"status", "Show repository status", StatusCmd, completeFiles, nil},
+		{"sync-repo", "Sync repository to another repository", SyncRepoCmd, completeNothing, []string{
+			"init", "add", "list", "delete", "run",
+		}},
+		{"tag", "Create, list, or delete named revisions", TagCmd, completeRevisions, nil},
+		{"undelete", "Bring back a path that was deleted from the repository", UndeleteCmd, completeNothing, nil},
+		{"upgrade-repo", "Copy the repository to the current repository version", UpgradeRepoCmd, completeFiles, nil},
+		{"watch", "Keep the workspace in sync with the repository", WatchCmd, completeNothing, nil},
+	}
+}
+
 func main() {
 	os.Exit(run())
 }
@@ -2140,26 +7336,17 @@ func run() int { //nolint:funlen
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "%s %s\n\n", appName, version)
 		fmt.Fprintf(os.Stderr, "Usage: %s <command> [command arguments]\n\n", appName)
-		fmt.Fprint(os.Stderr, "Remote repositories: only S3-compatible backends are currently supported.\n")
+		fmt.Fprint(os.Stderr, "Remote repositories: S3-compatible backends and rclone remotes.\n")
 		fmt.Fprintf(
 			os.Stderr,
-			"Use `s3+<http-url>` URIs to point at one, and `%s serve` to host one.\n\n",
+			"Use `s3+<http-url>` URIs to point at one, and `%s serve` to host one.\n"+
+				"Use `rclone://<remote>:<path>` URIs for any remote configured with `rclone config`.\n\n",
 			appName,
 		)
 		fmt.Fprint(os.Stderr, "Commands:\n")
-		fmt.Fprint(os.Stderr, "  attach       Attach a local directory to a repository\n")
-		fmt.Fprint(os.Stderr, "  cat          Print the contents of a file in the repository\n")
-		fmt.Fprint(os.Stderr, "  check        Check the health of the repository\n")
-		fmt.Fprint(os.Stderr, "  cp           Copy files from the repository to a local directory\n")
-		fmt.Fprint(os.Stderr, "  init         Initialize a new repository\n")
-		fmt.Fprint(os.Stderr, "  ls           List files in the repository\n")
-		fmt.Fprint(os.Stderr, "  log          Show revision log\n")
-		fmt.Fprint(os.Stderr, "  merge        Merge changes from the repository and the workspace\n")
-		fmt.Fprint(os.Stderr, "  reset        Reset the workspace to a specific revision\n")
-		fmt.Fprint(os.Stderr, "  security     Configure security settings (saved passphrase, encrypted S3 URIs)\n")
-		fmt.Fprint(os.Stderr, "  serve        Serve the workspace repository as an S3-compatible bucket\n")
-		fmt.Fprint(os.Stderr, "  status       Show repository status\n")
-		fmt.Fprint(os.Stderr, "  sync-repo    Sync repository to another repository")
+		for _, c := range commands() {
+			fmt.Fprintf(os.Stderr, "  %-12s %s\n", c.name, c.summary)
+		}
 		fmt.Fprint(os.Stderr, "\nGlobal flags:\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nRun '%s <command> --help' for more information on a command.\n", appName)
@@ -2171,6 +7358,85 @@ func run() int { //nolint:funlen
 		false,
 		"Read passphrase from stdin - useful for scripting, but use with caution as it might expose the passphrase",
 	)
+	flag.Func(
+		"http-header",
+		"Send this `Name: value` header with every request to the repository server (can be used multiple times)",
+		func(value string) error {
+			name, headerValue, err := clingHTTP.ParseHTTPHeader(value)
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+			if clingHTTP.DefaultHTTPClientConfig.Headers == nil {
+				clingHTTP.DefaultHTTPClientConfig.Headers = map[string]string{}
+			}
+			clingHTTP.DefaultHTTPClientConfig.Headers[name] = headerValue
+			return nil
+		},
+	)
+	flag.StringVar(
+		&clingHTTP.DefaultHTTPClientConfig.Proxy,
+		"http-proxy",
+		"",
+		"Connect to the repository server through this HTTP, HTTPS, or SOCKS5 proxy URL"+
+			" (default $"+clingHTTP.ProxyEnv+" or the HTTPS_PROXY and HTTP_PROXY environment variables)",
+	)
+	flag.Func(
+		"http-retries",
+		fmt.Sprintf(
+			"Retry failed requests to the repository server this many times, with a growing delay (default %d)",
+			clingHTTP.DefaultRetryPolicy.Attempts-1,
+		),
+		func(value string) error {
+			retries, err := strconv.Atoi(value)
+			if err != nil || retries < 0 {
+				return lib.Errorf("invalid number of retries: %s", value)
+			}
+			clingHTTP.DefaultRetryPolicy.Attempts = retries + 1
+			return nil
+		},
+	)
+	flag.StringVar(
+		&clingHTTP.DefaultHTTPClientConfig.CAFile,
+		"ca-file",
+		"",
+		"Trust the certificates in this PEM file in addition to the system's (default $"+clingHTTP.CAFileEnv+")",
+	)
+	flag.BoolVar(
+		&encryptTempFiles,
+		"encrypt-temp-files",
+		os.Getenv(encryptTempFilesEnv) != "",
+		"Encrypt the temporary files, e.g. the paths and hashes of the revisions a merge compares,\n"+
+			"with a key that only lives in memory (default $"+encryptTempFilesEnv+")",
+	)
+	flag.BoolVar(
+		&encryptCache,
+		"encrypt-cache",
+		os.Getenv(encryptCacheEnv) != "",
+		"Encrypt the staging cache of the workspace with a key derived from the repository keys,\n"+
+			"the cache is rebuilt whenever this is turned on or off (default $"+encryptCacheEnv+")",
+	)
+	logLevel.Set(slog.LevelWarn)
+	textLogHandler, _ := newLogHandler(os.Stderr, "text")
+	slog.SetDefault(slog.New(textLogHandler))
+	flag.Func(
+		"log-level",
+		"Write the diagnostic log to stderr from this `level` on: debug, info, warn, or error (default warn)",
+		func(value string) error {
+			return logLevel.UnmarshalText([]byte(value)) //nolint:wrapcheck
+		},
+	)
+	flag.Func(
+		"log-format",
+		"The `format` of the diagnostic log: text or json (default text)",
+		func(value string) error {
+			handler, err := newLogHandler(os.Stderr, value)
+			if err != nil {
+				return err
+			}
+			slog.SetDefault(slog.New(handler))
+			return nil
+		},
+	)
 	flag.Parse()
 	if args.Help {
 		flag.Usage()
@@ -2181,47 +7447,52 @@ func run() int { //nolint:funlen
 		flag.Usage()
 		return 1
 	}
+	if err := applyUserConfig(); err != nil {
+		PrintErr("%s", err.Error())
+		return 1
+	}
 	argv := flag.Args()[1:]
 	cmd := flag.Arg(0)
 	ctx := context.Background()
-	var err error
-	switch cmd {
-	case "attach":
-		err = AttachCmd(ctx, argv, args.PassphraseFromStdin)
-	case "cat":
-		err = CatCmd(ctx, argv, args.PassphraseFromStdin)
-	case "check":
-		err = CheckCmd(ctx, argv, args.PassphraseFromStdin)
-	case "cp":
-		err = CpCmd(ctx, argv, args.PassphraseFromStdin)
-	case "init":
-		err = InitCmd(ctx, argv, args.PassphraseFromStdin)
-	case "ls":
-		err = LsCmd(ctx, argv, args.PassphraseFromStdin)
-	case "log":
-		err = LogCmd(ctx, argv, args.PassphraseFromStdin)
-	case "merge":
-		err = MergeCmd(ctx, argv, args.PassphraseFromStdin)
-	case "reset":
-		err = ResetCmd(ctx, argv, args.PassphraseFromStdin)
-	case "security":
-		err = SecurityCmd(ctx, argv, args.PassphraseFromStdin)
-	case "serve":
-		err = ServeCmd(ctx, argv, args.PassphraseFromStdin)
-	case "status":
-		err = StatusCmd(ctx, argv, args.PassphraseFromStdin)
-	case "sync-repo":
-		err = SyncRepoCmd(ctx, argv, args.PassphraseFromStdin)
-	case "":
+	if cmd == "" {
 		flag.Usage()
 		return 0
-	default:
+	}
+	i := slices.IndexFunc(commands(), func(c command) bool { return c.name == cmd })
+	if i < 0 {
 		PrintErr("%s is not a valid command. See '%s --help'.", cmd, appName)
 		return 1
 	}
+	err := commands()[i].run(ctx, argv, args.PassphraseFromStdin)
 	if err != nil {
 		PrintErr("%s", err.Error())
-		return 1
+		if errors.Is(err, lib.ErrLockLost) {
+			fmt.Fprintln(os.Stderr, "The repository lock was released by someone else and the head was not updated. Try again.")
+		}
+		if errors.Is(err, lib.ErrNetwork) {
+			fmt.Fprintln(
+				os.Stderr,
+				"The repository could not be reached. The blocks uploaded so far are kept,\n"+
+					"so running the command again continues where it stopped.",
+			)
+		}
+		if errors.Is(err, lib.ErrQuotaExceeded) {
+			fmt.Fprintln(
+				os.Stderr,
+				"The repository quota of the server is exceeded and nothing was committed.\n"+
+					"Once the quota was raised, running the command again continues where it stopped.",
+			)
+		}
+		if errors.Is(err, ws.ErrHeadNotRepaired) {
+			fmt.Fprintf(
+				os.Stderr,
+				"Run `%s repair-head --revision <revision-id>` if you know which revision the workspace is at,\n"+
+					"or `%s reset <revision-id>` to discard the local changes.\n",
+				appName,
+				appName,
+			)
+		}
+		return exitCode(err)
 	}
 	return 0
 }
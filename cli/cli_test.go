@@ -0,0 +1,265 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	clingHTTP "github.com/flunderpero/cling-sync/http"
+	"github.com/flunderpero/cling-sync/lib"
+	ws "github.com/flunderpero/cling-sync/workspace"
+)
+
+func TestExitCode(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	assert.Equal(exitCodeError, exitCode(lib.Errorf("something failed")))
+	assert.Equal(exitCodeIgnored, exitCode(lib.WrapErrorf(errIgnoredPaths, "cp")))
+	assert.Equal(exitCodeConflict, exitCode(lib.WrapErrorf(ws.MergeConflictsError{}, "merge")))
+	assert.Equal(exitCodeConflict, exitCode(lib.WrapErrorKindf(ws.ErrConflict, nil, "conflicts")))
+	assert.Equal(exitCodeAuth, exitCode(lib.WrapErrorf(lib.ErrInvalidRecoveryCode, "init")))
+	assert.Equal(exitCodeCorrupt, exitCode(lib.WrapErrorKindf(lib.ErrCorrupt, io.ErrUnexpectedEOF, "read")))
+	assert.Equal(exitCodeContention, exitCode(lib.WrapErrorf(&lib.LockExistsError{}, "commit"))) //nolint:exhaustruct
+	assert.Equal(exitCodeContention, exitCode(lib.WrapErrorf(ws.ErrRemoteChanged, "merge")))
+	assert.Equal(exitCodeNetwork, exitCode(lib.WrapErrorKindf(lib.ErrNetwork, nil, "offline")))
+	assert.Equal(exitCodeQuota, exitCode(lib.WrapErrorf(lib.ErrQuotaExceeded, "write block")))
+}
+
+func TestPathFilterFlags(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	parse := func(argv ...string) (*pathFilterFlags, []string) {
+		t.Helper()
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		f := addPathFilterFlags(flags, "exclude")
+		assert.NoError(flags.Parse(argv))
+		return f, flags.Args()
+	}
+	include := func(filter lib.PathFilter, path string) bool {
+		t.Helper()
+		p, err := lib.NewPath(path)
+		assert.NoError(err)
+		return filter.Include(p, false)
+	}
+	f, _ := parse()
+	assert.Nil(f.PathFilter())
+	// `--include` only overrides `--exclude`.
+	f, _ = parse("--include", "*.txt")
+	assert.Nil(f.PathFilter())
+
+	// An include overrides the excludes no matter the order of the flags.
+	f, args := parse("--include", "logs/keep.log", "--exclude", "logs/*", "--exclude", "*.tmp", "a/**")
+	filter := f.PathFilter(args...)
+	assert.Equal(true, include(filter, "a/b.txt"))
+	assert.Equal(false, include(filter, "a/b.tmp"))
+	assert.Equal(false, include(filter, "b.txt"))
+	assert.Equal(true, include(f.PathFilter(), "b.txt"))
+	assert.Equal(false, include(f.PathFilter(), "logs/other.log"))
+	assert.Equal(true, include(f.PathFilter(), "logs/keep.log"))
+
+	// Like git, a path below an excluded directory cannot be included again.
+	f, _ = parse("--exclude", "logs", "--include", "logs/keep.log")
+	assert.Equal(false, include(f.PathFilter(), "logs/keep.log"))
+}
+
+func TestExpandMessage(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	hostname, err := os.Hostname()
+	assert.NoError(err)
+	now := time.Date(2025, 5, 13, 12, 16, 0, 0, time.UTC)
+	assert.Equal("Synced", expandMessage("Synced", now))
+	assert.Equal(
+		"Synced from "+hostname+" on 2025-05-13 at 12:16:00 {unknown}",
+		expandMessage("Synced from {hostname} on {date} at {time} {unknown}", now),
+	)
+}
+
+func TestReadCredentialsFile(t *testing.T) {
+	t.Parallel()
+	write := func(t *testing.T, content string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "credentials")
+		lib.NewAssert(t).NoError(os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+
+	t.Run("TOML and .env style", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		for _, content := range []string{
+			"[serve]\nCLING_S3_KEY_ID = \"id\"\nCLING_S3_ACCESS_KEY = \"secret\"\n",
+			"# comment\nCLING_S3_KEY_ID=id\n\n  CLING_S3_ACCESS_KEY=secret  \n",
+		} {
+			creds, err := readCredentialsFile(write(t, content))
+			assert.NoError(err)
+			assert.Equal("id", creds.AccessKeyID)
+			assert.Equal("secret", string(creds.SecretAccessKey))
+		}
+	})
+
+	t.Run("Malformed files are rejected", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		for _, content := range []string{
+			"",
+			"CLING_S3_KEY_ID=id\n",
+			"CLING_S3_ACCESS_KEY=secret\n",
+			"CLING_S3_KEY_ID id\nCLING_S3_ACCESS_KEY secret\n",
+			"CLING_S3_KEY_ID=\"\"\nCLING_S3_ACCESS_KEY=secret\n",
+		} {
+			_, err := readCredentialsFile(write(t, content))
+			assert.Error(err, "missing CLING_S3_KEY_ID or CLING_S3_ACCESS_KEY")
+		}
+		_, err := readCredentialsFile(filepath.Join(t.TempDir(), "missing"))
+		assert.Error(err, "failed to read --credentials-file")
+	})
+}
+
+func TestReadServeCredentials(t *testing.T) {
+	t.Parallel()
+	newStorage := func(t *testing.T) lib.Storage {
+		t.Helper()
+		storage, err := lib.NewFileStorage(lib.NewRealFS(t.TempDir()), lib.StoragePurposeRepository)
+		lib.NewAssert(t).NoError(err)
+		return storage
+	}
+
+	t.Run("Credentials are generated once", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		storage := newStorage(t)
+		ak, sk, created, err := readServeCredentials(t.Context(), storage)
+		assert.NoError(err)
+		assert.Equal(true, created)
+		assert.NotEqual("", ak)
+		assert.NotEqual("", sk)
+		ak2, sk2, created, err := readServeCredentials(t.Context(), storage)
+		assert.NoError(err)
+		assert.Equal(false, created)
+		assert.Equal(ak, ak2)
+		assert.Equal(sk, sk2)
+	})
+
+	t.Run("Malformed conf/serve is rejected", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		storage := newStorage(t)
+		assert.NoError(storage.WriteControlFile(t.Context(), lib.ControlFileSectionConf, "serve",
+			[]byte("[serve]\nCLING_S3_KEY_ID = \"id\"\n")))
+		_, _, _, err := readServeCredentials(t.Context(), storage)
+		assert.Error(err, "conf/serve is missing CLING_S3_KEY_ID or CLING_S3_ACCESS_KEY")
+	})
+}
+
+// Serve the repository in a fresh directory like `serve --credentials-file`
+// and return the server and the storage.
+func newTestServeServer(t *testing.T, mux *http.ServeMux) (*httptest.Server, lib.Storage) {
+	t.Helper()
+	assert := lib.NewAssert(t)
+	storage, err := lib.NewFileStorage(lib.NewRealFS(t.TempDir()), lib.StoragePurposeRepository)
+	assert.NoError(err)
+	assert.NoError(storage.Init(t.Context(), lib.Toml{}, ""))
+	credentials := filepath.Join(t.TempDir(), "credentials")
+	assert.NoError(os.WriteFile(credentials, []byte("CLING_S3_KEY_ID=id\nCLING_S3_ACCESS_KEY=secret\n"), 0o600))
+	server, err := newServeServer(
+		t.Context(), storage, "test", credentials, "us-east-1", serveServerOptions{}, "s3+http://test",
+	)
+	assert.NoError(err)
+	server.RegisterRoutes(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, storage
+}
+
+func newTestServeClient(srv *httptest.Server, id, secret string) *clingHTTP.S3StorageClient {
+	return clingHTTP.NewS3StorageClient(clingHTTP.S3StorageConfig{
+		BucketURL:       srv.URL,
+		Region:          "us-east-1",
+		Prefix:          "",
+		AccessKeyID:     id,
+		SecretAccessKey: []byte(secret),
+	}, clingHTTP.NewDefaultHTTPClient(srv.Client()))
+}
+
+func TestServeCredentials(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	srv, storage := newTestServeServer(t, http.NewServeMux())
+	assert.NoError(storage.WriteControlFile(t.Context(), lib.ControlFileSectionConf, "state", []byte("a")))
+
+	// Requests signed with the credentials of the file are accepted.
+	client := newTestServeClient(srv, "id", "secret")
+	data, err := client.ReadControlFile(t.Context(), lib.ControlFileSectionConf, "state")
+	assert.NoError(err)
+	assert.Equal("a", string(data))
+	assert.NoError(client.WriteControlFile(t.Context(), lib.ControlFileSectionConf, "state", []byte("b")))
+
+	// Requests signed with other credentials are rejected.
+	for _, creds := range [][2]string{{"id", "wrong"}, {"wrong", "secret"}} {
+		client := newTestServeClient(srv, creds[0], creds[1])
+		_, err := client.ReadControlFile(t.Context(), lib.ControlFileSectionConf, "state")
+		assert.Error(err, "403")
+		assert.Error(client.WriteControlFile(t.Context(), lib.ControlFileSectionConf, "state", []byte("c")), "403")
+	}
+
+	// So are requests without a signature.
+	resp, err := srv.Client().Get(srv.URL + "/conf/state")
+	assert.NoError(err)
+	assert.NoError(resp.Body.Close())
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+	data, err = storage.ReadControlFile(t.Context(), lib.ControlFileSectionConf, "state")
+	assert.NoError(err)
+	assert.Equal("b", string(data))
+}
+
+func TestServeUI(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	mux := http.NewServeMux()
+	ui := fstest.MapFS{"index.html": &fstest.MapFile{Data: []byte("<html>ui</html>")}} //nolint:exhaustruct
+	assert.Equal("/base/ui/", handleServeUI(mux, http.FileServerFS(ui), "/base/"))
+	srv, storage := newTestServeServer(t, mux)
+	assert.NoError(storage.WriteControlFile(t.Context(), lib.ControlFileSectionConf, "state", []byte("a")))
+
+	send := func(method, path string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequestWithContext(t.Context(), method, srv.URL+path, strings.NewReader("x"))
+		assert.NoError(err)
+		resp, err := srv.Client().Do(req)
+		assert.NoError(err)
+		assert.NoError(resp.Body.Close())
+		return resp
+	}
+
+	t.Run("The UI is read-only", func(t *testing.T) {
+		for _, path := range []string{"/ui/", "/base/ui/"} {
+			assert.Equal(http.StatusOK, send(http.MethodGet, path).StatusCode)
+			assert.Equal(http.StatusOK, send(http.MethodHead, path+"index.html").StatusCode)
+			for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+				resp := send(method, path+"index.html")
+				assert.Equal(http.StatusMethodNotAllowed, resp.StatusCode, method, path)
+				assert.Equal("GET, HEAD", resp.Header.Get("Allow"))
+			}
+		}
+	})
+
+	t.Run("The repository still requires the S3 credentials", func(t *testing.T) {
+		assert.Equal(http.StatusForbidden, send(http.MethodGet, "/conf/state").StatusCode)
+		assert.Equal(http.StatusForbidden, send(http.MethodPut, "/conf/state").StatusCode)
+		_, err := newTestServeClient(srv, "id", "wrong").ReadControlFile(t.Context(), lib.ControlFileSectionConf, "state")
+		assert.Error(err, "403")
+		data, err := newTestServeClient(srv, "id", "secret").ReadControlFile(
+			t.Context(), lib.ControlFileSectionConf, "state",
+		)
+		assert.NoError(err)
+		assert.Equal("a", string(data))
+	})
+}
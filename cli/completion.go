@@ -0,0 +1,384 @@
+//nolint:forbidigo
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/flunderpero/cling-sync/lib"
+	ws "github.com/flunderpero/cling-sync/workspace"
+)
+
+// What a positional argument or the value of a flag is completed with.
+type completionKind int
+
+const (
+	// No completions, the shell falls back to local files.
+	completeNothing completionKind = iota
+	completeFiles
+	// `head`, the tags, and the revision ids of the repository.
+	completeRevisions
+	// The paths of the head of the repository.
+	completePaths
+)
+
+// The revisions offered by the completion, the newest first.
+const maxCompletedRevisions = 100
+
+// Set by `commandFlags` to collect the flags of a command instead of running
+// it: `parseFlags` hands the flags over and returns `errFlagsCollected`.
+var flagCollector func(flags *flag.FlagSet) //nolint:gochecknoglobals
+
+var errFlagsCollected = lib.Errorf("the flags were collected")
+
+func CompletionCmd(ctx context.Context, argv []string, _ bool) error {
+	var help, complete bool
+	flags := flag.NewFlagSet("completion", flag.ExitOnError)
+	flags.BoolVar(&help, "help", false, "Show help message")
+	flags.BoolVar(
+		&complete,
+		"complete",
+		false,
+		"Print the completions of the last argument, the arguments are the command line\n"+
+			"without the program name (used by the completion scripts)",
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s completion <bash|zsh|fish>\n\n", appName)
+		fmt.Fprint(os.Stderr, "Print a script that completes the commands, flags, revisions, and\n")
+		fmt.Fprint(os.Stderr, "repository paths of cling-sync in the given shell, e.g.:\n\n")
+		fmt.Fprintf(os.Stderr, "    source <(%s completion bash)    # in ~/.bashrc\n", appName)
+		fmt.Fprintf(os.Stderr, "    source <(%s completion zsh)     # in ~/.zshrc\n", appName)
+		fmt.Fprintf(os.Stderr, "    %s completion fish > ~/.config/fish/completions/%s.fish\n\n", appName, appName)
+		fmt.Fprint(os.Stderr, "Revisions and repository paths are only completed in a workspace with a\n")
+		fmt.Fprint(os.Stderr, "saved passphrase (see `security save-passphrase`) or a running `agent`.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, argv); err != nil {
+		return err
+	}
+	if help {
+		flags.Usage()
+		return nil
+	}
+	if complete {
+		if flags.NArg() == 0 {
+			return lib.Errorf("--complete requires the command line as arguments")
+		}
+		for _, c := range completions(ctx, flags.Args()) {
+			fmt.Println(c)
+		}
+		return nil
+	}
+	if flags.NArg() != 1 {
+		return lib.Errorf("one positional argument is required: <bash|zsh|fish>")
+	}
+	var script string
+	switch flags.Arg(0) {
+	case "bash":
+		script = bashCompletion
+	case "zsh":
+		script = zshCompletion
+	case "fish":
+		script = fishCompletion
+	default:
+		return lib.Errorf("unsupported shell %q, use bash, zsh, or fish", flags.Arg(0))
+	}
+	fmt.Print(strings.NewReplacer("{app}", appName, "{fn}", strings.ReplaceAll(appName, "-", "_")).Replace(script))
+	return nil
+}
+
+// completions returns the completions of the last of `words`, the command
+// line without the program name. An empty result lets the shell complete
+// local files.
+func completions(ctx context.Context, words []string) []string {
+	current := words[len(words)-1]
+	words = words[:len(words)-1]
+	cmdIndex := skipFlags(flag.CommandLine, words)
+	if cmdIndex > len(words) {
+		// The value of a global flag.
+		return nil
+	}
+	if cmdIndex == len(words) {
+		if strings.HasPrefix(current, "-") {
+			return flagNames(flag.CommandLine, current)
+		}
+		var names []string
+		for _, c := range commands() {
+			names = append(names, c.name)
+		}
+		return withPrefix(names, current)
+	}
+	i := slices.IndexFunc(commands(), func(c command) bool { return c.name == words[cmdIndex] })
+	if i < 0 {
+		return nil
+	}
+	c := commands()[i]
+	flags := commandFlags(ctx, c)
+	if strings.HasPrefix(current, "-") {
+		return flagNames(flags, current)
+	}
+	args := words[cmdIndex+1:]
+	if len(args) > 0 {
+		if f := valueFlag(flags, args[len(args)-1]); f != nil {
+			switch f.Name {
+			case "revision":
+				return withPrefix(completeRevisionIds(ctx), current)
+			case "repository":
+				return withPrefix(repositoryAliases(), current)
+			default:
+				return nil
+			}
+		}
+	}
+	if c.subcommands != nil {
+		if positionalArgs(flags, args) == 0 {
+			return withPrefix(c.subcommands, current)
+		}
+		return nil
+	}
+	switch c.args {
+	case completeRevisions:
+		return withPrefix(completeRevisionIds(ctx), current)
+	case completePaths:
+		return completeRepositoryPaths(ctx, current)
+	case completeNothing, completeFiles:
+	}
+	return nil
+}
+
+// commandFlags returns the flags of `c` without running it, see
+// `flagCollector`. It is empty if `c` has no flags.
+func commandFlags(ctx context.Context, c command) *flag.FlagSet {
+	flags := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	flagCollector = func(f *flag.FlagSet) {
+		flags = f
+	}
+	defer func() { flagCollector = nil }()
+	_ = c.run(ctx, nil, false)
+	return flags
+}
+
+// Return the index of the first word that is neither a flag nor the value
+// of one, more than `len(words)` if the last word is a flag that is missing
+// its value.
+func skipFlags(flags *flag.FlagSet, words []string) int {
+	i := 0
+	for i < len(words) && strings.HasPrefix(words[i], "-") {
+		if valueFlag(flags, words[i]) != nil {
+			i++
+		}
+		i++
+	}
+	return i
+}
+
+// Return the number of positional arguments in `args`.
+func positionalArgs(flags *flag.FlagSet, args []string) int {
+	n := 0
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--":
+			return n + len(args) - i - 1
+		case strings.HasPrefix(args[i], "-"):
+			if valueFlag(flags, args[i]) != nil {
+				i++
+			}
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// Return the flag `word` if it takes a value that is given as the next
+// argument, i.e. it is not a boolean flag and not `--name=value`.
+func valueFlag(flags *flag.FlagSet, word string) *flag.Flag {
+	if !strings.HasPrefix(word, "-") || strings.Contains(word, "=") {
+		return nil
+	}
+	f := flags.Lookup(strings.TrimLeft(word, "-"))
+	if f == nil {
+		return nil
+	}
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		return nil
+	}
+	return f
+}
+
+func flagNames(flags *flag.FlagSet, prefix string) []string {
+	var names []string
+	flags.VisitAll(func(f *flag.Flag) {
+		names = append(names, "--"+f.Name)
+	})
+	return withPrefix(names, prefix)
+}
+
+func withPrefix(candidates []string, prefix string) []string {
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, prefix) {
+			matches = append(matches, c)
+		}
+	}
+	return matches
+}
+
+func repositoryAliases() []string {
+	config, _, err := readUserConfig()
+	if err != nil {
+		return nil
+	}
+	return slices.Sorted(maps.Keys(config.Section(userConfigRepositoriesSection)))
+}
+
+// openCompletionRepository opens the repository of the workspace in the
+// current directory, nil if that is not possible without asking for the
+// passphrase.
+func openCompletionRepository(ctx context.Context) (*lib.Repository, lib.Path, func()) {
+	workspace, err := openWorkspace(ctx)
+	if err != nil {
+		return nil, lib.Path{}, nil
+	}
+	if _, fromAgent := readAgentKeys(ctx, string(workspace.RemoteRepository)); !fromAgent &&
+		!workspace.HasSavedPassphrase(ctx) {
+		workspace.Close() //nolint:errcheck,gosec
+		return nil, lib.Path{}, nil
+	}
+	repository, _, err := openCachedRepository(ctx, workspace, "", false, blockCacheRead)
+	if err != nil {
+		workspace.Close() //nolint:errcheck,gosec
+		return nil, lib.Path{}, nil
+	}
+	return repository, workspace.PathPrefix, func() {
+		repository.Close() //nolint:errcheck,gosec
+		workspace.Close()  //nolint:errcheck,gosec
+	}
+}
+
+func completeRevisionIds(ctx context.Context) []string {
+	repository, _, closeRepository := openCompletionRepository(ctx)
+	if repository == nil {
+		return nil
+	}
+	defer closeRepository()
+	revisions := []string{"head"}
+	tags, err := repository.Tags(ctx)
+	if err != nil {
+		return nil
+	}
+	for _, tag := range tags {
+		revisions = append(revisions, tag.Name)
+	}
+	chain, err := lib.ReadRevisionChain(ctx, repository)
+	if err != nil {
+		return nil
+	}
+	for _, revisionId := range chain[:min(len(chain), maxCompletedRevisions)] {
+		if !revisionId.IsRoot() {
+			revisions = append(revisions, revisionId.String())
+		}
+	}
+	return revisions
+}
+
+// completeRepositoryPaths returns the paths of the head below the directory
+// of `prefix` that start with `prefix`. Directories end with a slash, so
+// that the completion continues with their contents.
+func completeRepositoryPaths(ctx context.Context, prefix string) []string {
+	repository, pathPrefix, closeRepository := openCompletionRepository(ctx)
+	if repository == nil {
+		return nil
+	}
+	defer closeRepository()
+	head, err := repository.Head(ctx)
+	if err != nil {
+		return nil
+	}
+	tmpFS, cleanup, err := newTempFS("completion")
+	if err != nil {
+		return nil
+	}
+	defer cleanup()
+	files, err := ws.Ls(ctx, repository, tmpFS, &ws.LsOptions{
+		RevisionId: head,
+		PathFilter: nil,
+		PathPrefix: pathPrefix,
+	})
+	if err != nil {
+		return nil
+	}
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i+1]
+	}
+	var paths []string
+	for _, file := range files {
+		path := file.Path.String()
+		if !strings.HasPrefix(path, prefix) || strings.Contains(path[len(dir):], "/") {
+			continue
+		}
+		if file.Metadata.FileMode.IsDir() {
+			path += "/"
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// The completion scripts, `{app}` is replaced with the name of the program
+// and `{fn}` with the name as part of a function name.
+// They call `completion --complete` with the words of the command line and
+// fall back to the completion of local files if it prints nothing.
+
+const bashCompletion = `# bash completion for {app}, generated by ` + "`{app} completion bash`" + `.
+_{fn}_completion() {
+	local IFS=$'\n'
+	COMPREPLY=($({app} completion --complete -- "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+	if [[ ${#COMPREPLY[@]} -eq 1 && ${COMPREPLY[0]} == */ ]]; then
+		compopt -o nospace
+	fi
+}
+complete -o default -F _{fn}_completion {app}
+`
+
+const zshCompletion = `#compdef {app}
+# zsh completion for {app}, generated by ` + "`{app} completion zsh`" + `.
+_{fn}_completion() {
+	local -a candidates dirs others
+	candidates=("${(@f)$({app} completion --complete -- "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+	for c in $candidates; do
+		if [[ $c == */ ]]; then
+			dirs+=($c)
+		elif [[ -n $c ]]; then
+			others+=($c)
+		fi
+	done
+	if (( ${#dirs} + ${#others} == 0 )); then
+		_files
+		return
+	fi
+	(( ${#dirs} )) && compadd -S '' -- $dirs
+	(( ${#others} )) && compadd -- $others
+}
+compdef _{fn}_completion {app}
+`
+
+const fishCompletion = `# fish completion for {app}, generated by ` + "`{app} completion fish`" + `.
+function __{fn}_completion
+	set -l words (commandline -opc) (commandline -ct)
+	set -l candidates ({app} completion --complete -- $words[2..-1] 2>/dev/null)
+	if test (count $candidates) -eq 0
+		__fish_complete_path (commandline -ct)
+		return
+	end
+	printf '%s\n' $candidates
+end
+complete -c {app} -f -a '(__{fn}_completion)'
+`
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestCompletions(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	ctx := t.Context()
+
+	for _, c := range commands() {
+		if c.name == "mount" {
+			// Without `-tags fuse`, `mount` has no flags.
+			continue
+		}
+		assert.NotNil(commandFlags(ctx, c).Lookup("help"), c.name)
+	}
+	assert.Equal([]string{"repair-head", "replicate", "repos", "reset", "restore"}, completions(ctx, []string{"re"}))
+	assert.Equal([]string{"--fail-on-ignored", "--fast-scan"}, completions(ctx, []string{"merge", "--fa"}))
+	assert.Equal([]string{"add-passphrase", "add-recipient"}, completions(ctx, []string{"security", "add-"}))
+	assert.Equal([]string{"forget"}, completions(ctx, []string{"agent", "--lifetime", "1h", ""}))
+	assert.Equal([]string(nil), completions(ctx, []string{"security", "signer", ""}))
+	assert.Equal([]string(nil), completions(ctx, []string{"merge", "--message", ""}))
+	assert.Equal([]string(nil), completions(ctx, []string{"no-such-command", ""}))
+}
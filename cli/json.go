@@ -0,0 +1,225 @@
+//nolint:forbidigo
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
+	ws "github.com/flunderpero/cling-sync/workspace"
+)
+
+// The records printed with `--json` by `ls`, `log`, `status`, `find`, and
+// `check`.
+// Each record is a single line of JSON on stdout, so that scripts don't have
+// to parse the human readable output.
+
+// A path in a revision (`ls`), also part of the records of `status` and
+// `log --status`.
+type jsonPath struct {
+	Path string `json:"path"`
+	Dir  bool   `json:"dir"`
+	// The `ls -l` style mode, e.g. "-rw-r--r--".
+	Mode  string `json:"mode"`
+	Size  int64  `json:"size"`
+	MTime string `json:"mtime"`
+	// Only set for regular files.
+	FileHash      string  `json:"file_hash,omitempty"`
+	SymlinkTarget *string `json:"symlink_target,omitempty"`
+}
+
+type jsonStatusFile struct {
+	// One of "add", "update", "delete", or "rename".
+	Kind        string  `json:"kind"`
+	RenamedFrom *string `json:"renamed_from,omitempty"`
+	jsonPath
+}
+
+type jsonRevisionLog struct {
+	Revision  string `json:"revision"`
+	Parent    string `json:"parent"`
+	Author    string `json:"author"`
+	Message   string `json:"message"`
+	Timestamp string `json:"timestamp"`
+	// Not set for revisions written by older clients.
+	ClientId string `json:"client_id,omitempty"`
+	// Only set with `log --status`.
+	Files []jsonStatusFile `json:"files,omitempty"`
+	// Only set with `log --verify`, see `ws.SignatureStatus.String`.
+	Signature string `json:"signature,omitempty"`
+	// Only set with `log --verify`, false if the signature is invalid or
+	// the signer is not trusted.
+	Verified *bool `json:"verified,omitempty"`
+	// Not set for revisions written by older clients.
+	Stats *jsonCommitStats `json:"stats,omitempty"`
+}
+
+type jsonCommitStats struct {
+	FilesAdded   uint32 `json:"files_added"`
+	FilesUpdated uint32 `json:"files_updated"`
+	FilesDeleted uint32 `json:"files_deleted"`
+	RawBytes     int64  `json:"raw_bytes"`
+	StoredBytes  int64  `json:"stored_bytes"`
+	DurationMs   int64  `json:"duration_ms"`
+	Hostname     string `json:"hostname"`
+}
+
+// A version of a path found by `find`, see `ws.FindMatch`.
+type jsonFindMatch struct {
+	jsonPath
+	First jsonFindRevision `json:"first"`
+	Last  jsonFindRevision `json:"last"`
+	// The revision that deleted or changed the path, not set if the version
+	// is still in the last revision.
+	End     *jsonFindRevision `json:"end,omitempty"`
+	Deleted bool              `json:"deleted"`
+}
+
+type jsonFindRevision struct {
+	Revision  string `json:"revision"`
+	Timestamp string `json:"timestamp"`
+}
+
+type jsonHealthCheck struct {
+	CheckedBlocks         bool   `json:"checked_blocks"`
+	CheckedOrphanedBlocks bool   `json:"checked_orphaned_blocks"`
+	Revisions             int    `json:"revisions"`
+	Paths                 int    `json:"paths"`
+	Blocks                int    `json:"blocks"`
+	BlockBytes            int64  `json:"block_bytes"`
+	OrphanedBlocks        int    `json:"orphaned_blocks"`
+	OrphanedBlocksFile    string `json:"orphaned_blocks_file,omitempty"`
+	QuarantinedBlocks     int    `json:"quarantined_blocks"`
+	// The changes made with `--repair`.
+	Repairs         []string `json:"repairs,omitempty"`
+	ReportFile      string   `json:"report_file"`
+	Start           string   `json:"start"`
+	End             string   `json:"end"`
+	DurationSeconds float64  `json:"duration_seconds"`
+}
+
+func newJSONPath(path lib.Path, md *lib.PathMetadata) jsonPath {
+	p := jsonPath{
+		Path:          path.String(),
+		Dir:           md.FileMode.IsDir(),
+		Mode:          md.FileMode.String(),
+		Size:          md.Size,
+		MTime:         md.MTime().Format(time.RFC3339Nano),
+		FileHash:      "",
+		SymlinkTarget: nil,
+	}
+	if md.FileMode.IsRegular() {
+		p.FileHash = hex.EncodeToString(md.FileHash[:])
+	}
+	if md.SymLinkTarget != nil {
+		target := md.SymLinkTarget.String()
+		p.SymlinkTarget = &target
+	}
+	return p
+}
+
+func newJSONStatusFile(f *ws.StatusFile) jsonStatusFile {
+	s := jsonStatusFile{Kind: f.Kind.String(), RenamedFrom: nil, jsonPath: newJSONPath(f.Path, &f.Metadata)}
+	if f.RenamedFrom != nil {
+		from := f.RenamedFrom.String()
+		s.Kind = "rename"
+		s.RenamedFrom = &from
+	}
+	return s
+}
+
+func newJSONRevisionLog(l *ws.RevisionLog, withFiles bool) jsonRevisionLog {
+	r := l.Revision
+	log := jsonRevisionLog{
+		Revision:  l.RevisionId.String(),
+		Parent:    r.ParentRevisionId.String(),
+		Author:    derefString(r.Author),
+		Message:   derefString(r.Message),
+		Timestamp: r.Timestamp.Time().Format(time.RFC3339Nano),
+		ClientId:  derefString(r.ClientId),
+		Files:     nil,
+		Signature: "",
+		Verified:  nil,
+		Stats:     nil,
+	}
+	if r.Stats != nil {
+		stats := jsonCommitStats(*r.Stats)
+		log.Stats = &stats
+	}
+	if l.Signature != nil {
+		verified := l.Signature.OK()
+		log.Signature = l.Signature.String()
+		log.Verified = &verified
+	}
+	if withFiles {
+		log.Files = make([]jsonStatusFile, 0, len(l.Files))
+		for i := range l.Files {
+			log.Files = append(log.Files, newJSONStatusFile(&l.Files[i]))
+		}
+	}
+	return log
+}
+
+func newJSONFindMatch(m *ws.FindMatch) jsonFindMatch {
+	match := jsonFindMatch{
+		jsonPath: newJSONPath(m.Path, &m.Metadata),
+		First:    newJSONFindRevision(m.First),
+		Last:     newJSONFindRevision(m.Last),
+		End:      nil,
+		Deleted:  m.Deleted,
+	}
+	if m.End != nil {
+		end := newJSONFindRevision(*m.End)
+		match.End = &end
+	}
+	return match
+}
+
+func newJSONFindRevision(r ws.FindRevision) jsonFindRevision {
+	return jsonFindRevision{r.RevisionId.String(), r.Timestamp.Format(time.RFC3339Nano)}
+}
+
+func newJSONHealthCheck(
+	m *cliHealthCheckMonitor,
+	checkedBlocks, checkedOrphanedBlocks bool,
+	reportFile, orphanedBlocksFile string,
+) jsonHealthCheck {
+	if len(m.OrphanedBlocks) == 0 {
+		orphanedBlocksFile = ""
+	}
+	return jsonHealthCheck{
+		CheckedBlocks:         checkedBlocks,
+		CheckedOrphanedBlocks: checkedOrphanedBlocks,
+		Revisions:             m.Revisions,
+		Paths:                 m.Paths,
+		Blocks:                m.Blocks,
+		BlockBytes:            m.BlockBytes,
+		OrphanedBlocks:        len(m.OrphanedBlocks),
+		OrphanedBlocksFile:    orphanedBlocksFile,
+		QuarantinedBlocks:     len(m.QuarantinedBlocks),
+		Repairs:               m.Repairs,
+		ReportFile:            reportFile,
+		Start:                 m.StartTime.Format(time.RFC3339),
+		End:                   m.EndTime.Format(time.RFC3339),
+		DurationSeconds:       m.Duration().Seconds(),
+	}
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// Print `v` as a single line of JSON to stdout.
+func printJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to encode JSON")
+	}
+	fmt.Println(string(data))
+	return nil
+}
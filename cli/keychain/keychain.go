@@ -1,26 +1,100 @@
-//go:build !darwin && !linux
-
+// Package keychain keeps small secrets in the keychain of the operating
+// system. Every platform has one or more backends, the first available one
+// is used unless `BackendEnv` names another one.
 package keychain
 
 import (
 	"context"
+	"os"
+	"strings"
 
 	"github.com/flunderpero/cling-sync/lib"
 )
 
+// Select a keychain backend by name, e.g. `kernel-keyring` on a Linux
+// server without a secret service.
+const BackendEnv = "CLING_SYNC_KEYCHAIN"
+
+// The name of the backend to use if `BackendEnv` is not set, e.g. from the
+// user config of the CLI (see `Backends`).
+var PreferredBackend string //nolint:gochecknoglobals
+
 var (
 	ErrKeychainEntryNotFound      = lib.Errorf("keychain entry not found")
 	ErrKeychainEntryAlreadyExists = lib.Errorf("keychain entry already exists")
 )
 
+type backend interface {
+	name() string
+	// Whether the backend can be used on this machine.
+	available() bool
+	add(ctx context.Context, service, account, secret string) error
+	get(ctx context.Context, service, account string) (string, error)
+	delete(ctx context.Context, service, account string) error
+}
+
 func AddKeychainEntry(ctx context.Context, service, account, secret string) error {
-	return lib.Errorf("not implemented")
+	b, err := selectBackend(backendName())
+	if err != nil {
+		return err
+	}
+	return b.add(ctx, service, account, secret)
 }
 
 func GetKeychainEntry(ctx context.Context, service, account string) (string, error) {
-	return "", lib.Errorf("not implemented")
+	b, err := selectBackend(backendName())
+	if err != nil {
+		return "", err
+	}
+	return b.get(ctx, service, account)
 }
 
+// Deleting an entry that does not exist is not an error.
 func DeleteKeychainEntry(ctx context.Context, service, account string) error {
-	return lib.Errorf("not implemented")
+	b, err := selectBackend(backendName())
+	if err != nil {
+		return err
+	}
+	return b.delete(ctx, service, account)
+}
+
+// The names of the backends of the platform, the preferred one first.
+func Backends() []string {
+	names := make([]string, 0, len(backends))
+	for _, b := range backends {
+		names = append(names, b.name())
+	}
+	return names
+}
+
+func backendName() string {
+	if name := os.Getenv(BackendEnv); name != "" {
+		return name
+	}
+	return PreferredBackend
+}
+
+// Return the backend named `override` or, if it is empty, the first
+// available backend of the platform.
+func selectBackend(override string) (backend, error) { //nolint:ireturn
+	names := Backends()
+	if override != "" {
+		for _, b := range backends {
+			if b.name() == override {
+				return b, nil
+			}
+		}
+		return nil, lib.Errorf(
+			"unknown keychain backend %q in %s, use one of: %s", override, BackendEnv, strings.Join(names, ", "),
+		)
+	}
+	for _, b := range backends {
+		if b.available() {
+			return b, nil
+		}
+	}
+	if len(backends) == 0 {
+		return nil, lib.Errorf("there is no keychain on this platform")
+	}
+	return nil, lib.Errorf("no keychain is available, tried: %s", strings.Join(names, ", "))
 }
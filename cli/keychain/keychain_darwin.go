@@ -18,13 +18,20 @@ import (
 	"github.com/flunderpero/cling-sync/lib"
 )
 
-var (
-	ErrKeychainEntryNotFound      = lib.Errorf("keychain entry not found")
-	ErrKeychainEntryAlreadyExists = lib.Errorf("keychain entry already exists")
-	ErrKeychainLocked             = lib.Errorf(
-		"macOS keychain is locked, unlock it by running: security unlock-keychain",
-	)
-)
+var ErrKeychainLocked = lib.Errorf("macOS keychain is locked, unlock it by running: security unlock-keychain")
+
+var backends = []backend{macKeychain{}} //nolint:gochecknoglobals
+
+// macKeychain keeps the entries as generic passwords in the login keychain.
+type macKeychain struct{}
+
+func (macKeychain) name() string {
+	return "keychain"
+}
+
+func (macKeychain) available() bool {
+	return true
+}
 
 // createCFString is a helper to convert a Go string to a CFStringRef.
 // The caller is responsible for releasing the returned CFStringRef.
@@ -61,7 +68,7 @@ func buildQueryDict(service, account string) C.CFMutableDictionaryRef {
 	return query
 }
 
-func AddKeychainEntry(ctx context.Context, service, account, secret string) error {
+func (macKeychain) add(ctx context.Context, service, account, secret string) error {
 	query := buildQueryDict(service, account)
 	defer C.CFRelease(C.CFTypeRef(query))
 
@@ -79,7 +86,7 @@ func AddKeychainEntry(ctx context.Context, service, account, secret string) erro
 	return nil
 }
 
-func GetKeychainEntry(ctx context.Context, service, account string) (string, error) {
+func (macKeychain) get(ctx context.Context, service, account string) (string, error) {
 	query := buildQueryDict(service, account)
 	defer C.CFRelease(C.CFTypeRef(query))
 
@@ -105,7 +112,7 @@ func GetKeychainEntry(ctx context.Context, service, account string) (string, err
 	return string(goBytes), nil
 }
 
-func DeleteKeychainEntry(ctx context.Context, service, account string) error {
+func (macKeychain) delete(ctx context.Context, service, account string) error {
 	query := buildQueryDict(service, account)
 	defer C.CFRelease(C.CFTypeRef(query))
 
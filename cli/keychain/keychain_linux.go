@@ -6,25 +6,52 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/flunderpero/cling-sync/lib"
+	"golang.org/x/sys/unix"
 )
 
-var (
-	ErrKeychainEntryNotFound      = lib.Errorf("keychain entry not found")
-	ErrKeychainEntryAlreadyExists = lib.Errorf("keychain entry already exists")
-	ErrKeychainLocked             = lib.Errorf("login keyring is locked or unavailable, unlock it and retry")
-)
+var ErrKeychainLocked = lib.Errorf("login keyring is locked or unavailable, unlock it and retry")
 
 // A locked keyring makes secret-tool hang on an unlock prompt (forever when
 // headless). 30s still leaves room for a real interactive unlock.
 const keychainTimeout = 30 * time.Second
 
-func AddKeychainEntry(ctx context.Context, service, account, secret string) error {
-	_, err := GetKeychainEntry(ctx, service, account)
+// The secret service (e.g. the Gnome keyring or KWallet) is preferred, the
+// kernel keyring is the fallback for machines without a desktop session.
+var backends = []backend{secretService{}, kernelKeyring{}} //nolint:gochecknoglobals
+
+// secretService talks to the secret service over D-Bus through
+// `secret-tool` (libsecret).
+type secretService struct{}
+
+func (secretService) name() string {
+	return "secret-service"
+}
+
+func (secretService) available() bool {
+	if _, err := exec.LookPath("secret-tool"); err != nil {
+		return false
+	}
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") != "" {
+		return true
+	}
+	// The default address of the session bus with systemd.
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(runtimeDir, "bus"))
+	return err == nil
+}
+
+func (s secretService) add(ctx context.Context, service, account, secret string) error {
+	_, err := s.get(ctx, service, account)
 	if err == nil {
 		return ErrKeychainEntryAlreadyExists
 	}
@@ -60,7 +87,7 @@ func AddKeychainEntry(ctx context.Context, service, account, secret string) erro
 	return nil
 }
 
-func GetKeychainEntry(ctx context.Context, service, account string) (string, error) {
+func (secretService) get(ctx context.Context, service, account string) (string, error) {
 	ctx, cancel := context.WithTimeout(ctx, keychainTimeout)
 	defer cancel()
 	cmd := exec.CommandContext(ctx, "secret-tool", "lookup", "service", service, "account", account)
@@ -90,7 +117,7 @@ func isSecretNotFound(stderr string) bool {
 	return stderr == "" || strings.Contains(stderr, "No matching secrets")
 }
 
-func DeleteKeychainEntry(ctx context.Context, service, account string) error {
+func (secretService) delete(ctx context.Context, service, account string) error {
 	ctx, cancel := context.WithTimeout(ctx, keychainTimeout)
 	defer cancel()
 	cmd := exec.CommandContext(ctx, "secret-tool", "clear", "service", service, "account", account)
@@ -110,3 +137,85 @@ func DeleteKeychainEntry(ctx context.Context, service, account string) error {
 	}
 	return nil
 }
+
+// kernelKeyring keeps the entries in the user keyring of the kernel (see
+// keyrings(7)). The entries do not survive a reboot, and they are gone once
+// the last session of the user ends.
+type kernelKeyring struct{}
+
+// Only the user (and processes possessing the key) can read the entries.
+const kernelKeyPerm = 0x3f3f0000 // KEY_POS_ALL | KEY_USR_ALL
+
+func (kernelKeyring) name() string {
+	return "kernel-keyring"
+}
+
+func (kernelKeyring) available() bool {
+	_, err := unix.KeyctlGetKeyringID(unix.KEY_SPEC_USER_KEYRING, true)
+	return err == nil
+}
+
+func (kernelKeyring) description(service, account string) string {
+	return service + ":" + account
+}
+
+func (k kernelKeyring) find(service, account string) (int, error) {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", k.description(service, account), 0)
+	if errors.Is(err, unix.ENOKEY) || errors.Is(err, unix.EKEYREVOKED) || errors.Is(err, unix.EKEYEXPIRED) {
+		return 0, ErrKeychainEntryNotFound
+	}
+	if err != nil {
+		return 0, lib.WrapErrorf(err, "failed to search the kernel keyring")
+	}
+	return id, nil
+}
+
+func (k kernelKeyring) add(ctx context.Context, service, account, secret string) error {
+	_, err := k.find(service, account)
+	if err == nil {
+		return ErrKeychainEntryAlreadyExists
+	}
+	if !errors.Is(err, ErrKeychainEntryNotFound) {
+		return err
+	}
+	id, err := unix.AddKey("user", k.description(service, account), []byte(secret), unix.KEY_SPEC_USER_KEYRING)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to store keychain entry")
+	}
+	if err := unix.KeyctlSetperm(id, kernelKeyPerm); err != nil {
+		_, _ = unix.KeyctlInt(unix.KEYCTL_UNLINK, id, unix.KEY_SPEC_USER_KEYRING, 0, 0)
+		return lib.WrapErrorf(err, "failed to restrict access to keychain entry")
+	}
+	return nil
+}
+
+func (k kernelKeyring) get(ctx context.Context, service, account string) (string, error) {
+	id, err := k.find(service, account)
+	if err != nil {
+		return "", err
+	}
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return "", lib.WrapErrorf(err, "failed to read keychain entry")
+	}
+	buf := make([]byte, size)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+	if err != nil {
+		return "", lib.WrapErrorf(err, "failed to read keychain entry")
+	}
+	return string(buf[:min(n, size)]), nil
+}
+
+func (k kernelKeyring) delete(ctx context.Context, service, account string) error {
+	id, err := k.find(service, account)
+	if errors.Is(err, ErrKeychainEntryNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_UNLINK, id, unix.KEY_SPEC_USER_KEYRING, 0, 0); err != nil {
+		return lib.WrapErrorf(err, "failed to delete keychain entry")
+	}
+	return nil
+}
@@ -24,8 +24,8 @@ func TestKeychainLinux(t *testing.T) {
 		t.Parallel()
 		assert := lib.NewAssert(t)
 		ctx := t.Context()
-		_ = DeleteKeychainEntry(ctx, service, "missing")
-		_, err := GetKeychainEntry(ctx, service, "missing")
+		_ = secretService{}.delete(ctx, service, "missing")
+		_, err := secretService{}.get(ctx, service, "missing")
 		assert.ErrorIs(err, ErrKeychainEntryNotFound)
 	})
 
@@ -35,10 +35,10 @@ func TestKeychainLinux(t *testing.T) {
 		ctx := t.Context()
 		account := "roundtrip"
 		secret := "round-trip-secret-value"
-		t.Cleanup(func() { _ = DeleteKeychainEntry(ctx, service, account) })
-		_ = DeleteKeychainEntry(ctx, service, account)
-		assert.NoError(AddKeychainEntry(ctx, service, account, secret))
-		got, err := GetKeychainEntry(ctx, service, account)
+		t.Cleanup(func() { _ = secretService{}.delete(ctx, service, account) })
+		_ = secretService{}.delete(ctx, service, account)
+		assert.NoError(secretService{}.add(ctx, service, account, secret))
+		got, err := secretService{}.get(ctx, service, account)
 		assert.NoError(err)
 		assert.Equal(secret, got)
 	})
@@ -48,16 +48,16 @@ func TestKeychainLinux(t *testing.T) {
 		assert := lib.NewAssert(t)
 		ctx := t.Context()
 		account := "duplicate"
-		t.Cleanup(func() { _ = DeleteKeychainEntry(ctx, service, account) })
-		_ = DeleteKeychainEntry(ctx, service, account)
-		assert.NoError(AddKeychainEntry(ctx, service, account, "first"))
-		assert.ErrorIs(AddKeychainEntry(ctx, service, account, "second"), ErrKeychainEntryAlreadyExists)
+		t.Cleanup(func() { _ = secretService{}.delete(ctx, service, account) })
+		_ = secretService{}.delete(ctx, service, account)
+		assert.NoError(secretService{}.add(ctx, service, account, "first"))
+		assert.ErrorIs(secretService{}.add(ctx, service, account, "second"), ErrKeychainEntryAlreadyExists)
 	})
 
 	t.Run("Deleting a missing entry should not fail", func(t *testing.T) {
 		t.Parallel()
 		assert := lib.NewAssert(t)
-		assert.NoError(DeleteKeychainEntry(t.Context(), service, "absent"))
+		assert.NoError(secretService{}.delete(t.Context(), service, "absent"))
 	})
 }
 
@@ -68,6 +68,30 @@ func TestKeychainLinuxLockedTimeout(t *testing.T) {
 	assert := lib.NewAssert(t)
 	ctx, cancel := context.WithDeadline(t.Context(), time.Now().Add(-time.Second))
 	defer cancel()
-	_, err := GetKeychainEntry(ctx, "cling-sync-keychain-test", "locked")
+	_, err := secretService{}.get(ctx, "cling-sync-keychain-test", "locked")
 	assert.ErrorIs(err, ErrKeychainLocked)
 }
+
+func TestKeychainKernelKeyring(t *testing.T) {
+	t.Parallel()
+	k := kernelKeyring{}
+	if !k.available() {
+		t.Skip("the kernel keyring is not available")
+	}
+	assert := lib.NewAssert(t)
+	ctx := t.Context()
+	service := "cling-sync-keychain-test-" + t.Name()
+	t.Cleanup(func() { _ = k.delete(ctx, service, "account") })
+
+	_, err := k.get(ctx, service, "account")
+	assert.ErrorIs(err, ErrKeychainEntryNotFound)
+	assert.NoError(k.add(ctx, service, "account", "kernel-secret"))
+	assert.ErrorIs(k.add(ctx, service, "account", "second"), ErrKeychainEntryAlreadyExists)
+	got, err := k.get(ctx, service, "account")
+	assert.NoError(err)
+	assert.Equal("kernel-secret", got)
+	assert.NoError(k.delete(ctx, service, "account"))
+	assert.NoError(k.delete(ctx, service, "account"))
+	_, err = k.get(ctx, service, "account")
+	assert.ErrorIs(err, ErrKeychainEntryNotFound)
+}
@@ -7,16 +7,23 @@ import (
 	"encoding/json"
 	"errors"
 	"os"
-
-	"github.com/flunderpero/cling-sync/lib"
 )
 
-var (
-	ErrKeychainEntryNotFound      = lib.Errorf("keychain entry not found")
-	ErrKeychainEntryAlreadyExists = lib.Errorf("keychain entry already exists")
-)
+var backends = []backend{mockKeychain{}} //nolint:gochecknoglobals
+
+// mockKeychain keeps the entries in a plain JSON file for the tests, see
+// `filename`.
+type mockKeychain struct{}
+
+func (mockKeychain) name() string {
+	return "mock"
+}
+
+func (mockKeychain) available() bool {
+	return true
+}
 
-func AddKeychainEntry(ctx context.Context, service, account, secret string) error {
+func (mockKeychain) add(ctx context.Context, service, account, secret string) error {
 	entries, err := readKeychainEntries()
 	if err != nil {
 		return err
@@ -29,7 +36,7 @@ func AddKeychainEntry(ctx context.Context, service, account, secret string) erro
 	return writeKeychainEntries(entries)
 }
 
-func GetKeychainEntry(ctx context.Context, service, account string) (string, error) {
+func (mockKeychain) get(ctx context.Context, service, account string) (string, error) {
 	entries, err := readKeychainEntries()
 	if err != nil {
 		return "", err
@@ -41,7 +48,7 @@ func GetKeychainEntry(ctx context.Context, service, account string) (string, err
 	return entry, nil
 }
 
-func DeleteKeychainEntry(ctx context.Context, service, account string) error {
+func (mockKeychain) delete(ctx context.Context, service, account string) error {
 	entries, err := readKeychainEntries()
 	if err != nil {
 		return err
@@ -0,0 +1,5 @@
+//go:build !darwin && !linux && !mock
+
+package keychain
+
+var backends = []backend{} //nolint:gochecknoglobals
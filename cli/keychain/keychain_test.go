@@ -0,0 +1,27 @@
+package keychain
+
+import (
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestSelectBackend(t *testing.T) {
+	t.Parallel()
+
+	t.Run("A backend can be selected by name", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		for _, b := range backends {
+			selected, err := selectBackend(b.name())
+			assert.NoError(err)
+			assert.Equal(b.name(), selected.name())
+		}
+	})
+
+	t.Run("An unknown backend is rejected", func(t *testing.T) {
+		t.Parallel()
+		_, err := selectBackend("no-such-backend")
+		lib.NewAssert(t).Error(err, `unknown keychain backend "no-such-backend" in CLING_SYNC_KEYCHAIN`)
+	})
+}
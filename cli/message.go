@@ -0,0 +1,145 @@
+//nolint:forbidigo
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/flunderpero/cling-sync/lib"
+	ws "github.com/flunderpero/cling-sync/workspace"
+)
+
+// The value of a `--message` flag that can be given multiple times. Like
+// with `git commit -m`, every message is a paragraph of the commit message.
+// The messages on the command line replace the default and the message of
+// a config file (see `setConfigFlags`) instead of being added to them.
+type messageFlag struct {
+	paragraphs []string
+	isDefault  bool
+}
+
+func (f *messageFlag) String() string {
+	return strings.Join(f.paragraphs, "\n\n")
+}
+
+func (f *messageFlag) Set(s string) error {
+	if f.isDefault {
+		f.paragraphs, f.isDefault = nil, false
+	}
+	f.paragraphs = append(f.paragraphs, s)
+	return nil
+}
+
+// Add the `--message` flag and its shorthand `-m` to `flags`.
+func messageFlagVar(flags *flag.FlagSet, value *messageFlag, defaultMessage string) {
+	*value = messageFlag{[]string{defaultMessage}, true}
+	flags.Var(value, "message", messageFlagDescription+" (can be used multiple times, one paragraph each)")
+	flags.Var(value, "m", "Shorthand for --message")
+}
+
+// Mark the values of the `messageFlag`s of `flags` as defaults, so that
+// the command line replaces them.
+func markMessageFlagDefaults(flags *flag.FlagSet) {
+	flags.VisitAll(func(f *flag.Flag) {
+		if m, ok := f.Value.(*messageFlag); ok {
+			m.isDefault = true
+		}
+	})
+}
+
+// Let the user edit the commit message of `merge --edit` (see
+// `editMessage`) with the local changes that `opts` finds. The editor is
+// not opened if there are none.
+func editMergeMessage(
+	ctx context.Context,
+	workspace *ws.Workspace,
+	repository *lib.Repository,
+	opts *ws.StatusOptions,
+	message string,
+) (string, error) {
+	tmpFS, err := workspace.TempFS.MkSub("status")
+	if err != nil {
+		return "", err //nolint:wrapcheck
+	}
+	var changes []ws.StatusFile
+	summary, err := ws.StatusStream(ctx, workspace, repository, opts, tmpFS, func(file ws.StatusFile) error {
+		changes = append(changes, file)
+		return nil
+	})
+	if err != nil {
+		return "", err //nolint:wrapcheck
+	}
+	if len(changes) == 0 {
+		return message, nil
+	}
+	return editMessage(ctx, message, changes, summary)
+}
+
+// The comment below the message in the file of `editMessage`.
+const editMessageComment = `# Enter the commit message of the local changes. Lines starting with '#'
+# are ignored, an empty message aborts the merge.
+#
+# Local changes:
+`
+
+// Let the user edit `message` in $VISUAL or $EDITOR (default `vi`), like
+// `git commit`. The file lists the `changes` as comments below the
+// message. Return the edited message without the comments.
+func editMessage(
+	ctx context.Context,
+	message string,
+	changes []ws.StatusFile,
+	summary ws.StatusSummary,
+) (string, error) {
+	file, err := os.CreateTemp("", "cling-sync-message-*.txt")
+	if err != nil {
+		return "", lib.WrapErrorf(err, "failed to create the message file")
+	}
+	defer os.Remove(file.Name()) //nolint:errcheck
+	var content strings.Builder
+	content.WriteString(message + "\n\n" + editMessageComment)
+	for _, change := range changes {
+		content.WriteString("#   " + change.Format() + "\n")
+	}
+	fmt.Fprintf(&content, "#   %s\n", summary)
+	_, err = file.WriteString(content.String())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", lib.WrapErrorf(err, "failed to write the message file")
+	}
+	editor := cmp.Or(os.Getenv("VISUAL"), os.Getenv("EDITOR"), "vi")
+	// The editor may have arguments, e.g. `code --wait`.
+	cmd := exec.CommandContext(ctx, "sh", "-c", editor+` "$1"`, editor, file.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", lib.WrapErrorf(err, "the editor %q failed", editor)
+	}
+	edited, err := os.ReadFile(file.Name())
+	if err != nil {
+		return "", lib.WrapErrorf(err, "failed to read the message file")
+	}
+	message = stripMessageComments(string(edited))
+	if message == "" {
+		return "", lib.Errorf("aborting the merge due to an empty commit message")
+	}
+	return message, nil
+}
+
+// Remove the lines starting with `#` and the leading and trailing empty
+// lines of an edited message.
+func stripMessageComments(message string) string {
+	var lines []string
+	for line := range strings.SplitSeq(message, "\n") {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, strings.TrimRight(line, " \t\r"))
+		}
+	}
+	return strings.Trim(strings.Join(lines, "\n"), "\n")
+}
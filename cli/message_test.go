@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+	ws "github.com/flunderpero/cling-sync/workspace"
+)
+
+func TestMessageFlag(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	parse := func(config string, argv ...string) string {
+		t.Helper()
+		flags := flag.NewFlagSet("merge", flag.ContinueOnError)
+		var message messageFlag
+		messageFlagVar(flags, &message, "default")
+		if config != "" {
+			assert.NoError(flags.Set("message", config))
+			markMessageFlagDefaults(flags)
+		}
+		assert.NoError(flags.Parse(argv))
+		return message.String()
+	}
+	assert.Equal("default", parse(""))
+	assert.Equal("config", parse("config"))
+	assert.Equal("subject", parse("config", "-m", "subject"))
+	assert.Equal("subject\n\nbody\n\nmore", parse("", "-m", "subject", "--message", "body", "-m", "more"))
+}
+
+func TestStripMessageComments(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	assert.Equal("", stripMessageComments("\n# comment\n\n"))
+	assert.Equal(
+		"subject\n\nbody  with #hash",
+		stripMessageComments("\nsubject  \n# comment\n\nbody  with #hash\n\n"+editMessageComment+"#   A a.txt\n"),
+	)
+}
+
+func TestEditMessage(t *testing.T) { //nolint:paralleltest
+	assert := lib.NewAssert(t)
+	path, err := lib.NewPath("a.txt")
+	assert.NoError(err)
+	changes := []ws.StatusFile{{Path: path, Kind: lib.RevisionEntryKindAdd}} //nolint:exhaustruct
+	summary := ws.StatusSummary{Added: 1, Updated: 0, Deleted: 0, Renamed: 0}
+
+	// The editor gets the message and the changes.
+	t.Setenv("VISUAL", `grep -q "^#   A a.txt$" "$1" && grep -q "^message$" "$1" && printf 'edited\n# x\n' >`)
+	message, err := editMessage(t.Context(), "message", changes, summary)
+	assert.NoError(err)
+	assert.Equal("edited", message)
+
+	// An empty message aborts.
+	t.Setenv("VISUAL", "printf '# only a comment' >")
+	_, err = editMessage(t.Context(), "message", changes, summary)
+	assert.Error(err, "empty commit message")
+
+	// A failing editor aborts.
+	t.Setenv("VISUAL", "false")
+	_, err = editMessage(t.Context(), "message", changes, summary)
+	assert.Error(err, `the editor "false" failed`)
+}
@@ -0,0 +1,296 @@
+//go:build fuse
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/flunderpero/cling-sync/lib"
+	ws "github.com/flunderpero/cling-sync/workspace"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func MountCmd(ctx context.Context, argv []string, passphraseFromStdin bool) error { //nolint:funlen
+	args := struct { //nolint:exhaustruct
+		Help       bool
+		Revision   string
+		Repository string
+		PathPrefix string
+		AllowOther bool
+	}{}
+	flags := flag.NewFlagSet("mount", flag.ExitOnError)
+	flags.BoolVar(&args.Help, "help", false, "Show help message")
+	flags.StringVar(&args.Revision, "revision", "HEAD", "Revision to mount")
+	flags.StringVar(&args.Repository, "repository", "", repositoryFlagDescription)
+	flags.StringVar(&args.PathPrefix, "path-prefix", "", pathPrefixFlagDescription)
+	flags.BoolVar(&args.AllowOther, "allow-other", false, "Allow other users to access the mounted filesystem")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s mount [--revision <revision>] <mountpoint>\n\n", appName)
+		fmt.Fprint(os.Stderr, "Mount a revision as a read-only FUSE filesystem.\n")
+		fmt.Fprint(os.Stderr, "File content is only read from the repository when it is accessed.\n")
+		fmt.Fprint(os.Stderr, "The filesystem is unmounted on Ctrl+C.\n")
+		fmt.Fprint(os.Stderr, "\nArguments:\n")
+		fmt.Fprint(os.Stderr, "  mountpoint\n")
+		fmt.Fprint(os.Stderr, "        An existing empty directory.\n")
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(argv); err != nil {
+		return err //nolint:wrapcheck
+	}
+	if args.Help {
+		flags.Usage()
+		return nil
+	}
+	if len(flags.Args()) != 1 {
+		return lib.Errorf("one positional argument is required: <mountpoint>")
+	}
+	mountpoint, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to get absolute path for %s", flags.Arg(0))
+	}
+	var (
+		repository *lib.Repository
+		pathPrefix lib.Path
+	)
+	if args.Repository != "" {
+		repository, err = openRepository(ctx, nil, args.Repository, passphraseFromStdin)
+		if err != nil {
+			return err
+		}
+	} else {
+		var workspace *ws.Workspace
+		workspace, err = openWorkspace(ctx)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to open workspace")
+		}
+		defer workspace.Close() //nolint:errcheck
+		repository, _, err = openCachedRepository(ctx, workspace, "", passphraseFromStdin, blockCacheRead)
+		if err != nil {
+			return err
+		}
+		pathPrefix = workspace.PathPrefix
+	}
+	defer repository.Close() //nolint:errcheck
+	pathPrefix, err = parsePathPrefix(args.PathPrefix, pathPrefix)
+	if err != nil {
+		return err
+	}
+	revisionId, err := revisionId(ctx, repository, args.Revision)
+	if err != nil {
+		return err
+	}
+	entries, err := readMountEntries(ctx, repository, revisionId, pathPrefix)
+	if err != nil {
+		return err
+	}
+	root := &mountRoot{mountDir{fs.Inode{}, nil}, repository, pathPrefix, entries}
+	opts := &fs.Options{ //nolint:exhaustruct
+		MountOptions: fuse.MountOptions{ //nolint:exhaustruct
+			AllowOther:  args.AllowOther,
+			FsName:      appName,
+			Name:        appName,
+			Options:     []string{"ro"},
+			DirectMount: true,
+		},
+	}
+	server, err := fs.Mount(mountpoint, root, opts)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to mount %s", mountpoint)
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		if err := server.Unmount(); err != nil {
+			PrintErr("failed to unmount %s: %s (is it still in use?)", mountpoint, err)
+		}
+	}()
+	fmt.Printf("Mounted revision %s at %s (press Ctrl+C to unmount)\n", revisionId, mountpoint)
+	server.Wait()
+	return nil
+}
+
+// Read the entries of the revision below `pathPrefix`. Only the metadata is
+// kept in memory, file content is read when it is accessed.
+func readMountEntries(
+	ctx context.Context,
+	repository *lib.Repository,
+	revisionId lib.RevisionId,
+	pathPrefix lib.Path,
+) ([]*lib.RevisionEntry, error) {
+	tmpFS, cleanup, err := newTempFS("mount")
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	snapshot, err := lib.NewFilteredRevisionSnapshot(ctx, repository, revisionId, tmpFS, pathPrefix.AsFilter())
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to create revision snapshot")
+	}
+	reader := snapshot.Reader(nil)
+	buf := lib.NewBlockBuf()
+	entries := []*lib.RevisionEntry{}
+	for {
+		entry, err := reader.Read(buf)
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to read revision snapshot")
+		}
+		entries = append(entries, entry)
+	}
+}
+
+type mountRoot struct {
+	mountDir
+	repository *lib.Repository
+	pathPrefix lib.Path
+	entries    []*lib.RevisionEntry
+}
+
+var _ = (fs.NodeOnAdder)((*mountRoot)(nil))
+
+// Build the whole tree when the filesystem is mounted.
+func (r *mountRoot) OnAdd(ctx context.Context) {
+	for _, entry := range r.entries {
+		path, ok := entry.Path.TrimBase(r.pathPrefix)
+		if !ok || path.IsEmpty() {
+			continue
+		}
+		md := entry.Metadata
+		parent := r.dir(ctx, path.Dir())
+		name := path.Base().String()
+		switch {
+		case md.FileMode.IsDir():
+			if existing := parent.GetChild(name); existing != nil {
+				if dir, ok := existing.Operations().(*mountDir); ok {
+					dir.md = &md
+				}
+				continue
+			}
+			child := parent.NewPersistentInode(ctx, &mountDir{fs.Inode{}, &md}, fs.StableAttr{Mode: fuse.S_IFDIR})
+			parent.AddChild(name, child, false)
+		case md.FileMode.IsSymlink():
+			if md.SymLinkTarget == nil {
+				continue
+			}
+			// Symlink targets are repository paths.
+			target, err := filepath.Rel(filepath.Dir(entry.Path.String()), md.SymLinkTarget.String())
+			if err != nil {
+				continue
+			}
+			symlink := &fs.MemSymlink{Inode: fs.Inode{}, Attr: fuse.Attr{}, Data: []byte(target)} //nolint:exhaustruct
+			setMountAttr(&symlink.Attr, &md)
+			child := parent.NewPersistentInode(ctx, symlink, fs.StableAttr{Mode: fuse.S_IFLNK})
+			parent.AddChild(name, child, false)
+		case md.FileMode.IsRegular():
+			file := &mountFile{fs.Inode{}, md, ws.NewFileReader(r.repository, &md)}
+			child := parent.NewPersistentInode(ctx, file, fs.StableAttr{Mode: fuse.S_IFREG})
+			parent.AddChild(name, child, false)
+		}
+	}
+	r.entries = nil
+}
+
+// Return the inode of the directory `path`, create it (and its parents) if
+// the revision does not contain it.
+func (r *mountRoot) dir(ctx context.Context, path lib.Path) *fs.Inode {
+	if path.IsEmpty() {
+		return r.EmbeddedInode()
+	}
+	parent := r.dir(ctx, path.Dir())
+	name := path.Base().String()
+	if child := parent.GetChild(name); child != nil {
+		return child
+	}
+	child := parent.NewPersistentInode(ctx, &mountDir{fs.Inode{}, nil}, fs.StableAttr{Mode: fuse.S_IFDIR})
+	parent.AddChild(name, child, false)
+	return child
+}
+
+type mountDir struct {
+	fs.Inode
+	// Nil for directories that are not part of the revision, i.e. the root.
+	md *lib.PathMetadata
+}
+
+var _ = (fs.NodeGetattrer)((*mountDir)(nil))
+
+func (d *mountDir) Getattr(_ context.Context, _ fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if d.md != nil {
+		setMountAttr(&out.Attr, d.md)
+	} else {
+		out.Mode = 0o555
+		out.Nlink = 1
+	}
+	return 0
+}
+
+type mountFile struct {
+	fs.Inode
+	md     lib.PathMetadata
+	reader *ws.FileReader
+}
+
+var (
+	_ = (fs.NodeGetattrer)((*mountFile)(nil))
+	_ = (fs.NodeOpener)((*mountFile)(nil))
+	_ = (fs.NodeReader)((*mountFile)(nil))
+)
+
+func (f *mountFile) Getattr(_ context.Context, _ fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	setMountAttr(&out.Attr, &f.md)
+	return 0
+}
+
+func (f *mountFile) Open(_ context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	// The content of a revision never changes.
+	return nil, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+func (f *mountFile) Read(
+	ctx context.Context,
+	_ fs.FileHandle,
+	dest []byte,
+	off int64,
+) (fuse.ReadResult, syscall.Errno) {
+	n, err := f.reader.ReadAt(ctx, dest, off)
+	if err != nil && !errors.Is(err, io.EOF) {
+		PrintErr("%s", err.Error())
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func setMountAttr(attr *fuse.Attr, md *lib.PathMetadata) {
+	attr.Mode = uint32(md.FileMode.AsFsFileMode().Perm())
+	attr.Nlink = 1
+	if md.FileMode.IsRegular() {
+		attr.Size = uint64(md.Size) //nolint:gosec
+		attr.Blocks = (attr.Size + 511) / 512
+	}
+	attr.Mtime = uint64(md.Mtime.Sec) //nolint:gosec
+	attr.Mtimensec = md.Mtime.Nsec
+	attr.Atime = attr.Mtime
+	attr.Atimensec = attr.Mtimensec
+	attr.Ctime = attr.Mtime
+	attr.Ctimensec = attr.Mtimensec
+	if md.Uid != nil && md.Gid != nil {
+		attr.Uid = *md.Uid
+		attr.Gid = *md.Gid
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !fuse
+
+package main
+
+import (
+	"context"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func MountCmd(_ context.Context, _ []string, _ bool) error {
+	return lib.Errorf("this build does not support `mount`, build with `-tags fuse` to enable it")
+}
@@ -0,0 +1,234 @@
+//nolint:forbidigo
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// The values of `--notify-on`.
+const (
+	notifyOnAlways  = "always"
+	notifyOnChanges = "changes"
+	notifyOnFailure = "failure"
+)
+
+// The values of `notification.Status`.
+const (
+	notificationStatusOk       = "ok"
+	notificationStatusUpToDate = "up-to-date"
+	notificationStatusFailed   = "failed"
+)
+
+const notifyWebhookTimeout = 10 * time.Second
+
+// The JSON body posted to `--notify-webhook`. `Text` is a one line summary,
+// so that chat services like Slack show something readable.
+type notification struct {
+	Command   string  `json:"command"`
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	Hostname  string  `json:"hostname"`
+	Workspace string  `json:"workspace"`
+	Revision  string  `json:"revision,omitempty"`
+	Files     int     `json:"files"`
+	Skipped   int     `json:"skipped"`
+	Failed    int     `json:"failed"`
+	Bytes     int64   `json:"bytes"`
+	Duration  float64 `json:"duration_seconds"`
+	Text      string  `json:"text"`
+}
+
+// notifier sends a `notification` once `merge` or `reset` is done, see
+// `addNotifyFlags`.
+type notifier struct {
+	webhook string
+	desktop bool
+	on      string
+	// Set by `start`, nothing is sent for `--help` and invalid flags.
+	started      bool
+	startTime    time.Time
+	notification notification
+}
+
+// addNotifyFlags adds `--notify-webhook`, `--notify-desktop`, and
+// `--notify-on` to `flags`.
+func addNotifyFlags(flags *flag.FlagSet) *notifier {
+	n := &notifier{} //nolint:exhaustruct
+	n.notification.Command = flags.Name()
+	flags.StringVar(
+		&n.webhook,
+		"notify-webhook",
+		"",
+		"POST a JSON summary to this URL when the command is done, e.g. a Slack or ntfy webhook",
+	)
+	flags.BoolVar(
+		&n.desktop,
+		"notify-desktop",
+		false,
+		"Show a desktop notification when the command is done (notify-send on Linux, osascript on macOS)",
+	)
+	flags.StringVar(
+		&n.on,
+		"notify-on",
+		notifyOnChanges,
+		"When to notify: always, changes (the command changed something or failed), or failure",
+	)
+	return n
+}
+
+// Validate the flags and start the clock, call it once the command runs.
+func (n *notifier) start() error {
+	switch n.on {
+	case notifyOnAlways, notifyOnChanges, notifyOnFailure:
+	default:
+		return lib.Errorf("invalid --notify-on %q, use always, changes, or failure", n.on)
+	}
+	n.started = true
+	n.startTime = time.Now()
+	return nil
+}
+
+// Record the outcome of a successful command.
+func (n *notifier) done(revisionId lib.RevisionId, summary runSummary, upToDate bool) {
+	n.notification.Status = notificationStatusOk
+	if upToDate {
+		n.notification.Status = notificationStatusUpToDate
+	}
+	if !revisionId.IsRoot() {
+		n.notification.Revision = revisionId.String()
+	}
+	n.notification.Files = summary.Ok
+	n.notification.Skipped = summary.Skipped
+	n.notification.Failed = summary.Failed
+	n.notification.Bytes = summary.Bytes
+}
+
+// Send the notification if it is enabled by the flags. `err` is the result
+// of the command. A notification that cannot be sent is only a warning.
+func (n *notifier) send(ctx context.Context, err error) {
+	if !n.started || (n.webhook == "" && !n.desktop) {
+		return
+	}
+	nt := n.notification
+	if err != nil {
+		nt.Status = notificationStatusFailed
+		nt.Error = errorMessage(err)
+	}
+	switch {
+	case n.on == notifyOnFailure && nt.Status != notificationStatusFailed:
+		return
+	case n.on == notifyOnChanges && nt.Status == notificationStatusUpToDate:
+		return
+	}
+	nt.Hostname, _ = os.Hostname()
+	nt.Workspace, _ = filepath.Abs(".")
+	nt.Duration = time.Since(n.startTime).Seconds()
+	nt.Text = nt.text()
+	if n.webhook != "" {
+		if err := postNotification(ctx, n.webhook, &nt); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to send the notification to %s: %s\n", n.webhook, err)
+		}
+	}
+	if n.desktop {
+		if err := showDesktopNotification(ctx, appName+" "+nt.Command, nt.Text); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to show the desktop notification: %s\n", err)
+		}
+	}
+}
+
+func (nt *notification) text() string {
+	where := fmt.Sprintf("%s %s in %s on %s", appName, nt.Command, nt.Workspace, nt.Hostname)
+	switch nt.Status {
+	case notificationStatusFailed:
+		return fmt.Sprintf("%s failed: %s", where, nt.Error)
+	case notificationStatusUpToDate:
+		return where + ": no changes"
+	}
+	summary := runSummary{
+		Ok:       nt.Files,
+		Skipped:  nt.Skipped,
+		Failed:   nt.Failed,
+		Bytes:    nt.Bytes,
+		Duration: time.Duration(nt.Duration * float64(time.Second)),
+	}
+	if nt.Revision == "" {
+		return fmt.Sprintf("%s: %s", where, summary)
+	}
+	return fmt.Sprintf("%s: revision %s, %s", where, nt.Revision, summary)
+}
+
+func postNotification(ctx context.Context, url string, nt *notification) error {
+	body, err := json.Marshal(nt)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to marshal the notification")
+	}
+	ctx, cancel := context.WithTimeout(ctx, notifyWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return lib.WrapErrorf(err, "invalid webhook URL")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to post the notification")
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return lib.Errorf("the webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func showDesktopNotification(ctx context.Context, title, text string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.CommandContext(
+			ctx,
+			"osascript",
+			"-e", "on run argv",
+			"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+			"-e", "end run",
+			title,
+			text,
+		)
+	default:
+		cmd = exec.CommandContext(ctx, "notify-send", title, text)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return lib.WrapErrorf(err, "%s failed: %s", cmd.Path, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Return the messages of `err` and its causes without the source locations
+// that `lib.WrappedError.Error` adds.
+func errorMessage(err error) string {
+	var messages []string
+	for err != nil {
+		wrapped, ok := err.(*lib.WrappedError) //nolint:errorlint
+		if !ok {
+			messages = append(messages, err.Error())
+			break
+		}
+		if wrapped.Msg != "" {
+			messages = append(messages, wrapped.Msg)
+		}
+		err = wrapped.Unwrap()
+	}
+	return strings.Join(messages, ": ")
+}
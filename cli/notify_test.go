@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestNotifier(t *testing.T) {
+	t.Parallel()
+
+	newWebhook := func(t *testing.T) (string, func() []notification) {
+		t.Helper()
+		var mu sync.Mutex
+		var received []notification
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			var nt notification
+			if err := json.Unmarshal(body, &nt); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			received = append(received, nt)
+		}))
+		t.Cleanup(server.Close)
+		return server.URL, func() []notification {
+			mu.Lock()
+			defer mu.Unlock()
+			return received
+		}
+	}
+	newNotifier := func(t *testing.T, argv ...string) *notifier {
+		t.Helper()
+		flags := flag.NewFlagSet("merge", flag.ContinueOnError)
+		n := addNotifyFlags(flags)
+		lib.NewAssert(t).NoError(flags.Parse(argv))
+		return n
+	}
+
+	t.Run("Changes and failures are posted", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		url, received := newWebhook(t)
+		revisionId := lib.RevisionId(lib.Sha256{1})
+
+		n := newNotifier(t, "--notify-webhook", url)
+		assert.NoError(n.start())
+		n.done(revisionId, runSummary{Ok: 2, Skipped: 1, Failed: 0, Bytes: 42, Duration: 0}, false)
+		n.send(t.Context(), nil)
+		n = newNotifier(t, "--notify-webhook", url)
+		assert.NoError(n.start())
+		n.done(lib.RevisionId{}, runSummary{}, true) //nolint:exhaustruct
+		n.send(t.Context(), nil)
+		n = newNotifier(t, "--notify-webhook", url)
+		assert.NoError(n.start())
+		n.send(t.Context(), lib.WrapErrorf(lib.Errorf("storage not found"), "failed to open workspace"))
+
+		notifications := received()
+		assert.Equal(2, len(notifications))
+		assert.Equal("merge", notifications[0].Command)
+		assert.Equal(notificationStatusOk, notifications[0].Status)
+		assert.Equal(revisionId.String(), notifications[0].Revision)
+		assert.Equal(2, notifications[0].Files)
+		assert.Equal(1, notifications[0].Skipped)
+		assert.Equal(int64(42), notifications[0].Bytes)
+		assert.Contains(notifications[0].Text, "2 files ok, 1 skipped, 0 failed")
+		assert.Equal(notificationStatusFailed, notifications[1].Status)
+		assert.Equal("failed to open workspace: storage not found", notifications[1].Error)
+		assert.Contains(notifications[1].Text, "failed: failed to open workspace: storage not found")
+	})
+
+	t.Run("--notify-on", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		url, received := newWebhook(t)
+
+		n := newNotifier(t, "--notify-webhook", url, "--notify-on", "always")
+		assert.NoError(n.start())
+		n.done(lib.RevisionId{}, runSummary{}, true) //nolint:exhaustruct
+		n.send(t.Context(), nil)
+		n = newNotifier(t, "--notify-webhook", url, "--notify-on", "failure")
+		assert.NoError(n.start())
+		n.done(lib.RevisionId{}, runSummary{Ok: 1}, false) //nolint:exhaustruct
+		n.send(t.Context(), nil)
+		assert.Equal(1, len(received()))
+		assert.Equal(notificationStatusUpToDate, received()[0].Status)
+
+		n = newNotifier(t, "--notify-webhook", url, "--notify-on", "never")
+		assert.Error(n.start(), "invalid --notify-on")
+	})
+
+	t.Run("Nothing is sent before the command runs", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		url, received := newWebhook(t)
+		n := newNotifier(t, "--notify-webhook", url)
+		n.send(t.Context(), lib.Errorf("invalid flags"))
+		assert.Equal(0, len(received()))
+	})
+}
@@ -3,8 +3,12 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/flunderpero/cling-sync/lib"
 	ws "github.com/flunderpero/cling-sync/workspace"
@@ -23,6 +27,24 @@ func PrintErr(msg string, args ...any) {
 	fmt.Fprintf(os.Stderr, s+msg+"\n", args...)
 }
 
+// The level of the diagnostic log (see `newLogHandler`), set with the global
+// `--log-level` flag.
+var logLevel = &slog.LevelVar{} //nolint:gochecknoglobals
+
+// Return the handler of the diagnostic log that is written to `w`.
+// The log is meant for debugging and is separate from the output of the
+// commands, `format` is either "text" or "json".
+func newLogHandler(w io.Writer, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: logLevel} //nolint:exhaustruct
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, lib.Errorf("invalid log format %q, must be `text` or `json`", format)
+}
+
 func CLIMonitorMode(verbose, noProgress bool) ws.DefaultMonitorMode {
 	switch {
 	case verbose:
@@ -34,43 +56,76 @@ func CLIMonitorMode(verbose, noProgress bool) ws.DefaultMonitorMode {
 	}
 }
 
-type (
-	cliStagingMonitor     struct{ *ws.DefaultStagingMonitor }
-	cliCommitMonitor      struct{ *ws.DefaultCommitMonitor }
-	cliHealthCheckMonitor struct{ *ws.DefaultHealthCheckMonitor }
-)
+type cliHealthCheckMonitor struct{ *ws.DefaultHealthCheckMonitor }
+
+// The staging, cp, and commit monitors show their progress with `progress`.
+type cliCommitMonitor struct {
+	*ws.DefaultCommitMonitor
+	progress *progress
+}
+
+type cliStagingMonitor struct {
+	*ws.DefaultStagingMonitor
+	progress  *progress
+	emitPlain bool
+	// Where lines that are not progress are printed, stdout by default.
+	out io.Writer
+}
 
 type cliCpMonitor struct {
 	*ws.DefaultCpMonitor
+	progress  *progress
 	emitPlain bool
 }
 
+type cliScrubMonitor struct {
+	*ws.DefaultScrubMonitor
+	emitPlain bool
+}
+
+type cliReplicationMonitor struct {
+	*ws.DefaultReplicationMonitor
+	emitPlain bool
+}
+
+type cliPackMonitor struct {
+	*ws.DefaultPackMonitor
+}
+
 type cliSyncRepoMonitor struct {
 	*ws.DefaultSyncRepoMonitor
 	targetName string
 	emitPlain  bool
 }
 
-func NewCpMonitor(mode ws.DefaultMonitorMode, cpOnExists ws.CpOnExists, ignoreErrors bool) *cliCpMonitor {
-	monitor := &cliCpMonitor{DefaultCpMonitor: nil, emitPlain: false}
+func NewCpMonitor(
+	mode ws.DefaultMonitorMode,
+	progress *progress,
+	cpOnExists ws.CpOnExists,
+	ignoreErrors bool,
+) *cliCpMonitor {
+	monitor := &cliCpMonitor{DefaultCpMonitor: nil, progress: progress, emitPlain: false}
 	monitor.DefaultCpMonitor = ws.NewDefaultCpMonitor(mode, nil, monitor.emit, cpOnExists, ignoreErrors)
 	return monitor
 }
 
-func NewStatusMonitor(mode ws.DefaultMonitorMode) *cliStagingMonitor {
-	monitor := &cliStagingMonitor{DefaultStagingMonitor: nil}
+func NewStatusMonitor(mode ws.DefaultMonitorMode, progress *progress) *cliStagingMonitor {
+	monitor := &cliStagingMonitor{DefaultStagingMonitor: nil, progress: progress, emitPlain: false, out: os.Stdout}
 	monitor.DefaultStagingMonitor = ws.NewDefaultStagingMonitor(mode, nil, monitor.emit)
 	return monitor
 }
 
-func NewResetMonitors(mode ws.DefaultMonitorMode) (*cliStagingMonitor, *cliCpMonitor) {
-	return NewStatusMonitor(mode), NewCpMonitor(mode, ws.CpOnExistsAbort, false)
+func NewResetMonitors(mode ws.DefaultMonitorMode, progress *progress) (*cliStagingMonitor, *cliCpMonitor) {
+	return NewStatusMonitor(mode, progress), NewCpMonitor(mode, progress, ws.CpOnExistsAbort, false)
 }
 
-func NewMergeMonitors(mode ws.DefaultMonitorMode) (*cliStagingMonitor, *cliCpMonitor, *cliCommitMonitor) {
-	staging := NewStatusMonitor(mode)
-	cp := NewCpMonitor(mode, ws.CpOnExistsAbort, false)
-	commit := &cliCommitMonitor{DefaultCommitMonitor: nil}
+func NewMergeMonitors(
+	mode ws.DefaultMonitorMode,
+	progress *progress,
+) (*cliStagingMonitor, *cliCpMonitor, *cliCommitMonitor) {
+	staging := NewStatusMonitor(mode, progress)
+	cp := NewCpMonitor(mode, progress, ws.CpOnExistsAbort, false)
+	commit := &cliCommitMonitor{DefaultCommitMonitor: nil, progress: progress}
 	commit.DefaultCommitMonitor = ws.NewDefaultCommitMonitor(mode, nil, commit.emit)
 	return staging, cp, commit
 }
@@ -81,6 +136,24 @@ func NewHeathCheckMonitor(mode ws.DefaultMonitorMode) *cliHealthCheckMonitor {
 	return monitor
 }
 
+func NewScrubMonitor(mode ws.DefaultMonitorMode) *cliScrubMonitor {
+	monitor := &cliScrubMonitor{DefaultScrubMonitor: nil, emitPlain: false}
+	monitor.DefaultScrubMonitor = ws.NewDefaultScrubMonitor(mode, monitor.emit)
+	return monitor
+}
+
+func NewPackMonitor(mode ws.DefaultMonitorMode) *cliPackMonitor {
+	monitor := &cliPackMonitor{DefaultPackMonitor: nil}
+	monitor.DefaultPackMonitor = ws.NewDefaultPackMonitor(mode, monitor.emit)
+	return monitor
+}
+
+func NewReplicationMonitor(mode ws.DefaultMonitorMode) *cliReplicationMonitor {
+	monitor := &cliReplicationMonitor{DefaultReplicationMonitor: nil, emitPlain: false}
+	monitor.DefaultReplicationMonitor = ws.NewDefaultReplicationMonitor(mode, monitor.emit)
+	return monitor
+}
+
 func NewSyncRepoMonitor(targetName string, mode ws.DefaultMonitorMode) *cliSyncRepoMonitor {
 	monitor := &cliSyncRepoMonitor{DefaultSyncRepoMonitor: nil, targetName: targetName, emitPlain: false}
 	monitor.DefaultSyncRepoMonitor = ws.NewDefaultSyncRepoMonitor(mode, monitor.emit, targetName)
@@ -95,19 +168,129 @@ func (m *cliCpMonitor) OnError(entry *lib.RevisionEntry, targetPath string, err
 
 func (m *cliCpMonitor) emit(text string) {
 	if m.Mode == ws.DefaultMonitorModeProgress && !m.emitPlain {
-		clearLine()
-		fmt.Fprintf(os.Stderr, "\r%s", text)
+		if m.StartTime.IsZero() {
+			m.progress.message(text)
+			return
+		}
+		m.progress.update(m.state())
 		return
 	}
-	clearLineIfProgress(m.Mode)
+	m.progress.clear()
 	fmt.Printf("%s\n", text)
 }
 
+func (m *cliCpMonitor) state() progressState {
+	s := newProgressState(progressPhaseCopy, m.StartTime, m.Paths, m.TotalPaths, m.BytesWritten, m.TotalBytes)
+	s.Excluded = m.Excluded
+	s.Errors = m.Errors
+	return s
+}
+
 func (m *cliCpMonitor) close() {
-	clearLineIfProgress(m.Mode)
+	if m.Mode == ws.DefaultMonitorModeProgress && !m.StartTime.IsZero() {
+		m.progress.finish(m.state())
+		return
+	}
+	m.progress.clear()
+}
+
+func (m *cliStagingMonitor) OnUnsupported(path lib.Path, dirEntry fs.DirEntry) error {
+	m.emitPlain = true
+	defer func() { m.emitPlain = false }()
+	return m.DefaultStagingMonitor.OnUnsupported(path, dirEntry) //nolint:wrapcheck
 }
 
 func (m *cliStagingMonitor) emit(text string) {
+	if m.Mode == ws.DefaultMonitorModeProgress && !m.emitPlain {
+		if m.StartTime.IsZero() {
+			m.progress.message(text)
+			return
+		}
+		m.progress.update(m.state())
+		return
+	}
+	m.progress.clear()
+	fmt.Fprintf(m.out, "%s\n", text)
+}
+
+func (m *cliStagingMonitor) state() progressState {
+	s := newProgressState(progressPhaseScan, m.StartTime, m.Paths-m.Excluded, 0, m.TotalFileSizes, 0)
+	s.Excluded = m.Excluded
+	s.Unsupported = m.Unsupported
+	return s
+}
+
+func (m *cliStagingMonitor) close() {
+	if m.Mode == ws.DefaultMonitorModeProgress && !m.StartTime.IsZero() {
+		m.progress.finish(m.state())
+		return
+	}
+	m.progress.clear()
+}
+
+func printUnsupportedSummary(m *cliStagingMonitor) {
+	if summary := m.UnsupportedSummary(); summary != "" {
+		fmt.Println(summary)
+	}
+}
+
+// runSummary is the last line printed by cp, merge, and reset.
+type runSummary struct {
+	Ok       int
+	Skipped  int
+	Failed   int
+	Bytes    int64
+	Duration time.Duration
+}
+
+func (s runSummary) String() string {
+	return fmt.Sprintf(
+		"%d files ok, %d skipped, %d failed (%s in %s)",
+		s.Ok,
+		s.Skipped,
+		s.Failed,
+		ws.FormatBytes(s.Bytes),
+		s.Duration.Round(time.Millisecond),
+	)
+}
+
+// printRunSummary prints the summary and, if `failOnIgnored` is set, returns
+// `errIgnoredPaths` if anything was skipped or failed.
+func printRunSummary(s runSummary, failOnIgnored bool) error {
+	fmt.Println(s)
+	if failOnIgnored && s.Skipped+s.Failed > 0 {
+		return lib.WrapErrorf(errIgnoredPaths, "%d skipped, %d failed", s.Skipped, s.Failed)
+	}
+	return nil
+}
+
+func (m *cliCommitMonitor) emit(text string) {
+	if m.Mode == ws.DefaultMonitorModeProgress {
+		if m.StartTime.IsZero() {
+			m.progress.message(text)
+			return
+		}
+		m.progress.update(m.state())
+		return
+	}
+	fmt.Printf("%s\n", text)
+}
+
+// The bytes of blocks that already existed count as uploaded.
+func (m *cliCommitMonitor) state() progressState {
+	bytes := m.RawBytesAdded + m.RawBytesReused
+	return newProgressState(progressPhaseUpload, m.StartTime, m.Paths, m.TotalPaths, bytes, m.TotalBytes)
+}
+
+func (m *cliCommitMonitor) close() {
+	if m.Mode == ws.DefaultMonitorModeProgress && !m.StartTime.IsZero() {
+		m.progress.finish(m.state())
+		return
+	}
+	m.progress.clear()
+}
+
+func (m *cliHealthCheckMonitor) emit(text string) {
 	if m.Mode == ws.DefaultMonitorModeProgress {
 		clearLine()
 		fmt.Fprintf(os.Stderr, "\r%s", text)
@@ -116,24 +299,51 @@ func (m *cliStagingMonitor) emit(text string) {
 	fmt.Printf("%s\n", text)
 }
 
-func (m *cliStagingMonitor) close() {
+func (m *cliHealthCheckMonitor) close() {
 	clearLineIfProgress(m.Mode)
 }
 
-func (m *cliCommitMonitor) emit(text string) {
-	if m.Mode == ws.DefaultMonitorModeProgress {
+func (m *cliScrubMonitor) OnCorruptBlock(blockID lib.BlockId, err error) {
+	m.emitPlain = true
+	defer func() { m.emitPlain = false }()
+	m.DefaultScrubMonitor.OnCorruptBlock(blockID, err)
+}
+
+func (m *cliScrubMonitor) emit(text string) {
+	if m.Mode == ws.DefaultMonitorModeProgress && !m.emitPlain {
 		clearLine()
 		fmt.Fprintf(os.Stderr, "\r%s", text)
 		return
 	}
+	clearLineIfProgress(m.Mode)
 	fmt.Printf("%s\n", text)
 }
 
-func (m *cliCommitMonitor) close() {
+func (m *cliScrubMonitor) close() {
 	clearLineIfProgress(m.Mode)
 }
 
-func (m *cliHealthCheckMonitor) emit(text string) {
+func (m *cliReplicationMonitor) OnBeforeCopy(srcBlocks, dstBlocks int) {
+	m.emitPlain = true
+	defer func() { m.emitPlain = false }()
+	m.DefaultReplicationMonitor.OnBeforeCopy(srcBlocks, dstBlocks)
+}
+
+func (m *cliReplicationMonitor) emit(text string) {
+	if m.Mode == ws.DefaultMonitorModeProgress && !m.emitPlain {
+		clearLine()
+		fmt.Fprintf(os.Stderr, "\r%s", text)
+		return
+	}
+	clearLineIfProgress(m.Mode)
+	fmt.Printf("%s\n", text)
+}
+
+func (m *cliReplicationMonitor) close() {
+	clearLineIfProgress(m.Mode)
+}
+
+func (m *cliPackMonitor) emit(text string) {
 	if m.Mode == ws.DefaultMonitorModeProgress {
 		clearLine()
 		fmt.Fprintf(os.Stderr, "\r%s", text)
@@ -142,7 +352,7 @@ func (m *cliHealthCheckMonitor) emit(text string) {
 	fmt.Printf("%s\n", text)
 }
 
-func (m *cliHealthCheckMonitor) close() {
+func (m *cliPackMonitor) close() {
 	clearLineIfProgress(m.Mode)
 }
 
@@ -193,3 +403,164 @@ func clearLine() {
 	}
 	fmt.Fprint(os.Stderr, "\r"+strings.Repeat(" ", cols)+"\r")
 }
+
+// cliWatchMonitor prefixes every line with `label` unless it is empty.
+type cliWatchMonitor struct {
+	label string
+}
+
+func (m cliWatchMonitor) OnMergeStart(reason string) {
+	m.print("merging (%s)", reason)
+}
+
+func (m cliWatchMonitor) OnMergeEnd(revisionId lib.RevisionId, err error) {
+	if err != nil {
+		m.print("merge failed: %s", err)
+		return
+	}
+	m.print("in sync at revision %s", revisionId)
+}
+
+func (m cliWatchMonitor) print(format string, args ...any) {
+	prefix := time.Now().Format(time.DateTime) + " "
+	if m.label != "" {
+		prefix += m.label + ": "
+	}
+	fmt.Printf(prefix+format+"\n", args...)
+}
+
+func printWatchStatus(status ws.WatchStatus) {
+	fmt.Printf("State:      %s\n", status.State)
+	fmt.Printf("Head:       %s\n", status.Head)
+	fmt.Printf("Merges:     %d\n", status.Merges)
+	if !status.LastMerge.IsZero() {
+		fmt.Printf("Last merge: %s\n", status.LastMerge.Local().Format(time.DateTime))
+	}
+	if !status.PendingSince.IsZero() {
+		fmt.Printf("Pending:    since %s\n", status.PendingSince.Local().Format(time.DateTime))
+	}
+	if status.LastError != "" {
+		fmt.Printf("Last error: %s\n", status.LastError)
+	}
+}
+
+// formatLockInfo returns `<name>  held for <age>  pid <pid> on <host>  owner <owner>`.
+// Unknown fields are left out.
+func formatLockInfo(lock lib.LockInfo, staleAfter time.Duration) string {
+	parts := []string{lock.Name}
+	if !lock.CreatedAt.IsZero() {
+		age := time.Since(lock.CreatedAt)
+		s := "held for " + age.Round(time.Second).String()
+		if age > staleAfter {
+			s += " (stale?)"
+		}
+		parts = append(parts, s)
+	}
+	if lock.Pid != 0 {
+		s := fmt.Sprintf("pid %d", lock.Pid)
+		if lock.Host != "" {
+			s += " on " + lock.Host
+		}
+		parts = append(parts, s)
+	}
+	if lock.Owner != "" {
+		parts = append(parts, "owner "+lock.Owner)
+	}
+	return strings.Join(parts, "  ")
+}
+
+func printFleetStatus(rows []fleetStatusRow) {
+	nameWidth := len("NAME")
+	for _, row := range rows {
+		nameWidth = max(nameWidth, len(row.Name))
+	}
+	fmt.Printf("%-*s  %6s  %7s  %-19s  %s\n", nameWidth, "NAME", "BEHIND", "CHANGES", "LAST SYNC", "PATH")
+	for _, row := range rows {
+		if row.Err != nil {
+			fmt.Printf("%-*s  %6s  %7s  %-19s  %s\n", nameWidth, row.Name, "-", "-", "error", row.Path)
+			continue
+		}
+		lastSync := "never"
+		if !row.LastSync.IsZero() {
+			lastSync = row.LastSync.Local().Format(time.DateTime)
+		}
+		fmt.Printf("%-*s  %6d  %7d  %-19s  %s\n", nameWidth, row.Name, row.Behind, row.Changes, lastSync, row.Path)
+	}
+	for _, row := range rows {
+		if row.Err != nil {
+			PrintErr("%s: %s", row.Name, row.Err)
+		}
+	}
+}
+
+func printStats(stats *lib.Stats, revisions bool) {
+	formatStored := func(size int64) string {
+		if size < 0 {
+			return "n/a"
+		}
+		return ws.FormatBytes(size)
+	}
+	fmt.Printf("Revisions:          %d\n", len(stats.Revisions))
+	fmt.Printf("Logical size:       %s\n", ws.FormatBytes(stats.LogicalSize))
+	fmt.Printf("Stored size:        %s\n", formatStored(stats.StoredSize))
+	fmt.Printf("Referenced blocks:  %d\n", stats.ReferencedBlocks)
+	fmt.Printf("Unique blocks:      %d\n", stats.UniqueBlocks)
+	fmt.Printf("Dedup ratio:        %.2f\n", stats.DedupRatio())
+	if stats.StoredSize > 0 {
+		fmt.Printf("Logical / stored:   %.2f\n", float64(stats.LogicalSize)/float64(stats.StoredSize))
+	}
+	if revisions && len(stats.Revisions) > 0 {
+		fmt.Printf("\n%-64s  %7s  %8s  %10s  %8s\n", "REVISION", "FILES", "LOGICAL", "NEW BLOCKS", "STORED")
+		for _, rs := range stats.Revisions {
+			fmt.Printf(
+				"%-64s  %7d  %8s  %10d  %8s\n",
+				rs.RevisionId,
+				rs.Files,
+				ws.FormatBytes(rs.LogicalSize),
+				rs.NewBlocks,
+				formatStored(rs.NewStoredSize),
+			)
+		}
+	}
+	if len(stats.LargestFiles) > 0 {
+		fmt.Print("\nLargest files:\n")
+		for _, file := range stats.LargestFiles {
+			fmt.Printf("  %8s  %s (revision %s)\n", ws.FormatBytes(file.Size), file.Path, file.RevisionId)
+		}
+	}
+}
+
+func printDiskUsage(report *lib.DiskUsageReport) {
+	formatStored := func(size int64) string {
+		if size < 0 {
+			return "n/a"
+		}
+		return ws.FormatBytes(size)
+	}
+	printUsages := func(usages []lib.DiskUsage) {
+		fmt.Printf("%8s  %8s  %7s  %7s  %s\n", "LOGICAL", "STORED", "BLOCKS", "FILES", "PATH")
+		for _, usage := range usages {
+			path := usage.Path.String()
+			if path == "" {
+				path = "."
+			}
+			fmt.Printf(
+				"%8s  %8s  %7d  %7d  %s\n",
+				ws.FormatBytes(usage.LogicalSize),
+				formatStored(usage.StoredSize),
+				usage.UniqueBlocks,
+				usage.Files,
+				path,
+			)
+		}
+	}
+	printUsages([]lib.DiskUsage{report.Total})
+	if len(report.Directories) > 0 {
+		fmt.Print("\nLargest directories:\n")
+		printUsages(report.Directories)
+	}
+	if len(report.Files) > 0 {
+		fmt.Print("\nLargest files:\n")
+		printUsages(report.Files)
+	}
+}
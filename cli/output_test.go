@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestRunSummary(t *testing.T) {
+	t.Parallel()
+
+	t.Run("String", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		s := runSummary{Ok: 12, Skipped: 1, Failed: 2, Bytes: 4_100_000, Duration: 1204300 * time.Microsecond}
+		assert.Equal("12 files ok, 1 skipped, 2 failed (4.1M in 1.204s)", s.String())
+	})
+
+	t.Run("Fail on ignored", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		assert.NoError(printRunSummary(runSummary{Ok: 1}, true))                       //nolint:exhaustruct
+		assert.NoError(printRunSummary(runSummary{Skipped: 1}, false))                 //nolint:exhaustruct
+		assert.ErrorIs(printRunSummary(runSummary{Skipped: 1}, true), errIgnoredPaths) //nolint:exhaustruct
+		assert.ErrorIs(printRunSummary(runSummary{Failed: 1}, true), errIgnoredPaths)  //nolint:exhaustruct
+	})
+}
+
+func TestNewLogHandler(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	var buf bytes.Buffer
+	handler, err := newLogHandler(&buf, "json")
+	assert.NoError(err)
+	log := slog.New(handler)
+	log.Debug("hidden")
+	log.Info("Acquired lock", "name", "head")
+	assert.Contains(buf.String(), `"level":"INFO","msg":"Acquired lock","name":"head"}`)
+	assert.Equal(false, bytes.Contains(buf.Bytes(), []byte("hidden")))
+
+	buf.Reset()
+	handler, err = newLogHandler(&buf, "text")
+	assert.NoError(err)
+	slog.New(handler).Warn("Retrying S3 request", "attempt", 1)
+	assert.Contains(buf.String(), ` level=WARN msg="Retrying S3 request" attempt=1`)
+
+	_, err = newLogHandler(&buf, "yaml")
+	assert.Error(err, "invalid log format")
+}
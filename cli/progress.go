@@ -0,0 +1,216 @@
+//nolint:forbidigo
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
+	ws "github.com/flunderpero/cling-sync/workspace"
+	"golang.org/x/term"
+)
+
+const (
+	progressInterval     = 100 * time.Millisecond
+	jsonProgressInterval = time.Second
+	progressBarWidth     = 20
+)
+
+// The phases of a command that report progress.
+const (
+	progressPhaseScan   = "scan"
+	progressPhaseCopy   = "copy"
+	progressPhaseUpload = "upload"
+)
+
+var progressPhaseLabels = map[string]string{ //nolint:gochecknoglobals
+	progressPhaseScan:   "scanning",
+	progressPhaseCopy:   "copying",
+	progressPhaseUpload: "uploading",
+}
+
+// progress shows the progress of the staging, cp, and commit monitors of a
+// command on stderr. Either as a single line that is updated in place, or
+// with `--json-progress` as one JSON object per line (see `progressState`).
+type progress struct {
+	json  bool
+	out   io.Writer
+	last  time.Time
+	phase string
+	// Whether the current terminal line has to be cleared before printing.
+	dirty bool
+}
+
+// The progress of a phase, this is also the JSON format of `--json-progress`.
+// The totals are 0 and `ETASeconds` is nil if they are unknown.
+type progressState struct {
+	Phase          string   `json:"phase"`
+	Paths          int      `json:"paths"`
+	TotalPaths     int      `json:"total_paths"`
+	Bytes          int64    `json:"bytes"`
+	TotalBytes     int64    `json:"total_bytes"`
+	BytesPerSecond int64    `json:"bytes_per_second"`
+	ElapsedSeconds float64  `json:"elapsed_seconds"`
+	ETASeconds     *float64 `json:"eta_seconds"`
+	Excluded       int      `json:"excluded,omitempty"`
+	Unsupported    int      `json:"unsupported,omitempty"`
+	Errors         int      `json:"errors,omitempty"`
+	Done           bool     `json:"done"`
+}
+
+func newProgress(jsonProgress bool) *progress {
+	return &progress{json: jsonProgress, out: os.Stderr, last: time.Time{}, phase: "", dirty: false}
+}
+
+// Return the progress for the `--json-progress` flag, which only works in
+// progress mode.
+func cliProgress(mode ws.DefaultMonitorMode, jsonProgress bool) (*progress, error) {
+	if jsonProgress && mode != ws.DefaultMonitorModeProgress {
+		return nil, lib.Errorf("--json-progress cannot be used with --verbose or --no-progress")
+	}
+	return newProgress(jsonProgress), nil
+}
+
+func newProgressState(phase string, start time.Time, paths, totalPaths int, bytes, totalBytes int64) progressState {
+	elapsed := time.Since(start)
+	s := progressState{
+		Phase:          phase,
+		Paths:          paths,
+		TotalPaths:     totalPaths,
+		Bytes:          bytes,
+		TotalBytes:     totalBytes,
+		BytesPerSecond: 0,
+		ElapsedSeconds: elapsed.Seconds(),
+		ETASeconds:     nil,
+		Excluded:       0,
+		Unsupported:    0,
+		Errors:         0,
+		Done:           false,
+	}
+	if elapsed > 0 {
+		s.BytesPerSecond = int64(float64(bytes) / elapsed.Seconds())
+	}
+	if fraction, ok := s.fraction(); ok && fraction > 0 {
+		eta := elapsed.Seconds() * (1 - fraction) / fraction
+		s.ETASeconds = &eta
+	}
+	return s
+}
+
+// Return the part of the phase that is done, by bytes if the total size is
+// known, by paths otherwise.
+func (s progressState) fraction() (float64, bool) {
+	switch {
+	case s.TotalBytes > 0:
+		return min(float64(s.Bytes)/float64(s.TotalBytes), 1), true
+	case s.TotalPaths > 0:
+		return min(float64(s.Paths)/float64(s.TotalPaths), 1), true
+	default:
+		return 0, false
+	}
+}
+
+func (s progressState) String() string {
+	parts := []string{fmt.Sprintf("%-9s", progressPhaseLabels[s.Phase])}
+	if fraction, ok := s.fraction(); ok {
+		done := int(fraction * progressBarWidth)
+		bar := strings.Repeat("=", done) + strings.Repeat(" ", progressBarWidth-done)
+		parts = append(parts, fmt.Sprintf("[%s] %3d%%", bar, int(fraction*100)))
+	}
+	parts = append(parts, formatProgressCount(s.Paths, s.TotalPaths)+" paths")
+	bytes := ws.FormatBytes(s.Bytes)
+	if s.TotalBytes > 0 {
+		bytes += "/" + ws.FormatBytes(s.TotalBytes)
+	}
+	parts = append(parts, bytes, ws.FormatBytes(s.BytesPerSecond)+"/s")
+	if s.ETASeconds != nil {
+		parts = append(parts, "ETA "+(time.Duration(*s.ETASeconds)*time.Second).String())
+	}
+	if s.Excluded > 0 {
+		parts = append(parts, fmt.Sprintf("%d excluded", s.Excluded))
+	}
+	if s.Unsupported > 0 {
+		parts = append(parts, fmt.Sprintf("%d unsupported", s.Unsupported))
+	}
+	if s.Errors > 0 {
+		parts = append(parts, fmt.Sprintf("%d errors", s.Errors))
+	}
+	return strings.Join(parts, "  ")
+}
+
+// Show `s`, but not more often than every `progressInterval` (or
+// `jsonProgressInterval`) unless the phase changed.
+func (p *progress) update(s progressState) {
+	interval := progressInterval
+	if p.json {
+		interval = jsonProgressInterval
+	}
+	if s.Phase == p.phase && time.Since(p.last) < interval {
+		return
+	}
+	p.show(s)
+}
+
+// Show the final state of a phase. Only `--json-progress` prints it, the
+// progress line is cleared.
+func (p *progress) finish(s progressState) {
+	if !p.json {
+		p.clear()
+		return
+	}
+	s.Done = true
+	p.show(s)
+}
+
+// Show a line that is not about a phase, e.g. "preparing...".
+// `--json-progress` ignores it.
+func (p *progress) message(text string) {
+	if p.json {
+		return
+	}
+	p.clear()
+	fmt.Fprint(p.out, "\r"+text)
+	p.dirty = true
+}
+
+// Clear the progress line, so that a regular line can be printed.
+func (p *progress) clear() {
+	if !p.dirty {
+		return
+	}
+	clearLine()
+	p.dirty = false
+}
+
+func (p *progress) show(s progressState) {
+	p.phase = s.Phase
+	p.last = time.Now()
+	if p.json {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return
+		}
+		fmt.Fprintln(p.out, string(data))
+		return
+	}
+	line := s.String()
+	if cols, _, err := term.GetSize(int(os.Stderr.Fd())); err == nil && len(line) >= cols { //nolint:gosec
+		line = line[:max(cols-1, 0)]
+	}
+	p.clear()
+	fmt.Fprint(p.out, "\r"+line)
+	p.dirty = true
+}
+
+// Return "count/total", or just "count" if the total is unknown.
+func formatProgressCount(count, total int) string {
+	if total <= 0 {
+		return strconv.Itoa(count)
+	}
+	return fmt.Sprintf("%d/%d", count, total)
+}
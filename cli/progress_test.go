@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+	ws "github.com/flunderpero/cling-sync/workspace"
+)
+
+func TestProgress(t *testing.T) {
+	t.Parallel()
+
+	t.Run("String", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		eta := 30.0
+		s := progressState{ //nolint:exhaustruct
+			Phase:          progressPhaseUpload,
+			Paths:          3,
+			TotalPaths:     12,
+			Bytes:          1_000_000,
+			TotalBytes:     4_000_000,
+			BytesPerSecond: 100_000,
+			ETASeconds:     &eta,
+			Errors:         1,
+		}
+		assert.Equal(
+			"uploading  [=====               ]  25%  3/12 paths  1.0M/4.0M  100.0K/s  ETA 30s  1 errors",
+			s.String(),
+		)
+		s = progressState{Phase: progressPhaseScan, Paths: 7} //nolint:exhaustruct
+		assert.Equal("scanning   7 paths  0B  0B/s", s.String())
+	})
+
+	t.Run("Fraction falls back to paths", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		fraction, ok := progressState{Paths: 1, TotalPaths: 4}.fraction() //nolint:exhaustruct
+		assert.Equal(true, ok)
+		assert.Equal(0.25, fraction)
+		_, ok = progressState{Paths: 1}.fraction() //nolint:exhaustruct
+		assert.Equal(false, ok)
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		var out bytes.Buffer
+		p := newProgress(true)
+		p.out = &out
+		p.update(progressState{Phase: progressPhaseCopy, Paths: 1, TotalPaths: 2}) //nolint:exhaustruct
+		// Updates of the same phase are throttled.
+		p.update(progressState{Phase: progressPhaseCopy, Paths: 2, TotalPaths: 2}) //nolint:exhaustruct
+		p.finish(progressState{Phase: progressPhaseCopy, Paths: 2, TotalPaths: 2}) //nolint:exhaustruct
+		lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+		assert.Equal(2, len(lines))
+		var last progressState
+		assert.NoError(json.Unmarshal(lines[1], &last))
+		assert.Equal(2, last.Paths)
+		assert.Equal(true, last.Done)
+	})
+
+	t.Run("JSON progress requires progress mode", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		_, err := cliProgress(ws.DefaultMonitorModeVerbose, true)
+		assert.Error(err, "--json-progress cannot be used")
+	})
+}
@@ -0,0 +1,23 @@
+//go:build ui
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The web UI of `serve --ui`. `./build.sh build cli-ui` copies the Wasm
+// module and `wasm_exec.js` next to `index.html` before building.
+//
+//go:embed ui/index.html ui/main.wasm ui/wasm_exec.js
+var uiFiles embed.FS //nolint:gochecknoglobals
+
+func uiHandler() (http.Handler, error) {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	return http.FileServerFS(files), nil
+}
@@ -0,0 +1,15 @@
+//go:build !ui
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func uiHandler() (http.Handler, error) {
+	return nil, lib.Errorf(
+		"this build does not support `serve --ui`, build with `./build.sh build cli-ui` to enable it",
+	)
+}
@@ -0,0 +1,306 @@
+//nolint:forbidigo
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	clingHTTP "github.com/flunderpero/cling-sync/http"
+	"github.com/flunderpero/cling-sync/lib"
+	"github.com/flunderpero/cling-sync/rclone"
+	ws "github.com/flunderpero/cling-sync/workspace"
+	"golang.org/x/term"
+)
+
+// initWizard guides a new user through `init`: choosing the repository
+// location, picking a passphrase, and attaching the first workspace.
+type initWizard struct {
+	in           *bufio.Reader
+	out          io.Writer
+	readPassword func() ([]byte, error)
+}
+
+func newInitWizard(in io.Reader, out io.Writer, readPassword func() ([]byte, error)) *initWizard {
+	return &initWizard{in: bufio.NewReader(in), out: out, readPassword: readPassword}
+}
+
+func readTermPassword() ([]byte, error) {
+	return term.ReadPassword(int(os.Stdin.Fd())) //nolint:gosec,wrapcheck
+}
+
+func (w *initWizard) Run(ctx context.Context) error { //nolint:funlen
+	fmt.Fprintf(w.out, "Welcome to %s!\n\n", appName)
+	fmt.Fprint(w.out, "This wizard creates a new encrypted repository and attaches a\n")
+	fmt.Fprint(w.out, "workspace directory to it. Press Ctrl+C at any time to abort.\n\n")
+	fmt.Fprint(w.out, "Step 1/3: Repository location\n")
+	fmt.Fprint(w.out, "  Either a local directory (must not exist or be empty), e.g. /mnt/backup/repo\n")
+	fmt.Fprint(w.out, "  or an S3-compatible bucket, e.g. s3+https://my-bucket.s3.region.example.com\n")
+	fmt.Fprintf(w.out, "  (use `%s serve` on another machine to host one yourself),\n", appName)
+	fmt.Fprint(w.out, "  or any rclone remote, e.g. rclone://gdrive:backups/repo\n")
+	location, err := w.askRepositoryLocation()
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(w.out, "\nStep 2/3: Passphrase\n")
+	fmt.Fprint(w.out, "  The passphrase encrypts everything in the repository. It cannot be\n")
+	fmt.Fprint(w.out, "  recovered - if you forget it, your data is lost.\n")
+	passphrase, err := w.askPassphrase()
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(w.out, "\nStep 3/3: Workspace\n")
+	fmt.Fprint(w.out, "  The workspace is the local directory you work in.\n")
+	workspaceDir, err := w.askWorkspaceDir(location)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(w.out, "\nSummary:\n")
+	fmt.Fprintf(w.out, "  Repository: %s\n", location)
+	fmt.Fprintf(w.out, "  Workspace:  %s\n", workspaceDir)
+	ok, err := w.confirm("Create the repository and attach the workspace?", true)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return lib.Errorf("aborted")
+	}
+	storage, repositoryURI, err := newRepositoryStorage(location, passphrase, false)
+	if err != nil {
+		return err
+	}
+	repository, err := lib.InitNewRepository(ctx, storage, passphrase)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to initialize repository")
+	}
+	repository.Close() //nolint:errcheck,gosec
+	if err := os.MkdirAll(workspaceDir, 0o700); err != nil {
+		return lib.WrapErrorf(err, "failed to create directory %s", workspaceDir)
+	}
+	tmpFS, err := newWorkspaceTempFS()
+	if err != nil {
+		return err
+	}
+	workspace, err := ws.NewWorkspace(
+		ctx,
+		lib.NewRealFS(workspaceDir),
+		tmpFS,
+		ws.RemoteRepository(repositoryURI),
+		lib.Path{},
+	)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to create workspace")
+	}
+	workspace.Close() //nolint:errcheck,gosec
+	fmt.Fprintf(w.out, "\nCreated repository %s and attached %s.\n\n", location, workspaceDir)
+	fmt.Fprint(w.out, "IMPORTANT: Back up the repository config file somewhere safe:\n\n")
+	switch {
+	case clingHTTP.IsS3StorageURI(location):
+		fmt.Fprint(w.out, "    repository.txt (at the root of the bucket)\n\n")
+	case rclone.IsStorageURI(location):
+		fmt.Fprintf(w.out, "    %s/repository.txt\n\n", strings.TrimPrefix(location, rclone.URIPrefix))
+	default:
+		fmt.Fprintf(w.out, "    %s\n\n", filepath.Join(repositoryURI, ".cling", "repository.txt"))
+	}
+	fmt.Fprint(w.out, "It holds the encrypted keys of the repository. Without it the\n")
+	fmt.Fprint(w.out, "repository cannot be opened, even with the correct passphrase.\n\n")
+	fmt.Fprintf(w.out, "Next: put files into %s and run `%s merge` there.\n", workspaceDir, appName)
+	return nil
+}
+
+func (w *initWizard) askRepositoryLocation() (string, error) {
+	for {
+		location, err := w.ask("Repository location", "")
+		if err != nil {
+			return "", err
+		}
+		if location == "" {
+			fmt.Fprint(w.out, "  Please enter a location.\n")
+			continue
+		}
+		if err := checkRepositoryLocation(location); err != nil {
+			fmt.Fprintf(w.out, "  %s\n", err)
+			continue
+		}
+		if clingHTTP.IsS3StorageURI(location) || rclone.IsStorageURI(location) {
+			return location, nil
+		}
+		abs, err := filepath.Abs(location)
+		if err != nil {
+			return "", lib.WrapErrorf(err, "failed to get absolute path for %s", location)
+		}
+		return abs, nil
+	}
+}
+
+// checkRepositoryLocation validates a repository location without creating
+// anything, so the wizard can ask again on errors.
+func checkRepositoryLocation(location string) error {
+	if err := clingHTTP.RejectBareHTTPURI(location); err != nil {
+		return err //nolint:wrapcheck
+	}
+	if clingHTTP.IsS3StorageURI(location) || rclone.IsStorageURI(location) {
+		return nil
+	}
+	stat, err := os.Stat(location)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to stat %s", location)
+	}
+	if !stat.IsDir() {
+		return lib.Errorf("%s is not a directory", location)
+	}
+	files, err := os.ReadDir(location)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to read directory %s", location)
+	}
+	if len(files) > 0 {
+		return lib.Errorf("directory %s is not empty", location)
+	}
+	return nil
+}
+
+func (w *initWizard) askPassphrase() ([]byte, error) {
+	for {
+		fmt.Fprint(w.out, "Enter passphrase: ")
+		passphrase, err := w.readPassword()
+		fmt.Fprintln(w.out)
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to read passphrase")
+		}
+		if err := lib.CheckPassphraseStrength(passphrase); err != nil {
+			fmt.Fprintf(w.out, "  Too weak: %s.\n", err)
+			continue
+		}
+		fmt.Fprintf(w.out, "  Strength: %s\n", passphraseFeedback(passphrase))
+		fmt.Fprint(w.out, "Repeat passphrase: ")
+		repeat, err := w.readPassword()
+		fmt.Fprintln(w.out)
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to read passphrase")
+		}
+		if string(passphrase) != string(repeat) {
+			fmt.Fprint(w.out, "  Passphrases do not match, please try again.\n")
+			continue
+		}
+		return passphrase, nil
+	}
+}
+
+// passphraseFeedback gives a rough strength estimate for a passphrase that
+// already passed `lib.CheckPassphraseStrength`.
+func passphraseFeedback(passphrase []byte) string {
+	var lower, upper, digit, other bool
+	for _, r := range string(passphrase) {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, b := range []bool{lower, upper, digit, other} {
+		if b {
+			classes++
+		}
+	}
+	n := len([]rune(string(passphrase)))
+	switch {
+	case n >= 24 || (n >= 16 && classes >= 3):
+		return "strong"
+	case n >= 16 || classes >= 3:
+		return "good - a few more random words would make it stronger"
+	default:
+		return "fair - consider a longer passphrase, e.g. four or more random words"
+	}
+}
+
+func (w *initWizard) askWorkspaceDir(repositoryLocation string) (string, error) {
+	for {
+		dir, err := w.ask("Workspace directory", ".")
+		if err != nil {
+			return "", err
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return "", lib.WrapErrorf(err, "failed to get absolute path for %s", dir)
+		}
+		if abs == repositoryLocation {
+			fmt.Fprint(w.out, "  The workspace must not be the repository directory.\n")
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(abs, ".cling", "workspace.txt")); err == nil {
+			fmt.Fprintf(w.out, "  %s is already a workspace.\n", abs)
+			continue
+		}
+		files, err := os.ReadDir(abs)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(w.out, "  Failed to read %s: %s\n", abs, err)
+			continue
+		}
+		if len(files) > 0 {
+			fmt.Fprintf(w.out, "  %s is not empty. Its files will be added on the first merge.\n", abs)
+			ok, err := w.confirm("Use it anyway?", false)
+			if err != nil {
+				return "", err
+			}
+			if !ok {
+				continue
+			}
+		}
+		return abs, nil
+	}
+}
+
+// ask prints `question` and returns the trimmed answer, or `default_` if
+// the answer is empty.
+func (w *initWizard) ask(question, default_ string) (string, error) {
+	if default_ != "" {
+		fmt.Fprintf(w.out, "%s [%s]: ", question, default_)
+	} else {
+		fmt.Fprintf(w.out, "%s: ", question)
+	}
+	line, err := w.in.ReadString('\n')
+	if err != nil && (!errors.Is(err, io.EOF) || line == "") {
+		return "", lib.WrapErrorf(err, "failed to read answer")
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return default_, nil
+	}
+	return line, nil
+}
+
+func (w *initWizard) confirm(question string, default_ bool) (bool, error) {
+	hint := "y/N"
+	if default_ {
+		hint = "Y/n"
+	}
+	for {
+		answer, err := w.ask(fmt.Sprintf("%s [%s]", question, hint), "")
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(answer) {
+		case "":
+			return default_, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func testWizard(input string, passwords ...string) (*initWizard, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	readPassword := func() ([]byte, error) {
+		p := passwords[0]
+		passwords = passwords[1:]
+		return []byte(p), nil
+	}
+	return newInitWizard(strings.NewReader(input), out, readPassword), out
+}
+
+func TestInitWizard(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Repository location asks again until the directory is usable", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		dir := t.TempDir()
+		nonEmpty := filepath.Join(dir, "non-empty")
+		assert.NoError(os.MkdirAll(filepath.Join(nonEmpty, "sub"), 0o700))
+		w, out := testWizard("\nhttp://example.com\n" + nonEmpty + "\n" + filepath.Join(dir, "repo") + "\n")
+		location, err := w.askRepositoryLocation()
+		assert.NoError(err)
+		assert.Equal(filepath.Join(dir, "repo"), location)
+		assert.Contains(out.String(), "Please enter a location.")
+		assert.Contains(out.String(), "is not empty")
+	})
+
+	t.Run("S3 URIs are accepted as-is", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		w, _ := testWizard("s3+https://bucket.example.com\n")
+		location, err := w.askRepositoryLocation()
+		assert.NoError(err)
+		assert.Equal("s3+https://bucket.example.com", location)
+	})
+
+	t.Run("Passphrase is rejected if too weak or not repeated correctly", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		w, out := testWizard("", "short", "long enough passphrase", "typo", "long enough passphrase",
+			"long enough passphrase")
+		passphrase, err := w.askPassphrase()
+		assert.NoError(err)
+		assert.Equal("long enough passphrase", string(passphrase))
+		assert.Contains(out.String(), "Too weak")
+		assert.Contains(out.String(), "Passphrases do not match")
+	})
+
+	t.Run("Non-empty workspace directory must be confirmed", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		dir := t.TempDir()
+		assert.NoError(os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0o600))
+		w, out := testWizard(dir + "\nn\n" + dir + "\ny\n")
+		workspaceDir, err := w.askWorkspaceDir(filepath.Join(dir, "repo"))
+		assert.NoError(err)
+		assert.Equal(dir, workspaceDir)
+		assert.Equal(2, strings.Count(out.String(), "is not empty"))
+	})
+
+	t.Run("Workspace directory must differ from the repository", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		dir := t.TempDir()
+		w, out := testWizard(dir + "\n" + filepath.Join(dir, "ws") + "\n")
+		workspaceDir, err := w.askWorkspaceDir(dir)
+		assert.NoError(err)
+		assert.Equal(filepath.Join(dir, "ws"), workspaceDir)
+		assert.Contains(out.String(), "must not be the repository directory")
+	})
+}
+
+func TestPassphraseFeedback(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	assert.Equal("strong", passphraseFeedback([]byte("correct horse battery staple")))
+	assert.Equal("strong", passphraseFeedback([]byte("Tr0ub4dor&3xyzab")))
+	assert.Contains(passphraseFeedback([]byte("abcdefghijkl")), "fair")
+}
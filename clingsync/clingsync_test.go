@@ -0,0 +1,125 @@
+package clingsync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+	ws "github.com/flunderpero/cling-sync/workspace"
+)
+
+func TestFacade(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	ctx := t.Context()
+	passphrase := []byte("testpassphrase")
+	repositoryDir := t.TempDir()
+	storage, err := lib.NewFileStorage(lib.NewRealFS(repositoryDir), lib.StoragePurposeRepository)
+	assert.NoError(err)
+	repository, err := lib.InitNewRepository(ctx, storage, passphrase)
+	assert.NoError(err)
+	assert.NoError(repository.Close())
+	newWorkspace := func() string {
+		t.Helper()
+		dir := t.TempDir()
+		workspace, err := ws.NewWorkspace(
+			ctx,
+			lib.NewRealFS(dir),
+			lib.NewRealFS(t.TempDir()),
+			ws.RemoteRepository(repositoryDir),
+			lib.Path{},
+		)
+		assert.NoError(err)
+		assert.NoError(workspace.Close())
+		return dir
+	}
+	workspaceDir := newWorkspace()
+	write := func(dir, path, content string) {
+		t.Helper()
+		assert.NoError(os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0o700))
+		assert.NoError(os.WriteFile(filepath.Join(dir, path), []byte(content), 0o600))
+	}
+
+	_, err = OpenWorkspace(ctx, workspaceDir, &OpenWorkspaceOptions{Passphrase: []byte("wrong")})
+	assert.ErrorIs(err, ErrAuth)
+
+	w, err := OpenWorkspace(ctx, workspaceDir, &OpenWorkspaceOptions{Passphrase: passphrase})
+	assert.NoError(err)
+	defer w.Close() //nolint:errcheck
+	write(workspaceDir, "a.txt", "a")
+	write(workspaceDir, "b/c.txt", "bc")
+	changes, err := w.Status(ctx, nil)
+	assert.NoError(err)
+	assert.Equal(3, len(changes))
+	assert.Equal(Change{ChangeAdd, "a.txt", "", false, 0o600, 1, changes[0].ModTime}, changes[0])
+	assert.Equal(true, changes[1].Dir)
+	changes, err = w.Status(ctx, &StatusOptions{Patterns: []string{"a.txt"}, FastScan: false})
+	assert.NoError(err)
+	assert.Equal(1, len(changes))
+	assert.Equal("a.txt", changes[0].Path)
+
+	revisionId1, err := w.Merge(ctx, &MergeOptions{ //nolint:exhaustruct
+		Author:  "test author",
+		Message: "first",
+	})
+	assert.NoError(err)
+	_, err = w.Merge(ctx, nil)
+	assert.ErrorIs(err, ErrUpToDate)
+	assert.NoError(os.Remove(filepath.Join(workspaceDir, "a.txt")))
+	revisionId2, err := w.Merge(ctx, &MergeOptions{ //nolint:exhaustruct
+		Author:  "test author",
+		Message: "second",
+	})
+	assert.NoError(err)
+	head, err := w.Repository().Head(ctx)
+	assert.NoError(err)
+	assert.Equal(revisionId2, head)
+	resolved, err := w.Repository().ResolveRevision(ctx, "head~1")
+	assert.NoError(err)
+	assert.Equal(revisionId1, resolved)
+
+	r, err := OpenRepository(ctx, repositoryDir, &OpenRepositoryOptions{Passphrase: passphrase})
+	assert.NoError(err)
+	defer r.Close() //nolint:errcheck
+	revisions, err := r.Log(ctx, &LogOptions{Patterns: nil, Changes: true})
+	assert.NoError(err)
+	assert.Equal(2, len(revisions))
+	assert.Equal(revisionId2, revisions[0].Id)
+	assert.Equal(revisionId1, revisions[0].Parent)
+	assert.Equal("second", revisions[0].Message)
+	assert.Equal([]Change{{ChangeDelete, "a.txt", "", false, 0o600, 1, revisions[0].Changes[0].ModTime}},
+		revisions[0].Changes)
+	assert.Equal("test author", revisions[1].Author)
+	revisions, err = r.Log(ctx, &LogOptions{Patterns: []string{"b/**"}, Changes: false})
+	assert.NoError(err)
+	assert.Equal(1, len(revisions))
+	assert.Equal(revisionId1, revisions[0].Id)
+
+	target := t.TempDir()
+	n, err := r.Cp(ctx, target, &CpOptions{Revision: "head~1"}) //nolint:exhaustruct
+	assert.NoError(err)
+	assert.Equal(3, n)
+	content, err := os.ReadFile(filepath.Join(target, "a.txt"))
+	assert.NoError(err)
+	assert.Equal("a", string(content))
+	_, err = r.Cp(ctx, target, &CpOptions{Revision: "head~1"}) //nolint:exhaustruct
+	assert.Error(err, "")
+	n, err = r.Cp(ctx, target, &CpOptions{Revision: "", Overwrite: true}) //nolint:exhaustruct
+	assert.NoError(err)
+	assert.Equal(2, n)
+
+	otherDir := newWorkspace()
+	other, err := OpenWorkspace(ctx, otherDir, &OpenWorkspaceOptions{Passphrase: passphrase})
+	assert.NoError(err)
+	defer other.Close() //nolint:errcheck
+	_, err = other.Merge(ctx, nil)
+	assert.NoError(err)
+	write(otherDir, "b/c.txt", "other")
+	_, err = other.Merge(ctx, nil)
+	assert.NoError(err)
+	write(workspaceDir, "b/c.txt", "local")
+	_, err = w.Merge(ctx, nil)
+	assert.ErrorIs(err, ErrConflict)
+	assert.Equal(&ConflictError{[]string{"b/c.txt"}}, err)
+}
@@ -0,0 +1,38 @@
+// Package clingsync is the Go API of cling-sync for programs that embed it.
+//
+// The packages `lib` and `workspace` that the CLI is built on change with
+// every release. This package is a small facade over them that stays
+// stable: it only exposes its own types and option structs, and new
+// options are added as fields whose zero value keeps the old behavior.
+//
+// A workspace is a local directory attached to a repository (see
+// `cling-sync attach`). It is opened with the passphrase of the repository:
+//
+//	w, err := clingsync.OpenWorkspace(ctx, "/home/me/Documents", &clingsync.OpenWorkspaceOptions{
+//		Passphrase: passphrase,
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer w.Close()
+//	changes, err := w.Status(ctx, nil)
+//	...
+//	revisionId, err := w.Merge(ctx, &clingsync.MergeOptions{Author: "me", Message: "Nightly sync"})
+//	if errors.Is(err, clingsync.ErrUpToDate) {
+//		...
+//	}
+//
+// A repository can also be read without a workspace:
+//
+//	r, err := clingsync.OpenRepository(ctx, "/mnt/backup/repository", &clingsync.OpenRepositoryOptions{
+//		Passphrase: passphrase,
+//	})
+//	...
+//	revisions, err := r.Log(ctx, &clingsync.LogOptions{Patterns: []string{"**/*.pdf"}})
+//	...
+//	n, err := r.Cp(ctx, "/tmp/restore", &clingsync.CpOptions{Revision: "head~1"})
+//
+// All functions take a context and can be canceled with it. The errors can
+// be told apart with `errors.Is` and the `Err*` variables of this package.
+// Nothing is printed, neither progress nor warnings.
+package clingsync
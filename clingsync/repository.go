@@ -0,0 +1,301 @@
+package clingsync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	clingHTTP "github.com/flunderpero/cling-sync/http"
+	"github.com/flunderpero/cling-sync/lib"
+	"github.com/flunderpero/cling-sync/rclone"
+	ws "github.com/flunderpero/cling-sync/workspace"
+)
+
+var (
+	// Returned by `Workspace.Merge` if there was nothing to merge.
+	ErrUpToDate = ws.ErrUpToDate
+	// The kind of the errors returned if the local changes conflict with the
+	// changes in the repository (see `ConflictError`).
+	ErrConflict = ws.ErrConflict
+	// The kind of the errors returned if the passphrase is wrong or the
+	// storage rejected the credentials.
+	ErrAuth = lib.ErrAuth
+	// The kind of the errors returned if the repository is corrupt.
+	ErrCorrupt = lib.ErrCorrupt
+	// The kind of the errors returned if someone else holds a lock of the
+	// repository or the workspace. Try again later.
+	ErrContention = lib.ErrContention
+	// The kind of the errors returned if the storage could not be reached.
+	ErrNetwork = lib.ErrNetwork
+)
+
+// A revision id, 64 hex characters.
+type RevisionId string
+
+type ChangeKind string
+
+const (
+	ChangeAdd    ChangeKind = "add"
+	ChangeUpdate ChangeKind = "update"
+	ChangeDelete ChangeKind = "delete"
+	ChangeRename ChangeKind = "rename"
+)
+
+// A changed path, either a local change (`Workspace.Status`) or a change
+// of a revision (`Repository.Log`). The metadata of deleted paths is the
+// one they had before.
+type Change struct {
+	Kind ChangeKind
+	// The path relative to the workspace, or the repository path in `Log`.
+	Path string
+	// The path before a `ChangeRename`, empty otherwise.
+	RenamedFrom string
+	Dir         bool
+	Mode        fs.FileMode
+	Size        int64
+	ModTime     time.Time
+}
+
+type Revision struct {
+	Id      RevisionId
+	Parent  RevisionId
+	Author  string
+	Message string
+	Time    time.Time
+	// Only set with `LogOptions.Changes`.
+	Changes []Change
+}
+
+// A repository opened with `OpenRepository` or by `OpenWorkspace`.
+type Repository struct {
+	repository       *lib.Repository
+	encryptTempFiles bool
+}
+
+type OpenRepositoryOptions struct {
+	// The passphrase of the repository or of one of its key slots.
+	Passphrase []byte
+	// Encrypt the temporary files, see `lib.EncryptedFS`.
+	EncryptTempFiles bool
+}
+
+// OpenRepository opens the repository at `uri`, either a local path, an
+// encrypted `s3+<http-url>` URI (see `cling-sync security encrypt-s3-url`),
+// or an `rclone://<remote>:<path>` URI.
+func OpenRepository(ctx context.Context, uri string, opts *OpenRepositoryOptions) (*Repository, error) {
+	if opts == nil {
+		opts = &OpenRepositoryOptions{} //nolint:exhaustruct
+	}
+	if err := clingHTTP.RejectBareHTTPURI(uri); err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	if !clingHTTP.IsS3StorageURI(uri) && !rclone.IsStorageURI(uri) {
+		abs, err := filepath.Abs(uri)
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to get absolute path for %s", uri)
+		}
+		uri = abs
+	}
+	storage, err := ws.OpenStorage(uri, opts.Passphrase)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to open repository storage")
+	}
+	repository, err := lib.OpenRepository(ctx, storage, opts.Passphrase)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to open repository")
+	}
+	return &Repository{repository, opts.EncryptTempFiles}, nil
+}
+
+// Close the repository and clear its keys from memory.
+func (r *Repository) Close() error {
+	return r.repository.Close() //nolint:wrapcheck
+}
+
+// Return the id of the newest revision. It is all zeros in an empty
+// repository.
+func (r *Repository) Head(ctx context.Context) (RevisionId, error) {
+	head, err := r.repository.Head(ctx)
+	if err != nil {
+		return "", err //nolint:wrapcheck
+	}
+	return RevisionId(head.String()), nil
+}
+
+// Resolve a revision like the `--revision` flag of the CLI: a revision id,
+// `head`, or the name of a tag, optionally followed by `~<n>` to go `n`
+// revisions back, e.g. `head~2`.
+func (r *Repository) ResolveRevision(ctx context.Context, revision string) (RevisionId, error) {
+	revisionId, err := r.resolveRevision(ctx, revision)
+	if err != nil {
+		return "", err
+	}
+	return RevisionId(revisionId.String()), nil
+}
+
+func (r *Repository) resolveRevision(ctx context.Context, revision string) (lib.RevisionId, error) {
+	if revision == "" {
+		revision = "head"
+	}
+	chain, err := lib.ReadRevisionChain(ctx, r.repository)
+	if err != nil {
+		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to read revision chain")
+	}
+	tags, err := r.repository.Tags(ctx)
+	if err != nil {
+		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to read tags")
+	}
+	return chain.ParseRevisionIdOrTag(revision, tags) //nolint:wrapcheck
+}
+
+type LogOptions struct {
+	// Only return the revisions that changed a path matching one of the
+	// patterns (see `cling-sync ls --help` for the syntax). Optional.
+	Patterns []string
+	// Return the changed paths of every revision in `Revision.Changes`.
+	Changes bool
+}
+
+// Log returns the revisions from the newest to the oldest.
+func (r *Repository) Log(ctx context.Context, opts *LogOptions) ([]Revision, error) {
+	if opts == nil {
+		opts = &LogOptions{} //nolint:exhaustruct
+	}
+	logs, err := ws.Log(ctx, r.repository, &ws.LogOptions{ //nolint:exhaustruct
+		PathFilter: patternFilter(opts.Patterns),
+		Status:     opts.Changes,
+	})
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	revisions := make([]Revision, 0, len(logs))
+	for _, l := range logs {
+		revision := Revision{
+			Id:      RevisionId(l.RevisionId.String()),
+			Parent:  RevisionId(l.Revision.ParentRevisionId.String()),
+			Author:  derefString(l.Revision.Author),
+			Message: derefString(l.Revision.Message),
+			Time:    l.Revision.Timestamp.Time(),
+			Changes: nil,
+		}
+		if opts.Changes {
+			revision.Changes = make([]Change, 0, len(l.Files))
+			for i := range l.Files {
+				revision.Changes = append(revision.Changes, newChange(&l.Files[i]))
+			}
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, nil
+}
+
+type CpOptions struct {
+	// The revision to copy from, see `ResolveRevision`. The head if empty.
+	Revision string
+	// Only copy the paths matching one of the patterns (see
+	// `cling-sync cp --help` for the syntax). Optional.
+	Patterns []string
+	// Overwrite existing files in the target directory instead of failing.
+	Overwrite bool
+	// Restore the file ownership and the extended attributes.
+	Chown  bool
+	Xattrs bool
+}
+
+// Cp copies the files of a revision into the directory `target`.
+// Return the number of copied paths.
+func (r *Repository) Cp(ctx context.Context, target string, opts *CpOptions) (int, error) {
+	if opts == nil {
+		opts = &CpOptions{} //nolint:exhaustruct
+	}
+	revisionId, err := r.resolveRevision(ctx, opts.Revision)
+	if err != nil {
+		return 0, err
+	}
+	onExists := ws.CpOnExistsAbort
+	if opts.Overwrite {
+		onExists = ws.CpOnExistsOverwrite
+	}
+	monitor := ws.NewDefaultCpMonitor(ws.DefaultMonitorModeSilent, nil, nil, onExists, false)
+	tmpDir, err := os.MkdirTemp("", "cling-sync-cp")
+	if err != nil {
+		return 0, lib.WrapErrorf(err, "failed to create temporary directory")
+	}
+	defer os.RemoveAll(tmpDir) //nolint:errcheck
+	tmpFS, err := newTempFS(tmpDir, r.encryptTempFiles)
+	if err != nil {
+		return 0, err
+	}
+	err = ws.Cp(ctx, r.repository, lib.NewRealFS(target), &ws.CpOptions{
+		RevisionId:             revisionId,
+		Monitor:                monitor,
+		PathFilter:             patternFilter(opts.Patterns),
+		PathPrefix:             lib.Path{},
+		RestorableMetadataFlag: restorableMetadata(opts.Chown, opts.Xattrs),
+		HardLinkDupes:          false,
+	}, tmpFS)
+	if err != nil {
+		return monitor.Paths, err //nolint:wrapcheck
+	}
+	return monitor.Paths, nil
+}
+
+func patternFilter(patterns []string) lib.PathFilter {
+	if len(patterns) == 0 {
+		return nil
+	}
+	return lib.NewPathInclusionFilter(patterns)
+}
+
+func restorableMetadata(chown, xattrs bool) lib.RestorableMetadataFlag {
+	flag := lib.RestorableMetadataAll
+	if !chown {
+		flag ^= lib.RestorableMetadataOwnership
+	}
+	if !xattrs {
+		flag ^= lib.RestorableMetadataXattrs
+	}
+	return flag
+}
+
+func newChange(f *ws.StatusFile) Change {
+	c := Change{
+		Kind:        ChangeKind(f.Kind.String()),
+		Path:        f.Path.String(),
+		RenamedFrom: "",
+		Dir:         f.Metadata.FileMode.IsDir(),
+		Mode:        f.Metadata.FileMode.AsFsFileMode(),
+		Size:        f.Metadata.Size,
+		ModTime:     f.Metadata.MTime(),
+	}
+	if f.RenamedFrom != nil {
+		c.Kind = ChangeRename
+		c.RenamedFrom = f.RenamedFrom.String()
+	}
+	return c
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// Close `c` and join its error with `err`.
+func closeWith(c io.Closer, err error) error {
+	return errors.Join(err, c.Close())
+}
+
+// The FS of the temporary directory `dir`, encrypted with a key that only
+// lives in memory if `encrypt` is set.
+func newTempFS(dir string, encrypt bool) (lib.FS, error) { //nolint:ireturn
+	if !encrypt {
+		return lib.NewRealFS(dir), nil
+	}
+	return lib.NewEncryptedFS(lib.NewRealFS(dir)) //nolint:wrapcheck
+}
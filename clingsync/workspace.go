@@ -0,0 +1,222 @@
+package clingsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/flunderpero/cling-sync/lib"
+	ws "github.com/flunderpero/cling-sync/workspace"
+)
+
+// A local directory attached to a repository, opened with `OpenWorkspace`.
+type Workspace struct {
+	workspace  *ws.Workspace
+	repository *Repository
+}
+
+type OpenWorkspaceOptions struct {
+	// The passphrase of the repository the workspace is attached to.
+	Passphrase []byte
+	// Encrypt the temporary files, e.g. the paths and hashes of the
+	// revisions compared by `Merge`, see `lib.EncryptedFS`.
+	EncryptTempFiles bool
+	// Encrypt the staging cache of the workspace, see
+	// `ws.Workspace.EncryptCache`.
+	EncryptCache bool
+}
+
+// OpenWorkspace opens the workspace in `dir` and the repository it is
+// attached to.
+func OpenWorkspace(ctx context.Context, dir string, opts *OpenWorkspaceOptions) (*Workspace, error) {
+	if opts == nil {
+		opts = &OpenWorkspaceOptions{} //nolint:exhaustruct
+	}
+	path, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to get absolute path for %s", dir)
+	}
+	tmpDir, err := os.MkdirTemp("", "cling-sync-workspace")
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to create temporary directory")
+	}
+	tmpFS, err := newTempFS(tmpDir, opts.EncryptTempFiles)
+	if err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	workspace, err := ws.OpenWorkspace(ctx, lib.NewRealFS(path), tmpFS)
+	if err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return nil, err //nolint:wrapcheck
+	}
+	workspace.EncryptCache = opts.EncryptCache
+	repository, err := OpenRepository(
+		ctx,
+		string(workspace.RemoteRepository),
+		&OpenRepositoryOptions{Passphrase: opts.Passphrase, EncryptTempFiles: opts.EncryptTempFiles},
+	)
+	if err != nil {
+		return nil, closeWith(workspace, err)
+	}
+	if err := workspace.MirrorRepositoryConfig(ctx, repository.repository.Config()); err != nil {
+		err = lib.WrapErrorf(err, "failed to mirror repository config")
+		return nil, closeWith(workspace, closeWith(repository, err))
+	}
+	signingKey, err := workspace.SigningKey(ctx)
+	if err != nil {
+		return nil, closeWith(workspace, closeWith(repository, err))
+	}
+	repository.repository.SetSigningKey(signingKey)
+	identity, err := workspace.Identity(ctx)
+	if err != nil {
+		return nil, closeWith(workspace, closeWith(repository, err))
+	}
+	repository.repository.SetClientId(identity.ClientId)
+	return &Workspace{workspace, repository}, nil
+}
+
+// Close the workspace and its repository.
+func (w *Workspace) Close() error {
+	return closeWith(w.workspace, w.repository.Close())
+}
+
+// The repository the workspace is attached to. It is closed with the
+// workspace.
+func (w *Workspace) Repository() *Repository {
+	return w.repository
+}
+
+type StatusOptions struct {
+	// Only return the changes of the paths matching one of the patterns
+	// (see `cling-sync status --help` for the syntax). Optional.
+	Patterns []string
+	// Trust the file metadata (size, ctime, inode) to detect changes
+	// instead of comparing the contents, see `cling-sync status --fast-scan`.
+	FastScan bool
+}
+
+// Status returns the local changes, i.e. what the next `Merge` commits.
+// Like `Merge`, it locks the workspace.
+func (w *Workspace) Status(ctx context.Context, opts *StatusOptions) ([]Change, error) {
+	if opts == nil {
+		opts = &StatusOptions{} //nolint:exhaustruct
+	}
+	unlock, err := w.workspace.Lock(ctx, false)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	defer unlock() //nolint:errcheck
+	tmpFS, err := w.workspace.TempFS.MkSub("status")
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to create status tmp dir")
+	}
+	defer tmpFS.RemoveAll(".") //nolint:errcheck
+	files, err := ws.Status(ctx, w.workspace, w.repository.repository, &ws.StatusOptions{
+		PathFilter:             patternFilter(opts.Patterns),
+		Monitor:                ws.NewDefaultStagingMonitor(ws.DefaultMonitorModeSilent, nil, nil),
+		RestorableMetadataFlag: restorableMetadata(false, false),
+		UseStagingCache:        opts.FastScan,
+		WatchJournal:           nil,
+	}, tmpFS)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	changes := make([]Change, 0, len(files))
+	for i := range files {
+		changes = append(changes, newChange(&files[i]))
+	}
+	return changes, nil
+}
+
+type MergeOptions struct {
+	// The author and the message of the revision with the local changes.
+	// The author defaults to the identity of the workspace, see
+	// `cling-sync identity`.
+	Author  string
+	Message string
+	// Merge conflicting text files line by line instead of failing with a
+	// `ConflictError`, see `cling-sync merge --merge-text`.
+	MergeText bool
+	// See `StatusOptions.FastScan`.
+	FastScan bool
+	// Restore the file ownership and the extended attributes of the files
+	// that are copied from the repository.
+	Chown  bool
+	Xattrs bool
+}
+
+// The local changes that conflict with the changes in the repository.
+// Nothing was changed, see `cling-sync merge --help` for how to resolve
+// the conflicts.
+type ConflictError struct {
+	// The conflicting paths relative to the workspace.
+	Paths []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("merge aborted due to conflicts: %s", strings.Join(e.Paths, ", "))
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict //nolint:errorlint
+}
+
+// Merge the changes in the repository into the workspace and commit the
+// local changes. Return the new head of the workspace, `ErrUpToDate` if
+// there was nothing to merge, or a `*ConflictError`.
+// The workspace is locked during the merge, another merge in the same
+// workspace fails with `ErrContention`.
+// The hooks in `.cling/hooks` of the workspace are run, their output is
+// discarded (see `cling-sync merge --help`).
+func (w *Workspace) Merge(ctx context.Context, opts *MergeOptions) (RevisionId, error) {
+	if opts == nil {
+		opts = &MergeOptions{} //nolint:exhaustruct
+	}
+	unlock, err := w.workspace.Lock(ctx, false)
+	if err != nil {
+		return "", err //nolint:wrapcheck
+	}
+	defer unlock() //nolint:errcheck
+	author := opts.Author
+	if author == "" {
+		identity, err := w.workspace.Identity(ctx)
+		if err != nil {
+			return "", err //nolint:wrapcheck
+		}
+		author = identity.Author()
+	}
+	cpMonitor := ws.NewDefaultCpMonitor(ws.DefaultMonitorModeSilent, nil, nil, ws.CpOnExistsAbort, false)
+	revisionId, err := ws.Merge(ctx, w.workspace, w.repository.repository, &ws.MergeOptions{
+		StagingMonitor:         ws.NewDefaultStagingMonitor(ws.DefaultMonitorModeSilent, nil, nil),
+		CpMonitor:              cpMonitor,
+		CommitMonitor:          ws.NewDefaultCommitMonitor(ws.DefaultMonitorModeSilent, nil, nil),
+		Author:                 author,
+		Message:                opts.Message,
+		RestorableMetadataFlag: restorableMetadata(opts.Chown, opts.Xattrs),
+		UseStagingCache:        opts.FastScan,
+		First:                  nil,
+		CommitFilter:           nil,
+		WatchJournal:           nil,
+		MergeText:              opts.MergeText,
+		MemoryBudget:           nil,
+		CacheMonitor:           nil,
+		HookOutput:             nil,
+	})
+	conflicts := ws.MergeConflictsError{}
+	if errors.As(err, &conflicts) {
+		paths := make([]string, 0, len(conflicts))
+		for _, conflict := range conflicts {
+			path, _ := conflict.WorkspaceEntry.Path.TrimBase(w.workspace.PathPrefix)
+			paths = append(paths, path.String())
+		}
+		return "", &ConflictError{paths}
+	}
+	if err != nil {
+		return "", err //nolint:wrapcheck
+	}
+	return RevisionId(revisionId.String()), nil
+}
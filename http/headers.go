@@ -0,0 +1,39 @@
+// Extra headers sent with every request of an `HTTPClient`, e.g. an auth
+// token for a proxy in front of the repository server or a tracing id.
+package http
+
+import (
+	"net/textproto"
+	"strings"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// ParseHTTPHeader parses a header given as `Name: value`.
+func ParseHTTPHeader(s string) (string, string, error) {
+	name, value, ok := strings.Cut(s, ":")
+	if !ok {
+		return "", "", lib.Errorf("invalid header %q, expected `Name: value`", s)
+	}
+	name = strings.TrimSpace(name)
+	if err := ValidateHTTPHeader(name); err != nil {
+		return "", "", err
+	}
+	return name, strings.TrimSpace(value), nil
+}
+
+// ValidateHTTPHeader rejects header names that are not valid or that would
+// interfere with the SigV4 signature of a request.
+func ValidateHTTPHeader(name string) error {
+	if name == "" || strings.ContainsFunc(name, func(r rune) bool {
+		return r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+	}) {
+		return lib.Errorf("invalid header name %q", name)
+	}
+	canonical := textproto.CanonicalMIMEHeaderKey(name)
+	if canonical == "Authorization" || canonical == "Host" || canonical == "Content-Length" ||
+		strings.HasPrefix(canonical, "X-Amz-") {
+		return lib.Errorf("the %s header cannot be overridden", canonical)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package http
+
+import (
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestParseHTTPHeader(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Name and value are trimmed", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		name, value, err := ParseHTTPHeader(" X-Trace-Id :  abc: def ")
+		assert.NoError(err)
+		assert.Equal("X-Trace-Id", name)
+		assert.Equal("abc: def", value)
+	})
+
+	t.Run("Invalid headers are rejected", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		_, _, err := ParseHTTPHeader("X-Trace-Id")
+		assert.Error(err, "expected `Name: value`")
+		_, _, err = ParseHTTPHeader(": value")
+		assert.Error(err, "invalid header name")
+		_, _, err = ParseHTTPHeader("X Trace: value")
+		assert.Error(err, "invalid header name")
+	})
+
+	t.Run("Headers of the signature cannot be overridden", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		_, _, err := ParseHTTPHeader("authorization: Bearer token")
+		assert.Error(err, "the Authorization header cannot be overridden")
+		_, _, err = ParseHTTPHeader("x-amz-date: 20240101T000000Z")
+		assert.Error(err, "the X-Amz-Date header cannot be overridden")
+		_, _, err = ParseHTTPHeader("Host: example.com")
+		assert.Error(err, "the Host header cannot be overridden")
+	})
+}
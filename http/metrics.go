@@ -0,0 +1,220 @@
+//go:build !wasm
+
+package http
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The upper bounds of the buckets of the request duration histogram.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10} //nolint:gochecknoglobals
+
+// Metrics collects the metrics of one or more `S3StorageServer`s and serves
+// them in the Prometheus text format at `/metrics`. A server is only
+// measured once it was added with `Add`.
+type Metrics struct {
+	mu              sync.Mutex
+	servers         map[string]*S3StorageServer
+	requests        map[requestKey]int64
+	durations       map[routeKey]*histogram
+	received        map[routeKey]int64
+	sent            map[routeKey]int64
+	lockContentions map[string]int64
+}
+
+// The labels of a request.
+type routeKey struct {
+	Repository string
+	Route      string
+	Method     string
+}
+
+type requestKey struct {
+	routeKey
+	Status int
+}
+
+type histogram struct {
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		mu:              sync.Mutex{},
+		servers:         map[string]*S3StorageServer{},
+		requests:        map[requestKey]int64{},
+		durations:       map[routeKey]*histogram{},
+		received:        map[routeKey]int64{},
+		sent:            map[routeKey]int64{},
+		lockContentions: map[string]int64{},
+	}
+}
+
+// Add measures `server` with the label `repository="<repository>"`.
+func (m *Metrics) Add(repository string, server *S3StorageServer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.servers[repository] = server
+	server.metrics = m
+	server.metricsRepository = repository
+}
+
+func (m *Metrics) RegisterRoutes(mux *http.ServeMux) {
+	mux.Handle("/metrics", m)
+}
+
+func (m *Metrics) observeRequest(key routeKey, status int, duration time.Duration, received, sent int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{key, status}]++
+	h, ok := m.durations[key]
+	if !ok {
+		h = &histogram{make([]int64, len(durationBuckets)), 0, 0}
+		m.durations[key] = h
+	}
+	seconds := duration.Seconds()
+	for i, le := range durationBuckets {
+		if seconds <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+	m.received[key] += int64(received)
+	m.sent[key] += int64(sent)
+}
+
+func (m *Metrics) observeLockContention(repository string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lockContentions[repository]++
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var sb strings.Builder
+	m.write(&sb)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = io.WriteString(w, sb.String())
+}
+
+//nolint:funlen
+func (m *Metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	header := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	header("cling_sync_requests_total", "counter", "Requests by repository, route, method, and status code.")
+	for _, key := range sortedKeys(m.requests, func(k requestKey) string {
+		return fmt.Sprintf("%s %d", k.routeKey.labels(), k.Status)
+	}) {
+		fmt.Fprintf(w, "cling_sync_requests_total{%s,status=\"%d\"} %d\n", key.labels(), key.Status, m.requests[key])
+	}
+
+	header("cling_sync_request_duration_seconds", "histogram", "Request latencies by repository, route, and method.")
+	for _, key := range sortedKeys(m.durations, routeKey.labels) {
+		h, labels := m.durations[key], key.labels()
+		for i, le := range durationBuckets {
+			fmt.Fprintf(w, "cling_sync_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, le, h.counts[i])
+		}
+		fmt.Fprintf(w, "cling_sync_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(w, "cling_sync_request_duration_seconds_sum{%s} %g\n", labels, h.sum)
+		fmt.Fprintf(w, "cling_sync_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	header("cling_sync_received_bytes_total", "counter", "Bytes of request bodies, i.e. written by clients.")
+	for _, key := range sortedKeys(m.received, routeKey.labels) {
+		fmt.Fprintf(w, "cling_sync_received_bytes_total{%s} %d\n", key.labels(), m.received[key])
+	}
+
+	header("cling_sync_sent_bytes_total", "counter", "Bytes of response bodies, i.e. read by clients.")
+	for _, key := range sortedKeys(m.sent, routeKey.labels) {
+		fmt.Fprintf(w, "cling_sync_sent_bytes_total{%s} %d\n", key.labels(), m.sent[key])
+	}
+
+	repositories := slices.Sorted(maps.Keys(m.servers))
+	header("cling_sync_locks_held", "gauge", "Locks held by clients right now.")
+	for _, repository := range repositories {
+		server := m.servers[repository]
+		server.locksMutex.Lock()
+		held := len(server.locks)
+		server.locksMutex.Unlock()
+		fmt.Fprintf(w, "cling_sync_locks_held{repository=%s} %d\n", labelValue(repository), held)
+	}
+
+	header("cling_sync_lock_contentions_total", "counter", "Lock requests rejected because the lock was held.")
+	for _, repository := range repositories {
+		fmt.Fprintf(w, "cling_sync_lock_contentions_total{repository=%s} %d\n",
+			labelValue(repository), m.lockContentions[repository])
+	}
+
+	header("cling_sync_quota_used_bytes", "gauge", "Bytes stored in blocks of repositories with a quota.")
+	for _, repository := range repositories {
+		server := m.servers[repository]
+		server.quotaMu.Lock()
+		used := server.usedSize
+		server.quotaMu.Unlock()
+		if server.MaxSize > 0 && used >= 0 {
+			fmt.Fprintf(w, "cling_sync_quota_used_bytes{repository=%s} %d\n", labelValue(repository), used)
+		}
+	}
+	header("cling_sync_quota_max_bytes", "gauge", "The quota of repositories with a quota.")
+	for _, repository := range repositories {
+		if server := m.servers[repository]; server.MaxSize > 0 {
+			fmt.Fprintf(w, "cling_sync_quota_max_bytes{repository=%s} %d\n", labelValue(repository), server.MaxSize)
+		}
+	}
+}
+
+func (k routeKey) labels() string {
+	return fmt.Sprintf("repository=%s,route=%s,method=%s", labelValue(k.Repository), labelValue(k.Route),
+		labelValue(k.Method))
+}
+
+func sortedKeys[K comparable, V any](m map[K]V, sortKey func(K) string) []K {
+	keys := slices.Collect(maps.Keys(m))
+	slices.SortFunc(keys, func(a, b K) int {
+		return strings.Compare(sortKey(a), sortKey(b))
+	})
+	return keys
+}
+
+// Quote a label value as the Prometheus text format wants it.
+func labelValue(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// The route label of a request, i.e. the kind of key it is for.
+func (s *S3StorageServer) routeLabel(r *http.Request) string {
+	path, _ := cutBasePath(s.BasePath, r.URL.Path)
+	key := strings.TrimPrefix(path, "/")
+	if s.Prefix != "" {
+		key = strings.TrimPrefix(key, s.Prefix+"/")
+	}
+	if key == "" {
+		return "list"
+	}
+	if key == "repository.txt" {
+		return "config"
+	}
+	section, _, _ := strings.Cut(key, "/")
+	switch section {
+	case "blocks", "refs", "security", "conf", "lost-found", "files", "locks":
+		return section
+	}
+	return "other"
+}
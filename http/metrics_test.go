@@ -0,0 +1,61 @@
+//nolint:bodyclose
+package http
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	storage := freshStorage(t)
+	server := NewS3StorageServer(storage, testRegion, testAccessKey, testSecret)
+	server.Prefix = "repos/photos"
+	metrics := NewMetrics()
+	metrics.Add("photos", server)
+	mux := http.NewServeMux()
+	server.RegisterRoutes(mux)
+	metrics.RegisterRoutes(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	client := NewS3StorageClient(S3StorageConfig{
+		BucketURL:       srv.URL,
+		Region:          testRegion,
+		Prefix:          "repos/photos",
+		AccessKeyID:     testAccessKey,
+		SecretAccessKey: []byte(testSecret),
+	}, NewDefaultHTTPClient(srv.Client()))
+	ctx := t.Context()
+	assert.NoError(client.Init(ctx, lib.Toml{}, ""))
+	_, err := client.WriteBlock(ctx, td.BlockId("1"), []byte("12345"))
+	assert.NoError(err)
+	_, err = client.ReadBlock(ctx, td.BlockId("1"), lib.NewBlockBuf())
+	assert.NoError(err)
+	unlock, err := client.Lock(ctx, "head")
+	assert.NoError(err)
+	_, err = client.Lock(ctx, "head")
+	assert.Error(err, "lock")
+
+	resp, err := http.Get(srv.URL + "/metrics") //nolint:noctx
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	data, err := io.ReadAll(resp.Body)
+	assert.NoError(err)
+	text := string(data)
+	blocks := `repository="photos",route="blocks",method="PUT"`
+	assert.Contains(text, "\ncling_sync_requests_total{"+blocks+`,status="201"} 1`+"\n")
+	assert.Contains(text, "\ncling_sync_request_duration_seconds_count{"+blocks+"} 1\n")
+	assert.Contains(text, "\ncling_sync_request_duration_seconds_bucket{"+blocks+`,le="+Inf"} 1`+"\n")
+	assert.Contains(text, "\ncling_sync_received_bytes_total{"+blocks+"} 5\n")
+	assert.Contains(text, "\ncling_sync_sent_bytes_total{"+
+		`repository="photos",route="blocks",method="GET"} 5`+"\n")
+	assert.Contains(text, `cling_sync_requests_total{repository="photos",route="config",method="PUT",status="200"}`)
+	assert.Contains(text, "\ncling_sync_locks_held{repository=\"photos\"} 1\n")
+	assert.Contains(text, "\ncling_sync_lock_contentions_total{repository=\"photos\"} 1\n")
+	assert.NoError(unlock())
+}
@@ -0,0 +1,58 @@
+//go:build !wasm
+
+package http
+
+import (
+	"net/http"
+	"strings"
+)
+
+// All repositories of an `S3MultiStorageServer` live below this key prefix.
+const MultiRepositoryKeyPrefix = "repos"
+
+// S3MultiStorageServer serves several independent repositories. The
+// repository `<name>` is served under the key prefix `repos/<name>/`, i.e.
+// clients use an endpoint like `s3+https://<host>/repos/<name>`.
+// Requests are authenticated by the repository's own `S3StorageServer`, so
+// every repository can have its own credentials.
+type S3MultiStorageServer struct {
+	Repositories map[string]*S3StorageServer
+	// See `S3StorageServer.BasePath`.
+	BasePath string
+}
+
+// NewS3MultiStorageServer sets the `Prefix` and the `BasePath` of each server
+// in `repositories`.
+func NewS3MultiStorageServer(repositories map[string]*S3StorageServer, basePath string) *S3MultiStorageServer {
+	for name, server := range repositories {
+		server.Prefix = MultiRepositoryKeyPrefix + "/" + name
+		server.BasePath = basePath
+	}
+	return &S3MultiStorageServer{repositories, basePath}
+}
+
+func (s *S3MultiStorageServer) RegisterRoutes(mux *http.ServeMux) {
+	mux.Handle("/", s)
+}
+
+func (s *S3MultiStorageServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path, _ := cutBasePath(s.BasePath, r.URL.Path)
+	key := strings.TrimPrefix(path, "/")
+	if key == "" {
+		// Listings are sent to the bucket root, the repository is part of
+		// the `prefix` parameter.
+		key = r.URL.Query().Get("prefix")
+	}
+	rest, ok := strings.CutPrefix(key, MultiRepositoryKeyPrefix+"/")
+	if !ok {
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", "unknown key shape")
+		return
+	}
+	name, _, _ := strings.Cut(rest, "/")
+	server, ok := s.Repositories[name]
+	if !ok {
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", "unknown repository")
+		return
+	}
+	server.ServeHTTP(w, r)
+}
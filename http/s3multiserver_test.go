@@ -0,0 +1,119 @@
+//nolint:bodyclose
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestS3MultiStorageServer(t *testing.T) {
+	t.Parallel()
+
+	// Each subtest gets its own server with the repositories `a` and `b`
+	// and runs against `b`.
+	checkS3Storage(t, func(t *testing.T) (S3StorageConfig, HTTPClient) { //nolint:thelper
+		srv, _ := newMultiServer(t)
+		return S3StorageConfig{
+			BucketURL:       srv.URL,
+			Region:          testRegion,
+			Prefix:          "repos/b",
+			AccessKeyID:     testAccessKey,
+			SecretAccessKey: []byte(testSecret),
+		}, NewDefaultHTTPClient(srv.Client())
+	})
+
+	t.Run("Repositories are independent", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		srv, storages := newMultiServer(t)
+		newClient := func(prefix, secret string) *S3StorageClient {
+			return NewS3StorageClient(S3StorageConfig{
+				BucketURL:       srv.URL,
+				Region:          testRegion,
+				Prefix:          prefix,
+				AccessKeyID:     testAccessKey,
+				SecretAccessKey: []byte(secret),
+			}, NewDefaultHTTPClient(srv.Client()))
+		}
+		a := newClient("repos/a", "secret-a")
+		assert.NoError(a.Init(t.Context(), lib.Toml{"repo": {"name": "a"}}, ""))
+		assert.NoError(a.WriteControlFile(t.Context(), lib.ControlFileSectionRefs, "head", []byte("a")))
+		toml, err := storages["a"].Open(t.Context())
+		assert.NoError(err)
+		assert.Equal("a", toml["repo"]["name"])
+		_, err = storages["b"].Open(t.Context())
+		assert.ErrorIs(err, lib.ErrStorageNotFound)
+
+		// The credentials of `a` don't work for `b`.
+		_, err = newClient("repos/b", "secret-a").Open(t.Context())
+		assert.Error(err, "403")
+		// Neither do the ones of `b` for `a`.
+		_, err = newClient("repos/a", testSecret).Open(t.Context())
+		assert.Error(err, "403")
+	})
+
+	t.Run("Repositories behind a proxy", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		storages := map[string]*lib.FileStorage{"a": freshStorage(t)}
+		srv := newProxiedServer(t, "/cling", true, func(mux *http.ServeMux) {
+			NewS3MultiStorageServer(map[string]*S3StorageServer{
+				"a": NewS3StorageServer(storages["a"], testRegion, testAccessKey, testSecret),
+			}, "/cling").RegisterRoutes(mux)
+		})
+		cfg, err := ParseS3Endpoint(
+			"s3+"+srv.URL+"/cling/repos/a?base-path=/cling",
+			S3Credentials{AccessKeyID: testAccessKey, SecretAccessKey: []byte(testSecret)},
+		)
+		assert.NoError(err)
+		cfg.Region = testRegion
+		client := NewS3StorageClient(cfg, NewDefaultHTTPClient(srv.Client()))
+		assert.NoError(client.Init(t.Context(), lib.Toml{"repo": {"name": "a"}}, ""))
+		assert.NoError(client.WriteControlFile(t.Context(), lib.ControlFileSectionRefs, "head", []byte("a")))
+		names, err := client.ListControlFiles(t.Context(), lib.ControlFileSectionRefs)
+		assert.NoError(err)
+		assert.Equal([]string{"head"}, names)
+		toml, err := storages["a"].Open(t.Context())
+		assert.NoError(err)
+		assert.Equal("a", toml["repo"]["name"])
+	})
+
+	pathCases := []struct {
+		name string
+		path string
+	}{
+		{"Unknown repository should be rejected", "/repos/c/repository.txt"},
+		{"Key outside of repos/ should be rejected", "/repository.txt"},
+		{"Listing outside of the repository should be rejected", "/?list-type=2&prefix=repos/b/../a/refs/"},
+		{"Listing another repository should be rejected", "/?list-type=2&prefix=repos/a/refs/"},
+	}
+	for _, tc := range pathCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert := lib.NewAssert(t)
+			srv, _ := newMultiServer(t)
+			resp, err := sendSignedTest(srv, http.MethodGet, srv.URL+tc.path, nil)
+			assert.NoError(err)
+			assert.Equal(http.StatusForbidden, resp.StatusCode)
+		})
+	}
+}
+
+// newMultiServer serves the repositories `a` (with the secret `secret-a`)
+// and `b` (with `testSecret`).
+func newMultiServer(t *testing.T) (*httptest.Server, map[string]*lib.FileStorage) {
+	t.Helper()
+	storages := map[string]*lib.FileStorage{"a": freshStorage(t), "b": freshStorage(t)}
+	server := NewS3MultiStorageServer(map[string]*S3StorageServer{
+		"a": NewS3StorageServer(storages["a"], testRegion, testAccessKey, "secret-a"),
+		"b": NewS3StorageServer(storages["b"], testRegion, testAccessKey, testSecret),
+	}, "")
+	mux := http.NewServeMux()
+	server.RegisterRoutes(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, storages
+}
@@ -1,17 +1,22 @@
 //go:build !wasm
 
 // An S3 compatible server that only implements what's actually needed for cling-sync clients.
-// It only ever serves one repository.
+// `S3StorageServer` serves one repository, `S3MultiStorageServer` serves several
+// of them, each under its own key prefix.
 package http
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,6 +29,16 @@ const (
 	storageLockTimeout           = 2 * time.Second
 	defaultListPageSize          = 10000
 	defaultListInactivityTimeout = 60 * time.Second
+	// An append-only server records every head it replaced in the control
+	// files `conf/<headLogPrefix><first byte of the revision id>`, each
+	// holding the concatenated revision ids.
+	headLogPrefix = "append-only-head-log-"
+	// The control file in `lib.ControlFileSectionConf` with the number of
+	// bytes stored in blocks if `MaxSize` is set.
+	quotaUsageFile = "quota-usage"
+	// How often the number of bytes stored in blocks is written to
+	// `quotaUsageFile` while blocks are written, see `SaveUsedSize`.
+	quotaUsageSaveInterval = 10 * time.Second
 )
 
 type S3StorageServer struct {
@@ -33,10 +48,46 @@ type S3StorageServer struct {
 	SecretAccessKey       string
 	ListPageSize          int
 	ListInactivityTimeout time.Duration
+	// Reject all requests that would modify the storage as well as all
+	// lock requests.
+	ReadOnly bool
+	// Reject overwriting blocks, the repository config, and the control files
+	// in `refs` and `security`, deleting control files, and moving `head`
+	// back to a revision it pointed to before, so that a compromised client
+	// cannot destroy what was committed. Locks can still be released.
+	AppendOnly bool
+	// Reject writing new blocks with `507 Insufficient Storage` once the
+	// blocks take up more than this many bytes, 0 means no limit. Only the
+	// blocks written through the server are counted, except for the first
+	// time a limit is set, when the existing blocks are counted, too. The
+	// count is kept in memory and written to the storage every
+	// `quotaUsageSaveInterval` and by `SaveUsedSize`, a crash forgets the
+	// blocks written since.
+	MaxSize int64
+	// If set, all keys must start with `<Prefix>/` (see `S3MultiStorageServer`).
+	Prefix string
+	// The path the server is mounted at by a reverse proxy, e.g. `/cling`.
+	// Requests are accepted with and without it, i.e. it does not matter
+	// whether the proxy strips it.
+	BasePath string
 
 	locksMutex sync.Mutex
 	locks      map[string]*serverLock
 
+	// Serializes the checks and writes of `head` if `AppendOnly` is set.
+	headMu sync.Mutex
+
+	quotaMu sync.Mutex
+	// The bytes stored in blocks, -1 until `UsedSize` read them.
+	usedSize int64
+	// The bytes stored in blocks last written to `quotaUsageFile` and when.
+	savedUsedSize   int64
+	usedSizeSavedAt time.Time
+
+	// Set by `Metrics.Add`.
+	metrics           *Metrics
+	metricsRepository string
+
 	// Only one block-id listing runs at a time.
 	listMu      sync.Mutex
 	listSession *listSession
@@ -57,10 +108,12 @@ type serverLock struct {
 
 func NewS3StorageServer(storage lib.Storage, region, accessKeyID, secretAccessKey string) *S3StorageServer {
 	return &S3StorageServer{
-		Storage: storage, Region: region,
+		Storage: storage, Region: region, ReadOnly: false, AppendOnly: false, MaxSize: 0, Prefix: "", BasePath: "",
 		AccessKeyID: accessKeyID, SecretAccessKey: secretAccessKey,
 		ListPageSize: defaultListPageSize, ListInactivityTimeout: defaultListInactivityTimeout,
-		locksMutex: sync.Mutex{}, locks: map[string]*serverLock{},
+		locksMutex: sync.Mutex{}, locks: map[string]*serverLock{}, headMu: sync.Mutex{},
+		quotaMu: sync.Mutex{}, usedSize: -1, savedUsedSize: -1, usedSizeSavedAt: time.Time{},
+		metrics: nil, metricsRepository: "",
 		listMu: sync.Mutex{}, listSession: nil,
 	}
 }
@@ -70,18 +123,64 @@ func (s *S3StorageServer) RegisterRoutes(mux *http.ServeMux) {
 }
 
 func (s *S3StorageServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.metrics != nil {
+		start := time.Now()
+		key := routeKey{s.metricsRepository, s.routeLabel(r), r.Method}
+		rw := &responseWriter{w, 0, 0}
+		w = rw
+		defer func() {
+			status := cmp.Or(rw.statusCode, http.StatusOK)
+			s.metrics.observeRequest(key, status, time.Since(start), int(max(r.ContentLength, 0)), rw.size)
+		}()
+	}
 	body, err := s.readBody(w, r)
 	if err != nil {
 		s.writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
 		return
 	}
-	if err := VerifySigV4(r, body, s.Region, s.AccessKeyID, s.SecretAccessKey, time.Now().UTC()); err != nil {
+	// The client signed the path including the base path.
+	path, stripped := cutBasePath(s.BasePath, r.URL.Path)
+	signed := r
+	if !stripped && s.BasePath != "" {
+		signed = r.Clone(r.Context())
+		signed.URL.Path = normalizeBasePath(s.BasePath) + path
+		signed.URL.RawPath = ""
+	}
+	if err := VerifySigV4(signed, body, s.Region, s.AccessKeyID, s.SecretAccessKey, time.Now().UTC()); err != nil {
 		s.writeError(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
 		return
 	}
+	r.URL.Path = path
+	r.URL.RawPath = ""
 	s.route(w, r, body)
 }
 
+// cutBasePath removes `basePath` from the start of `path`. `found` is false
+// if `path` does not start with it, i.e. if a reverse proxy already removed
+// it.
+func cutBasePath(basePath, path string) (string, bool) {
+	basePath = normalizeBasePath(basePath)
+	if basePath == "" {
+		return path, false
+	}
+	if path == basePath {
+		return "/", true
+	}
+	if rest, ok := strings.CutPrefix(path, basePath+"/"); ok {
+		return "/" + rest, true
+	}
+	return path, false
+}
+
+// Return `/<path>` without a trailing slash or "" for the root.
+func normalizeBasePath(basePath string) string {
+	basePath = strings.Trim(basePath, "/")
+	if basePath == "" {
+		return ""
+	}
+	return "/" + basePath
+}
+
 func (s *S3StorageServer) readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 	if r.Body == nil || r.ContentLength == 0 {
 		return nil, nil
@@ -104,6 +203,11 @@ func (s *S3StorageServer) route(w http.ResponseWriter, r *http.Request, body []b
 			s.writeError(w, http.StatusForbidden, "AccessDenied", "only LIST V2 allowed on bucket root")
 			return
 		}
+		prefix := r.URL.Query().Get("prefix")
+		if strings.Contains(prefix, "..") || (s.Prefix != "" && !strings.HasPrefix(prefix, s.Prefix+"/")) {
+			s.writeError(w, http.StatusForbidden, "AccessDenied", "prefix outside of the repository")
+			return
+		}
 		s.handleList(w, r)
 		return
 	}
@@ -111,9 +215,34 @@ func (s *S3StorageServer) route(w http.ResponseWriter, r *http.Request, body []b
 		s.writeError(w, http.StatusForbidden, "AccessDenied", "invalid key")
 		return
 	}
+	if s.Prefix != "" {
+		rest, ok := strings.CutPrefix(keyPart, s.Prefix+"/")
+		if !ok {
+			s.writeError(w, http.StatusForbidden, "AccessDenied", "key outside of the repository")
+			return
+		}
+		keyPart = rest
+	}
+	if s.ReadOnly && !isHasBlocksRequest(r, keyPart) &&
+		((r.Method != http.MethodGet && r.Method != http.MethodHead) || strings.HasPrefix(keyPart, "locks/")) {
+		s.writeError(w, http.StatusForbidden, "AccessDenied", "the server is read-only")
+		return
+	}
+	if isServerControlFile(keyPart) && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		s.writeError(w, http.StatusForbidden, "AccessDenied", "the control file is written by the server")
+		return
+	}
+	if s.AppendOnly && isAppendOnlyViolation(r, keyPart) {
+		s.writeError(w, http.StatusForbidden, "AccessDenied", "the server is append-only")
+		return
+	}
 	switch {
 	case keyPart == "repository.txt":
 		s.handleConfig(w, r, body)
+	case isHasBlocksRequest(r, keyPart):
+		s.handleHasBlocks(w, r, body)
+	case keyPart == "blocks" && r.Method == http.MethodPost && r.URL.RawQuery == "":
+		s.handleWriteBlocks(w, r, body)
 	case strings.HasPrefix(keyPart, "blocks/"):
 		rest := strings.TrimPrefix(keyPart, "blocks/")
 		if len(rest) != 2*lib.BlockIdSize {
@@ -132,6 +261,10 @@ func (s *S3StorageServer) route(w http.ResponseWriter, r *http.Request, body []b
 		s.handleControlRoute(w, r, lib.ControlFileSectionSecurity, strings.TrimPrefix(keyPart, "security/"), body)
 	case strings.HasPrefix(keyPart, "conf/"):
 		s.handleControlRoute(w, r, lib.ControlFileSectionConf, strings.TrimPrefix(keyPart, "conf/"), body)
+	case strings.HasPrefix(keyPart, "lost-found/"):
+		s.handleControlRoute(w, r, lib.ControlFileSectionLostFound, strings.TrimPrefix(keyPart, "lost-found/"), body)
+	case strings.HasPrefix(keyPart, "files/"):
+		s.handleControlRoute(w, r, lib.ControlFileSectionFiles, strings.TrimPrefix(keyPart, "files/"), body)
 	case strings.HasPrefix(keyPart, "locks/"):
 		rest := strings.TrimPrefix(keyPart, "locks/")
 		if err := lib.ValidateStorageLockName(rest); err != nil {
@@ -144,6 +277,30 @@ func (s *S3StorageServer) route(w http.ResponseWriter, r *http.Request, body []b
 	}
 }
 
+// The control files the server keeps for itself, clients can only read them.
+func isServerControlFile(keyPart string) bool {
+	return strings.HasPrefix(keyPart, "conf/"+headLogPrefix) || keyPart == "conf/"+quotaUsageFile
+}
+
+// `POST blocks?has` checks the existence of many blocks at once. It only
+// reads, so it is allowed on a read-only server.
+func isHasBlocksRequest(r *http.Request, keyPart string) bool {
+	return keyPart == "blocks" && r.Method == http.MethodPost && r.URL.Query().Has("has")
+}
+
+// Blocks and the repository config must be written with `If-None-Match: *`,
+// i.e. never overwritten, and control files must not be deleted. Overwriting
+// control files is checked in `handleControl`.
+func isAppendOnlyViolation(r *http.Request, keyPart string) bool {
+	switch {
+	case strings.HasPrefix(keyPart, "blocks/"), keyPart == "repository.txt":
+		return r.Method == http.MethodPut && r.Header.Get("If-None-Match") != "*"
+	case strings.HasPrefix(keyPart, "locks/"):
+		return false
+	}
+	return r.Method == http.MethodDelete
+}
+
 func (s *S3StorageServer) handleControlRoute(
 	w http.ResponseWriter, r *http.Request, section lib.ControlFileSection, name string, body []byte,
 ) {
@@ -158,7 +315,21 @@ func (s *S3StorageServer) handleControlRoute(
 func (s *S3StorageServer) handleList(w http.ResponseWriter, r *http.Request) {
 	wantPrefix := r.URL.Query().Get("prefix")
 	token := r.URL.Query().Get("continuation-token")
-	// Only the blocks/ namespace is enumerable. Other prefixes return empty.
+	for _, section := range []lib.ControlFileSection{
+		lib.ControlFileSectionRefs, lib.ControlFileSectionSecurity, lib.ControlFileSectionConf,
+		lib.ControlFileSectionLostFound, lib.ControlFileSectionFiles,
+	} {
+		if strings.HasSuffix(wantPrefix, string(section)+"/") {
+			s.handleControlList(w, r, wantPrefix, section)
+			return
+		}
+	}
+	if wantPrefix == "locks/" || strings.HasSuffix(wantPrefix, "/locks/") {
+		s.handleLockList(w, wantPrefix)
+		return
+	}
+	// Besides the control file sections and locks, only the blocks/
+	// namespace is enumerable. Other prefixes return empty.
 	if !strings.HasSuffix(wantPrefix, "blocks/") {
 		s.writeListResult(w, wantPrefix, nil, false, "")
 		return
@@ -238,6 +409,37 @@ func (s *S3StorageServer) handleList(w http.ResponseWriter, r *http.Request) {
 	s.writeListResult(w, wantPrefix, keys, true, sess.id)
 }
 
+// Control file sections are small, so they are listed in a single page.
+func (s *S3StorageServer) handleControlList(
+	w http.ResponseWriter, r *http.Request, prefix string, section lib.ControlFileSection,
+) {
+	names, err := s.Storage.ListControlFiles(r.Context(), section)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = prefix + name
+	}
+	s.writeListResult(w, prefix, keys, false, "")
+}
+
+// handleLockList lists the locks held through this server.
+func (s *S3StorageServer) handleLockList(w http.ResponseWriter, prefix string) {
+	keys := []string{}
+	s.locksMutex.Lock()
+	for name, lk := range s.locks {
+		// Locks that are still being acquired have no body yet.
+		if lk.body != nil {
+			keys = append(keys, prefix+name)
+		}
+	}
+	s.locksMutex.Unlock()
+	slices.Sort(keys)
+	s.writeListResult(w, prefix, keys, false, "")
+}
+
 func (s *S3StorageServer) writeListResult(
 	w http.ResponseWriter, prefix string, keys []string, isTruncated bool, nextToken string,
 ) {
@@ -310,6 +512,20 @@ func (s *S3StorageServer) handleConfig(w http.ResponseWriter, r *http.Request, b
 			s.writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
 			return
 		}
+		if r.Header.Get("If-None-Match") != "*" {
+			// An unconditional PUT replaces the config of an existing storage.
+			err := s.Storage.WriteConfig(r.Context(), toml, "")
+			if errors.Is(err, lib.ErrStorageNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				s.internalError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
 		if err := s.Storage.Init(r.Context(), toml, ""); err != nil {
 			if errors.Is(err, lib.ErrStorageAlreadyExists) {
 				// Match the conditional-PUT contract: client sends
@@ -350,13 +566,25 @@ func (s *S3StorageServer) handleBlock(w http.ResponseWriter, r *http.Request, id
 			s.internalError(w, err)
 			return
 		}
+		if r.Header.Get("Range") != "" {
+			// Clients that only need the start of a block, e.g. its header,
+			// do not have to download all of it. The block is still read
+			// from the storage as a whole.
+			w.Header().Set("Content-Type", "application/octet-stream")
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+			return
+		}
 		writeBody(w, "application/octet-stream", data)
 	case http.MethodPut:
 		if len(body) > lib.MaxBlockSize {
 			s.writeError(w, http.StatusRequestEntityTooLarge, "EntityTooLarge", "block too large")
 			return
 		}
-		existed, err := s.Storage.WriteBlock(r.Context(), id, body)
+		existed, err := s.writeBlock(r.Context(), id, body)
+		if errors.Is(err, lib.ErrQuotaExceeded) {
+			s.writeError(w, http.StatusInsufficientStorage, "QuotaExceeded", err.Error())
+			return
+		}
 		if err != nil {
 			s.internalError(w, err)
 			return
@@ -376,6 +604,195 @@ func (s *S3StorageServer) handleBlock(w http.ResponseWriter, r *http.Request, id
 	}
 }
 
+// handleHasBlocks answers a `POST blocks?has` request. The body is the
+// concatenated block ids, the response is a bitmap (see `encodeBitmap`) with
+// the bits of the existing blocks set.
+func (s *S3StorageServer) handleHasBlocks(w http.ResponseWriter, r *http.Request, body []byte) {
+	if len(body)%lib.BlockIdSize != 0 {
+		s.writeError(w, http.StatusBadRequest, "InvalidRequest", "the body must be a list of block ids")
+		return
+	}
+	blockIds := make([]lib.BlockId, len(body)/lib.BlockIdSize)
+	for i := range blockIds {
+		blockIds[i] = lib.BlockId(body[i*lib.BlockIdSize : (i+1)*lib.BlockIdSize])
+	}
+	exists, err := lib.HasBlocks(r.Context(), s.Storage, blockIds)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	writeBody(w, "application/octet-stream", encodeBitmap(exists))
+}
+
+// handleWriteBlocks answers a `POST blocks` request, which uploads many
+// blocks at once. The body is a list of frames (see `appendBlockFrame`), the
+// response is a bitmap with the bits of the blocks that existed already set.
+// Existing blocks are never overwritten, so this is fine for an append-only
+// server.
+func (s *S3StorageServer) handleWriteBlocks(w http.ResponseWriter, r *http.Request, body []byte) {
+	var existed []bool
+	for len(body) > 0 {
+		blockId, data, rest, err := cutBlockFrame(body)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+			return
+		}
+		body = rest
+		ok, err := s.writeBlock(r.Context(), blockId, data)
+		if errors.Is(err, lib.ErrQuotaExceeded) {
+			s.writeError(w, http.StatusInsufficientStorage, "QuotaExceeded", err.Error())
+			return
+		}
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+		existed = append(existed, ok)
+	}
+	writeBody(w, "application/octet-stream", encodeBitmap(existed))
+}
+
+func (s *S3StorageServer) writeBlock(ctx context.Context, id lib.BlockId, data []byte) (bool, error) {
+	if s.MaxSize > 0 {
+		return s.writeBlockWithinQuota(ctx, id, data)
+	}
+	return s.Storage.WriteBlock(ctx, id, data) //nolint:wrapcheck
+}
+
+// writeBlockWithinQuota writes the block if it exists already or if it fits
+// into `MaxSize`. Return `lib.ErrQuotaExceeded` otherwise.
+func (s *S3StorageServer) writeBlockWithinQuota(ctx context.Context, id lib.BlockId, data []byte) (bool, error) {
+	exists, err := s.Storage.HasBlock(ctx, id)
+	if err != nil {
+		return false, err //nolint:wrapcheck
+	}
+	if exists {
+		return true, nil
+	}
+	// Reserve the space before writing, so that concurrent writes cannot
+	// exceed the quota together.
+	if err := s.addUsedSize(ctx, int64(len(data)), true); err != nil {
+		return false, err
+	}
+	existed, err := s.Storage.WriteBlock(ctx, id, data)
+	if err != nil || existed {
+		if err := s.addUsedSize(ctx, -int64(len(data)), false); err != nil {
+			slog.Error("Failed to release the quota of a block", "error", err, "block", id)
+		}
+	}
+	return existed, err //nolint:wrapcheck
+}
+
+// UsedSize returns the bytes stored in blocks as counted for `MaxSize`. The
+// first call sums up the sizes of all blocks if the storage has no count
+// yet.
+func (s *S3StorageServer) UsedSize(ctx context.Context) (int64, error) {
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+	if err := s.loadUsedSize(ctx); err != nil {
+		return 0, err
+	}
+	return s.usedSize, nil
+}
+
+func (s *S3StorageServer) addUsedSize(ctx context.Context, delta int64, checkQuota bool) error {
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+	if err := s.loadUsedSize(ctx); err != nil {
+		return err
+	}
+	if checkQuota && s.usedSize+delta > s.MaxSize {
+		return lib.WrapErrorf(lib.ErrQuotaExceeded, "%d of %d bytes used", s.usedSize, s.MaxSize)
+	}
+	s.usedSize += delta
+	if time.Since(s.usedSizeSavedAt) >= quotaUsageSaveInterval {
+		// The block is written nonetheless, `SaveUsedSize` tries again.
+		if err := s.saveUsedSize(ctx); err != nil {
+			slog.Error("Failed to save the quota usage", "error", err)
+		}
+	}
+	return nil
+}
+
+// SaveUsedSize writes the bytes stored in blocks to the storage unless they
+// did not change since they were written last. Writing blocks only saves
+// them every `quotaUsageSaveInterval`, so call this before the server stops.
+func (s *S3StorageServer) SaveUsedSize(ctx context.Context) error {
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+	if s.usedSize < 0 || s.usedSize == s.savedUsedSize {
+		return nil
+	}
+	return s.saveUsedSize(ctx)
+}
+
+// Must be called with `quotaMu` held.
+func (s *S3StorageServer) saveUsedSize(ctx context.Context) error {
+	data := []byte(strconv.FormatInt(s.usedSize, 10))
+	if err := s.Storage.WriteControlFile(ctx, lib.ControlFileSectionConf, quotaUsageFile, data); err != nil {
+		return lib.WrapErrorf(err, "failed to write quota usage")
+	}
+	s.savedUsedSize = s.usedSize
+	s.usedSizeSavedAt = time.Now()
+	return nil
+}
+
+// Must be called with `quotaMu` held.
+func (s *S3StorageServer) loadUsedSize(ctx context.Context) error {
+	if s.usedSize >= 0 {
+		return nil
+	}
+	data, err := s.Storage.ReadControlFile(ctx, lib.ControlFileSectionConf, quotaUsageFile)
+	if err == nil {
+		used, err := strconv.ParseInt(string(data), 10, 64)
+		if err != nil {
+			return lib.WrapErrorf(err, "invalid quota usage %q", data)
+		}
+		s.usedSize = used
+		s.savedUsedSize = used
+		s.usedSizeSavedAt = time.Now()
+		return nil
+	}
+	if !errors.Is(err, lib.ErrControlFileNotFound) {
+		return lib.WrapErrorf(err, "failed to read quota usage")
+	}
+	used, err := storedBlockSize(ctx, s.Storage)
+	if err != nil {
+		return err
+	}
+	s.usedSize = used
+	return s.saveUsedSize(ctx)
+}
+
+// Sum up the sizes of all blocks in `storage`.
+func storedBlockSize(ctx context.Context, storage lib.Storage) (int64, error) {
+	sizer, canSize := storage.(lib.BlockSizer)
+	buf := lib.NewBlockBuf()
+	var (
+		total   int64
+		sizeErr error
+	)
+	err := storage.ReadBlockIds(ctx, func(blockId lib.BlockId) bool {
+		if canSize {
+			size, err := sizer.BlockSize(ctx, blockId)
+			sizeErr = err
+			total += size
+		} else {
+			data, err := storage.ReadBlock(ctx, blockId, buf)
+			sizeErr = err
+			total += int64(len(data))
+		}
+		return sizeErr == nil
+	})
+	if err == nil {
+		err = sizeErr
+	}
+	if err != nil {
+		return 0, lib.WrapErrorf(err, "failed to sum up the block sizes")
+	}
+	return total, nil
+}
+
 func (s *S3StorageServer) handleControl(
 	w http.ResponseWriter, r *http.Request, section lib.ControlFileSection, name string, body []byte,
 ) {
@@ -401,13 +818,48 @@ func (s *S3StorageServer) handleControl(
 			s.internalError(w, err)
 			return
 		}
+		w.Header().Set("ETag", controlFileETag(data))
 		writeBody(w, "application/octet-stream", data)
 	case http.MethodPut:
 		if len(body) > lib.MaxControlFileSize {
 			s.writeError(w, http.StatusRequestEntityTooLarge, "EntityTooLarge", "control file too large")
 			return
 		}
-		if err := s.Storage.WriteControlFile(r.Context(), section, name, body); err != nil {
+		createOnly := false
+		if s.AppendOnly && section == lib.ControlFileSectionRefs && name == "head" {
+			s.headMu.Lock()
+			defer s.headMu.Unlock()
+			if err := s.checkHeadMove(r.Context(), body); err != nil {
+				s.writeError(w, http.StatusForbidden, "AccessDenied", err.Error())
+				return
+			}
+		} else if s.AppendOnly && isAppendOnlyControlSection(section) && r.Header.Get("If-None-Match") != "*" {
+			if r.Header.Get("If-Match") != "" {
+				s.writeError(w, http.StatusForbidden, "AccessDenied", "the server is append-only")
+				return
+			}
+			createOnly = true
+		}
+		var err error
+		switch {
+		case createOnly:
+			err = s.createControlFile(r.Context(), section, name, body)
+			if errors.Is(err, lib.ErrControlFileChanged) {
+				s.writeError(w, http.StatusForbidden, "AccessDenied", "the server is append-only")
+				return
+			}
+		case r.Header.Get("If-None-Match") == "*":
+			err = s.Storage.CompareAndSwapControlFile(r.Context(), section, name, nil, body)
+		case r.Header.Get("If-Match") != "":
+			err = s.compareAndSwapControlFile(r.Context(), section, name, r.Header.Get("If-Match"), body)
+		default:
+			err = s.Storage.WriteControlFile(r.Context(), section, name, body)
+		}
+		if errors.Is(err, lib.ErrControlFileChanged) {
+			s.writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", err.Error())
+			return
+		}
+		if err != nil {
 			s.internalError(w, err)
 			return
 		}
@@ -427,6 +879,120 @@ func (s *S3StorageServer) handleControl(
 	}
 }
 
+// The sections whose control files an append-only server never overwrites:
+// the references (tags), the encrypted copies of the repository config and
+// the buckets of the file index (new entries are only added to new buckets
+// then). `head` is checked by `checkHeadMove` instead.
+func isAppendOnlyControlSection(section lib.ControlFileSection) bool {
+	return section == lib.ControlFileSectionRefs || section == lib.ControlFileSectionSecurity ||
+		section == lib.ControlFileSectionFiles
+}
+
+// createControlFile writes the control file only if it does not exist or
+// already has the same content, so that a retried write still succeeds.
+// Return `lib.ErrControlFileChanged` otherwise.
+func (s *S3StorageServer) createControlFile(
+	ctx context.Context, section lib.ControlFileSection, name string, data []byte,
+) error {
+	err := s.Storage.CompareAndSwapControlFile(ctx, section, name, nil, data)
+	if !errors.Is(err, lib.ErrControlFileChanged) {
+		return err //nolint:wrapcheck
+	}
+	current, readErr := s.Storage.ReadControlFile(ctx, section, name)
+	if readErr == nil && bytes.Equal(current, data) {
+		return nil
+	}
+	return err //nolint:wrapcheck
+}
+
+// compareAndSwapControlFile writes the control file only if the ETag of its
+// current content is `etag`. Passing the content that was just read to the
+// storage's compare-and-swap makes this atomic.
+func (s *S3StorageServer) compareAndSwapControlFile(
+	ctx context.Context, section lib.ControlFileSection, name, etag string, data []byte,
+) error {
+	current, err := s.Storage.ReadControlFile(ctx, section, name)
+	if errors.Is(err, lib.ErrControlFileNotFound) {
+		return lib.WrapErrorf(lib.ErrControlFileChanged, "control file %s/%s does not exist", section, name)
+	}
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	if controlFileETag(current) != etag {
+		return lib.WrapErrorf(lib.ErrControlFileChanged, "control file %s/%s has a different ETag", section, name)
+	}
+	return s.Storage.CompareAndSwapControlFile(ctx, section, name, current, data) //nolint:wrapcheck
+}
+
+// checkHeadMove rejects moving `head` to `data` if `head` pointed to it
+// before and records the current head in the head log otherwise. The server
+// cannot decrypt the revisions to follow their parents, so only the heads it
+// replaced itself are known to be older.
+func (s *S3StorageServer) checkHeadMove(ctx context.Context, data []byte) error {
+	newHead, err := hex.DecodeString(string(data))
+	if err != nil || len(newHead) != lib.BlockIdSize {
+		return lib.Errorf("invalid head %q", data)
+	}
+	current, err := s.Storage.ReadControlFile(ctx, lib.ControlFileSectionRefs, "head")
+	if errors.Is(err, lib.ErrControlFileNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	if bytes.Equal(current, data) {
+		return nil
+	}
+	known, err := s.readHeadLog(ctx, newHead)
+	if err != nil {
+		return err
+	}
+	if containsRevisionId(known, newHead) {
+		return lib.Errorf("the head must not be moved back to %s", data)
+	}
+	currentHead, err := hex.DecodeString(string(current))
+	if err != nil || len(currentHead) != lib.BlockIdSize {
+		// A corrupt head is not worth remembering.
+		return nil //nolint:nilerr
+	}
+	log, err := s.readHeadLog(ctx, currentHead)
+	if err != nil {
+		return err
+	}
+	if containsRevisionId(log, currentHead) {
+		return nil
+	}
+	log = append(log, currentHead...)
+	if err := s.Storage.WriteControlFile(ctx, lib.ControlFileSectionConf, headLogName(currentHead), log); err != nil {
+		return lib.WrapErrorf(err, "failed to write head log")
+	}
+	return nil
+}
+
+func (s *S3StorageServer) readHeadLog(ctx context.Context, revisionId []byte) ([]byte, error) {
+	data, err := s.Storage.ReadControlFile(ctx, lib.ControlFileSectionConf, headLogName(revisionId))
+	if errors.Is(err, lib.ErrControlFileNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read head log")
+	}
+	return data, nil
+}
+
+func headLogName(revisionId []byte) string {
+	return fmt.Sprintf("%s%02x", headLogPrefix, revisionId[0])
+}
+
+func containsRevisionId(log, revisionId []byte) bool {
+	for i := 0; i+len(revisionId) <= len(log); i += len(revisionId) {
+		if bytes.Equal(log[i:i+len(revisionId)], revisionId) {
+			return true
+		}
+	}
+	return false
+}
+
 //nolint:funlen
 func (s *S3StorageServer) handleLock(w http.ResponseWriter, r *http.Request, name string, body []byte) {
 	switch r.Method {
@@ -460,6 +1026,7 @@ func (s *S3StorageServer) handleLock(w http.ResponseWriter, r *http.Request, nam
 		s.locksMutex.Lock()
 		if _, exists := s.locks[name]; exists {
 			s.locksMutex.Unlock()
+			s.observeLockContention(r, name)
 			s.writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "lock held")
 			return
 		}
@@ -475,12 +1042,14 @@ func (s *S3StorageServer) handleLock(w http.ResponseWriter, r *http.Request, nam
 			s.locksMutex.Lock()
 			delete(s.locks, name)
 			s.locksMutex.Unlock()
+			s.observeLockContention(r, name)
 			s.writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "local flock contention: "+err.Error())
 			return
 		}
 		s.locksMutex.Lock()
 		s.locks[name] = &serverLock{body: body, unlock: unlock}
 		s.locksMutex.Unlock()
+		slog.Debug("Lock acquired by client", "name", name, "remote", r.RemoteAddr)
 		w.WriteHeader(http.StatusCreated)
 	case http.MethodDelete:
 		s.locksMutex.Lock()
@@ -498,12 +1067,20 @@ func (s *S3StorageServer) handleLock(w http.ResponseWriter, r *http.Request, nam
 				slog.Error("Failed to release flock on lock DELETE", "error", err, "name", name) //nolint:gosec
 			}
 		}
+		slog.Debug("Lock released by client", "name", name, "remote", r.RemoteAddr)
 		w.WriteHeader(http.StatusOK)
 	default:
 		s.writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed")
 	}
 }
 
+func (s *S3StorageServer) observeLockContention(r *http.Request, name string) {
+	slog.Debug("Lock requested by client is held", "name", name, "remote", r.RemoteAddr)
+	if s.metrics != nil {
+		s.metrics.observeLockContention(s.metricsRepository)
+	}
+}
+
 func writeBody(w http.ResponseWriter, contentType string, data []byte) {
 	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
@@ -516,6 +1093,10 @@ func (s *S3StorageServer) internalError(w http.ResponseWriter, err error) {
 }
 
 func (s *S3StorageServer) writeError(w http.ResponseWriter, status int, code, message string) {
+	writeS3Error(w, status, code, message)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code, message string) {
 	w.Header().Set("Content-Type", "application/xml")
 	w.WriteHeader(status)
 	type s3Error struct {
@@ -5,11 +5,18 @@ package http
 import (
 	"bytes"
 	"context"
+	"crypto/md5" //nolint:gosec
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
+	"log/slog"
 	"maps"
 	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -24,13 +31,27 @@ const (
 	methodGet    = "GET"
 	methodHead   = "HEAD"
 	methodPut    = "PUT"
+	methodPost   = "POST"
 	methodDelete = "DELETE"
 
-	statusOK                 = 200
-	statusCreated            = 201
-	statusNoContent          = 204
-	statusNotFound           = 404
-	statusPreconditionFailed = 412
+	statusOK                  = 200
+	statusCreated             = 201
+	statusNoContent           = 204
+	statusPartialContent      = 206
+	statusUnauthorized        = 401
+	statusForbidden           = 403
+	statusNotFound            = 404
+	statusConflict            = 409
+	statusPreconditionFailed  = 412
+	statusRangeNotSatisfiable = 416
+	statusTooManyRequests     = 429
+
+	statusInternalServerError = 500
+	statusBadGateway          = 502
+	statusServiceUnavailable  = 503
+	statusGatewayTimeout      = 504
+	// Sent by `cling-sync serve` if the quota of the repository is exceeded.
+	statusInsufficientStorage = 507
 )
 
 type HTTPClient interface {
@@ -44,6 +65,8 @@ type HTTPClient interface {
 }
 
 type S3StorageConfig struct {
+	// The bucket URL may have a path, e.g. if the server is mounted below
+	// a path by a reverse proxy. Keys and listings are relative to it.
 	BucketURL       string
 	Region          string
 	Prefix          string
@@ -51,18 +74,44 @@ type S3StorageConfig struct {
 	SecretAccessKey []byte
 }
 
+// RetryPolicy says how `S3StorageClient` retries a request that failed with
+// a network error or because the server is (temporarily) unavailable. Only
+// requests that can be repeated without changing their outcome are retried,
+// i.e. not the conditional writes of locks and `CompareAndSwapControlFile`.
+type RetryPolicy struct {
+	// The number of attempts, 1 (or less) means no retries.
+	Attempts int
+	// The wait before the second attempt. It is doubled after every attempt
+	// up to `MaxBackoff`.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// The retry policy of new clients, about 8 seconds in total. The CLI sets
+// `Attempts` from its global flags.
+var DefaultRetryPolicy = RetryPolicy{5, 500 * time.Millisecond, 8 * time.Second} //nolint:gochecknoglobals
+
 type S3StorageClient struct {
 	cfg    S3StorageConfig
 	signer SigV4Signer
 	http   HTTPClient
+	retry  RetryPolicy
 
 	lockMu    sync.Mutex
 	lockState *s3LockState
+	// Set once the server did not understand `POST blocks?has`, e.g. because
+	// it is not `cling-sync serve`. `HasBlocks` falls back to `HasBlock`.
+	noHasBlocks atomic.Bool
+	// The same for `POST blocks` and `WriteBlocks`.
+	noWriteBlocks atomic.Bool
 }
 
 type s3LockState struct {
 	Name  string
 	Owner string
+	// Set once the lock was found missing or stolen. All further writes
+	// fail without asking the server again.
+	Lost error
 }
 
 type s3LockMeta struct {
@@ -74,6 +123,7 @@ type s3LockMeta struct {
 
 func NewS3StorageClient(cfg S3StorageConfig, httpClient HTTPClient) *S3StorageClient {
 	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	cfg.BucketURL = strings.TrimSuffix(cfg.BucketURL, "/")
 	return &S3StorageClient{
 		cfg: cfg,
 		signer: SigV4Signer{
@@ -81,9 +131,12 @@ func NewS3StorageClient(cfg S3StorageConfig, httpClient HTTPClient) *S3StorageCl
 			SecretAccessKey: string(cfg.SecretAccessKey),
 			Region:          cfg.Region,
 		},
-		http:      httpClient,
-		lockMu:    sync.Mutex{},
-		lockState: nil,
+		http:          httpClient,
+		retry:         DefaultRetryPolicy,
+		lockMu:        sync.Mutex{},
+		lockState:     nil,
+		noHasBlocks:   atomic.Bool{},
+		noWriteBlocks: atomic.Bool{},
 	}
 }
 
@@ -126,8 +179,30 @@ func (c *S3StorageClient) Init(ctx context.Context, config lib.Toml, headerComme
 	return nil
 }
 
+// WriteConfig overwrites repository.txt unconditionally. Plain S3 buckets
+// can't tell whether the storage was initialized, only cling-sync's own
+// server reports `ErrStorageNotFound` (as 404).
+func (c *S3StorageClient) WriteConfig(ctx context.Context, config lib.Toml, headerComment string) error {
+	var buf bytes.Buffer
+	if err := lib.WriteToml(&buf, headerComment, config); err != nil {
+		return lib.WrapErrorf(err, "failed to encode config TOML")
+	}
+	status, body, err := c.do(ctx, methodPut, c.key("repository.txt"), nil, buf.Bytes(), nil)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to write config")
+	}
+	switch status {
+	case statusOK, statusCreated:
+		return nil
+	case statusNotFound:
+		return lib.ErrStorageNotFound
+	default:
+		return lib.Errorf("write config failed: %d (%s)", status, truncateErrBody(body))
+	}
+}
+
 func (c *S3StorageClient) Open(ctx context.Context) (lib.Toml, error) {
-	status, body, err := c.do(ctx, methodGet, c.key("repository.txt"), nil, nil, nil)
+	status, body, err := c.doIdempotent(ctx, methodGet, c.key("repository.txt"), nil, nil, nil)
 	if err != nil {
 		return nil, lib.WrapErrorf(err, "failed to open storage")
 	}
@@ -145,7 +220,7 @@ func (c *S3StorageClient) Open(ctx context.Context) (lib.Toml, error) {
 }
 
 func (c *S3StorageClient) HasBlock(ctx context.Context, blockId lib.BlockId) (bool, error) {
-	status, _, err := c.do(ctx, methodHead, c.key("blocks", blockId.String()), nil, nil, nil)
+	status, _, err := c.doIdempotent(ctx, methodHead, c.key("blocks", blockId.String()), nil, nil, nil)
 	if err != nil {
 		return false, lib.WrapErrorf(err, "failed to check block")
 	}
@@ -158,8 +233,60 @@ func (c *S3StorageClient) HasBlock(ctx context.Context, blockId lib.BlockId) (bo
 	return false, lib.Errorf("unexpected status: %d", status)
 }
 
+// The number of block ids sent in one `POST blocks?has` request.
+const hasBlocksBatchSize = 10_000
+
+// HasBlocks checks the existence of the blocks in batches with
+// `POST blocks?has`, which only `cling-sync serve` understands. Other
+// servers are asked one block at a time.
+func (c *S3StorageClient) HasBlocks(ctx context.Context, blockIds []lib.BlockId) ([]bool, error) {
+	exists := make([]bool, 0, len(blockIds))
+	for batch := range slices.Chunk(blockIds, hasBlocksBatchSize) {
+		if !c.noHasBlocks.Load() {
+			batchExists, err := c.hasBlocksBatch(ctx, batch)
+			if err != nil {
+				return nil, err
+			}
+			if batchExists != nil {
+				exists = append(exists, batchExists...)
+				continue
+			}
+		}
+		for _, blockId := range batch {
+			ok, err := c.HasBlock(ctx, blockId)
+			if err != nil {
+				return nil, err
+			}
+			exists = append(exists, ok)
+		}
+	}
+	return exists, nil
+}
+
+// Return nil if the server does not support `POST blocks?has`.
+func (c *S3StorageClient) hasBlocksBatch(ctx context.Context, blockIds []lib.BlockId) ([]bool, error) {
+	body := make([]byte, 0, len(blockIds)*lib.BlockIdSize)
+	for _, blockId := range blockIds {
+		body = append(body, blockId[:]...)
+	}
+	status, respBody, err := c.doIdempotent(ctx, methodPost, c.key("blocks")+"?has", nil, body, nil)
+	if isUnsupported(status, err) {
+		// Real auth failures show up again with `HasBlock`.
+		slog.Debug("The server does not support checking many blocks at once", "status", status)
+		c.noHasBlocks.Store(true)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to check blocks")
+	}
+	if status != statusOK {
+		return nil, lib.Errorf("check blocks failed: %d (%s)", status, truncateErrBody(respBody))
+	}
+	return decodeBitmap(respBody, len(blockIds))
+}
+
 func (c *S3StorageClient) ReadBlock(ctx context.Context, blockId lib.BlockId, buf lib.BlockBuf) ([]byte, error) {
-	status, body, err := c.do(
+	status, body, err := c.doIdempotent(
 		ctx, methodGet, c.key("blocks", blockId.String()), nil, nil, buf.Bytes(),
 	)
 	if err != nil {
@@ -174,6 +301,37 @@ func (c *S3StorageClient) ReadBlock(ctx context.Context, blockId lib.BlockId, bu
 	return body, nil
 }
 
+// ReadBlockRange reads `length` bytes of the stored block starting at
+// `offset` with a Range request. Fewer bytes are returned if the block ends
+// before.
+func (c *S3StorageClient) ReadBlockRange(
+	ctx context.Context,
+	blockId lib.BlockId,
+	offset, length int,
+	buf lib.BlockBuf,
+) ([]byte, error) {
+	if offset < 0 || length <= 0 {
+		return nil, lib.Errorf("invalid range of block %s: offset %d, length %d", blockId, offset, length)
+	}
+	headers := map[string]string{"Range": "bytes=" + strconv.Itoa(offset) + "-" + strconv.Itoa(offset+length-1)}
+	status, body, err := c.doIdempotent(ctx, methodGet, c.key("blocks", blockId.String()), headers, nil, buf.Bytes())
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read block")
+	}
+	switch status {
+	case statusPartialContent:
+		return body, nil
+	case statusOK:
+		// The server ignored the range and sent the whole block.
+		return body[min(offset, len(body)):min(offset+length, len(body))], nil
+	case statusRangeNotSatisfiable:
+		return body[:0], nil
+	case statusNotFound:
+		return nil, lib.WrapErrorf(lib.ErrBlockNotFound, "block %s does not exist", blockId)
+	}
+	return nil, lib.Errorf("read block failed: %d", status)
+}
+
 func (c *S3StorageClient) WriteBlock(ctx context.Context, blockId lib.BlockId, data []byte) (bool, error) {
 	if len(data) > lib.MaxBlockSize {
 		return false, lib.Errorf("block %s is too large: %d", blockId, len(data))
@@ -181,7 +339,9 @@ func (c *S3StorageClient) WriteBlock(ctx context.Context, blockId lib.BlockId, d
 	if err := c.verifyLockIfHeld(ctx); err != nil {
 		return false, err
 	}
-	status, body, err := c.do(
+	// Blocks are content-addressed, so if the response to a write is lost,
+	// writing the block again is fine. It is reported as existing then.
+	status, body, err := c.doIdempotent(
 		ctx, methodPut, c.key("blocks", blockId.String()),
 		ifNoneMatch, data, nil,
 	)
@@ -193,12 +353,170 @@ func (c *S3StorageClient) WriteBlock(ctx context.Context, blockId lib.BlockId, d
 		return false, nil
 	case statusPreconditionFailed:
 		return true, nil
+	case statusInsufficientStorage:
+		return false, lib.WrapErrorf(lib.ErrQuotaExceeded, "failed to write block %s", blockId)
 	}
 	return false, lib.Errorf("write block failed: %d (%s)", status, truncateErrBody(body))
 }
 
+// WriteBlocks uploads the blocks in batches of up to `lib.MaxBlockSize`
+// bytes with `POST blocks`, which only `cling-sync serve` understands.
+// Blocks too large for a batch and all blocks sent to other servers are
+// written one at a time.
+func (c *S3StorageClient) WriteBlocks(ctx context.Context, blocks []lib.StoredBlock) ([]bool, error) {
+	existed := make([]bool, 0, len(blocks))
+	for len(blocks) > 0 {
+		n, size := 0, 0
+		for n < len(blocks) && size+blockFrameHeaderSize+len(blocks[n].Data) <= lib.MaxBlockSize {
+			size += blockFrameHeaderSize + len(blocks[n].Data)
+			n++
+		}
+		if n > 1 && !c.noWriteBlocks.Load() {
+			batchExisted, err := c.writeBlocksBatch(ctx, blocks[:n], size)
+			if err != nil {
+				return nil, err
+			}
+			if batchExisted != nil {
+				existed = append(existed, batchExisted...)
+				blocks = blocks[n:]
+				continue
+			}
+		}
+		ok, err := c.WriteBlock(ctx, blocks[0].BlockId, blocks[0].Data)
+		if err != nil {
+			return nil, err
+		}
+		existed = append(existed, ok)
+		blocks = blocks[1:]
+	}
+	return existed, nil
+}
+
+// Return nil if the server does not support `POST blocks`.
+func (c *S3StorageClient) writeBlocksBatch(ctx context.Context, blocks []lib.StoredBlock, size int) ([]bool, error) {
+	if err := c.verifyLockIfHeld(ctx); err != nil {
+		return nil, err
+	}
+	body := make([]byte, 0, size)
+	for _, block := range blocks {
+		body = appendBlockFrame(body, block.BlockId, block.Data)
+	}
+	// Like `WriteBlock`, writing the blocks again is fine.
+	status, respBody, err := c.doIdempotent(ctx, methodPost, c.key("blocks"), nil, body, nil)
+	if isUnsupported(status, err) {
+		slog.Debug("The server does not support writing many blocks at once", "status", status)
+		c.noWriteBlocks.Store(true)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to write blocks")
+	}
+	switch status {
+	case statusOK:
+		return decodeBitmap(respBody, len(blocks))
+	case statusInsufficientStorage:
+		return nil, lib.WrapErrorf(lib.ErrQuotaExceeded, "failed to write %d blocks", len(blocks))
+	}
+	return nil, lib.Errorf("write blocks failed: %d (%s)", status, truncateErrBody(respBody))
+}
+
+// Whether the response to a request `cling-sync serve` understands but
+// plain S3 services do not, e.g. `POST blocks?has`, says that the server
+// does not support it. Auth failures count, because S3 services reject
+// unknown requests with 403. If it was a real auth failure, the fallback
+// fails the same way.
+func isUnsupported(status int, err error) bool {
+	if err != nil {
+		return errors.Is(err, lib.ErrAuth)
+	}
+	return status != statusOK && status != statusInsufficientStorage && !isRetryable(status, nil)
+}
+
+// A frame of `POST blocks` is the block id, the big-endian uint32 length of
+// the data, and the data.
+const blockFrameHeaderSize = lib.BlockIdSize + 4
+
+func appendBlockFrame(b []byte, blockId lib.BlockId, data []byte) []byte {
+	b = append(b, blockId[:]...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data))) //nolint:gosec
+	return append(b, data...)
+}
+
+// cutBlockFrame returns the block id and data of the first frame in `b` and
+// the rest of `b`.
+func cutBlockFrame(b []byte) (lib.BlockId, []byte, []byte, error) {
+	if len(b) < blockFrameHeaderSize {
+		return lib.BlockId{}, nil, nil, lib.Errorf("truncated block frame header")
+	}
+	blockId := lib.BlockId(b[:lib.BlockIdSize])
+	n := int(binary.BigEndian.Uint32(b[lib.BlockIdSize:blockFrameHeaderSize]))
+	b = b[blockFrameHeaderSize:]
+	if n > len(b) {
+		return lib.BlockId{}, nil, nil, lib.Errorf("truncated data of block %s", blockId)
+	}
+	return blockId, b[:n], b[n:], nil
+}
+
+// The responses to `POST blocks?has` and `POST blocks` have bit `i % 8` of
+// byte `i / 8` set if the answer for the i-th block is yes.
+func encodeBitmap(bits []bool) []byte {
+	bitmap := make([]byte, (len(bits)+7)/8)
+	for i, ok := range bits {
+		if ok {
+			bitmap[i/8] |= 1 << (i % 8)
+		}
+	}
+	return bitmap
+}
+
+func decodeBitmap(bitmap []byte, n int) ([]bool, error) {
+	if len(bitmap) != (n+7)/8 {
+		return nil, lib.Errorf("invalid bitmap for %d blocks: %d bytes", n, len(bitmap))
+	}
+	bits := make([]bool, n)
+	for i := range bits {
+		bits[i] = bitmap[i/8]&(1<<(i%8)) != 0
+	}
+	return bits, nil
+}
+
 func (c *S3StorageClient) ReadBlockIds(ctx context.Context, yield func(lib.BlockId) bool) error {
 	prefix := c.key("blocks") + "/"
+	var keyErr error
+	err := c.list(ctx, prefix, func(key string) bool {
+		blockId, err := lib.NewBlockIdFromString(strings.TrimPrefix(key, prefix))
+		if err != nil {
+			keyErr = lib.WrapErrorf(err, "invalid block key %q", key)
+			return false
+		}
+		return yield(blockId)
+	})
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to list blocks")
+	}
+	return keyErr
+}
+
+func (c *S3StorageClient) ListControlFiles(ctx context.Context, section lib.ControlFileSection) ([]string, error) {
+	prefix := c.key(string(section)) + "/"
+	names := []string{}
+	err := c.list(ctx, prefix, func(key string) bool {
+		name := strings.TrimPrefix(key, prefix)
+		if lib.ValidateControlFileName(name) == nil {
+			names = append(names, name)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to list control files")
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// list pages through all keys starting with `prefix`. `yield` returns false
+// to stop early.
+func (c *S3StorageClient) list(ctx context.Context, prefix string, yield func(key string) bool) error {
 	continuation := ""
 	for {
 		query := url.Values{}
@@ -207,11 +525,11 @@ func (c *S3StorageClient) ReadBlockIds(ctx context.Context, yield func(lib.Block
 		if continuation != "" {
 			query.Set("continuation-token", continuation)
 		}
-		status, body, err := c.do(
+		status, body, err := c.doIdempotent(
 			ctx, methodGet, c.cfg.BucketURL+"/?"+query.Encode(), nil, nil, nil,
 		)
 		if err != nil {
-			return lib.WrapErrorf(err, "failed to list blocks")
+			return err
 		}
 		if status != statusOK {
 			return lib.Errorf("list failed: %d (%s)", status, truncateErrBody(body))
@@ -227,12 +545,7 @@ func (c *S3StorageClient) ReadBlockIds(ctx context.Context, yield func(lib.Block
 			return lib.WrapErrorf(err, "failed to parse list response")
 		}
 		for _, item := range result.Contents {
-			key := strings.TrimPrefix(item.Key, prefix)
-			blockId, err := lib.NewBlockIdFromString(key)
-			if err != nil {
-				return lib.WrapErrorf(err, "invalid block key %q", item.Key)
-			}
-			if !yield(blockId) {
+			if !yield(item.Key) {
 				return nil
 			}
 		}
@@ -256,7 +569,7 @@ func (c *S3StorageClient) HasControlFile(
 	if err := lib.ValidateControlFileName(name); err != nil {
 		return false, err //nolint:wrapcheck
 	}
-	status, _, err := c.do(ctx, methodHead, c.key(string(section), name), nil, nil, nil)
+	status, _, err := c.doIdempotent(ctx, methodHead, c.key(string(section), name), nil, nil, nil)
 	if err != nil {
 		return false, lib.WrapErrorf(err, "failed to check control file")
 	}
@@ -277,7 +590,7 @@ func (c *S3StorageClient) ReadControlFile(
 	if err := lib.ValidateControlFileName(name); err != nil {
 		return nil, err //nolint:wrapcheck
 	}
-	status, body, err := c.do(ctx, methodGet, c.key(string(section), name), nil, nil, nil)
+	status, body, err := c.doIdempotent(ctx, methodGet, c.key(string(section), name), nil, nil, nil)
 	if err != nil {
 		return nil, lib.WrapErrorf(err, "failed to read control file")
 	}
@@ -308,7 +621,7 @@ func (c *S3StorageClient) WriteControlFile(
 	if err := c.verifyLockIfHeld(ctx); err != nil {
 		return err
 	}
-	status, body, err := c.do(
+	status, body, err := c.doIdempotent(
 		ctx, methodPut, c.key(string(section), name), nil, data, nil,
 	)
 	if err != nil {
@@ -320,6 +633,44 @@ func (c *S3StorageClient) WriteControlFile(
 	return nil
 }
 
+// CompareAndSwapControlFile uses S3 conditional writes: `If-None-Match: *`
+// if the control file must not exist, `If-Match: <etag>` otherwise, where
+// the ETag is derived from `expected` (see `controlFileETag`).
+func (c *S3StorageClient) CompareAndSwapControlFile(
+	ctx context.Context,
+	section lib.ControlFileSection,
+	name string,
+	expected, data []byte,
+) error {
+	if err := lib.ValidateControlFileName(name); err != nil {
+		return err //nolint:wrapcheck
+	}
+	if len(data) > lib.MaxControlFileSize {
+		return lib.Errorf("control file %s/%s is too large: %d", section, name, len(data))
+	}
+	if err := c.verifyLockIfHeld(ctx); err != nil {
+		return err
+	}
+	headers := ifNoneMatch
+	if expected != nil {
+		headers = map[string]string{"If-Match": controlFileETag(expected)}
+	}
+	status, body, err := c.do(ctx, methodPut, c.key(string(section), name), headers, data, nil)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to write control file")
+	}
+	switch status {
+	case statusOK, statusCreated:
+		return nil
+	// S3 answers `If-Match` on a missing object with 404 and concurrent
+	// conditional writes with 409.
+	case statusPreconditionFailed, statusNotFound, statusConflict:
+		return lib.WrapErrorf(lib.ErrControlFileChanged, "control file %s/%s", section, name)
+	default:
+		return lib.Errorf("write control file failed: %d (%s)", status, truncateErrBody(body))
+	}
+}
+
 func (c *S3StorageClient) DeleteControlFile(ctx context.Context, section lib.ControlFileSection, name string) error {
 	if err := lib.ValidateControlFileName(name); err != nil {
 		return err //nolint:wrapcheck
@@ -366,6 +717,7 @@ func (c *S3StorageClient) Lock(ctx context.Context, name string) (func() error,
 		c.lockMu.Lock()
 		c.lockState = state
 		c.lockMu.Unlock()
+		slog.Debug("Acquired lock", "name", name, "owner", owner)
 		return c.releaseLock(state), nil //nolint:contextcheck
 	case statusPreconditionFailed:
 		existsErr, perr := c.readLockExistsErr(ctx, name)
@@ -402,19 +754,29 @@ func (c *S3StorageClient) ForceUnlock(ctx context.Context, name string) error {
 	return nil
 }
 
+// verifyLockIfHeld makes sure that the lock acquired by `Lock` is still
+// ours before anything is written.
+// Return `lib.ErrLockLost` if it was released or taken over by someone else.
 func (c *S3StorageClient) verifyLockIfHeld(ctx context.Context) error {
 	c.lockMu.Lock()
 	state := c.lockState
+	var lost error
+	if state != nil {
+		lost = state.Lost
+	}
 	c.lockMu.Unlock()
 	if state == nil {
 		return nil
 	}
+	if lost != nil {
+		return lost
+	}
 	status, body, err := c.do(ctx, methodGet, c.key("locks", state.Name), nil, nil, nil)
 	if err != nil {
 		return lib.WrapErrorf(err, "failed to verify lock %s", state.Name)
 	}
 	if status == statusNotFound {
-		return lib.Errorf("lock %s no longer exists (force-unlocked?)", state.Name)
+		return c.lockLost(state, "lock %s no longer exists (force-unlocked?)", state.Name)
 	}
 	if status != statusOK {
 		return lib.Errorf("verify lock %s failed: %d", state.Name, status)
@@ -424,26 +786,76 @@ func (c *S3StorageClient) verifyLockIfHeld(ctx context.Context) error {
 		return lib.WrapErrorf(err, "failed to parse lock meta")
 	}
 	if meta.Owner != state.Owner {
-		return lib.Errorf("lock %s was stolen (owner %s != %s)", state.Name, meta.Owner, state.Owner)
+		return c.lockLost(state, "lock %s was stolen (owner %s != %s)", state.Name, meta.Owner, state.Owner)
 	}
 	return nil
 }
 
+func (c *S3StorageClient) lockLost(state *s3LockState, format string, args ...any) error {
+	err := lib.WrapErrorf(lib.ErrLockLost, format, args...)
+	slog.Warn("Lost lock", "name", state.Name, "error", err)
+	c.lockMu.Lock()
+	state.Lost = err
+	c.lockMu.Unlock()
+	return err
+}
+
 func (c *S3StorageClient) readLockExistsErr(ctx context.Context, name string) (*lib.LockExistsError, error) {
-	status, body, err := c.do(ctx, methodGet, c.key("locks", name), nil, nil, nil)
+	info, err := c.readLockInfo(ctx, name)
 	if err != nil {
 		return nil, err
 	}
+	return &lib.LockExistsError{
+		Name: name, Owner: info.Owner, Host: info.Host, Pid: info.Pid, CreatedAt: info.CreatedAt,
+	}, nil
+}
+
+// Return `lib.ErrLockNotFound` if the lock is not held.
+func (c *S3StorageClient) readLockInfo(ctx context.Context, name string) (lib.LockInfo, error) {
+	status, body, err := c.do(ctx, methodGet, c.key("locks", name), nil, nil, nil)
+	if err != nil {
+		return lib.LockInfo{}, err
+	}
+	if status == statusNotFound {
+		return lib.LockInfo{}, lib.WrapErrorf(lib.ErrLockNotFound, "lock %s does not exist", name)
+	}
 	if status != statusOK {
-		return nil, lib.Errorf("read lock holder failed: %d", status)
+		return lib.LockInfo{}, lib.Errorf("read lock holder failed: %d", status)
 	}
 	var meta s3LockMeta
 	if err := json.Unmarshal(body, &meta); err != nil {
-		return nil, lib.WrapErrorf(err, "failed to parse lock meta")
+		return lib.LockInfo{}, lib.WrapErrorf(err, "failed to parse lock meta")
 	}
-	return &lib.LockExistsError{
-		Name: name, Owner: meta.Owner, Host: meta.Host, Pid: meta.Pid, CreatedAt: meta.CreatedAt,
-	}, nil
+	return lib.LockInfo{Name: name, Owner: meta.Owner, Host: meta.Host, Pid: meta.Pid, CreatedAt: meta.CreatedAt}, nil
+}
+
+func (c *S3StorageClient) ListLocks(ctx context.Context) ([]lib.LockInfo, error) {
+	prefix := c.key("locks") + "/"
+	names := []string{}
+	err := c.list(ctx, prefix, func(key string) bool {
+		name := strings.TrimPrefix(key, prefix)
+		if lib.ValidateStorageLockName(name) == nil {
+			names = append(names, name)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to list locks")
+	}
+	slices.Sort(names)
+	locks := []lib.LockInfo{}
+	for _, name := range names {
+		info, err := c.readLockInfo(ctx, name)
+		if errors.Is(err, lib.ErrLockNotFound) {
+			// Released in the meantime.
+			continue
+		}
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to read lock %s", name)
+		}
+		locks = append(locks, info)
+	}
+	return locks, nil
 }
 
 func (c *S3StorageClient) releaseLock(state *s3LockState) func() error {
@@ -467,6 +879,7 @@ func (c *S3StorageClient) releaseLock(state *s3LockState) func() error {
 		if status != statusOK && status != statusNoContent && status != statusNotFound {
 			return lib.Errorf("release lock %s failed: %d", state.Name, status)
 		}
+		slog.Debug("Released lock", "name", state.Name, "owner", state.Owner)
 		return nil
 	}
 }
@@ -493,13 +906,88 @@ func (c *S3StorageClient) do(
 	if err := c.signer.Sign(method, fullURL, headers, body, time.Now().UTC()); err != nil {
 		return 0, nil, err
 	}
+	t0 := time.Now()
 	status, respBody, err := c.http.Request(ctx, method, fullURL, headers, body, dst)
 	if err != nil {
+		slog.Debug("S3 request failed", "method", method, "key", keyOrURL, "duration", time.Since(t0), "error", err)
 		return status, respBody, lib.WrapErrorf(err, "HTTP transport failed")
 	}
+	slog.Debug(
+		"S3 request",
+		"method", method,
+		"key", keyOrURL,
+		"status", status,
+		"duration", time.Since(t0),
+		"request_size", len(body),
+		"response_size", len(respBody),
+	)
+	if status == statusUnauthorized || status == statusForbidden {
+		return status, respBody, lib.WrapErrorKindf(
+			lib.ErrAuth,
+			nil,
+			"%s %s was rejected: %d (%s)",
+			method,
+			keyOrURL,
+			status,
+			truncateErrBody(respBody),
+		)
+	}
 	return status, respBody, nil
 }
 
+// SetRetryPolicy replaces the `DefaultRetryPolicy` of the client.
+func (c *S3StorageClient) SetRetryPolicy(policy RetryPolicy) {
+	c.retry = policy
+}
+
+// doIdempotent is `do` for requests that can safely be sent again, e.g. if
+// the response to the first one was lost. It retries according to the
+// `RetryPolicy` of the client.
+func (c *S3StorageClient) doIdempotent(
+	ctx context.Context, method, keyOrURL string, extraHeaders map[string]string, body, dst []byte,
+) (int, []byte, error) {
+	backoff := c.retry.Backoff
+	for attempt := 1; ; attempt++ {
+		status, respBody, err := c.do(ctx, method, keyOrURL, extraHeaders, body, dst)
+		if !isRetryable(status, err) || attempt >= c.retry.Attempts || ctx.Err() != nil {
+			return status, respBody, err
+		}
+		reason := []any{"status", status}
+		if err != nil {
+			reason = []any{"error", err}
+		}
+		slog.Warn(
+			"Retrying S3 request",
+			append([]any{"method", method, "key", keyOrURL, "attempt", attempt, "backoff", backoff}, reason...)...,
+		)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return status, respBody, err
+		}
+		backoff = min(backoff*2, c.retry.MaxBackoff)
+	}
+}
+
+func isRetryable(status int, err error) bool {
+	if err != nil {
+		return errors.Is(err, lib.ErrNetwork)
+	}
+	switch status {
+	case statusTooManyRequests, statusInternalServerError, statusBadGateway, statusServiceUnavailable,
+		statusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// controlFileETag returns the ETag S3 assigns to an object with `data` as
+// its content (written in a single PUT).
+func controlFileETag(data []byte) string {
+	sum := md5.Sum(data) //nolint:gosec // Not used for security, S3 ETags are MD5 hashes.
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
 // ifNoneMatch refuses overwrites. 412 means the object already exists.
 var ifNoneMatch = map[string]string{"If-None-Match": "*"} //nolint:gochecknoglobals
 
@@ -511,5 +999,11 @@ func truncateErrBody(b []byte) string {
 	return string(b[:limit]) + "..."
 }
 
-// Compile-time assertion that S3StorageClient satisfies lib.Storage.
-var _ lib.Storage = (*S3StorageClient)(nil)
+// Compile-time assertions that S3StorageClient satisfies lib.Storage and
+// the optional storage interfaces.
+var (
+	_ lib.Storage           = (*S3StorageClient)(nil)
+	_ lib.BlockRangeReader  = (*S3StorageClient)(nil)
+	_ lib.BlockBatchChecker = (*S3StorageClient)(nil)
+	_ lib.BlockBatchWriter  = (*S3StorageClient)(nil)
+)
@@ -56,6 +56,31 @@ func TestS3StorageLocal(t *testing.T) {
 	})
 }
 
+// TestS3StorageBehindProxy mounts the server below `/cling` like a reverse
+// proxy would, once with the proxy stripping the base path and once without.
+func TestS3StorageBehindProxy(t *testing.T) {
+	t.Parallel()
+	for _, strip := range []bool{true, false} {
+		t.Run(fmt.Sprintf("Strip base path %v", strip), func(t *testing.T) {
+			t.Parallel()
+			checkS3Storage(t, func(t *testing.T) (S3StorageConfig, HTTPClient) { //nolint:thelper
+				srv := newProxiedServer(t, "/cling", strip, func(mux *http.ServeMux) {
+					server := NewS3StorageServer(freshStorage(t), testRegion, testAccessKey, testSecret)
+					server.BasePath = "/cling"
+					server.RegisterRoutes(mux)
+				})
+				return S3StorageConfig{
+					BucketURL:       srv.URL + "/cling",
+					Region:          testRegion,
+					Prefix:          "",
+					AccessKeyID:     testAccessKey,
+					SecretAccessKey: []byte(testSecret),
+				}, NewDefaultHTTPClient(srv.Client())
+			})
+		})
+	}
+}
+
 // TestS3StorageScaleway exercises the same contract against a real
 // Scaleway-style S3 bucket. Skipped unless `.env` (or the process
 // environment) provides TEST_S3_URL, TEST_S3_ACCESS_KEY,
@@ -255,6 +280,17 @@ func checkS3Storage(t *testing.T, newSut func(*testing.T) (S3StorageConfig, HTTP
 		assert.ErrorIs(c.Init(t.Context(), lib.Toml{"x": {"y": "z"}}, ""), lib.ErrStorageAlreadyExists)
 	})
 
+	t.Run("WriteConfig replaces the TOML written by Init", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		c := initClient(t)
+		toml := lib.Toml{"x": {"y": "z"}}
+		assert.NoError(c.WriteConfig(t.Context(), toml, "header"))
+		got, err := c.Open(t.Context())
+		assert.NoError(err)
+		assert.Equal(toml, got)
+	})
+
 	t.Run("Open on uninitialised storage should return ErrStorageNotFound", func(t *testing.T) {
 		t.Parallel()
 		assert := lib.NewAssert(t)
@@ -298,6 +334,76 @@ func checkS3Storage(t *testing.T, newSut func(*testing.T) (S3StorageConfig, HTTP
 		assert.ErrorIs(err, lib.ErrBlockNotFound)
 	})
 
+	t.Run("ReadBlockRange reads part of a block", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		c := initClient(t)
+		blockId := td.BlockId("1")
+		_, err := c.WriteBlock(t.Context(), blockId, []byte("abcde"))
+		assert.NoError(err)
+
+		got, err := c.ReadBlockRange(t.Context(), blockId, 1, 3, lib.NewBlockBuf())
+		assert.NoError(err)
+		assert.Equal([]byte("bcd"), got)
+		got, err = c.ReadBlockRange(t.Context(), blockId, 3, 10, lib.NewBlockBuf())
+		assert.NoError(err)
+		assert.Equal([]byte("de"), got)
+		got, err = c.ReadBlockRange(t.Context(), blockId, 5, 1, lib.NewBlockBuf())
+		assert.NoError(err)
+		assert.Equal(0, len(got))
+		_, err = c.ReadBlockRange(t.Context(), td.BlockId("missing"), 0, 1, lib.NewBlockBuf())
+		assert.ErrorIs(err, lib.ErrBlockNotFound)
+	})
+
+	t.Run("HasBlocks checks many blocks at once", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		c := initClient(t)
+		blockIds := make([]lib.BlockId, 20)
+		want := make([]bool, len(blockIds))
+		for i := range blockIds {
+			blockIds[i] = td.BlockId(strconv.Itoa(i))
+			if i%3 == 0 {
+				_, err := c.WriteBlock(t.Context(), blockIds[i], []byte("data"))
+				assert.NoError(err)
+				want[i] = true
+			}
+		}
+		exists, err := c.HasBlocks(t.Context(), blockIds)
+		assert.NoError(err)
+		assert.Equal(want, exists)
+		exists, err = c.HasBlocks(t.Context(), nil)
+		assert.NoError(err)
+		assert.Equal(0, len(exists))
+	})
+
+	t.Run("WriteBlocks writes many blocks at once", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		c := initClient(t)
+		_, err := c.WriteBlock(t.Context(), td.BlockId("1"), []byte("one"))
+		assert.NoError(err)
+		blocks := []lib.StoredBlock{
+			{BlockId: td.BlockId("1"), Data: []byte("one")},
+			{BlockId: td.BlockId("2"), Data: []byte("two")},
+			{BlockId: td.BlockId("3"), Data: []byte{}},
+			// Too large to share a batch with the others.
+			{BlockId: td.BlockId("4"), Data: make([]byte, lib.MaxBlockSize)},
+			{BlockId: td.BlockId("5"), Data: []byte("five")},
+		}
+		existed, err := c.WriteBlocks(t.Context(), blocks)
+		assert.NoError(err)
+		assert.Equal([]bool{true, false, false, false, false}, existed)
+		for _, block := range blocks {
+			data, err := c.ReadBlock(t.Context(), block.BlockId, lib.NewBlockBuf())
+			assert.NoError(err)
+			assert.Equal(len(block.Data), len(data))
+		}
+		existed, err = c.WriteBlocks(t.Context(), blocks[1:3])
+		assert.NoError(err)
+		assert.Equal([]bool{true, true}, existed)
+	})
+
 	t.Run("WriteBlock should reject bodies larger than MaxBlockSize", func(t *testing.T) {
 		t.Parallel()
 		assert := lib.NewAssert(t)
@@ -424,6 +530,39 @@ func checkS3Storage(t *testing.T, newSut func(*testing.T) (S3StorageConfig, HTTP
 		}
 	})
 
+	t.Run("ListControlFiles lists a single section", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		c := initClient(t)
+		assert.NoError(c.WriteControlFile(t.Context(), lib.ControlFileSectionRefs, "tag-b", []byte("b")))
+		assert.NoError(c.WriteControlFile(t.Context(), lib.ControlFileSectionRefs, "tag-a", []byte("a")))
+		assert.NoError(c.WriteControlFile(t.Context(), lib.ControlFileSectionConf, "other", []byte("c")))
+		names, err := c.ListControlFiles(t.Context(), lib.ControlFileSectionRefs)
+		assert.NoError(err)
+		assert.Equal([]string{"tag-a", "tag-b"}, names)
+		names, err = c.ListControlFiles(t.Context(), lib.ControlFileSectionSecurity)
+		assert.NoError(err)
+		assert.Equal([]string{}, names)
+	})
+
+	t.Run("CompareAndSwapControlFile uses conditional writes", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		c := initClient(t)
+		section := lib.ControlFileSectionRefs
+		assert.NoError(c.CompareAndSwapControlFile(t.Context(), section, "tag-a", nil, []byte("1")))
+		err := c.CompareAndSwapControlFile(t.Context(), section, "tag-a", nil, []byte("2"))
+		assert.ErrorIs(err, lib.ErrControlFileChanged)
+		assert.NoError(c.CompareAndSwapControlFile(t.Context(), section, "tag-a", []byte("1"), []byte("2")))
+		err = c.CompareAndSwapControlFile(t.Context(), section, "tag-a", []byte("1"), []byte("3"))
+		assert.ErrorIs(err, lib.ErrControlFileChanged)
+		err = c.CompareAndSwapControlFile(t.Context(), section, "tag-b", []byte("1"), []byte("3"))
+		assert.ErrorIs(err, lib.ErrControlFileChanged)
+		data, err := c.ReadControlFile(t.Context(), section, "tag-a")
+		assert.NoError(err)
+		assert.Equal([]byte("2"), data)
+	})
+
 	t.Run("Lock should fail immediately when held by another client", func(t *testing.T) {
 		t.Parallel()
 		assert := lib.NewAssert(t)
@@ -457,7 +596,13 @@ func checkS3Storage(t *testing.T, newSut func(*testing.T) (S3StorageConfig, HTTP
 		// c2 force-releases out from under c1.
 		assert.NoError(c2.ForceUnlock(t.Context(), "head"))
 		err = c1.WriteControlFile(t.Context(), lib.ControlFileSectionRefs, "head", []byte("x"))
+		assert.ErrorIs(err, lib.ErrLockLost)
 		assert.Error(err, "no longer exists")
+		// The loss sticks even if the lock is re-created.
+		_, err = c2.Lock(t.Context(), "head")
+		assert.NoError(err)
+		_, err = c1.WriteBlock(t.Context(), lib.BlockId{1}, []byte("x"))
+		assert.ErrorIs(err, lib.ErrLockLost)
 	})
 
 	t.Run("Verify-on-write should detect owner-mismatch after force-unlock + re-acquire", func(t *testing.T) {
@@ -473,9 +618,31 @@ func checkS3Storage(t *testing.T, newSut func(*testing.T) (S3StorageConfig, HTTP
 		_, err = c2.Lock(t.Context(), "head")
 		assert.NoError(err)
 		err = c1.WriteControlFile(t.Context(), lib.ControlFileSectionRefs, "head", []byte("x"))
+		assert.ErrorIs(err, lib.ErrLockLost)
 		assert.Error(err, "stolen")
 	})
 
+	t.Run("ListLocks lists the held locks with their owner", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		c := newClient(t)
+		locks, err := c.ListLocks(t.Context())
+		assert.NoError(err)
+		assert.Equal([]lib.LockInfo{}, locks)
+		unlock, err := c.Lock(t.Context(), "head")
+		assert.NoError(err)
+		locks, err = c.ListLocks(t.Context())
+		assert.NoError(err)
+		assert.Equal(1, len(locks))
+		assert.Equal("head", locks[0].Name)
+		assert.Equal(os.Getpid(), locks[0].Pid)
+		assert.NotEqual("", locks[0].Owner)
+		assert.NoError(unlock())
+		locks, err = c.ListLocks(t.Context())
+		assert.NoError(err)
+		assert.Equal([]lib.LockInfo{}, locks)
+	})
+
 	t.Run("ForceUnlock on a non-existent lock should return ErrLockNotFound", func(t *testing.T) {
 		t.Parallel()
 		assert := lib.NewAssert(t)
@@ -495,6 +662,7 @@ func checkS3Storage(t *testing.T, newSut func(*testing.T) (S3StorageConfig, HTTP
 		var existsErr *lib.LockExistsError
 		assert.Equal(true, stderrors.As(err, &existsErr))
 		assert.Equal("head", existsErr.Name)
+		assert.ErrorIs(err, lib.ErrContention)
 	})
 }
 
@@ -523,6 +691,90 @@ func TestS3StorageInitRejectsNonConformantBackend(t *testing.T) {
 	assert.Error(err, "does not support `If-None-Match: *`")
 }
 
+func TestS3StorageRetry(t *testing.T) {
+	t.Parallel()
+
+	// Answer the first `failures` requests of each method with 503.
+	setup := func(t *testing.T, failures int) (*S3StorageClient, *sync.Map) {
+		t.Helper()
+		server := NewS3StorageServer(freshStorage(t), testRegion, testAccessKey, testSecret)
+		mux := http.NewServeMux()
+		server.RegisterRoutes(mux)
+		var requests sync.Map
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n, _ := requests.LoadOrStore(r.Method, new(atomic.Int32))
+			if int(n.(*atomic.Int32).Add(1)) <= failures { //nolint:forcetypeassert
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		}))
+		t.Cleanup(srv.Close)
+		client := NewS3StorageClient(S3StorageConfig{
+			BucketURL:       srv.URL,
+			Region:          testRegion,
+			Prefix:          "",
+			AccessKeyID:     testAccessKey,
+			SecretAccessKey: []byte(testSecret),
+		}, NewDefaultHTTPClient(srv.Client()))
+		client.SetRetryPolicy(RetryPolicy{3, time.Millisecond, time.Millisecond})
+		return client, &requests
+	}
+	attempts := func(requests *sync.Map, method string) int {
+		n, ok := requests.Load(method)
+		if !ok {
+			return 0
+		}
+		return int(n.(*atomic.Int32).Load()) //nolint:forcetypeassert
+	}
+
+	t.Run("Idempotent requests are retried", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		client, requests := setup(t, 2)
+		buf := lib.NewBlockBuf()
+		blockId := td.BlockId("block")
+		existed, err := client.WriteBlock(t.Context(), blockId, []byte("data"))
+		assert.NoError(err)
+		assert.Equal(false, existed)
+		assert.Equal(3, attempts(requests, http.MethodPut))
+		data, err := client.ReadBlock(t.Context(), blockId, buf)
+		assert.NoError(err)
+		assert.Equal("data", string(data))
+		assert.Equal(3, attempts(requests, http.MethodGet))
+	})
+
+	t.Run("Requests fail after the last attempt", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		client, requests := setup(t, 3)
+		_, err := client.ReadBlock(t.Context(), td.BlockId("block"), lib.NewBlockBuf())
+		assert.Error(err, "read block failed: 503")
+		assert.Equal(3, attempts(requests, http.MethodGet))
+	})
+
+	t.Run("Conditional writes are not retried", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		client, requests := setup(t, 1)
+		err := client.CompareAndSwapControlFile(t.Context(), lib.ControlFileSectionRefs, "head", nil, []byte("a"))
+		assert.Error(err, "503")
+		assert.Equal(1, attempts(requests, http.MethodPut))
+	})
+
+	t.Run("Network errors are retried", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		client, _ := setup(t, 0)
+		client.cfg.BucketURL = "http://127.0.0.1:1"
+		start := time.Now()
+		client.SetRetryPolicy(RetryPolicy{3, 20 * time.Millisecond, time.Second})
+		_, err := client.HasBlock(t.Context(), td.BlockId("block"))
+		assert.ErrorIs(err, lib.ErrNetwork)
+		assert.Equal(true, time.Since(start) >= 60*time.Millisecond)
+	})
+}
+
 func TestS3StorageServer(t *testing.T) {
 	t.Parallel()
 
@@ -548,6 +800,24 @@ func TestS3StorageServer(t *testing.T) {
 		}, NewDefaultHTTPClient(srv.Client()))
 		_, err := client.Open(t.Context())
 		assert.Error(err, "")
+		assert.ErrorIs(err, lib.ErrAuth)
+	})
+
+	t.Run("Unreachable server should be a network error", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		srv := newServerForStorage(t, freshStorage(t))
+		srv.Close()
+		client := NewS3StorageClient(S3StorageConfig{
+			BucketURL:       srv.URL,
+			Region:          testRegion,
+			Prefix:          "",
+			AccessKeyID:     testAccessKey,
+			SecretAccessKey: []byte(testSecret),
+		}, NewDefaultHTTPClient(srv.Client()))
+		client.SetRetryPolicy(RetryPolicy{1, 0, 0})
+		_, err := client.Open(t.Context())
+		assert.ErrorIs(err, lib.ErrNetwork)
 	})
 
 	t.Run("Unknown access key should fail", func(t *testing.T) {
@@ -589,6 +859,63 @@ func TestS3StorageServer(t *testing.T) {
 		})
 	}
 
+	t.Run("HasBlocks and WriteBlocks fall back if the server does not support them", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		storage := freshStorage(t)
+		assert.NoError(storage.Init(t.Context(), lib.Toml{}, ""))
+		_, err := storage.WriteBlock(t.Context(), td.BlockId("1"), []byte("data"))
+		assert.NoError(err)
+		server := NewS3StorageServer(storage, testRegion, testAccessKey, testSecret)
+		mux := http.NewServeMux()
+		server.RegisterRoutes(mux)
+		var posts atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				posts.Add(1)
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		}))
+		t.Cleanup(srv.Close)
+		client := NewS3StorageClient(S3StorageConfig{
+			BucketURL:       srv.URL,
+			Region:          testRegion,
+			Prefix:          "",
+			AccessKeyID:     testAccessKey,
+			SecretAccessKey: []byte(testSecret),
+		}, NewDefaultHTTPClient(srv.Client()))
+		for range 2 {
+			exists, err := client.HasBlocks(t.Context(), []lib.BlockId{td.BlockId("1"), td.BlockId("2")})
+			assert.NoError(err)
+			assert.Equal([]bool{true, false}, exists)
+		}
+		assert.Equal(int32(1), posts.Load())
+		for _, id := range []string{"2", "3"} {
+			existed, err := client.WriteBlocks(t.Context(), []lib.StoredBlock{
+				{BlockId: td.BlockId("1"), Data: []byte("data")},
+				{BlockId: td.BlockId(id), Data: []byte("data")},
+			})
+			assert.NoError(err)
+			assert.Equal([]bool{true, false}, existed)
+		}
+		assert.Equal(int32(2), posts.Load())
+	})
+
+	t.Run("Server should reject malformed block frames", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		srv := newServerForStorage(t, freshStorage(t))
+		body := appendBlockFrame(nil, td.BlockId("1"), []byte("data"))
+		resp, err := sendSignedTest(srv, http.MethodPost, srv.URL+"/blocks", body[:len(body)-1])
+		assert.NoError(err)
+		assert.Equal(http.StatusBadRequest, resp.StatusCode)
+		resp, err = sendSignedTest(srv, http.MethodPost, srv.URL+"/blocks", body[:blockFrameHeaderSize-1])
+		assert.NoError(err)
+		assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	})
+
 	t.Run("Server should reject bodies over MaxBlockSize", func(t *testing.T) {
 		t.Parallel()
 		assert := lib.NewAssert(t)
@@ -630,6 +957,228 @@ func TestS3StorageServer(t *testing.T) {
 		assert.Equal(http.StatusRequestEntityTooLarge, resp.StatusCode)
 	})
 
+	t.Run("Read-only server should only allow reads", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		storage := freshStorage(t)
+		assert.NoError(storage.Init(t.Context(), lib.Toml{}, ""))
+		assert.NoError(storage.WriteControlFile(t.Context(), lib.ControlFileSectionRefs, "head", []byte("abc")))
+		server := NewS3StorageServer(storage, testRegion, testAccessKey, testSecret)
+		server.ReadOnly = true
+		mux := http.NewServeMux()
+		server.RegisterRoutes(mux)
+		srv := httptest.NewServer(mux)
+		t.Cleanup(srv.Close)
+		cases := []struct {
+			method string
+			path   string
+			want   int
+		}{
+			{http.MethodGet, "/refs/head", http.StatusOK},
+			{http.MethodHead, "/refs/head", http.StatusOK},
+			{http.MethodGet, "/repository.txt", http.StatusOK},
+			{http.MethodGet, "/?list-type=2&prefix=refs/", http.StatusOK},
+			{http.MethodPut, "/refs/head", http.StatusForbidden},
+			{http.MethodDelete, "/refs/head", http.StatusForbidden},
+			{http.MethodPut, "/blocks/" + td.BlockId("1").String(), http.StatusForbidden},
+			{http.MethodPut, "/locks/head", http.StatusForbidden},
+			{http.MethodHead, "/locks/head", http.StatusForbidden},
+			{http.MethodPost, "/blocks", http.StatusForbidden},
+			// Not a list of block ids, but not rejected as a write either.
+			{http.MethodPost, "/blocks?has", http.StatusBadRequest},
+		}
+		for _, tc := range cases {
+			resp, err := sendSignedTest(srv, tc.method, srv.URL+tc.path, []byte("x"))
+			assert.NoError(err)
+			resp.Body.Close() //nolint:errcheck,gosec
+			assert.Equal(tc.want, resp.StatusCode, tc.method+" "+tc.path)
+		}
+		data, err := storage.ReadControlFile(t.Context(), lib.ControlFileSectionRefs, "head")
+		assert.NoError(err)
+		assert.Equal("abc", string(data))
+	})
+
+	t.Run("Append-only server should never drop what was committed", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		storage := freshStorage(t)
+		server := NewS3StorageServer(storage, testRegion, testAccessKey, testSecret)
+		server.AppendOnly = true
+		mux := http.NewServeMux()
+		server.RegisterRoutes(mux)
+		srv := httptest.NewServer(mux)
+		t.Cleanup(srv.Close)
+		client := NewS3StorageClient(S3StorageConfig{
+			BucketURL:       srv.URL,
+			Region:          testRegion,
+			Prefix:          "",
+			AccessKeyID:     testAccessKey,
+			SecretAccessKey: []byte(testSecret),
+		}, NewDefaultHTTPClient(srv.Client()))
+		ctx := t.Context()
+		assert.NoError(client.Init(ctx, lib.Toml{}, ""))
+
+		// Blocks are written once.
+		blockId := td.BlockId("1")
+		existed, err := client.WriteBlock(ctx, blockId, []byte("a"))
+		assert.NoError(err)
+		assert.Equal(false, existed)
+		existed, err = client.WriteBlock(ctx, blockId, []byte("a"))
+		assert.NoError(err)
+		assert.Equal(true, existed)
+		resp, err := sendSignedTest(srv, http.MethodPut, srv.URL+"/blocks/"+blockId.String(), []byte("b"))
+		assert.NoError(err)
+		assert.Equal(http.StatusForbidden, resp.StatusCode)
+		existedAll, err := client.WriteBlocks(ctx, []lib.StoredBlock{
+			{BlockId: blockId, Data: []byte("b")},
+			{BlockId: td.BlockId("2"), Data: []byte("c")},
+		})
+		assert.NoError(err)
+		assert.Equal([]bool{true, false}, existedAll)
+		data, err := storage.ReadBlock(ctx, blockId, lib.NewBlockBuf())
+		assert.NoError(err)
+		assert.Equal("a", string(data))
+
+		// The head only moves forward.
+		first, second := lib.RevisionId(td.BlockId("1")), lib.RevisionId(td.BlockId("2"))
+		assert.NoError(lib.WriteRef(ctx, client, "head", lib.RevisionId{}))
+		assert.NoError(lib.CompareAndSwapRef(ctx, client, "head", &lib.RevisionId{}, first))
+		assert.NoError(lib.WriteRef(ctx, client, "head", first))
+		assert.NoError(lib.CompareAndSwapRef(ctx, client, "head", &first, second))
+		assert.Error(lib.WriteRef(ctx, client, "head", first), "must not be moved back")
+		assert.Error(lib.WriteRef(ctx, client, "head", lib.RevisionId{}), "must not be moved back")
+		head, err := lib.ReadRef(ctx, storage, "head")
+		assert.NoError(err)
+		assert.Equal(second, head)
+
+		// Control files are never deleted, locks can be released.
+		assert.NoError(lib.WriteRef(ctx, client, "tag-v1", first))
+		assert.Error(lib.DeleteRef(ctx, client, "tag-v1"), "403")
+		assert.Error(client.WriteControlFile(ctx, lib.ControlFileSectionConf, headLogPrefix+"00", nil), "403")
+		unlock, err := client.Lock(ctx, "head")
+		assert.NoError(err)
+		assert.NoError(unlock())
+		_, err = storage.ReadControlFile(ctx, lib.ControlFileSectionRefs, "tag-v1")
+		assert.NoError(err)
+
+		// The repository config cannot be replaced.
+		assert.Error(client.WriteConfig(ctx, lib.Toml{"encryption": {"version": "2"}}, ""), "403")
+		config, err := storage.Open(ctx)
+		assert.NoError(err)
+		assert.Equal(lib.Toml{}, config)
+
+		// References and security files are written once, except `head`.
+		assert.NoError(lib.WriteRef(ctx, client, "tag-v1", first))
+		assert.Error(lib.WriteRef(ctx, client, "tag-v1", second), "403")
+		assert.Error(lib.CompareAndSwapRef(ctx, client, "tag-v1", &first, second), "403")
+		tag, err := lib.ReadRef(ctx, storage, "tag-v1")
+		assert.NoError(err)
+		assert.Equal(first, tag)
+		assert.NoError(client.WriteControlFile(ctx, lib.ControlFileSectionSecurity, "backup", []byte("a")))
+		assert.NoError(client.WriteControlFile(ctx, lib.ControlFileSectionSecurity, "backup", []byte("a")))
+		assert.Error(client.WriteControlFile(ctx, lib.ControlFileSectionSecurity, "backup", []byte("b")), "403")
+		data, err = storage.ReadControlFile(ctx, lib.ControlFileSectionSecurity, "backup")
+		assert.NoError(err)
+		assert.Equal("a", string(data))
+		// A bucket of the file index cannot be replaced either.
+		assert.NoError(client.CompareAndSwapControlFile(ctx, lib.ControlFileSectionFiles, "00", nil, []byte("a")))
+		assert.Error(client.CompareAndSwapControlFile(ctx, lib.ControlFileSectionFiles, "00", []byte("a"), []byte("b")), "403")
+		assert.Error(client.WriteControlFile(ctx, lib.ControlFileSectionFiles, "00", []byte("b")), "403")
+		data, err = storage.ReadControlFile(ctx, lib.ControlFileSectionFiles, "00")
+		assert.NoError(err)
+		assert.Equal("a", string(data))
+		// Other control files are state that is updated in place.
+		assert.NoError(client.WriteControlFile(ctx, lib.ControlFileSectionConf, "state", []byte("a")))
+		assert.NoError(client.WriteControlFile(ctx, lib.ControlFileSectionConf, "state", []byte("b")))
+	})
+
+	t.Run("Server should reject new blocks once the quota is exceeded", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		storage := freshStorage(t)
+		assert.NoError(storage.Init(t.Context(), lib.Toml{}, ""))
+		_, err := storage.WriteBlock(t.Context(), td.BlockId("1"), []byte("12345"))
+		assert.NoError(err)
+		newClient := func() (*S3StorageClient, *S3StorageServer) {
+			server := NewS3StorageServer(storage, testRegion, testAccessKey, testSecret)
+			server.MaxSize = 10
+			mux := http.NewServeMux()
+			server.RegisterRoutes(mux)
+			srv := httptest.NewServer(mux)
+			t.Cleanup(srv.Close)
+			return NewS3StorageClient(S3StorageConfig{
+				BucketURL:       srv.URL,
+				Region:          testRegion,
+				Prefix:          "",
+				AccessKeyID:     testAccessKey,
+				SecretAccessKey: []byte(testSecret),
+			}, NewDefaultHTTPClient(srv.Client())), server
+		}
+		ctx := t.Context()
+		client, server := newClient()
+		_, err = client.WriteBlock(ctx, td.BlockId("2"), []byte("123456"))
+		assert.ErrorIs(err, lib.ErrQuotaExceeded)
+		_, err = client.WriteBlocks(ctx, []lib.StoredBlock{
+			{BlockId: td.BlockId("1"), Data: []byte("12345")},
+			{BlockId: td.BlockId("2"), Data: []byte("123456")},
+		})
+		assert.ErrorIs(err, lib.ErrQuotaExceeded)
+		existed, err := client.WriteBlock(ctx, td.BlockId("2"), []byte("1234"))
+		assert.NoError(err)
+		assert.Equal(false, existed)
+		existed, err = client.WriteBlock(ctx, td.BlockId("1"), []byte("12345"))
+		assert.NoError(err)
+		assert.Equal(true, existed)
+		assert.Error(client.WriteControlFile(ctx, lib.ControlFileSectionConf, quotaUsageFile, []byte("0")), "403")
+
+		// The usage is only written every `quotaUsageSaveInterval` and when
+		// the server stops, it is kept across restarts.
+		data, err := storage.ReadControlFile(ctx, lib.ControlFileSectionConf, quotaUsageFile)
+		assert.NoError(err)
+		assert.Equal("5", string(data))
+		assert.NoError(server.SaveUsedSize(ctx))
+		data, err = storage.ReadControlFile(ctx, lib.ControlFileSectionConf, quotaUsageFile)
+		assert.NoError(err)
+		assert.Equal("9", string(data))
+		client, _ = newClient()
+		_, err = client.WriteBlock(ctx, td.BlockId("3"), []byte("12"))
+		assert.ErrorIs(err, lib.ErrQuotaExceeded)
+		_, err = client.WriteBlock(ctx, td.BlockId("3"), []byte("1"))
+		assert.NoError(err)
+	})
+
+	t.Run("Packed blocks should be served like loose blocks", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		storage := freshStorage(t)
+		assert.NoError(storage.Init(t.Context(), lib.Toml{}, ""))
+		blockId := td.BlockId("1")
+		_, err := storage.WriteBlock(t.Context(), blockId, []byte("packed"))
+		assert.NoError(err)
+		_, err = lib.PackBlocks(t.Context(), storage, lib.PackOptions{Monitor: noopPackMonitor{}, PackSize: 0})
+		assert.NoError(err)
+		srv := newServerForStorage(t, storage)
+		client := NewS3StorageClient(S3StorageConfig{
+			BucketURL:       srv.URL,
+			Region:          testRegion,
+			Prefix:          "",
+			AccessKeyID:     testAccessKey,
+			SecretAccessKey: []byte(testSecret),
+		}, NewDefaultHTTPClient(srv.Client()))
+		exists, err := client.HasBlock(t.Context(), blockId)
+		assert.NoError(err)
+		assert.Equal(true, exists)
+		data, err := client.ReadBlock(t.Context(), blockId, lib.NewBlockBuf())
+		assert.NoError(err)
+		assert.Equal("packed", string(data))
+		blockIds := []lib.BlockId{}
+		assert.NoError(client.ReadBlockIds(t.Context(), func(id lib.BlockId) bool {
+			blockIds = append(blockIds, id)
+			return true
+		}))
+		assert.Equal([]lib.BlockId{blockId}, blockIds)
+	})
+
 	t.Run("Client should reject oversized response bodies", func(t *testing.T) {
 		t.Parallel()
 		assert := lib.NewAssert(t)
@@ -828,6 +1377,24 @@ func newServerForStorage(t *testing.T, storage *lib.FileStorage) *httptest.Serve
 	return srv
 }
 
+// newProxiedServer serves the routes registered by `register` below
+// `basePath`. With `strip`, the base path is removed from the requests
+// before they reach the routes.
+func newProxiedServer(t *testing.T, basePath string, strip bool, register func(*http.ServeMux)) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	register(mux)
+	var handler http.Handler = mux
+	if strip {
+		handler = http.StripPrefix(basePath, mux)
+	}
+	proxy := http.NewServeMux()
+	proxy.Handle(basePath+"/", handler)
+	srv := httptest.NewServer(proxy)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
 // sendSignedTest builds, SigV4-signs, and dispatches a raw test request.
 func sendSignedTest(srv *httptest.Server, method, fullURL string, body []byte) (*http.Response, error) {
 	signer := SigV4Signer{AccessKeyID: testAccessKey, SecretAccessKey: testSecret, Region: testRegion}
@@ -871,6 +1438,10 @@ func loadS3Creds(t *testing.T) (bucketURL, accessKey, secretKey string) {
 	return pick("TEST_S3_URL"), pick("TEST_S3_ACCESS_KEY"), pick("TEST_S3_SECRET_KEY")
 }
 
+type noopPackMonitor struct{}
+
+func (noopPackMonitor) OnPackWritten(string, int, int64) {}
+
 type zeroReader struct{}
 
 func (zeroReader) Read(p []byte) (int, error) {
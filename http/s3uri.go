@@ -1,6 +1,10 @@
 // S3 URI encoding and decoding of the form:
 //
-//	s3+https://<base64url(argon2id-phc)>:<base64url(ciphertext)>@<host>[/<prefix>]
+//	s3+https://<base64url(argon2id-phc)>:<base64url(ciphertext)>@<host>[/<prefix>][?base-path=<path>]
+//
+// `base-path` is the part of the path that belongs to the bucket URL instead
+// of the key prefix, e.g. if the server is mounted below a path by a reverse
+// proxy: `s3+https://host/cling/repos/repo1?base-path=/cling`.
 package http
 
 import (
@@ -13,7 +17,10 @@ import (
 	"github.com/flunderpero/cling-sync/lib"
 )
 
-const s3URIPrefix = "s3+"
+const (
+	s3URIPrefix        = "s3+"
+	s3URIBasePathParam = "base-path"
+)
 
 type S3Credentials struct {
 	AccessKeyID     string
@@ -41,10 +48,14 @@ func ParseS3Endpoint(endpoint string, creds S3Credentials) (S3StorageConfig, err
 	if inner.User != nil {
 		return S3StorageConfig{}, lib.Errorf("endpoint must not carry credentials")
 	}
+	bucketURL, prefix, err := splitS3URL(inner)
+	if err != nil {
+		return S3StorageConfig{}, err
+	}
 	return S3StorageConfig{
-		BucketURL:       inner.Scheme + "://" + inner.Host,
+		BucketURL:       bucketURL,
 		Region:          regionFromHost(inner.Host),
-		Prefix:          strings.Trim(inner.Path, "/"),
+		Prefix:          prefix,
 		AccessKeyID:     creds.AccessKeyID,
 		SecretAccessKey: creds.SecretAccessKey,
 	}, nil
@@ -135,16 +146,24 @@ func DecodeS3URI(uri string, passphrase []byte) (S3StorageConfig, string, error)
 	cleartext.User = nil
 	plain, err := lib.Decrypt(encrypted, aead, []byte(uriAAD(&cleartext)), make([]byte, len(encrypted)))
 	if err != nil {
-		return S3StorageConfig{}, "", lib.WrapErrorf(err, "failed to decrypt credentials (wrong passphrase?)")
+		return S3StorageConfig{}, "", lib.WrapErrorKindf(
+			lib.ErrAuth,
+			err,
+			"failed to decrypt credentials (wrong passphrase?)",
+		)
 	}
 	akBytes, secretKey, ok := bytes.Cut(plain, []byte{':'})
 	if !ok {
 		return S3StorageConfig{}, "", lib.Errorf("decrypted credentials missing separator")
 	}
+	bucketURL, prefix, err := splitS3URL(&cleartext)
+	if err != nil {
+		return S3StorageConfig{}, "", err
+	}
 	return S3StorageConfig{
-		BucketURL:       cleartext.Scheme + "://" + cleartext.Host,
+		BucketURL:       bucketURL,
 		Region:          regionFromHost(cleartext.Host),
-		Prefix:          strings.Trim(cleartext.Path, "/"),
+		Prefix:          prefix,
 		AccessKeyID:     string(akBytes),
 		SecretAccessKey: secretKey,
 	}, s3URIPrefix + cleartext.String(), nil
@@ -170,6 +189,22 @@ func uriAAD(u *url.URL) string {
 	return out
 }
 
+// splitS3URL splits the path of `u` into the bucket URL and the key prefix
+// according to the `base-path` query parameter.
+func splitS3URL(u *url.URL) (string, string, error) {
+	bucketURL := u.Scheme + "://" + u.Host
+	basePath := strings.Trim(u.Query().Get(s3URIBasePathParam), "/")
+	path := strings.Trim(u.Path, "/")
+	if basePath == "" {
+		return bucketURL, path, nil
+	}
+	prefix, ok := strings.CutPrefix(path, basePath)
+	if !ok || (prefix != "" && !strings.HasPrefix(prefix, "/")) {
+		return "", "", lib.Errorf("the base path /%s is not a prefix of the path /%s", basePath, path)
+	}
+	return bucketURL + "/" + basePath, strings.Trim(prefix, "/"), nil
+}
+
 // parseS3URL strips the `s3+` prefix and parses the inner http(s) URL.
 func parseS3URL(raw string) (*url.URL, error) {
 	rest, ok := strings.CutPrefix(raw, s3URIPrefix)
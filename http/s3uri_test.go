@@ -35,6 +35,28 @@ func TestS3URI(t *testing.T) {
 		assert.Equal("s3+https://cling-sync-test.s3.nl-ams.scw.cloud/some/prefix", cleartextURI)
 	})
 
+	t.Run("The base path belongs to the bucket URL", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		creds := S3Credentials{AccessKeyID: "A", SecretAccessKey: []byte("B")}
+		raw := "s3+https://example.com/cling/repos/repo1?base-path=/cling"
+		uri, err := EncodeS3URI(raw, creds, uriTestPassphrase)
+		assert.NoError(err)
+		cfg, cleartextURI, err := DecodeS3URI(uri, uriTestPassphrase)
+		assert.NoError(err)
+		assert.Equal("https://example.com/cling", cfg.BucketURL)
+		assert.Equal("repos/repo1", cfg.Prefix)
+		assert.Equal(raw, cleartextURI)
+
+		cfg, err = ParseS3Endpoint("s3+https://example.com/cling/repo1?base-path=cling/repo1/", creds)
+		assert.NoError(err)
+		assert.Equal("https://example.com/cling/repo1", cfg.BucketURL)
+		assert.Equal("", cfg.Prefix)
+
+		_, err = ParseS3Endpoint("s3+https://example.com/clingy/repo1?base-path=/cling", creds)
+		assert.Error(err, "the base path /cling is not a prefix of the path /clingy/repo1")
+	})
+
 	t.Run("Accepts http scheme", func(t *testing.T) {
 		t.Parallel()
 		assert := lib.NewAssert(t)
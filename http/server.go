@@ -1,12 +1,10 @@
 //go:build !wasm
 
-//nolint:forbidigo
 package http
 
 import (
 	"log/slog"
 	"net/http"
-	"os"
 	"time"
 )
 
@@ -30,14 +28,14 @@ func (rw *responseWriter) Write(b []byte) (int, error) {
 	return n, err //nolint:wrapcheck
 }
 
+// RequestLogMiddleware logs every request with the default `slog` logger at
+// the info level.
 func RequestLogMiddleware(handler http.Handler) http.Handler {
-	// todo: Make the log format and level configurable
-	log := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})) //nolint:exhaustruct
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		t0 := time.Now()
 		wrapped := &responseWriter{w, 0, 0}
 		handler.ServeHTTP(wrapped, r)
-		log.Debug(
+		slog.Info(
 			"HTTP request",
 			"status",
 			wrapped.statusCode,
@@ -63,7 +61,7 @@ func CORSMiddleware(next http.Handler) http.Handler {
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, HEAD, OPTIONS")
 		w.Header().Set(
 			"Access-Control-Allow-Headers",
-			"Authorization, Content-Type, If-None-Match, X-Amz-Content-Sha256, X-Amz-Date",
+			"Authorization, Content-Type, If-Match, If-None-Match, X-Amz-Content-Sha256, X-Amz-Date",
 		)
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
@@ -0,0 +1,203 @@
+//go:build !wasm
+
+//nolint:forbidigo
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+const selfSignedCertValidity = 10 * 365 * 24 * time.Hour
+
+// GenerateSelfSignedCert writes a new self-signed certificate for `hosts`
+// (DNS names or IP addresses) to `certFile` and its private key to
+// `keyFile`, both PEM encoded.
+func GenerateSelfSignedCert(hosts []string, certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to generate key")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to generate serial number")
+	}
+	now := time.Now()
+	template := x509.Certificate{ //nolint:exhaustruct
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "cling-sync serve"}, //nolint:exhaustruct
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedCertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		// The certificate is its own CA, so clients can trust it directly.
+		IsCA: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to create certificate")
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to encode private key")
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}) //nolint:exhaustruct
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		return lib.WrapErrorf(err, "failed to write %s", keyFile)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}) //nolint:exhaustruct
+
+	if err := os.WriteFile(certFile, certPEM, 0o644); err != nil { //nolint:gosec
+		return lib.WrapErrorf(err, "failed to write %s", certFile)
+	}
+	return nil
+}
+
+// CertFingerprint returns the hex encoded SHA-256 fingerprint of the first
+// certificate in the PEM file `certFile`.
+func CertFingerprint(certFile string) (string, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return "", lib.WrapErrorf(err, "failed to read %s", certFile)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", lib.Errorf("no certificate found in %s", certFile)
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// NewHTTPClientTrusting returns an HTTP client that trusts the certificates
+// in the PEM file `caFile` in addition to the system's.
+func NewHTTPClientTrusting(caFile string) (*http.Client, error) {
+	transport, err := newTransport(HTTPClientConfig{nil, "", caFile})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport}, nil //nolint:exhaustruct
+}
+
+// The environment variable naming a PEM file with certificates to trust in
+// addition to the system's, e.g. the one of `serve --tls-self-signed`.
+const CAFileEnv = "CLING_S3_CA_FILE"
+
+// The environment variable with the URL of a proxy for all requests to the
+// repository server, see `HTTPClientConfig.Proxy`.
+const ProxyEnv = "CLING_S3_PROXY"
+
+type HTTPClientConfig struct {
+	// Sent with every request, see `ValidateHTTPHeader`.
+	Headers map[string]string
+	// The URL of an HTTP, HTTPS, or SOCKS5 proxy, e.g.
+	// `socks5://127.0.0.1:1080`. If empty, the proxy is taken from the
+	// `HTTPS_PROXY`, `HTTP_PROXY`, and `NO_PROXY` environment variables.
+	Proxy string
+	// A PEM file with certificates to trust in addition to the system's.
+	CAFile string
+}
+
+// The config of the clients returned by `NewDefaultHTTPClientFromEnv`. The
+// CLI sets it from its global flags.
+var DefaultHTTPClientConfig = HTTPClientConfig{nil, "", ""} //nolint:gochecknoglobals
+
+// NewConfiguredHTTPClient returns `NewDefaultHTTPClient(nil)` if `cfg` is
+// empty, otherwise a client with its own transport.
+func NewConfiguredHTTPClient(cfg HTTPClientConfig) (*DefaultHTTPClient, error) {
+	for name := range cfg.Headers {
+		if err := ValidateHTTPHeader(name); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Proxy == "" && cfg.CAFile == "" {
+		client := NewDefaultHTTPClient(nil)
+		client.Headers = cfg.Headers
+		return client, nil
+	}
+	transport, err := newTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client := NewDefaultHTTPClient(&http.Client{Transport: transport}) //nolint:exhaustruct
+	client.Headers = cfg.Headers
+	return client, nil
+}
+
+func newTransport(cfg HTTPClientConfig) (*http.Transport, error) {
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return nil, lib.Errorf("unexpected default transport %T", http.DefaultTransport)
+	}
+	transport = transport.Clone()
+	if cfg.CAFile != "" {
+		data, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to read %s", cfg.CAFile)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, lib.Errorf("no certificate found in %s", cfg.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12} //nolint:exhaustruct
+	}
+	if cfg.Proxy != "" {
+		proxy, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "invalid proxy URL %s", cfg.Proxy)
+		}
+		switch proxy.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, lib.Errorf("unsupported proxy URL %s, expected http, https, or socks5", cfg.Proxy)
+		}
+		if proxy.Host == "" {
+			return nil, lib.Errorf("invalid proxy URL %s, the host is missing", cfg.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	return transport, nil
+}
+
+// NewDefaultHTTPClientFromEnv returns a client for `DefaultHTTPClientConfig`.
+// `$CLING_S3_CA_FILE` and `$CLING_S3_PROXY` apply unless the config sets a CA
+// file or a proxy.
+func NewDefaultHTTPClientFromEnv() (*DefaultHTTPClient, error) {
+	cfg := DefaultHTTPClientConfig
+	if cfg.CAFile == "" {
+		cfg.CAFile = os.Getenv(CAFileEnv)
+	}
+	if cfg.Proxy == "" {
+		cfg.Proxy = os.Getenv(ProxyEnv)
+	}
+	client, err := NewConfiguredHTTPClient(cfg)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "invalid HTTP client configuration")
+	}
+	return client, nil
+}
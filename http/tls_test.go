@@ -0,0 +1,97 @@
+package http
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestSelfSignedCert(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	assert.NoError(GenerateSelfSignedCert([]string{"localhost", "127.0.0.1"}, certFile, keyFile))
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	assert.NoError(err)
+
+	fingerprint, err := CertFingerprint(certFile)
+	assert.NoError(err)
+	sum := sha256.Sum256(cert.Certificate[0])
+	assert.Equal(hex.EncodeToString(sum[:]), fingerprint)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}} //nolint:exhaustruct,gosec
+	srv.StartTLS()
+	defer srv.Close()
+
+	// The system does not trust the certificate.
+	_, _, err = NewDefaultHTTPClient(nil).Request(t.Context(), http.MethodGet, srv.URL, nil, nil, nil)
+	assert.Error(err, "certificate")
+
+	client, err := NewHTTPClientTrusting(certFile)
+	assert.NoError(err)
+	status, _, err := NewDefaultHTTPClient(client).Request(t.Context(), http.MethodGet, srv.URL, nil, nil, nil)
+	assert.NoError(err)
+	assert.Equal(http.StatusNoContent, status)
+}
+
+func TestConfiguredHTTPClient(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Headers are sent with every request", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Trace-Id") != "abc" || r.Header.Get("X-Request") != "request" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer srv.Close()
+		client, err := NewConfiguredHTTPClient(HTTPClientConfig{map[string]string{"X-Trace-Id": "abc"}, "", ""})
+		assert.NoError(err)
+		headers := map[string]string{"X-Request": "request"}
+		status, _, err := client.Request(t.Context(), http.MethodGet, srv.URL, headers, nil, nil)
+		assert.NoError(err)
+		assert.Equal(http.StatusNoContent, status)
+	})
+
+	t.Run("Requests go through the proxy", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		proxied := make(chan string, 1)
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proxied <- r.URL.String()
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer proxy.Close()
+		client, err := NewConfiguredHTTPClient(HTTPClientConfig{nil, proxy.URL, ""})
+		assert.NoError(err)
+		status, _, err := client.Request(t.Context(), http.MethodGet, "http://repository.invalid/a", nil, nil, nil)
+		assert.NoError(err)
+		assert.Equal(http.StatusNoContent, status)
+		assert.Equal("http://repository.invalid/a", <-proxied)
+	})
+
+	t.Run("Invalid configs are rejected", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		_, err := NewConfiguredHTTPClient(HTTPClientConfig{map[string]string{"Authorization": "x"}, "", ""})
+		assert.Error(err, "cannot be overridden")
+		_, err = NewConfiguredHTTPClient(HTTPClientConfig{nil, "ftp://proxy", ""})
+		assert.Error(err, "unsupported proxy URL")
+		_, err = NewConfiguredHTTPClient(HTTPClientConfig{nil, "", filepath.Join(t.TempDir(), "missing.pem")})
+		assert.Error(err, "failed to read")
+	})
+}
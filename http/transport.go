@@ -17,13 +17,15 @@ import (
 
 type DefaultHTTPClient struct {
 	Client *http.Client
+	// Sent with every request, see `ValidateHTTPHeader`.
+	Headers map[string]string
 }
 
 func NewDefaultHTTPClient(client *http.Client) *DefaultHTTPClient {
 	if client == nil {
 		client = http.DefaultClient
 	}
-	return &DefaultHTTPClient{Client: client}
+	return &DefaultHTTPClient{Client: client, Headers: nil}
 }
 
 func (c *DefaultHTTPClient) Request(
@@ -37,6 +39,9 @@ func (c *DefaultHTTPClient) Request(
 		return 0, nil, lib.WrapErrorf(err, "failed to create request")
 	}
 	req.ContentLength = int64(len(body))
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
 	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
@@ -44,7 +49,10 @@ func (c *DefaultHTTPClient) Request(
 	// URL. We're their S3 client.
 	resp, err := c.Client.Do(req) //nolint:gosec
 	if err != nil {
-		return 0, nil, lib.WrapErrorf(err, "failed to execute %s %s", method, fullURL)
+		if ctx.Err() != nil {
+			return 0, nil, lib.WrapErrorf(err, "failed to execute %s %s", method, fullURL)
+		}
+		return 0, nil, lib.WrapErrorKindf(lib.ErrNetwork, err, "failed to execute %s %s", method, fullURL)
 	}
 	defer resp.Body.Close() //nolint:errcheck
 	respBody, err := readCappedBody(resp.Body, dst)
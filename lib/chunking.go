@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+type ChunkingMode string
+
+const (
+	// Content-defined chunking, see `GearCDC`.
+	ChunkingModeGearCDC ChunkingMode = "gear-cdc"
+	// Split files into chunks of the same size. Useful for large files that
+	// are changed in place (VM images, databases), where content-defined
+	// boundaries are no better than fixed ones but cost more to compute.
+	ChunkingModeFixed ChunkingMode = "fixed"
+)
+
+const (
+	chunkingSection = "chunking"
+	// Smaller chunks would mostly add per-block overhead.
+	MinChunkSize          = 4 * 1024
+	DefaultFixedChunkSize = 4 * 1024 * 1024
+)
+
+// ChunkingPolicy decides how files are split into blocks. It is part of the
+// repository config, because all clients must split files the same way for
+// identical content to end up in identical blocks.
+type ChunkingPolicy struct {
+	Mode ChunkingMode
+	// Only used by `ChunkingModeGearCDC`.
+	MinSize int
+	// Only used by `ChunkingModeGearCDC`. Must be a power of two, chunks are
+	// roughly `MinSize + AvgSize` bytes on average.
+	AvgSize int
+	// The chunk size of `ChunkingModeFixed` and the upper bound for
+	// `ChunkingModeGearCDC`.
+	MaxSize int
+}
+
+func DefaultChunkingPolicy() ChunkingPolicy {
+	return ChunkingPolicy{ChunkingModeGearCDC, defaultMinBlockSize, defaultMask + 1, defaultMaxBlockSize}
+}
+
+func NewFixedChunkingPolicy(size int) ChunkingPolicy {
+	return ChunkingPolicy{ChunkingModeFixed, 0, 0, size}
+}
+
+func (p ChunkingPolicy) Validate() error {
+	if p.MaxSize < MinChunkSize || p.MaxSize > MaxBlockDataSize {
+		return Errorf(
+			"the chunk size must be between %d and %d bytes, got %d",
+			MinChunkSize,
+			MaxBlockDataSize,
+			p.MaxSize,
+		)
+	}
+	switch p.Mode {
+	case ChunkingModeFixed:
+		return nil
+	case ChunkingModeGearCDC:
+		if p.MinSize < MinChunkSize || p.MinSize > p.MaxSize {
+			return Errorf(
+				"the minimum chunk size must be between %d and %d bytes, got %d",
+				MinChunkSize,
+				p.MaxSize,
+				p.MinSize,
+			)
+		}
+		if p.AvgSize <= 0 || p.AvgSize > p.MaxSize || bits.OnesCount(uint(p.AvgSize)) != 1 {
+			return Errorf(
+				"the average chunk size must be a power of two of at most %d bytes, got %d",
+				p.MaxSize,
+				p.AvgSize,
+			)
+		}
+		return nil
+	default:
+		return Errorf("unknown chunking mode %q", p.Mode)
+	}
+}
+
+// NewChunker returns a chunker that splits `r` according to the policy.
+// `table` is only used by `ChunkingModeGearCDC`.
+func (p ChunkingPolicy) NewChunker(r io.Reader, table GearCDCTable) Chunker { //nolint:ireturn
+	if p.Mode == ChunkingModeFixed {
+		return NewFixedSizeChunker(r, p.MaxSize)
+	}
+	return NewGearCDC(r, uint64(p.AvgSize-1), p.MinSize, p.MaxSize, table) //nolint:gosec
+}
+
+func (p ChunkingPolicy) String() string {
+	if p.Mode == ChunkingModeFixed {
+		return fmt.Sprintf("%s (size %d)", p.Mode, p.MaxSize)
+	}
+	return fmt.Sprintf("%s (min %d, avg %d, max %d)", p.Mode, p.MinSize, p.AvgSize, p.MaxSize)
+}
+
+// Return the `[chunking]` section of the repository config. Repositories
+// created before the section existed use `DefaultChunkingPolicy`.
+func ParseChunkingPolicy(toml Toml) (ChunkingPolicy, error) {
+	mode, ok := toml.GetValue(chunkingSection, "mode")
+	if !ok {
+		return DefaultChunkingPolicy(), nil
+	}
+	policy := ChunkingPolicy{ChunkingMode(mode), 0, 0, 0}
+	intValue := func(key string, value *int) error {
+		v, ok := toml.GetIntValue(chunkingSection, key)
+		if !ok {
+			return Errorf("missing or invalid key `%s.%s` in repository config", chunkingSection, key)
+		}
+		*value = v
+		return nil
+	}
+	if err := intValue("max-size", &policy.MaxSize); err != nil {
+		return ChunkingPolicy{}, err
+	}
+	if policy.Mode == ChunkingModeGearCDC {
+		if err := intValue("min-size", &policy.MinSize); err != nil {
+			return ChunkingPolicy{}, err
+		}
+		if err := intValue("avg-size", &policy.AvgSize); err != nil {
+			return ChunkingPolicy{}, err
+		}
+	}
+	if err := policy.Validate(); err != nil {
+		return ChunkingPolicy{}, WrapErrorf(err, "invalid chunking policy in repository config")
+	}
+	return policy, nil
+}
+
+func createChunkingConfig(policy ChunkingPolicy) map[string]string {
+	section := map[string]string{
+		"mode":     string(policy.Mode),
+		"max-size": fmt.Sprintf("%d", policy.MaxSize),
+	}
+	if policy.Mode == ChunkingModeGearCDC {
+		section["min-size"] = fmt.Sprintf("%d", policy.MinSize)
+		section["avg-size"] = fmt.Sprintf("%d", policy.AvgSize)
+	}
+	return section
+}
+
+type Chunker interface {
+	// Return the next chunk or `io.EOF` after the last one.
+	// The returned slice is only valid until the next call.
+	Read() ([]byte, error)
+}
+
+var (
+	_ Chunker = (*GearCDC)(nil)
+	_ Chunker = (*FixedSizeChunker)(nil)
+)
+
+type FixedSizeChunker struct {
+	r   io.Reader
+	buf []byte
+}
+
+func NewFixedSizeChunker(r io.Reader, size int) *FixedSizeChunker {
+	return &FixedSizeChunker{r, make([]byte, size)}
+}
+
+func (c *FixedSizeChunker) Read() ([]byte, error) {
+	n, err := io.ReadFull(c.r, c.buf)
+	if errors.Is(err, io.EOF) {
+		return nil, io.EOF
+	}
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, WrapErrorf(err, "failed to read from underlying reader")
+	}
+	return c.buf[:n], nil
+}
@@ -0,0 +1,83 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestChunkingPolicy(t *testing.T) {
+	t.Parallel()
+	t.Run("Fixed-size chunks", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		input := strings.Repeat("a", 2*MinChunkSize) + "bc"
+		sut := NewFixedChunkingPolicy(MinChunkSize).NewChunker(bytes.NewBufferString(input), GearCDCTable{})
+		sizes := []int{}
+		for {
+			chunk, err := sut.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			assert.NoError(err)
+			sizes = append(sizes, len(chunk))
+		}
+		assert.Equal([]int{MinChunkSize, MinChunkSize, 2}, sizes)
+	})
+
+	t.Run("Round trip through the repository config", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		for _, policy := range []ChunkingPolicy{
+			DefaultChunkingPolicy(),
+			NewFixedChunkingPolicy(1024 * 1024),
+			{ChunkingModeGearCDC, 64 * 1024, 256 * 1024, 1024 * 1024},
+		} {
+			toml := Toml{chunkingSection: createChunkingConfig(policy)}
+			parsed, err := ParseChunkingPolicy(toml)
+			assert.NoError(err)
+			assert.Equal(policy, parsed)
+		}
+		// Repositories without a `[chunking]` section use the defaults.
+		parsed, err := ParseChunkingPolicy(Toml{})
+		assert.NoError(err)
+		assert.Equal(DefaultChunkingPolicy(), parsed)
+	})
+
+	t.Run("Invalid policies are rejected", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		assert.Error(NewFixedChunkingPolicy(MaxBlockDataSize+1).Validate(), "the chunk size must be between")
+		assert.Error(NewFixedChunkingPolicy(1).Validate(), "the chunk size must be between")
+		policy := ChunkingPolicy{ChunkingModeGearCDC, 64 * 1024, 100 * 1024, 1024 * 1024}
+		assert.Error(policy.Validate(), "must be a power of two")
+		policy = ChunkingPolicy{ChunkingModeGearCDC, 2 * 1024 * 1024, 256 * 1024, 1024 * 1024}
+		assert.Error(policy.Validate(), "the minimum chunk size must be between")
+		policy = ChunkingPolicy{"rabin", 0, 0, 1024 * 1024}
+		assert.Error(policy.Validate(), `unknown chunking mode "rabin"`)
+		_, err := ParseChunkingPolicy(Toml{chunkingSection: {"mode": "gear-cdc", "max-size": "1048576"}})
+		assert.Error(err, "missing or invalid key `chunking.min-size`")
+	})
+
+	t.Run("The policy is stored in the repository config", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		storage, err := NewFileStorage(td.NewFS(t), StoragePurposeRepository)
+		assert.NoError(err)
+		opts := &RepositoryOptions{NewFixedChunkingPolicy(1024 * 1024)}
+		_, err = InitNewRepositoryWithOptions(t.Context(), storage, []byte("testpassphrase"), opts)
+		assert.NoError(err)
+		// Changing the passphrase keeps the policy.
+		err = AddPassphrase(t.Context(), storage, []byte("testpassphrase"), "laptop", []byte("second passphrase"))
+		assert.NoError(err)
+		sut, err := OpenRepository(t.Context(), storage, []byte("second passphrase"))
+		assert.NoError(err)
+		assert.Equal(NewFixedChunkingPolicy(1024*1024), sut.ChunkingPolicy())
+
+		opts = &RepositoryOptions{NewFixedChunkingPolicy(1)}
+		_, err = InitNewRepositoryWithOptions(t.Context(), storage, []byte("testpassphrase"), opts)
+		assert.Error(err, "invalid chunking policy")
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"os"
 	"time"
 )
 
@@ -11,10 +12,15 @@ var ErrEmptyCommit = Errorf("empty commit")
 
 type Commit struct {
 	BaseRevision RevisionId
-	repository   *Repository
-	tempWriter   *TempWriter[*RevisionEntry]
-	tmpFS        FS
-	ensureDirs   []RevisionEntry
+	// How long to wait for the head lock, see `Repository.SetLockRetry`.
+	LockRetry  LockRetry
+	repository *Repository
+	tempWriter *TempWriter[*RevisionEntry]
+	tmpFS      FS
+	ensureDirs []RevisionEntry
+	// Counted by `Add` and completed by `Commit`.
+	stats CommitStats
+	start time.Time
 }
 
 func NewCommit(ctx context.Context, repository *Repository, tmpFS FS) (*Commit, error) {
@@ -23,14 +29,34 @@ func NewCommit(ctx context.Context, repository *Repository, tmpFS FS) (*Commit,
 		return nil, WrapErrorf(err, "failed to read head revision")
 	}
 	tempWriter := NewRevisionEntryTempWriter(tmpFS, DefaultTempChunkSize)
-	return &Commit{head, repository, tempWriter, tmpFS, nil}, nil
+	return &Commit{
+		head, repository.lockRetry, repository, tempWriter, tmpFS, nil, CommitStats{}, time.Now(),
+	}, nil
 }
 
 func (c *Commit) Add(entry *RevisionEntry) error {
 	if c.tempWriter == nil {
 		return Errorf("commit is closed")
 	}
-	return c.tempWriter.Add(entry)
+	if err := c.tempWriter.Add(entry); err != nil {
+		return err
+	}
+	if entry.Metadata.FileMode.IsDir() {
+		return nil
+	}
+	switch entry.Kind {
+	case RevisionEntryKindAdd:
+		c.stats.FilesAdded++
+	case RevisionEntryKindUpdate:
+		c.stats.FilesUpdated++
+	case RevisionEntryKindDelete:
+		c.stats.FilesDeleted++
+		return nil
+	}
+	if entry.Metadata.FileMode.IsRegular() {
+		c.stats.RawBytes += entry.Metadata.Size
+	}
+	return nil
 }
 
 // Make sure that the directory `path` exists in the current head of the repository.
@@ -80,7 +106,10 @@ func (c *Commit) EnsureDirExists(
 		if found {
 			break
 		}
-		c.ensureDirs = append(c.ensureDirs, RevisionEntry{Kind: RevisionEntryKindAdd, Path: p, Metadata: md})
+		c.ensureDirs = append(
+			c.ensureDirs,
+			RevisionEntry{Kind: RevisionEntryKindAdd, Path: p, Metadata: md, RenamedFrom: nil},
+		)
 		p = p.Dir()
 	}
 	return nil
@@ -89,9 +118,15 @@ func (c *Commit) EnsureDirExists(
 type CommitInfo struct {
 	Author  string
 	Message string
+	// The size of the blocks written for the files of the commit, see
+	// `Repository.WriteBlock`. Only the caller knows which blocks belong to
+	// the commit.
+	StoredBytes int64
 }
 
 // Return `ErrHeadChanged` if the head has changed during the commit.
+// Return a `*LockExistsError` if the head lock is held by another client
+// after the retries of `LockRetry`.
 // Return `ErrEmptyCommit` if the commit is empty.
 // A `Commit` is single-use: any call after the first closes it, so further
 // `Add` / `Commit` calls return "commit is closed".
@@ -117,39 +152,90 @@ func (c *Commit) Commit(ctx context.Context, info *CommitInfo) (RevisionId, erro
 	if sorted.Chunks() == 0 {
 		return RevisionId{}, ErrEmptyCommit
 	}
+	blockIds, err := writeRevisionEntryChunks(ctx, c.repository, sorted)
+	if err != nil {
+		return RevisionId{}, err
+	}
+	stats := c.stats
+	stats.StoredBytes = info.StoredBytes
+	stats.DurationMs = time.Since(c.start).Milliseconds()
+	stats.Hostname = commitHostname()
+	revision := &Revision{ //nolint:exhaustruct
+		Timestamp:        NewTimestampNow(),
+		Message:          &info.Message,
+		Author:           &info.Author,
+		ParentRevisionId: c.BaseRevision,
+		BlockIds:         blockIds,
+		Stats:            &stats,
+	}
+	if c.repository.clientId != "" {
+		clientId := c.repository.clientId
+		revision.ClientId = &clientId
+	}
+	revisionId, err := c.repository.writeRevision(ctx, revision, c.LockRetry)
+	if err != nil {
+		return RevisionId{}, WrapErrorf(err, "failed to write revision")
+	}
+	return revisionId, nil
+}
+
+// Return the hostname for `CommitStats.Hostname`, empty if it is unknown.
+func commitHostname() string {
+	hostname, err := os.Hostname() //nolint:forbidigo
+	if err != nil {
+		return ""
+	}
+	if len(hostname) > 0xFF {
+		hostname = hostname[:0xFF]
+	}
+	return hostname
+}
+
+// Write every chunk of the sorted entries as a block and return the block ids
+// for `Revision.BlockIds`.
+func writeRevisionEntryChunks(
+	ctx context.Context,
+	repository *Repository,
+	sorted *Temp[*RevisionEntry],
+) ([]BlockId, error) {
 	blockIds := []BlockId{}
+	// The marshalled chunks are written in batches of `WriteBlocksBatchSize`.
+	var batch [][]byte
+	batchSize := 0
+	flush := func() error {
+		ids, _, err := repository.WriteBlocks(ctx, batch)
+		if err != nil {
+			return WrapErrorf(err, "failed to write revision entry chunk blocks")
+		}
+		blockIds = append(blockIds, ids...)
+		batch, batchSize = nil, 0
+		return nil
+	}
 	sortedReader := sorted.Reader(nil)
 	buf := NewBlockBuf()
-	writeBuf := NewBlockBuf()
 	for i := range sorted.Chunks() {
 		entries, err := sortedReader.ReadChunk(i, buf)
 		if err != nil {
-			return RevisionId{}, WrapErrorf(err, "failed to read sorted chunk %d", i)
+			return nil, WrapErrorf(err, "failed to read sorted chunk %d", i)
 		}
 		chunk := &RevisionEntryChunk{Entries: entries}
 		blockBuf := make([]byte, chunk.MarshallSize())
 		pw := NewProtobufWriter(blockBuf)
 		if err := chunk.Marshall(pw); err != nil {
-			return RevisionId{}, WrapErrorf(err, "failed to marshall revision entry chunk")
+			return nil, WrapErrorf(err, "failed to marshall revision entry chunk")
 		}
-		blockId, _, err := c.repository.WriteBlock(ctx, pw.Bytes(), writeBuf)
-		if err != nil {
-			return RevisionId{}, WrapErrorf(err, "failed to write revision entry chunk block")
+		batch = append(batch, pw.Bytes())
+		batchSize += len(pw.Bytes())
+		if batchSize >= WriteBlocksBatchSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
 		}
-		blockIds = append(blockIds, blockId)
 	}
-	revision := &Revision{ //nolint:exhaustruct
-		Timestamp:        NewTimestampNow(),
-		Message:          &info.Message,
-		Author:           &info.Author,
-		ParentRevisionId: c.BaseRevision,
-		BlockIds:         blockIds,
+	if err := flush(); err != nil {
+		return nil, err
 	}
-	revisionId, err := c.repository.WriteRevision(ctx, revision)
-	if err != nil {
-		return RevisionId{}, WrapErrorf(err, "failed to write revision")
-	}
-	return revisionId, nil
+	return blockIds, nil
 }
 
 func (c *Commit) appendEnsureDirs(sorted *Temp[*RevisionEntry]) (*Temp[*RevisionEntry], error) {
@@ -160,7 +246,7 @@ func (c *Commit) appendEnsureDirs(sorted *Temp[*RevisionEntry]) (*Temp[*Revision
 		return nil, WrapErrorf(err, "failed to create temporary directory")
 	}
 	tempWriter := NewRevisionEntryTempWriter(tmpFS, DefaultTempChunkSize)
-	cache, err := NewRevisionEntryTempCache(sorted, 10)
+	cache, err := NewRevisionEntryTempCache(sorted, TempCacheOptions{})
 	if err != nil {
 		return nil, WrapErrorf(err, "failed to create revision temp cache")
 	}
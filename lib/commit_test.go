@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"io/fs"
+	"os"
 	"testing"
 )
 
@@ -50,6 +51,58 @@ func TestCommit(t *testing.T) {
 		assert.Equal([]*RevisionEntry{e4}, entries)
 	})
 
+	t.Run("Statistics", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+
+		commit, err := NewCommit(t.Context(), r.Repository, td.NewFS(t))
+		assert.NoError(err)
+		assert.NoError(commit.Add(td.RevisionEntryExt("a", RevisionEntryKindAdd, 0o700|FileModeDir, "")))
+		assert.NoError(commit.Add(td.RevisionEntryExt("a/1.txt", RevisionEntryKindAdd, 0o600, "1")))
+		assert.NoError(commit.Add(td.RevisionEntryExt("a/2.txt", RevisionEntryKindUpdate, 0o600, "22")))
+		assert.NoError(commit.Add(td.RevisionEntryExt("a/3.txt", RevisionEntryKindDelete, 0o600, "333")))
+		revisionId, err := commit.Commit(
+			t.Context(),
+			&CommitInfo{Author: "test author", Message: "test message", StoredBytes: 42},
+		)
+		assert.NoError(err)
+
+		revision, err := r.ReadRevision(t.Context(), revisionId, NewBlockBuf())
+		assert.NoError(err)
+		hostname, err := os.Hostname()
+		assert.NoError(err)
+		stats := *revision.Stats
+		assert.Equal(true, stats.DurationMs >= 0)
+		stats.DurationMs = 0
+		assert.Equal(CommitStats{1, 1, 1, 3, 42, 0, hostname}, stats)
+	})
+
+	t.Run("Client id", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+
+		commit, err := NewCommit(t.Context(), r.Repository, td.NewFS(t))
+		assert.NoError(err)
+		assert.NoError(commit.Add(td.RevisionEntry("a.txt", RevisionEntryKindAdd)))
+		revisionId, err := commit.Commit(t.Context(), td.CommitInfo())
+		assert.NoError(err)
+		revision, err := r.ReadRevision(t.Context(), revisionId, NewBlockBuf())
+		assert.NoError(err)
+		assert.Nil(revision.ClientId)
+
+		r.SetClientId("laptop")
+		commit, err = NewCommit(t.Context(), r.Repository, td.NewFS(t))
+		assert.NoError(err)
+		assert.NoError(commit.Add(td.RevisionEntry("b.txt", RevisionEntryKindAdd)))
+		revisionId, err = commit.Commit(t.Context(), td.CommitInfo())
+		assert.NoError(err)
+		revision, err = r.ReadRevision(t.Context(), revisionId, NewBlockBuf())
+		assert.NoError(err)
+		assert.Equal("laptop", *revision.ClientId)
+	})
+
 	t.Run("Empty commit", func(t *testing.T) {
 		t.Parallel()
 		assert := NewAssert(t)
@@ -133,7 +186,7 @@ func TestCommitEnsureDirExists(t *testing.T) {
 
 		snapshot, err := NewRevisionSnapshot(t.Context(), r.Repository, r.Head(), td.NewFS(t))
 		assert.NoError(err)
-		snapshotCache, err := NewRevisionEntryTempCache(snapshot, 10)
+		snapshotCache, err := NewRevisionEntryTempCache(snapshot, TempCacheOptions{})
 		assert.NoError(err)
 
 		err = commit.EnsureDirExists(dir, snapshotCache, r.Head())
@@ -195,7 +248,7 @@ func TestCommitEnsureDirExists(t *testing.T) {
 
 		snapshot, err := NewRevisionSnapshot(t.Context(), r.Repository, r.Head(), td.NewFS(t))
 		assert.NoError(err)
-		snapshotCache, err := NewRevisionEntryTempCache(snapshot, 10)
+		snapshotCache, err := NewRevisionEntryTempCache(snapshot, TempCacheOptions{})
 		assert.NoError(err)
 
 		err = commit.EnsureDirExists(Path{"a"}, snapshotCache, r.Head())
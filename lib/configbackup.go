@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+)
+
+// The repository config (`repository.toml`) is all that is needed to derive
+// the repository keys from the passphrase - losing it means losing all data.
+// That's why a copy of it is kept as a control file, encrypted with the
+// user-key. The passphrase-derivation settings are stored in plaintext in
+// front of the ciphertext, so that the copy can be decrypted without the
+// original file.
+// Every key slot has its own copy, encrypted with the user-key of the slot.
+const repositoryConfigBackupFileName = "repository-config"
+
+func repositoryConfigBackupName(slot string) string {
+	if slot == DefaultKeySlot {
+		return repositoryConfigBackupFileName
+	}
+	return repositoryConfigBackupFileName + "-slot-" + slot
+}
+
+var ErrRepositoryConfigBackupNotFound = Errorf("repository config backup not found")
+
+// Write the copy of `config` for the key slot `slot` unless an identical
+// copy exists. `userKey` is the user-key of the slot.
+func backupRepositoryConfig(ctx context.Context, storage Storage, config Toml, slot string, userKey RawKey) error {
+	mki, err := parseRepositoryConfig(config)
+	if err != nil {
+		return WrapErrorf(err, "failed to parse repository config")
+	}
+	argon2id := mki.Argon2id
+	if slot != DefaultKeySlot {
+		s, ok := mki.KeySlots[slot]
+		if !ok {
+			return WrapErrorf(ErrKeySlotNotFound, "no key slot %q in repository config", slot)
+		}
+		argon2id = s.Argon2id
+	}
+	cipher, err := NewCipher(userKey)
+	if err != nil {
+		return WrapErrorf(err, "failed to create a XChaCha20Poly1305 cipher from user-key")
+	}
+	var plaintext bytes.Buffer
+	if err := WriteToml(&plaintext, RepositoryConfigHeaderComment, config); err != nil {
+		return WrapErrorf(err, "failed to marshal repository config")
+	}
+	aad := masterKeyAAD(argon2id.Salt, aadConfigBackup)
+	name := repositoryConfigBackupName(slot)
+	existing, err := storage.ReadControlFile(ctx, ControlFileSectionSecurity, name)
+	if err != nil && !errors.Is(err, ErrControlFileNotFound) {
+		return WrapErrorf(err, "failed to read repository config backup")
+	}
+	if err == nil {
+		// If the passphrase was changed, decryption fails and the backup is replaced.
+		_, ciphertext, _ := bytes.Cut(existing, []byte("\n"))
+		decrypted, err := Decrypt(ciphertext, cipher, aad, make([]byte, len(ciphertext)))
+		if err == nil && bytes.Equal(decrypted, plaintext.Bytes()) {
+			return nil
+		}
+	}
+	ciphertext, err := Encrypt(plaintext.Bytes(), cipher, aad, make([]byte, plaintext.Len()+TotalCipherOverhead))
+	if err != nil {
+		return WrapErrorf(err, "failed to encrypt repository config backup")
+	}
+	data := append([]byte(argon2id.Marshal()+"\n"), ciphertext...)
+	if err := storage.WriteControlFile(ctx, ControlFileSectionSecurity, name, data); err != nil {
+		return WrapErrorf(err, "failed to write repository config backup")
+	}
+	return nil
+}
+
+// ReadRepositoryConfigBackup decrypts the copy of the repository config that
+// `OpenRepository` keeps in `storage` for the key slot `passphrase` belongs
+// to. This works without the original config, i.e. `storage.Open` is not
+// called.
+// Return `ErrRepositoryConfigBackupNotFound` if there is no backup.
+func ReadRepositoryConfigBackup(ctx context.Context, storage Storage, passphrase []byte) (Toml, error) {
+	names, err := storage.ListControlFiles(ctx, ControlFileSectionSecurity)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to list repository config backups")
+	}
+	// The backup of the default key slot is tried first.
+	var firstErr error
+	for _, name := range names {
+		if name != repositoryConfigBackupFileName {
+			continue
+		}
+		toml, err := readRepositoryConfigBackup(ctx, storage, name, passphrase)
+		if err == nil {
+			return toml, nil
+		}
+		firstErr = err
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, repositoryConfigBackupName("")) {
+			continue
+		}
+		toml, err := readRepositoryConfigBackup(ctx, storage, name, passphrase)
+		if err == nil {
+			return toml, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		return nil, ErrRepositoryConfigBackupNotFound
+	}
+	return nil, firstErr
+}
+
+func readRepositoryConfigBackup(ctx context.Context, storage Storage, name string, passphrase []byte) (Toml, error) {
+	data, err := storage.ReadControlFile(ctx, ControlFileSectionSecurity, name)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to read repository config backup")
+	}
+	passphraseDerivation, ciphertext, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return nil, Errorf("invalid repository config backup")
+	}
+	argon2id, err := UnmarshalArgon2idConfig(string(passphraseDerivation))
+	if err != nil {
+		return nil, WrapErrorf(err, "invalid passphrase derivation in repository config backup")
+	}
+	userKey, err := DeriveUserKey(passphrase, argon2id)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to derive user-key from passphrase")
+	}
+	defer clear(userKey[:])
+	cipher, err := NewCipher(userKey)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to create a XChaCha20Poly1305 cipher from user-key")
+	}
+	plaintext, err := Decrypt(
+		ciphertext,
+		cipher,
+		masterKeyAAD(argon2id.Salt, aadConfigBackup),
+		make([]byte, len(ciphertext)),
+	)
+	if err != nil {
+		return nil, WrapErrorKindf(ErrAuth, err, "failed to decrypt repository config backup (wrong passphrase?)")
+	}
+	toml, err := ReadToml(bytes.NewReader(plaintext))
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to parse repository config backup")
+	}
+	return toml, nil
+}
@@ -0,0 +1,52 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestRepositoryConfigBackup(t *testing.T) {
+	t.Parallel()
+	t.Run("Happy path", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		fs := td.NewFS(t)
+		r := td.NewTestRepository(t, fs)
+		config, err := r.Storage.Open(t.Context())
+		assert.NoError(err)
+		assert.Equal(true, config.Eq(r.Config()))
+
+		// The backup survives the loss of the original config.
+		assert.NoError(fs.Remove(r.Storage.configFilePath()))
+		_, err = r.Storage.Open(t.Context())
+		assert.ErrorIs(err, ErrStorageNotFound)
+		backup, err := ReadRepositoryConfigBackup(t.Context(), r.Storage, []byte(r.Passphrase))
+		assert.NoError(err)
+		assert.Equal(true, config.Eq(backup))
+	})
+
+	t.Run("Wrong passphrase", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		_, err := ReadRepositoryConfigBackup(t.Context(), r.Storage, []byte("wrong passphrase"))
+		assert.Error(err, "wrong passphrase?")
+	})
+
+	t.Run("The backup is created when an existing repository is opened", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		fs := td.NewFS(t)
+		r := td.NewTestRepository(t, fs)
+		assert.NoError(r.Storage.DeleteControlFile(
+			t.Context(),
+			ControlFileSectionSecurity,
+			repositoryConfigBackupFileName,
+		))
+		_, err := ReadRepositoryConfigBackup(t.Context(), r.Storage, []byte(r.Passphrase))
+		assert.ErrorIs(err, ErrRepositoryConfigBackupNotFound)
+		td.OpenRepository(t, fs)
+		backup, err := ReadRepositoryConfigBackup(t.Context(), r.Storage, []byte(r.Passphrase))
+		assert.NoError(err)
+		assert.Equal(true, r.Config().Eq(backup))
+	})
+}
@@ -0,0 +1,198 @@
+package lib
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+)
+
+// DiskUsage is the size of a file or of a directory with everything below
+// it, see `ComputeDiskUsage`.
+type DiskUsage struct {
+	Path Path
+	// Number of regular files.
+	Files int
+	// Sum of the sizes of the files.
+	LogicalSize int64
+	// Number of distinct blocks of the files. A block shared by two files
+	// (or twice by the same file) is only counted once.
+	UniqueBlocks int
+	// The stored (compressed and encrypted) size of the unique blocks, i.e.
+	// the deduplicated size, or -1 if the storage cannot tell (see
+	// `BlockSizer`).
+	StoredSize int64
+}
+
+type DiskUsageReport struct {
+	// The usage of `DiskUsageOptions.Path`.
+	Total DiskUsage
+	// The largest directories below `DiskUsageOptions.Path` (by logical size,
+	// largest first).
+	Directories []DiskUsage
+	// The largest files below `DiskUsageOptions.Path`, largest first.
+	Files []DiskUsage
+}
+
+type DiskUsageOptions struct {
+	RevisionId RevisionId
+	// The paths are reported relative to `PathPrefix`, paths outside of it
+	// are skipped.
+	PathPrefix Path
+	// Only count the paths below this directory (relative to `PathPrefix`).
+	Path Path
+	// The number of `DiskUsageReport.Directories` and
+	// `DiskUsageReport.Files` to return.
+	Top int
+}
+
+// ComputeDiskUsage adds up the sizes of the files of a revision per
+// directory, like `du`. Only the revision metadata is read, no file data.
+func ComputeDiskUsage( //nolint:funlen
+	ctx context.Context,
+	repository *Repository,
+	tmpFS FS,
+	opts DiskUsageOptions,
+) (*DiskUsageReport, error) {
+	root := opts.PathPrefix.Join(opts.Path)
+	snapshot, err := NewFilteredRevisionSnapshot(ctx, repository, opts.RevisionId, tmpFS, root.AsFilter())
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to create revision snapshot")
+	}
+	defer snapshot.Remove() //nolint:errcheck
+	sizer, canSize := repository.storage.(BlockSizer)
+	newUsage := func(path Path) *DiskUsage {
+		usage := &DiskUsage{path, 0, 0, 0, 0}
+		if !canSize {
+			usage.StoredSize = -1
+		}
+		return usage
+	}
+	total := newUsage(opts.Path)
+	directories := map[Path]*DiskUsage{}
+	files := []DiskUsage{}
+	// The directory of the last file that referenced a block and the stored
+	// size of the block.
+	type blockUsage struct {
+		dir  Path
+		size int64
+	}
+	blocks := map[BlockId]blockUsage{}
+	reader := snapshot.Reader(nil)
+	buf := NewBlockBuf()
+	for {
+		re, err := reader.Read(buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to read revision snapshot")
+		}
+		path, ok := re.Path.TrimBase(opts.PathPrefix)
+		if !ok || !re.Metadata.FileMode.IsRegular() {
+			continue
+		}
+		// The usages of the file and of all its directories up to `total`.
+		file := newUsage(path)
+		usages := []*DiskUsage{total}
+		for _, dir := range dirsDownTo(path.Dir(), opts.Path) {
+			usage, ok := directories[dir]
+			if !ok {
+				usage = newUsage(dir)
+				directories[dir] = usage
+			}
+			usages = append(usages, usage)
+		}
+		usages = append(usages, file)
+		seen := map[BlockId]struct{}{}
+		for _, blockId := range re.Metadata.BlockIds {
+			if _, ok := seen[blockId]; ok {
+				continue
+			}
+			seen[blockId] = struct{}{}
+			block, ok := blocks[blockId]
+			// The snapshot is sorted so that everything below a directory
+			// comes in one piece. So the block was already counted for the
+			// directories that also contain its last file, and only the
+			// directories below them (and the file) count it for the first
+			// time.
+			counted := 0
+			if ok {
+				counted = 1 + commonDirCount(block.dir, path.Dir(), opts.Path)
+			} else if canSize {
+				size, err := sizer.BlockSize(ctx, blockId)
+				if err != nil {
+					return nil, WrapErrorf(err, "failed to get size of block %s of %s", blockId, path)
+				}
+				block.size = size
+			}
+			block.dir = path.Dir()
+			blocks[blockId] = block
+			for _, usage := range usages[counted:] {
+				usage.UniqueBlocks++
+				if canSize {
+					usage.StoredSize += block.size
+				}
+			}
+		}
+		for _, usage := range usages {
+			usage.Files++
+			usage.LogicalSize += re.Metadata.Size
+		}
+		files = addLargestUsage(files, *file, opts.Top)
+	}
+	report := &DiskUsageReport{*total, []DiskUsage{}, files}
+	for _, usage := range directories {
+		report.Directories = addLargestUsage(report.Directories, *usage, opts.Top)
+	}
+	return report, nil
+}
+
+// Return the directories from below `root` down to `dir`, e.g. `a`, `a/b`
+// for `a/b` and an empty root.
+func dirsDownTo(dir Path, root Path) []Path {
+	var dirs []Path
+	for ; dir != root && !dir.IsEmpty(); dir = dir.Dir() {
+		dirs = append(dirs, dir)
+	}
+	slices.Reverse(dirs)
+	return dirs
+}
+
+// Return the number of directories below `root` that contain (or are) both
+// of the directories `a` and `b`.
+func commonDirCount(a, b Path, root Path) int {
+	n := 0
+	for _, dir := range dirsDownTo(a, root) {
+		if b != dir && !b.IsRelativeTo(dir) {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// Insert `usage` into `largest` (sorted by logical size, largest first, then
+// by path) and keep at most `n` entries.
+func addLargestUsage(largest []DiskUsage, usage DiskUsage, n int) []DiskUsage {
+	if n <= 0 {
+		return largest
+	}
+	compare := func(a, b DiskUsage) int {
+		if c := cmp.Compare(b.LogicalSize, a.LogicalSize); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Path.String(), b.Path.String())
+	}
+	i, _ := slices.BinarySearchFunc(largest, usage, compare)
+	if i >= n {
+		return largest
+	}
+	largest = slices.Insert(largest, i, usage)
+	if len(largest) > n {
+		largest = largest[:n]
+	}
+	return largest
+}
@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestComputeDiskUsage(t *testing.T) {
+	t.Parallel()
+	assert := NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	writeBlock := func(data string) BlockId {
+		blockId, _, err := r.WriteBlock(t.Context(), []byte(data), NewBlockBuf())
+		assert.NoError(err)
+		return blockId
+	}
+	blockIdA := writeBlock("aaa")
+	blockIdB := writeBlock("bb")
+	blockIdC := writeBlock("c")
+	blockSize := func(blockIds ...BlockId) int64 {
+		var sum int64
+		for _, blockId := range blockIds {
+			size, err := r.Storage.BlockSize(t.Context(), blockId)
+			assert.NoError(err)
+			sum += size
+		}
+		return sum
+	}
+	file := func(path string, size int64, blockIds ...BlockId) *RevisionEntry {
+		entry := td.RevisionEntry(path, RevisionEntryKindAdd)
+		entry.Metadata.Size = size
+		entry.Metadata.BlockIds = blockIds
+		return entry
+	}
+	dir := func(path string) *RevisionEntry {
+		return td.RevisionEntryExt(path, RevisionEntryKindAdd, 0o700|FileModeDir, "")
+	}
+	c, err := NewCommit(t.Context(), r.Repository, td.NewFS(t))
+	assert.NoError(err)
+	for _, entry := range []*RevisionEntry{
+		file("a.txt", 3, blockIdA),
+		dir("dir"),
+		file("dir/b.txt", 5, blockIdA, blockIdB),
+		dir("dir/sub"),
+		// A block referenced twice by the same file is only counted once.
+		file("dir/sub/c.txt", 5, blockIdB, blockIdC, blockIdC),
+		dir("other"),
+		file("other/d.txt", 3, blockIdA),
+	} {
+		assert.NoError(c.Add(entry))
+	}
+	revisionId, err := c.Commit(t.Context(), td.CommitInfo())
+	assert.NoError(err)
+
+	t.Run("Whole revision", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut, err := ComputeDiskUsage(
+			t.Context(),
+			r.Repository,
+			td.NewFS(t),
+			DiskUsageOptions{revisionId, Path{}, Path{}, 2},
+		)
+		assert.NoError(err)
+		assert.Equal(DiskUsage{Path{}, 4, 16, 3, blockSize(blockIdA, blockIdB, blockIdC)}, sut.Total)
+		assert.Equal([]DiskUsage{
+			{td.Path("dir"), 2, 10, 3, blockSize(blockIdA, blockIdB, blockIdC)},
+			{td.Path("dir/sub"), 1, 5, 2, blockSize(blockIdB, blockIdC)},
+		}, sut.Directories)
+		assert.Equal([]DiskUsage{
+			{td.Path("dir/b.txt"), 1, 5, 2, blockSize(blockIdA, blockIdB)},
+			{td.Path("dir/sub/c.txt"), 1, 5, 2, blockSize(blockIdB, blockIdC)},
+		}, sut.Files)
+	})
+
+	t.Run("Path and path prefix", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut, err := ComputeDiskUsage(
+			t.Context(),
+			r.Repository,
+			td.NewFS(t),
+			DiskUsageOptions{revisionId, td.Path("dir"), td.Path("sub"), 10},
+		)
+		assert.NoError(err)
+		assert.Equal(DiskUsage{td.Path("sub"), 1, 5, 2, blockSize(blockIdB, blockIdC)}, sut.Total)
+		assert.Equal([]DiskUsage{}, sut.Directories)
+		assert.Equal([]DiskUsage{
+			{td.Path("sub/c.txt"), 1, 5, 2, blockSize(blockIdB, blockIdC)},
+		}, sut.Files)
+	})
+}
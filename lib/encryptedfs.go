@@ -0,0 +1,249 @@
+package lib
+
+import (
+	"bufio"
+	cryptoCipher "crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// The size of the plaintext of a segment of a file of `EncryptedFS`.
+const encryptedFSSegmentSize = 64 * 1024
+
+// EncryptedFS encrypts the content of the files written to it. With
+// `NewEncryptedFS`, the key only lives in memory. Use it for temporary files
+// that must not be readable once the process is gone, e.g. the sorted chunks
+// of a `TempWriter` with the paths and hashes of a revision. The files
+// cannot be read by anyone else, not even by another `EncryptedFS` on the
+// same directory.
+//
+// A file is split into segments of 64 KiB that are encrypted one by one.
+// The index of a segment and whether it is the last one are authenticated,
+// so the segments can neither be reordered nor cut off. Files have to be
+// written and read sequentially. Everything but the content (names, sizes,
+// modes, ...) is passed through, `Stat` returns the size of the ciphertext.
+type EncryptedFS struct {
+	FS
+	cipher cryptoCipher.AEAD
+}
+
+// NewEncryptedFS wraps `fs` with a new random key.
+func NewEncryptedFS(fs FS) (*EncryptedFS, error) {
+	key, err := NewRawKey()
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptedFSWithKey(fs, key)
+}
+
+// NewEncryptedFSWithKey wraps `fs` with `key`, so that the files can be read
+// again by another `EncryptedFS` with the same key, e.g. a cache that
+// outlives the process.
+func NewEncryptedFSWithKey(fs FS, key RawKey) (*EncryptedFS, error) {
+	cipher, err := NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedFS{fs, cipher}, nil
+}
+
+func (f *EncryptedFS) OpenWrite(name string) (io.WriteCloser, error) {
+	w, err := f.FS.OpenWrite(name)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	return newEncryptedFileWriter(w, f.cipher), nil
+}
+
+func (f *EncryptedFS) OpenWriteExcl(name string) (io.WriteCloser, error) {
+	w, err := f.FS.OpenWriteExcl(name)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	return newEncryptedFileWriter(w, f.cipher), nil
+}
+
+// OpenAppend is not supported, the last segment of a file is sealed as the
+// last one. Return an error that matches `errors.ErrUnsupported`.
+func (f *EncryptedFS) OpenAppend(name string, size int64) (io.WriteCloser, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+}
+
+// OpenWriteAt is not supported, the segments can only be written in order.
+// Return an error that matches `errors.ErrUnsupported`.
+func (f *EncryptedFS) OpenWriteAt(name string) (FileWriterAt, error) { //nolint:ireturn
+	return nil, &fs.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+}
+
+// FSync syncs what was written to the underlying file so far. The last
+// segment is only written on `Close`.
+func (f *EncryptedFS) FSync(file io.WriteCloser) error {
+	if ew, ok := file.(*encryptedFileWriter); ok {
+		file = ew.w
+	}
+	return f.FS.FSync(file) //nolint:wrapcheck
+}
+
+func (f *EncryptedFS) OpenRead(name string) (io.ReadCloser, error) {
+	r, err := f.FS.OpenRead(name)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	return &encryptedFileReader{ //nolint:exhaustruct
+		r:      r,
+		br:     bufio.NewReaderSize(r, encryptedFSSegmentSize+TotalCipherOverhead),
+		cipher: f.cipher,
+	}, nil
+}
+
+func (f *EncryptedFS) MkSub(path string) (FS, error) { //nolint:ireturn
+	sub, err := f.FS.MkSub(path)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	return &EncryptedFS{sub, f.cipher}, nil
+}
+
+func (f *EncryptedFS) Sub(path string) (FS, error) { //nolint:ireturn
+	sub, err := f.FS.Sub(path)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	return &EncryptedFS{sub, f.cipher}, nil
+}
+
+// The associated data of a segment.
+func encryptedFSSegmentAD(index uint64, last bool) []byte {
+	ad := binary.BigEndian.AppendUint64(make([]byte, 0, 9), index)
+	if last {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+type encryptedFileWriter struct {
+	w      io.WriteCloser
+	cipher cryptoCipher.AEAD
+	// The plaintext of the current segment.
+	segment []byte
+	sealed  []byte
+	index   uint64
+	closed  bool
+}
+
+func newEncryptedFileWriter(w io.WriteCloser, cipher cryptoCipher.AEAD) *encryptedFileWriter {
+	return &encryptedFileWriter{
+		w:       w,
+		cipher:  cipher,
+		segment: make([]byte, 0, encryptedFSSegmentSize),
+		sealed:  make([]byte, encryptedFSSegmentSize+TotalCipherOverhead),
+		index:   0,
+		closed:  false,
+	}
+}
+
+func (w *encryptedFileWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// A full segment is only written once there is more data, the last
+		// segment is written by `Close`.
+		if len(w.segment) == encryptedFSSegmentSize {
+			if err := w.writeSegment(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(w.segment[len(w.segment):encryptedFSSegmentSize], p)
+		w.segment = w.segment[:len(w.segment)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (w *encryptedFileWriter) writeSegment(last bool) error {
+	sealed, err := Encrypt(w.segment, w.cipher, encryptedFSSegmentAD(w.index, last), w.sealed)
+	if err != nil {
+		return WrapErrorf(err, "failed to encrypt segment %d", w.index)
+	}
+	if _, err := w.w.Write(sealed); err != nil {
+		return WrapErrorf(err, "failed to write segment %d", w.index)
+	}
+	w.segment = w.segment[:0]
+	w.index++
+	return nil
+}
+
+// Close writes the last segment, which is empty if the file is.
+func (w *encryptedFileWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if err := w.writeSegment(true); err != nil {
+		_ = w.w.Close()
+		return err
+	}
+	return w.w.Close() //nolint:wrapcheck
+}
+
+type encryptedFileReader struct {
+	r      io.ReadCloser
+	br     *bufio.Reader
+	cipher cryptoCipher.AEAD
+	sealed []byte
+	// The rest of the plaintext of the current segment.
+	plaintext []byte
+	index     uint64
+	last      bool
+}
+
+func (r *encryptedFileReader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
+		if err := r.readSegment(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
+
+func (r *encryptedFileReader) readSegment() error {
+	if r.sealed == nil {
+		r.sealed = make([]byte, encryptedFSSegmentSize+TotalCipherOverhead)
+	}
+	n, err := io.ReadFull(r.br, r.sealed)
+	last := false
+	switch {
+	case errors.Is(err, io.EOF):
+		return Errorf("encrypted file is truncated after segment %d", r.index)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		last = true
+	case err != nil:
+		return WrapErrorf(err, "failed to read segment %d", r.index)
+	default:
+		// A full segment is the last one if nothing follows.
+		if _, err := r.br.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		} else if err != nil {
+			return WrapErrorf(err, "failed to read segment %d", r.index)
+		}
+	}
+	plaintext, err := DecryptInPlace(r.sealed[:n], r.cipher, encryptedFSSegmentAD(r.index, last))
+	if err != nil {
+		return WrapErrorf(err, "failed to decrypt segment %d", r.index)
+	}
+	r.plaintext = plaintext
+	r.index++
+	r.last = last
+	return nil
+}
+
+func (r *encryptedFileReader) Close() error {
+	return r.r.Close() //nolint:wrapcheck
+}
@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"testing"
+)
+
+func TestEncryptedFS(t *testing.T) {
+	t.Parallel()
+
+	newSut := func(t *testing.T) (*EncryptedFS, FS) {
+		t.Helper()
+		underlying := NewMemoryFS(10_000_000)
+		sut, err := NewEncryptedFS(underlying)
+		NewAssert(t).NoError(err)
+		return sut, underlying
+	}
+	newData := func(t *testing.T, size int) []byte {
+		t.Helper()
+		data, err := Rand(size)
+		NewAssert(t).NoError(err)
+		return data
+	}
+
+	t.Run("Files are encrypted", func(t *testing.T) {
+		t.Parallel()
+		sizes := []int{
+			0, 1, encryptedFSSegmentSize - 1, encryptedFSSegmentSize, encryptedFSSegmentSize + 1,
+			3 * encryptedFSSegmentSize,
+		}
+		for _, size := range sizes {
+			assert := NewAssert(t)
+			sut, underlying := newSut(t)
+			data := newData(t, size)
+			f, err := sut.OpenWrite("a")
+			assert.NoError(err)
+			// Write in odd pieces.
+			for rest := data; len(rest) > 0; {
+				n := min(len(rest), 1000+len(rest)/3)
+				_, err := f.Write(rest[:n])
+				assert.NoError(err)
+				rest = rest[n:]
+			}
+			assert.NoError(f.Close())
+			assert.NoError(f.Close())
+			ciphertext, err := ReadFile(underlying, "a")
+			assert.NoError(err)
+			segments := max((size+encryptedFSSegmentSize-1)/encryptedFSSegmentSize, 1)
+			assert.Equal(size+segments*TotalCipherOverhead, len(ciphertext))
+			// A few bytes may well show up in the ciphertext by chance.
+			if size >= 16 {
+				assert.Equal(false, bytes.Contains(ciphertext, data[:min(size, 32)]))
+			}
+			got, err := ReadFile(sut, "a")
+			assert.NoError(err)
+			assert.Equal(data, got, "size %d", size)
+		}
+	})
+
+	t.Run("OpenAppend and OpenWriteAt are not supported", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut, underlying := newSut(t)
+		_, err := sut.OpenAppend("a.txt", -1)
+		assert.ErrorIs(err, errors.ErrUnsupported)
+		_, err = sut.OpenWriteAt("a.txt")
+		assert.ErrorIs(err, errors.ErrUnsupported)
+		_, err = underlying.Stat("a.txt")
+		assert.ErrorIs(err, fs.ErrNotExist)
+	})
+
+	t.Run("Sub and MkSub encrypt with the same key", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut, underlying := newSut(t)
+		sub, err := sut.MkSub("a/b")
+		assert.NoError(err)
+		assert.NoError(WriteFile(sub, "c", []byte("secret")))
+		sub, err = sut.Sub("a")
+		assert.NoError(err)
+		got, err := ReadFile(sub, "b/c")
+		assert.NoError(err)
+		assert.Equal([]byte("secret"), got)
+		ciphertext, err := ReadFile(underlying, "a/b/c")
+		assert.NoError(err)
+		assert.Equal(false, bytes.Contains(ciphertext, []byte("secret")))
+		assert.NoError(sut.Rename("a/b/c", "d"))
+		got, err = ReadFile(sut, "d")
+		assert.NoError(err)
+		assert.Equal([]byte("secret"), got)
+	})
+
+	t.Run("Files cannot be read with another key", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut, underlying := newSut(t)
+		assert.NoError(WriteFile(sut, "a", []byte("secret")))
+		other, err := NewEncryptedFS(underlying)
+		assert.NoError(err)
+		_, err = ReadFile(other, "a")
+		assert.Error(err, "failed to decrypt segment 0")
+	})
+
+	t.Run("Files can be read with the same key", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		underlying := NewMemoryFS(10_000_000)
+		key, err := NewRawKey()
+		assert.NoError(err)
+		sut, err := NewEncryptedFSWithKey(underlying, key)
+		assert.NoError(err)
+		assert.NoError(WriteFile(sut, "a", []byte("secret")))
+		same, err := NewEncryptedFSWithKey(underlying, key)
+		assert.NoError(err)
+		got, err := ReadFile(same, "a")
+		assert.NoError(err)
+		assert.Equal([]byte("secret"), got)
+	})
+
+	t.Run("Truncated or reordered files are detected", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut, underlying := newSut(t)
+		data := newData(t, 2*encryptedFSSegmentSize+10)
+		assert.NoError(WriteFile(sut, "a", data))
+		ciphertext, err := ReadFile(underlying, "a")
+		assert.NoError(err)
+		segment := encryptedFSSegmentSize + TotalCipherOverhead
+
+		// The last segment is cut off.
+		assert.NoError(WriteFile(underlying, "a", ciphertext[:2*segment]))
+		_, err = ReadFile(sut, "a")
+		assert.Error(err, "failed to decrypt segment 1")
+		assert.NoError(WriteFile(underlying, "a", ciphertext[:len(ciphertext)-1]))
+		_, err = ReadFile(sut, "a")
+		assert.Error(err, "failed to decrypt segment 2")
+		assert.NoError(WriteFile(underlying, "a", nil))
+		_, err = ReadFile(sut, "a")
+		assert.Error(err, "truncated")
+
+		// The first two segments are swapped.
+		swapped := bytes.Clone(ciphertext)
+		copy(swapped, ciphertext[segment:2*segment])
+		copy(swapped[segment:], ciphertext[:segment])
+		assert.NoError(WriteFile(underlying, "a", swapped))
+		_, err = ReadFile(sut, "a")
+		assert.Error(err, "failed to decrypt segment 0")
+	})
+
+	t.Run("TempWriter spills encrypted chunks", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut, underlying := newSut(t)
+		writer := NewRevisionEntryTempWriter(sut, 1000)
+		for i := range 100 {
+			assert.NoError(writer.Add(td.RevisionEntry(fmt.Sprintf("secret-%02d", 99-i), RevisionEntryKindAdd)))
+		}
+		temp, err := writer.Finalize()
+		assert.NoError(err)
+		assert.Equal(true, temp.Chunks() > 1)
+		assert.NoError(underlying.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+			assert.NoError(err)
+			if d.IsDir() {
+				return nil
+			}
+			ciphertext, err := ReadFile(underlying, path)
+			assert.NoError(err)
+			assert.Equal(false, bytes.Contains(ciphertext, []byte("secret")), path)
+			return nil
+		}))
+		reader := temp.Reader(nil)
+		buf := NewBlockBuf()
+		var paths []string
+		for {
+			re, err := reader.Read(buf)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			assert.NoError(err)
+			paths = append(paths, re.Path.String())
+		}
+		assert.Equal(100, len(paths))
+		assert.Equal("secret-00", paths[0])
+		assert.Equal("secret-99", paths[99])
+	})
+}
@@ -9,10 +9,30 @@ import (
 
 var ErrCancel = Errorf("operation cancelled")
 
+// The kinds of errors a caller might want to handle differently, e.g. the CLI
+// exits with a distinct code for each. They are attached with
+// `WrapErrorKindf` and tested with `errors.Is`.
+var (
+	// A passphrase, identity, recovery code, or the storage credentials were
+	// rejected.
+	ErrAuth = Errorf("authentication failed")
+	// Data in the repository could be read, but is invalid, e.g. a block fails
+	// to decrypt or does not match its id.
+	ErrCorrupt = Errorf("repository data is corrupt")
+	// Someone else holds a lock or changed the repository concurrently.
+	// Retrying later will likely succeed.
+	ErrContention = Errorf("repository is busy")
+	// The storage could not be reached.
+	ErrNetwork = Errorf("network error")
+)
+
 type WrappedError struct {
 	Msg      string
 	err      error
 	location string
+	// One of the error kinds above (or any other sentinel error), nil if the
+	// error has no kind.
+	kind error
 }
 
 func (w *WrappedError) Error() string {
@@ -24,6 +44,9 @@ func (w *WrappedError) Unwrap() error {
 }
 
 func (w *WrappedError) Is(target error) bool {
+	if w.kind != nil && errors.Is(w.kind, target) {
+		return true
+	}
 	return errors.Is(w.err, target)
 }
 
@@ -49,12 +72,21 @@ func WrapErrorf(err error, msg string, msgArgs ...any) *WrappedError {
 	return internalWrapErrorf(err, msg, msgArgs...)
 }
 
+// Same as `WrapErrorf`, but `errors.Is(err, kind)` holds for the result.
+// `err` may be nil.
+func WrapErrorKindf(kind error, err error, msg string, msgArgs ...any) *WrappedError {
+	w := internalWrapErrorf(err, msg, msgArgs...)
+	w.kind = kind
+	return w
+}
+
 func internalWrapErrorf(err error, msg string, msgArgs ...any) *WrappedError {
 	location := location(3)
 	return &WrappedError{
 		Msg:      fmt.Sprintf(msg, msgArgs...),
 		err:      err,
 		location: location,
+		kind:     nil,
 	}
 }
 
@@ -32,4 +32,15 @@ Error at error_test.go:18: and I am on top
 		assert.Equal(true, errors.Is(e1, io.EOF))
 		assert.Equal(true, errors.Is(e2, io.EOF))
 	})
+	t.Run("Error kinds", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		e1 := WrapErrorKindf(ErrCorrupt, io.EOF, "block is truncated")
+		e2 := WrapErrorf(e1, "failed to read block")
+		assert.Equal(true, errors.Is(e2, ErrCorrupt))
+		assert.Equal(true, errors.Is(e2, io.EOF))
+		assert.Equal(false, errors.Is(e2, ErrAuth))
+		assert.Equal(false, errors.Is(ErrCorrupt, e1))
+		assert.Equal(true, errors.Is(WrapErrorKindf(ErrNetwork, nil, "offline"), ErrNetwork))
+	})
 }
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+)
+
+type ExportTarOptions struct {
+	RevisionId RevisionId
+	// Matched against the paths relative to `PathPrefix`, nil for all paths.
+	PathFilter PathFilter
+	// Only paths below the prefix are exported, relative to it.
+	PathPrefix Path
+	// Compress the archive with gzip.
+	Gzip bool
+}
+
+// ExportTar writes the revision as a tar archive to `w`. The file mode, the
+// mtime, and the owner (if it was recorded) of every path are preserved.
+// Paths are written in the order of the revision snapshot, i.e. every
+// directory comes before its content.
+func ExportTar( //nolint:funlen
+	ctx context.Context,
+	repository *Repository,
+	w io.Writer,
+	opts *ExportTarOptions,
+	tmpFS FS,
+) error {
+	snapshot, err := NewFilteredRevisionSnapshot(ctx, repository, opts.RevisionId, tmpFS, opts.PathPrefix.AsFilter())
+	if err != nil {
+		return WrapErrorf(err, "failed to create revision snapshot")
+	}
+	defer snapshot.Remove() //nolint:errcheck
+	var gz *gzip.Writer
+	if opts.Gzip {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	reader := snapshot.Reader(nil)
+	buf := NewBlockBuf()
+	for {
+		entry, err := reader.Read(buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return WrapErrorf(err, "failed to read revision snapshot")
+		}
+		path, ok := entry.Path.TrimBase(opts.PathPrefix)
+		if !ok || path.IsEmpty() {
+			continue
+		}
+		md := &entry.Metadata
+		if opts.PathFilter != nil && !opts.PathFilter.Include(path, md.FileMode.IsDir()) {
+			continue
+		}
+		header, err := newTarHeader(entry, path)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return WrapErrorf(err, "failed to write tar header for %s", path)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		for _, blockId := range md.BlockIds {
+			data, err := repository.ReadBlock(ctx, blockId, buf)
+			if err != nil {
+				return WrapErrorf(err, "failed to read block %s of %s", blockId, path)
+			}
+			if _, err := tw.Write(data); err != nil {
+				return WrapErrorf(err, "failed to write %s", path)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return WrapErrorf(err, "failed to finish tar archive")
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return WrapErrorf(err, "failed to finish gzip stream")
+		}
+	}
+	return nil
+}
+
+func newTarHeader(entry *RevisionEntry, path Path) (*tar.Header, error) {
+	md := &entry.Metadata
+	mode := int64(md.FileMode.Perm())
+	if md.FileMode&FileModeSetUid != 0 {
+		mode |= 0o4000
+	}
+	if md.FileMode&FileModeSetGid != 0 {
+		mode |= 0o2000
+	}
+	if md.FileMode&FileModeSticky != 0 {
+		mode |= 0o1000
+	}
+	header := &tar.Header{ //nolint:exhaustruct
+		Name:    path.String(),
+		Mode:    mode,
+		ModTime: md.Mtime.Time(),
+		// PAX keeps the sub-second part of the mtime.
+		Format: tar.FormatPAX,
+	}
+	if md.Uid != nil && md.Gid != nil {
+		header.Uid = int(*md.Uid)
+		header.Gid = int(*md.Gid)
+	}
+	switch {
+	case md.FileMode.IsDir():
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+	case md.FileMode.IsSymlink():
+		if md.SymLinkTarget == nil {
+			return nil, Errorf("symlink %s has no target", entry.Path)
+		}
+		// Symlink targets are repository paths.
+		target, err := filepath.Rel(filepath.Dir(entry.Path.String()), md.SymLinkTarget.String())
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to compute symlink target of %s", entry.Path)
+		}
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = filepath.ToSlash(target)
+	default:
+		header.Typeflag = tar.TypeReg
+		header.Size = md.Size
+	}
+	return header, nil
+}
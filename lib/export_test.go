@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestExportTar(t *testing.T) {
+	t.Parallel()
+	setup := func(t *testing.T) *TestRepository {
+		t.Helper()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		dir := td.RevisionEntryExt("a", RevisionEntryKindAdd, FileModeDir|0o750, "")
+		file, _ := testEntry(t, r, "a/b.txt", "hello")
+		file.Metadata.FileMode = FileModeSetUid | 0o644
+		link := td.RevisionEntryExt("a/link", RevisionEntryKindAdd, FileModeSymlink|0o777, "")
+		other, _ := testEntry(t, r, "c.txt", "other")
+		_, err := testCommit(t, r.Repository, dir, file, link, other)
+		assert.NoError(err)
+		return r
+	}
+
+	t.Run("Happy path", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := setup(t)
+		var buf bytes.Buffer
+		opts := &ExportTarOptions{RevisionId: r.Head()} //nolint:exhaustruct
+		assert.NoError(ExportTar(t.Context(), r.Repository, &buf, opts, td.NewFS(t)))
+		headers, contents := readTestTar(t, &buf)
+		assert.Equal([]string{"c.txt", "a/", "a/b.txt", "a/link"}, tarNames(headers))
+		assert.Equal(int64(0o750), headers[1].Mode)
+		assert.Equal(byte(tar.TypeDir), headers[1].Typeflag)
+		assert.Equal(int64(0o4644), headers[2].Mode)
+		assert.Equal("hello", contents["a/b.txt"])
+		assert.Equal(time.Unix(4567890, 567890), headers[2].ModTime)
+		assert.Equal(7890, headers[2].Uid)
+		assert.Equal(890, headers[2].Gid)
+		assert.Equal(byte(tar.TypeSymlink), headers[3].Typeflag)
+		assert.Equal("../some/target", headers[3].Linkname)
+		assert.Equal("other", contents["c.txt"])
+	})
+
+	t.Run("Path prefix, filter, and gzip", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := setup(t)
+		var buf bytes.Buffer
+		filter := NewPathInclusionFilter([]string{"*.txt"})
+		opts := &ExportTarOptions{RevisionId: r.Head(), PathFilter: filter, PathPrefix: td.Path("a"), Gzip: true}
+		assert.NoError(ExportTar(t.Context(), r.Repository, &buf, opts, td.NewFS(t)))
+		gz, err := gzip.NewReader(&buf)
+		assert.NoError(err)
+		headers, contents := readTestTar(t, gz)
+		assert.Equal([]string{"b.txt"}, tarNames(headers))
+		assert.Equal("hello", contents["b.txt"])
+	})
+}
+
+func readTestTar(t *testing.T, r io.Reader) ([]*tar.Header, map[string]string) {
+	t.Helper()
+	assert := NewAssert(t)
+	tr := tar.NewReader(r)
+	var headers []*tar.Header
+	contents := map[string]string{}
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		assert.NoError(err)
+		headers = append(headers, header)
+		data, err := io.ReadAll(tr)
+		assert.NoError(err)
+		contents[header.Name] = string(data)
+	}
+	return headers, contents
+}
+
+func tarNames(headers []*tar.Header) []string {
+	names := make([]string, len(headers))
+	for i, header := range headers {
+		names[i] = header.Name
+	}
+	return names
+}
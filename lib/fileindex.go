@@ -0,0 +1,231 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"slices"
+)
+
+// The file index maps the hash of the content of a file to the ids of the
+// blocks it was split into. It lets a client commit a file that is already
+// in the repository, e.g. the same photo added on another machine, without
+// chunking and encrypting it again.
+//
+// The entries are keyed by an HMAC of the file hash, so the storage cannot
+// tell whether a known file is in the repository. They are spread over at
+// most 256 control files (buckets) in `ControlFileSectionFiles`, named after
+// the first byte of the key, and each bucket is encrypted as a whole with
+// the KEK.
+// A bucket is updated with `CompareAndSwapControlFile`. Once a bucket is
+// full, its oldest entries are dropped, so the index never grows beyond
+// 256 * `MaxControlFileSize`.
+
+// The purpose of the key the keys of the file index are derived with (see
+// `DeriveKey`).
+const fileIndexKeyPurpose = "file index"
+
+// The maximum number of block ids of a file in the file index. A single file
+// must not push most of the other entries out of its bucket.
+const MaxFileIndexBlockIds = MaxControlFileSize / 16 / BlockIdSize
+
+// How often `WriteFileIndex` retries if a bucket was changed concurrently.
+const fileIndexWriteAttempts = 3
+
+// The key (32 bytes), the number of block ids (4 bytes) and the block ids.
+const fileIndexEntryHeaderSize = 32 + 4
+
+var aadFileIndex = []byte("cling-sync/file-index") //nolint:gochecknoglobals
+
+type fileIndexEntry struct {
+	key      Sha256Hmac
+	blockIds []BlockId
+}
+
+func (e fileIndexEntry) size() int {
+	return fileIndexEntryHeaderSize + len(e.blockIds)*BlockIdSize
+}
+
+// WriteFileIndex records that the file with `fileHash` consists of
+// `blockIds`. Files without blocks or with more than `MaxFileIndexBlockIds`
+// blocks are not recorded. Neither is the file if its bucket keeps being
+// changed concurrently, the index is only a shortcut.
+func (r *Repository) WriteFileIndex(ctx context.Context, fileHash Sha256, blockIds []BlockId) error {
+	if len(blockIds) == 0 || len(blockIds) > MaxFileIndexBlockIds {
+		return nil
+	}
+	key, err := r.fileIndexKey(fileHash)
+	if err != nil {
+		return err
+	}
+	bucket := fileIndexBucket(key)
+	for range fileIndexWriteAttempts {
+		current, entries, err := r.readFileIndexBucket(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		i := slices.IndexFunc(entries, func(e fileIndexEntry) bool { return e.key == key })
+		if i >= 0 && slices.Equal(entries[i].blockIds, blockIds) {
+			return nil
+		}
+		if i >= 0 {
+			entries = slices.Delete(entries, i, i+1)
+		}
+		entries = append(entries, fileIndexEntry{key, blockIds})
+		size := TotalCipherOverhead
+		for _, entry := range entries {
+			size += entry.size()
+		}
+		// Drop the oldest entries until the bucket fits into a control file.
+		for size > MaxControlFileSize {
+			size -= entries[0].size()
+			entries = entries[1:]
+		}
+		plaintext := make([]byte, 0, size-TotalCipherOverhead)
+		for _, entry := range entries {
+			plaintext = append(plaintext, entry.key[:]...)
+			plaintext = binary.BigEndian.AppendUint32(plaintext, uint32(len(entry.blockIds))) //nolint:gosec
+			for _, blockId := range entry.blockIds {
+				plaintext = append(plaintext, blockId[:]...)
+			}
+		}
+		data, err := Encrypt(plaintext, r.kekCipher, fileIndexAAD(bucket), make([]byte, size))
+		if err != nil {
+			return WrapErrorf(err, "failed to encrypt the file index")
+		}
+		err = r.storage.CompareAndSwapControlFile(ctx, ControlFileSectionFiles, bucket, current, data)
+		if errors.Is(err, ErrControlFileChanged) {
+			continue
+		}
+		if err != nil {
+			return WrapErrorf(err, "failed to write the file index")
+		}
+		return nil
+	}
+	return nil
+}
+
+// ReadFileIndex returns the block ids of the file with `fileHash` and `size`
+// recorded by `WriteFileIndex`. Return false if the file is not in the index,
+// if not all of its blocks exist, or if their content does not have `size`
+// and `fileHash`.
+// This reads the whole bucket of the file (up to `MaxControlFileSize`),
+// checks the existence of the blocks with one `HasBlocks` and then reads all
+// of them. Anyone who can write the index could otherwise make every other
+// client commit the wrong content for the file.
+func (r *Repository) ReadFileIndex(ctx context.Context, fileHash Sha256, size int64) ([]BlockId, bool, error) {
+	key, err := r.fileIndexKey(fileHash)
+	if err != nil {
+		return nil, false, err
+	}
+	_, entries, err := r.readFileIndexBucket(ctx, fileIndexBucket(key))
+	if err != nil {
+		return nil, false, err
+	}
+	i := slices.IndexFunc(entries, func(e fileIndexEntry) bool { return e.key == key })
+	if i < 0 {
+		return nil, false, nil
+	}
+	blockIds := entries[i].blockIds
+	exists, err := r.HasBlocks(ctx, blockIds)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, ok := range exists {
+		if !ok {
+			return nil, false, nil
+		}
+	}
+	ok, err := r.verifyFileIndexEntry(ctx, blockIds, fileHash, size)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		slog.Warn("Ignoring file index entry whose blocks do not match the file", "blocks", len(blockIds))
+		return nil, false, nil
+	}
+	return blockIds, true, nil
+}
+
+// Return whether the content of `blockIds` has `size` and `fileHash`.
+func (r *Repository) verifyFileIndexEntry(
+	ctx context.Context,
+	blockIds []BlockId,
+	fileHash Sha256,
+	size int64,
+) (bool, error) {
+	hash := sha256.New()
+	total := int64(0)
+	buf := NewBlockBuf()
+	for _, blockId := range blockIds {
+		data, err := r.ReadBlock(ctx, blockId, buf)
+		if err != nil {
+			return false, WrapErrorf(err, "failed to read a block of the file index")
+		}
+		total += int64(len(data))
+		if total > size {
+			return false, nil
+		}
+		hash.Write(data)
+	}
+	return total == size && Sha256(hash.Sum(nil)) == fileHash, nil
+}
+
+// Return the encrypted content of the bucket (nil if it does not exist, as
+// expected by `CompareAndSwapControlFile`) and its entries, oldest first.
+func (r *Repository) readFileIndexBucket(ctx context.Context, bucket string) ([]byte, []fileIndexEntry, error) {
+	data, err := r.storage.ReadControlFile(ctx, ControlFileSectionFiles, bucket)
+	if errors.Is(err, ErrControlFileNotFound) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, WrapErrorf(err, "failed to read the file index")
+	}
+	current := bytes.Clone(data)
+	plaintext, err := DecryptInPlace(data, r.kekCipher, fileIndexAAD(bucket))
+	if err != nil {
+		return nil, nil, WrapErrorf(err, "failed to decrypt the file index")
+	}
+	var entries []fileIndexEntry
+	for len(plaintext) > 0 {
+		if len(plaintext) < fileIndexEntryHeaderSize {
+			return nil, nil, Errorf("invalid file index: truncated entry of %d bytes", len(plaintext))
+		}
+		entry := fileIndexEntry{key: Sha256Hmac(plaintext[:32]), blockIds: nil}
+		count := int(binary.BigEndian.Uint32(plaintext[32:]))
+		plaintext = plaintext[fileIndexEntryHeaderSize:]
+		if count == 0 || count > len(plaintext)/BlockIdSize {
+			return nil, nil, Errorf("invalid file index: %d block ids in %d bytes", count, len(plaintext))
+		}
+		entry.blockIds = make([]BlockId, count)
+		for i := range entry.blockIds {
+			entry.blockIds[i] = BlockId(plaintext[i*BlockIdSize : (i+1)*BlockIdSize])
+		}
+		plaintext = plaintext[count*BlockIdSize:]
+		entries = append(entries, entry)
+	}
+	return current, entries, nil
+}
+
+func (r *Repository) fileIndexKey(fileHash Sha256) (Sha256Hmac, error) {
+	key, err := r.DeriveKey(fileIndexKeyPurpose)
+	if err != nil {
+		return Sha256Hmac{}, err
+	}
+	defer clear(key[:])
+	return CalculateHmac(fileHash[:], key), nil
+}
+
+func fileIndexBucket(key Sha256Hmac) string {
+	return hex.EncodeToString(key[:1])
+}
+
+// The associated data binds the encrypted entries to the name of the
+// bucket, so that the storage cannot swap two buckets.
+func fileIndexAAD(bucket string) []byte {
+	return append(append([]byte{}, aadFileIndex...), bucket...)
+}
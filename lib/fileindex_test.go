@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestFileIndex(t *testing.T) {
+	t.Parallel()
+	t.Run("Happy path", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		blockIds, _, err := r.WriteBlocks(t.Context(), [][]byte{[]byte("a"), []byte("b")})
+		assert.NoError(err)
+		fileHash := CalculateSha256([]byte("ab"))
+
+		_, ok, err := r.ReadFileIndex(t.Context(), fileHash, 2)
+		assert.NoError(err)
+		assert.Equal(false, ok)
+
+		assert.NoError(r.WriteFileIndex(t.Context(), fileHash, blockIds))
+		indexed, ok, err := r.ReadFileIndex(t.Context(), fileHash, 2)
+		assert.NoError(err)
+		assert.Equal(true, ok)
+		assert.Equal(blockIds, indexed)
+
+		// The bucket is named after the key, not the file hash.
+		names, err := r.Storage.ListControlFiles(t.Context(), ControlFileSectionFiles)
+		assert.NoError(err)
+		key, err := r.fileIndexKey(fileHash)
+		assert.NoError(err)
+		assert.Equal([]string{hex.EncodeToString(key[:1])}, names)
+
+		// Files in the same bucket are added to it.
+		otherHash := fileHashInBucket(t, r.Repository, names[0])
+		assert.NoError(r.WriteFileIndex(t.Context(), otherHash, blockIds[:1]))
+		names, err = r.Storage.ListControlFiles(t.Context(), ControlFileSectionFiles)
+		assert.NoError(err)
+		assert.Equal(1, len(names))
+		_, entries, err := r.readFileIndexBucket(t.Context(), names[0])
+		assert.NoError(err)
+		assert.Equal(2, len(entries))
+		indexed, ok, err = r.ReadFileIndex(t.Context(), fileHash, 2)
+		assert.NoError(err)
+		assert.Equal(true, ok)
+		assert.Equal(blockIds, indexed)
+	})
+
+	t.Run("Blocks that do not match the file are not used", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		blockIds, _, err := r.WriteBlocks(t.Context(), [][]byte{[]byte("a"), []byte("b")})
+		assert.NoError(err)
+		fileHash := CalculateSha256([]byte("ab"))
+		assert.NoError(r.WriteFileIndex(t.Context(), fileHash, blockIds[:1]))
+		_, ok, err := r.ReadFileIndex(t.Context(), fileHash, 2)
+		assert.NoError(err)
+		assert.Equal(false, ok)
+		_, ok, err = r.ReadFileIndex(t.Context(), fileHash, 1)
+		assert.NoError(err)
+		assert.Equal(false, ok)
+
+		otherHash := CalculateSha256([]byte("ba"))
+		assert.NoError(r.WriteFileIndex(t.Context(), otherHash, blockIds))
+		_, ok, err = r.ReadFileIndex(t.Context(), otherHash, 2)
+		assert.NoError(err)
+		assert.Equal(false, ok)
+	})
+
+	t.Run("Files with missing blocks are not found", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		blockId, _, err := r.WriteBlock(t.Context(), []byte("a"), NewBlockBuf())
+		assert.NoError(err)
+		fileHash := CalculateSha256([]byte("ab"))
+		assert.NoError(r.WriteFileIndex(t.Context(), fileHash, []BlockId{blockId, td.BlockId("missing")}))
+		_, ok, err := r.ReadFileIndex(t.Context(), fileHash, 2)
+		assert.NoError(err)
+		assert.Equal(false, ok)
+	})
+
+	t.Run("Full buckets drop the oldest entries", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		blockIds := make([]BlockId, MaxFileIndexBlockIds)
+		for i := range blockIds {
+			blockIds[i] = td.BlockId(fmt.Sprintf("%d", i))
+		}
+		first := CalculateSha256([]byte("first"))
+		assert.NoError(r.WriteFileIndex(t.Context(), first, blockIds))
+		key, err := r.fileIndexKey(first)
+		assert.NoError(err)
+		bucket := fileIndexBucket(key)
+		// Every entry takes up a 16th of the bucket.
+		for range 16 {
+			fileHash := fileHashInBucket(t, r.Repository, bucket)
+			assert.NoError(r.WriteFileIndex(t.Context(), fileHash, blockIds))
+		}
+		_, entries, err := r.readFileIndexBucket(t.Context(), bucket)
+		assert.NoError(err)
+		assert.Equal(15, len(entries))
+		assert.Equal(false, slices.ContainsFunc(entries, func(e fileIndexEntry) bool { return e.key == key }))
+	})
+
+	t.Run("Buckets cannot be swapped", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		blockIds, _, err := r.WriteBlocks(t.Context(), [][]byte{[]byte("a")})
+		assert.NoError(err)
+		hashA, hashB := CalculateSha256([]byte("a")), CalculateSha256([]byte("b"))
+		assert.NoError(r.WriteFileIndex(t.Context(), hashA, blockIds))
+		keyA, err := r.fileIndexKey(hashA)
+		assert.NoError(err)
+		keyB, err := r.fileIndexKey(hashB)
+		assert.NoError(err)
+		assert.NotEqual(fileIndexBucket(keyA), fileIndexBucket(keyB))
+		data, err := r.Storage.ReadControlFile(t.Context(), ControlFileSectionFiles, fileIndexBucket(keyA))
+		assert.NoError(err)
+		assert.NoError(r.Storage.WriteControlFile(t.Context(), ControlFileSectionFiles, fileIndexBucket(keyB), data))
+		_, _, err = r.ReadFileIndex(t.Context(), hashB, 1)
+		assert.Error(err, "failed to decrypt the file index")
+	})
+}
+
+// Return a random file hash whose entry goes into `bucket`.
+func fileHashInBucket(t *testing.T, r *Repository, bucket string) Sha256 {
+	t.Helper()
+	assert := NewAssert(t)
+	for {
+		data, err := Rand(32)
+		assert.NoError(err)
+		fileHash := CalculateSha256(data)
+		key, err := r.fileIndexKey(fileHash)
+		assert.NoError(err)
+		if fileIndexBucket(key) == bucket {
+			return fileHash
+		}
+	}
+}
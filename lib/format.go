@@ -283,6 +283,150 @@ const (
 	FileModeSticky     FileMode = 0x4000
 )
 
+type Xattr struct {
+	Name  string
+	Value string
+}
+
+func (o *Xattr) Validate() error {
+	if len(o.Name) > 255 {
+		return Errorf("Xattr.Name must not be longer than 255")
+	}
+	if len(o.Value) > 65536 {
+		return Errorf("Xattr.Value must not be longer than 65536")
+	}
+	return nil
+}
+
+func (o *Xattr) Marshall(w ProtobufWriter) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	if err := w.WriteBytes(1, []byte(o.Name)); err != nil {
+		return err
+	}
+	if err := w.WriteBytes(2, []byte(o.Value)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (o *Xattr) MarshallSize() int {
+	sw := NewProtobufSizeWriter()
+	_ = o.Marshall(sw)
+	return sw.Size()
+}
+
+func UnmarshallXattr(r *ProtobufReader) (*Xattr, error) {
+	o := &Xattr{}
+	for !r.AtEnd() {
+		tag, wireType, err := r.ReadTag()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case 1:
+			if wireType != 2 {
+				return nil, Errorf("Xattr.Name: unexpected wire type %d, want 2", wireType)
+			}
+			b, err := r.ReadBytes()
+			if err != nil {
+				return nil, err
+			}
+			o.Name = string(b)
+		case 2:
+			if wireType != 2 {
+				return nil, Errorf("Xattr.Value: unexpected wire type %d, want 2", wireType)
+			}
+			b, err := r.ReadBytes()
+			if err != nil {
+				return nil, err
+			}
+			o.Value = string(b)
+		default:
+			if err := r.Skip(wireType); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+type Hole struct {
+	Offset int64
+	Size   int64
+}
+
+func (o *Hole) Validate() error {
+	return nil
+}
+
+func (o *Hole) Marshall(w ProtobufWriter) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	if err := w.WriteTag(1, 0); err != nil {
+		return err
+	}
+	if err := w.WriteVarint(o.Offset); err != nil {
+		return err
+	}
+	if err := w.WriteTag(2, 0); err != nil {
+		return err
+	}
+	if err := w.WriteVarint(o.Size); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (o *Hole) MarshallSize() int {
+	sw := NewProtobufSizeWriter()
+	_ = o.Marshall(sw)
+	return sw.Size()
+}
+
+func UnmarshallHole(r *ProtobufReader) (*Hole, error) {
+	o := &Hole{}
+	for !r.AtEnd() {
+		tag, wireType, err := r.ReadTag()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case 1:
+			if wireType != 0 {
+				return nil, Errorf("Hole.Offset: unexpected wire type %d, want 0", wireType)
+			}
+			i, err := r.ReadVarint()
+			if err != nil {
+				return nil, err
+			}
+			o.Offset = i
+		case 2:
+			if wireType != 0 {
+				return nil, Errorf("Hole.Size: unexpected wire type %d, want 0", wireType)
+			}
+			i, err := r.ReadVarint()
+			if err != nil {
+				return nil, err
+			}
+			o.Size = i
+		default:
+			if err := r.Skip(wireType); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
 type PathMetadata struct {
 	FileMode      FileMode
 	Mtime         Timestamp
@@ -293,6 +437,9 @@ type PathMetadata struct {
 	Uid           *uint32
 	Gid           *uint32
 	Birthtime     *Timestamp
+	HardLinkGroup *Path
+	Xattrs        []*Xattr
+	Holes         []*Hole
 }
 
 func (o *PathMetadata) Validate() error {
@@ -302,6 +449,12 @@ func (o *PathMetadata) Validate() error {
 	if o.SymLinkTarget == nil && o.FileMode&FileModeSymlink != 0 {
 		return Errorf("PathMetadata.SymLinkTarget must be set")
 	}
+	if len(o.Xattrs) > 256 {
+		return Errorf("PathMetadata.Xattrs must not be longer than 256")
+	}
+	if len(o.Holes) > 1048576 {
+		return Errorf("PathMetadata.Holes must not be longer than 1048576")
+	}
 	return nil
 }
 
@@ -358,6 +511,21 @@ func (o *PathMetadata) Marshall(w ProtobufWriter) error {
 			return err
 		}
 	}
+	if o.HardLinkGroup != nil {
+		if err := w.WriteBytes(10, []byte((*o.HardLinkGroup).String())); err != nil {
+			return err
+		}
+	}
+	for _, v := range o.Xattrs {
+		if err := w.WriteMessage(11, v.Marshall); err != nil {
+			return err
+		}
+	}
+	for _, v := range o.Holes {
+		if err := w.WriteMessage(12, v.Marshall); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -477,6 +645,46 @@ func UnmarshallPathMetadata(r *ProtobufReader) (*PathMetadata, error) {
 				return nil, err
 			}
 			o.Birthtime = v
+		case 10:
+			if wireType != 2 {
+				return nil, Errorf("PathMetadata.HardLinkGroup: unexpected wire type %d, want 2", wireType)
+			}
+			b, err := r.ReadBytes()
+			if err != nil {
+				return nil, err
+			}
+			pv, err := NewPath(string(b))
+			if err != nil {
+				return nil, err
+			}
+			v := pv
+			o.HardLinkGroup = &v
+		case 11:
+			if wireType != 2 {
+				return nil, Errorf("PathMetadata.Xattrs: unexpected wire type %d, want 2", wireType)
+			}
+			b, err := r.ReadBytes()
+			if err != nil {
+				return nil, err
+			}
+			v, err := UnmarshallXattr(NewProtobufReader(b))
+			if err != nil {
+				return nil, err
+			}
+			o.Xattrs = append(o.Xattrs, v)
+		case 12:
+			if wireType != 2 {
+				return nil, Errorf("PathMetadata.Holes: unexpected wire type %d, want 2", wireType)
+			}
+			b, err := r.ReadBytes()
+			if err != nil {
+				return nil, err
+			}
+			v, err := UnmarshallHole(NewProtobufReader(b))
+			if err != nil {
+				return nil, err
+			}
+			o.Holes = append(o.Holes, v)
 		default:
 			if err := r.Skip(wireType); err != nil {
 				return nil, err
@@ -498,9 +706,10 @@ const (
 )
 
 type RevisionEntry struct {
-	Kind     RevisionEntryKind
-	Path     Path
-	Metadata PathMetadata
+	Kind        RevisionEntryKind
+	Path        Path
+	Metadata    PathMetadata
+	RenamedFrom *Path
 }
 
 func (o *RevisionEntry) Validate() error {
@@ -528,6 +737,11 @@ func (o *RevisionEntry) Marshall(w ProtobufWriter) error {
 	if err := w.WriteMessage(3, o.Metadata.Marshall); err != nil {
 		return err
 	}
+	if o.RenamedFrom != nil {
+		if err := w.WriteBytes(4, []byte((*o.RenamedFrom).String())); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -580,6 +794,20 @@ func UnmarshallRevisionEntry(r *ProtobufReader) (*RevisionEntry, error) {
 				return nil, err
 			}
 			o.Metadata = *v
+		case 4:
+			if wireType != 2 {
+				return nil, Errorf("RevisionEntry.RenamedFrom: unexpected wire type %d, want 2", wireType)
+			}
+			b, err := r.ReadBytes()
+			if err != nil {
+				return nil, err
+			}
+			pv, err := NewPath(string(b))
+			if err != nil {
+				return nil, err
+			}
+			v := pv
+			o.RenamedFrom = &v
 		default:
 			if err := r.Skip(wireType); err != nil {
 				return nil, err
@@ -710,6 +938,230 @@ func UnmarshallTempFrame(r *ProtobufReader) (*TempFrame, error) {
 	return o, nil
 }
 
+type RevisionSignature struct {
+	PublicKey Ed25519PublicKey
+	Signature Ed25519Signature
+}
+
+func (o *RevisionSignature) Validate() error {
+	return nil
+}
+
+func (o *RevisionSignature) Marshall(w ProtobufWriter) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	if err := w.WriteBytes(1, o.PublicKey[:]); err != nil {
+		return err
+	}
+	if err := w.WriteBytes(2, o.Signature[:]); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (o *RevisionSignature) MarshallSize() int {
+	sw := NewProtobufSizeWriter()
+	_ = o.Marshall(sw)
+	return sw.Size()
+}
+
+func UnmarshallRevisionSignature(r *ProtobufReader) (*RevisionSignature, error) {
+	o := &RevisionSignature{}
+	for !r.AtEnd() {
+		tag, wireType, err := r.ReadTag()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case 1:
+			if wireType != 2 {
+				return nil, Errorf("RevisionSignature.PublicKey: unexpected wire type %d, want 2", wireType)
+			}
+			b, err := r.ReadBytes()
+			if err != nil {
+				return nil, err
+			}
+			if len(b) != 32 {
+				return nil, Errorf("RevisionSignature.PublicKey must have length 32")
+			}
+			o.PublicKey = Ed25519PublicKey(b)
+		case 2:
+			if wireType != 2 {
+				return nil, Errorf("RevisionSignature.Signature: unexpected wire type %d, want 2", wireType)
+			}
+			b, err := r.ReadBytes()
+			if err != nil {
+				return nil, err
+			}
+			if len(b) != 64 {
+				return nil, Errorf("RevisionSignature.Signature must have length 64")
+			}
+			o.Signature = Ed25519Signature(b)
+		default:
+			if err := r.Skip(wireType); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+type CommitStats struct {
+	FilesAdded   uint32
+	FilesUpdated uint32
+	FilesDeleted uint32
+	RawBytes     int64
+	StoredBytes  int64
+	DurationMs   int64
+	Hostname     string
+}
+
+func (o *CommitStats) Validate() error {
+	if len(o.Hostname) > 255 {
+		return Errorf("CommitStats.Hostname must not be longer than 255")
+	}
+	return nil
+}
+
+func (o *CommitStats) Marshall(w ProtobufWriter) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	if err := w.WriteTag(1, 0); err != nil {
+		return err
+	}
+	if err := w.WriteVarint(int64(o.FilesAdded)); err != nil {
+		return err
+	}
+	if err := w.WriteTag(2, 0); err != nil {
+		return err
+	}
+	if err := w.WriteVarint(int64(o.FilesUpdated)); err != nil {
+		return err
+	}
+	if err := w.WriteTag(3, 0); err != nil {
+		return err
+	}
+	if err := w.WriteVarint(int64(o.FilesDeleted)); err != nil {
+		return err
+	}
+	if err := w.WriteTag(4, 0); err != nil {
+		return err
+	}
+	if err := w.WriteVarint(o.RawBytes); err != nil {
+		return err
+	}
+	if err := w.WriteTag(5, 0); err != nil {
+		return err
+	}
+	if err := w.WriteVarint(o.StoredBytes); err != nil {
+		return err
+	}
+	if err := w.WriteTag(6, 0); err != nil {
+		return err
+	}
+	if err := w.WriteVarint(o.DurationMs); err != nil {
+		return err
+	}
+	if err := w.WriteBytes(7, []byte(o.Hostname)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (o *CommitStats) MarshallSize() int {
+	sw := NewProtobufSizeWriter()
+	_ = o.Marshall(sw)
+	return sw.Size()
+}
+
+func UnmarshallCommitStats(r *ProtobufReader) (*CommitStats, error) {
+	o := &CommitStats{}
+	for !r.AtEnd() {
+		tag, wireType, err := r.ReadTag()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case 1:
+			if wireType != 0 {
+				return nil, Errorf("CommitStats.FilesAdded: unexpected wire type %d, want 0", wireType)
+			}
+			u, err := r.ReadUint32()
+			if err != nil {
+				return nil, err
+			}
+			o.FilesAdded = u
+		case 2:
+			if wireType != 0 {
+				return nil, Errorf("CommitStats.FilesUpdated: unexpected wire type %d, want 0", wireType)
+			}
+			u, err := r.ReadUint32()
+			if err != nil {
+				return nil, err
+			}
+			o.FilesUpdated = u
+		case 3:
+			if wireType != 0 {
+				return nil, Errorf("CommitStats.FilesDeleted: unexpected wire type %d, want 0", wireType)
+			}
+			u, err := r.ReadUint32()
+			if err != nil {
+				return nil, err
+			}
+			o.FilesDeleted = u
+		case 4:
+			if wireType != 0 {
+				return nil, Errorf("CommitStats.RawBytes: unexpected wire type %d, want 0", wireType)
+			}
+			i, err := r.ReadVarint()
+			if err != nil {
+				return nil, err
+			}
+			o.RawBytes = i
+		case 5:
+			if wireType != 0 {
+				return nil, Errorf("CommitStats.StoredBytes: unexpected wire type %d, want 0", wireType)
+			}
+			i, err := r.ReadVarint()
+			if err != nil {
+				return nil, err
+			}
+			o.StoredBytes = i
+		case 6:
+			if wireType != 0 {
+				return nil, Errorf("CommitStats.DurationMs: unexpected wire type %d, want 0", wireType)
+			}
+			i, err := r.ReadVarint()
+			if err != nil {
+				return nil, err
+			}
+			o.DurationMs = i
+		case 7:
+			if wireType != 2 {
+				return nil, Errorf("CommitStats.Hostname: unexpected wire type %d, want 2", wireType)
+			}
+			b, err := r.ReadBytes()
+			if err != nil {
+				return nil, err
+			}
+			o.Hostname = string(b)
+		default:
+			if err := r.Skip(wireType); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
 type Revision struct {
 	Magic            string
 	Timestamp        Timestamp
@@ -717,6 +1169,9 @@ type Revision struct {
 	Message          *string
 	Author           *string
 	BlockIds         []BlockId
+	Signature        *RevisionSignature
+	Stats            *CommitStats
+	ClientId         *string
 }
 
 func (o *Revision) Validate() error {
@@ -729,6 +1184,9 @@ func (o *Revision) Validate() error {
 	if len(o.BlockIds) > 65535 {
 		return Errorf("Revision.BlockIds must not be longer than 65535")
 	}
+	if o.ClientId != nil && len(*o.ClientId) > 64 {
+		return Errorf("Revision.ClientId must not be longer than 64")
+	}
 	return nil
 }
 
@@ -760,6 +1218,21 @@ func (o *Revision) Marshall(w ProtobufWriter) error {
 			return err
 		}
 	}
+	if o.Signature != nil {
+		if err := w.WriteMessage(7, (*o.Signature).Marshall); err != nil {
+			return err
+		}
+	}
+	if o.Stats != nil {
+		if err := w.WriteMessage(8, (*o.Stats).Marshall); err != nil {
+			return err
+		}
+	}
+	if o.ClientId != nil {
+		if err := w.WriteBytes(9, []byte((*o.ClientId))); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -843,6 +1316,42 @@ func UnmarshallRevision(r *ProtobufReader) (*Revision, error) {
 				return nil, Errorf("every entry in Revision.BlockIds must have length 32")
 			}
 			o.BlockIds = append(o.BlockIds, BlockId(b))
+		case 7:
+			if wireType != 2 {
+				return nil, Errorf("Revision.Signature: unexpected wire type %d, want 2", wireType)
+			}
+			b, err := r.ReadBytes()
+			if err != nil {
+				return nil, err
+			}
+			v, err := UnmarshallRevisionSignature(NewProtobufReader(b))
+			if err != nil {
+				return nil, err
+			}
+			o.Signature = v
+		case 8:
+			if wireType != 2 {
+				return nil, Errorf("Revision.Stats: unexpected wire type %d, want 2", wireType)
+			}
+			b, err := r.ReadBytes()
+			if err != nil {
+				return nil, err
+			}
+			v, err := UnmarshallCommitStats(NewProtobufReader(b))
+			if err != nil {
+				return nil, err
+			}
+			o.Stats = v
+		case 9:
+			if wireType != 2 {
+				return nil, Errorf("Revision.ClientId: unexpected wire type %d, want 2", wireType)
+			}
+			b, err := r.ReadBytes()
+			if err != nil {
+				return nil, err
+			}
+			v := string(b)
+			o.ClientId = &v
 		default:
 			if err := r.Skip(wireType); err != nil {
 				return nil, err
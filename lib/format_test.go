@@ -173,13 +173,27 @@ func TestFormatMarshall(t *testing.T) {
 		}
 	`)
 
-	msg, author := "hello", "alice"
+	msg, author, clientId := "hello", "alice", "laptop-1"
 	check("Revision fully set", &Revision{
 		Timestamp:        Timestamp{Sec: 1234567890, Nsec: 500000000},
 		ParentRevisionId: revisionId("a"),
 		Message:          &msg,
 		Author:           &author,
 		BlockIds:         []BlockId{blockId("b"), blockId("c")},
+		Signature: &RevisionSignature{
+			PublicKey: Ed25519PublicKey([]byte(strings.Repeat("d", 32))),
+			Signature: Ed25519Signature([]byte(strings.Repeat("e", 64))),
+		},
+		Stats: &CommitStats{
+			FilesAdded:   1,
+			FilesUpdated: 2,
+			FilesDeleted: 3,
+			RawBytes:     4,
+			StoredBytes:  5,
+			DurationMs:   6,
+			Hostname:     "laptop",
+		},
+		ClientId: &clientId,
 	}, UnmarshallRevision, `
 		timestamp {
 		  sec: 1234567890
@@ -190,6 +204,20 @@ func TestFormatMarshall(t *testing.T) {
 		author: "alice"
 		block_ids: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
 		block_ids: "cccccccccccccccccccccccccccccccc"
+		signature {
+		  public_key: "dddddddddddddddddddddddddddddddd"
+		  signature: "eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee"
+		}
+		stats {
+		  files_added: 1
+		  files_updated: 2
+		  files_deleted: 3
+		  raw_bytes: 4
+		  stored_bytes: 5
+		  duration_ms: 6
+		  hostname: "laptop"
+		}
+		client_id: "laptop-1"
 	`)
 }
 
@@ -208,6 +236,13 @@ func TestFormatUnmarshallLength(t *testing.T) {
 		_, err := UnmarshallPathMetadata(NewProtobufReader(w.Bytes()))
 		assert.Error(err, "every entry in PathMetadata.BlockIds must have length 32")
 	})
+	t.Run("RevisionSignature signature wrong length", func(t *testing.T) {
+		assert := NewAssert(t)
+		w := NewProtobufWriter(make([]byte, 4096))
+		assert.NoError(w.WriteBytes(2, make([]byte, 63)))
+		_, err := UnmarshallRevisionSignature(NewProtobufReader(w.Bytes()))
+		assert.Error(err, "RevisionSignature.Signature must have length 64")
+	})
 	t.Run("uint32 varint overflow", func(t *testing.T) {
 		assert := NewAssert(t)
 		w := NewProtobufWriter(make([]byte, 16))
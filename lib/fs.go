@@ -9,6 +9,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -33,6 +34,14 @@ type FS interface {
 	OpenWrite(name string) (io.WriteCloser, error)
 	// Return `fs.ErrExist` if the file already exists.
 	OpenWriteExcl(name string) (io.WriteCloser, error)
+	// Open the file for appending, create it if it does not exist. The file
+	// is truncated to `size` bytes first, e.g. to cut off a partial line
+	// that an interrupted writer left. A negative `size` keeps the whole
+	// file. Return `fs.ErrInvalid` if the file is shorter than `size`.
+	OpenAppend(name string, size int64) (io.WriteCloser, error)
+	// Open an existing file to change it in place. Return an error that
+	// matches `errors.ErrUnsupported` if the FS cannot do that.
+	OpenWriteAt(name string) (FileWriterAt, error)
 	FSync(file io.WriteCloser) error
 	FSyncDir(path string) error
 	OpenRead(name string) (io.ReadCloser, error)
@@ -42,6 +51,20 @@ type FS interface {
 	Stat(name string) (fs.FileInfo, error)
 	Symlink(target string, name string) error
 	ReadLink(name string) (string, error)
+	// Create `name` as a hard link to the file `oldname` (both relative to
+	// the root of the FS). Return an error that matches `errors.ErrUnsupported`
+	// if the FS cannot do that.
+	Link(oldname string, name string) error
+	// Return the extended attributes of a file or directory that can be
+	// restored, sorted by name. Return nothing if the FS does not support
+	// extended attributes.
+	Xattrs(name string) ([]*Xattr, error)
+	// Replace the extended attributes returned by `Xattrs` with `xattrs`.
+	SetXattrs(name string, xattrs []*Xattr) error
+	// Return the holes of a sparse file, sorted by offset. Return nothing if
+	// the file has none or the FS does not support sparse files. Use
+	// `NewSparseWriter` to recreate them.
+	Holes(name string) ([]*Hole, error)
 	ReadDir(name string) ([]fs.DirEntry, error)
 	Mkdir(name string) error
 	MkdirAll(path string) error
@@ -61,6 +84,13 @@ type FS interface {
 	Lock(ctx context.Context, path string) (unlock func() error, err error)
 }
 
+// A file opened with `FS.OpenWriteAt`. `*os.File` is one.
+type FileWriterAt interface {
+	io.WriterAt
+	io.Closer
+	Truncate(size int64) error
+}
+
 // MemoryFS is a complete in-memory file system modelled as a tree: each
 // directory node holds its children by base name, so a node and its subtree
 // list, move, and delete as a unit.
@@ -74,7 +104,14 @@ type memNode struct {
 	modTimeNSec int32
 	content     bytes.Buffer        // regular file data
 	linkTarget  string              // symlink target
+	xattrs      []*Xattr            // sorted by name
 	children    map[string]*memNode // non-nil iff this is a directory
+	// The part of `content` that is counted in `memShared.usedMemory`. The
+	// content is counted when its writer is closed.
+	usedMemory int64
+	// Set once the node is no longer in the tree, so that a writer that is
+	// still open does not count its content anymore.
+	removed bool
 }
 
 func newNode(mode fs.FileMode) *memNode {
@@ -161,8 +198,11 @@ func (r errorReader) Read(p []byte) (n int, err error) {
 	return 0, r.err
 }
 
+// The content of the node is not embedded, otherwise `io.Copy` and
+// `io.WriteString` would use the `ReadFrom` and `WriteString` of the buffer
+// and bypass the lock and the memory limit.
 type memoryFileWriter struct {
-	*bytes.Buffer
+	node   *memNode
 	shared *memShared
 	closed bool
 }
@@ -170,10 +210,44 @@ type memoryFileWriter struct {
 func (w *memoryFileWriter) Write(p []byte) (n int, err error) {
 	w.shared.mu.Lock()
 	defer w.shared.mu.Unlock()
-	if int64(w.Len()+len(p)) > w.shared.maxMemory {
+	if int64(w.node.content.Len()+len(p)) > w.shared.maxMemory {
 		return 0, WrapErrorf(io.ErrShortWrite, "memory limit of %d bytes exceeded", w.shared.maxMemory)
 	}
-	return w.Buffer.Write(p)
+	return w.node.content.Write(p) //nolint:wrapcheck
+}
+
+func (w *memoryFileWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.shared.mu.Lock()
+	defer w.shared.mu.Unlock()
+	if off < 0 {
+		return 0, Errorf("negative offset %d", off)
+	}
+	end := off + int64(len(p))
+	if end > w.shared.maxMemory {
+		return 0, WrapErrorf(io.ErrShortWrite, "memory limit of %d bytes exceeded", w.shared.maxMemory)
+	}
+	if grow := end - int64(w.node.content.Len()); grow > 0 {
+		w.node.content.Write(make([]byte, grow))
+	}
+	return copy(w.node.content.Bytes()[off:], p), nil
+}
+
+func (w *memoryFileWriter) Truncate(size int64) error {
+	w.shared.mu.Lock()
+	defer w.shared.mu.Unlock()
+	if size < 0 {
+		return Errorf("negative size %d", size)
+	}
+	if size > w.shared.maxMemory {
+		return WrapErrorf(io.ErrShortWrite, "memory limit of %d bytes exceeded", w.shared.maxMemory)
+	}
+	if grow := size - int64(w.node.content.Len()); grow > 0 {
+		w.node.content.Write(make([]byte, grow))
+	} else {
+		w.node.content.Truncate(int(size))
+	}
+	w.node.touch()
+	return nil
 }
 
 func (w *memoryFileWriter) Sync() error {
@@ -187,14 +261,21 @@ func (w *memoryFileWriter) Close() error {
 		return nil
 	}
 	w.closed = true
-	w.shared.usedMemory += int64(w.Len())
+	if !w.node.removed {
+		size := int64(w.node.content.Len())
+		w.shared.usedMemory += size - w.node.usedMemory
+		w.node.usedMemory = size
+	}
 	return nil
 }
 
 // memShared is the state shared by a MemoryFS and every view Sub/MkSub returns.
 // The views differ only in their `base` prefix.
+// `mu` guards the whole tree, the content of the files included, so that a
+// MemoryFS can be used from several goroutines. Operations that do not
+// change the tree only take the read lock and run in parallel.
 type memShared struct {
-	mu         sync.Mutex
+	mu         sync.RWMutex
 	root       *memNode
 	locks      map[string]chan struct{}
 	locksMutex sync.Mutex
@@ -233,14 +314,15 @@ func (f *MemoryFS) OpenWrite(name string) (io.WriteCloser, error) {
 			return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
 		}
 		// Truncate in place so mode and ownership survive, like O_TRUNC.
-		f.shared.usedMemory -= int64(node.content.Len())
+		f.shared.usedMemory -= node.usedMemory
+		node.usedMemory = 0
 		node.content.Reset()
 		node.touch()
-		return &memoryFileWriter{&node.content, f.shared, false}, nil
+		return &memoryFileWriter{node, f.shared, false}, nil
 	}
 	node := newNode(0o600)
 	parent.children[leaf] = node
-	return &memoryFileWriter{&node.content, f.shared, false}, nil
+	return &memoryFileWriter{node, f.shared, false}, nil
 }
 
 func (f *MemoryFS) OpenWriteExcl(name string) (io.WriteCloser, error) {
@@ -258,7 +340,59 @@ func (f *MemoryFS) OpenWriteExcl(name string) (io.WriteCloser, error) {
 	}
 	node := newNode(0o600)
 	parent.children[leaf] = node
-	return &memoryFileWriter{&node.content, f.shared, false}, nil
+	return &memoryFileWriter{node, f.shared, false}, nil
+}
+
+func (f *MemoryFS) OpenAppend(name string, size int64) (io.WriteCloser, error) {
+	f.shared.mu.Lock()
+	defer f.shared.mu.Unlock()
+	parent, leaf, err := f.shared.resolveParent(f.abs(name))
+	if err != nil {
+		return nil, err
+	}
+	node, ok := parent.children[leaf]
+	if !ok {
+		if size > 0 {
+			return nil, &fs.PathError{Op: "truncate", Path: name, Err: fs.ErrInvalid}
+		}
+		node = newNode(0o600)
+		parent.children[leaf] = node
+		return &memoryFileWriter{node, f.shared, false}, nil
+	}
+	if node.isSymlink() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: ErrIsSymlink}
+	}
+	if node.isDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	if size >= 0 {
+		if size > int64(node.content.Len()) {
+			return nil, &fs.PathError{Op: "truncate", Path: name, Err: fs.ErrInvalid}
+		}
+		// The content that is kept stays counted.
+		kept := min(node.usedMemory, size)
+		f.shared.usedMemory -= node.usedMemory - kept
+		node.usedMemory = kept
+		node.content.Truncate(int(size))
+		node.touch()
+	}
+	return &memoryFileWriter{node, f.shared, false}, nil
+}
+
+func (f *MemoryFS) OpenWriteAt(name string) (FileWriterAt, error) { //nolint:ireturn
+	f.shared.mu.Lock()
+	defer f.shared.mu.Unlock()
+	node, err := f.shared.resolve(f.abs(name))
+	if err != nil {
+		return nil, err
+	}
+	if node.isSymlink() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: ErrIsSymlink}
+	}
+	if node.isDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	return &memoryFileWriter{node, f.shared, false}, nil
 }
 
 func (f *MemoryFS) FSync(file io.WriteCloser) error {
@@ -266,15 +400,15 @@ func (f *MemoryFS) FSync(file io.WriteCloser) error {
 }
 
 func (f *MemoryFS) FSyncDir(path string) error {
-	f.shared.mu.Lock()
-	defer f.shared.mu.Unlock()
+	f.shared.mu.RLock()
+	defer f.shared.mu.RUnlock()
 	_, err := f.shared.resolve(f.abs(path))
 	return err
 }
 
 func (f *MemoryFS) OpenRead(name string) (io.ReadCloser, error) {
-	f.shared.mu.Lock()
-	defer f.shared.mu.Unlock()
+	f.shared.mu.RLock()
+	defer f.shared.mu.RUnlock()
 	node, err := f.shared.resolve(f.abs(name))
 	if err != nil {
 		return nil, err
@@ -334,8 +468,8 @@ func (f *MemoryFS) Chown(name string, uid int, gid int) error {
 }
 
 func (f *MemoryFS) Stat(name string) (fs.FileInfo, error) {
-	f.shared.mu.Lock()
-	defer f.shared.mu.Unlock()
+	f.shared.mu.RLock()
+	defer f.shared.mu.RUnlock()
 	abs := f.abs(name)
 	node, err := f.shared.resolve(abs)
 	if err != nil {
@@ -361,10 +495,45 @@ func (f *MemoryFS) Symlink(target string, name string) error {
 	return nil
 }
 
-func (f *MemoryFS) ReadLink(name string) (string, error) {
+// Link is not supported, a node belongs to exactly one directory.
+func (f *MemoryFS) Link(oldname string, name string) error {
+	return WrapErrorf(errors.ErrUnsupported, "hard links are not supported by MemoryFS")
+}
+
+func (f *MemoryFS) Xattrs(name string) ([]*Xattr, error) {
+	f.shared.mu.RLock()
+	defer f.shared.mu.RUnlock()
+	node, err := f.shared.resolve(f.abs(name))
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(node.xattrs), nil
+}
+
+// MemoryFS does not support sparse files.
+func (f *MemoryFS) Holes(name string) ([]*Hole, error) {
+	f.shared.mu.RLock()
+	defer f.shared.mu.RUnlock()
+	_, err := f.shared.resolve(f.abs(name))
+	return nil, err
+}
+
+func (f *MemoryFS) SetXattrs(name string, xattrs []*Xattr) error {
 	f.shared.mu.Lock()
 	defer f.shared.mu.Unlock()
 	node, err := f.shared.resolve(f.abs(name))
+	if err != nil {
+		return err
+	}
+	node.xattrs = slices.Clone(xattrs)
+	slices.SortFunc(node.xattrs, func(a, b *Xattr) int { return strings.Compare(a.Name, b.Name) })
+	return nil
+}
+
+func (f *MemoryFS) ReadLink(name string) (string, error) {
+	f.shared.mu.RLock()
+	defer f.shared.mu.RUnlock()
+	node, err := f.shared.resolve(f.abs(name))
 	if err != nil {
 		return "", err
 	}
@@ -375,8 +544,8 @@ func (f *MemoryFS) ReadLink(name string) (string, error) {
 }
 
 func (f *MemoryFS) ReadDir(name string) ([]fs.DirEntry, error) {
-	f.shared.mu.Lock()
-	defer f.shared.mu.Unlock()
+	f.shared.mu.RLock()
+	defer f.shared.mu.RUnlock()
 	node, err := f.shared.resolve(f.abs(name))
 	if err != nil {
 		return nil, err
@@ -426,7 +595,7 @@ func (f *MemoryFS) Remove(name string) error {
 	if node.isDir() && len(node.children) > 0 {
 		return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
 	}
-	f.shared.usedMemory -= int64(node.content.Len())
+	f.shared.usedMemory -= detachSubtree(node)
 	delete(parent.children, leaf)
 	return nil
 }
@@ -443,7 +612,7 @@ func (f *MemoryFS) RemoveAll(path string) error {
 	if !ok {
 		return nil
 	}
-	f.shared.usedMemory -= subtreeContentSize(node)
+	f.shared.usedMemory -= detachSubtree(node)
 	delete(parent.children, leaf)
 	return nil
 }
@@ -464,10 +633,13 @@ func (f *MemoryFS) Rename(oldpath, newpath string) error {
 		return err
 	}
 	if existing, ok := newParent.children[newLeaf]; ok {
+		if existing == node {
+			return nil
+		}
 		if existing.isDir() {
 			return fs.ErrExist
 		}
-		f.shared.usedMemory -= int64(existing.content.Len())
+		f.shared.usedMemory -= detachSubtree(existing)
 	}
 	delete(oldParent.children, oldLeaf)
 	newParent.children[newLeaf] = node
@@ -475,8 +647,8 @@ func (f *MemoryFS) Rename(oldpath, newpath string) error {
 }
 
 func (f *MemoryFS) Sub(path string) (FS, error) {
-	f.shared.mu.Lock()
-	defer f.shared.mu.Unlock()
+	f.shared.mu.RLock()
+	defer f.shared.mu.RUnlock()
 	abs := f.abs(path)
 	if _, err := f.shared.resolve(abs); err != nil {
 		return nil, err
@@ -501,10 +673,10 @@ func (f *MemoryFS) WalkDir(path string, fn fs.WalkDirFunc) error {
 		name string
 		info memFileInfo
 	}
-	f.shared.mu.Lock()
+	f.shared.mu.RLock()
 	start, err := f.shared.resolve(f.abs(path))
 	if err != nil {
-		f.shared.mu.Unlock()
+		f.shared.mu.RUnlock()
 		return err
 	}
 	entries := []walkEntry{}
@@ -518,7 +690,7 @@ func (f *MemoryFS) WalkDir(path string, fn fs.WalkDirFunc) error {
 		}
 	}
 	rec(start, path)
-	f.shared.mu.Unlock()
+	f.shared.mu.RUnlock()
 	skipDir := ""
 	for i := range entries {
 		e := &entries[i]
@@ -578,12 +750,9 @@ func (f *MemoryFS) Lock(ctx context.Context, path string) (func() error, error)
 	}
 	select {
 	case ch <- struct{}{}:
-		unlocked := false
+		var unlock sync.Once
 		return func() error {
-			if !unlocked {
-				unlocked = true
-				<-ch
-			}
+			unlock.Do(func() { <-ch })
 			return nil
 		}, nil
 	case <-ctx.Done():
@@ -596,7 +765,8 @@ func (f *MemoryFS) abs(name string) string {
 }
 
 // resolve returns the node at `abs`. A missing component yields fs.ErrNotExist,
-// descending through a non-directory yields ENOTDIR. Caller must hold s.mu.
+// descending through a non-directory yields ENOTDIR. Caller must hold s.mu
+// (the read lock is enough).
 func (s *memShared) resolve(abs string) (*memNode, error) {
 	node := s.root
 	for _, seg := range splitPath(abs) {
@@ -613,7 +783,7 @@ func (s *memShared) resolve(abs string) (*memNode, error) {
 }
 
 // resolveParent returns the parent directory node of `abs` and the final path
-// component. Caller must hold s.mu.
+// component. Caller must hold s.mu (the read lock is enough).
 func (s *memShared) resolveParent(abs string) (*memNode, string, error) {
 	parent, err := s.resolve(filepath.Dir(abs))
 	if err != nil {
@@ -627,7 +797,7 @@ func (s *memShared) resolveParent(abs string) (*memNode, string, error) {
 
 // mkdirAllLocked mirrors os.MkdirAll: create every missing component, no error
 // if the directory already exists, ENOTDIR if a component is a file. Caller
-// must hold s.mu.
+// must hold the write lock of s.mu.
 func (s *memShared) mkdirAllLocked(abs string) error {
 	node := s.root
 	for _, seg := range splitPath(abs) {
@@ -662,10 +832,12 @@ func sortedKeys(m map[string]*memNode) []string {
 	return keys
 }
 
-func subtreeContentSize(node *memNode) int64 {
-	total := int64(node.content.Len())
+// Mark `node` and its subtree as removed and return the memory they used.
+func detachSubtree(node *memNode) int64 {
+	node.removed = true
+	total := node.usedMemory
 	for _, child := range node.children {
-		total += subtreeContentSize(child)
+		total += detachSubtree(child)
 	}
 	return total
 }
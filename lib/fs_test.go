@@ -7,6 +7,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
 	"slices"
 	"strings"
 	"sync"
@@ -178,6 +179,50 @@ func TestMemoryFS(t *testing.T) {
 		assert.Equal(int64(10), sut.shared.usedMemory)
 	})
 
+	t.Run("OpenAppend counts the appended content and frees the truncated content", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := NewMemoryFS(20)
+
+		writeFile(t, sut, "a.txt", "1234567890")
+		w, err := sut.OpenAppend("a.txt", 4)
+		assert.NoError(err)
+		assert.Equal(int64(4), sut.shared.usedMemory)
+		_, err = w.Write([]byte("abc"))
+		assert.NoError(err)
+		assert.NoError(w.Close())
+		assert.Equal(int64(7), sut.shared.usedMemory)
+
+		w, err = sut.OpenAppend("a.txt", -1)
+		assert.NoError(err)
+		_, err = w.Write([]byte("1234567890123456"))
+		assert.ErrorIs(err, io.ErrShortWrite)
+		assert.NoError(w.Close())
+		assert.Equal(int64(7), sut.shared.usedMemory)
+	})
+
+	t.Run("OpenWriteAt counts the content when it is closed", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := NewMemoryFS(20)
+
+		writeFile(t, sut, "a.txt", "1234567890")
+		w, err := sut.OpenWriteAt("a.txt")
+		assert.NoError(err)
+		_, err = w.WriteAt([]byte("abc"), 12)
+		assert.NoError(err)
+		_, err = w.WriteAt([]byte("abc"), 18)
+		assert.ErrorIs(err, io.ErrShortWrite)
+		assert.NoError(w.Close())
+		assert.Equal(int64(15), sut.shared.usedMemory)
+
+		w, err = sut.OpenWriteAt("a.txt")
+		assert.NoError(err)
+		assert.NoError(w.Truncate(4))
+		assert.NoError(w.Close())
+		assert.Equal(int64(4), sut.shared.usedMemory)
+	})
+
 	t.Run("Concurrent FS operations are race-free", func(t *testing.T) {
 		t.Parallel()
 		assert := NewAssert(t)
@@ -219,6 +264,136 @@ func TestMemoryFS(t *testing.T) {
 		wg.Wait()
 	})
 
+	t.Run("io.Copy and io.WriteString go through the memory limit", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := NewMemoryFS(15)
+
+		w, err := sut.OpenWrite("a.txt")
+		assert.NoError(err)
+		_, err = io.Copy(w, onlyReader{strings.NewReader("1234567890")})
+		assert.NoError(err)
+		_, err = io.WriteString(w, "1234567890")
+		assert.ErrorIs(err, io.ErrShortWrite)
+		_, err = io.Copy(w, onlyReader{strings.NewReader("1234567890")})
+		assert.ErrorIs(err, io.ErrShortWrite)
+		assert.NoError(w.Close())
+		assert.Equal(int64(10), sut.shared.usedMemory)
+	})
+
+	t.Run("Files removed while they are written do not use memory", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := NewMemoryFS(20)
+
+		w, err := sut.OpenWrite("a.txt")
+		assert.NoError(err)
+		_, err = w.Write([]byte("1234567890"))
+		assert.NoError(err)
+		assert.NoError(sut.Remove("a.txt"))
+		assert.NoError(w.Close())
+		assert.Equal(int64(0), sut.shared.usedMemory)
+
+		// Two writers of the same file count it once.
+		w1, err := sut.OpenWrite("b.txt")
+		assert.NoError(err)
+		_, err = w1.Write([]byte("12345"))
+		assert.NoError(err)
+		w2, err := sut.OpenWrite("b.txt")
+		assert.NoError(err)
+		_, err = w2.Write([]byte("123"))
+		assert.NoError(err)
+		assert.NoError(w1.Close())
+		assert.NoError(w2.Close())
+		assert.Equal(int64(3), sut.shared.usedMemory)
+
+		assert.NoError(sut.Rename("b.txt", "b.txt"))
+		assert.Equal(int64(3), sut.shared.usedMemory)
+		data, err := ReadFile(sut, "b.txt")
+		assert.NoError(err)
+		assert.Equal("123", string(data))
+	})
+
+	t.Run("Concurrent writers and readers of the same file are race-free", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := NewMemoryFS(10000000)
+		sub, err := sut.MkSub("sub")
+		assert.NoError(err)
+
+		// Writers stream into the file (`io.Copy` and `io.WriteString` use
+		// the optional interfaces of the writer) while readers read it,
+		// through the root and through a view.
+		const workers = 8
+		var wg sync.WaitGroup
+		for i := range workers {
+			wg.Go(func() {
+				for range 200 {
+					w, err := sut.OpenWrite("sub/f.txt")
+					if err != nil {
+						continue
+					}
+					if i%2 == 0 {
+						_, _ = io.Copy(w, onlyReader{strings.NewReader("0123456789")})
+					} else {
+						_, _ = io.WriteString(w, "0123456789")
+					}
+					// Let the readers in while the file is open, even on a
+					// single CPU.
+					runtime.Gosched()
+					_ = w.Close()
+				}
+			})
+			wg.Go(func() {
+				for range 200 {
+					_, _ = ReadFile(sub, "f.txt")
+					_, _ = sub.Stat("f.txt")
+					_, _ = sut.ReadDir("sub")
+					runtime.Gosched()
+				}
+			})
+		}
+		wg.Wait()
+		data, err := ReadFile(sub, "f.txt")
+		assert.NoError(err)
+		assert.Equal(0, len(data)%10)
+	})
+
+	t.Run("Memory accounting is exact after concurrent operations", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := NewMemoryFS(10000000)
+		assert.NoError(sut.Mkdir("d"))
+
+		const workers = 16
+		var wg sync.WaitGroup
+		for w := range workers {
+			wg.Go(func() {
+				for i := range 100 {
+					name := fmt.Sprintf("d/f-%d.txt", (w+i)%8)
+					switch i % 4 {
+					case 0, 1:
+						_ = WriteFile(sut, name, []byte(strings.Repeat("x", w+1)))
+					case 2:
+						_ = sut.Rename(name, fmt.Sprintf("d/f-%d.txt", (w+i+1)%8))
+					case 3:
+						_ = sut.Remove(name)
+					}
+				}
+			})
+		}
+		wg.Wait()
+		var size int64
+		entries, err := sut.ReadDir("d")
+		assert.NoError(err)
+		for _, entry := range entries {
+			info, err := entry.Info()
+			assert.NoError(err)
+			size += info.Size()
+		}
+		assert.Equal(size, sut.shared.usedMemory)
+	})
+
 	t.Run("Lock with a cancelled context does not leak the lock", func(t *testing.T) {
 		t.Parallel()
 		assert := NewAssert(t)
@@ -332,6 +507,119 @@ func checkConsistency(t *testing.T, newSut func() FS) {
 		assert.Equal("ef", readFile(t, sut, "a.txt"))
 	})
 
+	t.Run("OpenAppend", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := newSut()
+
+		// A missing file is created.
+		w, err := sut.OpenAppend("a.txt", -1)
+		assert.NoError(err)
+		_, err = w.Write([]byte("abcd"))
+		assert.NoError(err)
+		assert.NoError(w.Close())
+		assert.Equal("abcd", readFile(t, sut, "a.txt"))
+
+		w, err = sut.OpenAppend("a.txt", -1)
+		assert.NoError(err)
+		_, err = io.WriteString(w, "ef")
+		assert.NoError(err)
+		_, err = w.Write([]byte("gh"))
+		assert.NoError(err)
+		assert.NoError(w.Close())
+		assert.Equal("abcdefgh", readFile(t, sut, "a.txt"))
+	})
+
+	t.Run("OpenAppend truncates the file to the given size", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := newSut()
+
+		writeFile(t, sut, "a.txt", "abcdef")
+		assert.NoError(sut.Chmod("a.txt", 0o755))
+		w, err := sut.OpenAppend("a.txt", 3)
+		assert.NoError(err)
+		_, err = w.Write([]byte("xy"))
+		assert.NoError(err)
+		assert.NoError(w.Close())
+		assert.Equal("abcxy", readFile(t, sut, "a.txt"))
+		stat, err := sut.Stat("a.txt")
+		assert.NoError(err)
+		assert.Equal(int64(5), stat.Size())
+		assert.Equal(fs.FileMode(0o755), stat.Mode().Perm())
+
+		w, err = sut.OpenAppend("a.txt", 0)
+		assert.NoError(err)
+		assert.NoError(w.Close())
+		assert.Equal("", readFile(t, sut, "a.txt"))
+
+		w, err = sut.OpenAppend("b.txt", 0)
+		assert.NoError(err)
+		assert.NoError(w.Close())
+		assert.Equal("", readFile(t, sut, "b.txt"))
+	})
+
+	t.Run("OpenAppend with a size larger than the file should fail", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := newSut()
+
+		writeFile(t, sut, "a.txt", "abc")
+		_, err := sut.OpenAppend("a.txt", 4)
+		assert.ErrorIs(err, fs.ErrInvalid)
+		assert.Equal("abc", readFile(t, sut, "a.txt"))
+	})
+
+	t.Run("OpenAppend on a directory should fail", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := newSut()
+
+		assert.NoError(sut.Mkdir("mydir"))
+		_, err := sut.OpenAppend("mydir", -1)
+		assert.ErrorIs(err, syscall.EISDIR)
+		_, err = sut.OpenAppend("missing/a.txt", -1)
+		assert.ErrorIs(err, fs.ErrNotExist)
+	})
+
+	t.Run("OpenWriteAt changes the file in place", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := newSut()
+
+		writeFile(t, sut, "a.txt", "abcdef")
+		assert.NoError(sut.Chmod("a.txt", 0o755))
+		w, err := sut.OpenWriteAt("a.txt")
+		assert.NoError(err)
+		_, err = w.WriteAt([]byte("XY"), 1)
+		assert.NoError(err)
+		_, err = w.WriteAt([]byte("Z"), 8)
+		assert.NoError(err)
+		assert.NoError(w.Close())
+		assert.Equal("aXYdef\x00\x00Z", readFile(t, sut, "a.txt"))
+		stat, err := sut.Stat("a.txt")
+		assert.NoError(err)
+		assert.Equal(fs.FileMode(0o755), stat.Mode().Perm())
+
+		w, err = sut.OpenWriteAt("a.txt")
+		assert.NoError(err)
+		assert.NoError(w.Truncate(3))
+		assert.NoError(w.Close())
+		assert.Equal("aXY", readFile(t, sut, "a.txt"))
+	})
+
+	t.Run("OpenWriteAt on a missing file or a directory should fail", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := newSut()
+
+		_, err := sut.OpenWriteAt("a.txt")
+		assert.ErrorIs(err, fs.ErrNotExist)
+		assert.NoError(sut.Mkdir("mydir"))
+		_, err = sut.OpenWriteAt("mydir")
+		assert.ErrorIs(err, syscall.EISDIR)
+	})
+
 	t.Run("Mkdir with a parent that is a file should fail", func(t *testing.T) {
 		t.Parallel()
 		assert := NewAssert(t)
@@ -431,6 +719,25 @@ func checkConsistency(t *testing.T, newSut func() FS) {
 		assert.ErrorIs(err, fs.ErrNotExist)
 	})
 
+	t.Run("SetXattrs replaces the extended attributes", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := newSut()
+
+		writeFile(t, sut, "a.txt", "data")
+		xattrs, err := sut.Xattrs("a.txt")
+		assert.NoError(err)
+		assert.Equal(0, len(xattrs))
+		assert.NoError(sut.SetXattrs("a.txt", []*Xattr{{"user.b", "2"}, {"user.a", "1"}}))
+		xattrs, err = sut.Xattrs("a.txt")
+		assert.NoError(err)
+		assert.Equal([]*Xattr{{"user.a", "1"}, {"user.b", "2"}}, xattrs)
+		assert.NoError(sut.SetXattrs("a.txt", []*Xattr{{"user.b", "3"}}))
+		xattrs, err = sut.Xattrs("a.txt")
+		assert.NoError(err)
+		assert.Equal([]*Xattr{{"user.b", "3"}}, xattrs)
+	})
+
 	t.Run("Rename to a missing parent directory should fail", func(t *testing.T) {
 		t.Parallel()
 		assert := NewAssert(t)
@@ -1160,6 +1467,31 @@ func checkConsistency(t *testing.T, newSut func() FS) {
 		assert.Equal("abcd", readFile(t, sut, "a.txt"))
 	})
 
+	t.Run("OpenAppend on a symlink refuses to follow", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := newSut()
+
+		writeFile(t, sut, "a.txt", "abcd")
+		assert.NoError(sut.Symlink("a.txt", "link"))
+
+		_, err := sut.OpenAppend("link", 0)
+		assert.ErrorIs(err, ErrIsSymlink)
+		assert.Equal("abcd", readFile(t, sut, "a.txt"))
+	})
+
+	t.Run("OpenWriteAt on a symlink refuses to follow", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := newSut()
+
+		writeFile(t, sut, "a.txt", "abcd")
+		assert.NoError(sut.Symlink("a.txt", "link"))
+
+		_, err := sut.OpenWriteAt("link")
+		assert.ErrorIs(err, ErrIsSymlink)
+	})
+
 	t.Run("OpenWriteExcl on a symlink refuses to follow", func(t *testing.T) {
 		t.Parallel()
 		assert := NewAssert(t)
@@ -1293,3 +1625,9 @@ func writeFile(t *testing.T, sut FS, name string, data string) {
 	err := WriteFile(sut, name, []byte(data))
 	assert.NoError(err)
 }
+
+// Hides the `io.WriterTo` of the reader, so that `io.Copy` uses the
+// `io.ReaderFrom` of the writer if it has one.
+type onlyReader struct {
+	io.Reader
+}
@@ -55,6 +55,42 @@ func (f *RealFS) OpenWriteExcl(name string) (io.WriteCloser, error) {
 	return file, nil
 }
 
+func (f *RealFS) OpenAppend(name string, size int64) (io.WriteCloser, error) {
+	file, err := os.OpenFile(
+		filepath.Join(f.BasePath, name),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND|syscall.O_NOFOLLOW,
+		0o600,
+	)
+	if err != nil {
+		return nil, translateErrIsSymlink("open", name, err)
+	}
+	if size < 0 {
+		return file, nil
+	}
+	// `O_APPEND` makes every write go to the end of the file, also after
+	// the truncation.
+	info, err := file.Stat()
+	if err == nil && info.Size() < size {
+		err = &fs.PathError{Op: "truncate", Path: name, Err: fs.ErrInvalid}
+	}
+	if err == nil {
+		err = file.Truncate(size)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *RealFS) OpenWriteAt(name string) (FileWriterAt, error) { //nolint:ireturn
+	file, err := os.OpenFile(filepath.Join(f.BasePath, name), os.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, translateErrIsSymlink("open", name, err)
+	}
+	return file, nil
+}
+
 func (f *RealFS) FSync(file io.WriteCloser) error {
 	fsFile, ok := file.(*os.File)
 	if !ok {
@@ -114,6 +150,22 @@ func (f *RealFS) Symlink(target string, name string) error {
 	return os.Symlink(target, filepath.Join(f.BasePath, name))
 }
 
+func (f *RealFS) Link(oldname string, name string) error {
+	return os.Link(filepath.Join(f.BasePath, oldname), filepath.Join(f.BasePath, name))
+}
+
+func (f *RealFS) Xattrs(name string) ([]*Xattr, error) {
+	return readXattrs(filepath.Join(f.BasePath, name))
+}
+
+func (f *RealFS) SetXattrs(name string, xattrs []*Xattr) error {
+	return writeXattrs(filepath.Join(f.BasePath, name), xattrs)
+}
+
+func (f *RealFS) Holes(name string) ([]*Hole, error) {
+	return readHoles(filepath.Join(f.BasePath, name))
+}
+
 func (f *RealFS) ReadLink(name string) (string, error) {
 	return os.Readlink(filepath.Join(f.BasePath, name))
 }
@@ -6,6 +6,7 @@ import (
 	"errors"
 	iofs "io/fs"
 	"path/filepath"
+	"slices"
 	"strings"
 )
 
@@ -431,6 +432,12 @@ func (i ExtendedGlobPatterns) Match(path string, isDir bool) bool {
 	return matched
 }
 
+// Return whether `name` is the base name of an ignore file, i.e. `.gitignore`
+// or `.clingignore`.
+func IsIgnoreFileName(name string) bool {
+	return slices.Contains(ignoreFileNames, name)
+}
+
 // Read and parse the `.gitignore` and `.clingignore` files located directly in `dir`.
 func readIgnoreFiles(fs FS, dir string) (ExtendedGlobPatterns, error) {
 	patterns := ExtendedGlobPatterns{}
@@ -2,8 +2,12 @@ package lib
 
 import (
 	"context"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
+	"slices"
+	"time"
 )
 
 type HealthCheckMonitor interface {
@@ -11,22 +15,56 @@ type HealthCheckMonitor interface {
 	OnRevisionEntry(entry *RevisionEntry)
 	OnBlockVerified(blockId BlockId, length int)
 	OnOrphanedBlock(blockId BlockId)
+	// Called once for every block that is corrupt or missing and was
+	// quarantined, either by an earlier repair or just now.
+	OnQuarantinedBlock(blockId BlockId)
+	// Called for every change made to the repository in repair mode.
+	OnRepair(description string)
 }
 
 type HealthCheckOptions struct {
 	Monitor HealthCheckMonitor
-	// Read and decrypt every block referenced by any revision.
+	// Read and decrypt every block referenced by any revision and verify
+	// that its content matches its id. Also verify that the blocks of every
+	// file add up to the file's size and hash.
 	CheckBlocks bool
 	// Report every block in storage that is not referenced by any revision.
 	CheckOrphanedBlocks bool
+	// Repair the repository before (and while) checking it, see `repairHead`,
+	// `repairTags`, and `quarantine`.
+	Repair bool
+	// Called in repair mode before the head is reset to an older revision.
+	// The revisions that would be dropped are passed newest first and the
+	// head is only reset if it returns true. If it is nil, no revisions are
+	// dropped.
+	ConfirmDropRevisions func(revisions []RevisionId) bool
+	// Fail if a signed revision is not signed by one of these (see
+	// `SigningKey`). Signatures are always verified, but without trusted
+	// signers any valid signature is accepted. Unsigned revisions are
+	// accepted either way.
+	TrustedSigners []Ed25519PublicKey
 }
 
 // CheckHealth verifies the integrity of `repository`.
 //
 // It always traverses the entire revision chain (head to root), checking that
-// every revision can be read and that every revision's path entries are
-// strictly sorted. Additional checks can be enabled via `opts`.
+// every revision can be read, that its signature (if any) is valid, and that
+// every revision's path entries are strictly sorted. Additional checks can be
+// enabled via `opts`.
+//
+// Blocks in the lost-found section are reported but don't fail the check.
+// With `opts.Repair` the head and the tags are repaired first and corrupt or
+// missing blocks of files are quarantined instead of failing the check.
 func CheckHealth(ctx context.Context, repository *Repository, tempFS FS, opts HealthCheckOptions) error {
+	if opts.Repair {
+		if err := repair(ctx, repository, tempFS, opts); err != nil {
+			return err
+		}
+	}
+	lostFound, err := newQuarantine(ctx, repository, opts.Monitor, opts.Repair)
+	if err != nil {
+		return err
+	}
 	var seenWriter *TempWriter[BlockId]
 	if opts.CheckBlocks || opts.CheckOrphanedBlocks {
 		seenFS, err := tempFS.MkSub("seen")
@@ -35,7 +73,21 @@ func CheckHealth(ctx context.Context, repository *Repository, tempFS FS, opts He
 		}
 		seenWriter = NewBlockIdTempWriter(seenFS)
 	}
-	if err := walkRevisions(ctx, repository, opts.Monitor, seenWriter); err != nil {
+	var files *fileChecker
+	if opts.CheckBlocks {
+		verifiedFS, err := tempFS.MkSub("verified")
+		if err != nil {
+			return WrapErrorf(err, "failed to create temp directory for verified block ids")
+		}
+		files = &fileChecker{
+			repository,
+			opts.Monitor,
+			lostFound,
+			NewBlockIdTempWriter(verifiedFS),
+			map[Sha256]struct{}{},
+		}
+	}
+	if err := walkRevisions(ctx, repository, opts.Monitor, seenWriter, files, opts.TrustedSigners); err != nil {
 		return err
 	}
 	if seenWriter == nil {
@@ -52,19 +104,25 @@ func CheckHealth(ctx context.Context, repository *Repository, tempFS FS, opts He
 		}
 	}
 	if opts.CheckBlocks {
-		if err := checkBlocks(ctx, repository, opts.Monitor, seen); err != nil {
+		verified, err := files.verified.Finalize()
+		if err != nil {
+			return WrapErrorf(err, "failed to sort verified block ids")
+		}
+		defer verified.Remove() //nolint:errcheck
+		if err := checkBlocks(ctx, repository, opts.Monitor, lostFound, seen, verified); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-//nolint:funlen
 func walkRevisions(
 	ctx context.Context,
 	repository *Repository,
 	monitor HealthCheckMonitor,
 	seen *TempWriter[BlockId],
+	files *fileChecker,
+	trustedSigners []Ed25519PublicKey,
 ) error {
 	revisionId, err := repository.Head(ctx)
 	if err != nil {
@@ -83,6 +141,9 @@ func walkRevisions(
 		if err != nil {
 			return WrapErrorf(err, "failed to read revision %s", revisionId)
 		}
+		if err := checkRevisionSignature(revisionId, &revision, trustedSigners); err != nil {
+			return err
+		}
 		if seen != nil {
 			for _, blockId := range revision.BlockIds {
 				if err := seen.Add(blockId); err != nil {
@@ -90,31 +151,13 @@ func walkRevisions(
 				}
 			}
 		}
-		reader := NewRevisionReader(repository, &revision)
-		var lastEntry *RevisionEntry
-		entryCount := 0
-		for {
-			entry, err := reader.Read(ctx, blockBuf)
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			if err != nil {
-				return WrapErrorf(err, "failed to read revision entry #%d of revision %s", entryCount, revisionId)
-			}
-			entryCount++
-			if lastEntry != nil && RevisionEntryPathCompare(lastEntry, entry) >= 0 {
-				return Errorf("paths of revision %s are not strictly sorted at position %d: %s >= %s",
-					revisionId, entryCount, lastEntry.Path, entry.Path)
-			}
-			if entry.Metadata.FileMode.IsSymlink() && entry.Metadata.SymLinkTarget == nil {
-				return Errorf("entry %s in revision %s is a symlink but has no SymLinkTarget",
-					entry.Path, revisionId)
-			}
-			if !entry.Metadata.FileMode.IsSymlink() && entry.Metadata.SymLinkTarget != nil {
-				return Errorf("entry %s in revision %s has SymLinkTarget but is not a symlink",
-					entry.Path, revisionId)
-			}
+		err = checkRevisionEntries(ctx, repository, revisionId, &revision, blockBuf, func(entry *RevisionEntry) error {
 			monitor.OnRevisionEntry(entry)
+			if files != nil {
+				if err := files.check(ctx, revisionId, entry, blockBuf); err != nil {
+					return err
+				}
+			}
 			if seen != nil {
 				for _, blockId := range entry.Metadata.BlockIds {
 					if err := seen.Add(blockId); err != nil {
@@ -123,13 +166,75 @@ func walkRevisions(
 					}
 				}
 			}
-			lastEntry = entry
+			return nil
+		})
+		if err != nil {
+			return err
 		}
 		revisionId = revision.ParentRevisionId
 	}
 	return nil
 }
 
+func checkRevisionSignature(revisionId RevisionId, revision *Revision, trustedSigners []Ed25519PublicKey) error {
+	signer, err := VerifyRevisionSignature(revision)
+	if errors.Is(err, ErrRevisionNotSigned) {
+		return nil
+	}
+	if err != nil {
+		return WrapErrorf(err, "failed to verify revision %s", revisionId)
+	}
+	if len(trustedSigners) > 0 && !slices.Contains(trustedSigners, signer) {
+		return WrapErrorf(ErrUntrustedSigner, "revision %s is signed by %s", revisionId, signer)
+	}
+	return nil
+}
+
+// checkRevisionEntries reads all entries of `revision` and makes sure that
+// their paths are strictly sorted and that only symlinks have a symlink
+// target. `fn` is called for every entry and may be nil.
+func checkRevisionEntries(
+	ctx context.Context,
+	repository *Repository,
+	revisionId RevisionId,
+	revision *Revision,
+	buf BlockBuf,
+	fn func(entry *RevisionEntry) error,
+) error {
+	reader := NewRevisionReader(repository, revision)
+	var lastEntry *RevisionEntry
+	entryCount := 0
+	for {
+		entry, err := reader.Read(ctx, buf)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return WrapErrorf(err, "failed to read revision entry #%d of revision %s", entryCount, revisionId)
+		}
+		entryCount++
+		if lastEntry != nil && RevisionEntryPathCompare(lastEntry, entry) >= 0 {
+			return WrapErrorKindf(ErrCorrupt, nil,
+				"paths of revision %s are not strictly sorted at position %d: %s >= %s",
+				revisionId, entryCount, lastEntry.Path, entry.Path)
+		}
+		if entry.Metadata.FileMode.IsSymlink() && entry.Metadata.SymLinkTarget == nil {
+			return WrapErrorKindf(ErrCorrupt, nil, "entry %s in revision %s is a symlink but has no SymLinkTarget",
+				entry.Path, revisionId)
+		}
+		if !entry.Metadata.FileMode.IsSymlink() && entry.Metadata.SymLinkTarget != nil {
+			return WrapErrorKindf(ErrCorrupt, nil, "entry %s in revision %s has SymLinkTarget but is not a symlink",
+				entry.Path, revisionId)
+		}
+		if fn != nil {
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+		lastEntry = entry
+	}
+}
+
 func checkOrphanedBlocks(
 	ctx context.Context,
 	repository *Repository,
@@ -148,7 +253,8 @@ func checkOrphanedBlocks(
 	defer stored.Remove() //nolint:errcheck
 
 	// Keep seen block ids in a cache for lookup.
-	seenCache, err := NewTempCache(seen, func(id BlockId) string { return string(id[:]) }, 1)
+	seenCache, err := NewTempCache(seen, func(id BlockId) string { return string(id[:]) },
+		TempCacheOptions{MaxChunks: 1})
 	if err != nil {
 		return WrapErrorf(err, "failed to open seen cache")
 	}
@@ -175,7 +281,21 @@ func checkOrphanedBlocks(
 	return nil
 }
 
-func checkBlocks(ctx context.Context, repository *Repository, monitor HealthCheckMonitor, seen *Temp[BlockId]) error {
+// checkBlocks reads all blocks in `seen` that were not already read (and
+// verified) as part of a file.
+func checkBlocks(
+	ctx context.Context,
+	repository *Repository,
+	monitor HealthCheckMonitor,
+	lostFound *quarantine,
+	seen *Temp[BlockId],
+	verified *Temp[BlockId],
+) error {
+	verifiedCache, err := NewTempCache(verified, func(id BlockId) string { return string(id[:]) },
+		TempCacheOptions{MaxChunks: 1})
+	if err != nil {
+		return WrapErrorf(err, "failed to open verified cache")
+	}
 	reader := seen.Reader(nil)
 	buf := NewBlockBuf()
 	for {
@@ -186,11 +306,168 @@ func checkBlocks(ctx context.Context, repository *Repository, monitor HealthChec
 		if err != nil {
 			return WrapErrorf(err, "failed to read seen block id")
 		}
-		data, err := repository.ReadBlock(ctx, id, buf)
+		_, ok, err := verifiedCache.Get(string(id[:]))
 		if err != nil {
-			return WrapErrorf(err, "failed to verify block %s", id)
+			return WrapErrorf(err, "failed to look up block id %s in verified cache", id)
+		}
+		if ok {
+			continue
+		}
+		data, err := readVerifiedBlock(ctx, repository, id, buf)
+		if err != nil {
+			if err := lostFound.check(ctx, id, err, "referenced by a revision"); err != nil {
+				return WrapErrorf(err, "failed to verify block %s", id)
+			}
+			continue
 		}
 		monitor.OnBlockVerified(id, len(data))
 	}
 	return nil
 }
+
+// readVerifiedBlock reads a block and makes sure that its content matches its
+// id, i.e. that it was written with the same block id HMAC key and that it
+// was not swapped with another (validly encrypted) block.
+func readVerifiedBlock(ctx context.Context, repository *Repository, id BlockId, buf BlockBuf) ([]byte, error) {
+	data, err := repository.ReadBlock(ctx, id, buf)
+	if err != nil {
+		return nil, err
+	}
+	if repository.CalculateBlockId(data) != id {
+		return nil, WrapErrorKindf(ErrCorrupt, nil,
+			"content of block %s does not match its id (wrong key or tampered block)", id)
+	}
+	return data, nil
+}
+
+// fileChecker verifies that the blocks of a file add up to the file's size
+// and hash. Each file version (i.e. hash and block ids) is only checked once.
+type fileChecker struct {
+	repository *Repository
+	monitor    HealthCheckMonitor
+	lostFound  *quarantine
+	verified   *TempWriter[BlockId]
+	checked    map[Sha256]struct{}
+}
+
+func (c *fileChecker) check(ctx context.Context, revisionId RevisionId, entry *RevisionEntry, buf BlockBuf) error {
+	md := entry.Metadata
+	if !md.FileMode.IsRegular() || len(md.BlockIds) == 0 {
+		return nil
+	}
+	version := sha256.New()
+	version.Write(md.FileHash[:])
+	for _, blockId := range md.BlockIds {
+		version.Write(blockId[:])
+	}
+	key := Sha256(version.Sum(nil))
+	if _, ok := c.checked[key]; ok {
+		return nil
+	}
+	fileHash := sha256.New()
+	size := int64(0)
+	damaged := false
+	for _, blockId := range md.BlockIds {
+		data, err := readVerifiedBlock(ctx, c.repository, blockId, buf)
+		if err != nil {
+			location := fmt.Sprintf("path %s in revision %s", entry.Path, revisionId)
+			if err := c.lostFound.check(ctx, blockId, err, location); err != nil {
+				return WrapErrorf(err, "failed to verify block %s of %s", blockId, location)
+			}
+			damaged = true
+			continue
+		}
+		fileHash.Write(data)
+		size += int64(len(data))
+		if err := c.verified.Add(blockId); err != nil {
+			return WrapErrorf(err, "failed to record verified block id %s", blockId)
+		}
+		c.monitor.OnBlockVerified(blockId, len(data))
+	}
+	if damaged {
+		// The quarantined blocks are already reported.
+		c.checked[key] = struct{}{}
+		return nil
+	}
+	if size != md.Size {
+		return WrapErrorKindf(ErrCorrupt, nil, "blocks of path %s in revision %s add up to %d bytes, want %d",
+			entry.Path, revisionId, size, md.Size)
+	}
+	if Sha256(fileHash.Sum(nil)) != md.FileHash {
+		return WrapErrorKindf(ErrCorrupt, nil,
+			"blocks of path %s in revision %s do not match the file hash", entry.Path, revisionId)
+	}
+	c.checked[key] = struct{}{}
+	return nil
+}
+
+// quarantine keeps track of the blocks in the lost-found section.
+//
+// The repository is append-only, so a corrupt or missing block cannot be
+// removed or replaced. Instead, a record about it is written to the
+// lost-found section (named after the block id), and from then on it is
+// reported instead of failing the health check.
+type quarantine struct {
+	repository *Repository
+	monitor    HealthCheckMonitor
+	repair     bool
+	// All quarantined blocks and whether they were reported yet.
+	blocks map[BlockId]bool
+}
+
+func newQuarantine(
+	ctx context.Context,
+	repository *Repository,
+	monitor HealthCheckMonitor,
+	repair bool,
+) (*quarantine, error) {
+	names, err := repository.storage.ListControlFiles(ctx, ControlFileSectionLostFound)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to list quarantined blocks")
+	}
+	blocks := make(map[BlockId]bool, len(names))
+	for _, name := range names {
+		blockId, err := NewBlockIdFromString(name)
+		if err != nil {
+			return nil, WrapErrorf(err, "invalid name of quarantined block %s", name)
+		}
+		blocks[blockId] = false
+	}
+	return &quarantine{repository, monitor, repair, blocks}, nil
+}
+
+// Return `err` (the error of reading and verifying block `blockId`) unless
+// the block is corrupt or missing and quarantined. In repair mode, such a
+// block is quarantined first. `location` tells where the block is used.
+func (q *quarantine) check(ctx context.Context, blockId BlockId, err error, location string) error {
+	if !errors.Is(err, ErrCorrupt) && !errors.Is(err, ErrBlockNotFound) {
+		return err
+	}
+	reported, ok := q.blocks[blockId]
+	if !ok {
+		if !q.repair {
+			return err
+		}
+		record := fmt.Sprintf(
+			"block: %s\nlocation: %s\ntime: %s\nerror: %s\n",
+			blockId,
+			location,
+			time.Now().UTC().Format(time.RFC3339),
+			err,
+		)
+		if err := q.repository.storage.WriteControlFile(
+			ctx,
+			ControlFileSectionLostFound,
+			blockId.String(),
+			[]byte(record),
+		); err != nil {
+			return WrapErrorf(err, "failed to quarantine block %s", blockId)
+		}
+		q.monitor.OnRepair(fmt.Sprintf("quarantined block %s of %s", blockId, location))
+	}
+	if !reported {
+		q.blocks[blockId] = true
+		q.monitor.OnQuarantinedBlock(blockId)
+	}
+	return nil
+}
@@ -92,15 +92,91 @@ func TestCheckHealth(t *testing.T) {
 			HealthCheckOptions{Monitor: monitor, CheckBlocks: true, CheckOrphanedBlocks: false},
 		)
 		assert.NoError(err)
-		assert.Equal(8, len(monitor.Calls))
+		// The blocks of each file are read (again) to verify the file, the
+		// remaining blocks (those of the revision itself) are read afterwards.
+		assert.Equal(10, len(monitor.Calls))
 		assert.Calls([]MockCall{
 			NewMockCall("OnRevisionStart", rev1Id),
 			NewMockCall("OnRevisionEntry", e1),
+			NewMockCall("OnBlockVerified", blockId1, 3),
 			NewMockCall("OnRevisionEntry", e2),
+			NewMockCall("OnBlockVerified", blockId2, 2),
 			NewMockCall("OnRevisionEntry", e3),
-		}, monitor.Calls[:4])
-		assert.Call(NewMockCall("OnBlockVerified", blockId1, 3), monitor.Calls[4:])
-		assert.Call(NewMockCall("OnBlockVerified", blockId2, 2), monitor.Calls[4:])
+			NewMockCall("OnBlockVerified", blockId1, 3),
+			NewMockCall("OnBlockVerified", blockId2, 2),
+		}, monitor.Calls[:8])
+		for _, call := range monitor.Calls[8:] {
+			assert.Equal("OnBlockVerified", call.Name)
+		}
+	})
+
+	t.Run("Verify blocks detects files that don't match their metadata", func(t *testing.T) {
+		t.Parallel()
+		tests := []struct {
+			name string
+			size int64
+			hash Sha256
+			want string
+		}{
+			{"Wrong size", 4, td.SHA256("abc"), "add up to 3 bytes, want 4"},
+			{"Wrong hash", 3, td.SHA256("abd"), "do not match the file hash"},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				t.Parallel()
+				assert := NewAssert(t)
+				r := td.NewTestRepository(t, td.NewFS(t))
+				commit, err := NewCommit(t.Context(), r.Repository, td.NewFS(t))
+				assert.NoError(err)
+				blockId, _, err := r.WriteBlock(t.Context(), []byte("abc"), NewBlockBuf())
+				assert.NoError(err)
+				e := td.RevisionEntry("a.txt", RevisionEntryKindAdd)
+				e.Metadata.BlockIds = []BlockId{blockId}
+				e.Metadata.Size = tc.size
+				e.Metadata.FileHash = tc.hash
+				assert.NoError(commit.Add(e))
+				revId, err := commit.Commit(t.Context(), td.CommitInfo())
+				assert.NoError(err)
+
+				err = CheckHealth(
+					t.Context(),
+					r.Repository,
+					td.NewFS(t),
+					HealthCheckOptions{Monitor: td.NewHealthCheckMonitor(), CheckBlocks: true, CheckOrphanedBlocks: false},
+				)
+				assert.Error(err, tc.want)
+				assert.Error(err, "path a.txt in revision "+revId.String())
+			})
+		}
+	})
+
+	t.Run("Verify blocks detects blocks that don't match their id", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		commit, err := NewCommit(t.Context(), r.Repository, td.NewFS(t))
+		assert.NoError(err)
+		blockId, _, err := r.WriteBlock(t.Context(), []byte("abc"), NewBlockBuf())
+		assert.NoError(err)
+		e := td.RevisionEntry("a.txt", RevisionEntryKindAdd)
+		e.Metadata.BlockIds = []BlockId{blockId}
+		e.Metadata.Size = 3
+		e.Metadata.FileHash = td.SHA256("abc")
+		assert.NoError(commit.Add(e))
+		revId, err := commit.Commit(t.Context(), td.CommitInfo())
+		assert.NoError(err)
+
+		// Simulate a repository opened with the wrong block id HMAC key.
+		r.blockIdHmacKey[0] ^= 1
+		err = CheckHealth(
+			t.Context(),
+			r.Repository,
+			td.NewFS(t),
+			HealthCheckOptions{Monitor: td.NewHealthCheckMonitor(), CheckBlocks: true, CheckOrphanedBlocks: false},
+		)
+		assert.Error(err, "does not match its id")
+		assert.Error(err, "path a.txt in revision "+revId.String())
+		assert.ErrorIs(err, ErrCorrupt)
 	})
 
 	t.Run("Verify blocks detects broken blocks", func(t *testing.T) {
@@ -283,10 +359,143 @@ func TestCheckHealth(t *testing.T) {
 	})
 }
 
+func TestCheckHealthRepair(t *testing.T) {
+	t.Parallel()
+	commitFile := func(t *testing.T, r *TestRepository, path, content string) RevisionId {
+		t.Helper()
+		assert := NewAssert(t)
+		commit, err := NewCommit(t.Context(), r.Repository, td.NewFS(t))
+		assert.NoError(err)
+		blockId, _, err := r.WriteBlock(t.Context(), []byte(content), NewBlockBuf())
+		assert.NoError(err)
+		e := td.RevisionEntry(path, RevisionEntryKindAdd)
+		e.Metadata.BlockIds = []BlockId{blockId}
+		e.Metadata.Size = int64(len(content))
+		e.Metadata.FileHash = td.SHA256(content)
+		assert.NoError(commit.Add(e))
+		revisionId, err := commit.Commit(t.Context(), td.CommitInfo())
+		assert.NoError(err)
+		return revisionId
+	}
+	corruptBlock := func(t *testing.T, r *TestRepository, blockId BlockId) {
+		t.Helper()
+		assert := NewAssert(t)
+		path := r.Storage.blockPath(blockId)
+		data, err := ReadFile(r.Storage.FS, path)
+		assert.NoError(err)
+		data[len(data)/2] ^= 1
+		assert.NoError(r.Storage.FS.Chmod(path, 0o600))
+		assert.NoError(WriteFile(r.Storage.FS, path, data))
+	}
+	repairs := func(monitor *TestHealthCheckMonitor) []string {
+		descriptions := []string{}
+		for _, call := range monitor.Calls {
+			if call.Name == "OnRepair" {
+				descriptions = append(descriptions, call.Args[0].(string)) //nolint:forcetypeassert
+			}
+		}
+		return descriptions
+	}
+
+	t.Run("Corrupt blocks are quarantined", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		commitFile(t, r, "a.txt", "abc")
+		blockId := r.RevisionSnapshot(r.Head(), nil)[0].Metadata.BlockIds[0]
+		corruptBlock(t, r, blockId)
+
+		monitor := td.NewHealthCheckMonitor()
+		err := CheckHealth(t.Context(), r.Repository, td.NewFS(t), HealthCheckOptions{
+			Monitor: monitor, CheckBlocks: true, CheckOrphanedBlocks: false, Repair: true, ConfirmDropRevisions: nil,
+		})
+		assert.NoError(err)
+		assert.Equal([]string{"quarantined block " + blockId.String() + " of path a.txt in revision " +
+			r.Head().String()}, repairs(monitor))
+		assert.Call(NewMockCall("OnQuarantinedBlock", blockId), monitor.Calls)
+		record, err := r.Storage.ReadControlFile(t.Context(), ControlFileSectionLostFound, blockId.String())
+		assert.NoError(err)
+		assert.Contains(string(record), "error: ")
+
+		// Quarantined blocks are reported, but don't fail the check anymore.
+		monitor = td.NewHealthCheckMonitor()
+		err = CheckHealth(t.Context(), r.Repository, td.NewFS(t), HealthCheckOptions{
+			Monitor: monitor, CheckBlocks: true, CheckOrphanedBlocks: false, Repair: false, ConfirmDropRevisions: nil,
+		})
+		assert.NoError(err)
+		assert.Equal(0, len(repairs(monitor)))
+		assert.Call(NewMockCall("OnQuarantinedBlock", blockId), monitor.Calls)
+	})
+
+	t.Run("A corrupt head revision is only dropped after confirmation", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		rev1 := commitFile(t, r, "a.txt", "abc")
+		rev2 := commitFile(t, r, "b.txt", "def")
+		assert.NoError(r.WriteTag(t.Context(), "good", rev1, false))
+		assert.NoError(r.WriteTag(t.Context(), "bad", rev2, false))
+		corruptBlock(t, r, BlockId(rev2))
+
+		err := CheckHealth(t.Context(), r.Repository, td.NewFS(t), HealthCheckOptions{
+			Monitor: td.NewHealthCheckMonitor(), CheckBlocks: false, CheckOrphanedBlocks: false,
+			Repair: false, ConfirmDropRevisions: nil,
+		})
+		assert.ErrorIs(err, ErrCorrupt)
+
+		var dropped []RevisionId
+		confirm := func(answer bool) func([]RevisionId) bool {
+			return func(revisions []RevisionId) bool {
+				dropped = revisions
+				return answer
+			}
+		}
+		err = CheckHealth(t.Context(), r.Repository, td.NewFS(t), HealthCheckOptions{
+			Monitor: td.NewHealthCheckMonitor(), CheckBlocks: false, CheckOrphanedBlocks: false,
+			Repair: true, ConfirmDropRevisions: confirm(false),
+		})
+		assert.ErrorIs(err, ErrCorrupt)
+		assert.Equal([]RevisionId{rev2}, dropped)
+		assert.Equal(rev2, r.Head())
+
+		monitor := td.NewHealthCheckMonitor()
+		err = CheckHealth(t.Context(), r.Repository, td.NewFS(t), HealthCheckOptions{
+			Monitor: monitor, CheckBlocks: true, CheckOrphanedBlocks: false,
+			Repair: true, ConfirmDropRevisions: confirm(true),
+		})
+		assert.NoError(err)
+		assert.Equal(rev1, r.Head())
+		assert.Equal([]string{
+			"reset the head from " + rev2.String() + " to " + rev1.String() + ", dropped 1 revisions",
+			"deleted the tag bad, it points to the corrupt revision " + rev2.String(),
+		}, repairs(monitor))
+		tags, err := r.Tags(t.Context())
+		assert.NoError(err)
+		assert.Equal([]Tag{{"good", rev1}}, tags)
+	})
+
+	t.Run("A missing head is re-derived", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		commitFile(t, r, "a.txt", "abc")
+		rev2 := commitFile(t, r, "b.txt", "def")
+		assert.NoError(DeleteRef(t.Context(), r.Storage, "head"))
+
+		monitor := td.NewHealthCheckMonitor()
+		err := CheckHealth(t.Context(), r.Repository, td.NewFS(t), HealthCheckOptions{
+			Monitor: monitor, CheckBlocks: false, CheckOrphanedBlocks: false, Repair: true, ConfirmDropRevisions: nil,
+		})
+		assert.NoError(err)
+		assert.Equal(rev2, r.Head())
+		assert.Equal([]string{"re-derived the head reference: " + rev2.String()}, repairs(monitor))
+	})
+}
+
 func TestFormatDoesNotChangeUnexpectedly(t *testing.T) {
 	t.Parallel()
 	assert := NewAssert(t)
-	want := "119c51dd05c7a50f321ec70ae5bbd51f6de311bcacf06e9436b0afea6c72e208"
+	want := "cebcf6c8d135254cbf7b0bea827256db9570eb15cc0df01c6d8dc6ca9b55629b"
 	data, err := os.ReadFile("format.proto") //nolint:forbidigo
 	assert.NoError(err)
 	sum := sha256.Sum256(data)
@@ -0,0 +1,154 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// A repository can be opened with several passphrases (like LUKS). Each
+// passphrase has a key slot that holds a copy of the repository keys
+// encrypted with the user-key derived from it. The slot created with the
+// repository is called `DefaultKeySlot`.
+// Removing a passphrase does not re-encrypt anything: whoever knew it could
+// have kept the repository keys.
+const (
+	DefaultKeySlot       = "default"
+	keySlotSectionPrefix = "key-slot."
+	maxKeySlotNameLen    = 32
+)
+
+var ErrKeySlotNotFound = Errorf("passphrase not found")
+
+// Names must be ASCII alphanumeric or `-`.
+func ValidateKeySlotName(name string) error {
+	if name == "" || len(name) > maxKeySlotNameLen {
+		return Errorf("invalid passphrase name %q, it must be 1 to %d characters long", name, maxKeySlotNameLen)
+	}
+	for i := range len(name) {
+		c := name[i]
+		ok := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-'
+		if !ok {
+			return Errorf("invalid passphrase name %q, only ASCII letters, digits, and `-` are allowed", name)
+		}
+	}
+	return nil
+}
+
+// KeySlotNames returns the names of all key slots in `config` (the default
+// slot first).
+func KeySlotNames(config Toml) ([]string, error) {
+	mki, err := parseRepositoryConfig(config)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to parse repository config")
+	}
+	return append([]string{DefaultKeySlot}, slices.Sorted(maps.Keys(mki.KeySlots))...), nil
+}
+
+// AddPassphrase adds the key slot `name`, so that the repository can also
+// be opened with `newPassphrase`. `passphrase` has to open one of the
+// existing key slots.
+func AddPassphrase(ctx context.Context, storage Storage, passphrase []byte, name string, newPassphrase []byte) error {
+	if err := ValidateKeySlotName(name); err != nil {
+		return err
+	}
+	toml, mki, keys, err := openKeySlots(ctx, storage, passphrase)
+	if err != nil {
+		return err
+	}
+	defer clear(keys.UserKey[:])
+	if _, ok := mki.KeySlots[name]; ok || name == DefaultKeySlot {
+		return Errorf("a passphrase named %q already exists", name)
+	}
+	userKey := keys.UserKey
+	defer clear(userKey[:])
+	slot, err := encryptRepositoryKeys(keys, newPassphrase)
+	if err != nil {
+		return err
+	}
+	mki.KeySlots[name] = slot
+	config, err := writeRepositoryConfig(ctx, storage, toml, *mki)
+	if err != nil {
+		return err
+	}
+	// The backups of all other key slots are updated the next time the
+	// repository is opened with their passphrase.
+	if keys.Slot != "" {
+		if err := backupRepositoryConfig(ctx, storage, config, keys.Slot, userKey); err != nil {
+			return WrapErrorf(err, "failed to back up repository config")
+		}
+	}
+	if err := backupRepositoryConfig(ctx, storage, config, name, keys.UserKey); err != nil {
+		return WrapErrorf(err, "failed to back up repository config")
+	}
+	return nil
+}
+
+// RemovePassphrase removes the key slot `name`. `passphrase` has to open one
+// of the key slots (it may be the one that is removed). The default key slot
+// cannot be removed.
+// Return `ErrKeySlotNotFound` if there is no key slot `name`.
+func RemovePassphrase(ctx context.Context, storage Storage, passphrase []byte, name string) error {
+	if name == DefaultKeySlot {
+		return Errorf("the %q passphrase cannot be removed", DefaultKeySlot)
+	}
+	toml, mki, keys, err := openKeySlots(ctx, storage, passphrase)
+	if err != nil {
+		return err
+	}
+	defer clear(keys.UserKey[:])
+	if _, ok := mki.KeySlots[name]; !ok {
+		return WrapErrorf(ErrKeySlotNotFound, "there is no passphrase named %q", name)
+	}
+	delete(mki.KeySlots, name)
+	config, err := writeRepositoryConfig(ctx, storage, toml, *mki)
+	if err != nil {
+		return err
+	}
+	// The backup is encrypted with the removed passphrase.
+	err = storage.DeleteControlFile(ctx, ControlFileSectionSecurity, repositoryConfigBackupName(name))
+	if err != nil && !errors.Is(err, ErrControlFileNotFound) {
+		return WrapErrorf(err, "failed to delete repository config backup of passphrase %q", name)
+	}
+	if keys.Slot != name && keys.Slot != "" {
+		if err := backupRepositoryConfig(ctx, storage, config, keys.Slot, keys.UserKey); err != nil {
+			return WrapErrorf(err, "failed to back up repository config")
+		}
+	}
+	return nil
+}
+
+func openKeySlots(ctx context.Context, storage Storage, passphrase []byte) (Toml, *masterKeyInfo, *repositoryKeys, error) {
+	toml, err := storage.Open(ctx)
+	if err != nil {
+		return nil, nil, nil, WrapErrorf(err, "failed to open storage")
+	}
+	keys, err := decryptrepositoryKeys(toml, passphrase)
+	if err != nil {
+		return nil, nil, nil, WrapErrorf(err, "failed to decrypt repository keys")
+	}
+	mki, err := parseRepositoryConfig(toml)
+	if err != nil {
+		clear(keys.UserKey[:])
+		return nil, nil, nil, WrapErrorf(err, "failed to parse repository config")
+	}
+	return toml, mki, keys, nil
+}
+
+// Replace the key slots of the repository config `old` with those of `mki`.
+// All other sections of `old` are kept.
+func writeRepositoryConfig(ctx context.Context, storage Storage, old Toml, mki masterKeyInfo) (Toml, error) {
+	config, headerComment := createRepositoryConfig(mki)
+	for section, values := range old {
+		if _, ok := config[section]; ok || strings.HasPrefix(section, keySlotSectionPrefix) {
+			continue
+		}
+		config[section] = values
+	}
+	if err := storage.WriteConfig(ctx, config, headerComment); err != nil {
+		return nil, WrapErrorf(err, "failed to write repository config")
+	}
+	return config, nil
+}
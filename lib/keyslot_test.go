@@ -0,0 +1,126 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestKeySlots(t *testing.T) {
+	t.Parallel()
+	t.Run("Open the repository with another passphrase", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		entry, _ := testEntry(t, r, "a.txt", "abc")
+		head, err := testCommit(t, r.Repository, entry)
+		assert.NoError(err)
+
+		err = AddPassphrase(t.Context(), r.Storage, []byte(r.Passphrase), "laptop", []byte("second passphrase"))
+		assert.NoError(err)
+		for _, passphrase := range []string{r.Passphrase, "second passphrase"} {
+			sut, err := OpenRepository(t.Context(), r.Storage, []byte(passphrase))
+			assert.NoError(err)
+			_, err = sut.ReadRevision(t.Context(), head, NewBlockBuf())
+			assert.NoError(err)
+		}
+		_, err = OpenRepository(t.Context(), r.Storage, []byte("wrong passphrase"))
+		assert.Error(err, "failed to decrypt repository keys")
+		assert.ErrorIs(err, ErrAuth)
+		config, err := r.Storage.Open(t.Context())
+		assert.NoError(err)
+		names, err := KeySlotNames(config)
+		assert.NoError(err)
+		assert.Equal([]string{DefaultKeySlot, "laptop"}, names)
+
+		// Another passphrase can be added with the second one.
+		err = AddPassphrase(t.Context(), r.Storage, []byte("second passphrase"), "backup", []byte("third passphrase"))
+		assert.NoError(err)
+		_, err = OpenRepository(t.Context(), r.Storage, []byte("third passphrase"))
+		assert.NoError(err)
+	})
+
+	t.Run("Invalid or duplicate names are rejected", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		passphrase := []byte(r.Passphrase)
+		assert.NoError(AddPassphrase(t.Context(), r.Storage, passphrase, "laptop", []byte("second passphrase")))
+		err := AddPassphrase(t.Context(), r.Storage, passphrase, "laptop", []byte("other passphrase"))
+		assert.Error(err, `a passphrase named "laptop" already exists`)
+		err = AddPassphrase(t.Context(), r.Storage, passphrase, DefaultKeySlot, []byte("other passphrase"))
+		assert.Error(err, `a passphrase named "default" already exists`)
+		err = AddPassphrase(t.Context(), r.Storage, passphrase, "my laptop", []byte("other passphrase"))
+		assert.Error(err, "invalid passphrase name")
+		err = AddPassphrase(t.Context(), r.Storage, passphrase, "", []byte("other passphrase"))
+		assert.Error(err, "invalid passphrase name")
+		err = AddPassphrase(t.Context(), r.Storage, []byte("wrong passphrase"), "other", []byte("other passphrase"))
+		assert.Error(err, "failed to decrypt repository keys")
+	})
+
+	t.Run("Remove a passphrase", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		passphrase := []byte(r.Passphrase)
+		assert.NoError(AddPassphrase(t.Context(), r.Storage, passphrase, "laptop", []byte("second passphrase")))
+		_, err := ReadRepositoryConfigBackup(t.Context(), r.Storage, []byte("second passphrase"))
+		assert.NoError(err)
+
+		err = RemovePassphrase(t.Context(), r.Storage, passphrase, "phone")
+		assert.ErrorIs(err, ErrKeySlotNotFound)
+		err = RemovePassphrase(t.Context(), r.Storage, passphrase, DefaultKeySlot)
+		assert.Error(err, `the "default" passphrase cannot be removed`)
+
+		assert.NoError(RemovePassphrase(t.Context(), r.Storage, []byte("second passphrase"), "laptop"))
+		_, err = OpenRepository(t.Context(), r.Storage, []byte("second passphrase"))
+		assert.Error(err, "failed to decrypt repository keys")
+		_, err = r.Storage.ReadControlFile(
+			t.Context(),
+			ControlFileSectionSecurity,
+			repositoryConfigBackupName("laptop"),
+		)
+		assert.ErrorIs(err, ErrControlFileNotFound)
+		// Opening the repository updates the backup of the default passphrase.
+		_, err = OpenRepository(t.Context(), r.Storage, passphrase)
+		assert.NoError(err)
+		config, err := r.Storage.Open(t.Context())
+		assert.NoError(err)
+		backup, err := ReadRepositoryConfigBackup(t.Context(), r.Storage, passphrase)
+		assert.NoError(err)
+		assert.Equal(true, config.Eq(backup))
+	})
+
+	t.Run("The backup of the repository config works with every passphrase", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		fs := td.NewFS(t)
+		r := td.NewTestRepository(t, fs)
+		assert.NoError(AddPassphrase(t.Context(), r.Storage, []byte(r.Passphrase), "laptop", []byte("second passphrase")))
+		config, err := r.Storage.Open(t.Context())
+		assert.NoError(err)
+		assert.NoError(fs.Remove(r.Storage.configFilePath()))
+		for _, passphrase := range []string{r.Passphrase, "second passphrase"} {
+			backup, err := ReadRepositoryConfigBackup(t.Context(), r.Storage, []byte(passphrase))
+			assert.NoError(err)
+			assert.Equal(true, config.Eq(backup))
+		}
+		_, err = ReadRepositoryConfigBackup(t.Context(), r.Storage, []byte("wrong passphrase"))
+		assert.Error(err, "wrong passphrase?")
+	})
+
+	t.Run("Resetting the passphrase keeps the other passphrases", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		assert.NoError(AddPassphrase(t.Context(), r.Storage, []byte(r.Passphrase), "laptop", []byte("second passphrase")))
+		code, err := ExportRecoveryCode(t.Context(), r.Storage, []byte(r.Passphrase))
+		assert.NoError(err)
+		_, err = ResetPassphrase(t.Context(), r.Storage, code, []byte("new passphrase"))
+		assert.NoError(err)
+		_, err = OpenRepository(t.Context(), r.Storage, []byte(r.Passphrase))
+		assert.Error(err, "failed to decrypt repository keys")
+		for _, passphrase := range []string{"new passphrase", "second passphrase"} {
+			_, err := OpenRepository(t.Context(), r.Storage, []byte(passphrase))
+			assert.NoError(err)
+		}
+	})
+}
@@ -0,0 +1,342 @@
+package lib
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Packs keep the number of files in a `FileStorage` down. Every block is
+// written as a file of its own (a loose block, see `FileStorage.blockPath`),
+// `PackBlocks` later moves the loose blocks into pack files.
+//
+// A pack is the plain concatenation of its blocks in
+// `.cling/<purpose>/packs/<pack id>.pack`. Its index is the control file
+// `<pack id>` in `ControlFileSectionPacks` (i.e. in the same directory), a
+// list of `packIndexEntry`. Packs are never modified once they are written,
+// and a pack without an index does not count, so that an interrupted
+// `PackBlocks` leaves nothing but a stray file behind.
+
+const (
+	// `PackBlocks` starts a new pack once a pack holds this many bytes.
+	DefaultPackSize = 64 * 1024 * 1024
+	// A pack holds at most `PackSize` bytes plus one block, the offsets and
+	// lengths in its index are 32 bits.
+	MaxPackSize = math.MaxUint32 - MaxBlockSize
+	// Block id, offset, and length.
+	packIndexEntrySize = BlockIdSize + 4 + 4
+	// The index of a pack must fit into a control file.
+	maxPackBlocks = MaxControlFileSize / packIndexEntrySize
+	// How long a `FileStorage` trusts its pack indexes before it looks for
+	// new packs when asked for a block it does not know. `ReadBlock` always
+	// looks, `HasBlock` and `WriteBlock` might miss a block that was packed
+	// by another process in the meantime and write it again as a loose
+	// block.
+	packIndexMaxAge = time.Second
+)
+
+type PackMonitor interface {
+	OnPackWritten(packId string, blocks int, bytes int64)
+}
+
+type PackOptions struct {
+	Monitor PackMonitor
+	// The size of a pack, `DefaultPackSize` if 0. At most `MaxPackSize`.
+	PackSize int
+}
+
+type PackResult struct {
+	Packs  int
+	Blocks int
+	Bytes  int64
+}
+
+type packIndexEntry struct {
+	BlockId BlockId
+	Offset  uint32
+	Length  uint32
+}
+
+// The pack indexes of a `FileStorage` loaded so far.
+type packIndex struct {
+	mu    sync.Mutex
+	packs []string
+	known map[string]bool
+	// Sorted by block id, `pack` is the index into `packs`.
+	entries []packedBlock
+	loaded  time.Time
+}
+
+type packedBlock struct {
+	packIndexEntry
+	pack int
+}
+
+func newPackIndex() *packIndex {
+	return &packIndex{sync.Mutex{}, nil, map[string]bool{}, nil, time.Time{}}
+}
+
+func (p *packIndex) find(blockId BlockId) (packedBlock, bool) {
+	i, found := slices.BinarySearchFunc(p.entries, blockId, func(e packedBlock, id BlockId) int {
+		return BlockIdCompare(e.BlockId, id)
+	})
+	if !found {
+		return packedBlock{}, false
+	}
+	return p.entries[i], true
+}
+
+// PackBlocks moves all loose blocks of `storage` into packs of about
+// `opts.PackSize` bytes. The loose blocks are removed once the pack and its
+// index are written. Only one `PackBlocks` runs at a time, all other
+// operations on the storage can go on in the meantime.
+func PackBlocks(ctx context.Context, storage *FileStorage, opts PackOptions) (*PackResult, error) { //nolint:funlen
+	packSize := opts.PackSize
+	if packSize == 0 {
+		packSize = DefaultPackSize
+	}
+	if packSize < 0 || packSize > MaxPackSize {
+		return nil, Errorf("invalid pack size %d, it must be between 1 and %d", packSize, MaxPackSize)
+	}
+	unlock, err := storage.Lock(ctx, "pack")
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to lock the storage for packing")
+	}
+	defer unlock() //nolint:errcheck
+	if err := storage.loadPackIndexes(ctx); err != nil {
+		return nil, err
+	}
+	// The loose blocks are removed while packing, so collect them first.
+	var loose []BlockId
+	if err := storage.readLooseBlockIds(ctx, func(id BlockId) bool {
+		loose = append(loose, id)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	result := &PackResult{0, 0, 0}
+	var (
+		entries []packIndexEntry
+		data    [][]byte
+		size    int
+	)
+	flush := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		packId, err := storage.writePack(ctx, entries, data)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			path := storage.blockPath(entry.BlockId)
+			if err := storage.FS.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return WrapErrorf(err, "failed to remove packed block %s", path)
+			}
+		}
+		result.Packs++
+		result.Blocks += len(entries)
+		result.Bytes += int64(size)
+		opts.Monitor.OnPackWritten(packId, len(entries), int64(size))
+		entries, data, size = nil, nil, 0
+		return nil
+	}
+	for _, blockId := range loose {
+		if err := ctx.Err(); err != nil {
+			return result, WrapErrorf(err, "packing canceled")
+		}
+		path := storage.blockPath(blockId)
+		if storage.isPacked(blockId) {
+			// Written again as a loose block after it was packed.
+			if err := storage.FS.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return result, WrapErrorf(err, "failed to remove packed block %s", path)
+			}
+			continue
+		}
+		block, err := ReadFile(storage.FS, path)
+		if err != nil {
+			return result, WrapErrorf(err, "failed to read block %s", path)
+		}
+		// The pack was flushed once `size` reached `packSize`, so this only
+		// guards the 32 bits of the index.
+		if size > MaxPackSize || len(block) > MaxBlockSize {
+			return result, Errorf("block %s of %d bytes does not fit into a pack", path, len(block))
+		}
+		entries = append(entries, packIndexEntry{blockId, uint32(size), uint32(len(block))})
+		data = append(data, block)
+		size += len(block)
+		if size >= packSize || len(entries) >= maxPackBlocks {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// Write the pack and then its index. Return the id of the new pack.
+func (s *FileStorage) writePack(ctx context.Context, entries []packIndexEntry, data [][]byte) (string, error) {
+	packId, err := RandStr(32)
+	if err != nil {
+		return "", WrapErrorf(err, "failed to generate pack id")
+	}
+	path := s.packPath(packId)
+	if err := s.FS.MkdirAll(filepath.Dir(path)); err != nil {
+		return "", WrapErrorf(err, "failed to create directory for pack %s", path)
+	}
+	if err := AtomicWriteFile(s.FS, path, 0o400, data...); err != nil {
+		return "", WrapErrorf(err, "failed to write pack %s", path)
+	}
+	index := make([]byte, 0, len(entries)*packIndexEntrySize)
+	for _, entry := range entries {
+		index = append(index, entry.BlockId[:]...)
+		index = binary.BigEndian.AppendUint32(index, entry.Offset)
+		index = binary.BigEndian.AppendUint32(index, entry.Length)
+	}
+	if err := s.WriteControlFile(ctx, ControlFileSectionPacks, packId, index); err != nil {
+		return "", WrapErrorf(err, "failed to write index of pack %s", packId)
+	}
+	s.packs.mu.Lock()
+	defer s.packs.mu.Unlock()
+	s.packs.add([]string{packId}, [][]packIndexEntry{entries})
+	return packId, nil
+}
+
+func parsePackIndex(data []byte) ([]packIndexEntry, error) {
+	if len(data)%packIndexEntrySize != 0 {
+		return nil, Errorf("invalid pack index size %d", len(data))
+	}
+	entries := make([]packIndexEntry, 0, len(data)/packIndexEntrySize)
+	for len(data) > 0 {
+		entries = append(entries, packIndexEntry{
+			BlockId(data[:BlockIdSize]),
+			binary.BigEndian.Uint32(data[BlockIdSize:]),
+			binary.BigEndian.Uint32(data[BlockIdSize+4:]),
+		})
+		data = data[packIndexEntrySize:]
+	}
+	return entries, nil
+}
+
+// Add the indexes of new packs. `entries` is replaced, not modified, so that
+// `FileStorage.ReadBlockIds` can go on with the old one without holding
+// `mu`. Must be called with `mu` held.
+func (p *packIndex) add(packIds []string, indexes [][]packIndexEntry) {
+	all := slices.Clone(p.entries)
+	for i, packId := range packIds {
+		p.known[packId] = true
+		p.packs = append(p.packs, packId)
+		for _, entry := range indexes[i] {
+			all = append(all, packedBlock{entry, len(p.packs) - 1})
+		}
+	}
+	slices.SortFunc(all, func(a, b packedBlock) int { return BlockIdCompare(a.BlockId, b.BlockId) })
+	p.entries = all
+}
+
+// Read the indexes of all packs that are not loaded yet.
+func (s *FileStorage) loadPackIndexes(ctx context.Context) error {
+	s.packs.mu.Lock()
+	defer s.packs.mu.Unlock()
+	return s.loadPackIndexesLocked(ctx)
+}
+
+func (s *FileStorage) loadPackIndexesLocked(ctx context.Context) error {
+	names, err := s.ListControlFiles(ctx, ControlFileSectionPacks)
+	if err != nil {
+		return WrapErrorf(err, "failed to list packs")
+	}
+	var (
+		packIds []string
+		indexes [][]packIndexEntry
+	)
+	for _, name := range names {
+		if s.packs.known[name] {
+			continue
+		}
+		data, err := s.ReadControlFile(ctx, ControlFileSectionPacks, name)
+		if err != nil {
+			return WrapErrorf(err, "failed to read index of pack %s", name)
+		}
+		entries, err := parsePackIndex(data)
+		if err != nil {
+			return WrapErrorKindf(ErrCorrupt, err, "invalid index of pack %s", name)
+		}
+		packIds = append(packIds, name)
+		indexes = append(indexes, entries)
+	}
+	if len(packIds) > 0 {
+		s.packs.add(packIds, indexes)
+	}
+	s.packs.loaded = time.Now()
+	return nil
+}
+
+// Look up a packed block. With `refresh` (or if the indexes are older than
+// `packIndexMaxAge`), look for new packs if the block is not known.
+func (s *FileStorage) findPacked(
+	ctx context.Context,
+	blockId BlockId,
+	refresh bool,
+) (packedBlock, string, bool, error) {
+	s.packs.mu.Lock()
+	defer s.packs.mu.Unlock()
+	entry, found := s.packs.find(blockId)
+	if !found && (refresh || time.Since(s.packs.loaded) > packIndexMaxAge) {
+		if err := s.loadPackIndexesLocked(ctx); err != nil {
+			return packedBlock{}, "", false, err
+		}
+		entry, found = s.packs.find(blockId)
+	}
+	if !found {
+		return packedBlock{}, "", false, nil
+	}
+	return entry, s.packs.packs[entry.pack], true, nil
+}
+
+// Whether the block is in one of the loaded packs.
+func (s *FileStorage) isPacked(blockId BlockId) bool {
+	s.packs.mu.Lock()
+	defer s.packs.mu.Unlock()
+	_, found := s.packs.find(blockId)
+	return found
+}
+
+func (s *FileStorage) readPackedBlock(entry packedBlock, packId string, buf BlockBuf) ([]byte, error) {
+	path := s.packPath(packId)
+	file, err := s.FS.OpenRead(path)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to open pack %s", path)
+	}
+	defer file.Close() //nolint:errcheck
+	if seeker, ok := file.(io.Seeker); ok {
+		_, err = seeker.Seek(int64(entry.Offset), io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, file, int64(entry.Offset))
+	}
+	if err != nil {
+		return nil, WrapErrorKindf(ErrCorrupt, err, "failed to find block %s in pack %s", entry.BlockId, path)
+	}
+	if entry.Length > MaxBlockSize {
+		return nil, WrapErrorKindf(ErrCorrupt, nil, "block %s in pack %s is too large", entry.BlockId, path)
+	}
+	data := buf.buf[:entry.Length]
+	if _, err := io.ReadFull(file, data); err != nil {
+		return nil, WrapErrorKindf(ErrCorrupt, err, "failed to read block %s from pack %s", entry.BlockId, path)
+	}
+	return data, nil
+}
+
+func (s *FileStorage) packPath(packId string) string {
+	return filepath.Join(".cling", string(s.Purpose), string(ControlFileSectionPacks), packId+".pack")
+}
@@ -0,0 +1,168 @@
+package lib
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestPackBlocks(t *testing.T) {
+	t.Parallel()
+
+	writeBlocks := func(t *testing.T, storage *FileStorage, n int) (map[BlockId][]byte, []BlockId) {
+		t.Helper()
+		assert := NewAssert(t)
+		blocks := map[BlockId][]byte{}
+		blockIds := []BlockId{}
+		for i := range n {
+			data := fmt.Appendf(nil, "block data %d", i)
+			blockId := BlockId(CalculateSha256(data))
+			_, err := storage.WriteBlock(t.Context(), blockId, data)
+			assert.NoError(err)
+			blocks[blockId] = data
+			blockIds = append(blockIds, blockId)
+		}
+		return blocks, blockIds
+	}
+	readBlockIds := func(t *testing.T, storage *FileStorage) []BlockId {
+		t.Helper()
+		blockIds := []BlockId{}
+		NewAssert(t).NoError(storage.ReadBlockIds(t.Context(), func(id BlockId) bool {
+			blockIds = append(blockIds, id)
+			return true
+		}))
+		slices.SortFunc(blockIds, BlockIdCompare)
+		return blockIds
+	}
+	looseBlocks := func(t *testing.T, storage *FileStorage) int {
+		t.Helper()
+		n := 0
+		NewAssert(t).NoError(storage.readLooseBlockIds(t.Context(), func(BlockId) bool {
+			n++
+			return true
+		}))
+		return n
+	}
+	pack := func(t *testing.T, storage *FileStorage, packSize int) *PackResult {
+		t.Helper()
+		result, err := PackBlocks(t.Context(), storage, PackOptions{&TestPackMonitor{}, packSize})
+		NewAssert(t).NoError(err)
+		return result
+	}
+
+	t.Run("Packed blocks are read like loose blocks", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		storage, err := NewFileStorage(td.NewFS(t), StoragePurposeRepository)
+		assert.NoError(err)
+		blocks, blockIds := writeBlocks(t, storage, 5)
+		slices.SortFunc(blockIds, BlockIdCompare)
+
+		result := pack(t, storage, 25)
+		assert.Equal(PackResult{2, 5, 60}, *result)
+		assert.Equal(0, looseBlocks(t, storage))
+		packs, err := storage.ListControlFiles(t.Context(), ControlFileSectionPacks)
+		assert.NoError(err)
+		assert.Equal(2, len(packs))
+		assert.Equal(blockIds, readBlockIds(t, storage))
+		for blockId, data := range blocks {
+			exists, err := storage.HasBlock(t.Context(), blockId)
+			assert.NoError(err)
+			assert.Equal(true, exists)
+			read, err := storage.ReadBlock(t.Context(), blockId, NewBlockBuf())
+			assert.NoError(err)
+			assert.Equal(data, read)
+			size, err := storage.BlockSize(t.Context(), blockId)
+			assert.NoError(err)
+			assert.Equal(int64(len(data)), size)
+			existed, err := storage.WriteBlock(t.Context(), blockId, data)
+			assert.NoError(err)
+			assert.Equal(true, existed)
+		}
+		assert.Equal(0, looseBlocks(t, storage))
+
+		// New blocks are loose until the next run.
+		newBlocks, _ := writeBlocks(t, storage, 7)
+		assert.Equal(2, looseBlocks(t, storage))
+		assert.Equal(PackResult{1, 2, 24}, *pack(t, storage, 0))
+		for blockId, data := range newBlocks {
+			read, err := storage.ReadBlock(t.Context(), blockId, NewBlockBuf())
+			assert.NoError(err)
+			assert.Equal(data, read)
+		}
+	})
+
+	t.Run("Blocks packed by another process are found", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		fs := td.NewFS(t)
+		storage, err := NewFileStorage(fs, StoragePurposeRepository)
+		assert.NoError(err)
+		other, err := NewFileStorage(fs, StoragePurposeRepository)
+		assert.NoError(err)
+		blocks, _ := writeBlocks(t, storage, 3)
+		assert.Equal(3, len(readBlockIds(t, other)))
+
+		pack(t, storage, 0)
+		for blockId, data := range blocks {
+			read, err := other.ReadBlock(t.Context(), blockId, NewBlockBuf())
+			assert.NoError(err)
+			assert.Equal(data, read)
+		}
+		assert.Equal(3, len(readBlockIds(t, other)))
+	})
+
+	t.Run("Loose copies of packed blocks are removed", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		storage, err := NewFileStorage(td.NewFS(t), StoragePurposeRepository)
+		assert.NoError(err)
+		blocks, blockIds := writeBlocks(t, storage, 2)
+		pack(t, storage, 0)
+		assert.NoError(WriteFile(storage.FS, storage.blockPath(blockIds[0]), blocks[blockIds[0]]))
+
+		assert.Equal(2, len(readBlockIds(t, storage)))
+		assert.Equal(PackResult{0, 0, 0}, *pack(t, storage, 0))
+		assert.Equal(0, looseBlocks(t, storage))
+	})
+
+	t.Run("Pack sizes beyond the 32 bit offsets are rejected", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		storage, err := NewFileStorage(td.NewFS(t), StoragePurposeRepository)
+		assert.NoError(err)
+		writeBlocks(t, storage, 2)
+		for _, packSize := range []int{-1, MaxPackSize + 1} {
+			_, err := PackBlocks(t.Context(), storage, PackOptions{&TestPackMonitor{}, packSize})
+			assert.Error(err, "invalid pack size")
+		}
+		assert.Equal(2, looseBlocks(t, storage))
+	})
+
+	t.Run("A packed repository can be read", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		entryA, _ := testEntry(t, r, "a.txt", "abc")
+		entryB, _ := testEntry(t, r, "b.txt", "de")
+		revisionId, err := testCommit(t, r.Repository, entryA, entryB)
+		assert.NoError(err)
+		expected := readRevisionSnapshot(t, r.Repository, revisionId, nil)
+
+		pack(t, r.Storage, 0)
+		assert.Equal(0, looseBlocks(t, r.Storage))
+		reopened := td.OpenRepository(t, r.FS)
+		assert.Equal(expected, readRevisionSnapshot(t, reopened.Repository, revisionId, nil))
+		data, err := reopened.ReadBlock(t.Context(), entryA.Metadata.BlockIds[0], NewBlockBuf())
+		assert.NoError(err)
+		assert.Equal([]byte("abc"), data)
+	})
+}
+
+type TestPackMonitor struct {
+	Calls []MockCall
+}
+
+func (m *TestPackMonitor) OnPackWritten(packId string, blocks int, bytes int64) {
+	m.Calls = append(m.Calls, NewMockCall("OnPackWritten", packId, blocks, bytes))
+}
@@ -2,6 +2,7 @@ package lib
 
 import (
 	"path/filepath"
+	"regexp"
 	"strings"
 )
 
@@ -149,6 +150,28 @@ func (pif *PathInclusionFilter) Include(p Path, isDir bool) bool {
 	return pif.Includes.Match(p.p, isDir)
 }
 
+// A PathFilter that only includes `Path` itself. Unlike a
+// `PathInclusionFilter`, `Path` is not a pattern, so it may contain `[`, `*`
+// and other glob metacharacters.
+type PathEqualFilter struct {
+	Path Path
+}
+
+func (pef *PathEqualFilter) Include(p Path, isDir bool) bool {
+	return p == pef.Path
+}
+
+// A PathFilter that includes the paths matching a regular expression. The
+// expression is matched against the whole path, e.g. `a/b.txt`, and is not
+// anchored unless it uses `^` and `$`.
+type PathRegexpFilter struct {
+	Regexp *regexp.Regexp
+}
+
+func (prf *PathRegexpFilter) Include(p Path, isDir bool) bool {
+	return prf.Regexp.MatchString(p.p)
+}
+
 // A PathFilter that combines multiple PathFilters.
 // It returns true if *all* of the PathFilters returns true.
 type AllPathFilter struct {
@@ -2,6 +2,7 @@ package lib
 
 import (
 	"io/fs"
+	"slices"
 	"time"
 )
 
@@ -80,6 +81,13 @@ func (p *PathMetadata) HasSymLinkTarget() bool {
 	return p.SymLinkTarget != nil
 }
 
+func (p *PathMetadata) HasHardLinkGroup() bool {
+	return p.HardLinkGroup != nil
+}
+
+// Extended attributes with larger values are not archived.
+const MaxXattrSize = 0x10000
+
 type RestorableMetadataFlag uint8
 
 const (
@@ -88,13 +96,19 @@ const (
 	RestorableMetadataMode      RestorableMetadataFlag = 1
 	RestorableMetadataMTime     RestorableMetadataFlag = 2
 	RestorableMetadataOwnership RestorableMetadataFlag = 4
-	RestorableMetadataAll       RestorableMetadataFlag = RestorableMetadataMode | RestorableMetadataMTime | RestorableMetadataOwnership
-	restorableMetadataModeMask  FileMode               = FileModePerm | FileModeSticky | FileModeSetUid | FileModeSetGid
+	// Extended attributes, including POSIX ACLs on Linux.
+	RestorableMetadataXattrs RestorableMetadataFlag = 8
+	RestorableMetadataAll    RestorableMetadataFlag = RestorableMetadataMode |
+		RestorableMetadataMTime | RestorableMetadataOwnership | RestorableMetadataXattrs
+	restorableMetadataModeMask FileMode = FileModePerm | FileModeSticky | FileModeSetUid | FileModeSetGid
 )
 
 // Compare all attributes that can be restored like `FileMode`, `Size`, `FileHash` etc.
+// `HardLinkGroup` is compared, too, so that a new hard link to an existing file
+// changes both files.
 // `Birthtime` is not compared because it cannot be restored.
 // `BlockIds` are not compared because they should be the same if the `FileHash` is the same.
+// `Holes` are not compared because they don't change the content.
 func (p *PathMetadata) IsEqualRestorableAttributes(other PathMetadata, flags RestorableMetadataFlag) bool {
 	if p.FileMode&^restorableMetadataModeMask != other.FileMode&^restorableMetadataModeMask {
 		return false
@@ -111,6 +125,12 @@ func (p *PathMetadata) IsEqualRestorableAttributes(other PathMetadata, flags Res
 	if p.HasSymLinkTarget() && *p.SymLinkTarget != *other.SymLinkTarget {
 		return false
 	}
+	if p.HasHardLinkGroup() != other.HasHardLinkGroup() {
+		return false
+	}
+	if p.HasHardLinkGroup() && *p.HardLinkGroup != *other.HardLinkGroup {
+		return false
+	}
 	if flags&RestorableMetadataOwnership != 0 {
 		if p.HasUID() != other.HasUID() || p.HasGID() != other.HasGID() {
 			return false
@@ -129,5 +149,10 @@ func (p *PathMetadata) IsEqualRestorableAttributes(other PathMetadata, flags Res
 		p.FileMode&restorableMetadataModeMask != other.FileMode&restorableMetadataModeMask {
 		return false
 	}
+	if flags&RestorableMetadataXattrs != 0 && !slices.EqualFunc(p.Xattrs, other.Xattrs, func(a, b *Xattr) bool {
+		return *a == *b
+	}) {
+		return false
+	}
 	return true
 }
@@ -27,10 +27,13 @@ func TestPathMetadata(t *testing.T) {
 				"FileHash",
 				"FileMode",
 				"Gid",
+				"HardLinkGroup",
+				"Holes",
 				"Mtime",
 				"Size",
 				"SymLinkTarget",
 				"Uid",
+				"Xattrs",
 			}, actualFields, "PathMetadata field names have changed, make sure to update IsEqualRestorableAttributes",
 		)
 
@@ -103,6 +106,23 @@ func TestPathMetadata(t *testing.T) {
 		assert.Equal(false, base.IsEqualRestorableAttributes(actual, RestorableMetadataAll))
 		assert.Equal(true, base.IsEqualRestorableAttributes(actual, RestorableMetadataAll^RestorableMetadataOwnership))
 
+		group := td.Path("a.txt")
+		actual = *base
+		actual.HardLinkGroup = &group
+		assert.Equal(false, base.IsEqualRestorableAttributes(actual, RestorableMetadataAll))
+		otherGroup := td.Path("b.txt")
+		linked := actual
+		linked.HardLinkGroup = &otherGroup
+		assert.Equal(false, actual.IsEqualRestorableAttributes(linked, RestorableMetadataAll))
+
+		actual = *base
+		actual.Xattrs = []*Xattr{{"user.tag", "red"}}
+		assert.Equal(false, base.IsEqualRestorableAttributes(actual, RestorableMetadataAll))
+		assert.Equal(true, base.IsEqualRestorableAttributes(actual, RestorableMetadataAll^RestorableMetadataXattrs))
+		tagged := actual
+		tagged.Xattrs = []*Xattr{{"user.tag", "blue"}}
+		assert.Equal(false, actual.IsEqualRestorableAttributes(tagged, RestorableMetadataAll))
+
 		// Birthtime is ignored because it is not restorable (on most systems).
 		actual = *base
 		modifiedBirth := Timestamp{Sec: base.Birthtime.Sec + 1, Nsec: base.Birthtime.Nsec}
@@ -5,6 +5,7 @@
 package lib
 
 import (
+	"errors"
 	"io/fs"
 )
 
@@ -12,11 +13,43 @@ type EnhancedStat_t struct {
 	CTimeSec  int64
 	CTimeNSec int32
 	Inode     uint64
+	Device    uint64
+	// The number of hard links to the file.
+	Nlink uint64
 }
 
 func EnhanceMetadata(md *PathMetadata, fileInfo fs.FileInfo) {
 }
 
+func readXattrs(path string) ([]*Xattr, error) {
+	return nil, nil
+}
+
+func writeXattrs(path string, xattrs []*Xattr) error {
+	if len(xattrs) == 0 {
+		return nil
+	}
+	return WrapErrorf(errors.ErrUnsupported, "extended attributes are not supported")
+}
+
+// There are no holes here (e.g. for a `MemoryFS` in the browser).
+func MayHaveHoles(fileInfo fs.FileInfo) bool {
+	return false
+}
+
+func readHoles(path string) ([]*Hole, error) {
+	return nil, nil
+}
+
+// There is no ctime and no inode here (e.g. for a `MemoryFS` in the
+// browser), the modification time has to do.
 func EnhancedStat(fileInfo fs.FileInfo) (*EnhancedStat_t, error) {
-	return nil, Errorf("not implemented")
+	mtime := fileInfo.ModTime()
+	return &EnhancedStat_t{
+		CTimeSec:  mtime.Unix(),
+		CTimeNSec: int32(mtime.Nanosecond()), //nolint:gosec
+		Inode:     0,
+		Device:    0,
+		Nlink:     1,
+	}, nil
 }
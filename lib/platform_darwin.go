@@ -5,12 +5,19 @@ package lib
 import (
 	"io/fs"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
+const errNoXattr = unix.ENOATTR
+
 type EnhancedStat_t struct {
 	CTimeSec  int64
 	CTimeNSec int32
 	Inode     uint64
+	Device    uint64
+	// The number of hard links to the file.
+	Nlink uint64
 }
 
 func EnhanceMetadata(md *PathMetadata, fileInfo fs.FileInfo) {
@@ -22,6 +29,12 @@ func EnhanceMetadata(md *PathMetadata, fileInfo fs.FileInfo) {
 	}
 }
 
+// Resource forks can be huge, they are skipped. ACLs are not extended
+// attributes on macOS and are not restored.
+func isRestorableXattr(name string) bool {
+	return name != "com.apple.ResourceFork"
+}
+
 func EnhancedStat(fileInfo fs.FileInfo) (*EnhancedStat_t, error) {
 	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
 	if !ok {
@@ -31,5 +44,7 @@ func EnhancedStat(fileInfo fs.FileInfo) (*EnhancedStat_t, error) {
 		CTimeSec:  stat.Ctimespec.Sec,
 		CTimeNSec: int32(stat.Ctimespec.Nsec), //nolint:gosec
 		Inode:     stat.Ino,
+		Device:    uint64(stat.Dev), //nolint:gosec
+		Nlink:     uint64(stat.Nlink),
 	}, nil
 }
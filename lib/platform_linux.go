@@ -4,13 +4,21 @@ package lib
 
 import (
 	"io/fs"
+	"strings"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
+const errNoXattr = unix.ENODATA
+
 type EnhancedStat_t struct {
 	CTimeSec  int64
 	CTimeNSec int32
 	Inode     uint64
+	Device    uint64
+	// The number of hard links to the file.
+	Nlink uint64
 }
 
 func EnhanceMetadata(md *PathMetadata, fileInfo fs.FileInfo) {
@@ -21,6 +29,12 @@ func EnhanceMetadata(md *PathMetadata, fileInfo fs.FileInfo) {
 	}
 }
 
+// Only the `user` namespace and POSIX ACLs are restored. The other
+// namespaces (`security`, `trusted`) belong to the system.
+func isRestorableXattr(name string) bool {
+	return strings.HasPrefix(name, "user.") || name == "system.posix_acl_access" || name == "system.posix_acl_default"
+}
+
 func EnhancedStat(fileInfo fs.FileInfo) (*EnhancedStat_t, error) {
 	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
 	if !ok {
@@ -30,5 +44,7 @@ func EnhancedStat(fileInfo fs.FileInfo) (*EnhancedStat_t, error) {
 		CTimeSec:  stat.Ctim.Sec,
 		CTimeNSec: int32(stat.Ctim.Nsec), //nolint:gosec
 		Inode:     stat.Ino,
+		Device:    uint64(stat.Dev),   //nolint:unconvert
+		Nlink:     uint64(stat.Nlink), //nolint:unconvert
 	}, nil
 }
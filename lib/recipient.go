@@ -0,0 +1,376 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+)
+
+// A recipient is an X25519 public key the repository keys are encrypted to
+// (similar to age). Whoever holds the matching identity (the private key)
+// opens the repository without the passphrase, e.g. a backup agent that
+// should never see the passphrase or the user-keys derived from it.
+// An identity unlocks the same keys as a passphrase, i.e. it can read
+// everything, too.
+//
+// The key of a recipient slot is derived with HKDF-SHA256 from the X25519
+// shared secret of an ephemeral key and the recipient's public key.
+//
+// Identities and recipients are formatted as
+//
+//	prefix | base32(key | checksum (4 bytes))
+//
+// where the checksum is the start of the SHA-256 of the key.
+const (
+	identityPrefix          = "CLING-SYNC-IDENTITY-"
+	recipientPrefix         = "cling-sync-recipient-"
+	recipientSectionPrefix  = "recipient."
+	recipientKeyChecksumLen = 4
+)
+
+//nolint:gochecknoglobals
+var aadRecipient = []byte("cling-sync/recipient")
+
+var ErrRecipientNotFound = WrapErrorKindf(ErrAuth, nil, "no recipient matches the identity")
+
+type recipientSlot struct {
+	PublicKey               []byte
+	EphemeralPublicKey      []byte
+	EncryptedKEK            EncryptedKey
+	EncryptedBlockIdHmacKey EncryptedKey
+	EncryptedGearCDCSeed    EncryptedKey
+}
+
+type Identity struct {
+	key *ecdh.PrivateKey
+}
+
+func NewIdentity() (*Identity, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to generate X25519 key")
+	}
+	return &Identity{key}, nil
+}
+
+// ParseIdentity parses an identity as written by `Identity.String`. Empty
+// lines and lines starting with `#` are ignored, so the content of an
+// identity file can be passed as is.
+func ParseIdentity(s string) (*Identity, error) {
+	line, ok := identityLine([]byte(s))
+	if !ok {
+		return nil, Errorf("invalid identity, expected a single line starting with %s", identityPrefix)
+	}
+	data, err := parseRecipientKey(line, identityPrefix)
+	if err != nil {
+		return nil, WrapErrorf(err, "invalid identity")
+	}
+	defer clear(data)
+	key, err := ecdh.X25519().NewPrivateKey(data)
+	if err != nil {
+		return nil, WrapErrorf(err, "invalid identity")
+	}
+	return &Identity{key}, nil
+}
+
+// IsIdentity reports whether `passphrase` is an identity rather than a
+// passphrase. Wherever a passphrase opens the repository, an identity
+// does, too.
+func IsIdentity(passphrase []byte) bool {
+	_, ok := identityLine(passphrase)
+	return ok
+}
+
+func identityLine(data []byte) (string, bool) {
+	var found string
+	for line := range strings.Lines(string(data)) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if found != "" || !strings.HasPrefix(line, identityPrefix) {
+			return "", false
+		}
+		found = line
+	}
+	return found, found != ""
+}
+
+func (i *Identity) String() string {
+	return formatRecipientKey(identityPrefix, i.key.Bytes())
+}
+
+// Recipient returns the public key of the identity to pass to
+// `AddRecipient`.
+func (i *Identity) Recipient() string {
+	return formatRecipientKey(recipientPrefix, i.key.PublicKey().Bytes())
+}
+
+func formatRecipientKey(prefix string, key []byte) string {
+	checksum := CalculateSha256(key)
+	data := append(append([]byte{}, key...), checksum[:recipientKeyChecksumLen]...)
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(data)
+	clear(data)
+	// Public keys are lower case, private keys upper case.
+	if prefix == strings.ToLower(prefix) {
+		encoded = strings.ToLower(encoded)
+	}
+	return prefix + encoded
+}
+
+func parseRecipientKey(s, prefix string) ([]byte, error) {
+	encoded, ok := strings.CutPrefix(s, prefix)
+	if !ok {
+		return nil, Errorf("missing prefix %s", prefix)
+	}
+	data, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(encoded))
+	if err != nil || len(data) != RawKeySize+recipientKeyChecksumLen {
+		// Don't wrap `err`, it might contain the key.
+		return nil, Errorf("failed to decode key")
+	}
+	key := data[:RawKeySize]
+	checksum := CalculateSha256(key)
+	if !bytes.Equal(checksum[:recipientKeyChecksumLen], data[RawKeySize:]) {
+		clear(data)
+		return nil, Errorf("checksum mismatch (typo?)")
+	}
+	return key, nil
+}
+
+func ParseRecipient(s string) (*ecdh.PublicKey, error) {
+	data, err := parseRecipientKey(strings.TrimSpace(s), recipientPrefix)
+	if err != nil {
+		return nil, WrapErrorf(err, "invalid recipient %q", s)
+	}
+	key, err := ecdh.X25519().NewPublicKey(data)
+	if err != nil {
+		return nil, WrapErrorf(err, "invalid recipient %q", s)
+	}
+	return key, nil
+}
+
+// AddRecipient encrypts the repository keys to `recipient` (see
+// `Identity.Recipient`) and stores them as the recipient `name` in the
+// repository config. `passphrase` has to open the repository.
+func AddRecipient(ctx context.Context, storage Storage, passphrase []byte, name string, recipient string) error {
+	if err := ValidateKeySlotName(name); err != nil {
+		return err
+	}
+	publicKey, err := ParseRecipient(recipient)
+	if err != nil {
+		return err
+	}
+	toml, _, keys, err := openKeySlots(ctx, storage, passphrase)
+	if err != nil {
+		return err
+	}
+	defer clear(keys.UserKey[:])
+	recipients, err := parseRecipients(toml)
+	if err != nil {
+		return err
+	}
+	for existing, r := range recipients {
+		if existing == name {
+			return Errorf("a recipient named %q already exists", name)
+		}
+		if bytes.Equal(r.PublicKey, publicKey.Bytes()) {
+			return Errorf("the recipient was already added as %q", existing)
+		}
+	}
+	slot, err := encryptToRecipient(keys, publicKey)
+	if err != nil {
+		return err
+	}
+	config := make(Toml, len(toml)+1)
+	for section, values := range toml {
+		config[section] = values
+	}
+	config[recipientSectionPrefix+name] = map[string]string{
+		"public-key":                   FormatRecoveryCode(slot.PublicKey),
+		"ephemeral-public-key":         FormatRecoveryCode(slot.EphemeralPublicKey),
+		"encrypted-key-encryption-key": FormatRecoveryCode(slot.EncryptedKEK[:]),
+		"encrypted-block-id-hmac":      FormatRecoveryCode(slot.EncryptedBlockIdHmacKey[:]),
+		"encrypted-gear-cdc-seed":      FormatRecoveryCode(slot.EncryptedGearCDCSeed[:]),
+	}
+	if err := storage.WriteConfig(ctx, config, RepositoryConfigHeaderComment); err != nil {
+		return WrapErrorf(err, "failed to write repository config")
+	}
+	if keys.Slot != "" {
+		if err := backupRepositoryConfig(ctx, storage, config, keys.Slot, keys.UserKey); err != nil {
+			return WrapErrorf(err, "failed to back up repository config")
+		}
+	}
+	return nil
+}
+
+func recipientCipher(shared, ephemeralPublicKey, publicKey []byte) (*recipientAEAD, error) {
+	salt := append(append([]byte{}, ephemeralPublicKey...), publicKey...)
+	key, err := hkdf.Key(sha256.New, shared, salt, string(aadRecipient), RawKeySize)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to derive recipient key")
+	}
+	defer clear(key)
+	cipher, err := NewCipher(RawKey(key))
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to create a XChaCha20Poly1305 cipher from recipient key")
+	}
+	return &recipientAEAD{cipher, ephemeralPublicKey}, nil
+}
+
+func encryptToRecipient(keys *repositoryKeys, publicKey *ecdh.PublicKey) (*recipientSlot, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to generate ephemeral X25519 key")
+	}
+	shared, err := ephemeral.ECDH(publicKey)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to compute X25519 shared secret")
+	}
+	defer clear(shared)
+	slot := &recipientSlot{ //nolint:exhaustruct
+		PublicKey:          publicKey.Bytes(),
+		EphemeralPublicKey: ephemeral.PublicKey().Bytes(),
+	}
+	c, err := recipientCipher(shared, slot.EphemeralPublicKey, slot.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range []struct {
+		key   RawKey
+		label []byte
+		dst   *EncryptedKey
+	}{
+		{keys.KEK, aadKEK, &slot.EncryptedKEK},
+		{keys.BlockIdHmacKey, aadBlockIdHmacKey, &slot.EncryptedBlockIdHmacKey},
+		{keys.GearCDCSeed, aadGearCDCSeed, &slot.EncryptedGearCDCSeed},
+	} {
+		encrypted, err := Encrypt(k.key[:], c.cipher, c.aad(k.label), make([]byte, EncryptedKeySize))
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to encrypt repository key to recipient")
+		}
+		if len(encrypted) != EncryptedKeySize {
+			return nil, Errorf("encrypted key has wrong size, want %d, got %d", EncryptedKeySize, len(encrypted))
+		}
+		*k.dst = EncryptedKey(encrypted)
+	}
+	return slot, nil
+}
+
+// Decrypt the repository keys with the recipient slot that matches
+// `identity`. `UserKey` and `Slot` of the result are empty.
+func decryptRecipientKeys(toml Toml, identity []byte) (*repositoryKeys, error) {
+	line, _ := identityLine(identity)
+	i, err := ParseIdentity(line)
+	if err != nil {
+		return nil, err
+	}
+	recipients, err := parseRecipients(toml)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := i.key.PublicKey().Bytes()
+	var slot *recipientSlot
+	for _, r := range recipients {
+		if bytes.Equal(r.PublicKey, publicKey) {
+			slot = &r
+			break
+		}
+	}
+	if slot == nil {
+		return nil, ErrRecipientNotFound
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(slot.EphemeralPublicKey)
+	if err != nil {
+		return nil, WrapErrorf(err, "invalid ephemeral public key in repository config")
+	}
+	shared, err := i.key.ECDH(ephemeral)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to compute X25519 shared secret")
+	}
+	defer clear(shared)
+	c, err := recipientCipher(shared, slot.EphemeralPublicKey, slot.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	var keys repositoryKeys
+	for _, k := range []struct {
+		encrypted EncryptedKey
+		label     []byte
+		dst       *RawKey
+	}{
+		{slot.EncryptedKEK, aadKEK, &keys.KEK},
+		{slot.EncryptedBlockIdHmacKey, aadBlockIdHmacKey, &keys.BlockIdHmacKey},
+		{slot.EncryptedGearCDCSeed, aadGearCDCSeed, &keys.GearCDCSeed},
+	} {
+		key, err := Decrypt(k.encrypted[:], c.cipher, c.aad(k.label), make([]byte, RawKeySize))
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to decrypt repository key with identity")
+		}
+		*k.dst = RawKey(key)
+	}
+	return &keys, nil
+}
+
+type recipientAEAD struct {
+	cipher             cipher.AEAD
+	ephemeralPublicKey []byte
+}
+
+func (r *recipientAEAD) aad(label []byte) []byte {
+	aad := make([]byte, 0, len(r.ephemeralPublicKey)+len(label))
+	aad = append(aad, r.ephemeralPublicKey...)
+	aad = append(aad, label...)
+	return aad
+}
+
+// Parse all `recipient.<name>` sections.
+func parseRecipients(toml Toml) (map[string]recipientSlot, error) {
+	recipients := map[string]recipientSlot{}
+	for section := range toml {
+		name, ok := strings.CutPrefix(section, recipientSectionPrefix)
+		if !ok {
+			continue
+		}
+		if err := ValidateKeySlotName(name); err != nil {
+			return nil, WrapErrorf(err, "invalid section `%s` in repository config", section)
+		}
+		parse := func(key string, expectedLen int) ([]byte, error) {
+			v, ok := toml.GetValue(section, key)
+			if !ok {
+				return nil, Errorf("missing key `%s.%s` in repository config", section, key)
+			}
+			b, err := ParseRecoveryCode(v)
+			if err != nil || len(b) != expectedLen {
+				return nil, Errorf("invalid key `%s.%s` in repository config", section, key)
+			}
+			return b, nil
+		}
+		var slot recipientSlot
+		var err error
+		if slot.PublicKey, err = parse("public-key", RawKeySize); err != nil {
+			return nil, err
+		}
+		if slot.EphemeralPublicKey, err = parse("ephemeral-public-key", RawKeySize); err != nil {
+			return nil, err
+		}
+		for key, dst := range map[string]*EncryptedKey{
+			"encrypted-key-encryption-key": &slot.EncryptedKEK,
+			"encrypted-block-id-hmac":      &slot.EncryptedBlockIdHmacKey,
+			"encrypted-gear-cdc-seed":      &slot.EncryptedGearCDCSeed,
+		} {
+			b, err := parse(key, EncryptedKeySize)
+			if err != nil {
+				return nil, err
+			}
+			*dst = EncryptedKey(b)
+		}
+		recipients[name] = slot
+	}
+	return recipients, nil
+}
@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecipients(t *testing.T) {
+	t.Parallel()
+	t.Run("Open the repository with an identity", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		entry, _ := testEntry(t, r, "a.txt", "abc")
+		head, err := testCommit(t, r.Repository, entry)
+		assert.NoError(err)
+		identity, err := NewIdentity()
+		assert.NoError(err)
+
+		_, err = OpenRepository(t.Context(), r.Storage, []byte(identity.String()))
+		assert.ErrorIs(err, ErrRecipientNotFound)
+		assert.NoError(AddRecipient(t.Context(), r.Storage, []byte(r.Passphrase), "agent", identity.Recipient()))
+		// The content of an identity file works as is.
+		identityFile := "# recipient: " + identity.Recipient() + "\n" + identity.String() + "\n"
+		sut, err := OpenRepository(t.Context(), r.Storage, []byte(identityFile))
+		assert.NoError(err)
+		_, err = sut.ReadRevision(t.Context(), head, NewBlockBuf())
+		assert.NoError(err)
+		entry, _ = testEntry(t, r, "b.txt", "def")
+		_, err = testCommit(t, sut, entry)
+		assert.NoError(err)
+		_, err = OpenRepository(t.Context(), r.Storage, []byte(r.Passphrase))
+		assert.NoError(err)
+
+		other, err := NewIdentity()
+		assert.NoError(err)
+		_, err = OpenRepository(t.Context(), r.Storage, []byte(other.String()))
+		assert.ErrorIs(err, ErrRecipientNotFound)
+	})
+
+	t.Run("Invalid or duplicate recipients are rejected", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		passphrase := []byte(r.Passphrase)
+		identity, err := NewIdentity()
+		assert.NoError(err)
+		assert.NoError(AddRecipient(t.Context(), r.Storage, passphrase, "agent", identity.Recipient()))
+		other, err := NewIdentity()
+		assert.NoError(err)
+		err = AddRecipient(t.Context(), r.Storage, passphrase, "agent", other.Recipient())
+		assert.Error(err, `a recipient named "agent" already exists`)
+		err = AddRecipient(t.Context(), r.Storage, passphrase, "other", identity.Recipient())
+		assert.Error(err, `the recipient was already added as "agent"`)
+		err = AddRecipient(t.Context(), r.Storage, passphrase, "other agent", other.Recipient())
+		assert.Error(err, "invalid passphrase name")
+		// The last character carries padding bits, so change the first one
+		// after the prefix.
+		recipient := other.Recipient()
+		i := len(recipientPrefix)
+		typo := "a"
+		if recipient[i] == 'a' {
+			typo = "b"
+		}
+		err = AddRecipient(t.Context(), r.Storage, passphrase, "other", recipient[:i]+typo+recipient[i+1:])
+		assert.Error(err, "checksum mismatch")
+		err = AddRecipient(t.Context(), r.Storage, passphrase, "other", identity.String())
+		assert.Error(err, "missing prefix")
+		err = AddRecipient(t.Context(), r.Storage, []byte("wrong passphrase"), "other", other.Recipient())
+		assert.Error(err, "failed to decrypt repository keys")
+	})
+
+	t.Run("Parse identities", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		identity, err := NewIdentity()
+		assert.NoError(err)
+		parsed, err := ParseIdentity(identity.String())
+		assert.NoError(err)
+		assert.Equal(identity.Recipient(), parsed.Recipient())
+		assert.Equal(true, IsIdentity([]byte(identity.String()+"\n")))
+		assert.Equal(false, IsIdentity([]byte("correct horse battery staple")))
+		assert.Equal(false, IsIdentity([]byte(identity.String()+"\n"+identity.String())))
+		_, err = ParseIdentity(strings.TrimPrefix(identity.String(), identityPrefix))
+		assert.Error(err, "invalid identity")
+	})
+
+	t.Run("Recipients survive key slot changes", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		identity, err := NewIdentity()
+		assert.NoError(err)
+		assert.NoError(AddRecipient(t.Context(), r.Storage, []byte(r.Passphrase), "agent", identity.Recipient()))
+		// An identity can manage passphrases, too.
+		err = AddPassphrase(t.Context(), r.Storage, []byte(identity.String()), "laptop", []byte("second passphrase"))
+		assert.NoError(err)
+		assert.NoError(RemovePassphrase(t.Context(), r.Storage, []byte(r.Passphrase), "laptop"))
+		_, err = OpenRepository(t.Context(), r.Storage, []byte(identity.String()))
+		assert.NoError(err)
+	})
+}
@@ -0,0 +1,214 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+)
+
+// A recovery code holds the raw repository keys, i.e. everything the
+// passphrase protects. It is formatted with `FormatRecoveryCode`:
+//
+//	version (1 byte) | KEK | block id HMAC key | GearCDC seed | repository id | checksum (4 bytes)
+//
+// The checksum is the start of the SHA-256 of everything before it and
+// catches typos when the code is entered by hand.
+// The blocks of a repository can only be read with its repository id, so
+// the id is part of the code, too. Codes of version 1 don't have it, they
+// are exported for repositories of `LegacyStorageVersion`.
+const (
+	recoveryCodeVersion       = 2
+	legacyRecoveryCodeVersion = 1
+	recoveryCodeChecksumSize  = 4
+	legacyRecoveryCodeSize    = 1 + 3*RawKeySize + recoveryCodeChecksumSize
+	recoveryCodeSize          = legacyRecoveryCodeSize + len(RepositoryId{})
+)
+
+var ErrInvalidRecoveryCode = WrapErrorKindf(ErrAuth, nil, "invalid recovery code")
+
+// ExportRecoveryCode decrypts the repository keys with `passphrase` and
+// returns them as a recovery code.
+func ExportRecoveryCode(ctx context.Context, storage Storage, passphrase []byte) (string, error) {
+	toml, err := storage.Open(ctx)
+	if err != nil {
+		return "", WrapErrorf(err, "failed to open storage")
+	}
+	keys, err := decryptrepositoryKeys(toml, passphrase)
+	if err != nil {
+		return "", WrapErrorf(err, "failed to decrypt repository keys")
+	}
+	clear(keys.UserKey[:])
+	info, err := parseStorageConfig(toml)
+	if err != nil {
+		return "", err
+	}
+	data := make([]byte, 0, recoveryCodeSize)
+	if info.Version == LegacyStorageVersion {
+		data = append(data, legacyRecoveryCodeVersion)
+	} else {
+		data = append(data, recoveryCodeVersion)
+	}
+	data = append(data, keys.KEK[:]...)
+	data = append(data, keys.BlockIdHmacKey[:]...)
+	data = append(data, keys.GearCDCSeed[:]...)
+	if info.Version != LegacyStorageVersion {
+		data = append(data, info.RepositoryId[:]...)
+	}
+	checksum := CalculateSha256(data)
+	data = append(data, checksum[:recoveryCodeChecksumSize]...)
+	code := FormatRecoveryCode(data)
+	clear(data)
+	return code, nil
+}
+
+// Return the keys and the storage info of the repository. The storage info
+// is nil for legacy codes, i.e. it has to be taken from the repository
+// config.
+func parseRecoveryCode(code string) (*repositoryKeys, *storageInfo, error) {
+	data, err := ParseRecoveryCode(code)
+	if err != nil {
+		// Don't wrap `err`, it contains the code.
+		return nil, nil, ErrInvalidRecoveryCode
+	}
+	defer clear(data)
+	if len(data) == 0 {
+		return nil, nil, ErrInvalidRecoveryCode
+	}
+	size := recoveryCodeSize
+	switch data[0] {
+	case recoveryCodeVersion:
+	case legacyRecoveryCodeVersion:
+		size = legacyRecoveryCodeSize
+	default:
+		return nil, nil, WrapErrorf(ErrInvalidRecoveryCode, "unsupported version %d", data[0])
+	}
+	if len(data) != size {
+		return nil, nil, WrapErrorf(ErrInvalidRecoveryCode, "want %d bytes, got %d", size, len(data))
+	}
+	payload := data[:len(data)-recoveryCodeChecksumSize]
+	checksum := CalculateSha256(payload)
+	if !bytes.Equal(checksum[:recoveryCodeChecksumSize], data[len(payload):]) {
+		return nil, nil, WrapErrorf(ErrInvalidRecoveryCode, "checksum mismatch (typo?)")
+	}
+	var keys repositoryKeys
+	rest := payload[1:]
+	copy(keys.KEK[:], rest[:RawKeySize])
+	copy(keys.BlockIdHmacKey[:], rest[RawKeySize:2*RawKeySize])
+	copy(keys.GearCDCSeed[:], rest[2*RawKeySize:3*RawKeySize])
+	if data[0] == legacyRecoveryCodeVersion {
+		return &keys, nil, nil
+	}
+	info := storageInfo{StorageVersion, RepositoryId(rest[3*RawKeySize:])}
+	return &keys, &info, nil
+}
+
+// Check that the repository id in the code matches the repository config.
+func checkRecoveryCodeStorageInfo(toml Toml, info *storageInfo) error {
+	if info == nil {
+		return nil
+	}
+	existing, err := parseStorageConfig(toml)
+	if err != nil {
+		return err
+	}
+	if existing != *info {
+		return WrapErrorKindf(ErrAuth, nil, "the recovery code does not match the repository")
+	}
+	return nil
+}
+
+// The keys are checked against the head revision, so a recovery code that
+// belongs to another repository is rejected (unless the repository is empty).
+func openRepositoryWithKeys(
+	ctx context.Context,
+	storage Storage,
+	keys *repositoryKeys,
+	config Toml,
+) (*Repository, error) {
+	repository, err := newRepository(storage, keys, config)
+	if err != nil {
+		return nil, err
+	}
+	head, err := repository.Head(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if head.IsRoot() {
+		return repository, nil
+	}
+	if _, err := readVerifiedBlock(ctx, repository, BlockId(head), NewBlockBuf()); err != nil {
+		return nil, WrapErrorKindf(ErrAuth, err, "the recovery code does not match the repository")
+	}
+	return repository, nil
+}
+
+// OpenRepositoryWithRecoveryCode opens the repository without a passphrase.
+func OpenRepositoryWithRecoveryCode(ctx context.Context, storage Storage, code string) (*Repository, error) {
+	toml, err := storage.Open(ctx)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to open storage")
+	}
+	keys, info, err := parseRecoveryCode(code)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRecoveryCodeStorageInfo(toml, info); err != nil {
+		return nil, err
+	}
+	return openRepositoryWithKeys(ctx, storage, keys, toml)
+}
+
+// ResetPassphrase encrypts the repository keys from `code` with
+// `newPassphrase` and replaces the repository config. This also works if
+// the repository config is lost.
+func ResetPassphrase(
+	ctx context.Context,
+	storage Storage,
+	code string,
+	newPassphrase []byte,
+) (*Repository, error) {
+	toml, err := storage.Open(ctx)
+	if errors.Is(err, ErrStorageNotFound) {
+		toml = nil
+	} else if err != nil {
+		return nil, WrapErrorf(err, "failed to open storage")
+	}
+	keys, info, err := parseRecoveryCode(code)
+	if err != nil {
+		return nil, err
+	}
+	if toml == nil {
+		// A legacy code can only belong to a legacy repository.
+		if info == nil {
+			info = &storageInfo{LegacyStorageVersion, RepositoryId{}}
+		}
+		toml = Toml{storageSection: createStorageConfig(*info)}
+	} else if err := checkRecoveryCodeStorageInfo(toml, info); err != nil {
+		return nil, err
+	}
+	repository, err := openRepositoryWithKeys(ctx, storage, keys, toml)
+	if err != nil {
+		return nil, err
+	}
+	slot, err := encryptRepositoryKeys(keys, newPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(keys.UserKey[:])
+	keys.Slot = DefaultKeySlot
+	// The other passphrases still work.
+	slots, err := parseKeySlots(toml)
+	if err != nil {
+		return nil, err
+	}
+	mki := masterKeyInfo{EncryptionVersion, slot, slots}
+	config, err := writeRepositoryConfig(ctx, storage, toml, mki)
+	if err != nil {
+		return nil, err
+	}
+	if err := backupRepositoryConfig(ctx, storage, config, DefaultKeySlot, keys.UserKey); err != nil {
+		return nil, WrapErrorf(err, "failed to back up repository config")
+	}
+	repository.config = config
+	return repository, nil
+}
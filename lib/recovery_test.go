@@ -0,0 +1,170 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecoveryCodeExport(t *testing.T) {
+	t.Parallel()
+	t.Run("Open the repository with the recovery code", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		entry, _ := testEntry(t, r, "a.txt", "abc")
+		head, err := testCommit(t, r.Repository, entry)
+		assert.NoError(err)
+		code, err := ExportRecoveryCode(t.Context(), r.Storage, []byte(r.Passphrase))
+		assert.NoError(err)
+
+		sut, err := OpenRepositoryWithRecoveryCode(t.Context(), r.Storage, code)
+		assert.NoError(err)
+		revision, err := sut.ReadRevision(t.Context(), head, NewBlockBuf())
+		assert.NoError(err)
+		assert.Equal(r.Config(), sut.Config())
+		expected, err := r.ReadRevision(t.Context(), head, NewBlockBuf())
+		assert.NoError(err)
+		assert.Equal(expected, revision)
+	})
+
+	t.Run("Wrong passphrase", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		_, err := ExportRecoveryCode(t.Context(), r.Storage, []byte("wrong passphrase"))
+		assert.Error(err, "failed to decrypt repository keys")
+	})
+
+	t.Run("A typo is detected", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		code, err := ExportRecoveryCode(t.Context(), r.Storage, []byte(r.Passphrase))
+		assert.NoError(err)
+		typo := "A"
+		if code[0] == 'A' {
+			typo = "B"
+		}
+		_, err = OpenRepositoryWithRecoveryCode(t.Context(), r.Storage, typo+code[1:])
+		assert.ErrorIs(err, ErrInvalidRecoveryCode)
+		_, err = OpenRepositoryWithRecoveryCode(t.Context(), r.Storage, code[:len(code)-5])
+		assert.ErrorIs(err, ErrInvalidRecoveryCode)
+		_, err = OpenRepositoryWithRecoveryCode(t.Context(), r.Storage, "not a code")
+		assert.ErrorIs(err, ErrInvalidRecoveryCode)
+	})
+
+	t.Run("The recovery code of a copy with another repository id is rejected", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		code, err := ExportRecoveryCode(t.Context(), r.Storage, []byte(r.Passphrase))
+		assert.NoError(err)
+		config := r.Config()
+		info, err := newStorageInfo()
+		assert.NoError(err)
+		config[storageSection] = createStorageConfig(info)
+		assert.NoError(r.Storage.WriteConfig(t.Context(), config, RepositoryConfigHeaderComment))
+		_, err = OpenRepositoryWithRecoveryCode(t.Context(), r.Storage, code)
+		assert.Error(err, "the recovery code does not match the repository")
+	})
+
+	t.Run("The recovery code of another repository is rejected", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		entry, _ := testEntry(t, r, "a.txt", "abc")
+		_, err := testCommit(t, r.Repository, entry)
+		assert.NoError(err)
+		other := td.NewTestRepository(t, td.NewFS(t))
+		code, err := ExportRecoveryCode(t.Context(), other.Storage, []byte(other.Passphrase))
+		assert.NoError(err)
+		_, err = OpenRepositoryWithRecoveryCode(t.Context(), r.Storage, code)
+		assert.Error(err, "the recovery code does not match the repository")
+		_, err = ResetPassphrase(t.Context(), r.Storage, code, []byte("new passphrase"))
+		assert.Error(err, "the recovery code does not match the repository")
+		_, err = OpenRepository(t.Context(), r.Storage, []byte(r.Passphrase))
+		assert.NoError(err)
+	})
+}
+
+func TestResetPassphrase(t *testing.T) {
+	t.Parallel()
+	t.Run("Happy path", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		entry, _ := testEntry(t, r, "a.txt", "abc")
+		head, err := testCommit(t, r.Repository, entry)
+		assert.NoError(err)
+		code, err := ExportRecoveryCode(t.Context(), r.Storage, []byte(r.Passphrase))
+		assert.NoError(err)
+
+		sut, err := ResetPassphrase(t.Context(), r.Storage, code, []byte("new passphrase"))
+		assert.NoError(err)
+		config, err := r.Storage.Open(t.Context())
+		assert.NoError(err)
+		assert.Equal(config, sut.Config())
+		_, err = OpenRepository(t.Context(), r.Storage, []byte(r.Passphrase))
+		assert.Error(err, "failed to decrypt repository keys")
+		repository, err := OpenRepository(t.Context(), r.Storage, []byte("new passphrase"))
+		assert.NoError(err)
+		_, err = repository.ReadRevision(t.Context(), head, NewBlockBuf())
+		assert.NoError(err)
+		backup, err := ReadRepositoryConfigBackup(t.Context(), r.Storage, []byte("new passphrase"))
+		assert.NoError(err)
+		assert.Equal(true, config.Eq(backup))
+		// The keys don't change, i.e. the recovery code stays the same.
+		newCode, err := ExportRecoveryCode(t.Context(), r.Storage, []byte("new passphrase"))
+		assert.NoError(err)
+		assert.Equal(code, newCode)
+	})
+
+	t.Run("The repository config is restored", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		fs := td.NewFS(t)
+		r := td.NewTestRepository(t, fs)
+		entry, _ := testEntry(t, r, "a.txt", "abc")
+		head, err := testCommit(t, r.Repository, entry)
+		assert.NoError(err)
+		code, err := ExportRecoveryCode(t.Context(), r.Storage, []byte(r.Passphrase))
+		assert.NoError(err)
+		assert.NoError(fs.Remove(r.Storage.configFilePath()))
+
+		_, err = ResetPassphrase(t.Context(), r.Storage, strings.ToLower(code), []byte("new passphrase"))
+		assert.ErrorIs(err, ErrInvalidRecoveryCode)
+		_, err = ResetPassphrase(t.Context(), r.Storage, code, []byte("new passphrase"))
+		assert.NoError(err)
+		repository, err := OpenRepository(t.Context(), r.Storage, []byte("new passphrase"))
+		assert.NoError(err)
+		// The repository id is restored from the recovery code.
+		assert.Equal(r.Config()["storage"], repository.Config()["storage"])
+		_, err = repository.ReadRevision(t.Context(), head, NewBlockBuf())
+		assert.NoError(err)
+	})
+
+	t.Run("The config of a legacy repository is restored", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		fs := td.NewFS(t)
+		r := td.NewLegacyTestRepository(t, fs)
+		entry, _ := testEntry(t, r, "a.txt", "abc")
+		head, err := testCommit(t, r.Repository, entry)
+		assert.NoError(err)
+		code, err := ExportRecoveryCode(t.Context(), r.Storage, []byte(r.Passphrase))
+		assert.NoError(err)
+		data, err := ParseRecoveryCode(code)
+		assert.NoError(err)
+		assert.Equal(byte(legacyRecoveryCodeVersion), data[0])
+		assert.Equal(legacyRecoveryCodeSize, len(data))
+		assert.NoError(fs.Remove(r.Storage.configFilePath()))
+
+		_, err = ResetPassphrase(t.Context(), r.Storage, code, []byte("new passphrase"))
+		assert.NoError(err)
+		repository, err := OpenRepository(t.Context(), r.Storage, []byte("new passphrase"))
+		assert.NoError(err)
+		assert.Equal(r.Config()["storage"], repository.Config()["storage"])
+		_, err = repository.ReadRevision(t.Context(), head, NewBlockBuf())
+		assert.NoError(err)
+	})
+}
@@ -0,0 +1,271 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// repair runs the repairs of `CheckHealth` in repair mode that have to be
+// done before the revisions can be walked.
+func repair(ctx context.Context, repository *Repository, tempFS FS, opts HealthCheckOptions) error {
+	if err := removeStaleTempFiles(ctx, repository, opts.Monitor); err != nil {
+		return err
+	}
+	chains := &revisionChains{repository, NewBlockBuf(), map[RevisionId]int{}}
+	if err := repairHead(ctx, repository, tempFS, chains, opts); err != nil {
+		return err
+	}
+	return repairTags(ctx, repository, chains, opts.Monitor)
+}
+
+// Remove the leftovers of interrupted writes of blocks that `FileStorage.Open`
+// does not look for.
+func removeStaleTempFiles(ctx context.Context, repository *Repository, monitor HealthCheckMonitor) error {
+	fileStorage, ok := repository.storage.(*FileStorage)
+	if !ok {
+		return nil
+	}
+	removed, err := fileStorage.RemoveStaleTempFiles(ctx, time.Now().Add(-StaleTempFileAge))
+	for _, path := range removed {
+		monitor.OnRepair("removed the stale temporary file " + path)
+	}
+	return err
+}
+
+// repairHead makes sure that the head points to a revision whose chain can be
+// read down to the root.
+//
+// If the head is broken, it is reset to the newest revision of its chain that
+// is intact, i.e. the revisions above it are dropped. They are not deleted,
+// they just become orphans. This needs `opts.ConfirmDropRevisions`.
+// If the head reference is missing or invalid (or the head revision itself
+// cannot be read), it is re-derived from all revisions in storage: The tip of
+// the longest intact chain becomes the head. This reads every block in
+// storage.
+func repairHead(
+	ctx context.Context,
+	repository *Repository,
+	tempFS FS,
+	chains *revisionChains,
+	opts HealthCheckOptions,
+) error {
+	head, headErr := repository.Head(ctx)
+	if headErr != nil && !errors.Is(headErr, ErrControlFileNotFound) && !errors.Is(headErr, ErrCorrupt) {
+		return headErr
+	}
+	var newHead RevisionId
+	var dropped []RevisionId
+	found := false
+	if headErr == nil {
+		var err error
+		newHead, dropped, found, err = chains.intactAncestor(ctx, head)
+		if err != nil {
+			return err
+		}
+		if found && len(dropped) == 0 {
+			return nil
+		}
+	}
+	if !found {
+		var err error
+		newHead, err = chains.longest(ctx, tempFS)
+		if err != nil {
+			return err
+		}
+	}
+	if len(dropped) > 0 {
+		if opts.ConfirmDropRevisions == nil || !opts.ConfirmDropRevisions(dropped) {
+			return WrapErrorKindf(ErrCorrupt, nil,
+				"the head revision %s is corrupt, resetting the head to %s would drop %d revisions",
+				head, newHead, len(dropped))
+		}
+	}
+	var err error
+	switch {
+	case headErr == nil:
+		err = CompareAndSwapRef(ctx, repository.storage, "head", &head, newHead)
+	case errors.Is(headErr, ErrControlFileNotFound):
+		err = CompareAndSwapRef(ctx, repository.storage, "head", nil, newHead)
+	default:
+		err = WriteRef(ctx, repository.storage, "head", newHead)
+	}
+	if err != nil {
+		return WrapErrorf(err, "failed to repair head reference")
+	}
+	if headErr == nil {
+		opts.Monitor.OnRepair(fmt.Sprintf("reset the head from %s to %s, dropped %d revisions",
+			head, newHead, len(dropped)))
+	} else {
+		opts.Monitor.OnRepair(fmt.Sprintf("re-derived the head reference: %s", newHead))
+	}
+	return nil
+}
+
+// repairTags deletes all tags that are invalid or point to a revision whose
+// chain is broken.
+func repairTags(ctx context.Context, repository *Repository, chains *revisionChains, monitor HealthCheckMonitor) error {
+	refs, err := ListRefs(ctx, repository.storage)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		name, ok := strings.CutPrefix(ref, tagRefPrefix)
+		if !ok {
+			continue
+		}
+		reason := ""
+		revisionId, err := ReadRef(ctx, repository.storage, ref)
+		if errors.Is(err, ErrCorrupt) {
+			reason = "is invalid"
+		} else if err != nil {
+			return err
+		} else {
+			length, err := chains.length(ctx, revisionId)
+			if err != nil {
+				return err
+			}
+			if length < 0 {
+				reason = fmt.Sprintf("points to the corrupt revision %s", revisionId)
+			}
+		}
+		if reason == "" {
+			continue
+		}
+		if err := DeleteRef(ctx, repository.storage, ref); err != nil {
+			return WrapErrorf(err, "failed to delete tag %s", name)
+		}
+		monitor.OnRepair(fmt.Sprintf("deleted the tag %s, it %s", name, reason))
+	}
+	return nil
+}
+
+// revisionChains finds out which revisions can be read down to the root.
+// Every revision is only read once.
+type revisionChains struct {
+	repository *Repository
+	buf        BlockBuf
+	// The number of revisions from a revision down to the root (including
+	// the revision itself), -1 if any of them is corrupt or missing.
+	lengths map[RevisionId]int
+}
+
+// Return the number of revisions from `revisionId` down to the root or -1 if
+// any of them is corrupt or missing.
+func (c *revisionChains) length(ctx context.Context, revisionId RevisionId) (int, error) {
+	path := []RevisionId{}
+	length := 0
+	for !revisionId.IsRoot() {
+		if l, ok := c.lengths[revisionId]; ok {
+			length = l
+			break
+		}
+		revision, err := c.repository.ReadRevision(ctx, revisionId, c.buf)
+		if err == nil {
+			err = checkRevisionEntries(ctx, c.repository, revisionId, &revision, c.buf, nil)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrCorrupt) && !errors.Is(err, ErrBlockNotFound) {
+				return 0, err
+			}
+			c.lengths[revisionId] = -1
+			length = -1
+			break
+		}
+		path = append(path, revisionId)
+		revisionId = revision.ParentRevisionId
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		if length >= 0 {
+			length++
+		}
+		c.lengths[path[i]] = length
+	}
+	return length, nil
+}
+
+// Walk from `head` towards the root and return the first revision with an
+// intact chain and the revisions above it (newest first).
+// `found` is false if a revision cannot be read, i.e. its parent is unknown.
+func (c *revisionChains) intactAncestor(
+	ctx context.Context,
+	head RevisionId,
+) (revisionId RevisionId, dropped []RevisionId, found bool, err error) {
+	revisionId = head
+	for !revisionId.IsRoot() {
+		length, err := c.length(ctx, revisionId)
+		if err != nil {
+			return RevisionId{}, nil, false, err
+		}
+		if length >= 0 {
+			break
+		}
+		dropped = append(dropped, revisionId)
+		revision, err := c.repository.ReadRevision(ctx, revisionId, c.buf)
+		if errors.Is(err, ErrCorrupt) || errors.Is(err, ErrBlockNotFound) {
+			return RevisionId{}, dropped, false, nil
+		}
+		if err != nil {
+			return RevisionId{}, nil, false, err
+		}
+		revisionId = revision.ParentRevisionId
+	}
+	return revisionId, dropped, true, nil
+}
+
+// Read every block in storage and return the tip of the longest intact
+// revision chain. Ties are broken by the newest timestamp. Return the root
+// revision if there is no intact revision.
+func (c *revisionChains) longest(ctx context.Context, tempFS FS) (RevisionId, error) {
+	storedFS, err := tempFS.MkSub("repair")
+	if err != nil {
+		return RevisionId{}, WrapErrorf(err, "failed to create temp directory for stored block ids")
+	}
+	stored, err := ReadSortedBlockIds(ctx, c.repository.storage, storedFS, nil)
+	if err != nil {
+		return RevisionId{}, WrapErrorf(err, "failed to snapshot storage block ids")
+	}
+	defer stored.Remove() //nolint:errcheck
+	tip := RevisionId{}
+	tipLength := 0
+	var tipTimestamp Timestamp
+	reader := stored.Reader(nil)
+	buf := NewBlockBuf()
+	for {
+		blockId, err := reader.Read(buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return RevisionId{}, WrapErrorf(err, "failed to read stored block id")
+		}
+		revisionId := RevisionId(blockId)
+		// Most blocks are not revisions, they fail with `ErrCorrupt`.
+		revision, err := c.repository.ReadRevision(ctx, revisionId, buf)
+		if errors.Is(err, ErrCorrupt) {
+			continue
+		}
+		if err != nil {
+			return RevisionId{}, err
+		}
+		length, err := c.length(ctx, revisionId)
+		if err != nil {
+			return RevisionId{}, err
+		}
+		if length < tipLength || length <= 0 {
+			continue
+		}
+		if length == tipLength {
+			newer := revision.Timestamp.Time().Compare(tipTimestamp.Time())
+			if newer < 0 || newer == 0 && bytes.Compare(revisionId[:], tip[:]) < 0 {
+				continue
+			}
+		}
+		tip, tipLength, tipTimestamp = revisionId, length, revision.Timestamp
+	}
+	return tip, nil
+}
@@ -0,0 +1,289 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+type ReplicationMonitor interface {
+	OnSrcBlockIdsRead(blocksTotal int)
+	OnDstBlockIdsRead(blocksTotal int)
+	OnBeforeCopy(srcBlocks, dstBlocks int)
+	OnCopyBlock(blockId BlockId, length int)
+	OnCopyControlFile(section ControlFileSection, name string)
+}
+
+type ReplicationOptions struct {
+	Monitor ReplicationMonitor
+	Workers int
+}
+
+// The sections copied by `Replicate`. The head is copied last.
+var replicatedControlFileSections = []ControlFileSection{ //nolint:gochecknoglobals
+	ControlFileSectionSecurity,
+	ControlFileSectionConf,
+	ControlFileSectionLostFound,
+	ControlFileSectionFiles,
+	ControlFileSectionRefs,
+}
+
+// Replicate copies the repository in `src` to `dst` as it is: every block
+// that is missing in `dst` and every control file that is missing or
+// different. Nothing is decrypted, so no passphrase is needed and `dst` is
+// a mirror that can be opened with the same passphrases as `src`.
+//
+// `dst` is initialized with the config of `src` if it does not exist yet,
+// otherwise both must be the same repository (see `isSameRepository`) and
+// the config of `dst` is updated if it changed. The head of `dst` must
+// be a revision of `src`, i.e. `dst` must not have commits of its own.
+//
+// Block ids are HMACs of the plaintext, so they cannot be verified without
+// the keys. Instead, every block must be a well-formed block envelope (see
+// `verifyBlockEnvelope`) before it is written.
+func Replicate(ctx context.Context, src, dst Storage, tempFS FS, opts ReplicationOptions) error { //nolint:funlen
+	if opts.Workers < 1 {
+		return Errorf("number of workers must be at least 1")
+	}
+	if err := replicateConfig(ctx, src, dst); err != nil {
+		return err
+	}
+	// Read the head before listing the blocks, see `SyncRepository`.
+	srcHead, err := ReadRef(ctx, src, "head")
+	if err != nil {
+		return WrapErrorf(err, "failed to read src head")
+	}
+	dstHead, err := ReadRef(ctx, dst, "head")
+	dstHasHead := err == nil
+	if err != nil && !errors.Is(err, ErrControlFileNotFound) {
+		return WrapErrorf(err, "failed to read dst head")
+	}
+	srcFS, err := tempFS.MkSub("src")
+	if err != nil {
+		return WrapErrorf(err, "failed to create temp dir for src block ids")
+	}
+	srcCount := 0
+	dstHeadInSrc := !dstHasHead || dstHead.IsRoot()
+	srcTemp, err := ReadSortedBlockIds(ctx, src, srcFS, func(id BlockId) {
+		srcCount++
+		if srcCount%blockIdReadProgressEvery == 0 {
+			opts.Monitor.OnSrcBlockIdsRead(srcCount)
+		}
+		if id == BlockId(dstHead) {
+			dstHeadInSrc = true
+		}
+	})
+	if err != nil {
+		return WrapErrorf(err, "failed to snapshot src block ids")
+	}
+	defer srcTemp.Remove() //nolint:errcheck
+	opts.Monitor.OnSrcBlockIdsRead(srcCount)
+	if !dstHeadInSrc {
+		return Errorf("dst head %s is not in src, dst has commits of its own", dstHead)
+	}
+	dstFS, err := tempFS.MkSub("dst")
+	if err != nil {
+		return WrapErrorf(err, "failed to create temp dir for dst block ids")
+	}
+	dstCount := 0
+	dstTemp, err := ReadSortedBlockIds(ctx, dst, dstFS, func(BlockId) {
+		dstCount++
+		if dstCount%blockIdReadProgressEvery == 0 {
+			opts.Monitor.OnDstBlockIdsRead(dstCount)
+		}
+	})
+	if err != nil {
+		return WrapErrorf(err, "failed to snapshot dst block ids")
+	}
+	defer dstTemp.Remove() //nolint:errcheck
+	opts.Monitor.OnDstBlockIdsRead(dstCount)
+	opts.Monitor.OnBeforeCopy(srcCount, dstCount)
+	if err := copyMissingBlocks(ctx, src, dst, srcTemp, dstTemp, opts); err != nil {
+		return err
+	}
+	for _, section := range replicatedControlFileSections {
+		if err := replicateControlFiles(ctx, src, dst, section, opts.Monitor); err != nil {
+			return err
+		}
+	}
+	if dstHasHead && dstHead == srcHead {
+		return nil
+	}
+	var expected *RevisionId
+	if dstHasHead {
+		expected = &dstHead
+	}
+	if err := CompareAndSwapRef(ctx, dst, "head", expected, srcHead); err != nil {
+		return WrapErrorf(err, "failed to write dst head reference")
+	}
+	opts.Monitor.OnCopyControlFile(ControlFileSectionRefs, "head")
+	return nil
+}
+
+// Initialize `dst` with the config of `src` if it does not exist yet or
+// update its config. Fail if `dst` is another repository.
+func replicateConfig(ctx context.Context, src, dst Storage) error {
+	srcToml, err := src.Open(ctx)
+	if err != nil {
+		return WrapErrorf(err, "failed to read src repository config")
+	}
+	dstToml, err := dst.Open(ctx)
+	if errors.Is(err, ErrStorageNotFound) {
+		if err := dst.Init(ctx, srcToml, RepositoryConfigHeaderComment); err != nil {
+			return WrapErrorf(err, "failed to initialize dst storage")
+		}
+		return nil
+	}
+	if err != nil {
+		return WrapErrorf(err, "failed to read dst repository config")
+	}
+	if srcToml.Eq(dstToml) {
+		return nil
+	}
+	// The key slots change with the passphrases, but the storage section
+	// (with the repository id) stays the same.
+	if !isSameRepository(srcToml, dstToml) {
+		return Errorf("src and dst are different repositories")
+	}
+	if err := dst.WriteConfig(ctx, srcToml, RepositoryConfigHeaderComment); err != nil {
+		return WrapErrorf(err, "failed to update dst repository config")
+	}
+	return nil
+}
+
+// Return whether both configs belong to the same repository, i.e. have the
+// same repository id. Legacy repositories don't have one, so their configs
+// must be equal.
+func isSameRepository(a, b Toml) bool {
+	infoA, err := parseStorageConfig(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := parseStorageConfig(b)
+	if err != nil {
+		return false
+	}
+	if infoA.Version == LegacyStorageVersion || infoB.Version == LegacyStorageVersion {
+		return a.Eq(b)
+	}
+	return infoA == infoB
+}
+
+// Copy the blocks in `srcIds` that are not in `dstIds` with `opts.Workers`
+// concurrent workers.
+func copyMissingBlocks(
+	ctx context.Context,
+	src, dst Storage,
+	srcIds, dstIds *Temp[BlockId],
+	opts ReplicationOptions,
+) error {
+	dstCache, err := NewTempCache(dstIds, func(id BlockId) string { return string(id[:]) },
+		TempCacheOptions{MaxChunks: 4})
+	if err != nil {
+		return WrapErrorf(err, "failed to open dst block id cache")
+	}
+	g, gctx := errgroup.WithContext(ctx)
+	ids := make(chan BlockId, opts.Workers)
+	var monitorMu sync.Mutex
+	for range opts.Workers {
+		g.Go(func() error {
+			blockBuf := NewBlockBuf()
+			for id := range ids {
+				data, err := src.ReadBlock(gctx, id, blockBuf)
+				if err != nil {
+					return WrapErrorf(err, "failed to read block %s from src", id)
+				}
+				if err := verifyBlockEnvelope(id, data); err != nil {
+					return err
+				}
+				if _, err := dst.WriteBlock(gctx, id, data); err != nil {
+					return WrapErrorf(err, "failed to write block %s to dst", id)
+				}
+				monitorMu.Lock()
+				opts.Monitor.OnCopyBlock(id, len(data))
+				monitorMu.Unlock()
+			}
+			return nil
+		})
+	}
+	g.Go(func() error {
+		defer close(ids)
+		reader := srcIds.Reader(nil)
+		buf := NewBlockBuf()
+		for {
+			id, err := reader.Read(buf)
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return WrapErrorf(err, "failed to read src block id")
+			}
+			_, present, err := dstCache.Get(string(id[:]))
+			if err != nil {
+				return WrapErrorf(err, "failed to look up block %s in dst", id)
+			}
+			if present {
+				continue
+			}
+			select {
+			case ids <- id:
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+		}
+	})
+	return g.Wait() //nolint:wrapcheck
+}
+
+// Copy all control files of `section` that are missing in `dst` or have a
+// different content. The head is left to the caller.
+func replicateControlFiles(
+	ctx context.Context,
+	src, dst Storage,
+	section ControlFileSection,
+	monitor ReplicationMonitor,
+) error {
+	names, err := src.ListControlFiles(ctx, section)
+	if err != nil {
+		return WrapErrorf(err, "failed to list control files in %s", section)
+	}
+	for _, name := range names {
+		if section == ControlFileSectionRefs && name == "head" {
+			continue
+		}
+		data, err := src.ReadControlFile(ctx, section, name)
+		if err != nil {
+			return WrapErrorf(err, "failed to read control file %s/%s", section, name)
+		}
+		existing, err := dst.ReadControlFile(ctx, section, name)
+		if err == nil && bytes.Equal(existing, data) {
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrControlFileNotFound) {
+			return WrapErrorf(err, "failed to read control file %s/%s from dst", section, name)
+		}
+		if err := dst.WriteControlFile(ctx, section, name, data); err != nil {
+			return WrapErrorf(err, "failed to write control file %s/%s", section, name)
+		}
+		monitor.OnCopyControlFile(section, name)
+	}
+	return nil
+}
+
+// verifyBlockEnvelope makes sure that `data` is a well-formed, encrypted
+// block without decrypting it. This catches blocks that were truncated or
+// overwritten in storage, but not blocks that were tampered with.
+func verifyBlockEnvelope(blockId BlockId, data []byte) error {
+	block, err := UnmarshallBlock(NewProtobufReader(data))
+	if err != nil {
+		return WrapErrorKindf(ErrCorrupt, err, "block %s is not a valid block", blockId)
+	}
+	if len(block.EncryptedHeader) == 0 || len(block.EncryptedData) == 0 {
+		return WrapErrorKindf(ErrCorrupt, nil, "block %s is not a valid block: it is empty", blockId)
+	}
+	return nil
+}
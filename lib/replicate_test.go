@@ -0,0 +1,144 @@
+//nolint:exhaustruct
+package lib
+
+import (
+	"testing"
+)
+
+func TestReplicate(t *testing.T) {
+	t.Parallel()
+
+	newDst := func(t *testing.T) (*FileStorage, FS) {
+		t.Helper()
+		fs := td.NewFS(t)
+		storage, err := NewFileStorage(fs, StoragePurposeRepository)
+		NewAssert(t).NoError(err)
+		return storage, fs
+	}
+	// Locks and temp files are local to each storage.
+	assertSameStorage := func(t *testing.T, src, dst FS) {
+		t.Helper()
+		for _, dir := range []string{"objects", "refs", "security"} {
+			srcSub, err := src.Sub(".cling/repository/" + dir)
+			NewAssert(t).NoError(err)
+			dstSub, err := dst.Sub(".cling/repository/" + dir)
+			NewAssert(t).NoError(err)
+			assertSameFS(t, srcSub, dstSub)
+		}
+	}
+
+	t.Run("Happy path", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		src := td.NewTestRepository(t, td.NewFS(t))
+		entry1, _ := testEntry(t, src, "a.txt", "abc")
+		rev1Id, err := testCommit(t, src.Repository, entry1)
+		assert.NoError(err)
+		assert.NoError(src.WriteTag(t.Context(), "v1", rev1Id, false))
+		dst, dstFS := newDst(t)
+
+		monitor := &TestReplicationMonitor{}
+		err = Replicate(t.Context(), src.Storage, dst, td.NewFS(t), ReplicationOptions{Monitor: monitor, Workers: 4})
+		assert.NoError(err)
+		assert.Equal(3, monitor.CountCalls("OnCopyBlock"))
+		assert.Call(NewMockCall("OnCopyControlFile", ControlFileSectionRefs, "tag-v1"), monitor.Calls)
+		assert.Call(NewMockCall("OnCopyControlFile", ControlFileSectionRefs, "head"), monitor.Calls)
+		assertSameStorage(t, src.FS, dstFS)
+		assertSameHistory(t, src, td.OpenRepository(t, dstFS))
+
+		// Only what is new is copied.
+		entry2, blockId2 := testEntry(t, src, "b.txt", "de")
+		_, err = testCommit(t, src.Repository, entry2)
+		assert.NoError(err)
+		monitor = &TestReplicationMonitor{}
+		err = Replicate(t.Context(), src.Storage, dst, td.NewFS(t), ReplicationOptions{Monitor: monitor, Workers: 4})
+		assert.NoError(err)
+		assert.Equal(3, monitor.CountCalls("OnCopyBlock"))
+		assert.Call(NewMockCall("OnCopyBlock", blockId2, assert.Any), monitor.Calls)
+		assert.Equal(1, monitor.CountCalls("OnCopyControlFile"))
+		assertSameStorage(t, src.FS, dstFS)
+		assertSameHistory(t, src, td.OpenRepository(t, dstFS))
+	})
+
+	t.Run("Different repositories are rejected", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		src := td.NewTestRepository(t, td.NewFS(t))
+		dst := td.NewTestRepository(t, td.NewFS(t))
+		err := Replicate(t.Context(), src.Storage, dst.Storage, td.NewFS(t),
+			ReplicationOptions{Monitor: &TestReplicationMonitor{}, Workers: 1})
+		assert.Error(err, "src and dst are different repositories")
+	})
+
+	t.Run("Fails when dst has commits of its own", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		src := td.NewTestRepository(t, td.NewFS(t))
+		dst, dstFS := newDst(t)
+		err := Replicate(t.Context(), src.Storage, dst, td.NewFS(t),
+			ReplicationOptions{Monitor: &TestReplicationMonitor{}, Workers: 1})
+		assert.NoError(err)
+		dstRepository := td.OpenRepository(t, dstFS)
+		entry, _ := testEntry(t, dstRepository, "a.txt", "abc")
+		_, err = testCommit(t, dstRepository.Repository, entry)
+		assert.NoError(err)
+
+		err = Replicate(t.Context(), src.Storage, dst, td.NewFS(t),
+			ReplicationOptions{Monitor: &TestReplicationMonitor{}, Workers: 1})
+		assert.Error(err, "dst has commits of its own")
+	})
+
+	t.Run("Broken blocks are not copied", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		src := td.NewTestRepository(t, td.NewFS(t))
+		entry, blockId := testEntry(t, src, "a.txt", "abc")
+		_, err := testCommit(t, src.Repository, entry)
+		assert.NoError(err)
+		path := src.Storage.blockPath(blockId)
+		data, err := ReadFile(src.Storage.FS, path)
+		assert.NoError(err)
+		assert.NoError(src.Storage.FS.Chmod(path, 0o600))
+		assert.NoError(WriteFile(src.Storage.FS, path, data[:len(data)/2]))
+		dst, _ := newDst(t)
+
+		err = Replicate(t.Context(), src.Storage, dst, td.NewFS(t),
+			ReplicationOptions{Monitor: &TestReplicationMonitor{}, Workers: 1})
+		assert.ErrorIs(err, ErrCorrupt)
+		assert.Error(err, blockId.String())
+	})
+}
+
+type TestReplicationMonitor struct {
+	Calls []MockCall
+}
+
+func (m *TestReplicationMonitor) CountCalls(name string) int {
+	count := 0
+	for _, call := range m.Calls {
+		if call.Name == name {
+			count += 1
+		}
+	}
+	return count
+}
+
+func (m *TestReplicationMonitor) OnSrcBlockIdsRead(n int) {
+	m.Calls = append(m.Calls, NewMockCall("OnSrcBlockIdsRead", n))
+}
+
+func (m *TestReplicationMonitor) OnDstBlockIdsRead(n int) {
+	m.Calls = append(m.Calls, NewMockCall("OnDstBlockIdsRead", n))
+}
+
+func (m *TestReplicationMonitor) OnBeforeCopy(srcBlocks, dstBlocks int) {
+	m.Calls = append(m.Calls, NewMockCall("OnBeforeCopy", srcBlocks, dstBlocks))
+}
+
+func (m *TestReplicationMonitor) OnCopyBlock(blockId BlockId, length int) {
+	m.Calls = append(m.Calls, NewMockCall("OnCopyBlock", blockId, length))
+}
+
+func (m *TestReplicationMonitor) OnCopyControlFile(section ControlFileSection, name string) {
+	m.Calls = append(m.Calls, NewMockCall("OnCopyControlFile", section, name))
+}
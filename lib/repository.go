@@ -1,12 +1,19 @@
 package lib
 
 import (
+	"bytes"
 	"context"
 	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"math/bits"
+	"slices"
 	"strings"
 )
 
@@ -18,6 +25,9 @@ const (
 	// `MaxBlockSize`.
 	MaxBlockDataSize           = MaxBlockSize - 128*1024
 	UpdateHeadRevisionLockName = "head"
+	// The number of bytes of data to collect before passing them to
+	// `Repository.WriteBlocks`.
+	WriteBlocksBatchSize = MaxBlockSize
 )
 
 //nolint:gochecknoglobals
@@ -37,26 +47,45 @@ even print it out and keep it somewhere safe.
 
 const (
 	EncryptionVersion uint16 = 1
-	StorageVersion    uint16 = 1
+	// Since version 2, blocks are bound to the repository id, see `blockAAD`.
+	StorageVersion uint16 = 2
+	// Repositories created before version 2 can still be used, see
+	// `UpgradeRepository`.
+	LegacyStorageVersion uint16 = 1
+	storageSection              = "storage"
 )
 
 var (
 	ErrRootRevision = errors.New("root revision cannot be read")
-	ErrHeadChanged  = Errorf("head changed during commit")
+	ErrHeadChanged  = WrapErrorKindf(ErrContention, nil, "head changed during commit")
 )
 
-type masterKeyInfo struct {
-	EncryptionVersion       uint16
+// A key slot holds the repository keys encrypted with the user-key derived
+// from one passphrase.
+type keySlot struct {
 	EncryptedKEK            EncryptedKey
 	Argon2id                Argon2id
 	EncryptedBlockIdHmacKey EncryptedKey
 	EncryptedGearCDCSeed    EncryptedKey
 }
 
+type masterKeyInfo struct {
+	EncryptionVersion uint16
+	// The default key slot, stored in the `encryption` section.
+	keySlot
+	// Additional key slots by name, each stored in a `key-slot.<name>`
+	// section (see `AddPassphrase`).
+	KeySlots map[string]keySlot
+}
+
 type repositoryKeys struct {
+	UserKey        RawKey
 	KEK            RawKey
 	BlockIdHmacKey RawKey
 	GearCDCSeed    RawKey
+	// The name of the key slot `UserKey` belongs to, empty if the keys were
+	// decrypted with an identity (see `IsIdentity`).
+	Slot string
 }
 
 //nolint:gochecknoglobals
@@ -64,6 +93,8 @@ var (
 	aadKEK            = []byte("cling-sync/kek")
 	aadBlockIdHmacKey = []byte("cling-sync/blockid-hmac-key")
 	aadGearCDCSeed    = []byte("cling-sync/gearcdc-seed")
+	aadConfigBackup   = []byte("cling-sync/config-backup")
+	aadBlock          = []byte("cling-sync/block")
 )
 
 func masterKeyAAD(salt Salt, label []byte) []byte {
@@ -73,124 +104,228 @@ func masterKeyAAD(salt Salt, label []byte) []byte {
 	return aad
 }
 
+// RepositoryId is generated randomly when a repository is created. Copies
+// made with `SyncRepository` share the id of their source, i.e. they are the
+// same repository.
+type RepositoryId [16]byte
+
+func (id RepositoryId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// The `storage` section of the repository config.
+type storageInfo struct {
+	Version uint16
+	// Zero for `LegacyStorageVersion`.
+	RepositoryId RepositoryId
+}
+
+func newStorageInfo() (storageInfo, error) {
+	info := storageInfo{StorageVersion, RepositoryId{}}
+	if _, err := io.ReadFull(rand.Reader, info.RepositoryId[:]); err != nil {
+		return info, WrapErrorf(err, "failed to generate random repository id")
+	}
+	return info, nil
+}
+
 type Repository struct {
 	storage        Storage
 	kekCipher      cipher.AEAD
 	blockIdHmacKey RawKey
 	gearCDCTable   GearCDCTable
+	chunking       ChunkingPolicy
+	config         Toml
+	storageInfo    storageInfo
+	// How `WriteRevision` waits for the head lock.
+	lockRetry LockRetry
+	// Sign the revisions written by `WriteRevision`. Optional.
+	signingKey *SigningKey
+	// Recorded in the revisions written by `Commit`. Optional.
+	clientId string
+}
+
+type RepositoryOptions struct {
+	Chunking ChunkingPolicy
+}
+
+func DefaultRepositoryOptions() *RepositoryOptions {
+	return &RepositoryOptions{DefaultChunkingPolicy()}
+}
+
+func InitNewRepository(ctx context.Context, storage Storage, passphrase []byte) (*Repository, error) {
+	return InitNewRepositoryWithOptions(ctx, storage, passphrase, DefaultRepositoryOptions())
+}
+
+func InitNewRepositoryWithOptions( //nolint:funlen
+	ctx context.Context,
+	storage Storage,
+	passphrase []byte,
+	opts *RepositoryOptions,
+) (*Repository, error) {
+	if err := opts.Chunking.Validate(); err != nil {
+		return nil, WrapErrorf(err, "invalid chunking policy")
+	}
+	kek, err := NewRawKey()
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to generate random KEK")
+	}
+	blockIdHmacKey, err := NewRawKey()
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to generate random block id HMAC key")
+	}
+	gearCDCSeed, err := NewRawKey()
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to generate random GearCDC seed")
+	}
+	keys := repositoryKeys{
+		UserKey:        RawKey{},
+		KEK:            kek,
+		BlockIdHmacKey: blockIdHmacKey,
+		GearCDCSeed:    gearCDCSeed,
+		Slot:           DefaultKeySlot,
+	}
+	slot, err := encryptRepositoryKeys(&keys, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	clear(keys.UserKey[:])
+	info, err := newStorageInfo()
+	if err != nil {
+		return nil, err
+	}
+	toml, headerComment := createRepositoryConfig(masterKeyInfo{EncryptionVersion, slot, nil})
+	toml[storageSection] = createStorageConfig(info)
+	toml[chunkingSection] = createChunkingConfig(opts.Chunking)
+	if err := storage.Init(ctx, toml, headerComment); err != nil {
+		return nil, WrapErrorf(err, "failed to initialize storage")
+	}
+	rootRevisionId := RevisionId{}
+	if !rootRevisionId.IsRoot() {
+		return nil, Errorf("root revision ID is not zero")
+	}
+	if err := WriteRef(ctx, storage, "head", rootRevisionId); err != nil {
+		return nil, WrapErrorf(err, "failed to write head reference")
+	}
+	return OpenRepository(ctx, storage, passphrase)
+}
+
+func OpenRepository(ctx context.Context, storage Storage, passphrase []byte) (*Repository, error) {
+	toml, err := storage.Open(ctx)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to open storage")
+	}
+	keys, err := decryptrepositoryKeys(toml, passphrase)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to decrypt repository keys")
+	}
+	// The backup is a safety net, not being able to write it (e.g. because
+	// the storage is read-only) must not keep anyone from using the repository.
+	if keys.Slot != "" {
+		_ = backupRepositoryConfig(ctx, storage, toml, keys.Slot, keys.UserKey)
+	}
+	clear(keys.UserKey[:])
+	return newRepository(storage, keys, toml)
+}
+
+func newRepository(storage Storage, keys *repositoryKeys, config Toml) (*Repository, error) {
+	kekCipher, err := NewCipher(keys.KEK)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to create a XChaCha20Poly1305 cipher from KEK")
+	}
+	gearCDCTable, err := NewGearCDCTable(keys.GearCDCSeed)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to create GearCDCTable")
+	}
+	chunking, err := ParseChunkingPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+	info, err := parseStorageConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Repository{
+		storage, kekCipher, keys.BlockIdHmacKey, gearCDCTable, chunking, config, info, DefaultLockRetry(), nil, "",
+	}, nil
 }
 
-func InitNewRepository(ctx context.Context, storage Storage, passphrase []byte) (*Repository, error) { //nolint:funlen
+// Encrypt the keys with a user-key derived from `passphrase` using a new
+// salt. `keys.UserKey` is set to the derived user-key, `keys.Slot` is left
+// to the caller.
+func encryptRepositoryKeys(keys *repositoryKeys, passphrase []byte) (keySlot, error) { //nolint:funlen
 	userKeySalt, err := NewSalt()
 	if err != nil {
-		return nil, WrapErrorf(err, "failed to generate random user key salt")
+		return keySlot{}, WrapErrorf(err, "failed to generate random user key salt")
 	}
 	argon2id := NewArgon2id(userKeySalt)
 	userKey, err := DeriveUserKey(passphrase, argon2id)
 	if err != nil {
-		return nil, WrapErrorf(err, "failed to derive user-key from passphrase")
+		return keySlot{}, WrapErrorf(err, "failed to derive user-key from passphrase")
 	}
+	keys.UserKey = userKey
 	cipher, err := NewCipher(userKey)
 	if err != nil {
-		return nil, WrapErrorf(err, "failed to create a XChaCha20Poly1305 cipher from user-key")
-	}
-	kek, err := NewRawKey()
-	if err != nil {
-		return nil, WrapErrorf(err, "failed to generate random KEK")
+		return keySlot{}, WrapErrorf(err, "failed to create a XChaCha20Poly1305 cipher from user-key")
 	}
 	encryptedKEK := make([]byte, EncryptedKeySize)
-	encryptedKEK, err = Encrypt(kek[:], cipher, masterKeyAAD(userKeySalt, aadKEK), encryptedKEK)
+	encryptedKEK, err = Encrypt(keys.KEK[:], cipher, masterKeyAAD(userKeySalt, aadKEK), encryptedKEK)
 	if err != nil {
-		return nil, WrapErrorf(err, "failed to encrypt KEK with user-key")
+		return keySlot{}, WrapErrorf(err, "failed to encrypt KEK with user-key")
 	}
 	if len(encryptedKEK) != EncryptedKeySize {
-		return nil, Errorf("encrypted KEK has wrong size, want %d, got %d", EncryptedKeySize, len(encryptedKEK))
-	}
-	blockIdHmacKey, err := NewRawKey()
-	if err != nil {
-		return nil, WrapErrorf(err, "failed to generate random block id HMAC key")
+		return keySlot{}, Errorf(
+			"encrypted KEK has wrong size, want %d, got %d",
+			EncryptedKeySize,
+			len(encryptedKEK),
+		)
 	}
 	encryptedBlockIdHmacKey := make([]byte, EncryptedKeySize)
 	encryptedBlockIdHmacKey, err = Encrypt(
-		blockIdHmacKey[:],
+		keys.BlockIdHmacKey[:],
 		cipher,
 		masterKeyAAD(userKeySalt, aadBlockIdHmacKey),
 		encryptedBlockIdHmacKey,
 	)
 	if err != nil {
-		return nil, WrapErrorf(err, "failed to encrypt block id HMAC key with user-key")
+		return keySlot{}, WrapErrorf(err, "failed to encrypt block id HMAC key with user-key")
 	}
 	if len(encryptedBlockIdHmacKey) != EncryptedKeySize {
-		return nil, Errorf(
+		return keySlot{}, Errorf(
 			"encrypted block id HMAC key has wrong size, want %d, got %d",
 			EncryptedKeySize,
 			len(encryptedBlockIdHmacKey),
 		)
 	}
-	gearCDCSeed, err := NewRawKey()
-	if err != nil {
-		return nil, WrapErrorf(err, "failed to generate random GearCDC seed")
-	}
 	encryptedGearCDCSeed := make([]byte, EncryptedKeySize)
 	encryptedGearCDCSeed, err = Encrypt(
-		gearCDCSeed[:],
+		keys.GearCDCSeed[:],
 		cipher,
 		masterKeyAAD(userKeySalt, aadGearCDCSeed),
 		encryptedGearCDCSeed,
 	)
 	if err != nil {
-		return nil, WrapErrorf(err, "failed to encrypt GearCDC seed with user-key")
+		return keySlot{}, WrapErrorf(err, "failed to encrypt GearCDC seed with user-key")
 	}
 	if len(encryptedGearCDCSeed) != EncryptedKeySize {
-		return nil, Errorf(
+		return keySlot{}, Errorf(
 			"encrypted GearCDC seed has wrong size, want %d, got %d",
 			EncryptedKeySize,
 			len(encryptedGearCDCSeed),
 		)
 	}
-	mki := masterKeyInfo{
-		EncryptionVersion,
+	return keySlot{
 		EncryptedKey(encryptedKEK),
 		argon2id,
 		EncryptedKey(encryptedBlockIdHmacKey),
 		EncryptedKey(encryptedGearCDCSeed),
-	}
-	toml, headerComment := createRepositoryConfig(mki)
-	if err := storage.Init(ctx, toml, headerComment); err != nil {
-		return nil, WrapErrorf(err, "failed to initialize storage")
-	}
-	rootRevisionId := RevisionId{}
-	if !rootRevisionId.IsRoot() {
-		return nil, Errorf("root revision ID is not zero")
-	}
-	if err := WriteRef(ctx, storage, "head", rootRevisionId); err != nil {
-		return nil, WrapErrorf(err, "failed to write head reference")
-	}
-	return OpenRepository(ctx, storage, passphrase)
-}
-
-func OpenRepository(ctx context.Context, storage Storage, passphrase []byte) (*Repository, error) {
-	keys, err := decryptrepositoryKeys(ctx, storage, passphrase)
-	if err != nil {
-		return nil, WrapErrorf(err, "failed to decrypt repository keys")
-	}
-	kekCipher, err := NewCipher(keys.KEK)
-	if err != nil {
-		return nil, WrapErrorf(err, "failed to create a XChaCha20Poly1305 cipher from KEK")
-	}
-	gearCDCTable, err := NewGearCDCTable(keys.GearCDCSeed)
-	if err != nil {
-		return nil, WrapErrorf(err, "failed to create GearCDCTable")
-	}
-	return &Repository{storage, kekCipher, keys.BlockIdHmacKey, gearCDCTable}, nil
+	}, nil
 }
 
-// Read the encrypted keys from the storage config (`repository.toml`) and decrypt them.
-func decryptrepositoryKeys(ctx context.Context, storage Storage, passphrase []byte) (*repositoryKeys, error) {
-	toml, err := storage.Open(ctx)
-	if err != nil {
-		return nil, WrapErrorf(err, "failed to open storage")
-	}
+// Read the encrypted keys from the storage config (`repository.toml`) and
+// decrypt them with the first key slot `passphrase` unlocks. The default slot
+// is tried first, the others in the order of their names.
+// If `passphrase` is an identity, the matching recipient slot is used.
+func decryptrepositoryKeys(toml Toml, passphrase []byte) (*repositoryKeys, error) {
 	mki, err := parseRepositoryConfig(toml)
 	if err != nil {
 		return nil, WrapErrorf(err, "failed to parse repository config")
@@ -202,7 +337,26 @@ func decryptrepositoryKeys(ctx context.Context, storage Storage, passphrase []by
 			EncryptionVersion,
 		)
 	}
-	userKey, err := DeriveUserKey(passphrase, mki.Argon2id)
+	if IsIdentity(passphrase) {
+		return decryptRecipientKeys(toml, passphrase)
+	}
+	keys, defaultErr := decryptKeySlot(mki.keySlot, passphrase)
+	if defaultErr == nil {
+		keys.Slot = DefaultKeySlot
+		return keys, nil
+	}
+	for _, name := range slices.Sorted(maps.Keys(mki.KeySlots)) {
+		keys, err := decryptKeySlot(mki.KeySlots[name], passphrase)
+		if err == nil {
+			keys.Slot = name
+			return keys, nil
+		}
+	}
+	return nil, defaultErr
+}
+
+func decryptKeySlot(slot keySlot, passphrase []byte) (*repositoryKeys, error) {
+	userKey, err := DeriveUserKey(passphrase, slot.Argon2id)
 	if err != nil {
 		return nil, WrapErrorf(err, "failed to derive user-key from passphrase")
 	}
@@ -211,15 +365,15 @@ func decryptrepositoryKeys(ctx context.Context, storage Storage, passphrase []by
 		return nil, WrapErrorf(err, "failed to create a XChaCha20Poly1305 cipher from user-key")
 	}
 	kek := make([]byte, RawKeySize)
-	kek, err = Decrypt(mki.EncryptedKEK[:], cipher, masterKeyAAD(mki.Argon2id.Salt, aadKEK), kek)
+	kek, err = Decrypt(slot.EncryptedKEK[:], cipher, masterKeyAAD(slot.Argon2id.Salt, aadKEK), kek)
 	if err != nil {
-		return nil, WrapErrorf(err, "failed to decrypt KEK with user-key")
+		return nil, WrapErrorKindf(ErrAuth, err, "failed to decrypt KEK with user-key (wrong passphrase?)")
 	}
 	blockIdHmacKey := make([]byte, RawKeySize)
 	blockIdHmacKey, err = Decrypt(
-		mki.EncryptedBlockIdHmacKey[:],
+		slot.EncryptedBlockIdHmacKey[:],
 		cipher,
-		masterKeyAAD(mki.Argon2id.Salt, aadBlockIdHmacKey),
+		masterKeyAAD(slot.Argon2id.Salt, aadBlockIdHmacKey),
 		blockIdHmacKey,
 	)
 	if err != nil {
@@ -227,18 +381,20 @@ func decryptrepositoryKeys(ctx context.Context, storage Storage, passphrase []by
 	}
 	gearCDCSeed := make([]byte, RawKeySize)
 	gearCDCSeed, err = Decrypt(
-		mki.EncryptedGearCDCSeed[:],
+		slot.EncryptedGearCDCSeed[:],
 		cipher,
-		masterKeyAAD(mki.Argon2id.Salt, aadGearCDCSeed),
+		masterKeyAAD(slot.Argon2id.Salt, aadGearCDCSeed),
 		gearCDCSeed,
 	)
 	if err != nil {
 		return nil, WrapErrorf(err, "failed to decrypt gear-cdc seed with user-key")
 	}
 	return &repositoryKeys{
+		UserKey:        userKey,
 		KEK:            RawKey(kek),
 		BlockIdHmacKey: RawKey(blockIdHmacKey),
 		GearCDCSeed:    RawKey(gearCDCSeed),
+		Slot:           "",
 	}, nil
 }
 
@@ -246,6 +402,27 @@ func (r *Repository) GearCDCTable() GearCDCTable {
 	return r.gearCDCTable
 }
 
+func (r *Repository) ChunkingPolicy() ChunkingPolicy {
+	return r.chunking
+}
+
+// NewChunker returns a chunker that splits `reader` into blocks the way the
+// repository config says.
+func (r *Repository) NewChunker(reader io.Reader) Chunker { //nolint:ireturn
+	return r.chunking.NewChunker(reader, r.gearCDCTable)
+}
+
+// Config returns the repository config (`repository.toml`) the repository
+// was opened with. It contains no secrets in plaintext.
+func (r *Repository) Config() Toml {
+	return r.config
+}
+
+// StorageVersion is either `StorageVersion` or `LegacyStorageVersion`.
+func (r *Repository) StorageVersion() uint16 {
+	return r.storageInfo.Version
+}
+
 // Close wipes the repository's key material. The instance must not be used afterwards.
 func (r *Repository) Close() error {
 	clear(r.blockIdHmacKey[:])
@@ -255,12 +432,16 @@ func (r *Repository) Close() error {
 	return nil
 }
 
+// CalculateBlockId returns the id of the block with `data`, i.e. the id
+// `WriteBlock` returns, without writing it.
+func (r *Repository) CalculateBlockId(data []byte) BlockId {
+	return BlockId(CalculateHmac(data, r.blockIdHmacKey))
+}
+
 // WriteBlock stores `data` as an encrypted, padded, optionally-compressed block
 // and returns its id. If `dataBytesWritten` is nil the block already existed.
 // Otherwise, it is the payload size after compression (if any). Padding obfuscates
 // the block size (Padmé: https://lbarman.ch/blog/padme).
-//
-//nolint:funlen
 func (r *Repository) WriteBlock(
 	ctx context.Context,
 	data []byte,
@@ -269,7 +450,7 @@ func (r *Repository) WriteBlock(
 	if len(data) > MaxBlockDataSize {
 		return BlockId{}, nil, Errorf("data size %d exceeds maximum block size %d", len(data), MaxBlockDataSize)
 	}
-	blockId = BlockId(CalculateHmac(data, r.blockIdHmacKey))
+	blockId = r.CalculateBlockId(data)
 	ok, err := r.storage.HasBlock(ctx, blockId)
 	if ok {
 		return blockId, nil, nil
@@ -277,7 +458,74 @@ func (r *Repository) WriteBlock(
 	if err != nil {
 		return blockId, nil, WrapErrorf(err, "failed to read header of block %s", blockId)
 	}
+	result, payloadLen, err := r.sealBlock(blockId, data, buf)
+	if err != nil {
+		return blockId, nil, err
+	}
+	exists, err := r.storage.WriteBlock(ctx, blockId, result)
+	if err != nil {
+		return blockId, nil, WrapErrorf(err, "failed to write block %s", blockId)
+	}
+	if exists {
+		return blockId, nil, nil
+	}
+	return blockId, &payloadLen, nil
+}
+
+// WriteBlocks is `WriteBlock` for many blocks. The existence of the blocks is
+// checked with one `HasBlocks` and the new blocks are written with
+// `WriteStoredBlocks`, which saves round trips on high-latency links.
+func (r *Repository) WriteBlocks(ctx context.Context, data [][]byte) ([]BlockId, []*int, error) {
+	blockIds := make([]BlockId, len(data))
+	for i, d := range data {
+		if len(d) > MaxBlockDataSize {
+			return nil, nil, Errorf("data size %d exceeds maximum block size %d", len(d), MaxBlockDataSize)
+		}
+		blockIds[i] = r.CalculateBlockId(d)
+	}
+	exists, err := r.HasBlocks(ctx, blockIds)
+	if err != nil {
+		return nil, nil, err
+	}
+	dataBytesWritten := make([]*int, len(data))
+	blocks := []StoredBlock{}
+	// The index into `data` of each of `blocks`.
+	indexes := []int{}
+	seen := map[BlockId]bool{}
+	var buf BlockBuf
+	for i, d := range data {
+		if exists[i] || seen[blockIds[i]] {
+			continue
+		}
+		seen[blockIds[i]] = true
+		if buf.buf == nil {
+			buf = NewBlockBuf()
+		}
+		result, payloadLen, err := r.sealBlock(blockIds[i], d, buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		blocks = append(blocks, StoredBlock{blockIds[i], bytes.Clone(result)})
+		indexes = append(indexes, i)
+		dataBytesWritten[i] = &payloadLen
+	}
+	existed, err := WriteStoredBlocks(ctx, r.storage, blocks)
+	if err != nil {
+		return nil, nil, WrapErrorf(err, "failed to write %d blocks", len(blocks))
+	}
+	for j, i := range indexes {
+		if existed[j] {
+			dataBytesWritten[i] = nil
+		}
+	}
+	return blockIds, dataBytesWritten, nil
+}
 
+// sealBlock compresses, pads, and encrypts `data` into `buf` and returns the
+// stored form of the block and the payload size after compression.
+//
+//nolint:funlen
+func (r *Repository) sealBlock(blockId BlockId, data []byte, buf BlockBuf) ([]byte, int, error) {
 	// The encrypted payload begins at `dataOffset`, leaving a front reserve for the
 	// block's protobuf prefix (written last, growing back toward `dataOffset`).
 	const dataOffset = 1024
@@ -293,7 +541,7 @@ func (r *Repository) WriteBlock(
 		limit := len(data) * 95 / 100
 		n, compressed, cerr := Compress(data, payload[:limit])
 		if cerr != nil {
-			return blockId, nil, WrapErrorf(cerr, "failed to compress data of block %s", blockId)
+			return nil, 0, WrapErrorf(cerr, "failed to compress data of block %s", blockId)
 		}
 		if compressed {
 			compression = CompressionDeflate
@@ -312,22 +560,23 @@ func (r *Repository) WriteBlock(
 	// Encrypt the payload in place with a fresh DEK.
 	dek, err := NewRawKey()
 	if err != nil {
-		return blockId, nil, WrapErrorf(err, "failed to generate random DEK for block %s", blockId)
+		return nil, 0, WrapErrorf(err, "failed to generate random DEK for block %s", blockId)
 	}
 	// Best-effort wipe so the DEK does not linger in memory after the block is written.
 	defer clear(dek[:])
 	dekCipher, err := NewCipher(dek)
 	if err != nil {
-		return blockId, nil, WrapErrorf(err, "failed to create DEK cipher for block %s", blockId)
+		return nil, 0, WrapErrorf(err, "failed to create DEK cipher for block %s", blockId)
 	}
 	encryptedPayload := work[dataOffset : dataOffset+len(payload)+TotalCipherOverhead]
-	if _, err := Encrypt(payload, dekCipher, blockId[:], encryptedPayload); err != nil {
-		return blockId, nil, WrapErrorf(err, "failed to encrypt data with DEK for block %s", blockId)
+	aad := r.blockAAD(blockId)
+	if _, err := Encrypt(payload, dekCipher, aad, encryptedPayload); err != nil {
+		return nil, 0, WrapErrorf(err, "failed to encrypt data with DEK for block %s", blockId)
 	}
 
 	// Marshal and KEK-encrypt the header in the workspace behind the payload.
 	header := BlockHeader{
-		Version:           uint32(StorageVersion),
+		Version:           uint32(r.storageInfo.Version),
 		Compression:       compression,
 		Dek:               dek,
 		EncryptedDataSize: uint32(payloadLen), //nolint:gosec
@@ -336,13 +585,13 @@ func (r *Repository) WriteBlock(
 	headerTemp := work[dataOffset+len(encryptedPayload):]
 	headerWriter := NewProtobufWriter(headerTemp[:header.MarshallSize()])
 	if err := header.Marshall(headerWriter); err != nil {
-		return blockId, nil, WrapErrorf(err, "failed to marshal block header %s", blockId)
+		return nil, 0, WrapErrorf(err, "failed to marshal block header %s", blockId)
 	}
 	headerBytes := headerWriter.Bytes()
 	encryptedHeaderLen := len(headerBytes) + TotalCipherOverhead
 	encryptedHeader := headerTemp[len(headerBytes) : len(headerBytes)+encryptedHeaderLen]
-	if _, err := Encrypt(headerBytes, r.kekCipher, blockId[:], encryptedHeader); err != nil {
-		return blockId, nil, WrapErrorf(err, "failed to encrypt block header with KEK for block %s", blockId)
+	if _, err := Encrypt(headerBytes, r.kekCipher, aad, encryptedHeader); err != nil {
+		return nil, 0, WrapErrorf(err, "failed to encrypt block header with KEK for block %s", blockId)
 	}
 
 	// Write the `Block` protobuf by hand, in field order: field 1 = encrypted header,
@@ -352,28 +601,95 @@ func (r *Repository) WriteBlock(
 	protobufLen := TagLen(1, 2) + VarintLen(int64(encryptedHeaderLen)) + encryptedHeaderLen +
 		TagLen(2, 2) + VarintLen(int64(len(encryptedPayload)))
 	if protobufLen > dataOffset {
-		return blockId, nil, Errorf("block protobuf %d exceeds reserve %d", protobufLen, dataOffset)
+		return nil, 0, Errorf("block protobuf %d exceeds reserve %d", protobufLen, dataOffset)
 	}
 	result := work[dataOffset-protobufLen : dataOffset+len(encryptedPayload)]
 	protobuf := NewProtobufWriter(result[:protobufLen])
 	if err := protobuf.WriteBytes(1, encryptedHeader); err != nil {
-		return blockId, nil, WrapErrorf(err, "failed to write block header field for %s", blockId)
+		return nil, 0, WrapErrorf(err, "failed to write block header field for %s", blockId)
 	}
 	if err := protobuf.WriteTag(2, 2); err != nil {
-		return blockId, nil, WrapErrorf(err, "failed to write block data tag for %s", blockId)
+		return nil, 0, WrapErrorf(err, "failed to write block data tag for %s", blockId)
 	}
 	if err := protobuf.WriteVarint(int64(len(encryptedPayload))); err != nil {
-		return blockId, nil, WrapErrorf(err, "failed to write block data length for %s", blockId)
+		return nil, 0, WrapErrorf(err, "failed to write block data length for %s", blockId)
 	}
 
-	exists, err := r.storage.WriteBlock(ctx, blockId, result)
+	return result, payloadLen, nil
+}
+
+func (r *Repository) HasBlock(ctx context.Context, blockId BlockId) (bool, error) {
+	exists, err := r.storage.HasBlock(ctx, blockId)
 	if err != nil {
-		return blockId, nil, WrapErrorf(err, "failed to write block %s", blockId)
+		return false, WrapErrorf(err, "failed to check if block %s exists", blockId)
 	}
-	if exists {
-		return blockId, nil, nil
+	return exists, nil
+}
+
+// HasBlocks returns whether each of `blockIds` exists, in the same order.
+// Storages that are a `BlockBatchChecker` are asked in batches.
+func (r *Repository) HasBlocks(ctx context.Context, blockIds []BlockId) ([]bool, error) {
+	exists, err := HasBlocks(ctx, r.storage, blockIds)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to check if %d blocks exist", len(blockIds))
 	}
-	return blockId, &payloadLen, nil
+	return exists, nil
+}
+
+// BlockBatchChecker is implemented by storages that can check the existence
+// of many blocks with fewer round trips than calling `HasBlock` for each.
+type BlockBatchChecker interface {
+	// Return whether each of `blockIds` exists, in the same order.
+	HasBlocks(ctx context.Context, blockIds []BlockId) ([]bool, error)
+}
+
+// HasBlocks asks `storage` whether each of `blockIds` exists, in one go if
+// it is a `BlockBatchChecker` and one block at a time otherwise.
+func HasBlocks(ctx context.Context, storage Storage, blockIds []BlockId) ([]bool, error) {
+	if checker, ok := storage.(BlockBatchChecker); ok {
+		return checker.HasBlocks(ctx, blockIds) //nolint:wrapcheck
+	}
+	exists := make([]bool, len(blockIds))
+	for i, blockId := range blockIds {
+		ok, err := storage.HasBlock(ctx, blockId)
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to check if block %s exists", blockId)
+		}
+		exists[i] = ok
+	}
+	return exists, nil
+}
+
+// A block in the form it is stored in, see `WriteStoredBlocks`.
+type StoredBlock struct {
+	BlockId BlockId
+	Data    []byte
+}
+
+// BlockBatchWriter is implemented by storages that can write many blocks
+// with fewer round trips than calling `WriteBlock` for each.
+type BlockBatchWriter interface {
+	// Write the blocks and return whether each of them existed already, in
+	// the same order. Existing blocks are never overwritten.
+	WriteBlocks(ctx context.Context, blocks []StoredBlock) ([]bool, error)
+}
+
+// WriteStoredBlocks writes `blocks` to `storage`, in one go if it is a
+// `BlockBatchWriter` and one block at a time otherwise. Return whether each
+// of them existed already.
+func WriteStoredBlocks(ctx context.Context, storage Storage, blocks []StoredBlock) ([]bool, error) {
+	if writer, ok := storage.(BlockBatchWriter); ok {
+		return writer.WriteBlocks(ctx, blocks) //nolint:wrapcheck
+	}
+	existed := make([]bool, len(blocks))
+	for i, block := range blocks {
+		ok, err := storage.WriteBlock(ctx, block.BlockId, block.Data)
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to write block %s", block.BlockId)
+		}
+		existed[i] = ok
+	}
+	return existed, nil
 }
 
 func (r *Repository) ReadBlock(ctx context.Context, blockId BlockId, buf BlockBuf) ([]byte, error) {
@@ -383,21 +699,15 @@ func (r *Repository) ReadBlock(ctx context.Context, blockId BlockId, buf BlockBu
 	}
 	block, err := UnmarshallBlock(NewProtobufReader(rawBlock))
 	if err != nil {
-		return nil, WrapErrorf(err, "failed to unmarshal block envelope for %s", blockId)
+		return nil, WrapErrorKindf(ErrCorrupt, err, "failed to unmarshal block envelope for %s", blockId)
 	}
-	rawHeader, err := DecryptInPlace(block.EncryptedHeader, r.kekCipher, blockId[:])
+	header, err := r.decryptBlockHeader(blockId, block.EncryptedHeader)
 	if err != nil {
-		return nil, WrapErrorf(err, "failed to decrypt block header with KEK for block %s", blockId)
-	}
-	header, err := UnmarshallBlockHeader(NewProtobufReader(rawHeader))
-	if err != nil {
-		return nil, WrapErrorf(err, "failed to unmarshal block header for block %s", blockId)
+		return nil, err
 	}
 	// Best-effort wipe so the DEK does not linger in memory after the block is read.
 	defer clear(header.Dek[:])
-	if header.Version != uint32(StorageVersion) {
-		return nil, Errorf("unsupported block version %d for block %s", header.Version, blockId)
-	}
+	aad := r.blockAAD(blockId)
 	dekCypher, err := NewCipher(header.Dek)
 	if err != nil {
 		return nil, WrapErrorf(
@@ -406,12 +716,14 @@ func (r *Repository) ReadBlock(ctx context.Context, blockId BlockId, buf BlockBu
 			blockId,
 		)
 	}
-	data, err := DecryptInPlace(block.EncryptedData, dekCypher, blockId[:])
+	data, err := DecryptInPlace(block.EncryptedData, dekCypher, aad)
 	if err != nil {
-		return nil, WrapErrorf(err, "failed to decrypt data with DEK for block %s", blockId)
+		return nil, WrapErrorKindf(ErrCorrupt, err, "failed to decrypt data with DEK for block %s", blockId)
 	}
 	if uint64(header.EncryptedDataSize) > uint64(len(data)) {
-		return nil, Errorf(
+		return nil, WrapErrorKindf(
+			ErrCorrupt,
+			nil,
 			"block %s declares encrypted data size %d but only %d bytes are present",
 			blockId,
 			header.EncryptedDataSize,
@@ -428,6 +740,93 @@ func (r *Repository) ReadBlock(ctx context.Context, blockId BlockId, buf BlockBu
 	return data, nil
 }
 
+// BlockRangeReader is implemented by storages that can read part of a block
+// without transferring all of it.
+type BlockRangeReader interface {
+	// Read `length` bytes of the stored block starting at `offset`. Fewer
+	// bytes are returned if the block ends before.
+	// Return `ErrBlockNotFound` if the block does not exist.
+	ReadBlockRange(ctx context.Context, blockId BlockId, offset, length int, buf BlockBuf) ([]byte, error)
+}
+
+// The header of a block, see `ReadBlockHeader`.
+type BlockInfo struct {
+	// The size of the data in the block, i.e. the size after compression
+	// and without padding.
+	Size int
+	// Whether the data is compressed.
+	Compressed bool
+}
+
+// The encrypted header is the first field of a stored block. This is enough
+// to read it: the protobuf tag, the length, and the maximum header size.
+const blockHeaderPrefixSize = 3 + 0x200
+
+// ReadBlockHeader reads and decrypts only the header of a block, if the
+// storage is a `BlockRangeReader`. The data of a block cannot be decrypted
+// in parts, because it is a single AEAD ciphertext.
+func (r *Repository) ReadBlockHeader(ctx context.Context, blockId BlockId) (BlockInfo, error) {
+	var rawBlock []byte
+	var err error
+	if rangeReader, ok := r.storage.(BlockRangeReader); ok {
+		rawBlock, err = rangeReader.ReadBlockRange(ctx, blockId, 0, blockHeaderPrefixSize, NewBlockBuf())
+	} else {
+		rawBlock, err = r.storage.ReadBlock(ctx, blockId, NewBlockBuf())
+	}
+	if err != nil {
+		return BlockInfo{}, WrapErrorf(err, "failed to read block %s", blockId)
+	}
+	pr := NewProtobufReader(rawBlock)
+	tag, wireType, err := pr.ReadTag()
+	if err == nil && (tag != 1 || wireType != 2) {
+		err = Errorf("the block does not start with its header")
+	}
+	var encryptedHeader []byte
+	if err == nil {
+		encryptedHeader, err = pr.ReadBytes()
+	}
+	if err != nil {
+		return BlockInfo{}, WrapErrorKindf(ErrCorrupt, err, "failed to unmarshal block envelope for %s", blockId)
+	}
+	header, err := r.decryptBlockHeader(blockId, encryptedHeader)
+	if err != nil {
+		return BlockInfo{}, err
+	}
+	clear(header.Dek[:])
+	return BlockInfo{int(header.EncryptedDataSize), header.Compression == CompressionDeflate}, nil
+}
+
+func (r *Repository) decryptBlockHeader(blockId BlockId, encryptedHeader []byte) (*BlockHeader, error) {
+	rawHeader, err := DecryptInPlace(encryptedHeader, r.kekCipher, r.blockAAD(blockId))
+	if err != nil {
+		return nil, WrapErrorKindf(ErrCorrupt, err, "failed to decrypt block header with KEK for block %s", blockId)
+	}
+	header, err := UnmarshallBlockHeader(NewProtobufReader(rawHeader))
+	if err != nil {
+		return nil, WrapErrorKindf(ErrCorrupt, err, "failed to unmarshal block header for block %s", blockId)
+	}
+	if header.Version != uint32(r.storageInfo.Version) {
+		clear(header.Dek[:])
+		return nil, Errorf("unsupported block version %d for block %s", header.Version, blockId)
+	}
+	return header, nil
+}
+
+// The associated data of both ciphertexts of a block. It binds the block to
+// its id and to the repository, so a block copied from another repository
+// fails to decrypt even if both repositories share the same keys.
+// Blocks of legacy repositories are only bound to their id.
+func (r *Repository) blockAAD(blockId BlockId) []byte {
+	if r.storageInfo.Version == LegacyStorageVersion {
+		return blockId[:]
+	}
+	aad := make([]byte, 0, len(aadBlock)+len(r.storageInfo.RepositoryId)+len(blockId))
+	aad = append(aad, aadBlock...)
+	aad = append(aad, r.storageInfo.RepositoryId[:]...)
+	aad = append(aad, blockId[:]...)
+	return aad
+}
+
 func (r *Repository) Head(ctx context.Context) (RevisionId, error) {
 	ref, err := ReadRef(ctx, r.storage, "head")
 	if err != nil {
@@ -436,6 +835,26 @@ func (r *Repository) Head(ctx context.Context) (RevisionId, error) {
 	return ref, nil
 }
 
+// Ping reads and decrypts the head revision without reading any other
+// block. It is a cheap way to check that the storage is reachable and that
+// the repository keys work.
+// Return the root revision id and an empty revision if the repository is
+// empty.
+func (r *Repository) Ping(ctx context.Context) (RevisionId, Revision, error) {
+	head, err := r.Head(ctx)
+	if err != nil {
+		return RevisionId{}, Revision{}, err
+	}
+	if head.IsRoot() {
+		return head, Revision{}, nil
+	}
+	revision, err := r.ReadRevision(ctx, head, NewBlockBuf())
+	if err != nil {
+		return RevisionId{}, Revision{}, WrapErrorf(err, "failed to read head revision")
+	}
+	return head, revision, nil
+}
+
 // RevisionMagic is the constant string stored as the first field of every
 // marshalled `Revision`. It lets a disaster-recovery tool tell revision
 // blocks apart from data blocks by decrypting each block and reading the
@@ -453,10 +872,10 @@ func (r *Repository) ReadRevision(ctx context.Context, revisionId RevisionId, bu
 	}
 	rev, err := UnmarshallRevision(NewProtobufReader(data))
 	if err != nil {
-		return Revision{}, WrapErrorf(err, "failed to unmarshal revision %s", revisionId)
+		return Revision{}, WrapErrorKindf(ErrCorrupt, err, "failed to unmarshal revision %s", revisionId)
 	}
 	if rev.Magic != RevisionMagic {
-		return Revision{}, Errorf(
+		return Revision{}, WrapErrorKindf(ErrCorrupt, nil,
 			"block %s is not a revision (magic %q, want %q)",
 			revisionId,
 			rev.Magic,
@@ -466,25 +885,60 @@ func (r *Repository) ReadRevision(ctx context.Context, revisionId RevisionId, bu
 	return *rev, nil
 }
 
+// Set how `WriteRevision` waits for the head lock if another client holds
+// it. The default is `DefaultLockRetry`.
+func (r *Repository) SetLockRetry(retry LockRetry) {
+	r.lockRetry = retry
+}
+
+// Sign all revisions written by `WriteRevision` with `key` (see
+// `SignRevision`). A nil key turns signing off.
+func (r *Repository) SetSigningKey(key *SigningKey) {
+	r.signingKey = key
+}
+
+// Record `id` in all revisions written by `Commit` (see
+// `Revision.ClientId`), so that the log tells which workspace wrote a
+// revision. An empty id records nothing.
+func (r *Repository) SetClientId(id string) {
+	r.clientId = id
+}
+
+// Derive a key for `purpose` from the keys of the repository, e.g. to
+// encrypt data that is kept on the client. The key is the same for all
+// clients of the repository and changes if the repository keys change.
+func (r *Repository) DeriveKey(purpose string) (RawKey, error) {
+	key, err := hkdf.Key(sha256.New, r.blockIdHmacKey[:], nil, "cling-sync "+purpose, RawKeySize)
+	if err != nil {
+		return RawKey{}, WrapErrorf(err, "failed to derive %s key", purpose)
+	}
+	defer clear(key)
+	return RawKey(key), nil
+}
+
 // Write a revision and set it as the current HEAD.
 // A revision can only reference the current head as their parent.
-// Return `ErrHeadChanged` if the head has changed during the commit.
+// Return `ErrHeadChanged` if the head has changed during the commit and
+// a `*LockExistsError` (`ErrContention`) if the head lock is still held by
+// another client after the retries of `SetLockRetry`.
 func (r *Repository) WriteRevision(ctx context.Context, revision *Revision) (RevisionId, error) {
+	return r.writeRevision(ctx, revision, r.lockRetry)
+}
+
+func (r *Repository) writeRevision(ctx context.Context, revision *Revision, retry LockRetry) (RevisionId, error) {
 	if len(revision.BlockIds) == 0 {
 		return RevisionId{}, Errorf("revision is empty")
 	}
-	for _, blockId := range revision.BlockIds {
-		exists, err := r.storage.HasBlock(ctx, blockId)
-		if err != nil {
-			return RevisionId{}, WrapErrorf(err, "failed to check if block %s exists", blockId)
-		}
-		if !exists {
-			return RevisionId{}, Errorf("block %s does not exist", blockId)
-		}
+	exists, err := r.HasBlocks(ctx, revision.BlockIds)
+	if err != nil {
+		return RevisionId{}, err
 	}
-	unlock, err := r.storage.Lock(ctx, UpdateHeadRevisionLockName)
+	if i := slices.Index(exists, false); i >= 0 {
+		return RevisionId{}, Errorf("block %s does not exist", revision.BlockIds[i])
+	}
+	unlock, err := LockWithRetry(ctx, r.storage, UpdateHeadRevisionLockName, retry)
 	if err != nil {
-		return RevisionId{}, WrapErrorf(err, "failed to create lock")
+		return RevisionId{}, WrapErrorf(err, "failed to lock the head")
 	}
 	defer unlock() //nolint:errcheck
 	head, err := r.Head(ctx)
@@ -500,6 +954,12 @@ func (r *Repository) WriteRevision(ctx context.Context, revision *Revision) (Rev
 		)
 	}
 	revision.Magic = RevisionMagic
+	revision.Signature = nil
+	if r.signingKey != nil {
+		if err := SignRevision(revision, r.signingKey); err != nil {
+			return RevisionId{}, err
+		}
+	}
 	revBuf := make([]byte, revision.MarshallSize())
 	pw := NewProtobufWriter(revBuf)
 	if err := revision.Marshall(pw); err != nil {
@@ -510,7 +970,17 @@ func (r *Repository) WriteRevision(ctx context.Context, revision *Revision) (Rev
 		return RevisionId{}, WrapErrorf(err, "failed to write revision block")
 	}
 	revisionId := RevisionId(blockId)
-	if err := WriteRef(ctx, r.storage, "head", revisionId); err != nil {
+	if err := CompareAndSwapRef(ctx, r.storage, "head", &head, revisionId); err != nil {
+		if errors.Is(err, ErrControlFileChanged) {
+			return RevisionId{}, WrapErrorf(ErrHeadChanged, "%s", err)
+		}
+		// Only the response might have been lost, the head is locked, so if
+		// it points to the revision now, the write went through.
+		if errors.Is(err, ErrNetwork) {
+			if current, headErr := r.Head(ctx); headErr == nil && current == revisionId {
+				return revisionId, nil
+			}
+		}
 		return RevisionId{}, WrapErrorf(err, "failed to write head reference")
 	}
 	return revisionId, nil
@@ -528,6 +998,32 @@ func WriteRef(ctx context.Context, storage Storage, name string, revisionId Revi
 	return nil
 }
 
+// CompareAndSwapRef updates the reference only if it currently points to
+// `expected`. A nil `expected` means that the reference must not exist yet.
+// Return `ErrControlFileChanged` otherwise.
+func CompareAndSwapRef(
+	ctx context.Context,
+	storage Storage,
+	name string,
+	expected *RevisionId,
+	revisionId RevisionId,
+) error {
+	var expectedData []byte
+	if expected != nil {
+		expectedData = []byte(hex.EncodeToString(expected[:]))
+	}
+	if err := storage.CompareAndSwapControlFile(
+		ctx,
+		ControlFileSectionRefs,
+		name,
+		expectedData,
+		[]byte(hex.EncodeToString(revisionId[:])),
+	); err != nil {
+		return WrapErrorf(err, "failed to update reference %s", name)
+	}
+	return nil
+}
+
 func ReadRef(ctx context.Context, storage Storage, name string) (RevisionId, error) {
 	data, err := storage.ReadControlFile(ctx, ControlFileSectionRefs, name)
 	if err != nil {
@@ -535,34 +1031,77 @@ func ReadRef(ctx context.Context, storage Storage, name string) (RevisionId, err
 	}
 	data, err = hex.DecodeString(string(data))
 	if err != nil {
-		return RevisionId{}, WrapErrorf(err, "failed to decode reference %s", name)
+		return RevisionId{}, WrapErrorKindf(ErrCorrupt, err, "failed to decode reference %s", name)
 	}
 	if len(data) != 32 {
-		return RevisionId{}, Errorf("invalid reference size for %s: want %d, got %d", name, 32, len(data))
+		return RevisionId{}, WrapErrorKindf(ErrCorrupt, nil,
+			"invalid reference size for %s: want %d, got %d", name, 32, len(data))
 	}
 	return RevisionId(data), nil
 }
 
-func parseRepositoryConfig(toml Toml) (*masterKeyInfo, error) {
-	i, ok := toml.GetIntValue("storage", "version")
-	if !ok {
-		return nil, Errorf("missing or invalid key `storage.version` in repository config")
+// Return `ErrControlFileNotFound` if the reference does not exist.
+func DeleteRef(ctx context.Context, storage Storage, name string) error {
+	if err := storage.DeleteControlFile(ctx, ControlFileSectionRefs, name); err != nil {
+		return WrapErrorf(err, "failed to delete reference %s", name)
 	}
-	if i != int(StorageVersion) {
-		return nil, Errorf("unsupported repository version %d, want %d", i, StorageVersion)
+	return nil
+}
+
+// ListRefs returns the sorted names of all references, including `head`.
+func ListRefs(ctx context.Context, storage Storage) ([]string, error) {
+	names, err := storage.ListControlFiles(ctx, ControlFileSectionRefs)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to list references")
+	}
+	return names, nil
+}
+
+func parseRepositoryConfig(toml Toml) (*masterKeyInfo, error) {
+	if _, err := parseStorageConfig(toml); err != nil {
+		return nil, err
 	}
-	i, ok = toml.GetIntValue("encryption", "version")
+	i, ok := toml.GetIntValue("encryption", "version")
 	if !ok {
 		return nil, Errorf("missing or invalid key `encryption.version` in repository config")
 	}
 	if i != int(EncryptionVersion) {
 		return nil, Errorf("unsupported repository version %d, want %d", i, EncryptionVersion)
 	}
-	mki := &masterKeyInfo{ //nolint:exhaustruct
-		EncryptionVersion: uint16(i),
+	slot, err := parseKeySlot(toml, "encryption")
+	if err != nil {
+		return nil, err
+	}
+	slots, err := parseKeySlots(toml)
+	if err != nil {
+		return nil, err
+	}
+	return &masterKeyInfo{uint16(i), slot, slots}, nil
+}
+
+// Parse the additional key slots, i.e. all `key-slot.<name>` sections.
+func parseKeySlots(toml Toml) (map[string]keySlot, error) {
+	slots := map[string]keySlot{}
+	for section := range toml {
+		name, ok := strings.CutPrefix(section, keySlotSectionPrefix)
+		if !ok {
+			continue
+		}
+		if err := ValidateKeySlotName(name); err != nil {
+			return nil, WrapErrorf(err, "invalid section `%s` in repository config", section)
+		}
+		slot, err := parseKeySlot(toml, section)
+		if err != nil {
+			return nil, err
+		}
+		slots[name] = slot
 	}
+	return slots, nil
+}
+
+func parseKeySlot(toml Toml, section string) (keySlot, error) {
+	var slot keySlot
 	parseRecoveryCode := func(key string, expectedLen int) ([]byte, error) {
-		section := "encryption"
 		v, ok := toml.GetValue(section, key)
 		if !ok {
 			return nil, Errorf("missing key `%s.%s` in repository config", section, key)
@@ -578,47 +1117,90 @@ func parseRepositoryConfig(toml Toml) (*masterKeyInfo, error) {
 	}
 	c, err := parseRecoveryCode("encrypted-key-encryption-key", EncryptedKeySize)
 	if err != nil {
-		return nil, err
+		return slot, err
 	}
-	mki.EncryptedKEK = EncryptedKey(c)
-	passphraseDerivation, ok := toml.GetValue("encryption", "passphrase-derivation")
+	slot.EncryptedKEK = EncryptedKey(c)
+	passphraseDerivation, ok := toml.GetValue(section, "passphrase-derivation")
 	if !ok {
-		return nil, Errorf("missing key `encryption.passphrase-derivation`")
+		return slot, Errorf("missing key `%s.passphrase-derivation`", section)
 	}
 	argon2id, err := UnmarshalArgon2idConfig(passphraseDerivation)
 	if err != nil {
-		return nil, err
+		return slot, err
 	}
-	mki.Argon2id = argon2id
+	slot.Argon2id = argon2id
 	c, err = parseRecoveryCode("encrypted-block-id-hmac", EncryptedKeySize)
 	if err != nil {
-		return nil, err
+		return slot, err
 	}
-	mki.EncryptedBlockIdHmacKey = EncryptedKey(c)
+	slot.EncryptedBlockIdHmacKey = EncryptedKey(c)
 	c, err = parseRecoveryCode("encrypted-gear-cdc-seed", EncryptedKeySize)
 	if err != nil {
-		return nil, err
+		return slot, err
 	}
-	mki.EncryptedGearCDCSeed = EncryptedKey(c)
-	return mki, nil
+	slot.EncryptedGearCDCSeed = EncryptedKey(c)
+	return slot, nil
 }
 
+func parseStorageConfig(toml Toml) (storageInfo, error) {
+	var info storageInfo
+	i, ok := toml.GetIntValue(storageSection, "version")
+	if !ok {
+		return info, Errorf("missing or invalid key `storage.version` in repository config")
+	}
+	switch i {
+	case int(LegacyStorageVersion):
+		info.Version = LegacyStorageVersion
+		return info, nil
+	case int(StorageVersion):
+		info.Version = StorageVersion
+	default:
+		return info, Errorf("unsupported repository version %d, want %d", i, StorageVersion)
+	}
+	v, ok := toml.GetValue(storageSection, "repository-id")
+	if !ok {
+		return info, Errorf("missing key `storage.repository-id` in repository config")
+	}
+	id, err := hex.DecodeString(v)
+	if err != nil || len(id) != len(info.RepositoryId) {
+		return info, Errorf("invalid key `storage.repository-id` in repository config")
+	}
+	info.RepositoryId = RepositoryId(id)
+	return info, nil
+}
+
+func createStorageConfig(info storageInfo) map[string]string {
+	section := map[string]string{
+		"version": fmt.Sprintf("%d", info.Version),
+	}
+	if info.Version != LegacyStorageVersion {
+		section["repository-id"] = info.RepositoryId.String()
+	}
+	return section
+}
+
+// Create the key slot sections of the repository config. The other sections
+// are left to the caller.
 func createRepositoryConfig(mki masterKeyInfo) (Toml, string) {
 	toml := Toml{
-		"encryption": {
-			"version":                      fmt.Sprintf("%d", mki.EncryptionVersion),
-			"passphrase-derivation":        mki.Argon2id.Marshal(),
-			"encrypted-key-encryption-key": FormatRecoveryCode(mki.EncryptedKEK[:]),
-			"encrypted-block-id-hmac":      FormatRecoveryCode(mki.EncryptedBlockIdHmacKey[:]),
-			"encrypted-gear-cdc-seed":      FormatRecoveryCode(mki.EncryptedGearCDCSeed[:]),
-		},
-		"storage": {
-			"version": fmt.Sprintf("%d", StorageVersion),
-		},
+		"encryption": createKeySlotConfig(mki.keySlot),
+	}
+	toml["encryption"]["version"] = fmt.Sprintf("%d", mki.EncryptionVersion)
+	for name, slot := range mki.KeySlots {
+		toml[keySlotSectionPrefix+name] = createKeySlotConfig(slot)
 	}
 	return toml, RepositoryConfigHeaderComment
 }
 
+func createKeySlotConfig(slot keySlot) map[string]string {
+	return map[string]string{
+		"passphrase-derivation":        slot.Argon2id.Marshal(),
+		"encrypted-key-encryption-key": FormatRecoveryCode(slot.EncryptedKEK[:]),
+		"encrypted-block-id-hmac":      FormatRecoveryCode(slot.EncryptedBlockIdHmacKey[:]),
+		"encrypted-gear-cdc-seed":      FormatRecoveryCode(slot.EncryptedGearCDCSeed[:]),
+	}
+}
+
 // Return the number of bytes to pad the given input size
 // according to: https://lbarman.ch/blog/padme
 func Padme(l uint64) uint64 {
@@ -1,9 +1,12 @@
 package lib
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
+	"maps"
 	mrand "math/rand/v2"
 	"path/filepath"
 	"strings"
@@ -26,6 +29,8 @@ func TestRepositoryInitAndOpen(t *testing.T) {
 		head, err := repo1.Head(t.Context())
 		assert.NoError(err)
 		assert.Equal(true, head.IsRoot())
+		assert.Equal(StorageVersion, repo1.storageInfo.Version)
+		assert.NotEqual(RepositoryId{}, repo1.storageInfo.RepositoryId)
 		repo2, err := OpenRepository(t.Context(), storage, userPassphrase)
 		assert.NoError(err)
 		defer repo2.Close() //nolint:errcheck
@@ -185,6 +190,37 @@ func TestRepositoryClose(t *testing.T) {
 	})
 }
 
+func TestRepositoryPing(t *testing.T) {
+	t.Parallel()
+	t.Run("Happy path", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+
+		head, revision, err := r.Ping(t.Context())
+		assert.NoError(err)
+		assert.Equal(true, head.IsRoot())
+		assert.Equal(Revision{}, revision)
+
+		revId, err := testCommit(t, r.Repository, td.RevisionEntry("a.txt", RevisionEntryKindAdd))
+		assert.NoError(err)
+		head, revision, err = r.Ping(t.Context())
+		assert.NoError(err)
+		assert.Equal(revId, head)
+		assert.Equal("test message", *revision.Message)
+	})
+
+	t.Run("Unreadable head revision fails", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+
+		assert.NoError(WriteRef(t.Context(), r.storage, "head", RevisionId{1, 2, 3}))
+		_, _, err := r.Ping(t.Context())
+		assert.Error(err, "failed to read head revision")
+	})
+}
+
 func TestRepositoryReadWriteBlock(t *testing.T) {
 	t.Parallel()
 	t.Run("Happy path", func(t *testing.T) {
@@ -359,6 +395,48 @@ func TestRepositoryReadWriteBlock(t *testing.T) {
 		assert.Error(err, "message authentication failed")
 	})
 
+	t.Run("A block copied from another repository with the same keys must fail to read", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		legacy := td.NewLegacyTestRepository(t, td.NewFS(t))
+
+		// Both repositories share the keys of `r`, only the storage section differs.
+		copyRepository := func(info storageInfo) *Repository {
+			storage, err := NewFileStorage(td.NewFS(t), StoragePurposeRepository)
+			assert.NoError(err)
+			config := maps.Clone(r.Config())
+			config[storageSection] = createStorageConfig(info)
+			assert.NoError(storage.Init(t.Context(), config, RepositoryConfigHeaderComment))
+			repository, err := OpenRepository(t.Context(), storage, []byte(r.Passphrase))
+			assert.NoError(err)
+			return repository
+		}
+		info, err := newStorageInfo()
+		assert.NoError(err)
+		other := copyRepository(info)
+		otherLegacy := copyRepository(storageInfo{LegacyStorageVersion, RepositoryId{}})
+
+		blockId, _, err := r.WriteBlock(t.Context(), []byte("block"), NewBlockBuf())
+		assert.NoError(err)
+		data, err := ReadFile(r.Storage.FS, r.Storage.blockPath(blockId))
+		assert.NoError(err)
+		for _, repository := range []*Repository{other, otherLegacy} {
+			_, err = repository.storage.WriteBlock(t.Context(), blockId, data)
+			assert.NoError(err)
+			_, err = repository.ReadBlock(t.Context(), blockId, NewBlockBuf())
+			assert.Error(err, "message authentication failed")
+		}
+
+		// Legacy repositories only bind blocks to their id.
+		blockId, _, err = legacy.WriteBlock(t.Context(), []byte("legacy"), NewBlockBuf())
+		assert.NoError(err)
+		read, err := legacy.ReadBlock(t.Context(), blockId, NewBlockBuf())
+		assert.NoError(err)
+		assert.Equal("legacy", string(read))
+		assert.Equal(blockId[:], legacy.blockAAD(blockId))
+	})
+
 	t.Run("Authenticated block with oversized EncryptedDataSize is rejected", func(t *testing.T) {
 		t.Parallel()
 		assert := NewAssert(t)
@@ -374,7 +452,7 @@ func TestRepositoryReadWriteBlock(t *testing.T) {
 		assert.NoError(err)
 		plaintext := []byte("payload")
 		encryptedData := make([]byte, len(plaintext)+TotalCipherOverhead)
-		_, err = Encrypt(plaintext, dekCypher, blockId[:], encryptedData)
+		_, err = Encrypt(plaintext, dekCypher, r.blockAAD(blockId), encryptedData)
 		assert.NoError(err)
 		writeBlock := func(encryptedDataSize uint32) {
 			header := BlockHeader{
@@ -387,7 +465,7 @@ func TestRepositoryReadWriteBlock(t *testing.T) {
 			err = header.Marshall(NewProtobufWriter(headerBuf))
 			assert.NoError(err)
 			encryptedHeader := make([]byte, len(headerBuf)+TotalCipherOverhead)
-			_, err = Encrypt(headerBuf, r.kekCipher, blockId[:], encryptedHeader)
+			_, err = Encrypt(headerBuf, r.kekCipher, r.blockAAD(blockId), encryptedHeader)
 			assert.NoError(err)
 			block := Block{EncryptedHeader: encryptedHeader, EncryptedData: encryptedData}
 			blockBuf := make([]byte, block.MarshallSize())
@@ -512,6 +590,148 @@ func TestRepositoryReadWriteBlock(t *testing.T) {
 	})
 }
 
+func TestRepositoryReadBlockHeader(t *testing.T) {
+	t.Parallel()
+	assert := NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	compressible := bytes.Repeat([]byte("abcd"), 100_000)
+	compressedId, _, err := r.WriteBlock(t.Context(), compressible, NewBlockBuf())
+	assert.NoError(err)
+	blockId, _, err := r.WriteBlock(t.Context(), []byte("abc"), NewBlockBuf())
+	assert.NoError(err)
+	storage := &rangeStorage{r.Storage, nil}
+	repository, err := OpenRepository(t.Context(), storage, []byte(r.Passphrase))
+	assert.NoError(err)
+
+	info, err := repository.ReadBlockHeader(t.Context(), blockId)
+	assert.NoError(err)
+	assert.Equal(BlockInfo{3, false}, info)
+	info, err = repository.ReadBlockHeader(t.Context(), compressedId)
+	assert.NoError(err)
+	assert.Equal(true, info.Compressed)
+	assert.Less(info.Size, len(compressible)/5)
+	assert.Equal([]int{blockHeaderPrefixSize, blockHeaderPrefixSize}, storage.lengths)
+
+	// Storages that cannot read a range fall back to reading the whole block.
+	info, err = r.ReadBlockHeader(t.Context(), blockId)
+	assert.NoError(err)
+	assert.Equal(BlockInfo{3, false}, info)
+	_, err = repository.ReadBlockHeader(t.Context(), td.BlockId("missing"))
+	assert.ErrorIs(err, ErrBlockNotFound)
+}
+
+// rangeStorage is a `BlockRangeReader` that records the lengths it read.
+type rangeStorage struct {
+	Storage
+	lengths []int
+}
+
+func (s *rangeStorage) ReadBlockRange(
+	ctx context.Context,
+	blockId BlockId,
+	offset, length int,
+	buf BlockBuf,
+) ([]byte, error) {
+	data, err := s.ReadBlock(ctx, blockId, buf)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	s.lengths = append(s.lengths, length)
+	return data[min(offset, len(data)):min(offset+length, len(data))], nil
+}
+
+func TestRepositoryHasBlocks(t *testing.T) {
+	t.Parallel()
+	assert := NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	blockId, _, err := r.WriteBlock(t.Context(), []byte("abc"), NewBlockBuf())
+	assert.NoError(err)
+	blockIds := []BlockId{td.BlockId("missing"), blockId}
+
+	exists, err := r.HasBlocks(t.Context(), blockIds)
+	assert.NoError(err)
+	assert.Equal([]bool{false, true}, exists)
+
+	storage := &batchStorage{r.Storage, nil, nil}
+	repository, err := OpenRepository(t.Context(), storage, []byte(r.Passphrase))
+	assert.NoError(err)
+	exists, err = repository.HasBlocks(t.Context(), blockIds)
+	assert.NoError(err)
+	assert.Equal([]bool{false, true}, exists)
+	assert.Equal([]int{2}, storage.batches)
+}
+
+// batchStorage is a `BlockBatchChecker` and `BlockBatchWriter` that records
+// the size of the batches it checked and wrote.
+type batchStorage struct {
+	Storage
+	batches      []int
+	writeBatches []int
+}
+
+func (s *batchStorage) HasBlocks(ctx context.Context, blockIds []BlockId) ([]bool, error) {
+	s.batches = append(s.batches, len(blockIds))
+	exists := make([]bool, len(blockIds))
+	for i, blockId := range blockIds {
+		ok, err := s.HasBlock(ctx, blockId)
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+		exists[i] = ok
+	}
+	return exists, nil
+}
+
+func (s *batchStorage) WriteBlocks(ctx context.Context, blocks []StoredBlock) ([]bool, error) {
+	s.writeBatches = append(s.writeBatches, len(blocks))
+	existed := make([]bool, len(blocks))
+	for i, block := range blocks {
+		ok, err := s.WriteBlock(ctx, block.BlockId, block.Data)
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+		existed[i] = ok
+	}
+	return existed, nil
+}
+
+func TestRepositoryWriteBlocks(t *testing.T) {
+	t.Parallel()
+	assert := NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	existingId, _, err := r.WriteBlock(t.Context(), []byte("abc"), NewBlockBuf())
+	assert.NoError(err)
+	storage := &batchStorage{r.Storage, nil, nil}
+	repository, err := OpenRepository(t.Context(), storage, []byte(r.Passphrase))
+	assert.NoError(err)
+
+	data := [][]byte{[]byte("abc"), []byte("def"), bytes.Repeat([]byte("g"), 1000), []byte("def")}
+	blockIds, dataBytesWritten, err := repository.WriteBlocks(t.Context(), data)
+	assert.NoError(err)
+	assert.Equal(4, len(blockIds))
+	assert.Equal(existingId, blockIds[0])
+	assert.Equal(blockIds[1], blockIds[3])
+	assert.Nil(dataBytesWritten[0])
+	assert.Equal(3, *dataBytesWritten[1])
+	assert.Equal(1000, *dataBytesWritten[2])
+	assert.Nil(dataBytesWritten[3])
+	// One batch to check all blocks, one to write the two new ones.
+	assert.Equal([]int{4}, storage.batches)
+	assert.Equal([]int{2}, storage.writeBatches)
+	for i, blockId := range blockIds {
+		got, err := repository.ReadBlock(t.Context(), blockId, NewBlockBuf())
+		assert.NoError(err)
+		assert.Equal(data[i], got)
+	}
+
+	// Storages that cannot write batches write one block at a time.
+	blockIds, dataBytesWritten, err = r.WriteBlocks(t.Context(), [][]byte{[]byte("abc"), []byte("xyz")})
+	assert.NoError(err)
+	assert.Equal(existingId, blockIds[0])
+	assert.Nil(dataBytesWritten[0])
+	assert.Equal(3, *dataBytesWritten[1])
+}
+
 func TestRepositoryReadWriteRevision(t *testing.T) {
 	t.Parallel()
 	t.Run("Happy path", func(t *testing.T) {
@@ -698,6 +918,92 @@ func TestRepositoryConcurrency(t *testing.T) {
 	}
 }
 
+// heldLockStorage reports the first `held` locks as held by someone else.
+type heldLockStorage struct {
+	Storage
+	held     int
+	attempts int
+}
+
+func (s *heldLockStorage) Lock(ctx context.Context, name string) (func() error, error) {
+	s.attempts++
+	if s.attempts <= s.held {
+		return nil, &LockExistsError{name, "other", "host", 1, time.Now()}
+	}
+	return s.Storage.Lock(ctx, name) //nolint:wrapcheck
+}
+
+// lostResponseStorage writes the head, but reports a network error as if the
+// response got lost.
+type lostResponseStorage struct {
+	Storage
+}
+
+func (s *lostResponseStorage) CompareAndSwapControlFile(
+	ctx context.Context,
+	section ControlFileSection,
+	name string,
+	expected, data []byte,
+) error {
+	if err := s.Storage.CompareAndSwapControlFile(ctx, section, name, expected, data); err != nil {
+		return err //nolint:wrapcheck
+	}
+	return WrapErrorKindf(ErrNetwork, nil, "connection reset")
+}
+
+func TestWriteRevisionLostResponse(t *testing.T) {
+	t.Parallel()
+	assert := NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	repository, err := OpenRepository(t.Context(), &lostResponseStorage{r.Storage}, []byte(r.Passphrase))
+	assert.NoError(err)
+	entry, _ := testEntry(t, r, "a.txt", "abc")
+	revisionId, err := testCommit(t, repository, entry)
+	assert.NoError(err)
+	head, err := repository.Head(t.Context())
+	assert.NoError(err)
+	assert.Equal(head, revisionId)
+}
+
+func TestWriteRevisionLockRetry(t *testing.T) {
+	t.Parallel()
+	open := func(t *testing.T, held int) (*TestRepository, *Repository, *heldLockStorage) {
+		t.Helper()
+		r := td.NewTestRepository(t, td.NewFS(t))
+		storage := &heldLockStorage{r.Storage, held, 0}
+		repository, err := OpenRepository(t.Context(), storage, []byte(r.Passphrase))
+		NewAssert(t).NoError(err)
+		return r, repository, storage
+	}
+
+	t.Run("A held lock is retried", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r, repository, storage := open(t, 2)
+		repository.SetLockRetry(LockRetry{3, time.Millisecond, time.Millisecond})
+		entry, _ := testEntry(t, r, "a.txt", "abc")
+		_, err := testCommit(t, repository, entry)
+		assert.NoError(err)
+		assert.Equal(3, storage.attempts)
+	})
+
+	t.Run("Contention is returned after the last attempt", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r, repository, storage := open(t, 5)
+		entry, _ := testEntry(t, r, "a.txt", "abc")
+		commit, err := NewCommit(t.Context(), repository, td.NewFS(t))
+		assert.NoError(err)
+		commit.LockRetry = LockRetry{2, time.Millisecond, time.Millisecond}
+		assert.NoError(commit.Add(entry))
+		_, err = commit.Commit(t.Context(), &CommitInfo{Author: "test author", Message: "test message"})
+		assert.ErrorIs(err, ErrContention)
+		var lockExists *LockExistsError
+		assert.Equal(true, errors.As(err, &lockExists))
+		assert.Equal(2, storage.attempts)
+	})
+}
+
 func TestPadme(t *testing.T) {
 	t.Parallel()
 	// Reference values taken from https://lbarman.ch/blog/padme/
@@ -791,7 +1097,8 @@ func FuzzParseRepositoryConfig(f *testing.F) {
 	f.Add("")
 	f.Add(`
 [storage]
-version = "1"
+version = "2"
+repository-id = "000102030405060708090a0b0c0d0e0f"
 [encryption]
 version = "1"
 passphrase-derivation = "$argon2id$v=19$m=131072,t=4,p=2$MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY"
@@ -51,17 +51,29 @@ func ReadRevisionChain(ctx context.Context, repository *Repository) (RevisionCha
 // back toward the root, like git's `HEAD~2`. `head` and `head~0` are the head
 // revision (the root revision on an empty repository).
 func (chain RevisionChain) ParseRevisionId(spec string) (RevisionId, error) {
+	return chain.ParseRevisionIdOrTag(spec, nil)
+}
+
+// ParseRevisionIdOrTag is like ParseRevisionId, but the spec may also start
+// with the name of one of `tags`, e.g. `release` or `release~2`.
+func (chain RevisionChain) ParseRevisionIdOrTag(spec string, tags []Tag) (RevisionId, error) {
 	base, steps, err := splitRevisionSteps(spec)
 	if err != nil {
 		return RevisionId{}, err
 	}
 	index := 0
 	if !strings.EqualFold(base, "head") {
-		id, err := NewBlockIdFromString(base)
-		if err != nil {
-			return RevisionId{}, WrapErrorf(err, "invalid revision id %q", base)
+		var id RevisionId
+		if i := slices.IndexFunc(tags, func(t Tag) bool { return t.Name == base }); i >= 0 {
+			id = tags[i].RevisionId
+		} else {
+			blockId, err := NewBlockIdFromString(base)
+			if err != nil {
+				return RevisionId{}, WrapErrorf(err, "invalid revision id %q", base)
+			}
+			id = RevisionId(blockId)
 		}
-		if index = slices.Index(chain, RevisionId(id)); index < 0 {
+		if index = slices.Index(chain, id); index < 0 {
 			return RevisionId{}, Errorf("revision not found in repository: %s", base)
 		}
 	}
@@ -111,20 +123,26 @@ type RevisionRange struct {
 // Each bound is a spec accepted by ParseRevisionId (an id or `head`, with an
 // optional `~<n>`).
 func (chain RevisionChain) ParseRevisionRange(spec string) (RevisionRange, error) {
+	return chain.ParseRevisionRangeOrTag(spec, nil)
+}
+
+// ParseRevisionRangeOrTag is like ParseRevisionRange, but the bounds may also
+// be tags (see ParseRevisionIdOrTag).
+func (chain RevisionChain) ParseRevisionRangeOrTag(spec string, tags []Tag) (RevisionRange, error) {
 	var r RevisionRange
 	since, until, isRange := strings.Cut(spec, "..")
 	if !isRange {
 		since, until = "", since
 	}
 	if since != "" {
-		id, err := chain.ParseRevisionId(since)
+		id, err := chain.ParseRevisionIdOrTag(since, tags)
 		if err != nil {
 			return r, WrapErrorf(err, "invalid range since %q", since)
 		}
 		r.Since = &id
 	}
 	if until != "" {
-		id, err := chain.ParseRevisionId(until)
+		id, err := chain.ParseRevisionIdOrTag(until, tags)
 		if err != nil {
 			return r, WrapErrorf(err, "invalid range until %q", until)
 		}
@@ -191,7 +209,7 @@ func (rr *RevisionReader) Read(ctx context.Context, buf BlockBuf) (*RevisionEntr
 		}
 		entries, err := rr.marshaller.UnmarshallAll(NewProtobufReader(data))
 		if err != nil {
-			return nil, WrapErrorf(err, "failed to unmarshall block %s", blockId)
+			return nil, WrapErrorKindf(ErrCorrupt, err, "failed to unmarshall block %s", blockId)
 		}
 		rr.blockIndex++
 		rr.current = entries
@@ -46,6 +46,22 @@ func TestParseRevisionId(t *testing.T) {
 		assert.Error(err, "non-negative")
 	})
 
+	t.Run("Tags resolve like ids", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		tags := []Tag{{"release", b}, {"old", RevisionId{0xff}}}
+		got, err := chain.ParseRevisionIdOrTag("release", tags)
+		assert.NoError(err)
+		assert.Equal(b, got)
+		got, err = chain.ParseRevisionIdOrTag("release~1", tags)
+		assert.NoError(err)
+		assert.Equal(a, got)
+		_, err = chain.ParseRevisionIdOrTag("old", tags) // tagged revision not in chain
+		assert.Error(err, "revision not found")
+		_, err = chain.ParseRevisionIdOrTag("nope", tags)
+		assert.Error(err, "invalid revision id")
+	})
+
 	t.Run("head on an empty chain is the root", func(t *testing.T) {
 		t.Parallel()
 		assert := NewAssert(t)
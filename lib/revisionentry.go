@@ -71,7 +71,7 @@ func (revisionEntryChunkMarshaller) EntrySize(entry *RevisionEntry) int {
 
 func NewRevisionEntryTempCache(
 	temp *Temp[*RevisionEntry],
-	maxChunksInCache int,
+	opts TempCacheOptions,
 ) (*TempCache[*RevisionEntry], error) {
-	return NewTempCache(temp, RevisionEntryPathCompareString, maxChunksInCache)
+	return NewTempCache(temp, RevisionEntryPathCompareString, opts)
 }
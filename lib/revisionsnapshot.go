@@ -16,6 +16,23 @@ func NewRevisionSnapshot(
 	repository *Repository,
 	revisionId RevisionId,
 	tmpFS FS,
+) (*Temp[*RevisionEntry], error) {
+	return NewFilteredRevisionSnapshot(ctx, repository, revisionId, tmpFS, nil)
+}
+
+// NewFilteredRevisionSnapshot is like `NewRevisionSnapshot` but only keeps
+// entries matched by `pathFilter`. Entries that don't match are dropped
+// during the merge, so they are never written to `tmpFS`.
+// This only saves memory and space in `tmpFS`, not I/O: every chunk of every
+// revision is still read and decrypted, because a revision does not record
+// which paths its chunks contain.
+// A `nil` filter includes all entries.
+func NewFilteredRevisionSnapshot(
+	ctx context.Context,
+	repository *Repository,
+	revisionId RevisionId,
+	tmpFS FS,
+	pathFilter PathFilter,
 ) (*Temp[*RevisionEntry], error) {
 	// Build a list of all revisions.
 	revisions := make([]*Revision, 0)
@@ -30,7 +47,7 @@ func NewRevisionSnapshot(
 		r = revision.ParentRevisionId
 	}
 	tempWriter := NewRevisionEntryTempWriter(tmpFS, DefaultTempChunkSize)
-	if err := revisionNWayMerge(ctx, repository, revisions, tempWriter, buf); err != nil {
+	if err := revisionNWayMerge(ctx, repository, revisions, pathFilter, tempWriter, buf); err != nil {
 		return nil, WrapErrorf(err, "failed to revision n-way merge revisions")
 	}
 	// todo: we don't need to call `tempWriter.Finalize()` because the entries
@@ -46,6 +63,7 @@ func revisionNWayMerge(
 	ctx context.Context,
 	repository *Repository,
 	revisions []*Revision,
+	pathFilter PathFilter,
 	tempWriter *TempWriter[*RevisionEntry],
 	buf BlockBuf,
 ) error {
@@ -92,6 +110,9 @@ func revisionNWayMerge(
 				heap[i] = re
 			}
 		}
+		if pathFilter != nil && !pathFilter.Include(newest.Path, newest.Metadata.FileMode.IsDir()) {
+			continue
+		}
 		if newest.Kind != RevisionEntryKindDelete {
 			if err := tempWriter.Add(newest); err != nil {
 				return WrapErrorf(err, "failed to write entry")
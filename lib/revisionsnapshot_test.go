@@ -144,6 +144,49 @@ func TestRevisionSnapshot(t *testing.T) {
 		}, snapshot)
 	})
 
+	t.Run("Filtered snapshot drops entries outside the filter", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+
+		_, err := testCommit(
+			t,
+			r.Repository,
+			td.RevisionEntryExt("a", RevisionEntryKindAdd, FileModeDir, ""),
+			td.RevisionEntry("a/1.txt", RevisionEntryKindAdd),
+			td.RevisionEntry("b/1.txt", RevisionEntryKindAdd),
+		)
+		assert.NoError(err)
+		revId2, err := testCommit(
+			t,
+			r.Repository,
+			td.RevisionEntry("a/2.txt", RevisionEntryKindAdd),
+			td.RevisionEntry("b/1.txt", RevisionEntryKindDelete),
+			td.RevisionEntry("b/2.txt", RevisionEntryKindAdd),
+		)
+		assert.NoError(err)
+		snapshot, err := NewFilteredRevisionSnapshot(
+			t.Context(), r.Repository, revId2, td.NewFS(t), td.Path("a").AsFilter(),
+		)
+		assert.NoError(err)
+		defer snapshot.Remove() //nolint:errcheck
+		reader := snapshot.Reader(nil)
+		entries := []*RevisionEntry{}
+		buf := NewBlockBuf()
+		for {
+			entry, err := reader.Read(buf)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			assert.NoError(err)
+			entries = append(entries, entry)
+		}
+		assert.Equal([]*RevisionEntry{
+			td.RevisionEntry("a/1.txt", RevisionEntryKindAdd),
+			td.RevisionEntry("a/2.txt", RevisionEntryKindAdd),
+		}, entries)
+	})
+
 	t.Run("Delete directory", func(t *testing.T) {
 		t.Parallel()
 		assert := NewAssert(t)
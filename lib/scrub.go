@@ -0,0 +1,211 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	// The control file in the conf section that holds the `ScrubProgress`.
+	scrubProgressFileName = "scrub"
+	// Save the progress every n blocks, so that an interrupted scrub does
+	// not start over.
+	scrubSaveInterval = 1000
+)
+
+type ScrubMonitor interface {
+	// Called once before the first block is verified with the number of
+	// blocks in storage and the number of blocks that will be verified.
+	OnScrubStart(blocks, sample int)
+	OnBlockVerified(blockId BlockId, length int)
+	// Called for every block that is corrupt or missing, the scrub goes on.
+	OnCorruptBlock(blockId BlockId, err error)
+}
+
+type ScrubOptions struct {
+	Monitor ScrubMonitor
+	// The number of blocks to verify. If 0, `Percent` is used.
+	Blocks int
+	// The percentage (0-100) of the blocks in storage to verify.
+	Percent float64
+}
+
+// ScrubProgress tells how far the scrub has come. It is kept in the
+// repository, so that every run continues where the last one stopped.
+type ScrubProgress struct {
+	// The number of the current pass over all blocks, starting at 1.
+	Cycle      int
+	CycleStart time.Time
+	// The number of blocks verified in the current cycle.
+	Verified int
+	// The last block verified in the current cycle.
+	Cursor  BlockId
+	LastRun time.Time
+}
+
+type ScrubResult struct {
+	// The number of blocks in storage.
+	Blocks   int
+	Verified int
+	Bytes    int64
+	Corrupt  []BlockId
+	// Whether this run finished a cycle, i.e. every block in storage has been
+	// verified since `Progress.CycleStart`.
+	CompletedCycle bool
+	Progress       ScrubProgress
+}
+
+// Scrub verifies a part of the blocks in storage: Every block must be
+// readable, decrypt, and its content must match its id (see
+// `readVerifiedBlock`). Unlike `CheckHealth` with `CheckBlocks`, the
+// revisions are not read and a run only reads a part of the repository.
+//
+// Blocks are verified in the order of their ids, starting after the block
+// the last run stopped at (see `ScrubProgress`). Block ids are HMACs of the
+// block content, so every run verifies a random sample, and repeated runs
+// eventually cover the whole repository. Orphaned blocks are verified, too.
+//
+// Corrupt or missing blocks are reported to the monitor. Return the result
+// and an `ErrCorrupt` error if there were any.
+func Scrub(ctx context.Context, repository *Repository, tempFS FS, opts ScrubOptions) (*ScrubResult, error) {
+	if opts.Blocks < 0 || opts.Percent < 0 || opts.Percent > 100 {
+		return nil, Errorf("invalid scrub sample: %d blocks, %g%%", opts.Blocks, opts.Percent)
+	}
+	progress, err := ReadScrubProgress(ctx, repository)
+	if err != nil {
+		return nil, err
+	}
+	storedFS, err := tempFS.MkSub("scrub")
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to create temp directory for stored block ids")
+	}
+	total := 0
+	stored, err := ReadSortedBlockIds(ctx, repository.storage, storedFS, func(BlockId) { total++ })
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to snapshot storage block ids")
+	}
+	defer stored.Remove() //nolint:errcheck
+	sample := opts.Blocks
+	if sample == 0 {
+		sample = int(math.Ceil(float64(total) * opts.Percent / 100))
+	}
+	sample = min(sample, total)
+	result := &ScrubResult{total, 0, 0, nil, false, progress}
+	if result.Progress.Cycle == 0 {
+		result.Progress = newScrubCycle(1)
+	}
+	opts.Monitor.OnScrubStart(total, sample)
+	buf := NewBlockBuf()
+	for result.Verified < sample {
+		// Continue after the cursor or start a new cycle.
+		p := &result.Progress
+		reader := stored.Reader(func(id BlockId) bool {
+			return p.Verified == 0 || BlockIdCompare(id, p.Cursor) > 0
+		})
+		for result.Verified < sample {
+			blockId, err := reader.Read(buf)
+			if errors.Is(err, io.EOF) {
+				result.CompletedCycle = true
+				result.Progress = newScrubCycle(result.Progress.Cycle + 1)
+				break
+			}
+			if err != nil {
+				return nil, WrapErrorf(err, "failed to read stored block id")
+			}
+			data, err := readVerifiedBlock(ctx, repository, blockId, buf)
+			switch {
+			case errors.Is(err, ErrCorrupt) || errors.Is(err, ErrBlockNotFound):
+				result.Corrupt = append(result.Corrupt, blockId)
+				opts.Monitor.OnCorruptBlock(blockId, err)
+			case err != nil:
+				return nil, WrapErrorf(err, "failed to verify block %s", blockId)
+			default:
+				result.Bytes += int64(len(data))
+				opts.Monitor.OnBlockVerified(blockId, len(data))
+			}
+			result.Verified++
+			result.Progress.Verified++
+			result.Progress.Cursor = blockId
+			if result.Verified%scrubSaveInterval == 0 {
+				if err := writeScrubProgress(ctx, repository, result.Progress); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	result.Progress.LastRun = time.Now()
+	if err := writeScrubProgress(ctx, repository, result.Progress); err != nil {
+		return nil, err
+	}
+	if len(result.Corrupt) > 0 {
+		return result, WrapErrorKindf(ErrCorrupt, nil,
+			"%d of %d verified blocks are corrupt or missing", len(result.Corrupt), result.Verified)
+	}
+	return result, nil
+}
+
+// Return the progress of the last scrub, or a zero `ScrubProgress` if the
+// repository was never scrubbed.
+func ReadScrubProgress(ctx context.Context, repository *Repository) (ScrubProgress, error) {
+	data, err := repository.storage.ReadControlFile(ctx, ControlFileSectionConf, scrubProgressFileName)
+	if errors.Is(err, ErrControlFileNotFound) {
+		return ScrubProgress{}, nil
+	}
+	if err != nil {
+		return ScrubProgress{}, WrapErrorf(err, "failed to read scrub progress")
+	}
+	toml, err := ReadToml(bytes.NewReader(data))
+	if err != nil {
+		return ScrubProgress{}, WrapErrorf(err, "failed to parse scrub progress")
+	}
+	invalid := func(key string) error {
+		return Errorf("missing or invalid key `scrub.%s` in scrub progress", key)
+	}
+	var progress ScrubProgress
+	var ok bool
+	if progress.Cycle, ok = toml.GetIntValue("scrub", "cycle"); !ok {
+		return ScrubProgress{}, invalid("cycle")
+	}
+	if progress.Verified, ok = toml.GetIntValue("scrub", "verified"); !ok {
+		return ScrubProgress{}, invalid("verified")
+	}
+	cursor, _ := toml.GetValue("scrub", "cursor")
+	if progress.Cursor, err = NewBlockIdFromString(cursor); err != nil {
+		return ScrubProgress{}, invalid("cursor")
+	}
+	for key, t := range map[string]*time.Time{"cycle-start": &progress.CycleStart, "last-run": &progress.LastRun} {
+		value, _ := toml.GetValue("scrub", key)
+		if *t, err = time.Parse(time.RFC3339, value); err != nil {
+			return ScrubProgress{}, invalid(key)
+		}
+	}
+	return progress, nil
+}
+
+func writeScrubProgress(ctx context.Context, repository *Repository, progress ScrubProgress) error {
+	var buf bytes.Buffer
+	if err := WriteToml(&buf, "", Toml{"scrub": {
+		"cycle":       strconv.Itoa(progress.Cycle),
+		"cycle-start": progress.CycleStart.UTC().Format(time.RFC3339),
+		"verified":    strconv.Itoa(progress.Verified),
+		"cursor":      hex.EncodeToString(progress.Cursor[:]),
+		"last-run":    progress.LastRun.UTC().Format(time.RFC3339),
+	}}); err != nil {
+		return WrapErrorf(err, "failed to encode scrub progress")
+	}
+	err := repository.storage.WriteControlFile(ctx, ControlFileSectionConf, scrubProgressFileName, buf.Bytes())
+	if err != nil {
+		return WrapErrorf(err, "failed to write scrub progress")
+	}
+	return nil
+}
+
+func newScrubCycle(cycle int) ScrubProgress {
+	return ScrubProgress{cycle, time.Now(), 0, BlockId{}, time.Time{}}
+}
@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestScrub(t *testing.T) {
+	t.Parallel()
+	writeBlocks := func(t *testing.T, r *TestRepository, n int) []BlockId {
+		t.Helper()
+		assert := NewAssert(t)
+		blockIds := []BlockId{}
+		for i := range n {
+			blockId, _, err := r.WriteBlock(t.Context(), fmt.Appendf(nil, "block %d", i), NewBlockBuf())
+			assert.NoError(err)
+			blockIds = append(blockIds, blockId)
+		}
+		return blockIds
+	}
+	verifiedBlocks := func(monitor *TestScrubMonitor) []BlockId {
+		blockIds := []BlockId{}
+		for _, call := range monitor.Calls {
+			if call.Name == "OnBlockVerified" || call.Name == "OnCorruptBlock" {
+				blockIds = append(blockIds, call.Args[0].(BlockId)) //nolint:forcetypeassert
+			}
+		}
+		return blockIds
+	}
+
+	t.Run("Repeated runs cover all blocks", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		blockIds := writeBlocks(t, r, 10)
+
+		progress, err := ReadScrubProgress(t.Context(), r.Repository)
+		assert.NoError(err)
+		assert.Equal(0, progress.Cycle)
+
+		seen := map[BlockId]int{}
+		for run := range 3 {
+			monitor := td.NewScrubMonitor()
+			result, err := Scrub(t.Context(), r.Repository, td.NewFS(t), ScrubOptions{monitor, 0, 40})
+			assert.NoError(err)
+			assert.Equal(NewMockCall("OnScrubStart", 10, 4), monitor.Calls[0])
+			for _, blockId := range verifiedBlocks(monitor) {
+				seen[blockId]++
+			}
+			assert.Equal(10, result.Blocks)
+			assert.Equal(4, result.Verified)
+			assert.Equal(run == 2, result.CompletedCycle, "run %d", run)
+		}
+		// The third run finished the first cycle after 2 blocks and started
+		// the second one.
+		assert.Equal(len(blockIds), len(seen))
+		twice := 0
+		for _, count := range seen {
+			if count == 2 {
+				twice++
+			}
+		}
+		assert.Equal(2, twice)
+		progress, err = ReadScrubProgress(t.Context(), r.Repository)
+		assert.NoError(err)
+		assert.Equal(2, progress.Cycle)
+		assert.Equal(2, progress.Verified)
+	})
+
+	t.Run("Corrupt blocks are reported and the scrub goes on", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		blockIds := writeBlocks(t, r, 3)
+		path := r.Storage.blockPath(blockIds[1])
+		data, err := ReadFile(r.Storage.FS, path)
+		assert.NoError(err)
+		data[len(data)/2] ^= 1
+		assert.NoError(r.Storage.FS.Chmod(path, 0o600))
+		assert.NoError(WriteFile(r.Storage.FS, path, data))
+
+		monitor := td.NewScrubMonitor()
+		result, err := Scrub(t.Context(), r.Repository, td.NewFS(t), ScrubOptions{monitor, 3, 0})
+		assert.ErrorIs(err, ErrCorrupt)
+		assert.Equal([]BlockId{blockIds[1]}, result.Corrupt)
+		assert.Equal(3, result.Verified)
+		assert.Call(NewMockCall("OnCorruptBlock", blockIds[1]), monitor.Calls)
+	})
+}
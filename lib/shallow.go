@@ -0,0 +1,397 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+// The control file in the conf section of a shallow mirror that holds the
+// `shallowState`.
+const shallowStateFileName = "shallow"
+
+// shallowState links a shallow mirror to its source.
+type shallowState struct {
+	// The last revision of the source that was replicated.
+	SourceHead RevisionId
+	// The revision of the mirror that corresponds to `SourceHead`.
+	Head RevisionId
+}
+
+type ShallowReplicationOptions struct {
+	Monitor ReplicationMonitor
+	Workers int
+	// The number of revisions to replicate when `dst` is created.
+	Depth int
+}
+
+// ReplicateShallow copies the latest `opts.Depth` revisions of `src` to `dst`,
+// i.e. only the blocks that are needed to restore the files of these
+// revisions.
+//
+// Revisions only contain the changes to their parent, so the oldest of them
+// is written to `dst` as a new revision with all the files of its snapshot,
+// and the newer ones are written again on top of it. The revisions in `dst`
+// have the same timestamps, authors, messages, and changes, but different
+// ids. Tags that point to one of them are rewritten, too. Therefore, `dst`
+// cannot be replicated to with `Replicate` or used by the workspaces of
+// `src`, but it can be attached to or read like any other repository.
+//
+// Later runs append the revisions of `src` that are new since the last run,
+// no matter how many. The last replicated revision is kept in `dst` (see
+// `shallowState`). `dst` must not have commits of its own.
+func ReplicateShallow( //nolint:funlen
+	ctx context.Context,
+	src *Repository,
+	dst Storage,
+	tempFS FS,
+	opts ShallowReplicationOptions,
+) error {
+	if opts.Workers < 1 {
+		return Errorf("number of workers must be at least 1")
+	}
+	if opts.Depth < 1 {
+		return Errorf("depth must be at least 1")
+	}
+	if err := replicateConfig(ctx, src.storage, dst); err != nil {
+		return err
+	}
+	// The backups of the config are needed to recover lost passphrases.
+	if err := replicateControlFiles(ctx, src.storage, dst, ControlFileSectionSecurity, opts.Monitor); err != nil {
+		return err
+	}
+	// The config (and therefore the keys) of both repositories is the same.
+	mirror := *src
+	mirror.storage = dst
+	state, found, err := readShallowState(ctx, dst)
+	if err != nil {
+		return err
+	}
+	dstHead, err := ReadRef(ctx, dst, "head")
+	if errors.Is(err, ErrControlFileNotFound) {
+		if err := CompareAndSwapRef(ctx, dst, "head", nil, RevisionId{}); err != nil {
+			return WrapErrorf(err, "failed to write dst head reference")
+		}
+	} else if err != nil {
+		return WrapErrorf(err, "failed to read dst head")
+	}
+	switch {
+	case found && dstHead != state.Head:
+		return Errorf("dst head %s is not the last replicated revision %s, dst has commits of its own",
+			dstHead, state.Head)
+	case !found && !dstHead.IsRoot():
+		return Errorf("dst is not empty and not a shallow mirror")
+	}
+	srcHead, err := src.Head(ctx)
+	if err != nil {
+		return WrapErrorf(err, "failed to read src head")
+	}
+	// The revisions to write to `dst`, newest first.
+	revisions := []RevisionId{}
+	buf := NewBlockBuf()
+	for revisionId := srcHead; revisionId != state.SourceHead; {
+		if revisionId.IsRoot() {
+			return Errorf("the last replicated revision %s is not in src", state.SourceHead)
+		}
+		if !found && len(revisions) == opts.Depth {
+			break
+		}
+		revisions = append(revisions, revisionId)
+		revision, err := src.ReadRevision(ctx, revisionId, buf)
+		if err != nil {
+			return WrapErrorf(err, "failed to read revision %s", revisionId)
+		}
+		revisionId = revision.ParentRevisionId
+	}
+	if len(revisions) == 0 {
+		return replicateShallowTags(ctx, src, &mirror, state, opts.Monitor)
+	}
+	var base *Temp[*RevisionEntry]
+	if !found {
+		baseFS, err := tempFS.MkSub("base")
+		if err != nil {
+			return WrapErrorf(err, "failed to create temp directory for the base revision")
+		}
+		base, err = NewRevisionSnapshot(ctx, src, revisions[len(revisions)-1], baseFS)
+		if err != nil {
+			return WrapErrorf(err, "failed to read the snapshot of the oldest revision")
+		}
+		defer base.Remove() //nolint:errcheck
+	}
+	if err := copyShallowBlocks(ctx, src, dst, tempFS, base, revisions, opts); err != nil {
+		return err
+	}
+	// Write the revisions oldest first.
+	for i := len(revisions) - 1; i >= 0; i-- {
+		revision, err := src.ReadRevision(ctx, revisions[i], buf)
+		if err != nil {
+			return WrapErrorf(err, "failed to read revision %s", revisions[i])
+		}
+		if base != nil && i == len(revisions)-1 {
+			revision.BlockIds, err = writeBaseRevisionEntries(ctx, &mirror, base, tempFS)
+			if err != nil {
+				return err
+			}
+		}
+		revision.ParentRevisionId = state.Head
+		if len(revision.BlockIds) == 0 {
+			// The snapshot of the oldest revision is empty.
+			state.SourceHead = revisions[i]
+			continue
+		}
+		mirrorId, err := mirror.WriteRevision(ctx, &revision)
+		if err != nil {
+			return WrapErrorf(err, "failed to write revision %s to dst", revisions[i])
+		}
+		state = shallowState{revisions[i], mirrorId}
+		if err := writeShallowState(ctx, dst, state); err != nil {
+			return err
+		}
+		opts.Monitor.OnCopyControlFile(ControlFileSectionRefs, "head")
+	}
+	if err := writeShallowState(ctx, dst, state); err != nil {
+		return err
+	}
+	return replicateShallowTags(ctx, src, &mirror, state, opts.Monitor)
+}
+
+// Copy the blocks of the files in `base` and the blocks of the entries and
+// files of `revisions` (except the oldest one if there is a `base`).
+func copyShallowBlocks(
+	ctx context.Context,
+	src *Repository,
+	dst Storage,
+	tempFS FS,
+	base *Temp[*RevisionEntry],
+	revisions []RevisionId,
+	opts ShallowReplicationOptions,
+) error {
+	neededFS, err := tempFS.MkSub("needed")
+	if err != nil {
+		return WrapErrorf(err, "failed to create temp directory for needed block ids")
+	}
+	writer := NewBlockIdTempWriter(neededFS)
+	add := func(blockIds []BlockId) error {
+		for _, blockId := range blockIds {
+			if err := writer.Add(blockId); err != nil {
+				return WrapErrorf(err, "failed to add block id %s", blockId)
+			}
+		}
+		return nil
+	}
+	buf := NewBlockBuf()
+	if base != nil {
+		reader := base.Reader(nil)
+		for {
+			entry, err := reader.Read(buf)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return WrapErrorf(err, "failed to read the snapshot of the oldest revision")
+			}
+			if err := add(entry.Metadata.BlockIds); err != nil {
+				return err
+			}
+		}
+		revisions = revisions[:len(revisions)-1]
+	}
+	for _, revisionId := range revisions {
+		revision, err := src.ReadRevision(ctx, revisionId, buf)
+		if err != nil {
+			return WrapErrorf(err, "failed to read revision %s", revisionId)
+		}
+		if err := add(revision.BlockIds); err != nil {
+			return err
+		}
+		reader := NewRevisionReader(src, &revision)
+		for {
+			entry, err := reader.Read(ctx, buf)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return WrapErrorf(err, "failed to read entries of revision %s", revisionId)
+			}
+			if err := add(entry.Metadata.BlockIds); err != nil {
+				return err
+			}
+		}
+	}
+	needed, err := writer.Finalize()
+	if err != nil {
+		return WrapErrorf(err, "failed to sort needed block ids")
+	}
+	defer needed.Remove() //nolint:errcheck
+	srcCount := 0
+	reader := needed.Reader(nil)
+	for {
+		if _, err := reader.Read(buf); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return WrapErrorf(err, "failed to read needed block id")
+		}
+		srcCount++
+	}
+	opts.Monitor.OnSrcBlockIdsRead(srcCount)
+	dstFS, err := tempFS.MkSub("dst")
+	if err != nil {
+		return WrapErrorf(err, "failed to create temp dir for dst block ids")
+	}
+	dstCount := 0
+	dstIds, err := ReadSortedBlockIds(ctx, dst, dstFS, func(BlockId) {
+		dstCount++
+		if dstCount%blockIdReadProgressEvery == 0 {
+			opts.Monitor.OnDstBlockIdsRead(dstCount)
+		}
+	})
+	if err != nil {
+		return WrapErrorf(err, "failed to snapshot dst block ids")
+	}
+	defer dstIds.Remove() //nolint:errcheck
+	opts.Monitor.OnDstBlockIdsRead(dstCount)
+	opts.Monitor.OnBeforeCopy(srcCount, dstCount)
+	return copyMissingBlocks(ctx, src.storage, dst, needed, dstIds,
+		ReplicationOptions{Monitor: opts.Monitor, Workers: opts.Workers})
+}
+
+// Write the entries of the snapshot `base` as additions to `mirror` and return
+// the block ids of the chunks.
+func writeBaseRevisionEntries(
+	ctx context.Context,
+	mirror *Repository,
+	base *Temp[*RevisionEntry],
+	tempFS FS,
+) ([]BlockId, error) {
+	addedFS, err := tempFS.MkSub("added")
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to create temp directory for the base revision")
+	}
+	writer := NewRevisionEntryTempWriter(addedFS, DefaultTempChunkSize)
+	reader := base.Reader(nil)
+	buf := NewBlockBuf()
+	for {
+		entry, err := reader.Read(buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to read the snapshot of the oldest revision")
+		}
+		entry.Kind = RevisionEntryKindAdd
+		entry.RenamedFrom = nil
+		if err := writer.Add(entry); err != nil {
+			return nil, WrapErrorf(err, "failed to add entry %s", entry.Path)
+		}
+	}
+	added, err := writer.Finalize()
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to sort the entries of the base revision")
+	}
+	defer added.Remove() //nolint:errcheck
+	return writeRevisionEntryChunks(ctx, mirror, added)
+}
+
+// Point every tag of `mirror` whose revision was replicated to the revision
+// in `mirror`. Only the tags of revisions that were written in this run
+// and of `state.SourceHead` can be mapped, older tags are left alone.
+func replicateShallowTags(
+	ctx context.Context,
+	src, mirror *Repository,
+	state shallowState,
+	monitor ReplicationMonitor,
+) error {
+	tags, err := src.Tags(ctx)
+	if err != nil {
+		return WrapErrorf(err, "failed to read src tags")
+	}
+	mapping, err := shallowRevisionMapping(ctx, src, mirror, state)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		mirrorId, ok := mapping[tag.RevisionId]
+		if !ok {
+			continue
+		}
+		existing, err := mirror.ReadTag(ctx, tag.Name)
+		if err == nil && existing == mirrorId {
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrTagNotFound) {
+			return WrapErrorf(err, "failed to read tag %s from dst", tag.Name)
+		}
+		if err := mirror.WriteTag(ctx, tag.Name, mirrorId, true); err != nil {
+			return WrapErrorf(err, "failed to write tag %s to dst", tag.Name)
+		}
+		monitor.OnCopyControlFile(ControlFileSectionRefs, tagRefPrefix+tag.Name)
+	}
+	return nil
+}
+
+// Map the revisions of `src` to the revisions of `mirror` by walking both
+// chains from `state` down to the oldest revision of `mirror`.
+func shallowRevisionMapping(
+	ctx context.Context,
+	src, mirror *Repository,
+	state shallowState,
+) (map[RevisionId]RevisionId, error) {
+	mapping := map[RevisionId]RevisionId{}
+	buf := NewBlockBuf()
+	srcId, mirrorId := state.SourceHead, state.Head
+	for !mirrorId.IsRoot() && !srcId.IsRoot() {
+		mapping[srcId] = mirrorId
+		mirrorRevision, err := mirror.ReadRevision(ctx, mirrorId, buf)
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to read dst revision %s", mirrorId)
+		}
+		srcRevision, err := src.ReadRevision(ctx, srcId, buf)
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to read src revision %s", srcId)
+		}
+		mirrorId, srcId = mirrorRevision.ParentRevisionId, srcRevision.ParentRevisionId
+	}
+	return mapping, nil
+}
+
+// Return the `shallowState` of `storage` and whether it is a shallow mirror.
+func readShallowState(ctx context.Context, storage Storage) (shallowState, bool, error) {
+	data, err := storage.ReadControlFile(ctx, ControlFileSectionConf, shallowStateFileName)
+	if errors.Is(err, ErrControlFileNotFound) {
+		return shallowState{}, false, nil
+	}
+	if err != nil {
+		return shallowState{}, false, WrapErrorf(err, "failed to read the shallow mirror state")
+	}
+	toml, err := ReadToml(bytes.NewReader(data))
+	if err != nil {
+		return shallowState{}, false, WrapErrorKindf(ErrCorrupt, err, "failed to parse the shallow mirror state")
+	}
+	var state shallowState
+	for key, id := range map[string]*RevisionId{"source-head": &state.SourceHead, "head": &state.Head} {
+		value, _ := toml.GetValue("shallow", key)
+		blockId, err := NewBlockIdFromString(value)
+		if err != nil {
+			return shallowState{}, false, WrapErrorKindf(ErrCorrupt, err,
+				"missing or invalid key `shallow.%s` in the shallow mirror state", key)
+		}
+		*id = RevisionId(blockId)
+	}
+	return state, true, nil
+}
+
+func writeShallowState(ctx context.Context, storage Storage, state shallowState) error {
+	var buf bytes.Buffer
+	if err := WriteToml(&buf, "", Toml{"shallow": {
+		"source-head": hex.EncodeToString(state.SourceHead[:]),
+		"head":        hex.EncodeToString(state.Head[:]),
+	}}); err != nil {
+		return WrapErrorf(err, "failed to encode the shallow mirror state")
+	}
+	if err := storage.WriteControlFile(ctx, ControlFileSectionConf, shallowStateFileName, buf.Bytes()); err != nil {
+		return WrapErrorf(err, "failed to write the shallow mirror state")
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+//nolint:exhaustruct
+package lib
+
+import (
+	"testing"
+)
+
+func TestReplicateShallow(t *testing.T) {
+	t.Parallel()
+
+	// a.txt is added in rev1 and deleted in rev2, b.txt is added in rev2,
+	// and c.txt in rev3.
+	setup := func(t *testing.T) (*TestRepository, []RevisionId, []BlockId) {
+		t.Helper()
+		assert := NewAssert(t)
+		src := td.NewTestRepository(t, td.NewFS(t))
+		entryA, blockA := testEntry(t, src, "a.txt", "abc")
+		rev1, err := testCommit(t, src.Repository, entryA)
+		assert.NoError(err)
+		deleteA := td.RevisionEntry("a.txt", RevisionEntryKindDelete)
+		entryB, blockB := testEntry(t, src, "b.txt", "de")
+		rev2, err := testCommit(t, src.Repository, deleteA, entryB)
+		assert.NoError(err)
+		entryC, blockC := testEntry(t, src, "c.txt", "fgh")
+		rev3, err := testCommit(t, src.Repository, entryC)
+		assert.NoError(err)
+		return src, []RevisionId{rev1, rev2, rev3}, []BlockId{blockA, blockB, blockC}
+	}
+	snapshotPaths := func(t *testing.T, r *TestRepository, revisionId RevisionId) []string {
+		t.Helper()
+		paths := []string{}
+		for _, entry := range readRevisionSnapshot(t, r.Repository, revisionId, nil) {
+			paths = append(paths, entry.Path.String())
+		}
+		return paths
+	}
+	replicate := func(t *testing.T, src *TestRepository, dst Storage, depth int) error {
+		t.Helper()
+		return ReplicateShallow(t.Context(), src.Repository, dst, td.NewFS(t),
+			ShallowReplicationOptions{Monitor: &TestReplicationMonitor{}, Workers: 2, Depth: depth})
+	}
+
+	t.Run("Only the latest revisions are copied", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		src, revisions, blockIds := setup(t)
+		assert.NoError(src.WriteTag(t.Context(), "v1", revisions[0], false))
+		assert.NoError(src.WriteTag(t.Context(), "v2", revisions[1], false))
+		dstFS := td.NewFS(t)
+		dst, err := NewFileStorage(dstFS, StoragePurposeRepository)
+		assert.NoError(err)
+
+		assert.NoError(replicate(t, src, dst, 2))
+		mirror := td.OpenRepository(t, dstFS)
+		chain, err := ReadRevisionChain(t.Context(), mirror.Repository)
+		assert.NoError(err)
+		assert.Equal(2, len(chain))
+		assert.Equal(snapshotPaths(t, src, revisions[2]), snapshotPaths(t, mirror, chain[0]))
+		assert.Equal(snapshotPaths(t, src, revisions[1]), snapshotPaths(t, mirror, chain[1]))
+		head, err := mirror.ReadRevision(t.Context(), chain[0], NewBlockBuf())
+		assert.NoError(err)
+		srcHead, err := src.ReadRevision(t.Context(), revisions[2], NewBlockBuf())
+		assert.NoError(err)
+		assert.Equal(srcHead.Timestamp, head.Timestamp)
+		for i, expected := range []bool{false, true, true} {
+			exists, err := dst.HasBlock(t.Context(), blockIds[i])
+			assert.NoError(err)
+			assert.Equal(expected, exists, "block %d", i)
+		}
+		tags, err := mirror.Tags(t.Context())
+		assert.NoError(err)
+		assert.Equal([]Tag{{"v2", chain[1]}}, tags)
+
+		// Later runs append the new revisions.
+		entryD, _ := testEntry(t, src, "d.txt", "ij")
+		rev4, err := testCommit(t, src.Repository, entryD)
+		assert.NoError(err)
+		assert.NoError(src.WriteTag(t.Context(), "v4", rev4, false))
+		assert.NoError(replicate(t, src, dst, 2))
+		chain, err = ReadRevisionChain(t.Context(), mirror.Repository)
+		assert.NoError(err)
+		assert.Equal(3, len(chain))
+		assert.Equal(snapshotPaths(t, src, rev4), snapshotPaths(t, mirror, chain[0]))
+		tags, err = mirror.Tags(t.Context())
+		assert.NoError(err)
+		assert.Equal([]Tag{{"v2", chain[2]}, {"v4", chain[0]}}, tags)
+
+		// Nothing to do.
+		assert.NoError(replicate(t, src, dst, 2))
+		assert.Equal(chain[0], mirror.Head())
+	})
+
+	t.Run("A shallow mirror cannot be replicated to", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		src, _, _ := setup(t)
+		dst, err := NewFileStorage(td.NewFS(t), StoragePurposeRepository)
+		assert.NoError(err)
+		assert.NoError(replicate(t, src, dst, 1))
+		err = Replicate(t.Context(), src.Storage, dst, td.NewFS(t),
+			ReplicationOptions{Monitor: &TestReplicationMonitor{}, Workers: 1})
+		assert.Error(err, "dst has commits of its own")
+	})
+
+	t.Run("Fails when dst has commits of its own", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		src, _, _ := setup(t)
+		dstFS := td.NewFS(t)
+		dst, err := NewFileStorage(dstFS, StoragePurposeRepository)
+		assert.NoError(err)
+		assert.NoError(replicate(t, src, dst, 1))
+		mirror := td.OpenRepository(t, dstFS)
+		entry, _ := testEntry(t, mirror, "x.txt", "x")
+		_, err = testCommit(t, mirror.Repository, entry)
+		assert.NoError(err)
+		assert.Error(replicate(t, src, dst, 1), "dst has commits of its own")
+	})
+
+	t.Run("A full mirror is rejected", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		src, _, _ := setup(t)
+		dst, err := NewFileStorage(td.NewFS(t), StoragePurposeRepository)
+		assert.NoError(err)
+		err = Replicate(t.Context(), src.Storage, dst, td.NewFS(t),
+			ReplicationOptions{Monitor: &TestReplicationMonitor{}, Workers: 1})
+		assert.NoError(err)
+		assert.Error(replicate(t, src, dst, 1), "dst is not empty and not a shallow mirror")
+	})
+}
@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"crypto/ed25519"
+	"strings"
+)
+
+// A signing key is an Ed25519 private key kept by a client, e.g. in its
+// workspace. All revisions the client writes are signed with it (see
+// `Repository.SetSigningKey`), so that anyone who trusts the matching signer
+// (the public key) can tell that a revision was written by that client.
+// Everybody with the repository keys can write revisions, without signatures
+// a revision cannot be attributed to anyone.
+//
+// Signing keys and signers are formatted like identities and recipients
+// (see `Identity`), the signing key holds the Ed25519 seed.
+const (
+	signingKeyPrefix = "CLING-SYNC-SIGNING-KEY-"
+	signerPrefix     = "cling-sync-signer-"
+)
+
+//nolint:gochecknoglobals
+var aadRevisionSignature = []byte("cling-sync/revision-signature")
+
+var (
+	ErrRevisionNotSigned = Errorf("revision is not signed")
+	ErrInvalidSignature  = WrapErrorKindf(ErrCorrupt, nil, "invalid revision signature")
+	ErrUntrustedSigner   = WrapErrorKindf(ErrCorrupt, nil, "revision is signed by an untrusted signer")
+)
+
+type Ed25519PublicKey [ed25519.PublicKeySize]byte
+
+type Ed25519Signature [ed25519.SignatureSize]byte
+
+// Return the signer as written by `ParseSigner`.
+func (k Ed25519PublicKey) String() string {
+	return formatRecipientKey(signerPrefix, k[:])
+}
+
+func ParseSigner(s string) (Ed25519PublicKey, error) {
+	data, err := parseRecipientKey(strings.TrimSpace(s), signerPrefix)
+	if err != nil {
+		return Ed25519PublicKey{}, WrapErrorf(err, "invalid signer %q", s)
+	}
+	return Ed25519PublicKey(data), nil
+}
+
+type SigningKey struct {
+	key ed25519.PrivateKey
+}
+
+func NewSigningKey() (*SigningKey, error) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to generate Ed25519 key")
+	}
+	return &SigningKey{key}, nil
+}
+
+// ParseSigningKey parses a signing key as written by `SigningKey.String`.
+// Empty lines and lines starting with `#` are ignored.
+func ParseSigningKey(s string) (*SigningKey, error) {
+	var line string
+	for l := range strings.Lines(s) {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if line != "" {
+			return nil, Errorf("invalid signing key, expected a single line starting with %s", signingKeyPrefix)
+		}
+		line = l
+	}
+	seed, err := parseRecipientKey(line, signingKeyPrefix)
+	if err != nil {
+		return nil, WrapErrorf(err, "invalid signing key")
+	}
+	defer clear(seed)
+	return &SigningKey{ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+func (k *SigningKey) String() string {
+	return formatRecipientKey(signingKeyPrefix, k.key.Seed())
+}
+
+// Signer returns the public key that verifies the signatures of `k`.
+func (k *SigningKey) Signer() Ed25519PublicKey {
+	return Ed25519PublicKey(k.key.Public().(ed25519.PublicKey)) //nolint:forcetypeassert
+}
+
+// SignRevision sets `revision.Signature` to the signature of `key` over the
+// marshalled revision without the signature. The revision must not be
+// changed afterwards.
+func SignRevision(revision *Revision, key *SigningKey) error {
+	data, err := revisionSigningData(revision)
+	if err != nil {
+		return err
+	}
+	revision.Signature = &RevisionSignature{
+		PublicKey: key.Signer(),
+		Signature: Ed25519Signature(ed25519.Sign(key.key, data)),
+	}
+	return nil
+}
+
+// VerifyRevisionSignature returns the signer of `revision`.
+// Return `ErrRevisionNotSigned` if the revision has no signature and
+// `ErrInvalidSignature` if the signature does not match the revision.
+// Whether the signer can be trusted is up to the caller.
+func VerifyRevisionSignature(revision *Revision) (Ed25519PublicKey, error) {
+	if revision.Signature == nil {
+		return Ed25519PublicKey{}, ErrRevisionNotSigned
+	}
+	data, err := revisionSigningData(revision)
+	if err != nil {
+		return Ed25519PublicKey{}, err
+	}
+	signer := revision.Signature.PublicKey
+	if !ed25519.Verify(signer[:], data, revision.Signature.Signature[:]) {
+		return signer, WrapErrorf(ErrInvalidSignature, "signature of %s does not match the revision", signer)
+	}
+	return signer, nil
+}
+
+// The signature covers the revision without its signature, prefixed with
+// `aadRevisionSignature`.
+func revisionSigningData(revision *Revision) ([]byte, error) {
+	unsigned := *revision
+	unsigned.Signature = nil
+	w := NewProtobufWriter(make([]byte, unsigned.MarshallSize()))
+	if err := unsigned.Marshall(w); err != nil {
+		return nil, WrapErrorf(err, "failed to marshal revision")
+	}
+	data := make([]byte, 0, len(aadRevisionSignature)+len(w.Bytes()))
+	data = append(data, aadRevisionSignature...)
+	return append(data, w.Bytes()...), nil
+}
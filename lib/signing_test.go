@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestSigning(t *testing.T) {
+	t.Parallel()
+	t.Run("Keys and signers round-trip", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		key, err := NewSigningKey()
+		assert.NoError(err)
+		parsed, err := ParseSigningKey("# a comment\n" + key.String() + "\n")
+		assert.NoError(err)
+		assert.Equal(key.Signer(), parsed.Signer())
+		signer, err := ParseSigner(key.Signer().String())
+		assert.NoError(err)
+		assert.Equal(key.Signer(), signer)
+
+		_, err = ParseSigner(key.String())
+		assert.Error(err, "invalid signer")
+		s := []byte(key.Signer().String())
+		i := len(s) - 10
+		if s[i] == 'a' {
+			s[i] = 'b'
+		} else {
+			s[i] = 'a'
+		}
+		_, err = ParseSigner(string(s))
+		assert.Error(err, "invalid signer")
+	})
+
+	t.Run("Revisions are signed by the repository", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		entry, _ := testEntry(t, r, "a.txt", "abc")
+		unsignedId, err := testCommit(t, r.Repository, entry)
+		assert.NoError(err)
+		key, err := NewSigningKey()
+		assert.NoError(err)
+		r.SetSigningKey(key)
+		entry, _ = testEntry(t, r, "b.txt", "def")
+		signedId, err := testCommit(t, r.Repository, entry)
+		assert.NoError(err)
+
+		unsigned, err := r.ReadRevision(t.Context(), unsignedId, NewBlockBuf())
+		assert.NoError(err)
+		_, err = VerifyRevisionSignature(&unsigned)
+		assert.ErrorIs(err, ErrRevisionNotSigned)
+		signed, err := r.ReadRevision(t.Context(), signedId, NewBlockBuf())
+		assert.NoError(err)
+		signer, err := VerifyRevisionSignature(&signed)
+		assert.NoError(err)
+		assert.Equal(key.Signer(), signer)
+
+		message := "tampered"
+		signed.Message = &message
+		_, err = VerifyRevisionSignature(&signed)
+		assert.ErrorIs(err, ErrInvalidSignature)
+		assert.ErrorIs(err, ErrCorrupt)
+	})
+
+	t.Run("Check verifies the signatures", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		key, err := NewSigningKey()
+		assert.NoError(err)
+		r.SetSigningKey(key)
+		entry, _ := testEntry(t, r, "a.txt", "abc")
+		head, err := testCommit(t, r.Repository, entry)
+		assert.NoError(err)
+		check := func(trusted ...Ed25519PublicKey) error {
+			return CheckHealth(t.Context(), r.Repository, td.NewFS(t), HealthCheckOptions{ //nolint:exhaustruct
+				Monitor:        td.NewHealthCheckMonitor(),
+				TrustedSigners: trusted,
+			})
+		}
+		assert.NoError(check())
+		assert.NoError(check(key.Signer()))
+		other, err := NewSigningKey()
+		assert.NoError(err)
+		assert.ErrorIs(check(other.Signer()), ErrUntrustedSigner)
+
+		// Replace the head with a revision whose signature does not match.
+		revision, err := r.ReadRevision(t.Context(), head, NewBlockBuf())
+		assert.NoError(err)
+		message := "tampered"
+		revision.Message = &message
+		w := NewProtobufWriter(make([]byte, revision.MarshallSize()))
+		assert.NoError(revision.Marshall(w))
+		tampered, _, err := r.WriteBlock(t.Context(), w.Bytes(), NewBlockBuf())
+		assert.NoError(err)
+		assert.NoError(WriteRef(t.Context(), r.Storage, "head", RevisionId(tampered)))
+		assert.ErrorIs(check(), ErrInvalidSignature)
+	})
+}
@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"io"
+)
+
+// Zeros in a hole are left out in pieces of this size (aligned to the
+// offset), the usual block size of file systems.
+const sparseBlockSize = 4096
+
+// The methods of `*os.File` that are needed to recreate holes.
+type sparseFile interface {
+	io.WriteCloser
+	io.Seeker
+	Truncate(size int64) error
+}
+
+type sparseWriter struct {
+	f sparseFile
+	// The holes that do not end before `offset`.
+	holes []*Hole
+	// The offset of the next byte written to the writer.
+	offset int64
+	// The offset of the next byte written to the file, it lags behind
+	// `offset` in a hole.
+	fileOffset int64
+}
+
+// Return a writer that writes to `w` but leaves out the `holes` (see
+// `PathMetadata.Holes`), so that they become holes of the file again.
+// Only zeros are left out, the blocks of a hole that are not zero are
+// written anyway, so that a wrong list of holes cannot change the content.
+// Return `w` if there are no holes or `w` cannot create holes, i.e. it
+// cannot seek and truncate like `*os.File`.
+func NewSparseWriter(w io.WriteCloser, holes []*Hole) io.WriteCloser {
+	f, ok := w.(sparseFile)
+	if !ok || len(holes) == 0 {
+		return w
+	}
+	return &sparseWriter{f, holes, 0, 0}
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		for len(w.holes) > 0 && w.holes[0].Offset+w.holes[0].Size <= w.offset {
+			w.holes = w.holes[1:]
+		}
+		chunk := p[n:]
+		skip := false
+		if len(w.holes) > 0 {
+			hole := w.holes[0]
+			if hole.Offset > w.offset {
+				chunk = chunk[:min(int64(len(chunk)), hole.Offset-w.offset)]
+			} else {
+				end := min(hole.Offset+hole.Size, (w.offset/sparseBlockSize+1)*sparseBlockSize)
+				chunk = chunk[:min(int64(len(chunk)), end-w.offset)]
+				skip = isZero(chunk)
+			}
+		}
+		if !skip {
+			if w.fileOffset != w.offset {
+				if _, err := w.f.Seek(w.offset, io.SeekStart); err != nil {
+					return n, err //nolint:wrapcheck
+				}
+			}
+			written, err := w.f.Write(chunk)
+			w.fileOffset = w.offset + int64(written)
+			if err != nil {
+				return n + written, err //nolint:wrapcheck
+			}
+		}
+		n += len(chunk)
+		w.offset += int64(len(chunk))
+	}
+	return n, nil
+}
+
+func (w *sparseWriter) Close() error {
+	if w.fileOffset < w.offset {
+		// The file ends with a hole.
+		if err := w.f.Truncate(w.offset); err != nil {
+			_ = w.f.Close()
+			return err //nolint:wrapcheck
+		}
+		w.fileOffset = w.offset
+	}
+	return w.f.Close() //nolint:wrapcheck
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSparseWriter(t *testing.T) {
+	t.Parallel()
+	// Holes are allocated in blocks of the file system, so the data and the
+	// holes are multiples of 64 KiB.
+	const k = 64 * 1024
+	newData := func(t *testing.T, holes ...*Hole) []byte {
+		t.Helper()
+		data, err := Rand(8 * k)
+		NewAssert(t).NoError(err)
+		for _, hole := range holes {
+			clear(data[hole.Offset : hole.Offset+hole.Size])
+		}
+		return data
+	}
+
+	t.Run("Happy path", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := td.NewTestFS(t, td.NewRealFS(t))
+		holes := []*Hole{{k, 2 * k}, {4 * k, k}, {6 * k, 2 * k}}
+		data := newData(t, holes...)
+
+		w, err := sut.FS.OpenWrite("a.img")
+		assert.NoError(err)
+		w = NewSparseWriter(w, holes)
+		// Write in pieces that do not line up with the holes.
+		for i := 0; i < len(data); i += 1000 {
+			_, err := w.Write(data[i:min(i+1000, len(data))])
+			assert.NoError(err)
+		}
+		assert.NoError(w.Close())
+		assert.Equal(data, []byte(sut.Cat("a.img")))
+		assert.Equal(holes, sut.Holes("a.img"))
+	})
+
+	t.Run("Data in a hole that is not zero is written", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := td.NewTestFS(t, td.NewRealFS(t))
+		data := newData(t, &Hole{k, 3 * k})
+		data[2*k+1] = 1
+
+		sut.WriteSparse("a.img", data, &Hole{k, 3 * k}, &Hole{7 * k, 10 * k})
+		assert.Equal(data, []byte(sut.Cat("a.img")))
+		assert.Equal([]*Hole{{k, k}, {2*k + sparseBlockSize, 2*k - sparseBlockSize}}, sut.Holes("a.img"))
+	})
+
+	t.Run("Files without holes", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := td.NewTestFS(t, td.NewRealFS(t))
+		data := newData(t)
+		sut.WriteSparse("a.img", data)
+		assert.Equal(0, len(sut.Holes("a.img")))
+		sut.Mkdir("dir")
+		assert.Equal(0, len(sut.Holes("dir")))
+	})
+
+	t.Run("Writers that cannot seek write the holes", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := td.NewTestFS(t, NewMemoryFS(10_000_000))
+		data := newData(t, &Hole{k, k})
+		sut.WriteSparse("a.img", data, &Hole{k, k})
+		assert.Equal(true, bytes.Equal(data, []byte(sut.Cat("a.img"))))
+		assert.Equal(0, len(sut.Holes("a.img")))
+	})
+}
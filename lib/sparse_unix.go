@@ -0,0 +1,79 @@
+//go:build darwin || linux
+
+//nolint:forbidigo
+package lib
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Return false if the file of `fileInfo` has no holes, i.e. it is not a
+// regular file or it uses at least as many blocks as its size. Then there is
+// no need to ask `FS.Holes`, which is true for the vast majority of files.
+func MayHaveHoles(fileInfo fs.FileInfo) bool {
+	if !fileInfo.Mode().IsRegular() {
+		return false
+	}
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+	return stat.Blocks*512 < stat.Size
+}
+
+// Read the holes of `path` with `SEEK_HOLE` and `SEEK_DATA`. Only regular
+// files that use fewer blocks than their size are opened, the others have
+// no holes. Symlinks are not followed.
+func readHoles(path string) ([]*Hole, error) {
+	var stat unix.Stat_t
+	if err := unix.Lstat(path, &stat); err != nil {
+		return nil, WrapErrorf(err, "failed to stat %s", path)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFREG || stat.Blocks*512 >= stat.Size {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, translateErrIsSymlink("open", path, err)
+	}
+	defer f.Close() //nolint:errcheck
+	info, err := f.Stat()
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to stat %s", path)
+	}
+	size := info.Size()
+	var holes []*Hole
+	for offset := int64(0); offset < size; {
+		start, err := f.Seek(offset, unix.SEEK_HOLE)
+		if errors.Is(err, unix.ENXIO) {
+			// The file was truncated in the meantime.
+			break
+		}
+		if errors.Is(err, unix.EINVAL) {
+			// The file system does not support `SEEK_HOLE`.
+			return nil, nil
+		}
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to find the holes of %s", path)
+		}
+		if start >= size {
+			break
+		}
+		end, err := f.Seek(start, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// The file ends with the hole.
+			end = size
+		} else if err != nil {
+			return nil, WrapErrorf(err, "failed to find the holes of %s", path)
+		}
+		end = min(end, size)
+		holes = append(holes, &Hole{start, end - start})
+		offset = end
+	}
+	return holes, nil
+}
@@ -0,0 +1,157 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+)
+
+// BlockSizer is implemented by storages that can tell the stored size of a
+// block without reading it.
+type BlockSizer interface {
+	// Return `ErrBlockNotFound` if the block does not exist.
+	BlockSize(ctx context.Context, blockId BlockId) (int64, error)
+}
+
+type RevisionStats struct {
+	RevisionId RevisionId
+	// Number of files added or updated by the revision.
+	Files int
+	// Sum of the sizes of the files added or updated by the revision.
+	LogicalSize int64
+	// Number of block references of the files added or updated by the
+	// revision.
+	ReferencedBlocks int
+	// Number of blocks that were referenced for the first time.
+	NewBlocks int
+	// The stored (compressed and encrypted) size of the new blocks, or -1 if
+	// the storage cannot tell (see `BlockSizer`).
+	NewStoredSize int64
+}
+
+type FileStats struct {
+	RevisionId RevisionId
+	Path       Path
+	Size       int64
+}
+
+type Stats struct {
+	// Head first.
+	Revisions []RevisionStats
+	// Sum of `RevisionStats.LogicalSize`, i.e. the size of all file versions
+	// without deduplication.
+	LogicalSize      int64
+	ReferencedBlocks int
+	UniqueBlocks     int
+	// The stored size of all unique blocks, or -1 if the storage cannot tell.
+	StoredSize int64
+	// The largest file versions of all revisions, largest first.
+	LargestFiles []FileStats
+}
+
+// Return the number of block references per unique block.
+func (s *Stats) DedupRatio() float64 {
+	if s.UniqueBlocks == 0 {
+		return 1
+	}
+	return float64(s.ReferencedBlocks) / float64(s.UniqueBlocks)
+}
+
+type StatsOptions struct {
+	// The number of `Stats.LargestFiles` to return.
+	LargestFiles int
+}
+
+// ComputeStats walks the metadata of all revisions and collects size and
+// deduplication statistics. No file data is read. Only the revision entries
+// are counted, not the blocks that store the revisions themselves.
+func ComputeStats(ctx context.Context, repository *Repository, opts StatsOptions) (*Stats, error) { //nolint:funlen
+	chain, err := ReadRevisionChain(ctx, repository)
+	if err != nil {
+		return nil, err
+	}
+	sizer, canSize := repository.storage.(BlockSizer)
+	stats := &Stats{Revisions: make([]RevisionStats, len(chain)), StoredSize: 0}
+	if !canSize {
+		stats.StoredSize = -1
+	}
+	seen := map[BlockId]struct{}{}
+	blockBuf := NewBlockBuf()
+	// Walk from the root, so that a block is new in the first revision that
+	// references it.
+	for i, revisionId := range slices.Backward(chain) {
+		rs := RevisionStats{RevisionId: revisionId, NewStoredSize: 0} //nolint:exhaustruct
+		if !canSize {
+			rs.NewStoredSize = -1
+		}
+		revision, err := repository.ReadRevision(ctx, revisionId, blockBuf)
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to read revision %s", revisionId)
+		}
+		reader := NewRevisionReader(repository, &revision)
+		for {
+			entry, err := reader.Read(ctx, blockBuf)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, WrapErrorf(err, "failed to read revision entry of revision %s", revisionId)
+			}
+			if entry.Kind == RevisionEntryKindDelete || !entry.Metadata.FileMode.IsRegular() {
+				continue
+			}
+			rs.Files++
+			rs.LogicalSize += entry.Metadata.Size
+			rs.ReferencedBlocks += len(entry.Metadata.BlockIds)
+			stats.LargestFiles = addLargestFile(
+				stats.LargestFiles,
+				FileStats{revisionId, entry.Path, entry.Metadata.Size},
+				opts.LargestFiles,
+			)
+			for _, blockId := range entry.Metadata.BlockIds {
+				if _, ok := seen[blockId]; ok {
+					continue
+				}
+				seen[blockId] = struct{}{}
+				rs.NewBlocks++
+				if !canSize {
+					continue
+				}
+				size, err := sizer.BlockSize(ctx, blockId)
+				if err != nil {
+					return nil, WrapErrorf(err, "failed to get size of block %s of %s", blockId, entry.Path)
+				}
+				rs.NewStoredSize += size
+			}
+		}
+		stats.Revisions[i] = rs
+		stats.LogicalSize += rs.LogicalSize
+		stats.ReferencedBlocks += rs.ReferencedBlocks
+		stats.UniqueBlocks += rs.NewBlocks
+		if canSize {
+			stats.StoredSize += rs.NewStoredSize
+		}
+	}
+	return stats, nil
+}
+
+// Insert `file` into `largest` (sorted by size, largest first) and keep at
+// most `n` files.
+func addLargestFile(largest []FileStats, file FileStats, n int) []FileStats {
+	if n <= 0 || (len(largest) == n && largest[n-1].Size >= file.Size) {
+		return largest
+	}
+	i, _ := slices.BinarySearchFunc(largest, file.Size, func(f FileStats, size int64) int {
+		// Sort descending, equal sizes keep their order.
+		if f.Size >= size {
+			return -1
+		}
+		return 1
+	})
+	largest = slices.Insert(largest, i, file)
+	if len(largest) > n {
+		largest = largest[:n]
+	}
+	return largest
+}
@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestComputeStats(t *testing.T) {
+	t.Parallel()
+	assert := NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	blockIdA, _, err := r.WriteBlock(t.Context(), []byte("aaa"), NewBlockBuf())
+	assert.NoError(err)
+	blockIdB, _, err := r.WriteBlock(t.Context(), []byte("bb"), NewBlockBuf())
+	assert.NoError(err)
+	blockSize := func(blockId BlockId) int64 {
+		size, err := r.Storage.BlockSize(t.Context(), blockId)
+		assert.NoError(err)
+		return size
+	}
+	commit := func(entries ...*RevisionEntry) RevisionId {
+		c, err := NewCommit(t.Context(), r.Repository, td.NewFS(t))
+		assert.NoError(err)
+		for _, entry := range entries {
+			assert.NoError(c.Add(entry))
+		}
+		revisionId, err := c.Commit(t.Context(), td.CommitInfo())
+		assert.NoError(err)
+		return revisionId
+	}
+	file := func(path string, kind RevisionEntryKind, size int64, blockIds ...BlockId) *RevisionEntry {
+		entry := td.RevisionEntry(path, kind)
+		entry.Metadata.Size = size
+		entry.Metadata.BlockIds = blockIds
+		return entry
+	}
+
+	rev1 := commit(
+		file("a.txt", RevisionEntryKindAdd, 3, blockIdA),
+		file("ab.txt", RevisionEntryKindAdd, 5, blockIdA, blockIdB),
+		td.RevisionEntryExt("dir", RevisionEntryKindAdd, 0o700|FileModeDir, ""),
+	)
+	// The copy only references existing blocks, deletes are not counted.
+	rev2 := commit(
+		file("a.txt", RevisionEntryKindDelete, 3, blockIdA),
+		file("copy.txt", RevisionEntryKindAdd, 5, blockIdA, blockIdB),
+	)
+
+	sut, err := ComputeStats(t.Context(), r.Repository, StatsOptions{LargestFiles: 2})
+	assert.NoError(err)
+	assert.Equal([]RevisionStats{
+		{rev2, 1, 5, 2, 0, 0},
+		{rev1, 2, 8, 3, 2, blockSize(blockIdA) + blockSize(blockIdB)},
+	}, sut.Revisions)
+	assert.Equal(int64(13), sut.LogicalSize)
+	assert.Equal(5, sut.ReferencedBlocks)
+	assert.Equal(2, sut.UniqueBlocks)
+	assert.Equal(blockSize(blockIdA)+blockSize(blockIdB), sut.StoredSize)
+	assert.Equal(2.5, sut.DedupRatio())
+	assert.Equal([]FileStats{
+		{rev1, td.Path("ab.txt"), 5},
+		{rev2, td.Path("copy.txt"), 5},
+	}, sut.LargestFiles)
+}
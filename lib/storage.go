@@ -8,7 +8,10 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"log/slog"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -19,6 +22,13 @@ const (
 	ControlFileSectionRefs     ControlFileSection = "refs"
 	ControlFileSectionSecurity ControlFileSection = "security"
 	ControlFileSectionConf     ControlFileSection = "conf"
+	// Corrupt blocks quarantined by `CheckHealth` in repair mode, see
+	// `quarantine`.
+	ControlFileSectionLostFound ControlFileSection = "lost-found"
+	// The indexes of the packs of a `FileStorage`, see `PackBlocks`.
+	ControlFileSectionPacks ControlFileSection = "packs"
+	// The file index of a repository, see `Repository.WriteFileIndex`.
+	ControlFileSectionFiles ControlFileSection = "files"
 )
 
 type StoragePurpose string
@@ -151,7 +161,14 @@ var (
 	ErrStorageAlreadyExists = Errorf("storage already exists")
 	ErrBlockNotFound        = Errorf("block not found")
 	ErrControlFileNotFound  = Errorf("control file not found")
+	ErrControlFileChanged   = WrapErrorKindf(ErrContention, nil, "control file changed concurrently")
 	ErrLockNotFound         = Errorf("lock not found")
+	// The storage refuses to store more blocks, e.g. because the quota of a
+	// `cling-sync serve` server is exceeded.
+	ErrQuotaExceeded = Errorf("repository quota exceeded")
+	// The lock was released or taken over by someone else while it was held,
+	// e.g. by `ForceUnlock`. The operation must be aborted.
+	ErrLockLost = WrapErrorKindf(ErrContention, nil, "lock lost")
 )
 
 // LockExistsError is returned by `Storage.Lock` when the lock is already
@@ -165,14 +182,75 @@ type LockExistsError struct {
 	CreatedAt time.Time
 }
 
+// The lock being held is contention, see `ErrContention`.
+func (e *LockExistsError) Is(target error) bool {
+	return target == ErrContention //nolint:errorlint
+}
+
 func (e *LockExistsError) Error() string {
 	return fmt.Sprintf("lock %q held by %s pid %d (owner %s, created %s)",
 		e.Name, e.Host, e.Pid, e.Owner, e.CreatedAt.Format(time.RFC3339))
 }
 
+// LockRetry says how `LockWithRetry` waits for a lock that is held by
+// someone else.
+type LockRetry struct {
+	// The number of attempts, 1 (or less) means no retries.
+	Attempts int
+	// The wait before the second attempt. It is doubled after every attempt
+	// up to `MaxBackoff`.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Retry for about 30 seconds.
+func DefaultLockRetry() LockRetry {
+	return LockRetry{10, 250 * time.Millisecond, 5 * time.Second}
+}
+
+// LockWithRetry acquires the lock `name` like `Storage.Lock`, but retries
+// while it is held by someone else (`*LockExistsError`). Return the last
+// `*LockExistsError` if all attempts fail.
+func LockWithRetry(ctx context.Context, storage Storage, name string, retry LockRetry) (func() error, error) {
+	backoff := retry.Backoff
+	for attempt := 1; ; attempt++ {
+		unlock, err := storage.Lock(ctx, name)
+		var lockExists *LockExistsError
+		if !errors.As(err, &lockExists) || attempt >= retry.Attempts {
+			return unlock, err //nolint:wrapcheck
+		}
+		slog.Debug(
+			"Waiting for lock",
+			"name", name,
+			"host", lockExists.Host,
+			"pid", lockExists.Pid,
+			"attempt", attempt,
+			"backoff", backoff,
+		)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, WrapErrorf(ctx.Err(), "failed to acquire lock %s", name)
+		}
+		backoff = min(backoff*2, retry.MaxBackoff)
+	}
+}
+
+// LockInfo describes a held lock. Fields unknown to the storage are empty.
+type LockInfo struct {
+	Name      string
+	Owner     string
+	Host      string
+	Pid       int
+	CreatedAt time.Time
+}
+
 type Storage interface {
 	Init(ctx context.Context, config Toml, headerComment string) error
 	Open(ctx context.Context) (Toml, error)
+	// Overwrite the config written by `Init` (or write it again if it was
+	// lost). Return `ErrStorageNotFound` if the storage was never initialized.
+	WriteConfig(ctx context.Context, config Toml, headerComment string) error
 	HasBlock(ctx context.Context, blockId BlockId) (bool, error)
 
 	// Stream all block ids present in storage. `yield` returns false to stop early.
@@ -191,32 +269,64 @@ type Storage interface {
 	WriteControlFile(ctx context.Context, section ControlFileSection, name string, data []byte) error
 	HasControlFile(ctx context.Context, section ControlFileSection, name string) (bool, error)
 
+	// Write the control file only if its current content is `expected`. A nil
+	// `expected` means that the control file must not exist yet.
+	// This is atomic with respect to other calls of `CompareAndSwapControlFile`
+	// (but not to `WriteControlFile`).
+	// Return `ErrControlFileChanged` if the current content does not match.
+	CompareAndSwapControlFile(
+		ctx context.Context,
+		section ControlFileSection,
+		name string,
+		expected, data []byte,
+	) error
+
 	// Return `ErrControlFileNotFound` if the control file does not exist.
 	DeleteControlFile(ctx context.Context, section ControlFileSection, name string) error
 
+	// Return the sorted names of all control files in `section`.
+	ListControlFiles(ctx context.Context, section ControlFileSection) ([]string, error)
+
 	// Create a lock file in `.cling/<purpose>/locks/<name>`. Returns
 	// `*LockExistsError` if the lock is already held by another acquirer.
+	// Writes return `ErrLockLost` once the storage detects that a held lock
+	// is gone.
 	Lock(ctx context.Context, name string) (func() error, error)
 
+	// Return all locks that are held right now, sorted by name.
+	ListLocks(ctx context.Context) ([]LockInfo, error)
+
 	// Forcefully drop a lock regardless of ownership. The caller is responsible
 	// for being sure the previous holder is dead. Returns `ErrLockNotFound` if
 	// there is nothing to release.
 	ForceUnlock(ctx context.Context, name string) error
 }
 
+// Leftovers of interrupted `AtomicWriteFile` calls are only removed once
+// they are older than this, because a younger one might still be written
+// by a concurrent process. The same interval limits how often `Open` looks
+// for them.
+const StaleTempFileAge = time.Hour
+
 type FileStorage struct {
 	FS      FS
 	Purpose StoragePurpose
+	// Stale temporary files removed by the last call to `Open`.
+	RemovedTempFiles []string
+	packs            *packIndex
 }
 
 func NewFileStorage(fs FS, purpose StoragePurpose) (*FileStorage, error) {
-	return &FileStorage{FS: fs, Purpose: purpose}, nil
+	return &FileStorage{FS: fs, Purpose: purpose, RemovedTempFiles: nil, packs: newPackIndex()}, nil
 }
 
 // FileStorage operates on a local FS, so most operations are fast and do not
 // observe `ctx`. `ReadBlockIds` is the exception: it can walk a large tree, so
 // it honors cancellation.
-var _ Storage = (*FileStorage)(nil)
+var (
+	_ Storage    = (*FileStorage)(nil)
+	_ BlockSizer = (*FileStorage)(nil)
+)
 
 func (s *FileStorage) Init(_ context.Context, config Toml, headerComment string) error {
 	stat, err := s.FS.Stat(".")
@@ -268,7 +378,12 @@ func (s *FileStorage) Init(_ context.Context, config Toml, headerComment string)
 	return nil
 }
 
-func (s *FileStorage) Open(_ context.Context) (Toml, error) {
+// Open also removes stale leftovers of interrupted writes of the config and
+// the control files at most once per `StaleTempFileAge`. The blocks are left
+// alone, walking them is expensive, see `RemoveStaleTempFiles`. The cleanup
+// is best-effort, failures don't fail `Open`. The removed files are
+// available in `RemovedTempFiles`.
+func (s *FileStorage) Open(ctx context.Context) (Toml, error) {
 	f, err := s.FS.OpenRead(s.configFilePath())
 	if errors.Is(err, fs.ErrNotExist) {
 		return nil, ErrStorageNotFound
@@ -281,22 +396,254 @@ func (s *FileStorage) Open(_ context.Context) (Toml, error) {
 	if err != nil {
 		return nil, WrapErrorf(err, "failed to read config file %s", s.configFilePath())
 	}
+	s.RemovedTempFiles = s.removeStaleTempFilesIfDue(ctx)
 	return toml, nil
 }
 
-func (s *FileStorage) HasBlock(_ context.Context, blockId BlockId) (bool, error) {
+func (s *FileStorage) WriteConfig(_ context.Context, config Toml, headerComment string) error {
+	purposeDir := filepath.Join(".cling", string(s.Purpose))
+	if _, err := s.FS.Stat(purposeDir); errors.Is(err, fs.ErrNotExist) {
+		return ErrStorageNotFound
+	} else if err != nil {
+		return WrapErrorf(err, "failed to stat %s", purposeDir)
+	}
+	var buf bytes.Buffer
+	if err := WriteToml(&buf, headerComment, config); err != nil {
+		return WrapErrorf(err, "failed to marshal config")
+	}
+	if err := AtomicWriteFile(s.FS, s.configFilePath(), 0o600, buf.Bytes()); err != nil {
+		return WrapErrorf(err, "failed to write config file %s", s.configFilePath())
+	}
+	return nil
+}
+
+// RemoveStaleTempFiles removes all leftovers of interrupted `AtomicWriteFile`
+// calls in the storage that were last modified before `olderThan`. This
+// walks all blocks of the storage, `check --repair` runs it.
+// Return the paths of the removed files.
+func (s *FileStorage) RemoveStaleTempFiles(ctx context.Context, olderThan time.Time) ([]string, error) {
+	return s.removeStaleTempFiles(ctx, olderThan, true)
+}
+
+// Same as `RemoveStaleTempFiles`, but the directory of the blocks is only
+// walked if `withBlocks` is set.
+func (s *FileStorage) removeStaleTempFiles( //nolint:funlen
+	ctx context.Context,
+	olderThan time.Time,
+	withBlocks bool,
+) ([]string, error) {
+	removed := []string{}
+	isStale := func(path string) (bool, error) {
+		if !IsAtomicWriteTempFile(path) {
+			return false, nil
+		}
+		stat, err := s.FS.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Someone else finished (or removed) the write in the meantime.
+			return false, nil
+		}
+		if err != nil {
+			return false, WrapErrorf(err, "failed to stat %s", path)
+		}
+		return !stat.IsDir() && stat.ModTime().Before(olderThan), nil
+	}
+	remove := func(path string) error {
+		if err := s.FS.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return WrapErrorf(err, "failed to remove stale temporary file %s", path)
+		}
+		removed = append(removed, path)
+		return nil
+	}
+	// The config file lives directly in `.cling`, next to the config files of
+	// other purposes, so only look at the temporary files of our own.
+	configTmpPrefix := ".cling_sync_tmp_" + filepath.Base(s.configFilePath()) + "."
+	entries, err := s.FS.ReadDir(".cling")
+	if err != nil {
+		return removed, WrapErrorf(err, "failed to read directory .cling")
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), configTmpPrefix) {
+			continue
+		}
+		path := filepath.Join(".cling", entry.Name())
+		if stale, err := isStale(path); err != nil {
+			return removed, err
+		} else if stale {
+			if err := remove(path); err != nil {
+				return removed, err
+			}
+		}
+	}
+	purposeDir := filepath.Join(".cling", string(s.Purpose))
+	objectsDir := filepath.Join(purposeDir, "objects")
+	err = s.FS.WalkDir(purposeDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return WrapErrorf(ctxErr, "removing stale temporary files canceled")
+		}
+		if !withBlocks && d.IsDir() && path == objectsDir {
+			return fs.SkipDir
+		}
+		stale, err := isStale(path)
+		if err != nil {
+			return err
+		}
+		if !stale {
+			return nil
+		}
+		return remove(path)
+	})
+	if err != nil {
+		return removed, WrapErrorf(err, "failed to remove stale temporary files in %s", purposeDir)
+	}
+	return removed, nil
+}
+
+// Remove the stale temporary files of the config and the control files
+// unless that already happened within the last `StaleTempFileAge`. The
+// modification time of the empty file `.cling/<purpose>/temp-cleanup`
+// records the last run. It is written first, so that a storage that cannot
+// be written to, e.g. on read-only media, is not searched on every `Open`.
+func (s *FileStorage) removeStaleTempFilesIfDue(ctx context.Context) []string {
+	markerPath := filepath.Join(".cling", string(s.Purpose), "temp-cleanup")
+	now := time.Now()
+	if stat, err := s.FS.Stat(markerPath); err == nil {
+		if last := stat.ModTime(); now.Sub(last) < StaleTempFileAge && !last.After(now) {
+			return nil
+		}
+	}
+	if err := WriteFile(s.FS, markerPath, nil); err != nil {
+		return nil
+	}
+	_ = s.FS.Chmtime(markerPath, now)
+	removed, _ := s.removeStaleTempFiles(ctx, now.Add(-StaleTempFileAge), false)
+	return removed
+}
+
+func (s *FileStorage) HasBlock(ctx context.Context, blockId BlockId) (bool, error) {
 	p := s.blockPath(blockId)
 	_, err := s.FS.Stat(p)
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
-			return false, nil
+			_, _, found, err := s.findPacked(ctx, blockId, false)
+			return found, err
 		}
 		return false, WrapErrorf(err, "failed to stat block file %s", p)
 	}
 	return true, nil
 }
 
+func (s *FileStorage) BlockSize(ctx context.Context, blockId BlockId) (int64, error) {
+	p := s.blockPath(blockId)
+	stat, err := s.FS.Stat(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			entry, _, found, err := s.findPacked(ctx, blockId, true)
+			if err != nil {
+				return 0, err
+			}
+			if !found {
+				return 0, WrapErrorf(ErrBlockNotFound, "block %s does not exist", blockId)
+			}
+			return int64(entry.Length), nil
+		}
+		return 0, WrapErrorf(err, "failed to stat block file %s", p)
+	}
+	return stat.Size(), nil
+}
+
+// The loose blocks are yielded first, then the packed blocks. A block that
+// is both loose and packed is only yielded once.
 func (s *FileStorage) ReadBlockIds(ctx context.Context, yield func(BlockId) bool) error {
+	if err := s.loadPackIndexes(ctx); err != nil {
+		return err
+	}
+	stop := false
+	err := s.readLooseBlockIds(ctx, func(blockId BlockId) bool {
+		if s.isPacked(blockId) {
+			return true
+		}
+		stop = !yield(blockId)
+		return !stop
+	})
+	if err != nil || stop {
+		return err
+	}
+	s.packs.mu.Lock()
+	entries := s.packs.entries
+	s.packs.mu.Unlock()
+	for i, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return WrapErrorf(err, "block id listing canceled")
+		}
+		// The same block might be in more than one pack.
+		if i > 0 && entries[i-1].BlockId == entry.BlockId {
+			continue
+		}
+		if !yield(entry.BlockId) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Stream the ids of all blocks that are stored as files of their own, i.e.
+// that are not packed.
+func (s *FileStorage) readLooseBlockIds(ctx context.Context, yield func(BlockId) bool) error {
+	return s.walkLooseBlocks(ctx, func(blockId BlockId, _ fs.DirEntry) (bool, error) {
+		return yield(blockId), nil
+	})
+}
+
+// ReadLooseBlocks is like `readLooseBlockIds`, but yields the file info of
+// every block as well.
+func (s *FileStorage) ReadLooseBlocks(ctx context.Context, yield func(BlockId, fs.FileInfo) bool) error {
+	return s.walkLooseBlocks(ctx, func(blockId BlockId, d fs.DirEntry) (bool, error) {
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed in the meantime.
+			return true, nil
+		}
+		if err != nil {
+			return false, WrapErrorf(err, "failed to stat block %s", blockId)
+		}
+		return yield(blockId, info), nil
+	})
+}
+
+// Set the modification time of a block that is stored as a file of its own.
+// Return `ErrBlockNotFound` if there is no such file.
+func (s *FileStorage) TouchLooseBlock(blockId BlockId, mtime time.Time) error {
+	path := s.blockPath(blockId)
+	if err := s.FS.Chmtime(path, mtime); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return WrapErrorf(ErrBlockNotFound, "block %s does not exist", blockId)
+		}
+		return WrapErrorf(err, "failed to set mtime of block file %s", path)
+	}
+	return nil
+}
+
+// Remove a block that is stored as a file of its own. This is only safe for
+// storages that are not a repository, e.g. a cache.
+// Return `ErrBlockNotFound` if there is no such file.
+func (s *FileStorage) DeleteLooseBlock(blockId BlockId) error {
+	path := s.blockPath(blockId)
+	if err := s.FS.Remove(path); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return WrapErrorf(ErrBlockNotFound, "block %s does not exist", blockId)
+		}
+		return WrapErrorf(err, "failed to remove block file %s", path)
+	}
+	return nil
+}
+
+func (s *FileStorage) walkLooseBlocks(
+	ctx context.Context,
+	yield func(BlockId, fs.DirEntry) (bool, error),
+) error {
 	objectsPath := filepath.Join(".cling", string(s.Purpose), "objects")
 	stat, err := s.FS.Stat(objectsPath)
 	if err != nil {
@@ -330,7 +677,11 @@ func (s *FileStorage) ReadBlockIds(ctx context.Context, yield func(BlockId) bool
 		if err != nil {
 			return WrapErrorf(err, "invalid block path %s", path)
 		}
-		if !yield(blockId) {
+		more, err := yield(blockId, d)
+		if err != nil {
+			return err
+		}
+		if !more {
 			return fs.SkipAll
 		}
 		return nil
@@ -341,7 +692,7 @@ func (s *FileStorage) ReadBlockIds(ctx context.Context, yield func(BlockId) bool
 	return nil
 }
 
-func (s *FileStorage) WriteBlock(_ context.Context, blockId BlockId, data []byte) (bool, error) {
+func (s *FileStorage) WriteBlock(ctx context.Context, blockId BlockId, data []byte) (bool, error) {
 	if len(data) > MaxBlockSize {
 		return false, Errorf("block %s is too large: %d", blockId, len(data))
 	}
@@ -352,6 +703,9 @@ func (s *FileStorage) WriteBlock(_ context.Context, blockId BlockId, data []byte
 	} else if !errors.Is(err, fs.ErrNotExist) {
 		return false, WrapErrorf(err, "failed to stat file for block %s", blockId)
 	}
+	if _, _, found, err := s.findPacked(ctx, blockId, false); err != nil || found {
+		return found, err
+	}
 	if err := s.FS.MkdirAll(filepath.Dir(targetPath)); err != nil {
 		return false, WrapErrorf(err, "failed to create directory for block %s", blockId)
 	}
@@ -362,12 +716,19 @@ func (s *FileStorage) WriteBlock(_ context.Context, blockId BlockId, data []byte
 }
 
 // Return `ErrBlockNotFound` if the block does not exist.
-func (s *FileStorage) ReadBlock(_ context.Context, blockId BlockId, buf BlockBuf) ([]byte, error) {
+func (s *FileStorage) ReadBlock(ctx context.Context, blockId BlockId, buf BlockBuf) ([]byte, error) {
 	path := s.blockPath(blockId)
 	file, err := s.FS.OpenRead(path)
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
-			return nil, WrapErrorf(ErrBlockNotFound, "block %s does not exist", blockId)
+			entry, packId, found, err := s.findPacked(ctx, blockId, true)
+			if err != nil {
+				return nil, err
+			}
+			if !found {
+				return nil, WrapErrorf(ErrBlockNotFound, "block %s does not exist", blockId)
+			}
+			return s.readPackedBlock(entry, packId, buf)
 		}
 		return nil, WrapErrorf(err, "failed to open block file %s", path)
 	}
@@ -428,6 +789,37 @@ func (s *FileStorage) HasControlFile(_ context.Context, section ControlFileSecti
 	return err == nil, nil
 }
 
+func (s *FileStorage) CompareAndSwapControlFile(
+	ctx context.Context,
+	section ControlFileSection,
+	name string,
+	expected, data []byte,
+) error {
+	lockPath := filepath.Join(".cling", string(s.Purpose), "locks", "control-files")
+	if err := s.FS.MkdirAll(filepath.Dir(lockPath)); err != nil {
+		return WrapErrorf(err, "failed to create directory for lock file %s", lockPath)
+	}
+	unlock, err := s.FS.Lock(ctx, lockPath)
+	if err != nil {
+		return WrapErrorf(err, "failed to lock control files")
+	}
+	defer unlock() //nolint:errcheck
+	current, err := s.ReadControlFile(ctx, section, name)
+	switch {
+	case errors.Is(err, ErrControlFileNotFound):
+		if expected != nil {
+			return WrapErrorf(ErrControlFileChanged, "control file %s/%s does not exist", section, name)
+		}
+	case err != nil:
+		return err
+	case expected == nil:
+		return WrapErrorf(ErrControlFileChanged, "control file %s/%s already exists", section, name)
+	case !bytes.Equal(current, expected):
+		return WrapErrorf(ErrControlFileChanged, "control file %s/%s has unexpected content", section, name)
+	}
+	return s.WriteControlFile(ctx, section, name, data)
+}
+
 func (s *FileStorage) DeleteControlFile(_ context.Context, section ControlFileSection, name string) error {
 	path, err := s.controlFilePath(section, name)
 	if err != nil {
@@ -442,6 +834,26 @@ func (s *FileStorage) DeleteControlFile(_ context.Context, section ControlFileSe
 	return nil
 }
 
+func (s *FileStorage) ListControlFiles(_ context.Context, section ControlFileSection) ([]string, error) {
+	path := filepath.Join(".cling", string(s.Purpose), string(section))
+	entries, err := s.FS.ReadDir(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return []string{}, nil
+		}
+		return nil, WrapErrorf(err, "failed to list control files in %s", path)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || ValidateControlFileName(entry.Name()) != nil {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
 func (s *FileStorage) Lock(ctx context.Context, name string) (func() error, error) {
 	if err := ValidateStorageLockName(name); err != nil {
 		return nil, err
@@ -454,7 +866,73 @@ func (s *FileStorage) Lock(ctx context.Context, name string) (func() error, erro
 	if err != nil {
 		return nil, WrapErrorf(err, "failed to create lock file %s", path)
 	}
-	return unlock, nil
+	slog.Debug("Acquired lock", "name", name, "path", path)
+	return func() error {
+		if err := unlock(); err != nil {
+			return err
+		}
+		slog.Debug("Released lock", "name", name, "path", path)
+		return nil
+	}, nil
+}
+
+// How long `FileStorage.ListLocks` tries to acquire a lock before it
+// reports the lock as held.
+const lockProbeTimeout = 100 * time.Millisecond
+
+// ListLocks probes every lock file by trying to acquire it. Locks on the
+// file system die with their process, so a held lock always belongs to a
+// running process.
+func (s *FileStorage) ListLocks(ctx context.Context) ([]LockInfo, error) {
+	dir := filepath.Join(".cling", string(s.Purpose), "locks")
+	entries, err := s.FS.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return []LockInfo{}, nil
+		}
+		return nil, WrapErrorf(err, "failed to list locks in %s", dir)
+	}
+	locks := []LockInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() || ValidateStorageLockName(entry.Name()) != nil {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		probeCtx, cancel := context.WithTimeout(ctx, lockProbeTimeout)
+		unlock, err := s.FS.Lock(probeCtx, path)
+		cancel()
+		if err == nil {
+			if err := unlock(); err != nil {
+				return nil, WrapErrorf(err, "failed to release lock %s", path)
+			}
+			continue
+		}
+		if ctx.Err() != nil || !errors.Is(err, context.DeadlineExceeded) {
+			return nil, WrapErrorf(err, "failed to probe lock %s", path)
+		}
+		data, err := ReadFile(s.FS, path)
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to read lock file %s", path)
+		}
+		locks = append(locks, parseLockFile(entry.Name(), data))
+	}
+	slices.SortFunc(locks, func(a, b LockInfo) int { return strings.Compare(a.Name, b.Name) })
+	return locks, nil
+}
+
+// parseLockFile reads the debug info written by `FS.Lock`, i.e.
+// `[<pid> ]<RFC 3339 timestamp>`.
+func parseLockFile(name string, data []byte) LockInfo {
+	info := LockInfo{Name: name} //nolint:exhaustruct
+	fields := strings.Fields(string(data))
+	if len(fields) == 2 {
+		info.Pid, _ = strconv.Atoi(fields[0])
+		fields = fields[1:]
+	}
+	if len(fields) == 1 {
+		info.CreatedAt, _ = time.Parse(time.RFC3339Nano, fields[0])
+	}
+	return info
 }
 
 // ForceUnlock removes the lock file. Any process still holding the orphaned
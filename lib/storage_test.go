@@ -5,12 +5,14 @@ import (
 	"io"
 	"io/fs"
 	mrand "math/rand/v2"
+	"os"
 	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestFileStorageInit(t *testing.T) {
@@ -84,6 +86,50 @@ func TestFileStorageOpen(t *testing.T) {
 		assert.Equal(Toml{"encryption": {"version": "1"}}, toml)
 	})
 
+	t.Run("Stale temporary files are removed", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		fs := td.NewTestFS(t, td.NewFS(t))
+		sut, err := NewFileStorage(fs.FS, StoragePurposeRepository)
+		assert.NoError(err)
+		err = sut.Init(t.Context(), Toml{"encryption": {"version": "1"}}, "header comment")
+		assert.NoError(err)
+		old := time.Now().Add(-2 * StaleTempFileAge)
+		staleBlock := filepath.Join(".cling", "repository", "objects", "aa", "bb", ".cling_sync_tmp_cc.1")
+		staleConfig := filepath.Join(".cling", ".cling_sync_tmp_repository.txt.2")
+		otherPurpose := filepath.Join(".cling", ".cling_sync_tmp_workspace.txt.3")
+		fresh := filepath.Join(".cling", "repository", "refs", ".cling_sync_tmp_head.4")
+		for _, path := range []string{staleBlock, staleConfig, otherPurpose, fresh} {
+			fs.Write(path, "garbage")
+		}
+		for _, path := range []string{staleBlock, staleConfig, otherPurpose} {
+			fs.Touch(path, old)
+		}
+
+		sut, err = NewFileStorage(fs.FS, StoragePurposeRepository)
+		assert.NoError(err)
+		_, err = sut.Open(t.Context())
+		assert.NoError(err)
+		assert.Equal([]string{staleConfig}, sut.RemovedTempFiles)
+		assert.Equal("garbage", fs.Cat(otherPurpose))
+		assert.Equal("garbage", fs.Cat(fresh))
+		// `Open` does not walk the blocks.
+		assert.Equal("garbage", fs.Cat(staleBlock))
+
+		// The cleanup only runs once per `StaleTempFileAge`.
+		fs.Write(staleConfig, "garbage")
+		fs.Touch(staleConfig, old)
+		_, err = sut.Open(t.Context())
+		assert.NoError(err)
+		assert.Equal([]string(nil), sut.RemovedTempFiles)
+		assert.Equal("garbage", fs.Cat(staleConfig))
+
+		// The blocks are only cleaned up explicitly.
+		removed, err := sut.RemoveStaleTempFiles(t.Context(), time.Now().Add(-StaleTempFileAge))
+		assert.NoError(err)
+		assert.Equal([]string{staleConfig, staleBlock}, removed)
+	})
+
 	t.Run("Repository does not exist", func(t *testing.T) {
 		t.Parallel()
 		assert := NewAssert(t)
@@ -109,6 +155,21 @@ func TestFileStorageOpen(t *testing.T) {
 		_, err = sut.Open(t.Context())
 		assert.ErrorIs(err, ErrStorageNotFound)
 	})
+
+	t.Run("WriteConfig restores a missing config file", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		fs := td.NewFS(t)
+		sut, err := NewFileStorage(fs, StoragePurposeRepository)
+		assert.NoError(err)
+		assert.ErrorIs(sut.WriteConfig(t.Context(), nil, ""), ErrStorageNotFound)
+		assert.NoError(sut.Init(t.Context(), Toml{"a": {"b": "c"}}, ""))
+		assert.NoError(fs.Remove(filepath.Join(".cling", "repository.txt")))
+		assert.NoError(sut.WriteConfig(t.Context(), Toml{"d": {"e": "f"}}, ""))
+		config, err := sut.Open(t.Context())
+		assert.NoError(err)
+		assert.Equal(Toml{"d": {"e": "f"}}, config)
+	})
 }
 
 func TestFileStorageMultiPurpose(t *testing.T) { //nolint:paralleltest
@@ -220,6 +281,78 @@ func TestControlFiles(t *testing.T) {
 		}
 	})
 
+	t.Run("ListControlFiles", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut, err := NewFileStorage(td.NewFS(t), StoragePurposeRepository)
+		assert.NoError(err)
+		assert.NoError(sut.Init(t.Context(), nil, ""))
+
+		names, err := sut.ListControlFiles(t.Context(), ControlFileSectionRefs)
+		assert.NoError(err)
+		assert.Equal([]string{}, names)
+
+		assert.NoError(sut.WriteControlFile(t.Context(), ControlFileSectionRefs, "tag-b", []byte("b")))
+		assert.NoError(sut.WriteControlFile(t.Context(), ControlFileSectionRefs, "head", []byte("h")))
+		assert.NoError(sut.WriteControlFile(t.Context(), ControlFileSectionConf, "other", []byte("c")))
+		// Leftover temporary files are not control files.
+		assert.NoError(WriteFile(sut.FS, AtomicWriteTempFilename(".cling/repository/refs/tag-c"), []byte("c")))
+		names, err = sut.ListControlFiles(t.Context(), ControlFileSectionRefs)
+		assert.NoError(err)
+		assert.Equal([]string{"head", "tag-b"}, names)
+	})
+
+	t.Run("CompareAndSwapControlFile", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut, err := NewFileStorage(td.NewFS(t), StoragePurposeRepository)
+		assert.NoError(err)
+		assert.NoError(sut.Init(t.Context(), nil, ""))
+		section := ControlFileSectionRefs
+
+		// `nil` means the file must not exist.
+		assert.NoError(sut.CompareAndSwapControlFile(t.Context(), section, "tag-a", nil, []byte("1")))
+		err = sut.CompareAndSwapControlFile(t.Context(), section, "tag-a", nil, []byte("2"))
+		assert.ErrorIs(err, ErrControlFileChanged)
+
+		assert.NoError(sut.CompareAndSwapControlFile(t.Context(), section, "tag-a", []byte("1"), []byte("2")))
+		err = sut.CompareAndSwapControlFile(t.Context(), section, "tag-a", []byte("1"), []byte("3"))
+		assert.ErrorIs(err, ErrControlFileChanged)
+		err = sut.CompareAndSwapControlFile(t.Context(), section, "tag-b", []byte("1"), []byte("3"))
+		assert.ErrorIs(err, ErrControlFileChanged)
+
+		data, err := sut.ReadControlFile(t.Context(), section, "tag-a")
+		assert.NoError(err)
+		assert.Equal([]byte("2"), data)
+	})
+
+	t.Run("ListLocks only lists held locks", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut, err := NewFileStorage(td.NewFS(t), StoragePurposeRepository)
+		assert.NoError(err)
+		locks, err := sut.ListLocks(t.Context())
+		assert.NoError(err)
+		assert.Equal([]LockInfo{}, locks)
+
+		unlockB, err := sut.Lock(t.Context(), "b")
+		assert.NoError(err)
+		unlockA, err := sut.Lock(t.Context(), "a")
+		assert.NoError(err)
+		assert.NoError(unlockA())
+		locks, err = sut.ListLocks(t.Context())
+		assert.NoError(err)
+		assert.Equal(1, len(locks))
+		assert.Equal("b", locks[0].Name)
+		assert.Equal(os.Getpid(), locks[0].Pid)
+		assert.Greater(time.Second, time.Since(locks[0].CreatedAt))
+
+		assert.NoError(unlockB())
+		locks, err = sut.ListLocks(t.Context())
+		assert.NoError(err)
+		assert.Equal([]LockInfo{}, locks)
+	})
+
 	t.Run("ReadControlFile should return ErrControlFileNotFound", func(t *testing.T) {
 		t.Parallel()
 		assert := NewAssert(t)
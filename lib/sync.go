@@ -122,7 +122,8 @@ func SyncRepository( //nolint:funlen
 	if dstCount%blockIdReadProgressEvery != 0 {
 		opts.Monitor.OnDstBlockIdsRead(dstCount)
 	}
-	dstCache, err := NewTempCache(dstTemp, func(id BlockId) string { return string(id[:]) }, 4)
+	dstCache, err := NewTempCache(dstTemp, func(id BlockId) string { return string(id[:]) },
+		TempCacheOptions{MaxChunks: 4})
 	if err != nil {
 		return WrapErrorf(err, "failed to open dst block id cache")
 	}
@@ -186,7 +187,7 @@ func SyncRepository( //nolint:funlen
 	if err := g.Wait(); err != nil {
 		return err //nolint:wrapcheck
 	}
-	unlock, err := dst.Lock(ctx, UpdateHeadRevisionLockName)
+	unlock, err := LockWithRetry(ctx, dst, UpdateHeadRevisionLockName, DefaultLockRetry())
 	if err != nil {
 		return WrapErrorf(err, "failed to lock dst head")
 	}
@@ -199,7 +200,7 @@ func SyncRepository( //nolint:funlen
 		return Errorf("dst head revision changed during sync")
 	}
 	opts.Monitor.OnBeforeUpdateDstHead(srcHead)
-	if err := WriteRef(ctx, dst, "head", srcHead); err != nil {
+	if err := CompareAndSwapRef(ctx, dst, "head", &dstHead, srcHead); err != nil {
 		return WrapErrorf(err, "failed to write dst head reference")
 	}
 	return nil
@@ -4,6 +4,7 @@ package lib
 import (
 	"io/fs"
 	"slices"
+	"strings"
 	"testing"
 )
 
@@ -331,6 +332,9 @@ func cloneRepository(t *testing.T, src *TestRepository) *TestRepository {
 	configData, err := ReadFile(src.FS, ".cling/repository.txt")
 	assert.NoError(err)
 	assert.NoError(WriteFile(dst.FS, ".cling/repository.txt", configData))
+	backupData, err := ReadFile(src.FS, ".cling/repository/security/repository-config")
+	assert.NoError(err)
+	assert.NoError(WriteFile(dst.FS, ".cling/repository/security/repository-config", backupData))
 	return td.OpenRepository(t, dst.FS)
 }
 
@@ -376,7 +380,8 @@ func assertSameFS(t *testing.T, src, dst FS) {
 		if srcInfo[path].IsDir() {
 			continue
 		}
-		if path == ".cling/repository/locks/head" {
+		// Lock files contain the pid and a timestamp.
+		if strings.HasPrefix(path, ".cling/repository/locks/") {
 			continue
 		}
 		srcData, err := ReadFile(src, path)
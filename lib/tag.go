@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrTagNotFound = Errorf("tag not found")
+	ErrTagExists   = Errorf("tag already exists")
+)
+
+// Tags are stored as references named `tag-<name>`.
+const tagRefPrefix = "tag-"
+
+type Tag struct {
+	Name       string
+	RevisionId RevisionId
+}
+
+// ValidateTagName checks that `name` can be stored as a reference and cannot
+// be confused with a revision spec, i.e. it is not `head`.
+func ValidateTagName(name string) error {
+	if strings.EqualFold(name, "head") {
+		return Errorf("invalid tag name %q: reserved", name)
+	}
+	if err := ValidateControlFileName(tagRefPrefix + name); err != nil || name == "" {
+		return Errorf("invalid tag name %q: only a-z, A-Z, 0-9, and - are allowed (max %d chars)",
+			name, 64-len(tagRefPrefix))
+	}
+	return nil
+}
+
+// WriteTag points the tag `name` to `revisionId`.
+// Return `ErrTagExists` if the tag already exists and `overwrite` is false.
+func (r *Repository) WriteTag(ctx context.Context, name string, revisionId RevisionId, overwrite bool) error {
+	if err := ValidateTagName(name); err != nil {
+		return err
+	}
+	if revisionId.IsRoot() {
+		return Errorf("cannot tag the root revision")
+	}
+	if _, err := r.ReadRevision(ctx, revisionId, NewBlockBuf()); err != nil {
+		return WrapErrorf(err, "failed to read revision %s", revisionId)
+	}
+	if overwrite {
+		return WriteRef(ctx, r.storage, tagRefPrefix+name, revisionId)
+	}
+	err := CompareAndSwapRef(ctx, r.storage, tagRefPrefix+name, nil, revisionId)
+	if errors.Is(err, ErrControlFileChanged) {
+		return WrapErrorf(ErrTagExists, "tag %s", name)
+	}
+	return err
+}
+
+// Return `ErrTagNotFound` if the tag does not exist.
+func (r *Repository) ReadTag(ctx context.Context, name string) (RevisionId, error) {
+	if err := ValidateTagName(name); err != nil {
+		return RevisionId{}, err
+	}
+	revisionId, err := ReadRef(ctx, r.storage, tagRefPrefix+name)
+	if errors.Is(err, ErrControlFileNotFound) {
+		return RevisionId{}, WrapErrorf(ErrTagNotFound, "tag %s", name)
+	}
+	return revisionId, err
+}
+
+// Return `ErrTagNotFound` if the tag does not exist.
+func (r *Repository) DeleteTag(ctx context.Context, name string) error {
+	if err := ValidateTagName(name); err != nil {
+		return err
+	}
+	err := DeleteRef(ctx, r.storage, tagRefPrefix+name)
+	if errors.Is(err, ErrControlFileNotFound) {
+		return WrapErrorf(ErrTagNotFound, "tag %s", name)
+	}
+	return err
+}
+
+// Tags returns all tags sorted by name.
+func (r *Repository) Tags(ctx context.Context) ([]Tag, error) {
+	names, err := ListRefs(ctx, r.storage)
+	if err != nil {
+		return nil, err
+	}
+	tags := []Tag{}
+	for _, ref := range names {
+		name, ok := strings.CutPrefix(ref, tagRefPrefix)
+		if !ok {
+			continue
+		}
+		revisionId, err := ReadRef(ctx, r.storage, ref)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, Tag{name, revisionId})
+	}
+	return tags, nil
+}
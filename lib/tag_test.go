@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	t.Parallel()
+	setup := func(t *testing.T) (*TestRepository, RevisionId, RevisionId) {
+		t.Helper()
+		assert := NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		revId1, err := testCommit(t, r.Repository, td.RevisionEntry("a.txt", RevisionEntryKindAdd))
+		assert.NoError(err)
+		revId2, err := testCommit(t, r.Repository, td.RevisionEntry("b.txt", RevisionEntryKindAdd))
+		assert.NoError(err)
+		return r, revId1, revId2
+	}
+
+	t.Run("Happy path", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r, revId1, revId2 := setup(t)
+
+		tags, err := r.Tags(t.Context())
+		assert.NoError(err)
+		assert.Equal([]Tag{}, tags)
+
+		assert.NoError(r.WriteTag(t.Context(), "v2", revId2, false))
+		assert.NoError(r.WriteTag(t.Context(), "v1", revId1, false))
+		got, err := r.ReadTag(t.Context(), "v1")
+		assert.NoError(err)
+		assert.Equal(revId1, got)
+		tags, err = r.Tags(t.Context())
+		assert.NoError(err)
+		assert.Equal([]Tag{{"v1", revId1}, {"v2", revId2}}, tags)
+
+		assert.NoError(r.DeleteTag(t.Context(), "v1"))
+		_, err = r.ReadTag(t.Context(), "v1")
+		assert.ErrorIs(err, ErrTagNotFound)
+		assert.ErrorIs(r.DeleteTag(t.Context(), "v1"), ErrTagNotFound)
+	})
+
+	t.Run("Existing tags are only overwritten if requested", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r, revId1, revId2 := setup(t)
+		assert.NoError(r.WriteTag(t.Context(), "v1", revId1, false))
+		assert.ErrorIs(r.WriteTag(t.Context(), "v1", revId2, false), ErrTagExists)
+		assert.NoError(r.WriteTag(t.Context(), "v1", revId2, true))
+		got, err := r.ReadTag(t.Context(), "v1")
+		assert.NoError(err)
+		assert.Equal(revId2, got)
+	})
+
+	t.Run("Only existing revisions can be tagged", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r, _, _ := setup(t)
+		assert.Error(r.WriteTag(t.Context(), "v1", RevisionId{}, false), "root revision")
+		assert.Error(r.WriteTag(t.Context(), "v1", RevisionId{1, 2, 3}, false), "failed to read revision")
+	})
+
+	t.Run("Invalid tag names", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		r, revId1, _ := setup(t)
+		for _, name := range []string{"", "HEAD", "head", "a/b", "a~1", string(make([]byte, 61))} {
+			assert.Error(r.WriteTag(t.Context(), name, revId1, false), "invalid tag name")
+		}
+		assert.NoError(ValidateTagName("release-2024-01"))
+	})
+}
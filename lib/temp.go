@@ -2,16 +2,37 @@
 package lib
 
 import (
+	"bufio"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
 const DefaultTempChunkSize = 4 * 1024 * 1024
 
+// Size of the read buffer of each input of a merge.
+const tempMergeReadBufferSize = 64 * 1024
+
+// TempMergeLimits bounds the resources `TempWriter.Finalize` uses to merge
+// the sorted chunks. If there are more chunks than can be merged at once,
+// they are merged in several passes.
+type TempMergeLimits struct {
+	// Maximum number of chunk files that are open at the same time.
+	FanIn int
+	// Memory (in bytes) available to the inputs of a merge. Each input
+	// holds one frame (about 1/16 of a chunk) and a read buffer.
+	BufferBudget int
+}
+
+// DefaultTempMergeLimits is used by all `TempWriter`s unless `SetMergeLimits`
+// is called. Lower it (before any writer is created) on constrained systems.
+var DefaultTempMergeLimits = TempMergeLimits{FanIn: 64, BufferBudget: 32 * 1024 * 1024} //nolint:gochecknoglobals
+
 // Splitting a sorted chunk into this many frames lets Finalize stream the
 // k-way merge with only one frame per input file in memory.
 const framesPerChunk = 16
@@ -158,6 +179,7 @@ type TempWriter[T any] struct {
 	compare          func(a, b T) int
 	marshaller       chunkMarshaller[T]
 	ignoreDuplicates bool
+	mergeLimits      TempMergeLimits
 	// Lazily allocated on first rotateChunk and reused for every frame.
 	frameBuf BlockBuf
 }
@@ -179,6 +201,7 @@ func NewTempWriter[T any](
 		fileExt:      "raw",
 		compare:      compare,
 		marshaller:   marshaller,
+		mergeLimits:  DefaultTempMergeLimits,
 	}
 }
 
@@ -208,25 +231,75 @@ func (tw *TempWriter[T]) Add(t T) error {
 	return nil
 }
 
+func (tw *TempWriter[T]) SetMergeLimits(limits TempMergeLimits) {
+	tw.mergeLimits = limits
+}
+
 // Rotate the current chunk and then sort all chunks and return the merged result.
-func (tw *TempWriter[T]) Finalize() (*Temp[T], error) { //nolint:funlen
+// At most `mergeFanIn` chunk files are merged at once. If there are more
+// chunks, they are first merged in groups into intermediate runs (each
+// consisting of several chunk files), then the runs are merged in groups,
+// and so on.
+func (tw *TempWriter[T]) Finalize() (*Temp[T], error) {
 	if err := tw.rotateChunk(); err != nil {
 		return nil, WrapErrorf(err, "failed to rotate final chunk")
 	}
-	sorted := NewTempWriter(tw.compare, tw.marshaller, tw.fs, tw.maxChunkSize)
-	sorted.fileExt = "sorted"
-	readers := make([]*frameReader[T], 0, tw.chunks)
-	heads := make([]T, 0, tw.chunks)
+	runs := make([][]string, tw.chunks)
+	for i := range tw.chunks {
+		runs[i] = []string{tw.chunkFilename(i)}
+	}
+	fanIn := tw.mergeFanIn()
+	for pass := 1; len(runs) > fanIn; pass++ {
+		merged := make([][]string, 0, (len(runs)+fanIn-1)/fanIn)
+		for start := 0; start < len(runs); start += fanIn {
+			group := runs[start:min(start+fanIn, len(runs))]
+			if len(group) == 1 {
+				merged = append(merged, group[0])
+				continue
+			}
+			target := tw.newMergeTarget(fmt.Sprintf("pass%d-%d", pass, len(merged)))
+			if err := tw.merge(group, target); err != nil {
+				return nil, err
+			}
+			run := make([]string, target.chunks)
+			for i := range target.chunks {
+				run[i] = target.chunkFilename(i)
+			}
+			merged = append(merged, run)
+		}
+		runs = merged
+	}
+	sorted := tw.newMergeTarget("sorted")
+	if err := tw.merge(runs, sorted); err != nil {
+		return nil, err
+	}
+	return &Temp[T]{sorted.fs, sorted.chunks, sorted.marshaller}, nil
+}
+
+// The number of chunk files merged at once, as allowed by `mergeLimits`.
+func (tw *TempWriter[T]) mergeFanIn() int {
+	perInput := tw.maxChunkSize/framesPerChunk + tempMergeReadBufferSize
+	return max(min(tw.mergeLimits.FanIn, tw.mergeLimits.BufferBudget/perInput), 2)
+}
+
+func (tw *TempWriter[T]) newMergeTarget(fileExt string) *TempWriter[T] {
+	target := NewTempWriter(tw.compare, tw.marshaller, tw.fs, tw.maxChunkSize)
+	target.fileExt = fileExt
+	target.ignoreDuplicates = tw.ignoreDuplicates
+	return target
+}
+
+// Merge the sorted `runs` into `target` and remove the files of the runs.
+func (tw *TempWriter[T]) merge(runs [][]string, target *TempWriter[T]) error { //nolint:funlen
+	readers := make([]*runReader[T], 0, len(runs))
+	heads := make([]T, 0, len(runs))
 	defer func() {
 		for _, r := range readers {
 			_ = r.Close()
 		}
 	}()
-	for i := range tw.chunks {
-		r, err := newFrameReader(tw.fs, tw.chunkFilename(i), tw.marshaller, NewBlockBuf())
-		if err != nil {
-			return nil, err
-		}
+	for _, run := range runs {
+		r := &runReader[T]{tw.fs, run, tw.marshaller, nil} //nolint:exhaustruct
 		e, err := r.Read()
 		if errors.Is(err, io.EOF) {
 			_ = r.Close()
@@ -234,7 +307,7 @@ func (tw *TempWriter[T]) Finalize() (*Temp[T], error) { //nolint:funlen
 		}
 		if err != nil {
 			_ = r.Close()
-			return nil, err
+			return err
 		}
 		readers = append(readers, r)
 		heads = append(heads, e)
@@ -244,15 +317,15 @@ func (tw *TempWriter[T]) Finalize() (*Temp[T], error) { //nolint:funlen
 		for i := 1; i < len(readers); i++ {
 			c := tw.compare(heads[i], heads[minIdx])
 			if c == 0 && !tw.ignoreDuplicates {
-				return nil, Errorf("duplicate entry: %v", heads[i])
+				return Errorf("duplicate entry: %v", heads[i])
 			}
 			if c < 0 {
 				minIdx = i
 			}
 		}
 		minHead := heads[minIdx]
-		if err := sorted.Add(minHead); err != nil {
-			return nil, WrapErrorf(err, "failed to write to target file")
+		if err := target.Add(minHead); err != nil {
+			return WrapErrorf(err, "failed to write to target file")
 		}
 		if tw.ignoreDuplicates {
 			// Advance every reader whose head matches `minHead`; several
@@ -271,7 +344,7 @@ func (tw *TempWriter[T]) Finalize() (*Temp[T], error) { //nolint:funlen
 					continue
 				}
 				if err != nil {
-					return nil, err
+					return err
 				}
 				heads[i] = e
 				i++
@@ -285,20 +358,22 @@ func (tw *TempWriter[T]) Finalize() (*Temp[T], error) { //nolint:funlen
 				continue
 			}
 			if err != nil {
-				return nil, err
+				return err
 			}
 			heads[minIdx] = e
 		}
 	}
-	if err := sorted.rotateChunk(); err != nil {
-		return nil, WrapErrorf(err, "failed to rotate final chunk")
+	if err := target.rotateChunk(); err != nil {
+		return WrapErrorf(err, "failed to rotate final chunk")
 	}
-	for i := range tw.chunks {
-		if err := tw.fs.Remove(tw.chunkFilename(i)); err != nil {
-			return nil, WrapErrorf(err, "failed to remove chunk file")
+	for _, run := range runs {
+		for _, name := range run {
+			if err := tw.fs.Remove(name); err != nil {
+				return WrapErrorf(err, "failed to remove chunk file")
+			}
 		}
 	}
-	return &Temp[T]{sorted.fs, sorted.chunks, sorted.marshaller}, nil
+	return nil
 }
 
 func (tw *TempWriter[T]) rotateChunk() error {
@@ -384,16 +459,64 @@ func (tw *TempWriter[T]) chunkFilename(index int) string {
 	return fmt.Sprintf("%d.%s", index, tw.fileExt)
 }
 
-// `buf` must remain unused by the caller until Close() returns.
-// The reader holds its bytes for the lifetime of the iteration.
+// runReader reads the chunk files of a sorted run one after the other, so
+// that only one of them is open at a time.
+type runReader[T any] struct {
+	fs         FS
+	files      []string
+	marshaller chunkMarshaller[T]
+	current    *frameReader[T]
+}
+
+// Read returns the next entry or io.EOF when all chunk files are exhausted.
+func (r *runReader[T]) Read() (T, error) {
+	for {
+		if r.current == nil {
+			if len(r.files) == 0 {
+				var zero T
+				return zero, io.EOF
+			}
+			fr, err := newStreamingFrameReader(r.fs, r.files[0], r.marshaller)
+			if err != nil {
+				var zero T
+				return zero, err
+			}
+			r.current = fr
+			r.files = r.files[1:]
+		}
+		e, err := r.current.Read()
+		if !errors.Is(err, io.EOF) {
+			return e, err
+		}
+		if err := r.Close(); err != nil {
+			return e, WrapErrorf(err, "failed to close chunk file")
+		}
+	}
+}
+
+func (r *runReader[T]) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
+
+// A frameReader either holds the whole chunk file in memory (see
+// `newFrameReader`) or reads it one frame at a time (see
+// `newStreamingFrameReader`).
 type frameReader[T any] struct {
 	closer     io.Closer
 	pb         *ProtobufReader
+	stream     *bufio.Reader
 	marshaller chunkMarshaller[T]
 	current    []T
 	cursor     int
 }
 
+// `buf` must remain unused by the caller until Close() returns.
+// The reader holds its bytes for the lifetime of the iteration.
 func newFrameReader[T any](
 	fs FS,
 	name string,
@@ -414,23 +537,25 @@ func newFrameReader[T any](
 	}, nil
 }
 
+// Only the current frame is kept in memory. Each frame gets its own buffer
+// because the entries may reference it.
+func newStreamingFrameReader[T any](fs FS, name string, m chunkMarshaller[T]) (*frameReader[T], error) {
+	f, err := fs.OpenRead(name)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to open chunk file %s", name)
+	}
+	return &frameReader[T]{ //nolint:exhaustruct
+		closer: f, stream: bufio.NewReaderSize(f, tempMergeReadBufferSize), marshaller: m,
+	}, nil
+}
+
 // Read returns the next entry or io.EOF when the chunk file is exhausted.
 func (r *frameReader[T]) Read() (T, error) {
 	var zero T
 	for r.cursor >= len(r.current) {
-		if r.pb.AtEnd() {
-			return zero, io.EOF
-		}
-		tag, wireType, err := r.pb.ReadTag()
+		frameData, err := r.nextFrame()
 		if err != nil {
-			return zero, WrapErrorf(err, "failed to read frame tag")
-		}
-		if tag != 1 || wireType != 2 {
-			return zero, Errorf("unexpected frame tag %d/wire %d", tag, wireType)
-		}
-		frameData, err := r.pb.ReadBytes()
-		if err != nil {
-			return zero, WrapErrorf(err, "failed to read frame data")
+			return zero, err
 		}
 		entries, err := r.marshaller.UnmarshallAll(NewProtobufReader(frameData))
 		if err != nil {
@@ -444,31 +569,151 @@ func (r *frameReader[T]) Read() (T, error) {
 	return e, nil
 }
 
+// Return io.EOF if there are no more frames.
+func (r *frameReader[T]) nextFrame() ([]byte, error) {
+	if r.stream == nil {
+		if r.pb.AtEnd() {
+			return nil, io.EOF
+		}
+		tag, wireType, err := r.pb.ReadTag()
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to read frame tag")
+		}
+		if tag != 1 || wireType != 2 {
+			return nil, Errorf("unexpected frame tag %d/wire %d", tag, wireType)
+		}
+		frameData, err := r.pb.ReadBytes()
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to read frame data")
+		}
+		return frameData, nil
+	}
+	t, err := binary.ReadUvarint(r.stream)
+	if errors.Is(err, io.EOF) {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to read frame tag")
+	}
+	if tag, wireType := t>>3, t&0x07; tag != 1 || wireType != 2 {
+		return nil, Errorf("unexpected frame tag %d/wire %d", tag, wireType)
+	}
+	l, err := binary.ReadUvarint(r.stream)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to read frame length")
+	}
+	if l > MaxBlockSize {
+		return nil, Errorf("frame too large: %d bytes", l)
+	}
+	frameData := make([]byte, l)
+	if _, err := io.ReadFull(r.stream, frameData); err != nil {
+		return nil, WrapErrorf(err, "failed to read frame data")
+	}
+	return frameData, nil
+}
+
 func (r *frameReader[T]) Close() error {
 	return r.closer.Close() //nolint:wrapcheck
 }
 
+// The number of chunks a `TempCache` keeps in memory if neither
+// `TempCacheOptions.MaxChunks` nor a `MemoryBudget` is given.
+const DefaultTempCacheChunks = 10
+
+// The decoded entries of a chunk and the map they are kept in take about
+// this many times the size of the chunk on disk.
+const tempCacheMemoryFactor = 4
+
+// MemoryBudget is the memory (in bytes) shared by the `TempCache`s of an
+// operation, e.g. a merge. Instead of a fixed number of chunks, each cache
+// keeps as many chunks in memory as the budget allows and spills (i.e.
+// evicts its least recently used chunks) once it is used up. A cache always
+// keeps the chunk it just read, so the budget is exceeded by at most one
+// chunk per cache.
+//
+// Memory is only given back when a chunk is evicted, so use a new budget
+// for every operation.
+type MemoryBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+}
+
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{sync.Mutex{}, limit, 0}
+}
+
+// Reserve `n` bytes. Unless `force` is set, return false and reserve
+// nothing if that would exceed the limit.
+func (b *MemoryBudget) reserve(n int64, force bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !force && b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *MemoryBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+}
+
+// Used returns the number of bytes reserved right now.
+func (b *MemoryBudget) Used() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+type TempCacheOptions struct {
+	// The maximum number of chunks kept in memory. If 0, this is
+	// `DefaultTempCacheChunks` without a `Budget` and unlimited with one.
+	MaxChunks int
+	// Optional, see `MemoryBudget`.
+	Budget *MemoryBudget
+}
+
+type TempCacheStats struct {
+	// Lookups answered by a chunk in memory.
+	Hits int
+	// Lookups that had to read a chunk from disk.
+	Misses int
+	// Chunks dropped from memory to make room for another one.
+	Evictions int
+	// The largest number of chunks in memory at the same time.
+	PeakChunks int
+}
+
+type TempCacheMonitor interface {
+	// Called once an operation is done with the cache `name`.
+	OnTempCacheStats(name string, stats TempCacheStats)
+}
+
 type TempCache[T any] struct {
-	Source           *Temp[T]
-	maxChunksInCache int
-	reader           *TempReader[T]
-	buf              BlockBuf
-	cache            []map[string]T
-	firstEntries     []string
-	lastAccessed     []int64
-	chunksInCache    int
-	cacheKey         func(T) string
-	CacheMisses      int
+	Source        *Temp[T]
+	maxChunks     int
+	budget        *MemoryBudget
+	reader        *TempReader[T]
+	buf           BlockBuf
+	cache         []map[string]T
+	firstEntries  []string
+	lastAccessed  []int64
+	memory        []int64
+	chunksInCache int
+	cacheKey      func(T) string
+	stats         TempCacheStats
 }
 
 func NewTempCache[T any](
 	temp *Temp[T],
 	cacheKey func(T) string,
-	maxChunksInCache int,
+	opts TempCacheOptions,
 ) (*TempCache[T], error) {
 	firstEntries := make([]string, temp.Chunks())
 	cache := make([]map[string]T, temp.Chunks())
-	chunksInCache := 0
 	reader := temp.Reader(nil)
 	buf := NewBlockBuf()
 	for i := range temp.Chunks() {
@@ -481,17 +726,23 @@ func NewTempCache[T any](
 		}
 		firstEntries[i] = cacheKey(entries[0])
 	}
+	maxChunks := opts.MaxChunks
+	if maxChunks == 0 && opts.Budget == nil {
+		maxChunks = DefaultTempCacheChunks
+	}
 	return &TempCache[T]{
-		Source:           temp,
-		maxChunksInCache: maxChunksInCache,
-		reader:           reader,
-		buf:              buf,
-		cache:            cache,
-		firstEntries:     firstEntries,
-		lastAccessed:     make([]int64, temp.Chunks()),
-		CacheMisses:      0,
-		cacheKey:         cacheKey,
-		chunksInCache:    chunksInCache,
+		Source:        temp,
+		maxChunks:     maxChunks,
+		budget:        opts.Budget,
+		reader:        reader,
+		buf:           buf,
+		cache:         cache,
+		firstEntries:  firstEntries,
+		lastAccessed:  make([]int64, temp.Chunks()),
+		memory:        make([]int64, temp.Chunks()),
+		chunksInCache: 0,
+		cacheKey:      cacheKey,
+		stats:         TempCacheStats{0, 0, 0, 0},
 	}, nil
 }
 
@@ -517,33 +768,103 @@ func (tc *TempCache[T]) Get(key string) (T, bool, error) {
 	}
 	cache := tc.cache[chunkIndex]
 	if cache == nil {
-		if tc.chunksInCache >= tc.maxChunksInCache {
-			// Evict the oldest chunk.
-			oldest := -1
-			for i, lastAccessed := range tc.lastAccessed {
-				if tc.cache[i] == nil {
-					continue
-				}
-				if oldest < 0 || lastAccessed < tc.lastAccessed[oldest] {
-					oldest = i
-				}
-			}
-			tc.cache[oldest] = nil
-		} else {
-			tc.chunksInCache++
-		}
-		cache = make(map[string]T)
-		tc.cache[chunkIndex] = cache
-		tc.CacheMisses++
+		tc.stats.Misses++
 		entries, err := tc.reader.ReadChunk(chunkIndex, tc.buf)
 		if err != nil {
 			return zero, false, WrapErrorf(err, "failed to read chunk %d", chunkIndex)
 		}
+		memory := int64(0)
+		for _, entry := range entries {
+			memory += int64(tc.Source.marshaller.EntrySize(entry))
+		}
+		memory *= tempCacheMemoryFactor
+		tc.makeRoom(memory)
+		cache = make(map[string]T, len(entries))
 		for _, entry := range entries {
 			cache[tc.cacheKey(entry)] = entry
 		}
+		tc.cache[chunkIndex] = cache
+		tc.memory[chunkIndex] = memory
+		tc.chunksInCache++
+		tc.stats.PeakChunks = max(tc.stats.PeakChunks, tc.chunksInCache)
+	} else {
+		tc.stats.Hits++
 	}
 	tc.lastAccessed[chunkIndex] = time.Now().UnixNano()
 	re, ok := cache[key]
 	return re, ok, nil
 }
+
+// Stats returns the statistics of all lookups so far.
+func (tc *TempCache[T]) Stats() TempCacheStats {
+	if tc == nil {
+		return TempCacheStats{0, 0, 0, 0}
+	}
+	return tc.stats
+}
+
+// Evict the least recently used chunks until there is room for another
+// chunk that takes `memory` bytes, and reserve them in the budget.
+func (tc *TempCache[T]) makeRoom(memory int64) {
+	for tc.chunksInCache > 0 {
+		if tc.maxChunks == 0 || tc.chunksInCache < tc.maxChunks {
+			if tc.budget == nil || tc.budget.reserve(memory, false) {
+				return
+			}
+		}
+		oldest := -1
+		for i, lastAccessed := range tc.lastAccessed {
+			if tc.cache[i] == nil {
+				continue
+			}
+			if oldest < 0 || lastAccessed < tc.lastAccessed[oldest] {
+				oldest = i
+			}
+		}
+		tc.cache[oldest] = nil
+		if tc.budget != nil {
+			tc.budget.release(tc.memory[oldest])
+		}
+		tc.memory[oldest] = 0
+		tc.chunksInCache--
+		tc.stats.Evictions++
+	}
+	// The chunk is needed no matter what.
+	if tc.budget != nil {
+		tc.budget.reserve(memory, true)
+	}
+}
+
+// ScanPrefix calls `fn` for all entries whose key starts with `prefix` in
+// key order. The chunks are read directly, the cache is not touched.
+func (tc *TempCache[T]) ScanPrefix(prefix string, fn func(T) error) error {
+	if tc == nil {
+		return nil
+	}
+	start := 0
+	for i, firstEntry := range tc.firstEntries {
+		if firstEntry > prefix {
+			break
+		}
+		start = i
+	}
+	for i := start; i < tc.Source.Chunks(); i++ {
+		entries, err := tc.reader.ReadChunk(i, tc.buf)
+		if err != nil {
+			return WrapErrorf(err, "failed to read chunk %d", i)
+		}
+		for _, entry := range entries {
+			key := tc.cacheKey(entry)
+			if key < prefix {
+				continue
+			}
+			if !strings.HasPrefix(key, prefix) {
+				return nil
+			}
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
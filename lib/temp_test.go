@@ -295,6 +295,78 @@ func TestTemp(t *testing.T) {
 			assert.Equal(true, a < b, "unsorted at %d: %q >= %q", i, a, b)
 		}
 	})
+
+	t.Run("Multi-pass merge", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		fs := td.NewFS(t)
+		sut := NewRevisionEntryTempWriter(fs, 4*1024)
+		sut.SetMergeLimits(TempMergeLimits{FanIn: 3, BufferBudget: DefaultTempMergeLimits.BufferBudget})
+		const n = 2000
+		paths := make([]string, n)
+		for i := range n {
+			paths[i] = fmt.Sprintf("p-%05d.txt", i)
+		}
+		rand.Shuffle(len(paths), func(i, j int) { paths[i], paths[j] = paths[j], paths[i] })
+		for _, p := range paths {
+			assert.NoError(sut.Add(td.RevisionEntry(p, RevisionEntryKindAdd)))
+		}
+		assert.Greater(sut.chunks, 27, "test setup: at least three merge passes are needed")
+		temp, err := sut.Finalize()
+		assert.NoError(err)
+		merged := readAllRevsisionTemp(t, temp, nil)
+		assert.Equal(n, len(merged))
+		for i, entry := range merged {
+			assert.Equal(fmt.Sprintf("p-%05d.txt", i), entry.Path.String())
+		}
+		// Only the final chunk files are left.
+		files, err := fs.ReadDir(".")
+		assert.NoError(err)
+		assert.Equal(temp.Chunks(), len(files))
+		for _, f := range files {
+			assert.Equal(true, strings.HasSuffix(f.Name(), ".sorted"), f.Name())
+		}
+	})
+
+	t.Run("Duplicates are handled across merge passes", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		limits := TempMergeLimits{FanIn: 2, BufferBudget: DefaultTempMergeLimits.BufferBudget}
+		paths := []string{"a.txt", "b.txt", "c.txt", "d.txt", "e.txt", "a.txt", "f.txt", "b.txt"}
+
+		sut := NewTempWriterWithIgnoreDuplicates[*RevisionEntry](
+			RevisionEntryPathCompare, revisionEntryChunkMarshaller{}, td.NewFS(t), 1,
+		)
+		sut.SetMergeLimits(limits)
+		for _, p := range paths {
+			assert.NoError(sut.Add(td.RevisionEntry(p, RevisionEntryKindAdd)))
+		}
+		temp, err := sut.Finalize()
+		assert.NoError(err)
+		merged := readAllRevsisionTemp(t, temp, nil)
+		assert.Equal(6, len(merged))
+
+		rejecting := NewRevisionEntryTempWriter(td.NewFS(t), 1)
+		rejecting.SetMergeLimits(limits)
+		for _, p := range paths {
+			assert.NoError(rejecting.Add(td.RevisionEntry(p, RevisionEntryKindAdd)))
+		}
+		_, err = rejecting.Finalize()
+		assert.Error(err, "duplicate entry")
+	})
+
+	t.Run("The buffer budget limits the fan-in", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := NewRevisionEntryTempWriter(td.NewFS(t), DefaultTempChunkSize)
+		assert.Equal(DefaultTempMergeLimits.FanIn, sut.mergeFanIn())
+		perInput := DefaultTempChunkSize/framesPerChunk + tempMergeReadBufferSize
+		sut.SetMergeLimits(TempMergeLimits{FanIn: 64, BufferBudget: 5 * perInput})
+		assert.Equal(5, sut.mergeFanIn())
+		// At least two inputs are always merged.
+		sut.SetMergeLimits(TempMergeLimits{FanIn: 1, BufferBudget: 0})
+		assert.Equal(2, sut.mergeFanIn())
+	})
 }
 
 func countFramesInChunkFile[T any](temp *Temp[T], i int) (int, error) {
@@ -349,7 +421,7 @@ func TestTempCache(t *testing.T) {
 		assert.NoError(err)
 		assert.Equal(4, temp.Chunks())
 
-		cache, err := NewRevisionEntryTempCache(temp, 2)
+		cache, err := NewRevisionEntryTempCache(temp, TempCacheOptions{MaxChunks: 2})
 		assert.NoError(err)
 
 		// First, check that we find all entries.
@@ -363,7 +435,7 @@ func TestTempCache(t *testing.T) {
 
 		// We read all entries in order so we should never evict a chunk we
 		// need later.
-		assert.Equal(4, cache.CacheMisses)
+		assert.Equal(4, cache.Stats().Misses)
 
 		// Check that we don't find entries.
 		for _, path := range []string{"a.txt", "z.txt", "sub/z.txt", "sub/sub/z.txt"} {
@@ -374,7 +446,45 @@ func TestTempCache(t *testing.T) {
 			assert.Nil(entry, path)
 		}
 		// The cache size is only two, so some more cache misses happened.
-		assert.Equal(7, cache.CacheMisses)
+		assert.Equal(7, cache.Stats().Misses)
+	})
+
+	t.Run("ScanPrefix", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		fs := td.NewFS(t)
+		sut := NewRevisionEntryTempWriter(fs, 400+chunkFramingOverhead)
+		for _, path := range []string{"b.txt", "sub", "sub/a.txt", "sub/y.txt", "sub/sub", "sub/sub/a.txt", "y.txt"} {
+			mode := FileMode(0)
+			if path == "sub" || path == "sub/sub" {
+				mode = FileModeDir
+			}
+			err := sut.Add(
+				&RevisionEntry{Kind: RevisionEntryKindAdd, Path: Path{path}, Metadata: *td.PathMetadata(mode)},
+			)
+			assert.NoError(err)
+		}
+		temp, err := sut.Finalize()
+		assert.NoError(err)
+		assert.Greater(temp.Chunks(), 2)
+		cache, err := NewRevisionEntryTempCache(temp, TempCacheOptions{MaxChunks: 2})
+		assert.NoError(err)
+		scan := func(prefix string) []string {
+			paths := []string{}
+			err := cache.ScanPrefix(prefix, func(e *RevisionEntry) error {
+				paths = append(paths, e.Path.String())
+				return nil
+			})
+			assert.NoError(err)
+			return paths
+		}
+
+		assert.Equal([]string{"sub/a.txt", "sub/y.txt", "sub/sub", "sub/sub/a.txt"},
+			scan(PathCompareString(Path{"sub"}, true)+"/"))
+		assert.Equal([]string{"sub/sub/a.txt"}, scan(PathCompareString(Path{"sub/sub"}, true)+"/"))
+		assert.Equal([]string{}, scan(PathCompareString(Path{"nope"}, true)+"/"))
+		assert.Equal(7, len(scan("")))
+		assert.Equal(0, cache.Stats().Misses)
 	})
 
 	t.Run("LRU eviction respects maxChunksInCache", func(t *testing.T) {
@@ -413,7 +523,7 @@ func TestTempCache(t *testing.T) {
 		}
 
 		// maxChunksInCache = 2, so at most 2 chunks should be in memory.
-		cache, err := NewRevisionEntryTempCache(temp, 2)
+		cache, err := NewRevisionEntryTempCache(temp, TempCacheOptions{MaxChunks: 2})
 		assert.NoError(err)
 		assert.Equal([]int{}, loadedChunks(cache))
 
@@ -457,6 +567,50 @@ func TestTempCache(t *testing.T) {
 			"at most maxChunksInCache (2) chunks should be loaded, got: %v",
 			loadedChunks(cache))
 	})
+
+	t.Run("A memory budget is shared by all caches", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		sut := NewRevisionEntryTempWriter(td.NewFS(t), 400+chunkFramingOverhead)
+		paths := []string{"a.txt", "b.txt", "c.txt", "d.txt", "e.txt", "f.txt", "g.txt", "h.txt"}
+		for _, path := range paths {
+			assert.NoError(sut.Add(td.RevisionEntry(path, RevisionEntryKindAdd)))
+		}
+		temp, err := sut.Finalize()
+		assert.NoError(err)
+		assert.Equal(4, temp.Chunks())
+		getAll := func(cache *TempCache[*RevisionEntry]) {
+			for _, path := range paths {
+				_, ok, err := cache.Get(PathCompareString(Path{path}, false))
+				assert.NoError(err)
+				assert.Equal(true, ok, path)
+			}
+		}
+
+		// With enough memory, the cache grows beyond `DefaultTempCacheChunks`
+		// chunks (if there were that many).
+		budget := NewMemoryBudget(1024 * 1024)
+		cache, err := NewRevisionEntryTempCache(temp, TempCacheOptions{MaxChunks: 0, Budget: budget})
+		assert.NoError(err)
+		getAll(cache)
+		getAll(cache)
+		assert.Equal(TempCacheStats{Hits: 12, Misses: 4, Evictions: 0, PeakChunks: 4}, cache.Stats())
+		assert.Greater(budget.Used(), int64(0))
+
+		// Without enough memory, each cache spills all but the chunk it
+		// reads from.
+		budget = NewMemoryBudget(1)
+		a, err := NewRevisionEntryTempCache(temp, TempCacheOptions{MaxChunks: 0, Budget: budget})
+		assert.NoError(err)
+		b, err := NewRevisionEntryTempCache(temp, TempCacheOptions{MaxChunks: 0, Budget: budget})
+		assert.NoError(err)
+		getAll(a)
+		getAll(b)
+		getAll(a)
+		assert.Equal(TempCacheStats{Hits: 8, Misses: 8, Evictions: 7, PeakChunks: 1}, a.Stats())
+		assert.Equal(TempCacheStats{Hits: 4, Misses: 4, Evictions: 3, PeakChunks: 1}, b.Stats())
+		assert.Equal(a.memory[3]+b.memory[3], budget.Used())
+	})
 }
 
 func BenchmarkRevisionTemp(b *testing.B) {
@@ -104,7 +104,7 @@ func (td TestData) RevisionEntryExt(
 	if err != nil {
 		panic(err)
 	}
-	return &RevisionEntry{Kind: entryType, Path: p, Metadata: *md}
+	return &RevisionEntry{Kind: entryType, Path: p, Metadata: *md, RenamedFrom: nil}
 }
 
 func (td TestData) Revision(parent RevisionId) *Revision {
@@ -143,10 +143,38 @@ func (m *TestHealthCheckMonitor) OnOrphanedBlock(blockId BlockId) {
 	m.Calls = append(m.Calls, NewMockCall("OnOrphanedBlock", blockId))
 }
 
+func (m *TestHealthCheckMonitor) OnQuarantinedBlock(blockId BlockId) {
+	m.Calls = append(m.Calls, NewMockCall("OnQuarantinedBlock", blockId))
+}
+
+func (m *TestHealthCheckMonitor) OnRepair(description string) {
+	m.Calls = append(m.Calls, NewMockCall("OnRepair", description))
+}
+
 func (td TestData) NewHealthCheckMonitor() *TestHealthCheckMonitor {
 	return &TestHealthCheckMonitor{[]MockCall{}}
 }
 
+type TestScrubMonitor struct {
+	Calls []MockCall
+}
+
+func (m *TestScrubMonitor) OnScrubStart(blocks, sample int) {
+	m.Calls = append(m.Calls, NewMockCall("OnScrubStart", blocks, sample))
+}
+
+func (m *TestScrubMonitor) OnBlockVerified(blockId BlockId, length int) {
+	m.Calls = append(m.Calls, NewMockCall("OnBlockVerified", blockId, length))
+}
+
+func (m *TestScrubMonitor) OnCorruptBlock(blockId BlockId, _ error) {
+	m.Calls = append(m.Calls, NewMockCall("OnCorruptBlock", blockId))
+}
+
+func (td TestData) NewScrubMonitor() *TestScrubMonitor {
+	return &TestScrubMonitor{[]MockCall{}}
+}
+
 func (td TestData) SHA256(content string) Sha256 {
 	if len(content) == 0 {
 		return Sha256{}
@@ -171,6 +199,17 @@ func (td TestData) NewTestRepository(tb testing.TB, fs FS) *TestRepository {
 	return &TestRepository{repository, td.NewTestFS(tb, fs), passphrase, storage, tb, assert}
 }
 
+// Create a repository of `LegacyStorageVersion`.
+func (td TestData) NewLegacyTestRepository(tb testing.TB, fs FS) *TestRepository {
+	tb.Helper()
+	assert := NewAssert(tb)
+	r := td.NewTestRepository(tb, fs)
+	config := r.Config()
+	config[storageSection] = createStorageConfig(storageInfo{LegacyStorageVersion, RepositoryId{}})
+	assert.NoError(r.Storage.WriteConfig(tb.Context(), config, RepositoryConfigHeaderComment))
+	return td.OpenRepository(tb, fs)
+}
+
 func (td TestData) OpenRepository(tb testing.TB, fs FS) *TestRepository {
 	tb.Helper()
 	assert := NewAssert(tb)
@@ -373,6 +412,53 @@ func (f *TestFS) Symlink(target string, name string) {
 	f.assert.NoError(err)
 }
 
+func (f *TestFS) Link(oldname string, name string) {
+	f.t.Helper()
+	dir := filepath.Dir(name)
+	if dir != "." {
+		f.MkdirAll(dir)
+	}
+	err := f.FS.Link(oldname, name)
+	f.assert.NoError(err)
+}
+
+func (f *TestFS) SetXattrs(path string, xattrs ...*Xattr) {
+	f.t.Helper()
+	err := f.FS.SetXattrs(path, xattrs)
+	f.assert.NoError(err)
+}
+
+func (f *TestFS) Xattrs(path string) []*Xattr {
+	f.t.Helper()
+	xattrs, err := f.FS.Xattrs(path)
+	f.assert.NoError(err)
+	return xattrs
+}
+
+// Write `data` and leave out the `holes`, see `NewSparseWriter`.
+func (f *TestFS) WriteSparse(path string, data []byte, holes ...*Hole) {
+	f.t.Helper()
+	w, err := f.FS.OpenWrite(path)
+	f.assert.NoError(err)
+	w = NewSparseWriter(w, holes)
+	_, err = w.Write(data)
+	f.assert.NoError(err)
+	f.assert.NoError(w.Close())
+}
+
+func (f *TestFS) Holes(path string) []*Hole {
+	f.t.Helper()
+	holes, err := f.FS.Holes(path)
+	f.assert.NoError(err)
+	return holes
+}
+
+// Whether `a` and `b` are hard links to the same file.
+func (f *TestFS) SameFile(a string, b string) bool {
+	f.t.Helper()
+	return os.SameFile(f.Stat(a), f.Stat(b)) //nolint:forbidigo
+}
+
 func (f *TestFS) ReadLink(name string) string {
 	f.t.Helper()
 	target, err := f.FS.ReadLink(name)
@@ -408,6 +494,9 @@ func (f *TestFS) PathMetadata(path string) *PathMetadata {
 	if md.FileMode.IsRegular() {
 		md.FileHash = f.Sha256(path)
 	}
+	if !md.FileMode.IsSymlink() {
+		md.Xattrs = f.Xattrs(path)
+	}
 	EnhanceMetadata(md, stat)
 	return md
 }
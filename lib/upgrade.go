@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"context"
+	"maps"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+type RepositoryUpgradeMonitor interface {
+	OnUpgradeBlock(blockId BlockId, length int)
+}
+
+// UpgradeRepository copies the repository in `src`, which must be of
+// `LegacyStorageVersion`, to the uninitialized storage `dst`. Every block is
+// decrypted and encrypted again, this time bound to a new repository id (see
+// `blockAAD`).
+// The keys and thus the block ids don't change, so all revisions and
+// references stay the same and workspaces can be attached to `dst` in place
+// of `src`.
+// The config backups (see `backupRepositoryConfig`) are not copied. The one
+// of the key slot `passphrase` belongs to is written right away, the others
+// the next time the repository is opened with their passphrase.
+func UpgradeRepository(
+	ctx context.Context,
+	src, dst Storage,
+	passphrase []byte,
+	workers int,
+	monitor RepositoryUpgradeMonitor,
+) (*Repository, error) {
+	if workers < 1 {
+		return nil, Errorf("number of workers must be at least 1")
+	}
+	srcRepository, err := OpenRepository(ctx, src, passphrase)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to open src repository")
+	}
+	defer srcRepository.Close() //nolint:errcheck
+	if srcRepository.storageInfo.Version != LegacyStorageVersion {
+		return nil, Errorf("the repository is already at version %d", srcRepository.storageInfo.Version)
+	}
+	info, err := newStorageInfo()
+	if err != nil {
+		return nil, err
+	}
+	config := maps.Clone(srcRepository.config)
+	config[storageSection] = createStorageConfig(info)
+	if err := dst.Init(ctx, config, RepositoryConfigHeaderComment); err != nil {
+		return nil, WrapErrorf(err, "failed to initialize dst storage")
+	}
+	dstRepository, err := OpenRepository(ctx, dst, passphrase)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to open dst repository")
+	}
+	err = upgradeBlocks(ctx, src, srcRepository, dstRepository, workers, monitor)
+	if err == nil {
+		err = copyControlFiles(ctx, src, dst, ControlFileSectionConf)
+	}
+	if err == nil {
+		err = copyControlFiles(ctx, src, dst, ControlFileSectionFiles)
+	}
+	// The head is copied last, an interrupted upgrade leaves `dst` without one.
+	if err == nil {
+		err = copyControlFiles(ctx, src, dst, ControlFileSectionRefs)
+	}
+	if err != nil {
+		dstRepository.Close() //nolint:errcheck,gosec
+		return nil, err
+	}
+	return dstRepository, nil
+}
+
+// Read every block of `src` with `srcRepository` and write it with
+// `dstRepository`.
+func upgradeBlocks(
+	ctx context.Context,
+	src Storage,
+	srcRepository, dstRepository *Repository,
+	workers int,
+	monitor RepositoryUpgradeMonitor,
+) error {
+	g, gctx := errgroup.WithContext(ctx)
+	ids := make(chan BlockId, workers)
+	// Workers call the monitor concurrently, so serialize it.
+	var monitorMu sync.Mutex
+	for range workers {
+		g.Go(func() error {
+			// `ReadBlock` returns a slice that aliases its buffer, so it cannot
+			// be used by `WriteBlock`.
+			readBuf := NewBlockBuf()
+			writeBuf := NewBlockBuf()
+			for id := range ids {
+				data, err := srcRepository.ReadBlock(gctx, id, readBuf)
+				if err != nil {
+					return WrapErrorf(err, "failed to read block %s from src", id)
+				}
+				newId, _, err := dstRepository.WriteBlock(gctx, data, writeBuf)
+				if err != nil {
+					return WrapErrorf(err, "failed to write block %s to dst", id)
+				}
+				if newId != id {
+					return Errorf("block %s was written as %s", id, newId)
+				}
+				monitorMu.Lock()
+				monitor.OnUpgradeBlock(id, len(data))
+				monitorMu.Unlock()
+			}
+			return nil
+		})
+	}
+	g.Go(func() error {
+		defer close(ids)
+		err := src.ReadBlockIds(gctx, func(id BlockId) bool {
+			select {
+			case ids <- id:
+				return true
+			case <-gctx.Done():
+				return false
+			}
+		})
+		if err != nil {
+			return WrapErrorf(err, "failed to read src block ids")
+		}
+		return gctx.Err()
+	})
+	return g.Wait() //nolint:wrapcheck
+}
+
+func copyControlFiles(ctx context.Context, src, dst Storage, section ControlFileSection) error {
+	names, err := src.ListControlFiles(ctx, section)
+	if err != nil {
+		return WrapErrorf(err, "failed to list control files in %s", section)
+	}
+	copyFile := func(name string) error {
+		data, err := src.ReadControlFile(ctx, section, name)
+		if err != nil {
+			return WrapErrorf(err, "failed to read control file %s/%s", section, name)
+		}
+		if err := dst.WriteControlFile(ctx, section, name, data); err != nil {
+			return WrapErrorf(err, "failed to write control file %s/%s", section, name)
+		}
+		return nil
+	}
+	head := false
+	for _, name := range names {
+		if section == ControlFileSectionRefs && name == "head" {
+			head = true
+			continue
+		}
+		if err := copyFile(name); err != nil {
+			return err
+		}
+	}
+	if head {
+		return copyFile("head")
+	}
+	return nil
+}
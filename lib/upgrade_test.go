@@ -0,0 +1,88 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestUpgradeRepository(t *testing.T) {
+	t.Parallel()
+	t.Run("Happy path", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		src := td.NewLegacyTestRepository(t, td.NewFS(t))
+		entryA, _ := testEntry(t, src, "a.txt", "a")
+		rev1, err := testCommit(t, src.Repository, entryA)
+		assert.NoError(err)
+		assert.NoError(src.WriteTag(t.Context(), "v1", rev1, false))
+		entryB, blockIdB := testEntry(t, src, "b.txt", "b")
+		rev2, err := testCommit(t, src.Repository, entryB)
+		assert.NoError(err)
+		blockIds := map[BlockId]bool{}
+		assert.NoError(src.Storage.ReadBlockIds(t.Context(), func(id BlockId) bool {
+			blockIds[id] = true
+			return true
+		}))
+
+		dstFS := td.NewFS(t)
+		dstStorage, err := NewFileStorage(dstFS, StoragePurposeRepository)
+		assert.NoError(err)
+		monitor := &testUpgradeMonitor{map[BlockId]bool{}}
+		sut, err := UpgradeRepository(t.Context(), src.Storage, dstStorage, []byte(src.Passphrase), 2, monitor)
+		assert.NoError(err)
+		defer sut.Close() //nolint:errcheck
+		assert.Equal(blockIds, monitor.blockIds)
+		assert.Equal(StorageVersion, sut.storageInfo.Version)
+		assert.NotEqual(RepositoryId{}, sut.storageInfo.RepositoryId)
+		assert.Equal(src.Config()["encryption"], sut.Config()["encryption"])
+
+		// Revision ids and references are the same.
+		dst := td.OpenRepository(t, dstFS)
+		assert.Equal(rev2, dst.Head())
+		tagged, err := dst.ReadTag(t.Context(), "v1")
+		assert.NoError(err)
+		assert.Equal(rev1, tagged)
+		assertSameHistory(t, src, dst)
+		data, err := dst.ReadBlock(t.Context(), blockIdB, NewBlockBuf())
+		assert.NoError(err)
+		assert.Equal("b", string(data))
+		_, err = ReadRepositoryConfigBackup(t.Context(), dstStorage, []byte(src.Passphrase))
+		assert.NoError(err)
+
+		// Blocks of the legacy repository cannot be mixed in.
+		legacyData, err := ReadFile(src.Storage.FS, src.Storage.blockPath(blockIdB))
+		assert.NoError(err)
+		assert.NoError(dstFS.Remove(dst.Storage.blockPath(blockIdB)))
+		assert.NoError(WriteFile(dstFS, dst.Storage.blockPath(blockIdB), legacyData))
+		_, err = dst.ReadBlock(t.Context(), blockIdB, NewBlockBuf())
+		assert.Error(err, "message authentication failed")
+	})
+
+	t.Run("Only legacy repositories are upgraded", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		src := td.NewTestRepository(t, td.NewFS(t))
+		dst, err := NewFileStorage(td.NewFS(t), StoragePurposeRepository)
+		assert.NoError(err)
+		monitor := &testUpgradeMonitor{map[BlockId]bool{}}
+		_, err = UpgradeRepository(t.Context(), src.Storage, dst, []byte(src.Passphrase), 1, monitor)
+		assert.Error(err, "already at version 2")
+	})
+
+	t.Run("The target must not be a repository", func(t *testing.T) {
+		t.Parallel()
+		assert := NewAssert(t)
+		src := td.NewLegacyTestRepository(t, td.NewFS(t))
+		dst := td.NewTestRepository(t, td.NewFS(t))
+		monitor := &testUpgradeMonitor{map[BlockId]bool{}}
+		_, err := UpgradeRepository(t.Context(), src.Storage, dst.Storage, []byte(src.Passphrase), 1, monitor)
+		assert.ErrorIs(err, ErrStorageAlreadyExists)
+	})
+}
+
+type testUpgradeMonitor struct {
+	blockIds map[BlockId]bool
+}
+
+func (m *testUpgradeMonitor) OnUpgradeBlock(blockId BlockId, _ int) {
+	m.blockIds[blockId] = true
+}
@@ -0,0 +1,115 @@
+//go:build darwin || linux
+
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Read the extended attributes of `path` that can be restored (see
+// `isRestorableXattr`), sorted by name. Symlinks are not followed.
+// Attributes larger than `MaxXattrSize` are skipped.
+func readXattrs(path string) ([]*Xattr, error) {
+	names, err := listXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+	var xattrs []*Xattr
+	for _, name := range names {
+		value, err := getXattr(path, name)
+		if errors.Is(err, errNoXattr) {
+			// Removed in the meantime.
+			continue
+		}
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to read extended attribute %s of %s", name, path)
+		}
+		if len(value) > MaxXattrSize {
+			continue
+		}
+		xattrs = append(xattrs, &Xattr{name, string(value)})
+	}
+	slices.SortFunc(xattrs, func(a, b *Xattr) int { return strings.Compare(a.Name, b.Name) })
+	return xattrs, nil
+}
+
+// Replace the restorable extended attributes of `path` with `xattrs`.
+func writeXattrs(path string, xattrs []*Xattr) error {
+	names, err := listXattrs(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if slices.ContainsFunc(xattrs, func(x *Xattr) bool { return x.Name == name }) {
+			continue
+		}
+		if err := unix.Lremovexattr(path, name); err != nil && !errors.Is(err, errNoXattr) {
+			return WrapErrorf(err, "failed to remove extended attribute %s of %s", name, path)
+		}
+	}
+	for _, xattr := range xattrs {
+		if err := unix.Lsetxattr(path, xattr.Name, []byte(xattr.Value), 0); err != nil {
+			return WrapErrorf(err, "failed to set extended attribute %s of %s", xattr.Name, path)
+		}
+	}
+	return nil
+}
+
+// List the names of the restorable extended attributes of `path`. Return
+// nothing if the file system does not support extended attributes.
+func listXattrs(path string) ([]string, error) {
+	for {
+		size, err := unix.Llistxattr(path, nil)
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to list extended attributes of %s", path)
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		size, err = unix.Llistxattr(path, buf)
+		if errors.Is(err, unix.ERANGE) {
+			// More attributes were added in the meantime.
+			continue
+		}
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to list extended attributes of %s", path)
+		}
+		var names []string
+		for name := range bytes.SplitSeq(buf[:size], []byte{0}) {
+			if len(name) > 0 && isRestorableXattr(string(name)) {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+func getXattr(path string, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+		value := make([]byte, size)
+		if size == 0 {
+			return value, nil
+		}
+		size, err = unix.Lgetxattr(path, name, value)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+		return value[:size], nil
+	}
+}
@@ -0,0 +1,684 @@
+//go:build !wasm
+
+//nolint:forbidigo
+package rclone
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// Repositories on an rclone remote are given as `rclone://<remote>:<path>`,
+// e.g. `rclone://gdrive:backups/photos`.
+const URIPrefix = "rclone://"
+
+func IsStorageURI(uri string) bool {
+	return strings.HasPrefix(uri, URIPrefix)
+}
+
+// Storage is a `lib.Storage` on any rclone remote, e.g. Google Drive,
+// Dropbox, or OneDrive. Every operation runs the `rclone` command, so rclone
+// has to be installed and the remote configured with `rclone config`.
+//
+// The layout is the one of `http.S3StorageClient`: `repository.txt`,
+// `blocks/<id>`, `<section>/<name>` for the control files, and
+// `locks/<name>`.
+//
+// Those backends cannot create a file only if it does not exist yet, so a
+// lock is a lease: a lock file with an expiry that the holder renews while
+// it holds the lock. To acquire a lock, the lock file is written if it does
+// not exist or has expired and read back after `LeaseSettle`. If others
+// tried at the same time, the last write wins and everybody else backs off.
+// `CompareAndSwapControlFile` holds the `control-files` lease while it
+// compares and writes.
+type Storage struct {
+	// The remote and path as passed to rclone, e.g. `gdrive:backups/photos`.
+	Remote string
+	// The rclone executable.
+	Command string
+	// How long a lock is held without being renewed. The lock of a client
+	// that died is free again after this.
+	LeaseDuration time.Duration
+	// How long to wait after writing a lock file before reading it back. It
+	// must be longer than it takes the remote to settle concurrent writes.
+	LeaseSettle time.Duration
+
+	lockMu sync.Mutex
+	// The lock acquired by `Lock`, the control files are only written while
+	// it is still ours.
+	lease *rcloneLease
+}
+
+var _ lib.Storage = (*Storage)(nil)
+
+type rcloneLease struct {
+	Name  string
+	Owner string
+	// Set once the lease was found missing or stolen, or could not be
+	// renewed in time. All further writes fail.
+	Lost error
+	// Stop renewing the lease.
+	stop    context.CancelFunc
+	stopped chan struct{}
+}
+
+type rcloneLeaseMeta struct {
+	Owner     string    `json:"owner"`
+	Host      string    `json:"host"`
+	Pid       int       `json:"pid"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+const (
+	DefaultLeaseDuration = 2 * time.Minute
+	DefaultLeaseSettle   = 3 * time.Second
+	// The lease `CompareAndSwapControlFile` holds, named like the lock file
+	// of `lib.FileStorage`.
+	rcloneControlFilesLease = "control-files"
+)
+
+func NewStorage(uri string) (*Storage, error) {
+	remote := strings.TrimPrefix(uri, URIPrefix)
+	if remote == "" || remote == uri {
+		return nil, lib.Errorf("invalid rclone URI %q, expected `rclone://<remote>:<path>`", uri)
+	}
+	return &Storage{
+		Remote:        remote,
+		Command:       "rclone",
+		LeaseDuration: DefaultLeaseDuration,
+		LeaseSettle:   DefaultLeaseSettle,
+		lockMu:        sync.Mutex{},
+		lease:         nil,
+	}, nil
+}
+
+func (s *Storage) Init(ctx context.Context, config lib.Toml, headerComment string) error {
+	exists, err := s.exists(ctx, "repository.txt")
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to init storage")
+	}
+	if exists {
+		return lib.ErrStorageAlreadyExists
+	}
+	return s.writeConfig(ctx, config, headerComment)
+}
+
+func (s *Storage) WriteConfig(ctx context.Context, config lib.Toml, headerComment string) error {
+	exists, err := s.exists(ctx, "repository.txt")
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to write config")
+	}
+	if !exists {
+		return lib.ErrStorageNotFound
+	}
+	return s.writeConfig(ctx, config, headerComment)
+}
+
+func (s *Storage) writeConfig(ctx context.Context, config lib.Toml, headerComment string) error {
+	var buf bytes.Buffer
+	if err := lib.WriteToml(&buf, headerComment, config); err != nil {
+		return lib.WrapErrorf(err, "failed to encode config TOML")
+	}
+	if err := s.write(ctx, buf.Bytes(), "repository.txt"); err != nil {
+		return lib.WrapErrorf(err, "failed to write config")
+	}
+	return nil
+}
+
+func (s *Storage) Open(ctx context.Context) (lib.Toml, error) {
+	data, err := s.read(ctx, "repository.txt")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, lib.ErrStorageNotFound
+	}
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to open storage")
+	}
+	toml, err := lib.ReadToml(bytes.NewReader(data))
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to parse storage TOML")
+	}
+	return toml, nil
+}
+
+func (s *Storage) HasBlock(ctx context.Context, blockId lib.BlockId) (bool, error) {
+	exists, err := s.exists(ctx, "blocks", blockId.String())
+	if err != nil {
+		return false, lib.WrapErrorf(err, "failed to check block")
+	}
+	return exists, nil
+}
+
+func (s *Storage) ReadBlockIds(ctx context.Context, yield func(lib.BlockId) bool) error {
+	names, err := s.list(ctx, "blocks")
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to list blocks")
+	}
+	for _, name := range names {
+		blockId, err := lib.NewBlockIdFromString(name)
+		if err != nil {
+			return lib.WrapErrorf(err, "invalid block file %q", name)
+		}
+		if !yield(blockId) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *Storage) ReadBlock(ctx context.Context, blockId lib.BlockId, buf lib.BlockBuf) ([]byte, error) {
+	data, err := s.read(ctx, "blocks", blockId.String())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, lib.WrapErrorf(lib.ErrBlockNotFound, "block %s does not exist", blockId)
+	}
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read block")
+	}
+	if len(data) > len(buf.Bytes()) {
+		return nil, lib.Errorf("block %s is too large: %d", blockId, len(data))
+	}
+	return buf.Bytes()[:copy(buf.Bytes(), data)], nil
+}
+
+// WriteBlock does not check the lock, blocks can be written by anybody
+// because they never change.
+func (s *Storage) WriteBlock(ctx context.Context, blockId lib.BlockId, data []byte) (bool, error) {
+	if len(data) > lib.MaxBlockSize {
+		return false, lib.Errorf("block %s is too large: %d", blockId, len(data))
+	}
+	exists, err := s.HasBlock(ctx, blockId)
+	if err != nil || exists {
+		return exists, err
+	}
+	if err := s.write(ctx, data, "blocks", blockId.String()); err != nil {
+		return false, lib.WrapErrorf(err, "failed to write block")
+	}
+	return false, nil
+}
+
+func (s *Storage) ReadControlFile(
+	ctx context.Context,
+	section lib.ControlFileSection,
+	name string,
+) ([]byte, error) {
+	if err := lib.ValidateControlFileName(name); err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	data, err := s.read(ctx, string(section), name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, lib.WrapErrorf(lib.ErrControlFileNotFound, "control file %s/%s does not exist", section, name)
+	}
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read control file")
+	}
+	if len(data) > lib.MaxControlFileSize {
+		return nil, lib.Errorf("control file exceeds max size %d", lib.MaxControlFileSize)
+	}
+	return data, nil
+}
+
+func (s *Storage) WriteControlFile(
+	ctx context.Context,
+	section lib.ControlFileSection,
+	name string,
+	data []byte,
+) error {
+	if err := lib.ValidateControlFileName(name); err != nil {
+		return err //nolint:wrapcheck
+	}
+	if len(data) > lib.MaxControlFileSize {
+		return lib.Errorf("control file %s/%s is too large: %d", section, name, len(data))
+	}
+	if err := s.verifyLeaseIfHeld(ctx); err != nil {
+		return err
+	}
+	if err := s.write(ctx, data, string(section), name); err != nil {
+		return lib.WrapErrorf(err, "failed to write control file")
+	}
+	return nil
+}
+
+func (s *Storage) HasControlFile(
+	ctx context.Context,
+	section lib.ControlFileSection,
+	name string,
+) (bool, error) {
+	if err := lib.ValidateControlFileName(name); err != nil {
+		return false, err //nolint:wrapcheck
+	}
+	exists, err := s.exists(ctx, string(section), name)
+	if err != nil {
+		return false, lib.WrapErrorf(err, "failed to check control file")
+	}
+	return exists, nil
+}
+
+// CompareAndSwapControlFile compares and writes while holding the
+// `control-files` lease, see `Storage`.
+func (s *Storage) CompareAndSwapControlFile(
+	ctx context.Context,
+	section lib.ControlFileSection,
+	name string,
+	expected, data []byte,
+) error {
+	if err := lib.ValidateControlFileName(name); err != nil {
+		return err //nolint:wrapcheck
+	}
+	if len(data) > lib.MaxControlFileSize {
+		return lib.Errorf("control file %s/%s is too large: %d", section, name, len(data))
+	}
+	lease, err := s.acquireLeaseWithRetry(ctx, rcloneControlFilesLease, lib.DefaultLockRetry())
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to lock control files")
+	}
+	defer s.releaseLease(lease) //nolint:errcheck
+	current, err := s.ReadControlFile(ctx, section, name)
+	switch {
+	case errors.Is(err, lib.ErrControlFileNotFound):
+		if expected != nil {
+			return lib.WrapErrorf(lib.ErrControlFileChanged, "control file %s/%s does not exist", section, name)
+		}
+	case err != nil:
+		return err
+	case expected == nil:
+		return lib.WrapErrorf(lib.ErrControlFileChanged, "control file %s/%s already exists", section, name)
+	case !bytes.Equal(current, expected):
+		return lib.WrapErrorf(lib.ErrControlFileChanged, "control file %s/%s has unexpected content", section, name)
+	}
+	if err := s.verifyLease(ctx, lease); err != nil {
+		return err
+	}
+	return s.WriteControlFile(ctx, section, name, data)
+}
+
+func (s *Storage) DeleteControlFile(ctx context.Context, section lib.ControlFileSection, name string) error {
+	if err := lib.ValidateControlFileName(name); err != nil {
+		return err //nolint:wrapcheck
+	}
+	if err := s.verifyLeaseIfHeld(ctx); err != nil {
+		return err
+	}
+	err := s.remove(ctx, string(section), name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return lib.WrapErrorf(lib.ErrControlFileNotFound, "control file %s/%s does not exist", section, name)
+	}
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to delete control file")
+	}
+	return nil
+}
+
+func (s *Storage) ListControlFiles(ctx context.Context, section lib.ControlFileSection) ([]string, error) {
+	files, err := s.list(ctx, string(section))
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to list control files")
+	}
+	names := []string{}
+	for _, name := range files {
+		if lib.ValidateControlFileName(name) == nil {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (s *Storage) Lock(ctx context.Context, name string) (func() error, error) {
+	if err := lib.ValidateStorageLockName(name); err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	lease, err := s.acquireLease(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	s.lockMu.Lock()
+	s.lease = lease
+	s.lockMu.Unlock()
+	var released atomic.Bool
+	return func() error {
+		if !released.CompareAndSwap(false, true) {
+			return nil
+		}
+		s.lockMu.Lock()
+		if s.lease == lease {
+			s.lease = nil
+		}
+		s.lockMu.Unlock()
+		return s.releaseLease(lease)
+	}, nil
+}
+
+// ListLocks lists the leases that have not expired.
+func (s *Storage) ListLocks(ctx context.Context) ([]lib.LockInfo, error) {
+	files, err := s.list(ctx, "locks")
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to list locks")
+	}
+	slices.Sort(files)
+	locks := []lib.LockInfo{}
+	for _, name := range files {
+		if lib.ValidateStorageLockName(name) != nil && name != rcloneControlFilesLease {
+			continue
+		}
+		meta, ok, err := s.readLease(ctx, name)
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to read lock %s", name)
+		}
+		if !ok || time.Now().After(meta.ExpiresAt) {
+			continue
+		}
+		locks = append(locks, lib.LockInfo{
+			Name: name, Owner: meta.Owner, Host: meta.Host, Pid: meta.Pid, CreatedAt: meta.CreatedAt,
+		})
+	}
+	return locks, nil
+}
+
+func (s *Storage) ForceUnlock(ctx context.Context, name string) error {
+	if err := lib.ValidateStorageLockName(name); err != nil {
+		return err //nolint:wrapcheck
+	}
+	err := s.remove(ctx, "locks", name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return lib.WrapErrorf(lib.ErrLockNotFound, "lock %s does not exist", name)
+	}
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to force-release lock")
+	}
+	return nil
+}
+
+// acquireLease writes the lock file `name` unless somebody else holds it
+// and starts renewing it until `releaseLease`.
+// Return a `*lib.LockExistsError` if somebody else holds it or won the race
+// for it.
+func (s *Storage) acquireLease(ctx context.Context, name string) (*rcloneLease, error) {
+	current, ok, err := s.readLease(ctx, name)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read lock %s", name)
+	}
+	if ok && time.Now().Before(current.ExpiresAt) {
+		return nil, leaseExistsError(name, current)
+	}
+	owner, err := lib.RandStr(32)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to generate owner GUID")
+	}
+	host, _ := os.Hostname()
+	now := time.Now().UTC()
+	meta := rcloneLeaseMeta{
+		Owner: owner, Host: host, Pid: os.Getpid(), CreatedAt: now, ExpiresAt: now.Add(s.LeaseDuration),
+	}
+	if err := s.writeLease(ctx, name, meta); err != nil {
+		return nil, lib.WrapErrorf(err, "failed to acquire lock %s", name)
+	}
+	select {
+	case <-time.After(s.LeaseSettle):
+	case <-ctx.Done():
+		// Do not leave a lock file behind that others have to wait out, but
+		// only remove it if nobody else wrote it after us.
+		s.removeLeaseIfOwned(context.WithoutCancel(ctx), name, owner)
+		return nil, ctx.Err() //nolint:wrapcheck
+	}
+	current, ok, err = s.readLease(ctx, name)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read lock %s", name)
+	}
+	if !ok || current.Owner != owner {
+		// Somebody else wrote the lock file after us.
+		return nil, leaseExistsError(name, current)
+	}
+	renewCtx, stop := context.WithCancel(context.Background()) //nolint:gosec
+	lease := &rcloneLease{Name: name, Owner: owner, Lost: nil, stop: stop, stopped: make(chan struct{})}
+	go s.renewLease(renewCtx, lease, meta) //nolint:contextcheck
+	slog.Debug("Acquired lock", "name", name, "owner", owner)
+	return lease, nil
+}
+
+// Remove the lock file `name` if `owner` still holds it. This is
+// best-effort, the lock expires anyway.
+func (s *Storage) removeLeaseIfOwned(ctx context.Context, name string, owner string) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	current, ok, err := s.readLease(ctx, name)
+	if err != nil || !ok || current.Owner != owner {
+		return
+	}
+	_ = s.remove(ctx, "locks", name)
+}
+
+// acquireLeaseWithRetry is `acquireLease` that retries like
+// `lib.LockWithRetry`.
+func (s *Storage) acquireLeaseWithRetry(
+	ctx context.Context,
+	name string,
+	retry lib.LockRetry,
+) (*rcloneLease, error) {
+	backoff := retry.Backoff
+	for attempt := 1; ; attempt++ {
+		lease, err := s.acquireLease(ctx, name)
+		var lockExists *lib.LockExistsError
+		if !errors.As(err, &lockExists) || attempt >= retry.Attempts {
+			return lease, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, lib.WrapErrorf(ctx.Err(), "failed to acquire lock %s", name)
+		}
+		backoff = min(backoff*2, retry.MaxBackoff)
+	}
+}
+
+func leaseExistsError(name string, meta rcloneLeaseMeta) *lib.LockExistsError {
+	return &lib.LockExistsError{
+		Name: name, Owner: meta.Owner, Host: meta.Host, Pid: meta.Pid, CreatedAt: meta.CreatedAt,
+	}
+}
+
+// renewLease extends the lease every third of `LeaseDuration` until it is
+// stopped or lost.
+func (s *Storage) renewLease(ctx context.Context, lease *rcloneLease, meta rcloneLeaseMeta) {
+	defer close(lease.stopped)
+	ticker := time.NewTicker(s.LeaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if time.Now().After(meta.ExpiresAt) {
+			s.leaseLost(lease, "lock %s expired before it could be renewed", lease.Name)
+			return
+		}
+		if err := s.verifyLease(ctx, lease); err != nil {
+			return
+		}
+		renewed := meta
+		renewed.ExpiresAt = time.Now().UTC().Add(s.LeaseDuration)
+		if err := s.writeLease(ctx, lease.Name, renewed); err != nil {
+			// Try again with the next tick, the lease is lost once it
+			// expired.
+			slog.Warn("Failed to renew lock", "name", lease.Name, "error", err)
+			continue
+		}
+		meta = renewed
+	}
+}
+
+func (s *Storage) releaseLease(lease *rcloneLease) error {
+	lease.stop()
+	<-lease.stopped
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	current, ok, err := s.readLease(ctx, lease.Name)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to release lock %s", lease.Name)
+	}
+	if !ok || current.Owner != lease.Owner {
+		// Taken over after it expired, it is not ours to remove anymore.
+		return nil
+	}
+	if err := s.remove(ctx, "locks", lease.Name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return lib.WrapErrorf(err, "failed to release lock %s", lease.Name)
+	}
+	slog.Debug("Released lock", "name", lease.Name, "owner", lease.Owner)
+	return nil
+}
+
+// verifyLeaseIfHeld makes sure that the lease acquired by `Lock` is still
+// ours before a control file is written.
+// Return `lib.ErrLockLost` if it was released or taken over by someone else.
+func (s *Storage) verifyLeaseIfHeld(ctx context.Context) error {
+	s.lockMu.Lock()
+	lease := s.lease
+	s.lockMu.Unlock()
+	if lease == nil {
+		return nil
+	}
+	return s.verifyLease(ctx, lease)
+}
+
+func (s *Storage) verifyLease(ctx context.Context, lease *rcloneLease) error {
+	s.lockMu.Lock()
+	lost := lease.Lost
+	s.lockMu.Unlock()
+	if lost != nil {
+		return lost
+	}
+	current, ok, err := s.readLease(ctx, lease.Name)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to verify lock %s", lease.Name)
+	}
+	if !ok {
+		return s.leaseLost(lease, "lock %s no longer exists (force-unlocked?)", lease.Name)
+	}
+	if current.Owner != lease.Owner {
+		return s.leaseLost(lease, "lock %s was stolen (owner %s != %s)", lease.Name, current.Owner, lease.Owner)
+	}
+	return nil
+}
+
+func (s *Storage) leaseLost(lease *rcloneLease, format string, args ...any) error {
+	err := lib.WrapErrorf(lib.ErrLockLost, format, args...)
+	slog.Warn("Lost lock", "name", lease.Name, "error", err)
+	s.lockMu.Lock()
+	lease.Lost = err
+	s.lockMu.Unlock()
+	return err
+}
+
+// Return false if the lock file does not exist.
+func (s *Storage) readLease(ctx context.Context, name string) (rcloneLeaseMeta, bool, error) {
+	data, err := s.read(ctx, "locks", name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return rcloneLeaseMeta{}, false, nil
+	}
+	if err != nil {
+		return rcloneLeaseMeta{}, false, err
+	}
+	var meta rcloneLeaseMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return rcloneLeaseMeta{}, false, lib.WrapErrorf(err, "failed to parse lock meta")
+	}
+	return meta, true, nil
+}
+
+func (s *Storage) writeLease(ctx context.Context, name string, meta rcloneLeaseMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to marshal lock meta")
+	}
+	return s.write(ctx, data, "locks", name)
+}
+
+// Return the rclone path of a file of the repository.
+func (s *Storage) path(parts ...string) string {
+	file := path.Join(parts...)
+	if strings.HasSuffix(s.Remote, ":") || strings.HasSuffix(s.Remote, "/") {
+		return s.Remote + file
+	}
+	return s.Remote + "/" + file
+}
+
+func (s *Storage) read(ctx context.Context, parts ...string) ([]byte, error) {
+	return s.run(ctx, nil, "cat", s.path(parts...))
+}
+
+func (s *Storage) write(ctx context.Context, data []byte, parts ...string) error {
+	_, err := s.run(ctx, data, "rcat", s.path(parts...))
+	return err
+}
+
+func (s *Storage) remove(ctx context.Context, parts ...string) error {
+	_, err := s.run(ctx, nil, "deletefile", s.path(parts...))
+	return err
+}
+
+func (s *Storage) exists(ctx context.Context, parts ...string) (bool, error) {
+	out, err := s.run(ctx, nil, "lsf", "--files-only", s.path(parts...))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(out)) == parts[len(parts)-1], nil
+}
+
+// Return the names of the files in the directory, nothing if it does not
+// exist.
+func (s *Storage) list(ctx context.Context, parts ...string) ([]string, error) {
+	out, err := s.run(ctx, nil, "lsf", "--files-only", s.path(parts...)+"/")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// run runs rclone and returns what it wrote to stdout.
+// Return `fs.ErrNotExist` if the file or directory does not exist.
+func (s *Storage) run(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, s.Command, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	t0 := time.Now()
+	err := cmd.Run()
+	slog.Debug("rclone", "args", args, "duration", time.Since(t0), "error", err)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// rclone exits with 3 if a directory and with 4 if a file was not
+		// found, see https://rclone.org/docs/#exit-code.
+		if code := exitErr.ExitCode(); code == 3 || code == 4 {
+			return nil, lib.WrapErrorf(fs.ErrNotExist, "%s does not exist", args[len(args)-1])
+		}
+	}
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > 200 {
+			msg = msg[:200] + "..."
+		}
+		return nil, lib.WrapErrorf(err, "rclone %s failed: %s", args[0], msg)
+	}
+	return stdout.Bytes(), nil
+}
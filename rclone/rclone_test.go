@@ -0,0 +1,312 @@
+//go:build !wasm
+
+package rclone
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// A stand-in for the `rclone` commands `Storage` uses that works on
+// local paths, with rclone's exit codes for missing files.
+const fakeRclone = `#!/bin/sh
+cmd=$1
+shift
+case $cmd in
+cat)
+	[ -f "$1" ] || exit 3
+	exec cat "$1"
+	;;
+rcat)
+	dir=$(dirname "$1")
+	mkdir -p "$dir" && cat > "$dir/.rcat$$" && mv "$dir/.rcat$$" "$1"
+	;;
+deletefile)
+	[ -f "$1" ] || exit 4
+	rm "$1"
+	;;
+lsf)
+	[ "$1" = --files-only ] || exit 1
+	p=${2%/}
+	if [ -d "$p" ]; then
+		ls -1 "$p"
+	elif [ -f "$p" ]; then
+		basename "$p"
+	else
+		exit 3
+	fi
+	;;
+*)
+	echo "unknown command: $cmd" >&2
+	exit 1
+	;;
+esac
+`
+
+func newTestStorage(t *testing.T, remote string) *Storage {
+	t.Helper()
+	assert := lib.NewAssert(t)
+	command := filepath.Join(t.TempDir(), "rclone")
+	assert.NoError(os.WriteFile(command, []byte(fakeRclone), 0o700)) //nolint:forbidigo
+	s, err := NewStorage(URIPrefix + remote)
+	assert.NoError(err)
+	s.Command = command
+	s.LeaseDuration = time.Second
+	s.LeaseSettle = 10 * time.Millisecond
+	return s
+}
+
+func TestStorage(t *testing.T) {
+	t.Parallel()
+
+	t.Run("NewStorage", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		s, err := NewStorage("rclone://gdrive:")
+		assert.NoError(err)
+		assert.Equal("gdrive:", s.Remote)
+		assert.Equal("gdrive:blocks/x", s.path("blocks", "x"))
+		s, err = NewStorage("rclone://gdrive:backups/repo")
+		assert.NoError(err)
+		assert.Equal("gdrive:backups/repo/locks/head", s.path("locks", "head"))
+		_, err = NewStorage("rclone://")
+		assert.Error(err, "invalid rclone URI")
+	})
+
+	t.Run("Init, Open, and WriteConfig", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		s := newTestStorage(t, t.TempDir())
+		_, err := s.Open(t.Context())
+		assert.ErrorIs(err, lib.ErrStorageNotFound)
+		assert.ErrorIs(s.WriteConfig(t.Context(), lib.Toml{}, ""), lib.ErrStorageNotFound)
+		toml := lib.Toml{"some": {"key": "value"}}
+		assert.NoError(s.Init(t.Context(), toml, "header"))
+		assert.ErrorIs(s.Init(t.Context(), toml, "header"), lib.ErrStorageAlreadyExists)
+		got, err := s.Open(t.Context())
+		assert.NoError(err)
+		assert.Equal(toml, got)
+		toml = lib.Toml{"x": {"y": "z"}}
+		assert.NoError(s.WriteConfig(t.Context(), toml, "header"))
+		got, err = s.Open(t.Context())
+		assert.NoError(err)
+		assert.Equal(toml, got)
+	})
+
+	t.Run("Blocks", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		s := newTestStorage(t, t.TempDir())
+		blockId := lib.BlockId{1}
+		buf := lib.NewBlockBuf()
+		_, err := s.ReadBlock(t.Context(), blockId, buf)
+		assert.ErrorIs(err, lib.ErrBlockNotFound)
+		exists, err := s.WriteBlock(t.Context(), blockId, []byte("data"))
+		assert.NoError(err)
+		assert.Equal(false, exists)
+		exists, err = s.WriteBlock(t.Context(), blockId, []byte("data"))
+		assert.NoError(err)
+		assert.Equal(true, exists)
+		exists, err = s.HasBlock(t.Context(), lib.BlockId{2})
+		assert.NoError(err)
+		assert.Equal(false, exists)
+		data, err := s.ReadBlock(t.Context(), blockId, buf)
+		assert.NoError(err)
+		assert.Equal([]byte("data"), data)
+		_, err = s.WriteBlock(t.Context(), lib.BlockId{2}, []byte("more"))
+		assert.NoError(err)
+		var blockIds []lib.BlockId
+		assert.NoError(s.ReadBlockIds(t.Context(), func(blockId lib.BlockId) bool {
+			blockIds = append(blockIds, blockId)
+			return true
+		}))
+		assert.Equal([]lib.BlockId{{1}, {2}}, blockIds)
+	})
+
+	t.Run("Control files", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		s := newTestStorage(t, t.TempDir())
+		section := lib.ControlFileSectionRefs
+		names, err := s.ListControlFiles(t.Context(), section)
+		assert.NoError(err)
+		assert.Equal([]string{}, names)
+		_, err = s.ReadControlFile(t.Context(), section, "head")
+		assert.ErrorIs(err, lib.ErrControlFileNotFound)
+		assert.NoError(s.WriteControlFile(t.Context(), section, "head", []byte("1")))
+		assert.NoError(s.WriteControlFile(t.Context(), section, "tag-a", []byte("2")))
+		data, err := s.ReadControlFile(t.Context(), section, "head")
+		assert.NoError(err)
+		assert.Equal([]byte("1"), data)
+		exists, err := s.HasControlFile(t.Context(), section, "tag-a")
+		assert.NoError(err)
+		assert.Equal(true, exists)
+		names, err = s.ListControlFiles(t.Context(), section)
+		assert.NoError(err)
+		assert.Equal([]string{"head", "tag-a"}, names)
+		assert.NoError(s.DeleteControlFile(t.Context(), section, "tag-a"))
+		assert.ErrorIs(s.DeleteControlFile(t.Context(), section, "tag-a"), lib.ErrControlFileNotFound)
+
+		// Compare and swap.
+		assert.NoError(s.CompareAndSwapControlFile(t.Context(), section, "tag-b", nil, []byte("1")))
+		err = s.CompareAndSwapControlFile(t.Context(), section, "tag-b", nil, []byte("2"))
+		assert.ErrorIs(err, lib.ErrControlFileChanged)
+		assert.NoError(s.CompareAndSwapControlFile(t.Context(), section, "tag-b", []byte("1"), []byte("2")))
+		err = s.CompareAndSwapControlFile(t.Context(), section, "tag-b", []byte("1"), []byte("3"))
+		assert.ErrorIs(err, lib.ErrControlFileChanged)
+		data, err = s.ReadControlFile(t.Context(), section, "tag-b")
+		assert.NoError(err)
+		assert.Equal([]byte("2"), data)
+		// The lease of compare and swap is released.
+		locks, err := s.ListLocks(t.Context())
+		assert.NoError(err)
+		assert.Equal(0, len(locks))
+	})
+
+	t.Run("Lock is held until it is released", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		remote := t.TempDir()
+		s1 := newTestStorage(t, remote)
+		s2 := newTestStorage(t, remote)
+		s1.LeaseDuration = 300 * time.Millisecond
+		unlock1, err := s1.Lock(t.Context(), "head")
+		assert.NoError(err)
+		// The lease is renewed, so it outlives its duration.
+		time.Sleep(time.Second)
+		_, err = s2.Lock(t.Context(), "head")
+		var existsErr *lib.LockExistsError
+		assert.Equal(true, errors.As(err, &existsErr))
+		assert.Equal("head", existsErr.Name)
+		locks, err := s2.ListLocks(t.Context())
+		assert.NoError(err)
+		assert.Equal(1, len(locks))
+		assert.Equal("head", locks[0].Name)
+		assert.Equal(os.Getpid(), locks[0].Pid) //nolint:forbidigo
+		assert.NoError(s1.WriteControlFile(t.Context(), lib.ControlFileSectionRefs, "head", []byte("x")))
+
+		assert.NoError(unlock1())
+		assert.NoError(unlock1())
+		unlock2, err := s2.Lock(t.Context(), "head")
+		assert.NoError(err)
+		assert.NoError(unlock2())
+		locks, err = s2.ListLocks(t.Context())
+		assert.NoError(err)
+		assert.Equal(0, len(locks))
+	})
+
+	t.Run("An expired lease is taken over", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		remote := t.TempDir()
+		s := newTestStorage(t, remote)
+		// A client that died an hour ago.
+		created := time.Now().Add(-time.Hour)
+		data, err := json.Marshal(rcloneLeaseMeta{"dead", "host", 1, created, created.Add(time.Minute)})
+		assert.NoError(err)
+		assert.NoError(s.write(t.Context(), data, "locks", "head"))
+		locks, err := s.ListLocks(t.Context())
+		assert.NoError(err)
+		assert.Equal(0, len(locks))
+		unlock, err := s.Lock(t.Context(), "head")
+		assert.NoError(err)
+		assert.NoError(unlock())
+	})
+
+	t.Run("A canceled lock only removes its own lock file", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		for _, overwritten := range []bool{false, true} {
+			s := newTestStorage(t, t.TempDir())
+			s.LeaseSettle = time.Minute
+			ctx, cancel := context.WithCancel(t.Context())
+			go func() {
+				defer cancel()
+				for {
+					if exists, err := s.exists(t.Context(), "locks", "head"); err != nil || exists {
+						break
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				if overwritten {
+					// Somebody else wrote the lock file after us.
+					now := time.Now()
+					data, err := json.Marshal(rcloneLeaseMeta{"other", "host", 1, now, now.Add(time.Minute)})
+					assert.NoError(err)
+					assert.NoError(s.write(t.Context(), data, "locks", "head"))
+				}
+			}()
+			_, err := s.Lock(ctx, "head")
+			assert.ErrorIs(err, context.Canceled)
+			meta, ok, err := s.readLease(t.Context(), "head")
+			assert.NoError(err)
+			assert.Equal(overwritten, ok)
+			if overwritten {
+				assert.Equal("other", meta.Owner)
+			}
+		}
+	})
+
+	t.Run("Writes fail once the lease is lost", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		remote := t.TempDir()
+		s1 := newTestStorage(t, remote)
+		s2 := newTestStorage(t, remote)
+		section := lib.ControlFileSectionRefs
+
+		unlock1, err := s1.Lock(t.Context(), "head")
+		assert.NoError(err)
+		assert.NoError(s2.ForceUnlock(t.Context(), "head"))
+		assert.ErrorIs(s2.ForceUnlock(t.Context(), "head"), lib.ErrLockNotFound)
+		err = s1.WriteControlFile(t.Context(), section, "head", []byte("x"))
+		assert.ErrorIs(err, lib.ErrLockLost)
+		assert.Error(err, "no longer exists")
+		// The loss sticks even if the lock is re-created.
+		unlock2, err := s2.Lock(t.Context(), "head")
+		assert.NoError(err)
+		err = s1.DeleteControlFile(t.Context(), section, "head")
+		assert.ErrorIs(err, lib.ErrLockLost)
+		// Releasing a lost lease leaves the new one alone.
+		assert.NoError(unlock1())
+		locks, err := s2.ListLocks(t.Context())
+		assert.NoError(err)
+		assert.Equal(1, len(locks))
+		assert.NoError(unlock2())
+	})
+
+	t.Run("Writes fail once the lease is stolen", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		remote := t.TempDir()
+		s1 := newTestStorage(t, remote)
+		s2 := newTestStorage(t, remote)
+		_, err := s1.Lock(t.Context(), "head")
+		assert.NoError(err)
+		assert.NoError(s2.ForceUnlock(t.Context(), "head"))
+		_, err = s2.Lock(t.Context(), "head")
+		assert.NoError(err)
+		err = s1.WriteControlFile(t.Context(), lib.ControlFileSectionRefs, "head", []byte("x"))
+		assert.ErrorIs(err, lib.ErrLockLost)
+		assert.Error(err, "stolen")
+	})
+
+	t.Run("A repository can be hosted", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		s := newTestStorage(t, t.TempDir())
+		repository, err := lib.InitNewRepository(t.Context(), s, []byte("passphrase"))
+		assert.NoError(err)
+		assert.NoError(repository.Close())
+		repository, err = lib.OpenRepository(t.Context(), s, []byte("passphrase"))
+		assert.NoError(err)
+		assert.NoError(repository.Close())
+	})
+}
@@ -3,6 +3,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net"
 	"os"
@@ -72,7 +73,8 @@ func TestHappyPath(t *testing.T) {
 			1 added, 2 updated, 1 deleted
 		`), sut.ClingSync("status", "--chtime"), "There should be local changes")
 
-		sut.ClingSync("merge", "--no-progress", "--chtime", "--message", "second commit")
+		// `-m` can be repeated, every message is a paragraph.
+		sut.ClingSync("merge", "--no-progress", "--chtime", "-m", "second commit", "-m", "Remove a.txt.")
 
 		log := sut.ClingSync("log", "--short")
 		assert.Equal(2, td.Wc("-l", log), "Two revisions should have been created")
@@ -156,6 +158,39 @@ func TestHappyPath(t *testing.T) {
 		assert.Equal(2, td.Wc("-l", sut.ClingSync("log", "--short", "--pattern", "a.txt")),
 			"Both revisions touched a.txt")
 
+		// `--json` prints one object per revision.
+		logLines := strings.Split(sut.ClingSync("log", "--json", "--status"), "\n")
+		assert.Equal(2, len(logLines), "There should be one line per revision")
+		var log struct {
+			Revision string
+			Message  string
+			Files    []struct{ Kind, Path string }
+			Stats    struct {
+				FilesDeleted int `json:"files_deleted"`
+			}
+		}
+		assert.NoError(json.Unmarshal([]byte(logLines[0]), &log))
+		assert.Equal(rev2Id, log.Revision)
+		assert.Equal("second commit\n\nRemove a.txt.", log.Message)
+		assert.Equal(4, len(log.Files))
+		assert.Equal("delete", log.Files[0].Kind)
+		assert.Equal("a.txt", log.Files[0].Path)
+		assert.Equal(1, log.Stats.FilesDeleted)
+
+		// The short format shows only the first line of the message, the long
+		// format all of it.
+		assert.Contains(
+			sut.ClingSync("log", "--revision", rev2Id),
+			"\n    second commit\n    \n    Remove a.txt.",
+		)
+
+		// The long format shows the statistics of the commit.
+		assert.Contains(
+			sut.ClingSync("log", "--revision", rev1Id),
+			"\nStats:    3 added, 0 updated, 0 deleted, 3B raw, ",
+			"The first revision added three files",
+		)
+
 		// An unknown revision id in a range is rejected by the CLI.
 		assert.Contains(
 			sut.ClingSyncError("log", "--short", "--revision", rev1Id+".."+strings.Repeat("0", 63)+"1"),
@@ -164,6 +199,44 @@ func TestHappyPath(t *testing.T) {
 		)
 	}
 
+	t.Log("Find all versions of a path (find)")
+	{
+		found := sut.ClingSync("find", "a.txt")
+		assert.Contains(found, "\n    first:   "+rev1Date+" "+rev1Id, "a.txt was added in the first revision")
+		assert.Contains(found, "\n    deleted: "+rev2Date+" "+rev2Id, "a.txt was deleted in the second revision")
+		assert.Equal(3, td.Wc("-l", sut.ClingSync("find", "--regexp", `^dir1/`)),
+			"Changing the mtime of dir1/d.txt does not start a new version")
+		assert.Equal("No matches", sut.ClingSync("find", "--until", "2000-01-01", "*.txt"))
+		assert.Contains(sut.ClingSyncError("find", "--since", "yesterday", "a.txt"), "invalid date")
+	}
+
+	t.Log("Show the size of the directories and files (du)")
+	{
+		usage := sut.ClingSync("du")
+		assert.Contains(strings.Split(usage, "\n")[1], "3        3  .", "Three files with three blocks in total")
+		assert.Contains(usage, "\nLargest directories:\n")
+		assert.Contains(usage, "1        1  dir1\n")
+		assert.Contains(sut.ClingSync("du", "--top", "1", "--revision", rev1Id, "dir1/"), "1  dir1/d.txt")
+		assert.Contains(sut.ClingSyncError("du", "a.txt", "b.txt"), "too many positional arguments")
+	}
+
+	t.Log("Set the identity of the workspace (identity, log)")
+	{
+		// A client id is generated for every workspace and recorded in the
+		// revisions.
+		identity := sut.ClingSync("identity")
+		clientId := strings.TrimPrefix(identity[strings.Index(identity, "Client id: "):], "Client id: ")
+		assert.Equal(16, len(clientId), "A client id should have been generated")
+		assert.Contains(sut.ClingSync("log", "--revision", "HEAD"), "\nClient:   "+clientId+"\n")
+
+		assert.Equal(td.Dedent(`
+			Name:      Alice
+			Email:     alice@example.com
+			Client id: laptop
+		`), sut.ClingSync("identity", "--name", "Alice", "--email", "alice@example.com", "--client-id", "laptop"))
+		assert.Contains(sut.ClingSyncError("identity", "--client-id", "my laptop"), "must not contain spaces")
+	}
+
 	t.Log("Copy a file from an older revision (cp, status)")
 	{
 		assert.Equal("bb", sut.Cat("b.txt"), "`b.txt` should contain the current content")
@@ -182,9 +255,23 @@ func TestHappyPath(t *testing.T) {
 			sut.ClingSync("status", "--no-progress", "--no-summary"),
 			"`b.txt` should be marked as modified",
 		)
+		var status struct {
+			Kind     string
+			Path     string
+			FileHash string `json:"file_hash"`
+		}
+		assert.NoError(json.Unmarshal([]byte(sut.ClingSync("status", "--json")), &status))
+		assert.Equal("update", status.Kind)
+		assert.Equal("b.txt", status.Path)
+		assert.Equal(fmt.Sprintf("%x", td.SHA256("b")), status.FileHash)
 
 		// Merge the change, so the workspace is up to date.
 		sut.ClingSync("merge", "--no-progress", "--message", "revert b.txt")
+		// The identity of the workspace is the default author.
+		assert.Contains(
+			sut.ClingSync("log", "--revision", "HEAD"),
+			"\nAuthor:   Alice <alice@example.com>\nClient:   laptop\n",
+		)
 	}
 
 	t.Log("Print file contents (cat)")
@@ -289,6 +376,61 @@ func TestHappyPath(t *testing.T) {
 		assert.Contains(check, "5 revisions")
 	}
 
+	t.Log("Verify all blocks (scrub)")
+	{
+		scrub := sut.ClingSync("scrub", "--no-progress", "--percent", "100")
+		assert.Contains(scrub, "0 corrupt")
+	}
+
+	t.Log("Mirror the repository (replicate)")
+	{
+		replicate := sut.ClingSync("replicate", "--no-progress", "../repository", "../repository_mirror")
+		assert.Contains(replicate, "Copied")
+		mirrorLog := sut.ClingSyncStdin(passphrase, "--passphrase-from-stdin",
+			"log", "--short", "--repository", "../repository_mirror")
+		assert.Equal(sut.ClingSync("log", "--short"), mirrorLog, "the mirror should have the same history")
+		replicate = sut.ClingSync("replicate", "--no-progress", "../repository", "../repository_mirror")
+		assert.Contains(replicate, "Copied 0 blocks")
+	}
+
+	t.Log("Mirror only the latest revision (replicate --latest-only)")
+	{
+		sut.ClingSyncStdin(passphrase, "--passphrase-from-stdin",
+			"replicate", "--no-progress", "--latest-only", "../repository", "../repository_shallow")
+		shallowLog := sut.ClingSyncStdin(passphrase, "--passphrase-from-stdin",
+			"log", "--short", "--repository", "../repository_shallow")
+		assert.Equal(1, td.Wc("-l", shallowLog), "the shallow mirror should have one revision")
+		shallowLs := sut.ClingSyncStdin(passphrase, "--passphrase-from-stdin",
+			"ls", "--short-file-mode", "--timestamp-format", "unix-fraction", "--repository", "../repository_shallow")
+		assert.Equal(sut.ClingSync("ls", "--short-file-mode", "--timestamp-format", "unix-fraction"), shallowLs,
+			"the shallow mirror should have the same files")
+	}
+
+	t.Log("Move the blocks into pack files (pack)")
+	{
+		before := sut.ClingSync("ls", "--short-file-mode", "--timestamp-format", "unix-fraction")
+		pack := sut.ClingSync("pack", "--no-progress")
+		assert.Contains(pack, "into 1 packs")
+		assert.Equal(before, sut.ClingSync("ls", "--short-file-mode", "--timestamp-format", "unix-fraction"))
+		scrub := sut.ClingSync("scrub", "--no-progress", "--percent", "100")
+		assert.Contains(scrub, "0 corrupt")
+		pack = sut.ClingSync("pack", "--no-progress")
+		assert.Contains(pack, "Packed 0 blocks")
+	}
+
+	t.Log("Limit and clear the block cache (cache)")
+	{
+		assert.Contains(sut.ClingSync("cache", "limit", "1MiB"), "Limited the block cache to 1.0M")
+		sut.ClingSync("prefetch", "**")
+		info := sut.ClingSync("cache", "info")
+		assert.Contains(info, "limit: 1.0M")
+		assert.Equal(false, strings.HasPrefix(info, "0 blocks"))
+		assert.Contains(sut.ClingSync("cache", "clear"), "Cleared the block cache")
+		assert.Contains(sut.ClingSync("cache", "info"), "0 blocks (0B)")
+		assert.Contains(sut.ClingSync("cache", "limit", "none"), "Removed the block cache limit")
+		assert.Contains(sut.ClingSync("cache", "info"), "limit: none")
+	}
+
 	t.Log("Attach to a non-empty directory (attach --allow-non-empty)")
 	{
 		nonEmptyDir := sut.Path("../workspace_nonempty")
@@ -465,6 +607,274 @@ func TestSyncRepoHappyPath(t *testing.T) {
 	assertSameRepositoryFS(t, sut.Path("../repository"), sut.Path("../sync-target-2"))
 }
 
+func TestRemotesHappyPath(t *testing.T) {
+	t.Parallel()
+	sut := NewSut(t)
+	assert := sut.assert
+
+	sut.Write("a.txt", "a")
+	sut.ClingSync("merge", "--no-progress")
+	sut.ClingSync("sync-repo", "init", "offsite", "../offsite")
+
+	t.Log("The remote needs the revision the workspace was last merged with")
+	stderr := sut.ClingSyncError("merge", "--no-progress", "--remote", "offsite")
+	assert.Contains(stderr, "replicate <remote> offsite")
+	sut.ClingSync("replicate", "--no-progress", "origin", "offsite")
+
+	t.Log("Merge with the remote only")
+	sut.Write("b.txt", "b")
+	sut.ClingSync("merge", "--no-progress", "--remote", "offsite")
+	stderr = sut.ClingSyncError("merge", "--no-progress")
+	assert.Contains(stderr, `remote "origin" does not have the revision`)
+
+	t.Log("Bring origin up to date with the remote")
+	sut.ClingSync("replicate", "--no-progress", "offsite", "origin")
+	assert.Contains(sut.ClingSync("merge", "--no-progress"), "No changes")
+	offsiteStorage, err := lib.NewFileStorage(lib.NewRealFS(sut.Path("../offsite")), lib.StoragePurposeRepository)
+	assert.NoError(err)
+	offsite, err := lib.OpenRepository(t.Context(), offsiteStorage, []byte(passphrase))
+	assert.NoError(err)
+	defer offsite.Close() //nolint:errcheck
+	assert.Equal(headFromRepository(t, offsite), sut.RepositoryHead())
+
+	assert.Contains(sut.ClingSyncError("merge", "--remote", "ghost"), `no remote named "ghost"`)
+	assert.Contains(sut.ClingSyncError("sync-repo", "init", "origin", "../other"), "reserved")
+}
+
+func TestFleetStatusHappyPath(t *testing.T) {
+	t.Parallel()
+	sut := NewSut(t)
+	assert := sut.assert
+
+	t.Log("Behind: the first workspace misses the merge of the second")
+	sut.Write("a.txt", "a")
+	sut.ClingSync("merge", "--no-progress")
+	attach := func(dir string) {
+		t.Helper()
+		sut.ClingSyncStdin(passphrase, "--passphrase-from-stdin", "attach", "../repository", dir)
+		sut.Chdir(dir)
+		sut.ClingSyncStdin(passphrase, "--passphrase-from-stdin", "security", "save-passphrase")
+		sut.ClingSync("merge", "--no-progress")
+	}
+	attach("../clean")
+	sut.Write("b.txt", "b")
+	sut.ClingSync("merge", "--no-progress")
+
+	t.Log("Dirty: the third workspace is up to date but has local changes")
+	attach("../dirty")
+	sut.Write("c.txt", "c")
+	sut.Write("a.txt", "aa")
+
+	config := fmt.Sprintf("[workspaces]\nbehind = %q\nclean = %q\ndirty = %q\nunreachable = %q\n",
+		sut.Path("../workspace"), sut.Path("../clean"), sut.Path("../dirty"), sut.Path("../missing"))
+	assert.NoError(os.WriteFile(sut.Path("../fleet.toml"), []byte(config), 0o600))
+
+	cmd := sut.cmd("fleet", "status", "--config", "../fleet.toml")
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	assert.Error(cmd.Run(), "", "a workspace that cannot be reached fails the command")
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	assert.Equal(5, len(lines), stdout.String())
+	assert.Equal([]string{"NAME", "BEHIND", "CHANGES", "LAST", "SYNC", "PATH"}, strings.Fields(lines[0]))
+	row := func(line string) []string {
+		t.Helper()
+		fields := strings.Fields(line)
+		// Drop the date and time of the last sync.
+		return append(fields[:3:3], fields[len(fields)-1])
+	}
+	assert.Equal([]string{"behind", "1", "0", sut.Path("../workspace")}, row(lines[1]))
+	assert.Equal([]string{"clean", "0", "0", sut.Path("../clean")}, row(lines[2]))
+	assert.Equal([]string{"dirty", "0", "2", sut.Path("../dirty")}, row(lines[3]))
+	assert.Equal([]string{"unreachable", "-", "-", "error", sut.Path("../missing")}, strings.Fields(lines[4]))
+	assert.Contains(stderr.String(), "unreachable: ")
+	assert.Contains(stderr.String(), "failed to open workspace")
+	assert.Contains(stderr.String(), "failed to get the status of 1 workspace(s)")
+}
+
+func TestIncludeExcludeHappyPath(t *testing.T) {
+	t.Parallel()
+	sut := NewSut(t)
+	assert := sut.assert
+
+	sut.Write("a.txt", "a")
+	sut.Write("logs/x.log", "x")
+	sut.Write("logs/keep.log", "keep")
+	status := sut.ClingSync("status", "--no-progress", "--exclude", "logs/*", "--include", "logs/keep.log")
+	assert.Contains(status, "logs/keep.log")
+	assert.Equal(false, strings.Contains(status, "logs/x.log"))
+
+	t.Log("Excluded local changes are not committed")
+	sut.ClingSync("merge", "--no-progress", "--exclude", "logs/x.log")
+	ls := sut.ClingSync("ls", "--short")
+	assert.Contains(ls, "keep.log")
+	assert.Equal(false, strings.Contains(ls, "x.log"))
+	assert.Contains(sut.ClingSync("status", "--no-progress"), "logs/x.log")
+	ls = sut.ClingSync("ls", "--short", "--exclude", "*.log", "--include", "keep.log")
+	assert.Contains(ls, "keep.log")
+	assert.Contains(ls, "a.txt")
+	sut.ClingSync("cp", "--no-progress", "--exclude", "logs", "**", "../target")
+	got, err := os.ReadFile(sut.Path("../target/a.txt"))
+	assert.NoError(err)
+	assert.Equal("a", string(got))
+	_, err = os.Stat(sut.Path("../target/logs/keep.log"))
+	assert.ErrorIs(err, os.ErrNotExist)
+
+	t.Log("Excluded paths are not reset")
+	sut.Write("a.txt", "changed")
+	// `logs/x.log` is still a local change.
+	assert.Contains(sut.ClingSyncError("reset", "--no-progress", "--exclude", "a.txt", "HEAD"), "local changes")
+	sut.ClingSync("reset", "--no-progress", "--exclude", "a.txt", "--exclude", "logs", "HEAD")
+	got, err = os.ReadFile(sut.Path("a.txt"))
+	assert.NoError(err)
+	assert.Equal("changed", string(got))
+	assert.Contains(sut.ClingSyncError("merge", "--accept-local", "--exclude", "a.txt"), "--accept-local")
+}
+
+func TestWorkspaceConfigHappyPath(t *testing.T) {
+	t.Parallel()
+	sut := NewSut(t)
+	assert := sut.assert
+
+	sut.Write(".cling/config.toml", `
+[defaults]
+no-progress = "true"
+
+[merge]
+author = "config author"
+message = "Synced on {date}"
+exclude = "*.tmp, logs/*"
+`)
+	sut.Write("a.txt", "a")
+	sut.Write("a.tmp", "tmp")
+	sut.Write("logs/x.log", "x")
+	sut.ClingSync("merge")
+	log := sut.ClingSync("log")
+	assert.Contains(log, "config author")
+	assert.Contains(log, "Synced on "+time.Now().Format(time.DateOnly))
+	ls := sut.ClingSync("ls")
+	assert.Contains(ls, "a.txt")
+	assert.Equal(false, strings.Contains(ls, "a.tmp"))
+
+	t.Log("The command line takes precedence")
+	sut.ClingSync("merge", "--message", "explicit", "--include", "logs/x.log")
+	assert.Contains(sut.ClingSync("log"), "explicit")
+	assert.Contains(sut.ClingSync("ls"), "logs/x.log")
+
+	sut.Write(".cling/config.toml", "[merge]\nauthr = \"typo\"\n")
+	assert.Contains(sut.ClingSyncError("merge"), `unknown flag "authr" in section [merge] of .cling/config.toml`)
+}
+
+func TestUserConfigHappyPath(t *testing.T) {
+	t.Parallel()
+	sut := NewSut(t)
+	assert := sut.assert
+	writeUserConfig := func(content string) {
+		t.Helper()
+		path := filepath.Join(sut.configHome, "cling-sync", "config.toml")
+		assert.NoError(os.MkdirAll(filepath.Dir(path), 0o700))
+		assert.NoError(os.WriteFile(path, []byte(content), 0o600))
+	}
+
+	assert.Contains(sut.ClingSync("repos"), "No repository aliases configured")
+	writeUserConfig(`
+[repositories]
+backup = "` + sut.Path("../repository") + `"
+
+[merge]
+author = "user author"
+message = "user message"
+`)
+	assert.Contains(sut.ClingSync("repos"), "backup  "+sut.Path("../repository"))
+
+	t.Log("The workspace config takes precedence over the user config")
+	sut.Write(".cling/config.toml", "[merge]\nmessage = \"workspace message\"\n")
+	sut.Write("a.txt", "a")
+	sut.ClingSync("merge")
+	log := sut.ClingSync("log")
+	assert.Contains(log, "user author")
+	assert.Contains(log, "workspace message")
+	assert.Contains(sut.ClingSyncStdin(passphrase, "--passphrase-from-stdin", "ls", "--repository", "backup"), "a.txt")
+
+	t.Log("An alias can be attached to")
+	sut.ClingSyncStdin(passphrase, "--passphrase-from-stdin", "attach", "backup", "../other")
+	sut.Chdir("../other")
+	sut.ClingSyncStdin(passphrase, "--passphrase-from-stdin", "merge")
+	content, err := os.ReadFile(sut.Path("a.txt"))
+	assert.NoError(err)
+	assert.Equal("a", string(content))
+
+	writeUserConfig("[keychain]\nbackend = \"no-such-backend\"\n")
+	assert.Contains(sut.ClingSyncError("repos"), `unknown keychain backend "no-such-backend"`)
+}
+
+func TestEncryptTempFilesHappyPath(t *testing.T) {
+	t.Parallel()
+	sut := NewSut(t)
+	assert := sut.assert
+
+	sut.Write("a.txt", "a")
+	sut.Mkdir("dir")
+	sut.Write("dir/b.txt", "b")
+	sut.ClingSync("--encrypt-temp-files", "merge", "--no-progress")
+	sut.Write("a.txt", "aa")
+	sut.Rm("dir/b.txt")
+	status := sut.ClingSync("--encrypt-temp-files", "status")
+	assert.Contains(status, "M a.txt")
+	assert.Contains(status, "D dir/b.txt")
+	sut.ClingSync("--encrypt-temp-files", "merge", "--no-progress")
+	assert.Equal("No changes", sut.ClingSync("--encrypt-temp-files", "status"))
+	ls := sut.ClingSync("--encrypt-temp-files", "ls")
+	assert.Contains(ls, "a.txt")
+	assert.Equal(false, strings.Contains(ls, "b.txt"))
+}
+
+func TestEncryptCacheHappyPath(t *testing.T) {
+	t.Parallel()
+	sut := NewSut(t)
+	assert := sut.assert
+
+	sut.Write("a.txt", "a")
+	sut.ClingSync("--encrypt-cache", "merge", "--no-progress")
+	_, err := os.Stat(sut.Path(".cling/workspace/cache/staging-key"))
+	assert.NoError(err)
+	sut.Write("a.txt", "aa")
+	assert.Contains(sut.ClingSync("--encrypt-cache", "status"), "M a.txt")
+	// Turning the encryption off drops the cache.
+	assert.Contains(sut.ClingSync("status"), "M a.txt")
+	_, err = os.Stat(sut.Path(".cling/workspace/cache/staging-key"))
+	assert.ErrorIs(err, os.ErrNotExist)
+	sut.ClingSync("--encrypt-cache", "merge", "--no-progress")
+	assert.Equal("No changes", sut.ClingSync("--encrypt-cache", "status"))
+}
+
+func TestCompletionHappyPath(t *testing.T) {
+	t.Parallel()
+	sut := NewSut(t)
+	assert := sut.assert
+
+	assert.Contains(sut.ClingSync("completion", "bash"), "complete -o default -F _cling_sync_completion cling-sync")
+	assert.Contains(sut.ClingSync("completion", "zsh"), "compdef _cling_sync_completion cling-sync")
+	assert.Contains(sut.ClingSync("completion", "fish"), "complete -c cling-sync")
+	sut.Write("a.txt", "a")
+	sut.Write("dir/b.txt", "b")
+	sut.ClingSync("merge")
+	complete := func(words ...string) string {
+		t.Helper()
+		return sut.ClingSync(append([]string{"completion", "--complete", "--"}, words...)...)
+	}
+	assert.Equal("merge", complete("--log-level", "debug", "me"))
+	assert.Equal("--fast-scan", complete("status", "--fast"))
+	assert.Equal("a.txt\ndir/", complete("cat", ""))
+	assert.Equal("dir/b.txt", complete("cp", "dir/"))
+	revisions := strings.Split(complete("reset", ""), "\n")
+	assert.Equal(2, len(revisions))
+	assert.Equal("head", revisions[0])
+	assert.Equal(64, len(revisions[1]))
+	assert.Equal(revisions[1], complete("ls", "--revision", revisions[1][:8]))
+}
+
 func TestChmodChtimeChown(t *testing.T) {
 	t.Parallel()
 	sut := NewSut(t)
@@ -866,7 +1276,7 @@ func TestClingIgnoreAndGitIgnore(t *testing.T) {
 		`), td.Column(ls, 4))
 	}
 
-	t.Log("Ignoring `dir3` should remove `dir3` from the new revision")
+	t.Log("Ignoring `dir3` should keep `dir3` in the repository, but not commit new files in it")
 	{
 		sut.Write(".clingignore", "*png\ndir1/dir3")
 		sut.Write("dir1/dir3/e.md", "e")
@@ -881,7 +1291,10 @@ func TestClingIgnoreAndGitIgnore(t *testing.T) {
 			dir1/
 			dir1/.gitignore
 			dir1/c.md
+			dir1/dir3/
+			dir1/dir3/c.md
 		`), td.Column(ls, 4))
+		assert.Equal("No changes", sut.ClingSync("status"), "There should be no local changes")
 	}
 
 	t.Log("All ignored files should still be present in the workspace")
@@ -905,6 +1318,16 @@ func TestClingIgnoreAndGitIgnore(t *testing.T) {
 			dir1/dir3/e.md
 		`), td.Column(sut.Ls(), 4))
 	}
+
+	t.Log("With --no-repo-ignore, the ignored files are committed, too (merge)")
+	{
+		status := sut.ClingSync("status", "--no-repo-ignore", "--short")
+		assert.Equal("8 added, 0 updated, 0 deleted", status)
+		sut.ClingSync("merge", "--no-progress", "--no-repo-ignore", "--message", "everything")
+		ls := sut.ClingSync("ls", "--short-file-mode", "--timestamp-format", "unix-fraction")
+		assert.Equal(td.Column(sut.Ls(), 4), td.Column(ls, 4))
+		assert.Equal("No changes", sut.ClingSync("status"), "There should be no local changes")
+	}
 }
 
 func TestSymlinks(t *testing.T) {
@@ -1164,6 +1587,52 @@ func startClingSyncServer(t *testing.T, addr, srvDir string) {
 	t.Fatalf("cling-sync serve on %s never became reachable", addr)
 }
 
+func TestServeSyncWorkspace(t *testing.T) {
+	t.Parallel()
+	sut := NewSut(t)
+	assert := sut.assert
+	addr := "127.0.0.1:9127"
+	sut.Write("a.txt", "a")
+
+	t.Log("Start serve and let it merge the workspace")
+	srv := sut.cmd("serve", "--address", addr, "--repository", "../repository",
+		"--sync-interval", "100ms", "--sync-workspace", ".")
+	stdout := bytes.NewBuffer(nil)
+	srv.Stdout = stdout
+	srv.Stderr = os.Stderr
+	assert.NoError(srv.Start())
+	done := make(chan error, 1)
+	go func() { done <- srv.Wait() }()
+	t.Cleanup(func() {
+		_ = srv.Process.Kill()
+	})
+	waitFor := func(what string, f func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for !f() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	waitFor("a.txt to be merged", func() bool { return strings.Contains(sut.ClingSync("ls"), "a.txt") })
+
+	t.Log("A later change is merged at the next interval")
+	sut.Write("b.txt", "b")
+	waitFor("b.txt to be merged", func() bool { return strings.Contains(sut.ClingSync("ls"), "b.txt") })
+
+	t.Log("Stop serve")
+	assert.NoError(srv.Process.Signal(os.Interrupt))
+	select {
+	case err := <-done:
+		assert.NoError(err, "serve should exit cleanly")
+	case <-time.After(10 * time.Second):
+		t.Fatal("serve did not stop after SIGINT")
+	}
+	assert.Contains(stdout.String(), "Syncing . every 100ms")
+}
+
 // TestS3Scaleway runs the same scenario against a real Scaleway-style S3
 // bucket configured in `.env`. Skipped if any of TEST_S3_URL,
 // TEST_S3_ACCESS_KEY, TEST_S3_SECRET_KEY is unset.
@@ -1291,6 +1760,7 @@ type Sut struct {
 	assert       lib.Assert
 	workDir      string // absolute path the Sut's helpers and `cling-sync` invocations run in
 	keychainFile string // per-test mock-keychain file. Isolates `save-passphrase` from sibling tests.
+	configHome   string // per-test $XDG_CONFIG_HOME. Keeps the user config of the machine out of the tests.
 }
 
 func newSut(t *testing.T) *Sut {
@@ -1304,7 +1774,14 @@ func newSut(t *testing.T) *Sut {
 	assert.NoError(err, "failed to create workspace directory")
 
 	fs := lib.NewRealFS(workspaceDir)
-	sut := &Sut{td.NewTestFS(t, fs), t, assert, workspaceDir, filepath.Join(tmpDir, "keychain.json")}
+	sut := &Sut{
+		td.NewTestFS(t, fs),
+		t,
+		assert,
+		workspaceDir,
+		filepath.Join(tmpDir, "keychain.json"),
+		filepath.Join(tmpDir, "config"),
+	}
 	return sut
 }
 
@@ -1461,7 +1938,7 @@ func (s *Sut) cmd(args ...string) *exec.Cmd {
 	// The mock keychain backs every entry with a single JSON file. Without
 	// per-test isolation, parallel `save-passphrase` calls would race on
 	// the read-modify-write of that file.
-	cmd.Env = append(os.Environ(), "CLING_SYNC_MOCK_KEYCHAIN_FILE="+s.keychainFile)
+	cmd.Env = append(os.Environ(), "CLING_SYNC_MOCK_KEYCHAIN_FILE="+s.keychainFile, "XDG_CONFIG_HOME="+s.configHome)
 	cmd.Env = append(cmd.Env, raceEnv()...)
 	return cmd
 }
@@ -1556,6 +2033,10 @@ func assertSameRepositoryFS(t *testing.T, srcRoot, dstRoot string) {
 		if srcModes[rel].IsDir() {
 			continue
 		}
+		// Each repository encrypts its own config backup with a random nonce.
+		if filepath.Dir(rel) == ".cling/repository/security" {
+			continue
+		}
 		srcData, err := os.ReadFile(filepath.Join(srcRoot, rel))
 		assert.NoError(err)
 		dstData, err := os.ReadFile(filepath.Join(dstRoot, rel))
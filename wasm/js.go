@@ -8,6 +8,8 @@ import (
 	"strconv"
 	"syscall/js"
 	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
 )
 
 // Wrap a function in a JS Promise.
@@ -110,8 +112,12 @@ func Await(promise js.Value) (js.Value, error) {
 	}
 }
 
-// A HTTP client that uses the browser's built-in fetch API.
-type WasmHTTPClient struct{}
+// A HTTP client that uses the browser's built-in fetch API. Proxies and
+// trusted certificates are up to the browser.
+type WasmHTTPClient struct {
+	// Sent with every request, see `clingHTTP.ValidateHTTPHeader`.
+	Headers map[string]string
+}
 
 type FetchError struct {
 	Message string
@@ -138,8 +144,11 @@ func (c *WasmHTTPClient) Request(
 		js.CopyBytesToJS(bodyJS, body)
 		opts.Set("body", bodyJS)
 	}
-	if len(headers) > 0 {
+	if len(headers) > 0 || len(c.Headers) > 0 {
 		hdrs := js.Global().Get("Object").New()
+		for k, v := range c.Headers {
+			hdrs.Set(k, v)
+		}
 		for k, v := range headers {
 			hdrs.Set(k, v)
 		}
@@ -166,7 +175,8 @@ func (c *WasmHTTPClient) Request(
 
 	resp, err := Await(js.Global().Call("fetch", url, opts))
 	if err != nil {
-		return 0, nil, abortErr(err)
+		// `fetch` only rejects if the request could not be sent at all.
+		return 0, nil, abortErr(lib.WrapErrorKindf(lib.ErrNetwork, err, "failed to fetch %s", url))
 	}
 	arrayBuffer, err := Await(resp.Call("arrayBuffer"))
 	if err != nil {
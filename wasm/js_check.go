@@ -16,11 +16,12 @@ const jsTestServerURL = "http://127.0.0.1:9124"
 func init() {
 	RegisterTest("WasmHTTPClient buffered request", TestWasmHTTPClientBufferedRequest)
 	RegisterTest("WasmHTTPClient request with headers", TestWasmHTTPClientHeaders)
+	RegisterTest("WasmHTTPClient headers of every request", TestWasmHTTPClientDefaultHeaders)
 	RegisterTest("WasmHTTPClient request context", TestWasmHTTPClientRequestContext)
 }
 
 func TestWasmHTTPClientBufferedRequest(t *WasmT) {
-	client := &WasmHTTPClient{}
+	client := &WasmHTTPClient{nil}
 	status, body, err := client.Request(
 		context.Background(), "POST", jsTestServerURL+"/regular", nil, []byte("regular request"), nil,
 	)
@@ -36,7 +37,7 @@ func TestWasmHTTPClientBufferedRequest(t *WasmT) {
 }
 
 func TestWasmHTTPClientHeaders(t *WasmT) {
-	client := &WasmHTTPClient{}
+	client := &WasmHTTPClient{nil}
 	status, body, err := client.Request(
 		context.Background(), "GET", jsTestServerURL+"/echo-header",
 		map[string]string{"X-Echo": "hello"}, nil, nil,
@@ -52,8 +53,30 @@ func TestWasmHTTPClientHeaders(t *WasmT) {
 	}
 }
 
+func TestWasmHTTPClientDefaultHeaders(t *WasmT) {
+	client := &WasmHTTPClient{map[string]string{"X-Echo": "default"}}
+	_, body, err := client.Request(context.Background(), "GET", jsTestServerURL+"/echo-header", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "default" {
+		t.Fatalf("body = %q, want %q", string(body), "default")
+	}
+	// The headers of the request win.
+	_, body, err = client.Request(
+		context.Background(), "GET", jsTestServerURL+"/echo-header",
+		map[string]string{"X-Echo": "hello"}, nil, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Fatalf("body = %q, want %q", string(body), "hello")
+	}
+}
+
 func TestWasmHTTPClientRequestContext(t *WasmT) {
-	client := &WasmHTTPClient{}
+	client := &WasmHTTPClient{nil}
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
 	defer cancel()
 	_, _, err := client.Request(ctx, "GET", jsTestServerURL+"/slow", nil, nil, nil)
@@ -38,7 +38,16 @@ func BuildRepositoryAPI() js.Value {
 	api.Set("head", js.FuncOf(repositoryAPI.Head))
 	api.Set("ls", js.FuncOf(repositoryAPI.Ls))
 	api.Set("readFile", js.FuncOf(repositoryAPI.ReadFile))
+	api.Set("readFileStream", js.FuncOf(repositoryAPI.ReadFileStream))
+	api.Set("log", js.FuncOf(repositoryAPI.Log))
+	api.Set("cat", js.FuncOf(repositoryAPI.Cat))
 	api.Set("close", js.FuncOf(repositoryAPI.Close))
+	// See `workspace.go`.
+	api.Set("openWorkspace", js.FuncOf(repositoryAPI.OpenWorkspace))
+	api.Set("cp", js.FuncOf(repositoryAPI.Cp))
+	api.Set("status", js.FuncOf(repositoryAPI.Status))
+	api.Set("readWorkspaceFile", js.FuncOf(repositoryAPI.ReadWorkspaceFile))
+	api.Set("closeWorkspace", js.FuncOf(repositoryAPI.CloseWorkspace))
 	return api
 }
 
@@ -46,8 +55,11 @@ type RepositoryAPI struct{}
 
 // Parameters:
 //
-//	url: string
+//	url: string (an encrypted S3 URI, keep its `base-path` query parameter
+//	     if the server is behind a reverse proxy)
 //	passphrase: string
+//	options: {headers?: {[name: string]: string}} (optional, the headers are
+//	         sent with every request, e.g. an auth token for a proxy)
 //
 // Returns:
 //
@@ -55,13 +67,22 @@ type RepositoryAPI struct{}
 func (r RepositoryAPI) Open(this js.Value, args []js.Value) any {
 	url := args[0].String()
 	passphrase := []byte(args[1].String())
+	var options js.Value
+	if len(args) > 2 {
+		options = args[2]
+	}
 	return Async(func(resolve func(js.Value), reject func(js.Value)) {
 		cfg, _, err := clingHTTP.DecodeS3URI(url, passphrase)
 		if err != nil {
 			reject(js.ValueOf(err.Error()))
 			return
 		}
-		storage := clingHTTP.NewS3StorageClient(cfg, &WasmHTTPClient{})
+		headers, err := headersOption(options)
+		if err != nil {
+			reject(js.ValueOf(err.Error()))
+			return
+		}
+		storage := clingHTTP.NewS3StorageClient(cfg, &WasmHTTPClient{headers})
 		repository, err := lib.OpenRepository(wasmContext(), storage, passphrase)
 		if err != nil {
 			reject(js.ValueOf(err.Error()))
@@ -102,6 +123,7 @@ func (r RepositoryAPI) Head(this js.Value, args []js.Value) any {
 //
 //	handle: RepositoryHandle
 //	excludes: string (comma separated)
+//	revisionId: string (optional, "" for HEAD, or e.g. "head~1")
 //
 // Returns:
 //
@@ -109,13 +131,17 @@ func (r RepositoryAPI) Head(this js.Value, args []js.Value) any {
 func (r RepositoryAPI) Ls(this js.Value, args []js.Value) any {
 	handle := args[0].Int()
 	excludes := args[1].String()
+	var revisionIdArg string
+	if len(args) > 2 {
+		revisionIdArg = args[2].String()
+	}
 	return Async(func(resolve func(js.Value), reject func(js.Value)) {
 		repository, ok := repositoryHandles[handle]
 		if !ok {
 			reject(js.ValueOf(fmt.Sprintf("invalid repository handle: %d", handle)))
 			return
 		}
-		revisionId, err := repository.Head(wasmContext())
+		revisionId, err := resolveRevisionId(repository, revisionIdArg)
 		if err != nil {
 			reject(js.ValueOf(err.Error()))
 			return
@@ -171,64 +197,24 @@ func (r RepositoryAPI) Ls(this js.Value, args []js.Value) any {
 //
 //	handle: RepositoryHandle
 //	path: string (base64 encoded)
-//	revisionId: string ("" for HEAD)
+//	revisionId: string ("" for HEAD, or e.g. "head~1")
 //
 // Returns:
 //
 //	Promise<[Uint8Array, string]>
 //	The data and the file name.
-func (r RepositoryAPI) ReadFile(this js.Value, args []js.Value) any { //nolint:funlen
+func (r RepositoryAPI) ReadFile(this js.Value, args []js.Value) any {
 	return Async(func(resolve func(js.Value), reject func(js.Value)) {
-		handle := args[0].Int()
-		pathBytes, err := base64.StdEncoding.DecodeString(args[1].String())
-		if err != nil {
-			reject(js.ValueOf(err.Error()))
-			return
-		}
-		path := string(pathBytes)
-		revisionIdArg := args[2].String()
-		repository, ok := repositoryHandles[handle]
-		if !ok {
-			reject(js.ValueOf(fmt.Sprintf("invalid repository handle: %d", handle)))
-			return
-		}
-		var revisionId lib.RevisionId
-		if revisionIdArg == "" {
-			var err error
-			revisionId, err = repository.Head(wasmContext())
-			if err != nil {
-				reject(js.ValueOf(err.Error()))
-				return
-			}
-		} else {
-			revisionId = lib.RevisionId([]byte(revisionIdArg))
-		}
-		tmpFS := lib.NewMemoryFS(10000000)
-		snapshot, err := lib.NewRevisionSnapshot(wasmContext(), repository, revisionId, tmpFS)
-		if err != nil {
-			reject(js.ValueOf(err.Error()))
-			return
-		}
-		buf := lib.NewBlockBuf()
-		filter := lib.NewPathInclusionFilter([]string{path})
-		r := snapshot.Reader(lib.RevisionEntryPathFilter(filter))
-		file, err := r.Read(buf)
-		if errors.Is(err, io.EOF) {
-			reject(js.ValueOf(fmt.Sprintf("file not found: %s", path)))
-			return
-		}
+		repository, file, err := readFileArgs(args)
 		if err != nil {
 			reject(js.ValueOf(err.Error()))
 			return
 		}
 		if file.Metadata.Size > MaxDownloadSize {
-			reject(js.ValueOf(fmt.Sprintf("file too large: %s", path)))
-			return
-		}
-		if !file.Metadata.FileMode.IsRegular() {
-			reject(js.ValueOf(fmt.Sprintf("not a regular file: %s", path)))
+			reject(js.ValueOf(fmt.Sprintf("file too large: %s", file.Path)))
 			return
 		}
+		buf := lib.NewBlockBuf()
 		data := bytes.NewBuffer(nil)
 		data.Grow(int(file.Metadata.Size))
 		for _, blockId := range file.Metadata.BlockIds {
@@ -249,6 +235,132 @@ func (r RepositoryAPI) ReadFile(this js.Value, args []js.Value) any { //nolint:f
 	})
 }
 
+// Like `readFile`, but the data is read block by block as the stream is
+// consumed, so only one block is held in memory at a time. There is no
+// size limit.
+//
+// Parameters:
+//
+//	handle: RepositoryHandle
+//	path: string (base64 encoded)
+//	revisionId: string ("" for HEAD, or e.g. "head~1")
+//
+// Returns:
+//
+//	Promise<[ReadableStream<Uint8Array>, string, number]>
+//	The stream, the file name, and the file size.
+func (r RepositoryAPI) ReadFileStream(this js.Value, args []js.Value) any {
+	return Async(func(resolve func(js.Value), reject func(js.Value)) {
+		repository, file, err := readFileArgs(args)
+		if err != nil {
+			reject(js.ValueOf(err.Error()))
+			return
+		}
+		result := js.Global().Get("Array").New()
+		result.Set("0", newBlockStream(repository, file.Metadata.BlockIds))
+		result.Set("1", js.ValueOf(filepath.Base(file.Path.String())))
+		result.Set("2", js.ValueOf(file.Metadata.Size))
+		resolve(result)
+	})
+}
+
+// Read the `headers` of the `options` argument of `open`.
+func headersOption(options js.Value) (map[string]string, error) {
+	if options.IsUndefined() || options.IsNull() {
+		return nil, nil
+	}
+	value := options.Get("headers")
+	if value.IsUndefined() || value.IsNull() {
+		return nil, nil
+	}
+	names := js.Global().Get("Object").Call("keys", value)
+	headers := make(map[string]string, names.Length())
+	for i := range names.Length() {
+		name := names.Index(i).String()
+		if err := clingHTTP.ValidateHTTPHeader(name); err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+		headers[name] = value.Get(name).String()
+	}
+	return headers, nil
+}
+
+// Look up the regular file given by the `handle`, `path`, and `revisionId`
+// arguments of `readFile` and `readFileStream`.
+func readFileArgs(args []js.Value) (*lib.Repository, *lib.RevisionEntry, error) {
+	handle := args[0].Int()
+	pathBytes, err := base64.StdEncoding.DecodeString(args[1].String())
+	if err != nil {
+		return nil, nil, err //nolint:wrapcheck
+	}
+	path := string(pathBytes)
+	revisionIdArg := args[2].String()
+	repository, ok := repositoryHandles[handle]
+	if !ok {
+		return nil, nil, lib.Errorf("invalid repository handle: %d", handle)
+	}
+	revisionId, err := resolveRevisionId(repository, revisionIdArg)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpFS := lib.NewMemoryFS(10000000)
+	snapshot, err := lib.NewRevisionSnapshot(wasmContext(), repository, revisionId, tmpFS)
+	if err != nil {
+		return nil, nil, err //nolint:wrapcheck
+	}
+	filter := lib.NewPathInclusionFilter([]string{path})
+	file, err := snapshot.Reader(lib.RevisionEntryPathFilter(filter)).Read(lib.NewBlockBuf())
+	if errors.Is(err, io.EOF) {
+		return nil, nil, lib.Errorf("file not found: %s", path)
+	}
+	if err != nil {
+		return nil, nil, err //nolint:wrapcheck
+	}
+	if !file.Metadata.FileMode.IsRegular() {
+		return nil, nil, lib.Errorf("not a regular file: %s", path)
+	}
+	return repository, file, nil
+}
+
+// A `ReadableStream` that reads one block each time it is pulled.
+func newBlockStream(repository *lib.Repository, blockIds []lib.BlockId) js.Value {
+	var pull, cancel js.Func
+	release := func() {
+		pull.Release()
+		cancel.Release()
+	}
+	buf := lib.NewBlockBuf()
+	next := 0
+	pull = js.FuncOf(func(this js.Value, args []js.Value) any {
+		controller := args[0]
+		return Async(func(resolve func(js.Value), reject func(js.Value)) {
+			if next == len(blockIds) {
+				controller.Call("close")
+				release()
+				resolve(js.Undefined())
+				return
+			}
+			block, err := repository.ReadBlock(wasmContext(), blockIds[next], buf)
+			if err != nil {
+				release()
+				reject(js.ValueOf(err.Error()))
+				return
+			}
+			next++
+			controller.Call("enqueue", uint8ArrayFromBytes(block))
+			resolve(js.Undefined())
+		})
+	})
+	cancel = js.FuncOf(func(this js.Value, args []js.Value) any {
+		release()
+		return nil
+	})
+	source := js.Global().Get("Object").New()
+	source.Set("pull", pull)
+	source.Set("cancel", cancel)
+	return js.Global().Get("ReadableStream").New(source)
+}
+
 // Close wipes the repository's key material and drops the handle. The handle
 // must not be used afterwards.
 //
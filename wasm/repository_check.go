@@ -6,13 +6,21 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"strconv"
 	"syscall/js"
 )
 
 func init() {
 	RegisterTest("Happy path", TestHappyPath)
 	RegisterTest("Close", TestClose)
+	RegisterTest("Ls", TestLs)
+	RegisterTest("Read file stream", TestReadFileStream)
+	RegisterTest("Read file stream with files", TestReadFileStreamWithFiles)
+	RegisterTest("Workspace", TestWorkspace)
+	RegisterTest("Workspace with files", TestWorkspaceWithFiles)
 }
 
 func TestHappyPath(t *WasmT) {
@@ -53,3 +61,260 @@ func TestClose(t *WasmT) {
 		t.Fatal("expected head on a closed repository to fail")
 	}
 }
+
+func TestLs(t *WasmT) {
+	api := BuildRepositoryAPI()
+	url := js.Global().Get("process").Get("env").Get("WASM_S3_URL").String()
+	if url == "" {
+		t.Fatal("WASM_S3_URL env var not set")
+	}
+	repository, err := Await(api.Call("open", url, "testpassphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, revision := range []string{"", "head"} {
+		ls, err := Await(api.Call("ls", repository, "", revision))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ls.String() != "" {
+			t.Fatal(fmt.Sprintf("ls of an empty repository should be empty but is: %s", ls))
+		}
+	}
+	if _, err := Await(api.Call("ls", repository, "", "head~1")); err == nil {
+		t.Fatal("expected ls of a revision before the root to fail")
+	}
+}
+
+func TestReadFileStream(t *WasmT) {
+	api := BuildRepositoryAPI()
+	url := js.Global().Get("process").Get("env").Get("WASM_S3_URL").String()
+	if url == "" {
+		t.Fatal("WASM_S3_URL env var not set")
+	}
+	repository, err := Await(api.Call("open", url, "testpassphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := js.Global().Call("btoa", "a.txt")
+	if _, err := Await(api.Call("readFileStream", repository, path, "")); err == nil {
+		t.Fatal("expected readFileStream of a missing file to fail")
+	}
+	if _, err := Await(api.Call("readFileStream", 4711, path, "")); err == nil {
+		t.Fatal("expected readFileStream with an invalid handle to fail")
+	}
+}
+
+func TestReadFileStreamWithFiles(t *WasmT) {
+	api := BuildRepositoryAPI()
+	env := js.Global().Get("process").Get("env")
+	url := env.Get("WASM_S3_URL_STREAM").String()
+	if url == "" {
+		t.Fatal("WASM_S3_URL_STREAM env var not set")
+	}
+	size, err := strconv.Atoi(env.Get("WASM_STREAM_SIZE").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	repository, err := Await(api.Call("open", url, "testpassphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Read the whole stream and return the number of chunks, the size, and
+	// the hash of the data.
+	readStream := func(path string) (int, int, string) {
+		result, err := Await(api.Call("readFileStream", repository, js.Global().Call("btoa", path), ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := result.Index(1).String(); name != path {
+			t.Fatalf("readFileStream of %s returned the file name %s", path, name)
+		}
+		if result.Index(2).Int() != map[string]int{"big.bin": size, "empty.txt": 0}[path] {
+			t.Fatalf("readFileStream of %s returned the size %d", path, result.Index(2).Int())
+		}
+		reader := result.Index(0).Call("getReader")
+		hash := sha256.New()
+		chunks, total := 0, 0
+		for {
+			chunk, err := Await(reader.Call("read"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chunk.Get("done").Bool() {
+				break
+			}
+			data := make([]byte, chunk.Get("value").Length())
+			js.CopyBytesToGo(data, chunk.Get("value"))
+			hash.Write(data)
+			chunks++
+			total += len(data)
+		}
+		return chunks, total, hex.EncodeToString(hash.Sum(nil))
+	}
+
+	// Every block of a file is a chunk of the stream.
+	chunks, total, hash := readStream("big.bin")
+	if chunks < 3 {
+		t.Fatalf("big.bin should be streamed in at least 3 chunks but was streamed in %d", chunks)
+	}
+	if total != size {
+		t.Fatalf("big.bin should have %d bytes but the stream had %d", size, total)
+	}
+	if expected := env.Get("WASM_STREAM_SHA256").String(); hash != expected {
+		t.Fatalf("big.bin should have the hash %s but the stream had %s", expected, hash)
+	}
+
+	chunks, total, _ = readStream("empty.txt")
+	if chunks != 0 || total != 0 {
+		t.Fatalf("empty.txt should be an empty stream but had %d chunks of %d bytes", chunks, total)
+	}
+}
+
+func TestWorkspace(t *WasmT) {
+	api := BuildRepositoryAPI()
+	url := js.Global().Get("process").Get("env").Get("WASM_S3_URL").String()
+	if url == "" {
+		t.Fatal("WASM_S3_URL env var not set")
+	}
+	repository, err := Await(api.Call("open", url, "testpassphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := Await(api.Call("log", repository, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log.Length() != 0 {
+		t.Fatalf("log of an empty repository should be empty but has %d revisions", log.Length())
+	}
+	if _, err := Await(api.Call("cat", repository, "a.txt", "")); err == nil {
+		t.Fatal("expected cat of a missing file to fail")
+	}
+	workspace, err := Await(api.Call("openWorkspace", repository, 1_000_000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := Await(api.Call("cp", workspace, "**/*", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied.Int() != 0 {
+		t.Fatalf("cp copied %d paths from an empty repository", copied.Int())
+	}
+	status, err := Await(api.Call("status", workspace, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Length() != 0 {
+		t.Fatalf("status should be empty but has %d files", status.Length())
+	}
+	if _, err := Await(api.Call("closeWorkspace", workspace)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Await(api.Call("status", workspace, "")); err == nil {
+		t.Fatal("expected status on a closed workspace to fail")
+	}
+}
+
+func TestWorkspaceWithFiles(t *WasmT) {
+	api := BuildRepositoryAPI()
+	url := js.Global().Get("process").Get("env").Get("WASM_S3_URL_FILES").String()
+	if url == "" {
+		t.Fatal("WASM_S3_URL_FILES env var not set")
+	}
+	repository, err := Await(api.Call("open", url, "testpassphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// `a.txt` is "a" in the first revision and "a2" in the second.
+	log, err := Await(api.Call("log", repository, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log.Length() != 2 {
+		t.Fatalf("log should have 2 revisions but has %d", log.Length())
+	}
+	if parent := log.Index(0).Get("parent").String(); parent != log.Index(1).Get("revision").String() {
+		t.Fatalf("log should start with the newest revision, but its parent is %s", parent)
+	}
+	log, err = Await(api.Call("log", repository, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log.Length() != 1 {
+		t.Fatalf("log with a limit of 1 has %d revisions", log.Length())
+	}
+	for revision, expected := range map[string]string{"": "a2", "head~1": "a"} {
+		data, err := Await(api.Call("cat", repository, "a.txt", revision))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := stringFromUint8Array(data); actual != expected {
+			t.Fatalf("cat of a.txt at %q should be %q but is %q", revision, expected, actual)
+		}
+	}
+
+	workspace, err := Await(api.Call("openWorkspace", repository, 1_000_000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCp := func(patterns, revision string, expected int) {
+		copied, err := Await(api.Call("cp", workspace, patterns, revision))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if copied.Int() != expected {
+			t.Fatalf("cp of %q at %q copied %d paths instead of %d", patterns, revision, copied.Int(), expected)
+		}
+	}
+	expectFile := func(path, expected string) {
+		data, err := Await(api.Call("readWorkspaceFile", workspace, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := stringFromUint8Array(data); actual != expected {
+			t.Fatalf("%s in the workspace should be %q but is %q", path, expected, actual)
+		}
+	}
+	expectStatus := func(revision string, expected string) {
+		status, err := Await(api.Call("status", workspace, revision))
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := ""
+		for i := range status.Length() {
+			actual += status.Index(i).Get("kind").String() + " " + status.Index(i).Get("path").String() + ";"
+		}
+		if actual != expected {
+			t.Fatalf("status against %q should be %q but is %q", revision, expected, actual)
+		}
+	}
+
+	expectCp("a.txt", "head~1", 1)
+	expectFile("a.txt", "a")
+	expectStatus("head~1", "")
+	expectStatus("", "update a.txt;")
+	if _, err := Await(api.Call("readWorkspaceFile", workspace, "docs/b.txt")); err == nil {
+		t.Fatal("expected readWorkspaceFile of a file that was not copied to fail")
+	}
+
+	// Existing files are overwritten.
+	expectCp("**/*", "", 3)
+	expectFile("a.txt", "a2")
+	expectFile("docs/b.txt", "b")
+	expectStatus("", "")
+	expectStatus("head~1", "update a.txt;")
+	if _, err := Await(api.Call("closeWorkspace", workspace)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Await(api.Call("readWorkspaceFile", workspace, "a.txt")); err == nil {
+		t.Fatal("expected readWorkspaceFile on a closed workspace to fail")
+	}
+}
+
+func stringFromUint8Array(v js.Value) string {
+	data := make([]byte, v.Length())
+	js.CopyBytesToGo(data, v)
+	return string(data)
+}
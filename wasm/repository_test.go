@@ -5,43 +5,96 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand/v2"
 	"net/http"
+	"strconv"
 	"testing"
 
 	clingHTTP "github.com/flunderpero/cling-sync/http"
 	"github.com/flunderpero/cling-sync/lib"
+	"github.com/flunderpero/cling-sync/workspace"
 )
 
-var td = lib.TestData{} //nolint:gochecknoglobals
+var (
+	td   = lib.TestData{}                //nolint:gochecknoglobals
+	wstd = workspace.WorkspaceTestData{} //nolint:gochecknoglobals
+)
 
 const (
 	wasmTestAccessKey = "test-access-key"
 	wasmTestSecret    = "test-secret-key"
 	wasmTestRegion    = "us-east-1"
 	wasmTestAddress   = "127.0.0.1:9123"
+	// 9124 is taken by `TestWasmHTTPClient`.
+	wasmTestFilesAddress  = "127.0.0.1:9125"
+	wasmTestStreamAddress = "127.0.0.1:9128"
 )
 
 func TestWasm(t *testing.T) {
 	t.Parallel()
-	fs := td.NewRealFS(t)
-	r := td.NewTestRepository(t, fs)
+	r := td.NewTestRepository(t, td.NewRealFS(t))
+
+	// A second repository with two revisions for the checks that need
+	// files: `a.txt` is changed by the second one.
+	rFiles := td.NewTestRepository(t, td.NewRealFS(t))
+	w := wstd.NewTestWorkspace(t, rFiles.Repository)
+	merge := func() {
+		t.Helper()
+		if _, err := workspace.Merge(t.Context(), w.Workspace, rFiles.Repository, wstd.MergeOptions()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Write("a.txt", "a")
+	w.Write("docs/b.txt", "b")
+	merge()
+	w.Write("a.txt", "a2")
+	merge()
+
+	// A third repository for `readFileStream`: `big.bin` spans more than two
+	// blocks, `empty.txt` has none.
+	rStream := td.NewTestRepository(t, td.NewRealFS(t))
+	wStream := wstd.NewTestWorkspace(t, rStream.Repository)
+	big := make([]byte, 2*lib.MaxBlockDataSize+1000)
+	_, _ = rand.NewChaCha8([32]byte{}).Read(big)
+	bigHash := sha256.Sum256(big)
+	wStream.Write("big.bin", string(big))
+	wStream.Write("empty.txt", "")
+	if _, err := workspace.Merge(t.Context(), wStream.Workspace, rStream.Repository, wstd.MergeOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	RunWasmTests(
+		t,
+		"checkrepo",
+		"WASM_S3_URL="+serveWasmTestRepository(t, r, wasmTestAddress),
+		"WASM_S3_URL_FILES="+serveWasmTestRepository(t, rFiles, wasmTestFilesAddress),
+		"WASM_S3_URL_STREAM="+serveWasmTestRepository(t, rStream, wasmTestStreamAddress),
+		"WASM_STREAM_SIZE="+strconv.Itoa(len(big)),
+		"WASM_STREAM_SHA256="+hex.EncodeToString(bigHash[:]),
+	)
+}
 
+// Serve `r` at `address` and return the encrypted URI of it.
+func serveWasmTestRepository(t *testing.T, r *lib.TestRepository, address string) string {
+	t.Helper()
 	mux := http.NewServeMux()
 	clingHTTP.NewS3StorageServer(r.Storage, wasmTestRegion, wasmTestAccessKey, wasmTestSecret).
 		RegisterRoutes(mux)
-	server := &http.Server{Addr: wasmTestAddress, Handler: mux} //nolint:exhaustruct
-	t.Cleanup(func() { _ = server.Close() })                    // outlives the parallel compiler subtests
-	go server.ListenAndServe()                                  //nolint:errcheck
+	server := &http.Server{Addr: address, Handler: mux} //nolint:exhaustruct
+	t.Cleanup(func() { _ = server.Close() })            // outlives the parallel compiler subtests
+	go server.ListenAndServe()                          //nolint:errcheck
 
 	// `wasm/testdata.go` sets the passphrase the test repository uses. The
 	// wasm side decodes the encrypted URI with the same passphrase.
 	encryptedURI, err := clingHTTP.EncodeS3URI(
-		"s3+http://"+wasmTestAddress,
+		"s3+http://"+address,
 		clingHTTP.S3Credentials{AccessKeyID: wasmTestAccessKey, SecretAccessKey: []byte(wasmTestSecret)},
 		[]byte("testpassphrase"),
 	)
 	if err != nil {
 		t.Fatal(err)
 	}
-	RunWasmTests(t, "checkrepo", "WASM_S3_URL="+encryptedURI)
+	return encryptedURI
 }
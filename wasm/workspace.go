@@ -0,0 +1,358 @@
+//go:build wasm
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"syscall/js"
+	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
+	"github.com/flunderpero/cling-sync/workspace"
+)
+
+// The operations on a workspace in the browser. Its files live in memory
+// (a `lib.MemoryFS`), they are copied there from the repository with `cp`
+// and can be read back with `readWorkspaceFile`.
+
+var (
+	workspaceHandles    = make(map[int]*browserWorkspace) //nolint:gochecknoglobals
+	nextWorkspaceHandle int                               //nolint:gochecknoglobals
+)
+
+// There is no ownership and there are no extended attributes in the browser.
+const browserRestorableMetadata = lib.RestorableMetadataMode | lib.RestorableMetadataMTime
+
+type browserWorkspace struct {
+	repositoryHandle int
+	fs               lib.FS
+	// The patterns of all paths copied with `cp`, `status` only looks at
+	// these.
+	patterns []string
+}
+
+// The records returned by `log` and `status`, see `cli/json.go` for the
+// equivalent of the CLI.
+func jsStatusFile(file *workspace.StatusFile) map[string]any {
+	kind := "add"
+	switch {
+	case file.RenamedFrom != nil:
+		kind = "rename"
+	case file.Kind == lib.RevisionEntryKindUpdate:
+		kind = "update"
+	case file.Kind == lib.RevisionEntryKindDelete:
+		kind = "delete"
+	}
+	record := map[string]any{
+		"kind": kind,
+		"path": file.Path.String(),
+		"dir":  file.Metadata.FileMode.IsDir(),
+		"size": file.Metadata.Size,
+	}
+	if file.RenamedFrom != nil {
+		record["renamed_from"] = file.RenamedFrom.String()
+	}
+	return record
+}
+
+func jsRevisionLog(log *workspace.RevisionLog) map[string]any {
+	r := log.Revision
+	author, message := "", ""
+	if r.Author != nil {
+		author = *r.Author
+	}
+	if r.Message != nil {
+		message = *r.Message
+	}
+	return map[string]any{
+		"revision":  log.RevisionId.String(),
+		"parent":    r.ParentRevisionId.String(),
+		"author":    author,
+		"message":   message,
+		"timestamp": r.Timestamp.Time().Format(time.RFC3339),
+	}
+}
+
+// Resolve a revision spec like `head~2` ("" for HEAD), see
+// `lib.RevisionChain.ParseRevisionId`.
+func resolveRevisionId(repository *lib.Repository, spec string) (lib.RevisionId, error) {
+	chain, err := lib.ReadRevisionChain(wasmContext(), repository)
+	if err != nil {
+		return lib.RevisionId{}, err //nolint:wrapcheck
+	}
+	if spec == "" {
+		spec = "head"
+	}
+	return chain.ParseRevisionId(spec) //nolint:wrapcheck
+}
+
+// Parameters:
+//
+//	handle: RepositoryHandle
+//	limit: int (0 for all revisions)
+//
+// Returns:
+//
+//	Promise<Array<{revision, parent, author, message, timestamp}>>
+//	The newest revision first.
+func (r RepositoryAPI) Log(this js.Value, args []js.Value) any {
+	handle := args[0].Int()
+	limit := args[1].Int()
+	return Async(func(resolve func(js.Value), reject func(js.Value)) {
+		repository, ok := repositoryHandles[handle]
+		if !ok {
+			reject(js.ValueOf(fmt.Sprintf("invalid repository handle: %d", handle)))
+			return
+		}
+		logs, err := workspace.Log(wasmContext(), repository, &workspace.LogOptions{}) //nolint:exhaustruct
+		if err != nil {
+			reject(js.ValueOf(err.Error()))
+			return
+		}
+		if limit > 0 && len(logs) > limit {
+			logs = logs[:limit]
+		}
+		result := make([]any, 0, len(logs))
+		for i := range logs {
+			result = append(result, jsRevisionLog(&logs[i]))
+		}
+		resolve(js.ValueOf(result))
+	})
+}
+
+// Read a file from the repository like `readFile`, but without the size
+// limit of a download.
+//
+// Parameters:
+//
+//	handle: RepositoryHandle
+//	path: string
+//	revisionId: string ("" for HEAD, or e.g. "head~1")
+//
+// Returns:
+//
+//	Promise<Uint8Array>
+func (r RepositoryAPI) Cat(this js.Value, args []js.Value) any {
+	handle := args[0].Int()
+	path := args[1].String()
+	revisionIdArg := args[2].String()
+	return Async(func(resolve func(js.Value), reject func(js.Value)) {
+		repository, ok := repositoryHandles[handle]
+		if !ok {
+			reject(js.ValueOf(fmt.Sprintf("invalid repository handle: %d", handle)))
+			return
+		}
+		revisionId, err := resolveRevisionId(repository, revisionIdArg)
+		if err != nil {
+			reject(js.ValueOf(err.Error()))
+			return
+		}
+		catPath, err := lib.NewPath(path)
+		if err != nil {
+			reject(js.ValueOf(err.Error()))
+			return
+		}
+		var data bytes.Buffer
+		opts := &workspace.CatOptions{RevisionId: revisionId, Path: catPath}
+		if err := workspace.Cat(wasmContext(), repository, &data, opts, lib.NewMemoryFS(10_000_000)); err != nil {
+			reject(js.ValueOf(err.Error()))
+			return
+		}
+		resolve(uint8ArrayFromBytes(data.Bytes()))
+	})
+}
+
+// Create an empty workspace in the memory of the browser.
+//
+// Parameters:
+//
+//	handle: RepositoryHandle
+//	maxBytes: int (the maximum size of the files in the workspace)
+//
+// Returns:
+//
+//	Promise<int> (WorkspaceHandle)
+func (r RepositoryAPI) OpenWorkspace(this js.Value, args []js.Value) any {
+	handle := args[0].Int()
+	maxBytes := args[1].Int()
+	return Async(func(resolve func(js.Value), reject func(js.Value)) {
+		if _, ok := repositoryHandles[handle]; !ok {
+			reject(js.ValueOf(fmt.Sprintf("invalid repository handle: %d", handle)))
+			return
+		}
+		wsHandle := nextWorkspaceHandle
+		nextWorkspaceHandle++
+		workspaceHandles[wsHandle] = &browserWorkspace{handle, lib.NewMemoryFS(int64(maxBytes)), nil}
+		resolve(js.ValueOf(wsHandle))
+	})
+}
+
+// Copy the paths matching `patterns` from a revision into the workspace.
+// Existing files are overwritten.
+//
+// Parameters:
+//
+//	handle: WorkspaceHandle
+//	patterns: string (comma separated, e.g. "docs/**/*")
+//	revisionId: string ("" for HEAD, or e.g. "head~1")
+//
+// Returns:
+//
+//	Promise<int> (the number of copied paths)
+func (r RepositoryAPI) Cp(this js.Value, args []js.Value) any {
+	wsHandle := args[0].Int()
+	patterns := strings.Split(args[1].String(), ",")
+	revisionIdArg := args[2].String()
+	return Async(func(resolve func(js.Value), reject func(js.Value)) {
+		ws, repository, err := lookupWorkspace(wsHandle)
+		if err != nil {
+			reject(js.ValueOf(err.Error()))
+			return
+		}
+		revisionId, err := resolveRevisionId(repository, revisionIdArg)
+		if err != nil {
+			reject(js.ValueOf(err.Error()))
+			return
+		}
+		monitor := workspace.NewDefaultCpMonitor(
+			workspace.DefaultMonitorModeSilent,
+			func() error { return nil },
+			func(string) {},
+			workspace.CpOnExistsOverwrite,
+			false,
+		)
+		opts := &workspace.CpOptions{ //nolint:exhaustruct
+			RevisionId:             revisionId,
+			Monitor:                monitor,
+			PathFilter:             lib.NewPathInclusionFilter(patterns),
+			RestorableMetadataFlag: browserRestorableMetadata,
+		}
+		if err := workspace.Cp(wasmContext(), repository, ws.fs, opts, lib.NewMemoryFS(10_000_000)); err != nil {
+			reject(js.ValueOf(err.Error()))
+			return
+		}
+		ws.patterns = append(ws.patterns, patterns...)
+		resolve(js.ValueOf(monitor.Paths))
+	})
+}
+
+// Compare the paths copied into the workspace with a revision, e.g. to see
+// what changed in the repository since they were copied.
+//
+// Parameters:
+//
+//	handle: WorkspaceHandle
+//	revisionId: string ("" for HEAD, or e.g. "head~1")
+//
+// Returns:
+//
+//	Promise<Array<{kind, path, dir, size, renamed_from?}>>
+//	`kind` is one of "add", "update", "delete", or "rename", from the point
+//	of view of the workspace (i.e. "add" is a path missing in the revision).
+func (r RepositoryAPI) Status(this js.Value, args []js.Value) any {
+	wsHandle := args[0].Int()
+	revisionIdArg := args[1].String()
+	return Async(func(resolve func(js.Value), reject func(js.Value)) {
+		ws, repository, err := lookupWorkspace(wsHandle)
+		if err != nil {
+			reject(js.ValueOf(err.Error()))
+			return
+		}
+		revisionId, err := resolveRevisionId(repository, revisionIdArg)
+		if err != nil {
+			reject(js.ValueOf(err.Error()))
+			return
+		}
+		result := []any{}
+		if len(ws.patterns) == 0 {
+			resolve(js.ValueOf(result))
+			return
+		}
+		opts := &workspace.CompareOptions{ //nolint:exhaustruct
+			RevisionId: revisionId,
+			PathFilter: lib.NewPathInclusionFilter(ws.patterns),
+			Monitor: workspace.NewDefaultStagingMonitor(
+				workspace.DefaultMonitorModeSilent,
+				func() error { return nil },
+				func(string) {},
+			),
+			RestorableMetadataFlag: browserRestorableMetadata,
+		}
+		files, err := workspace.CompareDirectory(wasmContext(), repository, ws.fs, opts, lib.NewMemoryFS(10_000_000))
+		if err != nil {
+			reject(js.ValueOf(err.Error()))
+			return
+		}
+		for i := range files {
+			result = append(result, jsStatusFile(&files[i]))
+		}
+		resolve(js.ValueOf(result))
+	})
+}
+
+// Parameters:
+//
+//	handle: WorkspaceHandle
+//	path: string
+//
+// Returns:
+//
+//	Promise<Uint8Array>
+func (r RepositoryAPI) ReadWorkspaceFile(this js.Value, args []js.Value) any {
+	wsHandle := args[0].Int()
+	path := args[1].String()
+	return Async(func(resolve func(js.Value), reject func(js.Value)) {
+		ws, _, err := lookupWorkspace(wsHandle)
+		if err != nil {
+			reject(js.ValueOf(err.Error()))
+			return
+		}
+		data, err := lib.ReadFile(ws.fs, path)
+		if err != nil {
+			reject(js.ValueOf(err.Error()))
+			return
+		}
+		resolve(uint8ArrayFromBytes(data))
+	})
+}
+
+// Drop the workspace and its files. The handle must not be used afterwards.
+//
+// Parameters:
+//
+//	handle: WorkspaceHandle
+//
+// Returns:
+//
+//	Promise<void>
+func (r RepositoryAPI) CloseWorkspace(this js.Value, args []js.Value) any {
+	wsHandle := args[0].Int()
+	return Async(func(resolve func(js.Value), reject func(js.Value)) {
+		if _, ok := workspaceHandles[wsHandle]; !ok {
+			reject(js.ValueOf(fmt.Sprintf("invalid workspace handle: %d", wsHandle)))
+			return
+		}
+		delete(workspaceHandles, wsHandle)
+		resolve(js.Undefined())
+	})
+}
+
+func lookupWorkspace(wsHandle int) (*browserWorkspace, *lib.Repository, error) {
+	ws, ok := workspaceHandles[wsHandle]
+	if !ok {
+		return nil, nil, lib.Errorf("invalid workspace handle: %d", wsHandle)
+	}
+	repository, ok := repositoryHandles[ws.repositoryHandle]
+	if !ok {
+		return nil, nil, lib.Errorf("the repository of workspace %d is closed", wsHandle)
+	}
+	return ws, repository, nil
+}
+
+func uint8ArrayFromBytes(data []byte) js.Value {
+	result := js.Global().Get("Uint8Array").New(len(data))
+	js.CopyBytesToJS(result, data)
+	return result
+}
@@ -0,0 +1,218 @@
+package workspace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// An `Agent` keeps the decrypted keys of repositories in memory and hands
+// them out over a unix socket (see `ServeAgent`), so that a sequence of
+// commands only asks for the passphrase once. Like `ssh-agent`, it trusts
+// everyone who can connect to the socket.
+//
+// The protocol is one JSON `agentRequest` per connection, answered with one
+// JSON `agentResponse`.
+type Agent struct {
+	mu       sync.Mutex
+	keys     map[string]agentEntry
+	lifetime time.Duration
+}
+
+// The secrets of a repository kept by an `Agent`.
+type AgentKeys struct {
+	// The repository keys, see `lib.ExportRecoveryCode`.
+	RecoveryCode string `json:"recovery_code"`
+	// Only for S3 repositories: the URI without the encrypted credentials
+	// and the decrypted credentials.
+	S3Endpoint        string `json:"s3_endpoint,omitempty"`
+	S3AccessKeyID     string `json:"s3_access_key_id,omitempty"`
+	S3SecretAccessKey []byte `json:"s3_secret_access_key,omitempty"`
+}
+
+type agentEntry struct {
+	keys  AgentKeys
+	added time.Time
+}
+
+type agentOp string
+
+const (
+	agentOpGet    agentOp = "get"
+	agentOpAdd    agentOp = "add"
+	agentOpForget agentOp = "forget"
+	// Any request larger than this is rejected.
+	maxAgentMessageSize = 64 * 1024
+)
+
+type agentRequest struct {
+	Op         agentOp    `json:"op"`
+	Repository string     `json:"repository,omitempty"`
+	Keys       *AgentKeys `json:"keys,omitempty"`
+}
+
+type agentResponse struct {
+	Keys  *AgentKeys `json:"keys,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+// Keys are forgotten `lifetime` after they were added, never if 0.
+func NewAgent(lifetime time.Duration) *Agent {
+	return &Agent{sync.Mutex{}, map[string]agentEntry{}, lifetime}
+}
+
+func (a *Agent) get(repository string) (AgentKeys, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry, ok := a.keys[repository]
+	if !ok {
+		return AgentKeys{}, false
+	}
+	if a.lifetime > 0 && time.Since(entry.added) > a.lifetime {
+		delete(a.keys, repository)
+		return AgentKeys{}, false
+	}
+	return entry.keys, true
+}
+
+func (a *Agent) add(repository string, keys AgentKeys) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys[repository] = agentEntry{keys, time.Now()}
+}
+
+// Forget all keys.
+func (a *Agent) Forget() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	clear(a.keys)
+}
+
+func (a *Agent) handle(req agentRequest) agentResponse {
+	switch req.Op {
+	case agentOpGet:
+		keys, ok := a.get(req.Repository)
+		if !ok {
+			return agentResponse{nil, ""}
+		}
+		return agentResponse{&keys, ""}
+	case agentOpAdd:
+		if req.Repository == "" || req.Keys == nil || req.Keys.RecoveryCode == "" {
+			return agentResponse{nil, "repository and keys are required"}
+		}
+		a.add(req.Repository, *req.Keys)
+		return agentResponse{nil, ""}
+	case agentOpForget:
+		a.Forget()
+		return agentResponse{nil, ""}
+	default:
+		return agentResponse{nil, "unknown op " + string(req.Op)}
+	}
+}
+
+// ServeAgent answers the requests to `a` on `l` until `l` is closed.
+func ServeAgent(l net.Listener, a *Agent) error {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to accept agent connection")
+		}
+		go func() {
+			defer conn.Close() //nolint:errcheck
+			_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+			var req agentRequest
+			resp := agentResponse{nil, ""}
+			line, err := bufio.NewReader(io.LimitReader(conn, maxAgentMessageSize)).ReadBytes('\n')
+			if err == nil {
+				err = json.Unmarshal(line, &req)
+			}
+			if err != nil {
+				resp.Error = "invalid request"
+			} else {
+				resp = a.handle(req)
+			}
+			_ = json.NewEncoder(conn).Encode(resp)
+		}()
+	}
+}
+
+func callAgent(ctx context.Context, socketPath string, req agentRequest) (agentResponse, error) {
+	var resp agentResponse
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return resp, lib.WrapErrorf(err, "failed to connect to %s (is `agent` running?)", socketPath)
+	}
+	defer conn.Close() //nolint:errcheck
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return resp, lib.WrapErrorf(err, "failed to send agent request")
+	}
+	data, err := io.ReadAll(io.LimitReader(conn, maxAgentMessageSize))
+	if err != nil {
+		return resp, lib.WrapErrorf(err, "failed to read agent response")
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return resp, lib.WrapErrorf(err, "failed to parse agent response")
+	}
+	if resp.Error != "" {
+		return resp, lib.Errorf("agent: %s", resp.Error)
+	}
+	return resp, nil
+}
+
+// ReadAgentKeys asks the agent listening on `socketPath` for the keys of
+// `repository`. Return false if the agent does not have them.
+func ReadAgentKeys(ctx context.Context, socketPath string, repository string) (AgentKeys, bool, error) {
+	resp, err := callAgent(ctx, socketPath, agentRequest{agentOpGet, repository, nil})
+	if err != nil || resp.Keys == nil {
+		return AgentKeys{}, false, err
+	}
+	return *resp.Keys, true, nil
+}
+
+// AddAgentKeys hands the keys of `repository` to the agent listening on
+// `socketPath`.
+func AddAgentKeys(ctx context.Context, socketPath string, repository string, keys AgentKeys) error {
+	_, err := callAgent(ctx, socketPath, agentRequest{agentOpAdd, repository, &keys})
+	return err
+}
+
+// ForgetAgentKeys makes the agent listening on `socketPath` forget all keys.
+func ForgetAgentKeys(ctx context.Context, socketPath string) error {
+	_, err := callAgent(ctx, socketPath, agentRequest{agentOpForget, "", nil})
+	return err
+}
+
+// CheckAgentSocket returns an error unless the socket at `socketPath`
+// belongs to the current user and nobody else can access it. Otherwise,
+// another user could pose as the agent and collect the keys handed to it.
+func CheckAgentSocket(socketPath string) error {
+	info, err := os.Lstat(socketPath) //nolint:forbidigo
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to stat %s", socketPath)
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return lib.Errorf("%s is not a socket", socketPath)
+	}
+	var md lib.PathMetadata
+	lib.EnhanceMetadata(&md, info)
+	if md.Uid != nil && int(*md.Uid) != os.Getuid() { //nolint:forbidigo
+		return lib.Errorf("%s belongs to another user", socketPath)
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return lib.Errorf("%s is accessible by other users", socketPath)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package workspace
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestAgent(t *testing.T) {
+	t.Parallel()
+
+	serve := func(t *testing.T, agent *Agent) string {
+		t.Helper()
+		socketPath := filepath.Join(t.TempDir(), "agent.sock")
+		l, err := net.Listen("unix", socketPath)
+		lib.NewAssert(t).NoError(err)
+		t.Cleanup(func() { l.Close() }) //nolint:errcheck,gosec
+		go ServeAgent(l, agent)         //nolint:errcheck
+		return socketPath
+	}
+
+	t.Run("Keys handed to the agent open the repository", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		socketPath := serve(t, NewAgent(0))
+
+		_, ok, err := ReadAgentKeys(t.Context(), socketPath, "/repo")
+		assert.NoError(err)
+		assert.Equal(false, ok)
+		keys, err := NewAgentKeys(t.Context(), r.Storage, "/repo", []byte(r.Passphrase))
+		assert.NoError(err)
+		assert.NoError(AddAgentKeys(t.Context(), socketPath, "/repo", keys))
+		read, ok, err := ReadAgentKeys(t.Context(), socketPath, "/repo")
+		assert.NoError(err)
+		assert.Equal(true, ok)
+		assert.Equal(keys, read)
+		repository, err := lib.OpenRepositoryWithRecoveryCode(t.Context(), r.Storage, read.RecoveryCode)
+		assert.NoError(err)
+		assert.NoError(repository.Close())
+
+		assert.NoError(ForgetAgentKeys(t.Context(), socketPath))
+		_, ok, err = ReadAgentKeys(t.Context(), socketPath, "/repo")
+		assert.NoError(err)
+		assert.Equal(false, ok)
+	})
+
+	t.Run("Keys are forgotten after their lifetime", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		socketPath := serve(t, NewAgent(50*time.Millisecond))
+		assert.NoError(AddAgentKeys(t.Context(), socketPath, "/repo", AgentKeys{"code", "", "", nil}))
+		_, ok, err := ReadAgentKeys(t.Context(), socketPath, "/repo")
+		assert.NoError(err)
+		assert.Equal(true, ok)
+		time.Sleep(100 * time.Millisecond)
+		_, ok, err = ReadAgentKeys(t.Context(), socketPath, "/repo")
+		assert.NoError(err)
+		assert.Equal(false, ok)
+	})
+
+	t.Run("Only a private socket is trusted", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		socketPath := serve(t, NewAgent(0))
+		assert.NoError(os.Chmod(socketPath, 0o600))
+		assert.NoError(CheckAgentSocket(socketPath))
+		assert.NoError(os.Chmod(socketPath, 0o660))
+		assert.Error(CheckAgentSocket(socketPath), "accessible by other users")
+		notASocket := filepath.Join(t.TempDir(), "file")
+		assert.NoError(os.WriteFile(notASocket, nil, 0o600))
+		assert.Error(CheckAgentSocket(notASocket), "not a socket")
+	})
+}
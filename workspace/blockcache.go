@@ -0,0 +1,326 @@
+package workspace
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+const blockCacheDir = workspaceDir + "/block-cache"
+
+// The control file in `lib.ControlFileSectionConf` with the size limit of the
+// block cache in bytes.
+const blockCacheLimitFile = "block-cache-limit"
+
+// Once the block cache exceeds its limit, the least recently used blocks are
+// evicted until it is down to this fraction of the limit, so that not every
+// new block triggers another eviction.
+const blockCacheEvictionTarget = 0.9
+
+var blockCacheHeaderComment = strings.Trim(`
+A copy of the repository config kept by the block cache of this workspace.
+`, "\n ")
+
+// BlockCache is a `lib.Storage` that serves blocks from a local cache in the
+// workspace before asking the remote storage. Blocks are immutable, so a
+// cached block never goes stale - unless the remote storage is replaced by
+// another repository (e.g. by `lib.UpgradeRepository`). Then the whole cache
+// is dropped.
+//
+// If the remote storage cannot be reached, the repository config and the
+// references fall back to the copies taken by the last `Populate` run. This
+// makes everything that was prefetched readable while offline.
+//
+// Everything else, including all writes, goes to the remote storage.
+//
+// With a size limit (see `Workspace.SetBlockCacheLimit`), the least recently
+// used blocks are evicted once the cache grows beyond it. A block is used
+// when it is read from or written to the cache, its mtime records when.
+type BlockCache struct {
+	lib.Storage
+	cache *lib.FileStorage
+	// Copy the blocks, the config, and the references read from the remote
+	// storage into the cache.
+	Populate bool
+	limit    int64
+	mu       sync.Mutex
+	// The size of all cached blocks, -1 until it is needed.
+	size int64
+}
+
+var (
+	_ lib.Storage           = (*BlockCache)(nil)
+	_ lib.BlockBatchChecker = (*BlockCache)(nil)
+	_ lib.BlockBatchWriter  = (*BlockCache)(nil)
+)
+
+func (w *Workspace) OpenBlockCache(ctx context.Context, remote lib.Storage) (*BlockCache, error) {
+	limit, err := w.BlockCacheLimit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cacheFS, err := w.FS.MkSub(blockCacheDir)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to create block cache directory")
+	}
+	cache, err := lib.NewFileStorage(cacheFS, lib.StoragePurposeRepository)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to create block cache storage")
+	}
+	return &BlockCache{remote, cache, false, limit, sync.Mutex{}, -1}, nil
+}
+
+// Return the size limit of the block cache in bytes, 0 if there is none.
+func (w *Workspace) BlockCacheLimit(ctx context.Context) (int64, error) {
+	data, err := w.Storage.ReadControlFile(ctx, lib.ControlFileSectionConf, blockCacheLimitFile)
+	if errors.Is(err, lib.ErrControlFileNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, lib.WrapErrorf(err, "failed to read block cache limit")
+	}
+	limit, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || limit < 0 {
+		return 0, lib.Errorf("invalid block cache limit %q", data)
+	}
+	return limit, nil
+}
+
+// Set the size limit of the block cache in bytes, 0 removes the limit. The
+// cache is only shrunk the next time a block is added.
+func (w *Workspace) SetBlockCacheLimit(ctx context.Context, limit int64) error {
+	if limit < 0 {
+		return lib.Errorf("invalid block cache limit %d", limit)
+	}
+	if limit == 0 {
+		err := w.Storage.DeleteControlFile(ctx, lib.ControlFileSectionConf, blockCacheLimitFile)
+		if err != nil && !errors.Is(err, lib.ErrControlFileNotFound) {
+			return lib.WrapErrorf(err, "failed to remove block cache limit")
+		}
+		return nil
+	}
+	data := []byte(strconv.FormatInt(limit, 10) + "\n")
+	if err := w.Storage.WriteControlFile(ctx, lib.ControlFileSectionConf, blockCacheLimitFile, data); err != nil {
+		return lib.WrapErrorf(err, "failed to write block cache limit")
+	}
+	return nil
+}
+
+// Remove all blocks, the config, and the references from the block cache.
+func (w *Workspace) ClearBlockCache() error {
+	if err := w.FS.RemoveAll(blockCacheDir); err != nil {
+		return lib.WrapErrorf(err, "failed to clear the block cache")
+	}
+	return nil
+}
+
+// The size limit of the cache in bytes, 0 if there is none.
+func (c *BlockCache) Limit() int64 {
+	return c.limit
+}
+
+// Usage returns the number and the total size of the cached blocks.
+func (c *BlockCache) Usage(ctx context.Context) (int, int64, error) {
+	blocks, size := 0, int64(0)
+	err := c.cache.ReadLooseBlocks(ctx, func(_ lib.BlockId, info fs.FileInfo) bool {
+		blocks++
+		size += info.Size()
+		return true
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		// Nothing was cached yet.
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, lib.WrapErrorf(err, "failed to read the block cache")
+	}
+	return blocks, size, nil
+}
+
+func (c *BlockCache) Open(ctx context.Context) (lib.Toml, error) {
+	config, err := c.Storage.Open(ctx)
+	if err != nil {
+		if errors.Is(err, lib.ErrStorageNotFound) {
+			return nil, err //nolint:wrapcheck
+		}
+		if cached, cacheErr := c.cache.Open(ctx); cacheErr == nil {
+			return cached, nil
+		}
+		return nil, err //nolint:wrapcheck
+	}
+	// Blocks are bound to the repository id in the `storage` section.
+	if cached, err := c.cache.Open(ctx); err == nil && !maps.Equal(cached["storage"], config["storage"]) {
+		if err := c.cache.FS.RemoveAll(".cling"); err != nil {
+			return nil, lib.WrapErrorf(err, "failed to clear the block cache")
+		}
+		c.mu.Lock()
+		c.size = -1
+		c.mu.Unlock()
+	}
+	if c.Populate {
+		err := c.cache.WriteConfig(ctx, config, blockCacheHeaderComment)
+		if errors.Is(err, lib.ErrStorageNotFound) {
+			err = c.cache.Init(ctx, config, blockCacheHeaderComment)
+		}
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to write repository config to the block cache")
+		}
+	}
+	return config, nil
+}
+
+func (c *BlockCache) ReadBlock(ctx context.Context, blockId lib.BlockId, buf lib.BlockBuf) ([]byte, error) {
+	data, err := c.cache.ReadBlock(ctx, blockId, buf)
+	if err == nil {
+		// Only a hint for the eviction, so a failure does not matter.
+		_ = c.cache.TouchLooseBlock(blockId, time.Now())
+		return data, nil
+	}
+	data, err = c.Storage.ReadBlock(ctx, blockId, buf)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	if c.Populate {
+		if err := c.add(ctx, blockId, data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// HasBlocks asks the remote storage, in batches if it supports them.
+func (c *BlockCache) HasBlocks(ctx context.Context, blockIds []lib.BlockId) ([]bool, error) {
+	return lib.HasBlocks(ctx, c.Storage, blockIds) //nolint:wrapcheck
+}
+
+// WriteBlocks writes to the remote storage, in batches if it supports them.
+func (c *BlockCache) WriteBlocks(ctx context.Context, blocks []lib.StoredBlock) ([]bool, error) {
+	return lib.WriteStoredBlocks(ctx, c.Storage, blocks) //nolint:wrapcheck
+}
+
+// Write a block downloaded from the remote storage to the cache and evict
+// the least recently used blocks if the cache grows beyond its limit.
+func (c *BlockCache) add(ctx context.Context, blockId lib.BlockId, data []byte) error {
+	existed, err := c.cache.WriteBlock(ctx, blockId, data)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to write block %s to the block cache", blockId)
+	}
+	if existed || c.limit == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size < 0 {
+		// Includes the block just written.
+		_, c.size, err = c.Usage(ctx)
+		if err != nil {
+			return err
+		}
+	} else {
+		c.size += int64(len(data))
+	}
+	if c.size <= c.limit {
+		return nil
+	}
+	return c.evict(ctx)
+}
+
+// Remove the least recently used blocks until the cache is down to
+// `blockCacheEvictionTarget` of its limit. Must be called with `mu` held.
+func (c *BlockCache) evict(ctx context.Context) error {
+	type cachedBlock struct {
+		id    lib.BlockId
+		size  int64
+		mtime time.Time
+	}
+	var blocks []cachedBlock
+	size := int64(0)
+	err := c.cache.ReadLooseBlocks(ctx, func(id lib.BlockId, info fs.FileInfo) bool {
+		blocks = append(blocks, cachedBlock{id, info.Size(), info.ModTime()})
+		size += info.Size()
+		return true
+	})
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to read the block cache")
+	}
+	slices.SortFunc(blocks, func(a, b cachedBlock) int { return a.mtime.Compare(b.mtime) })
+	target := int64(float64(c.limit) * blockCacheEvictionTarget)
+	for _, block := range blocks {
+		if size <= target {
+			break
+		}
+		err := c.cache.DeleteLooseBlock(block.id)
+		if err != nil && !errors.Is(err, lib.ErrBlockNotFound) {
+			return lib.WrapErrorf(err, "failed to evict block %s from the block cache", block.id)
+		}
+		size -= block.size
+	}
+	c.size = size
+	return nil
+}
+
+// Fetch copies a block from the remote storage into the cache unless it is
+// cached already. Return the size of the block if it was downloaded and 0
+// otherwise.
+func (c *BlockCache) Fetch(ctx context.Context, blockId lib.BlockId, buf lib.BlockBuf) (int, error) {
+	ok, err := c.cache.HasBlock(ctx, blockId)
+	if err != nil {
+		return 0, lib.WrapErrorf(err, "failed to check the block cache for block %s", blockId)
+	}
+	if ok {
+		_ = c.cache.TouchLooseBlock(blockId, time.Now())
+		return 0, nil
+	}
+	data, err := c.Storage.ReadBlock(ctx, blockId, buf)
+	if err != nil {
+		return 0, lib.WrapErrorf(err, "failed to download block %s", blockId)
+	}
+	if err := c.add(ctx, blockId, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (c *BlockCache) ReadControlFile(
+	ctx context.Context,
+	section lib.ControlFileSection,
+	name string,
+) ([]byte, error) {
+	data, err := c.Storage.ReadControlFile(ctx, section, name)
+	if section != lib.ControlFileSectionRefs {
+		return data, err //nolint:wrapcheck
+	}
+	if err != nil {
+		if errors.Is(err, lib.ErrControlFileNotFound) {
+			return nil, err //nolint:wrapcheck
+		}
+		if cached, cacheErr := c.cache.ReadControlFile(ctx, section, name); cacheErr == nil {
+			return cached, nil
+		}
+		return nil, err //nolint:wrapcheck
+	}
+	if c.Populate {
+		if err := c.cache.WriteControlFile(ctx, section, name, data); err != nil {
+			return nil, lib.WrapErrorf(err, "failed to write reference %s to the block cache", name)
+		}
+	}
+	return data, nil
+}
+
+func (c *BlockCache) ListControlFiles(ctx context.Context, section lib.ControlFileSection) ([]string, error) {
+	names, err := c.Storage.ListControlFiles(ctx, section)
+	if err != nil && section == lib.ControlFileSectionRefs {
+		if cached, cacheErr := c.cache.ListControlFiles(ctx, section); cacheErr == nil {
+			return cached, nil
+		}
+	}
+	return names, err //nolint:wrapcheck
+}
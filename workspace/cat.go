@@ -15,7 +15,9 @@ type CatOptions struct {
 
 // Cat writes the contents of a single regular file from the repository to w.
 func Cat(ctx context.Context, repository *lib.Repository, w io.Writer, opts *CatOptions, tmpFS lib.FS) error {
-	snapshot, err := lib.NewRevisionSnapshot(ctx, repository, opts.RevisionId, tmpFS)
+	// Only the requested path ends up in the snapshot.
+	filter := &lib.PathEqualFilter{Path: opts.Path}
+	snapshot, err := lib.NewFilteredRevisionSnapshot(ctx, repository, opts.RevisionId, tmpFS, filter)
 	if err != nil {
 		return lib.WrapErrorf(err, "failed to create revision snapshot")
 	}
@@ -19,6 +19,8 @@ func TestCat(t *testing.T) {
 		w.Write("a.txt", "a")
 		w.Write("b.txt", "b")
 		w.Write("c/1.txt", "c1")
+		w.Write("d[1].txt", "d1")
+		w.Write("!e*.txt", "e")
 		w.Symlink("a.txt", "link")
 		rev1, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
 		assert.NoError(err)
@@ -56,6 +58,18 @@ func TestCat(t *testing.T) {
 		assert.Equal("c1", got)
 	})
 
+	t.Run("Reads a file with glob metacharacters in its name", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		cat, _, rev2 := setupCat(t)
+		got, err := cat(rev2, "d[1].txt")
+		assert.NoError(err)
+		assert.Equal("d1", got)
+		got, err = cat(rev2, "!e*.txt")
+		assert.NoError(err)
+		assert.Equal("e", got)
+	})
+
 	t.Run("Reads a file from an older revision", func(t *testing.T) {
 		t.Parallel()
 		assert := lib.NewAssert(t)
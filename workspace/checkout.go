@@ -0,0 +1,50 @@
+package workspace
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+type CheckoutToOptions struct {
+	RevisionId             lib.RevisionId
+	Monitor                CpMonitor
+	RestorableMetadataFlag lib.RestorableMetadataFlag
+}
+
+// CheckoutTo writes the state of the workspace at `opts.RevisionId` into
+// `targetFS`, which must be empty (or not exist yet). Only paths below the
+// workspace path prefix are written, relative to it, i.e. `targetFS` looks
+// like the workspace after a `Reset` to the revision.
+// The workspace itself (files and head) is not touched.
+func CheckoutTo(
+	ctx context.Context,
+	ws *Workspace,
+	repository *lib.Repository,
+	targetFS lib.FS,
+	opts *CheckoutToOptions,
+) error {
+	entries, err := targetFS.ReadDir(".")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return lib.WrapErrorf(err, "failed to read target directory %s", targetFS)
+	}
+	if len(entries) > 0 {
+		return lib.Errorf("target directory %s is not empty", targetFS)
+	}
+	tempFS, err := ws.TempFS.MkSub("checkout-to")
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to create checkout-to tmp dir")
+	}
+	defer tempFS.RemoveAll(".") //nolint:errcheck
+	cpOpts := &CpOptions{
+		RevisionId:             opts.RevisionId,
+		Monitor:                opts.Monitor,
+		PathFilter:             nil,
+		PathPrefix:             ws.PathPrefix,
+		RestorableMetadataFlag: opts.RestorableMetadataFlag,
+		HardLinkDupes:          false,
+	}
+	return Cp(ctx, repository, targetFS, cpOpts, tempFS)
+}
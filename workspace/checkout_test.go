@@ -0,0 +1,66 @@
+package workspace
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestCheckoutTo(t *testing.T) {
+	t.Parallel()
+	t.Run("Happy path", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+
+		w.Write("a.txt", "a")
+		w.Write("c/1.txt", "c")
+		rev1, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		w.Write("a.txt", "aa")
+		w.Rm("c/1.txt")
+		w.Write("b.txt", "b")
+		rev2, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		before := w.Ls(".")
+
+		out := td.NewTestFS(t, td.NewFS(t))
+		opts := &CheckoutToOptions{rev1, wstd.CpMonitor(), lib.RestorableMetadataAll}
+		err = CheckoutTo(t.Context(), w.Workspace, r.Repository, out.FS, opts)
+		assert.NoError(err)
+		assert.Equal([]lib.TestFileInfo{
+			{"a.txt", 0o600, 1, "a"},
+			{"c", 0o700 | fs.ModeDir, 0, ""},
+			{"c/1.txt", 0o600, 1, "c"},
+		}, out.Ls("."))
+		// The workspace is untouched.
+		assert.Equal(before, w.Ls("."))
+		assert.Equal(rev2, w.Head())
+
+		// The target must be empty.
+		err = CheckoutTo(t.Context(), w.Workspace, r.Repository, out.FS, opts)
+		assert.Error(err, "is not empty")
+	})
+
+	t.Run("Workspace with path prefix", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		rootW := wstd.NewTestWorkspace(t, r.Repository)
+		rootW.Write("a.txt", "a")
+		rootW.Write("sub/b.txt", "b")
+		rev, err := Merge(t.Context(), rootW.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		prefixW := wstd.NewTestWorkspaceWithPathPrefix(t, r.Repository, "sub/")
+
+		out := td.NewTestFS(t, td.NewFS(t))
+		opts := &CheckoutToOptions{rev, wstd.CpMonitor(), lib.RestorableMetadataAll}
+		err = CheckoutTo(t.Context(), prefixW.Workspace, r.Repository, out.FS, opts)
+		assert.NoError(err)
+		assert.Equal([]lib.TestFileInfo{
+			{"b.txt", 0o600, 1, "b"},
+		}, out.Ls("."))
+	})
+}
@@ -0,0 +1,285 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// The commit journal lists the files a merge uploaded to the repository. If
+// the merge is interrupted before the revision is written, the next merge
+// takes the block ids of unchanged files from the journal instead of reading
+// and chunking them again. The journal is removed once the commit succeeded.
+// The first line identifies the journal, every other line is
+//
+//	<file hash> <block id>,<block id>,... <quoted path>
+//
+// The paths are repository paths. A line is only written once all blocks of
+// the file are in the repository.
+//
+// If the workspace encrypts its cache (see `Workspace.EncryptCache`), the
+// journal is written through a `lib.EncryptedFS` with the same key. Such a
+// file cannot be appended to, so the lines are written in batches instead,
+// each to a new file in `encryptedCommitJournalDir` that starts with the
+// header. A batch is written once it is large or old enough, and when the
+// journal is closed.
+const (
+	commitJournalPath         = workspaceDir + "/commit-journal.txt"
+	encryptedCommitJournalDir = workspaceDir + "/commit-journal"
+	commitJournalHeader       = "cling-sync commit journal 1"
+	commitJournalBatchSize    = 64 * 1024
+	commitJournalBatchAge     = 10 * time.Second
+)
+
+type commitJournalEntry struct {
+	fileHash lib.Sha256
+	blockIds []lib.BlockId
+}
+
+type commitJournal struct {
+	fs lib.FS
+	w  io.WriteCloser
+	// The files uploaded by this or an interrupted merge.
+	entries map[lib.Path]commitJournalEntry
+}
+
+// Open the commit journal of the workspace. The entries of an interrupted
+// merge are read and kept, new entries are appended to them, so that they
+// survive another interruption. If `key` is given, the journal is encrypted
+// with it. A journal that was written with another key (or without one) is
+// dropped.
+func openCommitJournal(src lib.FS, key *lib.RawKey) (*commitJournal, error) {
+	if key != nil {
+		return openEncryptedCommitJournal(src, *key)
+	}
+	if err := src.RemoveAll(encryptedCommitJournalDir); err != nil {
+		return nil, lib.WrapErrorf(err, "failed to remove encrypted commit journal")
+	}
+	entries := map[lib.Path]commitJournalEntry{}
+	data, err := lib.ReadFile(src, commitJournalPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, lib.WrapErrorf(err, "failed to read commit journal")
+	}
+	// Cut off a partial last line, the next entry would be appended to it.
+	keep := int64(0)
+	if header, rest, _ := bytes.Cut(data, []byte("\n")); string(header) == commitJournalHeader {
+		entries = parseCommitJournal(rest)
+		keep = int64(bytes.LastIndexByte(data, '\n') + 1)
+	}
+	w, err := src.OpenAppend(commitJournalPath, keep)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to open commit journal")
+	}
+	if keep == 0 {
+		if _, err := io.WriteString(w, commitJournalHeader+"\n"); err != nil {
+			_ = w.Close()
+			return nil, lib.WrapErrorf(err, "failed to write commit journal")
+		}
+	}
+	return &commitJournal{src, w, entries}, nil
+}
+
+func openEncryptedCommitJournal(src lib.FS, key lib.RawKey) (*commitJournal, error) {
+	if err := src.Remove(commitJournalPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, lib.WrapErrorf(err, "failed to remove unencrypted commit journal")
+	}
+	dir, err := src.MkSub(encryptedCommitJournalDir)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to create commit journal directory")
+	}
+	encrypted, err := lib.NewEncryptedFSWithKey(dir, key)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to encrypt commit journal")
+	}
+	files, err := dir.ReadDir(".")
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read commit journal directory")
+	}
+	entries := map[lib.Path]commitJournalEntry{}
+	next := 0
+	// The names are zero-padded sequence numbers, i.e. sorted by age.
+	for _, file := range files {
+		seq, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".txt"))
+		if err != nil {
+			// A leftover of an interrupted `lib.AtomicWriteFile`.
+			_ = dir.Remove(file.Name())
+			continue
+		}
+		next = max(next, seq+1)
+		data, err := lib.ReadFile(encrypted, file.Name())
+		header, rest, _ := bytes.Cut(data, []byte("\n"))
+		if err != nil || string(header) != commitJournalHeader {
+			// Written with another key or by another version.
+			if err := dir.Remove(file.Name()); err != nil {
+				return nil, lib.WrapErrorf(err, "failed to remove commit journal batch %s", file.Name())
+			}
+			continue
+		}
+		maps.Copy(entries, parseCommitJournal(rest))
+	}
+	w := &commitJournalBatchWriter{encrypted, next, nil, time.Now()}
+	return &commitJournal{src, w, entries}, nil
+}
+
+// Write the lines of the encrypted journal in batches, see `commitJournalPath`.
+type commitJournalBatchWriter struct {
+	fs lib.FS
+	// The sequence number of the next batch.
+	next    int
+	batch   []byte
+	started time.Time
+}
+
+// Add the lines in `p` to the batch and write it if it is large or old
+// enough. `p` must end with a complete line.
+func (w *commitJournalBatchWriter) Write(p []byte) (int, error) {
+	if len(w.batch) == 0 {
+		w.started = time.Now()
+	}
+	w.batch = append(w.batch, p...)
+	if len(w.batch) >= commitJournalBatchSize || time.Since(w.started) >= commitJournalBatchAge {
+		if err := w.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *commitJournalBatchWriter) flush() error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+	name := fmt.Sprintf("%010d.txt", w.next)
+	if err := lib.AtomicWriteFile(w.fs, name, 0o600, []byte(commitJournalHeader+"\n"), w.batch); err != nil {
+		return lib.WrapErrorf(err, "failed to write commit journal batch %s", name)
+	}
+	w.next++
+	w.batch = w.batch[:0]
+	return nil
+}
+
+func (w *commitJournalBatchWriter) Close() error {
+	return w.flush()
+}
+
+// Parse the entries of the journal. An interrupted merge might have left a
+// partial last line, invalid lines are ignored.
+func parseCommitJournal(data []byte) map[lib.Path]commitJournalEntry {
+	entries := map[lib.Path]commitJournalEntry{}
+	for line := range strings.SplitSeq(string(data), "\n") {
+		hashHex, rest, ok1 := strings.Cut(line, " ")
+		blockIdsHex, quotedPath, ok2 := strings.Cut(rest, " ")
+		if !ok1 || !ok2 {
+			continue
+		}
+		hash, err := hex.DecodeString(hashHex)
+		if err != nil || len(hash) != len(lib.Sha256{}) {
+			continue
+		}
+		rawPath, err := strconv.Unquote(quotedPath)
+		if err != nil {
+			continue
+		}
+		path, err := lib.NewPath(rawPath)
+		if err != nil {
+			continue
+		}
+		var blockIds []lib.BlockId
+		for s := range strings.SplitSeq(blockIdsHex, ",") {
+			blockId, err := lib.NewBlockIdFromString(s)
+			if err != nil {
+				blockIds = nil
+				break
+			}
+			blockIds = append(blockIds, blockId)
+		}
+		if len(blockIds) == 0 {
+			continue
+		}
+		entries[path] = commitJournalEntry{lib.Sha256(hash), blockIds}
+	}
+	return entries
+}
+
+func formatCommitJournalEntry(path lib.Path, fileHash lib.Sha256, blockIds []lib.BlockId) string {
+	var line strings.Builder
+	line.WriteString(hex.EncodeToString(fileHash[:]))
+	for i, blockId := range blockIds {
+		if i == 0 {
+			line.WriteByte(' ')
+		} else {
+			line.WriteByte(',')
+		}
+		line.WriteString(blockId.String())
+	}
+	line.WriteString(" " + strconv.Quote(path.String()) + "\n")
+	return line.String()
+}
+
+// Record that the file at `path` was uploaded. Empty files are not recorded,
+// there is nothing to upload.
+func (j *commitJournal) add(path lib.Path, fileHash lib.Sha256, blockIds []lib.BlockId) error {
+	if len(blockIds) == 0 {
+		return nil
+	}
+	if _, err := io.WriteString(j.w, formatCommitJournalEntry(path, fileHash, blockIds)); err != nil {
+		return lib.WrapErrorf(err, "failed to write commit journal")
+	}
+	j.entries[path] = commitJournalEntry{fileHash, blockIds}
+	return nil
+}
+
+// Return the block ids of the file at `path` with `fileHash` if it was
+// uploaded before and all its blocks are still in the repository.
+func (j *commitJournal) blockIds(
+	ctx context.Context,
+	repository *lib.Repository,
+	path lib.Path,
+	fileHash lib.Sha256,
+) ([]lib.BlockId, bool, error) {
+	entry, ok := j.entries[path]
+	if !ok || entry.fileHash != fileHash {
+		return nil, false, nil
+	}
+	exists, err := repository.HasBlocks(ctx, entry.blockIds)
+	if err != nil {
+		return nil, false, err //nolint:wrapcheck
+	}
+	if slices.Contains(exists, false) {
+		return nil, false, nil
+	}
+	return entry.blockIds, true, nil
+}
+
+// Close the journal and keep it for the next merge.
+func (j *commitJournal) close() error {
+	if err := j.w.Close(); err != nil {
+		return lib.WrapErrorf(err, "failed to close commit journal")
+	}
+	return nil
+}
+
+// Close and remove the journal after a successful commit.
+func (j *commitJournal) remove() error {
+	if err := j.close(); err != nil {
+		return err
+	}
+	if err := j.fs.Remove(commitJournalPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return lib.WrapErrorf(err, "failed to remove commit journal")
+	}
+	if err := j.fs.RemoveAll(encryptedCommitJournalDir); err != nil {
+		return lib.WrapErrorf(err, "failed to remove encrypted commit journal")
+	}
+	return nil
+}
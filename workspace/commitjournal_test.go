@@ -0,0 +1,193 @@
+package workspace
+
+import (
+	"io/fs"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// A commit monitor that records the files with blocks and fails when
+// `failAt` is started.
+type journalTestMonitor struct {
+	TestCommitMonitor
+	failAt  lib.Path
+	chunked map[lib.Path]bool
+}
+
+func (m *journalTestMonitor) OnStart(entry *lib.RevisionEntry) error {
+	if entry.Path == m.failAt {
+		return lib.Errorf("interrupted")
+	}
+	return m.TestCommitMonitor.OnStart(entry)
+}
+
+func (m *journalTestMonitor) OnAddBlock(
+	entry *lib.RevisionEntry,
+	blockId lib.BlockId,
+	dataSize int,
+	dataBytesWritten *int,
+) error {
+	m.chunked[entry.Path] = true
+	return nil
+}
+
+func TestCommitJournal(t *testing.T) {
+	t.Parallel()
+	merge := func(t *testing.T, w *TestWorkspace, r *lib.TestRepository, failAt string) (*journalTestMonitor, error) {
+		t.Helper()
+		mon := &journalTestMonitor{TestCommitMonitor{}, td.Path(failAt), map[lib.Path]bool{}} //nolint:exhaustruct
+		opts := wstd.MergeOptions()
+		opts.CommitMonitor = mon
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, opts)
+		return mon, err
+	}
+
+	t.Run("Files uploaded by an interrupted merge are not uploaded again", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		w.Write("b.txt", "b")
+		w.Write("c.txt", "c")
+		mon, err := merge(t, w, r, "c.txt")
+		assert.Error(err, "interrupted")
+		assert.Equal(map[lib.Path]bool{td.Path("a.txt"): true, td.Path("b.txt"): true}, mon.chunked)
+		assert.Equal(true, r.Head().IsRoot())
+
+		w.Write("b.txt", "b changed")
+		mon, err = merge(t, w, r, "")
+		assert.NoError(err)
+		assert.Equal(map[lib.Path]bool{td.Path("b.txt"): true, td.Path("c.txt"): true}, mon.chunked)
+		assert.Equal([]lib.TestFileInfo{
+			{"a.txt", 0o600, 1, "a"},
+			{"b.txt", 0o600, 9, "b changed"},
+			{"c.txt", 0o600, 1, "c"},
+		}, r.RevisionSnapshotFileInfos(r.Head(), nil))
+		_, err = w.Workspace.FS.Stat(commitJournalPath)
+		assert.ErrorIs(err, fs.ErrNotExist)
+	})
+
+	t.Run("The journal survives another interruption", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		w.Write("b.txt", "b")
+		_, err := merge(t, w, r, "b.txt")
+		assert.Error(err, "interrupted")
+		mon, err := merge(t, w, r, "b.txt")
+		assert.Error(err, "interrupted")
+		assert.Equal(map[lib.Path]bool{}, mon.chunked)
+		mon, err = merge(t, w, r, "")
+		assert.NoError(err)
+		assert.Equal(map[lib.Path]bool{td.Path("b.txt"): true}, mon.chunked)
+	})
+
+	t.Run("Entries are appended after a partial last line is cut off", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		src := lib.NewMemoryFS(10_000_000)
+		assert.NoError(src.MkdirAll(workspaceDir))
+		blockIds := []lib.BlockId{{1}}
+		a := formatCommitJournalEntry(td.Path("a.txt"), lib.Sha256{1}, blockIds)
+		b := formatCommitJournalEntry(td.Path("b.txt"), lib.Sha256{2}, blockIds)
+		c := formatCommitJournalEntry(td.Path("c.txt"), lib.Sha256{3}, blockIds)
+		header := commitJournalHeader + "\n"
+		assert.NoError(lib.WriteFile(src, commitJournalPath, []byte(header+a+b[:20])))
+
+		j, err := openCommitJournal(src, nil)
+		assert.NoError(err)
+		assert.Equal([]lib.Path{td.Path("a.txt")}, slices.Collect(maps.Keys(j.entries)))
+		assert.NoError(j.add(td.Path("c.txt"), lib.Sha256{3}, blockIds))
+		assert.NoError(j.close())
+		data, err := lib.ReadFile(src, commitJournalPath)
+		assert.NoError(err)
+		assert.Equal(header+a+c, string(data))
+
+		// A journal with an unknown header is started anew.
+		assert.NoError(lib.WriteFile(src, commitJournalPath, []byte("cling-sync commit journal 0\n"+a)))
+		j, err = openCommitJournal(src, nil)
+		assert.NoError(err)
+		assert.Equal(0, len(j.entries))
+		assert.NoError(j.add(td.Path("c.txt"), lib.Sha256{3}, blockIds))
+		assert.NoError(j.close())
+		data, err = lib.ReadFile(src, commitJournalPath)
+		assert.NoError(err)
+		assert.Equal(header+c, string(data))
+	})
+
+	t.Run("The encrypted journal can only be read with the same key", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		src := lib.NewMemoryFS(10_000_000)
+		assert.NoError(src.MkdirAll(workspaceDir))
+		key, err := lib.NewRawKey()
+		assert.NoError(err)
+		otherKey, err := lib.NewRawKey()
+		assert.NoError(err)
+		blockIds := []lib.BlockId{{1}}
+		header := commitJournalHeader + "\n"
+		assert.NoError(lib.WriteFile(src, commitJournalPath, []byte(header)))
+
+		j, err := openCommitJournal(src, &key)
+		assert.NoError(err)
+		assert.NoError(j.add(td.Path("a.txt"), lib.Sha256{1}, blockIds))
+		assert.NoError(j.close())
+		_, err = src.Stat(commitJournalPath)
+		assert.ErrorIs(err, fs.ErrNotExist)
+		data, err := lib.ReadFile(src, encryptedCommitJournalDir+"/0000000000.txt")
+		assert.NoError(err)
+		assert.Equal(false, strings.Contains(string(data), "a.txt"))
+
+		// Every batch is a new file.
+		j, err = openCommitJournal(src, &key)
+		assert.NoError(err)
+		assert.Equal([]lib.Path{td.Path("a.txt")}, slices.Collect(maps.Keys(j.entries)))
+		assert.NoError(j.add(td.Path("b.txt"), lib.Sha256{2}, blockIds))
+		assert.NoError(j.close())
+		j, err = openCommitJournal(src, &key)
+		assert.NoError(err)
+		assert.Equal(2, len(j.entries))
+		assert.NoError(j.close())
+
+		j, err = openCommitJournal(src, &otherKey)
+		assert.NoError(err)
+		assert.Equal(0, len(j.entries))
+		assert.NoError(j.close())
+		files, err := src.ReadDir(encryptedCommitJournalDir)
+		assert.NoError(err)
+		assert.Equal(0, len(files))
+
+		// Without a key, the encrypted journal is dropped.
+		j, err = openCommitJournal(src, &key)
+		assert.NoError(err)
+		assert.NoError(j.add(td.Path("a.txt"), lib.Sha256{1}, blockIds))
+		assert.NoError(j.close())
+		j, err = openCommitJournal(src, nil)
+		assert.NoError(err)
+		assert.Equal(0, len(j.entries))
+		assert.NoError(j.remove())
+		_, err = src.Stat(encryptedCommitJournalDir)
+		assert.ErrorIs(err, fs.ErrNotExist)
+	})
+
+	t.Run("Invalid lines are ignored", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		blockIds := []lib.BlockId{{1}, {2}}
+		hash := lib.Sha256{3}
+		valid := formatCommitJournalEntry(td.Path("a b\n.txt"), hash, blockIds)
+		partial := formatCommitJournalEntry(td.Path("c.txt"), hash, blockIds)
+		partial = partial[:len(partial)-10]
+		entries := parseCommitJournal([]byte(valid + "xyz \"b.txt\"\n" + partial))
+		assert.Equal(map[lib.Path]commitJournalEntry{
+			td.Path("a b\n.txt"): {hash, blockIds},
+		}, entries)
+	})
+}
@@ -0,0 +1,75 @@
+package workspace
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"strings"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// The file with the settings of a workspace that are up to the user, unlike
+// the configuration in `.cling/workspace` (see `Config`).
+const ConfigFile = ".cling/config.toml"
+
+// The section of `ConfigFile` that applies to all commands.
+const ConfigDefaultsSection = "defaults"
+
+// Config holds the defaults of the command line flags of a workspace, so
+// that they don't have to be passed to every command:
+//
+//	[defaults]
+//	no-progress = "true"
+//
+//	[merge]
+//	author = "me"
+//	message = "Synced from {hostname}"
+//	fast-scan = "true"
+//	exclude = "*.tmp, logs/*"
+//
+// The keys are flag names. The `[defaults]` section applies to all commands
+// that have the flag, a section named after a command only to that command.
+type Config struct {
+	toml lib.Toml
+}
+
+// Read `ConfigFile`. Return an empty config if the file does not exist.
+func ReadConfig(fs_ lib.FS) (*Config, error) {
+	return ReadConfigFile(fs_, ConfigFile)
+}
+
+// Read a config file with the same format as `ConfigFile` at `path`, e.g.
+// the user config of the CLI. Return an empty config if the file does not
+// exist.
+func ReadConfigFile(fs_ lib.FS, path string) (*Config, error) {
+	content, err := lib.ReadFile(fs_, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &Config{lib.Toml{}}, nil
+	}
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read %s", path)
+	}
+	toml, err := lib.ReadToml(bytes.NewReader(content))
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to parse %s", path)
+	}
+	return &Config{toml}, nil
+}
+
+// Return the key-value pairs of `section`, nil if there is no such section.
+func (c *Config) Section(section string) map[string]string {
+	return c.toml[section]
+}
+
+// Split a list value of the config, e.g. the patterns of `exclude`, at the
+// commas.
+func SplitConfigList(value string) []string {
+	var values []string
+	for v := range strings.SplitSeq(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,35 @@
+package workspace
+
+import (
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestConfig(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	fs := td.NewTestFS(t, td.NewFS(t))
+	config, err := ReadConfig(fs.FS)
+	assert.NoError(err)
+	assert.Nil(config.Section("merge"))
+
+	fs.Write(ConfigFile, `
+# The defaults of the flags.
+[defaults]
+no-progress = "true"
+
+[merge]
+message = "Synced from {hostname}"
+exclude = "*.tmp, logs/* ,"
+`)
+	config, err = ReadConfig(fs.FS)
+	assert.NoError(err)
+	assert.Equal(map[string]string{"no-progress": "true"}, config.Section(ConfigDefaultsSection))
+	assert.Equal("Synced from {hostname}", config.Section("merge")["message"])
+	assert.Equal([]string{"*.tmp", "logs/*"}, SplitConfigList(config.Section("merge")["exclude"]))
+
+	fs.Write(ConfigFile, "[merge]\nfast-scan = true\n")
+	_, err = ReadConfig(fs.FS)
+	assert.Error(err, "failed to parse .cling/config.toml")
+}
@@ -26,6 +26,9 @@ const (
 )
 
 type CpMonitor interface {
+	// OnTotal is called before copying with the number of paths and the
+	// total size of the files that are going to be copied.
+	OnTotal(paths int, bytes int64)
 	OnStart(entry *lib.RevisionEntry, targetPath string) error
 	OnExists(entry *lib.RevisionEntry, targetPath string) CpOnExists
 	OnWrite(entry *lib.RevisionEntry, targetPath string, blockId lib.BlockId, data []byte) error
@@ -39,6 +42,10 @@ type CpOptions struct {
 	PathFilter             lib.PathFilter
 	PathPrefix             lib.Path
 	RestorableMetadataFlag lib.RestorableMetadataFlag
+	// Restore files with the same content and metadata as hard links of
+	// each other. Files of the same hard link group (see
+	// `lib.PathMetadata.HardLinkGroup`) are always restored as hard links.
+	HardLinkDupes bool
 }
 
 func Cp( //nolint:funlen
@@ -53,8 +60,25 @@ func Cp( //nolint:funlen
 		return lib.WrapErrorf(err, "failed to create revision snapshot")
 	}
 	defer snapshot.Remove() //nolint:errcheck
-	reader := snapshot.Reader(nil)
 	mon := opts.Monitor
+	buf := lib.NewBlockBuf()
+	links := newHardLinker(opts.HardLinkDupes)
+	include := func(entry *lib.RevisionEntry) (lib.Path, bool) {
+		// Match the filter and restore under the prefix-relative path the user
+		// sees.
+		path, ok := entry.Path.TrimBase(opts.PathPrefix)
+		if !ok {
+			return path, false
+		}
+		if opts.PathFilter != nil && !opts.PathFilter.Include(path, entry.Metadata.FileMode.IsDir()) {
+			return path, false
+		}
+		return path, true
+	}
+	if err := reportCpTotal(snapshot, include, mon, buf); err != nil {
+		return err
+	}
+	reader := snapshot.Reader(nil)
 	// Directory modes are restored last, after their contents. We carry the
 	// prefix-relative restore target because the entry itself is left untouched.
 	type restorableDir struct {
@@ -71,7 +95,6 @@ func Cp( //nolint:funlen
 		return nil
 	}
 	defer restoreDirFileModes() //nolint:errcheck
-	buf := lib.NewBlockBuf()
 	for {
 		entry, err := reader.Read(buf)
 		if errors.Is(err, io.EOF) {
@@ -80,20 +103,15 @@ func Cp( //nolint:funlen
 		if err != nil {
 			return lib.WrapErrorf(err, "failed to read revision snapshot")
 		}
-		// Match the filter and restore under the prefix-relative path the user
-		// sees.
-		path, ok := entry.Path.TrimBase(opts.PathPrefix)
+		path, ok := include(entry)
 		if !ok {
 			continue
 		}
-		if opts.PathFilter != nil && !opts.PathFilter.Include(path, entry.Metadata.FileMode.IsDir()) {
-			continue
-		}
 		target := path.String()
 		if err := mon.OnStart(entry, target); err != nil {
 			return lib.WrapErrorf(err, "cp monitor start failed for %s", target)
 		}
-		if err := restore(ctx, entry, repository, targetFS, target, buf, mon); err != nil {
+		if err := restore(ctx, entry, repository, targetFS, target, buf, mon, links); err != nil {
 			return lib.WrapErrorf(err, "failed to copy %s", target)
 		}
 		if err := restoreFileMode(targetFS, target, &entry.Metadata, opts.RestorableMetadataFlag); err != nil {
@@ -132,6 +150,36 @@ func Cp( //nolint:funlen
 	return nil
 }
 
+// Call `mon.OnTotal` with the number of entries in `snapshot` that are
+// included and the size of their files.
+func reportCpTotal(
+	snapshot *lib.Temp[*lib.RevisionEntry],
+	include func(entry *lib.RevisionEntry) (lib.Path, bool),
+	mon CpMonitor,
+	buf lib.BlockBuf,
+) error {
+	paths, bytes := 0, int64(0)
+	reader := snapshot.Reader(nil)
+	for {
+		entry, err := reader.Read(buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to read revision snapshot")
+		}
+		if _, ok := include(entry); !ok {
+			continue
+		}
+		paths++
+		if entry.Metadata.FileMode.IsRegular() {
+			bytes += entry.Metadata.Size
+		}
+	}
+	mon.OnTotal(paths, bytes)
+	return nil
+}
+
 func restore( //nolint:funlen
 	ctx context.Context,
 	entry *lib.RevisionEntry,
@@ -140,6 +188,7 @@ func restore( //nolint:funlen
 	target string,
 	buf lib.BlockBuf,
 	mon CpMonitor,
+	links *hardLinker,
 ) error {
 	md := entry.Metadata
 	localInfo, statErr := targetFS.Stat(target)
@@ -195,6 +244,12 @@ func restore( //nolint:funlen
 		}
 		return lib.WrapErrorf(err, "failed to create parent directory %s", target)
 	}
+	// Existing files are overwritten in place below, never replaced by a link.
+	if source, ok := links.source(&md); ok && statErr != nil {
+		if replaceWithHardLink(targetFS, source, target) {
+			return nil
+		}
+	}
 	f, err := targetFS.OpenWriteExcl(target)
 	if errors.Is(err, fs.ErrExist) {
 		switch mon.OnExists(entry, target) {
@@ -218,6 +273,7 @@ func restore( //nolint:funlen
 		}
 		return lib.WrapErrorf(err, "failed to open file %s for writing", target)
 	}
+	f = lib.NewSparseWriter(f, md.Holes)
 	defer f.Close() //nolint:errcheck
 	for _, blockId := range entry.Metadata.BlockIds {
 		data, err := repository.ReadBlock(ctx, blockId, buf)
@@ -261,6 +317,7 @@ func restore( //nolint:funlen
 		}
 		return lib.WrapErrorf(err, "failed to restore file mode %s for %s", md.FileMode, target)
 	}
+	links.addRestored(&md, target)
 	return nil
 }
 
@@ -333,6 +390,12 @@ func restoreFileMode(
 				)
 			}
 		}
+		// Before the mode, a read-only file cannot get extended attributes.
+		if restorableMetadataFlag&lib.RestorableMetadataXattrs != 0 {
+			if err := fs.SetXattrs(path, md.Xattrs); err != nil {
+				return lib.WrapErrorf(err, "failed to restore extended attributes for %s", path)
+			}
+		}
 		if restorableMetadataFlag&lib.RestorableMetadataMode != 0 {
 			if err := fs.Chmod(path, (md.FileMode & lib.FileModePerm).AsFsFileMode()); err != nil {
 				return lib.WrapErrorf(err, "failed to restore file mode %s for %s", md.FileMode, path)
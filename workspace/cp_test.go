@@ -6,6 +6,7 @@ import (
 	"runtime"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/flunderpero/cling-sync/lib"
 )
@@ -66,7 +67,7 @@ func TestCp(t *testing.T) {
 		cpOpts := func(pattern string) *CpOptions {
 			return &CpOptions{
 				rev, wstd.CpMonitor(),
-				lib.NewPathInclusionFilter([]string{pattern}), prefixA, lib.RestorableMetadataAll,
+				lib.NewPathInclusionFilter([]string{pattern}), prefixA, lib.RestorableMetadataAll, false,
 			}
 		}
 
@@ -89,6 +90,40 @@ func TestCp(t *testing.T) {
 		assert.Equal("B/1.txt", linkTarget)
 	})
 
+	t.Run("Hard links and (optionally) duplicates are restored as hard links", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		mtime := time.Now().Add(-time.Hour)
+		w.Write("a.txt", "abc")
+		w.Link("a.txt", "b/c.txt")
+		for _, path := range []string{"a.txt", "d.txt", "e.txt"} {
+			if path != "a.txt" {
+				w.Write(path, "abc")
+			}
+			w.Touch(path, mtime)
+		}
+		w.Chmod("e.txt", 0o640)
+		rev, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+
+		out := td.NewTestFS(t, td.NewFS(t))
+		assert.NoError(Cp(t.Context(), r.Repository, out.FS, wstd.CpOptions(rev), td.NewFS(t)))
+		assert.Equal(true, out.SameFile("a.txt", "b/c.txt"))
+		assert.Equal(false, out.SameFile("a.txt", "d.txt"))
+
+		// Only files with the same metadata are linked.
+		out = td.NewTestFS(t, td.NewFS(t))
+		opts := wstd.CpOptions(rev)
+		opts.HardLinkDupes = true
+		assert.NoError(Cp(t.Context(), r.Repository, out.FS, opts, td.NewFS(t)))
+		assert.Equal(true, out.SameFile("a.txt", "b/c.txt"))
+		assert.Equal(true, out.SameFile("a.txt", "d.txt"))
+		assert.Equal(false, out.SameFile("a.txt", "e.txt"))
+		assert.Equal("abc", out.Cat("e.txt"))
+	})
+
 	t.Run("Overwrite", func(t *testing.T) {
 		t.Parallel()
 		assert := lib.NewAssert(t)
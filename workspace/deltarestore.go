@@ -0,0 +1,332 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// Smaller files are always restored as a whole, see `restoreInPlace`.
+const restoreInPlaceMinSize = lib.MaxBlockDataSize
+
+// While a file is restored in place, it is neither the old nor the new
+// version. The journal records the revision entry of the new version (with
+// the path of the file relative to the workspace), so that an interrupted
+// restore is finished by `finishRestoreInPlace`. It has a header line
+// followed by the marshalled entry, and it is encrypted like the commit
+// journal (see `commitJournalPath`).
+const (
+	restoreJournalPath   = workspaceDir + "/restore-in-place.txt"
+	restoreJournalHeader = "cling-sync restore in place 1"
+)
+
+// Restore a large file that exists in the workspace by only writing the
+// blocks that differ. The local file is split into blocks like
+// `addBlocksToRepository` does, the blocks of `entry` that are at the same
+// offset in the local file are left alone, the others are read from the
+// repository and written in place.
+// Return `false` if the file has to be restored as a whole, i.e. it does not
+// exist, is small, is a hard link (the other links would change, too), is
+// sparse, or has less than half of its blocks in common with `entry`.
+// An interrupted restore is finished by the next merge or reset, see
+// `restoreJournalPath`.
+func (m *Merger) restoreInPlace(
+	ctx context.Context,
+	entry *lib.RevisionEntry,
+	mon CpMonitor,
+	target string,
+) (bool, error) {
+	md := &entry.Metadata
+	if md.Size < restoreInPlaceMinSize || len(md.Holes) > 0 {
+		return false, nil
+	}
+	stat, err := m.ws.FS.Stat(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, lib.WrapErrorf(err, "failed to stat %s", target)
+	}
+	if !stat.Mode().IsRegular() || stat.Size() < restoreInPlaceMinSize {
+		return false, nil
+	}
+	if _, isLink := newHardLinkKey(stat); isLink {
+		return false, nil
+	}
+	local, sizes, err := m.localBlockIds(target)
+	if err != nil {
+		return false, err
+	}
+	common := 0
+	for _, blockId := range md.BlockIds {
+		if _, ok := sizes[blockId]; ok {
+			common++
+		}
+	}
+	if common*2 < len(md.BlockIds) {
+		return false, nil
+	}
+	f, err := m.ws.FS.OpenWriteAt(target)
+	if errors.Is(err, errors.ErrUnsupported) || errors.Is(err, fs.ErrPermission) {
+		// A read-only file can still be replaced.
+		return false, nil
+	}
+	if err != nil {
+		return false, lib.WrapErrorf(err, "failed to open file %s for writing", target)
+	}
+	defer f.Close() //nolint:errcheck
+	journalFS, err := restoreJournalFS(m.ws, m.repository)
+	if err != nil {
+		return true, err
+	}
+	if err := writeRestoreJournal(journalFS, target, entry); err != nil {
+		return true, err
+	}
+	offset := int64(0)
+	for _, blockId := range md.BlockIds {
+		if local[offset] == blockId {
+			offset += sizes[blockId]
+			continue
+		}
+		data, err := m.repository.ReadBlock(ctx, blockId, m.blockBuf)
+		if err != nil {
+			return true, lib.WrapErrorf(err, "failed to read block %s", blockId)
+		}
+		if _, err := f.WriteAt(data, offset); err != nil {
+			return true, lib.WrapErrorf(err, "failed to write block %s", blockId)
+		}
+		if err := mon.OnWrite(entry, target, blockId, data); err != nil {
+			return true, lib.WrapErrorf(err, "cp monitor write failed for %s", target)
+		}
+		offset += int64(len(data))
+	}
+	if err := f.Truncate(offset); err != nil {
+		return true, lib.WrapErrorf(err, "failed to truncate %s", target)
+	}
+	if err := f.Close(); err != nil {
+		return true, lib.WrapErrorf(err, "failed to close file %s", target)
+	}
+	if err := m.ws.FS.Remove(restoreJournalPath); err != nil {
+		return true, lib.WrapErrorf(err, "failed to remove %s", restoreJournalPath)
+	}
+	return true, nil
+}
+
+// Return the FS the restore journal is read from and written to.
+func restoreJournalFS(ws *Workspace, repository *lib.Repository) (lib.FS, error) { //nolint:ireturn
+	key, err := ws.cacheKey(repository)
+	if err != nil || key == nil {
+		return ws.FS, err
+	}
+	encrypted, err := lib.NewEncryptedFSWithKey(ws.FS, *key)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to encrypt %s", restoreJournalPath)
+	}
+	return encrypted, nil
+}
+
+func writeRestoreJournal(journalFS lib.FS, target string, entry *lib.RevisionEntry) error {
+	path, err := lib.NewPath(target)
+	if err != nil {
+		return lib.WrapErrorf(err, "invalid path %s", target)
+	}
+	journaled := *entry
+	journaled.Path = path
+	w := lib.NewProtobufWriter(make([]byte, journaled.MarshallSize()))
+	if err := journaled.Marshall(w); err != nil {
+		return lib.WrapErrorf(err, "failed to marshal revision entry for %s", target)
+	}
+	if err := lib.AtomicWriteFile(
+		journalFS, restoreJournalPath, 0o600, []byte(restoreJournalHeader+"\n"), w.Bytes(),
+	); err != nil {
+		return lib.WrapErrorf(err, "failed to write %s", restoreJournalPath)
+	}
+	return nil
+}
+
+// Return the entry recorded by `writeRestoreJournal`. Return nil if there is
+// no journal or it cannot be read, e.g. because it was encrypted with
+// another key.
+func readRestoreJournal(journalFS lib.FS) (*lib.RevisionEntry, error) {
+	data, err := lib.ReadFile(journalFS, restoreJournalPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil //nolint:nilnil
+	}
+	header, marshalled, _ := bytes.Cut(data, []byte("\n"))
+	if err != nil || string(header) != restoreJournalHeader {
+		slog.Warn("Ignoring unreadable restore journal", "error", err)
+		return nil, nil //nolint:nilnil
+	}
+	entry, err := lib.UnmarshallRevisionEntry(lib.NewProtobufReader(marshalled))
+	if err != nil {
+		slog.Warn("Ignoring unreadable restore journal", "error", err)
+		return nil, nil //nolint:nilnil
+	}
+	return entry, nil
+}
+
+// Finish a restore in place that was interrupted. The file is neither the
+// old nor the new version, so it is restored as a whole to the version of
+// the revision the workspace is at, including its mode and mtime (and
+// whatever else `flags` asks for). It is no local change then, and the merge
+// or reset restores the new version again. A file that is not in that
+// revision was a local change that was about to be overwritten, it is
+// restored to the new version recorded in the journal.
+// Otherwise, the next merge would commit the half-written file.
+func finishRestoreInPlace(
+	ctx context.Context,
+	ws *Workspace,
+	repository *lib.Repository,
+	flags lib.RestorableMetadataFlag,
+) error {
+	journalFS, err := restoreJournalFS(ws, repository)
+	if err != nil {
+		return err
+	}
+	entry, err := readRestoreJournal(journalFS)
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		slog.Debug("Finishing interrupted restore in place", "path", entry.Path.String())
+		wsEntry, err := workspaceHeadEntry(ctx, ws, repository, entry.Path)
+		if err != nil {
+			return err
+		}
+		if wsEntry != nil && wsEntry.Metadata.FileMode.IsRegular() {
+			wsEntry.Path = entry.Path
+			entry = wsEntry
+		}
+		if err := restoreWholeFile(ctx, ws.FS, repository, entry, flags); err != nil {
+			return err
+		}
+	}
+	if err := ws.FS.Remove(restoreJournalPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return lib.WrapErrorf(err, "failed to remove %s", restoreJournalPath)
+	}
+	return nil
+}
+
+// Return the entry of `path` (relative to the workspace) in the revision the
+// workspace is at, nil if there is none.
+func workspaceHeadEntry(
+	ctx context.Context,
+	ws *Workspace,
+	repository *lib.Repository,
+	path lib.Path,
+) (*lib.RevisionEntry, error) {
+	wsHead, err := lib.ReadRef(ctx, ws.Storage, "head")
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read workspace head")
+	}
+	if wsHead.IsRoot() {
+		return nil, nil //nolint:nilnil
+	}
+	tmpFS, err := ws.TempFS.MkSub("restore-in-place")
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to create restore tmp dir")
+	}
+	defer tmpFS.RemoveAll(".") //nolint:errcheck
+	repoPath := ws.PathPrefix.Join(path)
+	filter := &lib.PathEqualFilter{Path: repoPath}
+	snapshot, err := lib.NewFilteredRevisionSnapshot(ctx, repository, wsHead, tmpFS, filter)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to create revision snapshot")
+	}
+	defer snapshot.Remove() //nolint:errcheck
+	r := snapshot.Reader(nil)
+	buf := lib.NewBlockBuf()
+	for {
+		entry, err := r.Read(buf)
+		if errors.Is(err, io.EOF) {
+			return nil, nil //nolint:nilnil
+		}
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to read revision snapshot")
+		}
+		if entry.Path == repoPath {
+			return entry, nil
+		}
+	}
+}
+
+// Replace the file at `entry.Path` (relative to `targetFS`) with the content
+// of `entry` and restore its mode and mtime. Do nothing if it no longer is a
+// regular file.
+func restoreWholeFile(
+	ctx context.Context,
+	targetFS lib.FS,
+	repository *lib.Repository,
+	entry *lib.RevisionEntry,
+	flags lib.RestorableMetadataFlag,
+) error {
+	target := entry.Path.String()
+	stat, err := targetFS.Stat(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to stat %s", target)
+	}
+	if !stat.Mode().IsRegular() {
+		return nil
+	}
+	tmpPath := lib.AtomicWriteTempFilename(target)
+	f, err := targetFS.OpenWrite(tmpPath)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to open file %s for writing", tmpPath)
+	}
+	defer targetFS.Remove(tmpPath) //nolint:errcheck
+	f = lib.NewSparseWriter(f, entry.Metadata.Holes)
+	defer f.Close() //nolint:errcheck
+	buf := lib.NewBlockBuf()
+	for _, blockId := range entry.Metadata.BlockIds {
+		data, err := repository.ReadBlock(ctx, blockId, buf)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to read block %s", blockId)
+		}
+		if _, err := f.Write(data); err != nil {
+			return lib.WrapErrorf(err, "failed to write block %s", blockId)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return lib.WrapErrorf(err, "failed to close file %s", tmpPath)
+	}
+	if err := targetFS.Rename(tmpPath, target); err != nil {
+		return lib.WrapErrorf(err, "failed to rename %s to %s", tmpPath, target)
+	}
+	flags |= lib.RestorableMetadataMode | lib.RestorableMetadataMTime
+	return restoreFileMode(targetFS, target, &entry.Metadata, flags)
+}
+
+// Split the local file at `path` into blocks and return the id of the block
+// at each offset and the size of each block.
+func (m *Merger) localBlockIds(path string) (map[int64]lib.BlockId, map[lib.BlockId]int64, error) {
+	f, err := m.ws.FS.OpenRead(path)
+	if err != nil {
+		return nil, nil, lib.WrapErrorf(err, "failed to open file %s", path)
+	}
+	defer f.Close() //nolint:errcheck
+	blockIds := map[int64]lib.BlockId{}
+	sizes := map[lib.BlockId]int64{}
+	chunker := m.repository.NewChunker(f)
+	offset := int64(0)
+	for {
+		data, err := chunker.Read()
+		if errors.Is(err, io.EOF) {
+			return blockIds, sizes, nil
+		}
+		if err != nil {
+			return nil, nil, lib.WrapErrorf(err, "failed to read file %s", path)
+		}
+		blockId := m.repository.CalculateBlockId(data)
+		blockIds[offset] = blockId
+		sizes[blockId] = int64(len(data))
+		offset += int64(len(data))
+	}
+}
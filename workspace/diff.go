@@ -0,0 +1,209 @@
+package workspace
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+type DiffFile struct {
+	Path lib.Path
+	Kind lib.RevisionEntryKind
+	// Nil if the path was added.
+	From *lib.PathMetadata
+	// Nil if the path was deleted.
+	To *lib.PathMetadata
+}
+
+// Return the diff in the form:
+//
+//	A <path> (<size>)
+//	M <path> (<from size> -> <to size>, <size delta>, <from hash> -> <to hash>)
+//	D <path> (<size>)
+//
+// The hashes are only shown if the content changed.
+func (f DiffFile) Format() string {
+	switch f.Kind {
+	case lib.RevisionEntryKindAdd:
+		return fmt.Sprintf("A %s (%s)", formatStatusPath(f.Path, *f.To), FormatBytes(f.To.Size))
+	case lib.RevisionEntryKindDelete:
+		return fmt.Sprintf("D %s (%s)", formatStatusPath(f.Path, *f.From), FormatBytes(f.From.Size))
+	case lib.RevisionEntryKindUpdate:
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "M %s (%s -> %s, %s", formatStatusPath(f.Path, *f.To),
+			FormatBytes(f.From.Size), FormatBytes(f.To.Size), formatSizeDelta(f.To.Size-f.From.Size))
+		if f.From.FileHash != f.To.FileHash {
+			fmt.Fprintf(&sb, ", %s -> %s", shortHash(f.From.FileHash), shortHash(f.To.FileHash))
+		}
+		sb.WriteString(")")
+		return sb.String()
+	default:
+		panic(fmt.Sprintf("invalid revision entry type %d", f.Kind))
+	}
+}
+
+func formatSizeDelta(delta int64) string {
+	if delta < 0 {
+		return "-" + FormatBytes(-delta)
+	}
+	return "+" + FormatBytes(delta)
+}
+
+func shortHash(h lib.Sha256) string {
+	return hex.EncodeToString(h[:4])
+}
+
+type DiffStat struct {
+	Added   int
+	Updated int
+	Deleted int
+	// The sum of the size differences of all files.
+	SizeDelta int64
+}
+
+func (s *DiffStat) Summary() string {
+	return fmt.Sprintf(
+		"%d added, %d updated, %d deleted, %s",
+		s.Added,
+		s.Updated,
+		s.Deleted,
+		formatSizeDelta(s.SizeDelta),
+	)
+}
+
+func (s *DiffStat) add(f DiffFile) {
+	switch f.Kind { //nolint:exhaustive
+	case lib.RevisionEntryKindAdd:
+		s.Added++
+		s.SizeDelta += f.To.Size
+	case lib.RevisionEntryKindUpdate:
+		s.Updated++
+		s.SizeDelta += f.To.Size - f.From.Size
+	case lib.RevisionEntryKindDelete:
+		s.Deleted++
+		s.SizeDelta -= f.From.Size
+	}
+}
+
+type DiffOptions struct {
+	From lib.RevisionId
+	To   lib.RevisionId
+	// The filter is matched against paths relative to `PathPrefix`.
+	PathFilter lib.PathFilter
+	PathPrefix lib.Path
+}
+
+// Diff compares the snapshots of `opts.From` and `opts.To` and calls `onFile`
+// for every path that differs, in path order. Paths are relative to
+// `opts.PathPrefix`.
+// A path that changed its type (e.g. from a file to a directory) is reported
+// as a delete and an add.
+// Return the summary of all differences.
+func Diff( //nolint:funlen
+	ctx context.Context,
+	repository *lib.Repository,
+	tmpFS lib.FS,
+	opts *DiffOptions,
+	onFile func(DiffFile) error,
+) (DiffStat, error) {
+	stat := DiffStat{}
+	snapshots := make([]*lib.Temp[*lib.RevisionEntry], 2)
+	for i, revisionId := range []lib.RevisionId{opts.From, opts.To} {
+		snapshotFS, err := tmpFS.MkSub(fmt.Sprintf("snapshot-%d", i))
+		if err != nil {
+			return stat, lib.WrapErrorf(err, "failed to create snapshot tmp dir")
+		}
+		snapshot, err := lib.NewFilteredRevisionSnapshot(
+			ctx,
+			repository,
+			revisionId,
+			snapshotFS,
+			opts.PathPrefix.AsFilter(),
+		)
+		if err != nil {
+			return stat, lib.WrapErrorf(err, "failed to create revision snapshot of %s", revisionId)
+		}
+		defer snapshot.Remove() //nolint:errcheck
+		snapshots[i] = snapshot
+	}
+	include := func(entry *lib.RevisionEntry) bool {
+		path, ok := entry.Path.TrimBase(opts.PathPrefix)
+		if !ok {
+			return false
+		}
+		return opts.PathFilter == nil || opts.PathFilter.Include(path, entry.Metadata.FileMode.IsDir())
+	}
+	fromReader := snapshots[0].Reader(include)
+	toReader := snapshots[1].Reader(include)
+	fromBuf := lib.NewBlockBuf()
+	toBuf := lib.NewBlockBuf()
+	read := func(r *lib.TempReader[*lib.RevisionEntry], buf lib.BlockBuf) (*lib.RevisionEntry, error) {
+		entry, err := r.Read(buf)
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to read revision snapshot")
+		}
+		return entry, nil
+	}
+	emit := func(entry *lib.RevisionEntry, kind lib.RevisionEntryKind, from, to *lib.PathMetadata) error {
+		path, _ := entry.Path.TrimBase(opts.PathPrefix)
+		f := DiffFile{Path: path, Kind: kind, From: from, To: to}
+		stat.add(f)
+		return onFile(f)
+	}
+	from, err := read(fromReader, fromBuf)
+	if err != nil {
+		return stat, err
+	}
+	to, err := read(toReader, toBuf)
+	if err != nil {
+		return stat, err
+	}
+	for from != nil || to != nil {
+		var c int
+		switch {
+		case from == nil:
+			c = 1
+		case to == nil:
+			c = -1
+		default:
+			c = lib.RevisionEntryPathCompare(from, to)
+		}
+		switch {
+		case c < 0:
+			if err := emit(from, lib.RevisionEntryKindDelete, &from.Metadata, nil); err != nil {
+				return stat, err
+			}
+			if from, err = read(fromReader, fromBuf); err != nil {
+				return stat, err
+			}
+		case c > 0:
+			if err := emit(to, lib.RevisionEntryKindAdd, nil, &to.Metadata); err != nil {
+				return stat, err
+			}
+			if to, err = read(toReader, toBuf); err != nil {
+				return stat, err
+			}
+		default:
+			if !from.Metadata.IsEqualRestorableAttributes(to.Metadata, lib.RestorableMetadataAll) {
+				if err := emit(to, lib.RevisionEntryKindUpdate, &from.Metadata, &to.Metadata); err != nil {
+					return stat, err
+				}
+			}
+			if from, err = read(fromReader, fromBuf); err != nil {
+				return stat, err
+			}
+			if to, err = read(toReader, toBuf); err != nil {
+				return stat, err
+			}
+		}
+	}
+	return stat, nil
+}
@@ -0,0 +1,86 @@
+package workspace
+
+import (
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+	setup := func(t *testing.T) (*lib.TestRepository, lib.RevisionId, lib.RevisionId) {
+		t.Helper()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		w.Write("b.txt", "b")
+		w.Write("c/1.txt", "c1")
+		revId1, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		w.Rm("a.txt")
+		w.Write("b.txt", "bbb")
+		w.Write("c/2.txt", "c2")
+		revId2, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		return r, revId1, revId2
+	}
+	diff := func(t *testing.T, r *lib.TestRepository, opts *DiffOptions) ([]string, DiffStat) {
+		t.Helper()
+		files := []string{}
+		stat, err := Diff(t.Context(), r.Repository, td.NewFS(t), opts, func(f DiffFile) error {
+			files = append(files, f.Format())
+			return nil
+		})
+		lib.NewAssert(t).NoError(err)
+		return files, stat
+	}
+
+	t.Run("Happy path", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r, revId1, revId2 := setup(t)
+		files, stat := diff(t, r, &DiffOptions{revId1, revId2, nil, lib.Path{}})
+		assert.Equal([]string{
+			"D a.txt (1B)",
+			"M b.txt (1B -> 3B, +2B, " + shortHash(td.SHA256("b")) + " -> " + shortHash(td.SHA256("bbb")) + ")",
+			"M c/ (0B -> 0B, +0B)",
+			"A c/2.txt (2B)",
+		}, files)
+		assert.Equal("1 added, 2 updated, 1 deleted, +3B", stat.Summary())
+
+		// The reverse direction.
+		files, stat = diff(t, r, &DiffOptions{revId2, revId1, nil, lib.Path{}})
+		assert.Equal("A a.txt (1B)", files[0])
+		assert.Equal("D c/2.txt (2B)", files[3])
+		assert.Equal("1 added, 2 updated, 1 deleted, -3B", stat.Summary())
+	})
+
+	t.Run("Diff against the root lists all files as added", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r, revId1, _ := setup(t)
+		files, _ := diff(t, r, &DiffOptions{lib.RevisionId{}, revId1, nil, lib.Path{}})
+		assert.Equal([]string{"A a.txt (1B)", "A b.txt (1B)", "A c/ (0B)", "A c/1.txt (2B)"}, files)
+	})
+
+	t.Run("PathFilter and PathPrefix", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r, revId1, revId2 := setup(t)
+		files, _ := diff(t, r, &DiffOptions{revId1, revId2, lib.NewPathInclusionFilter([]string{"c/*"}), lib.Path{}})
+		assert.Equal([]string{"A c/2.txt (2B)"}, files)
+		files, stat := diff(t, r, &DiffOptions{revId1, revId2, nil, td.Path("c")})
+		assert.Equal([]string{"A 2.txt (2B)"}, files)
+		assert.Equal("1 added, 0 updated, 0 deleted, +2B", stat.Summary())
+	})
+
+	t.Run("Same revision has no differences", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r, _, revId2 := setup(t)
+		files, stat := diff(t, r, &DiffOptions{revId2, revId2, nil, lib.Path{}})
+		assert.Equal([]string{}, files)
+		assert.Equal(DiffStat{0, 0, 0, 0}, stat)
+	})
+}
@@ -0,0 +1,108 @@
+package workspace
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// FileReader reads the content of a file in the repository at arbitrary
+// offsets. Blocks are only read when they are needed and the last block read
+// is kept, so sequential reads read each block once.
+// Blocks differ in size, so the offset of a block is only known after all
+// blocks before it have been read once.
+type FileReader struct {
+	repository *lib.Repository
+	blockIds   []lib.BlockId
+	size       int64
+	mu         sync.Mutex
+	// `offsets[i]` is the offset of block `i` for all blocks whose offset is
+	// known.
+	offsets []int64
+	// The index of the block in `data`, -1 if none.
+	block int
+	data  []byte
+	buf   *lib.BlockBuf
+}
+
+func NewFileReader(repository *lib.Repository, md *lib.PathMetadata) *FileReader {
+	return &FileReader{
+		repository: repository,
+		blockIds:   md.BlockIds,
+		size:       md.Size,
+		mu:         sync.Mutex{},
+		offsets:    []int64{0},
+		block:      -1,
+		data:       nil,
+		buf:        nil,
+	}
+}
+
+func (r *FileReader) Size() int64 {
+	return r.size
+}
+
+// Read up to `len(p)` bytes starting at `off`. Like `io.ReaderAt`, return
+// `io.EOF` if fewer bytes are read because the end of the file is reached.
+// It is safe to call `ReadAt` concurrently.
+func (r *FileReader) ReadAt(ctx context.Context, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, lib.Errorf("negative offset %d", off)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for n < len(p) && off < r.size {
+		data, start, err := r.blockAt(ctx, off)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], data[off-start:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Return the data and the offset of the block that contains `off`.
+func (r *FileReader) blockAt(ctx context.Context, off int64) ([]byte, int64, error) {
+	i := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > off }) - 1
+	for ; i < len(r.blockIds); i++ {
+		data, err := r.readBlock(ctx, i)
+		if err != nil {
+			return nil, 0, err
+		}
+		end := r.offsets[i] + int64(len(data))
+		if i+1 == len(r.offsets) {
+			r.offsets = append(r.offsets, end)
+		}
+		if off < end {
+			return data, r.offsets[i], nil
+		}
+	}
+	return nil, 0, lib.Errorf("the blocks of the file end before offset %d (file size %d)", off, r.size)
+}
+
+func (r *FileReader) readBlock(ctx context.Context, i int) ([]byte, error) {
+	if r.block == i {
+		return r.data, nil
+	}
+	if r.buf == nil {
+		buf := lib.NewBlockBuf()
+		r.buf = &buf
+	}
+	data, err := r.repository.ReadBlock(ctx, r.blockIds[i], *r.buf)
+	if err != nil {
+		r.block = -1
+		return nil, lib.WrapErrorf(err, "failed to read block %s", r.blockIds[i])
+	}
+	r.block = i
+	r.data = data
+	return data, nil
+}
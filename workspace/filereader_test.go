@@ -0,0 +1,50 @@
+package workspace
+
+import (
+	"io"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestFileReader(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	md := lib.PathMetadata{Size: 9} //nolint:exhaustruct
+	for _, data := range []string{"aaa", "bb", "cccc"} {
+		blockId, _, err := r.WriteBlock(t.Context(), []byte(data), lib.NewBlockBuf())
+		assert.NoError(err)
+		md.BlockIds = append(md.BlockIds, blockId)
+	}
+	sut := NewFileReader(r.Repository, &md)
+	read := func(off int64, n int) (string, error) {
+		p := make([]byte, n)
+		c, err := sut.ReadAt(t.Context(), p, off)
+		return string(p[:c]), err
+	}
+
+	// Read from the middle before the offsets are known.
+	s, err := read(4, 3)
+	assert.NoError(err)
+	assert.Equal("bcc", s)
+
+	// Read across all blocks.
+	s, err = read(0, 9)
+	assert.NoError(err)
+	assert.Equal("aaabbcccc", s)
+
+	// Read past the end.
+	s, err = read(7, 5)
+	assert.ErrorIs(err, io.EOF)
+	assert.Equal("cc", s)
+	s, err = read(9, 1)
+	assert.ErrorIs(err, io.EOF)
+	assert.Equal("", s)
+
+	// The blocks end before the file size.
+	md.Size = 10
+	sut = NewFileReader(r.Repository, &md)
+	_, err = read(0, 10)
+	assert.Error(err, "end before offset 9")
+}
@@ -0,0 +1,185 @@
+package workspace
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// A revision in the result of `Find`.
+type FindRevision struct {
+	RevisionId lib.RevisionId
+	Timestamp  time.Time
+}
+
+func (r FindRevision) String() string {
+	return r.Timestamp.Format(time.RFC3339) + " " + r.RevisionId.String()
+}
+
+// FindMatch is a version of a path found by `Find`, i.e. the path with the
+// same content in consecutive revisions. A change of the mode or the mtime
+// alone does not start a new version.
+type FindMatch struct {
+	Path lib.Path
+	// The metadata of the first revision of the version, without the block
+	// ids.
+	Metadata lib.PathMetadata
+	// The first and the last revision that contain this version.
+	First FindRevision
+	Last  FindRevision
+	// The revision that deleted the path or changed its content, nil if
+	// the version is still in the last revision that was searched.
+	End *FindRevision
+	// Whether `End` deleted the path.
+	Deleted bool
+}
+
+// Return the version in this format:
+//
+//	<path> <size> <file hash or symlink target>
+//	    first:   <date> <revision>
+//	    last:    <date> <revision>
+//	    deleted: <date> <revision>
+//
+// The last line is `changed:` if the content changed, and missing if the
+// version is still in the last revision.
+func (m *FindMatch) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %d ", m.Path, m.Metadata.Size)
+	if m.Metadata.SymLinkTarget != nil {
+		fmt.Fprintf(&sb, "-> %s", m.Metadata.SymLinkTarget)
+	} else {
+		sb.WriteString(hex.EncodeToString(m.Metadata.FileHash[:]))
+	}
+	fmt.Fprintf(&sb, "\n    first:   %s\n    last:    %s", m.First, m.Last)
+	switch {
+	case m.End == nil:
+	case m.Deleted:
+		fmt.Fprintf(&sb, "\n    deleted: %s", m.End)
+	default:
+		fmt.Fprintf(&sb, "\n    changed: %s", m.End)
+	}
+	return sb.String()
+}
+
+type FindOptions struct {
+	PathFilter lib.PathFilter
+	// The paths are matched and returned relative to `PathPrefix`, paths
+	// outside of it are skipped.
+	PathPrefix lib.Path
+	// Only return the versions that are in at least one revision between
+	// `Since` and `Until` (both inclusive). A zero time is unbounded.
+	// Revisions after `Until` are not searched at all.
+	Since time.Time
+	Until time.Time
+}
+
+// Find searches the path metadata of all revisions for the paths (but not
+// the directories) matching `opts.PathFilter` and returns all versions of
+// them, sorted by path and then by revision. The revisions are read from
+// the root to the head, because a version starts and ends where a revision
+// entry changes the path, e.g. the version that ends with `Deleted` tells
+// when a file disappeared.
+func Find(ctx context.Context, repository *lib.Repository, opts *FindOptions) ([]FindMatch, error) {
+	revisionId, err := repository.Head(ctx)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to get head revision")
+	}
+	buf := lib.NewBlockBuf()
+	var revisions []lib.Revision
+	var revisionIds []lib.RevisionId
+	for !revisionId.IsRoot() {
+		revision, err := repository.ReadRevision(ctx, revisionId, buf)
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to read revision %s", revisionId)
+		}
+		// Skip the revisions from the head back to the first one not after
+		// `Until`.
+		if len(revisions) > 0 || opts.Until.IsZero() || !revision.Timestamp.Time().After(opts.Until) {
+			revisions = append(revisions, revision)
+			revisionIds = append(revisionIds, revisionId)
+		}
+		revisionId = revision.ParentRevisionId
+	}
+	slices.Reverse(revisions)
+	slices.Reverse(revisionIds)
+	matches := []FindMatch{}
+	current := map[lib.Path]*FindMatch{}
+	inRange := func(m *FindMatch) bool {
+		return opts.Since.IsZero() || !m.Last.Timestamp.Before(opts.Since)
+	}
+	findRevision := func(i int) FindRevision {
+		return FindRevision{revisionIds[i], revisions[i].Timestamp.Time()}
+	}
+	// End the version `m` with the revision at `i`.
+	end := func(m *FindMatch, i int, deleted bool) {
+		endRevision := findRevision(i)
+		m.Last = findRevision(i - 1)
+		m.End = &endRevision
+		m.Deleted = deleted
+		delete(current, m.Path)
+		if inRange(m) {
+			matches = append(matches, *m)
+		}
+	}
+	for i := range revisions {
+		reader := lib.NewRevisionReader(repository, &revisions[i])
+		for {
+			entry, err := reader.Read(ctx, buf)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, lib.WrapErrorf(err, "failed to read revision %s", revisionIds[i])
+			}
+			path, ok := entry.Path.TrimBase(opts.PathPrefix)
+			if !ok || entry.Metadata.FileMode.IsDir() {
+				continue
+			}
+			if opts.PathFilter != nil && !opts.PathFilter.Include(path, false) {
+				continue
+			}
+			m, exists := current[path]
+			if entry.Kind == lib.RevisionEntryKindDelete {
+				if exists {
+					end(m, i, true)
+				}
+				continue
+			}
+			if exists {
+				if sameContent(&m.Metadata, &entry.Metadata) {
+					continue
+				}
+				end(m, i, false)
+			}
+			md := entry.Metadata
+			md.BlockIds = nil
+			current[path] = &FindMatch{path, md, findRevision(i), FindRevision{}, nil, false}
+		}
+	}
+	for _, m := range current {
+		m.Last = findRevision(len(revisions) - 1)
+		if inRange(m) {
+			matches = append(matches, *m)
+		}
+	}
+	// The versions of a path are already in the order of the revisions.
+	slices.SortStableFunc(matches, func(a, b FindMatch) int {
+		return strings.Compare(lib.PathCompareString(a.Path, false), lib.PathCompareString(b.Path, false))
+	})
+	return matches, nil
+}
+
+func sameContent(a, b *lib.PathMetadata) bool {
+	if a.Size != b.Size || a.FileHash != b.FileHash || (a.SymLinkTarget == nil) != (b.SymLinkTarget == nil) {
+		return false
+	}
+	return a.SymLinkTarget == nil || *a.SymLinkTarget == *b.SymLinkTarget
+}
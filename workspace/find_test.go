@@ -0,0 +1,125 @@
+package workspace
+
+import (
+	"encoding/hex"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+type testFindMatch struct {
+	Path    string
+	Hash    lib.Sha256
+	First   lib.RevisionId
+	Last    lib.RevisionId
+	End     *lib.RevisionId
+	Deleted bool
+}
+
+func newTestFindMatches(matches []FindMatch) []testFindMatch {
+	result := []testFindMatch{}
+	for _, m := range matches {
+		var end *lib.RevisionId
+		if m.End != nil {
+			end = &m.End.RevisionId
+		}
+		result = append(result, testFindMatch{
+			m.Path.String(), m.Metadata.FileHash, m.First.RevisionId, m.Last.RevisionId, end, m.Deleted,
+		})
+	}
+	return result
+}
+
+func TestFind(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	w := wstd.NewTestWorkspace(t, r.Repository)
+	merge := func() lib.RevisionId {
+		t.Helper()
+		revId, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		return revId
+	}
+	timestamp := func(revId lib.RevisionId) time.Time {
+		t.Helper()
+		revision, err := r.Repository.ReadRevision(t.Context(), revId, lib.NewBlockBuf())
+		assert.NoError(err)
+		return revision.Timestamp.Time()
+	}
+
+	w.Write("a.txt", "a")
+	w.Write("dir/b.txt", "b")
+	w.Write("dir/c.md", "c")
+	revId1 := merge()
+	// Changing the mode does not start a new version.
+	w.Write("a.txt", "aa")
+	w.Chmod("dir/b.txt", 0o644)
+	revId2 := merge()
+	w.Rm("dir/b.txt")
+	revId3 := merge()
+	w.Write("dir/b.txt", "b")
+	revId4 := merge()
+
+	t.Run("All versions of the matching paths", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		filter := lib.NewPathInclusionFilter([]string{"*.txt"})
+		matches, err := Find(t.Context(), r.Repository, &FindOptions{filter, lib.Path{}, time.Time{}, time.Time{}})
+		assert.NoError(err)
+		assert.Equal([]testFindMatch{
+			{"a.txt", td.SHA256("a"), revId1, revId1, &revId2, false},
+			{"a.txt", td.SHA256("aa"), revId2, revId4, nil, false},
+			{"dir/b.txt", td.SHA256("b"), revId1, revId2, &revId3, true},
+			{"dir/b.txt", td.SHA256("b"), revId4, revId4, nil, false},
+		}, newTestFindMatches(matches))
+		assert.Equal(timestamp(revId3), matches[2].End.Timestamp)
+	})
+
+	t.Run("Since and until", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		filter := lib.NewPathInclusionFilter([]string{"*.txt"})
+		matches, err := Find(
+			t.Context(),
+			r.Repository,
+			&FindOptions{filter, lib.Path{}, timestamp(revId3), time.Time{}},
+		)
+		assert.NoError(err)
+		assert.Equal([]testFindMatch{
+			{"a.txt", td.SHA256("aa"), revId2, revId4, nil, false},
+			{"dir/b.txt", td.SHA256("b"), revId4, revId4, nil, false},
+		}, newTestFindMatches(matches))
+
+		matches, err = Find(
+			t.Context(),
+			r.Repository,
+			&FindOptions{filter, lib.Path{}, time.Time{}, timestamp(revId2)},
+		)
+		assert.NoError(err)
+		assert.Equal([]testFindMatch{
+			{"a.txt", td.SHA256("a"), revId1, revId1, &revId2, false},
+			{"a.txt", td.SHA256("aa"), revId2, revId2, nil, false},
+			{"dir/b.txt", td.SHA256("b"), revId1, revId2, nil, false},
+		}, newTestFindMatches(matches))
+	})
+
+	t.Run("Regular expression and path prefix", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		filter := &lib.PathRegexpFilter{regexp.MustCompile(`^c\.`)}
+		matches, err := Find(t.Context(), r.Repository, &FindOptions{filter, td.Path("dir"), time.Time{}, time.Time{}})
+		assert.NoError(err)
+		assert.Equal([]testFindMatch{
+			{"c.md", td.SHA256("c"), revId1, revId4, nil, false},
+		}, newTestFindMatches(matches))
+		hash := td.SHA256("c")
+		assert.Equal(
+			"c.md 1 "+hex.EncodeToString(hash[:])+
+				"\n    first:   "+matches[0].First.String()+"\n    last:    "+matches[0].Last.String(),
+			matches[0].String(),
+		)
+	})
+}
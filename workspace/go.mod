@@ -5,6 +5,7 @@ go 1.26.5
 require (
 	github.com/flunderpero/cling-sync/http v0.0.0
 	github.com/flunderpero/cling-sync/lib v0.0.0
+	github.com/flunderpero/cling-sync/rclone v0.0.0
 )
 
 require (
@@ -16,3 +17,5 @@ require (
 replace github.com/flunderpero/cling-sync/lib v0.0.0 => ../lib
 
 replace github.com/flunderpero/cling-sync/http v0.0.0 => ../http
+
+replace github.com/flunderpero/cling-sync/rclone v0.0.0 => ../rclone
@@ -0,0 +1,115 @@
+package workspace
+
+import (
+	"errors"
+	"io/fs"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// hardLinker keeps track of the files of a merge, reset, or cp that other
+// files can be hard linked to, so that the files of a hard link group (see
+// `lib.PathMetadata.HardLinkGroup`) are uploaded and restored only once.
+type hardLinker struct {
+	// Restore all files with the same content and metadata as hard links,
+	// not only the files of a hard link group.
+	dupes bool
+	// The local path of the first restored file of each group.
+	restored map[lib.Path]string
+	// The first restored file of each content, only with `dupes`.
+	restoredDupes map[lib.Sha256]hardLinkDupe
+	// The metadata of the first uploaded file of each group.
+	uploaded map[lib.Path]lib.PathMetadata
+}
+
+type hardLinkDupe struct {
+	target string
+	md     lib.PathMetadata
+}
+
+func newHardLinker(dupes bool) *hardLinker {
+	return &hardLinker{dupes, map[lib.Path]string{}, map[lib.Sha256]hardLinkDupe{}, map[lib.Path]lib.PathMetadata{}}
+}
+
+// Return the local path of a restored file that the file with `md` can be a
+// hard link to.
+func (h *hardLinker) source(md *lib.PathMetadata) (string, bool) {
+	if !md.FileMode.IsRegular() {
+		return "", false
+	}
+	if md.HasHardLinkGroup() {
+		target, ok := h.restored[*md.HardLinkGroup]
+		return target, ok
+	}
+	if !h.dupes || md.Size == 0 {
+		return "", false
+	}
+	dupe, ok := h.restoredDupes[md.FileHash]
+	if !ok || !dupe.md.IsEqualRestorableAttributes(dupeMetadata(md), lib.RestorableMetadataAll) {
+		return "", false
+	}
+	return dupe.target, true
+}
+
+// The metadata of a file as far as duplicates are concerned, i.e. without
+// its hard link group.
+func dupeMetadata(md *lib.PathMetadata) lib.PathMetadata {
+	dupe := *md
+	dupe.BlockIds = nil
+	dupe.HardLinkGroup = nil
+	return dupe
+}
+
+// Record that the file with `md` was restored to `target` (or is there
+// already).
+func (h *hardLinker) addRestored(md *lib.PathMetadata, target string) {
+	if !md.FileMode.IsRegular() {
+		return
+	}
+	if md.HasHardLinkGroup() {
+		if _, ok := h.restored[*md.HardLinkGroup]; !ok {
+			h.restored[*md.HardLinkGroup] = target
+		}
+	}
+	if !h.dupes || md.Size == 0 {
+		return
+	}
+	if _, ok := h.restoredDupes[md.FileHash]; !ok {
+		h.restoredDupes[md.FileHash] = hardLinkDupe{target, dupeMetadata(md)}
+	}
+}
+
+// Return the metadata of an uploaded file of the same group as `md`, or
+// false if there is none or its content is different.
+func (h *hardLinker) uploadedMetadata(md *lib.PathMetadata) (lib.PathMetadata, bool) {
+	if !md.HasHardLinkGroup() {
+		return lib.PathMetadata{}, false
+	}
+	uploaded, ok := h.uploaded[*md.HardLinkGroup]
+	if !ok || uploaded.FileHash != md.FileHash || uploaded.Size != md.Size {
+		return lib.PathMetadata{}, false
+	}
+	return uploaded, true
+}
+
+func (h *hardLinker) addUploaded(md *lib.PathMetadata) {
+	if md.HasHardLinkGroup() {
+		h.uploaded[*md.HardLinkGroup] = *md
+	}
+}
+
+// Replace `target` with a hard link to `source`.
+// Return false if the link could not be created, e.g. because the file
+// system does not support hard links. The file has to be copied then.
+func replaceWithHardLink(targetFS lib.FS, source string, target string) bool {
+	tmpPath := lib.AtomicWriteTempFilename(target)
+	if err := targetFS.Link(source, tmpPath); err != nil {
+		return false
+	}
+	err := targetFS.Rename(tmpPath, target)
+	// If `target` is a link to `source` already, the rename does nothing.
+	if removeErr := targetFS.Remove(tmpPath); removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+		return false
+	}
+	return err == nil
+}
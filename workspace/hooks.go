@@ -0,0 +1,218 @@
+//nolint:forbidigo
+package workspace
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// The directory with the hooks of a workspace: executables named after a
+// `Hook` that `Merge` and `ForceCommit` run in the workspace directory.
+const HooksDir = ".cling/hooks"
+
+// A hook is called with the environment of the process and:
+//
+//	CLING_SYNC_HOOK               the name of the hook
+//	CLING_SYNC_WORKSPACE          the absolute path of the workspace
+//	CLING_SYNC_REVISION           the workspace head (`pre-merge`), the new
+//	                              revision (`post-commit`), or the new
+//	                              workspace head (`post-merge`)
+//	CLING_SYNC_PREVIOUS_REVISION  the parent of the new revision
+//	                              (`post-commit`) or the workspace head
+//	                              before the merge (`post-merge`)
+//	CLING_SYNC_CHANGES            a file with the paths that changed between
+//	                              the two revisions, one `A|M|D <path>` per
+//	                              line, relative to the workspace
+//	                              (`post-commit` and `post-merge`)
+//	CLING_SYNC_AUTHOR             the author and the message of the new
+//	CLING_SYNC_MESSAGE            revision (`post-commit`)
+type Hook string
+
+const (
+	// Run before the local changes are scanned, e.g. to dump a database into
+	// the workspace. The merge is aborted if the hook fails.
+	HookPreMerge Hook = "pre-merge"
+	// Run for every revision with local changes that was committed.
+	HookPostCommit Hook = "post-commit"
+	// Run after the workspace was merged, unless it was up to date.
+	HookPostMerge Hook = "post-merge"
+)
+
+// Run `hook` if the workspace has it. `revision` is passed as
+// `CLING_SYNC_REVISION`, `env` is added to the environment.
+func runHook(
+	ctx context.Context,
+	ws *Workspace,
+	hook Hook,
+	output io.Writer,
+	revision lib.RevisionId,
+	env ...string,
+) error {
+	root, path := ws.hook(hook)
+	if path == "" {
+		return nil
+	}
+	slog.Debug("Running hook", "hook", hook, "path", path)
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Dir = root
+	cmd.Env = append(
+		os.Environ(),
+		append([]string{
+			"CLING_SYNC_HOOK=" + string(hook),
+			"CLING_SYNC_WORKSPACE=" + root,
+			"CLING_SYNC_REVISION=" + revision.String(),
+		}, env...)...,
+	)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Run(); err != nil {
+		return lib.WrapErrorf(err, "%s hook failed", hook)
+	}
+	return nil
+}
+
+// Run `hook` if the workspace has it with the changes between `previous`
+// and `revision` (see `Hook`).
+func runRevisionHook(
+	ctx context.Context,
+	ws *Workspace,
+	repository *lib.Repository,
+	hook Hook,
+	output io.Writer,
+	previous, revision lib.RevisionId,
+	env ...string,
+) error {
+	if _, path := ws.hook(hook); path == "" {
+		return nil
+	}
+	changes, err := os.CreateTemp("", "cling-sync-"+string(hook))
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to create the changes file of the %s hook", hook)
+	}
+	defer os.Remove(changes.Name()) //nolint:errcheck
+	err = writeHookChanges(ctx, ws, repository, changes, previous, revision)
+	if closeErr := changes.Close(); err == nil && closeErr != nil {
+		err = lib.WrapErrorf(closeErr, "failed to close the changes file of the %s hook", hook)
+	}
+	if err != nil {
+		return err
+	}
+	env = append([]string{
+		"CLING_SYNC_PREVIOUS_REVISION=" + previous.String(),
+		"CLING_SYNC_CHANGES=" + changes.Name(),
+	}, env...)
+	return runHook(ctx, ws, hook, output, revision, env...)
+}
+
+func writeHookChanges(
+	ctx context.Context,
+	ws *Workspace,
+	repository *lib.Repository,
+	w io.Writer,
+	previous, revision lib.RevisionId,
+) error {
+	tmpFS, err := ws.TempFS.MkSub("hook")
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to create hook tmp dir")
+	}
+	defer tmpFS.RemoveAll(".") //nolint:errcheck
+	opts := &DiffOptions{previous, revision, nil, ws.PathPrefix}
+	_, err = Diff(ctx, repository, tmpFS, opts, func(f DiffFile) error {
+		var line string
+		switch f.Kind {
+		case lib.RevisionEntryKindAdd:
+			line = "A " + formatStatusPath(f.Path, *f.To)
+		case lib.RevisionEntryKindUpdate:
+			line = "M " + formatStatusPath(f.Path, *f.To)
+		case lib.RevisionEntryKindDelete:
+			line = "D " + formatStatusPath(f.Path, *f.From)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return lib.WrapErrorf(err, "failed to write the changes of the hook")
+		}
+		return nil
+	})
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to compare %s and %s", previous, revision)
+	}
+	return nil
+}
+
+// Run `merge` between the `pre-merge` and the `post-merge` hook of the
+// workspace. `merge` adds the revisions it commits to `commits`, the
+// `post-commit` hook is run for each of them once the merge is done.
+func runMergeHooks(
+	ctx context.Context,
+	ws *Workspace,
+	repository *lib.Repository,
+	opts *MergeOptions,
+	merge func(commits *[]lib.RevisionId) (lib.RevisionId, error),
+) (lib.RevisionId, error) {
+	previous, err := ws.Head(ctx)
+	if err != nil {
+		return lib.RevisionId{}, err
+	}
+	if err := runHook(ctx, ws, HookPreMerge, opts.HookOutput, previous); err != nil {
+		return lib.RevisionId{}, err
+	}
+	var commits []lib.RevisionId
+	head, err := merge(&commits)
+	if err != nil {
+		return head, err
+	}
+	if err := runPostCommitHooks(ctx, ws, repository, opts, commits); err != nil {
+		return head, lib.WrapErrorf(err, "the workspace was merged (head %s)", head)
+	}
+	err = runRevisionHook(ctx, ws, repository, HookPostMerge, opts.HookOutput, previous, head)
+	if err != nil {
+		return head, lib.WrapErrorf(err, "the workspace was merged (head %s)", head)
+	}
+	return head, nil
+}
+
+func runPostCommitHooks(
+	ctx context.Context,
+	ws *Workspace,
+	repository *lib.Repository,
+	opts *MergeOptions,
+	commits []lib.RevisionId,
+) error {
+	if _, path := ws.hook(HookPostCommit); path == "" {
+		return nil
+	}
+	buf := lib.NewBlockBuf()
+	for _, revisionId := range commits {
+		revision, err := repository.ReadRevision(ctx, revisionId, buf)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to read revision %s", revisionId)
+		}
+		var author, message string
+		if revision.Author != nil {
+			author = *revision.Author
+		}
+		if revision.Message != nil {
+			message = *revision.Message
+		}
+		err = runRevisionHook(
+			ctx,
+			ws,
+			repository,
+			HookPostCommit,
+			opts.HookOutput,
+			revision.ParentRevisionId,
+			revisionId,
+			"CLING_SYNC_AUTHOR="+author,
+			"CLING_SYNC_MESSAGE="+message,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
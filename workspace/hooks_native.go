@@ -0,0 +1,31 @@
+//go:build !wasm
+
+//nolint:forbidigo
+package workspace
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// Return the absolute path of the workspace and of the executable of `hook`.
+// The path of the executable is empty if the workspace has no such hook or
+// is not on the local file system.
+func (w *Workspace) hook(hook Hook) (string, string) {
+	realFS, ok := w.FS.(*lib.RealFS)
+	if !ok {
+		return "", ""
+	}
+	root, err := filepath.Abs(realFS.BasePath)
+	if err != nil {
+		return "", ""
+	}
+	path := filepath.Join(root, HooksDir, string(hook))
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Mode()&0o111 == 0 {
+		return root, ""
+	}
+	return root, path
+}
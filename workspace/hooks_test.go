@@ -0,0 +1,104 @@
+package workspace
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestHooks(t *testing.T) {
+	t.Parallel()
+	t.Run("Merge runs the hooks", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		logFS := td.NewRealFS(t)
+		log := filepath.Join(logFS.BasePath, "hooks.log")
+		// `pre-merge` dumps a "database" into the workspace.
+		writeTestHook(w, HookPreMerge, "umask 077\n"+
+			"[ -e dump.sql ] || echo dump > dump.sql\n"+
+			"echo \"$CLING_SYNC_HOOK $CLING_SYNC_REVISION\" >> "+log)
+		logChanges := "echo \"$CLING_SYNC_HOOK $CLING_SYNC_PREVIOUS_REVISION $CLING_SYNC_REVISION\" >> " + log + "\n" +
+			"cat \"$CLING_SYNC_CHANGES\" >> " + log
+		writeTestHook(w, HookPostCommit, logChanges+"\necho \"$CLING_SYNC_AUTHOR: $CLING_SYNC_MESSAGE\" >> "+log)
+		writeTestHook(w, HookPostMerge, logChanges)
+		w.Write("a.txt", "a")
+		w.Write("b/c.txt", "c")
+		root := lib.RevisionId{}
+		rev1, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.Equal([]lib.TestFileInfo{
+			{"a.txt", 0o600, 1, "a"},
+			{"dump.sql", 0o600, 5, "dump\n"},
+			{"b", 0o700 | fs.ModeDir, 0, ""},
+			{"b/c.txt", 0o600, 1, "c"},
+		}, r.RevisionSnapshotFileInfos(rev1, nil))
+		changes := "A a.txt\nA dump.sql\nA b/\nA b/c.txt\n"
+		assert.Equal(
+			fmt.Sprintf("pre-merge %s\npost-commit %s %s\n%sauthor: message\npost-merge %s %s\n%s",
+				root, root, rev1, changes, root, rev1, changes),
+			readTestHookLog(t, logFS),
+		)
+
+		// Nothing changed, only `pre-merge` runs.
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.ErrorIs(err, ErrUpToDate)
+		assert.Equal(true, strings.HasSuffix(readTestHookLog(t, logFS), "\npre-merge "+rev1.String()+"\n"))
+	})
+
+	t.Run("A failing pre-merge hook aborts the merge", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		writeTestHook(w, HookPreMerge, "exit 3")
+		w.Write("a.txt", "a")
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.Error(err, "pre-merge hook failed")
+		assert.Equal(true, w.Head().IsRoot())
+	})
+
+	t.Run("A failing post-merge hook is reported after the merge", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		writeTestHook(w, HookPostMerge, "exit 3")
+		w.Write("a.txt", "a")
+		head, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.Error(err, "post-merge hook failed")
+		assert.Equal(head, w.Head())
+		assert.Equal(false, head.IsRoot())
+	})
+
+	t.Run("Hooks that are not executable are ignored", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		writeTestHook(w, HookPreMerge, "exit 3")
+		w.Chmod(HooksDir+"/"+string(HookPreMerge), 0o600)
+		w.Write("a.txt", "a")
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+	})
+}
+
+func writeTestHook(w *TestWorkspace, hook Hook, script string) {
+	w.t.Helper()
+	path := HooksDir + "/" + string(hook)
+	w.Write(path, "#!/bin/sh\nset -e\n"+script+"\n")
+	w.Chmod(path, 0o700)
+}
+
+func readTestHookLog(t *testing.T, fs_ lib.FS) string {
+	t.Helper()
+	content, err := lib.ReadFile(fs_, "hooks.log")
+	lib.NewAssert(t).NoError(err)
+	return string(content)
+}
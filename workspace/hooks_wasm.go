@@ -0,0 +1,6 @@
+package workspace
+
+// There are no hooks in the browser.
+func (w *Workspace) hook(Hook) (string, string) {
+	return "", ""
+}
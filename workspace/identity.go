@@ -0,0 +1,129 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"unicode"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// The control file in `lib.ControlFileSectionConf` with the `Identity` of the
+// workspace and its TOML section.
+const (
+	identityFile    = "identity"
+	identitySection = "identity"
+)
+
+// Identity is who commits from a workspace. The author of the revisions
+// defaults to the name and the email, and every revision records the
+// client id (see `lib.Repository.SetClientId`), so that the revisions of
+// several machines of the same user can be told apart.
+type Identity struct {
+	Name  string
+	Email string
+	// Generated the first time the identity is read, but it can be set to
+	// something more telling like `laptop`.
+	ClientId string
+}
+
+// Return `Name <Email>`, only the name if there is no email, or an empty
+// string if there is no name.
+func (i *Identity) Author() string {
+	if i.Name == "" {
+		return ""
+	}
+	if i.Email == "" {
+		return i.Name
+	}
+	return i.Name + " <" + i.Email + ">"
+}
+
+func (i *Identity) Validate() error {
+	if err := validateIdentityValue("name", i.Name, 200); err != nil {
+		return err
+	}
+	if err := validateIdentityValue("email", i.Email, 200); err != nil {
+		return err
+	}
+	if strings.ContainsAny(i.Email, "<> ") {
+		return lib.Errorf("invalid email %q", i.Email)
+	}
+	if i.ClientId == "" {
+		return lib.Errorf("the client id must not be empty")
+	}
+	if err := validateIdentityValue("client id", i.ClientId, 64); err != nil {
+		return err
+	}
+	if strings.ContainsFunc(i.ClientId, unicode.IsSpace) {
+		return lib.Errorf("invalid client id %q, it must not contain spaces", i.ClientId)
+	}
+	return nil
+}
+
+func validateIdentityValue(name string, value string, maxLen int) error {
+	if len(value) > maxLen {
+		return lib.Errorf("the %s must not be longer than %d bytes", name, maxLen)
+	}
+	if strings.ContainsFunc(value, func(r rune) bool { return unicode.IsControl(r) || r == '"' || r == '\\' }) {
+		return lib.Errorf("invalid %s %q, it must not contain control characters, `\"`, or `\\`", name, value)
+	}
+	return nil
+}
+
+// Return the identity of the workspace. A new client id is generated and
+// saved if the workspace has none yet.
+func (w *Workspace) Identity(ctx context.Context) (*Identity, error) {
+	identity := &Identity{"", "", ""}
+	data, err := w.Storage.ReadControlFile(ctx, lib.ControlFileSectionConf, identityFile)
+	if err != nil && !errors.Is(err, lib.ErrControlFileNotFound) {
+		return nil, lib.WrapErrorf(err, "failed to read identity")
+	}
+	if err == nil {
+		toml, err := lib.ReadToml(bytes.NewReader(data))
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to parse identity")
+		}
+		identity.Name, _ = toml.GetValue(identitySection, "name")
+		identity.Email, _ = toml.GetValue(identitySection, "email")
+		identity.ClientId, _ = toml.GetValue(identitySection, "client-id")
+	}
+	if identity.ClientId != "" {
+		return identity, nil
+	}
+	id, err := lib.Rand(8)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to generate client id")
+	}
+	identity.ClientId = hex.EncodeToString(id)
+	if err := w.SetIdentity(ctx, identity); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// Save the identity of the workspace.
+func (w *Workspace) SetIdentity(ctx context.Context, identity *Identity) error {
+	if err := identity.Validate(); err != nil {
+		return err
+	}
+	toml := lib.Toml{identitySection: {"client-id": identity.ClientId}}
+	if identity.Name != "" {
+		toml[identitySection]["name"] = identity.Name
+	}
+	if identity.Email != "" {
+		toml[identitySection]["email"] = identity.Email
+	}
+	var data bytes.Buffer
+	if err := lib.WriteToml(&data, "The identity of the workspace, see `cling-sync identity`.", toml); err != nil {
+		return lib.WrapErrorf(err, "failed to write identity")
+	}
+	err := w.Storage.WriteControlFile(ctx, lib.ControlFileSectionConf, identityFile, data.Bytes())
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to write identity")
+	}
+	return nil
+}
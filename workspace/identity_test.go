@@ -0,0 +1,74 @@
+package workspace
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestIdentity(t *testing.T) {
+	t.Parallel()
+	t.Run("Happy path", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+
+		// A client id is generated and kept.
+		identity, err := w.Identity(t.Context())
+		assert.NoError(err)
+		assert.Equal("", identity.Name)
+		assert.Equal("", identity.Author())
+		assert.Equal(16, len(identity.ClientId))
+		again, err := w.Identity(t.Context())
+		assert.NoError(err)
+		assert.Equal(identity, again)
+
+		identity.Name = "Alice"
+		assert.NoError(w.SetIdentity(t.Context(), identity))
+		identity, err = w.Identity(t.Context())
+		assert.NoError(err)
+		assert.Equal("Alice", identity.Author())
+
+		identity.Email = "alice@example.com"
+		identity.ClientId = "laptop"
+		assert.NoError(w.SetIdentity(t.Context(), identity))
+		identity, err = w.Identity(t.Context())
+		assert.NoError(err)
+		assert.Equal(&Identity{"Alice", "alice@example.com", "laptop"}, identity)
+		assert.Equal("Alice <alice@example.com>", identity.Author())
+	})
+
+	t.Run("Validate", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		assert.NoError((&Identity{"Alice Smith", "alice@example.com", "laptop"}).Validate())
+		assert.NoError((&Identity{"", "", "laptop"}).Validate())
+		assert.Error((&Identity{"", "", ""}).Validate(), "the client id must not be empty")
+		assert.Error((&Identity{"", "", "my laptop"}).Validate(), "must not contain spaces")
+		assert.Error((&Identity{"", "", strings.Repeat("a", 65)}).Validate(), "must not be longer than 64 bytes")
+		assert.Error((&Identity{`"Alice"`, "", "laptop"}).Validate(), "invalid name")
+		assert.Error((&Identity{"Alice\n", "", "laptop"}).Validate(), "invalid name")
+		assert.Error((&Identity{"", "<alice@example.com>", "laptop"}).Validate(), "invalid email")
+	})
+
+	t.Run("The client id is recorded in the revisions", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		assert.NoError(w.SetIdentity(t.Context(), &Identity{"", "", "laptop"}))
+		identity, err := w.Identity(t.Context())
+		assert.NoError(err)
+		r.SetClientId(identity.ClientId)
+
+		w.Write("a.txt", "a")
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		logs, err := Log(t.Context(), r.Repository, &LogOptions{nil, false, lib.RevisionRange{nil, nil}, false, nil})
+		assert.NoError(err)
+		assert.Equal("laptop", *logs[0].Revision.ClientId)
+		assert.Contains(logs[0].Long(), "\nClient:   laptop\n")
+	})
+}
@@ -0,0 +1,158 @@
+package workspace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"slices"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// The control file with the ignore patterns of the last merge or reset.
+const appliedIgnoreFileName = "ignore-applied"
+
+// Exclude the paths matched by the `.gitignore` and `.clingignore` files of
+// the workspace. A path is excluded if it or one of its parent directories
+// is matched, like `lib.WalkDirIgnore` does.
+type ignoreFilter struct {
+	patterns lib.ExtendedGlobPatterns
+}
+
+func (f *ignoreFilter) Include(p lib.Path, isDir bool) bool {
+	for q, qIsDir := p, isDir; !q.IsEmpty(); q, qIsDir = q.Dir(), true {
+		if f.patterns.Match(q.String(), qIsDir) {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the ignore patterns of the workspace, nil if `w.NoRepoIgnore` is
+// set. The ignore files are committed like any other file, so all
+// workspaces of a repository share them.
+func (w *Workspace) ignorePatterns() (lib.ExtendedGlobPatterns, error) {
+	if w.NoRepoIgnore {
+		return nil, nil
+	}
+	patterns, err := lib.CollectIgnorePatterns(w.FS, ".")
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to collect ignore patterns")
+	}
+	return patterns, nil
+}
+
+// Return a filter for the repository paths that are not ignored by the
+// ignore files in the workspace, or nil if nothing is ignored.
+func (w *Workspace) ignoreFilter() (lib.PathFilter, error) {
+	patterns, err := w.ignorePatterns()
+	if err != nil {
+		return nil, err
+	}
+	return w.ignorePatternsFilter(patterns), nil
+}
+
+func (w *Workspace) ignorePatternsFilter(patterns lib.ExtendedGlobPatterns) lib.PathFilter {
+	if len(patterns) == 0 {
+		return nil
+	}
+	return &relativePathFilter{w.PathPrefix, &ignoreFilter{patterns}}
+}
+
+type appliedIgnorePattern struct {
+	BaseDir string `json:"base_dir"`
+	Pattern string `json:"pattern"`
+}
+
+func encodeIgnorePatterns(patterns lib.ExtendedGlobPatterns) ([]byte, error) {
+	applied := make([]appliedIgnorePattern, 0, len(patterns))
+	for _, p := range patterns {
+		pattern := string(p.GlobPattern)
+		if p.IsNegate {
+			pattern = "!" + pattern
+		}
+		applied = append(applied, appliedIgnorePattern{p.BaseDir, pattern})
+	}
+	data, err := json.Marshal(applied)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to encode ignore patterns")
+	}
+	return data, nil
+}
+
+// Return the encoded ignore patterns of the last merge or reset, nil if
+// there was none yet.
+func (w *Workspace) appliedIgnoreData(ctx context.Context) ([]byte, error) {
+	data, err := w.Storage.ReadControlFile(ctx, lib.ControlFileSectionConf, appliedIgnoreFileName)
+	if errors.Is(err, lib.ErrControlFileNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read the applied ignore patterns")
+	}
+	return data, nil
+}
+
+// Return the ignore patterns of the last merge or reset.
+func (w *Workspace) appliedIgnorePatterns(ctx context.Context) (lib.ExtendedGlobPatterns, error) {
+	data, err := w.appliedIgnoreData(ctx)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var applied []appliedIgnorePattern
+	if err := json.Unmarshal(data, &applied); err != nil {
+		return nil, lib.WrapErrorf(err, "failed to parse the applied ignore patterns")
+	}
+	patterns := make(lib.ExtendedGlobPatterns, 0, len(applied))
+	for _, p := range applied {
+		patterns = append(patterns, lib.NewExtendedGlobPattern(p.Pattern, p.BaseDir))
+	}
+	return patterns, nil
+}
+
+// Return whether the ignore patterns changed since the last merge or reset.
+func (w *Workspace) ignoreChanged(ctx context.Context) (bool, error) {
+	patterns, err := w.ignorePatterns()
+	if err != nil {
+		return false, err
+	}
+	current, err := encodeIgnorePatterns(patterns)
+	if err != nil {
+		return false, err
+	}
+	applied, err := w.appliedIgnoreData(ctx)
+	if err != nil {
+		return false, err
+	}
+	if applied == nil {
+		return len(patterns) > 0, nil
+	}
+	return !slices.Equal(current, applied), nil
+}
+
+// Record the current ignore patterns as applied, called after a successful
+// merge or reset.
+func (w *Workspace) writeAppliedIgnore(ctx context.Context) error {
+	patterns, err := w.ignorePatterns()
+	if err != nil {
+		return err
+	}
+	data, err := encodeIgnorePatterns(patterns)
+	if err != nil {
+		return err
+	}
+	if err := w.Storage.WriteControlFile(ctx, lib.ControlFileSectionConf, appliedIgnoreFileName, data); err != nil {
+		return lib.WrapErrorf(err, "failed to write the applied ignore patterns")
+	}
+	return nil
+}
+
+// Same as `lib.WalkDirIgnore`, but ignore files are not respected if
+// `ignoreFiles` is false.
+func walkDir(fs_ lib.FS, dir string, ignoreFiles bool, f fs.WalkDirFunc) error {
+	if !ignoreFiles {
+		return fs_.WalkDir(dir, f) //nolint:wrapcheck
+	}
+	return lib.WalkDirIgnore(fs_, dir, f) //nolint:wrapcheck
+}
@@ -0,0 +1,321 @@
+package workspace
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+type ImportOptions struct {
+	// The imported paths are placed below this prefix.
+	PathPrefix             lib.Path
+	Author                 string
+	Message                string
+	RestorableMetadataFlag lib.RestorableMetadataFlag
+	// Only used by `ImportDirectory`.
+	StagingMonitor StagingEntryMonitor
+	CommitMonitor  CommitMonitor
+}
+
+// Return a copy of the options whose `CommitMonitor` counts the stored bytes
+// for the commit statistics.
+func (o *ImportOptions) countStoredBytes() (*ImportOptions, *storedBytesMonitor) {
+	counter := &storedBytesMonitor{o.CommitMonitor, 0}
+	opts := *o
+	opts.CommitMonitor = counter
+	return &opts, counter
+}
+
+// ImportDirectory commits the content of `dir` below `opts.PathPrefix` as a
+// new revision. `dir` does not have to be a workspace, it is not written to
+// and no staging cache is used.
+// Paths that exist in the repository but not in `dir` are kept.
+// Return `lib.ErrEmptyCommit` if nothing changed.
+func ImportDirectory(
+	ctx context.Context,
+	repository *lib.Repository,
+	dir lib.FS,
+	opts *ImportOptions,
+	tmpFS lib.FS,
+) (lib.RevisionId, error) {
+	opts, counter := opts.countStoredBytes()
+	stagingFS, err := tmpFS.MkSub("staging")
+	if err != nil {
+		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to create staging tmp dir")
+	}
+	staging, err := NewReadOnlyStaging(
+		dir,
+		opts.PathPrefix,
+		nil,
+		opts.RestorableMetadataFlag,
+		stagingFS,
+		opts.StagingMonitor,
+	)
+	if err != nil {
+		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to scan %s", dir)
+	}
+	upload := func(entry *lib.RevisionEntry) (lib.PathMetadata, error) {
+		localPath, _ := entry.Path.TrimBase(opts.PathPrefix)
+		stat, err := dir.Stat(localPath.String())
+		if err != nil {
+			return lib.PathMetadata{}, lib.WrapErrorf(err, "failed to stat %s", localPath)
+		}
+		md, err := AddFileToRepository(ctx, dir, localPath, stat, repository, entry, opts.CommitMonitor)
+		if err != nil {
+			return lib.PathMetadata{}, lib.WrapErrorf(err, "failed to add blocks and get metadata for %s", localPath)
+		}
+		if md.FileHash != entry.Metadata.FileHash {
+			return lib.PathMetadata{}, lib.Errorf("file %s was modified during import - aborting import", localPath)
+		}
+		md.HardLinkGroup = entry.Metadata.HardLinkGroup
+		md.Xattrs = entry.Metadata.Xattrs
+		md.Holes = entry.Metadata.Holes
+		return md, nil
+	}
+	return commitImport(ctx, repository, staging, upload, nil, opts, counter, tmpFS)
+}
+
+// ImportTar commits the content of the tar archive read from `r` below
+// `opts.PathPrefix` as a new revision. File modes, mtimes, and owners are
+// taken from the archive. The archive is read once, so the content of every
+// file is added to the repository while reading (blocks that already exist
+// are not written again).
+// Directories that are not in the archive, but contain paths of it, are
+// created if they don't exist in the repository.
+// Paths that exist in the repository but not in the archive are kept.
+// Return `lib.ErrEmptyCommit` if nothing changed.
+func ImportTar( //nolint:funlen
+	ctx context.Context,
+	repository *lib.Repository,
+	r io.Reader,
+	opts *ImportOptions,
+	tmpFS lib.FS,
+) (lib.RevisionId, error) {
+	opts, counter := opts.countStoredBytes()
+	stagingFS, err := tmpFS.MkSub("staging")
+	if err != nil {
+		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to create staging tmp dir")
+	}
+	stagingWriter := NewStagingCacheWriter(stagingFS, lib.DefaultTempChunkSize)
+	staging := &Staging{nil, opts.PathPrefix, nil, stagingWriter, nil, stagingFS}
+	mon := opts.CommitMonitor
+	seen := map[string]bool{}
+	dirs := map[lib.Path]bool{}
+	parents := map[lib.Path]bool{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return lib.RevisionId{}, lib.WrapErrorf(err, "failed to read tar archive")
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(header.Name, "./"), "/")
+		if name == "" || name == "." {
+			continue
+		}
+		localPath, err := lib.NewPath(name)
+		if err != nil {
+			return lib.RevisionId{}, lib.WrapErrorf(err, "invalid path %q in tar archive", header.Name)
+		}
+		if slices.Contains(strings.Split(name, "/"), ".cling") {
+			continue
+		}
+		repoPath := opts.PathPrefix.Join(localPath)
+		fileInfo := header.FileInfo()
+		var md lib.PathMetadata
+		switch header.Typeflag {
+		case tar.TypeDir:
+			md = lib.NewPathMetadataFromFileInfo(fileInfo, lib.Sha256{}, nil)
+			dirs[localPath] = true
+		case tar.TypeSymlink:
+			if filepath.IsAbs(header.Linkname) {
+				return lib.RevisionId{}, lib.WrapErrorf(
+					ErrSymLinkTargetEscapes,
+					"absolute target %q at %s",
+					header.Linkname,
+					localPath,
+				)
+			}
+			joined := filepath.ToSlash(filepath.Clean(filepath.Join(filepath.Dir(name), header.Linkname)))
+			resolved, err := lib.NewPath(joined)
+			if err != nil {
+				return lib.RevisionId{}, lib.WrapErrorf(
+					ErrSymLinkTargetEscapes,
+					"target %q at %s escapes archive root",
+					header.Linkname,
+					localPath,
+				)
+			}
+			md = lib.NewPathMetadataFromFileInfo(fileInfo, lib.Sha256{}, nil)
+			repoTarget := opts.PathPrefix.Join(resolved)
+			md.SymLinkTarget = &repoTarget
+		case tar.TypeReg:
+			entry := &lib.RevisionEntry{Kind: lib.RevisionEntryKindAdd, Path: repoPath, Metadata: md, RenamedFrom: nil}
+			if err := mon.OnStart(entry); err != nil {
+				return lib.RevisionId{}, lib.WrapErrorf(err, "commit monitor start failed for %s", repoPath)
+			}
+			fileHash, blockIds, err := addBlocksToRepository(ctx, tr, repository, entry, mon)
+			if err != nil {
+				return lib.RevisionId{}, lib.WrapErrorf(err, "failed to add %s", localPath)
+			}
+			md = lib.NewPathMetadataFromFileInfo(fileInfo, fileHash, blockIds)
+			entry.Metadata = md
+			if err := mon.OnEnd(entry); err != nil {
+				return lib.RevisionId{}, lib.WrapErrorf(err, "commit monitor end failed for %s", repoPath)
+			}
+		default:
+			return lib.RevisionId{}, lib.WrapErrorf(
+				ErrUnsupportedFileType,
+				"%s in tar archive (type %q), extract the archive and import the directory instead",
+				localPath,
+				header.Typeflag,
+			)
+		}
+		if !md.FileMode.IsSymlink() {
+			uid, gid := uint32(header.Uid), uint32(header.Gid) //nolint:gosec
+			md.Uid = &uid
+			md.Gid = &gid
+		}
+		key := lib.PathCompareString(localPath, md.FileMode.IsDir())
+		if seen[key] {
+			return lib.RevisionId{}, lib.Errorf("%s is in the tar archive more than once", localPath)
+		}
+		seen[key] = true
+		if parent := localPath.Dir(); !parent.IsEmpty() {
+			parents[parent] = true
+		}
+		stagingEntry := &StagingEntry{RepoPath: repoPath, Metadata: md, Ctime: lib.Timestamp{}, Size: md.Size, Inode: 0}
+		if err := staging.add(stagingEntry); err != nil {
+			return lib.RevisionId{}, lib.WrapErrorf(err, "failed to add %s to staging", localPath)
+		}
+	}
+	missingDirs := []lib.Path{}
+	for parent := range parents {
+		if !dirs[parent] {
+			missingDirs = append(missingDirs, opts.PathPrefix.Join(parent))
+		}
+	}
+	return commitImport(ctx, repository, staging, nil, missingDirs, opts, counter, tmpFS)
+}
+
+// Commit the difference between `staging` and the repository head.
+// If `upload` is given, it is called for every new or updated regular file to
+// add its content to the repository. Otherwise the metadata in `staging` must
+// be complete.
+// `ensureDirs` are created if they don't exist.
+func commitImport( //nolint:funlen
+	ctx context.Context,
+	repository *lib.Repository,
+	staging *Staging,
+	upload func(entry *lib.RevisionEntry) (lib.PathMetadata, error),
+	ensureDirs []lib.Path,
+	opts *ImportOptions,
+	counter *storedBytesMonitor,
+	tmpFS lib.FS,
+) (lib.RevisionId, error) {
+	commitFS, err := tmpFS.MkSub("commit")
+	if err != nil {
+		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to create commit tmp dir")
+	}
+	commit, err := lib.NewCommit(ctx, repository, commitFS)
+	if err != nil {
+		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to create commit")
+	}
+	snapshotFS, err := tmpFS.MkSub("snapshot")
+	if err != nil {
+		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to create snapshot tmp dir")
+	}
+	// The snapshot is not filtered by the path prefix, `EnsureDirExists` needs
+	// the parent directories, too.
+	snapshot, err := lib.NewRevisionSnapshot(ctx, repository, commit.BaseRevision, snapshotFS)
+	if err != nil {
+		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to create revision snapshot")
+	}
+	defer snapshot.Remove() //nolint:errcheck
+	snapshotCache, err := lib.NewRevisionEntryTempCache(snapshot, lib.TempCacheOptions{})
+	if err != nil {
+		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to create revision snapshot cache")
+	}
+	changes, err := staging.MergeWithSnapshot(snapshot, opts.RestorableMetadataFlag, true)
+	if err != nil {
+		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to merge staging and revision snapshot")
+	}
+	defer changes.Remove() //nolint:errcheck
+	if err := opts.CommitMonitor.OnBeforeCommit(); err != nil {
+		return lib.RevisionId{}, err //nolint:wrapcheck
+	}
+	mon := opts.CommitMonitor
+	buf := lib.NewBlockBuf()
+	if upload != nil {
+		if err := reportCommitTotal(changes, nil, mon, buf); err != nil {
+			return lib.RevisionId{}, err
+		}
+	}
+	reader := changes.Reader(nil)
+	for {
+		entry, err := reader.Read(buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return lib.RevisionId{}, lib.WrapErrorf(err, "failed to read changes")
+		}
+		isDir := entry.Metadata.FileMode.IsDir()
+		// Deletes are suppressed, so a path cannot silently change between
+		// being a directory and not being one.
+		_, found, err := snapshotCache.Get(lib.PathCompareString(entry.Path, !isDir))
+		if err != nil {
+			return lib.RevisionId{}, lib.WrapErrorf(err, "failed to get %s from revision snapshot", entry.Path)
+		}
+		if found {
+			return lib.RevisionId{}, lib.Errorf(
+				"%s already exists in the repository as a different type of file, remove it first",
+				entry.Path,
+			)
+		}
+		if upload != nil {
+			if err := mon.OnStart(entry); err != nil {
+				return lib.RevisionId{}, lib.WrapErrorf(err, "commit monitor start failed for %s", entry.Path)
+			}
+			if !isDir && !entry.Metadata.FileMode.IsSymlink() {
+				md, err := upload(entry)
+				if err != nil {
+					return lib.RevisionId{}, err
+				}
+				entry.Metadata = md
+			}
+		}
+		if err := commit.Add(entry); err != nil {
+			return lib.RevisionId{}, lib.WrapErrorf(err, "failed to add revision entry to commit")
+		}
+		if upload != nil {
+			if err := mon.OnEnd(entry); err != nil {
+				return lib.RevisionId{}, lib.WrapErrorf(err, "commit monitor end failed for %s", entry.Path)
+			}
+		}
+	}
+	for _, dir := range append(ensureDirs, opts.PathPrefix) {
+		if err := commit.EnsureDirExists(dir, snapshotCache, commit.BaseRevision); err != nil {
+			return lib.RevisionId{}, lib.WrapErrorf(err, "failed to ensure directory %s exists in the repository", dir)
+		}
+	}
+	revisionId, err := commit.Commit(
+		ctx,
+		&lib.CommitInfo{Author: opts.Author, Message: opts.Message, StoredBytes: counter.storedBytes},
+	)
+	if err != nil {
+		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to commit")
+	}
+	return revisionId, nil
+}
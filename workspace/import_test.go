@@ -0,0 +1,155 @@
+package workspace
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestImport(t *testing.T) {
+	t.Parallel()
+	setup := func(t *testing.T) *lib.TestRepository {
+		t.Helper()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		w.Write("imported/old.txt", "old")
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		return r
+	}
+	importOptions := func(pathPrefix string) *ImportOptions {
+		return &ImportOptions{
+			PathPrefix:             td.Path(pathPrefix),
+			Author:                 "test author",
+			Message:                "import",
+			RestorableMetadataFlag: lib.RestorableMetadataAll,
+			StagingMonitor:         wstd.StagingMonitor(),
+			CommitMonitor:          wstd.CommitMonitor(),
+		}
+	}
+	cat := func(t *testing.T, r *lib.TestRepository, path string) string {
+		t.Helper()
+		assert := lib.NewAssert(t)
+		var buf bytes.Buffer
+		err := Cat(t.Context(), r.Repository, &buf, &CatOptions{RevisionId: r.Head(), Path: td.Path(path)}, td.NewFS(t))
+		assert.NoError(err)
+		return buf.String()
+	}
+
+	t.Run("Directory", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := setup(t)
+		dir := td.NewTestFS(t, td.NewFS(t))
+		dir.Write("b.txt", "b")
+		dir.Write("sub/c.txt", "c")
+		revId, err := ImportDirectory(t.Context(), r.Repository, dir.FS, importOptions("imported"), td.NewFS(t))
+		assert.NoError(err)
+		assert.Equal(r.Head(), revId)
+		ls, err := Ls(t.Context(), r.Repository, td.NewFS(t), wstd.LsOptions(revId))
+		assert.NoError(err)
+		assert.Equal([]lsFileInfo{
+			{"a.txt", 0o600, 1},
+			{"imported", 0o700 | lib.FileModeDir, 0},
+			{"imported/b.txt", 0o600, 1},
+			{"imported/old.txt", 0o600, 3},
+			{"imported/sub", 0o700 | lib.FileModeDir, 0},
+			{"imported/sub/c.txt", 0o600, 1},
+		}, lsFiles(ls))
+		assert.Equal("c", cat(t, r, "imported/sub/c.txt"))
+
+		// Nothing is written to the directory.
+		_, err = dir.FS.Stat(".cling")
+		assert.ErrorIs(err, fs.ErrNotExist)
+
+		// Importing the same directory again does not change anything.
+		_, err = ImportDirectory(t.Context(), r.Repository, dir.FS, importOptions("imported"), td.NewFS(t))
+		assert.ErrorIs(err, lib.ErrEmptyCommit)
+	})
+
+	t.Run("Tar archive", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := setup(t)
+		mtime := time.Unix(1234567890, 123456789)
+		archive := testTar(t, []*tar.Header{
+			{Typeflag: tar.TypeReg, Name: "./x/y/b.txt", Mode: 0o4640, ModTime: mtime, Uid: 12, Gid: 34, Size: 1},
+			{Typeflag: tar.TypeDir, Name: "./x/", Mode: 0o750, ModTime: mtime},
+			{Typeflag: tar.TypeSymlink, Name: "./x/link", Linkname: "y/b.txt", ModTime: mtime},
+			{Typeflag: tar.TypeReg, Name: "./old.txt", Mode: 0o600, ModTime: mtime, Size: 1},
+		})
+		revId, err := ImportTar(t.Context(), r.Repository, archive, importOptions("imported"), td.NewFS(t))
+		assert.NoError(err)
+		ls, err := Ls(t.Context(), r.Repository, td.NewFS(t), wstd.LsOptions(revId))
+		assert.NoError(err)
+		assert.Equal([]lsFileInfo{
+			{"a.txt", 0o600, 1},
+			{"imported", 0o700 | lib.FileModeDir, 0},
+			{"imported/old.txt", 0o600, 1},
+			{"imported/x", 0o750 | lib.FileModeDir, 0},
+			{"imported/x/link", lib.FileModeSymlink, 0},
+			{"imported/x/y", 0o700 | lib.FileModeDir, 0},
+			{"imported/x/y/b.txt", 0o640 | lib.FileModeSetUid, 1},
+		}, lsFiles(ls))
+		assert.Equal("b", cat(t, r, "imported/x/y/b.txt"))
+		assert.Equal("o", cat(t, r, "imported/old.txt"))
+		for _, file := range ls {
+			switch file.Path.String() {
+			case "imported/x/y/b.txt":
+				assert.Equal(mtime, file.Metadata.Mtime.Time())
+				assert.Equal(uint32(12), *file.Metadata.Uid)
+				assert.Equal(uint32(34), *file.Metadata.Gid)
+			case "imported/x/link":
+				assert.Equal("imported/x/y/b.txt", file.Metadata.SymLinkTarget.String())
+			}
+		}
+	})
+
+	t.Run("Unsupported and invalid archive entries", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := setup(t)
+		head := r.Head()
+		tests := []struct {
+			header   *tar.Header
+			expected string
+		}{
+			{&tar.Header{Typeflag: tar.TypeLink, Name: "hard", Linkname: "a.txt"}, "unsupported file type"},
+			{&tar.Header{Typeflag: tar.TypeReg, Name: "../escape.txt"}, "invalid path"},
+			{&tar.Header{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "../escape.txt"}, "escapes"},
+			// `imported/old.txt` is a file in the repository.
+			{&tar.Header{Typeflag: tar.TypeDir, Name: "old.txt/", Mode: 0o700}, "different type of file"},
+		}
+		for _, test := range tests {
+			archive := testTar(t, []*tar.Header{test.header})
+			_, err := ImportTar(t.Context(), r.Repository, archive, importOptions("imported"), td.NewFS(t))
+			assert.Error(err, test.expected)
+		}
+		assert.Equal(head, r.Head())
+	})
+}
+
+// Write a tar archive with the headers. Regular files contain the first
+// `Size` bytes of the base name.
+func testTar(t *testing.T, headers []*tar.Header) *bytes.Buffer {
+	t.Helper()
+	assert := lib.NewAssert(t)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, header := range headers {
+		header.Format = tar.FormatPAX
+		assert.NoError(tw.WriteHeader(header))
+		if header.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(td.Path(header.Name).Base().String()[:header.Size]))
+			assert.NoError(err)
+		}
+	}
+	assert.NoError(tw.Close())
+	return &buf
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/flunderpero/cling-sync/lib"
 )
@@ -16,34 +17,160 @@ type RevisionLog struct {
 	RevisionId lib.RevisionId
 	Revision   lib.Revision
 	Files      []StatusFile
+	// Only set with `LogOptions.Verify`.
+	Signature *SignatureStatus
+}
+
+// The result of verifying the signature of a revision.
+type SignatureStatus struct {
+	// Nil if the revision is not signed.
+	Signer *lib.Ed25519PublicKey
+	// The name of the signer in `LogOptions.TrustedSigners`, empty if the
+	// signer is not trusted.
+	Name string
+	// `lib.ErrInvalidSignature` if the signature does not match the
+	// revision.
+	Err error
+}
+
+// Return false if the signature is invalid or the signer is not trusted.
+// Unsigned revisions are fine.
+func (s *SignatureStatus) OK() bool {
+	return s.Err == nil && (s.Signer == nil || s.Name != "")
+}
+
+func (s *SignatureStatus) String() string {
+	switch {
+	case s.Err != nil:
+		return "BAD (" + s.Err.Error() + ")"
+	case s.Signer == nil:
+		return "none"
+	case s.Name == "":
+		return "UNTRUSTED signer " + s.Signer.String()
+	default:
+		return "good, signed by " + s.Name
+	}
+}
+
+func verifySignature(revision *lib.Revision, trusted map[string]lib.Ed25519PublicKey) *SignatureStatus {
+	signer, err := lib.VerifyRevisionSignature(revision)
+	if errors.Is(err, lib.ErrRevisionNotSigned) {
+		return &SignatureStatus{nil, "", nil}
+	}
+	status := &SignatureStatus{&signer, "", err}
+	for name, s := range trusted {
+		if s == signer {
+			status.Name = name
+		}
+	}
+	return status
 }
 
 // Return the log in long format (a bit like `git log`).
 //
 // Revision: 54601297f7a5003df8a4be36f4298c03dd2f90d1
-// Author:   pero
+// Author:   pero <pero@example.com>
+// Client:   laptop
 // Date:     Tue, 13 May 2025 12:16:16 CEST
+// Host:     laptop.local
+// Stats:    2 added, 1 updated, 0 deleted, 12.5M raw, 4.1M stored, took 3.2s
 //
 //	Commit message
+//
+//	More details, wrapped at `logMessageWidth` columns.
+//
+// The `Client:`, `Host:`, and `Stats:` lines are missing for revisions
+// written by older clients.
 func (l *RevisionLog) Long() string {
 	r := l.Revision
 	date := r.Timestamp.Time().Format(time.RFC1123)
+	stats := ""
+	if r.Stats != nil {
+		stats = formatCommitStats(r.Stats)
+	}
+	signature := ""
+	if l.Signature != nil {
+		signature = "Signature: " + l.Signature.String() + "\n"
+	}
+	client := ""
+	if r.ClientId != nil {
+		client = "Client:   " + *r.ClientId + "\n"
+	}
 	return fmt.Sprintf(
-		"Revision: %s\nAuthor:   %s\nDate:     %s\n\n    %s",
+		"Revision: %s\nAuthor:   %s\n%sDate:     %s\n%s%s\n    %s",
 		l.RevisionId,
 		strings.ReplaceAll(derefString(r.Author), "\n", " "),
+		client,
 		date,
-		strings.ReplaceAll(derefString(r.Message), "\n", "\n    "),
+		stats,
+		signature,
+		strings.Join(wrapMessage(derefString(r.Message), logMessageWidth), "\n    "),
+	)
+}
+
+// The width at which the lines of a commit message are wrapped by
+// `RevisionLog.Long`.
+const logMessageWidth = 72
+
+// Split `message` into lines and wrap the lines that are longer than
+// `width` at spaces. Indented lines (e.g. code or a list that was
+// formatted by hand) and words longer than `width` are kept as they are.
+func wrapMessage(message string, width int) []string {
+	var lines []string
+	for line := range strings.SplitSeq(strings.TrimRight(message, "\n"), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if utf8.RuneCountInString(line) <= width || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			lines = append(lines, line)
+			continue
+		}
+		current := ""
+		for word := range strings.FieldsSeq(line) {
+			if current != "" && utf8.RuneCountInString(current)+1+utf8.RuneCountInString(word) > width {
+				lines = append(lines, current)
+				current = ""
+			}
+			if current != "" {
+				current += " "
+			}
+			current += word
+		}
+		lines = append(lines, current)
+	}
+	return lines
+}
+
+// Return the `Host:` and `Stats:` lines of the long format.
+func formatCommitStats(stats *lib.CommitStats) string {
+	host := ""
+	if stats.Hostname != "" {
+		host = "Host:     " + stats.Hostname + "\n"
+	}
+	return fmt.Sprintf(
+		"%sStats:    %d added, %d updated, %d deleted, %s raw, %s stored, took %s\n",
+		host,
+		stats.FilesAdded,
+		stats.FilesUpdated,
+		stats.FilesDeleted,
+		FormatBytes(stats.RawBytes),
+		FormatBytes(stats.StoredBytes),
+		(time.Duration(stats.DurationMs) * time.Millisecond).String(),
 	)
 }
 
 // Return the log in short format.
 //
-// <RevisionId> <Date> <Message>
+// <RevisionId> <Date> <First line of the message>
+//
+// With `LogOptions.Verify`, the signature is shown in brackets before the
+// message.
 func (l *RevisionLog) Short() string {
 	r := l.Revision
 	date := r.Timestamp.Time().Format(time.RFC3339)
-	return fmt.Sprintf("%s %s %s", l.RevisionId, date, strings.ReplaceAll(derefString(r.Message), "\n", " "))
+	if l.Signature != nil {
+		date += " [signature: " + l.Signature.String() + "]"
+	}
+	subject, _, _ := strings.Cut(derefString(r.Message), "\n")
+	return fmt.Sprintf("%s %s %s", l.RevisionId, date, subject)
 }
 
 func derefString(s *string) string {
@@ -61,6 +188,10 @@ type LogOptions struct {
 	// and a Range.Since not in the repository is never reached, so the log
 	// runs to the root.
 	Range lib.RevisionRange
+	// Verify the signature of every revision (see `RevisionLog.Signature`)
+	// against `TrustedSigners`.
+	Verify         bool
+	TrustedSigners map[string]lib.Ed25519PublicKey
 }
 
 func Log(ctx context.Context, repository *lib.Repository, opts *LogOptions) ([]RevisionLog, error) {
@@ -101,17 +232,44 @@ func Log(ctx context.Context, repository *lib.Repository, opts *LogOptions) ([]R
 				}
 				matchedAtLeastOnePath = true
 				if opts.Status {
-					files = append(files, StatusFile{entry.Path, entry.Kind, entry.Metadata})
+					files = append(files, StatusFile{entry.Path, entry.Kind, entry.Metadata, entry.RenamedFrom})
 				}
 			}
+			files = collapseRenames(files)
 		}
 		if !opts.Status {
 			files = nil
 		}
 		if opts.PathFilter == nil || matchedAtLeastOnePath {
-			logs = append(logs, RevisionLog{revisionId, revision, files})
+			var signature *SignatureStatus
+			if opts.Verify {
+				signature = verifySignature(&revision, opts.TrustedSigners)
+			}
+			logs = append(logs, RevisionLog{revisionId, revision, files, signature})
 		}
 		revisionId = revision.ParentRevisionId
 	}
 	return logs, nil
 }
+
+// collapseRenames drops the delete entries that are the source of a rename
+// in the same revision, so that a rename is shown as a single entry.
+func collapseRenames(files []StatusFile) []StatusFile {
+	renamedFrom := map[lib.Path]bool{}
+	for _, f := range files {
+		if f.RenamedFrom != nil {
+			renamedFrom[*f.RenamedFrom] = true
+		}
+	}
+	if len(renamedFrom) == 0 {
+		return files
+	}
+	result := make([]StatusFile, 0, len(files))
+	for _, f := range files {
+		if f.Kind == lib.RevisionEntryKindDelete && renamedFrom[f.Path] {
+			continue
+		}
+		result = append(result, f)
+	}
+	return result
+}
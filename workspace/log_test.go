@@ -1,6 +1,7 @@
 package workspace
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/flunderpero/cling-sync/lib"
@@ -27,7 +28,7 @@ func TestLog(t *testing.T) {
 		assert.NoError(err)
 
 		// List all revisions.
-		logs, err := Log(t.Context(), r.Repository, &LogOptions{nil, false, lib.RevisionRange{nil, nil}})
+		logs, err := Log(t.Context(), r.Repository, &LogOptions{nil, false, lib.RevisionRange{nil, nil}, false, nil})
 		assert.NoError(err)
 		assert.Equal([]TestRevisionLog{
 			revisionLog(t, r, revId3, nil),
@@ -39,7 +40,7 @@ func TestLog(t *testing.T) {
 		logs, err = Log(
 			t.Context(),
 			r.Repository,
-			&LogOptions{nil, false, lib.RevisionRange{Since: &revId1, Until: &revId3}},
+			&LogOptions{nil, false, lib.RevisionRange{Since: &revId1, Until: &revId3}, false, nil},
 		)
 		assert.NoError(err)
 		assert.Equal([]TestRevisionLog{
@@ -51,7 +52,7 @@ func TestLog(t *testing.T) {
 		logs, err = Log(
 			t.Context(),
 			r.Repository,
-			&LogOptions{nil, false, lib.RevisionRange{Since: nil, Until: &revId2}},
+			&LogOptions{nil, false, lib.RevisionRange{Since: nil, Until: &revId2}, false, nil},
 		)
 		assert.NoError(err)
 		assert.Equal([]TestRevisionLog{
@@ -60,6 +61,70 @@ func TestLog(t *testing.T) {
 		}, newTestRevisionLogs(logs, false))
 	})
 
+	t.Run("Commit statistics", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+
+		w.Write("a.txt", "aaa")
+		w.Write("dir/b.txt", "b")
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		// The content of `c.txt` is already in the repository.
+		w.Write("a.txt", "a")
+		w.Rm("dir/b.txt")
+		w.Write("c.txt", "aaa")
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+
+		logs, err := Log(t.Context(), r.Repository, &LogOptions{nil, false, lib.RevisionRange{nil, nil}, false, nil})
+		assert.NoError(err)
+		assert.Equal(2, len(logs))
+		stats := logs[1].Revision.Stats
+		assert.Equal([]uint32{2, 0, 0}, []uint32{stats.FilesAdded, stats.FilesUpdated, stats.FilesDeleted})
+		assert.Equal(int64(4), stats.RawBytes)
+		assert.Equal(true, stats.StoredBytes > 0)
+		stats = logs[0].Revision.Stats
+		assert.Equal([]uint32{1, 1, 1}, []uint32{stats.FilesAdded, stats.FilesUpdated, stats.FilesDeleted})
+		assert.Equal(int64(4), stats.RawBytes)
+		firstStoredBytes := logs[1].Revision.Stats.StoredBytes
+		assert.Equal(true, stats.StoredBytes > 0 && stats.StoredBytes < firstStoredBytes)
+		assert.Contains(
+			logs[0].Long(),
+			"\nStats:    1 added, 1 updated, 1 deleted, 4B raw, "+FormatBytes(stats.StoredBytes)+" stored, took ",
+		)
+	})
+
+	t.Run("Multi-line messages", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+
+		w.Write("a.txt", "a")
+		opts := wstd.MergeOptions()
+		opts.Message = "Subject\n\n" + strings.Repeat("word ", 20) + "\n\n    " + strings.Repeat("code ", 20)
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, opts)
+		assert.NoError(err)
+		logs, err := Log(t.Context(), r.Repository, &LogOptions{nil, false, lib.RevisionRange{nil, nil}, false, nil})
+		assert.NoError(err)
+		assert.Equal(opts.Message, *logs[0].Revision.Message)
+		assert.Equal(true, strings.HasSuffix(logs[0].Short(), " Subject"))
+		long := logs[0].Long()
+		_, message, _ := strings.Cut(long, "\n\n")
+		// The indented line is not wrapped.
+		assert.Equal(
+			"    Subject\n    \n"+
+				"    "+strings.TrimSpace(strings.Repeat("word ", 14))+"\n"+
+				"    "+strings.TrimSpace(strings.Repeat("word ", 6))+"\n    \n"+
+				"        "+strings.TrimSpace(strings.Repeat("code ", 20)),
+			message,
+		)
+		assert.Equal([]string{""}, wrapMessage("", 10))
+		assert.Equal([]string{"a", "longerthanten", "b c"}, wrapMessage("a longerthanten b c", 10))
+	})
+
 	t.Run("Status", func(t *testing.T) {
 		t.Parallel()
 		assert := lib.NewAssert(t)
@@ -81,7 +146,7 @@ func TestLog(t *testing.T) {
 		assert.NoError(err)
 
 		// List all revisions.
-		logs, err := Log(t.Context(), r.Repository, &LogOptions{nil, true, lib.RevisionRange{nil, nil}})
+		logs, err := Log(t.Context(), r.Repository, &LogOptions{nil, true, lib.RevisionRange{nil, nil}, false, nil})
 		assert.NoError(err)
 		assert.Equal([]TestRevisionLog{
 			revisionLog(t, r, revId2, []TestStatusFile{
@@ -120,7 +185,7 @@ func TestLog(t *testing.T) {
 
 		// PathFilter on `a.txt` without status.
 		filter := lib.NewPathInclusionFilter([]string{"a.txt"})
-		logs, err := Log(t.Context(), r.Repository, &LogOptions{filter, false, lib.RevisionRange{nil, nil}})
+		logs, err := Log(t.Context(), r.Repository, &LogOptions{filter, false, lib.RevisionRange{nil, nil}, false, nil})
 		assert.NoError(err)
 		assert.Equal([]TestRevisionLog{
 			revisionLog(t, r, revId3, nil),
@@ -128,7 +193,7 @@ func TestLog(t *testing.T) {
 		}, newTestRevisionLogs(logs, false))
 
 		// PathFilter on `a.txt` with status.
-		logs, err = Log(t.Context(), r.Repository, &LogOptions{filter, true, lib.RevisionRange{nil, nil}})
+		logs, err = Log(t.Context(), r.Repository, &LogOptions{filter, true, lib.RevisionRange{nil, nil}, false, nil})
 		assert.NoError(err)
 		assert.Equal([]TestRevisionLog{
 			revisionLog(t, r, revId3, []TestStatusFile{{"a.txt", lib.RevisionEntryKindDelete, 1}}),
@@ -137,7 +202,7 @@ func TestLog(t *testing.T) {
 
 		// PathFilter on `c/*` with status.
 		filter = lib.NewPathInclusionFilter([]string{"c/*"})
-		logs, err = Log(t.Context(), r.Repository, &LogOptions{filter, true, lib.RevisionRange{nil, nil}})
+		logs, err = Log(t.Context(), r.Repository, &LogOptions{filter, true, lib.RevisionRange{nil, nil}, false, nil})
 		assert.NoError(err)
 		assert.Equal([]TestRevisionLog{
 			revisionLog(t, r, revId2, []TestStatusFile{{"c/e.txt", lib.RevisionEntryKindAdd, 1}}),
@@ -9,19 +9,32 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"log/slog"
+	"maps"
 	"path/filepath"
 	"slices"
 	"strings"
+	"syscall"
 
 	"github.com/flunderpero/cling-sync/lib"
 )
 
 var (
 	ErrUpToDate      = lib.Errorf("workspace is up to date")
-	ErrRemoteChanged = lib.Errorf("remote repository has changed during merge")
+	ErrRemoteChanged = lib.WrapErrorKindf(lib.ErrContention, nil, "remote repository has changed during merge")
+	// The kind of `MergeConflictsError`, `ResetError`, and `RestoreError`:
+	// local changes conflict with the repository and have to be resolved by
+	// the user.
+	ErrConflict = lib.Errorf("conflicting changes")
+	// The kind of the error returned if the repository does not contain the
+	// workspace head, e.g. a mirror that is behind (see `UseRemote`).
+	ErrHeadNotInRepository = lib.Errorf("the workspace head is not in the repository")
 )
 
 type CommitMonitor interface {
+	// OnTotal is called before uploading with the number of paths and the
+	// total size of the files that are going to be committed.
+	OnTotal(paths int, bytes int64)
 	OnStart(entry *lib.RevisionEntry) error
 	// bytesWritten: if nil, the block already existed; otherwise, the total block size (including
 	// header) written.
@@ -30,6 +43,25 @@ type CommitMonitor interface {
 	OnBeforeCommit() error
 }
 
+// storedBytesMonitor adds up the bytes of the blocks written while
+// committing for `lib.CommitInfo.StoredBytes`.
+type storedBytesMonitor struct {
+	CommitMonitor
+	storedBytes int64
+}
+
+func (m *storedBytesMonitor) OnAddBlock(
+	entry *lib.RevisionEntry,
+	blockId lib.BlockId,
+	dataSize int,
+	bytesWritten *int,
+) error {
+	if bytesWritten != nil {
+		m.storedBytes += int64(*bytesWritten)
+	}
+	return m.CommitMonitor.OnAddBlock(entry, blockId, dataSize, bytesWritten) //nolint:wrapcheck
+}
+
 type MergeOptions struct {
 	StagingMonitor         StagingEntryMonitor
 	CpMonitor              CpMonitor
@@ -38,9 +70,55 @@ type MergeOptions struct {
 	Message                string
 	RestorableMetadataFlag lib.RestorableMetadataFlag
 	UseStagingCache        bool
+	// Paths (relative to the workspace) included by this filter are uploaded
+	// and downloaded before all others, so that they are safe first if a long
+	// merge is interrupted. Optional.
+	First lib.PathFilter
+	// Only the local changes of the paths (relative to the workspace)
+	// included by this filter are committed, the others stay local changes.
+	// The changes in the repository are merged regardless. Optional, only
+	// used by `Merge`.
+	CommitFilter lib.PathFilter
+	// Only scan the directories that changed according to the watch journal
+	// (see `RunWatchJournal`). Needs `UseStagingCache`. Optional.
+	WatchJournal *WatchJournalPosition
+	// Merge conflicting text files line by line instead of failing. Changes
+	// to the same lines are put between conflict markers and the file is not
+	// committed until they are removed (see `Workspace.UnresolvedConflicts`).
+	// Only used by `Merge`.
+	MergeText bool
+	// Shared by the caches of the revisions and changes compared during the
+	// merge (see `lib.MemoryBudget`). Optional, without a budget each cache
+	// keeps `lib.DefaultTempCacheChunks` chunks in memory.
+	MemoryBudget *lib.MemoryBudget
+	// Called with the statistics of these caches once the merge is done.
+	// Optional.
+	CacheMonitor lib.TempCacheMonitor
+	// Receives the standard output and error of the hooks (see `Hook`).
+	// Optional, the output is discarded if nil.
+	HookOutput io.Writer
 	// todo: add a `MergeMonitor` that is called after each merge step.
 }
 
+func (opts *MergeOptions) tempCacheOptions() lib.TempCacheOptions {
+	return lib.TempCacheOptions{MaxChunks: 0, Budget: opts.MemoryBudget}
+}
+
+// Implemented by every `lib.TempCache`.
+type tempCacheStatser interface {
+	Stats() lib.TempCacheStats
+}
+
+// Report the statistics of the caches of a merge to `opts.CacheMonitor`.
+func reportTempCacheStats(opts *MergeOptions, caches map[string]tempCacheStatser) {
+	if opts.CacheMonitor == nil {
+		return
+	}
+	for _, name := range slices.Sorted(maps.Keys(caches)) {
+		opts.CacheMonitor.OnTempCacheStats(name, caches[name].Stats())
+	}
+}
+
 type MergeConflict struct {
 	WorkspaceEntry  *lib.RevisionEntry
 	RepositoryEntry *lib.RevisionEntry
@@ -48,6 +126,10 @@ type MergeConflict struct {
 
 type MergeConflictsError []MergeConflict
 
+func (mc MergeConflictsError) Is(target error) bool {
+	return target == ErrConflict //nolint:errorlint
+}
+
 func (mc MergeConflictsError) Error() string {
 	var s strings.Builder
 	s.WriteString("MergeConflictsError(")
@@ -69,17 +151,49 @@ type Merger struct {
 	directories      map[string]fs.FileInfo
 	opts             *MergeOptions
 	blockBuf         lib.BlockBuf
+	// Local changes (by repository path) that are not committed.
+	skipCommit map[lib.Path]bool
+	links      *hardLinker
+	// The files uploaded by the current commit, see `commitJournal`.
+	journal *commitJournal
+	// Only the paths (relative to the workspace) included by this filter are
+	// copied into and deleted from the workspace, see `ResetOptions.PathFilter`.
+	// Optional.
+	pathFilter lib.PathFilter
 }
 
 // Merge the changes from the repository into the workspace and vice versa.
 // Return a `MergeConflictsError` error if there are conflicts.
+// The hooks of the workspace are run before and after the merge (see `Hook`).
 // todo: return new revision id and the local changes.
 func Merge(ctx context.Context, ws *Workspace, repository *lib.Repository, opts *MergeOptions) (lib.RevisionId, error) {
+	return runMergeHooks(ctx, ws, repository, opts, func(commits *[]lib.RevisionId) (lib.RevisionId, error) {
+		return merge(ctx, ws, repository, opts, commits)
+	})
+}
+
+// Merge without running the hooks, add the committed revisions to `commits`.
+func merge(
+	ctx context.Context,
+	ws *Workspace,
+	repository *lib.Repository,
+	opts *MergeOptions,
+	commits *[]lib.RevisionId,
+) (lib.RevisionId, error) {
 	tempFS, err := ws.TempFS.MkSub("merge")
 	if err != nil {
 		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to create merge tmp dir")
 	}
 	defer tempFS.RemoveAll(".") //nolint:errcheck
+	if err := repairPendingCommit(ctx, ws, repository, opts); err != nil {
+		return lib.RevisionId{}, err
+	}
+	if err := finishRestoreInPlace(ctx, ws, repository, opts.RestorableMetadataFlag); err != nil {
+		return lib.RevisionId{}, err
+	}
+	if err := checkWorkspaceHead(ctx, ws, repository); err != nil {
+		return lib.RevisionId{}, err
+	}
 	head, err := repository.Head(ctx)
 	if err != nil {
 		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to get repository head")
@@ -88,65 +202,241 @@ func Merge(ctx context.Context, ws *Workspace, repository *lib.Repository, opts
 	if err != nil {
 		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to build local changes")
 	}
-	if head == wsHead && localChanges.Source.Chunks() == 0 {
-		return lib.RevisionId{}, ErrUpToDate
+	var remoteRevision *lib.TempCache[*lib.RevisionEntry]
+	defer func() {
+		reportTempCacheStats(opts, map[string]tempCacheStatser{
+			"staging":            staging,
+			"local-changes":      localChanges,
+			"workspace-revision": wsRevision,
+			"remote-revision":    remoteRevision,
+		})
+	}()
+	merger := Merger{
+		ws,
+		wsHead,
+		head,
+		tempFS,
+		repository,
+		make(map[string]fs.FileInfo),
+		opts,
+		lib.NewBlockBuf(),
+		map[lib.Path]bool{},
+		newHardLinker(false),
+		nil,
+		nil,
+	}
+	unresolved, err := ws.UnresolvedConflicts(ctx)
+	if err != nil {
+		return lib.RevisionId{}, err
+	}
+	for _, path := range unresolved {
+		merger.skipCommit[ws.PathPrefix.Join(path)] = true
+	}
+	if opts.CommitFilter != nil {
+		if err := merger.skipExcludedChanges(localChanges.Source); err != nil {
+			return lib.RevisionId{}, err
+		}
 	}
-	if !wsHead.IsRoot() {
-		chain, err := lib.ReadRevisionChain(ctx, repository)
+	hasLocalChanges, err := merger.hasLocalChanges(localChanges.Source)
+	if err != nil {
+		return lib.RevisionId{}, err
+	}
+	slog.Debug(
+		"Merging",
+		"workspace_head", wsHead.String(),
+		"repository_head", head.String(),
+		"local_changes", hasLocalChanges,
+	)
+	if head == wsHead && !hasLocalChanges {
+		// Paths that were added to the sparse patterns or un-ignored still
+		// have to be fetched.
+		scopeChanged, err := ws.scopeChanged(ctx)
 		if err != nil {
-			return lib.RevisionId{}, lib.WrapErrorf(err, "failed to read repository revision chain")
+			return lib.RevisionId{}, err
 		}
-		if !slices.Contains(chain, wsHead) {
-			return lib.RevisionId{}, lib.Errorf("workspace head %s is not in the repository's revision chain", wsHead)
+		if !scopeChanged {
+			return lib.RevisionId{}, ErrUpToDate
 		}
 	}
-	remoteRevision, err := buildRemoteChanges(ctx, tempFS, repository, head)
+	remoteRevision, err = buildRemoteChanges(ctx, tempFS, repository, head, opts.tempCacheOptions())
 	if err != nil {
 		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to build remote changes")
 	}
-	merger := Merger{ws, wsHead, head, tempFS, repository, make(map[string]fs.FileInfo), opts, lib.NewBlockBuf()}
 	conflicts, err := merger.findConflicts(localChanges.Source, remoteRevision, wsRevision)
 	if err != nil {
 		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to find conflicts")
 	}
+	var textMerges []textMerge
+	if opts.MergeText && len(conflicts) > 0 {
+		textMerges, conflicts, err = merger.mergeTextConflicts(ctx, conflicts, wsRevision)
+		if err != nil {
+			return lib.RevisionId{}, lib.WrapErrorf(err, "failed to merge conflicting text files")
+		}
+	}
 	if len(conflicts) > 0 {
+		slog.Debug("Merge stopped because of conflicts", "conflicts", len(conflicts))
 		return lib.RevisionId{}, conflicts
 	}
-	if err := merger.applyRemoteChanges(ctx, head, remoteRevision, staging, localChanges); err != nil {
+	// The local versions of the merged files are neither committed nor
+	// overwritten, the merged content replaces them after the merge.
+	for _, merge := range textMerges {
+		merger.skipCommit[merge.repoPath] = true
+	}
+	if len(textMerges) > 0 {
+		if hasLocalChanges, err = merger.hasLocalChanges(localChanges.Source); err != nil {
+			return lib.RevisionId{}, err
+		}
+	}
+	if err := merger.applyRemoteChanges(ctx, head, remoteRevision, wsRevision, staging, localChanges); err != nil {
 		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to apply remote changes")
 	}
-	if localChanges.Source.Chunks() > 0 {
+	if hasLocalChanges {
 		err := opts.CommitMonitor.OnBeforeCommit()
 		if err != nil {
 			return lib.RevisionId{}, err //nolint:wrapcheck
 		}
+		if err := ws.beginCommit(ctx, wsHead); err != nil {
+			return lib.RevisionId{}, err
+		}
 		newHead, err := merger.commitLocalChanges(
 			ctx,
 			localChanges.Source,
 			remoteRevision,
+			nil,
 			opts.CommitMonitor,
 			opts.Author,
 			opts.Message,
 		)
 		if err != nil {
+			// Nothing was committed.
+			_ = ws.endCommit(ctx)
 			return lib.RevisionId{}, lib.WrapErrorf(err, "failed to commit local changes")
 		}
 		head = newHead
+		*commits = append(*commits, newHead)
 	}
 	if err := lib.WriteRef(ctx, ws.Storage, "head", head); err != nil {
 		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to write workspace head reference - please re-run merge")
 	}
+	if err := ws.endCommit(ctx); err != nil {
+		return lib.RevisionId{}, err
+	}
+	if err := ws.writeAppliedScope(ctx); err != nil {
+		return lib.RevisionId{}, err
+	}
+	if err := merger.writeTextMerges(ctx, textMerges, unresolved); err != nil {
+		return lib.RevisionId{}, err
+	}
+	if slices.ContainsFunc(textMerges, func(merge textMerge) bool { return merge.conflicts == 0 }) {
+		// The cleanly merged files are local changes now, commit them.
+		newHead, err := merge(ctx, ws, repository, opts, commits)
+		if errors.Is(err, ErrUpToDate) || errors.Is(err, lib.ErrEmptyCommit) {
+			return head, nil
+		}
+		return newHead, err
+	}
 	return head, nil
 }
 
+// Return whether there are local changes to commit.
+func (m *Merger) hasLocalChanges(localChanges *lib.Temp[*lib.RevisionEntry]) (bool, error) {
+	if len(m.skipCommit) == 0 {
+		return localChanges.Chunks() > 0, nil
+	}
+	r := localChanges.Reader(nil)
+	for {
+		entry, err := r.Read(m.blockBuf)
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		if err != nil {
+			return false, lib.WrapErrorf(err, "failed to read local changes")
+		}
+		if !m.skipCommit[entry.Path] {
+			return true, nil
+		}
+	}
+}
+
+// Do not commit the local changes excluded by `MergeOptions.CommitFilter`.
+// The paths below a skipped new directory are skipped, too, and a deleted
+// directory is kept as long as a path below it is skipped.
+func (m *Merger) skipExcludedChanges(localChanges *lib.Temp[*lib.RevisionEntry]) error {
+	var skippedDirs, deletedDirs []lib.Path
+	r := localChanges.Reader(nil)
+	for {
+		entry, err := r.Read(m.blockBuf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to read local changes")
+		}
+		isDir := entry.Metadata.FileMode.IsDir()
+		if isDir && entry.Kind == lib.RevisionEntryKindDelete {
+			deletedDirs = append(deletedDirs, entry.Path)
+		}
+		localPath, _ := entry.Path.TrimBase(m.ws.PathPrefix)
+		if m.opts.CommitFilter.Include(localPath, isDir) && !slices.ContainsFunc(skippedDirs, entry.Path.IsRelativeTo) {
+			continue
+		}
+		m.skipCommit[entry.Path] = true
+		if isDir && entry.Kind == lib.RevisionEntryKindAdd {
+			skippedDirs = append(skippedDirs, entry.Path)
+		}
+	}
+	for _, dir := range deletedDirs {
+		for path := range m.skipCommit {
+			if path.IsRelativeTo(dir) {
+				m.skipCommit[dir] = true
+				break
+			}
+		}
+	}
+	return nil
+}
+
 type ForceCommitOptions struct {
 	MergeOptions
+	// Keep the repository version of each conflicting file in the commit
+	// under `ConflictPath`, so that it can be inspected and recovered from
+	// any workspace.
+	KeepConflicts bool
+}
+
+// The directory in the repository where `ForceCommit` keeps the overwritten
+// versions of conflicting files (see `ForceCommitOptions.KeepConflicts`).
+const ConflictsDir = "~conflicts"
+
+// Return the path of the version of `path` that was overwritten in
+// `revisionId` by a `ForceCommit`, i.e. `~conflicts/<revisionId>/<path>`.
+func ConflictPath(revisionId lib.RevisionId, path lib.Path) lib.Path {
+	dir, _ := lib.NewPath(ConflictsDir + "/" + revisionId.String()) // Always a valid path.
+	return dir.Join(path)
 }
 
 // Commit all local changes ignoring possible conflicts.
 // Afterwards, merge the repository into the workspace.
 // Return a `lib.EmptyCommit` error if there are no local changes.
-func ForceCommit( //nolint:funlen
+// The hooks of the workspace are run like in `Merge`.
+func ForceCommit(
+	ctx context.Context,
+	ws *Workspace,
+	repository *lib.Repository,
+	opts *ForceCommitOptions,
+) (lib.RevisionId, error) {
+	commit := func(commits *[]lib.RevisionId) (lib.RevisionId, error) {
+		head, err := forceCommit(ctx, ws, repository, opts)
+		if err != nil {
+			return head, err
+		}
+		*commits = append(*commits, head)
+		return head, nil
+	}
+	return runMergeHooks(ctx, ws, repository, &opts.MergeOptions, commit)
+}
+
+func forceCommit( //nolint:funlen
 	ctx context.Context,
 	ws *Workspace,
 	repository *lib.Repository,
@@ -157,27 +447,40 @@ func ForceCommit( //nolint:funlen
 		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to create merge tmp dir")
 	}
 	defer tempFS.RemoveAll(".") //nolint:errcheck
-	wsHead, staging, localChanges, _, err := buildLocalChanges(ctx, ws, tempFS, repository, &opts.MergeOptions)
+	if err := repairPendingCommit(ctx, ws, repository, &opts.MergeOptions); err != nil {
+		return lib.RevisionId{}, err
+	}
+	if err := checkWorkspaceHead(ctx, ws, repository); err != nil {
+		return lib.RevisionId{}, err
+	}
+	wsHead, staging, localChanges, wsRevision, err := buildLocalChanges(
+		ctx,
+		ws,
+		tempFS,
+		repository,
+		&opts.MergeOptions,
+	)
 	if err != nil {
 		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to build local changes")
 	}
+	var remoteRevision *lib.TempCache[*lib.RevisionEntry]
+	defer func() {
+		reportTempCacheStats(&opts.MergeOptions, map[string]tempCacheStatser{
+			"staging":            staging,
+			"local-changes":      localChanges,
+			"workspace-revision": wsRevision,
+			"remote-revision":    remoteRevision,
+		})
+	}()
 	if localChanges.Source.Chunks() == 0 {
 		return lib.RevisionId{}, lib.ErrEmptyCommit
 	}
-	if !wsHead.IsRoot() {
-		chain, err := lib.ReadRevisionChain(ctx, repository)
-		if err != nil {
-			return lib.RevisionId{}, lib.WrapErrorf(err, "failed to read repository revision chain")
-		}
-		if !slices.Contains(chain, wsHead) {
-			return lib.RevisionId{}, lib.Errorf("workspace head %s is not in the repository's revision chain", wsHead)
-		}
-	}
+	slog.Debug("Force committing", "workspace_head", wsHead.String(), "keep_conflicts", opts.KeepConflicts)
 	head, err := repository.Head(ctx)
 	if err != nil {
 		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to get repository head")
 	}
-	remoteRevision, err := buildRemoteChanges(ctx, tempFS, repository, head)
+	remoteRevision, err = buildRemoteChanges(ctx, tempFS, repository, head, opts.tempCacheOptions())
 	if err != nil {
 		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to build remote changes")
 	}
@@ -190,28 +493,51 @@ func ForceCommit( //nolint:funlen
 		make(map[string]fs.FileInfo),
 		&opts.MergeOptions,
 		lib.NewBlockBuf(),
+		nil,
+		newHardLinker(false),
+		nil,
+		nil,
+	}
+	var conflicts MergeConflictsError
+	if opts.KeepConflicts {
+		conflicts, err = merger.findConflicts(localChanges.Source, remoteRevision, wsRevision)
+		if err != nil {
+			return lib.RevisionId{}, lib.WrapErrorf(err, "failed to find conflicts")
+		}
+	}
+	if err := ws.beginCommit(ctx, wsHead); err != nil {
+		return lib.RevisionId{}, err
 	}
 	newHead, err := merger.commitLocalChanges(
 		ctx,
 		localChanges.Source,
 		remoteRevision,
+		conflicts,
 		opts.CommitMonitor,
 		opts.Author,
 		opts.Message,
 	)
 	if err != nil {
+		// Nothing was committed.
+		_ = ws.endCommit(ctx)
 		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to commit local changes")
 	}
-	remoteRevision, err = buildRemoteChanges(ctx, tempFS, repository, newHead)
+	remoteRevision, err = buildRemoteChanges(ctx, tempFS, repository, newHead, opts.tempCacheOptions())
 	if err != nil {
 		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to build remote changes")
 	}
-	if err := merger.applyRemoteChanges(ctx, newHead, remoteRevision, staging, localChanges); err != nil {
+	if err := merger.applyRemoteChanges(ctx, newHead, remoteRevision, wsRevision, staging, localChanges); err != nil {
 		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to apply remote changes")
 	}
 	if err := lib.WriteRef(ctx, ws.Storage, "head", newHead); err != nil {
 		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to write workspace head reference - please re-run merge")
 	}
+	if err := ws.endCommit(ctx); err != nil {
+		return lib.RevisionId{}, err
+	}
+	if err := ws.writeAppliedScope(ctx); err != nil {
+		return lib.RevisionId{}, err
+	}
 	return newHead, nil
 }
 
@@ -230,10 +556,14 @@ func (m *Merger) commitLocalChanges( //nolint:funlen
 	ctx context.Context,
 	localChanges *lib.Temp[*lib.RevisionEntry],
 	remoteRevision *lib.TempCache[*lib.RevisionEntry],
+	conflicts MergeConflictsError,
 	mon CommitMonitor,
 	author string,
 	message string,
 ) (lib.RevisionId, error) {
+	slog.Debug("Committing local changes", "parent", m.remoteRevisionId.String())
+	counter := &storedBytesMonitor{mon, 0}
+	mon = counter
 	tmpFS, err := m.tempFS.MkSub("commit")
 	if err != nil {
 		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to create commit tmp dir")
@@ -242,6 +572,29 @@ func (m *Merger) commitLocalChanges( //nolint:funlen
 	if err != nil {
 		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to create commit")
 	}
+	if err := reportCommitTotal(localChanges, m.skipCommit, mon, m.blockBuf); err != nil {
+		return lib.RevisionId{}, err
+	}
+	key, err := m.ws.cacheKey(m.repository)
+	if err != nil {
+		return lib.RevisionId{}, err
+	}
+	journal, err := openCommitJournal(m.ws.FS, key)
+	if err != nil {
+		return lib.RevisionId{}, err
+	}
+	m.journal = journal
+	defer func() {
+		if m.journal != nil {
+			// Keep the journal for the next merge.
+			_ = m.journal.close()
+			m.journal = nil
+		}
+	}()
+	uploadedFirst, err := m.uploadFirst(ctx, localChanges, remoteRevision, mon)
+	if err != nil {
+		return lib.RevisionId{}, err
+	}
 	r := localChanges.Reader(nil)
 	for {
 		entry, err := r.Read(m.blockBuf)
@@ -251,7 +604,18 @@ func (m *Merger) commitLocalChanges( //nolint:funlen
 		if err != nil {
 			return lib.RevisionId{}, lib.WrapErrorf(err, "failed to read revision snapshot")
 		}
-		localPath, _ := entry.Path.TrimBase(m.ws.PathPrefix)
+		if m.skipCommit[entry.Path] {
+			continue
+		}
+		if md, ok := uploadedFirst[entry.Path]; ok {
+			if md != nil {
+				entry.Metadata = *md
+				if err := commit.Add(entry); err != nil {
+					return lib.RevisionId{}, lib.WrapErrorf(err, "failed to add revision entry to commit")
+				}
+			}
+			continue
+		}
 		if err := mon.OnStart(entry); err != nil {
 			return lib.RevisionId{}, lib.WrapErrorf(err, "commit monitor start failed for %s", entry.Path)
 		}
@@ -264,57 +628,23 @@ func (m *Merger) commitLocalChanges( //nolint:funlen
 			}
 			continue
 		}
-		stat, err := m.ws.FS.Stat(localPath.String())
-		if errors.Is(err, fs.ErrNotExist) {
-			// todo: make special errors out of these so we can distinguish them later.
-			return lib.RevisionId{}, lib.Errorf("file %s was deleted during merge - aborting merge", localPath)
-		}
-		if err != nil {
-			return lib.RevisionId{}, lib.WrapErrorf(err, "failed to stat %s", localPath)
-		}
-		remoteEntry, existsInRemote, err := remoteRevision.Get(lib.RevisionEntryPathCompareString(entry))
+		md, changed, err := m.uploadLocalChange(ctx, entry, remoteRevision, mon)
 		if err != nil {
-			return lib.RevisionId{}, lib.WrapErrorf(
-				err,
-				"failed to get entry from repository snapshot cache for %s",
-				entry.Path,
-			)
+			return lib.RevisionId{}, err
 		}
-		var md lib.PathMetadata
-		if existsInRemote && entry.Metadata.FileHash == remoteEntry.Metadata.FileHash {
-			if entry.Metadata.IsEqualRestorableAttributes(remoteEntry.Metadata, m.opts.RestorableMetadataFlag) {
-				// The file did not change at all, we can skip it completely.
-				if err := mon.OnEnd(entry); err != nil {
-					return lib.RevisionId{}, lib.WrapErrorf(err, "commit monitor end failed for %s", entry.Path)
-				}
-				continue
-			}
-			// Only metadata changed.
-			md = entry.Metadata
-			md.BlockIds = remoteEntry.Metadata.BlockIds
-		} else {
-			uploadedMD, err := AddFileToRepository(ctx, m.ws.FS, localPath, stat, m.repository, entry, mon)
-			if err != nil {
-				return lib.RevisionId{}, lib.WrapErrorf(err, "failed to add blocks and get metadata for %s", localPath)
+		if changed {
+			entry.Metadata = md
+			if err := commit.Add(entry); err != nil {
+				return lib.RevisionId{}, lib.WrapErrorf(err, "failed to add revision entry to commit")
 			}
-			md = uploadedMD
-		}
-		if md.FileHash != entry.Metadata.FileHash {
-			return lib.RevisionId{}, lib.Errorf(
-				"file %s was modified during merge - aborting merge (hash: %s vs %s)",
-				localPath,
-				md.FileHash,
-				entry.Metadata.FileHash,
-			)
-		}
-		entry.Metadata = md
-		if err := commit.Add(entry); err != nil {
-			return lib.RevisionId{}, lib.WrapErrorf(err, "failed to add revision entry to commit")
 		}
 		if err := mon.OnEnd(entry); err != nil {
 			return lib.RevisionId{}, lib.WrapErrorf(err, "commit monitor end failed for %s", entry.Path)
 		}
 	}
+	if err := m.keepConflicts(commit, conflicts, remoteRevision); err != nil {
+		return lib.RevisionId{}, err
+	}
 	// Make sure the path prefix exists in the repository after the commit.
 	if err := commit.EnsureDirExists(m.ws.PathPrefix, remoteRevision, m.remoteRevisionId); err != nil {
 		return lib.RevisionId{}, lib.WrapErrorf(
@@ -323,14 +653,225 @@ func (m *Merger) commitLocalChanges( //nolint:funlen
 			m.ws.PathPrefix,
 		)
 	}
-	info := &lib.CommitInfo{Author: author, Message: message}
+	info := &lib.CommitInfo{Author: author, Message: message, StoredBytes: counter.storedBytes}
 	revisionId, err := commit.Commit(ctx, info)
 	if err != nil {
 		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to commit")
 	}
+	slog.Debug("Committed local changes", "revision", revisionId.String())
+	m.journal = nil
+	// A journal that is left behind does no harm, its entries only match
+	// unchanged files whose blocks are in the repository.
+	_ = journal.remove()
 	return revisionId, nil
 }
 
+// Call `mon.OnTotal` with the number of local changes to commit (without the
+// paths in `skip`) and the size of their files.
+func reportCommitTotal(
+	localChanges *lib.Temp[*lib.RevisionEntry],
+	skip map[lib.Path]bool,
+	mon CommitMonitor,
+	buf lib.BlockBuf,
+) error {
+	paths, bytes := 0, int64(0)
+	r := localChanges.Reader(nil)
+	for {
+		entry, err := r.Read(buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to read local changes")
+		}
+		if skip[entry.Path] {
+			continue
+		}
+		paths++
+		if entry.Kind != lib.RevisionEntryKindDelete && entry.Metadata.FileMode.IsRegular() {
+			bytes += entry.Metadata.Size
+		}
+	}
+	mon.OnTotal(paths, bytes)
+	return nil
+}
+
+// keepConflicts adds the repository version of each conflicting file to
+// `commit` under `ConflictPath`. No data is uploaded, the entries refer to the
+// existing blocks.
+func (m *Merger) keepConflicts(
+	commit *lib.Commit,
+	conflicts MergeConflictsError,
+	remoteRevision *lib.TempCache[*lib.RevisionEntry],
+) error {
+	for _, conflict := range conflicts {
+		remoteEntry := conflict.RepositoryEntry
+		if remoteEntry.Kind == lib.RevisionEntryKindDelete || remoteEntry.Metadata.FileMode.IsDir() {
+			continue
+		}
+		path := ConflictPath(m.remoteRevisionId, remoteEntry.Path)
+		if err := commit.EnsureDirExists(path.Dir(), remoteRevision, m.remoteRevisionId); err != nil {
+			return lib.WrapErrorf(err, "failed to ensure directory %s exists in the repository", path.Dir())
+		}
+		entry := &lib.RevisionEntry{
+			Kind:        lib.RevisionEntryKindAdd,
+			Path:        path,
+			Metadata:    remoteEntry.Metadata,
+			RenamedFrom: nil,
+		}
+		if err := commit.Add(entry); err != nil {
+			return lib.WrapErrorf(err, "failed to add conflicting version of %s to commit", remoteEntry.Path)
+		}
+	}
+	return nil
+}
+
+// uploadFirst uploads the local changes included by `MergeOptions.First`
+// ahead of all others.
+// Return the metadata of each uploaded entry to be added to the commit in
+// order later, or nil if the entry did not change at all.
+func (m *Merger) uploadFirst(
+	ctx context.Context,
+	localChanges *lib.Temp[*lib.RevisionEntry],
+	remoteRevision *lib.TempCache[*lib.RevisionEntry],
+	mon CommitMonitor,
+) (map[lib.Path]*lib.PathMetadata, error) {
+	if m.opts.First == nil {
+		return nil, nil
+	}
+	uploaded := map[lib.Path]*lib.PathMetadata{}
+	r := localChanges.Reader(nil)
+	for {
+		entry, err := r.Read(m.blockBuf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to read revision snapshot")
+		}
+		localPath, _ := entry.Path.TrimBase(m.ws.PathPrefix)
+		isDir := entry.Metadata.FileMode.IsDir()
+		if entry.Kind == lib.RevisionEntryKindDelete || isDir || !m.opts.First.Include(localPath, isDir) ||
+			m.skipCommit[entry.Path] {
+			continue
+		}
+		if err := mon.OnStart(entry); err != nil {
+			return nil, lib.WrapErrorf(err, "commit monitor start failed for %s", entry.Path)
+		}
+		md, changed, err := m.uploadLocalChange(ctx, entry, remoteRevision, mon)
+		if err != nil {
+			return nil, err
+		}
+		uploaded[entry.Path] = nil
+		if changed {
+			uploaded[entry.Path] = &md
+		}
+		if err := mon.OnEnd(entry); err != nil {
+			return nil, lib.WrapErrorf(err, "commit monitor end failed for %s", entry.Path)
+		}
+	}
+	return uploaded, nil
+}
+
+// uploadLocalChange adds the blocks of a new or updated `entry` to the
+// repository if they are not there yet.
+// Return `false` if the entry did not change at all compared to the
+// repository.
+func (m *Merger) uploadLocalChange(
+	ctx context.Context,
+	entry *lib.RevisionEntry,
+	remoteRevision *lib.TempCache[*lib.RevisionEntry],
+	mon CommitMonitor,
+) (lib.PathMetadata, bool, error) {
+	localPath, _ := entry.Path.TrimBase(m.ws.PathPrefix)
+	stat, err := m.ws.FS.Stat(localPath.String())
+	if errors.Is(err, fs.ErrNotExist) {
+		// todo: make special errors out of these so we can distinguish them later.
+		return lib.PathMetadata{}, false, lib.Errorf("file %s was deleted during merge - aborting merge", localPath)
+	}
+	if err != nil {
+		return lib.PathMetadata{}, false, lib.WrapErrorf(err, "failed to stat %s", localPath)
+	}
+	remoteEntry, existsInRemote, err := remoteRevision.Get(lib.RevisionEntryPathCompareString(entry))
+	if err != nil {
+		return lib.PathMetadata{}, false, lib.WrapErrorf(
+			err,
+			"failed to get entry from repository snapshot cache for %s",
+			entry.Path,
+		)
+	}
+	var md lib.PathMetadata
+	if existsInRemote && entry.Metadata.FileHash == remoteEntry.Metadata.FileHash {
+		if entry.Metadata.IsEqualRestorableAttributes(remoteEntry.Metadata, m.opts.RestorableMetadataFlag) {
+			// The file did not change at all, we can skip it completely.
+			return lib.PathMetadata{}, false, nil
+		}
+		// Only metadata changed.
+		md = entry.Metadata
+		md.BlockIds = remoteEntry.Metadata.BlockIds
+	} else if uploaded, ok := m.links.uploadedMetadata(&entry.Metadata); ok {
+		// Another hard link to a file that was uploaded by this merge.
+		md = entry.Metadata
+		md.BlockIds = uploaded.BlockIds
+	} else if journaled, ok, err := m.journaledMetadata(ctx, entry, stat); err != nil {
+		return lib.PathMetadata{}, false, err
+	} else if ok {
+		// Uploaded by an interrupted merge.
+		md = journaled
+	} else {
+		uploadedMD, err := AddFileToRepository(ctx, m.ws.FS, localPath, stat, m.repository, entry, mon)
+		if err != nil {
+			return lib.PathMetadata{}, false, lib.WrapErrorf(
+				err,
+				"failed to add blocks and get metadata for %s",
+				localPath,
+			)
+		}
+		md = uploadedMD
+		md.HardLinkGroup = entry.Metadata.HardLinkGroup
+		md.Xattrs = entry.Metadata.Xattrs
+		md.Holes = entry.Metadata.Holes
+		if m.journal != nil && md.FileHash == entry.Metadata.FileHash {
+			if err := m.journal.add(entry.Path, md.FileHash, md.BlockIds); err != nil {
+				return lib.PathMetadata{}, false, err
+			}
+		}
+	}
+	if md.FileHash != entry.Metadata.FileHash {
+		return lib.PathMetadata{}, false, lib.Errorf(
+			"file %s was modified during merge - aborting merge (hash: %s vs %s)",
+			localPath,
+			md.FileHash,
+			entry.Metadata.FileHash,
+		)
+	}
+	m.links.addUploaded(&md)
+	return md, true, nil
+}
+
+// Return the metadata of `entry` with the block ids from the commit journal
+// if an interrupted merge uploaded the file already and it was not touched
+// since it was staged. Return `false` if the file has to be uploaded.
+func (m *Merger) journaledMetadata(
+	ctx context.Context,
+	entry *lib.RevisionEntry,
+	stat fs.FileInfo,
+) (lib.PathMetadata, bool, error) {
+	if m.journal == nil || !stat.Mode().IsRegular() || stat.Size() != entry.Metadata.Size ||
+		lib.NewTimestampFromTime(stat.ModTime()) != entry.Metadata.Mtime {
+		return lib.PathMetadata{}, false, nil
+	}
+	blockIds, ok, err := m.journal.blockIds(ctx, m.repository, entry.Path, entry.Metadata.FileHash)
+	if err != nil || !ok {
+		return lib.PathMetadata{}, false, err
+	}
+	md := lib.NewPathMetadataFromFileInfo(stat, entry.Metadata.FileHash, blockIds)
+	md.HardLinkGroup = entry.Metadata.HardLinkGroup
+	md.Xattrs = entry.Metadata.Xattrs
+	md.Holes = entry.Metadata.Holes
+	return md, true, nil
+}
+
 func (m *Merger) findConflicts(
 	localChanges *lib.Temp[*lib.RevisionEntry],
 	remoteRevisionCache *lib.TempCache[*lib.RevisionEntry],
@@ -380,6 +921,11 @@ func (m *Merger) findConflicts(
 			if localChange.Metadata.IsEqualRestorableAttributes(remoteChange.Metadata, m.opts.RestorableMetadataFlag) {
 				continue
 			}
+			if isSameRename(localChange, remoteChange) {
+				// The file was renamed both locally and in the repository,
+				// only the attributes differ.
+				continue
+			}
 			localChange.Path, _ = localChange.Path.TrimBase(m.ws.PathPrefix)
 			conflicts = append(conflicts, MergeConflict{localChange, remoteChange})
 		}
@@ -387,6 +933,18 @@ func (m *Merger) findConflicts(
 	return conflicts, nil
 }
 
+// isSameRename reports whether `localChange` adds the same file that
+// `remoteChange` added by a rename (see `Mv`).
+func isSameRename(localChange, remoteChange *lib.RevisionEntry) bool {
+	if remoteChange.RenamedFrom == nil ||
+		localChange.Kind != lib.RevisionEntryKindAdd ||
+		remoteChange.Kind != lib.RevisionEntryKindAdd {
+		return false
+	}
+	lmd, rmd := localChange.Metadata, remoteChange.Metadata
+	return lmd.FileMode.AsFsFileMode().Type() == rmd.FileMode.AsFsFileMode().Type() && lmd.FileHash == rmd.FileHash
+}
+
 func (m *Merger) makeDirsWritable(relPath string) error {
 	parent := filepath.Dir(relPath)
 	for parent != "." {
@@ -434,10 +992,15 @@ func (m *Merger) restoreDirFileModes() error {
 }
 
 // Make the workspace look like the remote repository by applying all remote changes (add, update, remove).
+// `wsRevision` is the snapshot of the workspace head that `staging` was
+// compared with. Only the paths that are in it but not in `remoteRevision`
+// are deleted, the workspace is not walked again (see
+// `deleteObsoleteWorkspaceFiles`).
 func (m *Merger) applyRemoteChanges(
 	ctx context.Context,
 	head lib.RevisionId,
 	remoteRevision *lib.TempCache[*lib.RevisionEntry],
+	wsRevision *lib.TempCache[*lib.RevisionEntry],
 	staging *lib.TempCache[*StagingEntry],
 	localChanges *lib.TempCache[*lib.RevisionEntry],
 ) error {
@@ -445,10 +1008,16 @@ func (m *Merger) applyRemoteChanges(
 	if err := hasRemoteChanged(ctx, m.repository, head); err != nil {
 		return err
 	}
+	slog.Debug("Applying remote changes", "workspace_head", m.wsHead.String(), "repository_head", head.String())
 	if err := m.copyRepositoryFiles(ctx, remoteRevision.Source, staging, localChanges); err != nil {
 		return lib.WrapErrorf(err, "failed to copy remote files")
 	}
-	if err := m.deleteObsoleteWorkspaceFiles(remoteRevision, staging, localChanges); err != nil {
+	if err := m.deleteObsoleteWorkspaceFiles(
+		revisionEntryCandidates(wsRevision.Source, m.blockBuf),
+		remoteRevision,
+		staging,
+		localChanges,
+	); err != nil {
 		return lib.WrapErrorf(err, "failed to delete obsolete workspace files")
 	}
 	if err := m.restoreDirFileModes(); err != nil {
@@ -459,18 +1028,124 @@ func (m *Merger) applyRemoteChanges(
 
 // Copy all remote files that are not part of the local changes.
 // If a remote file would be exclude by a .clingignore or .gitignore file, it will
-// not be copied.
-func (m *Merger) copyRepositoryFiles( //nolint:funlen
+// not be copied (unless `Workspace.NoRepoIgnore` is set).
+func (m *Merger) copyRepositoryFiles(
 	ctx context.Context,
 	remoteRevision *lib.Temp[*lib.RevisionEntry],
 	staging *lib.TempCache[*StagingEntry],
 	localChanges *lib.TempCache[*lib.RevisionEntry],
 ) error {
-	r := remoteRevision.Reader(lib.RevisionEntryPathFilter(m.ws.PathPrefix.AsFilter()))
-	ignorePatterns, err := lib.CollectIgnorePatterns(m.ws.FS, ".")
+	ignoreFilter, err := m.ws.ignoreFilter()
 	if err != nil {
-		return lib.WrapErrorf(err, "failed to collect ignore patterns")
+		return err
+	}
+	isIgnoreFile := func(localPath lib.Path, isDir bool) bool {
+		return !isDir && lib.IsIgnoreFileName(localPath.Base().String())
 	}
+	if err := m.reportCopyTotal(remoteRevision, staging, localChanges, ignoreFilter); err != nil {
+		return err
+	}
+	var passes []func(localPath lib.Path, isDir bool) bool
+	if !m.ws.NoRepoIgnore {
+		// Copy the ignore files first, the patterns that come from the
+		// repository apply to the other paths right away.
+		err := m.copyRepositoryFilesPass(ctx, remoteRevision, staging, localChanges, ignoreFilter, isIgnoreFile)
+		if err != nil {
+			return err
+		}
+		if ignoreFilter, err = m.ws.ignoreFilter(); err != nil {
+			return err
+		}
+		passes = append(passes, func(localPath lib.Path, isDir bool) bool {
+			return !isIgnoreFile(localPath, isDir)
+		})
+	} else {
+		passes = append(passes, func(lib.Path, bool) bool { return true })
+	}
+	// With `MergeOptions.First`, the first pass copies all directories and
+	// the paths included by it, the second pass everything else.
+	if first := m.opts.First; first != nil {
+		rest := passes[0]
+		passes = []func(localPath lib.Path, isDir bool) bool{
+			func(localPath lib.Path, isDir bool) bool {
+				return (isDir || first.Include(localPath, isDir)) && rest(localPath, isDir)
+			},
+			func(localPath lib.Path, isDir bool) bool {
+				return !isDir && !first.Include(localPath, isDir) && rest(localPath, isDir)
+			},
+		}
+	}
+	for _, include := range passes {
+		err := m.copyRepositoryFilesPass(ctx, remoteRevision, staging, localChanges, ignoreFilter, include)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Same as `Workspace.scopeFilter`, but also without the paths excluded by
+// `m.pathFilter`.
+func (m *Merger) scopeFilter() lib.PathFilter {
+	if m.pathFilter == nil {
+		return m.ws.scopeFilter()
+	}
+	return allPathFilters(m.ws.scopeFilter(), &relativePathFilter{m.ws.PathPrefix, m.pathFilter})
+}
+
+// Call `CpMonitor.OnTotal` with the number of files `copyRepositoryFiles`
+// is going to restore and their size. Paths that are only un-ignored by
+// ignore files that come from the repository are not counted.
+func (m *Merger) reportCopyTotal(
+	remoteRevision *lib.Temp[*lib.RevisionEntry],
+	staging *lib.TempCache[*StagingEntry],
+	localChanges *lib.TempCache[*lib.RevisionEntry],
+	ignoreFilter lib.PathFilter,
+) error {
+	paths, bytes := 0, int64(0)
+	r := remoteRevision.Reader(lib.RevisionEntryPathFilter(allPathFilters(m.scopeFilter(), ignoreFilter)))
+	for {
+		remoteEntry, err := r.Read(m.blockBuf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to read revision snapshot")
+		}
+		md := remoteEntry.Metadata
+		if !md.FileMode.IsRegular() {
+			continue
+		}
+		key := lib.RevisionEntryPathCompareString(remoteEntry)
+		_, isLocalChange, err := localChanges.Get(key)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to get entry from cache for %s", remoteEntry.Path)
+		}
+		if isLocalChange {
+			continue
+		}
+		stagingEntry, existsInStaging, err := staging.Get(key)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to get entry from cache for %s", remoteEntry.Path)
+		}
+		if !existsInStaging || md.FileHash != stagingEntry.Metadata.FileHash || md.Size != stagingEntry.Metadata.Size {
+			paths++
+			bytes += md.Size
+		}
+	}
+	m.opts.CpMonitor.OnTotal(paths, bytes)
+	return nil
+}
+
+func (m *Merger) copyRepositoryFilesPass( //nolint:funlen
+	ctx context.Context,
+	remoteRevision *lib.Temp[*lib.RevisionEntry],
+	staging *lib.TempCache[*StagingEntry],
+	localChanges *lib.TempCache[*lib.RevisionEntry],
+	ignoreFilter lib.PathFilter,
+	include func(localPath lib.Path, isDir bool) bool,
+) error {
+	r := remoteRevision.Reader(lib.RevisionEntryPathFilter(m.scopeFilter()))
 	for {
 		remoteEntry, err := r.Read(m.blockBuf)
 		if errors.Is(err, io.EOF) {
@@ -486,9 +1161,12 @@ func (m *Merger) copyRepositoryFiles( //nolint:funlen
 			return lib.Errorf("unexpected revision entry type %s for %s", remoteEntry.Kind, remoteEntry.Path)
 		}
 		localPath, _ := remoteEntry.Path.TrimBase(m.ws.PathPrefix)
+		if !include(localPath, remoteEntry.Metadata.FileMode.IsDir()) {
+			continue
+		}
 		targetPath := localPath.String()
 		// A repository entry the workspace ignores must never be materialized.
-		if ignorePatterns.Match(targetPath, remoteEntry.Metadata.FileMode.IsDir()) {
+		if ignoreFilter != nil && !ignoreFilter.Include(remoteEntry.Path, remoteEntry.Metadata.FileMode.IsDir()) {
 			continue
 		}
 		if err := m.makeDirsWritable(targetPath); err != nil {
@@ -547,7 +1225,8 @@ func (m *Merger) copyRepositoryFiles( //nolint:funlen
 			}
 		case md.FileMode.IsDir():
 			if !existsInStaging {
-				if err := m.ws.FS.Mkdir(targetPath); err != nil {
+				// The directory might have been created for an ignore file.
+				if err := m.ws.FS.Mkdir(targetPath); err != nil && !errors.Is(err, fs.ErrExist) {
 					return lib.WrapErrorf(err, "failed to create directory %s", targetPath)
 				}
 			}
@@ -558,6 +1237,8 @@ func (m *Merger) copyRepositoryFiles( //nolint:funlen
 				if err := m.restoreFromRepository(ctx, remoteEntry, m.opts.CpMonitor, targetPath); err != nil {
 					return lib.WrapErrorf(err, "failed to restore %s", targetPath)
 				}
+			} else {
+				m.links.addRestored(&md, targetPath)
 			}
 		}
 		restoreMode := m.opts.RestorableMetadataFlag
@@ -599,107 +1280,135 @@ func removeLocalIfTypeMismatch(targetFS lib.FS, target string, remoteMode lib.Fi
 	return true, nil
 }
 
-// Delete all files in the workspace that are not in the repository and are not local changes.
-// Return an error if the workspace changed during the merge.
+// Call `yield` for each path (and its metadata) that might have to be deleted
+// from the workspace, see `deleteObsoleteWorkspaceFiles`.
+type obsoletePathCandidates func(yield func(repoPath lib.Path, md *lib.PathMetadata) error) error
+
+// All paths of a revision snapshot, i.e. the paths the workspace had at its
+// head revision.
+func revisionEntryCandidates(revision *lib.Temp[*lib.RevisionEntry], buf lib.BlockBuf) obsoletePathCandidates {
+	return func(yield func(lib.Path, *lib.PathMetadata) error) error {
+		r := revision.Reader(nil)
+		for {
+			entry, err := r.Read(buf)
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return lib.WrapErrorf(err, "failed to read revision snapshot")
+			}
+			if err := yield(entry.Path, &entry.Metadata); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// All paths of the staging area, i.e. all paths currently in the workspace.
+func stagingEntryCandidates(staging *lib.Temp[*StagingEntry], buf lib.BlockBuf) obsoletePathCandidates {
+	return func(yield func(lib.Path, *lib.PathMetadata) error) error {
+		r := staging.Reader(nil)
+		for {
+			entry, err := r.Read(buf)
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return lib.WrapErrorf(err, "failed to read staging")
+			}
+			if err := yield(entry.RepoPath, &entry.Metadata); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Delete all `candidates` from the workspace that are not in `remoteRevision`
+// and are not local changes.
+// The merge passes the paths of the workspace head revision, so only paths
+// that were deleted remotely are removed, reset passes the whole staging area,
+// so every path that is not in the target revision is removed.
+// `staging` must have been built during this merge, because it is trusted to
+// reflect the workspace: paths that are not in it are not touched.
+// Return an error if a file to be deleted changed during the merge.
 func (m *Merger) deleteObsoleteWorkspaceFiles( //nolint:funlen
+	candidates obsoletePathCandidates,
 	remoteRevision *lib.TempCache[*lib.RevisionEntry],
 	staging *lib.TempCache[*StagingEntry],
 	localChanges *lib.TempCache[*lib.RevisionEntry],
 ) error {
-	deleteDirs := make(map[string]bool)
-	err := lib.WalkDirIgnore(m.ws.FS, ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return lib.WrapErrorf(err, "failed to walk directory %s", path)
-		}
-		if path == "." {
+	deleteDirs := []string{}
+	err := candidates(func(repoPath lib.Path, md *lib.PathMetadata) error {
+		localPath, ok := repoPath.TrimBase(m.ws.PathPrefix)
+		if !ok || localPath.IsEmpty() {
 			return nil
 		}
-		if filepath.Base(path) == ".cling" {
-			return filepath.SkipDir
+		// An include pattern might match a path below an excluded directory.
+		if m.pathFilter != nil && !m.pathFilter.Include(localPath, md.FileMode.IsDir()) {
+			return nil
 		}
-		fileInfo, err := d.Info()
+		key := lib.PathCompareString(repoPath, md.FileMode.IsDir())
+		_, existsInRemote, err := remoteRevision.Get(key)
 		if err != nil {
-			return lib.WrapErrorf(err, "failed to get file info for %s", path)
+			return lib.WrapErrorf(err, "failed to get entry from repository snapshot cache for %s", localPath)
 		}
-		if !d.Type().IsRegular() && !d.Type().IsDir() && d.Type()&fs.ModeSymlink == 0 {
+		if existsInRemote {
 			return nil
 		}
-		repositoryPath_, err := lib.NewPath(path)
+		_, existsInLocalChanges, err := localChanges.Get(key)
 		if err != nil {
-			return lib.WrapErrorf(err, "failed to create path from %s", path)
+			return lib.WrapErrorf(err, "failed to get entry from local changes cache for %s", localPath)
 		}
-		repositoryPath := m.ws.PathPrefix.Join(repositoryPath_)
-		stagingEntry, existsInStaging, err := staging.Get(lib.PathCompareString(repositoryPath, d.IsDir()))
-		if err != nil {
-			return lib.WrapErrorf(err, "failed to get entry from staging cache for %s", path)
+		if existsInLocalChanges {
+			return nil
 		}
-		_, existsInLocalChanges, err := localChanges.Get(lib.PathCompareString(repositoryPath, d.IsDir()))
+		stagingEntry, existsInStaging, err := staging.Get(key)
 		if err != nil {
-			return lib.WrapErrorf(err, "failed to get entry from local changes cache for %s", path)
+			return lib.WrapErrorf(err, "failed to get entry from staging cache for %s", localPath)
 		}
-		isSymlink := d.Type()&fs.ModeSymlink != 0
-		if existsInStaging && existsInLocalChanges {
-			if !d.IsDir() && !isSymlink &&
-				(stagingEntry.Metadata.MTime() != fileInfo.ModTime() || stagingEntry.Metadata.Size != fileInfo.Size()) {
-				return lib.Errorf(
-					"metadata of file %s was modified during merge (before: mtime=%s size=%d after: mtime=%s size=%d)- aborting merge",
-					path,
-					stagingEntry.Metadata.MTime(),
-					stagingEntry.Metadata.Size,
-					fileInfo.ModTime(),
-					fileInfo.Size(),
-				)
-			}
+		if !existsInStaging {
+			return nil
+		}
+		path := localPath.String()
+		fileInfo, err := m.ws.FS.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+			// Already deleted, or a parent directory was replaced by a file.
 			return nil
 		}
-		remoteEntry, existsInRemote, err := remoteRevision.Get(lib.PathCompareString(repositoryPath, d.IsDir()))
 		if err != nil {
-			return lib.WrapErrorf(err, "failed to get entry from repository snapshot cache for %s", path)
+			return lib.WrapErrorf(err, "failed to stat %s", path)
 		}
-		if existsInRemote {
-			if d.IsDir() || isSymlink {
-				return nil
-			}
-			if remoteEntry.Metadata.Size != fileInfo.Size() {
-				// todo: We should record inode and ctime during staging and compare them here.
-				return lib.Errorf(
-					"file %s was modified during merge - aborting merge (size: %d vs %d)",
-					path,
-					remoteEntry.Metadata.Size,
-					fileInfo.Size(),
-				)
-			}
+		localMode := lib.NewFileMode(fileInfo.Mode())
+		if localMode.IsDir() != md.FileMode.IsDir() || localMode.IsSymlink() != md.FileMode.IsSymlink() {
+			// Replaced by a remote path of another type (see `copyRepositoryFiles`).
 			return nil
 		}
-		if !existsInStaging {
-			return lib.Errorf("file %s was created during merge - aborting merge", path)
+		if localMode.IsDir() {
+			deleteDirs = append(deleteDirs, path)
+			return nil
 		}
-		if d.IsDir() {
-			deleteDirs[path] = true
-		} else {
-			if fileInfo.ModTime() != stagingEntry.Metadata.MTime() || fileInfo.Size() != stagingEntry.Metadata.Size {
-				return lib.Errorf("file %s was modified during merge - aborting merge", path)
-			}
-			if err := m.makeDirsWritable(path); err != nil {
-				return lib.WrapErrorf(err, "failed to make directories writable for %s", path)
-			}
-			if err := m.ws.FS.Remove(path); err != nil {
-				return lib.WrapErrorf(err, "failed to delete %s", path)
-			}
+		if !localMode.IsSymlink() &&
+			(fileInfo.ModTime() != stagingEntry.Metadata.MTime() || fileInfo.Size() != stagingEntry.Metadata.Size) {
+			return lib.Errorf("file %s was modified during merge - aborting merge", path)
+		}
+		if err := m.makeDirsWritable(path); err != nil {
+			return lib.WrapErrorf(err, "failed to make directories writable for %s", path)
+		}
+		if err := m.ws.FS.Remove(path); err != nil {
+			return lib.WrapErrorf(err, "failed to delete %s", path)
 		}
 		return nil
 	})
 	if err != nil {
-		return lib.WrapErrorf(err, "failed to walk directory %s", m.ws.FS)
+		return err
 	}
 	// Delete directories depth-first.
-	dirs := make([]string, 0, len(deleteDirs))
-	for path := range deleteDirs {
-		dirs = append(dirs, path)
-	}
-	slices.Sort(dirs)
-	slices.Reverse(dirs)
-	for _, path := range dirs {
+	slices.Sort(deleteDirs)
+	slices.Reverse(deleteDirs)
+	for _, path := range deleteDirs {
+		if err := m.checkNoUnstagedEntries(path, staging); err != nil {
+			return err
+		}
 		if err := m.makeDirsWritable(path); err != nil {
 			return lib.WrapErrorf(err, "failed to make directories writable for %s", path)
 		}
@@ -710,6 +1419,32 @@ func (m *Merger) deleteObsoleteWorkspaceFiles( //nolint:funlen
 	return nil
 }
 
+// Return an error if the directory `dir` (relative to the workspace) contains
+// a path that is not in `staging`, i.e. a path that was created during the
+// merge and would otherwise make the removal of `dir` fail.
+func (m *Merger) checkNoUnstagedEntries(dir string, staging *lib.TempCache[*StagingEntry]) error {
+	entries, err := m.ws.FS.ReadDir(dir)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to read directory %s", dir)
+	}
+	for _, entry := range entries {
+		path := dir + "/" + entry.Name()
+		localPath, err := lib.NewPath(path)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to create path from %s", path)
+		}
+		key := lib.PathCompareString(m.ws.PathPrefix.Join(localPath), entry.IsDir())
+		_, existsInStaging, err := staging.Get(key)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to get entry from staging cache for %s", path)
+		}
+		if !existsInStaging {
+			return lib.Errorf("file %s was created during merge - aborting merge", path)
+		}
+	}
+	return nil
+}
+
 func (m *Merger) restoreFromRepository( //nolint:funlen
 	ctx context.Context,
 	entry *lib.RevisionEntry,
@@ -741,8 +1476,13 @@ func (m *Merger) restoreFromRepository( //nolint:funlen
 		}
 		return lib.WrapErrorf(err, "failed to create parent directory %s", target)
 	}
-	tmpPath := lib.AtomicWriteTempFilename(target)
-	f, err := m.ws.FS.OpenWrite(tmpPath)
+	if source, ok := m.links.source(&md); ok && replaceWithHardLink(m.ws.FS, source, target) {
+		if err := mon.OnEnd(entry, target); err != nil {
+			return lib.WrapErrorf(err, "cp monitor end failed for %s", target)
+		}
+		return nil
+	}
+	inPlace, err := m.restoreInPlace(ctx, entry, mon, target)
 	if err != nil {
 		if mon.OnError(entry, target, err) == CpOnErrorIgnore {
 			if endErr := mon.OnEnd(entry, target); endErr != nil {
@@ -750,11 +1490,11 @@ func (m *Merger) restoreFromRepository( //nolint:funlen
 			}
 			return nil
 		}
-		return lib.WrapErrorf(err, "failed to open file %s for writing", target)
+		return err
 	}
-	defer f.Close() //nolint:errcheck
-	for _, blockId := range entry.Metadata.BlockIds {
-		data, err := m.repository.ReadBlock(ctx, blockId, m.blockBuf)
+	if !inPlace {
+		tmpPath := lib.AtomicWriteTempFilename(target)
+		f, err := m.ws.FS.OpenWrite(tmpPath)
 		if err != nil {
 			if mon.OnError(entry, target, err) == CpOnErrorIgnore {
 				if endErr := mon.OnEnd(entry, target); endErr != nil {
@@ -762,39 +1502,53 @@ func (m *Merger) restoreFromRepository( //nolint:funlen
 				}
 				return nil
 			}
-			return lib.WrapErrorf(err, "failed to read block %s", blockId)
+			return lib.WrapErrorf(err, "failed to open file %s for writing", target)
+		}
+		f = lib.NewSparseWriter(f, md.Holes)
+		defer f.Close() //nolint:errcheck
+		for _, blockId := range entry.Metadata.BlockIds {
+			data, err := m.repository.ReadBlock(ctx, blockId, m.blockBuf)
+			if err != nil {
+				if mon.OnError(entry, target, err) == CpOnErrorIgnore {
+					if endErr := mon.OnEnd(entry, target); endErr != nil {
+						return lib.WrapErrorf(endErr, "cp monitor end failed for %s", target)
+					}
+					return nil
+				}
+				return lib.WrapErrorf(err, "failed to read block %s", blockId)
+			}
+			if _, err := f.Write(data); err != nil {
+				if mon.OnError(entry, target, err) == CpOnErrorIgnore {
+					if endErr := mon.OnEnd(entry, target); endErr != nil {
+						return lib.WrapErrorf(endErr, "cp monitor end failed for %s", target)
+					}
+					return nil
+				}
+				return lib.WrapErrorf(err, "failed to write block %s", blockId)
+			}
+			if err := mon.OnWrite(entry, target, blockId, data); err != nil {
+				return lib.WrapErrorf(err, "cp monitor write failed for %s", target)
+			}
 		}
-		if _, err := f.Write(data); err != nil {
+		if err := f.Close(); err != nil {
 			if mon.OnError(entry, target, err) == CpOnErrorIgnore {
 				if endErr := mon.OnEnd(entry, target); endErr != nil {
 					return lib.WrapErrorf(endErr, "cp monitor end failed for %s", target)
 				}
 				return nil
 			}
-			return lib.WrapErrorf(err, "failed to write block %s", blockId)
-		}
-		if err := mon.OnWrite(entry, target, blockId, data); err != nil {
-			return lib.WrapErrorf(err, "cp monitor write failed for %s", target)
-		}
-	}
-	if err := f.Close(); err != nil {
-		if mon.OnError(entry, target, err) == CpOnErrorIgnore {
-			if endErr := mon.OnEnd(entry, target); endErr != nil {
-				return lib.WrapErrorf(endErr, "cp monitor end failed for %s", target)
-			}
-			return nil
+			return lib.WrapErrorf(err, "failed to close file %s", target)
 		}
-		return lib.WrapErrorf(err, "failed to close file %s", target)
-	}
-	if err := m.ws.FS.Rename(tmpPath, target); err != nil {
-		_ = m.ws.FS.Remove(tmpPath)
-		if mon.OnError(entry, target, err) == CpOnErrorIgnore {
-			if endErr := mon.OnEnd(entry, target); endErr != nil {
-				return lib.WrapErrorf(endErr, "cp monitor end failed for %s", target)
+		if err := m.ws.FS.Rename(tmpPath, target); err != nil {
+			_ = m.ws.FS.Remove(tmpPath)
+			if mon.OnError(entry, target, err) == CpOnErrorIgnore {
+				if endErr := mon.OnEnd(entry, target); endErr != nil {
+					return lib.WrapErrorf(endErr, "cp monitor end failed for %s", target)
+				}
+				return nil
 			}
-			return nil
+			return lib.WrapErrorf(err, "failed to rename %s to %s", tmpPath, target)
 		}
-		return lib.WrapErrorf(err, "failed to rename %s to %s", tmpPath, target)
 	}
 	if err := m.ws.FS.Chmod(target, md.FileMode.AsFsFileMode()); err != nil {
 		if mon.OnError(entry, target, err) == CpOnErrorIgnore {
@@ -805,14 +1559,22 @@ func (m *Merger) restoreFromRepository( //nolint:funlen
 		}
 		return lib.WrapErrorf(err, "failed to restore file mode %s for %s", md.FileMode, target)
 	}
+	m.links.addRestored(&md, target)
 	if err := mon.OnEnd(entry, target); err != nil {
 		return lib.WrapErrorf(err, "cp monitor end failed for %s", target)
 	}
 	return nil
 }
 
-// Add the file contents to the repository and return the file metadata.
-func AddFileToRepository(
+// Files of at least this size are looked up in and added to the file index
+// of the repository (see `lib.Repository.WriteFileIndex`). Smaller files are
+// not worth the additional round trips (reading the bucket of the file and,
+// on a miss, writing it).
+const fileIndexMinSize = lib.WriteBlocksBatchSize
+
+// Add the file contents to the repository and return the file metadata. The
+// file is split into blocks according to the chunking policy of the repository.
+func AddFileToRepository( //nolint:funlen
 	ctx context.Context,
 	srcFS lib.FS,
 	path lib.Path,
@@ -843,37 +1605,133 @@ func AddFileToRepository(
 			return md, nil
 		}
 	}
-	blockIds := []lib.BlockId{}
-	fileHash := sha256.New()
+	// Files that are already in the repository, e.g. the same photo added on
+	// another machine, are found in the file index. A hit skips chunking,
+	// encrypting and uploading, but the blocks are still downloaded once to
+	// verify them (see `lib.Repository.ReadFileIndex`) and the whole file is
+	// read once to calculate its hash and make sure it did not change since
+	// it was staged.
+	indexed := entry != nil && fileInfo.Size() >= fileIndexMinSize
+	if indexed {
+		blockIds, ok, err := repository.ReadFileIndex(ctx, entry.Metadata.FileHash, fileInfo.Size())
+		if err != nil {
+			return lib.PathMetadata{}, lib.WrapErrorf(err, "failed to look up %s in the file index", path)
+		}
+		if ok {
+			md, err := computeFileHash(srcFS, path, fileInfo)
+			if err != nil {
+				return lib.PathMetadata{}, lib.WrapErrorf(err, "failed to create file metadata")
+			}
+			if md.FileHash == entry.Metadata.FileHash {
+				md.BlockIds = blockIds
+				return md, nil
+			}
+		}
+	}
 	f, err := srcFS.OpenRead(path.String())
 	if err != nil {
 		return lib.PathMetadata{}, lib.WrapErrorf(err, "failed to open file %s", path)
 	}
 	defer f.Close() //nolint:errcheck
-	// Read blocks and add them to the repository.
-	cdc := lib.NewGearCDCWithDefaults(f, repository.GearCDCTable())
-	writeBuf := lib.NewBlockBuf()
+	fileHash, blockIds, err := addBlocksToRepository(ctx, f, repository, entry, mon)
+	if err != nil {
+		return lib.PathMetadata{}, lib.WrapErrorf(err, "failed to add %s", path)
+	}
+	// The index is only a shortcut, the file is committed either way.
+	if indexed {
+		if err := repository.WriteFileIndex(ctx, fileHash, blockIds); err != nil {
+			slog.Warn("Failed to add file to the file index", "path", path.String(), "error", err)
+		}
+	}
+	return lib.NewPathMetadataFromFileInfo(fileInfo, fileHash, blockIds), nil
+}
+
+// Read `r` to the end, split it into blocks according to the chunking policy
+// of the repository and add the blocks to the repository.
+// Return the hash of the content and the block ids.
+func addBlocksToRepository(
+	ctx context.Context,
+	r io.Reader,
+	repository *lib.Repository,
+	entry *lib.RevisionEntry,
+	mon CommitMonitor,
+) (lib.Sha256, []lib.BlockId, error) {
+	blockIds := []lib.BlockId{}
+	fileHash := sha256.New()
+	chunker := repository.NewChunker(r)
+	// The chunks are written in batches of `lib.WriteBlocksBatchSize`.
+	var batch [][]byte
+	batchSize := 0
+	flush := func() error {
+		ids, bytesWritten, err := repository.WriteBlocks(ctx, batch)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to write blocks")
+		}
+		for i, blockId := range ids {
+			if err := mon.OnAddBlock(entry, blockId, len(batch[i]), bytesWritten[i]); err != nil {
+				return lib.WrapErrorf(err, "commit monitor add block failed")
+			}
+		}
+		blockIds = append(blockIds, ids...)
+		batch, batchSize = nil, 0
+		return nil
+	}
 	for {
-		data, err := cdc.Read()
+		data, err := chunker.Read()
 		if errors.Is(err, io.EOF) {
 			break
 		}
 		if err != nil {
-			return lib.PathMetadata{}, lib.WrapErrorf(err, "failed to read file %s", path)
+			return lib.Sha256{}, nil, lib.WrapErrorf(err, "failed to read content")
 		}
 		if _, err := fileHash.Write(data); err != nil {
-			return lib.PathMetadata{}, lib.WrapErrorf(err, "failed to update file hash")
-		}
-		blockId, bytesWritten, err := repository.WriteBlock(ctx, data, writeBuf)
-		if err != nil {
-			return lib.PathMetadata{}, lib.WrapErrorf(err, "failed to write block")
-		}
-		if err := mon.OnAddBlock(entry, blockId, len(data), bytesWritten); err != nil {
-			return lib.PathMetadata{}, lib.WrapErrorf(err, "commit monitor add block failed for %s", path)
+			return lib.Sha256{}, nil, lib.WrapErrorf(err, "failed to update file hash")
+		}
+		// The chunk is only valid until the next read.
+		batch = append(batch, bytes.Clone(data))
+		batchSize += len(data)
+		if batchSize >= lib.WriteBlocksBatchSize {
+			if err := flush(); err != nil {
+				return lib.Sha256{}, nil, err
+			}
 		}
-		blockIds = append(blockIds, blockId)
 	}
-	return lib.NewPathMetadataFromFileInfo(fileInfo, lib.Sha256(fileHash.Sum(nil)), blockIds), nil
+	if err := flush(); err != nil {
+		return lib.Sha256{}, nil, err
+	}
+	return lib.Sha256(fileHash.Sum(nil)), blockIds, nil
+}
+
+// checkWorkspaceHead returns `ErrHeadNotInRepository` if the revision chain
+// of `repository` does not contain the workspace head.
+func checkWorkspaceHead(ctx context.Context, ws *Workspace, repository *lib.Repository) error {
+	wsHead, err := ws.Head(ctx)
+	if err != nil {
+		return err
+	}
+	if wsHead.IsRoot() {
+		return nil
+	}
+	head, err := repository.Head(ctx)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to get repository head")
+	}
+	if head == wsHead {
+		return nil
+	}
+	chain, err := lib.ReadRevisionChain(ctx, repository)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to read repository revision chain")
+	}
+	if !slices.Contains(chain, wsHead) {
+		return lib.WrapErrorKindf(
+			ErrHeadNotInRepository,
+			nil,
+			"workspace head %s is not in the repository's revision chain",
+			wsHead,
+		)
+	}
+	return nil
 }
 
 // Create a `Staging` from `ws.WorkspacePath` and a `lib.RevisionSnapshot` based on the
@@ -911,15 +1769,38 @@ func buildLocalChanges(
 	if err != nil {
 		return wsHead, nil, nil, nil, lib.WrapErrorf(err, "failed to create snapshot tmp dir")
 	}
-	wsRevisionSnapshot, err := lib.NewRevisionSnapshot(ctx, repository, baselineHead, wsSnapshotTmpDir)
+	// Only entries inside the path prefix (and the sparse patterns) that are
+	// not ignored are ever compared against the staging area, so don't bother
+	// reading the rest of the repository.
+	trackedFilter, err := ws.trackedFilter()
+	if err != nil {
+		return wsHead, nil, nil, nil, err
+	}
+	wsRevisionSnapshot, err := lib.NewFilteredRevisionSnapshot(
+		ctx,
+		repository,
+		baselineHead,
+		wsSnapshotTmpDir,
+		trackedFilter,
+	)
 	if err != nil {
 		return wsHead, nil, nil, nil, lib.WrapErrorf(err, "failed to create revision snapshot")
 	}
-	wsRevisionCache, err = lib.NewRevisionEntryTempCache(wsRevisionSnapshot, 10)
+	wsRevisionCache, err = lib.NewRevisionEntryTempCache(wsRevisionSnapshot, opts.tempCacheOptions())
 	if err != nil {
 		return wsHead, nil, nil, nil, lib.WrapErrorf(err, "failed to create revision temp cache")
 	}
-	staging, err := NewStaging(ws.FS, ws.PathPrefix, nil, opts.UseStagingCache, stagingTmpDir, opts.StagingMonitor)
+	staging, err := newWorkspaceStaging(
+		ctx,
+		ws,
+		repository,
+		ws.sparseFilter(),
+		opts.UseStagingCache,
+		opts.RestorableMetadataFlag,
+		opts.WatchJournal,
+		stagingTmpDir,
+		opts.StagingMonitor,
+	)
 	if err != nil {
 		return wsHead, nil, nil, nil, lib.WrapErrorf(err, "failed to detect local changes")
 	}
@@ -927,7 +1808,7 @@ func buildLocalChanges(
 	if err != nil {
 		return wsHead, nil, nil, nil, lib.WrapErrorf(err, "failed to finalize staging temp writer")
 	}
-	stagingCache, err = lib.NewTempCache(finalStaging, StagingCacheKey, 10)
+	stagingCache, err = lib.NewTempCache(finalStaging, StagingCacheKey, opts.tempCacheOptions())
 	if err != nil {
 		return wsHead, nil, nil, nil, lib.WrapErrorf(err, "failed to create staging cache")
 	}
@@ -935,7 +1816,7 @@ func buildLocalChanges(
 	if err != nil {
 		return wsHead, nil, nil, nil, lib.WrapErrorf(err, "failed to merge staging and workspace snapshot")
 	}
-	localChangesCache, err = lib.NewRevisionEntryTempCache(localChanges, 10)
+	localChangesCache, err = lib.NewRevisionEntryTempCache(localChanges, opts.tempCacheOptions())
 	if err != nil {
 		return wsHead, nil, nil, nil, lib.WrapErrorf(err, "failed to create local changes cache")
 	}
@@ -948,6 +1829,7 @@ func buildRemoteChanges(
 	tempFS lib.FS,
 	repository *lib.Repository,
 	head lib.RevisionId,
+	cacheOpts lib.TempCacheOptions,
 ) (remoteRevisionCache *lib.TempCache[*lib.RevisionEntry], err error) {
 	tmp, err := tempFS.MkSub("repository-snapshot")
 	if err != nil {
@@ -957,7 +1839,7 @@ func buildRemoteChanges(
 	if err != nil {
 		return nil, lib.WrapErrorf(err, "failed to create remote revision snapshot")
 	}
-	remoteRevisionCache, err = lib.NewRevisionEntryTempCache(remoteRevisionSnapshot, 10)
+	remoteRevisionCache, err = lib.NewRevisionEntryTempCache(remoteRevisionSnapshot, cacheOpts)
 	if err != nil {
 		return nil, lib.WrapErrorf(err, "failed to create remote revision cache")
 	}
@@ -1,8 +1,12 @@
 package workspace
 
 import (
+	"bytes"
 	"errors"
 	"io/fs"
+	"maps"
+	"slices"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -151,6 +155,64 @@ func TestMerge(t *testing.T) {
 		assert.Equal([]lib.TestFileInfo{}, w2.Ls("."))
 	})
 
+	t.Run("Only remotely deleted paths are deleted", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w2 := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		w.Write("dir/b.txt", "b")
+		w.Write("dir/c.txt", "c")
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		// Ignored files are not part of any revision.
+		w2.Write(".clingignore", "*.log")
+		w2.Write("top.log", "t")
+		w2.Write("dir/x.log", "x")
+		_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+
+		w.Rm("a.txt")
+		w.Rm("dir/b.txt")
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.Equal([]lib.TestFileInfo{
+			{".clingignore", 0o600, 5, "*.log"},
+			{"dir", 0o700 | fs.ModeDir, 0, ""},
+			{"dir/c.txt", 0o600, 1, "c"},
+			{"dir/x.log", 0o600, 1, "x"},
+			{"top.log", 0o600, 1, "t"},
+		}, w2.Ls("."))
+	})
+
+	t.Run("A file created in a remotely deleted directory during merge aborts the merge", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w2 := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("dir/a.txt", "a")
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+
+		w.Rm("dir/a.txt")
+		w.Rm("dir")
+		w.Write("b.txt", "b")
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		opts := wstd.MergeOptions()
+		opts.CpMonitor = writingCpMonitor{wstd.CpMonitor(), func() { w2.Write("dir/new.txt", "new") }}
+		_, err = Merge(t.Context(), w2.Workspace, r.Repository, opts)
+		assert.Error(err, "file dir/new.txt was created during merge - aborting merge")
+	})
+
 	t.Run("Change metadata only", func(t *testing.T) {
 		t.Parallel()
 		assert := lib.NewAssert(t)
@@ -367,6 +429,7 @@ func TestMerge(t *testing.T) {
 
 		// Merging `w2` should detect the conflict.
 		_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+		assert.ErrorIs(err, ErrConflict)
 		assert.Error(err, "MergeConflictsError")
 		conflicts, ok := err.(MergeConflictsError) //nolint:errorlint
 		assert.Equal(true, ok)
@@ -644,10 +707,12 @@ func TestMerge(t *testing.T) {
 		w.Write("c.txt", "c")
 		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
 		assert.Error(err, "is not in the repository's revision chain")
+		assert.ErrorIs(err, ErrHeadNotInRepository)
 
 		opts := ForceCommitOptions{MergeOptions: *wstd.MergeOptions()}
 		_, err = ForceCommit(t.Context(), w.Workspace, r.Repository, &opts)
 		assert.Error(err, "is not in the repository's revision chain")
+		assert.ErrorIs(err, ErrHeadNotInRepository)
 	})
 
 	t.Run("Ignored files and directories are not copied from the repository", func(t *testing.T) {
@@ -703,6 +768,104 @@ func TestMerge(t *testing.T) {
 		}, w2.Ls("."))
 	})
 
+	t.Run("Ignored paths are not deleted from the repository", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w2 := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		w.Write("debug.log", "d")
+		w.Write("build/out.txt", "o")
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+
+		// Ignoring paths that are already in the repository only adds the
+		// ignore file to the next revision.
+		w.Write(".clingignore", "*.log\nbuild/")
+		w.Write("debug.log", "changed")
+		status, err := Status(t.Context(), w.Workspace, r.Repository, wstd.StatusOptions(), td.NewFS(t))
+		assert.NoError(err)
+		assert.Equal([]string{"A .clingignore"}, statusFilesString(status))
+		rev, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.Equal([]lib.TestRevisionEntryInfo{
+			{".clingignore", lib.RevisionEntryKindAdd, 0o600, td.SHA256("*.log\nbuild/")},
+		}, r.RevisionInfos(rev))
+
+		// The ignore file is distributed to the other workspaces, they don't
+		// get the ignored paths.
+		_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.Equal("*.log\nbuild/", w2.Cat(".clingignore"))
+		assert.Equal([]lib.TestFileInfo{
+			{".clingignore", 0o600, 12, "*.log\nbuild/"},
+			{"a.txt", 0o600, 1, "a"},
+		}, w2.Ls("."))
+		_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+		assert.ErrorIs(err, ErrUpToDate)
+
+		// Remote deletes of ignored paths don't touch the workspace.
+		w2.Workspace.NoRepoIgnore = true
+		_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.Equal("d", w2.Cat("debug.log"))
+		w2.Rm("debug.log")
+		_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.Equal("changed", w.Cat("debug.log"))
+	})
+
+	t.Run("Paths that are no longer ignored are fetched", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w2 := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		w.Write("x.log", "x")
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		w2.Write(".clingignore", "*.log")
+		_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.Equal([]lib.TestFileInfo{
+			{".clingignore", 0o600, 5, "*.log"},
+			{"a.txt", 0o600, 1, "a"},
+		}, w2.Ls("."))
+
+		w2.Rm(".clingignore")
+		rev, err := Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.Equal([]lib.TestRevisionEntryInfo{
+			{".clingignore", lib.RevisionEntryKindDelete, 0o600, td.SHA256("*.log")},
+		}, r.RevisionInfos(rev))
+		assert.Equal([]lib.TestFileInfo{
+			{"a.txt", 0o600, 1, "a"},
+			{"x.log", 0o600, 1, "x"},
+		}, w2.Ls("."))
+	})
+
+	t.Run("NoRepoIgnore syncs ignored paths", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write(".clingignore", "*.log")
+		w.Write("a.txt", "a")
+		w.Write("debug.log", "d")
+		w.Workspace.NoRepoIgnore = true
+		rev, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.Equal([]lib.TestRevisionEntryInfo{
+			{".clingignore", lib.RevisionEntryKindAdd, 0o600, td.SHA256("*.log")},
+			{"a.txt", lib.RevisionEntryKindAdd, 0o600, td.SHA256("a")},
+			{"debug.log", lib.RevisionEntryKindAdd, 0o600, td.SHA256("d")},
+		}, r.RevisionInfos(rev))
+	})
+
 	// todo: implement
 	// t.Run("MTime is restored", func(t *testing.T) {
 	// 	// Make sure that mtime is restored even for directories.
@@ -993,6 +1156,51 @@ func TestForceCommit(t *testing.T) {
 		assert.Equal(expectedState, w2.Ls("."))
 	})
 
+	t.Run("Keep conflicts", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w2 := wstd.NewTestWorkspace(t, r.Repository)
+
+		w.Write("a.txt", "a")
+		w.Write("c/d.txt", "d")
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+
+		// Conflicting changes to both files, `b.txt` is no conflict.
+		w.Write("a.txt", "remote a")
+		w.Write("c/d.txt", "remote d")
+		remoteRev, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		w2.Write("a.txt", "local a")
+		w2.Write("b.txt", "b")
+		w2.Write("c/d.txt", "local d")
+
+		opts := ForceCommitOptions{MergeOptions: *wstd.MergeOptions(), KeepConflicts: true}
+		commitRev, err := ForceCommit(t.Context(), w2.Workspace, r.Repository, &opts)
+		assert.NoError(err)
+		conflictsDir := ConflictsDir + "/" + remoteRev.String()
+		expectedState := []lib.TestFileInfo{
+			{"a.txt", 0o600, 7, "local a"},
+			{"b.txt", 0o600, 1, "b"},
+			{"c", 0o700 | fs.ModeDir, 0, ""},
+			{"c/d.txt", 0o600, 7, "local d"},
+			{ConflictsDir, 0o700 | fs.ModeDir, 0, ""},
+			{conflictsDir, 0o700 | fs.ModeDir, 0, ""},
+			{conflictsDir + "/a.txt", 0o600, 8, "remote a"},
+			{conflictsDir + "/c", 0o700 | fs.ModeDir, 0, ""},
+			{conflictsDir + "/c/d.txt", 0o600, 8, "remote d"},
+		}
+		assert.Equal(expectedState, r.RevisionSnapshotFileInfos(commitRev, nil))
+		// Other workspaces receive the overwritten versions.
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.Equal(expectedState, w.Ls("."))
+	})
+
 	t.Run("Workspace with path prefix", func(t *testing.T) {
 		t.Parallel()
 		assert := lib.NewAssert(t)
@@ -1029,7 +1237,7 @@ func TestForceCommit(t *testing.T) {
 			t.Context(),
 			prefixW.Workspace,
 			r.Repository,
-			&ForceCommitOptions{*wstd.MergeOptions()},
+			&ForceCommitOptions{*wstd.MergeOptions(), false},
 		)
 		assert.NoError(err)
 		assert.Equal(r.Head(), commitRev)
@@ -1327,3 +1535,546 @@ func TestMergeSymlinks(t *testing.T) {
 		assert.Equal(linkMtime.UnixNano(), info.ModTime().UnixNano())
 	})
 }
+
+func TestMergeFirst(t *testing.T) {
+	t.Parallel()
+	paths := func(entries []*lib.RevisionEntry) []string {
+		var result []string
+		for _, e := range entries {
+			result = append(result, e.Path.String())
+		}
+		return result
+	}
+	assert := lib.NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	w := wstd.NewTestWorkspace(t, r.Repository)
+	w2 := wstd.NewTestWorkspace(t, r.Repository)
+	w.Write("a.txt", "a")
+	w.Write("b.docx", "b")
+	w.Write("photos/2023/c.jpg", "c")
+	w.Write("photos/2024/d.jpg", "d")
+	w.Write("z.docx", "z")
+	first := lib.NewPathInclusionFilter([]string{"*.docx", "photos/2024/**"})
+
+	commitMon := &TestCommitMonitor{} //nolint:exhaustruct
+	opts := wstd.MergeOptions()
+	opts.CommitMonitor = commitMon
+	opts.First = first
+	head, err := Merge(t.Context(), w.Workspace, r.Repository, opts)
+	assert.NoError(err)
+	assert.Equal([]string{
+		"b.docx", "z.docx", "photos/2024/d.jpg",
+		"a.txt", "photos", "photos/2023", "photos/2023/c.jpg", "photos/2024",
+	}, paths(commitMon.OnStartCalls))
+	assert.Equal([]lib.TestFileInfo{
+		{"a.txt", 0o600, 1, "a"},
+		{"b.docx", 0o600, 1, "b"},
+		{"z.docx", 0o600, 1, "z"},
+		{"photos", 0o700 | fs.ModeDir, 0, ""},
+		{"photos/2023", 0o700 | fs.ModeDir, 0, ""},
+		{"photos/2023/c.jpg", 0o600, 1, "c"},
+		{"photos/2024", 0o700 | fs.ModeDir, 0, ""},
+		{"photos/2024/d.jpg", 0o600, 1, "d"},
+	}, r.RevisionSnapshotFileInfos(head, nil))
+
+	// Directories are always created in the first pass.
+	cpMon := wstd.CpMonitor()
+	opts = wstd.MergeOptions()
+	opts.CpMonitor = cpMon
+	opts.First = first
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, opts)
+	assert.NoError(err)
+	assert.Equal([]string{
+		"b.docx", "z.docx", "photos/2024/d.jpg", "a.txt", "photos/2023/c.jpg",
+	}, paths(cpMon.OnStartCalls))
+	assert.Equal(w.Ls("."), w2.Ls("."))
+}
+
+func TestMergeCommitFilter(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	w := wstd.NewTestWorkspace(t, r.Repository)
+	w2 := wstd.NewTestWorkspace(t, r.Repository)
+	w.Write("a.txt", "a")
+	w.Write("d/a.txt", "da")
+	w.Write("d/b.txt", "db")
+	w.Write("logs/x.log", "x")
+	w.Write("new/dir/c.txt", "c")
+	// `new` is excluded, so its new sub-directories and files are not
+	// committed even if they are included.
+	opts := wstd.MergeOptions()
+	opts.CommitFilter = lib.NewPathExclusionFilter([]string{"logs", "new", "!new/dir/c.txt"})
+	head, err := Merge(t.Context(), w.Workspace, r.Repository, opts)
+	assert.NoError(err)
+	assert.Equal([]lib.TestFileInfo{
+		{"a.txt", 0o600, 1, "a"},
+		{"d", 0o700 | fs.ModeDir, 0, ""},
+		{"d/a.txt", 0o600, 2, "da"},
+		{"d/b.txt", 0o600, 2, "db"},
+	}, r.RevisionSnapshotFileInfos(head, nil))
+	_, err = Merge(t.Context(), w.Workspace, r.Repository, opts)
+	assert.ErrorIs(err, ErrUpToDate)
+
+	// The changes of the repository are merged regardless.
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	w2.Write("logs/x.log", "remote")
+	w2.Write("a.txt", "aa")
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	_, err = Merge(t.Context(), w.Workspace, r.Repository, opts)
+	assert.Error(err, "MergeConflictsError")
+	conflicts, ok := err.(MergeConflictsError) //nolint:errorlint
+	assert.Equal(true, ok)
+	assert.Equal(1, len(conflicts))
+	assert.Equal("logs/x.log", conflicts[0].WorkspaceEntry.Path.String())
+	w.Rm("logs/x.log")
+	w.Rm("logs")
+	_, err = Merge(t.Context(), w.Workspace, r.Repository, opts)
+	assert.NoError(err)
+	assert.Equal("aa", w.Cat("a.txt"))
+	assert.Equal("remote", w.Cat("logs/x.log"))
+
+	// A deleted directory is kept as long as a path below it is excluded.
+	w.RmAll("d")
+	opts.CommitFilter = lib.NewPathExclusionFilter([]string{"new", "d/b.txt"})
+	head, err = Merge(t.Context(), w.Workspace, r.Repository, opts)
+	assert.NoError(err)
+	assert.Equal([]lib.TestFileInfo{
+		{"a.txt", 0o600, 2, "aa"},
+		{"d", 0o700 | fs.ModeDir, 0, ""},
+		{"d/b.txt", 0o600, 2, "db"},
+		{"logs", 0o700 | fs.ModeDir, 0, ""},
+		{"logs/x.log", 0o600, 6, "remote"},
+	}, r.RevisionSnapshotFileInfos(head, nil))
+	_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+}
+
+func TestMergeFixedSizeChunking(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	storage, err := lib.NewFileStorage(td.NewFS(t), lib.StoragePurposeRepository)
+	assert.NoError(err)
+	opts := &lib.RepositoryOptions{Chunking: lib.NewFixedChunkingPolicy(lib.MinChunkSize)}
+	repository, err := lib.InitNewRepositoryWithOptions(t.Context(), storage, []byte("testpassphrase"), opts)
+	assert.NoError(err)
+	w := wstd.NewTestWorkspace(t, repository)
+	content := strings.Repeat("a", lib.MinChunkSize) + strings.Repeat("b", lib.MinChunkSize) + "c"
+	w.Write("a.txt", content)
+	head, err := Merge(t.Context(), w.Workspace, repository, wstd.MergeOptions())
+	assert.NoError(err)
+	files, err := Ls(t.Context(), repository, td.NewFS(t), &LsOptions{head, nil, lib.Path{}})
+	assert.NoError(err)
+	assert.Equal(1, len(files))
+	assert.Equal(3, len(files[0].Metadata.BlockIds))
+	var buf bytes.Buffer
+	err = Cat(t.Context(), repository, &buf, &CatOptions{head, files[0].Path}, td.NewFS(t))
+	assert.NoError(err)
+	assert.Equal(content, buf.String())
+}
+
+func TestMergeReportsTotals(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	w := wstd.NewTestWorkspace(t, r.Repository)
+	w2 := wstd.NewTestWorkspace(t, r.Repository)
+	w.Write("a.txt", "a")
+	w.Write("b/c.txt", "cc")
+	opts := wstd.MergeOptions()
+	_, err := Merge(t.Context(), w.Workspace, r.Repository, opts)
+	assert.NoError(err)
+	commitMonitor := opts.CommitMonitor.(*TestCommitMonitor) //nolint:forcetypeassert
+	assert.Equal(3, commitMonitor.TotalPaths)
+	assert.Equal(int64(3), commitMonitor.TotalBytes)
+	assert.Equal(3, len(commitMonitor.OnStartCalls))
+
+	w2.Write("a.txt", "a")
+	opts = wstd.MergeOptions()
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, opts)
+	assert.NoError(err)
+	cpMonitor := opts.CpMonitor.(*TestCpMonitor) //nolint:forcetypeassert
+	assert.Equal(1, cpMonitor.TotalPaths)
+	assert.Equal(int64(2), cpMonitor.TotalBytes)
+	assert.Equal(1, len(cpMonitor.OnStartCalls))
+
+	cpOpts := wstd.CpOptions(r.Head())
+	err = Cp(t.Context(), r.Repository, td.NewFS(t), cpOpts, td.NewFS(t))
+	assert.NoError(err)
+	cpMonitor = cpOpts.Monitor.(*TestCpMonitor) //nolint:forcetypeassert
+	assert.Equal(3, cpMonitor.TotalPaths)
+	assert.Equal(int64(3), cpMonitor.TotalBytes)
+	assert.Equal(3, len(cpMonitor.OnStartCalls))
+}
+
+func TestMergeMemoryBudget(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	w := wstd.NewTestWorkspace(t, r.Repository)
+	w2 := wstd.NewTestWorkspace(t, r.Repository)
+	w.Write("a.txt", "a")
+	w.Write("b/c.txt", "c")
+	_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+
+	// Even a budget too small for a single chunk is enough for a merge.
+	w2.Write("d.txt", "d")
+	opts := wstd.MergeOptions()
+	opts.MemoryBudget = lib.NewMemoryBudget(1)
+	monitor := testTempCacheMonitor{}
+	opts.CacheMonitor = monitor
+	head, err := Merge(t.Context(), w2.Workspace, r.Repository, opts)
+	assert.NoError(err)
+	assert.Equal(head, w2.Head())
+	assert.Equal([]lib.TestFileInfo{
+		{"a.txt", 0o600, 1, "a"},
+		{"b", 0o700 | fs.ModeDir, 0, ""},
+		{"b/c.txt", 0o600, 1, "c"},
+		{"d.txt", 0o600, 1, "d"},
+	}, w2.Ls("."))
+	assert.Equal(
+		[]string{"local-changes", "remote-revision", "staging", "workspace-revision"},
+		slices.Sorted(maps.Keys(monitor)),
+	)
+	assert.Greater(monitor["remote-revision"].Misses, 0)
+	assert.Equal(1, monitor["remote-revision"].PeakChunks)
+}
+
+func TestMergeHardLinks(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	w := wstd.NewTestWorkspace(t, r.Repository)
+	w2 := wstd.NewTestWorkspace(t, r.Repository)
+	w.Write("a.txt", "abc")
+	w.Link("a.txt", "b/c.txt")
+	w.Write("d.txt", "abc")
+	head, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	groups := map[string]string{}
+	for _, entry := range r.RevisionSnapshot(head, nil) {
+		if entry.Metadata.HasHardLinkGroup() {
+			groups[entry.Path.String()] = entry.Metadata.HardLinkGroup.String()
+		}
+	}
+	assert.Equal(map[string]string{"a.txt": "a.txt", "b/c.txt": "a.txt"}, groups)
+
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	assert.Equal(true, w2.SameFile("a.txt", "b/c.txt"))
+	assert.Equal(false, w2.SameFile("a.txt", "d.txt"))
+	status, err := Status(t.Context(), w2.Workspace, r.Repository, wstd.StatusOptions(), td.NewFS(t))
+	assert.NoError(err)
+	assert.Equal(0, len(status))
+
+	// A new link changes both files.
+	w2.Link("d.txt", "e.txt")
+	status, err = Status(t.Context(), w2.Workspace, r.Repository, wstd.StatusOptions(), td.NewFS(t))
+	assert.NoError(err)
+	assert.Equal([]string{"M d.txt", "A e.txt"}, statusFilesString(status))
+}
+
+func TestMergeXattrs(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	w := wstd.NewTestWorkspace(t, r.Repository)
+	w2 := wstd.NewTestWorkspace(t, r.Repository)
+	tag := &lib.Xattr{Name: "user.tag", Value: "red"}
+	w.Write("a.txt", "abc")
+	w.SetXattrs("a.txt", tag)
+	w.Mkdir("b")
+	w.SetXattrs("b", tag)
+	w.Write("c.txt", "abc")
+	_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+
+	// Without `RestorableMetadataXattrs`, they are neither restored nor
+	// recorded.
+	opts := wstd.MergeOptions()
+	opts.RestorableMetadataFlag ^= lib.RestorableMetadataXattrs
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, opts)
+	assert.NoError(err)
+	assert.Equal(0, len(w2.Xattrs("a.txt")))
+	w2.Write("d.txt", "abc")
+	w2.SetXattrs("d.txt", tag)
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, opts)
+	assert.NoError(err)
+
+	w3 := wstd.NewTestWorkspace(t, r.Repository)
+	_, err = Merge(t.Context(), w3.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	assert.Equal([]*lib.Xattr{tag}, w3.Xattrs("a.txt"))
+	assert.Equal([]*lib.Xattr{tag}, w3.Xattrs("b"))
+	assert.Equal(0, len(w3.Xattrs("c.txt")))
+	assert.Equal(0, len(w3.Xattrs("d.txt")))
+
+	// A change of only the extended attributes is a change with
+	// `RestorableMetadataXattrs`.
+	w.SetXattrs("c.txt", tag)
+	statusOpts := wstd.StatusOptions()
+	status, err := Status(t.Context(), w.Workspace, r.Repository, statusOpts, td.NewFS(t))
+	assert.NoError(err)
+	assert.Equal([]string{"M c.txt"}, statusFilesString(status))
+	statusOpts.RestorableMetadataFlag ^= lib.RestorableMetadataXattrs
+	status, err = Status(t.Context(), w.Workspace, r.Repository, statusOpts, td.NewFS(t))
+	assert.NoError(err)
+	assert.Equal(0, len(status))
+}
+
+func TestMergeSparseFiles(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	w := wstd.NewTestWorkspace(t, r.Repository)
+	const k = 64 * 1024
+	data, err := lib.Rand(4 * k)
+	assert.NoError(err)
+	holes := []*lib.Hole{{Offset: k, Size: k}, {Offset: 3 * k, Size: k}}
+	for _, hole := range holes {
+		clear(data[hole.Offset : hole.Offset+hole.Size])
+	}
+	w.WriteSparse("a.img", data, holes...)
+	revId, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	entries := r.RevisionSnapshot(revId, nil)
+	assert.Equal(1, len(entries))
+	assert.Equal(holes, entries[0].Metadata.Holes)
+
+	// The holes are recreated by `merge` and `cp`.
+	w2 := wstd.NewTestWorkspace(t, r.Repository)
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	assert.Equal(string(data), w2.Cat("a.img"))
+	assert.Equal(holes, w2.Holes("a.img"))
+	out := td.NewTestFS(t, td.NewFS(t))
+	assert.NoError(Cp(t.Context(), r.Repository, out.FS, wstd.CpOptions(revId), td.NewFS(t)))
+	assert.Equal(string(data), out.Cat("a.img"))
+	assert.Equal(holes, out.Holes("a.img"))
+
+	// Holes alone are not a change.
+	stat, err := w.Workspace.FS.Stat("a.img")
+	assert.NoError(err)
+	w.WriteSparse("a.img", data)
+	assert.NoError(w.Workspace.FS.Chmtime("a.img", stat.ModTime()))
+	assert.Equal(0, len(w.Holes("a.img")))
+	status, err := Status(t.Context(), w.Workspace, r.Repository, wstd.StatusOptions(), td.NewFS(t))
+	assert.NoError(err)
+	assert.Equal(0, len(status))
+}
+
+func TestMergeRestoreInPlace(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	w := wstd.NewTestWorkspace(t, r.Repository)
+	w2 := wstd.NewTestWorkspace(t, r.Repository)
+	data, err := lib.Rand(4 * restoreInPlaceMinSize)
+	assert.NoError(err)
+	w.Write("a.img", string(data))
+	w.Write("b.txt", "b")
+	rev1, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	inode := func() uint64 {
+		t.Helper()
+		stat, err := w2.Workspace.FS.Stat("a.img")
+		assert.NoError(err)
+		enhanced, err := lib.EnhancedStat(stat)
+		assert.NoError(err)
+		return enhanced.Inode
+	}
+	before := inode()
+
+	// Only the changed blocks are written.
+	changed := bytes.Clone(data)
+	copy(changed[len(changed)/2:], "changed")
+	w.Write("a.img", string(changed))
+	_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	opts := wstd.MergeOptions()
+	mon := wstd.CpMonitor()
+	opts.CpMonitor = mon
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, opts)
+	assert.NoError(err)
+	assert.Equal(string(changed), w2.Cat("a.img"))
+	assert.Equal(before, inode())
+	blockIds := r.RevisionSnapshot(r.Head(), nil)[0].Metadata.BlockIds
+	assert.Greater(len(blockIds), 2)
+	assert.Greater(len(blockIds), len(mon.OnWriteCalls))
+	assert.Greater(len(mon.OnWriteCalls), 0)
+
+	// The same goes for `reset`.
+	resetOpts := wstd.ResetOptions(rev1, false)
+	mon = wstd.CpMonitorOverwrite()
+	resetOpts.CpMonitor = mon
+	assert.NoError(Reset(t.Context(), w2.Workspace, r.Repository, resetOpts))
+	assert.Equal(string(data), w2.Cat("a.img"))
+	assert.Equal(before, inode())
+	assert.Greater(len(blockIds), len(mon.OnWriteCalls))
+
+	// Files that have little in common with the new version are replaced.
+	other, err := lib.Rand(len(data))
+	assert.NoError(err)
+	w.Write("a.img", string(other))
+	_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	assert.Equal(string(other), w2.Cat("a.img"))
+	assert.NotEqual(before, inode())
+
+	// Sparse files are replaced, so that their holes are recreated.
+	before = inode()
+	sparse := bytes.Clone(other)
+	hole := &lib.Hole{Offset: 0, Size: 64 * 1024}
+	clear(sparse[:hole.Size])
+	w.WriteSparse("a.img", sparse, hole)
+	_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	assert.Equal(string(sparse), w2.Cat("a.img"))
+	assert.Equal([]*lib.Hole{hole}, w2.Holes("a.img"))
+	assert.NotEqual(before, inode())
+}
+
+// A cp monitor that fails after the first block was written.
+type failingWriteCpMonitor struct {
+	*TestCpMonitor
+}
+
+func (m failingWriteCpMonitor) OnWrite(
+	entry *lib.RevisionEntry,
+	targetPath string,
+	blockId lib.BlockId,
+	data []byte,
+) error {
+	return lib.Errorf("interrupted")
+}
+
+// A cp monitor that calls `write` after each copied path.
+type writingCpMonitor struct {
+	*TestCpMonitor
+	write func()
+}
+
+func (m writingCpMonitor) OnEnd(entry *lib.RevisionEntry, targetPath string) error {
+	m.write()
+	return m.TestCpMonitor.OnEnd(entry, targetPath)
+}
+
+func TestMergeRestoreInPlaceInterrupted(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	w := wstd.NewTestWorkspace(t, r.Repository)
+	w2 := wstd.NewTestWorkspace(t, r.Repository)
+	data, err := lib.Rand(4 * restoreInPlaceMinSize)
+	assert.NoError(err)
+	w.Write("a.img", string(data))
+	rev1, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	changed := bytes.Clone(data)
+	copy(changed, "changed")
+	copy(changed[len(changed)/2:], "changed")
+	w.Write("a.img", string(changed))
+	revChanged, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+
+	opts := wstd.MergeOptions()
+	opts.CpMonitor = failingWriteCpMonitor{wstd.CpMonitor()}
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, opts)
+	assert.Error(err, "interrupted")
+	current := w2.Cat("a.img")
+	assert.NotEqual(string(data), current)
+	assert.NotEqual(string(changed), current)
+	_, err = w2.Workspace.FS.Stat(restoreJournalPath)
+	assert.NoError(err)
+
+	// The next merge puts the old version back before it looks for local
+	// changes, so the half-written file is never committed.
+	head, err := Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	assert.Equal(revChanged, head)
+	assert.Equal(revChanged, r.Head())
+	assert.Equal(string(changed), w2.Cat("a.img"))
+	_, err = w2.Workspace.FS.Stat(restoreJournalPath)
+	assert.ErrorIs(err, fs.ErrNotExist)
+
+	// The same goes for `reset`.
+	resetOpts := wstd.ResetOptions(rev1, false)
+	resetOpts.CpMonitor = failingWriteCpMonitor{wstd.CpMonitorOverwrite()}
+	assert.Error(Reset(t.Context(), w2.Workspace, r.Repository, resetOpts), "interrupted")
+	assert.NotEqual(string(changed), w2.Cat("a.img"))
+	status, err := Status(t.Context(), w2.Workspace, r.Repository, wstd.StatusOptions(), td.NewFS(t))
+	assert.NoError(err)
+	assert.Equal(1, len(status))
+	assert.NoError(Reset(t.Context(), w2.Workspace, r.Repository, wstd.ResetOptions(rev1, false)))
+	assert.Equal(string(data), w2.Cat("a.img"))
+}
+
+func TestWorkspaceHeadEntry(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	w := wstd.NewTestWorkspace(t, r.Repository)
+	w.Write("a[1].img", "a")
+	w.Write("a1.img", "b")
+	_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+
+	// The path is not a glob pattern.
+	entry, err := workspaceHeadEntry(t.Context(), w.Workspace, r.Repository, td.Path("a[1].img"))
+	assert.NoError(err)
+	assert.NotNil(entry)
+	assert.Equal(td.Path("a[1].img"), entry.Path)
+	entry, err = workspaceHeadEntry(t.Context(), w.Workspace, r.Repository, td.Path("missing.img"))
+	assert.NoError(err)
+	assert.Nil(entry)
+}
+
+type testTempCacheMonitor map[string]lib.TempCacheStats
+
+func (m testTempCacheMonitor) OnTempCacheStats(name string, stats lib.TempCacheStats) {
+	m[name] = stats
+}
+
+func TestMergeFileIndex(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	w := wstd.NewTestWorkspace(t, r.Repository)
+	w2 := wstd.NewTestWorkspace(t, r.Repository)
+	data, err := lib.Rand(2 * fileIndexMinSize)
+	assert.NoError(err)
+	w.Write("a.jpg", string(data))
+	opts := wstd.MergeOptions()
+	mon := wstd.CommitMonitor()
+	opts.CommitMonitor = mon
+	_, err = Merge(t.Context(), w.Workspace, r.Repository, opts)
+	assert.NoError(err)
+	blockIds := r.RevisionSnapshot(r.Head(), nil)[0].Metadata.BlockIds
+	assert.Equal(blockIds, mon.OnAddBlockCalls)
+
+	// The same file in another workspace is not split into blocks again.
+	w2.Write("copy.jpg", string(data))
+	opts = wstd.MergeOptions()
+	mon = wstd.CommitMonitor()
+	opts.CommitMonitor = mon
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, opts)
+	assert.NoError(err)
+	assert.Equal(0, len(mon.OnAddBlockCalls))
+	snapshot := r.RevisionSnapshot(r.Head(), nil)
+	assert.Equal(2, len(snapshot))
+	assert.Equal(blockIds, snapshot[1].Metadata.BlockIds)
+	_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	assert.Equal(string(data), w.Cat("copy.jpg"))
+}
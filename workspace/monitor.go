@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/fs"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -57,6 +58,9 @@ type DefaultCommitMonitor struct {
 	RawBytesAdded        int64
 	CompressedBytesAdded int64
 	RawBytesReused       int64
+	// Set by `OnTotal`, zero if unknown.
+	TotalPaths int
+	TotalBytes int64
 }
 
 func NewDefaultCommitMonitor(
@@ -71,9 +75,16 @@ func NewDefaultCommitMonitor(
 		RawBytesAdded:        0,
 		CompressedBytesAdded: 0,
 		RawBytesReused:       0,
+		TotalPaths:           0,
+		TotalBytes:           0,
 	}
 }
 
+func (m *DefaultCommitMonitor) OnTotal(paths int, bytes int64) {
+	m.TotalPaths += paths
+	m.TotalBytes += bytes
+}
+
 func (m *DefaultCommitMonitor) OnBeforeCommit() error {
 	if err := m.cancel(); err != nil {
 		return err
@@ -84,6 +95,22 @@ func (m *DefaultCommitMonitor) OnBeforeCommit() error {
 	return nil
 }
 
+// OnTempCacheStats reports how well the caches of a merge did (see
+// `MergeOptions.CacheMonitor`). Only shown in verbose mode.
+func (m *DefaultCommitMonitor) OnTempCacheStats(name string, stats lib.TempCacheStats) {
+	if m.Mode != DefaultMonitorModeVerbose {
+		return
+	}
+	m.emit(fmt.Sprintf(
+		"  cache  %s: %d hits, %d misses, %d evictions, %d chunks at most",
+		name,
+		stats.Hits,
+		stats.Misses,
+		stats.Evictions,
+		stats.PeakChunks,
+	))
+}
+
 func (m *DefaultCommitMonitor) OnStart(entry *lib.RevisionEntry) error {
 	if err := m.cancel(); err != nil {
 		return err
@@ -172,20 +199,52 @@ func (m *DefaultCommitMonitor) emitProgress() {
 	}
 	m.emit(
 		fmt.Sprintf(
-			"adding %d paths (%s at %s/s)",
-			m.Paths,
+			"adding %s paths (%s at %s/s)",
+			formatCount(m.Paths, m.TotalPaths),
 			FormatBytes(m.RawBytesAdded),
 			FormatBytes(int64(float64(m.RawBytesAdded)/elapsed)),
 		),
 	)
 }
 
+// Return "count/total", or just "count" if the total is unknown.
+func formatCount(count, total int) string {
+	if total <= 0 {
+		return strconv.Itoa(count)
+	}
+	return fmt.Sprintf("%d/%d", count, total)
+}
+
+// What `DefaultStagingMonitor` does with sockets, FIFOs, and device nodes.
+type UnsupportedFilePolicy int
+
+const (
+	UnsupportedFileWarn UnsupportedFilePolicy = iota
+	UnsupportedFileSkip
+	UnsupportedFileFail
+)
+
+func ParseUnsupportedFilePolicy(s string) (UnsupportedFilePolicy, error) {
+	switch s {
+	case "warn":
+		return UnsupportedFileWarn, nil
+	case "skip":
+		return UnsupportedFileSkip, nil
+	case "fail":
+		return UnsupportedFileFail, nil
+	default:
+		return 0, lib.Errorf("invalid unsupported file policy %q, expected `skip`, `warn`, or `fail`", s)
+	}
+}
+
 type DefaultStagingMonitor struct {
 	defaultMonitorBase
-	StartTime      time.Time
-	Paths          int
-	Excluded       int
-	TotalFileSizes int64
+	UnsupportedFilePolicy UnsupportedFilePolicy
+	StartTime             time.Time
+	Paths                 int
+	Excluded              int
+	Unsupported           int
+	TotalFileSizes        int64
 }
 
 func NewDefaultStagingMonitor(
@@ -194,11 +253,13 @@ func NewDefaultStagingMonitor(
 	emit MonitorEmit,
 ) *DefaultStagingMonitor {
 	return &DefaultStagingMonitor{
-		defaultMonitorBase: newDefaultMonitorBase(mode, cancel, emit),
-		StartTime:          time.Time{},
-		Paths:              0,
-		Excluded:           0,
-		TotalFileSizes:     0,
+		defaultMonitorBase:    newDefaultMonitorBase(mode, cancel, emit),
+		UnsupportedFilePolicy: UnsupportedFileWarn,
+		StartTime:             time.Time{},
+		Paths:                 0,
+		Excluded:              0,
+		Unsupported:           0,
+		TotalFileSizes:        0,
 	}
 }
 
@@ -245,6 +306,46 @@ func (m *DefaultStagingMonitor) OnEnd(path lib.Path, excluded bool, metadata *li
 	return nil
 }
 
+func (m *DefaultStagingMonitor) OnUnsupported(path lib.Path, dirEntry fs.DirEntry) error {
+	if err := m.cancel(); err != nil {
+		return err
+	}
+	m.Unsupported++
+	switch m.UnsupportedFilePolicy {
+	case UnsupportedFileFail:
+		return lib.WrapErrorf(ErrUnsupportedFileType, "%s (%s)", path, fileTypeName(dirEntry.Type()))
+	case UnsupportedFileWarn:
+		m.emit(fmt.Sprintf("%s\n  skipped, unsupported file type (%s)", path, fileTypeName(dirEntry.Type())))
+	case UnsupportedFileSkip:
+	}
+	m.emitProgress()
+	return nil
+}
+
+// UnsupportedSummary returns a line about the skipped unsupported files or
+// an empty string if there were none or the policy is to skip them silently.
+func (m *DefaultStagingMonitor) UnsupportedSummary() string {
+	if m.Unsupported == 0 || m.UnsupportedFilePolicy == UnsupportedFileSkip {
+		return ""
+	}
+	return fmt.Sprintf("%d unsupported files (sockets, FIFOs, or devices) were not archived", m.Unsupported)
+}
+
+func fileTypeName(mode fs.FileMode) string {
+	switch {
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	case mode&fs.ModeNamedPipe != 0:
+		return "FIFO"
+	case mode&fs.ModeCharDevice != 0:
+		return "character device"
+	case mode&fs.ModeDevice != 0:
+		return "block device"
+	default:
+		return "irregular file"
+	}
+}
+
 func (m *DefaultStagingMonitor) emitProgress() {
 	if m.Mode != DefaultMonitorModeProgress || m.StartTime.IsZero() {
 		return
@@ -257,6 +358,9 @@ func (m *DefaultStagingMonitor) emitProgress() {
 	if m.Excluded > 0 {
 		text += fmt.Sprintf(" (%d excluded)", m.Excluded)
 	}
+	if m.Unsupported > 0 {
+		text += fmt.Sprintf(" (%d unsupported)", m.Unsupported)
+	}
 	text += fmt.Sprintf(
 		" (%s at %s/s)",
 		FormatBytes(m.TotalFileSizes),
@@ -274,6 +378,11 @@ type DefaultCpMonitor struct {
 	Excluded     int
 	BytesWritten int64
 	Errors       int
+	// Existing paths that were left alone (`CpOnExistsIgnore`).
+	Skipped int
+	// Set by `OnTotal`, zero if unknown.
+	TotalPaths int
+	TotalBytes int64
 }
 
 func NewDefaultCpMonitor(
@@ -292,9 +401,17 @@ func NewDefaultCpMonitor(
 		Excluded:           0,
 		BytesWritten:       0,
 		Errors:             0,
+		Skipped:            0,
+		TotalPaths:         0,
+		TotalBytes:         0,
 	}
 }
 
+func (m *DefaultCpMonitor) OnTotal(paths int, bytes int64) {
+	m.TotalPaths += paths
+	m.TotalBytes += bytes
+}
+
 func (m *DefaultCpMonitor) OnStart(entry *lib.RevisionEntry, targetPath string) error {
 	if err := m.cancel(); err != nil {
 		return err
@@ -311,8 +428,11 @@ func (m *DefaultCpMonitor) OnStart(entry *lib.RevisionEntry, targetPath string)
 }
 
 func (m *DefaultCpMonitor) OnExists(entry *lib.RevisionEntry, targetPath string) CpOnExists {
-	if m.Mode == DefaultMonitorModeVerbose && m.cpOnExists == CpOnExistsIgnore {
-		m.emit("  skipping existing")
+	if m.cpOnExists == CpOnExistsIgnore {
+		m.Skipped++
+		if m.Mode == DefaultMonitorModeVerbose {
+			m.emit("  skipping existing")
+		}
 	}
 	return m.cpOnExists
 }
@@ -374,7 +494,7 @@ func (m *DefaultCpMonitor) emitProgress() {
 	if elapsed <= 0 {
 		elapsed = 1
 	}
-	text := fmt.Sprintf("%d files copied", m.Paths-m.Excluded)
+	text := formatCount(m.Paths-m.Excluded, m.TotalPaths) + " files copied"
 	if m.Excluded > 0 {
 		text += fmt.Sprintf(" (+ %d excluded)", m.Excluded)
 	}
@@ -398,6 +518,10 @@ type DefaultHealthCheckMonitor struct {
 	Blocks         int
 	BlockBytes     int64
 	OrphanedBlocks []lib.BlockId
+	// Corrupt or missing blocks in the lost-found section.
+	QuarantinedBlocks []lib.BlockId
+	// The changes made with `check --repair`.
+	Repairs []string
 }
 
 func NewDefaultHealthCheckMonitor(mode DefaultMonitorMode, emit MonitorEmit) *DefaultHealthCheckMonitor {
@@ -410,6 +534,8 @@ func NewDefaultHealthCheckMonitor(mode DefaultMonitorMode, emit MonitorEmit) *De
 		Blocks:             0,
 		BlockBytes:         0,
 		OrphanedBlocks:     nil,
+		QuarantinedBlocks:  nil,
+		Repairs:            nil,
 	}
 }
 
@@ -449,6 +575,20 @@ func (m *DefaultHealthCheckMonitor) OnOrphanedBlock(blockID lib.BlockId) {
 	}
 }
 
+func (m *DefaultHealthCheckMonitor) OnQuarantinedBlock(blockID lib.BlockId) {
+	m.QuarantinedBlocks = append(m.QuarantinedBlocks, blockID)
+	if m.Mode == DefaultMonitorModeVerbose {
+		m.emit("  lost     " + blockID.String())
+	}
+}
+
+func (m *DefaultHealthCheckMonitor) OnRepair(description string) {
+	m.Repairs = append(m.Repairs, description)
+	if m.Mode == DefaultMonitorModeVerbose {
+		m.emit("repair   " + description)
+	}
+}
+
 func (m *DefaultHealthCheckMonitor) Finish() {
 	m.EndTime = time.Now()
 }
@@ -481,6 +621,7 @@ func (m *DefaultHealthCheckMonitor) Report(
 	fmt.Fprintf(&b, "  [ok] metadata blocks are readable\n")
 	fmt.Fprintf(&b, "  [ok] paths in each revision are sorted\n")
 	fmt.Fprintf(&b, "  [%s] data blocks are valid\n", check(checkedBlocks))
+	fmt.Fprintf(&b, "  [%s] file contents match their size and hash\n", check(checkedBlocks))
 	orphanLine := "--"
 	if checkedOrphanedBlocks {
 		if len(m.OrphanedBlocks) > 0 {
@@ -490,6 +631,17 @@ func (m *DefaultHealthCheckMonitor) Report(
 		}
 	}
 	fmt.Fprintf(&b, "  [%s] no orphaned blocks in storage\n", orphanLine)
+	quarantineLine := "ok"
+	if len(m.QuarantinedBlocks) > 0 {
+		quarantineLine = "!!"
+	}
+	fmt.Fprintf(&b, "  [%s] no quarantined (corrupt or missing) blocks\n", quarantineLine)
+	if len(m.Repairs) > 0 {
+		fmt.Fprintf(&b, "\nRepairs:\n")
+		for _, repair := range m.Repairs {
+			fmt.Fprintf(&b, "  %s\n", repair)
+		}
+	}
 	fmt.Fprintf(&b, "\nStatistics:\n")
 	fmt.Fprintf(&b, "  %d revisions\n", m.Revisions)
 	fmt.Fprintf(&b, "  %d path entries in all revisions\n", m.Paths)
@@ -508,6 +660,11 @@ func (m *DefaultHealthCheckMonitor) Report(
 			fmt.Fprint(&b, "        yet referenced by a revision. Re-run after it completes.\n")
 		}
 	}
+	if len(m.QuarantinedBlocks) > 0 {
+		fmt.Fprintf(&b, "  %d quarantined blocks\n", len(m.QuarantinedBlocks))
+		fmt.Fprint(&b, "  Note: files with quarantined blocks cannot be restored from the\n")
+		fmt.Fprint(&b, "        affected revisions.\n")
+	}
 	fmt.Fprintf(&b, "\nTiming:\n")
 	fmt.Fprintf(&b, "  start    %s\n", m.StartTime.Format(time.RFC3339))
 	fmt.Fprintf(&b, "  end      %s\n", m.EndTime.Format(time.RFC3339))
@@ -567,6 +724,71 @@ func (m *DefaultHealthCheckMonitor) emitProgress() {
 	)
 }
 
+type DefaultScrubMonitor struct {
+	defaultMonitorBase
+	StartTime     time.Time
+	Sample        int
+	Blocks        int
+	BlockBytes    int64
+	CorruptBlocks []lib.BlockId
+}
+
+func NewDefaultScrubMonitor(mode DefaultMonitorMode, emit MonitorEmit) *DefaultScrubMonitor {
+	return &DefaultScrubMonitor{
+		defaultMonitorBase: newDefaultMonitorBase(mode, nil, emit),
+		StartTime:          time.Time{},
+		Sample:             0,
+		Blocks:             0,
+		BlockBytes:         0,
+		CorruptBlocks:      nil,
+	}
+}
+
+func (m *DefaultScrubMonitor) OnScrubStart(blocks, sample int) {
+	m.StartTime = time.Now()
+	m.Sample = sample
+	if m.Mode == DefaultMonitorModeVerbose {
+		m.emit(fmt.Sprintf("verifying %d of %d blocks", sample, blocks))
+	}
+}
+
+func (m *DefaultScrubMonitor) OnBlockVerified(blockID lib.BlockId, length int) {
+	m.Blocks++
+	m.BlockBytes += int64(length)
+	m.emitProgress()
+	if m.Mode == DefaultMonitorModeVerbose {
+		m.emit("  block    " + blockID.String())
+	}
+}
+
+func (m *DefaultScrubMonitor) OnCorruptBlock(blockID lib.BlockId, err error) {
+	m.Blocks++
+	m.CorruptBlocks = append(m.CorruptBlocks, blockID)
+	if m.Mode != DefaultMonitorModeSilent {
+		m.emit(fmt.Sprintf("  corrupt  %s: %s", blockID, err))
+	}
+}
+
+func (m *DefaultScrubMonitor) emitProgress() {
+	if m.Mode != DefaultMonitorModeProgress {
+		return
+	}
+	elapsed := time.Since(m.StartTime).Seconds()
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+	m.emit(
+		fmt.Sprintf(
+			"%d/%d blocks verified, %d corrupt, %s at %s/s",
+			m.Blocks,
+			m.Sample,
+			len(m.CorruptBlocks),
+			FormatBytes(m.BlockBytes),
+			FormatBytes(int64(float64(m.BlockBytes)/elapsed)),
+		),
+	)
+}
+
 type DefaultSyncRepoMonitor struct {
 	defaultMonitorBase
 	TargetName string
@@ -656,3 +878,127 @@ func (m *DefaultSyncRepoMonitor) emitProgress() {
 func (m *DefaultSyncRepoMonitor) emitWithTargetPrefix(text string) {
 	m.emit(m.TargetName + ": " + text)
 }
+
+type DefaultReplicationMonitor struct {
+	defaultMonitorBase
+	StartTime    time.Time
+	SrcBlocks    int
+	DstBlocks    int
+	Blocks       int
+	Bytes        int64
+	ControlFiles int
+}
+
+func NewDefaultReplicationMonitor(mode DefaultMonitorMode, emit MonitorEmit) *DefaultReplicationMonitor {
+	return &DefaultReplicationMonitor{
+		defaultMonitorBase: newDefaultMonitorBase(mode, nil, emit),
+		StartTime:          time.Time{},
+		SrcBlocks:          0,
+		DstBlocks:          0,
+		Blocks:             0,
+		Bytes:              0,
+		ControlFiles:       0,
+	}
+}
+
+func (m *DefaultReplicationMonitor) OnSrcBlockIdsRead(blocksTotal int) {
+	if m.Mode != DefaultMonitorModeProgress {
+		return
+	}
+	m.emit(fmt.Sprintf("read %d source blocks", blocksTotal))
+}
+
+func (m *DefaultReplicationMonitor) OnDstBlockIdsRead(blocksTotal int) {
+	if m.Mode != DefaultMonitorModeProgress {
+		return
+	}
+	m.emit(fmt.Sprintf("read %d target blocks", blocksTotal))
+}
+
+func (m *DefaultReplicationMonitor) OnBeforeCopy(srcBlocks, dstBlocks int) {
+	m.StartTime = time.Now()
+	m.SrcBlocks = srcBlocks
+	m.DstBlocks = dstBlocks
+	if m.Mode == DefaultMonitorModeSilent {
+		return
+	}
+	m.emit(fmt.Sprintf("source has %d blocks, target has %d", srcBlocks, dstBlocks))
+}
+
+func (m *DefaultReplicationMonitor) OnCopyBlock(blockID lib.BlockId, length int) {
+	m.Blocks++
+	m.Bytes += int64(length)
+	m.emitProgress()
+	if m.Mode == DefaultMonitorModeVerbose {
+		m.emit("  block    " + blockID.String())
+	}
+}
+
+func (m *DefaultReplicationMonitor) OnCopyControlFile(section lib.ControlFileSection, name string) {
+	m.ControlFiles++
+	if m.Mode == DefaultMonitorModeVerbose {
+		m.emit(fmt.Sprintf("  control  %s/%s", section, name))
+	}
+}
+
+func (m *DefaultReplicationMonitor) emitProgress() {
+	if m.Mode != DefaultMonitorModeProgress || m.StartTime.IsZero() {
+		return
+	}
+	elapsed := time.Since(m.StartTime).Seconds()
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+	m.emit(
+		fmt.Sprintf(
+			"%d/%d blocks copied, %s at %s/s",
+			m.Blocks,
+			max(m.SrcBlocks-m.DstBlocks, m.Blocks),
+			FormatBytes(m.Bytes),
+			FormatBytes(int64(float64(m.Bytes)/elapsed)),
+		),
+	)
+}
+
+type DefaultPackMonitor struct {
+	defaultMonitorBase
+	StartTime time.Time
+	Packs     int
+	Blocks    int
+	Bytes     int64
+}
+
+func NewDefaultPackMonitor(mode DefaultMonitorMode, emit MonitorEmit) *DefaultPackMonitor {
+	return &DefaultPackMonitor{
+		defaultMonitorBase: newDefaultMonitorBase(mode, nil, emit),
+		StartTime:          time.Now(),
+		Packs:              0,
+		Blocks:             0,
+		Bytes:              0,
+	}
+}
+
+func (m *DefaultPackMonitor) OnPackWritten(packId string, blocks int, bytes int64) {
+	m.Packs++
+	m.Blocks += blocks
+	m.Bytes += bytes
+	if m.Mode == DefaultMonitorModeVerbose {
+		m.emit(fmt.Sprintf("  pack     %s: %d blocks, %s", packId, blocks, FormatBytes(bytes)))
+	}
+	if m.Mode != DefaultMonitorModeProgress {
+		return
+	}
+	elapsed := time.Since(m.StartTime).Seconds()
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+	m.emit(
+		fmt.Sprintf(
+			"%d packs, %d blocks, %s at %s/s",
+			m.Packs,
+			m.Blocks,
+			FormatBytes(m.Bytes),
+			FormatBytes(int64(float64(m.Bytes)/elapsed)),
+		),
+	)
+}
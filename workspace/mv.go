@@ -0,0 +1,144 @@
+package workspace
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+var (
+	ErrMvSourceNotFound = lib.Errorf("source does not exist")
+	ErrMvTargetExists   = lib.Errorf("target already exists")
+)
+
+type MvOptions struct {
+	// Both paths are relative to `PathPrefix`.
+	Source     lib.Path
+	Target     lib.Path
+	PathPrefix lib.Path
+	Author     string
+	Message    string
+}
+
+// Mv commits a new revision that renames `opts.Source` to `opts.Target`.
+// If `opts.Source` is a directory, everything below it is moved, too.
+// Renames are recorded as a delete of the old path and an add of the new
+// path with `RenamedFrom` set, so that `Log` and `Merge` can tell a rename
+// from an unrelated delete and add.
+// Missing parent directories of `opts.Target` are created.
+// Return the renamed paths (relative to `opts.PathPrefix`) and the new
+// revision id.
+func Mv( //nolint:funlen
+	ctx context.Context,
+	repository *lib.Repository,
+	opts *MvOptions,
+	tmpFS lib.FS,
+) (StatusFiles, lib.RevisionId, error) {
+	if opts.Source.IsEmpty() || opts.Target.IsEmpty() {
+		return nil, lib.RevisionId{}, lib.Errorf("source and target must not be empty")
+	}
+	source := opts.PathPrefix.Join(opts.Source)
+	target := opts.PathPrefix.Join(opts.Target)
+	if source == target || target.IsRelativeTo(source) {
+		return nil, lib.RevisionId{}, lib.Errorf("cannot move %s into itself", opts.Source)
+	}
+	commitFS, err := tmpFS.MkSub("commit")
+	if err != nil {
+		return nil, lib.RevisionId{}, lib.WrapErrorf(err, "failed to create commit tmp dir")
+	}
+	commit, err := lib.NewCommit(ctx, repository, commitFS)
+	if err != nil {
+		return nil, lib.RevisionId{}, lib.WrapErrorf(err, "failed to create commit")
+	}
+	snapshotFS, err := tmpFS.MkSub("snapshot")
+	if err != nil {
+		return nil, lib.RevisionId{}, lib.WrapErrorf(err, "failed to create snapshot tmp dir")
+	}
+	snapshot, err := lib.NewFilteredRevisionSnapshot(
+		ctx,
+		repository,
+		commit.BaseRevision,
+		snapshotFS,
+		opts.PathPrefix.AsFilter(),
+	)
+	if err != nil {
+		return nil, lib.RevisionId{}, lib.WrapErrorf(err, "failed to create revision snapshot")
+	}
+	defer snapshot.Remove() //nolint:errcheck
+	cache, err := lib.NewRevisionEntryTempCache(snapshot, lib.TempCacheOptions{})
+	if err != nil {
+		return nil, lib.RevisionId{}, lib.WrapErrorf(err, "failed to create revision snapshot cache")
+	}
+	exists := func(p lib.Path) (bool, error) {
+		for _, isDir := range []bool{false, true} {
+			_, found, err := cache.Get(lib.PathCompareString(p, isDir))
+			if err != nil {
+				return false, lib.WrapErrorf(err, "failed to get path %s from revision snapshot", p)
+			}
+			if found {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	if ok, err := exists(source); err != nil {
+		return nil, lib.RevisionId{}, err
+	} else if !ok {
+		return nil, lib.RevisionId{}, lib.WrapErrorf(ErrMvSourceNotFound, "%s", opts.Source)
+	}
+	if ok, err := exists(target); err != nil {
+		return nil, lib.RevisionId{}, err
+	} else if ok {
+		return nil, lib.RevisionId{}, lib.WrapErrorf(ErrMvTargetExists, "%s", opts.Target)
+	}
+	if err := commit.EnsureDirExists(target.Dir(), cache, commit.BaseRevision); err != nil {
+		return nil, lib.RevisionId{}, lib.WrapErrorf(err, "failed to ensure parent directory of %s", opts.Target)
+	}
+	moved := StatusFiles{}
+	reader := snapshot.Reader(nil)
+	buf := lib.NewBlockBuf()
+	for {
+		entry, err := reader.Read(buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, lib.RevisionId{}, lib.WrapErrorf(err, "failed to read revision snapshot")
+		}
+		newPath := target
+		if entry.Path != source {
+			rest, ok := entry.Path.TrimBase(source)
+			if !ok {
+				continue
+			}
+			newPath = target.Join(rest)
+		}
+		oldPath := entry.Path
+		if err := commit.Add(&lib.RevisionEntry{
+			Kind:        lib.RevisionEntryKindDelete,
+			Path:        oldPath,
+			Metadata:    entry.Metadata,
+			RenamedFrom: nil,
+		}); err != nil {
+			return nil, lib.RevisionId{}, lib.WrapErrorf(err, "failed to add delete entry for %s", oldPath)
+		}
+		if err := commit.Add(&lib.RevisionEntry{
+			Kind:        lib.RevisionEntryKindAdd,
+			Path:        newPath,
+			Metadata:    entry.Metadata,
+			RenamedFrom: &oldPath,
+		}); err != nil {
+			return nil, lib.RevisionId{}, lib.WrapErrorf(err, "failed to add entry for %s", newPath)
+		}
+		relOld, _ := oldPath.TrimBase(opts.PathPrefix)
+		relNew, _ := newPath.TrimBase(opts.PathPrefix)
+		moved = append(moved, StatusFile{relNew, lib.RevisionEntryKindAdd, entry.Metadata, &relOld})
+	}
+	revisionId, err := commit.Commit(ctx, &lib.CommitInfo{Author: opts.Author, Message: opts.Message})
+	if err != nil {
+		return nil, lib.RevisionId{}, lib.WrapErrorf(err, "failed to commit")
+	}
+	return moved, revisionId, nil
+}
@@ -0,0 +1,125 @@
+package workspace
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestMv(t *testing.T) {
+	t.Parallel()
+	setup := func(t *testing.T) (*lib.TestRepository, *TestWorkspace) {
+		t.Helper()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		w.Write("c/1.txt", "c1")
+		w.Write("c/d/2.txt", "cd2")
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		return r, w
+	}
+	mvOptions := func(source, target string) *MvOptions {
+		return &MvOptions{
+			Source:     td.Path(source),
+			Target:     td.Path(target),
+			PathPrefix: lib.Path{},
+			Author:     "test author",
+			Message:    "mv",
+		}
+	}
+
+	t.Run("Moving a directory moves everything below it", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r, _ := setup(t)
+		moved, revId, err := Mv(t.Context(), r.Repository, mvOptions("c", "x/y"), td.NewFS(t))
+		assert.NoError(err)
+		assert.Equal(r.Head(), revId)
+		assert.Equal([]string{
+			"R c/ -> x/y/",
+			"R c/1.txt -> x/y/1.txt",
+			"R c/d/ -> x/y/d/",
+			"R c/d/2.txt -> x/y/d/2.txt",
+		}, formatStatus(moved))
+		ls, err := Ls(t.Context(), r.Repository, td.NewFS(t), wstd.LsOptions(revId))
+		assert.NoError(err)
+		assert.Equal([]lsFileInfo{
+			{"a.txt", 0o600, 1},
+			{"x", 0o700 | lib.FileModeDir, 0},
+			{"x/y", 0o700 | lib.FileModeDir, 0},
+			{"x/y/1.txt", 0o600, 2},
+			{"x/y/d", 0o700 | lib.FileModeDir, 0},
+			{"x/y/d/2.txt", 0o600, 3},
+		}, lsFiles(ls))
+	})
+
+	t.Run("The next merge moves the files in the workspace", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r, w := setup(t)
+		_, _, err := Mv(t.Context(), r.Repository, mvOptions("a.txt", "b.txt"), td.NewFS(t))
+		assert.NoError(err)
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.Equal(r.Head(), w.Head())
+		assert.Equal([]lib.TestFileInfo{
+			{"b.txt", 0o600, 1, "a"},
+			{"c", 0o700 | fs.ModeDir, 0, ""},
+			{"c/1.txt", 0o600, 2, "c1"},
+			{"c/d", 0o700 | fs.ModeDir, 0, ""},
+			{"c/d/2.txt", 0o600, 3, "cd2"},
+		}, w.Ls("."))
+	})
+
+	t.Run("Log shows a rename as a single entry", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r, _ := setup(t)
+		_, _, err := Mv(t.Context(), r.Repository, mvOptions("a.txt", "b.txt"), td.NewFS(t))
+		assert.NoError(err)
+		logs, err := Log(t.Context(), r.Repository, &LogOptions{nil, true, lib.RevisionRange{nil, nil}, false, nil})
+		assert.NoError(err)
+		assert.Equal([]string{"R a.txt -> b.txt"}, formatStatus(logs[0].Files))
+		assert.Equal("0 added, 0 updated, 0 deleted, 1 renamed", StatusFiles(logs[0].Files).Summary())
+	})
+
+	t.Run("Renaming the same file locally is not a conflict", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r, w := setup(t)
+		_, _, err := Mv(t.Context(), r.Repository, mvOptions("a.txt", "b.txt"), td.NewFS(t))
+		assert.NoError(err)
+		w.Rm("a.txt")
+		w.Write("b.txt", "a")
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+	})
+
+	t.Run("Source must exist and target must not", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r, _ := setup(t)
+		head := r.Head()
+		_, _, err := Mv(t.Context(), r.Repository, mvOptions("nope", "b.txt"), td.NewFS(t))
+		assert.ErrorIs(err, ErrMvSourceNotFound)
+		_, _, err = Mv(t.Context(), r.Repository, mvOptions("a.txt", "c/1.txt"), td.NewFS(t))
+		assert.ErrorIs(err, ErrMvTargetExists)
+		_, _, err = Mv(t.Context(), r.Repository, mvOptions("c", "c/d/e"), td.NewFS(t))
+		assert.Error(err, "into itself")
+		assert.Equal(head, r.Head())
+	})
+
+	t.Run("Paths are relative to the path prefix", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r, _ := setup(t)
+		opts := mvOptions("1.txt", "d/3.txt")
+		opts.PathPrefix = td.Path("c")
+		moved, _, err := Mv(t.Context(), r.Repository, opts, td.NewFS(t))
+		assert.NoError(err)
+		assert.Equal([]string{"R 1.txt -> d/3.txt"}, formatStatus(moved))
+	})
+}
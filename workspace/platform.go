@@ -3,14 +3,20 @@
 package workspace
 
 import (
+	"context"
+
 	clingHTTP "github.com/flunderpero/cling-sync/http"
 	"github.com/flunderpero/cling-sync/lib"
+	"github.com/flunderpero/cling-sync/rclone"
 )
 
 // OpenStorage opens a repository storage by URI. `s3+<http-url>` URIs need
 // the repository passphrase to decrypt the embedded credentials. Local paths
-// ignore the passphrase.
+// and `rclone://` URIs ignore the passphrase.
 func OpenStorage(uri string, passphrase []byte) (lib.Storage, error) {
+	if rclone.IsStorageURI(uri) {
+		return rclone.NewStorage(uri) //nolint:wrapcheck
+	}
 	if clingHTTP.IsS3StorageURI(uri) {
 		if passphrase == nil {
 			return nil, lib.Errorf("S3 storage URI requires a passphrase")
@@ -19,7 +25,11 @@ func OpenStorage(uri string, passphrase []byte) (lib.Storage, error) {
 		if err != nil {
 			return nil, lib.WrapErrorf(err, "failed to decode S3 URI")
 		}
-		return clingHTTP.NewS3StorageClient(cfg, clingHTTP.NewDefaultHTTPClient(nil)), nil
+		client, err := clingHTTP.NewDefaultHTTPClientFromEnv()
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+		return clingHTTP.NewS3StorageClient(cfg, client), nil
 	}
 	storage, err := lib.NewFileStorage(lib.NewRealFS(uri), lib.StoragePurposeRepository)
 	if err != nil {
@@ -27,3 +37,42 @@ func OpenStorage(uri string, passphrase []byte) (lib.Storage, error) {
 	}
 	return storage, nil
 }
+
+// NewAgentKeys returns the secrets of the repository in `storage` that an
+// `Agent` needs to open it again without `passphrase`. `uri` is the URI the
+// storage was opened with.
+func NewAgentKeys(ctx context.Context, storage lib.Storage, uri string, passphrase []byte) (AgentKeys, error) {
+	code, err := lib.ExportRecoveryCode(ctx, storage, passphrase)
+	if err != nil {
+		return AgentKeys{}, err //nolint:wrapcheck
+	}
+	keys := AgentKeys{code, "", "", nil}
+	if clingHTTP.IsS3StorageURI(uri) {
+		cfg, endpoint, err := clingHTTP.DecodeS3URI(uri, passphrase)
+		if err != nil {
+			return AgentKeys{}, lib.WrapErrorf(err, "failed to decode S3 URI")
+		}
+		keys.S3Endpoint, keys.S3AccessKeyID, keys.S3SecretAccessKey = endpoint, cfg.AccessKeyID, cfg.SecretAccessKey
+	}
+	return keys, nil
+}
+
+// OpenAgentStorage is like `OpenStorage`, but takes the S3 credentials from
+// `keys` instead of decrypting them with the passphrase.
+func OpenAgentStorage(uri string, keys AgentKeys) (lib.Storage, error) {
+	if !clingHTTP.IsS3StorageURI(uri) {
+		return OpenStorage(uri, nil)
+	}
+	cfg, err := clingHTTP.ParseS3Endpoint(
+		keys.S3Endpoint,
+		clingHTTP.S3Credentials{AccessKeyID: keys.S3AccessKeyID, SecretAccessKey: keys.S3SecretAccessKey},
+	)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to parse S3 endpoint")
+	}
+	client, err := clingHTTP.NewDefaultHTTPClientFromEnv()
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	return clingHTTP.NewS3StorageClient(cfg, client), nil
+}
@@ -0,0 +1,75 @@
+package workspace
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+type PrefetchOptions struct {
+	RevisionId lib.RevisionId
+	PathFilter lib.PathFilter
+	PathPrefix lib.Path
+}
+
+type PrefetchResult struct {
+	Files int
+	// Blocks that were downloaded, i.e. not counting those already cached.
+	Blocks int
+	Bytes  int64
+}
+
+// Prefetch downloads the blocks of all files matching `opts` into `cache`
+// without writing any files.
+//
+// `repository` must be opened on top of `cache` with `cache.Populate` set,
+// so that the revisions (and the references used to find them) are cached
+// as well.
+func Prefetch(
+	ctx context.Context,
+	repository *lib.Repository,
+	cache *BlockCache,
+	opts *PrefetchOptions,
+	tmpFS lib.FS,
+) (PrefetchResult, error) {
+	var result PrefetchResult
+	snapshot, err := lib.NewRevisionSnapshot(ctx, repository, opts.RevisionId, tmpFS)
+	if err != nil {
+		return result, lib.WrapErrorf(err, "failed to create revision snapshot")
+	}
+	defer snapshot.Remove() //nolint:errcheck
+	reader := snapshot.Reader(nil)
+	buf := lib.NewBlockBuf()
+	for {
+		entry, err := reader.Read(buf)
+		if errors.Is(err, io.EOF) {
+			return result, nil
+		}
+		if err != nil {
+			return result, lib.WrapErrorf(err, "failed to read revision snapshot")
+		}
+		path, ok := entry.Path.TrimBase(opts.PathPrefix)
+		if !ok {
+			continue
+		}
+		if opts.PathFilter != nil && !opts.PathFilter.Include(path, entry.Metadata.FileMode.IsDir()) {
+			continue
+		}
+		if len(entry.Metadata.BlockIds) == 0 {
+			continue
+		}
+		result.Files++
+		for _, blockId := range entry.Metadata.BlockIds {
+			n, err := cache.Fetch(ctx, blockId, buf)
+			if err != nil {
+				return result, lib.WrapErrorf(err, "failed to prefetch %s", path)
+			}
+			if n > 0 {
+				result.Blocks++
+				result.Bytes += int64(n)
+			}
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// offlineStorage fails all reads once `offline` is set, like a remote
+// storage without network.
+type offlineStorage struct {
+	lib.Storage
+	offline bool
+}
+
+var errOffline = lib.Errorf("offline")
+
+func (s *offlineStorage) Open(ctx context.Context) (lib.Toml, error) {
+	if s.offline {
+		return nil, errOffline
+	}
+	return s.Storage.Open(ctx) //nolint:wrapcheck
+}
+
+func (s *offlineStorage) ReadBlock(ctx context.Context, blockId lib.BlockId, buf lib.BlockBuf) ([]byte, error) {
+	if s.offline {
+		return nil, errOffline
+	}
+	return s.Storage.ReadBlock(ctx, blockId, buf) //nolint:wrapcheck
+}
+
+func (s *offlineStorage) ReadControlFile(
+	ctx context.Context,
+	section lib.ControlFileSection,
+	name string,
+) ([]byte, error) {
+	if s.offline {
+		return nil, errOffline
+	}
+	return s.Storage.ReadControlFile(ctx, section, name) //nolint:wrapcheck
+}
+
+func (s *offlineStorage) ListControlFiles(ctx context.Context, section lib.ControlFileSection) ([]string, error) {
+	if s.offline {
+		return nil, errOffline
+	}
+	return s.Storage.ListControlFiles(ctx, section) //nolint:wrapcheck
+}
+
+func TestPrefetch(t *testing.T) {
+	t.Parallel()
+
+	setup := func(t *testing.T) (*TestWorkspace, *offlineStorage, string, lib.RevisionId) {
+		t.Helper()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a/1.txt", "a1")
+		w.Write("a/2.txt", "a2")
+		w.Write("b.txt", "b")
+		head, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		return w, &offlineStorage{r.Storage, false}, r.Passphrase, head
+	}
+
+	prefetch := func(t *testing.T, w *TestWorkspace, remote lib.Storage, passphrase, pattern string) PrefetchResult {
+		t.Helper()
+		assert := lib.NewAssert(t)
+		cache, err := w.OpenBlockCache(t.Context(), remote)
+		assert.NoError(err)
+		cache.Populate = true
+		repository, err := lib.OpenRepository(t.Context(), cache, []byte(passphrase))
+		assert.NoError(err)
+		head, err := repository.Head(t.Context())
+		assert.NoError(err)
+		opts := &PrefetchOptions{head, lib.NewPathInclusionFilter([]string{pattern}), lib.Path{}}
+		result, err := Prefetch(t.Context(), repository, cache, opts, td.NewFS(t))
+		assert.NoError(err)
+		return result
+	}
+
+	t.Run("Prefetched files can be read offline", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		w, remote, passphrase, head := setup(t)
+		result := prefetch(t, w, remote, passphrase, "a/**")
+		assert.Equal(2, result.Files)
+		assert.Equal(2, result.Blocks)
+
+		remote.offline = true
+		cache, err := w.OpenBlockCache(t.Context(), remote)
+		assert.NoError(err)
+		repository, err := lib.OpenRepository(t.Context(), cache, []byte(passphrase))
+		assert.NoError(err)
+		cachedHead, err := repository.Head(t.Context())
+		assert.NoError(err)
+		assert.Equal(head, cachedHead)
+		cat := func(path string) (string, error) {
+			p, err := lib.NewPath(path)
+			assert.NoError(err)
+			var buf bytes.Buffer
+			err = Cat(t.Context(), repository, &buf, &CatOptions{RevisionId: head, Path: p}, td.NewFS(t))
+			return buf.String(), err
+		}
+		got, err := cat("a/1.txt")
+		assert.NoError(err)
+		assert.Equal("a1", got)
+		got, err = cat("a/2.txt")
+		assert.NoError(err)
+		assert.Equal("a2", got)
+		_, err = cat("b.txt")
+		assert.ErrorIs(err, errOffline)
+	})
+
+	t.Run("Cached blocks are not downloaded again", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		w, remote, passphrase, _ := setup(t)
+		result := prefetch(t, w, remote, passphrase, "a/1.txt")
+		assert.Equal(1, result.Files)
+		assert.Equal(1, result.Blocks)
+		result = prefetch(t, w, remote, passphrase, "**/*.txt")
+		assert.Equal(3, result.Files)
+		assert.Equal(2, result.Blocks)
+	})
+
+	t.Run("Without a prefetch the remote storage is needed", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		w, remote, passphrase, _ := setup(t)
+		remote.offline = true
+		cache, err := w.OpenBlockCache(t.Context(), remote)
+		assert.NoError(err)
+		_, err = lib.OpenRepository(t.Context(), cache, []byte(passphrase))
+		assert.ErrorIs(err, errOffline)
+	})
+}
+
+func TestBlockCacheOfReplacedRepository(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	src := td.NewLegacyTestRepository(t, td.NewFS(t))
+	w := wstd.NewTestWorkspace(t, src.Repository)
+	w.Write("a.txt", "a")
+	head, err := Merge(t.Context(), w.Workspace, src.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	remote := &offlineStorage{src.Storage, false}
+	cache, err := w.OpenBlockCache(t.Context(), remote)
+	assert.NoError(err)
+	cache.Populate = true
+	repository, err := lib.OpenRepository(t.Context(), cache, []byte(src.Passphrase))
+	assert.NoError(err)
+	_, err = Prefetch(t.Context(), repository, cache, &PrefetchOptions{head, nil, lib.Path{}}, td.NewFS(t))
+	assert.NoError(err)
+
+	// Replace the remote storage with an upgraded copy.
+	dstFS := td.NewFS(t)
+	dst, err := lib.NewFileStorage(dstFS, lib.StoragePurposeRepository)
+	assert.NoError(err)
+	upgraded, err := lib.UpgradeRepository(t.Context(), src.Storage, dst, []byte(src.Passphrase), 1, upgradeMonitor{})
+	assert.NoError(err)
+	assert.NoError(upgraded.Close())
+	remote.Storage = dst
+	cache, err = w.OpenBlockCache(t.Context(), remote)
+	assert.NoError(err)
+	repository, err = lib.OpenRepository(t.Context(), cache, []byte(src.Passphrase))
+	assert.NoError(err)
+	var buf bytes.Buffer
+	err = Cat(t.Context(), repository, &buf, &CatOptions{RevisionId: head, Path: td.Path("a.txt")}, td.NewFS(t))
+	assert.NoError(err)
+	assert.Equal("a", buf.String())
+}
+
+func TestBlockCacheLimit(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	w := wstd.NewTestWorkspace(t, r.Repository)
+	limit, err := w.BlockCacheLimit(t.Context())
+	assert.NoError(err)
+	assert.Equal(int64(0), limit)
+	assert.NoError(w.SetBlockCacheLimit(t.Context(), 250))
+	limit, err = w.BlockCacheLimit(t.Context())
+	assert.NoError(err)
+	assert.Equal(int64(250), limit)
+
+	remote, err := lib.NewFileStorage(td.NewFS(t), lib.StoragePurposeRepository)
+	assert.NoError(err)
+	blockIds := []lib.BlockId{}
+	for _, c := range "abc" {
+		data := bytes.Repeat([]byte{byte(c)}, 100)
+		blockId := lib.BlockId(lib.CalculateSha256(data))
+		_, err := remote.WriteBlock(t.Context(), blockId, data)
+		assert.NoError(err)
+		blockIds = append(blockIds, blockId)
+	}
+	cache, err := w.OpenBlockCache(t.Context(), remote)
+	assert.NoError(err)
+	cache.Populate = true
+	read := func(blockId lib.BlockId) {
+		_, err := cache.ReadBlock(t.Context(), blockId, lib.NewBlockBuf())
+		assert.NoError(err)
+	}
+	cached := func() []bool {
+		result := []bool{}
+		for _, blockId := range blockIds {
+			ok, err := cache.cache.HasBlock(t.Context(), blockId)
+			assert.NoError(err)
+			result = append(result, ok)
+		}
+		return result
+	}
+	read(blockIds[0])
+	read(blockIds[1])
+	assert.Equal([]bool{true, true, false}, cached())
+
+	// Reading `a` from the cache makes `b` the least recently used block.
+	read(blockIds[0])
+	read(blockIds[2])
+	assert.Equal([]bool{true, false, true}, cached())
+	blocks, size, err := cache.Usage(t.Context())
+	assert.NoError(err)
+	assert.Equal(2, blocks)
+	assert.Equal(int64(200), size)
+
+	assert.NoError(w.ClearBlockCache())
+	cache, err = w.OpenBlockCache(t.Context(), remote)
+	assert.NoError(err)
+	assert.Equal([]bool{false, false, false}, cached())
+	assert.NoError(w.SetBlockCacheLimit(t.Context(), 0))
+	limit, err = w.BlockCacheLimit(t.Context())
+	assert.NoError(err)
+	assert.Equal(int64(0), limit)
+}
+
+type upgradeMonitor struct{}
+
+func (upgradeMonitor) OnUpgradeBlock(lib.BlockId, int) {}
@@ -0,0 +1,209 @@
+package workspace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// While a merge commits to the repository, this reference holds the workspace
+// head the commit is based on. It is only left behind if the merge did not
+// get to write the new workspace head.
+const pendingCommitRef = "pending-commit"
+
+var ErrHeadNotRepaired = lib.Errorf("no revision in the repository matches the workspace")
+
+func (w *Workspace) beginCommit(ctx context.Context, wsHead lib.RevisionId) error {
+	if err := lib.WriteRef(ctx, w.Storage, pendingCommitRef, wsHead); err != nil {
+		return lib.WrapErrorf(err, "failed to record pending commit")
+	}
+	return nil
+}
+
+func (w *Workspace) endCommit(ctx context.Context) error {
+	if err := lib.DeleteRef(ctx, w.Storage, pendingCommitRef); err != nil &&
+		!errors.Is(err, lib.ErrControlFileNotFound) {
+		return lib.WrapErrorf(err, "failed to clear pending commit")
+	}
+	return nil
+}
+
+// PendingCommit returns the workspace head a merge was based on if that
+// merge committed (or tried to commit) to the repository but failed to
+// write the new workspace head afterwards.
+// Return `false` if there is nothing to repair.
+func (w *Workspace) PendingCommit(ctx context.Context) (lib.RevisionId, bool, error) {
+	exists, err := w.Storage.HasControlFile(ctx, lib.ControlFileSectionRefs, pendingCommitRef)
+	if err != nil {
+		return lib.RevisionId{}, false, lib.WrapErrorf(err, "failed to check for pending commit")
+	}
+	if !exists {
+		return lib.RevisionId{}, false, nil
+	}
+	base, err := lib.ReadRef(ctx, w.Storage, pendingCommitRef)
+	if err != nil {
+		return lib.RevisionId{}, false, lib.WrapErrorf(err, "failed to read pending commit")
+	}
+	return base, true, nil
+}
+
+type RepairHeadOptions struct {
+	// If set, the workspace head is set to this revision without comparing
+	// it to the workspace.
+	RevisionId             *lib.RevisionId
+	StagingMonitor         StagingEntryMonitor
+	RestorableMetadataFlag lib.RestorableMetadataFlag
+	UseStagingCache        bool
+}
+
+// RepairHead moves the workspace head to the revision that an interrupted
+// merge committed (see `Workspace.PendingCommit`).
+// The revisions committed on top of the old workspace head are compared to
+// the workspace, newest first, and the first one without any differences
+// becomes the new workspace head.
+// If none matches, the commit most likely never happened and the workspace
+// head is already correct - but it is just as likely that files were changed
+// since. In that case, `ErrHeadNotRepaired` is returned and the pending
+// commit is kept, so that the user can decide with `opts.RevisionId`.
+// Return the (new) workspace head.
+func RepairHead( //nolint:funlen
+	ctx context.Context,
+	ws *Workspace,
+	repository *lib.Repository,
+	opts *RepairHeadOptions,
+) (lib.RevisionId, error) {
+	chain, err := lib.ReadRevisionChain(ctx, repository)
+	if err != nil {
+		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to read repository revision chain")
+	}
+	if opts.RevisionId != nil {
+		if !opts.RevisionId.IsRoot() && !slices.Contains(chain, *opts.RevisionId) {
+			return lib.RevisionId{}, lib.Errorf("revision %s is not in the repository's revision chain", *opts.RevisionId)
+		}
+		return *opts.RevisionId, setRepairedHead(ctx, ws, *opts.RevisionId)
+	}
+	base, pending, err := ws.PendingCommit(ctx)
+	if err != nil {
+		return lib.RevisionId{}, err
+	}
+	if !pending {
+		return ws.Head(ctx) //nolint:wrapcheck
+	}
+	candidates := chain
+	if !base.IsRoot() {
+		i := slices.Index(chain, base)
+		if i < 0 {
+			return lib.RevisionId{}, lib.Errorf("workspace head %s is not in the repository's revision chain", base)
+		}
+		candidates = chain[:i]
+	}
+	tempFS, err := ws.TempFS.MkSub("repair-head")
+	if err != nil {
+		return lib.RevisionId{}, lib.WrapErrorf(err, "failed to create repair tmp dir")
+	}
+	defer tempFS.RemoveAll(".") //nolint:errcheck
+	for i, revisionId := range candidates {
+		candidateFS, err := tempFS.MkSub(fmt.Sprintf("candidate-%d", i))
+		if err != nil {
+			return lib.RevisionId{}, lib.WrapErrorf(err, "failed to create candidate tmp dir")
+		}
+		matches, err := matchesWorkspace(ctx, ws, candidateFS, repository, revisionId, opts)
+		if err != nil {
+			return lib.RevisionId{}, lib.WrapErrorf(err, "failed to compare revision %s with the workspace", revisionId)
+		}
+		if matches {
+			return revisionId, setRepairedHead(ctx, ws, revisionId)
+		}
+	}
+	return lib.RevisionId{}, lib.WrapErrorf(
+		ErrHeadNotRepaired,
+		"checked %d revision(s) committed after %s",
+		len(candidates),
+		base,
+	)
+}
+
+func setRepairedHead(ctx context.Context, ws *Workspace, revisionId lib.RevisionId) error {
+	if err := lib.WriteRef(ctx, ws.Storage, "head", revisionId); err != nil {
+		return lib.WrapErrorf(err, "failed to write workspace head reference")
+	}
+	return ws.endCommit(ctx)
+}
+
+// matchesWorkspace reports whether the workspace has no local changes
+// compared to `revisionId`.
+func matchesWorkspace(
+	ctx context.Context,
+	ws *Workspace,
+	tempFS lib.FS,
+	repository *lib.Repository,
+	revisionId lib.RevisionId,
+	opts *RepairHeadOptions,
+) (bool, error) {
+	stagingTmpDir, err := tempFS.MkSub("staging")
+	if err != nil {
+		return false, lib.WrapErrorf(err, "failed to create staging tmp dir")
+	}
+	snapshotTmpDir, err := tempFS.MkSub("snapshot")
+	if err != nil {
+		return false, lib.WrapErrorf(err, "failed to create snapshot tmp dir")
+	}
+	trackedFilter, err := ws.trackedFilter()
+	if err != nil {
+		return false, err
+	}
+	snapshot, err := lib.NewFilteredRevisionSnapshot(
+		ctx,
+		repository,
+		revisionId,
+		snapshotTmpDir,
+		trackedFilter,
+	)
+	if err != nil {
+		return false, lib.WrapErrorf(err, "failed to create revision snapshot")
+	}
+	staging, err := newWorkspaceStaging(
+		ctx,
+		ws,
+		repository,
+		ws.sparseFilter(),
+		opts.UseStagingCache,
+		opts.RestorableMetadataFlag,
+		nil,
+		stagingTmpDir,
+		opts.StagingMonitor,
+	)
+	if err != nil {
+		return false, lib.WrapErrorf(err, "failed to detect local changes")
+	}
+	localChanges, err := staging.MergeWithSnapshot(snapshot, opts.RestorableMetadataFlag, false)
+	if err != nil {
+		return false, lib.WrapErrorf(err, "failed to merge staging and revision snapshot")
+	}
+	return localChanges.Chunks() == 0, nil
+}
+
+// repairPendingCommit runs `RepairHead` before a merge if the previous merge
+// was interrupted. Otherwise, the changes committed by the previous merge
+// would show up as local changes again.
+func repairPendingCommit(ctx context.Context, ws *Workspace, repository *lib.Repository, opts *MergeOptions) error {
+	_, pending, err := ws.PendingCommit(ctx)
+	if err != nil || !pending {
+		return err
+	}
+	slog.Debug("The previous merge was interrupted, repairing the workspace head")
+	_, err = RepairHead(ctx, ws, repository, &RepairHeadOptions{
+		RevisionId:             nil,
+		StagingMonitor:         opts.StagingMonitor,
+		RestorableMetadataFlag: opts.RestorableMetadataFlag,
+		UseStagingCache:        opts.UseStagingCache,
+	})
+	if err != nil {
+		return lib.WrapErrorf(err, "the previous merge was interrupted and the workspace head could not be repaired")
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package workspace
+
+import (
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestRepairHead(t *testing.T) {
+	t.Parallel()
+	// Simulate a merge that committed but failed to write the workspace head.
+	interruptedMerge := func(t *testing.T, w *TestWorkspace, r *lib.TestRepository) (lib.RevisionId, lib.RevisionId) {
+		t.Helper()
+		assert := lib.NewAssert(t)
+		oldHead := w.Head()
+		newHead, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.NoError(lib.WriteRef(t.Context(), w.Storage, "head", oldHead))
+		assert.NoError(w.beginCommit(t.Context(), oldHead))
+		return oldHead, newHead
+	}
+
+	t.Run("No pending commit", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		head, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		_, pending, err := w.PendingCommit(t.Context())
+		assert.NoError(err)
+		assert.Equal(false, pending)
+		repaired, err := RepairHead(t.Context(), w.Workspace, r.Repository, wstd.RepairHeadOptions(nil))
+		assert.NoError(err)
+		assert.Equal(head, repaired)
+	})
+
+	t.Run("The committed revision becomes the workspace head", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		w.Write("b.txt", "b")
+		oldHead, newHead := interruptedMerge(t, w, r)
+		base, pending, err := w.PendingCommit(t.Context())
+		assert.NoError(err)
+		assert.Equal(true, pending)
+		assert.Equal(oldHead, base)
+
+		repaired, err := RepairHead(t.Context(), w.Workspace, r.Repository, wstd.RepairHeadOptions(nil))
+		assert.NoError(err)
+		assert.Equal(newHead, repaired)
+		assert.Equal(newHead, w.Head())
+		_, pending, err = w.PendingCommit(t.Context())
+		assert.NoError(err)
+		assert.Equal(false, pending)
+	})
+
+	t.Run("Merge repairs the workspace head first", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		_, newHead := interruptedMerge(t, w, r)
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.ErrorIs(err, ErrUpToDate)
+		assert.Equal(newHead, w.Head())
+		assert.Equal(newHead, r.Head())
+	})
+
+	t.Run("Local changes after the interrupted merge", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		oldHead, newHead := interruptedMerge(t, w, r)
+		w.Write("a.txt", "changed")
+		_, err := RepairHead(t.Context(), w.Workspace, r.Repository, wstd.RepairHeadOptions(nil))
+		assert.ErrorIs(err, ErrHeadNotRepaired)
+		assert.Equal(oldHead, w.Head())
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.ErrorIs(err, ErrHeadNotRepaired)
+
+		// The user knows better.
+		repaired, err := RepairHead(t.Context(), w.Workspace, r.Repository, wstd.RepairHeadOptions(&newHead))
+		assert.NoError(err)
+		assert.Equal(newHead, repaired)
+		assert.Equal(newHead, w.Head())
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.Equal("changed", w.Cat("a.txt"))
+	})
+
+	t.Run("Reset clears the pending commit", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		_, newHead := interruptedMerge(t, w, r)
+		assert.NoError(Reset(t.Context(), w.Workspace, r.Repository, wstd.ResetOptions(newHead, true)))
+		_, pending, err := w.PendingCommit(t.Context())
+		assert.NoError(err)
+		assert.Equal(false, pending)
+	})
+}
@@ -2,36 +2,53 @@ package workspace
 
 import (
 	"context"
+	"errors"
+	"io"
 	"io/fs"
 
 	"github.com/flunderpero/cling-sync/lib"
 )
 
 type ResetOptions struct {
-	RevisionId             lib.RevisionId
+	RevisionId lib.RevisionId
+	// Only reset the paths (relative to the workspace) included by this
+	// filter. The other paths are left as they are, they become local
+	// changes if they differ from `RevisionId`. Optional.
+	PathFilter             lib.PathFilter
 	Force                  bool
 	StagingMonitor         StagingEntryMonitor
 	CpMonitor              CpMonitor
 	RestorableMetadataFlag lib.RestorableMetadataFlag
 	UseStagingCache        bool
+	// Restore files with the same content and metadata as hard links of
+	// each other (see `CpOptions.HardLinkDupes`).
+	HardLinkDupes bool
 }
 
 func (e ResetError) Error() string {
 	return "Reset aborted due to local changes"
 }
 
+func (e ResetError) Is(target error) bool {
+	return target == ErrConflict //nolint:errorlint
+}
+
 type ResetError struct {
 	LocalChanges *lib.TempCache[*lib.RevisionEntry]
 }
 
 // Reset the workspace to a specific revision.
-// Return `ResetError` if there are local changes and `opts.Force` is not set.
+// Return `ResetError` if there are local changes (of the paths included by
+// `opts.PathFilter`) and `opts.Force` is not set.
 func Reset(ctx context.Context, ws *Workspace, repository *lib.Repository, opts *ResetOptions) error {
 	tempFS, err := ws.TempFS.MkSub("reset")
 	if err != nil {
 		return lib.WrapErrorf(err, "failed to create reset tmp dir")
 	}
 	defer tempFS.RemoveAll(".") //nolint:errcheck
+	if err := finishRestoreInPlace(ctx, ws, repository, opts.RestorableMetadataFlag); err != nil {
+		return err
+	}
 	// todo: Refactor Merger and MergeOptions to suit both, Reset and Merge better.
 	// todo: Actually, we should commit first in Merge and then Reset and move the code to Reset.
 	mergeOptions := MergeOptions{
@@ -42,19 +59,30 @@ func Reset(ctx context.Context, ws *Workspace, repository *lib.Repository, opts
 		Message:                "unused",
 		RestorableMetadataFlag: opts.RestorableMetadataFlag,
 		UseStagingCache:        opts.UseStagingCache,
+		First:                  nil,
+		CommitFilter:           nil,
+		WatchJournal:           nil,
+		MergeText:              false,
+		MemoryBudget:           nil,
+		CacheMonitor:           nil,
+		HookOutput:             nil,
 	}
 	wsHead, staging, localChanges, _, err := buildLocalChanges(ctx, ws, tempFS, repository, &mergeOptions)
 	if err != nil {
 		return lib.WrapErrorf(err, "failed to build local changes")
 	}
-	if localChanges.Source.Chunks() > 0 {
-		if !opts.Force {
+	if !opts.Force {
+		hasLocalChanges, err := hasIncludedChanges(ws, localChanges.Source, opts.PathFilter)
+		if err != nil {
+			return err
+		}
+		if hasLocalChanges {
 			return ResetError{localChanges}
 		}
 	}
 	// We ignore local changes.
 	localChanges = nil
-	remoteRevision, err := buildRemoteChanges(ctx, tempFS, repository, opts.RevisionId)
+	remoteRevision, err := buildRemoteChanges(ctx, tempFS, repository, opts.RevisionId, mergeOptions.tempCacheOptions())
 	if err != nil {
 		return lib.WrapErrorf(err, "failed to build remote changes")
 	}
@@ -67,12 +95,21 @@ func Reset(ctx context.Context, ws *Workspace, repository *lib.Repository, opts
 		make(map[string]fs.FileInfo),
 		&mergeOptions,
 		lib.NewBlockBuf(),
+		nil,
+		newHardLinker(opts.HardLinkDupes),
+		nil,
+		opts.PathFilter,
 	}
 	defer merger.restoreDirFileModes() //nolint:errcheck
 	if err := merger.copyRepositoryFiles(ctx, remoteRevision.Source, staging, localChanges); err != nil {
 		return lib.WrapErrorf(err, "failed to copy remote files")
 	}
-	if err := merger.deleteObsoleteWorkspaceFiles(remoteRevision, staging, localChanges); err != nil {
+	if err := merger.deleteObsoleteWorkspaceFiles(
+		stagingEntryCandidates(staging.Source, merger.blockBuf),
+		remoteRevision,
+		staging,
+		localChanges,
+	); err != nil {
 		return lib.WrapErrorf(err, "failed to delete obsolete workspace files")
 	}
 	if err := merger.restoreDirFileModes(); err != nil {
@@ -81,5 +118,37 @@ func Reset(ctx context.Context, ws *Workspace, repository *lib.Repository, opts
 	if err := lib.WriteRef(ctx, ws.Storage, "head", opts.RevisionId); err != nil {
 		return lib.WrapErrorf(err, "failed to write workspace head reference - please re-run reset")
 	}
-	return nil
+	// The workspace head was set explicitly, an interrupted merge no longer
+	// matters.
+	if err := ws.endCommit(ctx); err != nil {
+		return err
+	}
+	return ws.writeAppliedScope(ctx)
+}
+
+// Return whether one of `localChanges` is included by `filter` (relative to
+// the workspace). Without a filter, all are included.
+func hasIncludedChanges(
+	ws *Workspace,
+	localChanges *lib.Temp[*lib.RevisionEntry],
+	filter lib.PathFilter,
+) (bool, error) {
+	if filter == nil {
+		return localChanges.Chunks() > 0, nil
+	}
+	r := localChanges.Reader(nil)
+	buf := lib.NewBlockBuf()
+	for {
+		entry, err := r.Read(buf)
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		if err != nil {
+			return false, lib.WrapErrorf(err, "failed to read local changes")
+		}
+		path, _ := entry.Path.TrimBase(ws.PathPrefix)
+		if filter.Include(path, entry.Metadata.FileMode.IsDir()) {
+			return true, nil
+		}
+	}
 }
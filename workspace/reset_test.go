@@ -146,6 +146,55 @@ func TestReset(t *testing.T) {
 		}, prefixW.Ls("."))
 	})
 
+	t.Run("With a path filter", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+
+		w.Write("a.txt", "a")
+		w.Write("b.txt", "b")
+		w.Write("logs/x.log", "x")
+		remoteRev1, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		w.Write("a.txt", "aa")
+		w.Rm("b.txt")
+		w.Write("logs/x.log", "xx")
+		w.Write("logs/y.log", "y")
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+
+		// Local changes of excluded paths do not matter, the paths are
+		// left as they are.
+		w.Write("logs/x.log", "local")
+		opts := wstd.ResetOptions(remoteRev1, false)
+		opts.PathFilter = lib.NewPathExclusionFilter([]string{"logs"})
+		err = Reset(t.Context(), w.Workspace, r.Repository, opts)
+		assert.NoError(err)
+		assert.Equal(remoteRev1, w.Head())
+		assert.Equal([]lib.TestFileInfo{
+			{"a.txt", 0o600, 1, "a"},
+			{"b.txt", 0o600, 1, "b"},
+			{"logs", 0o700 | fs.ModeDir, 0, ""},
+			{"logs/x.log", 0o600, 5, "local"},
+			{"logs/y.log", 0o600, 1, "y"},
+		}, w.Ls("."))
+
+		// `logs/y.log` is a local change now.
+		opts.PathFilter = lib.NewPathExclusionFilter([]string{"logs", "!logs/y.log"})
+		err = Reset(t.Context(), w.Workspace, r.Repository, opts)
+		assert.ErrorIs(err, ErrConflict)
+		opts.Force = true
+		err = Reset(t.Context(), w.Workspace, r.Repository, opts)
+		assert.NoError(err)
+		assert.Equal([]lib.TestFileInfo{
+			{"a.txt", 0o600, 1, "a"},
+			{"b.txt", 0o600, 1, "b"},
+			{"logs", 0o700 | fs.ModeDir, 0, ""},
+			{"logs/x.log", 0o600, 5, "local"},
+		}, w.Ls("."))
+	})
+
 	t.Run("RestorableMetadata is respected", func(t *testing.T) {
 		t.Parallel()
 		assert := lib.NewAssert(t)
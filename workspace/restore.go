@@ -0,0 +1,152 @@
+package workspace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+var ErrNothingToRestore = lib.Errorf("no paths matched")
+
+type RestoreOptions struct {
+	RevisionId lib.RevisionId
+	// Paths matching the filter (relative to the workspace path prefix) are restored.
+	PathFilter lib.PathFilter
+	// Overwrite local changes of the matching paths.
+	Force                  bool
+	StagingMonitor         StagingEntryMonitor
+	CpMonitor              CpMonitor
+	RestorableMetadataFlag lib.RestorableMetadataFlag
+	UseStagingCache        bool
+}
+
+type RestoreError struct {
+	// The local changes (relative to the workspace path prefix) that would
+	// be overwritten.
+	LocalChanges []lib.Path
+}
+
+func (e RestoreError) Error() string {
+	paths := make([]string, len(e.LocalChanges))
+	for i, p := range e.LocalChanges {
+		paths[i] = p.String()
+	}
+	return fmt.Sprintf("restore aborted due to local changes: %s", strings.Join(paths, ", "))
+}
+
+func (e RestoreError) Is(target error) bool {
+	return target == ErrConflict //nolint:errorlint
+}
+
+// Restore copies the paths matching `opts.PathFilter` from `opts.RevisionId`
+// into the workspace. Unlike `Reset`, the workspace head is not changed, so
+// the restored files show up as local changes in `Status` and are committed
+// by the next `Merge`.
+// Paths that do not exist in `opts.RevisionId` are left untouched.
+// Return `RestoreError` if a matching path has local changes and
+// `opts.Force` is not set.
+// Return the number of restored paths or `ErrNothingToRestore`.
+func Restore(ctx context.Context, ws *Workspace, repository *lib.Repository, opts *RestoreOptions) (int, error) {
+	tempFS, err := ws.TempFS.MkSub("restore")
+	if err != nil {
+		return 0, lib.WrapErrorf(err, "failed to create restore tmp dir")
+	}
+	defer tempFS.RemoveAll(".") //nolint:errcheck
+	if !opts.Force {
+		if err := checkLocalChanges(ctx, ws, tempFS, repository, opts); err != nil {
+			return 0, err
+		}
+	}
+	cpFS, err := tempFS.MkSub("cp")
+	if err != nil {
+		return 0, lib.WrapErrorf(err, "failed to create cp tmp dir")
+	}
+	mon := &restoreCpMonitor{opts.CpMonitor, 0}
+	cpOpts := &CpOptions{
+		RevisionId:             opts.RevisionId,
+		Monitor:                mon,
+		PathFilter:             opts.PathFilter,
+		PathPrefix:             ws.PathPrefix,
+		RestorableMetadataFlag: opts.RestorableMetadataFlag,
+		HardLinkDupes:          false,
+	}
+	if err := Cp(ctx, repository, ws.FS, cpOpts, cpFS); err != nil {
+		return mon.restored, lib.WrapErrorf(err, "failed to restore files")
+	}
+	if mon.restored == 0 {
+		return 0, ErrNothingToRestore
+	}
+	return mon.restored, nil
+}
+
+func checkLocalChanges(
+	ctx context.Context,
+	ws *Workspace,
+	tempFS lib.FS,
+	repository *lib.Repository,
+	opts *RestoreOptions,
+) error {
+	mergeOptions := MergeOptions{
+		StagingMonitor:         opts.StagingMonitor,
+		CpMonitor:              opts.CpMonitor,
+		CommitMonitor:          nil,
+		Author:                 "unused",
+		Message:                "unused",
+		RestorableMetadataFlag: opts.RestorableMetadataFlag,
+		UseStagingCache:        opts.UseStagingCache,
+		First:                  nil,
+		CommitFilter:           nil,
+		WatchJournal:           nil,
+		MergeText:              false,
+		MemoryBudget:           nil,
+		CacheMonitor:           nil,
+		HookOutput:             nil,
+	}
+	_, _, localChanges, _, err := buildLocalChanges(ctx, ws, tempFS, repository, &mergeOptions)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to build local changes")
+	}
+	changed := []lib.Path{}
+	reader := localChanges.Source.Reader(nil)
+	buf := lib.NewBlockBuf()
+	for {
+		entry, err := reader.Read(buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to read local changes")
+		}
+		path, ok := entry.Path.TrimBase(ws.PathPrefix)
+		if !ok {
+			continue
+		}
+		if opts.PathFilter == nil || opts.PathFilter.Include(path, entry.Metadata.FileMode.IsDir()) {
+			changed = append(changed, path)
+		}
+	}
+	if len(changed) > 0 {
+		return RestoreError{changed}
+	}
+	return nil
+}
+
+// restoreCpMonitor always overwrites existing files and counts the restored
+// paths.
+type restoreCpMonitor struct {
+	CpMonitor
+	restored int
+}
+
+func (m *restoreCpMonitor) OnStart(entry *lib.RevisionEntry, targetPath string) error {
+	m.restored++
+	return m.CpMonitor.OnStart(entry, targetPath) //nolint:wrapcheck
+}
+
+func (m *restoreCpMonitor) OnExists(entry *lib.RevisionEntry, targetPath string) CpOnExists {
+	return CpOnExistsOverwrite
+}
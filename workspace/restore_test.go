@@ -0,0 +1,75 @@
+package workspace
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestRestore(t *testing.T) {
+	t.Parallel()
+	setup := func(t *testing.T) (*lib.TestRepository, *TestWorkspace, lib.RevisionId) {
+		t.Helper()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		w.Write("b.txt", "b")
+		revId1, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		w.Write("a.txt", "aa")
+		w.Rm("b.txt")
+		w.Write("c.txt", "c")
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		return r, w, revId1
+	}
+
+	t.Run("Restored files become local changes", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r, w, revId1 := setup(t)
+		head := w.Head()
+		n, err := Restore(t.Context(), w.Workspace, r.Repository, wstd.RestoreOptions(revId1, false, "*.txt"))
+		assert.NoError(err)
+		assert.Equal(2, n)
+		assert.Equal(head, w.Head())
+		assert.Equal([]lib.TestFileInfo{
+			{"a.txt", 0o600, 1, "a"},
+			{"b.txt", 0o600, 1, "b"},
+			{"c.txt", 0o600, 1, "c"},
+		}, w.Ls("."))
+		status, err := Status(t.Context(), w.Workspace, r.Repository, wstd.StatusOptions(), td.NewFS(t))
+		assert.NoError(err)
+		assert.Equal([]string{"M a.txt", "A b.txt"}, formatStatus(status))
+	})
+
+	t.Run("Local changes are not overwritten without force", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r, w, revId1 := setup(t)
+		w.Write("a.txt", "local")
+		_, err := Restore(t.Context(), w.Workspace, r.Repository, wstd.RestoreOptions(revId1, false, "a.txt"))
+		var restoreErr RestoreError
+		assert.Equal(true, errors.As(err, &restoreErr))
+		assert.Equal([]lib.Path{td.Path("a.txt")}, restoreErr.LocalChanges)
+		assert.Equal("local", w.Cat("a.txt"))
+
+		// Local changes of other paths do not matter.
+		_, err = Restore(t.Context(), w.Workspace, r.Repository, wstd.RestoreOptions(revId1, false, "b.txt"))
+		assert.NoError(err)
+
+		_, err = Restore(t.Context(), w.Workspace, r.Repository, wstd.RestoreOptions(revId1, true, "a.txt"))
+		assert.NoError(err)
+		assert.Equal("a", w.Cat("a.txt"))
+	})
+
+	t.Run("No match returns ErrNothingToRestore", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r, w, revId1 := setup(t)
+		_, err := Restore(t.Context(), w.Workspace, r.Repository, wstd.RestoreOptions(revId1, false, "c.txt"))
+		assert.ErrorIs(err, ErrNothingToRestore)
+	})
+}
@@ -0,0 +1,118 @@
+package workspace
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+var ErrNothingToRemove = lib.Errorf("no paths matched")
+
+type RmOptions struct {
+	// Paths matching the filter (relative to `PathPrefix`) are removed.
+	// Removing a directory always removes everything below it.
+	PathFilter lib.PathFilter
+	PathPrefix lib.Path
+	Author     string
+	Message    string
+	// Only return the paths that would be removed without committing.
+	DryRun bool
+}
+
+// Rm commits a new revision that deletes all paths matching `opts.PathFilter`
+// from the repository head. The paths don't have to exist in any workspace;
+// workspaces pick up the deletion on their next merge.
+// Return the removed paths (relative to `opts.PathPrefix`) and the new
+// revision id (the current head for a dry-run).
+// Return `ErrNothingToRemove` if no path matched.
+func Rm( //nolint:funlen
+	ctx context.Context,
+	repository *lib.Repository,
+	opts *RmOptions,
+	tmpFS lib.FS,
+) (StatusFiles, lib.RevisionId, error) {
+	commitFS, err := tmpFS.MkSub("commit")
+	if err != nil {
+		return nil, lib.RevisionId{}, lib.WrapErrorf(err, "failed to create commit tmp dir")
+	}
+	commit, err := lib.NewCommit(ctx, repository, commitFS)
+	if err != nil {
+		return nil, lib.RevisionId{}, lib.WrapErrorf(err, "failed to create commit")
+	}
+	snapshotFS, err := tmpFS.MkSub("snapshot")
+	if err != nil {
+		return nil, lib.RevisionId{}, lib.WrapErrorf(err, "failed to create snapshot tmp dir")
+	}
+	// Use the commit's base revision so the deletes are based on exactly
+	// the snapshot we read.
+	snapshot, err := lib.NewFilteredRevisionSnapshot(
+		ctx,
+		repository,
+		commit.BaseRevision,
+		snapshotFS,
+		opts.PathPrefix.AsFilter(),
+	)
+	if err != nil {
+		return nil, lib.RevisionId{}, lib.WrapErrorf(err, "failed to create revision snapshot")
+	}
+	defer snapshot.Remove() //nolint:errcheck
+	// The snapshot is sorted so that a directory comes before its contents.
+	// Remember removed directories to remove their contents, too.
+	removedDirs := map[lib.Path]bool{}
+	isInRemovedDir := func(p lib.Path) bool {
+		for d := p.Dir(); !d.IsEmpty(); d = d.Dir() {
+			if removedDirs[d] {
+				return true
+			}
+		}
+		return false
+	}
+	removed := StatusFiles{}
+	reader := snapshot.Reader(nil)
+	buf := lib.NewBlockBuf()
+	for {
+		entry, err := reader.Read(buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, lib.RevisionId{}, lib.WrapErrorf(err, "failed to read revision snapshot")
+		}
+		path, ok := entry.Path.TrimBase(opts.PathPrefix)
+		if !ok {
+			continue
+		}
+		isDir := entry.Metadata.FileMode.IsDir()
+		if !isInRemovedDir(path) && (opts.PathFilter == nil || !opts.PathFilter.Include(path, isDir)) {
+			continue
+		}
+		if isDir {
+			removedDirs[path] = true
+		}
+		removed = append(removed, StatusFile{path, lib.RevisionEntryKindDelete, entry.Metadata, nil})
+		if opts.DryRun {
+			continue
+		}
+		if err := commit.Add(&lib.RevisionEntry{
+			Kind:        lib.RevisionEntryKindDelete,
+			Path:        entry.Path,
+			Metadata:    entry.Metadata,
+			RenamedFrom: nil,
+		}); err != nil {
+			return nil, lib.RevisionId{}, lib.WrapErrorf(err, "failed to add delete entry for %s", path)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, lib.RevisionId{}, ErrNothingToRemove
+	}
+	if opts.DryRun {
+		return removed, commit.BaseRevision, nil
+	}
+	revisionId, err := commit.Commit(ctx, &lib.CommitInfo{Author: opts.Author, Message: opts.Message})
+	if err != nil {
+		return nil, lib.RevisionId{}, lib.WrapErrorf(err, "failed to commit")
+	}
+	return removed, revisionId, nil
+}
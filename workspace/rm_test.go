@@ -0,0 +1,108 @@
+package workspace
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestRm(t *testing.T) {
+	t.Parallel()
+	setup := func(t *testing.T) (*lib.TestRepository, *TestWorkspace) {
+		t.Helper()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		w.Write("b.txt", "b")
+		w.Write("c/1.txt", "c1")
+		w.Write("c/d/2.txt", "cd2")
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		return r, w
+	}
+	rmOptions := func(patterns ...string) *RmOptions {
+		return &RmOptions{
+			PathFilter: lib.NewPathInclusionFilter(patterns),
+			PathPrefix: lib.Path{},
+			Author:     "test author",
+			Message:    "rm",
+			DryRun:     false,
+		}
+	}
+
+	t.Run("Removing a directory removes everything below it", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r, _ := setup(t)
+		removed, revId, err := Rm(t.Context(), r.Repository, rmOptions("c"), td.NewFS(t))
+		assert.NoError(err)
+		assert.Equal(r.Head(), revId)
+		assert.Equal([]string{"D c/", "D c/1.txt", "D c/d/", "D c/d/2.txt"}, formatStatus(removed))
+		ls, err := Ls(t.Context(), r.Repository, td.NewFS(t), wstd.LsOptions(revId))
+		assert.NoError(err)
+		assert.Equal([]lsFileInfo{
+			{"a.txt", 0o600, 1},
+			{"b.txt", 0o600, 1},
+		}, lsFiles(ls))
+	})
+
+	t.Run("The next merge removes the files from the workspace", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r, w := setup(t)
+		_, _, err := Rm(t.Context(), r.Repository, rmOptions("*.txt"), td.NewFS(t))
+		assert.NoError(err)
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.Equal(r.Head(), w.Head())
+		assert.Equal([]lib.TestFileInfo{
+			{"c", 0o700 | fs.ModeDir, 0, ""},
+			{"c/d", 0o700 | fs.ModeDir, 0, ""},
+		}, w.Ls("."))
+	})
+
+	t.Run("Dry-run does not commit", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r, _ := setup(t)
+		head := r.Head()
+		opts := rmOptions("b.txt")
+		opts.DryRun = true
+		removed, revId, err := Rm(t.Context(), r.Repository, opts, td.NewFS(t))
+		assert.NoError(err)
+		assert.Equal(head, revId)
+		assert.Equal(head, r.Head())
+		assert.Equal([]string{"D b.txt"}, formatStatus(removed))
+	})
+
+	t.Run("Patterns match relative to the path prefix", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r, _ := setup(t)
+		opts := rmOptions("d")
+		opts.PathPrefix = td.Path("c")
+		removed, _, err := Rm(t.Context(), r.Repository, opts, td.NewFS(t))
+		assert.NoError(err)
+		assert.Equal([]string{"D d/", "D d/2.txt"}, formatStatus(removed))
+	})
+
+	t.Run("No match returns ErrNothingToRemove", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r, _ := setup(t)
+		head := r.Head()
+		_, _, err := Rm(t.Context(), r.Repository, rmOptions("nope"), td.NewFS(t))
+		assert.ErrorIs(err, ErrNothingToRemove)
+		assert.Equal(head, r.Head())
+	})
+}
+
+func formatStatus(files StatusFiles) []string {
+	result := make([]string, len(files))
+	for i, f := range files {
+		result[i] = f.Format()
+	}
+	return result
+}
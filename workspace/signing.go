@@ -0,0 +1,130 @@
+package workspace
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// The control files in `lib.ControlFileSectionConf` with the signing key of
+// the workspace (see `lib.SigningKey`) and the signers it trusts, one
+// `<name> <signer>` per line.
+const (
+	signingKeyFile     = "signing-key"
+	trustedSignersFile = "trusted-signers"
+	// The name of the workspace's own signer in `TrustedSigners`.
+	SelfSigner = "self"
+)
+
+// Return the signing key of the workspace or nil if it has none.
+func (w *Workspace) SigningKey(ctx context.Context) (*lib.SigningKey, error) {
+	data, err := w.Storage.ReadControlFile(ctx, lib.ControlFileSectionConf, signingKeyFile)
+	if errors.Is(err, lib.ErrControlFileNotFound) {
+		return nil, nil //nolint:nilnil
+	}
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read signing key")
+	}
+	defer clear(data)
+	return lib.ParseSigningKey(string(data)) //nolint:wrapcheck
+}
+
+// Set the key that signs all revisions committed from this workspace.
+// An existing key is only replaced with `overwrite`, the revisions signed
+// with it can only be verified by whoever kept its signer.
+func (w *Workspace) SetSigningKey(ctx context.Context, key *lib.SigningKey, overwrite bool) error {
+	existing, err := w.SigningKey(ctx)
+	if err != nil {
+		return err
+	}
+	if existing != nil && !overwrite {
+		return lib.Errorf("the workspace has a signing key already (signer %s)", existing.Signer())
+	}
+	data := []byte("# signer: " + key.Signer().String() + "\n" + key.String() + "\n")
+	defer clear(data)
+	if err := w.Storage.WriteControlFile(ctx, lib.ControlFileSectionConf, signingKeyFile, data); err != nil {
+		return lib.WrapErrorf(err, "failed to write signing key")
+	}
+	return nil
+}
+
+// Return the signers trusted by this workspace by name. The signer of the
+// workspace's own signing key is always trusted as `SelfSigner`.
+func (w *Workspace) TrustedSigners(ctx context.Context) (map[string]lib.Ed25519PublicKey, error) {
+	signers, err := w.readTrustedSigners(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key, err := w.SigningKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		signers[SelfSigner] = key.Signer()
+	}
+	return signers, nil
+}
+
+// Trust the revisions signed by `signer`, e.g. another device of the same
+// user. `name` identifies the signer in `log --verify`.
+func (w *Workspace) TrustSigner(ctx context.Context, name string, signer lib.Ed25519PublicKey) error {
+	if err := lib.ValidateKeySlotName(name); err != nil {
+		return err //nolint:wrapcheck
+	}
+	if name == SelfSigner {
+		return lib.Errorf("the name %q is reserved for the signing key of the workspace", SelfSigner)
+	}
+	signers, err := w.readTrustedSigners(ctx)
+	if err != nil {
+		return err
+	}
+	for existing, s := range signers {
+		if existing == name {
+			return lib.Errorf("a signer named %q is trusted already", name)
+		}
+		if s == signer {
+			return lib.Errorf("the signer is trusted already as %q", existing)
+		}
+	}
+	signers[name] = signer
+	var data strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(signers)) {
+		data.WriteString(name + " " + signers[name].String() + "\n")
+	}
+	err = w.Storage.WriteControlFile(ctx, lib.ControlFileSectionConf, trustedSignersFile, []byte(data.String()))
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to write trusted signers")
+	}
+	return nil
+}
+
+func (w *Workspace) readTrustedSigners(ctx context.Context) (map[string]lib.Ed25519PublicKey, error) {
+	signers := map[string]lib.Ed25519PublicKey{}
+	data, err := w.Storage.ReadControlFile(ctx, lib.ControlFileSectionConf, trustedSignersFile)
+	if errors.Is(err, lib.ErrControlFileNotFound) {
+		return signers, nil
+	}
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read trusted signers")
+	}
+	for line := range strings.Lines(string(data)) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, s, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, lib.Errorf("invalid trusted signer %q", line)
+		}
+		signer, err := lib.ParseSigner(s)
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+		signers[name] = signer
+	}
+	return signers, nil
+}
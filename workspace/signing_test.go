@@ -0,0 +1,74 @@
+package workspace
+
+import (
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestSigning(t *testing.T) {
+	t.Parallel()
+	t.Run("Trusted signers", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		signers, err := w.TrustedSigners(t.Context())
+		assert.NoError(err)
+		assert.Equal(map[string]lib.Ed25519PublicKey{}, signers)
+
+		key, err := lib.NewSigningKey()
+		assert.NoError(err)
+		assert.NoError(w.SetSigningKey(t.Context(), key, false))
+		assert.Error(w.SetSigningKey(t.Context(), key, false), "the workspace has a signing key already")
+		other, err := lib.NewSigningKey()
+		assert.NoError(err)
+		assert.NoError(w.TrustSigner(t.Context(), "laptop", other.Signer()))
+		assert.Error(w.TrustSigner(t.Context(), "phone", other.Signer()), `trusted already as "laptop"`)
+		assert.Error(w.TrustSigner(t.Context(), SelfSigner, other.Signer()), "reserved")
+		signers, err = w.TrustedSigners(t.Context())
+		assert.NoError(err)
+		assert.Equal(map[string]lib.Ed25519PublicKey{SelfSigner: key.Signer(), "laptop": other.Signer()}, signers)
+		stored, err := w.SigningKey(t.Context())
+		assert.NoError(err)
+		assert.Equal(key.Signer(), stored.Signer())
+	})
+
+	t.Run("Log verifies the signatures", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		trusted, err := lib.NewSigningKey()
+		assert.NoError(err)
+		r.SetSigningKey(trusted)
+		w.Write("b.txt", "b")
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		untrusted, err := lib.NewSigningKey()
+		assert.NoError(err)
+		r.SetSigningKey(untrusted)
+		w.Write("c.txt", "c")
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+
+		opts := &LogOptions{ //nolint:exhaustruct
+			Verify:         true,
+			TrustedSigners: map[string]lib.Ed25519PublicKey{"laptop": trusted.Signer()},
+		}
+		logs, err := Log(t.Context(), r.Repository, opts)
+		assert.NoError(err)
+		assert.Equal(3, len(logs))
+		assert.Equal("UNTRUSTED signer "+untrusted.Signer().String(), logs[0].Signature.String())
+		assert.Equal(false, logs[0].Signature.OK())
+		assert.Equal("good, signed by laptop", logs[1].Signature.String())
+		assert.Equal(true, logs[1].Signature.OK())
+		assert.Equal("none", logs[2].Signature.String())
+		assert.Equal(true, logs[2].Signature.OK())
+		assert.Contains(logs[1].Long(), "\nSignature: good, signed by laptop\n")
+		assert.Contains(logs[2].Short(), " [signature: none] ")
+	})
+}
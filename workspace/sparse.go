@@ -0,0 +1,231 @@
+package workspace
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"slices"
+	"strings"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// The file with the sparse checkout patterns of a workspace (see `SparseFilter`).
+const SparseFile = ".cling/sparse"
+
+// The control file with the sparse checkout patterns of the last merge or
+// reset.
+const appliedSparseFileName = "sparse-applied"
+
+// SparseFilter restricts a workspace to the paths matching its patterns.
+// The patterns have the syntax of `.clingignore` files and are relative to
+// the workspace: a path is included if the last pattern matching it or one of
+// its parent directories is not negated (`!`). Directories on the way to a
+// pattern are included, too, but not their content.
+// Paths outside the patterns are neither downloaded, nor uploaded, nor
+// deleted by `Merge`, `Status`, and `Reset`.
+type SparseFilter struct {
+	source   string
+	patterns lib.ExtendedGlobPatterns
+	// The directories leading to the patterns.
+	parents map[string]bool
+	// Set if a pattern can match in any directory.
+	allDirs bool
+}
+
+func NewSparseFilter(patterns []string) *SparseFilter {
+	source := strings.Join(patterns, "\n")
+	f := &SparseFilter{source, lib.ParseGlobIgnoreFile("", patterns), map[string]bool{}, false}
+	for _, line := range patterns {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+		anchored := strings.HasPrefix(line, "/")
+		parts := strings.Split(strings.Trim(line, "/"), "/")
+		if !anchored && len(parts) == 1 {
+			// A pattern without a slash matches at any depth.
+			f.allDirs = true
+			continue
+		}
+		for i := range len(parts) - 1 {
+			if strings.ContainsAny(parts[i], "*?[\\") {
+				if i == 0 {
+					f.allDirs = true
+				}
+				break
+			}
+			f.parents[strings.Join(parts[:i+1], "/")] = true
+		}
+	}
+	return f
+}
+
+// Read the sparse checkout patterns from `SparseFile`.
+// Return nil if the file does not exist.
+func ReadSparseFilter(fs_ lib.FS) (*SparseFilter, error) {
+	content, err := lib.ReadFile(fs_, SparseFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil //nolint:nilnil
+	}
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read %s", SparseFile)
+	}
+	return NewSparseFilter(strings.Split(string(content), "\n")), nil
+}
+
+func (f *SparseFilter) Include(p lib.Path, isDir bool) bool {
+	for q, qIsDir := p, isDir; !q.IsEmpty(); q, qIsDir = q.Dir(), true {
+		if included, matched := f.match(q.String(), qIsDir); matched {
+			return included
+		}
+	}
+	return isDir && (f.allDirs || f.parents[p.String()])
+}
+
+// Return whether the last pattern matching `path` includes it and whether
+// any pattern matched at all.
+func (f *SparseFilter) match(path string, isDir bool) (included bool, matched bool) {
+	for _, pattern := range f.patterns {
+		if lib.GlobMatch(pattern.GlobPattern, []byte(path), isDir) {
+			included, matched = !pattern.IsNegate, true
+		}
+	}
+	return included, matched
+}
+
+// Apply `filter` to the paths relative to `prefix`. The prefix itself and
+// paths outside of it are included, they are the business of
+// `lib.Path.AsFilter`.
+type relativePathFilter struct {
+	prefix lib.Path
+	filter lib.PathFilter
+}
+
+func (f *relativePathFilter) Include(p lib.Path, isDir bool) bool {
+	rel, ok := p.TrimBase(f.prefix)
+	if !ok {
+		return true
+	}
+	return f.filter.Include(rel, isDir)
+}
+
+// Return a filter for the repository paths the workspace is about, i.e. the
+// paths below `w.PathPrefix` that are included by `w.Sparse`, or nil if
+// that is the whole repository.
+func (w *Workspace) scopeFilter() lib.PathFilter {
+	return allPathFilters(w.PathPrefix.AsFilter(), w.sparseFilter())
+}
+
+// Return `w.Sparse` as a filter for repository paths, or nil if the workspace
+// is not sparse.
+func (w *Workspace) sparseFilter() lib.PathFilter {
+	if w.Sparse == nil {
+		return nil
+	}
+	return &relativePathFilter{w.PathPrefix, w.Sparse}
+}
+
+// Same as `scopeFilter`, but without the paths ignored by the ignore files
+// in the workspace. These are the paths to compare between the workspace and
+// the workspace head.
+func (w *Workspace) trackedFilter() (lib.PathFilter, error) {
+	ignoreFilter, err := w.ignoreFilter()
+	if err != nil {
+		return nil, err
+	}
+	return allPathFilters(w.scopeFilter(), ignoreFilter), nil
+}
+
+// Return a filter for the paths that were tracked by the last merge or reset
+// according to the sparse and ignore patterns back then, or nil if that is
+// the whole repository. Paths that were added to the sparse patterns or
+// un-ignored since are not in the workspace yet, that does not mean they
+// were deleted.
+func (w *Workspace) appliedScopeFilter(ctx context.Context) (lib.PathFilter, error) {
+	applied, err := w.appliedSparse(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var appliedFilter lib.PathFilter
+	if applied != nil {
+		appliedFilter = &relativePathFilter{w.PathPrefix, applied}
+	}
+	appliedIgnore, err := w.appliedIgnorePatterns(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return allPathFilters(appliedFilter, w.ignorePatternsFilter(appliedIgnore)), nil
+}
+
+// Return whether the sparse or ignore patterns changed since the last merge
+// or reset.
+func (w *Workspace) scopeChanged(ctx context.Context) (bool, error) {
+	if changed, err := w.sparseChanged(ctx); err != nil || changed {
+		return changed, err
+	}
+	return w.ignoreChanged(ctx)
+}
+
+// Record the sparse and ignore patterns as applied, called after a
+// successful merge or reset.
+func (w *Workspace) writeAppliedScope(ctx context.Context) error {
+	if err := w.writeAppliedSparse(ctx); err != nil {
+		return err
+	}
+	return w.writeAppliedIgnore(ctx)
+}
+
+// Return whether the sparse patterns changed since the last merge or reset.
+func (w *Workspace) sparseChanged(ctx context.Context) (bool, error) {
+	applied, err := w.appliedSparse(ctx)
+	if err != nil {
+		return false, err
+	}
+	if applied == nil || w.Sparse == nil {
+		return (applied == nil) != (w.Sparse == nil), nil
+	}
+	return applied.source != w.Sparse.source, nil
+}
+
+// Return the sparse patterns of the last merge or reset, nil if the
+// workspace was not sparse.
+func (w *Workspace) appliedSparse(ctx context.Context) (*SparseFilter, error) {
+	data, err := w.Storage.ReadControlFile(ctx, lib.ControlFileSectionConf, appliedSparseFileName)
+	if errors.Is(err, lib.ErrControlFileNotFound) {
+		return nil, nil //nolint:nilnil
+	}
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read the applied sparse patterns")
+	}
+	return NewSparseFilter(strings.Split(string(data), "\n")), nil
+}
+
+// Record `w.Sparse` as applied, called after a successful merge or reset.
+func (w *Workspace) writeAppliedSparse(ctx context.Context) error {
+	if w.Sparse == nil {
+		err := w.Storage.DeleteControlFile(ctx, lib.ControlFileSectionConf, appliedSparseFileName)
+		if err != nil && !errors.Is(err, lib.ErrControlFileNotFound) {
+			return lib.WrapErrorf(err, "failed to delete the applied sparse patterns")
+		}
+		return nil
+	}
+	err := w.Storage.WriteControlFile(ctx, lib.ControlFileSectionConf, appliedSparseFileName, []byte(w.Sparse.source))
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to write the applied sparse patterns")
+	}
+	return nil
+}
+
+// Combine the non-nil filters, return nil if there are none.
+func allPathFilters(filters ...lib.PathFilter) lib.PathFilter {
+	filters = slices.DeleteFunc(filters, func(f lib.PathFilter) bool { return f == nil })
+	switch len(filters) {
+	case 0:
+		return nil
+	case 1:
+		return filters[0]
+	default:
+		return &lib.AllPathFilter{Filters: filters}
+	}
+}
@@ -0,0 +1,155 @@
+package workspace
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestSparseFilter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Include", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		f := NewSparseFilter([]string{"# comment", "/docs", "!docs/tmp", "photos/2024/**", "", "/notes/*.md"})
+		tests := []struct {
+			path     string
+			isDir    bool
+			expected bool
+		}{
+			{"docs", true, true},
+			{"docs/a.txt", false, true},
+			{"docs/sub/b.txt", false, true},
+			{"docs/tmp", true, false},
+			{"docs/tmp/c.txt", false, false},
+			{"photos", true, true},
+			{"photos/a.jpg", false, false},
+			{"photos/2023", true, false},
+			{"photos/2024", true, true},
+			{"photos/2024/a.jpg", false, true},
+			{"notes", true, true},
+			{"notes/a.md", false, true},
+			{"notes/a.txt", false, false},
+			{"other", true, false},
+			{"other/docs", true, false},
+			{"top.txt", false, false},
+		}
+		for _, test := range tests {
+			assert.Equal(test.expected, f.Include(td.Path(test.path), test.isDir), test.path)
+		}
+	})
+
+	t.Run("Unanchored patterns match in every directory", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		f := NewSparseFilter([]string{"*.md"})
+		assert.Equal(true, f.Include(td.Path("a/b"), true))
+		assert.Equal(true, f.Include(td.Path("a/b/c.md"), false))
+		assert.Equal(false, f.Include(td.Path("a/b/c.txt"), false))
+	})
+}
+
+func TestSparseWorkspace(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	w := wstd.NewTestWorkspace(t, r.Repository)
+	w.Write("docs/a.txt", "a")
+	w.Write("photos/p.jpg", "p")
+	w.Write("top.txt", "t")
+	_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	first := r.Head()
+
+	w2 := wstd.NewTestWorkspace(t, r.Repository)
+	w2.Write(SparseFile, "/docs\n")
+	w2.Workspace.Sparse, err = ReadSparseFilter(w2.Workspace.FS)
+	assert.NoError(err)
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	assert.Equal([]lib.TestFileInfo{
+		{"docs", 0o700 | fs.ModeDir, 0, ""},
+		{"docs/a.txt", 0o600, 1, "a"},
+	}, w2.Ls("."))
+
+	// Local paths outside the patterns are neither committed nor deleted.
+	w2.Write("photos/local.jpg", "l")
+	status, err := Status(t.Context(), w2.Workspace, r.Repository, wstd.StatusOptions(), td.NewFS(t))
+	assert.NoError(err)
+	assert.Equal(0, len(status))
+
+	// Remote changes outside the patterns are not applied.
+	w.Rm("photos/p.jpg")
+	w.Write("photos/q.jpg", "q")
+	w.Write("docs/a.txt", "aa")
+	_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	w2.Write("docs/b.txt", "b")
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	assert.Equal([]lib.TestFileInfo{
+		{"docs", 0o700 | fs.ModeDir, 0, ""},
+		{"docs/a.txt", 0o600, 2, "aa"},
+		{"docs/b.txt", 0o600, 1, "b"},
+		{"photos", 0o700 | fs.ModeDir, 0, ""},
+		{"photos/local.jpg", 0o600, 1, "l"},
+	}, w2.Ls("."))
+	_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	assert.Equal("b", w.Cat("docs/b.txt"))
+	assert.Equal("q", w.Cat("photos/q.jpg"))
+
+	// Reset only touches the paths inside the patterns.
+	err = Reset(t.Context(), w2.Workspace, r.Repository, wstd.ResetOptions(first, false))
+	assert.NoError(err)
+	assert.Equal([]lib.TestFileInfo{
+		{"docs", 0o700 | fs.ModeDir, 0, ""},
+		{"docs/a.txt", 0o600, 1, "a"},
+		{"photos", 0o700 | fs.ModeDir, 0, ""},
+		{"photos/local.jpg", 0o600, 1, "l"},
+	}, w2.Ls("."))
+}
+
+func TestSparseWorkspaceChangePatterns(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	w := wstd.NewTestWorkspace(t, r.Repository)
+	w.Write("docs/a.txt", "a")
+	w.Write("photos/p.jpg", "p")
+	_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	head := r.Head()
+
+	w2 := wstd.NewTestWorkspace(t, r.Repository)
+	w2.Write(SparseFile, "/docs\n")
+	w2.Workspace.Sparse, err = ReadSparseFilter(w2.Workspace.FS)
+	assert.NoError(err)
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+
+	// Widening the patterns is not a local delete, the new paths are fetched.
+	w2.Write(SparseFile, "/docs\n/photos\n")
+	w2.Workspace.Sparse, err = ReadSparseFilter(w2.Workspace.FS)
+	assert.NoError(err)
+	status, err := Status(t.Context(), w2.Workspace, r.Repository, wstd.StatusOptions(), td.NewFS(t))
+	assert.NoError(err)
+	assert.Equal(0, len(status))
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	assert.Equal(head, r.Head())
+	assert.Equal("p", w2.Cat("photos/p.jpg"))
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+	assert.ErrorIs(err, ErrUpToDate)
+
+	// Narrowing the patterns keeps the files that are no longer covered.
+	w2.Write(SparseFile, "/docs\n")
+	w2.Workspace.Sparse, err = ReadSparseFilter(w2.Workspace.FS)
+	assert.NoError(err)
+	_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	assert.Equal(head, r.Head())
+	assert.Equal("p", w2.Cat("photos/p.jpg"))
+}
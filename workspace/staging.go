@@ -1,12 +1,15 @@
 package workspace
 
 import (
+	"context"
 	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"io"
 	"io/fs"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/flunderpero/cling-sync/lib"
@@ -15,19 +18,34 @@ import (
 const (
 	cacheDir           = workspaceDir + "/cache"
 	cacheFinalDir      = cacheDir + "/staging"
+	cachePartialDir    = cacheDir + "/staging-partial"
 	cacheTempDirPrefix = ".staging-tmp-"
+	// The fingerprint of the key the staging cache is encrypted with. It
+	// does not exist if the cache is not encrypted.
+	cacheKeyPath = cacheDir + "/staging-key"
 )
 
-var ErrSymLinkTargetEscapes = lib.Errorf("symlink target escapes path root")
+var (
+	ErrSymLinkTargetEscapes = lib.Errorf("symlink target escapes path root")
+	ErrStagingOutOfSpace    = lib.Errorf("out of temporary space while scanning")
+	ErrUnsupportedFileType  = lib.Errorf("unsupported file type")
+)
 
 type StagingEntryMonitor interface {
 	OnStart(path lib.Path, dirEntry fs.DirEntry) error
 	OnEnd(path lib.Path, excluded bool, metadata *lib.PathMetadata) error
+	// Called instead of `OnStart` and `OnEnd` for paths that cannot be
+	// archived, i.e. sockets, FIFOs, and device nodes. These paths are
+	// skipped unless an error is returned, which aborts the scan.
+	OnUnsupported(path lib.Path, dirEntry fs.DirEntry) error
 }
 
 type Staging struct {
 	PathFilter lib.PathFilter
 	pathPrefix lib.Path
+	// Paths of the revision snapshot that are not in staging are only deleted
+	// if they are included by this filter (see `MergeWithSnapshot`).
+	deletable  lib.PathFilter
 	tempWriter *lib.TempWriter[*StagingEntry]
 	temp       *lib.Temp[*StagingEntry]
 	tmpFS      lib.FS
@@ -37,30 +55,170 @@ type Staging struct {
 // `.cling` is always ignored.
 // If `pathPrefix` is not empty, it will be prepended to all paths *after* the
 // `pathFilter` is applied.
-func NewStaging( //nolint:funlen
+// If the scan fails, the file hashes computed so far are kept in the staging
+// cache and the next scan does not compute them again (see `StagingCache`).
+// Files with more than one hard link are only hashed once, they all get the
+// path of the first of them as `lib.PathMetadata.HardLinkGroup`.
+// The extended attributes are always recorded, `NewReadOnlyStaging` and
+// `newWorkspaceStaging` only record them with `lib.RestorableMetadataXattrs`.
+// Return `ErrStagingOutOfSpace` if `tmp` (or the workspace) ran out of space.
+func NewStaging(
+	src lib.FS,
+	pathPrefix lib.Path,
+	pathFilter lib.PathFilter,
+	useCache bool,
+	tmp lib.FS,
+	mon StagingEntryMonitor,
+) (*Staging, error) {
+	return newStaging(src, pathPrefix, pathFilter, useCache, nil, tmp, mon)
+}
+
+// Same as `NewStaging` without a staging cache, but nothing is written to
+// `src`: the cache of the scan is kept in `tmp` and leftover temp files of
+// atomic writes are skipped instead of removed. Used to scan directories
+// that are not a workspace.
+func NewReadOnlyStaging(
+	src lib.FS,
+	pathPrefix lib.Path,
+	pathFilter lib.PathFilter,
+	restorableMetadataFlag lib.RestorableMetadataFlag,
+	tmp lib.FS,
+	mon StagingEntryMonitor,
+) (*Staging, error) {
+	xattrs := restorableMetadataFlag&lib.RestorableMetadataXattrs != 0
+	return scanStaging(src, pathPrefix, pathFilter, false, nil, xattrs, nil, true, true, tmp, mon)
+}
+
+// Same as `NewStaging`, but if `journal` is given (and `useCache` is `true`),
+// directories that did not change according to the watch journal are not
+// scanned, their entries are taken from the staging cache (see
+// `RunWatchJournal`). `journal` must be read before the scan starts.
+func newStaging(
+	src lib.FS,
+	pathPrefix lib.Path,
+	pathFilter lib.PathFilter,
+	useCache bool,
+	journal *WatchJournalPosition,
+	tmp lib.FS,
+	mon StagingEntryMonitor,
+) (*Staging, error) {
+	return scanStaging(src, pathPrefix, pathFilter, useCache, nil, true, journal, false, true, tmp, mon)
+}
+
+// Same as `newStaging` for the workspace `ws`. If `ws.NoRepoIgnore` is set,
+// the ignore files are not respected and the watch journal is not used (it
+// does not track ignored directories). If `ws.EncryptCache` is set, the
+// staging cache is encrypted with a key derived from `repository`.
+// Paths outside the sparse and ignore patterns of the last merge or reset are
+// not deleted by `MergeWithSnapshot`, they were never in the workspace.
+// The extended attributes are only read with `lib.RestorableMetadataXattrs`
+// in `restorableMetadataFlag`.
+func newWorkspaceStaging(
+	ctx context.Context,
+	ws *Workspace,
+	repository *lib.Repository,
+	pathFilter lib.PathFilter,
+	useCache bool,
+	restorableMetadataFlag lib.RestorableMetadataFlag,
+	journal *WatchJournalPosition,
+	tmp lib.FS,
+	mon StagingEntryMonitor,
+) (*Staging, error) {
+	if ws.NoRepoIgnore {
+		journal = nil
+	}
+	deletable, err := ws.appliedScopeFilter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cacheKey, err := ws.cacheKey(repository)
+	if err != nil {
+		return nil, err
+	}
+	staging, err := scanStaging(
+		ws.FS,
+		ws.PathPrefix,
+		pathFilter,
+		useCache,
+		cacheKey,
+		restorableMetadataFlag&lib.RestorableMetadataXattrs != 0,
+		journal,
+		false,
+		!ws.NoRepoIgnore,
+		tmp,
+		mon,
+	)
+	if err != nil {
+		return nil, err
+	}
+	staging.deletable = deletable
+	return staging, nil
+}
+
+func scanStaging( //nolint:funlen
 	src lib.FS,
 	pathPrefix lib.Path,
 	pathFilter lib.PathFilter,
 	useCache bool,
+	cacheKey *lib.RawKey,
+	xattrs bool,
+	journal *WatchJournalPosition,
+	readOnly bool,
+	ignoreFiles bool,
 	tmp lib.FS,
 	mon StagingEntryMonitor,
 ) (*Staging, error) {
 	revisionEntryWriter := NewStagingCacheWriter(tmp, lib.DefaultTempChunkSize)
-	cache, err := NewStagingCache(src, useCache)
+	cacheRoot := src
+	if readOnly {
+		var err error
+		if cacheRoot, err = tmp.MkSub("staging-cache"); err != nil {
+			return nil, lib.WrapErrorf(err, "failed to create staging cache directory")
+		}
+	}
+	cache, err := newStagingCache(src, cacheRoot, useCache, cacheKey, xattrs)
 	if err != nil {
 		return nil, lib.WrapErrorf(err, "failed to create staging cache")
 	}
 	defer cache.Cleanup() //nolint:errcheck
-	staging := &Staging{pathFilter, pathPrefix, revisionEntryWriter, nil, tmp}
-	err = lib.WalkDirIgnore(src, ".", func(path_ string, d fs.DirEntry, err error) (retErr error) {
+	var changes *watchJournalChanges
+	if journal != nil && cache.cache != nil {
+		changes, err = readWatchJournalChanges(src, *journal)
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to read watch journal")
+		}
+	}
+	if pathFilter == nil {
+		// Only a complete scan matches the journal position.
+		cache.journal = journal
+	}
+	staging := &Staging{pathFilter, pathPrefix, nil, revisionEntryWriter, nil, tmp}
+	links := map[hardLinkKey]hardLink{}
+	// Stage everything below the unchanged directory `localPath` from the cache.
+	copyUnchanged := func(localPath lib.Path) error {
+		prefix := ""
+		if repoPath := pathPrefix.Join(localPath); !repoPath.IsEmpty() {
+			prefix = lib.PathCompareString(repoPath, true) + "/"
+		}
+		return cache.CopyFromCache(prefix, staging.add) //nolint:wrapcheck
+	}
+	err = walkDir(src, ".", ignoreFiles, func(path_ string, d fs.DirEntry, err error) (retErr error) {
 		if err != nil {
 			return err
 		}
 		if path_ == "." {
+			if changes != nil && changes.unchanged(lib.Path{}) {
+				if err := copyUnchanged(lib.Path{}); err != nil {
+					return lib.WrapErrorf(err, "failed to stage the workspace from the cache")
+				}
+				return fs.SkipAll
+			}
 			return nil
 		}
 		if lib.IsAtomicWriteTempFile(path_) {
-			_ = src.Remove(path_)
+			if !readOnly {
+				_ = src.Remove(path_)
+			}
 			return nil
 		}
 		localPath, err := lib.NewPath(path_)
@@ -76,7 +234,12 @@ func NewStaging( //nolint:funlen
 		}
 		isSymlink := d.Type()&fs.ModeSymlink != 0
 		if !d.Type().IsRegular() && !d.Type().IsDir() && !isSymlink {
-			// This filetype is not supported - we ignore it silently.
+			if pathFilter != nil && !pathFilter.Include(pathPrefix.Join(localPath), false) {
+				return nil
+			}
+			if err := mon.OnUnsupported(localPath, d); err != nil {
+				return lib.WrapErrorf(err, "staging monitor failed for unsupported file %s", localPath)
+			}
 			return nil
 		}
 		if err := mon.OnStart(localPath, d); err != nil {
@@ -93,14 +256,14 @@ func NewStaging( //nolint:funlen
 		}()
 		// Eager exclusion so we don't hash excluded files or recurse into
 		// excluded directories.
-		if pathFilter != nil && !pathFilter.Include(localPath, d.IsDir()) {
+		repoPath := pathPrefix.Join(localPath)
+		if pathFilter != nil && !pathFilter.Include(repoPath, d.IsDir()) {
 			excluded = true
 			if d.IsDir() {
 				return filepath.SkipDir
 			}
 			return nil
 		}
-		repoPath := pathPrefix.Join(localPath)
 		var entry *StagingEntry
 		if isSymlink {
 			target, err := src.ReadLink(localPath.String())
@@ -126,19 +289,60 @@ func NewStaging( //nolint:funlen
 				return lib.WrapErrorf(err, "failed to build staging entry for %s", localPath)
 			}
 			entry.Metadata.SymLinkTarget = &repoTarget
+			// Symlinks are cached, too, so that unchanged directories can be
+			// staged from the cache completely.
+			if err := cache.Add(entry); err != nil {
+				return lib.WrapErrorf(err, "failed to add cache entry for %s", localPath)
+			}
 		} else {
-			entry, err = cache.Handle(localPath, repoPath, fileInfo)
-			if err != nil {
-				return lib.WrapErrorf(err, "failed to stage %s", localPath)
+			key, isLink := newHardLinkKey(fileInfo)
+			first, seen := links[key]
+			switch {
+			case isLink && seen:
+				// The file was hashed already, it is only read once.
+				entry, err = NewStagingEntry(repoPath, fileInfo, fileInfo.Size(), first.fileHash, nil)
+				if err != nil {
+					return lib.WrapErrorf(err, "failed to build staging entry for %s", localPath)
+				}
+				entry.Metadata.HardLinkGroup = &first.group
+				entry.Metadata.Xattrs = first.xattrs
+				if err := cache.Add(entry); err != nil {
+					return lib.WrapErrorf(err, "failed to add cache entry for %s", localPath)
+				}
+			case isLink:
+				entry, err = cache.Handle(localPath, repoPath, fileInfo, &repoPath)
+				if err != nil {
+					return lib.WrapErrorf(err, "failed to stage %s", localPath)
+				}
+				links[key] = hardLink{repoPath, entry.Metadata.FileHash, entry.Metadata.Xattrs}
+			default:
+				entry, err = cache.Handle(localPath, repoPath, fileInfo, nil)
+				if err != nil {
+					return lib.WrapErrorf(err, "failed to stage %s", localPath)
+				}
 			}
 		}
 		entryMD = &entry.Metadata
 		if err := staging.add(entry); err != nil {
 			return lib.WrapErrorf(err, "failed to add %s to staging (as %s)", localPath, repoPath)
 		}
+		if d.IsDir() && changes != nil && changes.unchanged(localPath) {
+			if err := copyUnchanged(localPath); err != nil {
+				return lib.WrapErrorf(err, "failed to stage %s from the cache", localPath)
+			}
+			return filepath.SkipDir
+		}
 		return nil
 	})
 	if err != nil {
+		_ = cache.SavePartial()
+		if errors.Is(err, io.ErrShortWrite) || errors.Is(err, syscall.ENOSPC) {
+			return nil, lib.WrapErrorf(
+				ErrStagingOutOfSpace,
+				"%s (free some space and try again, files already scanned are not hashed again)",
+				err,
+			)
+		}
 		return nil, lib.WrapErrorf(err, "failed to walk directory %s", src)
 	}
 	if err := cache.Finalize(); err != nil {
@@ -147,6 +351,31 @@ func NewStaging( //nolint:funlen
 	return staging, nil
 }
 
+// A file with more than one hard link.
+type hardLinkKey struct {
+	device uint64
+	inode  uint64
+}
+
+// The first link to a `hardLinkKey` staged by a scan.
+type hardLink struct {
+	group    lib.Path
+	fileHash lib.Sha256
+	xattrs   []*lib.Xattr
+}
+
+// Return the key of a regular file with more than one hard link.
+func newHardLinkKey(fileInfo fs.FileInfo) (hardLinkKey, bool) {
+	if !fileInfo.Mode().IsRegular() {
+		return hardLinkKey{}, false
+	}
+	stat, err := lib.EnhancedStat(fileInfo)
+	if err != nil || stat.Nlink < 2 {
+		return hardLinkKey{}, false
+	}
+	return hardLinkKey{stat.Device, stat.Inode}, true
+}
+
 func (s *Staging) Finalize() (*lib.Temp[*StagingEntry], error) {
 	if s.temp == nil {
 		t, err := s.tempWriter.Finalize()
@@ -164,6 +393,7 @@ func (s *Staging) Finalize() (*lib.Temp[*StagingEntry], error) {
 // If `suppressDeletes` is `true`, paths that are in the revision snapshot but
 // not in staging do not produce `Delete` entries. Used when the diff baseline
 // is the repository head rather than the workspace head (attach-non-empty).
+// Otherwise, only paths included by `s.deletable` (if set) do.
 func (s *Staging) MergeWithSnapshot( //nolint:funlen
 	snapshot *lib.Temp[*lib.RevisionEntry],
 	restorableMetadataFlag lib.RestorableMetadataFlag,
@@ -190,10 +420,11 @@ func (s *Staging) MergeWithSnapshot( //nolint:funlen
 	}
 	finalWriter := lib.NewRevisionEntryTempWriter(final, lib.MaxBlockDataSize)
 	add := func(path lib.Path, kind lib.RevisionEntryKind, md lib.PathMetadata) error {
-		if suppressDeletes && kind == lib.RevisionEntryKindDelete {
+		if kind == lib.RevisionEntryKindDelete &&
+			(suppressDeletes || s.deletable != nil && !s.deletable.Include(path, md.FileMode.IsDir())) {
 			return nil
 		}
-		re := lib.RevisionEntry{Kind: kind, Path: path, Metadata: md}
+		re := lib.RevisionEntry{Kind: kind, Path: path, Metadata: md, RenamedFrom: nil}
 		if err := finalWriter.Add(&re); err != nil {
 			return lib.WrapErrorf(err, "failed to write revision entry for path %s", path)
 		}
@@ -310,14 +541,42 @@ func (s *Staging) add(stagingEntry *StagingEntry) error {
 	return nil
 }
 
+// The staging cache remembers the file hashes of the last scan.
+// All entries are written to a temp dir inside the workspace while scanning.
+// After a successful scan, the temp dir replaces the cache (`Finalize`).
+// If the scan fails, the entries written so far are saved as the partial
+// cache (`SavePartial`). The next scan uses the partial cache like the
+// cache, i.e. only if `useCache` is `true`. Otherwise both are ignored and
+// replaced once the scan finishes.
 type StagingCache struct {
-	src          lib.FS
+	src lib.FS
+	// The directory that contains the cache directory, usually `src`.
+	root         lib.FS
 	cacheTempDir string
 	cacheWriter  *lib.TempWriter[*StagingEntry]
 	cache        *lib.TempCache[*StagingEntry]
+	partial      *lib.TempCache[*StagingEntry]
+	// Whether the extended attributes are read.
+	xattrs bool
+	// The watch journal position the new cache corresponds to, if any.
+	journal *WatchJournalPosition
 }
 
 func NewStagingCache(src lib.FS, useCache bool) (*StagingCache, error) {
+	return newStagingCache(src, src, useCache, nil, true)
+}
+
+// Same as `NewStagingCache`, but the cache directories are in `root`. If
+// `key` is given, the cache is encrypted with it. A cache that was written
+// with another key (or without one) is dropped, see `checkStagingCacheKey`.
+// The extended attributes are only read if `xattrs` is set.
+func newStagingCache(
+	src lib.FS,
+	root lib.FS,
+	useCache bool,
+	key *lib.RawKey,
+	xattrs bool,
+) (*StagingCache, error) {
 	rand, err := lib.RandStr(32)
 	if err != nil {
 		return nil, lib.WrapErrorf(err, "failed to generate random string for cache temp dir")
@@ -325,39 +584,126 @@ func NewStagingCache(src lib.FS, useCache bool) (*StagingCache, error) {
 	cacheTempDir := filepath.Join(cacheDir, cacheTempDirPrefix+rand)
 	var cacheWriter *lib.TempWriter[*StagingEntry]
 	var cache *lib.TempCache[*StagingEntry]
-	cacheTempFS, err := src.MkSub(cacheTempDir)
+	cacheTempFS, err := root.MkSub(cacheTempDir)
 	if err != nil {
 		return nil, lib.WrapErrorf(err, "failed to create cache tmp dir")
 	}
+	if err := checkStagingCacheKey(root, key); err != nil {
+		return nil, err
+	}
+	// The journal marker and the key fingerprint are not encrypted, only the
+	// cache directories are.
+	encrypt := func(fs_ lib.FS) (lib.FS, error) {
+		if key == nil {
+			return fs_, nil
+		}
+		return lib.NewEncryptedFSWithKey(fs_, *key) //nolint:wrapcheck
+	}
+	if cacheTempFS, err = encrypt(cacheTempFS); err != nil {
+		return nil, lib.WrapErrorf(err, "failed to encrypt cache tmp dir")
+	}
 	cacheWriter = NewStagingCacheWriter(cacheTempFS, lib.MaxBlockDataSize)
 	if useCache {
-		cacheFS, err := src.Sub(cacheFinalDir)
+		cacheFS, err := root.Sub(cacheFinalDir)
 		if err != nil && !errors.Is(err, fs.ErrNotExist) {
 			return nil, lib.WrapErrorf(err, "failed to open cache dir")
 		}
 		if err == nil {
-			cache, err = OpenStagingCache(cacheFS, 10) // todo: Choose a reasonable max chunks in cache.
+			if cacheFS, err = encrypt(cacheFS); err != nil {
+				return nil, lib.WrapErrorf(err, "failed to encrypt cache dir")
+			}
+			cache, err = OpenStagingCache(cacheFS, lib.TempCacheOptions{})
 			if err != nil {
 				return nil, lib.WrapErrorf(err, "failed to open cache")
 			}
 		}
 	}
+	var partial *lib.TempCache[*StagingEntry]
+	if useCache {
+		partialFS, err := root.Sub(cachePartialDir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, lib.WrapErrorf(err, "failed to open partial cache dir")
+		}
+		if err == nil {
+			if partialFS, err = encrypt(partialFS); err != nil {
+				return nil, lib.WrapErrorf(err, "failed to encrypt partial cache dir")
+			}
+			partial, err = OpenStagingCache(partialFS, lib.TempCacheOptions{})
+			if err != nil {
+				return nil, lib.WrapErrorf(err, "failed to open partial cache")
+			}
+		}
+	}
 	return &StagingCache{
 		src:          src,
+		root:         root,
 		cacheTempDir: cacheTempDir,
 		cacheWriter:  cacheWriter,
 		cache:        cache,
+		partial:      partial,
+		xattrs:       xattrs,
+		journal:      nil,
 	}, nil
 }
 
+// The purpose of the key the staging cache is encrypted with (see
+// `lib.Repository.DeriveKey`).
+const stagingCacheKeyPurpose = "staging cache"
+
+// Drop the staging cache in `root` unless it was written with `key`, i.e.
+// the fingerprint of the key in `cacheKeyPath` matches. Then record the
+// fingerprint of `key`, or remove it if `key` is nil.
+func checkStagingCacheKey(root lib.FS, key *lib.RawKey) error {
+	fingerprint := ""
+	if key != nil {
+		hmac := lib.CalculateHmac([]byte(stagingCacheKeyPurpose), *key)
+		fingerprint = hex.EncodeToString(hmac[:])
+	}
+	current, err := lib.ReadFile(root, cacheKeyPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return lib.WrapErrorf(err, "failed to read %s", cacheKeyPath)
+	}
+	if string(current) == fingerprint {
+		return nil
+	}
+	for _, dir := range []string{cacheFinalDir, cachePartialDir} {
+		if err := root.RemoveAll(dir); err != nil {
+			return lib.WrapErrorf(err, "failed to remove %s", dir)
+		}
+	}
+	if err := writeStagingJournalMarker(root, nil); err != nil {
+		return err
+	}
+	if key == nil {
+		if err := root.Remove(cacheKeyPath); err != nil {
+			return lib.WrapErrorf(err, "failed to remove %s", cacheKeyPath)
+		}
+		return nil
+	}
+	if err := lib.AtomicWriteFile(root, cacheKeyPath, 0o600, []byte(fingerprint)); err != nil {
+		return lib.WrapErrorf(err, "failed to write %s", cacheKeyPath)
+	}
+	return nil
+}
+
 // Return the metadata either from the cache or compute it.
 // Update the cache.
-func (c *StagingCache) Handle(localPath lib.Path, repoPath lib.Path, fileInfo fs.FileInfo) (*StagingEntry, error) {
+// `hardLinkGroup` is set as `lib.PathMetadata.HardLinkGroup` of the entry.
+func (c *StagingCache) Handle(
+	localPath lib.Path,
+	repoPath lib.Path,
+	fileInfo fs.FileInfo,
+	hardLinkGroup *lib.Path,
+) (*StagingEntry, error) {
 	var fileMetadata *lib.PathMetadata
 	var stagingEntry *StagingEntry
+	var holes []*lib.Hole
 	var err error
-	if c.cache != nil {
-		existingEntry, ok, err := c.cache.Get(lib.PathCompareString(repoPath, fileInfo.IsDir()))
+	for _, cache := range []*lib.TempCache[*StagingEntry]{c.partial, c.cache} {
+		if cache == nil || fileMetadata != nil {
+			continue
+		}
+		existingEntry, ok, err := cache.Get(lib.PathCompareString(repoPath, fileInfo.IsDir()))
 		if err != nil {
 			return nil, lib.WrapErrorf(err, "failed to get entry from cache for %s", localPath)
 		}
@@ -380,6 +726,8 @@ func (c *StagingCache) Handle(localPath lib.Path, repoPath lib.Path, fileInfo fs
 					existingEntry.Metadata.BlockIds,
 				)
 				fileMetadata = &md
+				// Filling or punching a hole changes the ctime.
+				holes = existingEntry.Metadata.Holes
 			}
 		}
 	}
@@ -389,6 +737,11 @@ func (c *StagingCache) Handle(localPath lib.Path, repoPath lib.Path, fileInfo fs
 			return nil, lib.WrapErrorf(err, "failed to get metadata for %s", localPath)
 		}
 		fileMetadata = &md
+		if lib.MayHaveHoles(fileInfo) {
+			if holes, err = c.src.Holes(localPath.String()); err != nil {
+				return nil, lib.WrapErrorf(err, "failed to read the holes of %s", localPath)
+			}
+		}
 	}
 	if stagingEntry == nil {
 		stagingEntry, err = NewStagingEntry(
@@ -402,32 +755,83 @@ func (c *StagingCache) Handle(localPath lib.Path, repoPath lib.Path, fileInfo fs
 			return nil, lib.WrapErrorf(err, "failed to create cache entry for %s", localPath)
 		}
 	}
+	stagingEntry.Metadata.HardLinkGroup = hardLinkGroup
+	if c.xattrs {
+		xattrs, err := c.src.Xattrs(localPath.String())
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to read extended attributes of %s", localPath)
+		}
+		stagingEntry.Metadata.Xattrs = xattrs
+	}
+	stagingEntry.Metadata.Holes = holes
 	if err := c.cacheWriter.Add(stagingEntry); err != nil {
 		return nil, lib.WrapErrorf(err, "failed to add cache entry for %s", localPath)
 	}
 	return stagingEntry, nil
 }
 
+// Add an entry that is not handled by `Handle` to the new cache.
+func (c *StagingCache) Add(stagingEntry *StagingEntry) error {
+	return c.cacheWriter.Add(stagingEntry) //nolint:wrapcheck
+}
+
+// Call `add` for all entries of the cache whose cache key starts with
+// `prefix` and add them to the new cache.
+func (c *StagingCache) CopyFromCache(prefix string, add func(*StagingEntry) error) error {
+	return c.cache.ScanPrefix(prefix, func(entry *StagingEntry) error { //nolint:wrapcheck
+		if err := add(entry); err != nil {
+			return err
+		}
+		return c.cacheWriter.Add(entry)
+	})
+}
+
 func (c *StagingCache) Finalize() error {
 	if _, err := c.cacheWriter.Finalize(); err != nil {
 		return lib.WrapErrorf(err, "failed to finalize cache writer")
 	}
+	// The marker belongs to the cache that is about to be replaced.
+	if err := writeStagingJournalMarker(c.root, nil); err != nil {
+		return err
+	}
 	// Move the cache to the final location.
-	if err := c.src.RemoveAll(cacheFinalDir); err != nil {
+	if err := c.root.RemoveAll(cacheFinalDir); err != nil {
 		return lib.WrapErrorf(err, "failed to remove cache dir")
 	}
-	if err := c.src.Rename(c.cacheTempDir, cacheFinalDir); err != nil {
+	if err := c.root.Rename(c.cacheTempDir, cacheFinalDir); err != nil {
 		return lib.WrapErrorf(err, "failed to move temp cache dir %s to %s", c.cacheTempDir, cacheFinalDir)
 	}
+	if err := c.root.RemoveAll(cachePartialDir); err != nil {
+		return lib.WrapErrorf(err, "failed to remove partial cache dir")
+	}
+	if c.journal != nil {
+		return writeStagingJournalMarker(c.root, c.journal)
+	}
+	return nil
+}
+
+// Save the entries handled so far as the partial cache for the next scan.
+// The entries include those taken from the previous partial cache, so
+// repeated failures make progress as long as each scan gets further.
+func (c *StagingCache) SavePartial() error {
+	if _, err := c.cacheWriter.Finalize(); err != nil {
+		return lib.WrapErrorf(err, "failed to finalize cache writer")
+	}
+	if err := c.root.RemoveAll(cachePartialDir); err != nil {
+		return lib.WrapErrorf(err, "failed to remove partial cache dir")
+	}
+	if err := c.root.Rename(c.cacheTempDir, cachePartialDir); err != nil {
+		return lib.WrapErrorf(err, "failed to move temp cache dir %s to %s", c.cacheTempDir, cachePartialDir)
+	}
 	return nil
 }
 
 // Remove the current and all temp cache directories if they are alder than one day.
 func (c *StagingCache) Cleanup() error {
-	if err := c.src.RemoveAll(c.cacheTempDir); err != nil {
+	if err := c.root.RemoveAll(c.cacheTempDir); err != nil {
 		return lib.WrapErrorf(err, "failed to remove cache temp dir %s", c.cacheTempDir)
 	}
-	files, err := c.src.ReadDir(cacheDir)
+	files, err := c.root.ReadDir(cacheDir)
 	if err != nil {
 		return lib.WrapErrorf(err, "failed to find stale cache dirs")
 	}
@@ -438,7 +842,7 @@ func (c *StagingCache) Cleanup() error {
 				return lib.WrapErrorf(err, "failed to get file info for %s", f.Name())
 			}
 			if time.Since(fileInfo.ModTime()) > time.Hour*24 {
-				if err := c.src.RemoveAll(filepath.Join(cacheDir, f.Name())); err != nil {
+				if err := c.root.RemoveAll(filepath.Join(cacheDir, f.Name())); err != nil {
 					return lib.WrapErrorf(err, "failed to remove stale cache dir %s", f.Name())
 				}
 			}
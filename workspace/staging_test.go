@@ -1,9 +1,12 @@
 package workspace
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"io/fs"
+	"path/filepath"
+	"syscall"
 	"testing"
 
 	"github.com/flunderpero/cling-sync/lib"
@@ -279,6 +282,75 @@ func TestStagingSymlinks(t *testing.T) {
 	})
 }
 
+func TestStagingUnsupportedFileTypes(t *testing.T) {
+	t.Parallel()
+	setup := func(t *testing.T) *TestWorkspace {
+		t.Helper()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		w.Write("b/c.txt", "c")
+		realFS, ok := w.Workspace.FS.(*lib.RealFS)
+		assert.Equal(true, ok)
+		assert.NoError(syscall.Mkfifo(filepath.Join(realFS.BasePath, "b", "fifo"), 0o600))
+		return w
+	}
+
+	t.Run("Unsupported files are reported to the monitor and skipped", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		w := setup(t)
+		var lines []string
+		mon := NewDefaultStagingMonitor(DefaultMonitorModeSilent, nil, func(text string) { lines = append(lines, text) })
+		staging, err := NewStaging(w.Workspace.FS, lib.Path{}, nil, false, w.TempFS, mon)
+		assert.NoError(err)
+		finalized, err := staging.Finalize()
+		assert.NoError(err)
+		assert.Equal(3, len(readAllStagingEntries(t, finalized)))
+		assert.Equal(1, mon.Unsupported)
+		assert.Equal([]string{"b/fifo\n  skipped, unsupported file type (FIFO)"}, lines)
+		assert.Equal("1 unsupported files (sockets, FIFOs, or devices) were not archived", mon.UnsupportedSummary())
+	})
+
+	t.Run("Skip policy is silent", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		w := setup(t)
+		var lines []string
+		mon := NewDefaultStagingMonitor(DefaultMonitorModeSilent, nil, func(text string) { lines = append(lines, text) })
+		mon.UnsupportedFilePolicy = UnsupportedFileSkip
+		_, err := NewStaging(w.Workspace.FS, lib.Path{}, nil, false, w.TempFS, mon)
+		assert.NoError(err)
+		assert.Equal(1, mon.Unsupported)
+		assert.Equal(0, len(lines))
+		assert.Equal("", mon.UnsupportedSummary())
+	})
+
+	t.Run("Fail policy aborts the scan", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		w := setup(t)
+		mon := NewDefaultStagingMonitor(DefaultMonitorModeSilent, nil, nil)
+		mon.UnsupportedFilePolicy = UnsupportedFileFail
+		_, err := NewStaging(w.Workspace.FS, lib.Path{}, nil, false, w.TempFS, mon)
+		assert.ErrorIs(err, ErrUnsupportedFileType)
+		assert.Error(err, "b/fifo (FIFO)")
+	})
+
+	t.Run("Excluded unsupported files are not reported", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		w := setup(t)
+		mon := NewDefaultStagingMonitor(DefaultMonitorModeSilent, nil, nil)
+		mon.UnsupportedFilePolicy = UnsupportedFileFail
+		filter := lib.NewPathExclusionFilter([]string{"**/fifo"})
+		_, err := NewStaging(w.Workspace.FS, lib.Path{}, filter, false, w.TempFS, mon)
+		assert.NoError(err)
+		assert.Equal(0, mon.Unsupported)
+	})
+}
+
 type cancelStagingMonitor struct{}
 
 func (m *cancelStagingMonitor) OnStart(path lib.Path, dirEntry fs.DirEntry) error {
@@ -289,6 +361,10 @@ func (m *cancelStagingMonitor) OnEnd(path lib.Path, excluded bool, metadata *lib
 	return nil
 }
 
+func (m *cancelStagingMonitor) OnUnsupported(path lib.Path, dirEntry fs.DirEntry) error {
+	return nil
+}
+
 func TestStagingCache(t *testing.T) {
 	t.Parallel()
 	t.Run("Existing cache is used and new cache is created", func(t *testing.T) {
@@ -350,7 +426,7 @@ func TestStagingCache(t *testing.T) {
 			{"dir", 0o700 | fs.ModeDir, lib.Sha256{}},
 			{"dir/a.txt", 0o600, td.SHA256("a")},
 		}, wstd.StagingEntryInfos(finalized))
-		cache, err := OpenStagingCache(cacheFS, 2)
+		cache, err := OpenStagingCache(cacheFS, lib.TempCacheOptions{MaxChunks: 2})
 		assert.NoError(err)
 		entry, ok, err := cache.Get(lib.PathCompareString(td.Path("dir/a.txt"), false))
 		assert.NoError(err)
@@ -359,6 +435,131 @@ func TestStagingCache(t *testing.T) {
 		assert.Equal(td.SHA256("a"), entry.Metadata.FileHash)
 	})
 
+	t.Run("Encrypted cache is dropped when the key changes", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("dir/a.txt", "a")
+		w.Chmod("dir/a.txt", 0o600)
+		w.Workspace.EncryptCache = true
+		scan := func(repository *lib.Repository) []TestStagingEntryInfo {
+			t.Helper()
+			staging, err := newWorkspaceStaging(
+				t.Context(), w.Workspace, repository, nil, true, lib.RestorableMetadataAll, nil, w.TempFS, wstd.StagingMonitor(),
+			)
+			assert.NoError(err)
+			finalized, err := staging.Finalize()
+			assert.NoError(err)
+			return wstd.StagingEntryInfos(finalized)
+		}
+		cachePlaintext := func() bool {
+			t.Helper()
+			found := false
+			assert.NoError(w.Workspace.FS.WalkDir(cacheFinalDir, func(path string, d fs.DirEntry, err error) error {
+				assert.NoError(err)
+				if d.IsDir() {
+					return nil
+				}
+				data, err := lib.ReadFile(w.Workspace.FS, path)
+				assert.NoError(err)
+				found = found || bytes.Contains(data, []byte("dir/a.txt"))
+				return nil
+			}))
+			return found
+		}
+
+		scan(r.Repository)
+		assert.Equal(false, cachePlaintext())
+		fingerprint, err := lib.ReadFile(w.Workspace.FS, cacheKeyPath)
+		assert.NoError(err)
+
+		// Replace the cache with an encrypted entry for `a.txt`.
+		assert.NoError(w.Workspace.FS.RemoveAll(cacheFinalDir))
+		cacheFS, err := w.Workspace.FS.MkSub(cacheFinalDir)
+		assert.NoError(err)
+		key, err := r.Repository.DeriveKey(stagingCacheKeyPurpose)
+		assert.NoError(err)
+		encryptedCacheFS, err := lib.NewEncryptedFSWithKey(cacheFS, key)
+		assert.NoError(err)
+		tempWriter := NewStagingCacheWriter(encryptedCacheFS, lib.MaxBlockDataSize)
+		fileInfo, err := w.Workspace.FS.Stat("dir/a.txt")
+		assert.NoError(err)
+		a, err := NewStagingEntry(td.Path("dir/a.txt"), fileInfo, fileInfo.Size(), td.SHA256("from_cache"), nil)
+		assert.NoError(err)
+		assert.NoError(tempWriter.Add(a))
+		_, err = tempWriter.Finalize()
+		assert.NoError(err)
+		assert.Equal([]TestStagingEntryInfo{
+			{"dir", 0o700 | fs.ModeDir, lib.Sha256{}},
+			{"dir/a.txt", 0o600, td.SHA256("from_cache")},
+		}, scan(r.Repository))
+
+		// Another repository has another key, the cache is dropped.
+		other := td.NewTestRepository(t, td.NewFS(t))
+		assert.Equal([]TestStagingEntryInfo{
+			{"dir", 0o700 | fs.ModeDir, lib.Sha256{}},
+			{"dir/a.txt", 0o600, td.SHA256("a")},
+		}, scan(other.Repository))
+		otherFingerprint, err := lib.ReadFile(w.Workspace.FS, cacheKeyPath)
+		assert.NoError(err)
+		assert.NotEqual(fingerprint, otherFingerprint)
+
+		// Without encryption, the cache is dropped, too.
+		w.Workspace.EncryptCache = false
+		scan(r.Repository)
+		assert.Equal(true, cachePlaintext())
+		_, err = w.Workspace.FS.Stat(cacheKeyPath)
+		assert.ErrorIs(err, fs.ErrNotExist)
+	})
+
+	t.Run("Holes are taken from the cache", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		const k = 64 * 1024
+		holes := []*lib.Hole{{Offset: k, Size: k}}
+		w.WriteSparse("a.img", make([]byte, 2*k), holes...)
+		cachedHoles := func() []*lib.Hole {
+			t.Helper()
+			cacheFS, err := w.Workspace.FS.Sub(".cling/workspace/cache/staging")
+			assert.NoError(err)
+			cache, err := OpenStagingCache(cacheFS, lib.TempCacheOptions{})
+			assert.NoError(err)
+			entry, ok, err := cache.Get(lib.PathCompareString(td.Path("a.img"), false))
+			assert.NoError(err)
+			assert.Equal(true, ok)
+			return entry.Metadata.Holes
+		}
+
+		staging, err := NewStaging(w.Workspace.FS, lib.Path{}, nil, false, w.TempFS, wstd.StagingMonitor())
+		assert.NoError(err)
+		_, err = staging.Finalize()
+		assert.NoError(err)
+		assert.Equal(holes, cachedHoles())
+
+		// Replace the cache with an entry with other holes, they are taken
+		// as long as the file did not change.
+		assert.NoError(w.Workspace.FS.RemoveAll(".cling/workspace/cache/staging"))
+		cacheFS, err := w.Workspace.FS.MkSub(".cling/workspace/cache/staging")
+		assert.NoError(err)
+		tempWriter := NewStagingCacheWriter(cacheFS, lib.MaxBlockDataSize)
+		fileInfo, err := w.Workspace.FS.Stat("a.img")
+		assert.NoError(err)
+		a, err := NewStagingEntry(td.Path("a.img"), fileInfo, fileInfo.Size(), td.SHA256("a"), nil)
+		assert.NoError(err)
+		a.Metadata.Holes = []*lib.Hole{{Offset: 0, Size: k}}
+		assert.NoError(tempWriter.Add(a))
+		_, err = tempWriter.Finalize()
+		assert.NoError(err)
+		staging, err = NewStaging(w.Workspace.FS, lib.Path{}, nil, true, w.TempFS, wstd.StagingMonitor())
+		assert.NoError(err)
+		_, err = staging.Finalize()
+		assert.NoError(err)
+		assert.Equal([]*lib.Hole{{Offset: 0, Size: k}}, cachedHoles())
+	})
+
 	t.Run("Cache detects same-size content changes", func(t *testing.T) {
 		t.Parallel()
 		assert := lib.NewAssert(t)
@@ -395,6 +596,99 @@ func TestStagingCache(t *testing.T) {
 	})
 }
 
+func TestStagingPartialCache(t *testing.T) {
+	t.Parallel()
+
+	t.Run("A failed scan saves the hashes computed so far", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		w.Write("b.txt", "b")
+		w.Write("c.txt", "c")
+
+		mon := &failingStagingMonitor{td.Path("c.txt"), lib.WrapErrorf(io.ErrShortWrite, "disk full")}
+		_, err := NewStaging(w.Workspace.FS, lib.Path{}, nil, false, w.TempFS, mon)
+		assert.ErrorIs(err, ErrStagingOutOfSpace)
+		partialFS, err := w.Workspace.FS.Sub(".cling/workspace/cache/staging-partial")
+		assert.NoError(err)
+		partial, err := OpenStagingCache(partialFS, lib.TempCacheOptions{MaxChunks: 2})
+		assert.NoError(err)
+		for _, path := range []string{"a.txt", "b.txt"} {
+			entry, ok, err := partial.Get(lib.PathCompareString(td.Path(path), false))
+			assert.NoError(err)
+			assert.Equal(true, ok, path)
+			assert.Equal(td.SHA256(path[:1]), entry.Metadata.FileHash)
+		}
+		_, ok, err := partial.Get(lib.PathCompareString(td.Path("c.txt"), false))
+		assert.NoError(err)
+		assert.Equal(false, ok)
+	})
+
+	for _, useCache := range []bool{true, false} {
+		name := "The partial cache is used and removed by the next scan"
+		expected := td.SHA256("from_partial")
+		if !useCache {
+			// The partial cache might be as wrong as the cache that the
+			// caller does not trust.
+			name = "The partial cache is ignored and removed without useCache"
+			expected = td.SHA256("a")
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			assert := lib.NewAssert(t)
+			r := td.NewTestRepository(t, td.NewFS(t))
+			w := wstd.NewTestWorkspace(t, r.Repository)
+			w.Write("a.txt", "a")
+			w.Write("b.txt", "b")
+
+			// Create a partial cache with a fake hash for `a.txt`.
+			partialFS, err := w.Workspace.FS.MkSub(".cling/workspace/cache/staging-partial")
+			assert.NoError(err)
+			tempWriter := NewStagingCacheWriter(partialFS, lib.MaxBlockDataSize)
+			fileInfo, err := w.Workspace.FS.Stat("a.txt")
+			assert.NoError(err)
+			a, err := NewStagingEntry(td.Path("a.txt"), fileInfo, fileInfo.Size(), td.SHA256("from_partial"), nil)
+			assert.NoError(err)
+			assert.NoError(tempWriter.Add(a))
+			_, err = tempWriter.Finalize()
+			assert.NoError(err)
+
+			staging, err := NewStaging(w.Workspace.FS, lib.Path{}, nil, useCache, w.TempFS, wstd.StagingMonitor())
+			assert.NoError(err)
+			finalized, err := staging.Finalize()
+			assert.NoError(err)
+			assert.Equal([]TestStagingEntryInfo{
+				{"a.txt", 0o600, expected},
+				{"b.txt", 0o600, td.SHA256("b")},
+			}, wstd.StagingEntryInfos(finalized))
+			_, err = w.Workspace.FS.Stat(".cling/workspace/cache/staging-partial")
+			assert.ErrorIs(err, fs.ErrNotExist)
+		})
+	}
+}
+
+type failingStagingMonitor struct {
+	path lib.Path
+	err  error
+}
+
+func (m *failingStagingMonitor) OnStart(path lib.Path, dirEntry fs.DirEntry) error {
+	if path == m.path {
+		return m.err
+	}
+	return nil
+}
+
+func (m *failingStagingMonitor) OnEnd(path lib.Path, excluded bool, metadata *lib.PathMetadata) error {
+	return nil
+}
+
+func (m *failingStagingMonitor) OnUnsupported(path lib.Path, dirEntry fs.DirEntry) error {
+	return nil
+}
+
 func readAllStagingEntries(t *testing.T, temp *lib.Temp[*StagingEntry]) []*StagingEntry {
 	t.Helper()
 	r := temp.Reader(nil)
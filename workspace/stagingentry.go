@@ -70,12 +70,12 @@ func NewStagingCacheWriter(fs lib.FS, maxChunkSize int) *lib.TempWriter[*Staging
 	)
 }
 
-func OpenStagingCache(fs lib.FS, maxChunksInCache int) (*lib.TempCache[*StagingEntry], error) {
+func OpenStagingCache(fs lib.FS, opts lib.TempCacheOptions) (*lib.TempCache[*StagingEntry], error) {
 	temp, err := lib.OpenTemp[*StagingEntry](fs, stagingEntryChunkMarshaller{})
 	if err != nil {
 		return nil, lib.WrapErrorf(err, "failed to open temp")
 	}
-	cache, err := lib.NewTempCache(temp, StagingCacheKey, maxChunksInCache)
+	cache, err := lib.NewTempCache(temp, StagingCacheKey, opts)
 	if err != nil {
 		return nil, lib.WrapErrorf(err, "failed to create new TempCache")
 	}
@@ -31,7 +31,7 @@ func TestStagingEntry(t *testing.T) {
 		assert.NoError(tempWriter.Add(&b))
 		_, err := tempWriter.Finalize()
 		assert.NoError(err)
-		cache, err := OpenStagingCache(fs, 2)
+		cache, err := OpenStagingCache(fs, lib.TempCacheOptions{MaxChunks: 2})
 		assert.NoError(err)
 
 		entry, ok, err := cache.Get(lib.PathCompareString(a.RepoPath, a.Metadata.FileMode.IsDir()))
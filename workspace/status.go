@@ -13,12 +13,17 @@ type StatusFile struct {
 	Path     lib.Path
 	Kind     lib.RevisionEntryKind
 	Metadata lib.PathMetadata
+	// Set if the file was added by renaming `RenamedFrom` (see `Mv`).
+	RenamedFrom *lib.Path
 }
 
 func (f StatusFile) Format() string {
 	var typeStr string
 	switch f.Kind {
 	case lib.RevisionEntryKindAdd:
+		if f.RenamedFrom != nil {
+			return fmt.Sprintf("R %s -> %s", formatStatusPath(*f.RenamedFrom, f.Metadata), formatStatusPath(f.Path, f.Metadata))
+		}
 		typeStr = "A"
 	case lib.RevisionEntryKindUpdate:
 		typeStr = "M"
@@ -27,35 +32,65 @@ func (f StatusFile) Format() string {
 	default:
 		panic(fmt.Sprintf("invalid revision entry type %d", f.Kind))
 	}
-	path := f.Path.String()
-	if f.Metadata.FileMode.IsDir() {
-		path += "/"
+	return fmt.Sprintf("%s %s", typeStr, formatStatusPath(f.Path, f.Metadata))
+}
+
+func formatStatusPath(path lib.Path, md lib.PathMetadata) string {
+	if md.FileMode.IsDir() {
+		return path.String() + "/"
 	}
-	return fmt.Sprintf("%s %s", typeStr, path)
+	return path.String()
 }
 
 type StatusFiles []StatusFile
 
 func (s StatusFiles) Summary() string {
-	if len(s) == 0 {
-		return "No changes"
+	var summary StatusSummary
+	for i := range s {
+		summary.Add(&s[i])
 	}
-	added := 0
-	updated := 0
-	deleted := 0
-	for _, file := range s {
-		switch file.Kind {
-		case lib.RevisionEntryKindAdd:
-			added++
-		case lib.RevisionEntryKindUpdate:
-			updated++
-		case lib.RevisionEntryKindDelete:
-			deleted++
-		default:
-			panic(fmt.Sprintf("invalid revision entry type %d", file.Kind))
+	return summary.String()
+}
+
+// StatusSummary counts the files of a status by kind. It is built up file by
+// file, so that `StatusStream` does not have to keep the files around.
+type StatusSummary struct {
+	Added   int
+	Updated int
+	Deleted int
+	Renamed int
+}
+
+func (s *StatusSummary) Add(file *StatusFile) {
+	switch file.Kind {
+	case lib.RevisionEntryKindAdd:
+		if file.RenamedFrom != nil {
+			s.Renamed++
+			return
 		}
+		s.Added++
+	case lib.RevisionEntryKindUpdate:
+		s.Updated++
+	case lib.RevisionEntryKindDelete:
+		s.Deleted++
+	default:
+		panic(fmt.Sprintf("invalid revision entry type %d", file.Kind))
 	}
-	return fmt.Sprintf("%d added, %d updated, %d deleted", added, updated, deleted)
+}
+
+func (s StatusSummary) Total() int {
+	return s.Added + s.Updated + s.Deleted + s.Renamed
+}
+
+func (s StatusSummary) String() string {
+	if s.Total() == 0 {
+		return "No changes"
+	}
+	summary := fmt.Sprintf("%d added, %d updated, %d deleted", s.Added, s.Updated, s.Deleted)
+	if s.Renamed > 0 {
+		summary += fmt.Sprintf(", %d renamed", s.Renamed)
+	}
+	return summary
 }
 
 type StatusOptions struct {
@@ -63,6 +98,9 @@ type StatusOptions struct {
 	Monitor                StagingEntryMonitor
 	RestorableMetadataFlag lib.RestorableMetadataFlag
 	UseStagingCache        bool
+	// Only scan the directories that changed according to the watch journal
+	// (see `RunWatchJournal`). Needs `UseStagingCache`. Optional.
+	WatchJournal *WatchJournalPosition
 }
 
 func Status(
@@ -72,9 +110,32 @@ func Status(
 	opts *StatusOptions,
 	tmpFS lib.FS,
 ) (StatusFiles, error) {
+	result := StatusFiles{}
+	_, err := StatusStream(ctx, ws, repository, opts, tmpFS, func(file StatusFile) error {
+		result = append(result, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// StatusStream is like `Status`, but it calls `yield` for every file as soon
+// as it is read instead of collecting them, so that the memory use does not
+// depend on the number of changes. It stops at the first error returned by
+// `yield` and returns it as is.
+func StatusStream(
+	ctx context.Context,
+	ws *Workspace,
+	repository *lib.Repository,
+	opts *StatusOptions,
+	tmpFS lib.FS,
+	yield func(StatusFile) error,
+) (StatusSummary, error) {
 	head, err := ws.Head(ctx)
 	if err != nil {
-		return nil, lib.WrapErrorf(err, "failed to get head")
+		return StatusSummary{}, lib.WrapErrorf(err, "failed to get head")
 	}
 	// A root workspace head means the workspace was attached but never
 	// merged. Compare against the repository head so `status` predicts
@@ -84,35 +145,136 @@ func Status(
 	if head.IsRoot() {
 		head, err = repository.Head(ctx)
 		if err != nil {
-			return nil, lib.WrapErrorf(err, "failed to read repository head")
+			return StatusSummary{}, lib.WrapErrorf(err, "failed to read repository head")
 		}
 		suppressDeletes = true
 	}
 	snapshotFS, err := tmpFS.MkSub("snapshot")
 	if err != nil {
-		return nil, lib.WrapErrorf(err, "failed to create temporary snapshot directory")
+		return StatusSummary{}, lib.WrapErrorf(err, "failed to create temporary snapshot directory")
 	}
 	stagingTmpFS, err := tmpFS.MkSub("staging")
 	if err != nil {
-		return nil, lib.WrapErrorf(err, "failed to create temporary staging directory")
+		return StatusSummary{}, lib.WrapErrorf(err, "failed to create temporary staging directory")
 	}
-	snapshot, err := lib.NewRevisionSnapshot(ctx, repository, head, snapshotFS)
+	trackedFilter, err := ws.trackedFilter()
 	if err != nil {
-		return nil, lib.WrapErrorf(err, "failed to create revision snapshot")
+		return StatusSummary{}, err
 	}
-	staging, err := NewStaging(ws.FS, ws.PathPrefix, opts.PathFilter, opts.UseStagingCache, stagingTmpFS, opts.Monitor)
+	snapshot, err := lib.NewFilteredRevisionSnapshot(ctx, repository, head, snapshotFS, trackedFilter)
 	if err != nil {
-		return nil, lib.WrapErrorf(err, "failed to scan changes")
+		return StatusSummary{}, lib.WrapErrorf(err, "failed to create revision snapshot")
+	}
+	staging, err := newWorkspaceStaging(
+		ctx,
+		ws,
+		repository,
+		allPathFilters(opts.PathFilter, ws.sparseFilter()),
+		opts.UseStagingCache,
+		opts.RestorableMetadataFlag,
+		opts.WatchJournal,
+		stagingTmpFS,
+		opts.Monitor,
+	)
+	if err != nil {
+		return StatusSummary{}, lib.WrapErrorf(err, "failed to scan changes")
 	}
 	revisionTemp, err := staging.MergeWithSnapshot(snapshot, opts.RestorableMetadataFlag, suppressDeletes)
 	if err != nil {
-		return nil, lib.WrapErrorf(err, "failed to merge staging and revision snapshot")
+		return StatusSummary{}, lib.WrapErrorf(err, "failed to merge staging and revision snapshot")
+	}
+	return readStatusFiles(revisionTemp, ws.PathPrefix, yield)
+}
+
+type CompareOptions struct {
+	RevisionId lib.RevisionId
+	// Compare `dir` with the paths below this prefix of the revision.
+	PathPrefix             lib.Path
+	PathFilter             lib.PathFilter
+	Monitor                StagingEntryMonitor
+	RestorableMetadataFlag lib.RestorableMetadataFlag
+}
+
+// CompareDirectory shows the difference between the directory `dir` and
+// `opts.RevisionId` like `Status` does for a workspace, i.e. paths that only
+// exist in `dir` are added and paths that only exist in the revision are
+// deleted. `dir` does not have to be a workspace and is not written to.
+func CompareDirectory(
+	ctx context.Context,
+	repository *lib.Repository,
+	dir lib.FS,
+	opts *CompareOptions,
+	tmpFS lib.FS,
+) (StatusFiles, error) {
+	result := StatusFiles{}
+	_, err := CompareDirectoryStream(ctx, repository, dir, opts, tmpFS, func(file StatusFile) error {
+		result = append(result, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return result, nil
+}
+
+// CompareDirectoryStream is to `CompareDirectory` what `StatusStream` is to
+// `Status`.
+func CompareDirectoryStream(
+	ctx context.Context,
+	repository *lib.Repository,
+	dir lib.FS,
+	opts *CompareOptions,
+	tmpFS lib.FS,
+	yield func(StatusFile) error,
+) (StatusSummary, error) {
+	snapshotFS, err := tmpFS.MkSub("snapshot")
+	if err != nil {
+		return StatusSummary{}, lib.WrapErrorf(err, "failed to create temporary snapshot directory")
+	}
+	stagingTmpFS, err := tmpFS.MkSub("staging")
+	if err != nil {
+		return StatusSummary{}, lib.WrapErrorf(err, "failed to create temporary staging directory")
+	}
+	snapshot, err := lib.NewFilteredRevisionSnapshot(
+		ctx,
+		repository,
+		opts.RevisionId,
+		snapshotFS,
+		opts.PathPrefix.AsFilter(),
+	)
+	if err != nil {
+		return StatusSummary{}, lib.WrapErrorf(err, "failed to create revision snapshot")
+	}
+	staging, err := NewReadOnlyStaging(
+		dir,
+		opts.PathPrefix,
+		opts.PathFilter,
+		opts.RestorableMetadataFlag,
+		stagingTmpFS,
+		opts.Monitor,
+	)
+	if err != nil {
+		return StatusSummary{}, lib.WrapErrorf(err, "failed to scan %s", dir)
+	}
+	revisionTemp, err := staging.MergeWithSnapshot(snapshot, opts.RestorableMetadataFlag, false)
+	if err != nil {
+		return StatusSummary{}, lib.WrapErrorf(err, "failed to merge staging and revision snapshot")
+	}
+	return readStatusFiles(revisionTemp, opts.PathPrefix, yield)
+}
+
+// Call `yield` for the entries of `revisionTemp` converted to `StatusFile`s
+// relative to `pathPrefix`.
+func readStatusFiles(
+	revisionTemp *lib.Temp[*lib.RevisionEntry],
+	pathPrefix lib.Path,
+	yield func(StatusFile) error,
+) (StatusSummary, error) {
+	var summary StatusSummary
 	if revisionTemp.Chunks() == 0 {
-		return []StatusFile{}, nil
+		return summary, nil
 	}
 	revisionTempReader := revisionTemp.Reader(nil)
-	result := []StatusFile{}
 	buf := lib.NewBlockBuf()
 	for {
 		entry, err := revisionTempReader.Read(buf)
@@ -120,13 +282,17 @@ func Status(
 			break
 		}
 		if err != nil {
-			return nil, lib.WrapErrorf(err, "failed to read revision chunk file")
+			return summary, lib.WrapErrorf(err, "failed to read revision chunk file")
 		}
-		path, ok := entry.Path.TrimBase(ws.PathPrefix)
+		path, ok := entry.Path.TrimBase(pathPrefix)
 		if !ok {
 			continue
 		}
-		result = append(result, StatusFile{path, entry.Kind, entry.Metadata})
+		file := StatusFile{path, entry.Kind, entry.Metadata, nil}
+		summary.Add(&file)
+		if err := yield(file); err != nil {
+			return summary, err
+		}
 	}
-	return result, nil
+	return summary, nil
 }
@@ -1,6 +1,7 @@
 package workspace
 
 import (
+	"io/fs"
 	"testing"
 	"time"
 
@@ -250,6 +251,83 @@ func TestStatus(t *testing.T) {
 		assert.NoError(err)
 		assert.Equal([]string{"A c.txt"}, statusFilesString(status))
 	})
+
+	t.Run("StatusStream yields the files and counts the summary", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		w.Write("b.txt", "b")
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		w.Rm("a.txt")
+		w.Write("b.txt", "bb")
+		w.Write("c.txt", "c")
+
+		files := []StatusFile{}
+		summary, err := StatusStream(t.Context(), w.Workspace, r.Repository, wstd.StatusOptions(), td.NewFS(t),
+			func(file StatusFile) error {
+				files = append(files, file)
+				return nil
+			})
+		assert.NoError(err)
+		assert.Equal([]string{"D a.txt", "M b.txt", "A c.txt"}, statusFilesString(files))
+		assert.Equal(StatusSummary{1, 1, 1, 0}, summary)
+		assert.Equal(StatusFiles(files).Summary(), summary.String())
+
+		// An error stops the stream.
+		n := 0
+		_, err = StatusStream(t.Context(), w.Workspace, r.Repository, wstd.StatusOptions(), td.NewFS(t),
+			func(StatusFile) error {
+				n++
+				return lib.Errorf("stop")
+			})
+		assert.Error(err, "stop")
+		assert.Equal(1, n)
+	})
+}
+
+func TestCompareDirectory(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	w := wstd.NewTestWorkspace(t, r.Repository)
+	w.Write("a.txt", "a")
+	w.Write("sub/b.txt", "b")
+	w.Write("sub/c.txt", "c")
+	rev, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+	assert.NoError(err)
+	opts := func(pathPrefix string) *CompareOptions {
+		return &CompareOptions{rev, td.Path(pathPrefix), nil, wstd.StagingMonitor(), 0}
+	}
+
+	dir := td.NewTestFS(t, td.NewFS(t))
+	dir.Write("b.txt", "b")
+	dir.Write("c.txt", "cc")
+	dir.Write("d.txt", "d")
+	dir.Write(".cling_sync_tmp_123", "tmp")
+	status, err := CompareDirectory(t.Context(), r.Repository, dir.FS, opts("sub"), td.NewFS(t))
+	assert.NoError(err)
+	assert.Equal([]string{"M c.txt", "A d.txt"}, statusFilesString(status))
+
+	// The whole revision.
+	status, err = CompareDirectory(t.Context(), r.Repository, dir.FS, opts(""), td.NewFS(t))
+	assert.NoError(err)
+	assert.Equal([]string{
+		"D a.txt",
+		"A b.txt",
+		"A c.txt",
+		"A d.txt",
+		"D sub/",
+		"D sub/b.txt",
+		"D sub/c.txt",
+	}, statusFilesString(status))
+
+	// Nothing is written to the directory.
+	_, err = dir.FS.Stat(".cling")
+	assert.ErrorIs(err, fs.ErrNotExist)
+	assert.Equal("tmp", dir.Cat(".cling_sync_tmp_123"))
 }
 
 func statusFilesString(files []StatusFile) []string {
@@ -27,9 +27,15 @@ type SyncTarget struct {
 	URI  string
 }
 
+// The name of the repository the workspace is attached to. Together with the
+// sync targets, it makes up the named remotes of the workspace, see
+// `ResolveRemote`.
+const DefaultRemote = "origin"
+
 var syncTargetNameRegexp = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
 
-// ValidateSyncTargetName rejects names that aren't ASCII alphanumeric or '-'.
+// ValidateSyncTargetName rejects names that aren't ASCII alphanumeric or '-',
+// and `DefaultRemote`.
 func ValidateSyncTargetName(name string) error {
 	if name == "" {
 		return lib.Errorf("sync target name must not be empty")
@@ -37,6 +43,9 @@ func ValidateSyncTargetName(name string) error {
 	if !syncTargetNameRegexp.MatchString(name) {
 		return lib.Errorf("sync target name %q must be ASCII alphanumeric or '-'", name)
 	}
+	if name == DefaultRemote {
+		return lib.Errorf("sync target name %q is reserved for the repository of the workspace", name)
+	}
 	return nil
 }
 
@@ -63,8 +72,10 @@ func LoadSyncTargets(ctx context.Context, w *Workspace) ([]SyncTarget, error) {
 		if !ok {
 			return nil, lib.Errorf("unexpected section %q in sync targets", section)
 		}
-		if err := ValidateSyncTargetName(name); err != nil {
-			return nil, lib.WrapErrorf(err, "invalid sync target name in stored config")
+		// Not `ValidateSyncTargetName`: a target named `DefaultRemote` that
+		// was added before the name was reserved can still be deleted.
+		if !syncTargetNameRegexp.MatchString(name) {
+			return nil, lib.Errorf("invalid sync target name %q in stored config", name)
 		}
 		uri, ok := kvs[syncTargetURIKey]
 		if !ok {
@@ -91,6 +102,35 @@ func GetSyncTarget(ctx context.Context, w *Workspace, name string) (uri string,
 	return "", false, nil
 }
 
+// ResolveRemote returns the URI of the remote `name`: `DefaultRemote` is the
+// repository the workspace is attached to, every other name is a sync target.
+// Sync targets are mirrors of the repository, so the workspace can merge
+// with any of them (see `UseRemote`).
+func ResolveRemote(ctx context.Context, w *Workspace, name string) (string, error) {
+	if name == DefaultRemote {
+		return string(w.Origin), nil
+	}
+	uri, found, err := GetSyncTarget(ctx, w, name)
+	if err != nil {
+		return "", lib.WrapErrorf(err, "failed to look up remote %q", name)
+	}
+	if !found {
+		return "", lib.Errorf("no remote named %q, see `cling-sync sync-repo list`", name)
+	}
+	return uri, nil
+}
+
+// UseRemote makes the remote `name` the repository of `w` until it is closed,
+// i.e. the workspace head and the staging cache are used with it.
+func (w *Workspace) UseRemote(ctx context.Context, name string) error {
+	uri, err := ResolveRemote(ctx, w, name)
+	if err != nil {
+		return err
+	}
+	w.RemoteRepository = RemoteRepository(uri)
+	return nil
+}
+
 // AddSyncTarget registers a new target. Returns an error if `name` is
 // invalid, already present, or if the target's repository config does not
 // match the workspace's source repository (the sync precondition).
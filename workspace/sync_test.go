@@ -226,6 +226,69 @@ func TestRunSync(t *testing.T) {
 	})
 }
 
+func TestRemotes(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Origin and sync targets are resolved by name", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		srcPath := t.TempDir()
+		src := td.NewTestRepository(t, lib.NewRealFS(srcPath))
+		w, err := NewWorkspace(t.Context(), td.NewFS(t), td.NewFS(t), RemoteRepository(srcPath), lib.Path{})
+		assert.NoError(err)
+		offsite := cloneRepositoryAt(t, src)
+		assert.NoError(AddSyncTarget(t.Context(), w, "offsite", offsite, nil))
+		assert.Error(AddSyncTarget(t.Context(), w, DefaultRemote, offsite, nil), "reserved")
+
+		uri, err := ResolveRemote(t.Context(), w, DefaultRemote)
+		assert.NoError(err)
+		assert.Equal(srcPath, uri)
+		uri, err = ResolveRemote(t.Context(), w, "offsite")
+		assert.NoError(err)
+		assert.Equal(offsite, uri)
+		_, err = ResolveRemote(t.Context(), w, "ghost")
+		assert.Error(err, `no remote named "ghost"`)
+
+		assert.NoError(w.UseRemote(t.Context(), "offsite"))
+		assert.Equal(RemoteRepository(offsite), w.RemoteRepository)
+		uri, err = ResolveRemote(t.Context(), w, DefaultRemote)
+		assert.NoError(err)
+		assert.Equal(srcPath, uri)
+	})
+
+	t.Run("Merge with a mirror needs the workspace head", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		srcPath := t.TempDir()
+		src := td.NewTestRepository(t, lib.NewRealFS(srcPath))
+		w := wstd.NewTestWorkspace(t, src.Repository)
+		w.RemoteRepository = RemoteRepository(srcPath)
+		offsitePath := cloneRepositoryAt(t, src)
+		assert.NoError(AddSyncTarget(t.Context(), w.Workspace, "offsite", offsitePath, nil))
+		w.Write("a.txt", "a")
+		_, err := Merge(t.Context(), w.Workspace, src.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+
+		offsite := td.OpenRepository(t, lib.NewRealFS(offsitePath))
+		w.Write("b.txt", "b")
+		_, err = Merge(t.Context(), w.Workspace, offsite.Repository, wstd.MergeOptions())
+		assert.ErrorIs(err, ErrHeadNotInRepository)
+
+		assert.NoError(RunSync(t.Context(), w.Workspace, "offsite", nil, td.RevisionChain(t, src), RunSyncOpts{
+			Monitor: &countingMonitor{}, Workers: 8,
+		}))
+		offsite = td.OpenRepository(t, lib.NewRealFS(offsitePath))
+		revId, err := Merge(t.Context(), w.Workspace, offsite.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.Equal(revId, offsite.Head())
+
+		// The commit only went to the mirror.
+		w.Write("c.txt", "c")
+		_, err = Merge(t.Context(), w.Workspace, src.Repository, wstd.MergeOptions())
+		assert.ErrorIs(err, ErrHeadNotInRepository)
+	})
+}
+
 func newSyncTestWorkspace(t *testing.T) *Workspace {
 	t.Helper()
 	assert := lib.NewAssert(t)
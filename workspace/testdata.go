@@ -70,7 +70,7 @@ func (wstd WorkspaceTestData) CommitMonitor() *TestCommitMonitor {
 }
 
 func (wstd WorkspaceTestData) StatusOptions() *StatusOptions {
-	return &StatusOptions{nil, wstd.StagingMonitor(), lib.RestorableMetadataAll, false}
+	return &StatusOptions{nil, wstd.StagingMonitor(), lib.RestorableMetadataAll, false, nil}
 }
 
 func (wstd WorkspaceTestData) MergeOptions() *MergeOptions {
@@ -82,6 +82,13 @@ func (wstd WorkspaceTestData) MergeOptions() *MergeOptions {
 		"message",
 		lib.RestorableMetadataAll,
 		false,
+		nil,
+		nil,
+		nil,
+		false,
+		nil,
+		nil,
+		nil,
 	}
 }
 
@@ -96,12 +103,36 @@ func (wstd WorkspaceTestData) CpOptions(revisionId lib.RevisionId) *CpOptions {
 		nil,
 		lib.Path{},
 		lib.RestorableMetadataAll,
+		false,
 	}
 }
 
 func (wstd WorkspaceTestData) ResetOptions(revisionId lib.RevisionId, force bool) *ResetOptions {
 	return &ResetOptions{
 		revisionId,
+		nil,
+		force,
+		wstd.StagingMonitor(),
+		wstd.CpMonitor(),
+		lib.RestorableMetadataAll,
+		false,
+		false,
+	}
+}
+
+func (wstd WorkspaceTestData) RepairHeadOptions(revisionId *lib.RevisionId) *RepairHeadOptions {
+	return &RepairHeadOptions{
+		revisionId,
+		wstd.StagingMonitor(),
+		lib.RestorableMetadataAll,
+		false,
+	}
+}
+
+func (wstd WorkspaceTestData) RestoreOptions(revisionId lib.RevisionId, force bool, patterns ...string) *RestoreOptions {
+	return &RestoreOptions{
+		revisionId,
+		lib.NewPathInclusionFilter(patterns),
 		force,
 		wstd.StagingMonitor(),
 		wstd.CpMonitor(),
@@ -130,6 +161,8 @@ func (wstd WorkspaceTestData) StagingEntryInfos(temp *lib.Temp[*StagingEntry]) [
 
 type TestCpMonitor struct {
 	Exists        CpOnExists
+	TotalPaths    int
+	TotalBytes    int64
 	OnStartCalls  []*lib.RevisionEntry
 	OnWriteCalls  []*lib.RevisionEntry
 	OnExistsCalls []*lib.RevisionEntry
@@ -141,6 +174,11 @@ func NewTestCpMonitor(exists CpOnExists) *TestCpMonitor {
 	return &TestCpMonitor{Exists: exists} //nolint:exhaustruct
 }
 
+func (m *TestCpMonitor) OnTotal(paths int, bytes int64) {
+	m.TotalPaths += paths
+	m.TotalBytes += bytes
+}
+
 func (m *TestCpMonitor) OnStart(entry *lib.RevisionEntry, targetPath string) error {
 	m.OnStartCalls = append(m.OnStartCalls, entry)
 	return nil
@@ -176,16 +214,31 @@ func (m *TestStagingMonitor) OnEnd(path lib.Path, excluded bool, metadata *lib.P
 	return nil
 }
 
+func (m *TestStagingMonitor) OnUnsupported(path lib.Path, dirEntry fs.DirEntry) error {
+	return nil
+}
+
 func (m *TestStagingMonitor) Close() {
 }
 
-type TestCommitMonitor struct{}
+type TestCommitMonitor struct {
+	OnStartCalls    []*lib.RevisionEntry
+	OnAddBlockCalls []lib.BlockId
+	TotalPaths      int
+	TotalBytes      int64
+}
+
+func (m *TestCommitMonitor) OnTotal(paths int, bytes int64) {
+	m.TotalPaths += paths
+	m.TotalBytes += bytes
+}
 
 func (m *TestCommitMonitor) OnBeforeCommit() error {
 	return nil
 }
 
 func (m *TestCommitMonitor) OnStart(entry *lib.RevisionEntry) error {
+	m.OnStartCalls = append(m.OnStartCalls, entry)
 	return nil
 }
 
@@ -195,6 +248,7 @@ func (m *TestCommitMonitor) OnAddBlock(
 	dataSize int,
 	dataBytesWritten *int,
 ) error {
+	m.OnAddBlockCalls = append(m.OnAddBlockCalls, blockId)
 	return nil
 }
 
@@ -0,0 +1,392 @@
+// Three-way merge of conflicting text files (see `MergeOptions.MergeText`).
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// The lines around the conflicting parts of a merged text file, like git's
+// conflict markers.
+const (
+	ConflictMarkerWorkspace  = "<<<<<<< workspace"
+	ConflictMarkerSeparator  = "======="
+	ConflictMarkerRepository = ">>>>>>> repository"
+)
+
+const (
+	// Larger files are never merged line by line.
+	maxTextMergeSize = 8 * 1024 * 1024
+	// If more lines than this differ between the base and one side, the
+	// file is treated as a regular conflict.
+	maxTextMergeEdits = 2000
+)
+
+// The control file with the paths (relative to the workspace) of the merged
+// text files that contained conflict markers.
+const unresolvedConflictsFileName = "unresolved-conflicts"
+
+// A conflicting file that was merged line by line.
+type textMerge struct {
+	// Relative to the workspace.
+	path      lib.Path
+	repoPath  lib.Path
+	content   []byte
+	conflicts int
+}
+
+// Merge the conflicting regular files that are text on both sides with the
+// workspace head revision as the base (an empty base if the file was added on
+// both sides).
+// Return the merged files and the remaining conflicts. Nothing is written.
+func (m *Merger) mergeTextConflicts(
+	ctx context.Context,
+	conflicts MergeConflictsError,
+	wsRevision *lib.TempCache[*lib.RevisionEntry],
+) ([]textMerge, MergeConflictsError, error) {
+	var merges []textMerge
+	rest := MergeConflictsError{}
+	for _, conflict := range conflicts {
+		merge, ok, err := m.mergeTextConflict(ctx, conflict, wsRevision)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			rest = append(rest, conflict)
+			continue
+		}
+		merges = append(merges, merge)
+	}
+	return merges, rest, nil
+}
+
+func (m *Merger) mergeTextConflict(
+	ctx context.Context,
+	conflict MergeConflict,
+	wsRevision *lib.TempCache[*lib.RevisionEntry],
+) (textMerge, bool, error) {
+	local, remote := conflict.WorkspaceEntry, conflict.RepositoryEntry
+	if !isMergeableTextEntry(local) || !isMergeableTextEntry(remote) {
+		return textMerge{}, false, nil
+	}
+	var base []byte
+	baseEntry, exists, err := wsRevision.Get(lib.RevisionEntryPathCompareString(remote))
+	if err != nil {
+		return textMerge{}, false, lib.WrapErrorf(
+			err,
+			"failed to get entry from workspace snapshot cache for %s",
+			remote.Path,
+		)
+	}
+	if exists {
+		if !isMergeableTextEntry(baseEntry) {
+			return textMerge{}, false, nil
+		}
+		if base, err = m.readRepositoryFile(ctx, baseEntry); err != nil {
+			return textMerge{}, false, err
+		}
+	}
+	theirs, err := m.readRepositoryFile(ctx, remote)
+	if err != nil {
+		return textMerge{}, false, err
+	}
+	ours, err := lib.ReadFile(m.ws.FS, local.Path.String())
+	if err != nil {
+		return textMerge{}, false, lib.WrapErrorf(err, "failed to read %s", local.Path)
+	}
+	if !isText(base) || !isText(ours) || !isText(theirs) {
+		return textMerge{}, false, nil
+	}
+	merged, conflicts, ok := mergeText(base, ours, theirs)
+	if !ok {
+		return textMerge{}, false, nil
+	}
+	return textMerge{local.Path, remote.Path, merged, conflicts}, true, nil
+}
+
+func isMergeableTextEntry(entry *lib.RevisionEntry) bool {
+	mode := entry.Metadata.FileMode
+	return entry.Kind != lib.RevisionEntryKindDelete &&
+		!mode.IsDir() &&
+		!mode.IsSymlink() &&
+		entry.Metadata.Size <= maxTextMergeSize
+}
+
+func (m *Merger) readRepositoryFile(ctx context.Context, entry *lib.RevisionEntry) ([]byte, error) {
+	var content []byte
+	for _, blockId := range entry.Metadata.BlockIds {
+		data, err := m.repository.ReadBlock(ctx, blockId, m.blockBuf)
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to read block %s of %s", blockId, entry.Path)
+		}
+		content = append(content, data...)
+	}
+	return content, nil
+}
+
+// Write the merged files to the workspace and record the ones with conflict
+// markers, together with `unresolved`, as unresolved conflicts.
+func (m *Merger) writeTextMerges(ctx context.Context, merges []textMerge, unresolved []lib.Path) error {
+	for _, merge := range merges {
+		path := merge.path.String()
+		stat, err := m.ws.FS.Stat(path)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to stat %s", path)
+		}
+		if err := lib.AtomicWriteFile(m.ws.FS, path, stat.Mode().Perm(), merge.content); err != nil {
+			return lib.WrapErrorf(err, "failed to write merged file %s", path)
+		}
+		if merge.conflicts > 0 && !slices.Contains(unresolved, merge.path) {
+			unresolved = append(unresolved, merge.path)
+		}
+	}
+	return m.ws.writeUnresolvedConflicts(ctx, unresolved)
+}
+
+// UnresolvedConflicts returns the paths (relative to the workspace) of the
+// files merged by `MergeOptions.MergeText` that still contain conflict
+// markers. `Merge` does not commit them until the markers are removed.
+func (w *Workspace) UnresolvedConflicts(ctx context.Context) ([]lib.Path, error) {
+	data, err := w.Storage.ReadControlFile(ctx, lib.ControlFileSectionConf, unresolvedConflictsFileName)
+	if errors.Is(err, lib.ErrControlFileNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read the unresolved conflicts")
+	}
+	var paths []lib.Path
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		path, err := lib.NewPath(line)
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "invalid path %q in the unresolved conflicts", line)
+		}
+		content, err := lib.ReadFile(w.FS, path.String())
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to read %s", path)
+		}
+		if hasConflictMarkers(content) {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+func (w *Workspace) writeUnresolvedConflicts(ctx context.Context, paths []lib.Path) error {
+	if len(paths) == 0 {
+		err := w.Storage.DeleteControlFile(ctx, lib.ControlFileSectionConf, unresolvedConflictsFileName)
+		if err != nil && !errors.Is(err, lib.ErrControlFileNotFound) {
+			return lib.WrapErrorf(err, "failed to delete the unresolved conflicts")
+		}
+		return nil
+	}
+	var sb strings.Builder
+	for _, path := range paths {
+		sb.WriteString(path.String() + "\n")
+	}
+	err := w.Storage.WriteControlFile(ctx, lib.ControlFileSectionConf, unresolvedConflictsFileName, []byte(sb.String()))
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to write the unresolved conflicts")
+	}
+	return nil
+}
+
+func hasConflictMarkers(content []byte) bool {
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("<<<<<<<")) || bytes.HasPrefix(line, []byte(">>>>>>>")) {
+			return true
+		}
+	}
+	return false
+}
+
+func isText(content []byte) bool {
+	return len(content) <= maxTextMergeSize && bytes.IndexByte(content, 0) < 0 && utf8.Valid(content)
+}
+
+// Merge the changes from `base` to `ours` and from `base` to `theirs` line
+// by line (diff3). Changes to different lines are combined, overlapping
+// changes are put between conflict markers.
+// Return the merged content and the number of conflicts, `ok` is false if
+// the files differ too much to be merged.
+func mergeText(base, ours, theirs []byte) (merged []byte, conflicts int, ok bool) {
+	lines := map[string]int{}
+	baseLines, b := internLines(base, lines)
+	oursLines, o := internLines(ours, lines)
+	theirsLines, t := internLines(theirs, lines)
+	mo, ok := matchLines(b, o, maxTextMergeEdits)
+	if !ok {
+		return nil, 0, false
+	}
+	mt, ok := matchLines(b, t, maxTextMergeEdits)
+	if !ok {
+		return nil, 0, false
+	}
+	var out bytes.Buffer
+	i, j, k := 0, 0, 0
+	for {
+		if i < len(b) && mo[i] == j && mt[i] == k {
+			out.Write(baseLines[i])
+			i, j, k = i+1, j+1, k+1
+			continue
+		}
+		// Find the next base line that is unchanged on both sides.
+		l := i
+		for l < len(b) && (mo[l] < 0 || mt[l] < 0) {
+			l++
+		}
+		jEnd, kEnd := len(o), len(t)
+		if l < len(b) {
+			jEnd, kEnd = mo[l], mt[l]
+		}
+		if i == l && j == jEnd && k == kEnd {
+			break
+		}
+		switch {
+		case slices.Equal(b[i:l], o[j:jEnd]):
+			writeLines(&out, theirsLines[k:kEnd])
+		case slices.Equal(b[i:l], t[k:kEnd]) || slices.Equal(o[j:jEnd], t[k:kEnd]):
+			writeLines(&out, oursLines[j:jEnd])
+		default:
+			writeConflict(&out, oursLines[j:jEnd], o[j:jEnd], theirsLines[k:kEnd], t[k:kEnd])
+			conflicts++
+		}
+		i, j, k = l, jEnd, kEnd
+	}
+	return out.Bytes(), conflicts, true
+}
+
+// Write the differing lines of both sides between conflict markers, the
+// lines they start or end with are the same on both sides and are written
+// outside of the markers.
+func writeConflict(out *bytes.Buffer, ours [][]byte, o []int, theirs [][]byte, t []int) {
+	prefix := 0
+	for prefix < len(o) && prefix < len(t) && o[prefix] == t[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(o)-prefix && suffix < len(t)-prefix && o[len(o)-1-suffix] == t[len(t)-1-suffix] {
+		suffix++
+	}
+	writeLines(out, ours[:prefix])
+	writeMarker(out, ConflictMarkerWorkspace)
+	writeLines(out, ours[prefix:len(ours)-suffix])
+	writeMarker(out, ConflictMarkerSeparator)
+	writeLines(out, theirs[prefix:len(theirs)-suffix])
+	writeMarker(out, ConflictMarkerRepository)
+	writeLines(out, ours[len(ours)-suffix:])
+}
+
+// Write a conflict marker on its own line, even if the last line of the
+// file before it has no line break.
+func writeMarker(out *bytes.Buffer, marker string) {
+	if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		out.WriteByte('\n')
+	}
+	out.WriteString(marker + "\n")
+}
+
+func writeLines(out *bytes.Buffer, lines [][]byte) {
+	for _, line := range lines {
+		out.Write(line)
+	}
+}
+
+// Split `content` into lines (including the line breaks) and map each line
+// to a number, equal lines get the same number.
+func internLines(content []byte, ids map[string]int) ([][]byte, []int) {
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	numbers := make([]int, len(lines))
+	for i, line := range lines {
+		id, ok := ids[string(line)]
+		if !ok {
+			id = len(ids)
+			ids[string(line)] = id
+		}
+		numbers[i] = id
+	}
+	return lines, numbers
+}
+
+// Return for each line of `a` the index of the same line in `b` according to
+// the shortest edit script (Myers' diff), -1 if the line is not in `b`.
+// `ok` is false if more than `maxEdits` lines would have to be added or
+// removed.
+func matchLines(a, b []int, maxEdits int) (matches []int, ok bool) {
+	matches = make([]int, len(a))
+	for i := range matches {
+		matches[i] = -1
+	}
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		matches[prefix] = prefix
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		matches[len(a)-1-suffix] = len(b) - 1 - suffix
+		suffix++
+	}
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	n, m := len(a), len(b)
+	maxD := min(n+m, maxEdits)
+	offset := maxD + 1
+	v := make([]int, 2*maxD+3)
+	var trace [][]int
+	for d := 0; d <= maxD; d++ {
+		trace = append(trace, slices.Clone(v))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+			if x < n || y < m {
+				continue
+			}
+			// Follow the edit script back to the start.
+			for ; d > 0; d-- {
+				prev := trace[d]
+				dk := x - y
+				prevK := dk - 1
+				if dk == -d || (dk != d && prev[offset+dk-1] < prev[offset+dk+1]) {
+					prevK = dk + 1
+				}
+				prevX := prev[offset+prevK]
+				prevY := prevX - prevK
+				for x > prevX && y > prevY {
+					x, y = x-1, y-1
+					matches[prefix+x] = prefix + y
+				}
+				x, y = prevX, prevY
+			}
+			for x > 0 && y > 0 {
+				x, y = x-1, y-1
+				matches[prefix+x] = prefix + y
+			}
+			return matches, true
+		}
+	}
+	return nil, false
+}
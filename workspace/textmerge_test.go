@@ -0,0 +1,177 @@
+package workspace
+
+import (
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestMergeText(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		base      string
+		ours      string
+		theirs    string
+		expected  string
+		conflicts int
+	}{
+		{"Unchanged", "a\nb\n", "a\nb\n", "a\nb\n", "a\nb\n", 0},
+		{"Only ours changed", "a\nb\nc\n", "a\nB\nc\n", "a\nb\nc\n", "a\nB\nc\n", 0},
+		{"Only theirs changed", "a\nb\nc\n", "a\nb\nc\n", "a\nb\nC\n", "a\nb\nC\n", 0},
+		{"Different lines changed", "a\nb\nc\nd\n", "A\nb\nc\nd\n", "a\nb\nc\nD\n", "A\nb\nc\nD\n", 0},
+		{"Same change on both sides", "a\nb\n", "a\nB\n", "a\nB\n", "a\nB\n", 0},
+		{"Insert and delete", "a\nb\nc\n", "a\nx\nb\nc\n", "a\nb\n", "a\nx\nb\n", 0},
+		{
+			"Same lines changed",
+			"a\nb\nc\n",
+			"a\nours\nc\n",
+			"a\ntheirs\nc\n",
+			"a\n<<<<<<< workspace\nours\n=======\ntheirs\n>>>>>>> repository\nc\n",
+			1,
+		},
+		{
+			"Common lines of a conflict are kept outside the markers",
+			"a\nb\n",
+			"a\nx\nours\ny\n",
+			"a\nx\ntheirs\ny\n",
+			"a\nx\n<<<<<<< workspace\nours\n=======\ntheirs\n>>>>>>> repository\ny\n",
+			1,
+		},
+		{
+			"Added on both sides",
+			"",
+			"ours\n",
+			"theirs\n",
+			"<<<<<<< workspace\nours\n=======\ntheirs\n>>>>>>> repository\n",
+			1,
+		},
+		{
+			"Missing line break at the end",
+			"a",
+			"ours",
+			"theirs",
+			"<<<<<<< workspace\nours\n=======\ntheirs\n>>>>>>> repository\n",
+			1,
+		},
+		{"Missing line break at the end is kept", "a\nb", "A\nb", "a\nb", "A\nb", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			assert := lib.NewAssert(t)
+			merged, conflicts, ok := mergeText([]byte(test.base), []byte(test.ours), []byte(test.theirs))
+			assert.Equal(true, ok)
+			assert.Equal(test.expected, string(merged))
+			assert.Equal(test.conflicts, conflicts)
+		})
+	}
+}
+
+func TestMatchLines(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	matches, ok := matchLines([]int{1, 2, 3, 4, 5}, []int{1, 3, 6, 4, 5, 7}, 100)
+	assert.Equal(true, ok)
+	assert.Equal([]int{0, -1, 1, 3, 4}, matches)
+
+	_, ok = matchLines([]int{1, 2, 3, 4}, []int{5, 6, 7, 8}, 4)
+	assert.Equal(false, ok)
+}
+
+func TestMergeWithMergeText(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Text files are merged line by line", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w2 := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a\nb\nc\n")
+		w.Write("b.bin", "b")
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+
+		w.Write("a.txt", "A\nb\nc\n")
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		w2.Write("a.txt", "a\nb\nC\n")
+		opts := wstd.MergeOptions()
+		opts.MergeText = true
+		head, err := Merge(t.Context(), w2.Workspace, r.Repository, opts)
+		assert.NoError(err)
+		assert.Equal("A\nb\nC\n", w2.Cat("a.txt"))
+		assert.Equal(head, r.Head())
+		assert.Equal(head, w2.Head())
+		unresolved, err := w2.Workspace.UnresolvedConflicts(t.Context())
+		assert.NoError(err)
+		assert.Equal(0, len(unresolved))
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.Equal("A\nb\nC\n", w.Cat("a.txt"))
+
+		// Binary files still conflict and nothing is changed.
+		w.Write("b.bin", "b\x00b")
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		w2.Write("a.txt", "a\n")
+		w2.Write("b.bin", "bb")
+		_, err = Merge(t.Context(), w2.Workspace, r.Repository, opts)
+		conflicts, ok := err.(MergeConflictsError) //nolint:errorlint
+		assert.Equal(true, ok)
+		assert.Equal(1, len(conflicts))
+		assert.Equal("b.bin", conflicts[0].WorkspaceEntry.Path.String())
+		assert.Equal("a\n", w2.Cat("a.txt"))
+	})
+
+	t.Run("Files with conflict markers are not committed", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w2 := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a\nb\n")
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+
+		w.Write("a.txt", "a\ntheirs\n")
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		remoteHead := r.Head()
+		w2.Write("a.txt", "a\nours\n")
+		w2.Write("c.txt", "c")
+		opts := wstd.MergeOptions()
+		opts.MergeText = true
+		_, err = Merge(t.Context(), w2.Workspace, r.Repository, opts)
+		assert.NoError(err)
+		assert.Equal(
+			"a\n<<<<<<< workspace\nours\n=======\ntheirs\n>>>>>>> repository\n",
+			w2.Cat("a.txt"),
+		)
+		unresolved, err := w2.Workspace.UnresolvedConflicts(t.Context())
+		assert.NoError(err)
+		assert.Equal([]lib.Path{td.Path("a.txt")}, unresolved)
+		assert.Equal([]lib.TestRevisionEntryInfo{
+			{"c.txt", lib.RevisionEntryKindAdd, 0o600, td.SHA256("c")},
+		}, r.RevisionInfos(r.Head()))
+
+		// The repository version is kept while the markers are in place.
+		_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+		assert.ErrorIs(err, ErrUpToDate)
+		w2.Write("a.txt", "a\nresolved\n")
+		_, err = Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.NotEqual(remoteHead, r.Head())
+		unresolved, err = w2.Workspace.UnresolvedConflicts(t.Context())
+		assert.NoError(err)
+		assert.Equal(0, len(unresolved))
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.Equal("a\nresolved\n", w.Cat("a.txt"))
+	})
+}
@@ -0,0 +1,109 @@
+package workspace
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+var ErrNotDeleted = lib.Errorf("the path was not deleted")
+
+type UndeleteOptions struct {
+	// The deleted path relative to the workspace path prefix. A deleted
+	// directory is brought back with everything that was below it.
+	Path lib.Path
+	// Overwrite local changes of the path.
+	Force                  bool
+	StagingMonitor         StagingEntryMonitor
+	CpMonitor              CpMonitor
+	RestorableMetadataFlag lib.RestorableMetadataFlag
+	UseStagingCache        bool
+}
+
+type Deletion struct {
+	// The revision that deleted the path.
+	DeletedIn lib.RevisionId
+	// The last revision that contained the path, i.e. the parent of
+	// `DeletedIn`.
+	RevisionId lib.RevisionId
+}
+
+// FindDeletion walks the revisions from the head backwards to the revision
+// that deleted `path` (a repository path).
+// Return `ErrNotDeleted` if the path exists in the head or never existed.
+func FindDeletion(ctx context.Context, repository *lib.Repository, path lib.Path) (Deletion, error) {
+	revisionId, err := repository.Head(ctx)
+	if err != nil {
+		return Deletion{}, lib.WrapErrorf(err, "failed to get head revision")
+	}
+	buf := lib.NewBlockBuf()
+	for !revisionId.IsRoot() {
+		revision, err := repository.ReadRevision(ctx, revisionId, buf)
+		if err != nil {
+			return Deletion{}, lib.WrapErrorf(err, "failed to read revision %s", revisionId)
+		}
+		reader := lib.NewRevisionReader(repository, &revision)
+		for {
+			entry, err := reader.Read(ctx, buf)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return Deletion{}, lib.WrapErrorf(err, "failed to read revision %s", revisionId)
+			}
+			if entry.Path != path {
+				continue
+			}
+			if entry.Kind != lib.RevisionEntryKindDelete {
+				return Deletion{}, lib.WrapErrorf(
+					ErrNotDeleted,
+					"%s exists, it was written in revision %s",
+					path,
+					revisionId,
+				)
+			}
+			return Deletion{revisionId, revision.ParentRevisionId}, nil
+		}
+		revisionId = revision.ParentRevisionId
+	}
+	return Deletion{}, lib.WrapErrorf(ErrNotDeleted, "%s was never in the repository", path)
+}
+
+// Undelete brings back a path that was deleted from the repository, e.g.
+// by `Rm` or by a merge of a workspace where it was deleted. Blocks are
+// never removed from a repository, so the path is copied from the last
+// revision that contained it (see `FindDeletion`).
+// Like `Restore`, the path is written into the workspace and committed by
+// the next `Merge`.
+func Undelete(
+	ctx context.Context,
+	ws *Workspace,
+	repository *lib.Repository,
+	opts *UndeleteOptions,
+) (Deletion, int, error) {
+	deletion, err := FindDeletion(ctx, repository, ws.PathPrefix.Join(opts.Path))
+	if err != nil {
+		return Deletion{}, 0, err
+	}
+	n, err := Restore(ctx, ws, repository, &RestoreOptions{
+		RevisionId:             deletion.RevisionId,
+		PathFilter:             &pathTreeFilter{opts.Path},
+		Force:                  opts.Force,
+		StagingMonitor:         opts.StagingMonitor,
+		CpMonitor:              opts.CpMonitor,
+		RestorableMetadataFlag: opts.RestorableMetadataFlag,
+		UseStagingCache:        opts.UseStagingCache,
+	})
+	return deletion, n, err
+}
+
+// Include `root` and everything below it.
+type pathTreeFilter struct {
+	root lib.Path
+}
+
+func (f *pathTreeFilter) Include(p lib.Path, _ bool) bool {
+	return p == f.root || p.IsRelativeTo(f.root)
+}
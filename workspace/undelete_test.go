@@ -0,0 +1,89 @@
+package workspace
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestUndelete(t *testing.T) {
+	t.Parallel()
+	undeleteOptions := func(path string) *UndeleteOptions {
+		return &UndeleteOptions{
+			Path:                   td.Path(path),
+			Force:                  false,
+			StagingMonitor:         wstd.StagingMonitor(),
+			CpMonitor:              wstd.CpMonitor(),
+			RestorableMetadataFlag: lib.RestorableMetadataAll,
+			UseStagingCache:        false,
+		}
+	}
+
+	t.Run("Paths deleted by rm and merge are brought back", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		w.Write("c/1.txt", "c1")
+		w.Write("c/d/2.txt", "cd2")
+		revId1, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		w.Rm("a.txt")
+		revId2, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		_, revId3, err := Rm(t.Context(), r.Repository, &RmOptions{
+			PathFilter: lib.NewPathInclusionFilter([]string{"c"}),
+			PathPrefix: lib.Path{},
+			Author:     "test author",
+			Message:    "rm",
+			DryRun:     false,
+		}, td.NewFS(t))
+		assert.NoError(err)
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		assert.Equal([]lib.TestFileInfo{}, w.Ls("."))
+
+		deletion, n, err := Undelete(t.Context(), w.Workspace, r.Repository, undeleteOptions("a.txt"))
+		assert.NoError(err)
+		assert.Equal(Deletion{revId2, revId1}, deletion)
+		assert.Equal(1, n)
+		deletion, n, err = Undelete(t.Context(), w.Workspace, r.Repository, undeleteOptions("c"))
+		assert.NoError(err)
+		assert.Equal(Deletion{revId3, revId2}, deletion)
+		assert.Equal(4, n)
+		assert.Equal([]lib.TestFileInfo{
+			{"a.txt", 0o600, 1, "a"},
+			{"c", 0o700 | fs.ModeDir, 0, ""},
+			{"c/1.txt", 0o600, 2, "c1"},
+			{"c/d", 0o700 | fs.ModeDir, 0, ""},
+			{"c/d/2.txt", 0o600, 3, "cd2"},
+		}, w.Ls("."))
+		status, err := Status(t.Context(), w.Workspace, r.Repository, wstd.StatusOptions(), td.NewFS(t))
+		assert.NoError(err)
+		assert.Equal([]string{"A a.txt", "A c/", "A c/1.txt", "A c/d/", "A c/d/2.txt"}, formatStatus(status))
+	})
+
+	t.Run("Paths that exist or never existed are not deleted", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		_, err := Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		w.Rm("a.txt")
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		w.Write("a.txt", "new")
+		_, err = Merge(t.Context(), w.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+
+		_, _, err = Undelete(t.Context(), w.Workspace, r.Repository, undeleteOptions("a.txt"))
+		assert.ErrorIs(err, ErrNotDeleted)
+		_, _, err = Undelete(t.Context(), w.Workspace, r.Repository, undeleteOptions("b.txt"))
+		assert.ErrorIs(err, ErrNotDeleted)
+		assert.Equal("new", w.Cat("a.txt"))
+	})
+}
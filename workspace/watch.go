@@ -0,0 +1,280 @@
+package workspace
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// The path of the status socket of a running `Watcher`, relative to the
+// workspace root.
+const WatchSocketPath = workspaceDir + "/watch.sock"
+
+type WatchState string
+
+const (
+	WatchStateIdle    WatchState = "idle"
+	WatchStatePending WatchState = "pending"
+	WatchStateMerging WatchState = "merging"
+	WatchStateFailed  WatchState = "failed"
+)
+
+// WatchStatus is what a running `Watcher` reports on its status socket.
+type WatchStatus struct {
+	State WatchState `json:"state"`
+	// The time of the last local change that has not been merged yet.
+	PendingSince time.Time `json:"pendingSince,omitzero"`
+	LastMerge    time.Time `json:"lastMerge,omitzero"`
+	// The workspace head after the last successful merge.
+	Head      string `json:"head"`
+	Merges    int    `json:"merges"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+type WatchMonitor interface {
+	OnMergeStart(reason string)
+	// `err` is nil if the merge succeeded or there was nothing to merge.
+	OnMergeEnd(revisionId lib.RevisionId, err error)
+}
+
+type WatchOptions struct {
+	// Called for every merge, so that each merge gets fresh monitors.
+	MergeOptions func() *MergeOptions
+	// How often the workspace and the repository head are checked.
+	PollInterval time.Duration
+	// A local change is merged once the workspace did not change for this long.
+	QuietPeriod time.Duration
+	// Only changes to paths included by the filter trigger a merge. Changes
+	// to other paths are still committed by the next merge, `.clingignore`
+	// keeps them out of the repository.
+	PathFilter lib.PathFilter
+	Monitor    WatchMonitor
+}
+
+type Watcher struct {
+	ws         *Workspace
+	repository *lib.Repository
+	opts       *WatchOptions
+	mu         sync.Mutex
+	status     WatchStatus
+}
+
+func NewWatcher(ws *Workspace, repository *lib.Repository, opts *WatchOptions) *Watcher {
+	return &Watcher{ws, repository, opts, sync.Mutex{}, WatchStatus{State: WatchStateIdle}} //nolint:exhaustruct
+}
+
+func (w *Watcher) Status() WatchStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.status
+}
+
+func (w *Watcher) setStatus(f func(s *WatchStatus)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	f(&w.status)
+}
+
+// Merge while holding the workspace lock. A command running in the workspace
+// in the meantime is waited for.
+func (w *Watcher) lockedMerge(ctx context.Context) (lib.RevisionId, error) {
+	unlock, err := w.ws.Lock(ctx, true)
+	if err != nil {
+		return lib.RevisionId{}, err
+	}
+	defer unlock() //nolint:errcheck
+	return Merge(ctx, w.ws, w.repository, w.opts.MergeOptions())
+}
+
+// Run merges the workspace once and then polls the workspace and the
+// repository until `ctx` is done.
+// The workspace is merged again once a local change has settled for
+// `opts.QuietPeriod` or whenever the repository head moved.
+// A failed merge (e.g. because of conflicts) is only retried after the next
+// change, local or remote.
+// Return `nil` if `ctx` is done.
+func (w *Watcher) Run(ctx context.Context) error { //nolint:funlen
+	var lastFingerprint lib.Sha256
+	var lastChange time.Time
+	pending := false
+	// The repository head the workspace was last merged with (or the last
+	// failed attempt).
+	lastRemoteHead, err := w.ws.Head(ctx)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	merge := func(reason string) error {
+		w.setStatus(func(s *WatchStatus) { s.State = WatchStateMerging })
+		w.opts.Monitor.OnMergeStart(reason)
+		revisionId, mergeErr := w.lockedMerge(ctx)
+		if errors.Is(mergeErr, ErrUpToDate) {
+			revisionId, mergeErr = w.ws.Head(ctx)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		w.opts.Monitor.OnMergeEnd(revisionId, mergeErr)
+		// A merge changes the workspace itself.
+		var err error
+		if lastFingerprint, err = w.fingerprint(); err != nil {
+			return err
+		}
+		if remoteHead, err := w.repository.Head(ctx); err == nil {
+			lastRemoteHead = remoteHead
+		}
+		pending = false
+		w.setStatus(func(s *WatchStatus) {
+			s.PendingSince = time.Time{}
+			if mergeErr != nil {
+				s.State = WatchStateFailed
+				s.LastError = mergeErr.Error()
+				return
+			}
+			s.State = WatchStateIdle
+			s.LastError = ""
+			s.LastMerge = time.Now() //nolint:forbidigo
+			s.Head = revisionId.String()
+			s.Merges++
+		})
+		return nil
+	}
+	if err := merge("startup"); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(w.opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		fingerprint, err := w.fingerprint()
+		if err != nil {
+			return err
+		}
+		now := time.Now() //nolint:forbidigo
+		if fingerprint != lastFingerprint {
+			lastFingerprint = fingerprint
+			lastChange = now
+			if !pending {
+				pending = true
+				w.setStatus(func(s *WatchStatus) {
+					s.State = WatchStatePending
+					s.PendingSince = now
+				})
+			}
+		}
+		remoteHead, err := w.repository.Head(ctx)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to read repository head")
+		}
+		switch {
+		case remoteHead != lastRemoteHead:
+			err = merge("repository changed")
+		case pending && now.Sub(lastChange) >= w.opts.QuietPeriod:
+			err = merge("local changes")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// fingerprint hashes path, size, mode, and mtime of all files that are not
+// ignored or excluded by `opts.PathFilter`.
+func (w *Watcher) fingerprint() (lib.Sha256, error) {
+	h := sha256.New()
+	var buf [8]byte
+	err := lib.WalkDirIgnore(w.ws.FS, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files might be deleted while we walk.
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if path == "." {
+			return nil
+		}
+		if filepath.Base(path) == ".cling" || lib.IsAtomicWriteTempFile(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		localPath, err := lib.NewPath(path)
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to create path from %s", path)
+		}
+		if w.opts.PathFilter != nil && !w.opts.PathFilter.Include(localPath, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to get file info for %s", path)
+		}
+		h.Write([]byte(path))
+		h.Write([]byte{0})
+		for _, v := range []int64{info.Size(), int64(info.Mode()), info.ModTime().UnixNano()} {
+			binary.LittleEndian.PutUint64(buf[:], uint64(v)) //nolint:gosec
+			h.Write(buf[:])
+		}
+		return nil
+	})
+	if err != nil {
+		return lib.Sha256{}, lib.WrapErrorf(err, "failed to scan workspace")
+	}
+	return lib.Sha256(h.Sum(nil)), nil
+}
+
+// ServeWatchStatus writes the JSON encoded `Watcher.Status` to every
+// connection accepted by `l` until `l` is closed.
+func ServeWatchStatus(l net.Listener, w *Watcher) error {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to accept status connection")
+		}
+		_ = json.NewEncoder(conn).Encode(w.Status())
+		_ = conn.Close()
+	}
+}
+
+// ReadWatchStatus asks the `Watcher` listening on `socketPath` for its status.
+func ReadWatchStatus(ctx context.Context, socketPath string) (WatchStatus, error) {
+	var status WatchStatus
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return status, lib.WrapErrorf(err, "failed to connect to %s (is `watch` running?)", socketPath)
+	}
+	defer conn.Close() //nolint:errcheck
+	data, err := io.ReadAll(io.LimitReader(conn, 64*1024))
+	if err != nil {
+		return status, lib.WrapErrorf(err, "failed to read status")
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return status, lib.WrapErrorf(err, "failed to parse status")
+	}
+	return status, nil
+}
@@ -0,0 +1,131 @@
+package workspace
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+type testWatchMonitor struct {
+	mu      sync.Mutex
+	reasons []string
+}
+
+func (m *testWatchMonitor) OnMergeStart(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reasons = append(m.reasons, reason)
+}
+
+func (m *testWatchMonitor) OnMergeEnd(revisionId lib.RevisionId, err error) {}
+
+func (m *testWatchMonitor) Reasons() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.reasons...)
+}
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+	waitFor := func(t *testing.T, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal("timeout")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	watch := func(t *testing.T, w *TestWorkspace, r *lib.TestRepository, filter lib.PathFilter) (*Watcher, *testWatchMonitor) {
+		t.Helper()
+		mon := &testWatchMonitor{} //nolint:exhaustruct
+		watcher := NewWatcher(w.Workspace, r.Repository, &WatchOptions{
+			MergeOptions: wstd.MergeOptions,
+			PollInterval: 10 * time.Millisecond,
+			QuietPeriod:  50 * time.Millisecond,
+			PathFilter:   filter,
+			Monitor:      mon,
+		})
+		ctx, cancel := context.WithCancel(t.Context())
+		done := make(chan error)
+		go func() { done <- watcher.Run(ctx) }()
+		t.Cleanup(func() {
+			cancel()
+			lib.NewAssert(t).NoError(<-done)
+		})
+		waitFor(t, func() bool { return watcher.Status().Merges == 1 })
+		return watcher, mon
+	}
+
+	t.Run("Local changes are merged after the quiet period", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		watcher, mon := watch(t, w, r, nil)
+		assert.Equal(WatchStateIdle, watcher.Status().State)
+		w.Write("a.txt", "a")
+		waitFor(t, func() bool { return watcher.Status().Merges == 2 })
+		status := watcher.Status()
+		assert.Equal(WatchStateIdle, status.State)
+		assert.Equal(r.Head().String(), status.Head)
+		assert.Equal([]string{"startup", "local changes"}, mon.Reasons())
+	})
+
+	t.Run("Repository changes are merged", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w1 := wstd.NewTestWorkspace(t, r.Repository)
+		w2 := wstd.NewTestWorkspace(t, r.Repository)
+		watcher, mon := watch(t, w1, r, nil)
+		w2.Write("b.txt", "b")
+		_, err := Merge(t.Context(), w2.Workspace, r.Repository, wstd.MergeOptions())
+		assert.NoError(err)
+		waitFor(t, func() bool { return watcher.Status().Merges == 2 })
+		assert.Equal("b", w1.Cat("b.txt"))
+		assert.Equal([]string{"startup", "repository changed"}, mon.Reasons())
+	})
+
+	t.Run("Excluded paths do not trigger a merge", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		watcher, _ := watch(t, w, r, lib.NewPathExclusionFilter([]string{"*.tmp"}))
+		w.Write("a.tmp", "a")
+		time.Sleep(200 * time.Millisecond)
+		assert.Equal(1, watcher.Status().Merges)
+		// The excluded file is committed with the next merge.
+		w.Write("b.txt", "b")
+		waitFor(t, func() bool { return watcher.Status().Merges == 2 })
+		files, err := Ls(t.Context(), r.Repository, td.NewFS(t), wstd.LsOptions(w.Head()))
+		assert.NoError(err)
+		assert.Equal(2, len(files))
+	})
+
+	t.Run("Status socket", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		watcher, _ := watch(t, w, r, nil)
+		socketPath := filepath.Join(t.TempDir(), "watch.sock")
+		l, err := net.Listen("unix", socketPath)
+		assert.NoError(err)
+		defer l.Close() //nolint:errcheck
+
+		go ServeWatchStatus(l, watcher) //nolint:errcheck
+		status, err := ReadWatchStatus(t.Context(), socketPath)
+		assert.NoError(err)
+		assert.Equal(WatchStateIdle, status.State)
+		assert.Equal(1, status.Merges)
+		assert.Equal(true, status.LastMerge.Equal(watcher.Status().LastMerge))
+	})
+}
@@ -0,0 +1,181 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// The watch journal is written by `RunWatchJournal` and lists the
+// directories that changed, so that a scan only has to look at those.
+// The first line identifies the journal, every other line is either
+//
+//	d <quoted path>   the entries of the directory changed
+//	r <quoted path>   everything below the directory has to be scanned again
+//
+// The paths are relative to the workspace root, the root itself is ".".
+const (
+	WatchJournalPath       = workspaceDir + "/watch-journal.txt"
+	WatchJournalSocketPath = workspaceDir + "/watch-journal.sock"
+	watchJournalHeader     = "cling-sync watch journal "
+	// The position in the journal that corresponds to the staging cache.
+	stagingJournalMarkerPath = cacheDir + "/staging-journal.json"
+)
+
+// WatchJournalPosition is what `RunWatchJournal` reports on its socket.
+// All changes up to the moment it was asked for are in the journal
+// before `Offset`.
+type WatchJournalPosition struct {
+	// A new journal gets a new id, offsets of another journal are meaningless.
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+}
+
+// ReadWatchJournalPosition asks the journal watcher listening on
+// `socketPath` for the current end of its journal.
+func ReadWatchJournalPosition(ctx context.Context, socketPath string) (WatchJournalPosition, error) {
+	var position WatchJournalPosition
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return position, lib.WrapErrorf(
+			err,
+			"failed to connect to %s (is `watch --journal-only` running?)",
+			socketPath,
+		)
+	}
+	defer conn.Close() //nolint:errcheck
+	data, err := io.ReadAll(io.LimitReader(conn, 64*1024))
+	if err != nil {
+		return position, lib.WrapErrorf(err, "failed to read journal position")
+	}
+	if err := json.Unmarshal(data, &position); err != nil {
+		return position, lib.WrapErrorf(err, "failed to parse journal position")
+	}
+	return position, nil
+}
+
+func formatWatchJournalEntry(kind byte, path string) string {
+	return string(kind) + " " + strconv.Quote(path) + "\n"
+}
+
+// The directories that changed between two positions of the journal.
+type watchJournalChanges struct {
+	// The directories with changed entries and all their parents.
+	touched map[string]bool
+	// The directories that have to be scanned recursively.
+	rescan map[string]bool
+}
+
+func parseWatchJournal(data []byte) (*watchJournalChanges, error) {
+	changes := &watchJournalChanges{map[string]bool{}, map[string]bool{}}
+	for line := range strings.SplitSeq(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		if len(line) < 3 || line[1] != ' ' {
+			return nil, lib.Errorf("invalid watch journal entry %q", line)
+		}
+		path, err := strconv.Unquote(line[2:])
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "invalid path in watch journal entry %q", line)
+		}
+		path = filepath.ToSlash(filepath.Clean(path))
+		if path == "." {
+			path = ""
+		}
+		switch line[0] {
+		case 'd':
+		case 'r':
+			changes.rescan[path] = true
+		default:
+			return nil, lib.Errorf("invalid watch journal entry %q", line)
+		}
+		for {
+			changes.touched[path] = true
+			if path == "" {
+				break
+			}
+			path = filepath.ToSlash(filepath.Dir(path))
+			if path == "." {
+				path = ""
+			}
+		}
+	}
+	return changes, nil
+}
+
+// Return `true` if neither `dir` nor anything below it changed.
+// The root is the empty path.
+func (c *watchJournalChanges) unchanged(dir lib.Path) bool {
+	if c.touched[dir.String()] {
+		return false
+	}
+	for p := dir; !p.IsEmpty(); p = p.Dir() {
+		if c.rescan[p.String()] {
+			return false
+		}
+	}
+	return !c.rescan[""]
+}
+
+// Read the changes since the staging cache was written. Return `nil` if the
+// journal cannot tell, i.e. everything has to be scanned.
+func readWatchJournalChanges(src lib.FS, position WatchJournalPosition) (*watchJournalChanges, error) {
+	data, err := lib.ReadFile(src, stagingJournalMarkerPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil //nolint:nilnil
+	}
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read staging journal marker")
+	}
+	var marker WatchJournalPosition
+	if err := json.Unmarshal(data, &marker); err != nil {
+		return nil, lib.WrapErrorf(err, "failed to parse staging journal marker")
+	}
+	if marker.ID != position.ID || marker.Offset > position.Offset {
+		return nil, nil //nolint:nilnil
+	}
+	journal, err := lib.ReadFile(src, WatchJournalPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil //nolint:nilnil
+	}
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read watch journal")
+	}
+	header, _, _ := bytes.Cut(journal, []byte("\n"))
+	if string(header) != watchJournalHeader+position.ID || position.Offset > int64(len(journal)) {
+		// The journal was rotated in the meantime.
+		return nil, nil //nolint:nilnil
+	}
+	return parseWatchJournal(journal[marker.Offset:position.Offset])
+}
+
+// Remember that the staging cache reflects the workspace at `position`.
+// Without `position`, the marker is removed and the next scan cannot use
+// the journal.
+func writeStagingJournalMarker(src lib.FS, position *WatchJournalPosition) error {
+	if position == nil {
+		if err := src.Remove(stagingJournalMarkerPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return lib.WrapErrorf(err, "failed to remove staging journal marker")
+		}
+		return nil
+	}
+	data, err := json.Marshal(position)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to marshal staging journal marker")
+	}
+	if err := lib.AtomicWriteFile(src, stagingJournalMarkerPath, 0o600, data); err != nil {
+		return lib.WrapErrorf(err, "failed to write staging journal marker")
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+//go:build linux
+
+package workspace
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+const (
+	// How often pending inotify events are read.
+	watchJournalPollInterval = 100 * time.Millisecond
+	// Once the journal is larger, a new journal is started. The next scan
+	// then has to look at everything once.
+	watchJournalMaxSize = 8 * 1024 * 1024
+	watchJournalMask    = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+		syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF |
+		syscall.IN_ONLYDIR | syscall.IN_DONT_FOLLOW
+)
+
+type inotifyJournal struct {
+	root    string
+	fs      lib.FS
+	fd      int
+	watches map[int32]string
+	file    *os.File
+	w       *bufio.Writer
+	id      string
+	size    int64
+	// The entries written since the position was last reported.
+	written map[string]bool
+}
+
+// RunWatchJournal watches all directories of the workspace at `root` with
+// inotify and writes the directories that change to the watch journal
+// (`WatchJournalPath`) until `ctx` is done. The current position in the
+// journal is written to every connection accepted by `l`.
+// Pass the position to `StatusOptions.WatchJournal` or
+// `MergeOptions.WatchJournal`, so that only the directories that changed
+// since the last scan are scanned.
+func RunWatchJournal(ctx context.Context, root string, l net.Listener) error { //nolint:funlen
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to initialize inotify")
+	}
+	defer syscall.Close(fd) //nolint:errcheck
+	j := &inotifyJournal{   //nolint:exhaustruct
+		root:    root,
+		fs:      lib.NewRealFS(root),
+		fd:      fd,
+		watches: map[int32]string{},
+		written: map[string]bool{},
+	}
+	if err := j.rotate(); err != nil {
+		return err
+	}
+	defer j.file.Close() //nolint:errcheck
+	// Watch first, everything that changes while the watches are added is
+	// in the journal.
+	if err := j.addWatches("."); err != nil {
+		return err
+	}
+	requests := make(chan net.Conn)
+	go func() {
+		defer close(requests)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			select {
+			case requests <- conn:
+			case <-ctx.Done():
+				_ = conn.Close()
+				return
+			}
+		}
+	}()
+	ticker := time.NewTicker(watchJournalPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := j.readEvents(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case conn, ok := <-requests:
+			if !ok {
+				return nil
+			}
+			// Make sure all changes made before the request are in the journal.
+			err := j.readEvents()
+			if err == nil {
+				_ = json.NewEncoder(conn).Encode(WatchJournalPosition{j.id, j.size})
+				clear(j.written)
+			}
+			_ = conn.Close()
+			if err != nil {
+				return err
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// Start a new journal.
+func (j *inotifyJournal) rotate() error {
+	if j.file != nil {
+		_ = j.file.Close()
+	}
+	id, err := lib.RandStr(16)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to generate watch journal id")
+	}
+	path := filepath.Join(j.root, WatchJournalPath)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600) //nolint:forbidigo
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to create watch journal %s", path)
+	}
+	j.file = f
+	j.w = bufio.NewWriter(f)
+	j.id = id
+	j.size = 0
+	clear(j.written)
+	return j.write(watchJournalHeader + id + "\n")
+}
+
+func (j *inotifyJournal) write(s string) error {
+	n, err := j.w.WriteString(s)
+	j.size += int64(n)
+	if err != nil {
+		return lib.WrapErrorf(err, "failed to write watch journal")
+	}
+	return nil
+}
+
+func (j *inotifyJournal) record(kind byte, path string) error {
+	entry := formatWatchJournalEntry(kind, path)
+	if j.written[entry] {
+		return nil
+	}
+	if j.size+int64(len(entry)) > watchJournalMaxSize {
+		if err := j.w.Flush(); err != nil {
+			return lib.WrapErrorf(err, "failed to write watch journal")
+		}
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+	j.written[entry] = true
+	return j.write(entry)
+}
+
+// Add a watch for `dir` and all directories below it that are not ignored.
+func (j *inotifyJournal) addWatches(dir string) error {
+	err := lib.WalkDirIgnore(j.fs, dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path == ".cling" {
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(j.fd, filepath.Join(j.root, path), watchJournalMask)
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ENOTDIR) {
+			// Removed in the meantime, the parent is in the journal.
+			return filepath.SkipDir
+		}
+		if errors.Is(err, syscall.ENOSPC) {
+			return lib.WrapErrorf(err, "too many directories to watch (raise fs.inotify.max_user_watches)")
+		}
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to watch %s", path)
+		}
+		j.watches[int32(wd)] = filepath.ToSlash(path) //nolint:gosec
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err //nolint:wrapcheck
+}
+
+// Read all pending events and write them to the journal.
+func (j *inotifyJournal) readEvents() error {
+	var buf [64 * 1024]byte
+	for {
+		n, err := syscall.Read(j.fd, buf[:])
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if errors.Is(err, syscall.EAGAIN) {
+			break
+		}
+		if err != nil {
+			return lib.WrapErrorf(err, "failed to read inotify events")
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			wd := int32(binary.NativeEndian.Uint32(buf[offset:])) //nolint:gosec
+			mask := binary.NativeEndian.Uint32(buf[offset+4:])
+			nameLen := int(binary.NativeEndian.Uint32(buf[offset+12:]))
+			offset += syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[offset:offset+nameLen]), "\x00")
+			offset += nameLen
+			if err := j.handleEvent(wd, mask, name); err != nil {
+				return err
+			}
+		}
+	}
+	if err := j.w.Flush(); err != nil {
+		return lib.WrapErrorf(err, "failed to write watch journal")
+	}
+	return nil
+}
+
+func (j *inotifyJournal) handleEvent(wd int32, mask uint32, name string) error {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		// Events were lost.
+		return j.record('r', ".")
+	}
+	dir, ok := j.watches[wd]
+	if !ok {
+		return nil
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(j.watches, wd)
+		return nil
+	}
+	if name == "" {
+		// The directory itself changed, that is an entry of its parent.
+		if dir == "." {
+			return nil
+		}
+		return j.record('d', filepath.Dir(dir))
+	}
+	path := filepath.Join(dir, name)
+	if path == ".cling" || strings.HasPrefix(path, ".cling/") {
+		return nil
+	}
+	switch {
+	case name == ".clingignore" || name == ".gitignore":
+		// Paths below `dir` might be included (or excluded) now.
+		if err := j.record('r', dir); err != nil {
+			return err
+		}
+		return j.addWatches(dir)
+	case mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		// Anything might have been put into the directory before it is watched.
+		if err := j.record('d', dir); err != nil {
+			return err
+		}
+		if err := j.record('r', path); err != nil {
+			return err
+		}
+		return j.addWatches(path)
+	default:
+		return j.record('d', dir)
+	}
+}
@@ -0,0 +1,57 @@
+//go:build linux
+
+package workspace
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestRunWatchJournal(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	root := t.TempDir()
+	write := func(path, content string) {
+		assert.NoError(os.MkdirAll(filepath.Join(root, filepath.Dir(path)), 0o700))
+		assert.NoError(os.WriteFile(filepath.Join(root, path), []byte(content), 0o600))
+	}
+	write(".cling/workspace/conf", "")
+	write("a/b/c.txt", "c")
+	write("ignored/d.txt", "d")
+	write(".clingignore", "ignored/\n")
+	socketPath := filepath.Join(t.TempDir(), "journal.sock")
+	l, err := net.Listen("unix", socketPath)
+	assert.NoError(err)
+	defer l.Close() //nolint:errcheck
+	done := make(chan error)
+	go func() { done <- RunWatchJournal(t.Context(), root, l) }()
+	readJournal := func() []string {
+		position, err := ReadWatchJournalPosition(t.Context(), socketPath)
+		assert.NoError(err)
+		data, err := os.ReadFile(filepath.Join(root, WatchJournalPath))
+		assert.NoError(err)
+		assert.Equal(true, strings.HasPrefix(string(data), watchJournalHeader+position.ID+"\n"))
+		assert.Equal(int64(len(data)), position.Offset)
+		return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")[1:]
+	}
+	assert.Equal([]string{}, readJournal())
+
+	write("a/b/c.txt", "cc")
+	write("ignored/d.txt", "dd")
+	write(".cling/workspace/conf", "changed")
+	write("new/sub/e.txt", "e")
+	assert.Equal([]string{`d "a/b"`, `d "."`, `r "new"`}, readJournal())
+
+	// Entries are written again after a position was read.
+	write("a/b/c.txt", "ccc")
+	write("new/sub/e.txt", "ee")
+	assert.Equal([]string{`d "a/b"`, `d "."`, `r "new"`, `d "a/b"`, `d "new/sub"`}, readJournal())
+
+	assert.NoError(l.Close())
+	assert.NoError(<-done)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package workspace
+
+import (
+	"context"
+	"net"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+// RunWatchJournal is only implemented with inotify for now.
+func RunWatchJournal(ctx context.Context, root string, l net.Listener) error {
+	return lib.Errorf("the watch journal is only supported on Linux")
+}
@@ -0,0 +1,168 @@
+package workspace
+
+import (
+	"fmt"
+	"io/fs"
+	"testing"
+
+	"github.com/flunderpero/cling-sync/lib"
+)
+
+func TestWatchJournalChanges(t *testing.T) {
+	t.Parallel()
+	t.Run("Parents of changed directories are changed", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		sut, err := parseWatchJournal([]byte("d \"a/b\"\nr \"c\"\n"))
+		assert.NoError(err)
+		assert.Equal(false, sut.unchanged(lib.Path{}))
+		assert.Equal(false, sut.unchanged(td.Path("a")))
+		assert.Equal(false, sut.unchanged(td.Path("a/b")))
+		assert.Equal(true, sut.unchanged(td.Path("a/b/c")))
+		assert.Equal(true, sut.unchanged(td.Path("a/x")))
+		assert.Equal(false, sut.unchanged(td.Path("c")))
+		assert.Equal(false, sut.unchanged(td.Path("c/d/e")))
+		assert.Equal(true, sut.unchanged(td.Path("cc")))
+	})
+
+	t.Run("Rescan the root", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		sut, err := parseWatchJournal([]byte("r \".\"\n"))
+		assert.NoError(err)
+		assert.Equal(false, sut.unchanged(lib.Path{}))
+		assert.Equal(false, sut.unchanged(td.Path("a/b")))
+	})
+
+	t.Run("Nothing changed", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		sut, err := parseWatchJournal(nil)
+		assert.NoError(err)
+		assert.Equal(true, sut.unchanged(lib.Path{}))
+	})
+
+	t.Run("Paths are quoted", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		sut, err := parseWatchJournal([]byte(formatWatchJournalEntry('d', "new\nline")))
+		assert.NoError(err)
+		assert.Equal(false, sut.unchanged(td.Path("new\nline")))
+		_, err = parseWatchJournal([]byte("d a\n"))
+		assert.Error(err, "invalid path in watch journal entry")
+		_, err = parseWatchJournal([]byte("x \"a\"\n"))
+		assert.Error(err, "invalid watch journal entry")
+	})
+}
+
+func TestStagingWithWatchJournal(t *testing.T) {
+	t.Parallel()
+	stagedPaths := func(t *testing.T, staging *Staging) map[string]lib.Sha256 {
+		t.Helper()
+		finalized, err := staging.Finalize()
+		lib.NewAssert(t).NoError(err)
+		paths := map[string]lib.Sha256{}
+		for _, e := range readAllStagingEntries(t, finalized) {
+			paths[e.RepoPath.String()] = e.Metadata.FileHash
+		}
+		return paths
+	}
+
+	t.Run("Unchanged directories are staged from the cache", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("a.txt", "a")
+		w.Write("x/b.txt", "b")
+		w.Write("x/y/c.txt", "c")
+		w.Symlink("b.txt", "x/link")
+		w.Write("z/d.txt", "d")
+		journal := "cling-sync watch journal j1\n"
+		writeJournal := func(entries string) *WatchJournalPosition {
+			journal += entries
+			assert.NoError(lib.WriteFile(w.Workspace.FS, WatchJournalPath, []byte(journal)))
+			return &WatchJournalPosition{"j1", int64(len(journal))}
+		}
+		newStagingAt := func(position *WatchJournalPosition) *Staging {
+			staging, err := newStaging(
+				w.Workspace.FS, lib.Path{}, nil, true, position, w.TempFS, wstd.StagingMonitor(),
+			)
+			assert.NoError(err)
+			return staging
+		}
+
+		// Without a marker, everything is scanned.
+		initial := stagedPaths(t, newStagingAt(writeJournal("")))
+		assert.Equal(8, len(initial))
+		_, err := w.Workspace.FS.Stat(stagingJournalMarkerPath)
+		assert.NoError(err)
+
+		// The journal does not mention `x`, so changes to it go unnoticed.
+		// This verifies that `x` is not scanned.
+		w.Write("x/y/c.txt", "cc")
+		w.Write("x/new.txt", "new")
+		w.Write("z/d.txt", "dd")
+		staged := stagedPaths(t, newStagingAt(writeJournal(formatWatchJournalEntry('d', "z"))))
+		assert.Equal(8, len(staged))
+		assert.Equal(td.SHA256("c"), staged["x/y/c.txt"])
+		assert.Equal(td.SHA256("dd"), staged["z/d.txt"])
+		_, ok := staged["x/link"]
+		assert.Equal(true, ok)
+
+		// Once it does, `x` is scanned.
+		staged = stagedPaths(t, newStagingAt(writeJournal(formatWatchJournalEntry('r', "x"))))
+		assert.Equal(9, len(staged))
+		assert.Equal(td.SHA256("cc"), staged["x/y/c.txt"])
+		assert.Equal(td.SHA256("new"), staged["x/new.txt"])
+
+		// Nothing changed at all.
+		staged = stagedPaths(t, newStagingAt(writeJournal("")))
+		assert.Equal(9, len(staged))
+		assert.Equal(td.SHA256("cc"), staged["x/y/c.txt"])
+	})
+
+	t.Run("A journal with another id is ignored", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("x/a.txt", "a")
+		writeJournal := func(id string) *WatchJournalPosition {
+			journal := fmt.Sprintf("cling-sync watch journal %s\n", id)
+			assert.NoError(lib.WriteFile(w.Workspace.FS, WatchJournalPath, []byte(journal)))
+			return &WatchJournalPosition{id, int64(len(journal))}
+		}
+		_, err := newStaging(w.Workspace.FS, lib.Path{}, nil, true, writeJournal("j1"), w.TempFS, wstd.StagingMonitor())
+		assert.NoError(err)
+		w.Write("x/a.txt", "aa")
+		staging, err := newStaging(
+			w.Workspace.FS, lib.Path{}, nil, true, writeJournal("j2"), w.TempFS, wstd.StagingMonitor(),
+		)
+		assert.NoError(err)
+		assert.Equal(td.SHA256("aa"), stagedPaths(t, staging)["x/a.txt"])
+	})
+
+	t.Run("A filtered scan removes the marker", func(t *testing.T) {
+		t.Parallel()
+		assert := lib.NewAssert(t)
+		r := td.NewTestRepository(t, td.NewFS(t))
+		w := wstd.NewTestWorkspace(t, r.Repository)
+		w.Write("x/a.txt", "a")
+		w.Write("y/b.txt", "b")
+		journal := "cling-sync watch journal j1\n"
+		assert.NoError(lib.WriteFile(w.Workspace.FS, WatchJournalPath, []byte(journal)))
+		position := &WatchJournalPosition{"j1", int64(len(journal))}
+		_, err := newStaging(w.Workspace.FS, lib.Path{}, nil, true, position, w.TempFS, wstd.StagingMonitor())
+		assert.NoError(err)
+		// The new cache only has `x`, so `y` must be scanned next time.
+		filter := lib.NewPathInclusionFilter([]string{"x/**"})
+		_, err = newStaging(w.Workspace.FS, lib.Path{}, filter, true, position, w.TempFS, wstd.StagingMonitor())
+		assert.NoError(err)
+		_, err = w.Workspace.FS.Stat(stagingJournalMarkerPath)
+		assert.ErrorIs(err, fs.ErrNotExist)
+		staging, err := newStaging(w.Workspace.FS, lib.Path{}, nil, true, position, w.TempFS, wstd.StagingMonitor())
+		assert.NoError(err)
+		assert.Equal(td.SHA256("b"), stagedPaths(t, staging)["y/b.txt"])
+	})
+}
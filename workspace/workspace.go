@@ -1,10 +1,12 @@
 package workspace
 
 import (
+	"bytes"
 	"context"
 	cryptoCipher "crypto/cipher"
 	"errors"
 	"strings"
+	"time"
 
 	"github.com/flunderpero/cling-sync/lib"
 )
@@ -15,10 +17,37 @@ type RemoteRepository string
 
 type Workspace struct {
 	RemoteRepository RemoteRepository
-	PathPrefix       lib.Path
-	Storage          lib.Storage
-	FS               lib.FS
-	TempFS           lib.FS
+	// The repository the workspace is attached to. It is `RemoteRepository`
+	// unless another remote is used, see `UseRemote`.
+	Origin     RemoteRepository
+	PathPrefix lib.Path
+	Storage    lib.Storage
+	FS         lib.FS
+	TempFS     lib.FS
+	// Read from `SparseFile` when the workspace is opened, nil if the
+	// workspace is not sparse.
+	Sparse *SparseFilter
+	// Don't respect the `.gitignore` and `.clingignore` files in the
+	// workspace, i.e. stage, delete, and restore ignored paths, too.
+	NoRepoIgnore bool
+	// Encrypt the staging cache in `.cling/cache` and the commit journal
+	// with a key derived from the repository keys (see `cacheKey`), so that
+	// they do not reveal the paths and hashes of the workspace. They are
+	// dropped whenever the key changes, e.g. when this is turned on or off.
+	EncryptCache bool
+}
+
+// Return the key the staging cache and the commit journal are encrypted
+// with, nil if `EncryptCache` is not set.
+func (w *Workspace) cacheKey(repository *lib.Repository) (*lib.RawKey, error) {
+	if !w.EncryptCache {
+		return nil, nil //nolint:nilnil
+	}
+	key, err := repository.DeriveKey(stagingCacheKeyPurpose)
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to derive the staging cache key")
+	}
+	return &key, nil
 }
 
 // Load the configuration from `<fs>/.cling/workspace.txt`.
@@ -45,7 +74,21 @@ func OpenWorkspace(ctx context.Context, fs lib.FS, tempFS lib.FS) (*Workspace, e
 			return nil, lib.WrapErrorf(err, "invalid path prefix %q", pathPrefix)
 		}
 	}
-	return &Workspace{RemoteRepository(remoteRepository), pathPrefix, storage, fs, tempFS}, nil
+	sparse, err := ReadSparseFilter(fs)
+	if err != nil {
+		return nil, err
+	}
+	return &Workspace{
+		RemoteRepository(remoteRepository),
+		RemoteRepository(remoteRepository),
+		pathPrefix,
+		storage,
+		fs,
+		tempFS,
+		sparse,
+		false,
+		false,
+	}, nil
 }
 
 // Create a new workspace. Workspaces can be nested, i.e. a workspace can be inside another workspace.
@@ -82,7 +125,7 @@ This file contains the configuration of your cling workspace.
 	if err := lib.WriteRef(ctx, storage, "head", lib.RevisionId{}); err != nil {
 		return nil, lib.WrapErrorf(err, "failed to write workspace head reference")
 	}
-	return &Workspace{remoteRepository, pathPrefix, storage, fs, tempFS}, nil
+	return &Workspace{remoteRepository, remoteRepository, pathPrefix, storage, fs, tempFS, nil, false, false}, nil
 }
 
 // Remove `w.TempFS`.
@@ -101,6 +144,40 @@ func (w *Workspace) Head(ctx context.Context) (lib.RevisionId, error) {
 	return ref, nil
 }
 
+// The lock in `.cling/workspace/locks` held by every command that changes
+// the staging cache, the workspace head, or the files in the workspace.
+const workspaceLockName = "workspace"
+
+// How long `Lock` tries to acquire the workspace lock without `wait`.
+const workspaceLockProbeTimeout = 100 * time.Millisecond
+
+var ErrWorkspaceLocked = lib.WrapErrorKindf(lib.ErrContention, nil, "the workspace is locked by another process")
+
+// Lock acquires the workspace lock, so that two commands running in the same
+// workspace don't corrupt the staging cache or race on the workspace head.
+// With `wait`, Lock blocks until the lock is released or `ctx` is done.
+// Otherwise, `ErrWorkspaceLocked` is returned if the lock is held by another
+// process.
+func (w *Workspace) Lock(ctx context.Context, wait bool) (func() error, error) {
+	if wait {
+		unlock, err := w.Storage.Lock(ctx, workspaceLockName)
+		if err != nil {
+			return nil, lib.WrapErrorf(err, "failed to lock the workspace")
+		}
+		return unlock, nil
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, workspaceLockProbeTimeout)
+	defer cancel()
+	unlock, err := w.Storage.Lock(probeCtx, workspaceLockName)
+	if err == nil {
+		return unlock, nil
+	}
+	if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+		return nil, ErrWorkspaceLocked
+	}
+	return nil, lib.WrapErrorf(err, "failed to lock the workspace")
+}
+
 var ErrSavedPassphraseNotFound = lib.Errorf("saved passphrase not found")
 
 const savedPassphraseFileName = "encrypted-passphrase"
@@ -162,6 +239,52 @@ func (w *Workspace) DeleteSavedPassphrase(ctx context.Context) error {
 	return nil
 }
 
+// A plaintext copy of the repository config, so that a workspace is enough
+// to recover from losing the repository's `repository.toml`.
+const repositoryConfigFileName = "repository-config"
+
+var ErrRepositoryConfigNotMirrored = lib.Errorf("no copy of the repository config in the workspace")
+
+// MirrorRepositoryConfig stores `config` (see `lib.Repository.Config`) in the
+// workspace unless an identical copy exists.
+func (w *Workspace) MirrorRepositoryConfig(ctx context.Context, config lib.Toml) error {
+	existing, err := w.ReadRepositoryConfig(ctx)
+	if err == nil && existing.Eq(config) {
+		return nil
+	}
+	if err != nil && !errors.Is(err, ErrRepositoryConfigNotMirrored) {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := lib.WriteToml(&buf, lib.RepositoryConfigHeaderComment, config); err != nil {
+		return lib.WrapErrorf(err, "failed to marshal repository config")
+	}
+	if err := w.Storage.WriteControlFile(
+		ctx,
+		lib.ControlFileSectionConf,
+		repositoryConfigFileName,
+		buf.Bytes(),
+	); err != nil {
+		return lib.WrapErrorf(err, "failed to write copy of repository config")
+	}
+	return nil
+}
+
+func (w *Workspace) ReadRepositoryConfig(ctx context.Context) (lib.Toml, error) {
+	data, err := w.Storage.ReadControlFile(ctx, lib.ControlFileSectionConf, repositoryConfigFileName)
+	if errors.Is(err, lib.ErrControlFileNotFound) {
+		return nil, ErrRepositoryConfigNotMirrored
+	}
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to read copy of repository config")
+	}
+	config, err := lib.ReadToml(bytes.NewReader(data))
+	if err != nil {
+		return nil, lib.WrapErrorf(err, "failed to parse copy of repository config")
+	}
+	return config, nil
+}
+
 func ValidatePathPrefix(pathPrefix string) (lib.Path, error) {
 	if pathPrefix == "" {
 		return lib.Path{}, nil
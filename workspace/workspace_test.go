@@ -2,6 +2,7 @@ package workspace
 
 import (
 	"testing"
+	"time"
 
 	"github.com/flunderpero/cling-sync/lib"
 )
@@ -105,3 +106,57 @@ func TestWorkspaceNewAndOpen(t *testing.T) {
 		assert.NoError(err)
 	})
 }
+
+func TestWorkspaceMirrorRepositoryConfig(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	r := td.NewTestRepository(t, td.NewFS(t))
+	ws, err := NewWorkspace(t.Context(), td.NewFS(t), td.NewFS(t), RemoteRepository("remote"), lib.Path{})
+	assert.NoError(err)
+	_, err = ws.ReadRepositoryConfig(t.Context())
+	assert.ErrorIs(err, ErrRepositoryConfigNotMirrored)
+	assert.NoError(ws.MirrorRepositoryConfig(t.Context(), r.Config()))
+	config, err := ws.ReadRepositoryConfig(t.Context())
+	assert.NoError(err)
+	assert.Equal(true, r.Config().Eq(config))
+
+	// A changed config replaces the copy.
+	changed := lib.Toml{"encryption": r.Config()["encryption"], "storage": {"version": "2"}}
+	assert.NoError(ws.MirrorRepositoryConfig(t.Context(), changed))
+	config, err = ws.ReadRepositoryConfig(t.Context())
+	assert.NoError(err)
+	assert.Equal("2", config["storage"]["version"])
+}
+
+func TestWorkspaceLock(t *testing.T) {
+	t.Parallel()
+	assert := lib.NewAssert(t)
+	fs := td.NewFS(t)
+	ws, err := NewWorkspace(t.Context(), fs, td.NewFS(t), RemoteRepository("remote"), lib.Path{})
+	assert.NoError(err)
+	other, err := OpenWorkspace(t.Context(), fs, td.NewFS(t))
+	assert.NoError(err)
+
+	unlock, err := ws.Lock(t.Context(), false)
+	assert.NoError(err)
+	_, err = other.Lock(t.Context(), false)
+	assert.ErrorIs(err, ErrWorkspaceLocked)
+	assert.ErrorIs(err, lib.ErrContention)
+
+	// With `wait`, the lock is acquired once it is released.
+	acquired := make(chan error)
+	go func() {
+		unlock, err := other.Lock(t.Context(), true)
+		if err == nil {
+			err = unlock()
+		}
+		acquired <- err
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("the lock was acquired while it was held")
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.NoError(unlock())
+	assert.NoError(<-acquired)
+}